@@ -0,0 +1,66 @@
+package awsinteg
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/apigatewaymanagementapi"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+/*
+NewWebSocketConnectionsClient returns a client that sends messages to the clients connected to an API gateway WebSocket
+API. The endpoint is the callback URL of the API stage, e.g. "https://abcdef1234.execute-api.us-east-1.amazonaws.com/dev".
+*/
+func NewWebSocketConnectionsClient(endpoint string) (*WebSocketConnectionsClient, error) {
+	logger := &lalog.Logger{ComponentName: "apigateway", ComponentID: []lalog.LoggerIDField{{Key: "Endpoint", Value: endpoint}}}
+	regionName := inet.GetAWSRegion()
+	if regionName == "" {
+		return nil, fmt.Errorf("NewWebSocketConnectionsClient: unable to determine AWS region, is it set in environment variable AWS_REGION?")
+	}
+	logger.Info("", nil, "initialising using AWS region name \"%s\"", regionName)
+	apiSession, err := session.NewSession(&aws.Config{Region: aws.String(regionName), Endpoint: aws.String(endpoint)})
+	if err != nil {
+		return nil, err
+	}
+	apiInst := apigatewaymanagementapi.New(apiSession)
+	xray.AWS(apiInst.Client)
+	return &WebSocketConnectionsClient{
+		apiSession: apiSession,
+		client:     apiInst,
+		logger:     logger,
+	}, nil
+}
+
+type WebSocketConnectionsClient struct {
+	logger     *lalog.Logger
+	apiSession *session.Session
+	client     *apigatewaymanagementapi.ApiGatewayManagementApi
+}
+
+// PostToConnection sends a message to the WebSocket client of the connection ID.
+func (wsClient *WebSocketConnectionsClient) PostToConnection(ctx context.Context, connectionID string, data []byte) error {
+	startTimeNano := time.Now().UnixNano()
+	_, err := wsClient.client.PostToConnectionWithContext(ctx, &apigatewaymanagementapi.PostToConnectionInput{
+		ConnectionId: aws.String(connectionID),
+		Data:         data,
+	})
+	durationMilli := (time.Now().UnixNano() - startTimeNano) / 1000000
+	wsClient.logger.Info(connectionID, nil, "PostToConnectionWithContext completed in %d milliseconds for a %d bytes long message (err? %v)",
+		durationMilli, len(data), err)
+	return err
+}
+
+// DeleteConnection disconnects the WebSocket client of the connection ID.
+func (wsClient *WebSocketConnectionsClient) DeleteConnection(ctx context.Context, connectionID string) error {
+	_, err := wsClient.client.DeleteConnectionWithContext(ctx, &apigatewaymanagementapi.DeleteConnectionInput{
+		ConnectionId: aws.String(connectionID),
+	})
+	wsClient.logger.Info(connectionID, nil, "DeleteConnectionWithContext completed (err? %v)", err)
+	return err
+}
@@ -30,6 +30,7 @@ func NewS3Client() (*S3Client, error) {
 	xray.AWS(s3Inst.Client)
 	return &S3Client{
 		apiSession: apiSession,
+		client:     s3Inst,
 		uploader:   s3manager.NewUploaderWithClient(s3Inst),
 		logger:     logger,
 	}, nil
@@ -38,6 +39,7 @@ func NewS3Client() (*S3Client, error) {
 type S3Client struct {
 	logger     *lalog.Logger
 	apiSession *session.Session
+	client     *s3.S3
 	uploader   *s3manager.Uploader
 }
 
@@ -53,3 +55,48 @@ func (s3Client *S3Client) Upload(ctx context.Context, bucketName, objectKey stri
 	s3Client.logger.Info(bucketName, nil, "UploadWithContext completed in %d milliseconds for object \"%s\" (err? %v)", durationMilli, objectKey, err)
 	return err
 }
+
+/*
+UploadEncrypted uploads the object and asks S3 to encrypt it at rest using the KMS key (SSE-KMS). An empty KMS key ID uses
+the AWS managed KMS key of S3.
+*/
+func (s3Client *S3Client) UploadEncrypted(ctx context.Context, bucketName, objectKey, kmsKeyID string, objectValue io.Reader) error {
+	startTimeNano := time.Now().UnixNano()
+	s3Client.logger.Info(bucketName, nil, "uploading encrypted object \"%s\"", objectKey)
+	input := &s3manager.UploadInput{
+		Body:                 objectValue,
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(objectKey),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms),
+	}
+	if kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(kmsKeyID)
+	}
+	_, err := s3Client.uploader.UploadWithContext(ctx, input)
+	durationMilli := (time.Now().UnixNano() - startTimeNano) / 1000000
+	s3Client.logger.Info(bucketName, nil, "UploadWithContext completed in %d milliseconds for encrypted object \"%s\" (err? %v)", durationMilli, objectKey, err)
+	return err
+}
+
+// GetLastModified returns the time the object was last modified, or an error if the object does not exist.
+func (s3Client *S3Client) GetLastModified(ctx context.Context, bucketName, objectKey string) (time.Time, error) {
+	output, err := s3Client.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return aws.TimeValue(output.LastModified), nil
+}
+
+// PresignGetObject returns a URL that downloads the object without further authorisation until the URL expires.
+func (s3Client *S3Client) PresignGetObject(bucketName, objectKey string, expiry time.Duration) (string, error) {
+	req, _ := s3Client.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(objectKey),
+	})
+	url, err := req.Presign(expiry)
+	s3Client.logger.Info(bucketName, nil, "presigned a download URL for object \"%s\" valid for %v (err? %v)", objectKey, expiry, err)
+	return url, err
+}
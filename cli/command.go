@@ -0,0 +1,245 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+/*
+Command is a subcommand of the program (e.g. "serve" in "laitos serve -config c.json"), it has its own set of flags
+that are defined separately from the flags of other subcommands.
+*/
+type Command struct {
+	// Name is the word that selects the command on the command line.
+	Name string
+	// Summary is a one-line description of the command shown in the program usage.
+	Summary string
+	// Synopsis describes the positional arguments of the command, e.g. "encrypt|decrypt FILE".
+	Synopsis string
+	// DefineFlags defines the flags of the command in the flag set.
+	DefineFlags func(flags *flag.FlagSet)
+	// FlagValues are the fixed choices of flag values (by flag name) and positional arguments (by the empty string)
+	// offered by shell completion. A comma-separated list of choices is completed one choice at a time.
+	FlagValues map[string][]string
+	// Run runs the command after the flags are parsed, the flag set carries the remaining positional arguments.
+	Run func(flags *flag.FlagSet)
+}
+
+// NewFlagSet returns a new flag set with the command flags defined.
+func (cmd *Command) NewFlagSet(program string, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	name := program
+	if cmd.Name != "" {
+		name += " " + cmd.Name
+	}
+	flags := flag.NewFlagSet(name, errorHandling)
+	if cmd.DefineFlags != nil {
+		cmd.DefineFlags(flags)
+	}
+	flags.Usage = func() {
+		out := flags.Output()
+		_, _ = fmt.Fprintln(out, strings.TrimSpace(fmt.Sprintf("Usage: %s [flags] %s", name, cmd.Synopsis)))
+		if cmd.Summary != "" {
+			_, _ = fmt.Fprintf(out, "\n%s\n", cmd.Summary)
+		}
+		var hasFlags bool
+		flags.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			_, _ = fmt.Fprintln(out, "\nFlags:")
+			flags.PrintDefaults()
+		}
+	}
+	return flags
+}
+
+/*
+CommandSet is a small command framework that dispatches program arguments to one of its subcommands. For backward
+compatibility, the arguments that do not begin with a subcommand name are handled by the legacy command, which
+understands the flat set of program flags used prior to the introduction of subcommands.
+*/
+type CommandSet struct {
+	// Program is the name of the executable, e.g. "laitos".
+	Program string
+	// Commands are the subcommands in the order they appear in the program usage.
+	Commands []*Command
+	// Legacy handles the arguments that do not begin with a subcommand name.
+	Legacy *Command
+}
+
+// Find returns the subcommand of the name, or nil if there is no such subcommand.
+func (set *CommandSet) Find(name string) *Command {
+	for _, cmd := range set.Commands {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+/*
+Parse determines the subcommand from the program arguments (which must not include the executable path), and parses
+the remaining arguments into the flags of the subcommand.
+*/
+func (set *CommandSet) Parse(args []string, errorHandling flag.ErrorHandling) (*Command, *flag.FlagSet, error) {
+	cmd := set.Legacy
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if cmd = set.Find(args[0]); cmd == nil {
+			return nil, nil, fmt.Errorf("unknown command \"%s\", run \"%s -h\" to list the commands", args[0], set.Program)
+		}
+		args = args[1:]
+	}
+	flags := cmd.NewFlagSet(set.Program, errorHandling)
+	if cmd == set.Legacy {
+		// The usage of the program lists the subcommands ahead of the legacy flags
+		legacyUsage := flags.Usage
+		flags.Usage = func() {
+			set.PrintUsage(flags.Output())
+			_, _ = fmt.Fprintf(flags.Output(), "\nAlternatively, run %s without a command using the following flags.\n", set.Program)
+			legacyUsage()
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	return cmd, flags, nil
+}
+
+// Run parses the program arguments (which must not include the executable path) and runs the subcommand.
+func (set *CommandSet) Run(args []string) {
+	cmd, flags, err := set.Parse(args, flag.ExitOnError)
+	if err != nil {
+		set.PrintUsage(os.Stderr)
+		_, _ = fmt.Fprintln(os.Stderr, "\n"+err.Error())
+		os.Exit(2)
+	}
+	cmd.Run(flags)
+}
+
+// PrintUsage writes the list of subcommands and their summaries.
+func (set *CommandSet) PrintUsage(out io.Writer) {
+	_, _ = fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", set.Program)
+	for _, cmd := range set.Commands {
+		_, _ = fmt.Fprintf(out, "  %-12s %s\n", cmd.Name, cmd.Summary)
+	}
+	_, _ = fmt.Fprintf(out, "\nRun \"%s <command> -h\" for the flags of a command.\n", set.Program)
+}
+
+// commandFlag is a flag of a subcommand, as seen by shell completion.
+type commandFlag struct {
+	name, usage string
+	isBool      bool
+	values      []string
+}
+
+// completionFlags returns the flags of the command sorted by name.
+func (set *CommandSet) completionFlags(cmd *Command) []commandFlag {
+	ret := make([]commandFlag, 0)
+	cmd.NewFlagSet(set.Program, flag.ContinueOnError).VisitAll(func(f *flag.Flag) {
+		boolFlag, isBool := f.Value.(interface{ IsBoolFlag() bool })
+		ret = append(ret, commandFlag{
+			name:   f.Name,
+			usage:  f.Usage,
+			isBool: isBool && boolFlag.IsBoolFlag(),
+			values: cmd.FlagValues[f.Name],
+		})
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].name < ret[j].name
+	})
+	return ret
+}
+
+// completionFuncName returns the name of the shell function that completes the program.
+func (set *CommandSet) completionFuncName() string {
+	return "_" + strings.NewReplacer("-", "_", ".", "_").Replace(set.Program)
+}
+
+/*
+WriteBashCompletion writes a bash completion script for the program, which completes the subcommand names, their flag
+names, and the fixed choices of flag values. Other flag values fall back to file name completion.
+*/
+func (set *CommandSet) WriteBashCompletion(out io.Writer) {
+	funcName := set.completionFuncName()
+	names := make([]string, 0, len(set.Commands))
+	for _, cmd := range set.Commands {
+		names = append(names, cmd.Name)
+	}
+	_, _ = fmt.Fprintf(out, `# bash completion for %[1]s, install it by running: source <(%[1]s completion bash)
+%[2]s_words() {
+    local prefix=""
+    if [[ "$cur" == *,* ]]; then
+        prefix="${cur%%,*},"
+    fi
+    COMPREPLY=($(compgen -P "$prefix" -W "$1" -- "${cur##*,}"))
+}
+%[2]s() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+    COMPREPLY=()
+    if [ "$COMP_CWORD" -eq 1 ]; then
+        COMPREPLY=($(compgen -W "%[3]s" -- "$cur"))
+        return
+    fi
+    case "${COMP_WORDS[1]}" in
+`, set.Program, funcName, strings.Join(names, " "))
+	for _, cmd := range set.Commands {
+		flags := set.completionFlags(cmd)
+		_, _ = fmt.Fprintf(out, "    %s)\n        case \"$prev\" in\n", cmd.Name)
+		flagNames := make([]string, 0, len(flags))
+		valueFlags := make([]string, 0)
+		for _, f := range flags {
+			flagNames = append(flagNames, "-"+f.name)
+			if len(f.values) > 0 {
+				_, _ = fmt.Fprintf(out, "        -%s | --%s) %s_words \"%s\"; return ;;\n", f.name, f.name, funcName, strings.Join(f.values, " "))
+			} else if !f.isBool {
+				valueFlags = append(valueFlags, "-"+f.name+" | --"+f.name)
+			}
+		}
+		if len(valueFlags) > 0 {
+			// Leave the reply empty to fall back to file name completion
+			_, _ = fmt.Fprintf(out, "        %s) return ;;\n", strings.Join(valueFlags, " | "))
+		}
+		_, _ = fmt.Fprint(out, "        esac\n")
+		if positional := cmd.FlagValues[""]; len(positional) > 0 {
+			_, _ = fmt.Fprintf(out, "        if [[ \"$cur\" != -* ]]; then %s_words \"%s\"; return; fi\n", funcName, strings.Join(positional, " "))
+		}
+		_, _ = fmt.Fprintf(out, "        COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n", strings.Join(flagNames, " "))
+	}
+	_, _ = fmt.Fprintf(out, "    esac\n}\ncomplete -o default -F %s %s\n", funcName, set.Program)
+}
+
+// zshEscape escapes the text for use in a single-quoted zsh _arguments specification.
+func zshEscape(text string) string {
+	return strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(text)
+}
+
+// WriteZshCompletion writes a zsh completion script for the program, which offers the same completion as bash.
+func (set *CommandSet) WriteZshCompletion(out io.Writer) {
+	funcName := set.completionFuncName()
+	_, _ = fmt.Fprintf(out, "#compdef %[1]s\n# zsh completion for %[1]s, install it by running: source <(%[1]s completion zsh)\n%[2]s() {\n    local -a commands\n    commands=(\n", set.Program, funcName)
+	for _, cmd := range set.Commands {
+		_, _ = fmt.Fprintf(out, "        '%s:%s'\n", cmd.Name, zshEscape(cmd.Summary))
+	}
+	_, _ = fmt.Fprint(out, "    )\n    if (( CURRENT == 2 )); then\n        _describe 'command' commands\n        return\n    fi\n    local command=$words[2]\n    shift words\n    (( CURRENT-- ))\n    case $command in\n")
+	for _, cmd := range set.Commands {
+		_, _ = fmt.Fprintf(out, "    %s)\n        _arguments -S", cmd.Name)
+		for _, f := range set.completionFlags(cmd) {
+			spec := "-" + f.name + "[" + zshEscape(f.usage) + "]"
+			if len(f.values) > 0 {
+				spec += ":" + f.name + ":_sequence compadd - " + strings.Join(f.values, " ")
+			} else if !f.isBool {
+				spec += ":" + f.name + ":_files"
+			}
+			_, _ = fmt.Fprintf(out, " \\\n            '%s'", spec)
+		}
+		if positional := cmd.FlagValues[""]; len(positional) > 0 {
+			_, _ = fmt.Fprintf(out, " \\\n            '*:argument:(%s)'", strings.Join(positional, " "))
+		} else if cmd.Synopsis != "" {
+			_, _ = fmt.Fprint(out, " \\\n            '*:argument:_files'")
+		}
+		_, _ = fmt.Fprint(out, " ;;\n")
+	}
+	_, _ = fmt.Fprintf(out, "    esac\n}\ncompdef %s %s\n", funcName, set.Program)
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+func TestCommandSet(t *testing.T) {
+	var port int
+	var verbose bool
+	set := &CommandSet{
+		Program: "laitos",
+		Commands: []*Command{
+			{
+				Name:    "serve",
+				Summary: "serve it",
+				DefineFlags: func(flags *flag.FlagSet) {
+					flags.IntVar(&port, "port", 80, "port number")
+					flags.BoolVar(&verbose, "verbose", false, "verbose: [yes] or no")
+				},
+				FlagValues: map[string][]string{"port": {"80", "443"}},
+			},
+			{Name: "completion", Synopsis: "bash|zsh", FlagValues: map[string][]string{"": {"bash", "zsh"}}},
+		},
+		Legacy: &Command{
+			DefineFlags: func(flags *flag.FlagSet) {
+				flags.IntVar(&port, "serveport", 80, "port number")
+			},
+		},
+	}
+	cmd, flags, err := set.Parse([]string{"serve", "-port", "443", "-verbose", "extra"}, flag.ContinueOnError)
+	if err != nil || cmd.Name != "serve" || port != 443 || !verbose || flags.Arg(0) != "extra" {
+		t.Fatal(err, cmd, port, verbose)
+	}
+	cmd, _, err = set.Parse([]string{"-serveport", "8080"}, flag.ContinueOnError)
+	if err != nil || cmd != set.Legacy || port != 8080 {
+		t.Fatal(err, cmd, port)
+	}
+	if _, _, err := set.Parse([]string{"bogus"}, flag.ContinueOnError); err == nil {
+		t.Fatal("did not reject unknown command")
+	}
+	if _, _, err := set.Parse([]string{"serve", "-serveport", "1"}, flag.ContinueOnError); err == nil {
+		t.Fatal("did not reject legacy flag given to subcommand")
+	}
+
+	var bash, zsh bytes.Buffer
+	set.WriteBashCompletion(&bash)
+	for _, want := range []string{`compgen -W "serve completion"`, `-port | --port) _laitos_words "80 443"`, `"-port -verbose"`, `_laitos_words "bash zsh"`, "complete -o default -F _laitos laitos"} {
+		if !strings.Contains(bash.String(), want) {
+			t.Fatal(want, bash.String())
+		}
+	}
+	set.WriteZshCompletion(&zsh)
+	for _, want := range []string{"#compdef laitos", "'serve:serve it'", `'-port[port number]:port:_sequence compadd - 80 443'`, `'-verbose[verbose\: \[yes\] or no]'`, "'*:argument:(bash zsh)'"} {
+		if !strings.Contains(zsh.String(), want) {
+			t.Fatal(want, zsh.String())
+		}
+	}
+}
+
+func TestRunConsole(t *testing.T) {
+	var out bytes.Buffer
+	in := strings.NewReader(toolbox.TestCommandProcessorPIN + ".s echo hi\n\nwrong\n")
+	if err := RunConsole(context.Background(), toolbox.GetTestCommandProcessor(), in, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) != 4 || lines[0] != "> hi" || lines[1] != "> > "+toolbox.ErrPINAndShortcutNotFound.Error() || lines[2] != "> " {
+		t.Fatalf("%q", lines)
+	}
+}
@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// ConsoleCommandTimeoutSec is the timeout of each app command entered on the console.
+const ConsoleCommandTimeoutSec = 120
+
+/*
+RunConsole reads app commands line by line from the input, and writes their results to the output, until the input
+is exhausted. The commands go through the command processor's filters (e.g. PIN and shortcuts) just like the commands
+sent to laitos daemons.
+*/
+func RunConsole(ctx context.Context, processor *toolbox.CommandProcessor, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	_, _ = fmt.Fprint(out, "> ")
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			result := processor.Process(ctx, toolbox.Command{
+				DaemonName: "console",
+				ClientTag:  "stdin",
+				Content:    line,
+				TimeoutSec: ConsoleCommandTimeoutSec,
+			}, true)
+			_, _ = fmt.Fprintln(out, result.CombinedOutput)
+		}
+		_, _ = fmt.Fprint(out, "> ")
+	}
+	_, _ = fmt.Fprintln(out)
+	return scanner.Err()
+}
@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+/*
+AttestProgramIntegrity verifies the files recorded in the signed integrity manifest before the program starts. A
+failed verification is logged as a warning, and if enforce is true, the program refuses to start.
+*/
+func AttestProgramIntegrity(logger *lalog.Logger, manifestPath, pubKey string, enforce bool) {
+	if manifestPath == "" {
+		if enforce {
+			logger.Abort(nil, nil, "the integrity manifest (-integritymanifest) must be provided to enforce program integrity")
+		}
+		return
+	}
+	err := verifyIntegrityManifest(logger, manifestPath, pubKey)
+	if err == nil {
+		return
+	}
+	if enforce {
+		logger.Abort(manifestPath, err, "refuse to start because program integrity cannot be verified")
+		return
+	}
+	logger.Warning(manifestPath, err, "program integrity cannot be verified, the program starts anyway")
+}
+
+// verifyIntegrityManifest verifies the manifest signature and the files recorded in it, and logs each file that does not match.
+func verifyIntegrityManifest(logger *lalog.Logger, manifestPath, pubKeyStr string) error {
+	if pubKeyStr == "" {
+		return errors.New("the public key (-integritypubkey) of the manifest signature must be provided")
+	}
+	pubKey, err := misc.ParseIntegrityPublicKey(pubKeyStr)
+	if err != nil {
+		return err
+	}
+	manifest, err := misc.ReadIntegrityManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	mismatches, err := manifest.Verify(pubKey)
+	for _, mismatch := range mismatches {
+		logger.Warning(mismatch, nil, "the file does not match the integrity manifest")
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info(manifestPath, nil, "successfully verified the integrity of %d files signed at %s", len(manifest.Files), manifest.SignedAt)
+	return nil
+}
+
+/*
+HandleIntegrityUtil is a distinct routine of laitos main program, it generates the key pair for signing integrity
+manifests, signs a manifest, or verifies a manifest.
+*/
+func HandleIntegrityUtil(logger *lalog.Logger, args []string) error {
+	if len(args) == 0 {
+		return errors.New("please provide the mode of operation (keygen|sign|verify)")
+	}
+	switch args[0] {
+	case "keygen":
+		if len(args) != 2 {
+			return errors.New("usage: keygen PRIVATE_KEY_FILE")
+		}
+		privKeyPEM, pubKey, err := misc.GenerateIntegrityKey()
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(args[1], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if _, err := file.Write(privKeyPEM); err != nil {
+			return err
+		}
+		fmt.Printf("The private key is saved in %s, keep it away from the servers.\nThe public key (-integritypubkey) is: %s\n", args[1], pubKey)
+	case "sign":
+		if len(args) < 4 {
+			return errors.New("usage: sign PRIVATE_KEY_FILE MANIFEST_FILE FILE...")
+		}
+		privKeyPEM, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		privKey, err := misc.ParseIntegrityPrivateKey(privKeyPEM)
+		if err != nil {
+			return err
+		}
+		manifest, err := misc.SignIntegrityManifest(privKey, args[3:]...)
+		if err != nil {
+			return err
+		}
+		if err := misc.WriteIntegrityManifest(args[2], manifest); err != nil {
+			return err
+		}
+		logger.Info(args[2], nil, "signed the integrity manifest of %s", strings.Join(args[3:], ", "))
+	case "verify":
+		if len(args) != 3 {
+			return errors.New("usage: verify PUBLIC_KEY MANIFEST_FILE")
+		}
+		return verifyIntegrityManifest(logger, args[2], args[1])
+	default:
+		return fmt.Errorf("unknown mode of operation \"%s\", use keygen|sign|verify", args[0])
+	}
+	return nil
+}
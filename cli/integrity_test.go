@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleIntegrityUtil(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key.pem")
+	manifestPath := filepath.Join(dir, "manifest.json")
+	configPath := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(configPath, []byte("{}"), 0600))
+
+	require.Error(t, HandleIntegrityUtil(lalog.DefaultLogger, nil))
+	require.Error(t, HandleIntegrityUtil(lalog.DefaultLogger, []string{"keygen"}))
+	require.NoError(t, HandleIntegrityUtil(lalog.DefaultLogger, []string{"keygen", keyPath}))
+	// An existing key is never overwritten
+	require.Error(t, HandleIntegrityUtil(lalog.DefaultLogger, []string{"keygen", keyPath}))
+	require.NoError(t, HandleIntegrityUtil(lalog.DefaultLogger, []string{"sign", keyPath, manifestPath, configPath}))
+
+	privKeyPEM, err := os.ReadFile(keyPath)
+	require.NoError(t, err)
+	privKey, err := misc.ParseIntegrityPrivateKey(privKeyPEM)
+	require.NoError(t, err)
+	pubKeyStr := base64.StdEncoding.EncodeToString(privKey.Public().(ed25519.PublicKey))
+	require.NoError(t, HandleIntegrityUtil(lalog.DefaultLogger, []string{"verify", pubKeyStr, manifestPath}))
+	_, otherPubKeyStr, err := misc.GenerateIntegrityKey()
+	require.NoError(t, err)
+	require.ErrorContains(t, HandleIntegrityUtil(lalog.DefaultLogger, []string{"verify", otherPubKeyStr, manifestPath}), "signature is invalid")
+
+	// The program starts anyway when the integrity is not enforced
+	require.NoError(t, os.WriteFile(configPath, []byte("{\"tampered\": true}"), 0600))
+	require.ErrorIs(t, verifyIntegrityManifest(lalog.DefaultLogger, manifestPath, pubKeyStr), misc.ErrIntegrityMismatch)
+	AttestProgramIntegrity(lalog.DefaultLogger, manifestPath, pubKeyStr, false)
+	AttestProgramIntegrity(lalog.DefaultLogger, "", "", false)
+}
@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/daemon/sockd"
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+/*
+KnockSockd reads the sockd password from the input (the first line) and sends a signed knock packet to the knock port of
+the sockd server (e.g. "example.com:12345"), so that the server lets the client IP use its proxy ports. If the client IP
+is empty, it is this computer's IP as seen by the server - the local IP for a server in the private network, or
+otherwise the public IP.
+*/
+func KnockSockd(input io.Reader, serverAddr, clientIP string) error {
+	if _, _, err := net.SplitHostPort(serverAddr); err != nil {
+		return fmt.Errorf("KnockSockd: the server address must be in the form of host:port - %w", err)
+	}
+	password, err := bufio.NewReader(input).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("KnockSockd: failed to read password - %w", err)
+	}
+	password = strings.TrimSpace(password)
+	if password == "" {
+		return errors.New("KnockSockd: password must not be empty")
+	}
+	var ip net.IP
+	if clientIP == "" {
+		if ip, err = getKnockClientIP(serverAddr); err != nil {
+			return err
+		}
+	} else if ip = net.ParseIP(clientIP); ip == nil {
+		return fmt.Errorf("KnockSockd: %q is not a valid IP address", clientIP)
+	}
+	return sockd.Knock(serverAddr, password, ip)
+}
+
+// getKnockClientIP returns this computer's IP as seen by the sockd server.
+func getKnockClientIP(serverAddr string) (net.IP, error) {
+	conn, err := net.Dial("udp", serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("KnockSockd: %w", err)
+	}
+	defer conn.Close()
+	// The server in the private network sees the local IP of this computer
+	if serverIP := conn.RemoteAddr().(*net.UDPAddr).IP; serverIP.IsLoopback() || serverIP.IsPrivate() || serverIP.IsLinkLocalUnicast() {
+		return conn.LocalAddr().(*net.UDPAddr).IP, nil
+	}
+	if publicIP := inet.GetPublicIP(); publicIP != nil && !publicIP.IsUnspecified() {
+		return publicIP, nil
+	}
+	return nil, errors.New("KnockSockd: failed to determine the public IP of this computer, please specify the client IP")
+}
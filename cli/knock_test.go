@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/sockd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKnockSockd(t *testing.T) {
+	require.Error(t, KnockSockd(strings.NewReader("abcdefg\n"), "no-port", ""))
+	require.Error(t, KnockSockd(strings.NewReader("\n"), "127.0.0.1:1", ""))
+	require.Error(t, KnockSockd(strings.NewReader("abcdefg\n"), "127.0.0.1:1", "not-an-ip"))
+
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer listener.Close()
+	// The client IP of a server in the private network is the local IP
+	require.NoError(t, KnockSockd(strings.NewReader("abcdefg\n"), listener.LocalAddr().String(), ""))
+	require.NoError(t, listener.SetReadDeadline(time.Now().Add(5*time.Second)))
+	packet := make([]byte, 1500)
+	n, _, err := listener.ReadFromUDP(packet)
+	require.NoError(t, err)
+	// The knock gate accepts the packet signed by the same password
+	gate := &sockd.KnockGate{Password: "abcdefg", UDPPort: 1}
+	require.NoError(t, gate.Initialise())
+	require.ErrorIs(t, gate.Verify("127.0.0.2", packet[:n], time.Now()), sockd.ErrKnockRejected)
+	require.NoError(t, gate.Verify("127.0.0.1", packet[:n], time.Now()))
+	require.True(t, gate.IsAllowed("127.0.0.1"))
+
+	// The knock opens the gate to the specified client IP
+	require.NoError(t, KnockSockd(strings.NewReader("abcdefg\n"), listener.LocalAddr().String(), "192.0.2.1"))
+	n, _, err = listener.ReadFromUDP(packet)
+	require.NoError(t, err)
+	require.NoError(t, gate.Verify("192.0.2.1", packet[:n], time.Now()))
+}
@@ -52,7 +52,7 @@ log entry to AWS SQS.
 This behaviour is enabled optionally by specifying the queue URL in environment variable LAITOS_SEND_WARNING_LOG_TO_SQS_URL.
 */
 func InstallOptionalLoggerSQSCallback(logger *lalog.Logger, sqsURL string) {
-	if misc.EnableAWSIntegration && sqsURL != "" {
+	if misc.AWSIntegration.IsEnabled() && sqsURL != "" {
 		logger.Info(nil, nil, "installing callback for sending logger warning messages to SQS")
 		loggerSQSClientInitOnce.Do(func() {
 			sqsClient, err := awsinteg.NewSQSClient()
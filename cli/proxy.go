@@ -43,6 +43,15 @@ type ProxyCLIOptions struct {
 	// length must be identical. If TXT is used as carrier then the downstream
 	// length can be up to ~5 times the upstream length.
 	DownstreamSegmentLength int
+	// Carrier is the name of the carrier that transports segments to laitos
+	// server, e.g. "dns" (default), "https", or "icmp".
+	Carrier string
+	// CarrierAddress is the address of laitos server used by carriers other
+	// than DNS, e.g. the URL of HTTPS carrier, or the IP of ICMP carrier.
+	CarrierAddress string
+	// Multiplex transports all proxy connections as streams of a single
+	// transmission control.
+	Multiplex bool
 }
 
 func HandleTCPOverDNSClient(logger *lalog.Logger, proxyOpts ProxyCLIOptions) {
@@ -81,6 +90,8 @@ func HandleTCPOverDNSClient(logger *lalog.Logger, proxyOpts ProxyCLIOptions) {
 				Debug:            proxyOpts.Debug,
 				DNSResolver:      proxyOpts.RecursiveResolverAddress,
 				DNSHostName:      proxyOpts.LaitosDNSName,
+				Carrier:          proxyOpts.Carrier,
+				CarrierAddress:   proxyOpts.CarrierAddress,
 				RequestOTPSecret: proxyOpts.AccessOTPSecret,
 				// The port of laitos recursive DNS resolver is hard coded to 53
 				// for now.
@@ -129,7 +140,10 @@ func HandleTCPOverDNSClient(logger *lalog.Logger, proxyOpts ProxyCLIOptions) {
 		Debug:            proxyOpts.Debug,
 		DNSResolver:      proxyOpts.RecursiveResolverAddress,
 		DNSHostName:      proxyOpts.LaitosDNSName,
+		Carrier:          proxyOpts.Carrier,
+		CarrierAddress:   proxyOpts.CarrierAddress,
 		RequestOTPSecret: proxyOpts.AccessOTPSecret,
+		Multiplex:        proxyOpts.Multiplex,
 	}
 	logger.Info(nil, nil, "starting an HTTP (TLS capable) proxy server on %s:%d to relay traffic via TCP-over-DNS to %s", httpProxyServer.Address, httpProxyServer.Port, httpProxyServer.DNSHostName)
 	if err := httpProxyServer.Initialise(context.Background()); err != nil {
@@ -3,6 +3,7 @@ package cli
 import (
 	"bufio"
 	"context"
+	"errors"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -29,7 +30,9 @@ func AutoRestart(logger *lalog.Logger, logActorName string, fun func() error) {
 			logger.Warning(logActorName, nil, "emergency lock-down has been activated, no further restart is performed.")
 			return
 		}
+		misc.DaemonStarted(logActorName)
 		err := fun()
+		misc.DaemonStopped(logActorName, err)
 		if err == nil {
 			logger.Info(logActorName, nil, "the function has returned successfully, no further restart is required.")
 			return
@@ -141,8 +144,40 @@ func GetConfig(logger *lalog.Logger, pwdServer bool, pwdServerPort int, pwdServe
 	return configBytes
 }
 
-// HandleDaemonSignals ignores signals irrelevant to daemon operation.
-func HandleDaemonSignals() {
+/*
+RereadConfig returns the latest laitos program configuration content (JSON) in order to reload the configuration.
+Unlike GetConfig, it does not ask for the decryption password of an encrypted configuration file, instead it uses the
+password obtained when the program started.
+*/
+func RereadConfig() ([]byte, error) {
+	if configBytes := []byte(strings.TrimSpace(os.Getenv("LAITOS_CONFIG"))); len(configBytes) > 0 {
+		return configBytes, nil
+	}
+	if misc.ConfigFilePath == "" {
+		return nil, errors.New("configuration file path is unknown")
+	}
+	contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, misc.ConfigFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return contents[0], nil
+}
+
+/*
+HandleDaemonSignals ignores signals irrelevant to daemon operation. The reload function is called upon receiving SIGHUP,
+if the function is nil then SIGHUP is ignored as well.
+*/
+func HandleDaemonSignals(reload func()) {
 	signal.Ignore(syscall.SIGPIPE)
-	signal.Ignore(syscall.SIGHUP)
+	if reload == nil {
+		signal.Ignore(syscall.SIGHUP)
+		return
+	}
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			reload()
+		}
+	}()
 }
@@ -3,6 +3,9 @@ package cli
 import (
 	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 	"testing"
 	"time"
 
@@ -68,5 +71,22 @@ func TestAutoRestartDuringLockDown(t *testing.T) {
 }
 
 func TestHandleDaemonSignals(t *testing.T) {
-	HandleDaemonSignals()
+	HandleDaemonSignals(nil)
+	reloaded := make(chan struct{}, 1)
+	HandleDaemonSignals(func() {
+		reloaded <- struct{}{}
+	})
+	defer signal.Reset(syscall.SIGHUP)
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := self.Signal(syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGHUP did not trigger the reload")
+	}
 }
@@ -71,7 +71,7 @@ func DisableConflicts(logger *lalog.Logger) {
 // returns an empty string.
 func GAEDaemonList(logger *lalog.Logger) string {
 	if os.Getenv("GAE_ENV") == "standard" {
-		misc.EnablePrometheusIntegration = true
+		misc.PrometheusIntegration.Set(true)
 		// Change working directory to the data directory (if not done yet).
 		// All program config files and data files are expected to reside in the data directory.
 		cwd, err := os.Getwd()
@@ -47,6 +47,7 @@ export interface DaemonStatsDisplay extends StatsDisplayValue {
 
 export interface ProgramStats {
   AutoUnlock?: StatsDisplayValue;
+  Commands?: StatsDisplayValue;
   DNSOverTCP?: StatsDisplayValue;
   DNSOverUDP?: StatsDisplayValue;
   HTTP?: StatsDisplayValue;
@@ -56,9 +57,13 @@ export interface ProgramStats {
   PlainSocketUDP?: StatsDisplayValue;
   SimpleIPServiceTCP?: StatsDisplayValue;
   SimpleIPServiceUDP?: StatsDisplayValue;
+  SerialDevices?: StatsDisplayValue;
   SMTP?: StatsDisplayValue;
+  SNMP?: StatsDisplayValue;
+  SSH?: StatsDisplayValue;
   SockdTCP?: StatsDisplayValue;
   SockdUDP?: StatsDisplayValue;
+  SockdKnock?: StatsDisplayValue;
   TelegramBot?: StatsDisplayValue;
   OutgoingMailBytes?: number;
 }
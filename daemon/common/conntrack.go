@@ -0,0 +1,229 @@
+package common
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// DefaultConnTrackMaxIPs is the default maximum number of client IPs whose connection metadata is remembered.
+	DefaultConnTrackMaxIPs = 2000
+	// DefaultConnTrackFailureWindowSec is the default interval in which handshake failures are counted towards a ban.
+	DefaultConnTrackFailureWindowSec = 10 * 60
+	// DefaultConnTrackBanFailures is the default number of handshake failures within the window that get a client IP banned.
+	DefaultConnTrackBanFailures = 20
+	// DefaultConnTrackBanSec is the default duration of a ban.
+	DefaultConnTrackBanSec = 60 * 60
+)
+
+// TCPConnections tracks the client connections of all TCP daemons (plain socket, smtpd, sockd, sshd, and simple IP services).
+var TCPConnections = NewConnectionTracker()
+
+// ConnectionRecord is the connection metadata of a single client IP.
+type ConnectionRecord struct {
+	IP string
+	// Connections is the number of connections made by the client, keyed by daemon name.
+	Connections map[string]int64
+	// HandshakeFailures is the number of failed handshakes (e.g. incorrect password or malformed greeting), keyed by daemon name.
+	HandshakeFailures map[string]int64
+	// BytesIn is the number of bytes received from the client.
+	BytesIn int64
+	// BytesOut is the number of bytes sent to the client.
+	BytesOut  int64
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// BannedUntil is the time at which the ban expires, it is zero if the client IP has never been banned.
+	BannedUntil time.Time
+
+	recentFailures []time.Time
+}
+
+// TotalConnections returns the number of connections made by the client to all daemons.
+func (rec ConnectionRecord) TotalConnections() (total int64) {
+	for _, count := range rec.Connections {
+		total += count
+	}
+	return
+}
+
+// TotalHandshakeFailures returns the number of handshake failures of the client among all daemons.
+func (rec ConnectionRecord) TotalHandshakeFailures() (total int64) {
+	for _, count := range rec.HandshakeFailures {
+		total += count
+	}
+	return
+}
+
+/*
+ConnectionTracker records the connection count, handshake failures, and bytes moved of each client IP among TCP daemons,
+so that abusive clients can be identified in one place instead of in the logs of each daemon. A client IP that fails
+too many handshakes in a short while is banned from connecting to all TCP daemons for a while.
+*/
+type ConnectionTracker struct {
+	// MaxIPs is the maximum number of client IPs to remember, the client IP seen least recently is forgotten first.
+	MaxIPs int
+	// FailureWindowSec is the interval in which handshake failures are counted towards a ban.
+	FailureWindowSec int
+	// BanFailures is the number of handshake failures within the window that get a client IP banned.
+	BanFailures int
+	// BanSec is the duration of a ban.
+	BanSec int
+
+	records map[string]*ConnectionRecord
+	mutex   *sync.Mutex
+	logger  *lalog.Logger
+}
+
+// NewConnectionTracker returns an initialised connection tracker with default limits.
+func NewConnectionTracker() *ConnectionTracker {
+	return &ConnectionTracker{
+		MaxIPs:           DefaultConnTrackMaxIPs,
+		FailureWindowSec: DefaultConnTrackFailureWindowSec,
+		BanFailures:      DefaultConnTrackBanFailures,
+		BanSec:           DefaultConnTrackBanSec,
+		records:          make(map[string]*ConnectionRecord),
+		mutex:            new(sync.Mutex),
+		logger:           &lalog.Logger{ComponentName: "ConnectionTracker"},
+	}
+}
+
+// getRecord returns the record of the client IP, creating one if necessary. The caller must hold the mutex.
+func (tracker *ConnectionTracker) getRecord(ip string, now time.Time) *ConnectionRecord {
+	rec, exists := tracker.records[ip]
+	if !exists {
+		if len(tracker.records) >= tracker.MaxIPs {
+			tracker.evictOldest(now)
+		}
+		rec = &ConnectionRecord{
+			IP:                ip,
+			Connections:       make(map[string]int64),
+			HandshakeFailures: make(map[string]int64),
+			FirstSeen:         now,
+		}
+		tracker.records[ip] = rec
+	}
+	rec.LastSeen = now
+	return rec
+}
+
+// evictOldest forgets the client IP seen least recently, while keeping those that are still banned. The caller must hold the mutex.
+func (tracker *ConnectionTracker) evictOldest(now time.Time) {
+	var oldestIP string
+	var oldest time.Time
+	for ip, rec := range tracker.records {
+		if now.Before(rec.BannedUntil) {
+			continue
+		}
+		if oldestIP == "" || rec.LastSeen.Before(oldest) {
+			oldestIP = ip
+			oldest = rec.LastSeen
+		}
+	}
+	if oldestIP != "" {
+		delete(tracker.records, oldestIP)
+	}
+}
+
+// RecordConnection increases the connection counter of the client IP for the daemon.
+func (tracker *ConnectionTracker) RecordConnection(daemonName, ip string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.getRecord(ip, time.Now()).Connections[daemonName]++
+}
+
+// AddBytes adds to the number of bytes received from and sent to the client IP.
+func (tracker *ConnectionTracker) AddBytes(ip string, bytesIn, bytesOut int64) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	rec := tracker.getRecord(ip, time.Now())
+	rec.BytesIn += bytesIn
+	rec.BytesOut += bytesOut
+}
+
+/*
+RecordHandshakeFailure increases the handshake failure counter of the client IP for the daemon, and bans the client IP
+if it has failed too many handshakes among all daemons within the window. Loopback addresses are never banned.
+*/
+func (tracker *ConnectionTracker) RecordHandshakeFailure(daemonName, ip, reason string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	now := time.Now()
+	rec := tracker.getRecord(ip, now)
+	rec.HandshakeFailures[daemonName]++
+	// Only keep the failures that occurred within the window
+	windowStart := now.Add(-time.Duration(tracker.FailureWindowSec) * time.Second)
+	recent := rec.recentFailures[:0]
+	for _, failedAt := range rec.recentFailures {
+		if failedAt.After(windowStart) {
+			recent = append(recent, failedAt)
+		}
+	}
+	rec.recentFailures = append(recent, now)
+	tracker.logger.Info(ip, nil, "%s handshake failure (%d in the past %d seconds) - %s", daemonName, len(rec.recentFailures), tracker.FailureWindowSec, reason)
+	if len(rec.recentFailures) >= tracker.BanFailures && !now.Before(rec.BannedUntil) {
+		if parsedIP := net.ParseIP(ip); parsedIP != nil && parsedIP.IsLoopback() {
+			return
+		}
+		rec.BannedUntil = now.Add(time.Duration(tracker.BanSec) * time.Second)
+		rec.recentFailures = nil
+		tracker.logger.Warning(ip, nil, "banned from all TCP daemons for %d seconds after %d handshake failures", tracker.BanSec, tracker.BanFailures)
+	}
+}
+
+// IsBanned returns true only if the client IP is currently banned.
+func (tracker *ConnectionTracker) IsBanned(ip string) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	rec, exists := tracker.records[ip]
+	return exists && time.Now().Before(rec.BannedUntil)
+}
+
+// Unban lifts the ban on the client IP and clears its recent handshake failures. It returns false if the IP was not banned.
+func (tracker *ConnectionTracker) Unban(ip string) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	rec, exists := tracker.records[ip]
+	if !exists || !time.Now().Before(rec.BannedUntil) {
+		return false
+	}
+	rec.BannedUntil = time.Time{}
+	rec.recentFailures = nil
+	tracker.logger.Info(ip, nil, "ban has been lifted")
+	return true
+}
+
+// GetRecords returns a copy of all records, sorted by total handshake failures and then total connections, both in descending order.
+func (tracker *ConnectionTracker) GetRecords() []ConnectionRecord {
+	tracker.mutex.Lock()
+	ret := make([]ConnectionRecord, 0, len(tracker.records))
+	for _, rec := range tracker.records {
+		recCopy := *rec
+		recCopy.Connections = make(map[string]int64, len(rec.Connections))
+		for name, count := range rec.Connections {
+			recCopy.Connections[name] = count
+		}
+		recCopy.HandshakeFailures = make(map[string]int64, len(rec.HandshakeFailures))
+		for name, count := range rec.HandshakeFailures {
+			recCopy.HandshakeFailures[name] = count
+		}
+		recCopy.recentFailures = nil
+		ret = append(ret, recCopy)
+	}
+	tracker.mutex.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		failuresI, failuresJ := ret[i].TotalHandshakeFailures(), ret[j].TotalHandshakeFailures()
+		if failuresI != failuresJ {
+			return failuresI > failuresJ
+		}
+		connsI, connsJ := ret[i].TotalConnections(), ret[j].TotalConnections()
+		if connsI != connsJ {
+			return connsI > connsJ
+		}
+		return ret[i].IP < ret[j].IP
+	})
+	return ret
+}
@@ -0,0 +1,123 @@
+package common
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+func TestConnectionTracker(t *testing.T) {
+	tracker := NewConnectionTracker()
+	tracker.MaxIPs = 3
+	tracker.BanFailures = 3
+
+	tracker.RecordConnection("smtpd", "1.1.1.1")
+	tracker.RecordConnection("sockd", "1.1.1.1")
+	tracker.AddBytes("1.1.1.1", 10, 20)
+	tracker.AddBytes("1.1.1.1", 1, 2)
+	tracker.RecordConnection("smtpd", "2.2.2.2")
+	tracker.RecordHandshakeFailure("smtpd", "2.2.2.2", "test")
+	recs := tracker.GetRecords()
+	if len(recs) != 2 || recs[0].IP != "2.2.2.2" || recs[1].IP != "1.1.1.1" {
+		t.Fatalf("%+v", recs)
+	}
+	if recs[1].TotalConnections() != 2 || recs[1].Connections["sockd"] != 1 || recs[1].BytesIn != 11 || recs[1].BytesOut != 22 {
+		t.Fatalf("%+v", recs[1])
+	}
+	if recs[0].TotalHandshakeFailures() != 1 || tracker.IsBanned("2.2.2.2") {
+		t.Fatalf("%+v", recs[0])
+	}
+
+	// Failures among different daemons count towards the same ban
+	tracker.RecordHandshakeFailure("sockd", "2.2.2.2", "test")
+	tracker.RecordHandshakeFailure("plainsocket", "2.2.2.2", "test")
+	if !tracker.IsBanned("2.2.2.2") || tracker.IsBanned("1.1.1.1") {
+		t.Fatal("incorrect ban state")
+	}
+	if !tracker.Unban("2.2.2.2") || tracker.Unban("2.2.2.2") || tracker.IsBanned("2.2.2.2") {
+		t.Fatal("failed to unban")
+	}
+
+	// Loopback addresses are never banned
+	for i := 0; i < 5; i++ {
+		tracker.RecordHandshakeFailure("smtpd", "127.0.0.1", "test")
+	}
+	if tracker.IsBanned("127.0.0.1") {
+		t.Fatal("should not have banned loopback")
+	}
+
+	// The IP seen least recently is forgotten first
+	time.Sleep(10 * time.Millisecond)
+	tracker.RecordConnection("smtpd", "2.2.2.2")
+	tracker.RecordConnection("smtpd", "127.0.0.1")
+	tracker.RecordConnection("smtpd", "3.3.3.3")
+	recs = tracker.GetRecords()
+	if len(recs) != 3 {
+		t.Fatalf("%+v", recs)
+	}
+	for _, rec := range recs {
+		if rec.IP == "1.1.1.1" {
+			t.Fatalf("%+v", recs)
+		}
+	}
+}
+
+type trackedTCPApp struct{}
+
+func (app *trackedTCPApp) GetTCPStatsCollector() *misc.Stats {
+	return misc.PlainSocketStatsTCP
+}
+
+func (app *trackedTCPApp) HandleTCPConnection(_ *lalog.Logger, _ string, conn *net.TCPConn) {
+	_, _ = conn.Write([]byte("hello"))
+}
+
+func TestTCPServer_Ban(t *testing.T) {
+	srv := NewTCPServer("127.0.0.1", 18164, "conntrack-test", &trackedTCPApp{}, 100)
+	go func() {
+		if err := srv.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	readGreeting := func() string {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(18164)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		buf := make([]byte, 5)
+		n, _ := conn.Read(buf)
+		return string(buf[:n])
+	}
+	if greeting := readGreeting(); greeting != "hello" {
+		t.Fatal(greeting)
+	}
+	var conns int64
+	for _, rec := range TCPConnections.GetRecords() {
+		if rec.IP == "127.0.0.1" {
+			conns = rec.Connections["conntrack-test"]
+		}
+	}
+	if conns != 1 {
+		t.Fatal(conns)
+	}
+	// Simulate a ban, connections from a banned IP are closed right away.
+	TCPConnections.mutex.Lock()
+	TCPConnections.records["127.0.0.1"].BannedUntil = time.Now().Add(1 * time.Hour)
+	TCPConnections.mutex.Unlock()
+	if greeting := readGreeting(); greeting != "" {
+		t.Fatal(greeting)
+	}
+	TCPConnections.Unban("127.0.0.1")
+	if greeting := readGreeting(); greeting != "hello" {
+		t.Fatal(greeting)
+	}
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// IPVersionBoth lets a listener accept clients over both IPv4 and IPv6 (dual-stack), it is the default.
+	IPVersionBoth = "both"
+	// IPVersion4 restricts a listener to IPv4 clients.
+	IPVersion4 = "v4"
+	// IPVersion6 restricts a listener to IPv6 clients.
+	IPVersion6 = "v6"
+)
+
+/*
+ValidateIPVersion returns an error if the IP version is not among the supported choices, or the listen address does not
+belong to the IP version. An empty IP version is treated as dual-stack.
+*/
+func ValidateIPVersion(ipVersion, listenAddr string) error {
+	switch ipVersion {
+	case "", IPVersionBoth, IPVersion4, IPVersion6:
+	default:
+		return fmt.Errorf("ValidateIPVersion: IPVersion must be one of %q, %q, or %q", IPVersionBoth, IPVersion4, IPVersion6)
+	}
+	ip := net.ParseIP(listenAddr)
+	if ip == nil {
+		// Host names are resolved by the network of the IP version when the listener starts
+		return nil
+	}
+	if ipVersion == IPVersion4 && ip.To4() == nil {
+		return fmt.Errorf("ValidateIPVersion: listen address %s is not an IPv4 address", listenAddr)
+	}
+	if ipVersion == IPVersion6 && ip.To4() != nil {
+		return fmt.Errorf("ValidateIPVersion: listen address %s is not an IPv6 address", listenAddr)
+	}
+	return nil
+}
+
+/*
+DefaultListenAddress returns the address of all network interfaces for the IP version - "::" for IPv6, and "0.0.0.0"
+for IPv4. A dual-stack listener uses "0.0.0.0" too, because Go listens on both IPv4 and IPv6 for the unspecified
+address when the network is "tcp" or "udp".
+*/
+func DefaultListenAddress(ipVersion string) string {
+	if ipVersion == IPVersion6 {
+		return "::"
+	}
+	return "0.0.0.0"
+}
+
+// ListenNetwork returns the network name (e.g. "tcp4", "udp6") of the protocol ("tcp" or "udp") for the IP version.
+func ListenNetwork(protocol, ipVersion string) string {
+	switch ipVersion {
+	case IPVersion4:
+		return protocol + "4"
+	case IPVersion6:
+		return protocol + "6"
+	default:
+		return protocol
+	}
+}
+
+// LoopbackAddress returns the loopback address ("::1" or "127.0.0.1") that clients of the IP version may connect to.
+func LoopbackAddress(ipVersion string) string {
+	if ipVersion == IPVersion6 {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateIPVersion(t *testing.T) {
+	require.NoError(t, ValidateIPVersion("", "0.0.0.0"))
+	require.NoError(t, ValidateIPVersion(IPVersionBoth, "::"))
+	require.NoError(t, ValidateIPVersion(IPVersion4, "127.0.0.1"))
+	require.NoError(t, ValidateIPVersion(IPVersion6, "::1"))
+	require.NoError(t, ValidateIPVersion(IPVersion6, "localhost"))
+	require.Error(t, ValidateIPVersion("v5", "0.0.0.0"))
+	require.Error(t, ValidateIPVersion(IPVersion4, "::"))
+	require.Error(t, ValidateIPVersion(IPVersion6, "0.0.0.0"))
+	require.Error(t, ValidateIPVersion(IPVersion6, "::ffff:127.0.0.1"))
+}
+
+func TestListenNetwork(t *testing.T) {
+	require.Equal(t, "tcp", ListenNetwork("tcp", ""))
+	require.Equal(t, "udp", ListenNetwork("udp", IPVersionBoth))
+	require.Equal(t, "tcp4", ListenNetwork("tcp", IPVersion4))
+	require.Equal(t, "udp6", ListenNetwork("udp", IPVersion6))
+	require.Equal(t, "0.0.0.0", DefaultListenAddress(""))
+	require.Equal(t, "0.0.0.0", DefaultListenAddress(IPVersion4))
+	require.Equal(t, "::", DefaultListenAddress(IPVersion6))
+	require.Equal(t, "127.0.0.1", LoopbackAddress(IPVersionBoth))
+	require.Equal(t, "::1", LoopbackAddress(IPVersion6))
+}
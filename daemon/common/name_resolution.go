@@ -0,0 +1,74 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultNameResolutionMaxRecords is the default maximum number of name resolution records to remember.
+const DefaultNameResolutionMaxRecords = 1000
+
+// ProxyNameResolutions records the destination names resolved by the DNS daemon for the connections of proxy daemons (sockd and httpproxy).
+var ProxyNameResolutions = NewNameResolutionTracker()
+
+// NameResolutionRecord describes the destination name resolved for a proxy connection.
+type NameResolutionRecord struct {
+	Time       time.Time
+	DaemonName string
+	ClientIP   string
+	// Name is the destination name requested by the client.
+	Name string
+	// Addresses are the IP addresses resolved from the name, they are empty if the resolution failed.
+	Addresses []string
+	// Blacklisted is true if the name (or its alias) is blacklisted by the DNS daemon, in which case the connection is refused.
+	Blacklisted bool
+	// Error describes the failure of resolution if any.
+	Error string
+}
+
+/*
+NameResolutionTracker remembers the latest name resolution records of proxy connections, which tells the destinations
+visited by each client even though the proxy connections are encrypted.
+*/
+type NameResolutionTracker struct {
+	// MaxRecords is the maximum number of records to remember, the oldest record is forgotten first.
+	MaxRecords int
+
+	records []NameResolutionRecord
+	mutex   *sync.Mutex
+}
+
+// NewNameResolutionTracker returns an initialised name resolution tracker with default limits.
+func NewNameResolutionTracker() *NameResolutionTracker {
+	return &NameResolutionTracker{
+		MaxRecords: DefaultNameResolutionMaxRecords,
+		mutex:      new(sync.Mutex),
+	}
+}
+
+// Record remembers a name resolution record, its time is set to the current time if it is zero.
+func (tracker *NameResolutionTracker) Record(rec NameResolutionRecord) {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.records = append(tracker.records, rec)
+	if excess := len(tracker.records) - tracker.MaxRecords; excess > 0 {
+		tracker.records = append(tracker.records[:0], tracker.records[excess:]...)
+	}
+}
+
+// GetRecords returns a copy of the records of the client IP (or of all clients if the IP is empty), the latest record comes first.
+func (tracker *NameResolutionTracker) GetRecords(clientIP string) []NameResolutionRecord {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	ret := make([]NameResolutionRecord, 0, len(tracker.records))
+	for i := len(tracker.records) - 1; i >= 0; i-- {
+		if rec := tracker.records[i]; clientIP == "" || rec.ClientIP == clientIP {
+			rec.Addresses = append([]string(nil), rec.Addresses...)
+			ret = append(ret, rec)
+		}
+	}
+	return ret
+}
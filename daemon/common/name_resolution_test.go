@@ -0,0 +1,30 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameResolutionTracker(t *testing.T) {
+	tracker := NewNameResolutionTracker()
+	tracker.MaxRecords = 3
+	require.Empty(t, tracker.GetRecords(""))
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"} {
+		tracker.Record(NameResolutionRecord{DaemonName: "sockd", ClientIP: "192.0.2.1", Name: name, Addresses: []string{"192.0.2.80"}})
+	}
+	tracker.Record(NameResolutionRecord{DaemonName: "httpproxy", ClientIP: "192.0.2.2", Name: "e.example.com", Blacklisted: true})
+	// The oldest records are forgotten and the latest record comes first
+	all := tracker.GetRecords("")
+	require.Len(t, all, 3)
+	require.Equal(t, []string{"e.example.com", "d.example.com", "c.example.com"}, []string{all[0].Name, all[1].Name, all[2].Name})
+	require.False(t, all[0].Time.IsZero())
+	require.True(t, all[0].Blacklisted)
+	// Filter by client IP
+	client := tracker.GetRecords("192.0.2.1")
+	require.Len(t, client, 2)
+	require.Equal(t, "d.example.com", client[0].Name)
+	client[0].Addresses[0] = "modified"
+	require.Equal(t, "192.0.2.80", tracker.GetRecords("192.0.2.1")[0].Addresses[0])
+	require.Empty(t, tracker.GetRecords("192.0.2.3"))
+}
@@ -83,6 +83,16 @@ func (cmds *RecurringCommands) AddTransientCommand(cmd string) {
 	cmds.transientCommands = append(cmds.transientCommands, cmd)
 }
 
+/*
+SetPreConfiguredCommands replaces the pre-configured commands, which take effect from the next round of execution.
+The caller must not modify the slice afterwards.
+*/
+func (cmds *RecurringCommands) SetPreConfiguredCommands(commands []string) {
+	cmds.mutex.Lock()
+	defer cmds.mutex.Unlock()
+	cmds.PreConfiguredCommands = commands
+}
+
 // ClearTransientCommands removes all transient commands.
 func (cmds *RecurringCommands) ClearTransientCommands() {
 	cmds.mutex.Lock()
@@ -92,9 +102,12 @@ func (cmds *RecurringCommands) ClearTransientCommands() {
 
 // runAllCommands executes all pre-configured and transient commands one after another and store their results.
 func (cmds *RecurringCommands) runAllCommands(ctx context.Context) {
-	//	Access to the commands array is not protected by mutex since no other function modifies it
-	if cmds.PreConfiguredCommands != nil {
-		for _, cmd := range cmds.PreConfiguredCommands {
+	// Make a copy of the pre-configured commands, which may be replaced by SetPreConfiguredCommands.
+	cmds.mutex.RLock()
+	preConfiguredCommands := cmds.PreConfiguredCommands
+	cmds.mutex.RUnlock()
+	if preConfiguredCommands != nil {
+		for _, cmd := range preConfiguredCommands {
 			// Skip result filters that may send notifications or manipulate result in other means
 			result := cmds.CommandProcessor.Process(ctx, toolbox.Command{
 				DaemonName: "RecurringCommands",
@@ -0,0 +1,190 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StatsCollector is the uniform interface of the stats counters that record the requests served by the daemons.
+type StatsCollector interface {
+	// DisplayValue returns a snapshot of the numbers in human-readable scale, which are consistent among themselves.
+	DisplayValue() misc.StatsDisplayValue
+	// Reset clears the counter and numeric statistics.
+	Reset()
+}
+
+// DaemonStats associates a daemon with one of its stats counters, a daemon may have a counter for each transport protocol.
+type DaemonStats struct {
+	// Key identifies the counter in the JSON system info, e.g. "DNSOverTCP".
+	Key string
+	// Daemon is the name of the daemon, e.g. "dnsd".
+	Daemon string
+	// Transport tells the counters of the same daemon apart, e.g. "tcp" or "udp". It is empty if the daemon has a single counter.
+	Transport string
+	// Label describes the counter in the text report.
+	Label     string
+	Collector StatsCollector
+}
+
+// DaemonStatsSnapshot is a snapshot of the numbers of a daemon stats counter.
+type DaemonStatsSnapshot struct {
+	Key       string
+	Daemon    string
+	Transport string
+	Label     string
+	misc.StatsDisplayValue
+}
+
+var (
+	/*
+		AllDaemonStats is the comprehensive list of daemon stats counters, it is the single source of numbers for the
+		system info handler, SNMP agent, prometheus exporter, and maintenance reports.
+	*/
+	AllDaemonStats = []DaemonStats{
+		{Key: "AutoUnlock", Daemon: "autounlock", Label: "Auto-unlock events", Collector: misc.AutoUnlockStats},
+		{Key: "Commands", Daemon: "toolbox", Label: "Commands processed", Collector: misc.CommandStats},
+		{Key: "DNSOverTCP", Daemon: "dnsd", Transport: "tcp", Label: "DNS server TCP", Collector: misc.DNSDStatsTCP},
+		{Key: "DNSOverUDP", Daemon: "dnsd", Transport: "udp", Label: "DNS server UDP", Collector: misc.DNSDStatsUDP},
+		{Key: "TCPOverDNS", Daemon: "dnsd", Transport: "tcpoverdns", Label: "TCP-over-DNS proxy", Collector: misc.TCPOverDNSStats},
+		{Key: "HTTP", Daemon: "httpd", Label: "HTTP/S server", Collector: misc.HTTPDStats},
+		{Key: "HTTPProxy", Daemon: "httpproxy", Label: "HTTP proxy", Collector: misc.HTTPProxyStats},
+		{Key: "PlainSocketTCP", Daemon: "plainsocket", Transport: "tcp", Label: "Plain text server TCP", Collector: misc.PlainSocketStatsTCP},
+		{Key: "PlainSocketUDP", Daemon: "plainsocket", Transport: "udp", Label: "Plain text server UDP", Collector: misc.PlainSocketStatsUDP},
+		{Key: "SerialDevices", Daemon: "serialport", Label: "Serial port devices", Collector: misc.SerialDevicesStats},
+		{Key: "SimpleIPServiceTCP", Daemon: "simpleipsvcd", Transport: "tcp", Label: "Simple IP servers TCP", Collector: misc.SimpleIPStatsTCP},
+		{Key: "SimpleIPServiceUDP", Daemon: "simpleipsvcd", Transport: "udp", Label: "Simple IP servers UDP", Collector: misc.SimpleIPStatsUDP},
+		{Key: "SMTP", Daemon: "smtpd", Label: "SMTP server", Collector: misc.SMTPDStats},
+		{Key: "SNMP", Daemon: "snmpd", Label: "SNMP server", Collector: misc.SNMPStats},
+		{Key: "SSH", Daemon: "sshd", Label: "SSH server", Collector: misc.SSHDStats},
+		{Key: "SockdTCP", Daemon: "sockd", Transport: "tcp", Label: "Sock server TCP", Collector: misc.SOCKDStatsTCP},
+		{Key: "SockdUDP", Daemon: "sockd", Transport: "udp", Label: "Sock server UDP", Collector: misc.SOCKDStatsUDP},
+		{Key: "SockdKnock", Daemon: "sockd", Transport: "knock", Label: "Sock server knocks", Collector: misc.SOCKDStatsKnock},
+		{Key: "TelegramBot", Daemon: "telegram", Label: "Telegram commands", Collector: misc.TelegramBotStats},
+	}
+	// daemonStatsAliases associates the daemons that share the stats counters of another daemon.
+	daemonStatsAliases = map[string]string{"insecurehttpd": "httpd"}
+
+	daemonStatsPrometheusOnce = new(sync.Once)
+)
+
+// GetDaemonStatsSnapshots returns a snapshot of all daemon stats counters, in the order of AllDaemonStats.
+func GetDaemonStatsSnapshots() []DaemonStatsSnapshot {
+	ret := make([]DaemonStatsSnapshot, 0, len(AllDaemonStats))
+	for _, stats := range AllDaemonStats {
+		ret = append(ret, DaemonStatsSnapshot{
+			Key:               stats.Key,
+			Daemon:            stats.Daemon,
+			Transport:         stats.Transport,
+			Label:             stats.Label,
+			StatsDisplayValue: stats.Collector.DisplayValue(),
+		})
+	}
+	return ret
+}
+
+// GetDaemonRequestCount returns the number of requests served by the daemon, summed up from all of its stats counters.
+func GetDaemonRequestCount(daemon string) (count int) {
+	if alias, exists := daemonStatsAliases[daemon]; exists {
+		daemon = alias
+	}
+	for _, stats := range AllDaemonStats {
+		if stats.Daemon == daemon {
+			count += int(stats.Collector.DisplayValue().Count)
+		}
+	}
+	return
+}
+
+// ResetDaemonStats clears the stats counters of the daemon, or all daemons if the name is empty. It returns the number of counters cleared.
+func ResetDaemonStats(daemon string) (numReset int) {
+	if alias, exists := daemonStatsAliases[daemon]; exists {
+		daemon = alias
+	}
+	for _, stats := range AllDaemonStats {
+		if daemon == "" || stats.Daemon == daemon {
+			stats.Collector.Reset()
+			numReset++
+		}
+	}
+	return
+}
+
+// FormatDaemonStats returns the stats of all daemons and the outstanding mails in a piece of multi-line, formatted text.
+func FormatDaemonStats() string {
+	var out bytes.Buffer
+	for _, snapshot := range GetDaemonStatsSnapshots() {
+		_, _ = fmt.Fprintf(&out, "%-26s %s\n", snapshot.Label+":", snapshot.Summary)
+	}
+	_, _ = fmt.Fprintf(&out, "%-26s %d KiloBytes\n", "Mail to deliver:", atomic.LoadInt64(&misc.OutstandingMailBytes)/1024)
+	_, _ = fmt.Fprintf(&out, "%-26s %d\n", "Dropped log messages:", lalog.NumDropped.Load())
+	return out.String()
+}
+
+// GetDaemonStatuses returns the status of all daemons that have started along with the number of requests they served, sorted by daemon name.
+func GetDaemonStatuses() []misc.DaemonStatus {
+	statuses := misc.GetDaemonStatuses()
+	for i := range statuses {
+		statuses[i].RequestsServed = GetDaemonRequestCount(statuses[i].Name)
+	}
+	return statuses
+}
+
+// GetDaemonStatusText returns the status of all daemons that have started in a piece of multi-line, formatted text.
+func GetDaemonStatusText() string {
+	var out bytes.Buffer
+	for _, status := range GetDaemonStatuses() {
+		state := "stopped"
+		if status.Running {
+			state = "up " + (time.Duration(status.UptimeSec) * time.Second).String()
+		}
+		_, _ = fmt.Fprintf(&out, "%-14s %-20s requests: %-8d restarts: %d", status.Name, state, status.RequestsServed, status.Restarts)
+		if status.LastError != "" {
+			_, _ = fmt.Fprintf(&out, " last error (%s): %s", status.LastErrorAt.Format(time.RFC3339), status.LastError)
+		}
+		out.WriteRune('\n')
+	}
+	return out.String()
+}
+
+// daemonStatsPrometheusCollector reads the daemon stats counters when prometheus gathers the metrics.
+type daemonStatsPrometheusCollector struct {
+	countDesc, durationDesc *prometheus.Desc
+}
+
+// Describe sends the descriptors of the daemon stats metrics to the channel.
+func (collector *daemonStatsPrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.countDesc
+	ch <- collector.durationDesc
+}
+
+// Collect sends a snapshot of the daemon stats counters to the channel.
+func (collector *daemonStatsPrometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, snapshot := range GetDaemonStatsSnapshots() {
+		ch <- prometheus.MustNewConstMetric(collector.countDesc, prometheus.CounterValue, float64(snapshot.Count), snapshot.Daemon, snapshot.Transport)
+		ch <- prometheus.MustNewConstMetric(collector.durationDesc, prometheus.CounterValue, snapshot.Total, snapshot.Daemon, snapshot.Transport)
+	}
+}
+
+// RegisterDaemonStatsMetrics registers the daemon stats counters with prometheus once, if prometheus integration is enabled.
+func RegisterDaemonStatsMetrics(logger *lalog.Logger) {
+	if !misc.PrometheusIntegration.IsEnabled() {
+		return
+	}
+	daemonStatsPrometheusOnce.Do(func() {
+		labels := []string{"daemon", "transport"}
+		collector := &daemonStatsPrometheusCollector{
+			countDesc:    prometheus.NewDesc("laitos_daemon_requests_total", "The number of requests served by each daemon", labels, nil),
+			durationDesc: prometheus.NewDesc("laitos_daemon_request_duration_seconds_total", "The total duration of requests served by each daemon in seconds", labels, nil),
+		}
+		if err := prometheus.Register(collector); err != nil {
+			logger.Warning("", err, "failed to register prometheus metrics collectors")
+		}
+	})
+}
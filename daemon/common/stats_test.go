@@ -0,0 +1,107 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDaemonStats(t *testing.T) {
+	// Every counter is uniquely identified by its key, and by its daemon and transport.
+	keys := make(map[string]bool)
+	daemonTransports := make(map[string]bool)
+	for _, stats := range AllDaemonStats {
+		require.False(t, keys[stats.Key], stats.Key)
+		require.False(t, daemonTransports[stats.Daemon+"/"+stats.Transport], stats.Daemon)
+		keys[stats.Key] = true
+		daemonTransports[stats.Daemon+"/"+stats.Transport] = true
+	}
+
+	ResetDaemonStats("")
+	for i := 0; i < 1928; i++ {
+		misc.AutoUnlockStats.Trigger(1)
+	}
+	misc.DNSDStatsTCP.Trigger(1)
+	misc.DNSDStatsUDP.Trigger(1)
+	misc.HTTPDStats.Trigger(3000000000)
+	misc.SOCKDStatsTCP.Trigger(1)
+	require.Equal(t, 1928, GetDaemonRequestCount("autounlock"))
+	require.Equal(t, 2, GetDaemonRequestCount("dnsd"))
+	require.Equal(t, 1, GetDaemonRequestCount("insecurehttpd"))
+	require.Equal(t, 0, GetDaemonRequestCount("does-not-exist"))
+	require.Contains(t, FormatDaemonStats(), "1928")
+
+	// The snapshot and text report agree on the numbers
+	for _, snapshot := range GetDaemonStatsSnapshots() {
+		if snapshot.Key == "HTTP" {
+			require.EqualValues(t, 1, snapshot.Count)
+			require.Equal(t, 3.0, snapshot.Highest)
+			require.Equal(t, 3.0, snapshot.Total)
+			require.Equal(t, "3.00/3.00/3.00,3.00(1)", snapshot.Summary)
+			require.Contains(t, FormatDaemonStats(), snapshot.Label+":             "+snapshot.Summary)
+		}
+	}
+
+	// Reset the counters of a single daemon
+	require.Equal(t, 3, ResetDaemonStats("sockd"))
+	require.Equal(t, 0, GetDaemonRequestCount("sockd"))
+	require.Equal(t, 1, GetDaemonRequestCount("httpd"))
+	require.Equal(t, 1, ResetDaemonStats("insecurehttpd"))
+	require.Equal(t, 0, GetDaemonRequestCount("httpd"))
+
+	// Daemon status carries the number of requests served
+	misc.DaemonStarted("dnsd")
+	misc.DaemonStopped("dnsd", errors.New("listener failed"))
+	var found bool
+	for _, status := range GetDaemonStatuses() {
+		if status.Name == "dnsd" {
+			found = true
+			require.Equal(t, 2, status.RequestsServed)
+		}
+	}
+	require.True(t, found)
+	text := GetDaemonStatusText()
+	require.Contains(t, text, "dnsd")
+	require.Contains(t, text, "requests: 2")
+	require.Contains(t, text, "listener failed")
+
+	// Prometheus collector reports the count and duration of each counter
+	collector := &daemonStatsPrometheusCollector{
+		countDesc:    prometheus.NewDesc("count", "count", []string{"daemon", "transport"}, nil),
+		durationDesc: prometheus.NewDesc("duration", "duration", []string{"daemon", "transport"}, nil),
+	}
+	metrics := make(chan prometheus.Metric, 2*len(AllDaemonStats))
+	collector.Collect(metrics)
+	close(metrics)
+	var numMetrics int
+	for metric := range metrics {
+		numMetrics++
+		require.True(t, strings.Contains(metric.Desc().String(), "count") || strings.Contains(metric.Desc().String(), "duration"))
+	}
+	require.Equal(t, 2*len(AllDaemonStats), numMetrics)
+
+	ResetDaemonStats("")
+	require.Equal(t, 0, GetDaemonRequestCount("autounlock"))
+}
+
+func TestFormatDaemonStats(t *testing.T) {
+	// The text report replaces misc.GetLatestStats, it has a line for each counter along with the outstanding mails and dropped logs.
+	ResetDaemonStats("")
+	defer ResetDaemonStats("")
+	for i := 0; i < 1928; i++ {
+		misc.AutoUnlockStats.Trigger(1)
+	}
+	text := FormatDaemonStats()
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	require.Len(t, lines, len(AllDaemonStats)+2)
+	for i, stats := range AllDaemonStats {
+		require.True(t, strings.HasPrefix(lines[i], stats.Label+":"), lines[i])
+	}
+	require.Contains(t, lines[0], "(1928)")
+	require.Contains(t, text, "Mail to deliver:")
+	require.Contains(t, text, "Dropped log messages:")
+}
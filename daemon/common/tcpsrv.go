@@ -37,6 +37,8 @@ type TCPServer struct {
 	ListenAddr string
 	// ListenPort is the port number to listen on.
 	ListenPort int
+	// IPVersion is the IP version (IPVersionBoth, IPVersion4, or IPVersion6) of clients to serve, it defaults to dual-stack.
+	IPVersion string
 	// AppName is a human readable name that identifies the server application in log entries.
 	AppName string
 	// App is the concrete implementation of TCP server application.
@@ -74,7 +76,7 @@ func (srv *TCPServer) Initialise() {
 		ComponentName: srv.AppName,
 		ComponentID:   []lalog.LoggerIDField{{Key: "Addr", Value: srv.ListenAddr}, {Key: "TCPPort", Value: srv.ListenPort}},
 	}
-	srv.rateLimit = lalog.NewRateLimit(1, srv.LimitPerSec, srv.logger)
+	srv.rateLimit = lalog.NewSharedRateLimit(fmt.Sprintf("tcp-%s-%d", srv.AppName, srv.ListenPort), 1, srv.LimitPerSec, srv.logger)
 }
 
 /*
@@ -90,7 +92,7 @@ func (srv *TCPServer) StartAndBlock() error {
 	}
 	srv.logger.Info("", nil, "starting TCP listener")
 	var err error
-	listener, err := net.Listen("tcp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
+	listener, err := net.Listen(ListenNetwork("tcp", srv.IPVersion), net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
 	if err != nil {
 		srv.mutex.Unlock()
 		return fmt.Errorf("TCPServer.StartAndBlock(%s): failed to listen on port %d - %v", srv.AppName, srv.ListenPort, err)
@@ -112,6 +114,10 @@ func (srv *TCPServer) StartAndBlock() error {
 		// Check client IP against rate limit
 		tcpClient := client.(*net.TCPConn)
 		clientIP := tcpClient.RemoteAddr().(*net.TCPAddr).IP.String()
+		if TCPConnections.IsBanned(clientIP) {
+			srv.logger.MaybeMinorError(tcpClient.Close())
+			continue
+		}
 		if !srv.rateLimit.Add(clientIP, true) {
 			srv.logger.MaybeMinorError(tcpClient.Close())
 			continue
@@ -134,6 +140,7 @@ func (srv *TCPServer) handleConnection(clientIP string, client *net.TCPConn) {
 		srv.App.GetTCPStatsCollector().Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 	}()
 	srv.logger.Info(clientIP, nil, "accepted a connection from %s to %s", client.RemoteAddr(), client.LocalAddr())
+	TCPConnections.RecordConnection(srv.AppName, clientIP)
 	// Turn on keep-alive for OS to detect and remove dead clients
 	if err := client.SetKeepAlive(true); err != nil {
 		srv.logger.Warning(clientIP, err, "failed to turn on keep alive")
@@ -153,6 +160,13 @@ func (srv *TCPServer) handleConnection(clientIP string, client *net.TCPConn) {
 	srv.App.HandleTCPConnection(srv.logger, clientIP, client)
 }
 
+// IsRunning returns true only if the server has started and has not been told to stop.
+func (srv *TCPServer) IsRunning() bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.listener != nil
+}
+
 // Stop the TCP server from accepting new connections. Ongoing connections will continue nonetheless.
 func (srv *TCPServer) Stop() {
 	srv.mutex.Lock()
@@ -31,6 +31,8 @@ type UDPServer struct {
 	ListenAddr string
 	// ListenPort is the port number to listen on.
 	ListenPort int
+	// IPVersion is the IP version (IPVersionBoth, IPVersion4, or IPVersion6) of clients to serve, it defaults to dual-stack.
+	IPVersion string
 	// AppName is a human readable name that identifies the server application in log entries.
 	AppName string
 	// App is the concrete implementation of UDP server application.
@@ -68,12 +70,7 @@ func (srv *UDPServer) Initialise() {
 		ComponentName: srv.AppName,
 		ComponentID:   []lalog.LoggerIDField{{Key: "Addr", Value: srv.ListenAddr}, {Key: "UDPPort", Value: srv.ListenPort}},
 	}
-	srv.rateLimit = &lalog.RateLimit{
-		UnitSecs: 1,
-		MaxCount: srv.LimitPerSec,
-		Logger:   srv.logger,
-	}
-	srv.rateLimit = lalog.NewRateLimit(1, srv.LimitPerSec, srv.logger)
+	srv.rateLimit = lalog.NewSharedRateLimit(fmt.Sprintf("udp-%s-%d", srv.AppName, srv.ListenPort), 1, srv.LimitPerSec, srv.logger)
 }
 
 /*
@@ -89,11 +86,12 @@ func (srv *UDPServer) StartAndBlock() error {
 	}
 	srv.logger.Info(nil, nil, "starting UDP listener")
 	var err error
-	listenUDPAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
+	listenUDPAddr, err := net.ResolveUDPAddr(ListenNetwork("udp", srv.IPVersion), net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
 	if err != nil {
+		srv.mutex.Unlock()
 		return fmt.Errorf("UDPServer.StartAndBlock(%s): failed to resolve listning address %s - %v", srv.AppName, srv.ListenAddr, err)
 	}
-	udpServer, err := net.ListenUDP("udp", listenUDPAddr)
+	udpServer, err := net.ListenUDP(ListenNetwork("udp", srv.IPVersion), listenUDPAddr)
 	if err != nil {
 		srv.mutex.Unlock()
 		return fmt.Errorf("UDPServer.StartAndBlock(%s): failed to listen on port %d - %v", srv.AppName, srv.ListenPort, err)
@@ -3,9 +3,7 @@ package dnsd
 import (
 	"context"
 	"strings"
-	"sync"
 
-	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 )
 
@@ -15,6 +13,8 @@ const (
 		The limit prevents an exceedingly long third party host file from taking too much memory.
 	*/
 	MaxNameEntriesToExtract = 50000
+	// DefaultBlacklistCategory is the category of a black listed name that did not come from a categorised hosts file.
+	DefaultBlacklistCategory = "unwanted"
 )
 
 // HostsFileURLs is a collection of URLs where up-to-date ad/malware/spyware blacklist hosts files are published.
@@ -27,6 +27,16 @@ var HostsFileURLs = []string{
 	"https://raw.githubusercontent.com/blocklistproject/Lists/master/tracking.txt",
 }
 
+// HostsFileCategories describes the kind of names each of the HostsFileURLs blocks, the block page shows the category to visitors.
+var HostsFileCategories = map[string]string{
+	"http://winhelp2002.mvps.org/hosts.txt":                                                        "ads",
+	"http://pgl.yoyo.org/adservers/serverlist.php?hostformat=hosts&showintro=0&mimetype=plaintext": "ads",
+	"http://someonewhocares.org/hosts/hosts":                                                       "ads",
+	"https://raw.githubusercontent.com/blocklistproject/Lists/master/ransomware.txt":               "ransomware",
+	"https://raw.githubusercontent.com/blocklistproject/Lists/master/scam.txt":                     "scam",
+	"https://raw.githubusercontent.com/blocklistproject/Lists/master/tracking.txt":                 "tracking",
+}
+
 /*
 Whitelist is an array of domain names that often appear in black lists, but cause inconvenience when blocked. These
 names are removed from downloaded black lists.
@@ -76,48 +86,28 @@ DownloadAllBlacklists attempts to download all hosts files and return combined l
 The special cases of white listed names are removed from return value.
 */
 func DownloadAllBlacklists(maxEntries int, logger *lalog.Logger) []string {
-	wg := new(sync.WaitGroup)
-	wg.Add(len(HostsFileURLs))
-
-	// Download all lists in parallel
-	lists := make([][]string, len(HostsFileURLs))
-	for i, url := range HostsFileURLs {
-		go func(i int, url string) {
-			resp, err := inet.DoHTTP(context.Background(), inet.HTTPRequest{TimeoutSec: BlackListDownloadTimeoutSec}, url)
-			if err == nil {
-				names := ExtractNamesFromHostsContent(string(resp.Body))
-				logger.Info(url, err, "downloaded %d names, please obey the license the list author uses to publish the data.", len(names))
-				lists[i] = names
-			} else {
-				logger.Warning(url, err, "failed to download blacklist")
-				lists[i] = []string{}
-			}
-			defer wg.Done()
-		}(i, url)
-	}
-	wg.Wait()
-	// Calculate unique set of domain names
-	set := map[string]struct{}{}
-	for _, list := range lists {
-		for _, str := range list {
-			if _, exists := set[str]; !exists && len(set) < maxEntries {
-				set[str] = struct{}{}
-			}
-		}
-	}
-	// Remove white listed names
-	for _, toRemove := range Whitelist {
-		delete(set, toRemove)
-	}
-
-	ret := make([]string, 0, len(set))
-	for str := range set {
+	categorised := DownloadCategorisedBlacklists(maxEntries, logger)
+	ret := make([]string, 0, len(categorised))
+	for str := range categorised {
 		ret = append(ret, str)
 	}
-	logger.Info("", nil, "downloaded %d unique names in total", len(ret))
 	return ret
 }
 
+/*
+DownloadCategorisedBlacklists attempts to download all hosts files and return the combined domain names to block, each
+mapped to the category of the hosts file it first appeared in. The special cases of white listed names are removed from
+return value.
+*/
+func DownloadCategorisedBlacklists(maxEntries int, logger *lalog.Logger) map[string]string {
+	subs := &BlacklistSubscriptions{Subscriptions: DefaultBlacklistSubscriptions(), MaxEntries: maxEntries}
+	if err := subs.Initialise(logger); err != nil {
+		logger.Warning("", err, "failed to initialise the default blacklists")
+		return map[string]string{}
+	}
+	return subs.Refresh(context.Background())
+}
+
 /*
 ExtractNamesFromHostsContent extracts domain names from hosts file content. It will not return empty lines, comments, and potentially
 illegal domain names.
@@ -151,10 +141,7 @@ func ExtractNamesFromHostsContent(content string) []string {
 		}
 		// Extract the name itself. Matching of black list name always takes place in lower case.
 		aName := strings.ToLower(strings.TrimSpace(line[:nameEnd]))
-		if aName == "" || strings.HasSuffix(aName, "localhost") || strings.HasSuffix(aName, "localdomain") ||
-			len(aName) < 4 || len(aName) > 253 {
-			// Skip empty names, local names, and overly short names
-			// Also, domain name length may not exceed 253 characters according to various technical documents in the public domain.
+		if !isBlacklistableName(aName) {
 			continue
 		}
 		ret = append(ret, aName)
@@ -165,3 +152,48 @@ func ExtractNamesFromHostsContent(content string) []string {
 	}
 	return ret
 }
+
+/*
+ExtractNamesFromDomainList extracts domain names from a plain list of names, one name per line. Comments beginning with
+"#" or "!" are ignored, and so are the adblock-style decorations around the name, e.g. "||example.com^".
+*/
+func ExtractNamesFromDomainList(content string) []string {
+	ret := make([]string, 0, 16384)
+	for _, line := range strings.Split(content, "\n") {
+		if strings.ContainsRune(line, 0) {
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' || line[0] == '!' {
+			// Skip blank and comments
+			continue
+		}
+		// Name may be followed by a comment
+		if commentStart := strings.IndexRune(line, '#'); commentStart > 0 && (line[commentStart-1] == ' ' || line[commentStart-1] == '\t') {
+			line = strings.TrimSpace(line[:commentStart])
+		}
+		line = strings.TrimPrefix(line, "||")
+		line = strings.TrimSuffix(line, "^")
+		line = strings.TrimPrefix(line, "*.")
+		line = strings.TrimSuffix(line, ".")
+		aName := strings.ToLower(line)
+		if strings.ContainsAny(aName, " \t/:*$|^#") || !isBlacklistableName(aName) {
+			// Skip the rules that are not a plain domain name
+			continue
+		}
+		ret = append(ret, aName)
+		if len(ret) > MaxNameEntriesToExtract {
+			// Avoid taking in too many names
+			break
+		}
+	}
+	return ret
+}
+
+// isBlacklistableName returns true if the lower case name may be placed into the black list.
+func isBlacklistableName(aName string) bool {
+	// Skip empty names, local names, and overly short names
+	// Also, domain name length may not exceed 253 characters according to various technical documents in the public domain.
+	return aName != "" && !strings.HasSuffix(aName, "localhost") && !strings.HasSuffix(aName, "localdomain") &&
+		len(aName) >= 4 && len(aName) <= 253
+}
@@ -0,0 +1,204 @@
+package dnsd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// BlacklistFormatHosts is the format of hosts files, each line has an IP address followed by a domain name.
+	BlacklistFormatHosts = "hosts"
+	// BlacklistFormatDomains is the format of plain domain lists, each line has a domain name.
+	BlacklistFormatDomains = "domains"
+)
+
+// BlacklistSubscription is a third party black list of domain names, the DNS daemon downloads it periodically.
+type BlacklistSubscription struct {
+	// URL is the HTTP(S) location of the black list.
+	URL string `json:"URL"`
+	// Format is either "hosts" (IP address followed by a name) or "domains" (a name per line), it defaults to "hosts".
+	Format string `json:"Format"`
+	// Category describes the kind of names the list blocks, e.g. "ads", and the block page shows it to visitors.
+	Category string `json:"Category"`
+}
+
+// BlacklistSubscriptionStatus is the outcome of the latest download of a black list.
+type BlacklistSubscriptionStatus struct {
+	URL string
+	// Entries is the number of names extracted from the list in the latest successful download.
+	Entries int
+	// LastRefresh is the time of the latest successful download.
+	LastRefresh time.Time
+	// LastError is the error of the latest download, it is empty if the download succeeded.
+	LastError string
+	// Errors is the total number of failed downloads.
+	Errors int
+}
+
+// DefaultBlacklistSubscriptions returns the built-in selection of ad, malware, and tracking black lists.
+func DefaultBlacklistSubscriptions() []BlacklistSubscription {
+	ret := make([]BlacklistSubscription, 0, len(HostsFileURLs))
+	for _, url := range HostsFileURLs {
+		ret = append(ret, BlacklistSubscription{URL: url, Format: BlacklistFormatHosts, Category: HostsFileCategories[url]})
+	}
+	return ret
+}
+
+/*
+BlacklistSubscriptions downloads, parses, and combines multiple black lists. A list that fails to download keeps
+contributing the names from its latest successful download, so that a temporary outage of the publisher does not
+unblock its names.
+*/
+type BlacklistSubscriptions struct {
+	// Subscriptions are the black lists to download.
+	Subscriptions []BlacklistSubscription
+	// MaxEntries is the maximum number of unique names to take from all lists combined.
+	MaxEntries int
+
+	logger *lalog.Logger
+	// names are the names downloaded from each list most recently, keyed by URL.
+	names  map[string][]string
+	status map[string]*BlacklistSubscriptionStatus
+	mutex  *sync.Mutex
+}
+
+// Initialise validates the subscriptions and prepares internal states.
+func (subs *BlacklistSubscriptions) Initialise(logger *lalog.Logger) error {
+	seen := make(map[string]struct{})
+	for i, sub := range subs.Subscriptions {
+		if !strings.HasPrefix(sub.URL, "http://") && !strings.HasPrefix(sub.URL, "https://") {
+			return fmt.Errorf("BlacklistSubscriptions.Initialise: URL %q must begin with http:// or https://", sub.URL)
+		}
+		if _, exists := seen[sub.URL]; exists {
+			return fmt.Errorf("BlacklistSubscriptions.Initialise: URL %q appears more than once", sub.URL)
+		}
+		seen[sub.URL] = struct{}{}
+		switch sub.Format {
+		case "":
+			subs.Subscriptions[i].Format = BlacklistFormatHosts
+		case BlacklistFormatHosts, BlacklistFormatDomains:
+		default:
+			return fmt.Errorf("BlacklistSubscriptions.Initialise: format of %q must be either %q or %q", sub.URL, BlacklistFormatHosts, BlacklistFormatDomains)
+		}
+		if sub.Category == "" {
+			subs.Subscriptions[i].Category = DefaultBlacklistCategory
+		}
+	}
+	if subs.MaxEntries < 1 {
+		subs.MaxEntries = BlacklistMaxEntries
+	}
+	subs.logger = logger
+	subs.names = make(map[string][]string)
+	subs.status = make(map[string]*BlacklistSubscriptionStatus)
+	subs.mutex = new(sync.Mutex)
+	registerPrometheusMetrics(logger)
+	return nil
+}
+
+/*
+Refresh downloads all black lists in parallel and returns the combined unique names, each mapped to the category of the
+list it first appeared in. The white listed names are removed from the return value.
+*/
+func (subs *BlacklistSubscriptions) Refresh(ctx context.Context) map[string]string {
+	wg := new(sync.WaitGroup)
+	for _, sub := range subs.Subscriptions {
+		wg.Add(1)
+		go func(sub BlacklistSubscription) {
+			defer wg.Done()
+			names, err := downloadBlacklist(ctx, sub)
+			subs.mutex.Lock()
+			defer subs.mutex.Unlock()
+			status, exists := subs.status[sub.URL]
+			if !exists {
+				status = &BlacklistSubscriptionStatus{URL: sub.URL}
+				subs.status[sub.URL] = status
+			}
+			if err != nil {
+				subs.logger.Warning(sub.URL, err, "failed to download blacklist")
+				status.LastError = err.Error()
+				status.Errors++
+				if misc.PrometheusIntegration.IsEnabled() {
+					blacklistRefreshErrorsCounter.WithLabelValues(sub.URL).Inc()
+				}
+				return
+			}
+			subs.logger.Info(sub.URL, nil, "downloaded %d names, please obey the license the list author uses to publish the data.", len(names))
+			subs.names[sub.URL] = names
+			status.Entries = len(names)
+			status.LastRefresh = time.Now()
+			status.LastError = ""
+			if misc.PrometheusIntegration.IsEnabled() {
+				blacklistEntriesGauge.WithLabelValues(sub.URL).Set(float64(len(names)))
+			}
+		}(sub)
+	}
+	wg.Wait()
+	// Calculate unique set of domain names in the order of subscriptions
+	subs.mutex.Lock()
+	set := map[string]string{}
+	for _, sub := range subs.Subscriptions {
+		for _, name := range subs.names[sub.URL] {
+			if _, exists := set[name]; !exists && len(set) < subs.MaxEntries {
+				set[name] = sub.Category
+			}
+		}
+	}
+	subs.mutex.Unlock()
+	// Remove white listed names
+	for _, toRemove := range Whitelist {
+		delete(set, toRemove)
+	}
+	if misc.PrometheusIntegration.IsEnabled() {
+		blacklistUniqueNamesGauge.Set(float64(len(set)))
+	}
+	subs.logger.Info("", nil, "downloaded %d unique names in total", len(set))
+	return set
+}
+
+// GetStatus returns the outcome of the latest download of each black list, in the order of subscriptions.
+func (subs *BlacklistSubscriptions) GetStatus() []BlacklistSubscriptionStatus {
+	subs.mutex.Lock()
+	defer subs.mutex.Unlock()
+	ret := make([]BlacklistSubscriptionStatus, 0, len(subs.Subscriptions))
+	for _, sub := range subs.Subscriptions {
+		if status, exists := subs.status[sub.URL]; exists {
+			ret = append(ret, *status)
+		} else {
+			ret = append(ret, BlacklistSubscriptionStatus{URL: sub.URL})
+		}
+	}
+	return ret
+}
+
+// downloadBlacklist downloads a black list and extracts the names from it according to its format.
+func downloadBlacklist(ctx context.Context, sub BlacklistSubscription) ([]string, error) {
+	resp, err := inet.DoHTTP(ctx, inet.HTTPRequest{TimeoutSec: BlackListDownloadTimeoutSec}, sub.URL)
+	if err != nil {
+		return nil, err
+	}
+	if err := resp.Non2xxToError(); err != nil {
+		return nil, err
+	}
+	var names []string
+	if sub.Format == BlacklistFormatDomains {
+		names = ExtractNamesFromDomainList(string(resp.Body))
+	} else {
+		names = ExtractNamesFromHostsContent(string(resp.Body))
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("the %s list does not contain any name", sub.Format)
+	}
+	return names, nil
+}
+
+// GetBlacklistStatus returns the outcome of the latest download of each black list.
+func (daemon *Daemon) GetBlacklistStatus() []BlacklistSubscriptionStatus {
+	return daemon.blacklistSubs.GetStatus()
+}
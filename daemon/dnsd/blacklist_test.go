@@ -1,8 +1,12 @@
 package dnsd
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sync/atomic"
 	"testing"
 
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -42,3 +46,72 @@ func TestExtractNamesFromHostsContent(t *testing.T) {
 		t.Fatal(names)
 	}
 }
+
+func TestExtractNamesFromDomainList(t *testing.T) {
+	sample := `# comment
+! adblock comment
+ads.example.com
+  Tracker.Example.NET	# trailing comment
+||adblock.example.org^
+*.wildcard.example.com
+a.b
+/path/rule.js
+example.com##.banner
+localhost
+`
+	names := ExtractNamesFromDomainList(sample)
+	if !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.net", "adblock.example.org", "wildcard.example.com"}) {
+		t.Fatal(names)
+	}
+}
+
+func TestBlacklistSubscriptions(t *testing.T) {
+	if err := (&BlacklistSubscriptions{Subscriptions: []BlacklistSubscription{{URL: "ftp://example.com"}}}).Initialise(&lalog.Logger{}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := (&BlacklistSubscriptions{Subscriptions: []BlacklistSubscription{{URL: "http://example.com", Format: "csv"}}}).Initialise(&lalog.Logger{}); err == nil {
+		t.Fatal("did not error")
+	}
+
+	var hostsAvailable atomic.Bool
+	hostsAvailable.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hosts":
+			if !hostsAvailable.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write([]byte("0.0.0.0 ads.example.com\n0.0.0.0 shared.example.com\n0.0.0.0 t.co\n"))
+		case "/domains":
+			_, _ = w.Write([]byte("shared.example.com\nmalware.example.com\n"))
+		}
+	}))
+	defer server.Close()
+
+	subs := &BlacklistSubscriptions{Subscriptions: []BlacklistSubscription{
+		{URL: server.URL + "/hosts", Category: "ads"},
+		{URL: server.URL + "/domains", Format: BlacklistFormatDomains},
+	}}
+	if err := subs.Initialise(&lalog.Logger{}); err != nil {
+		t.Fatal(err)
+	}
+	// The name on more than one list takes the category of the first list, and the white listed name is removed.
+	expected := map[string]string{"ads.example.com": "ads", "shared.example.com": "ads", "malware.example.com": DefaultBlacklistCategory}
+	if names := subs.Refresh(context.Background()); !reflect.DeepEqual(names, expected) {
+		t.Fatal(names)
+	}
+	status := subs.GetStatus()
+	if len(status) != 2 || status[0].Entries != 3 || status[1].Entries != 2 || status[0].LastRefresh.IsZero() || status[0].LastError != "" {
+		t.Fatalf("%+v", status)
+	}
+	// The list that fails to download keeps contributing the names of its latest download.
+	hostsAvailable.Store(false)
+	if names := subs.Refresh(context.Background()); !reflect.DeepEqual(names, expected) {
+		t.Fatal(names)
+	}
+	status = subs.GetStatus()
+	if status[0].Errors != 1 || status[0].LastError == "" || status[0].Entries != 3 || status[1].Errors != 0 {
+		t.Fatalf("%+v", status)
+	}
+}
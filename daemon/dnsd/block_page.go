@@ -0,0 +1,179 @@
+package dnsd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// BlockPageResponseTTL is the TTL of the block page address given to black listed names. It is kept short so that
+	// a temporarily allowed name resolves to its real address soon after.
+	BlockPageResponseTTL = 30
+	// MaxTemporaryAllowDuration is the longest duration a black listed name may be temporarily allowed for.
+	MaxTemporaryAllowDuration = 24 * time.Hour
+	// MaxBlockedQueryStatsNames is the maximum number of distinct names counted individually by the blocked query statistics.
+	MaxBlockedQueryStatsNames = 1000
+)
+
+// BlockedQueryStats counts the queries of black listed names since the DNS daemon was initialised.
+type BlockedQueryStats struct {
+	// Total is the number of queries of all black listed names.
+	Total int64
+	// ByCategory is the number of queries of each category of black listed names.
+	ByCategory map[string]int64
+	// ByName is the number of queries of each black listed name, up to MaxBlockedQueryStatsNames distinct names.
+	ByName map[string]int64
+	// Since is the time the statistics started counting.
+	Since time.Time
+}
+
+// newBlockedQueryStats returns an empty set of statistics counting from now.
+func newBlockedQueryStats() BlockedQueryStats {
+	return BlockedQueryStats{
+		ByCategory: make(map[string]int64),
+		ByName:     make(map[string]int64),
+		Since:      time.Now(),
+	}
+}
+
+// normaliseBlacklistName returns the name in lower case and without the rightmost dot.
+func normaliseBlacklistName(nameOrIP string) string {
+	nameOrIP = strings.ToLower(strings.TrimSpace(nameOrIP))
+	return strings.TrimSuffix(nameOrIP, ".")
+}
+
+/*
+blacklistCandidates returns the normalised input name followed by all of its parent domain names that can be used to
+find a blacklist match. If "a.com" is blacklisted, then "alpha.a.com" and "beta.alpha.a.com" are also considered
+blacklisted.
+*/
+func blacklistCandidates(nameOrIP string) []string {
+	nameOrIP = normaliseBlacklistName(nameOrIP)
+	candidates := make([]string, 0, 4)
+	candidates = append(candidates, nameOrIP)
+	for {
+		// Remove sub-domain name prefix
+		index := strings.IndexRune(nameOrIP, '.')
+		if index < 1 || index == len(nameOrIP)-1 {
+			break
+		}
+		nameOrIP = nameOrIP[index+1:]
+		if len(nameOrIP) < 4 {
+			// It is impossible to have a domain name shorter than 4 characters, therefore stop further stripping.
+			continue
+		}
+		candidates = append(candidates, nameOrIP)
+	}
+	return candidates
+}
+
+// matchBlacklist returns the first candidate found in the black list, or an empty string if none of them is black listed.
+func (daemon *Daemon) matchBlacklist(candidates []string) string {
+	daemon.blackListMutex.RLock()
+	defer daemon.blackListMutex.RUnlock()
+	for _, candidate := range candidates {
+		if _, blacklisted := daemon.blackList[candidate]; blacklisted {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// isTemporarilyAllowed returns true if any of the candidates is temporarily exempted from the black list.
+func (daemon *Daemon) isTemporarilyAllowed(candidates []string) bool {
+	daemon.blockPageMutex.Lock()
+	defer daemon.blockPageMutex.Unlock()
+	if len(daemon.temporarilyAllowed) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, candidate := range candidates {
+		if expiry, exists := daemon.temporarilyAllowed[candidate]; exists && now.Before(expiry) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateBlackListCategories replaces the categories of black listed names, e.g. "ads" and "scam".
+func (daemon *Daemon) UpdateBlackListCategories(categories map[string]string) {
+	daemon.blackListMutex.Lock()
+	daemon.blackListCategories = categories
+	daemon.blackListMutex.Unlock()
+}
+
+/*
+GetBlacklistCategory returns the category of the black listed name, or an empty string if the name is not black
+listed. A name that is black listed without a known category belongs to DefaultBlacklistCategory.
+*/
+func (daemon *Daemon) GetBlacklistCategory(nameOrIP string) string {
+	matched := daemon.matchBlacklist(blacklistCandidates(nameOrIP))
+	if matched == "" {
+		return ""
+	}
+	daemon.blackListMutex.RLock()
+	defer daemon.blackListMutex.RUnlock()
+	if category := daemon.blackListCategories[matched]; category != "" {
+		return category
+	}
+	return DefaultBlacklistCategory
+}
+
+/*
+AllowTemporarily exempts a black listed name and its sub-domain names from the black list for the duration. The DNS
+server resolves the name as usual during the time, and so do the other daemons that use the black list.
+*/
+func (daemon *Daemon) AllowTemporarily(name string, duration time.Duration) error {
+	name = normaliseBlacklistName(name)
+	if len(name) < 4 || len(name) > 255 {
+		return fmt.Errorf("dnsd.AllowTemporarily: invalid name %q", name)
+	}
+	if duration <= 0 || duration > MaxTemporaryAllowDuration {
+		return fmt.Errorf("dnsd.AllowTemporarily: duration must be within (0, %v]", MaxTemporaryAllowDuration)
+	}
+	if daemon.matchBlacklist(blacklistCandidates(name)) == "" {
+		return errors.New("dnsd.AllowTemporarily: the name is not black listed")
+	}
+	now := time.Now()
+	daemon.blockPageMutex.Lock()
+	defer daemon.blockPageMutex.Unlock()
+	for allowedName, expiry := range daemon.temporarilyAllowed {
+		if now.After(expiry) {
+			delete(daemon.temporarilyAllowed, allowedName)
+		}
+	}
+	daemon.temporarilyAllowed[name] = now.Add(duration)
+	daemon.logger.Info("", nil, "temporarily allowed black listed name %q for %v", name, duration)
+	return nil
+}
+
+// recordBlockedQuery counts a query of the black listed name in the blocked query statistics.
+func (daemon *Daemon) recordBlockedQuery(name string) {
+	name = normaliseBlacklistName(name)
+	category := daemon.GetBlacklistCategory(name)
+	daemon.blockPageMutex.Lock()
+	defer daemon.blockPageMutex.Unlock()
+	daemon.blockedQueryStats.Total++
+	daemon.blockedQueryStats.ByCategory[category]++
+	if _, exists := daemon.blockedQueryStats.ByName[name]; exists || len(daemon.blockedQueryStats.ByName) < MaxBlockedQueryStatsNames {
+		daemon.blockedQueryStats.ByName[name]++
+	}
+}
+
+// GetBlockedQueryStats returns a copy of the statistics of blocked queries.
+func (daemon *Daemon) GetBlockedQueryStats() BlockedQueryStats {
+	daemon.blockPageMutex.Lock()
+	defer daemon.blockPageMutex.Unlock()
+	ret := daemon.blockedQueryStats
+	ret.ByCategory = make(map[string]int64, len(daemon.blockedQueryStats.ByCategory))
+	for category, count := range daemon.blockedQueryStats.ByCategory {
+		ret.ByCategory[category] = count
+	}
+	ret.ByName = make(map[string]int64, len(daemon.blockedQueryStats.ByName))
+	for name, count := range daemon.blockedQueryStats.ByName {
+		ret.ByName[name] = count
+	}
+	return ret
+}
@@ -0,0 +1,108 @@
+package dnsd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDaemon_BlockPage(t *testing.T) {
+	daemon := &Daemon{BlockPageIP: "not an ip"}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	daemon.BlockPageIP = "192.168.1.1"
+	daemon.BlockPageIPv6 = "192.168.1.1"
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	daemon.BlockPageIPv6 = "fe80::1"
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.blackList["ads.example.com"] = struct{}{}
+	daemon.blackList["tracker.example.net"] = struct{}{}
+	daemon.UpdateBlackListCategories(map[string]string{"ads.example.com": "ads"})
+
+	// Categories
+	if cat := daemon.GetBlacklistCategory("www.ADS.example.com."); cat != "ads" {
+		t.Fatal(cat)
+	}
+	if cat := daemon.GetBlacklistCategory("tracker.example.net"); cat != DefaultBlacklistCategory {
+		t.Fatal(cat)
+	}
+	if cat := daemon.GetBlacklistCategory("example.com"); cat != "" {
+		t.Fatal(cat)
+	}
+
+	// Statistics
+	daemon.recordBlockedQuery("ads.example.com.")
+	daemon.recordBlockedQuery("a.ads.example.com")
+	daemon.recordBlockedQuery("tracker.example.net")
+	stats := daemon.GetBlockedQueryStats()
+	if stats.Total != 3 || stats.ByCategory["ads"] != 2 || stats.ByCategory[DefaultBlacklistCategory] != 1 ||
+		stats.ByName["ads.example.com"] != 1 || stats.ByName["a.ads.example.com"] != 1 {
+		t.Fatalf("%+v", stats)
+	}
+	// The returned statistics are a copy
+	stats.ByName["ads.example.com"] = 100
+	if daemon.GetBlockedQueryStats().ByName["ads.example.com"] != 1 {
+		t.Fatal("did not return a copy")
+	}
+
+	// Temporary allow
+	if err := daemon.AllowTemporarily("example.org", time.Minute); err == nil {
+		t.Fatal("should not allow a name that is not black listed")
+	}
+	if err := daemon.AllowTemporarily("ads.example.com", MaxTemporaryAllowDuration+time.Second); err == nil {
+		t.Fatal("should not allow an excessive duration")
+	}
+	if err := daemon.AllowTemporarily("a.ads.example.com", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if daemon.IsInBlacklist("a.ads.example.com") || daemon.IsInBlacklist("b.a.ads.example.com") {
+		t.Fatal("should have been temporarily allowed")
+	}
+	if !daemon.IsInBlacklist("ads.example.com") || !daemon.IsInBlacklist("c.ads.example.com") {
+		t.Fatal("should have remained in the black list")
+	}
+	daemon.temporarilyAllowed["a.ads.example.com"] = time.Now().Add(-time.Second)
+	if !daemon.IsInBlacklist("a.ads.example.com") {
+		t.Fatal("the exemption should have expired")
+	}
+}
+
+func TestBuildBlockPageAddrResponse(t *testing.T) {
+	name := dnsmessage.MustNewName("ads.example.com.")
+	for _, test := range []struct {
+		qType      dnsmessage.Type
+		ipv4, ipv6 net.IP
+		want       net.IP
+	}{
+		{dnsmessage.TypeA, net.ParseIP("192.168.1.1"), nil, net.ParseIP("192.168.1.1")},
+		{dnsmessage.TypeA, nil, net.ParseIP("fe80::1"), net.ParseIP("0.0.0.0")},
+		{dnsmessage.TypeAAAA, nil, net.ParseIP("fe80::1"), net.ParseIP("fe80::1")},
+		{dnsmessage.TypeAAAA, net.ParseIP("192.168.1.1"), nil, net.ParseIP("::1")},
+	} {
+		respBody, err := BuildBlockPageAddrResponse(dnsmessage.Header{ID: 1}, dnsmessage.Question{Name: name, Type: test.qType, Class: dnsmessage.ClassINET}, test.ipv4, test.ipv6)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(respBody); err != nil || len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != BlockPageResponseTTL {
+			t.Fatal(err, msg)
+		}
+		var got net.IP
+		switch body := msg.Answers[0].Body.(type) {
+		case *dnsmessage.AResource:
+			got = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			got = net.IP(body.AAAA[:])
+		}
+		if !got.Equal(test.want) {
+			t.Fatalf("%+v: got %v", test, got)
+		}
+	}
+}
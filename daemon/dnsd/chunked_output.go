@@ -0,0 +1,137 @@
+package dnsd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// MaxSingleTextResponseLen is the maximum length of app command output that is answered in a single TXT entry.
+	// Longer outputs are answered in chunks.
+	MaxSingleTextResponseLen = 200
+	// ChunkedOutputChunkLen is the length of each chunk of a long app command output. Together with the chunk header
+	// and the question, the response fits into the conventional 512 bytes DNS message size.
+	ChunkedOutputChunkLen = 180
+	// ChunkedOutputRetentionSec is the duration for which the chunks of a long app command output remain retrievable.
+	ChunkedOutputRetentionSec = 600
+	// MaxChunkedOutputs is the maximum number of long app command outputs kept for chunk retrieval.
+	MaxChunkedOutputs = 100
+	// MaxChunkedOutputLen is the maximum length of app command output available for chunk retrieval, longer
+	// outputs are truncated.
+	MaxChunkedOutputLen = 64 * 1024
+)
+
+/*
+RegexChunkQueryLabel matches the first label of a query that retrieves a chunk of long app command output, which is
+"_" followed by the output ID, "_", the chunk sequence number, and an optional "_" followed by an arbitrary number that
+helps the retry of the same chunk to bypass the caches of recursive resolvers.
+*/
+var RegexChunkQueryLabel = regexp.MustCompile(`^_([0-9a-f]{16})_([0-9]+)(?:_[0-9]+)?$`)
+
+// chunkedOutput is a long app command output split into chunks for retrieval.
+type chunkedOutput struct {
+	chunks    []string
+	outputSum uint32
+	expiry    time.Time
+}
+
+/*
+ChunkedOutputs keeps long app command outputs for their retrieval in chunks. Each chunk is answered along with a header
+"SEQ/TOTAL ID CHUNK-CRC32 OUTPUT-CRC32", in which the checksums (CRC32-IEEE in hex) let the client verify each chunk
+and the reassembled output, and retry the retrieval of a corrupted chunk.
+*/
+type ChunkedOutputs struct {
+	outputs map[string]*chunkedOutput
+	// idSalt makes the output IDs impossible to derive from the outputs themselves.
+	idSalt []byte
+	mutex  *sync.Mutex
+}
+
+// NewChunkedOutputs returns an initialised store of long app command outputs.
+func NewChunkedOutputs() *ChunkedOutputs {
+	return &ChunkedOutputs{
+		outputs: make(map[string]*chunkedOutput),
+		idSalt:  misc.RandomBytes(32),
+		mutex:   new(sync.Mutex),
+	}
+}
+
+/*
+Store splits the output into chunks and keeps them for retrieval, and returns the ID of the output. Storing the same
+output again, for example when a recursive resolver repeats a query, yields the same ID.
+*/
+func (store *ChunkedOutputs) Store(output string, now time.Time) string {
+	if len(output) > MaxChunkedOutputLen {
+		output = output[:MaxChunkedOutputLen]
+	}
+	digest := sha256.Sum256(append(append([]byte{}, store.idSalt...), output...))
+	id := hex.EncodeToString(digest[:8])
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for existingID, existing := range store.outputs {
+		if !now.Before(existing.expiry) {
+			delete(store.outputs, existingID)
+		}
+	}
+	if existing, exists := store.outputs[id]; exists {
+		existing.expiry = now.Add(ChunkedOutputRetentionSec * time.Second)
+		return id
+	}
+	if len(store.outputs) >= MaxChunkedOutputs {
+		// Make room by evicting the output that expires the soonest
+		var soonestID string
+		for existingID, existing := range store.outputs {
+			if soonestID == "" || existing.expiry.Before(store.outputs[soonestID].expiry) {
+				soonestID = existingID
+			}
+		}
+		delete(store.outputs, soonestID)
+	}
+	store.outputs[id] = &chunkedOutput{
+		chunks:    misc.SplitIntoSlice(output, ChunkedOutputChunkLen, len(output)),
+		outputSum: crc32.ChecksumIEEE([]byte(output)),
+		expiry:    now.Add(ChunkedOutputRetentionSec * time.Second),
+	}
+	return id
+}
+
+// GetChunk returns the header and content of the chunk of the sequence number (starting from 0), or false if the
+// output or the chunk does not exist.
+func (store *ChunkedOutputs) GetChunk(id string, seq int, now time.Time) (header, chunk string, found bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	output, exists := store.outputs[id]
+	if !exists || !now.Before(output.expiry) || seq < 0 || seq >= len(output.chunks) {
+		return "", "", false
+	}
+	chunk = output.chunks[seq]
+	header = fmt.Sprintf("%d/%d %s %08x %08x", seq, len(output.chunks), id, crc32.ChecksumIEEE([]byte(chunk)), output.outputSum)
+	return header, chunk, true
+}
+
+// ParseChunkQuery returns the output ID and chunk sequence number of a chunk retrieval query, or false if the query
+// labels (excluding the domain name) do not retrieve a chunk.
+func ParseChunkQuery(labels []string) (id string, seq int, ok bool) {
+	if len(labels) != 1 {
+		return "", 0, false
+	}
+	// Resolvers may randomise the letter case of a query (DNS 0x20 encoding)
+	match := RegexChunkQueryLabel.FindStringSubmatch(strings.ToLower(labels[0]))
+	if match == nil {
+		return "", 0, false
+	}
+	seq, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", 0, false
+	}
+	return match[1], seq, true
+}
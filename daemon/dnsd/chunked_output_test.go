@@ -0,0 +1,115 @@
+package dnsd
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestChunkedOutputs(t *testing.T) {
+	store := NewChunkedOutputs()
+	now := time.Now()
+	output := strings.Repeat("0123456789", 50)
+	id := store.Store(output, now)
+	if len(id) != 16 || store.Store(output, now) != id || len(store.outputs) != 1 {
+		t.Fatal(id, len(store.outputs))
+	}
+	// Reassemble the output from its chunks
+	var reassembled string
+	for seq := 0; ; seq++ {
+		header, chunk, found := store.GetChunk(id, seq, now)
+		if !found {
+			if seq != 3 {
+				t.Fatal(seq)
+			}
+			break
+		}
+		want := fmt.Sprintf("%d/3 %s %08x %08x", seq, id, crc32.ChecksumIEEE([]byte(chunk)), crc32.ChecksumIEEE([]byte(output)))
+		if header != want || len(chunk) > ChunkedOutputChunkLen {
+			t.Fatal(header, want, len(chunk))
+		}
+		reassembled += chunk
+	}
+	if reassembled != output {
+		t.Fatal(reassembled)
+	}
+	// Chunks expire
+	if _, _, found := store.GetChunk(id, 0, now.Add(ChunkedOutputRetentionSec*time.Second)); found {
+		t.Fatal("should have expired")
+	}
+	store.Store("another output", now.Add(ChunkedOutputRetentionSec*time.Second))
+	if _, exists := store.outputs[id]; exists || len(store.outputs) != 1 {
+		t.Fatal("did not evict expired output")
+	}
+	// Limit the number of outputs
+	for i := 0; i < MaxChunkedOutputs+10; i++ {
+		store.Store(fmt.Sprint(i), now)
+	}
+	if len(store.outputs) != MaxChunkedOutputs {
+		t.Fatal(len(store.outputs))
+	}
+}
+
+func TestParseChunkQuery(t *testing.T) {
+	for _, test := range []struct {
+		labels []string
+		id     string
+		seq    int
+		ok     bool
+	}{
+		{labels: []string{"_0123456789abcdef_12"}, id: "0123456789abcdef", seq: 12, ok: true},
+		{labels: []string{"_0123456789ABCDEF_3_7"}, id: "0123456789abcdef", seq: 3, ok: true},
+		{labels: []string{"_0123456789abcdef_"}},
+		{labels: []string{"_0123456789abcde_1"}},
+		{labels: []string{"_mypassword1420s0echo"}},
+		{labels: []string{"_0123456789abcdef_1", "extra"}},
+	} {
+		id, seq, ok := ParseChunkQuery(test.labels)
+		if id != test.id || seq != test.seq || ok != test.ok {
+			t.Fatal(test, id, seq, ok)
+		}
+	}
+}
+
+func TestDaemon_ChunkQuery(t *testing.T) {
+	daemon := &Daemon{MyDomainNames: []string{"example.com"}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	output := strings.Repeat("a", ChunkedOutputChunkLen) + "b"
+	id := daemon.chunkedOutputs.Store(output, time.Now())
+	query := func(label string) []string {
+		question := dnsmessage.Question{Name: dnsmessage.MustNewName(label + ".example.com."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}
+		respBody := daemon.handleTextQuery("127.0.0.1", nil, nil, nil, dnsmessage.Header{ID: 1}, question)
+		var parser dnsmessage.Parser
+		if _, err := parser.Start(respBody); err != nil {
+			t.Fatal(err)
+		}
+		if err := parser.SkipAllQuestions(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parser.AnswerHeader(); err != nil {
+			t.Fatal(err)
+		}
+		txt, err := parser.TXTResource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return txt.TXT
+	}
+	if txt := query(fmt.Sprintf("_%s_1", strings.ToUpper(id))); len(txt) != 2 || !strings.HasPrefix(txt[0], "1/2 "+id) || txt[1] != "b" {
+		t.Fatal(txt)
+	}
+	// Retry the same chunk using a different name to bypass resolver caches
+	if txt := query(fmt.Sprintf("_%s_0_1", id)); len(txt) != 2 || !strings.HasPrefix(txt[0], "0/2 "+id) || len(txt[1]) != ChunkedOutputChunkLen {
+		t.Fatal(txt)
+	}
+	// The total number of chunks is 0 if the output does not exist
+	if txt := query(fmt.Sprintf("_%s_2", id)); len(txt) != 2 || txt[0] != "2/0 "+id || txt[1] != "" {
+		t.Fatal(txt)
+	}
+}
@@ -2,6 +2,7 @@ package dnsd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sort"
@@ -37,6 +38,11 @@ const (
 		as DNS query input has to be pretty short.
 	*/
 	ToolboxCommandPrefix = '_'
+	/*
+		ToolboxBinaryCommandPrefix is the first label of a TXT query that carries a binary (base32-encoded) phone-home
+		report, which is much more compact than a DTMF-encoded toolbox command.
+	*/
+	ToolboxBinaryCommandPrefix = "__"
 
 	// ProxyPrefix is the name prefix DNS clients need to put in front of their
 	// address queries to send the query to the TCP-over-DNS proxy.
@@ -98,6 +104,9 @@ type Daemon struct {
 	// Forwarders are recursive DNS resolvers for all query types. All resolvers
 	// must support both TCP and UDP.
 	Forwarders []string `json:"Forwarders"`
+	// QNameMinimisation resolves the recursive queries iteratively from the root name servers with minimised query names
+	// (RFC 9156) instead of forwarding the full query names to the Forwarders, which are only used if the resolution fails.
+	QNameMinimisation bool `json:"QNameMinimisation"`
 	// Processor enables execution of toolbox commands via DNS TXT queries when
 	// the queries are directed at the server's own domain name(s).
 	Processor *toolbox.CommandProcessor `json:"-"`
@@ -114,13 +123,37 @@ type Daemon struct {
 	// CustomRecords are the user-defined DNS records for which the DNS server
 	// will respond authoritatively.
 	CustomRecords map[string]*CustomRecord `json:"CustomRecords"`
+	// BlockPageIP is the (optional) IPv4 address of the laitos web server that serves the block page. When set, the
+	// DNS server answers A queries of black listed names with this address instead of the black hole address 0.0.0.0,
+	// so that a visitor learns why the name is blocked and may allow it temporarily.
+	BlockPageIP string `json:"BlockPageIP"`
+	// BlockPageIPv6 is the (optional) IPv6 address of the web server that serves the block page, used for AAAA queries.
+	BlockPageIPv6 string `json:"BlockPageIPv6"`
+	// Blacklists are the black lists to download and combine, the daemon uses DefaultBlacklistSubscriptions if left empty.
+	Blacklists []BlacklistSubscription `json:"Blacklists"`
+	// BlacklistRefreshIntervalSec is the interval between downloads of the black lists, it defaults to 12 hours.
+	BlacklistRefreshIntervalSec int `json:"BlacklistRefreshIntervalSec"`
 
 	UDPPort int `json:"UDPPort"` // UDP port to listen on
 	TCPPort int `json:"TCPPort"` // TCP port to listen on
+	// TLSPort is the port of DNS-over-TLS listener, it defaults to 853 when the TLS certificate is configured.
+	TLSPort int `json:"TLSPort"`
+	// TLSCertPath is the path to the TLS certificate of DNS-over-TLS listener, which only starts when this is set.
+	TLSCertPath string `json:"TLSCertPath"`
+	// TLSKeyPath is the path to the TLS certificate key of DNS-over-TLS listener.
+	TLSKeyPath string `json:"TLSKeyPath"`
+	// Listeners are the (optional) additional address and port pairs to listen on, each with its own allowed clients.
+	Listeners []*Listener `json:"Listeners"`
+	// MDNS is an (optional) multicast DNS responder that announces the host name and selected services on the LAN.
+	MDNS *MDNSResponder `json:"MDNS"`
 
 	tcpServer      *common.TCPServer
 	udpServer      *common.UDPServer
+	tlsServer      *common.TCPServer
+	tlsConfig      *tls.Config
 	queryRateLimit *lalog.RateLimit
+	// blacklistSubs downloads and combines the black lists periodically.
+	blacklistSubs *BlacklistSubscriptions
 
 	// TCPProxy is a TCP-over-DNS proxy server.
 	TCPProxy *Proxy `json:"TCPProxy"`
@@ -129,6 +162,10 @@ type Daemon struct {
 
 	// latestCommands caches the result of recently executed toolbox commands.
 	latestCommands *LatestCommands
+	// chunkedOutputs keeps long app command outputs for retrieval in chunks.
+	chunkedOutputs *ChunkedOutputs
+	// qnameMinimiser resolves the recursive queries with minimised query names when QNameMinimisation is enabled.
+	qnameMinimiser *QNameMinimiser
 	// responseCache caches the responses of recently made queries.
 	responseCache *ResponseCache
 	// processQueryTestCaseFunc works along side DNS query processing routine, it offers queried name to test case for inspection.
@@ -143,6 +180,18 @@ type Daemon struct {
 	// such as the HTTP proxy and sockd.
 	blackList      map[string]struct{}
 	blackListMutex *sync.RWMutex
+	// blackListCategories maps black listed domain names to their category, e.g. "ads".
+	blackListCategories map[string]string
+
+	blockPageIPv4, blockPageIPv6 net.IP
+	// temporarilyAllowed maps black listed names to the time their exemption from the black list expires.
+	temporarilyAllowed map[string]time.Time
+	blockedQueryStats  BlockedQueryStats
+	blockPageMutex     *sync.Mutex
+
+	// dynamicTXT maps the lower case DNS names (without the trailing full-stop) to the text records set at run time.
+	dynamicTXT      map[string][]string
+	dynamicTXTMutex *sync.RWMutex
 
 	allowQueryMutex *sync.Mutex
 
@@ -180,10 +229,15 @@ func (daemon *Daemon) Initialise() error {
 		daemon.Forwarders = make([]string, len(DefaultForwarders))
 		copy(daemon.Forwarders, DefaultForwarders)
 	}
+	if daemon.QNameMinimisation {
+		daemon.qnameMinimiser = &QNameMinimiser{}
+		daemon.qnameMinimiser.Initialise()
+	}
 	daemon.logger = &lalog.Logger{
 		ComponentName: "dnsd",
 		ComponentID:   []lalog.LoggerIDField{{Key: "TCP", Value: daemon.TCPPort}, {Key: "UDP", Value: daemon.UDPPort}},
 	}
+	registerPrometheusMetrics(daemon.logger)
 	if daemon.Processor == nil || daemon.Processor.IsEmpty() {
 		daemon.logger.Info("", nil, "daemon will not be able to execute toolbox commands due to lack of command processor filter configuration")
 		daemon.Processor = toolbox.GetEmptyCommandProcessor()
@@ -233,14 +287,55 @@ func (daemon *Daemon) Initialise() error {
 		daemon.allowQueryFromCidrNets = append(daemon.allowQueryFromCidrNets, cidrNet)
 	}
 
+	if daemon.BlockPageIP != "" {
+		if daemon.blockPageIPv4 = net.ParseIP(daemon.BlockPageIP).To4(); daemon.blockPageIPv4 == nil {
+			return fmt.Errorf("Initialise: BlockPageIP %q must be an IPv4 address", daemon.BlockPageIP)
+		}
+	}
+	if daemon.BlockPageIPv6 != "" {
+		if daemon.blockPageIPv6 = net.ParseIP(daemon.BlockPageIPv6); daemon.blockPageIPv6 == nil || daemon.blockPageIPv6.To4() != nil {
+			return fmt.Errorf("Initialise: BlockPageIPv6 %q must be an IPv6 address", daemon.BlockPageIPv6)
+		}
+	}
+
+	if len(daemon.Blacklists) == 0 {
+		daemon.Blacklists = DefaultBlacklistSubscriptions()
+	}
+	if daemon.BlacklistRefreshIntervalSec < 1 {
+		daemon.BlacklistRefreshIntervalSec = BlacklistUpdateIntervalSec
+	}
+	daemon.blacklistSubs = &BlacklistSubscriptions{Subscriptions: daemon.Blacklists, MaxEntries: BlacklistMaxEntries}
+	if err := daemon.blacklistSubs.Initialise(daemon.logger); err != nil {
+		return fmt.Errorf("dnsd.Initialise: %w", err)
+	}
 	daemon.blackListMutex = new(sync.RWMutex)
 	daemon.blackList = make(map[string]struct{})
+	daemon.blackListCategories = make(map[string]string)
+	daemon.blockPageMutex = new(sync.Mutex)
+	daemon.temporarilyAllowed = make(map[string]time.Time)
+	daemon.blockedQueryStats = newBlockedQueryStats()
+	daemon.dynamicTXT = make(map[string][]string)
+	daemon.dynamicTXTMutex = new(sync.RWMutex)
 
 	daemon.latestCommands = NewLatestCommands()
+	daemon.chunkedOutputs = NewChunkedOutputs()
 	daemon.responseCache = NewResponseCache(5*time.Second, 200)
 	daemon.tcpServer = common.NewTCPServer(daemon.Address, daemon.TCPPort, "dnsd", daemon, daemon.PerIPLimit)
 	daemon.udpServer = common.NewUDPServer(daemon.Address, daemon.UDPPort, "dnsd", daemon, daemon.PerIPLimit)
-	daemon.queryRateLimit = lalog.NewRateLimit(1, daemon.PerIPQueryLimit, daemon.logger)
+	if err := daemon.initialiseDoT(); err != nil {
+		return err
+	}
+	for _, listener := range daemon.Listeners {
+		if err := listener.initialise(daemon); err != nil {
+			return err
+		}
+	}
+	if daemon.MDNS != nil {
+		if err := daemon.MDNS.Initialise(daemon.logger); err != nil {
+			return err
+		}
+	}
+	daemon.queryRateLimit = lalog.NewSharedRateLimit("dnsd", 1, daemon.PerIPQueryLimit, daemon.logger)
 	if daemon.TCPProxy != nil && daemon.TCPProxy.RequestOTPSecret != "" {
 		daemon.TCPProxy.DNSDaemon = daemon
 	}
@@ -248,11 +343,16 @@ func (daemon *Daemon) Initialise() error {
 }
 
 // isRecursiveQueryAllowed checks whether the input client IP is allowed to make
-// recursive queries to this DNS server.
-func (daemon *Daemon) isRecursiveQueryAllowed(clientIP string) bool {
+// recursive queries to this DNS server via the listener (nil for the main
+// listener).
+func (daemon *Daemon) isRecursiveQueryAllowed(clientIP string, listener *Listener) bool {
 	if clientIP == "" || len(clientIP) > 64 {
 		return false
 	}
+	// The listener that restricts its clients allows all of them to query.
+	if listener.hasClientRestriction() {
+		return listener.isClientAllowed(clientIP)
+	}
 	// Fast track - always allow this host to query itself.
 	if strings.HasPrefix(clientIP, "127.") || clientIP == "::1" || clientIP == inet.GetPublicIP().String() {
 		return true
@@ -357,7 +457,7 @@ func (daemon *Daemon) StartAndBlock() error {
 	defer cancelBlacklistUpdate()
 	periodicBlacklistUpdate := &misc.Periodic{
 		LogActorName: "dnsd-update-blacklist",
-		Interval:     BlacklistUpdateIntervalSec * time.Second,
+		Interval:     time.Duration(daemon.BlacklistRefreshIntervalSec) * time.Second,
 		MaxInt:       1,
 		Func: func(ctx context.Context, round, _ int) error {
 			if round == 0 {
@@ -368,7 +468,13 @@ func (daemon *Daemon) StartAndBlock() error {
 					return ctx.Err()
 				}
 			}
-			daemon.UpdateBlackList(DownloadAllBlacklists(BlacklistMaxEntries, daemon.logger))
+			categorised := daemon.blacklistSubs.Refresh(ctx)
+			names := make([]string, 0, len(categorised))
+			for name := range categorised {
+				names = append(names, name)
+			}
+			daemon.UpdateBlackList(names)
+			daemon.UpdateBlackListCategories(categorised)
 			return nil
 		},
 	}
@@ -395,22 +501,34 @@ func (daemon *Daemon) StartAndBlock() error {
 
 	// Start the DNS listeners on all ports.
 	numListeners := 0
-	errChan := make(chan error, 2)
-	if daemon.UDPPort != 0 {
+	errChan := make(chan error, 4+2*len(daemon.Listeners))
+	startServer := func(startAndBlock func() error) {
 		numListeners++
 		go func() {
-			err := daemon.udpServer.StartAndBlock()
+			err := startAndBlock()
 			errChan <- err
 			cancelBlacklistUpdate()
 		}()
 	}
+	if daemon.UDPPort != 0 {
+		startServer(daemon.udpServer.StartAndBlock)
+	}
 	if daemon.TCPPort != 0 {
-		numListeners++
-		go func() {
-			err := daemon.tcpServer.StartAndBlock()
-			errChan <- err
-			cancelBlacklistUpdate()
-		}()
+		startServer(daemon.tcpServer.StartAndBlock)
+	}
+	if daemon.TLSPort != 0 {
+		startServer(daemon.tlsServer.StartAndBlock)
+	}
+	for _, listener := range daemon.Listeners {
+		if listener.UDPPort != 0 {
+			startServer(listener.udpServer.StartAndBlock)
+		}
+		if listener.TCPPort != 0 {
+			startServer(listener.tcpServer.StartAndBlock)
+		}
+	}
+	if daemon.MDNS != nil {
+		startServer(daemon.MDNS.StartAndBlock)
 	}
 	for i := 0; i < numListeners; i++ {
 		if err := <-errChan; err != nil {
@@ -421,56 +539,84 @@ func (daemon *Daemon) StartAndBlock() error {
 	return nil
 }
 
+// IsRunning returns true only if all of the configured TCP and UDP listeners are accepting queries.
+func (daemon *Daemon) IsRunning() bool {
+	if daemon.UDPPort != 0 && !daemon.udpServer.IsRunning() {
+		return false
+	}
+	if daemon.TCPPort != 0 && !daemon.tcpServer.IsRunning() {
+		return false
+	}
+	if daemon.TLSPort != 0 && !daemon.tlsServer.IsRunning() {
+		return false
+	}
+	for _, listener := range daemon.Listeners {
+		if listener.UDPPort != 0 && !listener.udpServer.IsRunning() {
+			return false
+		}
+		if listener.TCPPort != 0 && !listener.tcpServer.IsRunning() {
+			return false
+		}
+	}
+	return daemon.UDPPort != 0 || daemon.TCPPort != 0 || len(daemon.Listeners) > 0
+}
+
 // Close all of open TCP and UDP listeners so that they will cease processing incoming connections.
 func (daemon *Daemon) Stop() {
 	daemon.cancelFunc()
 	daemon.tcpServer.Stop()
 	daemon.udpServer.Stop()
+	if daemon.tlsServer != nil {
+		daemon.tlsServer.Stop()
+	}
+	for _, listener := range daemon.Listeners {
+		listener.tcpServer.Stop()
+		listener.udpServer.Stop()
+	}
+	if daemon.MDNS != nil {
+		daemon.MDNS.Stop()
+	}
 }
 
 /*
-IsInBlacklist returns true only if the input domain name or IP address is black listed. If the domain name represents
-a sub-domain name, then the function strips the sub-domain portion in order to check it against black list.
+IsInBlacklist returns true only if the input domain name or IP address is black listed and not temporarily allowed. If
+the domain name represents a sub-domain name, then the function strips the sub-domain portion in order to check it
+against black list.
 */
 func (daemon *Daemon) IsInBlacklist(nameOrIP string) bool {
 	// Treat excessively (impossibly) long input name as if it is black-listed.
 	if len(nameOrIP) > 255 || len(nameOrIP) < 4 {
 		return true
 	}
-	// The black list uses lower case letters by convention.
-	nameOrIP = strings.ToLower(strings.TrimSpace(nameOrIP))
-	// Trim the rightmost dot.
-	if nameOrIP[len(nameOrIP)-1] == '.' {
-		nameOrIP = nameOrIP[:len(nameOrIP)-1]
-	}
-	// Discover all candidate names derived from the input name that can be used
-	// to find a blacklist match.
-	// If "a.com" is blacklisted, then "alpha.a.com" and "beta.alpha.a.com" are
-	// also considered blacklisted.
-	blackListCandidates := make([]string, 0, 4)
-	blackListCandidates = append(blackListCandidates, nameOrIP)
-	for {
-		// Remove sub-domain name prefix
-		index := strings.IndexRune(nameOrIP, '.')
-		if index < 1 || index == len(nameOrIP)-1 {
-			break
-		}
-		nameOrIP = nameOrIP[index+1:]
-		if len(nameOrIP) < 4 {
-			// It is impossible to have a domain name shorter than 4 characters, therefore stop further stripping.
-			continue
-		}
-		blackListCandidates = append(blackListCandidates, nameOrIP)
+	candidates := blacklistCandidates(nameOrIP)
+	if daemon.isTemporarilyAllowed(candidates) {
+		return false
 	}
-	// Check each broken-down variation of domain name against black list
-	daemon.blackListMutex.RLock()
-	defer daemon.blackListMutex.RUnlock()
-	for _, candidate := range blackListCandidates {
-		if _, blacklisted := daemon.blackList[candidate]; blacklisted {
-			return true
-		}
+	return daemon.matchBlacklist(candidates) != ""
+}
+
+/*
+SetDynamicTXT sets the text record entries of the DNS name at run time, or removes the record if there are no entries.
+The DNS server answers TXT queries of the name authoritatively with these entries. This is used by the web server to
+answer the ACME DNS-01 challenges of the domain names delegated to this DNS server.
+*/
+func (daemon *Daemon) SetDynamicTXT(name string, entries []string) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	daemon.dynamicTXTMutex.Lock()
+	defer daemon.dynamicTXTMutex.Unlock()
+	if len(entries) == 0 {
+		delete(daemon.dynamicTXT, name)
+	} else {
+		daemon.dynamicTXT[name] = entries
 	}
-	return false
+}
+
+// getDynamicTXT returns the text record entries set at run time for the DNS name.
+func (daemon *Daemon) getDynamicTXT(name string) []string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	daemon.dynamicTXTMutex.RLock()
+	defer daemon.dynamicTXTMutex.RUnlock()
+	return daemon.dynamicTXT[name]
 }
 
 // queryLabels helps caller process an input DNS name by dissecting it into
@@ -10,6 +10,7 @@ import (
 
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/toolbox"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestUpdateBlackList(t *testing.T) {
@@ -43,27 +44,27 @@ func TestCheckAllowClientIP(t *testing.T) {
 	// Allowed by tags (client IPs) seen by store&forward message processor
 	for _, client := range []string{"123.0.0.1", "123.0.0.2", "123.0.0.3"} {
 		daemon.Processor.Features.MessageProcessor.StoreReport(context.Background(), toolbox.SubjectReportRequest{SubjectHostName: "dummy"}, client, "dummy")
-		if !daemon.isRecursiveQueryAllowed(client) {
+		if !daemon.isRecursiveQueryAllowed(client, nil) {
 			t.Fatal("should have allowed", client)
 		}
 	}
 
 	// Allowed by fast track
 	for _, client := range []string{"127.0.0.1", "::1", "127.0.100.1", inet.GetPublicIP().String()} {
-		if !daemon.isRecursiveQueryAllowed(client) {
+		if !daemon.isRecursiveQueryAllowed(client, nil) {
 			t.Fatal("should have allowed", client)
 		}
 	}
 	// Allowed by configured prefixes
 	for _, client := range []string{"192.168.1.1", "100.1.1.1"} {
-		if !daemon.isRecursiveQueryAllowed(client) {
+		if !daemon.isRecursiveQueryAllowed(client, nil) {
 			t.Fatal("should have allowed", client)
 		}
 	}
 
 	// Blocked
 	for _, client := range []string{"172.16.0.1", "193.0.0.1", "101.0.0.1", "128.0.0.1", "1.1.1.2", "0.0.0.0", "123.0.0.5"} {
-		if daemon.isRecursiveQueryAllowed(client) {
+		if daemon.isRecursiveQueryAllowed(client, nil) {
 			t.Fatal("should have blocked", client)
 		}
 	}
@@ -332,3 +333,45 @@ func TestDaemon_queryLabels(t *testing.T) {
 		})
 	}
 }
+
+func TestDaemon_SetDynamicTXT(t *testing.T) {
+	daemon := &Daemon{MyDomainNames: []string{"example.com"}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	query := func(name string) []string {
+		question := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}
+		respBody := daemon.handleTextQuery("127.0.0.1", nil, nil, nil, dnsmessage.Header{ID: 1}, question)
+		var parser dnsmessage.Parser
+		if _, err := parser.Start(respBody); err != nil {
+			t.Fatal(err)
+		}
+		if err := parser.SkipAllQuestions(); err != nil {
+			t.Fatal(err)
+		}
+		// Each entry is an individual record.
+		var entries []string
+		for {
+			if _, err := parser.AnswerHeader(); err != nil {
+				return entries
+			}
+			txt, err := parser.TXTResource()
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, txt.TXT...)
+		}
+	}
+	// The name of an ACME challenge otherwise looks like an app command.
+	if txt := query("_acme-challenge.example.com."); reflect.DeepEqual(txt, []string{"token1", "token2"}) {
+		t.Fatal(txt)
+	}
+	daemon.SetDynamicTXT("_ACME-challenge.example.com.", []string{"token1", "token2"})
+	if txt := query("_acme-challenge.Example.com."); !reflect.DeepEqual(txt, []string{"token1", "token2"}) {
+		t.Fatal(txt)
+	}
+	daemon.SetDynamicTXT("_acme-challenge.example.com", nil)
+	if txt := query("_acme-challenge.example.com."); reflect.DeepEqual(txt, []string{"token1", "token2"}) {
+		t.Fatal(txt)
+	}
+}
@@ -0,0 +1,114 @@
+package dnsd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DoHContentType is the media type of DNS queries and responses exchanged over HTTPS (RFC 8484).
+	DoHContentType = "application/dns-message"
+	// DoHDefaultPath is the conventional URL path of a DNS-over-HTTPS endpoint.
+	DoHDefaultPath = "/dns-query"
+)
+
+// dohAnyClientListener lets all DNS-over-HTTPS clients make recursive queries, as if they used a listener dedicated to them.
+var dohAnyClientListener = &Listener{allowClientCidrNets: []*net.IPNet{
+	{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+	{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+}}
+
+/*
+AnswerDoHQuery answers a DNS query received over HTTPS with the same records, blacklist, forwarders, and app command
+processor as the UDP and TCP listeners. Recursive queries are subject to the daemon's AllowQueryFromCidrs unless
+allowAnyClient is true. It returns nil if there is no appropriate response, e.g. a recursive query is not allowed.
+*/
+func (daemon *Daemon) AnswerDoHQuery(clientIP string, query []byte, allowAnyClient bool) []byte {
+	if len(query) < MinNameQuerySize || len(query) > MaxPacketSize {
+		return nil
+	}
+	var listener *Listener
+	if allowAnyClient {
+		listener = dohAnyClientListener
+	}
+	// The forwarders are reached over TCP, which carries the query length ahead of the query.
+	queryLen := []byte{byte(len(query) / 256), byte(len(query) % 256)}
+	return daemon.respondToQuery(daemon.logger, clientIP, listener, queryLen, query)
+}
+
+/*
+ServeDoH serves a DNS-over-HTTPS (RFC 8484) request, which carries the query in the base64url "dns" parameter of a GET
+request, or in the body of a POST request.
+*/
+func (daemon *Daemon) ServeDoH(w http.ResponseWriter, r *http.Request, clientIP string, allowAnyClient bool) {
+	var query []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+		if err != nil {
+			http.Error(w, "failed to decode the dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if contentType := r.Header.Get("Content-Type"); contentType != DoHContentType {
+			http.Error(w, fmt.Sprintf("content type must be %s", DoHContentType), http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = io.ReadAll(io.LimitReader(r.Body, MaxPacketSize+1))
+		if err != nil {
+			http.Error(w, "failed to read the query", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "DNS queries are made via GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(query) > MaxPacketSize {
+		http.Error(w, "the query is too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if len(query) < MinNameQuerySize {
+		http.Error(w, "the query is too small", http.StatusBadRequest)
+		return
+	}
+	respBody := daemon.AnswerDoHQuery(clientIP, query, allowAnyClient)
+	if len(respBody) == 0 {
+		http.Error(w, "the query did not yield a response", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", DoHContentType)
+	if ttl, found := getMinAnswerTTL(respBody); found {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	_, _ = w.Write(respBody)
+}
+
+// getMinAnswerTTL returns the smallest TTL among the answers of a DNS response, which is how long HTTP caches may keep it.
+func getMinAnswerTTL(respBody []byte) (ttl uint32, found bool) {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(respBody); err != nil {
+		return
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		header, err := parser.AnswerHeader()
+		if err != nil {
+			return
+		}
+		if !found || header.TTL < ttl {
+			ttl = header.TTL
+			found = true
+		}
+		if err := parser.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
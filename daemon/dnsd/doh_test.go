@@ -0,0 +1,82 @@
+package dnsd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func buildDoHTestQuery(t *testing.T, name string, qType dnsmessage.Type) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	require.NoError(t, builder.StartQuestions())
+	require.NoError(t, builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qType, Class: dnsmessage.ClassINET}))
+	query, err := builder.Finish()
+	require.NoError(t, err)
+	return query
+}
+
+func TestDaemon_ServeDoH(t *testing.T) {
+	daemon := &Daemon{
+		Address:       "127.0.0.1",
+		UDPPort:       62157,
+		TCPPort:       18527,
+		MyDomainNames: []string{"example.com"},
+		CustomRecords: map[string]*CustomRecord{
+			"example.com": {A: V4AddressRecord{AddressRecord: AddressRecord{Addresses: []string{"5.0.0.1"}}}},
+		},
+		Processor: toolbox.GetTestCommandProcessor(),
+	}
+	require.NoError(t, daemon.Initialise())
+	query := buildDoHTestQuery(t, "example.com.", dnsmessage.TypeA)
+
+	checkResponse := func(rec *httptest.ResponseRecorder) {
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		require.Equal(t, DoHContentType, rec.Header().Get("Content-Type"))
+		require.Contains(t, rec.Header().Get("Cache-Control"), "max-age=")
+		var msg dnsmessage.Message
+		require.NoError(t, msg.Unpack(rec.Body.Bytes()))
+		require.Equal(t, uint16(1234), msg.Header.ID)
+		require.Len(t, msg.Answers, 1)
+		require.Equal(t, [4]byte{5, 0, 0, 1}, msg.Answers[0].Body.(*dnsmessage.AResource).A)
+	}
+
+	// GET carries the query in the base64url encoded parameter.
+	rec := httptest.NewRecorder()
+	daemon.ServeDoH(rec, httptest.NewRequest(http.MethodGet, DoHDefaultPath+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil), "10.0.0.1", false)
+	checkResponse(rec)
+
+	// POST carries the query in the body.
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, DoHDefaultPath, bytes.NewReader(query))
+	req.Header.Set("Content-Type", DoHContentType)
+	daemon.ServeDoH(rec, req, "10.0.0.1", false)
+	checkResponse(rec)
+
+	// Malformed requests.
+	rec = httptest.NewRecorder()
+	daemon.ServeDoH(rec, httptest.NewRequest(http.MethodGet, DoHDefaultPath+"?dns=!!!", nil), "10.0.0.1", false)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = httptest.NewRecorder()
+	daemon.ServeDoH(rec, httptest.NewRequest(http.MethodPost, DoHDefaultPath, bytes.NewReader(query)), "10.0.0.1", false)
+	require.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	rec = httptest.NewRecorder()
+	daemon.ServeDoH(rec, httptest.NewRequest(http.MethodPut, DoHDefaultPath, nil), "10.0.0.1", false)
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, DoHDefaultPath, bytes.NewReader(make([]byte, MaxPacketSize+1)))
+	req.Header.Set("Content-Type", DoHContentType)
+	daemon.ServeDoH(rec, req, "10.0.0.1", false)
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+
+	// The client outside of AllowQueryFromCidrs cannot make a recursive query unless all clients are allowed.
+	require.False(t, daemon.isRecursiveQueryAllowed("10.0.0.1", nil))
+	require.True(t, daemon.isRecursiveQueryAllowed("10.0.0.1", dohAnyClientListener))
+	require.True(t, daemon.isRecursiveQueryAllowed("2001:db8::1", dohAnyClientListener))
+	require.Nil(t, daemon.AnswerDoHQuery("10.0.0.1", buildDoHTestQuery(t, "github.com.", dnsmessage.TypeA), false))
+}
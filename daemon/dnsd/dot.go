@@ -0,0 +1,102 @@
+package dnsd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// DefaultDoTPort is the port of DNS-over-TLS (RFC 7858) listener used by Android's private DNS and other clients.
+	DefaultDoTPort = 853
+	// DoTHandshakeTimeoutSec is the timeout of TLS handshake with a DNS-over-TLS client.
+	DoTHandshakeTimeoutSec = 10
+)
+
+// dotServer is the TCP application that answers DNS queries over TLS connections.
+type dotServer struct {
+	daemon *Daemon
+}
+
+// initialiseDoT loads the TLS certificate and prepares the DNS-over-TLS listener if the certificate is configured.
+func (daemon *Daemon) initialiseDoT() error {
+	if daemon.TLSCertPath == "" && daemon.TLSKeyPath == "" {
+		daemon.TLSPort = 0
+		return nil
+	}
+	if daemon.TLSCertPath == "" || daemon.TLSKeyPath == "" {
+		return errors.New("dnsd.Initialise: TLS certificate or key path is missing")
+	}
+	if daemon.TLSPort < 1 {
+		daemon.TLSPort = DefaultDoTPort
+	}
+	contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, daemon.TLSCertPath, daemon.TLSKeyPath)
+	if err != nil {
+		return fmt.Errorf("dnsd.Initialise: %w", err)
+	}
+	cert, err := tls.X509KeyPair(contents[0], contents[1])
+	if err != nil {
+		return fmt.Errorf("dnsd.Initialise: failed to load certificate or key - %v", err)
+	}
+	daemon.tlsConfig = misc.DefaultTLS.ServerConfig(cert)
+	daemon.tlsServer = common.NewTCPServer(daemon.Address, daemon.TLSPort, "dnsd-dot", &dotServer{daemon: daemon}, daemon.PerIPLimit)
+	return nil
+}
+
+// GetTCPStatsCollector returns stats collector for the TCP server of the DNS daemon.
+func (dot *dotServer) GetTCPStatsCollector() *misc.Stats {
+	return misc.DNSDStatsTCP
+}
+
+/*
+HandleTCPConnection completes TLS handshake with the client and then answers its queries, which are framed in the same
+way as DNS over TCP. The client may send many queries over the connection until it goes idle.
+*/
+func (dot *dotServer) HandleTCPConnection(logger *lalog.Logger, ip string, conn *net.TCPConn) {
+	tlsConn := tls.Server(conn, dot.daemon.tlsConfig)
+	misc.TweakTCPConnection(conn, DoTHandshakeTimeoutSec*time.Second)
+	if err := tlsConn.Handshake(); err != nil {
+		logger.Info(ip, err, "failed to complete TLS handshake")
+		return
+	}
+	for {
+		misc.TweakTCPConnection(conn, ClientTimeoutSec*time.Second)
+		queryLen := make([]byte, 2)
+		if _, err := io.ReadFull(tlsConn, queryLen); err != nil {
+			// The client closes the connection when it no longer has queries to make.
+			return
+		}
+		queryLenInteger := int(queryLen[0])*256 + int(queryLen[1])
+		if queryLenInteger > MaxPacketSize || queryLenInteger < MinNameQuerySize {
+			logger.Info(ip, nil, "invalid query length (%d) from client", queryLenInteger)
+			return
+		}
+		queryBody := make([]byte, queryLenInteger)
+		if _, err := io.ReadFull(tlsConn, queryBody); err != nil {
+			logger.Warning(ip, err, "failed to read query from client")
+			return
+		}
+		if !dot.daemon.tlsServer.AddAndCheckRateLimit(ip) {
+			return
+		}
+		respBody := dot.daemon.respondToQuery(logger, ip, nil, queryLen, queryBody)
+		if len(respBody) < 3 {
+			// Close the connection so that the client does not wait for the response.
+			return
+		}
+		resp := make([]byte, 0, 2+len(respBody))
+		resp = append(resp, byte(len(respBody)/256), byte(len(respBody)%256))
+		resp = append(resp, respBody...)
+		if _, err := tlsConn.Write(resp); err != nil {
+			logger.Warning(ip, err, "failed to answer to the client")
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package dnsd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// writeDoTTestCert writes a self-signed certificate and its key to the directory, and returns their paths.
+func writeDoTTestCert(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.example.com"},
+		DNSNames:     []string{"dns.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPath, keyPath = filepath.Join(dir, "dot.crt"), filepath.Join(dir, "dot.key")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return
+}
+
+func TestDaemon_DoT(t *testing.T) {
+	certPath, keyPath := writeDoTTestCert(t, t.TempDir())
+	require.Error(t, (&Daemon{TLSCertPath: certPath}).Initialise())
+	require.Error(t, (&Daemon{TLSCertPath: keyPath, TLSKeyPath: certPath}).Initialise())
+
+	daemon := &Daemon{Address: "127.0.0.1", UDPPort: 62158, TLSCertPath: certPath, TLSKeyPath: keyPath}
+	require.NoError(t, daemon.Initialise())
+	require.Equal(t, DefaultDoTPort, daemon.TLSPort)
+
+	daemon = &Daemon{
+		Address:       "127.0.0.1",
+		UDPPort:       62159,
+		TLSPort:       18529,
+		TLSCertPath:   certPath,
+		TLSKeyPath:    keyPath,
+		MyDomainNames: []string{"example.com"},
+		CustomRecords: map[string]*CustomRecord{
+			"example.com": {A: V4AddressRecord{AddressRecord: AddressRecord{Addresses: []string{"5.0.0.1"}}}},
+		},
+		Processor: toolbox.GetTestCommandProcessor(),
+	}
+	require.NoError(t, daemon.Initialise())
+	serverStopped := make(chan struct{})
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+		close(serverStopped)
+	}()
+	require.True(t, misc.ProbePort(30*time.Second, "127.0.0.1", 18529))
+	for i := 0; i < 30 && !daemon.IsRunning(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.True(t, daemon.IsRunning())
+
+	conn, err := tls.Dial("tcp", "127.0.0.1:18529", &tls.Config{ServerName: "dns.example.com", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	// The client may send several queries over the same connection.
+	for i := 0; i < 2; i++ {
+		query := buildDoHTestQuery(t, "example.com.", dnsmessage.TypeA)
+		_, err = conn.Write(append([]byte{byte(len(query) / 256), byte(len(query) % 256)}, query...))
+		require.NoError(t, err)
+		respLen := make([]byte, 2)
+		_, err = io.ReadFull(conn, respLen)
+		require.NoError(t, err)
+		resp := make([]byte, int(respLen[0])*256+int(respLen[1]))
+		_, err = io.ReadFull(conn, resp)
+		require.NoError(t, err)
+		var msg dnsmessage.Message
+		require.NoError(t, msg.Unpack(resp))
+		require.Equal(t, uint16(1234), msg.Header.ID)
+		require.Len(t, msg.Answers, 1)
+		require.Equal(t, [4]byte{5, 0, 0, 1}, msg.Answers[0].Body.(*dnsmessage.AResource).A)
+	}
+	daemon.Stop()
+	<-serverStopped
+}
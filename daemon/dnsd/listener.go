@@ -0,0 +1,110 @@
+package dnsd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+/*
+Listener is an additional address and port pair on which the DNS daemon listens for queries, e.g. port 53 on a LAN
+interface and port 5353 on a WireGuard interface. All listeners share the daemon's records, blacklist, and forwarders.
+*/
+type Listener struct {
+	// Address is the network address of an interface for both TCP and UDP to listen to.
+	Address string `json:"Address"`
+	// UDPPort is the UDP port to listen on, 0 means the listener does not serve UDP clients.
+	UDPPort int `json:"UDPPort"`
+	// TCPPort is the TCP port to listen on, 0 means the listener does not serve TCP clients.
+	TCPPort int `json:"TCPPort"`
+	/*
+		AllowClientCidrs are the network address blocks (both IPv4 and IPv6) from which clients may use this listener.
+		Clients from these blocks may also send recursive queries via this listener, regardless of the daemon's
+		AllowQueryFromCidrs. If left empty, the listener serves all clients in the same way as the daemon's main listener.
+	*/
+	AllowClientCidrs []string `json:"AllowClientCidrs"`
+
+	daemon              *Daemon
+	allowClientCidrNets []*net.IPNet
+	tcpServer           *common.TCPServer
+	udpServer           *common.UDPServer
+}
+
+// initialise validates the listener configuration and prepares its TCP and UDP servers.
+func (listener *Listener) initialise(daemon *Daemon) error {
+	if listener.Address == "" {
+		return fmt.Errorf("Initialise: listener Address must not be empty")
+	}
+	if listener.UDPPort < 1 && listener.TCPPort < 1 {
+		return fmt.Errorf("Initialise: listener on %q must have a TCP or UDP port", listener.Address)
+	}
+	listener.daemon = daemon
+	listener.allowClientCidrNets = make([]*net.IPNet, 0)
+	for _, cidr := range listener.AllowClientCidrs {
+		_, cidrNet, err := net.ParseCIDR(cidr)
+		if err != nil || cidr == "" {
+			return fmt.Errorf("Initialise: failed to parse AllowClientCidrs entry %q of listener on %q", cidr, listener.Address)
+		}
+		listener.allowClientCidrNets = append(listener.allowClientCidrNets, cidrNet)
+	}
+	listener.tcpServer = common.NewTCPServer(listener.Address, listener.TCPPort, "dnsd", listener, daemon.PerIPLimit)
+	listener.udpServer = common.NewUDPServer(listener.Address, listener.UDPPort, "dnsd", listener, daemon.PerIPLimit)
+	return nil
+}
+
+// hasClientRestriction returns true if the listener only serves clients from its own CIDR blocks.
+func (listener *Listener) hasClientRestriction() bool {
+	return listener != nil && len(listener.allowClientCidrNets) > 0
+}
+
+// isClientAllowed returns true if the listener does not restrict clients, or the client IP belongs to the allowed blocks.
+func (listener *Listener) isClientAllowed(clientIP string) bool {
+	if !listener.hasClientRestriction() {
+		return true
+	}
+	if strings.HasPrefix(clientIP, "127.") || clientIP == "::1" {
+		return true
+	}
+	parsedClientIP := net.ParseIP(clientIP)
+	if parsedClientIP == nil {
+		return false
+	}
+	for _, cidrNet := range listener.allowClientCidrNets {
+		if cidrNet.Contains(parsedClientIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetTCPStatsCollector returns stats collector for the TCP server of the DNS daemon.
+func (listener *Listener) GetTCPStatsCollector() *misc.Stats {
+	return misc.DNSDStatsTCP
+}
+
+// HandleTCPConnection responds to the DNS query of a TCP client that is allowed to use this listener.
+func (listener *Listener) HandleTCPConnection(logger *lalog.Logger, ip string, conn *net.TCPConn) {
+	if !listener.isClientAllowed(ip) {
+		logger.Info(ip, nil, "client IP is not allowed to use this listener")
+		return
+	}
+	listener.daemon.handleTCPConnection(logger, ip, conn, listener)
+}
+
+// GetUDPStatsCollector returns stats collector for the UDP server of the DNS daemon.
+func (listener *Listener) GetUDPStatsCollector() *misc.Stats {
+	return misc.DNSDStatsUDP
+}
+
+// HandleUDPClient responds to the DNS query of a UDP client that is allowed to use this listener.
+func (listener *Listener) HandleUDPClient(logger *lalog.Logger, ip string, client *net.UDPAddr, packet []byte, srv *net.UDPConn) {
+	if !listener.isClientAllowed(ip) {
+		logger.Info(ip, nil, "client IP is not allowed to use this listener")
+		return
+	}
+	listener.daemon.handleUDPClient(logger, ip, client, packet, srv, listener)
+}
@@ -0,0 +1,88 @@
+package dnsd
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListener_Initialise(t *testing.T) {
+	daemon := &Daemon{Listeners: []*Listener{{UDPPort: 5353}}}
+	require.Error(t, daemon.Initialise())
+	daemon = &Daemon{Listeners: []*Listener{{Address: "127.0.0.1"}}}
+	require.Error(t, daemon.Initialise())
+	daemon = &Daemon{Listeners: []*Listener{{Address: "127.0.0.1", UDPPort: 5353, AllowClientCidrs: []string{"not-a-cidr"}}}}
+	require.Error(t, daemon.Initialise())
+
+	daemon = &Daemon{
+		AllowQueryFromCidrs: []string{"192.168.0.0/16"},
+		Listeners: []*Listener{
+			{Address: "10.0.0.1", UDPPort: 5353, AllowClientCidrs: []string{"10.0.0.0/24"}},
+			{Address: "192.168.0.1", TCPPort: 53},
+		},
+	}
+	require.NoError(t, daemon.Initialise())
+	restricted, unrestricted := daemon.Listeners[0], daemon.Listeners[1]
+	// The restricted listener only serves its own clients and allows them to make recursive queries.
+	require.True(t, restricted.isClientAllowed("10.0.0.2"))
+	require.True(t, restricted.isClientAllowed("127.0.0.1"))
+	require.False(t, restricted.isClientAllowed("192.168.0.2"))
+	require.True(t, daemon.isRecursiveQueryAllowed("10.0.0.2", restricted))
+	require.False(t, daemon.isRecursiveQueryAllowed("192.168.0.2", restricted))
+	// The unrestricted listener follows the daemon's recursive query rules.
+	require.True(t, unrestricted.isClientAllowed("10.0.0.2"))
+	require.False(t, daemon.isRecursiveQueryAllowed("10.0.0.2", unrestricted))
+	require.True(t, daemon.isRecursiveQueryAllowed("192.168.0.2", unrestricted))
+	require.False(t, daemon.isRecursiveQueryAllowed("10.0.0.2", nil))
+}
+
+func TestListener_StartAndBlock(t *testing.T) {
+	daemon := &Daemon{
+		Address:       "127.0.0.1",
+		UDPPort:       62155,
+		TCPPort:       18525,
+		MyDomainNames: []string{"example.com"},
+		Listeners: []*Listener{
+			{Address: "127.0.0.1", UDPPort: 62156, TCPPort: 18526, AllowClientCidrs: []string{"10.0.0.0/8"}},
+		},
+		CustomRecords: map[string]*CustomRecord{
+			"example.com": {A: V4AddressRecord{AddressRecord: AddressRecord{Addresses: []string{"5.0.0.1"}}}},
+		},
+		Processor: toolbox.GetTestCommandProcessor(),
+	}
+	require.NoError(t, daemon.Initialise())
+	serverStopped := make(chan struct{})
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+		close(serverStopped)
+	}()
+	require.True(t, misc.ProbePort(30*time.Second, "127.0.0.1", 18526))
+	for i := 0; i < 30 && !daemon.IsRunning(); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.True(t, daemon.IsRunning())
+	for _, network := range []string{"tcp", "udp"} {
+		port := "18526"
+		if network == "udp" {
+			port = "62156"
+		}
+		resolver := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, network, "127.0.0.1:"+port)
+			},
+		}
+		addrs, err := resolver.LookupHost(context.Background(), "example.com")
+		require.NoError(t, err, network)
+		require.Equal(t, []string{"5.0.0.1"}, addrs)
+	}
+	daemon.Stop()
+	<-serverStopped
+}
@@ -0,0 +1,404 @@
+package dnsd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// MDNSPort is the UDP port of multicast DNS (RFC 6762).
+	MDNSPort = 5353
+	// MDNSHostRecordTTL is the TTL of the records that carry a host name (A, AAAA, SRV), as recommended by RFC 6762.
+	MDNSHostRecordTTL = 120
+	// MDNSOtherRecordTTL is the TTL of the other records (PTR, TXT), as recommended by RFC 6762.
+	MDNSOtherRecordTTL = 4500
+	// MDNSLegacyUnicastTTL is the maximum TTL of the records sent to a conventional DNS client that queries from a port other than 5353.
+	MDNSLegacyUnicastTTL = 10
+	// MDNSAnnounceIntervalSec is the interval between the two unsolicited announcements made when the responder starts.
+	MDNSAnnounceIntervalSec = 1
+
+	// mdnsCacheFlush is the top bit of the record class that tells the neighbours to replace their cached records of the name.
+	mdnsCacheFlush = 1 << 15
+	// mdnsUnicastResponse is the top bit of the question class that asks for a unicast response.
+	mdnsUnicastResponse = 1 << 15
+)
+
+var (
+	// mdnsIPv4Group is the IPv4 multicast address and port of multicast DNS.
+	mdnsIPv4Group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: MDNSPort}
+	// mdnsServiceTypeRegex matches a DNS-SD service type such as "_http._tcp".
+	mdnsServiceTypeRegex = regexp.MustCompile(`^_[a-z0-9-]{1,15}\._(tcp|udp)$`)
+	// mdnsServiceEnumeration is the name that lists all service types available on the network (RFC 6763).
+	mdnsServiceEnumeration = dnsmessage.MustNewName("_services._dns-sd._udp.local.")
+)
+
+// MDNSService is a network service announced on the LAN using DNS-based service discovery (RFC 6763).
+type MDNSService struct {
+	// Type is the DNS-SD service type, e.g. "_http._tcp" for a web server or "_ssh._tcp" for an SSH server.
+	Type string `json:"Type"`
+	// Name is the user-friendly instance name of the service, e.g. "laitos web server". It defaults to the host name.
+	Name string `json:"Name"`
+	// Port is the TCP or UDP port number of the service.
+	Port int `json:"Port"`
+	// TXT are the (optional) "key=value" attributes of the service, e.g. "path=/index.html".
+	TXT []string `json:"TXT"`
+
+	typeName, instanceName dnsmessage.Name
+}
+
+/*
+MDNSResponder answers multicast DNS (RFC 6762) queries of the host name and announces the selected services on the
+LAN, so that the home devices can find the laitos server by name (e.g. "laitos.local") even when the upstream DNS
+is unavailable. The responder does not probe for name conflicts, the host name should be unique on the LAN.
+*/
+type MDNSResponder struct {
+	// HostName is the host name announced in the ".local" domain, it defaults to the system host name.
+	HostName string `json:"HostName"`
+	// Interface is the (optional) name of the network interface on which the responder listens, e.g. "eth0". It
+	// defaults to the interface chosen by the operating system.
+	Interface string `json:"Interface"`
+	// Addresses are the (optional) IP addresses announced for the host name. They default to the unicast addresses
+	// of the network interfaces, excluding loopback and link-local addresses.
+	Addresses []string `json:"Addresses"`
+	// Services are the network services announced on the LAN.
+	Services []*MDNSService `json:"Services"`
+
+	hostName  dnsmessage.Name
+	addresses []net.IP
+	iface     *net.Interface
+	conn      *net.UDPConn
+	mutex     *sync.Mutex
+	logger    *lalog.Logger
+}
+
+// Initialise validates the configuration and gives default values to the unset attributes.
+func (responder *MDNSResponder) Initialise(logger *lalog.Logger) error {
+	responder.mutex = new(sync.Mutex)
+	responder.logger = logger
+	hostName := strings.ToLower(strings.TrimSuffix(strings.TrimSuffix(responder.HostName, "."), ".local"))
+	if hostName == "" {
+		systemHostName, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("MDNSResponder.Initialise: failed to determine system host name - %w", err)
+		}
+		// Use the first label of a fully qualified host name
+		hostName = strings.ToLower(strings.Split(systemHostName, ".")[0])
+	}
+	if strings.Contains(hostName, ".") || len(hostName) > 63 {
+		return fmt.Errorf("MDNSResponder.Initialise: HostName %q must be a single label", hostName)
+	}
+	responder.HostName = hostName
+	var err error
+	if responder.hostName, err = dnsmessage.NewName(hostName + ".local."); err != nil {
+		return fmt.Errorf("MDNSResponder.Initialise: invalid HostName %q - %w", hostName, err)
+	}
+	responder.iface = nil
+	if responder.Interface != "" {
+		if responder.iface, err = net.InterfaceByName(responder.Interface); err != nil {
+			return fmt.Errorf("MDNSResponder.Initialise: failed to find network interface %q - %w", responder.Interface, err)
+		}
+	}
+	responder.addresses = make([]net.IP, 0, len(responder.Addresses))
+	for _, addr := range responder.Addresses {
+		ip := net.ParseIP(strings.TrimSpace(addr))
+		if ip == nil {
+			return fmt.Errorf("MDNSResponder.Initialise: failed to parse IP address %q", addr)
+		}
+		responder.addresses = append(responder.addresses, ip)
+	}
+	for i, svc := range responder.Services {
+		if svc == nil || !mdnsServiceTypeRegex.MatchString(svc.Type) {
+			return fmt.Errorf("MDNSResponder.Initialise: service at index %d must have a Type such as \"_http._tcp\"", i)
+		}
+		if svc.Name == "" {
+			svc.Name = hostName
+		}
+		if strings.Contains(svc.Name, ".") || len(svc.Name) > 63 {
+			return fmt.Errorf("MDNSResponder.Initialise: Name %q of service at index %d must be a single label", svc.Name, i)
+		}
+		if svc.Port < 1 || svc.Port > 65535 {
+			return fmt.Errorf("MDNSResponder.Initialise: Port of service %q must be between 1 and 65535", svc.Name)
+		}
+		if svc.typeName, err = dnsmessage.NewName(svc.Type + ".local."); err != nil {
+			return fmt.Errorf("MDNSResponder.Initialise: invalid Type of service %q - %w", svc.Name, err)
+		}
+		if svc.instanceName, err = dnsmessage.NewName(svc.Name + "." + svc.Type + ".local."); err != nil {
+			return fmt.Errorf("MDNSResponder.Initialise: invalid Name of service %q - %w", svc.Name, err)
+		}
+	}
+	return nil
+}
+
+// getAddresses returns the IP addresses announced for the host name.
+func (responder *MDNSResponder) getAddresses() []net.IP {
+	if len(responder.addresses) > 0 {
+		return responder.addresses
+	}
+	// The addresses of the interfaces are determined on the fly, as they may change (e.g. DHCP) while the program runs.
+	var addrs []net.Addr
+	var err error
+	if responder.iface != nil {
+		addrs, err = responder.iface.Addrs()
+	} else {
+		addrs, err = net.InterfaceAddrs()
+	}
+	if err != nil {
+		responder.logger.Warning("", err, "failed to read network interface addresses")
+		return nil
+	}
+	ret := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+			ret = append(ret, ipNet.IP)
+		}
+	}
+	return ret
+}
+
+// hostRecords returns the A and AAAA records of the host name.
+func (responder *MDNSResponder) hostRecords() []dnsmessage.Resource {
+	ret := make([]dnsmessage.Resource, 0)
+	for _, ip := range responder.getAddresses() {
+		if v4 := ip.To4(); v4 != nil {
+			ret = append(ret, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: responder.hostName, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: MDNSHostRecordTTL},
+				Body:   &dnsmessage.AResource{A: [4]byte(v4)},
+			})
+		} else {
+			ret = append(ret, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: responder.hostName, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: MDNSHostRecordTTL},
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())},
+			})
+		}
+	}
+	return ret
+}
+
+// serviceRecords returns the PTR, SRV, and TXT records that describe the service.
+func (responder *MDNSResponder) serviceRecords(svc *MDNSService) (enumeration, ptr, srv, txt dnsmessage.Resource) {
+	enumeration = dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: mdnsServiceEnumeration, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: MDNSOtherRecordTTL},
+		Body:   &dnsmessage.PTRResource{PTR: svc.typeName},
+	}
+	ptr = dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: svc.typeName, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: MDNSOtherRecordTTL},
+		Body:   &dnsmessage.PTRResource{PTR: svc.instanceName},
+	}
+	srv = dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: svc.instanceName, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: MDNSHostRecordTTL},
+		Body:   &dnsmessage.SRVResource{Target: responder.hostName, Port: uint16(svc.Port)},
+	}
+	// A TXT record must carry at least one string, which is empty if the service does not have attributes (RFC 6763).
+	txtStrings := svc.TXT
+	if len(txtStrings) == 0 {
+		txtStrings = []string{""}
+	}
+	txt = dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: svc.instanceName, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: MDNSOtherRecordTTL},
+		Body:   &dnsmessage.TXTResource{TXT: txtStrings},
+	}
+	return
+}
+
+// allRecords returns all of the records that the responder is authoritative for, as they are announced.
+func (responder *MDNSResponder) allRecords() []dnsmessage.Resource {
+	ret := responder.hostRecords()
+	for _, svc := range responder.Services {
+		enumeration, ptr, srv, txt := responder.serviceRecords(svc)
+		ret = append(ret, enumeration, ptr, srv, txt)
+	}
+	return ret
+}
+
+// mdnsRecordSet is a list of records without duplicates.
+type mdnsRecordSet []dnsmessage.Resource
+
+func (set *mdnsRecordSet) has(rec dnsmessage.Resource) bool {
+	for _, existing := range *set {
+		if existing.Header.Type == rec.Header.Type && strings.EqualFold(existing.Header.Name.String(), rec.Header.Name.String()) && existing.Body.GoString() == rec.Body.GoString() {
+			return true
+		}
+	}
+	return false
+}
+
+func (set *mdnsRecordSet) add(recs ...dnsmessage.Resource) {
+	for _, rec := range recs {
+		if !set.has(rec) {
+			*set = append(*set, rec)
+		}
+	}
+}
+
+/*
+answer returns the answers and additional records that respond to the questions, the additional records spare the
+querying device from following up with more queries (e.g. the SRV and A records that accompany a service PTR record).
+*/
+func (responder *MDNSResponder) answer(questions []dnsmessage.Question) (answers, additionals mdnsRecordSet) {
+	hostRecords := responder.hostRecords()
+	matches := func(q dnsmessage.Question, rec dnsmessage.Resource) bool {
+		return (q.Type == rec.Header.Type || q.Type == dnsmessage.TypeALL) && strings.EqualFold(q.Name.String(), rec.Header.Name.String())
+	}
+	for _, q := range questions {
+		for _, rec := range hostRecords {
+			if matches(q, rec) {
+				answers.add(rec)
+			}
+		}
+		for _, svc := range responder.Services {
+			enumeration, ptr, srv, txt := responder.serviceRecords(svc)
+			if matches(q, enumeration) {
+				answers.add(enumeration)
+			}
+			if matches(q, ptr) {
+				answers.add(ptr)
+				additionals.add(srv, txt)
+				additionals.add(hostRecords...)
+			}
+			if matches(q, srv) {
+				answers.add(srv)
+				additionals.add(hostRecords...)
+			}
+			if matches(q, txt) {
+				answers.add(txt)
+			}
+		}
+	}
+	// An additional record is redundant if it is already among the answers
+	dedup := make(mdnsRecordSet, 0, len(additionals))
+	for _, rec := range additionals {
+		if !answers.has(rec) {
+			dedup = append(dedup, rec)
+		}
+	}
+	return answers, dedup
+}
+
+/*
+handleQuery returns the response packet to the query packet and its destination, or nil if the responder does not
+have an answer. The response is multicast to the LAN unless the querying device asks for a unicast response, or the
+query comes from a conventional DNS client (legacy unicast) that expects a conventional DNS response.
+*/
+func (responder *MDNSResponder) handleQuery(packet []byte, client *net.UDPAddr) ([]byte, *net.UDPAddr) {
+	var query dnsmessage.Message
+	if err := query.Unpack(packet); err != nil || query.Header.Response || query.Header.OpCode != 0 || len(query.Questions) == 0 {
+		return nil, nil
+	}
+	unicast := true
+	questions := make([]dnsmessage.Question, 0, len(query.Questions))
+	for _, q := range query.Questions {
+		if q.Class&mdnsUnicastResponse == 0 {
+			unicast = false
+		}
+		q.Class &^= mdnsUnicastResponse
+		if q.Class == dnsmessage.ClassINET || q.Class == dnsmessage.ClassANY {
+			questions = append(questions, q)
+		}
+	}
+	answers, additionals := responder.answer(questions)
+	if len(answers) == 0 {
+		return nil, nil
+	}
+	resp := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additionals,
+	}
+	dest := mdnsIPv4Group
+	if client.Port != MDNSPort {
+		// A conventional DNS client expects the query ID and questions in the response, and the records must not use
+		// mDNS-specific class bits or long TTLs (RFC 6762 section 6.7).
+		resp.Header.ID = query.Header.ID
+		resp.Questions = questions
+		for _, records := range [][]dnsmessage.Resource{resp.Answers, resp.Additionals} {
+			for i := range records {
+				records[i].Header.Class &^= mdnsCacheFlush
+				records[i].Header.TTL = min(records[i].Header.TTL, MDNSLegacyUnicastTTL)
+			}
+		}
+		dest = client
+	} else if unicast {
+		dest = client
+	}
+	packed, err := resp.Pack()
+	if err != nil {
+		responder.logger.Warning(client.IP.String(), err, "failed to construct mDNS response")
+		return nil, nil
+	}
+	return packed, dest
+}
+
+// announce multicasts all of the records to the LAN without being asked. A TTL of 0 tells the neighbours that the records are no longer valid.
+func (responder *MDNSResponder) announce(conn *net.UDPConn, goodbye bool) {
+	records := responder.allRecords()
+	if len(records) == 0 {
+		return
+	}
+	if goodbye {
+		for i := range records {
+			records[i].Header.TTL = 0
+		}
+	}
+	msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}, Answers: records}
+	packed, err := msg.Pack()
+	if err != nil {
+		responder.logger.Warning("", err, "failed to construct mDNS announcement")
+		return
+	}
+	if _, err := conn.WriteToUDP(packed, mdnsIPv4Group); err != nil && !errors.Is(err, net.ErrClosed) {
+		responder.logger.Warning("", err, "failed to send mDNS announcement")
+	}
+}
+
+// StartAndBlock listens for mDNS queries and announces the host name and services, it blocks until the responder is stopped.
+func (responder *MDNSResponder) StartAndBlock() error {
+	conn, err := net.ListenMulticastUDP("udp4", responder.iface, mdnsIPv4Group)
+	if err != nil {
+		return fmt.Errorf("MDNSResponder.StartAndBlock: failed to listen on %s - %w", mdnsIPv4Group, err)
+	}
+	responder.mutex.Lock()
+	responder.conn = conn
+	responder.mutex.Unlock()
+	responder.logger.Info("", nil, "announcing host name %s and %d services", responder.hostName, len(responder.Services))
+	// Announce twice in the beginning in case the first announcement is lost (RFC 6762 section 8.3)
+	go func() {
+		responder.announce(conn, false)
+		time.Sleep(MDNSAnnounceIntervalSec * time.Second)
+		responder.announce(conn, false)
+	}()
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("MDNSResponder.StartAndBlock: failed to read query - %w", err)
+		}
+		if resp, dest := responder.handleQuery(buf[:n], client); resp != nil {
+			if _, err := conn.WriteToUDP(resp, dest); err != nil {
+				responder.logger.Warning(client.IP.String(), err, "failed to send mDNS response")
+			}
+		}
+	}
+}
+
+// Stop withdraws the announced records from the neighbours' cache and stops the responder.
+func (responder *MDNSResponder) Stop() {
+	responder.mutex.Lock()
+	defer responder.mutex.Unlock()
+	if responder.conn != nil {
+		responder.announce(responder.conn, true)
+		_ = responder.conn.Close()
+		responder.conn = nil
+	}
+}
@@ -0,0 +1,99 @@
+package dnsd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func mdnsQuery(t *testing.T, responder *MDNSResponder, name string, qType dnsmessage.Type, client *net.UDPAddr) (*dnsmessage.Message, *net.UDPAddr) {
+	t.Helper()
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1234},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qType, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, dest := responder.handleQuery(packet, client)
+	if resp == nil {
+		return nil, dest
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	return &msg, dest
+}
+
+func TestMDNSResponder(t *testing.T) {
+	if err := (&MDNSResponder{HostName: "a.b"}).Initialise(lalog.DefaultLogger); err == nil {
+		t.Fatal("did not reject multi-label host name")
+	}
+	if err := (&MDNSResponder{Services: []*MDNSService{{Type: "http", Port: 80}}}).Initialise(lalog.DefaultLogger); err == nil {
+		t.Fatal("did not reject bad service type")
+	}
+	if err := (&MDNSResponder{Services: []*MDNSService{{Type: "_http._tcp"}}}).Initialise(lalog.DefaultLogger); err == nil {
+		t.Fatal("did not reject missing port")
+	}
+	responder := &MDNSResponder{
+		HostName:  "Laitos.local",
+		Addresses: []string{"192.168.1.10", "fd00::10"},
+		Services:  []*MDNSService{{Type: "_http._tcp", Name: "laitos web", Port: 8080, TXT: []string{"path=/"}}},
+	}
+	if err := responder.Initialise(lalog.DefaultLogger); err != nil {
+		t.Fatal(err)
+	}
+	if responder.HostName != "laitos" || responder.Services[0].instanceName.String() != "laitos web._http._tcp.local." {
+		t.Fatal(responder.HostName, responder.Services[0].instanceName)
+	}
+	mdnsClient := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: MDNSPort}
+
+	// Host name
+	resp, dest := mdnsQuery(t, responder, "LAITOS.local.", dnsmessage.TypeA, mdnsClient)
+	if resp == nil || dest != mdnsIPv4Group || len(resp.Answers) != 1 || resp.Header.ID != 0 || !resp.Header.Authoritative {
+		t.Fatalf("%+v %v", resp, dest)
+	}
+	if a := resp.Answers[0].Body.(*dnsmessage.AResource).A; net.IP(a[:]).String() != "192.168.1.10" || resp.Answers[0].Header.Class != dnsmessage.ClassINET|mdnsCacheFlush {
+		t.Fatalf("%+v", resp.Answers[0])
+	}
+	if resp, _ = mdnsQuery(t, responder, "laitos.local.", dnsmessage.TypeALL, mdnsClient); resp == nil || len(resp.Answers) != 2 {
+		t.Fatalf("%+v", resp)
+	}
+	if resp, _ = mdnsQuery(t, responder, "other.local.", dnsmessage.TypeA, mdnsClient); resp != nil {
+		t.Fatalf("%+v", resp)
+	}
+
+	// Service enumeration and discovery
+	resp, _ = mdnsQuery(t, responder, "_services._dns-sd._udp.local.", dnsmessage.TypePTR, mdnsClient)
+	if resp == nil || len(resp.Answers) != 1 || resp.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String() != "_http._tcp.local." {
+		t.Fatalf("%+v", resp)
+	}
+	resp, _ = mdnsQuery(t, responder, "_http._tcp.local.", dnsmessage.TypePTR, mdnsClient)
+	if resp == nil || len(resp.Answers) != 1 || resp.Answers[0].Body.(*dnsmessage.PTRResource).PTR.String() != "laitos web._http._tcp.local." {
+		t.Fatalf("%+v", resp)
+	}
+	// SRV, TXT, A, and AAAA accompany the PTR answer
+	if len(resp.Additionals) != 4 {
+		t.Fatalf("%+v", resp.Additionals)
+	}
+	if srv := resp.Additionals[0].Body.(*dnsmessage.SRVResource); srv.Port != 8080 || srv.Target.String() != "laitos.local." {
+		t.Fatalf("%+v", srv)
+	}
+	if txt := resp.Additionals[1].Body.(*dnsmessage.TXTResource); len(txt.TXT) != 1 || txt.TXT[0] != "path=/" {
+		t.Fatalf("%+v", txt)
+	}
+
+	// A conventional DNS client receives a unicast response with short TTL
+	legacyClient := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 40000}
+	resp, dest = mdnsQuery(t, responder, "laitos.local.", dnsmessage.TypeAAAA, legacyClient)
+	if resp == nil || dest != legacyClient || resp.Header.ID != 1234 || len(resp.Questions) != 1 || len(resp.Answers) != 1 {
+		t.Fatalf("%+v %v", resp, dest)
+	}
+	if hdr := resp.Answers[0].Header; hdr.TTL != MDNSLegacyUnicastTTL || hdr.Class != dnsmessage.ClassINET {
+		t.Fatalf("%+v", hdr)
+	}
+}
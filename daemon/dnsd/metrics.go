@@ -0,0 +1,110 @@
+package dnsd
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// QueryOutcomeBlocked is the outcome of a query for a black listed name.
+	QueryOutcomeBlocked = "blocked"
+	// QueryOutcomeForwarded is the outcome of a recursive query answered by a forwarder.
+	QueryOutcomeForwarded = "forwarded"
+	// QueryOutcomeLocal is the outcome of a query answered by the DNS daemon itself, e.g. using custom records.
+	QueryOutcomeLocal = "local"
+	// QueryOutcomeDenied is the outcome of a recursive query made by a client that is not allowed to make one.
+	QueryOutcomeDenied = "denied"
+	// QueryOutcomeUnanswered is the outcome of a query that did not get a response, e.g. due to rate limit or forwarder error.
+	QueryOutcomeUnanswered = "unanswered"
+)
+
+var (
+	blacklistEntriesGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "laitos_dnsd_blacklist_entries",
+		Help: "The number of names downloaded from each black list in the latest refresh",
+	}, []string{"url"})
+	blacklistRefreshErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "laitos_dnsd_blacklist_refresh_errors_total",
+		Help: "The number of failed downloads of each black list",
+	}, []string{"url"})
+	blacklistUniqueNamesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "laitos_dnsd_blacklist_unique_names",
+		Help: "The number of unique names combined from all black lists in the latest refresh",
+	})
+	queriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "laitos_dnsd_queries_total",
+		Help: "The number of queries by their type and outcome (blocked, forwarded, local, denied, unanswered)",
+	}, []string{"type", "outcome"})
+	forwarderDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "laitos_dnsd_forwarder_duration_seconds",
+		Help:    "The round trip duration of queries forwarded to recursive resolvers in seconds",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2},
+	}, []string{"transport"})
+	tcpOverDNSSegmentsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "laitos_dnsd_tcp_over_dns_segments_total",
+		Help: "The number of TCP-over-DNS segments received from and sent to the clients",
+	}, []string{"direction"})
+	tcpOverDNSBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "laitos_dnsd_tcp_over_dns_bytes_total",
+		Help: "The number of TCP-over-DNS data bytes received from and sent to the clients",
+	}, []string{"direction"})
+	registerMetricsOnce = new(sync.Once)
+)
+
+// registerPrometheusMetrics registers the metrics collectors of DNS daemon with prometheus once.
+func registerPrometheusMetrics(logger *lalog.Logger) {
+	if !misc.PrometheusIntegration.IsEnabled() {
+		return
+	}
+	registerMetricsOnce.Do(func() {
+		for _, collector := range []prometheus.Collector{
+			blacklistEntriesGauge, blacklistRefreshErrorsCounter, blacklistUniqueNamesGauge,
+			queriesCounter, forwarderDurationHistogram, tcpOverDNSSegmentsCounter, tcpOverDNSBytesCounter,
+		} {
+			if err := prometheus.Register(collector); err != nil {
+				logger.Warning("", err, "failed to register prometheus metrics collectors")
+			}
+		}
+	})
+}
+
+// queryTypeLabel returns the query type as a metrics label, the less common types share the label "other" to keep the number of labels small.
+func queryTypeLabel(qType dnsmessage.Type) string {
+	switch qType {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA, dnsmessage.TypeCNAME, dnsmessage.TypeMX, dnsmessage.TypeNS,
+		dnsmessage.TypePTR, dnsmessage.TypeSOA, dnsmessage.TypeSRV, dnsmessage.TypeTXT, dnsmessage.TypeALL:
+		return strings.TrimPrefix(qType.String(), "Type")
+	case TypeHTTPS:
+		return "HTTPS"
+	default:
+		return "other"
+	}
+}
+
+// recordQueryOutcome counts a query of the type by its outcome.
+func recordQueryOutcome(qType dnsmessage.Type, outcome string) {
+	if misc.PrometheusIntegration.IsEnabled() {
+		queriesCounter.WithLabelValues(queryTypeLabel(qType), outcome).Inc()
+	}
+}
+
+// recordForwarderDuration records the round trip duration of a query forwarded over the transport (udp, tcp, or relay).
+func recordForwarderDuration(transport string, start time.Time) {
+	if misc.PrometheusIntegration.IsEnabled() {
+		forwarderDurationHistogram.WithLabelValues(transport).Observe(time.Since(start).Seconds())
+	}
+}
+
+// recordTCPOverDNSSegment counts a TCP-over-DNS segment received from ("in") or sent to ("out") a client.
+func recordTCPOverDNSSegment(direction string, dataLen int) {
+	if misc.PrometheusIntegration.IsEnabled() {
+		tcpOverDNSSegmentsCounter.WithLabelValues(direction).Inc()
+		tcpOverDNSBytesCounter.WithLabelValues(direction).Add(float64(dataLen))
+	}
+}
@@ -0,0 +1,77 @@
+package dnsd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// getMetricValue returns the value of a counter or the sample count of a histogram that has the label value.
+func getMetricValue(t *testing.T, reg *prometheus.Registry, name, labelValue string) (ret float64) {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var labelValues []string
+			for _, label := range metric.GetLabel() {
+				labelValues = append(labelValues, label.GetValue())
+			}
+			if strings.Join(labelValues, " ") == labelValue {
+				ret += metric.GetCounter().GetValue() + float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return
+}
+
+func TestDaemon_QueryMetrics(t *testing.T) {
+	misc.PrometheusIntegration.Set(true)
+	defer func() {
+		misc.PrometheusIntegration.Set(false)
+	}()
+	daemon := &Daemon{
+		Address:       "127.0.0.1",
+		UDPPort:       62163,
+		Forwarders:    []string{startCaseTestForwarder(t, false)},
+		MyDomainNames: []string{"example.com"},
+		CustomRecords: map[string]*CustomRecord{
+			"example.com": {A: V4AddressRecord{AddressRecord: AddressRecord{Addresses: []string{"5.0.0.1"}}}},
+		},
+		Processor: toolbox.GetTestCommandProcessor(),
+	}
+	require.NoError(t, daemon.Initialise())
+	daemon.blackList["ads.example.net"] = struct{}{}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(queriesCounter, forwarderDurationHistogram)
+
+	for _, tc := range []struct {
+		clientIP string
+		name     string
+		qType    dnsmessage.Type
+		typeName string
+		outcome  string
+	}{
+		{"127.0.0.1", "example.com.", dnsmessage.TypeA, "A", QueryOutcomeLocal},
+		{"127.0.0.1", "example.org.", dnsmessage.TypeAAAA, "AAAA", QueryOutcomeForwarded},
+		{"10.0.0.1", "example.org.", dnsmessage.TypeAAAA, "AAAA", QueryOutcomeDenied},
+		{"10.0.0.1", "ads.example.net.", dnsmessage.TypeA, "A", QueryOutcomeBlocked},
+		{"127.0.0.1", "example.org.", dnsmessage.TypeALL, "ALL", QueryOutcomeLocal},
+		{"127.0.0.1", "example.org.", dnsmessage.Type(99), "other", QueryOutcomeForwarded},
+	} {
+		// The labels are sorted by name - outcome and then type
+		labelValue := tc.outcome + " " + tc.typeName
+		before := getMetricValue(t, reg, "laitos_dnsd_queries_total", labelValue)
+		daemon.respondToQuery(&lalog.Logger{}, tc.clientIP, nil, nil, buildDoHTestQuery(t, tc.name, tc.qType))
+		require.Equal(t, before+1, getMetricValue(t, reg, "laitos_dnsd_queries_total", labelValue), "%+v", tc)
+	}
+	require.Positive(t, getMetricValue(t, reg, "laitos_dnsd_forwarder_duration_seconds", "udp"))
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -20,6 +21,10 @@ const (
 	// control. The transmission controls are unconditionally closed after this
 	// duration.
 	MaxProxyConnectionLifetime = 30 * time.Minute
+	// MaxMuxStreamOpenAge is the maximum age of a multiplexed transmission
+	// control to take new streams, which leaves each stream at least half of
+	// the maximum lifetime before the transmission control closes.
+	MaxMuxStreamOpenAge = MaxProxyConnectionLifetime / 2
 )
 
 // ProxyRequest is the data sent by a proxy client to initiate a connection
@@ -34,13 +39,20 @@ type ProxyRequest struct {
 	Address string `json:"a"`
 	// AccessTOTP is a time-based OTP that authorises the connection request.
 	AccessTOTP string `json:"t"`
+	// Mux asks the proxy to multiplex many streams over the transmission
+	// control instead of relaying a single connection. Each stream begins
+	// with its own ProxyRequest (without the TOTP) as the open data.
+	Mux bool `json:"m,omitempty"`
 }
 
 // ProxyConnection consists of a transmission control paired to a TCP connection
 // relayed by the transmission control.
 type ProxyConnection struct {
-	proxy         *Proxy
-	tcpConn       *net.TCPConn
+	proxy   *Proxy
+	tcpConn *net.TCPConn
+	// mux is true if the transmission control multiplexes many streams, each
+	// relayed to its own proxy destination.
+	mux           bool
 	context       context.Context
 	tc            *tcpoverdns.TransmissionControl
 	buf           *tcpoverdns.SegmentBuffer
@@ -52,13 +64,13 @@ type ProxyConnection struct {
 // transmission control.
 // The function blocks until the underlying TC is closed.
 func (conn *ProxyConnection) Start() {
-	if conn.proxy.Debug {
+	if conn.proxy.isDebug() {
 		conn.logger.Info("", nil, "starting now")
 	}
 	conn.buf = tcpoverdns.NewSegmentBuffer(conn.logger, conn.tc.Debug, 0)
 	beginTimeNano := time.Now().UnixNano()
 	defer func() {
-		if conn.proxy.Debug {
+		if conn.proxy.isDebug() {
 			conn.logger.Info("", nil, "closing and lingering")
 			conn.tc.DumpState()
 		}
@@ -74,7 +86,7 @@ func (conn *ProxyConnection) Start() {
 			conn.proxy.mutex.Lock()
 			delete(conn.proxy.connections, conn.tc.ID)
 			conn.proxy.mutex.Unlock()
-			if conn.proxy.Debug {
+			if conn.proxy.isDebug() {
 				conn.logger.Info("", nil, "closed and removed from proxy")
 			}
 		}()
@@ -84,21 +96,20 @@ func (conn *ProxyConnection) Start() {
 	// Carry on with the handshake.
 	conn.tc.Start(conn.context)
 	conn.tc.WaitState(conn.context, tcpoverdns.StateEstablished)
-	if conn.proxy.Debug {
+	if conn.proxy.isDebug() {
 		conn.logger.Info("", nil, "TC is established")
 	}
-	// Pipe data in both directions.
-	if conn.tcpConn != nil {
-		go func() {
-			_, err := io.Copy(conn.tcpConn, conn.tc)
-			if conn.proxy.Debug {
-				conn.logger.Info(nil, err, "finished piping from TC to TCP connection")
-			}
-		}()
-		_, err := io.Copy(conn.tc, conn.tcpConn)
-		if conn.proxy.Debug {
-			conn.logger.Info(nil, err, "finished piping from TCP connection to TC")
-		}
+	var limiter *tcpoverdns.BandwidthLimiter
+	if conn.proxy.MaxBytesPerSec > 0 {
+		// Both directions (and all streams of a mux) share the same bandwidth
+		// budget.
+		limiter = tcpoverdns.NewBandwidthLimiter(conn.proxy.MaxBytesPerSec, conn.proxy.BurstBytes)
+	}
+	if conn.mux {
+		conn.serveMux(limiter)
+	} else if conn.tcpConn != nil {
+		// Pipe data in both directions.
+		conn.pipe(conn.tc, conn.tcpConn, limiter)
 	}
 	// Wait for the transmission control to close.
 	conn.tc.CloseAfterDrained()
@@ -106,6 +117,66 @@ func (conn *ProxyConnection) Start() {
 	// The proxy connection lingers for a short while, see defer.
 }
 
+// pipe copies data in both directions between the transmission control (or a
+// mux stream) and the TCP connection. The function blocks until the copying
+// from the TCP connection is finished.
+func (conn *ProxyConnection) pipe(tc io.ReadWriter, tcpConn *net.TCPConn, limiter *tcpoverdns.BandwidthLimiter) {
+	var fromTC, fromTCP io.Reader = tc, tcpConn
+	if limiter != nil {
+		fromTC = tcpoverdns.NewThrottledReader(conn.context, limiter, tc)
+		fromTCP = tcpoverdns.NewThrottledReader(conn.context, limiter, tcpConn)
+	}
+	go func() {
+		_, err := io.Copy(tcpConn, fromTC)
+		if conn.proxy.isDebug() {
+			conn.logger.Info(nil, err, "finished piping from TC to TCP connection")
+		}
+	}()
+	_, err := io.Copy(tc, fromTCP)
+	if conn.proxy.isDebug() {
+		conn.logger.Info(nil, err, "finished piping from TCP connection to TC")
+	}
+}
+
+// serveMux multiplexes streams over the transmission control and relays each
+// stream to its own proxy destination. The function blocks until the
+// transmission control is closed.
+func (conn *ProxyConnection) serveMux(limiter *tcpoverdns.BandwidthLimiter) {
+	mux := &tcpoverdns.Mux{
+		Conn:   conn.tc,
+		Debug:  conn.proxy.isDebug(),
+		LogTag: fmt.Sprint(conn.tc.ID),
+	}
+	mux.Start(conn.context)
+	defer mux.Close()
+	for {
+		stream, err := mux.Accept(conn.context)
+		if err != nil {
+			conn.logger.Info(nil, err, "stop accepting streams")
+			return
+		}
+		go func() {
+			defer stream.Close()
+			var req ProxyRequest
+			if err := json.Unmarshal(stream.OpenData, &req); err != nil {
+				conn.logger.Warning(stream.ID, err, "failed to deserialise stream proxy request")
+				return
+			}
+			if conn.proxy.DNSDaemon != nil && conn.proxy.DNSDaemon.IsInBlacklist(req.Address) {
+				conn.logger.Info(stream.ID, nil, "refusing stream to blacklisted destination %q", req.Address)
+				return
+			}
+			tcpConn, err := conn.proxy.dialDestination(req)
+			if err != nil {
+				conn.logger.Warning(stream.ID, err, "failed to connect to proxy destination %+v", req)
+				return
+			}
+			defer tcpConn.Close()
+			conn.pipe(stream, tcpConn, limiter)
+		}()
+	}
+}
+
 // WaitSegment busy-waits until a new segment is available from the output
 // segment backlog, and then pops the segment.
 func (conn *ProxyConnection) WaitSegment(ctx context.Context) (tcpoverdns.Segment, bool) {
@@ -155,6 +226,21 @@ type Proxy struct {
 	// DialTimeout is the timeout used for creating new a proxy TCP connection.
 	DialTimeout time.Duration `json:"-"`
 
+	// MaxBytesPerSec is the approximate throughput limit of each proxy
+	// connection, counting data transferred in both directions. This prevents
+	// a single tunnel user from exhausting the DNS query budget of everyone
+	// else. The default value 0 means the throughput is unlimited.
+	MaxBytesPerSec int `json:"MaxBytesPerSec"`
+	// BurstBytes is the number of bytes a proxy connection may transfer in a
+	// short burst before the throughput limit kicks in. It defaults to
+	// MaxBytesPerSec.
+	BurstBytes int `json:"BurstBytes"`
+
+	// ICMPListenAddress is an IPv4 address on which the proxy additionally
+	// serves clients using the ICMP echo carrier, in networks where even DNS
+	// is proxied or inspected. Listening for ICMP requires root privilege.
+	ICMPListenAddress string `json:"ICMPListenAddress"`
+
 	// logger is used to log IO activities when verbose logging is enabled.
 	logger *lalog.Logger `json:"-"`
 
@@ -162,6 +248,14 @@ type Proxy struct {
 	context     context.Context
 	cancelFun   func()
 	mutex       *sync.Mutex
+	// debug follows the program-global feature flag misc.Debug.
+	debug atomic.Bool
+}
+
+// isDebug returns true if verbose logging is enabled by either the proxy
+// configuration or the program-global feature flag.
+func (proxy *Proxy) isDebug() bool {
+	return proxy.Debug || proxy.debug.Load()
 }
 
 // Start initialises the internal state of the proxy.
@@ -172,10 +266,23 @@ func (proxy *Proxy) Start(ctx context.Context) {
 	if proxy.Linger == 0 {
 		proxy.Linger = 60 * time.Second
 	}
+	if proxy.MaxBytesPerSec > 0 && proxy.BurstBytes < proxy.MaxBytesPerSec {
+		proxy.BurstBytes = proxy.MaxBytesPerSec
+	}
 	proxy.connections = make(map[uint16]*ProxyConnection)
 	proxy.context, proxy.cancelFun = context.WithCancel(ctx)
 	proxy.mutex = new(sync.Mutex)
 	proxy.logger = &lalog.Logger{ComponentName: "TCProxy"}
+	// The debug flag may be toggled at runtime by an admin command.
+	proxy.debug.Store(misc.Debug.IsEnabled())
+	unsubscribe := misc.Debug.Subscribe(proxy.debug.Store)
+	go func() {
+		<-proxy.context.Done()
+		unsubscribe()
+	}()
+	if proxy.ICMPListenAddress != "" {
+		go proxy.serveICMP()
+	}
 }
 
 // Receive processes an incoming segment and relay the segment to an existing
@@ -212,35 +319,30 @@ func (proxy *Proxy) Receive(in tcpoverdns.Segment) (tcpoverdns.Segment, bool) {
 		}
 		// Construct the transmission control at proxy's side.
 		proxyIn, tcIn := net.Pipe()
-		// Connect to the intended destination.
-		var dialNet, dialDest string
-		if req.Network == "" {
-			dialNet = "tcp"
-			dialDest = fmt.Sprintf("%s:%d", req.Address, req.Port)
-		} else {
-			dialNet = req.Network
-			dialDest = req.Address
-		}
-		netConn, err := net.DialTimeout(dialNet, dialDest, proxy.DialTimeout)
-		if err != nil {
-			// Immediately close the transmission control if the destination is
-			// unreachable.
-			proxy.logger.Warning(in.ID, err, "failed to connect to proxy destination %s %s", dialNet, dialDest)
-			// Proceed with handshake, but there will be no data coming through
-			// the transmission control and it will be closed shortly.
-		}
 		var localAddr, remoteAddr string
 		var tcpConn *net.TCPConn
-		if netConn != nil {
-			tcpConn = netConn.(*net.TCPConn)
-			misc.TweakTCPConnection(tcpConn, 30*time.Minute)
-			localAddr = tcpConn.LocalAddr().String()
-			remoteAddr = tcpConn.RemoteAddr().String()
+		if req.Mux {
+			// Each stream of the mux connects to its own destination later.
+			remoteAddr = "mux"
+		} else {
+			// Connect to the intended destination.
+			tcpConn, err = proxy.dialDestination(req)
+			if err != nil {
+				// Immediately close the transmission control if the destination is
+				// unreachable.
+				proxy.logger.Warning(in.ID, err, "failed to connect to proxy destination")
+				// Proceed with handshake, but there will be no data coming through
+				// the transmission control and it will be closed shortly.
+			} else {
+				localAddr = tcpConn.LocalAddr().String()
+				remoteAddr = tcpConn.RemoteAddr().String()
+			}
 		}
 		// Track the new proxy connection.
 		conn = &ProxyConnection{
 			proxy:         proxy,
 			tcpConn:       tcpConn,
+			mux:           req.Mux,
 			context:       proxy.context,
 			inputSegments: proxyIn,
 			logger: &lalog.Logger{
@@ -253,7 +355,7 @@ func (proxy *Proxy) Receive(in tcpoverdns.Segment) (tcpoverdns.Segment, bool) {
 			},
 		}
 		tc := &tcpoverdns.TransmissionControl{
-			Debug:  proxy.Debug,
+			Debug:  proxy.isDebug(),
 			LogTag: fmt.Sprintf("ProxyConn(%s->%s)", localAddr, remoteAddr),
 			ID:     in.ID,
 			// This transmission control is a responder during the handshake.
@@ -296,6 +398,29 @@ func (proxy *Proxy) Receive(in tcpoverdns.Segment) (tcpoverdns.Segment, bool) {
 	return seg, hasSeg
 }
 
+// dialDestination connects to the destination of the proxy request.
+func (proxy *Proxy) dialDestination(req ProxyRequest) (*net.TCPConn, error) {
+	var dialNet, dialDest string
+	if req.Network == "" {
+		dialNet = "tcp"
+		dialDest = fmt.Sprintf("%s:%d", req.Address, req.Port)
+	} else {
+		dialNet = req.Network
+		dialDest = req.Address
+	}
+	netConn, err := net.DialTimeout(dialNet, dialDest, proxy.DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Proxy.dialDestination: failed to connect to %s %s - %w", dialNet, dialDest, err)
+	}
+	tcpConn, ok := netConn.(*net.TCPConn)
+	if !ok {
+		_ = netConn.Close()
+		return nil, fmt.Errorf("Proxy.dialDestination: %s is not a TCP network", dialNet)
+	}
+	misc.TweakTCPConnection(tcpConn, 30*time.Minute)
+	return tcpConn, nil
+}
+
 // Close terminates all ongoing transmission controls.
 // The function always returns nil.
 func (proxy *Proxy) Close() error {
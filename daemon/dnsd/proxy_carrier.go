@@ -0,0 +1,246 @@
+package dnsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/HouzuoGuo/laitos/tcpoverdns"
+	"github.com/miekg/dns"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// DNSCarrierName is the registered name of the DNS query carrier.
+	DNSCarrierName = "dns"
+)
+
+func init() {
+	tcpoverdns.RegisterCarrier(DNSCarrierName, NewDNSCarrier)
+}
+
+// GetDNSClientConfig returns the DNS client configuration for the recursive
+// resolver address (ip:port), or the system resolver if the address is empty.
+func GetDNSClientConfig(resolverAddress string) (*dns.ClientConfig, error) {
+	if resolverAddress == "" {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, err
+		}
+		if len(conf.Servers) == 0 {
+			return nil, fmt.Errorf("resolv.conf appears to be malformed or empty, try specifying an explicit DNS resolver address instead.")
+		}
+		return conf, nil
+	}
+	host, port, err := net.SplitHostPort(resolverAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ip:port from DNS resolver %q", err)
+	}
+	portInt, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ip:port from DNS resolver %q", err)
+	}
+	return &dns.ClientConfig{
+		Servers: []string{host},
+		Port:    strconv.Itoa(portInt),
+	}, nil
+}
+
+// DNSCarrier transports each segment in the name of a DNS query, and reads the
+// reply segment from the CNAME or TXT answer.
+type DNSCarrier struct {
+	dnsHostName         string
+	countHostNameLabels int
+	dnsConfig           *dns.ClientConfig
+	enableTXTRequests   bool
+	dropPercentage      int
+}
+
+// NewDNSCarrier returns a DNS carrier that sends segments to the laitos DNS
+// server host name in the params address.
+func NewDNSCarrier(params tcpoverdns.CarrierParams) (tcpoverdns.Carrier, error) {
+	hostName := params.Address
+	if len(hostName) < 3 {
+		return nil, fmt.Errorf("DNSDomainName (%q) must be a valid host name", hostName)
+	}
+	if hostName[0] == '.' {
+		hostName = hostName[1:]
+	}
+	dnsConfig, err := GetDNSClientConfig(params.ResolverAddress)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSCarrier{
+		dnsHostName:         hostName,
+		countHostNameLabels: CountNameLabels(hostName),
+		dnsConfig:           dnsConfig,
+		enableTXTRequests:   params.EnableTXT,
+		dropPercentage:      params.DropPercentage,
+	}, nil
+}
+
+// Exchange sends the segment in a DNS query and returns the reply segment from
+// the query response.
+func (carrier *DNSCarrier) Exchange(ctx context.Context, seg tcpoverdns.Segment) (tcpoverdns.Segment, error) {
+	malformedSegment := tcpoverdns.Segment{Flags: tcpoverdns.FlagMalformed}
+	questionName := seg.DNSName(fmt.Sprintf("%c", ProxyPrefix), carrier.dnsHostName)
+	if len(questionName) < 3 {
+		return malformedSegment, errors.New("the input query name is too short")
+	}
+	if questionName[len(questionName)-1] != '.' {
+		questionName += "."
+	}
+	client := new(dns.Client)
+	query := new(dns.Msg)
+	query.RecursionDesired = true
+	query.SetEdns0(EDNSBufferSize, false)
+	serverAddr := fmt.Sprintf("%s:%s", carrier.dnsConfig.Servers[0], carrier.dnsConfig.Port)
+
+	if carrier.enableTXTRequests {
+		query.SetQuestion(questionName, dns.TypeTXT)
+		response, _, err := client.ExchangeContext(ctx, query, serverAddr)
+		if err != nil {
+			return malformedSegment, err
+		}
+		if len(response.Answer) == 0 {
+			return malformedSegment, errors.New("the DNS query did not receive a response")
+		}
+		if txtResponse, ok := response.Answer[0].(*dns.TXT); ok {
+			if rand.Intn(100) < carrier.dropPercentage {
+				return malformedSegment, errors.New("dropped for testing")
+			}
+			return tcpoverdns.SegmentFromDNSText(txtResponse.Txt), nil
+		} else {
+			return malformedSegment, fmt.Errorf("the response answer %v is not a TXT", response.Answer[0])
+		}
+	} else {
+		query.SetQuestion(questionName, dns.TypeA)
+		response, _, err := client.ExchangeContext(ctx, query, serverAddr)
+		if err != nil {
+			return malformedSegment, err
+		}
+		if len(response.Answer) == 0 {
+			return malformedSegment, errors.New("the DNS query did not receive a response")
+		}
+		if cnameResp, ok := response.Answer[0].(*dns.CNAME); ok {
+			if rand.Intn(100) < carrier.dropPercentage {
+				return malformedSegment, errors.New("dropped for testing")
+			}
+			return tcpoverdns.SegmentFromDNSName(carrier.countHostNameLabels, cnameResp.Target), nil
+		} else {
+			return malformedSegment, fmt.Errorf("the response answer %v is not a CNAME", response.Answer[0])
+		}
+	}
+}
+
+// ServeHTTP receives a segment carried by the HTTPS carrier from the request
+// body, and responds with the reply segment in the response body. A keep-alive
+// segment is long-polled, the response waits for the reply segment for up to
+// HTTPSCarrierLongPollDuration.
+func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if proxy.mutex == nil {
+		http.Error(w, "TCP-over-DNS proxy has not started", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	packet, err := io.ReadAll(io.LimitReader(r.Body, tcpoverdns.SegmentHeaderLen+tcpoverdns.MaxSegmentDataLen))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	seg := tcpoverdns.SegmentFromPacket(packet)
+	if seg.Flags.Has(tcpoverdns.FlagMalformed) {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	reply, hasReply := proxy.Receive(seg)
+	if !hasReply && seg.Flags.Has(tcpoverdns.FlagKeepAlive) && len(seg.Data) == 0 {
+		// The client has nothing to send, hold on to the request until the
+		// transmission control has a reply segment.
+		waitCtx, cancel := context.WithTimeout(r.Context(), tcpoverdns.HTTPSCarrierLongPollDuration)
+		reply, hasReply = proxy.waitSegment(waitCtx, seg.ID)
+		cancel()
+	}
+	if !hasReply {
+		// The client will carry on with an ordinary keep-alive.
+		reply = tcpoverdns.Segment{ID: seg.ID, Flags: tcpoverdns.FlagKeepAlive}
+	}
+	w.Header().Set("Content-Type", tcpoverdns.HTTPSCarrierContentType)
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	_, _ = w.Write(reply.Packet())
+}
+
+// waitSegment waits for the next output segment of the proxy connection.
+func (proxy *Proxy) waitSegment(ctx context.Context, id uint16) (tcpoverdns.Segment, bool) {
+	proxy.mutex.Lock()
+	conn, exists := proxy.connections[id]
+	proxy.mutex.Unlock()
+	if !exists || conn.buf == nil {
+		return tcpoverdns.Segment{}, false
+	}
+	return conn.WaitSegment(ctx)
+}
+
+// serveICMP receives segments carried by ICMP echo requests, and responds
+// with the reply segments in echo replies. The function blocks until the
+// proxy is closed.
+func (proxy *Proxy) serveICMP() {
+	conn, err := icmp.ListenPacket("ip4:icmp", proxy.ICMPListenAddress)
+	if err != nil {
+		proxy.logger.Warning(proxy.ICMPListenAddress, err, "failed to listen for ICMP carrier (is the program running with root privilege?)")
+		return
+	}
+	proxy.logger.Info(proxy.ICMPListenAddress, nil, "listening for segments carried by ICMP echo requests")
+	go func() {
+		<-proxy.context.Done()
+		_ = conn.Close()
+	}()
+	buf := make([]byte, 2*(tcpoverdns.SegmentHeaderLen+tcpoverdns.MaxSegmentDataLen))
+	for {
+		n, clientAddr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if proxy.context.Err() == nil {
+				proxy.logger.Warning(proxy.ICMPListenAddress, err, "failed to read ICMP packet")
+			}
+			return
+		}
+		msg, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil || msg.Type != ipv4.ICMPTypeEcho {
+			continue
+		}
+		echo, ok := msg.Body.(*icmp.Echo)
+		if !ok {
+			continue
+		}
+		seg, isSeg := tcpoverdns.SegmentFromICMPPayload(echo.Data)
+		if !isSeg || seg.Flags.Has(tcpoverdns.FlagMalformed) {
+			continue
+		}
+		go func(echo icmp.Echo, seg tcpoverdns.Segment, clientAddr net.Addr) {
+			reply, hasReply := proxy.Receive(seg)
+			if !hasReply {
+				reply = tcpoverdns.Segment{ID: seg.ID, Flags: tcpoverdns.FlagKeepAlive}
+			}
+			replyMsg := icmp.Message{
+				Type: ipv4.ICMPTypeEchoReply,
+				Body: &icmp.Echo{ID: echo.ID, Seq: echo.Seq, Data: tcpoverdns.ICMPPayload(reply)},
+			}
+			replyBytes, err := replyMsg.Marshal(nil)
+			if err != nil {
+				return
+			}
+			if _, err := conn.WriteTo(replyBytes, clientAddr); err != nil && proxy.isDebug() {
+				proxy.logger.Info(clientAddr.String(), err, "failed to write ICMP echo reply")
+			}
+		}(*echo, seg, clientAddr)
+	}
+}
@@ -2,15 +2,12 @@ package dnsd
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"math/rand"
 	"net"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/tcpoverdns"
-	"github.com/miekg/dns"
 )
 
 // MaxUpstreamSegmentLength returns the maximum segment length appropriate for
@@ -36,13 +33,11 @@ func MaxDownstreamSegmentLengthTXT(dnsHostName string) int {
 
 // ProxiedConnection handles an individual proxy connection to transport
 // data between local transmission control and the one on the remote DNS proxy
-// server.
+// server. The segments are transported by a carrier, usually DNS queries.
 type ProxiedConnection struct {
-	dnsHostName       string
-	dnsConfig         *dns.ClientConfig
-	dropPercentage    int
-	debug             bool
-	enableTXTRequests bool
+	// carrier transports segments to and from the remote proxy server.
+	carrier tcpoverdns.Carrier
+	debug   bool
 
 	in      net.Conn
 	tc      *tcpoverdns.TransmissionControl
@@ -53,11 +48,11 @@ type ProxiedConnection struct {
 
 // Start configures and then starts the transmission control on local side, and
 // spawns a background goroutine to transport segments back and forth using
-// DNS queries.
+// the carrier.
 // The function returns when the local transmission control transitions to the
 // established state, or an error.
 func (conn *ProxiedConnection) Start() error {
-	conn.logger.Info("", nil, "start transporting data over DNS")
+	conn.logger.Info("", nil, "start transporting data over the carrier")
 	conn.buf = tcpoverdns.NewSegmentBuffer(conn.logger, conn.debug, conn.tc.MaxSegmentLenExclHeader)
 	// Absorb outgoing segments into the outgoing backlog.
 	conn.tc.OutputSegmentCallback = conn.buf.Absorb
@@ -70,69 +65,18 @@ func (conn *ProxiedConnection) Start() error {
 	return nil
 }
 
-func (conn *ProxiedConnection) sendDNSQuery(countHostNameLabels int, questionName string) (tcpoverdns.Segment, error) {
-	malformedSegment := tcpoverdns.Segment{Flags: tcpoverdns.FlagMalformed}
-	if len(questionName) < 3 {
-		return malformedSegment, errors.New("the input query name is too short")
-	}
-	if questionName[len(questionName)-1] != '.' {
-		questionName += "."
-	}
-	client := new(dns.Client)
-	query := new(dns.Msg)
-	query.RecursionDesired = true
-	query.SetEdns0(EDNSBufferSize, false)
-
-	if conn.enableTXTRequests {
-		query.SetQuestion(questionName, dns.TypeTXT)
-		response, _, err := client.Exchange(query, fmt.Sprintf("%s:%s", conn.dnsConfig.Servers[0], conn.dnsConfig.Port))
-		if err != nil {
-			return malformedSegment, err
-		}
-		if len(response.Answer) == 0 {
-			return malformedSegment, errors.New("the DNS query did not receive a response")
-		}
-		if txtResponse, ok := response.Answer[0].(*dns.TXT); ok {
-			if rand.Intn(100) < conn.dropPercentage {
-				return malformedSegment, errors.New("dropped for testing")
-			}
-			return tcpoverdns.SegmentFromDNSText(txtResponse.Txt), nil
-		} else {
-			return malformedSegment, fmt.Errorf("the response answer %v is not a TXT", response.Answer[0])
-		}
-	} else {
-		query.SetQuestion(questionName, dns.TypeA)
-		response, _, err := client.Exchange(query, fmt.Sprintf("%s:%s", conn.dnsConfig.Servers[0], conn.dnsConfig.Port))
-		if err != nil {
-			return malformedSegment, err
-		}
-		if len(response.Answer) == 0 {
-			return malformedSegment, errors.New("the DNS query did not receive a response")
-		}
-		if cnameResp, ok := response.Answer[0].(*dns.CNAME); ok {
-			if rand.Intn(100) < conn.dropPercentage {
-				return malformedSegment, errors.New("dropped for testing")
-			}
-			return tcpoverdns.SegmentFromDNSName(countHostNameLabels, cnameResp.Target), nil
-		} else {
-			return malformedSegment, fmt.Errorf("the response answer %v is not a CNAME", response.Answer[0])
-		}
-	}
-}
-
 func (conn *ProxiedConnection) transportLoop() {
-	countHostNameLabels := CountNameLabels(conn.dnsHostName)
 	defer func() {
 		// Linger briefly, then send the last segment. The brief waiting
 		// time allows the TC to transition to the closed state.
 		time.Sleep(5 * time.Second)
 		final, exists := conn.buf.Latest()
 		if exists && final.Flags != 0 {
-			if _, err := conn.sendDNSQuery(countHostNameLabels, final.DNSName(fmt.Sprintf("%c", ProxyPrefix), conn.dnsHostName)); err != nil {
+			if _, err := conn.carrier.Exchange(context.Background(), final); err != nil {
 				conn.logger.Warning("", err, "failed to send the final segment")
 			}
 		}
-		conn.logger.Info("", nil, "DNS data transport finished, the final segment was: %v", final)
+		conn.logger.Info("", nil, "data transport finished, the final segment was: %v", final)
 	}()
 	for {
 		if conn.tc.State() == tcpoverdns.StateClosed {
@@ -148,17 +92,17 @@ func (conn *ProxiedConnection) transportLoop() {
 			// Wait for a segment.
 			goto busyWaitInterval
 		}
-		// Turn the segment into a DNS query and send the query out
-		// (data.data.data.example.com).
-		replySeg, err = conn.sendDNSQuery(countHostNameLabels, outgoingSeg.DNSName(fmt.Sprintf("%c", ProxyPrefix), conn.dnsHostName))
-		conn.logger.Info(fmt.Sprint(conn.tc.ID), nil, "sent over DNS query in %dms: %+v", time.Since(begin).Milliseconds(), outgoingSeg)
+		// Send the segment out using the carrier, e.g. turn the segment into
+		// a DNS query (data.data.data.example.com).
+		replySeg, err = conn.carrier.Exchange(conn.context, outgoingSeg)
+		conn.logger.Info(fmt.Sprint(conn.tc.ID), nil, "sent over carrier in %dms: %+v", time.Since(begin).Milliseconds(), outgoingSeg)
 		if err != nil {
 			conn.logger.Warning(fmt.Sprint(conn.tc.ID), err, "failed to send output segment %v", outgoingSeg)
 			conn.tc.IncreaseTimingInterval()
 			goto busyWaitInterval
 		}
 		if conn.debug {
-			conn.logger.Info(fmt.Sprint(conn.tc.ID), nil, "DNS query response segment: %v", replySeg)
+			conn.logger.Info(fmt.Sprint(conn.tc.ID), nil, "carrier reply segment: %v", replySeg)
 		}
 		if replySeg.Flags.Has(tcpoverdns.FlagMalformed) {
 			// Slow down a notch in the presence of transmission error.
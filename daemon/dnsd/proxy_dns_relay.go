@@ -7,14 +7,12 @@ import (
 	"io"
 	"math/rand"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/tcpoverdns"
 	"github.com/HouzuoGuo/laitos/toolbox"
-	"github.com/miekg/dns"
 )
 
 type DNSRelay struct {
@@ -31,7 +29,14 @@ type DNSRelay struct {
 	DNSResolver string
 	// DNSHostName is the host name of the TCP-over-DNS proxy server.
 	DNSHostName string
-	dnsConfig   *dns.ClientConfig
+
+	// Carrier is the name of the carrier that transports segments to the
+	// TCP-over-DNS proxy server, e.g. "dns" (default), "https", or "icmp".
+	Carrier string
+	// CarrierAddress is the address of the proxy server used by carriers other
+	// than DNS, e.g. the URL of HTTPS carrier, or the IP of ICMP carrier.
+	CarrierAddress string
+	carrier        tcpoverdns.Carrier
 
 	// ForwardTo is the address (ip:port) of the public recursive DNS resolver.
 	ForwardTo string
@@ -60,30 +65,20 @@ func (relay *DNSRelay) Initialise(ctx context.Context) error {
 	relay.logger = &lalog.Logger{ComponentName: "DNSRelay", ComponentID: []lalog.LoggerIDField{{Key: "ForwardTo", Value: relay.ForwardTo}}}
 	relay.context, relay.cancelFun = context.WithCancel(ctx)
 
-	var err error
-	if relay.DNSResolver == "" {
-		relay.dnsConfig, err = dns.ClientConfigFromFile("/etc/resolv.conf")
-		if err != nil {
-			return err
-		}
-		if len(relay.dnsConfig.Servers) == 0 {
-			return fmt.Errorf("resolv.conf appears to be malformed or empty, try specifying an explicit DNS resolver address instead.")
-		}
-	} else {
-		host, port, err := net.SplitHostPort(relay.DNSResolver)
-		if err != nil {
-			return fmt.Errorf("failed to parse ip:port from DNS resolver %q", err)
-		}
-		portInt, err := strconv.Atoi(port)
-		if err != nil {
-			return fmt.Errorf("failed to parse ip:port from DNS resolver %q", err)
-		}
-		relay.dnsConfig = &dns.ClientConfig{
-			Servers: []string{host},
-			Port:    strconv.Itoa(portInt),
-		}
+	if relay.Carrier == "" {
+		relay.Carrier = DNSCarrierName
 	}
-	return nil
+	params := tcpoverdns.CarrierParams{
+		Address:         relay.CarrierAddress,
+		ResolverAddress: relay.DNSResolver,
+		Debug:           relay.Debug,
+	}
+	if relay.Carrier == DNSCarrierName {
+		params.Address = relay.DNSHostName
+	}
+	var err error
+	relay.carrier, err = tcpoverdns.NewCarrier(relay.Carrier, params)
+	return err
 }
 
 func (relay *DNSRelay) establish(ctx context.Context) (*ProxiedConnection, error) {
@@ -123,12 +118,11 @@ func (relay *DNSRelay) establish(ctx context.Context) (*ProxiedConnection, error
 	}
 	relay.Config.Config(tc)
 	conn := &ProxiedConnection{
-		debug:       relay.Debug,
-		dnsHostName: relay.DNSHostName,
-		dnsConfig:   relay.dnsConfig,
-		in:          proxyServerIn,
-		tc:          tc,
-		context:     ctx,
+		carrier: relay.carrier,
+		debug:   relay.Debug,
+		in:      proxyServerIn,
+		tc:      tc,
+		context: ctx,
 		logger: &lalog.Logger{
 			ComponentName: "DNSClientProxyConn",
 			ComponentID: []lalog.LoggerIDField{
@@ -11,13 +11,13 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/tcpoverdns"
 	"github.com/HouzuoGuo/laitos/toolbox"
-	"github.com/miekg/dns"
 )
 
 // HTTPProxyServer is an HTTP proxy server that tunnels its HTTP clients'
@@ -45,6 +45,11 @@ type HTTPProxyServer struct {
 	// RequestOTPSecret is the proxy OTP secret for laitos DNS server to
 	// authorise this client's connection requests.
 	RequestOTPSecret string `json:"RequestOTPSecret"`
+	// Multiplex transports all proxy connections as streams of a single,
+	// long-lived transmission control. This saves the handshake of a new
+	// transmission control for each connection, which greatly reduces the
+	// latency of browsers that open many connections in parallel.
+	Multiplex bool `json:"Multiplex"`
 
 	// httpTransport is the HTTP round tripper used by the proxy handler for
 	// HTTP (unencrypted) proxy requests. This transport is not used for handling
@@ -57,15 +62,26 @@ type HTTPProxyServer struct {
 	// DNSHostName is the host name of the TCP-over-DNS proxy server.
 	DNSHostName string
 
-	dnsConfig *dns.ClientConfig
+	// Carrier is the name of the carrier that transports segments to the
+	// TCP-over-DNS proxy server, e.g. "dns" (default), "https", or "icmp".
+	Carrier string
+	// CarrierAddress is the address of the proxy server used by carriers other
+	// than DNS, e.g. the URL of HTTPS carrier, or the IP of ICMP carrier.
+	CarrierAddress string
 	// dropPercentage is the percentage of resposnes to be dropped (returned as
 	// error). This is for internal testing only.
 	dropPercentage             int
 	proxyHandlerWithMiddleware http.HandlerFunc
-	logger                     *lalog.Logger
-	httpServer                 *http.Server
-	context                    context.Context
-	cancelFun                  func()
+	// mux multiplexes the proxy connections when Multiplex is enabled, it is
+	// re-established on demand after the underlying transmission control is
+	// closed, or when it is too old to take new streams.
+	mux        *tcpoverdns.Mux
+	muxStarted time.Time
+	muxMutex   *sync.Mutex
+	logger     *lalog.Logger
+	httpServer *http.Server
+	context    context.Context
+	cancelFun  func()
 }
 
 // Initialise validates configuration parameters and initialises the internal state of the daemon.
@@ -85,10 +101,11 @@ func (proxy *HTTPProxyServer) Initialise(ctx context.Context) error {
 	proxy.logger = &lalog.Logger{ComponentName: "HTTPProxyServer", ComponentID: []lalog.LoggerIDField{{Key: "Port", Value: strconv.Itoa(proxy.Port)}}}
 	proxy.proxyHandlerWithMiddleware = middleware.LogRequestStats(proxy.logger, middleware.EmergencyLockdown(proxy.ProxyHandler))
 	proxy.context, proxy.cancelFun = context.WithCancel(ctx)
+	proxy.muxMutex = new(sync.Mutex)
 
 	proxy.httpTransport = &http.Transport{
 		Proxy:                 nil,
-		DialContext:           proxy.dialContext,
+		DialContext:           proxy.DialContext,
 		ForceAttemptHTTP2:     false,
 		MaxIdleConns:          100,
 		IdleConnTimeout:       proxy.Config.Timing.ReadTimeout,
@@ -101,43 +118,89 @@ func (proxy *HTTPProxyServer) Initialise(ctx context.Context) error {
 		proxy.responderConfig.MaxSegmentLenExclHeader = proxy.DownstreamSegmentLength
 	}
 
-	var err error
-	if proxy.DNSResolver == "" {
-		proxy.dnsConfig, err = dns.ClientConfigFromFile("/etc/resolv.conf")
-		if err != nil {
-			return err
-		}
-		if len(proxy.dnsConfig.Servers) == 0 {
-			return fmt.Errorf("resolv.conf appears to be malformed or empty, try specifying an explicit DNS resolver address instead.")
-		}
-	} else {
-		host, port, err := net.SplitHostPort(proxy.DNSResolver)
-		if err != nil {
-			return fmt.Errorf("failed to parse ip:port from DNS resolver %q", err)
-		}
-		portInt, err := strconv.Atoi(port)
+	if proxy.Carrier == "" {
+		proxy.Carrier = DNSCarrierName
+	}
+	// Construct a carrier to validate its parameters.
+	if _, err := proxy.newCarrier(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newCarrier returns a new carrier for a proxy connection.
+func (proxy *HTTPProxyServer) newCarrier() (tcpoverdns.Carrier, error) {
+	params := tcpoverdns.CarrierParams{
+		Address:         proxy.CarrierAddress,
+		ResolverAddress: proxy.DNSResolver,
+		EnableTXT:       proxy.EnableTXTRequests,
+		DropPercentage:  proxy.dropPercentage,
+		Debug:           proxy.Debug,
+	}
+	if proxy.Carrier == DNSCarrierName {
+		params.Address = proxy.DNSHostName
+	}
+	return tcpoverdns.NewCarrier(proxy.Carrier, params)
+}
+
+// DialContext returns a network connection tunnelled by the TCP-over-DNS proxy.
+// The proxy server must have been initialised, though it does not have to be
+// serving HTTP proxy clients.
+func (proxy *HTTPProxyServer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if proxy.Multiplex {
+		return proxy.dialMux(network, addr)
+	}
+	tc, err := proxy.dialTC(ctx, ProxyRequest{Network: network, Address: addr})
+	if err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// dialMux returns a new stream of the mux that is tunnelled by the TCP-over-DNS
+// proxy. The mux is established if it has not been, or if it has been closed.
+// All streams of a mux are closed along with its transmission control upon the
+// maximum lifetime, therefore, a mux older than MaxMuxStreamOpenAge leaves the
+// new streams to a new mux, and keeps serving its existing streams until the
+// end of its lifetime.
+func (proxy *HTTPProxyServer) dialMux(network, addr string) (net.Conn, error) {
+	openData, err := json.Marshal(ProxyRequest{Network: network, Address: addr})
+	if err != nil {
+		return nil, err
+	}
+	proxy.muxMutex.Lock()
+	defer proxy.muxMutex.Unlock()
+	if proxy.mux == nil || proxy.mux.IsClosed() || time.Since(proxy.muxStarted) > MaxMuxStreamOpenAge {
+		// The mux outlives the individual requests.
+		tc, err := proxy.dialTC(proxy.context, ProxyRequest{Mux: true})
 		if err != nil {
-			return fmt.Errorf("failed to parse ip:port from DNS resolver %q", err)
+			return nil, err
 		}
-		proxy.dnsConfig = &dns.ClientConfig{
-			Servers: []string{host},
-			Port:    strconv.Itoa(portInt),
+		proxy.mux = &tcpoverdns.Mux{
+			Conn:      tc,
+			Initiator: true,
+			Debug:     proxy.Debug,
+			LogTag:    fmt.Sprint(tc.ID),
 		}
+		proxy.mux.Start(proxy.context)
+		proxy.muxStarted = time.Now()
 	}
-	return nil
+	return proxy.mux.OpenStream(openData)
 }
 
-// dialContet returns a network connection tunnelled by the TCP-over-DNS proxy.
-func (proxy *HTTPProxyServer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+// dialTC returns a new transmission control tunnelled by the TCP-over-DNS
+// proxy.
+func (proxy *HTTPProxyServer) dialTC(ctx context.Context, req ProxyRequest) (*tcpoverdns.TransmissionControl, error) {
 	_, curr, _, err := toolbox.GetTwoFACodes(proxy.RequestOTPSecret)
 	if err != nil {
 		return nil, err
 	}
-	initiatorSegment, err := json.Marshal(ProxyRequest{
-		Network:    network,
-		Address:    addr,
-		AccessTOTP: curr,
-	})
+	req.AccessTOTP = curr
+	initiatorSegment, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	carrier, err := proxy.newCarrier()
 	if err != nil {
 		return nil, err
 	}
@@ -167,14 +230,11 @@ func (proxy *HTTPProxyServer) dialContext(ctx context.Context, network, addr str
 	}
 	proxy.Config.Config(tc)
 	conn := &ProxiedConnection{
-		dnsHostName:       proxy.DNSHostName,
-		dnsConfig:         proxy.dnsConfig,
-		dropPercentage:    proxy.dropPercentage,
-		debug:             proxy.Debug,
-		enableTXTRequests: proxy.EnableTXTRequests,
-		in:                proxyServerIn,
-		tc:                tc,
-		context:           ctx,
+		carrier: carrier,
+		debug:   proxy.Debug,
+		in:      proxyServerIn,
+		tc:      tc,
+		context: ctx,
 		logger: &lalog.Logger{
 			ComponentName: "HTTPProxyServerConn",
 			ComponentID: []lalog.LoggerIDField{
@@ -184,7 +244,11 @@ func (proxy *HTTPProxyServer) dialContext(ctx context.Context, network, addr str
 	}
 	// Start returns after the local transmission control transitions to the
 	// established state.
-	return conn.tc, conn.Start()
+	if err := conn.Start(); err != nil {
+		_ = conn.tc.Close()
+		return nil, err
+	}
+	return conn.tc, nil
 }
 
 // ProxyHandler is an HTTP handler function that uses TCP-over-DNS proxy to
@@ -194,7 +258,7 @@ func (proxy *HTTPProxyServer) ProxyHandler(w http.ResponseWriter, r *http.Reques
 	switch r.Method {
 	case http.MethodConnect:
 		// Connect to the destination over TCP-over-DNS.
-		dstConn, err := proxy.dialContext(r.Context(), "tcp", r.Host)
+		dstConn, err := proxy.DialContext(r.Context(), "tcp", r.Host)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadGateway)
 			return
@@ -263,6 +327,11 @@ func (proxy *HTTPProxyServer) StartAndBlock() error {
 // Stop the proxy server.
 func (proxy *HTTPProxyServer) Stop() {
 	proxy.cancelFun()
+	proxy.muxMutex.Lock()
+	if proxy.mux != nil {
+		_ = proxy.mux.Close()
+	}
+	proxy.muxMutex.Unlock()
 	if proxy.httpServer != nil {
 		stopCtx, cancelFunc := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancelFunc()
@@ -2,11 +2,14 @@ package dnsd
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -14,6 +17,7 @@ import (
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/tcpoverdns"
 	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
 )
 
 func pipeSegments(t *testing.T, testOut, testIn net.Conn, proxy *Proxy) {
@@ -134,6 +138,75 @@ func TestProxy_TCPClient(t *testing.T) {
 	tcpoverdns.CheckTCError(t, tc, 2, 0, 0, 0)
 }
 
+func TestProxy_Mux(t *testing.T) {
+	echoTCPServer(t, 63242)
+	echoTCPServer(t, 63243)
+	proxy := &Proxy{
+		Debug:            true,
+		RequestOTPSecret: "testtest",
+	}
+	proxy.Start(context.Background())
+	_, curr, _, err := toolbox.GetTwoFACodes(proxy.RequestOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testIn, inTransport := net.Pipe()
+	testOut, outTransport := net.Pipe()
+	tc := &tcpoverdns.TransmissionControl{
+		LogTag:               "TestMux",
+		Debug:                true,
+		ID:                   1111,
+		InputTransport:       inTransport,
+		OutputTransport:      outTransport,
+		InitiatorSegmentData: []byte(fmt.Sprintf(`{"m": true, "t": "%s"}`, curr)),
+		Initiator:            true,
+	}
+	tc.Start(context.Background())
+	go pipeSegments(t, testOut, testIn, proxy)
+	mux := &tcpoverdns.Mux{Conn: tc, Initiator: true, Debug: true}
+	mux.Start(context.Background())
+	// Have a conversation with both echo servers over the same TC.
+	for _, port := range []int{63242, 63243} {
+		stream, err := mux.OpenStream([]byte(fmt.Sprintf(`{"p": %d, "a": "127.0.0.1"}`, port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(stream)
+		for _, line := range []string{"aaa\n", "bb\n"} {
+			if _, err := stream.Write([]byte(line)); err != nil {
+				t.Fatal(err)
+			}
+			if readBack, err := reader.ReadString('\n'); err != nil || readBack != line {
+				t.Fatalf("failed to read back line - n: %s, err: %v", readBack, err)
+			}
+		}
+		// The echo server closes the connection after "end\n", and so does the stream.
+		if _, err := stream.Write([]byte("end\n")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+	// An unreachable destination closes the stream without affecting the TC.
+	stream, err := mux.OpenStream([]byte(`{"p": 63244, "a": "127.0.0.1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal(err)
+	}
+	if tc.State() != tcpoverdns.StateEstablished {
+		t.Fatal(tc.State())
+	}
+	// Closing the mux closes the TC.
+	_ = mux.Close()
+	if tc.State() != tcpoverdns.StateClosed {
+		t.Fatal(tc.State())
+	}
+}
+
 func TestProxy_HTTPClient(t *testing.T) {
 	proxy := &Proxy{Debug: true}
 	proxy.Start(context.Background())
@@ -386,3 +459,54 @@ func TestProxy_CleanUp(t *testing.T) {
 		t.Fatalf("left over connections: %+v", proxy.connections)
 	}
 }
+
+func TestProxy_HTTPSCarrierLongPoll(t *testing.T) {
+	proxy := &Proxy{Debug: true}
+	proxy.Start(context.Background())
+
+	proxyIn, tcIn := net.Pipe()
+	go func() {
+		_, _ = io.Copy(io.Discard, tcIn)
+	}()
+	conn := &ProxyConnection{
+		proxy:         proxy,
+		context:       context.Background(),
+		tc:            &tcpoverdns.TransmissionControl{ID: 1234},
+		buf:           tcpoverdns.NewSegmentBuffer(lalog.DefaultLogger, true, 0),
+		inputSegments: proxyIn,
+		logger:        lalog.DefaultLogger,
+	}
+	proxy.mutex.Lock()
+	proxy.connections[1234] = conn
+	proxy.mutex.Unlock()
+
+	keepAlive := tcpoverdns.Segment{ID: 1234, Flags: tcpoverdns.FlagKeepAlive}
+	// The reply segment becomes available while the request is held.
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		conn.buf.Absorb(tcpoverdns.Segment{ID: 1234, SeqNum: 10, Data: []byte("hello")})
+	}()
+	begin := time.Now()
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(keepAlive.Packet())))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.GreaterOrEqual(t, time.Since(begin), 500*time.Millisecond)
+	reply := tcpoverdns.SegmentFromPacket(rec.Body.Bytes())
+	require.EqualValues(t, 10, reply.SeqNum)
+	require.Equal(t, []byte("hello"), reply.Data)
+
+	// The request is held no longer than its context allows.
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(keepAlive.Packet())).WithContext(ctx))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.True(t, tcpoverdns.SegmentFromPacket(rec.Body.Bytes()).Flags.Has(tcpoverdns.FlagKeepAlive))
+
+	// The transmission control was never started, do not let the proxy close it.
+	proxy.mutex.Lock()
+	delete(proxy.connections, 1234)
+	proxy.mutex.Unlock()
+	_ = proxy.Close()
+	_ = proxyIn.Close()
+}
@@ -0,0 +1,94 @@
+package dnsd
+
+import (
+	"bytes"
+	"crypto/rand"
+)
+
+/*
+The functions in this file implement the "0x20" protection (draft-vixie-dnsext-dns0x20) for the queries forwarded over
+UDP. The query name sent to the forwarder has its letters in randomised case, and the forwarder is expected to repeat
+the name in the response question exactly as is. An off-path attacker forging a response has to guess the case in
+addition to the transaction ID and source port.
+*/
+
+// questionNameRange returns the beginning and end offsets of the (uncompressed) question name in the DNS packet.
+func questionNameRange(packet []byte) (begin, end int, ok bool) {
+	// The question section immediately follows the 12 bytes of header.
+	begin = 12
+	for pos := begin; pos < len(packet); {
+		labelLen := int(packet[pos])
+		if labelLen == 0 {
+			return begin, pos + 1, true
+		}
+		if labelLen&0xC0 != 0 {
+			// The question name is not expected to be compressed.
+			return 0, 0, false
+		}
+		pos += 1 + labelLen
+	}
+	return 0, 0, false
+}
+
+// randomiseQueryNameCase returns a copy of the query packet with the letters of its question name in random case.
+func randomiseQueryNameCase(query []byte) []byte {
+	ret := make([]byte, len(query))
+	copy(ret, query)
+	begin, end, ok := questionNameRange(ret)
+	if !ok {
+		return ret
+	}
+	randBits := make([]byte, end-begin)
+	if _, err := rand.Read(randBits); err != nil {
+		return ret
+	}
+	for i := begin; i < end; i++ {
+		// The length prefix of a label is never a letter because a label is at most 63 characters long.
+		if c := ret[i]; c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			ret[i] = c&^0x20 | randBits[i-begin]&0x20
+		}
+	}
+	return ret
+}
+
+// hasIdenticalQuestionName returns true only if the two packets have the same question name in exactly the same case.
+func hasIdenticalQuestionName(query, resp []byte) bool {
+	queryBegin, queryEnd, queryOK := questionNameRange(query)
+	respBegin, respEnd, respOK := questionNameRange(resp)
+	return queryOK && respOK && bytes.Equal(query[queryBegin:queryEnd], resp[respBegin:respEnd])
+}
+
+/*
+restoreQueryNameCase overwrites the question name of the response with that of the query, if the two names only differ
+in case. This preserves the case of the name a client asked for, even if the forwarder does not. The answer records
+that refer to the question name by compression pointer are restored too.
+*/
+func restoreQueryNameCase(query, resp []byte) {
+	queryBegin, queryEnd, queryOK := questionNameRange(query)
+	respBegin, respEnd, respOK := questionNameRange(resp)
+	if !queryOK || !respOK || !equalFoldASCII(query[queryBegin:queryEnd], resp[respBegin:respEnd]) {
+		return
+	}
+	copy(resp[respBegin:respEnd], query[queryBegin:queryEnd])
+}
+
+// equalFoldASCII returns true only if the two byte slices are equal under ASCII case-folding, which is how DNS compares names.
+func equalFoldASCII(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if toLowerASCII(a[i]) != toLowerASCII(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// toLowerASCII returns the lower case of an ASCII letter, or the input byte as is.
+func toLowerASCII(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 0x20
+	}
+	return c
+}
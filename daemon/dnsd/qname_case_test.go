@@ -0,0 +1,111 @@
+package dnsd
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestRandomiseQueryNameCase(t *testing.T) {
+	query := buildDoHTestQuery(t, "www.example-123.com.", dnsmessage.TypeA)
+	begin, end, ok := questionNameRange(query)
+	require.True(t, ok)
+	require.Equal(t, 12, begin)
+	require.Equal(t, 12+len("www.example-123.com.")+1, end)
+
+	var randomised []byte
+	for i := 0; i < 10; i++ {
+		randomised = randomiseQueryNameCase(query)
+		if !bytes.Equal(query, randomised) {
+			break
+		}
+	}
+	require.NotEqual(t, query, randomised)
+	require.True(t, equalFoldASCII(query, randomised))
+	require.True(t, hasIdenticalQuestionName(randomised, randomised))
+	require.False(t, hasIdenticalQuestionName(query, randomised))
+
+	restoreQueryNameCase(query, randomised)
+	require.Equal(t, query, randomised)
+	// A response to a different name is left alone
+	other := buildDoHTestQuery(t, "www.example-124.com.", dnsmessage.TypeA)
+	restoreQueryNameCase(query, other)
+	require.Equal(t, buildDoHTestQuery(t, "www.example-124.com.", dnsmessage.TypeA), other)
+}
+
+// startCaseTestForwarder starts a UDP forwarder that answers each query with the query itself, optionally lower-casing the question name.
+func startCaseTestForwarder(t *testing.T, lowerCase bool) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, client, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			resp := append([]byte{}, buf[:n]...)
+			resp[2] |= 0x80
+			if begin, end, ok := questionNameRange(resp); lowerCase && ok {
+				for i := begin; i < end; i++ {
+					resp[i] = toLowerASCII(resp[i])
+				}
+			}
+			_, _ = conn.WriteToUDP(resp, client)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestDaemon_ForwardQueryNameCase(t *testing.T) {
+	for _, lowerCase := range []bool{false, true} {
+		daemon := &Daemon{
+			Address:       "127.0.0.1",
+			UDPPort:       62161,
+			Forwarders:    []string{startCaseTestForwarder(t, lowerCase)},
+			MyDomainNames: []string{"example.com"},
+			Processor:     toolbox.GetTestCommandProcessor(),
+		}
+		require.NoError(t, daemon.Initialise())
+		query := buildDoHTestQuery(t, "WwW.ExAmPlE.OrG.", dnsmessage.TypeA)
+		resp := daemon.respondToQuery(&lalog.Logger{}, "127.0.0.1", nil, nil, query)
+		if lowerCase {
+			// The forwarder that does not repeat the case of query name could be an impostor.
+			require.Nil(t, resp)
+			continue
+		}
+		var msg dnsmessage.Message
+		require.NoError(t, msg.Unpack(resp))
+		require.Equal(t, uint16(1234), msg.Header.ID)
+		require.Equal(t, "WwW.ExAmPlE.OrG.", msg.Questions[0].Name.String())
+	}
+}
+
+func TestDaemon_ANYQuery(t *testing.T) {
+	daemon := &Daemon{
+		Address:       "127.0.0.1",
+		UDPPort:       62162,
+		MyDomainNames: []string{"example.com"},
+		Processor:     toolbox.GetTestCommandProcessor(),
+	}
+	require.NoError(t, daemon.Initialise())
+	for _, name := range []string{"Www.Example.COM.", "example.org."} {
+		resp := daemon.respondToQuery(&lalog.Logger{}, "127.0.0.1", nil, nil, buildDoHTestQuery(t, name, dnsmessage.TypeALL))
+		var msg dnsmessage.Message
+		require.NoError(t, msg.Unpack(resp))
+		require.Equal(t, uint16(1234), msg.Header.ID)
+		require.Equal(t, name, msg.Questions[0].Name.String())
+		require.Len(t, msg.Answers, 1)
+		require.Equal(t, name, msg.Answers[0].Header.Name.String())
+		require.Equal(t, TypeHINFO, msg.Answers[0].Header.Type)
+		require.Equal(t, []byte("\x07RFC8482\x00"), msg.Answers[0].Body.(*dnsmessage.UnknownResource).Data)
+	}
+	// The recursive ANY query is subject to the restriction of recursive queries.
+	require.Nil(t, daemon.respondToQuery(&lalog.Logger{}, "10.0.0.1", nil, nil, buildDoHTestQuery(t, "example.org.", dnsmessage.TypeALL)))
+}
@@ -0,0 +1,536 @@
+package dnsd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+/*
+The functions in this file implement QNAME minimisation (RFC 9156) for the queries that would otherwise be forwarded to
+a recursive resolver in full. Instead of handing the complete query name to a forwarder, the daemon resolves the name
+iteratively starting from the root name servers, and reveals to each name server on the way just one more label than
+the zone the name server is authoritative for. Only the authoritative name servers of the query name get to see the
+full name and query type.
+*/
+
+// DefaultRootServers are the IPv4 addresses of the root name servers a.root-servers.net to m.root-servers.net.
+var DefaultRootServers = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13", "192.203.230.10", "192.5.5.241", "192.112.36.4",
+	"198.97.190.53", "192.36.148.17", "192.58.128.30", "193.0.14.129", "199.7.83.42", "202.12.27.33",
+}
+
+const (
+	// MinimisedQueryMaxSteps is the maximum number of queries made to the name servers to resolve a single name.
+	MinimisedQueryMaxSteps = 30
+	// MinimisedQueryMaxDepth is the maximum depth of nested resolutions, which are made to follow aliases (CNAME) and
+	// to find the addresses of name servers that come without glue records.
+	MinimisedQueryMaxDepth = 4
+	// MinimisedQueryMaxAttempts is the maximum number of name servers of a zone to try before giving up on a query.
+	MinimisedQueryMaxAttempts = 3
+	// MinimisedQueryUDPSize is the EDNS UDP payload size advertised to the name servers (DNS flag day 2020).
+	MinimisedQueryUDPSize = 1232
+	// ZoneCutCacheMaxEntries is the maximum number of zone cuts (delegations) to cache along with their name servers.
+	ZoneCutCacheMaxEntries = 10000
+	// ZoneCutCacheMaxTTLSec is the maximum number of seconds to cache a zone cut, regardless of the TTL of its NS records.
+	ZoneCutCacheMaxTTLSec = 6 * 3600
+	// AnswerCacheMaxEntries is the maximum number of resolved answers to cache.
+	AnswerCacheMaxEntries = 10000
+	// AnswerCacheMaxTTLSec is the maximum number of seconds to cache a resolved answer, regardless of the TTL of its records.
+	AnswerCacheMaxTTLSec = 3600
+)
+
+// zoneCut is a cached delegation of a zone to its name servers.
+type zoneCut struct {
+	servers []string
+	expiry  time.Time
+}
+
+// cachedAnswer is a cached resolution of a name and query type.
+type cachedAnswer struct {
+	answers     []dnsmessage.Resource
+	authorities []dnsmessage.Resource
+	rcode       dnsmessage.RCode
+	cachedAt    time.Time
+	expiry      time.Time
+}
+
+// QNameMinimiser resolves names iteratively from the root name servers, minimising the query name sent to each server.
+type QNameMinimiser struct {
+	// RootServers are the IP addresses of the root name servers, they default to DefaultRootServers.
+	RootServers []string
+	// Port is the port number of all name servers, it defaults to 53.
+	Port int
+
+	// zoneCuts maps the lower case zone names (with the trailing full-stop) to their name servers.
+	zoneCuts map[string]zoneCut
+	// answers maps the lower case names (with the trailing full-stop) and query types to their resolutions.
+	answers map[string]cachedAnswer
+	mutex   *sync.Mutex
+}
+
+// Initialise sets the default root servers and port number, and initialises internal states.
+func (minimiser *QNameMinimiser) Initialise() {
+	if len(minimiser.RootServers) == 0 {
+		minimiser.RootServers = DefaultRootServers
+	}
+	if minimiser.Port < 1 {
+		minimiser.Port = 53
+	}
+	minimiser.zoneCuts = make(map[string]zoneCut)
+	minimiser.answers = make(map[string]cachedAnswer)
+	minimiser.mutex = new(sync.Mutex)
+}
+
+/*
+Resolve resolves the question of the query packet iteratively and returns the response packet, which carries the ID
+and question of the query. Be aware that toolbox command processor may invoke this function with an incorrect PIN
+entry similar to the real PIN, therefore the returned error never carries the query name.
+*/
+func (minimiser *QNameMinimiser) Resolve(query []byte) ([]byte, error) {
+	var queryMsg dnsmessage.Message
+	if err := queryMsg.Unpack(query); err != nil {
+		return nil, fmt.Errorf("QNameMinimiser.Resolve: failed to parse the query - %w", err)
+	}
+	if len(queryMsg.Questions) != 1 || queryMsg.Questions[0].Class != dnsmessage.ClassINET {
+		return nil, errors.New("QNameMinimiser.Resolve: the query must have exactly one question of class INET")
+	}
+	question := queryMsg.Questions[0]
+	answers, authorities, rcode, err := minimiser.resolve(question.Name.String(), question.Type, 0)
+	if err != nil {
+		return nil, fmt.Errorf("QNameMinimiser.Resolve: %w", err)
+	}
+	// The name servers may have repeated the query name in different case, give the client the name it asked for.
+	for _, records := range [][]dnsmessage.Resource{answers, authorities} {
+		for i := range records {
+			if strings.EqualFold(records[i].Header.Name.String(), question.Name.String()) {
+				records[i].Header.Name = question.Name
+			}
+		}
+	}
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 queryMsg.Header.ID,
+			Response:           true,
+			RecursionDesired:   queryMsg.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions:   queryMsg.Questions,
+		Answers:     answers,
+		Authorities: authorities,
+	}
+	return resp.Pack()
+}
+
+/*
+resolve resolves the name by asking the name servers of each zone from the closest known zone cut downwards. The
+servers are asked for the A record of the name shortened to one label beneath their zone, until they refer the query
+further down to the servers of a child zone, or they turn out to be authoritative for the full name. The full name and
+query type are only revealed in the last query.
+*/
+func (minimiser *QNameMinimiser) resolve(name string, queryType dnsmessage.Type, depth int) (answers, authorities []dnsmessage.Resource, rcode dnsmessage.RCode, err error) {
+	if depth > MinimisedQueryMaxDepth {
+		err = errors.New("too many nested resolutions")
+		return
+	}
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	if cached, exists := minimiser.getCachedAnswer(name, queryType); exists {
+		return cached.answers, cached.authorities, cached.rcode, nil
+	}
+	defer func() {
+		if err == nil {
+			minimiser.cacheAnswer(name, queryType, answers, authorities, rcode)
+		}
+	}()
+	var labels []string
+	if name != "." {
+		labels = strings.Split(strings.TrimSuffix(name, "."), ".")
+	}
+	zone, servers := minimiser.closestZoneCut(labels)
+	known := countLabels(zone)
+	for step := 0; step < MinimisedQueryMaxSteps; step++ {
+		if known < len(labels) {
+			known++
+		}
+		full := known == len(labels)
+		minimisedName, askType := joinLabels(labels[len(labels)-known:]), dnsmessage.TypeA
+		if full {
+			askType = queryType
+		}
+		var resp *dnsmessage.Message
+		if resp, err = minimiser.exchange(servers, minimisedName, askType); err != nil {
+			return
+		}
+		if childZone, nsNames, ttl := getReferral(resp, zone, name); childZone != "" {
+			// Follow the referral down to the name servers of the child zone
+			if servers, err = minimiser.getNameServerAddrs(nsNames, resp.Additionals, depth); err != nil {
+				return
+			}
+			minimiser.cacheZoneCut(childZone, servers, ttl)
+			zone, known = childZone, countLabels(childZone)
+			continue
+		}
+		if !resp.Header.Authoritative && len(resp.Answers) == 0 {
+			err = errors.New("received a response that is neither authoritative nor a referral")
+			return
+		}
+		if !full {
+			switch resp.Header.RCode {
+			case dnsmessage.RCodeSuccess:
+				// The shortened name is not a zone cut, carry on with one more label.
+			case dnsmessage.RCodeNameError:
+				// Some name servers answer NXDOMAIN to empty non-terminals by mistake, ask for the full name right away.
+				known = len(labels) - 1
+			default:
+				err = fmt.Errorf("name server responded with %s", resp.Header.RCode)
+				return
+			}
+			continue
+		}
+		answers, authorities, rcode = resp.Answers, resp.Authorities, resp.Header.RCode
+		if rcode != dnsmessage.RCodeSuccess && rcode != dnsmessage.RCodeNameError {
+			err = fmt.Errorf("name server responded with %s", rcode)
+			return
+		}
+		// Follow the alias that points outside of the zone
+		if target := getUnresolvedAlias(answers, name, queryType); target != "" {
+			var aliasAnswers []dnsmessage.Resource
+			if aliasAnswers, authorities, rcode, err = minimiser.resolve(target, queryType, depth+1); err != nil {
+				return
+			}
+			answers = append(answers, aliasAnswers...)
+		}
+		return
+	}
+	err = errors.New("too many steps")
+	return
+}
+
+// closestZoneCut returns the closest enclosing zone of the name labels among the cached zone cuts, and its name servers.
+func (minimiser *QNameMinimiser) closestZoneCut(labels []string) (zone string, servers []string) {
+	minimiser.mutex.Lock()
+	defer minimiser.mutex.Unlock()
+	for i := range labels {
+		zone = joinLabels(labels[i:])
+		if cut, exists := minimiser.zoneCuts[zone]; exists && time.Now().Before(cut.expiry) {
+			return zone, cut.servers
+		}
+	}
+	return ".", minimiser.RootServers
+}
+
+// cacheZoneCut remembers the name servers of the zone for no longer than ZoneCutCacheMaxTTLSec.
+func (minimiser *QNameMinimiser) cacheZoneCut(zone string, servers []string, ttl uint32) {
+	if ttl > ZoneCutCacheMaxTTLSec {
+		ttl = ZoneCutCacheMaxTTLSec
+	}
+	minimiser.mutex.Lock()
+	defer minimiser.mutex.Unlock()
+	if len(minimiser.zoneCuts) >= ZoneCutCacheMaxEntries {
+		minimiser.zoneCuts = make(map[string]zoneCut)
+	}
+	minimiser.zoneCuts[zone] = zoneCut{servers: servers, expiry: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// answerCacheKey returns the key of the lower case name and query type among the cached answers.
+func answerCacheKey(name string, queryType dnsmessage.Type) string {
+	return name + " " + queryType.String()
+}
+
+// getCachedAnswer returns a copy of the cached answer of the name and query type, with the TTL of each record reduced
+// by the time spent in the cache.
+func (minimiser *QNameMinimiser) getCachedAnswer(name string, queryType dnsmessage.Type) (ret cachedAnswer, exists bool) {
+	minimiser.mutex.Lock()
+	cached, exists := minimiser.answers[answerCacheKey(name, queryType)]
+	minimiser.mutex.Unlock()
+	if !exists || !time.Now().Before(cached.expiry) {
+		return cachedAnswer{}, false
+	}
+	elapsed := uint32(time.Since(cached.cachedAt) / time.Second)
+	age := func(records []dnsmessage.Resource) []dnsmessage.Resource {
+		aged := make([]dnsmessage.Resource, len(records))
+		copy(aged, records)
+		for i := range aged {
+			if aged[i].Header.TTL > elapsed {
+				aged[i].Header.TTL -= elapsed
+			} else {
+				aged[i].Header.TTL = 0
+			}
+		}
+		return aged
+	}
+	return cachedAnswer{answers: age(cached.answers), authorities: age(cached.authorities), rcode: cached.rcode}, true
+}
+
+/*
+cacheAnswer remembers the resolution of the name and query type for the lowest TTL among the records, and no longer
+than AnswerCacheMaxTTLSec. A negative answer is cached for the TTL of its SOA record (RFC 2308). The resolution that
+does not carry any record is not cached.
+*/
+func (minimiser *QNameMinimiser) cacheAnswer(name string, queryType dnsmessage.Type, answers, authorities []dnsmessage.Resource, rcode dnsmessage.RCode) {
+	if len(answers)+len(authorities) == 0 {
+		return
+	}
+	ttl := uint32(AnswerCacheMaxTTLSec)
+	for _, records := range [][]dnsmessage.Resource{answers, authorities} {
+		for _, record := range records {
+			if record.Header.TTL < ttl {
+				ttl = record.Header.TTL
+			}
+			if soa, ok := record.Body.(*dnsmessage.SOAResource); ok && soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	minimiser.mutex.Lock()
+	defer minimiser.mutex.Unlock()
+	if len(minimiser.answers) >= AnswerCacheMaxEntries {
+		minimiser.answers = make(map[string]cachedAnswer)
+	}
+	minimiser.answers[answerCacheKey(name, queryType)] = cachedAnswer{
+		answers:     slices.Clone(answers),
+		authorities: slices.Clone(authorities),
+		rcode:       rcode,
+		cachedAt:    now,
+		expiry:      now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// getNameServerAddrs returns the IPv4 addresses of the name servers from the glue records, or resolves them if there is no glue.
+func (minimiser *QNameMinimiser) getNameServerAddrs(nsNames []string, additionals []dnsmessage.Resource, depth int) ([]string, error) {
+	var ret []string
+	for _, additional := range additionals {
+		if addr, ok := additional.Body.(*dnsmessage.AResource); ok {
+			for _, nsName := range nsNames {
+				if strings.EqualFold(additional.Header.Name.String(), nsName) {
+					ret = append(ret, net.IP(addr.A[:]).String())
+				}
+			}
+		}
+	}
+	for i := 0; len(ret) == 0 && i < len(nsNames) && i < MinimisedQueryMaxAttempts; i++ {
+		answers, _, _, err := minimiser.resolve(nsNames[i], dnsmessage.TypeA, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, answer := range answers {
+			if addr, ok := answer.Body.(*dnsmessage.AResource); ok {
+				ret = append(ret, net.IP(addr.A[:]).String())
+			}
+		}
+	}
+	if len(ret) == 0 {
+		return nil, errors.New("failed to find the address of any name server of the zone")
+	}
+	return ret, nil
+}
+
+// exchange asks a few randomly chosen name servers the question, and returns the first response received.
+func (minimiser *QNameMinimiser) exchange(servers []string, name string, queryType dnsmessage.Type) (*dnsmessage.Message, error) {
+	var lastErr error
+	for i, serverIndex := range mathrand.Perm(len(servers)) {
+		if i == MinimisedQueryMaxAttempts {
+			break
+		}
+		resp, err := minimiser.exchangeWith(net.JoinHostPort(servers[serverIndex], strconv.Itoa(minimiser.Port)), name, queryType)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("there is no name server to ask")
+	}
+	return nil, lastErr
+}
+
+// exchangeWith asks the name server the question over UDP, and asks again over TCP if the UDP response is truncated.
+func (minimiser *QNameMinimiser) exchangeWith(serverAddr, name string, queryType dnsmessage.Type) (*dnsmessage.Message, error) {
+	queryName, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	var queryID [2]byte
+	if _, err := rand.Read(queryID[:]); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.Resource
+	if err := opt.Header.SetEDNS0(MinimisedQueryUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	opt.Body = &dnsmessage.OPTResource{}
+	queryMsg := dnsmessage.Message{
+		Header:      dnsmessage.Header{ID: binary.BigEndian.Uint16(queryID[:])},
+		Questions:   []dnsmessage.Question{{Name: queryName, Type: queryType, Class: dnsmessage.ClassINET}},
+		Additionals: []dnsmessage.Resource{opt},
+	}
+	query, err := queryMsg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// Randomise the case of query name to make it harder to forge a response
+	query = randomiseQueryNameCase(query)
+	respBody, err := minimiser.roundTrip("udp", serverAddr, query)
+	if err != nil {
+		return nil, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(respBody); err != nil {
+		return nil, err
+	}
+	if resp.Header.Truncated {
+		if respBody, err = minimiser.roundTrip("tcp", serverAddr, query); err != nil {
+			return nil, err
+		}
+		if err := resp.Unpack(respBody); err != nil {
+			return nil, err
+		}
+	}
+	if resp.Header.ID != queryMsg.Header.ID || !hasIdenticalQuestionName(query, respBody) {
+		return nil, errors.New("discarded the response that does not match the query, it may have been forged")
+	}
+	return &resp, nil
+}
+
+// roundTrip sends the query packet to the name server over UDP or TCP and returns the response packet.
+func (minimiser *QNameMinimiser) roundTrip(network, serverAddr string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, serverAddr, ForwarderTimeoutSec*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(ForwarderTimeoutSec * time.Second)); err != nil {
+		return nil, err
+	}
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		respBody := make([]byte, MaxPacketSize)
+		n, err := conn.Read(respBody)
+		if err != nil {
+			return nil, err
+		}
+		return respBody[:n], nil
+	}
+	if _, err := conn.Write(append([]byte{byte(len(query) / 256), byte(len(query) % 256)}, query...)); err != nil {
+		return nil, err
+	}
+	respLen := make([]byte, 2)
+	if _, err := io.ReadFull(conn, respLen); err != nil {
+		return nil, err
+	}
+	respBody := make([]byte, int(respLen[0])*256+int(respLen[1]))
+	if _, err := io.ReadFull(conn, respBody); err != nil {
+		return nil, err
+	}
+	return respBody, nil
+}
+
+/*
+getReferral returns the child zone, its name server names, and the TTL of its NS records, if the response refers the
+query to the name servers of a zone beneath the current zone that encloses the name. Otherwise it returns an empty
+child zone.
+*/
+func getReferral(resp *dnsmessage.Message, zone, name string) (childZone string, nsNames []string, ttl uint32) {
+	if resp.Header.RCode != dnsmessage.RCodeSuccess || len(resp.Answers) > 0 {
+		return "", nil, 0
+	}
+	for _, authority := range resp.Authorities {
+		ns, ok := authority.Body.(*dnsmessage.NSResource)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(authority.Header.Name.String())
+		if countLabels(owner) <= countLabels(zone) || !isSubdomain(name, owner) || childZone != "" && owner != childZone {
+			continue
+		}
+		if childZone == "" || authority.Header.TTL < ttl {
+			ttl = authority.Header.TTL
+		}
+		childZone = owner
+		nsNames = append(nsNames, ns.NS.String())
+	}
+	return
+}
+
+// getUnresolvedAlias returns the end of the alias (CNAME) chain of the name if the answers do not include its records.
+func getUnresolvedAlias(answers []dnsmessage.Resource, name string, queryType dnsmessage.Type) string {
+	if queryType == dnsmessage.TypeCNAME || queryType == dnsmessage.TypeALL {
+		return ""
+	}
+	target := name
+	for i := 0; i < len(answers); i++ {
+		for _, answer := range answers {
+			if cname, ok := answer.Body.(*dnsmessage.CNAMEResource); ok && strings.EqualFold(answer.Header.Name.String(), target) {
+				target = strings.ToLower(cname.CNAME.String())
+				break
+			}
+		}
+	}
+	if target == name {
+		return ""
+	}
+	for _, answer := range answers {
+		if answer.Header.Type == queryType && strings.EqualFold(answer.Header.Name.String(), target) {
+			return ""
+		}
+	}
+	return target
+}
+
+// isSubdomain returns true if the lower case name is the same as the lower case parent zone name or is beneath it.
+func isSubdomain(name, parent string) bool {
+	return parent == "." || name == parent || strings.HasSuffix(name, "."+parent)
+}
+
+// countLabels returns the number of labels of the name, the root zone "." has none.
+func countLabels(name string) int {
+	if name = strings.TrimSuffix(name, "."); name == "" {
+		return 0
+	}
+	return strings.Count(name, ".") + 1
+}
+
+// joinLabels returns the DNS name of the labels with the trailing full-stop.
+func joinLabels(labels []string) string {
+	return strings.Join(labels, ".") + "."
+}
+
+/*
+resolveWithMinimisedName resolves the query iteratively with QNAME minimisation. It returns nil if QNAME minimisation
+is not in use (including when the queries go through a DNS relay) or the resolution fails, in which case the caller
+should forward the query to a recursive resolver instead.
+*/
+func (daemon *Daemon) resolveWithMinimisedName(clientIP string, queryBody []byte) []byte {
+	if daemon.qnameMinimiser == nil || daemon.DNSRelay != nil {
+		return nil
+	}
+	resolveStart := time.Now()
+	respBody, err := daemon.qnameMinimiser.Resolve(queryBody)
+	if err != nil {
+		daemon.logger.Info(clientIP, err, "failed to resolve the query with minimised name, forwarding the query instead")
+		return nil
+	}
+	recordForwarderDuration("minimised", resolveStart)
+	return respBody
+}
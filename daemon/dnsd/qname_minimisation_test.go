@@ -0,0 +1,200 @@
+package dnsd
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const minimisationTestPort = 62164
+
+// minimisationTestServer is a UDP name server that answers with the response of its handler and records the queries.
+type minimisationTestServer struct {
+	mutex   sync.Mutex
+	queries []string
+}
+
+func (server *minimisationTestServer) getQueries() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	ret := server.queries
+	server.queries = nil
+	return ret
+}
+
+func startMinimisationTestServer(t *testing.T, ip string, handler func(name string, queryType dnsmessage.Type) dnsmessage.Message) *minimisationTestServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(ip), Port: minimisationTestPort})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	server := &minimisationTestServer{}
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, client, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var query dnsmessage.Message
+			if query.Unpack(buf[:n]) != nil {
+				continue
+			}
+			name := strings.ToLower(query.Questions[0].Name.String())
+			server.mutex.Lock()
+			server.queries = append(server.queries, name+" "+query.Questions[0].Type.String())
+			server.mutex.Unlock()
+			resp := handler(name, query.Questions[0].Type)
+			resp.Header.ID = query.Header.ID
+			resp.Header.Response = true
+			resp.Questions = query.Questions
+			respBody, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteToUDP(respBody, client)
+		}
+	}()
+	return server
+}
+
+func minimisationTestRR(name string, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: 300}, Body: body}
+}
+
+// minimisationTestReferral refers the query to the name server of the zone, with or without the glue address.
+func minimisationTestReferral(zone, nsName, glue string) dnsmessage.Message {
+	resp := dnsmessage.Message{Authorities: []dnsmessage.Resource{minimisationTestRR(zone, &dnsmessage.NSResource{NS: dnsmessage.MustNewName(nsName)})}}
+	if glue != "" {
+		resp.Additionals = []dnsmessage.Resource{minimisationTestRR(nsName, &dnsmessage.AResource{A: [4]byte(net.ParseIP(glue).To4())})}
+	}
+	return resp
+}
+
+func minimisationTestAnswer(rcode dnsmessage.RCode, answers ...dnsmessage.Resource) dnsmessage.Message {
+	return dnsmessage.Message{Header: dnsmessage.Header{Authoritative: true, RCode: rcode}, Answers: answers}
+}
+
+func TestDaemon_QNameMinimisation(t *testing.T) {
+	rootServer := startMinimisationTestServer(t, "127.0.0.1", func(name string, _ dnsmessage.Type) dnsmessage.Message {
+		if strings.HasSuffix(name, "net.") {
+			// The name server of net. comes without glue
+			return minimisationTestReferral("net.", "ns.example.com.", "")
+		}
+		return minimisationTestReferral("com.", "a.gtld.com.", "127.0.0.2")
+	})
+	comServer := startMinimisationTestServer(t, "127.0.0.2", func(name string, _ dnsmessage.Type) dnsmessage.Message {
+		return minimisationTestReferral("example.com.", "ns1.example.com.", "127.0.0.3")
+	})
+	exampleComServer := startMinimisationTestServer(t, "127.0.0.3", func(name string, queryType dnsmessage.Type) dnsmessage.Message {
+		switch {
+		case name == "www.a.example.com." && queryType == dnsmessage.TypeTXT:
+			return minimisationTestAnswer(dnsmessage.RCodeSuccess, minimisationTestRR(name, &dnsmessage.TXTResource{TXT: []string{"hello"}}))
+		case name == "alias.example.com.":
+			return minimisationTestAnswer(dnsmessage.RCodeSuccess, minimisationTestRR(name, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("target.example.net.")}))
+		case name == "ns.example.com.":
+			return minimisationTestAnswer(dnsmessage.RCodeSuccess, minimisationTestRR(name, &dnsmessage.AResource{A: [4]byte{127, 0, 0, 4}}))
+		case name == "a.example.com." || name == "www.a.example.com.":
+			return minimisationTestAnswer(dnsmessage.RCodeSuccess)
+		}
+		return minimisationTestAnswer(dnsmessage.RCodeNameError)
+	})
+	netServer := startMinimisationTestServer(t, "127.0.0.4", func(name string, _ dnsmessage.Type) dnsmessage.Message {
+		if name == "target.example.net." {
+			return minimisationTestAnswer(dnsmessage.RCodeSuccess, minimisationTestRR(name, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}))
+		}
+		return minimisationTestAnswer(dnsmessage.RCodeSuccess)
+	})
+
+	daemon := &Daemon{
+		Address:           "127.0.0.1",
+		UDPPort:           62165,
+		Forwarders:        []string{startCaseTestForwarder(t, false)},
+		MyDomainNames:     []string{"example.org"},
+		Processor:         toolbox.GetTestCommandProcessor(),
+		QNameMinimisation: true,
+	}
+	require.NoError(t, daemon.Initialise())
+	daemon.qnameMinimiser = &QNameMinimiser{RootServers: []string{"127.0.0.1"}, Port: minimisationTestPort}
+	daemon.qnameMinimiser.Initialise()
+
+	// Each name server sees no more than one label beneath its zone, only the last one sees the full name and type.
+	resp := daemon.respondToQuery(&lalog.Logger{}, "127.0.0.1", nil, nil, buildDoHTestQuery(t, "WwW.A.ExAmPlE.CoM.", dnsmessage.TypeTXT))
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(resp))
+	require.Equal(t, uint16(1234), msg.Header.ID)
+	require.Equal(t, dnsmessage.RCodeSuccess, msg.Header.RCode)
+	require.Equal(t, "WwW.A.ExAmPlE.CoM.", msg.Questions[0].Name.String())
+	require.Len(t, msg.Answers, 1)
+	require.Equal(t, "WwW.A.ExAmPlE.CoM.", msg.Answers[0].Header.Name.String())
+	require.Equal(t, []string{"hello"}, msg.Answers[0].Body.(*dnsmessage.TXTResource).TXT)
+	require.Equal(t, []string{"com. TypeA"}, rootServer.getQueries())
+	require.Equal(t, []string{"example.com. TypeA"}, comServer.getQueries())
+	require.Equal(t, []string{"a.example.com. TypeA", "www.a.example.com. TypeTXT"}, exampleComServer.getQueries())
+
+	// The answer is cached for no longer than its TTL, and none of the name servers is asked again.
+	resp = daemon.respondToQuery(&lalog.Logger{}, "127.0.0.1", nil, nil, buildDoHTestQuery(t, "www.a.example.com.", dnsmessage.TypeTXT))
+	require.NoError(t, msg.Unpack(resp))
+	require.Len(t, msg.Answers, 1)
+	require.Equal(t, "www.a.example.com.", msg.Answers[0].Header.Name.String())
+	require.LessOrEqual(t, msg.Answers[0].Header.TTL, uint32(300))
+	require.Empty(t, rootServer.getQueries())
+	require.Empty(t, comServer.getQueries())
+	require.Empty(t, exampleComServer.getQueries())
+
+	// The cached zone cut of example.com. spares the root and com. servers, the alias is followed into net.
+	resp = daemon.respondToQuery(&lalog.Logger{}, "127.0.0.1", nil, nil, buildDoHTestQuery(t, "alias.example.com.", dnsmessage.TypeA))
+	require.NoError(t, msg.Unpack(resp))
+	require.Len(t, msg.Answers, 2)
+	require.Equal(t, "target.example.net.", msg.Answers[0].Body.(*dnsmessage.CNAMEResource).CNAME.String())
+	require.Equal(t, [4]byte{192, 0, 2, 2}, msg.Answers[1].Body.(*dnsmessage.AResource).A)
+	require.Equal(t, []string{"net. TypeA"}, rootServer.getQueries())
+	require.Empty(t, comServer.getQueries())
+	require.Equal(t, []string{"alias.example.com. TypeA", "ns.example.com. TypeA"}, exampleComServer.getQueries())
+	require.Equal(t, []string{"example.net. TypeA", "target.example.net. TypeA"}, netServer.getQueries())
+
+	// The name that does not exist
+	resp = daemon.respondToQuery(&lalog.Logger{}, "127.0.0.1", nil, nil, buildDoHTestQuery(t, "b.c.example.com.", dnsmessage.TypeA))
+	require.NoError(t, msg.Unpack(resp))
+	require.Equal(t, dnsmessage.RCodeNameError, msg.Header.RCode)
+	require.Equal(t, []string{"c.example.com. TypeA", "b.c.example.com. TypeA"}, exampleComServer.getQueries())
+
+	// The answer that expired is resolved again from the cached zone cut.
+	daemon.qnameMinimiser.mutex.Lock()
+	for key, cached := range daemon.qnameMinimiser.answers {
+		cached.expiry = time.Now()
+		daemon.qnameMinimiser.answers[key] = cached
+	}
+	daemon.qnameMinimiser.mutex.Unlock()
+	resp = daemon.respondToQuery(&lalog.Logger{}, "127.0.0.1", nil, nil, buildDoHTestQuery(t, "www.a.example.com.", dnsmessage.TypeTXT))
+	require.NoError(t, msg.Unpack(resp))
+	require.Len(t, msg.Answers, 1)
+	require.Empty(t, comServer.getQueries())
+	require.Equal(t, []string{"a.example.com. TypeA", "www.a.example.com. TypeTXT"}, exampleComServer.getQueries())
+
+	// The query is forwarded in full if the iterative resolution fails
+	daemon.qnameMinimiser = &QNameMinimiser{RootServers: []string{"127.0.0.5"}, Port: minimisationTestPort}
+	daemon.qnameMinimiser.Initialise()
+	query := buildDoHTestQuery(t, "www.example.com.", dnsmessage.TypeA)
+	resp = daemon.respondToQuery(&lalog.Logger{}, "127.0.0.1", nil, nil, query)
+	require.NoError(t, msg.Unpack(resp))
+	require.Equal(t, "www.example.com.", msg.Questions[0].Name.String())
+	require.Empty(t, msg.Answers)
+}
+
+func TestGetUnresolvedAlias(t *testing.T) {
+	cname := func(name, target string) dnsmessage.Resource {
+		return minimisationTestRR(name, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)})
+	}
+	addr := minimisationTestRR("c.example.com.", &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}})
+	addr.Header.Type = dnsmessage.TypeA
+	require.Equal(t, "", getUnresolvedAlias(nil, "a.example.com.", dnsmessage.TypeA))
+	require.Equal(t, "c.example.com.", getUnresolvedAlias([]dnsmessage.Resource{cname("a.example.com.", "B.example.com."), cname("b.example.com.", "c.example.com.")}, "a.example.com.", dnsmessage.TypeA))
+	require.Equal(t, "", getUnresolvedAlias([]dnsmessage.Resource{cname("a.example.com.", "c.example.com."), addr}, "a.example.com.", dnsmessage.TypeA))
+	require.Equal(t, "", getUnresolvedAlias([]dnsmessage.Resource{cname("a.example.com.", "c.example.com.")}, "a.example.com.", dnsmessage.TypeCNAME))
+}
@@ -1,6 +1,7 @@
 package dnsd
 
 import (
+	"encoding/base32"
 	"errors"
 	"fmt"
 	"net"
@@ -15,10 +16,29 @@ import (
 const (
 	// EDNSBufferSize is the maximum DNS buffer size advertised to DNS clients.
 	EDNSBufferSize = 1232
+	// TypeHINFO is the type of host information record (RFC 1035), which is not among the types known to dnsmessage package.
+	TypeHINFO = dnsmessage.Type(13)
+	// TypeHTTPS is the type of HTTPS service binding record (RFC 9460), which is not among the types known to dnsmessage package.
+	TypeHTTPS = dnsmessage.Type(65)
 )
 
 // BuildTextResponse constructs a TXT record response packet.
 func BuildTextResponse(name string, header dnsmessage.Header, question dnsmessage.Question, txt []string) ([]byte, error) {
+	records := make([][]string, 0, len(txt))
+	for _, entry := range txt {
+		records = append(records, []string{entry})
+	}
+	return buildTextResponse(name, header, question, records)
+}
+
+// BuildChunkTextResponse constructs a TXT record response packet that carries a chunk of long app command output.
+// The chunk header and content are placed in the same record, so that they stay together in their order.
+func BuildChunkTextResponse(name string, header dnsmessage.Header, question dnsmessage.Question, chunkHeader, chunk string) ([]byte, error) {
+	return buildTextResponse(name, header, question, [][]string{{chunkHeader, chunk}})
+}
+
+// buildTextResponse constructs a response packet of TXT records, each record comprises one or more strings.
+func buildTextResponse(name string, header dnsmessage.Header, question dnsmessage.Question, records [][]string) ([]byte, error) {
 	// Retain the original transaction ID.
 	header.Response = true
 	header.Truncated = false
@@ -40,19 +60,79 @@ func BuildTextResponse(name string, header dnsmessage.Header, question dnsmessag
 	if err != nil {
 		return nil, err
 	}
-	for _, entry := range txt {
+	for _, record := range records {
 		if err := builder.TXTResource(dnsmessage.ResourceHeader{
 			Name:  dnsName,
-			Class: dnsmessage.ClassINET, TTL: CommonResponseTTL}, dnsmessage.TXTResource{TXT: []string{entry}}); err != nil {
+			Class: dnsmessage.ClassINET, TTL: CommonResponseTTL}, dnsmessage.TXTResource{TXT: record}); err != nil {
 			return nil, err
 		}
 	}
 	return builder.Finish()
 }
 
+/*
+BuildHINFOResponse constructs a response to an ANY query with a single HINFO record, whose CPU field is "RFC8482" and OS
+field is empty, as recommended by RFC 8482. The record TTL is hard coded to 3600 seconds.
+*/
+func BuildHINFOResponse(header dnsmessage.Header, question dnsmessage.Question, authoritative bool) ([]byte, error) {
+	header.Response = true
+	header.Truncated = false
+	header.Authoritative = authoritative
+	header.RecursionAvailable = header.RecursionDesired
+	builder := dnsmessage.NewBuilder(nil, header)
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, err
+	}
+	if err := builder.StartAnswers(); err != nil {
+		return nil, err
+	}
+	// The HINFO record data comprises two character strings, each of which is prefixed by its length.
+	cpu, os := "RFC8482", ""
+	data := make([]byte, 0, 2+len(cpu)+len(os))
+	data = append(data, byte(len(cpu)))
+	data = append(data, cpu...)
+	data = append(data, byte(len(os)))
+	data = append(data, os...)
+	if err := builder.UnknownResource(dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Type:  TypeHINFO,
+		Class: dnsmessage.ClassINET,
+		TTL:   3600,
+	}, dnsmessage.UnknownResource{Type: TypeHINFO, Data: data}); err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
 // BuildBlackHoleAddrResponse constructs an A or AAAA address record response
 // packet pointing to localhost, the record TTL is hard coded to 600 seconds.
 func BuildBlackHoleAddrResponse(header dnsmessage.Header, question dnsmessage.Question) ([]byte, error) {
+	// 0.0.0.0 - any network interface, ::1 - localhost.
+	return buildFixedAddrResponse(header, question, [4]byte{0, 0, 0, 0}, [16]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 600)
+}
+
+// BuildBlockPageAddrResponse constructs an A or AAAA address record response
+// packet pointing to the web server that serves the block page. A nil block
+// page address leads to the black hole address of the same type.
+func BuildBlockPageAddrResponse(header dnsmessage.Header, question dnsmessage.Question, ipv4, ipv6 net.IP) ([]byte, error) {
+	v4 := [4]byte{0, 0, 0, 0}
+	v6 := [16]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}
+	if ipv4 != nil {
+		copy(v4[:], ipv4.To4())
+	}
+	if ipv6 != nil {
+		copy(v6[:], ipv6.To16())
+	}
+	return buildFixedAddrResponse(header, question, v4, v6, BlockPageResponseTTL)
+}
+
+// buildFixedAddrResponse constructs an A or AAAA address record response
+// packet that answers the question with the fixed address.
+func buildFixedAddrResponse(header dnsmessage.Header, question dnsmessage.Question, v4 [4]byte, v6 [16]byte, ttl uint32) ([]byte, error) {
 	// Retain the original transaction ID.
 	header.Response = true
 	header.Truncated = false
@@ -79,9 +159,8 @@ func BuildBlackHoleAddrResponse(header dnsmessage.Header, question dnsmessage.Qu
 		err := builder.AResource(dnsmessage.ResourceHeader{
 			Name:  dnsName,
 			Class: dnsmessage.ClassINET,
-			TTL:   600,
-			// 0.0.0.0 - any network interface.
-		}, dnsmessage.AResource{A: [4]byte{0, 0, 0, 0}})
+			TTL:   ttl,
+		}, dnsmessage.AResource{A: v4})
 		if err != nil {
 			return nil, err
 		}
@@ -89,11 +168,8 @@ func BuildBlackHoleAddrResponse(header dnsmessage.Header, question dnsmessage.Qu
 		err := builder.AAAAResource(dnsmessage.ResourceHeader{
 			Name:  dnsName,
 			Class: dnsmessage.ClassINET,
-			TTL:   600,
-		}, dnsmessage.AAAAResource{
-			// ::1 - localhost.
-			AAAA: [16]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
-		})
+			TTL:   ttl,
+		}, dnsmessage.AAAAResource{AAAA: v6})
 		if err != nil {
 			return nil, err
 		}
@@ -140,6 +216,25 @@ func DecodeDTMFCommandInput(labels []string) (decodedCommand string) {
 	return
 }
 
+// BinaryCommandEncoding is the base32 encoding of binary data carried by query labels, DNS names are case-insensitive.
+var BinaryCommandEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+/*
+DecodeBinaryCommandInput extracts a binary phone-home report from the input DNS query labels which exclude the domain
+name, and returns the equivalent app command. The first label must be the binary command prefix.
+*/
+func DecodeBinaryCommandInput(labels []string) (decodedCommand string, err error) {
+	if len(labels) < 2 || labels[0] != ToolboxBinaryCommandPrefix {
+		return "", errors.New("DecodeBinaryCommandInput: the query does not carry a binary command")
+	}
+	// Resolvers may randomise the letter case of a query (DNS 0x20 encoding)
+	decoded, err := BinaryCommandEncoding.DecodeString(strings.ToUpper(strings.Join(labels[1:], "")))
+	if err != nil {
+		return "", fmt.Errorf("DecodeBinaryCommandInput: failed to decode base32 - %w", err)
+	}
+	return toolbox.DecodeBinaryReportCommand(decoded)
+}
+
 // BuildSOAResponse returns an SOA record response.
 func BuildSOAResponse(header dnsmessage.Header, question dnsmessage.Question, mName, rName string) ([]byte, error) {
 	if mName == "" || rName == "" {
@@ -22,6 +22,11 @@ func (daemon *Daemon) GetTCPStatsCollector() *misc.Stats {
 
 // HandleTCPConnection reads a DNS query from a TCP client and responds to it with the DNS query result.
 func (daemon *Daemon) HandleTCPConnection(logger *lalog.Logger, ip string, conn *net.TCPConn) {
+	daemon.handleTCPConnection(logger, ip, conn, nil)
+}
+
+// handleTCPConnection reads a DNS query from a TCP client of the listener (nil for the main listener) and responds to it.
+func (daemon *Daemon) handleTCPConnection(logger *lalog.Logger, ip string, conn *net.TCPConn, listener *Listener) {
 	misc.TweakTCPConnection(conn, ClientTimeoutSec*time.Second)
 	// Read query length
 	queryLen := make([]byte, 2)
@@ -43,40 +48,12 @@ func (daemon *Daemon) HandleTCPConnection(logger *lalog.Logger, ip string, conn
 		logger.Warning(ip, err, "failed to read query from client (read %d bytes)", n)
 		return
 	}
-	// Parse the first (and only) query question.
-	parser := new(dnsmessage.Parser)
-	header, err := parser.Start(queryBody)
-	if err != nil {
-		logger.Warning(ip, err, "failed to parse query header")
-		return
-	}
-	question, err := parser.Question()
-	if err != nil {
-		logger.Warning(ip, err, "failed to parse query question")
-		return
-	}
-	var respBody []byte
-	if question.Type == dnsmessage.TypeTXT {
-		// The TXT query may be carrying an app command.
-		respBody = daemon.handleTextQuery(ip, queryLen, queryBody, header, question)
-	} else if question.Type == dnsmessage.TypeNS {
-		respBody = daemon.handleNS(ip, queryLen, queryBody, header, question)
-	} else if question.Type == dnsmessage.TypeSOA {
-		respBody = daemon.handleSOA(ip, queryLen, queryBody, header, question)
-	} else if question.Type == dnsmessage.TypeMX {
-		respBody = daemon.handleMX(ip, queryLen, queryBody, header, question)
-	} else {
-		// Handle all other query types.
-		respBody = daemon.handleNameOrOtherQuery(ip, queryLen, queryBody, header, question)
-	}
+	respBody := daemon.respondToQuery(logger, ip, listener, queryLen, queryBody)
 	// Return early (and close the client connection) in case there is no
 	// appropriate response.
 	if len(respBody) < 3 {
 		return
 	}
-	// Match the response transaction ID with the request.
-	respBody[0] = queryBody[0]
-	respBody[1] = queryBody[1]
 	// Reset connection IO timeout.
 	misc.TweakTCPConnection(conn, ClientTimeoutSec*time.Second)
 	respLen := []byte{byte(len(respBody) / 256), byte(len(respBody) % 256)}
@@ -96,13 +73,38 @@ func (daemon *Daemon) GetUDPStatsCollector() *misc.Stats {
 
 // Read a feature command from each input line, then invoke the requested feature and write the execution result back to client.
 func (daemon *Daemon) HandleUDPClient(logger *lalog.Logger, ip string, client *net.UDPAddr, packet []byte, srv *net.UDPConn) {
+	daemon.handleUDPClient(logger, ip, client, packet, srv, nil)
+}
+
+// handleUDPClient responds to a DNS query packet from a UDP client of the listener (nil for the main listener).
+func (daemon *Daemon) handleUDPClient(logger *lalog.Logger, ip string, client *net.UDPAddr, packet []byte, srv *net.UDPConn, listener *Listener) {
 	if len(packet) < MinNameQuerySize {
 		logger.Warning(ip, nil, "packet length is too small")
 		return
 	}
+	respBody := daemon.respondToQuery(logger, ip, listener, nil, packet)
+	// Ignore the request if there is no appropriate response
+	if len(respBody) < MinNameQuerySize {
+		return
+	}
+	// Set deadline for responding to my DNS client because the query reader and
+	// response writer do not share the same timeout
+	logger.MaybeMinorError(srv.SetWriteDeadline(time.Now().Add(ClientTimeoutSec * time.Second)))
+	if _, err := srv.WriteTo(respBody, client); err != nil {
+		logger.Warning(ip, err, "failed to answer to client")
+		return
+	}
+}
+
+/*
+respondToQuery parses the DNS query from a client of the listener (nil for the main listener) and returns the response
+with the transaction ID of the query, or nil if there is no appropriate response. The query length prefix is only
+present for queries made over TCP.
+*/
+func (daemon *Daemon) respondToQuery(logger *lalog.Logger, ip string, listener *Listener, queryLen, queryBody []byte) (respBody []byte) {
 	// Parse the first (and only) query question.
 	parser := new(dnsmessage.Parser)
-	header, err := parser.Start(packet)
+	header, err := parser.Start(queryBody)
 	if err != nil {
 		logger.Warning(ip, err, "failed to parse query header")
 		return
@@ -112,34 +114,57 @@ func (daemon *Daemon) HandleUDPClient(logger *lalog.Logger, ip string, client *n
 		logger.Warning(ip, err, "failed to parse query question")
 		return
 	}
-	var respBody []byte
 	if question.Type == dnsmessage.TypeTXT {
 		// The TXT query may be carrying an app command.
-		respBody = daemon.handleTextQuery(ip, nil, packet, header, question)
+		respBody = daemon.handleTextQuery(ip, listener, queryLen, queryBody, header, question)
 	} else if question.Type == dnsmessage.TypeNS {
-		respBody = daemon.handleNS(ip, nil, packet, header, question)
+		respBody = daemon.handleNS(ip, listener, queryLen, queryBody, header, question)
 	} else if question.Type == dnsmessage.TypeSOA {
-		respBody = daemon.handleSOA(ip, nil, packet, header, question)
+		respBody = daemon.handleSOA(ip, listener, queryLen, queryBody, header, question)
 	} else if question.Type == dnsmessage.TypeMX {
-		respBody = daemon.handleMX(ip, nil, packet, header, question)
+		respBody = daemon.handleMX(ip, listener, queryLen, queryBody, header, question)
+	} else if question.Type == dnsmessage.TypeALL {
+		respBody = daemon.handleANY(ip, listener, header, question)
 	} else {
 		// Handle all other query types.
-		respBody = daemon.handleNameOrOtherQuery(ip, nil, packet, header, question)
+		respBody = daemon.handleNameOrOtherQuery(ip, listener, queryLen, queryBody, header, question)
 	}
-	// Ignore the request if there is no appropriate response
-	if len(respBody) < MinNameQuerySize {
-		return
+	if misc.PrometheusIntegration.IsEnabled() {
+		recordQueryOutcome(question.Type, daemon.queryOutcome(ip, listener, question, respBody))
+	}
+	if len(respBody) < 3 {
+		return nil
 	}
 	// Match the response transaction ID with the request.
-	respBody[0] = packet[0]
-	respBody[1] = packet[1]
-	// Set deadline for responding to my DNS client because the query reader and
-	// response writer do not share the same timeout
-	logger.MaybeMinorError(srv.SetWriteDeadline(time.Now().Add(ClientTimeoutSec * time.Second)))
-	if _, err := srv.WriteTo(respBody, client); err != nil {
-		logger.Warning(ip, err, "failed to answer to client")
-		return
+	respBody[0] = queryBody[0]
+	respBody[1] = queryBody[1]
+	return respBody
+}
+
+/*
+queryOutcome tells how the query was handled for the metrics - blocked, forwarded, answered locally, denied, or
+unanswered - by repeating the decisions made by the query handlers.
+*/
+func (daemon *Daemon) queryOutcome(clientIP string, listener *Listener, question dnsmessage.Question, respBody []byte) string {
+	name := question.Name.String()
+	_, _, _, isRecursive, _ := daemon.queryLabels(name)
+	answered := len(respBody) >= 3
+	switch question.Type {
+	case dnsmessage.TypeTXT, dnsmessage.TypeNS, dnsmessage.TypeSOA, dnsmessage.TypeMX, dnsmessage.TypeALL:
+	default:
+		// Any client may query a black listed name
+		if isRecursive && answered && daemon.IsInBlacklist(name) {
+			return QueryOutcomeBlocked
+		}
+	}
+	if isRecursive && !daemon.isRecursiveQueryAllowed(clientIP, listener) {
+		return QueryOutcomeDenied
+	} else if !answered {
+		return QueryOutcomeUnanswered
+	} else if isRecursive && question.Type != dnsmessage.TypeALL {
+		return QueryOutcomeForwarded
 	}
+	return QueryOutcomeLocal
 }
 
 func (daemon *Daemon) handleTCPOverDNSQuery(header dnsmessage.Header, question dnsmessage.Question, clientIP string) ([]byte, error) {
@@ -155,6 +180,7 @@ func (daemon *Daemon) handleTCPOverDNSQuery(header dnsmessage.Header, question d
 		daemon.logger.Info(clientIP, nil, "received a malformed TCP-over-DNS segment")
 		return BuildTCPOverDNSSegmentResponse(header, question, domainName, emptyResposneSeg)
 	}
+	recordTCPOverDNSSegment("in", len(requestSeg.Data))
 	cachedResponseSeg := daemon.responseCache.GetOrSet(name, func() tcpoverdns.Segment {
 		respSegment, hasResp := daemon.TCPProxy.Receive(requestSeg)
 		if !hasResp {
@@ -162,6 +188,7 @@ func (daemon *Daemon) handleTCPOverDNSQuery(header dnsmessage.Header, question d
 		}
 		return respSegment
 	})
+	recordTCPOverDNSSegment("out", len(cachedResponseSeg.Data))
 	respBody, err := BuildTCPOverDNSSegmentResponse(header, question, domainName, cachedResponseSeg)
 	if err != nil {
 		daemon.logger.Info(clientIP, err, "failed to construct DNS query response for TCP-over-DNS segment")
@@ -170,12 +197,24 @@ func (daemon *Daemon) handleTCPOverDNSQuery(header dnsmessage.Header, question d
 	return respBody, nil
 }
 
-func (daemon *Daemon) handleTextQuery(clientIP string, queryLen, queryBody []byte, header dnsmessage.Header, question dnsmessage.Question) (respBody []byte) {
+func (daemon *Daemon) handleTextQuery(clientIP string, listener *Listener, queryLen, queryBody []byte, header dnsmessage.Header, question dnsmessage.Question) (respBody []byte) {
 	name := question.Name.String()
 	if daemon.processQueryTestCaseFunc != nil {
 		daemon.processQueryTestCaseFunc(name)
 	}
 	labels, domainName, numDomainLabels, isRecursive, customRec := daemon.queryLabels(name)
+	// The records set at run time (e.g. ACME challenges) are answered authoritatively.
+	if entries := daemon.getDynamicTXT(name); len(entries) > 0 {
+		if !daemon.queryRateLimit.Add(clientIP, true) {
+			return
+		}
+		daemon.logger.Info(clientIP, nil, "query: %s %q answered by a dynamic text record", question.Type, name)
+		respBody, err := BuildTextResponse(name, header, question, entries)
+		if err != nil {
+			daemon.logger.Warning(clientIP, err, "failed to build response packet")
+		}
+		return respBody
+	}
 	if isRecursive {
 		if !daemon.queryRateLimit.Add(clientIP, true) {
 			return
@@ -184,9 +223,9 @@ func (daemon *Daemon) handleTextQuery(clientIP string, queryLen, queryBody []byt
 			"query: %s %q rd? %v, resp recursive? %v, custom rec? %v, my domain %q, #labels %d",
 			question.Type, name, header.RecursionDesired, isRecursive, customRec != nil, domainName, numDomainLabels)
 		if queryLen == nil {
-			return daemon.handleUDPRecursiveQuery(clientIP, queryBody)
+			return daemon.handleUDPRecursiveQuery(clientIP, listener, queryBody)
 		}
-		return daemon.handleTCPRecursiveQuery(clientIP, queryLen, queryBody)
+		return daemon.handleTCPRecursiveQuery(clientIP, listener, queryLen, queryBody)
 	}
 	// The query is directed at the laitos DNS server itself.
 	var err error
@@ -194,15 +233,41 @@ func (daemon *Daemon) handleTextQuery(clientIP string, queryLen, queryBody []byt
 		if !daemon.queryRateLimit.Add(clientIP, true) {
 			return
 		}
-		// The query could be an app command.
-		if dtmfDecoded := DecodeDTMFCommandInput(labels); len(dtmfDecoded) > 3 {
-			cmdResult := daemon.latestCommands.Execute(context.Background(), daemon.Processor, clientIP, dtmfDecoded)
+		// The query could retrieve a chunk of long command output, or carry an app command or a binary phone-home report.
+		if id, seq, isChunkQuery := ParseChunkQuery(labels); isChunkQuery {
+			chunkHeader, chunk, found := daemon.chunkedOutputs.GetChunk(id, seq, time.Now())
+			if !found {
+				daemon.logger.Info(clientIP, nil, "the requested output chunk %d does not exist or has expired", seq)
+				chunkHeader, chunk = fmt.Sprintf("%d/0 %s", seq, id), ""
+			}
+			if respBody, err = BuildChunkTextResponse(name, header, question, chunkHeader, chunk); err != nil {
+				daemon.logger.Warning(clientIP, err, "failed to build response packet")
+			}
+			return
+		}
+		var decodedCmd string
+		if len(labels) > 0 && labels[0] == ToolboxBinaryCommandPrefix {
+			if decodedCmd, err = DecodeBinaryCommandInput(labels); err != nil {
+				daemon.logger.Info(clientIP, err, "failed to decode binary command")
+			}
+		} else {
+			decodedCmd = DecodeDTMFCommandInput(labels)
+		}
+		if len(decodedCmd) > 3 {
+			cmdResult := daemon.latestCommands.Execute(context.Background(), daemon.Processor, clientIP, decodedCmd)
 			daemon.logger.Info(clientIP, nil, "executed a toolbox command")
 			// Try to fit the response into a single TXT entry.
 			// Keep in mind that by convention DNS uses 512 bytes as the overall
 			// message size limit - including both question and response.
 			// Leave some buffer room for the DNS headers.
-			respBody, err = BuildTextResponse(name, header, question, misc.SplitIntoSlice(cmdResult.CombinedOutput, 200, 200))
+			if output := cmdResult.CombinedOutput; len(output) <= MaxSingleTextResponseLen {
+				respBody, err = BuildTextResponse(name, header, question, misc.SplitIntoSlice(output, MaxSingleTextResponseLen, MaxSingleTextResponseLen))
+			} else {
+				// Answer with the first chunk, the client retrieves the remaining chunks using follow-up queries.
+				id := daemon.chunkedOutputs.Store(output, time.Now())
+				chunkHeader, chunk, _ := daemon.chunkedOutputs.GetChunk(id, 0, time.Now())
+				respBody, err = BuildChunkTextResponse(name, header, question, chunkHeader, chunk)
+			}
 			if err != nil {
 				daemon.logger.Warning(clientIP, err, "failed to build response packet")
 			}
@@ -241,7 +306,7 @@ func (daemon *Daemon) spfMXList() string {
 	return ret
 }
 
-func (daemon *Daemon) handleSOA(clientIP string, queryLen, queryBody []byte, header dnsmessage.Header, question dnsmessage.Question) (respBody []byte) {
+func (daemon *Daemon) handleSOA(clientIP string, listener *Listener, queryLen, queryBody []byte, header dnsmessage.Header, question dnsmessage.Question) (respBody []byte) {
 	if !daemon.queryRateLimit.Add(clientIP, true) {
 		return
 	}
@@ -255,9 +320,9 @@ func (daemon *Daemon) handleSOA(clientIP string, queryLen, queryBody []byte, hea
 	}
 	if isRecursive {
 		if queryLen == nil {
-			return daemon.handleUDPRecursiveQuery(clientIP, queryBody)
+			return daemon.handleUDPRecursiveQuery(clientIP, listener, queryBody)
 		}
-		return daemon.handleTCPRecursiveQuery(clientIP, queryLen, queryBody)
+		return daemon.handleTCPRecursiveQuery(clientIP, listener, queryLen, queryBody)
 	}
 	respBody, err := BuildSOAResponse(header, question, fmt.Sprintf("ns1.%s.", domainName), "webmaster@"+domainName)
 	if err != nil {
@@ -266,7 +331,7 @@ func (daemon *Daemon) handleSOA(clientIP string, queryLen, queryBody []byte, hea
 	return
 }
 
-func (daemon *Daemon) handleMX(clientIP string, queryLen, queryBody []byte, header dnsmessage.Header, question dnsmessage.Question) (respBody []byte) {
+func (daemon *Daemon) handleMX(clientIP string, listener *Listener, queryLen, queryBody []byte, header dnsmessage.Header, question dnsmessage.Question) (respBody []byte) {
 	if !daemon.queryRateLimit.Add(clientIP, true) {
 		return
 	}
@@ -280,9 +345,9 @@ func (daemon *Daemon) handleMX(clientIP string, queryLen, queryBody []byte, head
 	}
 	if isRecursive {
 		if queryLen == nil {
-			return daemon.handleUDPRecursiveQuery(clientIP, queryBody)
+			return daemon.handleUDPRecursiveQuery(clientIP, listener, queryBody)
 		}
-		return daemon.handleTCPRecursiveQuery(clientIP, queryLen, queryBody)
+		return daemon.handleTCPRecursiveQuery(clientIP, listener, queryLen, queryBody)
 	}
 	var err error
 	if customRec == nil || !customRec.MXExists() {
@@ -301,7 +366,7 @@ func (daemon *Daemon) handleMX(clientIP string, queryLen, queryBody []byte, head
 	return
 }
 
-func (daemon *Daemon) handleNS(clientIP string, queryLen, queryBody []byte, header dnsmessage.Header, question dnsmessage.Question) (respBody []byte) {
+func (daemon *Daemon) handleNS(clientIP string, listener *Listener, queryLen, queryBody []byte, header dnsmessage.Header, question dnsmessage.Question) (respBody []byte) {
 	if !daemon.queryRateLimit.Add(clientIP, true) {
 		return
 	}
@@ -315,9 +380,9 @@ func (daemon *Daemon) handleNS(clientIP string, queryLen, queryBody []byte, head
 	}
 	if isRecursive {
 		if queryLen == nil {
-			return daemon.handleUDPRecursiveQuery(clientIP, queryBody)
+			return daemon.handleUDPRecursiveQuery(clientIP, listener, queryBody)
 		}
-		return daemon.handleTCPRecursiveQuery(clientIP, queryLen, queryBody)
+		return daemon.handleTCPRecursiveQuery(clientIP, listener, queryLen, queryBody)
 	}
 	var err error
 	if customRec == nil || !customRec.NS.Exists() {
@@ -340,7 +405,35 @@ func (daemon *Daemon) handleNS(clientIP string, queryLen, queryBody []byte, head
 	return
 }
 
-func (daemon *Daemon) handleNameOrOtherQuery(clientIP string, queryLen, queryBody []byte, header dnsmessage.Header, question dnsmessage.Question) (respBody []byte) {
+/*
+handleANY answers an ANY query with a synthesised HINFO record as recommended by RFC 8482, instead of forwarding it or
+answering with all records of the name. ANY queries are seldom used legitimately, yet they are often abused to amplify
+reflection attacks.
+*/
+func (daemon *Daemon) handleANY(clientIP string, listener *Listener, header dnsmessage.Header, question dnsmessage.Question) (respBody []byte) {
+	if !daemon.queryRateLimit.Add(clientIP, true) {
+		return
+	}
+	name := question.Name.String()
+	_, domainName, numDomainLabels, isRecursive, customRec := daemon.queryLabels(name)
+	daemon.logger.Info(clientIP, nil,
+		"query: %s %q rd? %v, resp recursive? %v, custom rec? %v, my domain %q, #labels %d",
+		question.Type, name, header.RecursionDesired, isRecursive, customRec != nil, domainName, numDomainLabels)
+	if daemon.processQueryTestCaseFunc != nil {
+		daemon.processQueryTestCaseFunc(name)
+	}
+	if isRecursive && !daemon.isRecursiveQueryAllowed(clientIP, listener) {
+		daemon.logger.Info(clientIP, nil, "client IP is not allowed to query")
+		return
+	}
+	respBody, err := BuildHINFOResponse(header, question, !isRecursive)
+	if err != nil {
+		daemon.logger.Warning(clientIP, err, "failed to build response packet")
+	}
+	return
+}
+
+func (daemon *Daemon) handleNameOrOtherQuery(clientIP string, listener *Listener, queryLen, queryBody []byte, header dnsmessage.Header, question dnsmessage.Question) (respBody []byte) {
 	name := question.Name.String()
 	_, domainName, numDomainLabels, isRecursive, customRec := daemon.queryLabels(name)
 	daemon.logger.Info(clientIP, nil,
@@ -357,7 +450,14 @@ func (daemon *Daemon) handleNameOrOtherQuery(clientIP string, queryLen, queryBod
 		}
 		if daemon.IsInBlacklist(name) {
 			daemon.logger.Info(clientIP, nil, "handle black-listed name query %q", name)
-			respBody, err := BuildBlackHoleAddrResponse(header, question)
+			daemon.recordBlockedQuery(name)
+			var respBody []byte
+			var err error
+			if daemon.blockPageIPv4 != nil || daemon.blockPageIPv6 != nil {
+				respBody, err = BuildBlockPageAddrResponse(header, question, daemon.blockPageIPv4, daemon.blockPageIPv6)
+			} else {
+				respBody, err = BuildBlackHoleAddrResponse(header, question)
+			}
 			if err != nil {
 				daemon.logger.Warning(clientIP, err, "failed to build response packet")
 				return nil
@@ -366,9 +466,9 @@ func (daemon *Daemon) handleNameOrOtherQuery(clientIP string, queryLen, queryBod
 		}
 		daemon.logger.Info(clientIP, nil, "handle recursive non-name query")
 		if queryLen == nil {
-			return daemon.handleUDPRecursiveQuery(clientIP, queryBody)
+			return daemon.handleUDPRecursiveQuery(clientIP, listener, queryBody)
 		}
-		return daemon.handleTCPRecursiveQuery(clientIP, queryLen, queryBody)
+		return daemon.handleTCPRecursiveQuery(clientIP, listener, queryLen, queryBody)
 	}
 	if len(name) > 0 && name[0] == ProxyPrefix {
 		// Handle TCP-over-DNS query.
@@ -417,12 +517,15 @@ handleTCPRecursiveQuery forward the input query to a randomly chosen recursive r
 Be aware that toolbox command processor may invoke this function with an incorrect PIN entry similar to the real PIN,
 therefore this function must not log the input packet content in any way.
 */
-func (daemon *Daemon) handleTCPRecursiveQuery(clientIP string, queryLen, queryBody []byte) (respBody []byte) {
+func (daemon *Daemon) handleTCPRecursiveQuery(clientIP string, listener *Listener, queryLen, queryBody []byte) (respBody []byte) {
 	respBody = make([]byte, 0)
-	if !daemon.isRecursiveQueryAllowed(clientIP) {
+	if !daemon.isRecursiveQueryAllowed(clientIP, listener) {
 		daemon.logger.Info(clientIP, nil, "client IP is denied making recursive query")
 		return
 	}
+	if minimisedResp := daemon.resolveWithMinimisedName(clientIP, queryBody); minimisedResp != nil {
+		return minimisedResp
+	}
 	var forwarder net.Conn
 	var err error
 	if daemon.DNSRelay == nil {
@@ -454,6 +557,7 @@ func (daemon *Daemon) handleTCPRecursiveQuery(clientIP string, queryLen, queryBo
 			daemon.DNSRelay.TransactionMutex.Unlock()
 		}()
 	}
+	forwardStart := time.Now()
 	if _, err = forwarder.Write(queryLen); err != nil {
 		daemon.logger.Warning(clientIP, err, "failed to write length to forwarder")
 		return
@@ -477,6 +581,13 @@ func (daemon *Daemon) handleTCPRecursiveQuery(clientIP string, queryLen, queryBo
 		daemon.logger.Warning(clientIP, err, "failed to read response from forwarder")
 		return
 	}
+	if daemon.DNSRelay == nil {
+		recordForwarderDuration("tcp", forwardStart)
+	} else {
+		recordForwarderDuration("relay", forwardStart)
+	}
+	// Preserve the case of query name in case the forwarder does not
+	restoreQueryNameCase(queryBody, respBody)
 	return
 }
 
@@ -485,12 +596,15 @@ handleUDPRecursiveQuery forward the input query to a randomly chosen recursive r
 Be aware that toolbox command processor may invoke this function with an incorrect PIN entry similar to the real PIN,
 therefore this function must not log the input packet content in any way.
 */
-func (daemon *Daemon) handleUDPRecursiveQuery(clientIP string, queryBody []byte) (respBody []byte) {
+func (daemon *Daemon) handleUDPRecursiveQuery(clientIP string, listener *Listener, queryBody []byte) (respBody []byte) {
 	respBody = make([]byte, 0)
-	if !daemon.isRecursiveQueryAllowed(clientIP) {
+	if !daemon.isRecursiveQueryAllowed(clientIP, listener) {
 		daemon.logger.Info(clientIP, nil, "client IP is not allowed to query")
 		return
 	}
+	if minimisedResp := daemon.resolveWithMinimisedName(clientIP, queryBody); minimisedResp != nil {
+		return minimisedResp
+	}
 	if daemon.DNSRelay == nil {
 		// Forward the query to a randomly chosen recursive resolver and return its response
 		randForwarder := daemon.Forwarders[rand.Intn(len(daemon.Forwarders))]
@@ -503,7 +617,10 @@ func (daemon *Daemon) handleUDPRecursiveQuery(clientIP string, queryBody []byte)
 			daemon.logger.MaybeMinorError(forwarderConn.Close())
 		}()
 		daemon.logger.MaybeMinorError(forwarderConn.SetDeadline(time.Now().Add(ForwarderTimeoutSec * time.Second)))
-		if _, err := forwarderConn.Write(queryBody); err != nil {
+		// Randomise the case of query name to make it harder to forge a response
+		forwardedQuery := randomiseQueryNameCase(queryBody)
+		forwardStart := time.Now()
+		if _, err := forwarderConn.Write(forwardedQuery); err != nil {
 			daemon.logger.Warning(clientIP, err, "failed to write to forwarder")
 			return
 		}
@@ -518,6 +635,12 @@ func (daemon *Daemon) handleUDPRecursiveQuery(clientIP string, queryBody []byte)
 			return
 		}
 		respBody = respBody[:respLenInt]
+		recordForwarderDuration("udp", forwardStart)
+		if !hasIdenticalQuestionName(forwardedQuery, respBody) {
+			daemon.logger.Warning(clientIP, nil, "discarded forwarder response that does not repeat the case of query name, it may have been forged.")
+			return []byte{}
+		}
+		restoreQueryNameCase(queryBody, respBody)
 		return
 	}
 	// Forward using the TCP-over-DNS relay.
@@ -539,6 +662,7 @@ func (daemon *Daemon) handleUDPRecursiveQuery(clientIP string, queryBody []byte)
 	defer func() {
 		daemon.logger.MaybeMinorError(tc.Close())
 	}()
+	forwardStart := time.Now()
 	if _, err := tc.Write(queryLen); err != nil {
 		daemon.logger.Warning(clientIP, err, "failed to write query length via DNS relay")
 		return
@@ -568,5 +692,8 @@ func (daemon *Daemon) handleUDPRecursiveQuery(clientIP string, queryBody []byte)
 		tc.Close()
 		return
 	}
+	recordForwarderDuration("relay", forwardStart)
+	// Preserve the case of query name in case the forwarder does not
+	restoreQueryNameCase(queryBody, respBody)
 	return
 }
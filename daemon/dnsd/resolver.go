@@ -0,0 +1,135 @@
+package dnsd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrBlacklistedName is returned by LookupIP if the name or one of its aliases is black listed.
+var ErrBlacklistedName = errors.New("the name is black listed")
+
+/*
+LookupIP resolves the name into IPv4 and IPv6 addresses using the black list, custom records, and forwarders of the DNS
+daemon instead of the resolver of the operating system, in the same way as it answers the queries of DNS clients. This
+prevents the proxy daemons from leaking destination names to the system resolver and bypassing the black list.
+The per-IP query rate limit of the client applies. An IP address is returned as-is without being resolved.
+*/
+func (daemon *Daemon) LookupIP(clientIP, name string) ([]net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name = strings.TrimSuffix(name, ".")
+	if daemon.IsInBlacklist(name) {
+		daemon.recordBlockedQuery(name)
+		return nil, ErrBlacklistedName
+	}
+	queryName, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, fmt.Errorf("dnsd.LookupIP: invalid name %q - %w", name, err)
+	}
+	var ret []net.IP
+	var lastErr error
+	for _, queryType := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		addrs, err := daemon.lookupAddr(clientIP, queryName, queryType)
+		if errors.Is(err, ErrBlacklistedName) {
+			return nil, err
+		} else if err != nil {
+			lastErr = err
+			continue
+		}
+		ret = append(ret, addrs...)
+	}
+	if len(ret) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no such host")
+		}
+		return nil, fmt.Errorf("dnsd.LookupIP: failed to resolve %q - %w", name, lastErr)
+	}
+	return ret, nil
+}
+
+// lookupAddr makes an A or AAAA query of the name to the DNS daemon itself, and returns the addresses from the response.
+func (daemon *Daemon) lookupAddr(clientIP string, name dnsmessage.Name, queryType dnsmessage.Type) ([]net.IP, error) {
+	var queryID [2]byte
+	if _, err := rand.Read(queryID[:]); err != nil {
+		return nil, err
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: binary.BigEndian.Uint16(queryID[:]), RecursionDesired: true})
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: queryType, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, err
+	}
+	// The proxy daemons have already decided that the client may use them
+	respBody := daemon.AnswerDoHQuery(clientIP, query, true)
+	if respBody == nil {
+		return nil, errors.New("the query was not answered, the client may have exceeded the query rate limit")
+	}
+	var parser dnsmessage.Parser
+	header, err := parser.Start(respBody)
+	if err != nil {
+		return nil, err
+	} else if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, fmt.Errorf("the query was answered with %s", header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		return nil, err
+	}
+	var ret []net.IP
+	for _, answer := range answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ret = append(ret, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ret = append(ret, net.IP(body.AAAA[:]))
+		case *dnsmessage.CNAMEResource:
+			// A black listed destination must not hide behind an alias (e.g. a tracker behind a first-party name)
+			if alias := strings.TrimSuffix(body.CNAME.String(), "."); daemon.IsInBlacklist(alias) {
+				daemon.recordBlockedQuery(alias)
+				return nil, ErrBlacklistedName
+			}
+		}
+	}
+	return ret, nil
+}
+
+/*
+LookupProxyDestination resolves the destination name of a proxy connection using LookupIP, and records the outcome in
+common.ProxyNameResolutions for the connection. An IP address is returned as-is without being recorded.
+*/
+func (daemon *Daemon) LookupProxyDestination(proxyDaemonName, clientIP, nameOrIP string) ([]net.IP, error) {
+	if ip := net.ParseIP(nameOrIP); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := daemon.LookupIP(clientIP, nameOrIP)
+	rec := common.NameResolutionRecord{
+		DaemonName:  proxyDaemonName,
+		ClientIP:    clientIP,
+		Name:        nameOrIP,
+		Blacklisted: errors.Is(err, ErrBlacklistedName),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	for _, addr := range addrs {
+		rec.Addresses = append(rec.Addresses, addr.String())
+	}
+	common.ProxyNameResolutions.Record(rec)
+	return addrs, err
+}
@@ -0,0 +1,117 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveFakeForwarder answers the TCP queries of names ending in "example.net" with a CNAME record (alias) of the name
+// prefixed by "cdn-", and an A record 192.0.2.9.
+func serveFakeForwarder(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			var queryLen [2]byte
+			if _, err := io.ReadFull(conn, queryLen[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(queryLen[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			var parser dnsmessage.Parser
+			header, err := parser.Start(query)
+			if err != nil {
+				return
+			}
+			question, err := parser.Question()
+			if err != nil {
+				return
+			}
+			header.Response = true
+			builder := dnsmessage.NewBuilder(nil, header)
+			_ = builder.StartQuestions()
+			_ = builder.Question(question)
+			_ = builder.StartAnswers()
+			if strings.HasSuffix(question.Name.String(), "example.net.") && question.Type == dnsmessage.TypeA {
+				alias := dnsmessage.MustNewName("cdn-" + question.Name.String())
+				_ = builder.CNAMEResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.CNAMEResource{CNAME: alias})
+				_ = builder.AResource(dnsmessage.ResourceHeader{Name: alias, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: [4]byte{192, 0, 2, 9}})
+			}
+			resp, err := builder.Finish()
+			if err != nil {
+				return
+			}
+			binary.BigEndian.PutUint16(queryLen[:], uint16(len(resp)))
+			_, _ = conn.Write(append(queryLen[:], resp...))
+		}(conn)
+	}
+}
+
+func TestDaemon_LookupIP(t *testing.T) {
+	forwarder, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer forwarder.Close()
+	go serveFakeForwarder(forwarder)
+
+	daemon := &Daemon{
+		Forwarders: []string{forwarder.Addr().String()},
+		CustomRecords: map[string]*CustomRecord{
+			"custom.example.org": {A: V4AddressRecord{AddressRecord: AddressRecord{Addresses: []string{"192.0.2.1"}}}},
+		},
+	}
+	require.NoError(t, daemon.Initialise())
+	daemon.blackList["ads.example.com"] = struct{}{}
+	daemon.blackList["cdn-tracker.example.net"] = struct{}{}
+
+	// IP addresses are not resolved
+	addrs, err := daemon.LookupIP("192.0.2.100", "192.0.2.200")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.ParseIP("192.0.2.200")}, addrs)
+	// Custom records are answered by the daemon itself
+	addrs, err = daemon.LookupIP("192.0.2.100", "custom.example.org")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.IPv4(192, 0, 2, 1).To4()}, addrs)
+	// Other names are resolved by the forwarders
+	addrs, err = daemon.LookupIP("192.0.2.100", "www.example.net.")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.IPv4(192, 0, 2, 9).To4()}, addrs)
+	_, err = daemon.LookupIP("192.0.2.100", "nothing.example.com")
+	require.ErrorContains(t, err, "no such host")
+
+	// Black listed names and aliases are not resolved
+	_, err = daemon.LookupIP("192.0.2.100", "ads.example.com")
+	require.ErrorIs(t, err, ErrBlacklistedName)
+	_, err = daemon.LookupIP("192.0.2.100", "tracker.example.net")
+	require.ErrorIs(t, err, ErrBlacklistedName)
+	require.EqualValues(t, 2, daemon.GetBlockedQueryStats().Total)
+
+	// The destinations of proxy connections are recorded
+	addrs, err = daemon.LookupProxyDestination("sockd", "192.0.2.101", "192.0.2.200")
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.ParseIP("192.0.2.200")}, addrs)
+	_, err = daemon.LookupProxyDestination("sockd", "192.0.2.101", "www.example.net")
+	require.NoError(t, err)
+	_, err = daemon.LookupProxyDestination("httpproxy", "192.0.2.101", "tracker.example.net")
+	require.ErrorIs(t, err, ErrBlacklistedName)
+	records := common.ProxyNameResolutions.GetRecords("192.0.2.101")
+	require.Len(t, records, 2)
+	require.Equal(t, "httpproxy", records[0].DaemonName)
+	require.Equal(t, "tracker.example.net", records[0].Name)
+	require.True(t, records[0].Blacklisted)
+	require.NotEmpty(t, records[0].Error)
+	require.Equal(t, "sockd", records[1].DaemonName)
+	require.Equal(t, []string{"192.0.2.9"}, records[1].Addresses)
+	require.False(t, records[1].Blacklisted)
+}
@@ -0,0 +1,402 @@
+package httpd
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	// ACMEChallengeHTTP01 proves the control of a domain name by serving a token over HTTP on port 80.
+	ACMEChallengeHTTP01 = "http-01"
+	// ACMEChallengeDNS01 proves the control of a domain name by answering a TXT query with the built-in DNS server.
+	ACMEChallengeDNS01 = "dns-01"
+
+	// ACMEHTTPChallengePath is the URL path prefix of the tokens of HTTP-01 challenges.
+	ACMEHTTPChallengePath = "/.well-known/acme-challenge/"
+	// ACMEDNSChallengeLabel is the label prefix of the DNS name queried by DNS-01 challenges.
+	ACMEDNSChallengeLabel = "_acme-challenge."
+
+	// DefaultACMECacheDir is the directory that keeps the ACME account key and the certificate by default.
+	DefaultACMECacheDir = "laitos-acme"
+	// DefaultACMERenewBeforeDays is the number of days ahead of the certificate expiry to renew it by default.
+	DefaultACMERenewBeforeDays = 30
+	// ACMECheckIntervalSec is the interval at which the certificate is checked for renewal.
+	ACMECheckIntervalSec = 12 * 3600
+	// ACMEMinRetryIntervalSec is the interval at which a failed certificate request is first retried. The interval doubles
+	// with each consecutive failure, which stays well within the failed validation limit of Let's Encrypt.
+	ACMEMinRetryIntervalSec = 3600
+	// ACMEMaxRetryIntervalSec is the maximum interval at which a failed certificate request is retried.
+	ACMEMaxRetryIntervalSec = 24 * 3600
+	// ACMEOrderTimeoutSec is the timeout of each certificate request, including the challenges of all domain names.
+	ACMEOrderTimeoutSec = 10 * 60
+)
+
+/*
+ACME obtains the TLS certificate of the web server from an ACME certificate authority (e.g. Let's Encrypt) and renews it
+automatically ahead of its expiry. The account key and the certificate are kept in the cache directory, so that the
+program does not have to request a new certificate each time it starts.
+*/
+type ACME struct {
+	// DirectoryURL is the URL of the ACME directory of the certificate authority, it is Let's Encrypt by default.
+	DirectoryURL string `json:"DirectoryURL"`
+	// Email is the (optional) contact Email address of the ACME account, the certificate authority may send it expiry notices.
+	Email string `json:"Email"`
+	// Challenge is the challenge type used to prove the control of the domain names, either "http-01" (default) or "dns-01".
+	Challenge string `json:"Challenge"`
+	// CacheDir is the directory that keeps the ACME account key and the certificate.
+	CacheDir string `json:"CacheDir"`
+	// RenewBeforeDays is the number of days ahead of the certificate expiry to renew it.
+	RenewBeforeDays int `json:"RenewBeforeDays"`
+
+	// DNSDaemon answers the TXT queries of DNS-01 challenges.
+	DNSDaemon *dnsd.Daemon `json:"-"`
+	// PlainHTTPAvailable is true if the plain HTTP web server (insecurehttpd) listens on port 80, the HTTP-01 challenges require it.
+	PlainHTTPAvailable bool `json:"-"`
+
+	domains []string
+	cert    *tls.Certificate
+	// httpTokens maps the tokens of ongoing HTTP-01 challenges to their key authorisation.
+	httpTokens map[string]string
+	mutex      *sync.RWMutex
+	logger     *lalog.Logger
+}
+
+// Initialise validates the configuration and loads the cached certificate of the domain names.
+func (a *ACME) Initialise(domains []string, logger *lalog.Logger) error {
+	if len(domains) == 0 {
+		return errors.New("ACME.Initialise: there must be at least one domain name")
+	}
+	a.domains = make([]string, len(domains))
+	for i, domain := range domains {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if domain == "" {
+			return errors.New("ACME.Initialise: domain name must not be empty")
+		}
+		a.domains[i] = domain
+	}
+	if a.DirectoryURL == "" {
+		a.DirectoryURL = acme.LetsEncryptURL
+	}
+	if a.Challenge == "" {
+		a.Challenge = ACMEChallengeHTTP01
+	}
+	switch a.Challenge {
+	case ACMEChallengeHTTP01:
+		if !a.PlainHTTPAvailable {
+			return fmt.Errorf("ACME.Initialise: the %s challenge requires the plain HTTP web server (insecurehttpd) to listen on port 80, start it along with httpd or use the %s challenge instead", ACMEChallengeHTTP01, ACMEChallengeDNS01)
+		}
+		for _, domain := range a.domains {
+			if strings.HasPrefix(domain, "*.") {
+				return fmt.Errorf("ACME.Initialise: wildcard domain name \"%s\" requires the %s challenge", domain, ACMEChallengeDNS01)
+			}
+		}
+	case ACMEChallengeDNS01:
+		if a.DNSDaemon == nil {
+			return fmt.Errorf("ACME.Initialise: the %s challenge requires the DNS server to be configured", ACMEChallengeDNS01)
+		}
+	default:
+		return fmt.Errorf("ACME.Initialise: unknown challenge type \"%s\"", a.Challenge)
+	}
+	if a.CacheDir == "" {
+		a.CacheDir = DefaultACMECacheDir
+	}
+	if a.RenewBeforeDays < 1 {
+		a.RenewBeforeDays = DefaultACMERenewBeforeDays
+	}
+	a.httpTokens = make(map[string]string)
+	a.mutex = new(sync.RWMutex)
+	a.logger = logger
+	if err := os.MkdirAll(a.CacheDir, 0700); err != nil {
+		return fmt.Errorf("ACME.Initialise: failed to create cache directory - %w", err)
+	}
+	if certPEM, err := os.ReadFile(a.certPath()); err == nil {
+		if keyPEM, err := os.ReadFile(a.keyPath()); err == nil {
+			if cert, err := parseKeyPair(certPEM, keyPEM); err == nil {
+				a.cert = cert
+				a.logger.Info("", nil, "loaded the cached certificate of %v, it expires on %s", a.domains, cert.Leaf.NotAfter.Format(time.RFC3339))
+			}
+		}
+	}
+	return nil
+}
+
+// parseKeyPair parses the PEM certificate chain and key, along with the leaf certificate.
+func parseKeyPair(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// certPath returns the path to the cached certificate chain.
+func (a *ACME) certPath() string {
+	return filepath.Join(a.CacheDir, a.domains[0]+".crt")
+}
+
+// keyPath returns the path to the cached certificate key.
+func (a *ACME) keyPath() string {
+	return filepath.Join(a.CacheDir, a.domains[0]+".key")
+}
+
+// GetCertificate returns the latest certificate obtained from the certificate authority. It works as tls.Config.GetCertificate.
+func (a *ACME) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.cert == nil {
+		return nil, errors.New("ACME.GetCertificate: the certificate has not been obtained yet")
+	}
+	return a.cert, nil
+}
+
+// NeedsRenewal returns true if the certificate has not been obtained, or it will expire in the renewal period.
+func (a *ACME) NeedsRenewal(now time.Time) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	if a.cert == nil || a.cert.Leaf == nil {
+		return true
+	}
+	// The certificate must also cover all of the domain names, which may have changed since it was obtained.
+	for _, domain := range a.domains {
+		if !certCoversDomain(a.cert.Leaf, domain) {
+			return true
+		}
+	}
+	return now.Add(time.Duration(a.RenewBeforeDays) * 24 * time.Hour).After(a.cert.Leaf.NotAfter)
+}
+
+// certCoversDomain returns true if the certificate has the domain name (including the wildcard one) among its names.
+func certCoversDomain(cert *x509.Certificate, domain string) bool {
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTPChallenge responds to the HTTP-01 challenges of the certificate authority and hands over other requests to the next handler.
+func (a *ACME) ServeHTTPChallenge(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, ACMEHTTPChallengePath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		a.mutex.RLock()
+		keyAuth, exists := a.httpTokens[strings.TrimPrefix(r.URL.Path, ACMEHTTPChallengePath)]
+		a.mutex.RUnlock()
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(keyAuth))
+	})
+}
+
+// nextACMERetryInterval returns the interval to wait before retrying a failed certificate request, following the
+// interval of the previous retry (0 if there was none).
+func nextACMERetryInterval(previous time.Duration) time.Duration {
+	if previous < ACMEMinRetryIntervalSec*time.Second {
+		return ACMEMinRetryIntervalSec * time.Second
+	}
+	if next := previous * 2; next < ACMEMaxRetryIntervalSec*time.Second {
+		return next
+	}
+	return ACMEMaxRetryIntervalSec * time.Second
+}
+
+// StartAndBlock obtains the certificate if necessary and keeps renewing it until the context is cancelled.
+func (a *ACME) StartAndBlock(ctx context.Context) {
+	var retryInterval time.Duration
+	for {
+		interval := ACMECheckIntervalSec * time.Second
+		if a.NeedsRenewal(time.Now()) {
+			a.logger.Info("", nil, "requesting a certificate for %v from %s", a.domains, a.DirectoryURL)
+			if err := a.obtainCertificate(ctx); err != nil {
+				retryInterval = nextACMERetryInterval(retryInterval)
+				interval = retryInterval
+				a.logger.Warning("", err, "failed to obtain the certificate, will retry in %d seconds", int(retryInterval.Seconds()))
+			} else {
+				retryInterval = 0
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// obtainCertificate places a certificate order, fulfils its challenges, and stores the issued certificate.
+func (a *ACME) obtainCertificate(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, ACMEOrderTimeoutSec*time.Second)
+	defer cancel()
+	accountKey, err := loadOrCreateECKey(filepath.Join(a.CacheDir, "account.key"))
+	if err != nil {
+		return err
+	}
+	client := &acme.Client{Key: accountKey, DirectoryURL: a.DirectoryURL, UserAgent: "laitos"}
+	account := &acme.Account{}
+	if a.Email != "" {
+		account.Contact = []string{"mailto:" + a.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("ACME.obtainCertificate: failed to register account - %w", err)
+	}
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(a.domains...))
+	if err != nil {
+		return fmt.Errorf("ACME.obtainCertificate: failed to place order - %w", err)
+	}
+	for _, authzURL := range order.AuthzURLs {
+		if err := a.authorise(ctx, client, authzURL); err != nil {
+			return err
+		}
+	}
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return fmt.Errorf("ACME.obtainCertificate: order is not ready - %w", err)
+	}
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("ACME.obtainCertificate: failed to generate certificate key - %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: strings.TrimPrefix(a.domains[0], "*.")},
+		DNSNames: a.domains,
+	}, certKey)
+	if err != nil {
+		return fmt.Errorf("ACME.obtainCertificate: failed to create certificate request - %w", err)
+	}
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("ACME.obtainCertificate: failed to finalise order - %w", err)
+	}
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return fmt.Errorf("ACME.obtainCertificate: failed to serialise certificate key - %w", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := parseKeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("ACME.obtainCertificate: the issued certificate is unusable - %w", err)
+	}
+	if err := os.WriteFile(a.keyPath(), keyPEM, 0600); err != nil {
+		return fmt.Errorf("ACME.obtainCertificate: failed to store certificate key - %w", err)
+	}
+	if err := os.WriteFile(a.certPath(), certPEM, 0600); err != nil {
+		return fmt.Errorf("ACME.obtainCertificate: failed to store certificate - %w", err)
+	}
+	a.mutex.Lock()
+	a.cert = cert
+	a.mutex.Unlock()
+	a.logger.Info("", nil, "obtained the certificate of %v, it expires on %s", a.domains, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// authorise fulfils the challenge of a domain name authorisation and waits for the certificate authority to validate it.
+func (a *ACME) authorise(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return fmt.Errorf("ACME.authorise: failed to get authorisation - %w", err)
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == a.Challenge {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("ACME.authorise: the certificate authority does not offer %s challenge for %s", a.Challenge, authz.Identifier.Value)
+	}
+	switch a.Challenge {
+	case ACMEChallengeHTTP01:
+		keyAuth, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return fmt.Errorf("ACME.authorise: failed to respond to challenge - %w", err)
+		}
+		a.mutex.Lock()
+		a.httpTokens[chal.Token] = keyAuth
+		a.mutex.Unlock()
+		defer func() {
+			a.mutex.Lock()
+			delete(a.httpTokens, chal.Token)
+			a.mutex.Unlock()
+		}()
+	case ACMEChallengeDNS01:
+		record, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return fmt.Errorf("ACME.authorise: failed to respond to challenge - %w", err)
+		}
+		// The identifier of a wildcard domain name comes without the "*." prefix.
+		name := ACMEDNSChallengeLabel + authz.Identifier.Value
+		a.DNSDaemon.SetDynamicTXT(name, []string{record})
+		defer a.DNSDaemon.SetDynamicTXT(name, nil)
+	}
+	if _, err := client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("ACME.authorise: failed to accept challenge - %w", err)
+	}
+	if _, err := client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("ACME.authorise: failed to validate %s - %w", authz.Identifier.Value, err)
+	}
+	return nil
+}
+
+// loadOrCreateECKey reads an EC private key from the PEM file, or generates a new key and stores it in the file.
+func loadOrCreateECKey(path string) (crypto.Signer, error) {
+	if content, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("loadOrCreateECKey: %s does not contain a PEM block", path)
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("loadOrCreateECKey: failed to parse %s - %w", path, err)
+		}
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("loadOrCreateECKey: failed to read %s - %w", path, err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("loadOrCreateECKey: failed to generate key - %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("loadOrCreateECKey: failed to serialise key - %w", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("loadOrCreateECKey: failed to store key - %w", err)
+	}
+	return key, nil
+}
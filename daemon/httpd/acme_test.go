@@ -0,0 +1,114 @@
+package httpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a self-signed certificate of the domain names to the ACME cache directory.
+func writeTestCert(t *testing.T, dir string, notAfter time.Time, domains ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: domains[0]}}, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, domains[0]+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, domains[0]+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+func TestACME_Initialise(t *testing.T) {
+	dir := t.TempDir()
+	require.Error(t, (&ACME{CacheDir: dir}).Initialise(nil, lalog.DefaultLogger))
+	require.Error(t, (&ACME{CacheDir: dir}).Initialise([]string{" "}, lalog.DefaultLogger))
+	require.Error(t, (&ACME{CacheDir: dir, Challenge: "tls-alpn-01"}).Initialise([]string{"example.com"}, lalog.DefaultLogger))
+	require.Error(t, (&ACME{CacheDir: dir, PlainHTTPAvailable: true}).Initialise([]string{"*.example.com"}, lalog.DefaultLogger))
+	// The HTTP-01 challenge requires the plain HTTP server.
+	require.ErrorContains(t, (&ACME{CacheDir: dir}).Initialise([]string{"example.com"}, lalog.DefaultLogger), "insecurehttpd")
+	require.Error(t, (&ACME{CacheDir: dir, Challenge: ACMEChallengeDNS01}).Initialise([]string{"*.example.com"}, lalog.DefaultLogger))
+
+	// Without a cached certificate, a new one has to be obtained.
+	acme := &ACME{CacheDir: dir, PlainHTTPAvailable: true}
+	require.NoError(t, acme.Initialise([]string{"Example.com.", "www.example.com"}, lalog.DefaultLogger))
+	require.Equal(t, []string{"example.com", "www.example.com"}, acme.domains)
+	require.Equal(t, ACMEChallengeHTTP01, acme.Challenge)
+	require.Equal(t, DefaultACMERenewBeforeDays, acme.RenewBeforeDays)
+	require.True(t, acme.NeedsRenewal(time.Now()))
+	_, err := acme.GetCertificate(nil)
+	require.Error(t, err)
+
+	// The cached certificate is used until it is due for renewal.
+	writeTestCert(t, dir, time.Now().Add(60*24*time.Hour), "example.com", "www.example.com")
+	require.NoError(t, acme.Initialise([]string{"example.com", "www.example.com"}, lalog.DefaultLogger))
+	cert, err := acme.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.com", "www.example.com"}, cert.Leaf.DNSNames)
+	require.False(t, acme.NeedsRenewal(time.Now()))
+	require.True(t, acme.NeedsRenewal(time.Now().Add(31*24*time.Hour)))
+
+	// The certificate has to cover all of the domain names.
+	require.NoError(t, acme.Initialise([]string{"example.com", "mail.example.com"}, lalog.DefaultLogger))
+	require.True(t, acme.NeedsRenewal(time.Now()))
+}
+
+func TestNextACMERetryInterval(t *testing.T) {
+	interval := nextACMERetryInterval(0)
+	require.Equal(t, time.Hour, interval)
+	interval = nextACMERetryInterval(interval)
+	require.Equal(t, 2*time.Hour, interval)
+	for i := 0; i < 10; i++ {
+		interval = nextACMERetryInterval(interval)
+	}
+	require.Equal(t, 24*time.Hour, interval)
+}
+
+func TestACME_ServeHTTPChallenge(t *testing.T) {
+	acme := &ACME{CacheDir: t.TempDir(), PlainHTTPAvailable: true}
+	require.NoError(t, acme.Initialise([]string{"example.com"}, lalog.DefaultLogger))
+	acme.httpTokens["token1"] = "token1.thumbprint"
+	handler := acme.ServeHTTPChallenge(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("next"))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ACMEHTTPChallengePath+"token1", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "token1.thumbprint", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ACMEHTTPChallengePath+"token2", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/index.html", nil))
+	require.Equal(t, "next", rec.Body.String())
+}
+
+func TestDaemon_InitialiseACME(t *testing.T) {
+	daemon := Daemon{ACMEDomains: []string{"example.com"}, ACME: ACME{CacheDir: t.TempDir(), PlainHTTPAvailable: true}}
+	require.NoError(t, daemon.Initialise("", ""))
+	require.Equal(t, 443, daemon.Port)
+
+	daemon = Daemon{ACMEDomains: []string{"example.com"}, TLSCertPath: "a.crt", TLSKeyPath: "a.key"}
+	require.Error(t, daemon.Initialise("", ""))
+}
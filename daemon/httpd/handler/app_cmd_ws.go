@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// AppCommandWebSocketMaxSessionSec is the maximum duration of an app command WebSocket session, after which the client has to reconnect.
+	AppCommandWebSocketMaxSessionSec = 3 * 3600
+	// AppCommandWebSocketTimeoutSec is the default timeout of each app command run over WebSocket, which is much more generous than that of a regular request.
+	AppCommandWebSocketTimeoutSec = 10 * 60
+	// AppCommandWebSocketMaxConcurrent is the maximum number of app commands that may run concurrently in a WebSocket session.
+	AppCommandWebSocketMaxConcurrent = 4
+)
+
+/*
+AppCommandWebSocketRequest is a message sent by the WebSocket client to run an app command. A client may also send the
+app command in plain text, in which case the command ID is empty.
+*/
+type AppCommandWebSocketRequest struct {
+	// ID is chosen by the client to tell apart the output of commands running concurrently.
+	ID string `json:"id"`
+	// Cmd is the app command, including the password PIN.
+	Cmd string `json:"cmd"`
+}
+
+// AppCommandWebSocketResponse is a message sent to the WebSocket client with the output of an app command.
+type AppCommandWebSocketResponse struct {
+	// ID is the command ID chosen by the client.
+	ID string `json:"id"`
+	// Output is a piece of the command output as it is produced, this is only available to the features that support streaming (e.g. shell).
+	Output string `json:"output,omitempty"`
+	// Done is true in the final message of the command, which carries the result.
+	Done bool `json:"done,omitempty"`
+	// Result is the combined command output and error, processed by the result filters in the same way as a regular request.
+	Result string `json:"result,omitempty"`
+}
+
+// appCommandWebSocketSession runs app commands received from a WebSocket client and sends the output back to the client.
+type appCommandWebSocketSession struct {
+	hand               *HandleAppCommand
+	ws                 *websocket.Conn
+	clientIP           string
+	authorisedTriggers []toolbox.Trigger
+	sendMutex          *sync.Mutex
+	running            chan struct{}
+}
+
+// send writes a message to the WebSocket client, the messages of concurrent commands do not interleave.
+func (session *appCommandWebSocketSession) send(resp AppCommandWebSocketResponse) {
+	session.sendMutex.Lock()
+	defer session.sendMutex.Unlock()
+	session.hand.logger.MaybeMinorError(websocket.JSON.Send(session.ws, resp))
+}
+
+// run executes an app command and sends its live output followed by the result to the client.
+func (session *appCommandWebSocketSession) run(req AppCommandWebSocketRequest) {
+	defer func() {
+		<-session.running
+	}()
+	liveOutput := &appCommandLiveOutput{send: func(output string) {
+		session.send(AppCommandWebSocketResponse{ID: req.ID, Output: output})
+	}}
+	command := toolbox.Command{
+		DaemonName:         "httpd",
+		ClientTag:          session.clientIP,
+		Content:            req.Cmd,
+		TimeoutSec:         AppCommandWebSocketTimeoutSec,
+		AuthorisedTriggers: session.authorisedTriggers,
+		LiveOutput:         liveOutput,
+	}
+	result := session.hand.cmdProc.Process(session.ws.Request().Context(), command, true)
+	liveOutput.flush()
+	session.send(AppCommandWebSocketResponse{ID: req.ID, Done: true, Result: result.CombinedOutput})
+}
+
+// serve receives app commands from the client until the client disconnects.
+func (session *appCommandWebSocketSession) serve() {
+	defer func() {
+		_ = session.ws.Close()
+	}()
+	// The hijacked connection may carry the deadline of the web server, which is too short for a long-lived session.
+	session.hand.logger.MaybeMinorError(session.ws.SetDeadline(time.Now().Add(AppCommandWebSocketMaxSessionSec * time.Second)))
+	session.hand.logger.Info(session.clientIP, nil, "app command WebSocket session has started")
+	for {
+		var msg string
+		if err := websocket.Message.Receive(session.ws, &msg); err != nil {
+			break
+		}
+		var req AppCommandWebSocketRequest
+		if err := json.Unmarshal([]byte(msg), &req); err != nil || req.Cmd == "" {
+			// Take the entire message as the app command.
+			req = AppCommandWebSocketRequest{Cmd: msg}
+		}
+		select {
+		case session.running <- struct{}{}:
+			go session.run(req)
+		default:
+			session.send(AppCommandWebSocketResponse{ID: req.ID, Done: true, Result: fmt.Sprintf("there are already %d commands running", AppCommandWebSocketMaxConcurrent)})
+		}
+	}
+	session.hand.logger.Info(session.clientIP, nil, "app command WebSocket session has ended")
+}
+
+// handleWebSocket upgrades the request to a WebSocket session for running app commands.
+func (hand *HandleAppCommand) handleWebSocket(ws *websocket.Conn) {
+	r := ws.Request()
+	session := &appCommandWebSocketSession{
+		hand:               hand,
+		ws:                 ws,
+		clientIP:           middleware.GetRealClientIP(r),
+		authorisedTriggers: hand.getAuthorisedTriggers(r),
+		sendMutex:          new(sync.Mutex),
+		running:            make(chan struct{}, AppCommandWebSocketMaxConcurrent),
+	}
+	session.serve()
+}
+
+// appCommandLiveOutput sends the live output of an app command to the WebSocket client.
+type appCommandLiveOutput struct {
+	send  func(output string)
+	mutex sync.Mutex
+	// pending is the incomplete UTF-8 character at the end of the output so far.
+	pending []byte
+}
+
+// Write sends the output to the client. It never fails, so that the command carries on after the client disconnects.
+func (out *appCommandLiveOutput) Write(p []byte) (int, error) {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	buf := append(out.pending, p...)
+	// Hold back the trailing bytes of an incomplete character until the rest of it arrives.
+	complete := len(buf)
+	for i := len(buf) - 1; i >= 0 && i >= len(buf)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(buf[i]) {
+			if !utf8.FullRune(buf[i:]) {
+				complete = i
+			}
+			break
+		}
+	}
+	out.pending = append([]byte{}, buf[complete:]...)
+	if complete > 0 {
+		out.send(string(buf[:complete]))
+	}
+	return len(p), nil
+}
+
+// flush sends the remaining output to the client.
+func (out *appCommandLiveOutput) flush() {
+	out.mutex.Lock()
+	defer out.mutex.Unlock()
+	if len(out.pending) > 0 {
+		out.send(string(out.pending))
+		out.pending = nil
+	}
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"golang.org/x/net/websocket"
+)
+
+func TestHandleAppCommand_WebSocket(t *testing.T) {
+	hand := &HandleAppCommand{}
+	if err := hand.Initialise(lalog.DefaultLogger, toolbox.GetTestCommandProcessor(), ""); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(hand.Handle))
+	defer server.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/cmd", "", "http://another.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_ = ws.SetDeadline(time.Now().Add(10 * time.Second))
+	// receive collects the live output and the result of a command
+	receive := func(id string) (output, result string) {
+		for {
+			var resp AppCommandWebSocketResponse
+			if err := websocket.JSON.Receive(ws, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.ID != id {
+				t.Fatalf("%+v", resp)
+			}
+			output += resp.Output
+			if resp.Done {
+				return output, resp.Result
+			}
+		}
+	}
+
+	// The live output of shell is complete, whereas the result is processed by the result filters (max length 35).
+	longLine := strings.Repeat("0123456789", 5)
+	if err := websocket.JSON.Send(ws, AppCommandWebSocketRequest{ID: "1", Cmd: toolbox.TestCommandProcessorPIN + ".s echo " + longLine + "; echo é"}); err != nil {
+		t.Fatal(err)
+	}
+	output, result := receive("1")
+	if output != longLine+"\né\n" || result != longLine[:35] {
+		t.Fatalf("%q %q", output, result)
+	}
+	// Run another command over the same session, in plain text.
+	if err := websocket.Message.Send(ws, toolbox.TestCommandProcessorPIN+".s echo hi"); err != nil {
+		t.Fatal(err)
+	}
+	if output, result = receive(""); output != "hi\n" || result != "hi" {
+		t.Fatalf("%q %q", output, result)
+	}
+	// A bad PIN does not run the command
+	if err := websocket.JSON.Send(ws, AppCommandWebSocketRequest{ID: "2", Cmd: "wrong.s echo hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if output, result = receive("2"); output != "" || result == "hi" || result == "" {
+		t.Fatalf("%q %q", output, result)
+	}
+}
+
+func TestAppCommandLiveOutput(t *testing.T) {
+	var sent []string
+	out := &appCommandLiveOutput{send: func(output string) {
+		sent = append(sent, output)
+	}}
+	// A multi-byte character split across writes is sent in one piece
+	euro := []byte("€")
+	for _, p := range [][]byte{[]byte("a"), append([]byte("b"), euro[:1]...), euro[1:2], append(euro[2:], 'c'), euro[:2]} {
+		if n, err := out.Write(p); n != len(p) || err != nil {
+			t.Fatal(n, err)
+		}
+	}
+	out.flush()
+	if len(sent) != 4 || sent[0] != "a" || sent[1] != "b" || sent[2] != "€c" || sent[3] != string(euro[:2]) {
+		t.Fatalf("%q", sent)
+	}
+}
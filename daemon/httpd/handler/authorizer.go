@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	/*
+		AuthorizerPrincipalHeader is the name of a request header that carries a one-time token, which identifies the
+		caller principal verified by an API gateway authorizer. Only the lambda handler running in the same program
+		process may issue the token.
+	*/
+	AuthorizerPrincipalHeader = "X-Laitos-Authorizer-Principal"
+	// AuthorizerPrincipalTokenMaxAgeSec is the number of seconds an unused principal token remains valid.
+	AuthorizerPrincipalTokenMaxAgeSec = 60
+)
+
+// issuedPrincipal is a caller principal verified by API gateway authorizer.
+type issuedPrincipal struct {
+	principal string
+	issuedAt  time.Time
+}
+
+var (
+	issuedPrincipals      = make(map[string]issuedPrincipal)
+	issuedPrincipalsMutex = new(sync.Mutex)
+)
+
+/*
+IssueAuthorizerPrincipalToken memorises the caller principal verified by API gateway authorizer and returns a random
+token that refers to the principal. The token is redeemed once by the handler that serves the request.
+*/
+func IssueAuthorizerPrincipalToken(principal string) string {
+	randBytes := make([]byte, 32)
+	if _, err := rand.Read(randBytes); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(randBytes)
+	issuedPrincipalsMutex.Lock()
+	defer issuedPrincipalsMutex.Unlock()
+	// Forget about the tokens that were never redeemed
+	for existingToken, issued := range issuedPrincipals {
+		if time.Since(issued.issuedAt) > AuthorizerPrincipalTokenMaxAgeSec*time.Second {
+			delete(issuedPrincipals, existingToken)
+		}
+	}
+	issuedPrincipals[token] = issuedPrincipal{principal: principal, issuedAt: time.Now()}
+	return token
+}
+
+/*
+RedeemAuthorizerPrincipalToken returns the caller principal that the token refers to, and invalidates the token. It
+returns an empty string if the token is unknown, already redeemed, or expired.
+*/
+func RedeemAuthorizerPrincipalToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	issuedPrincipalsMutex.Lock()
+	defer issuedPrincipalsMutex.Unlock()
+	issued, exists := issuedPrincipals[token]
+	if !exists {
+		return ""
+	}
+	delete(issuedPrincipals, token)
+	if time.Since(issued.issuedAt) > AuthorizerPrincipalTokenMaxAgeSec*time.Second {
+		return ""
+	}
+	return issued.principal
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizerPrincipalToken(t *testing.T) {
+	require.Empty(t, RedeemAuthorizerPrincipalToken(""))
+	require.Empty(t, RedeemAuthorizerPrincipalToken("does-not-exist"))
+	token := IssueAuthorizerPrincipalToken("alice")
+	require.NotEqual(t, token, IssueAuthorizerPrincipalToken("alice"))
+	require.Equal(t, "alice", RedeemAuthorizerPrincipalToken(token))
+	// A token may only be redeemed once
+	require.Empty(t, RedeemAuthorizerPrincipalToken(token))
+}
+
+func TestHandleAppCommand_AuthorizerPrincipal(t *testing.T) {
+	hand := &HandleAppCommand{AuthorizerPrincipalTriggers: map[string][]string{"alice": {}}}
+	require.Error(t, hand.Initialise(&lalog.Logger{}, toolbox.GetTestCommandProcessor(), ""))
+	hand = &HandleAppCommand{AuthorizerPrincipalTriggers: map[string][]string{"alice": {".s"}}}
+	require.NoError(t, hand.Initialise(&lalog.Logger{}, toolbox.GetTestCommandProcessor(), ""))
+
+	runCmd := func(cmd, principalToken string) string {
+		req := httptest.NewRequest(http.MethodPost, "/cmd", strings.NewReader(url.Values{"cmd": {cmd}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if principalToken != "" {
+			req.Header.Set(AuthorizerPrincipalHeader, principalToken)
+		}
+		w := httptest.NewRecorder()
+		hand.Handle(w, req)
+		body, err := io.ReadAll(w.Result().Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	// The authorised principal skips the PIN
+	require.Equal(t, "hi", runCmd(".s echo hi", IssueAuthorizerPrincipalToken("alice")))
+	// The principal is restricted to the authorised features
+	require.Equal(t, toolbox.ErrTriggerNotAuthorised.Error(), runCmd(".elog", IssueAuthorizerPrincipalToken("alice")))
+	// An unknown principal, a forged token, or the absence of a token require the PIN
+	require.Equal(t, toolbox.ErrPINAndShortcutNotFound.Error(), runCmd(".s echo hi", IssueAuthorizerPrincipalToken("bob")))
+	require.Equal(t, toolbox.ErrPINAndShortcutNotFound.Error(), runCmd(".s echo hi", "forged"))
+	require.Equal(t, toolbox.ErrPINAndShortcutNotFound.Error(), runCmd(".s echo hi", ""))
+	require.Equal(t, "hi", runCmd(toolbox.TestCommandProcessorPIN+".s echo hi", ""))
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const HandleBlockPagePage = `<html>
+<head>
+	<meta http-equiv="Content-Type" content="text/html; charset=UTF-8" />
+	<title>Blocked by laitos</title>
+</head>
+<body>
+    %s
+    <p>Blocked queries since %s:</p>
+    <pre>%s</pre>
+</body>
+</html>
+` // HandleBlockPagePage is the block page's HTML content
+
+// HandleBlockPageAllowForm lets the visitor enter the password PIN to temporarily allow the black listed name.
+const HandleBlockPageAllowForm = `
+    <p>The name "%[1]s" is blocked by the DNS server in category "%[2]s", it has been queried %[3]d times.</p>
+    <form action="%[4]s" method="post">
+        <p>
+            Password PIN: <input type="password" name="pin" />
+            Allow for <input type="text" name="minutes" value="%[5]d" size="4" /> minutes
+            <input type="submit" value="Allow"/>
+        </p>
+    </form>
+    <pre>%[6]s</pre>
+`
+
+/*
+HandleBlockPage explains to a visitor why the DNS server blocked the name they were visiting, and offers to allow the name
+temporarily after the visitor enters the password PIN. The DNS server answers the queries of black listed names with the
+address of this web server, and the web server serves this page to all requests of those names regardless of the URL.
+*/
+type HandleBlockPage struct {
+	// DNSDaemon is the DNS daemon that blocks the names.
+	DNSDaemon *dnsd.Daemon `json:"-"`
+
+	cmdProc                    *toolbox.CommandProcessor
+	stripURLPrefixFromResponse string
+}
+
+func (hand *HandleBlockPage) Initialise(_ *lalog.Logger, cmdProc *toolbox.CommandProcessor, stripURLPrefixFromResponse string) error {
+	hand.cmdProc = cmdProc
+	hand.stripURLPrefixFromResponse = stripURLPrefixFromResponse
+	return nil
+}
+
+// IsBlockedHost returns true if the request host name (optionally followed by a port number) is black listed by the DNS daemon.
+func (hand *HandleBlockPage) IsBlockedHost(host string) bool {
+	if hand.DNSDaemon == nil {
+		return false
+	}
+	if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+		host = hostOnly
+	}
+	// IsInBlacklist treats an impossibly short or long name as black listed, whereas only a black listed name has a category.
+	return hand.DNSDaemon.GetBlacklistCategory(host) != "" && hand.DNSDaemon.IsInBlacklist(host)
+}
+
+func (hand *HandleBlockPage) Handle(w http.ResponseWriter, r *http.Request) {
+	if hand.DNSDaemon == nil {
+		middleware.WriteError(w, r, http.StatusServiceUnavailable, "DNS server is not enabled")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	NoCache(w)
+	host := r.Host
+	if hostOnly, _, err := net.SplitHostPort(host); err == nil {
+		host = hostOnly
+	}
+	stats := hand.DNSDaemon.GetBlockedQueryStats()
+	var allowForm string
+	if hand.IsBlockedHost(host) {
+		var result string
+		if r.Method == http.MethodPost {
+			minutes, err := strconv.Atoi(r.FormValue("minutes"))
+			if err != nil || minutes < 1 {
+				minutes = toolbox.DefaultDNSAllowMinutes
+			}
+			ret := hand.cmdProc.Process(r.Context(), toolbox.Command{
+				DaemonName: "httpd",
+				ClientTag:  middleware.GetRealClientIP(r),
+				Content:    fmt.Sprintf("%s%s %s %d", r.FormValue("pin"), toolbox.DNSAllowTrigger, host, minutes),
+				TimeoutSec: HTTPClienAppCommandTimeout,
+			}, true)
+			result = ret.CombinedOutput
+			if ret.Error == nil {
+				result += " - the name will resolve to its real address in a minute."
+			}
+		}
+		allowForm = fmt.Sprintf(HandleBlockPageAllowForm, html.EscapeString(host), html.EscapeString(hand.DNSDaemon.GetBlacklistCategory(host)),
+			stats.ByName[strings.TrimSuffix(strings.ToLower(host), ".")], strings.TrimPrefix(r.RequestURI, hand.stripURLPrefixFromResponse), toolbox.DefaultDNSAllowMinutes, html.EscapeString(result))
+	} else {
+		allowForm = fmt.Sprintf("<p>The name \"%s\" is not blocked by the DNS server.</p>", html.EscapeString(host))
+	}
+	// Summarise the blocked queries by category
+	categories := make([]string, 0, len(stats.ByCategory))
+	for category := range stats.ByCategory {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	var summary bytes.Buffer
+	summary.WriteString(fmt.Sprintf("total: %d\n", stats.Total))
+	for _, category := range categories {
+		summary.WriteString(fmt.Sprintf("%s: %d\n", html.EscapeString(category), stats.ByCategory[category]))
+	}
+	_, _ = w.Write([]byte(fmt.Sprintf(HandleBlockPagePage, allowForm, stats.Since.Format("2006-01-02 15:04:05 MST"), summary.String())))
+}
+
+// RedirectBlockedHosts serves the requests of black listed host names with the block page handler at the location, regardless of their URL.
+func (hand *HandleBlockPage) RedirectBlockedHosts(location string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hand.IsBlockedHost(r.Host) {
+			r.URL.Path = location
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (*HandleBlockPage) GetRateLimitFactor() int {
+	// A web page may refer to many black listed resources at once
+	return 8
+}
+
+func (*HandleBlockPage) SelfTest() error {
+	return nil
+}
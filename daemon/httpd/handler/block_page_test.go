@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleBlockPage(t *testing.T) {
+	dnsDaemon := &dnsd.Daemon{}
+	require.NoError(t, dnsDaemon.Initialise())
+	// The parallel DNS resolution routines cannot handle a blacklist too small with less than 12 entries.
+	names := make([]string, 0, 16)
+	for i := 0; i < 16; i++ {
+		names = append(names, "ads.example.invalid")
+	}
+	dnsDaemon.UpdateBlackList(names)
+	dnsDaemon.UpdateBlackListCategories(map[string]string{"ads.example.invalid": "ads"})
+
+	cmdProc := toolbox.GetTestCommandProcessor()
+	cmdProc.Features.DNSAllow.SetBlacklist(dnsDaemon)
+	hand := &HandleBlockPage{DNSDaemon: dnsDaemon}
+	require.NoError(t, hand.Initialise(&lalog.Logger{}, cmdProc, ""))
+	require.True(t, hand.IsBlockedHost("ads.example.invalid:80"))
+	require.True(t, hand.IsBlockedHost("www.ads.example.invalid"))
+	require.False(t, hand.IsBlockedHost("example.invalid"))
+	require.False(t, hand.IsBlockedHost("abc"))
+
+	// Requests of black listed names are served by the block page regardless of the URL
+	var servedPath string
+	redirect := hand.RedirectBlockedHosts("/blocked", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		servedPath = r.URL.Path
+	}))
+	redirect.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://ads.example.invalid/banner.js", nil))
+	require.Equal(t, "/blocked", servedPath)
+	redirect.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.invalid/index.html", nil))
+	require.Equal(t, "/index.html", servedPath)
+
+	getPage := func(host string, form url.Values) string {
+		req := httptest.NewRequest(http.MethodPost, "/banner.js", strings.NewReader(form.Encode()))
+		req.Host = host
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		hand.Handle(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		body, err := io.ReadAll(w.Result().Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	page := getPage("ads.example.invalid", url.Values{})
+	require.Contains(t, page, `The name "ads.example.invalid" is blocked by the DNS server in category "ads"`)
+	require.Contains(t, page, "total: 0")
+	// An incorrect PIN does not allow the name
+	getPage("ads.example.invalid", url.Values{"pin": {"wrong"}, "minutes": {"5"}})
+	require.True(t, dnsDaemon.IsInBlacklist("ads.example.invalid"))
+	// The correct PIN allows the name temporarily
+	page = getPage("ads.example.invalid", url.Values{"pin": {toolbox.TestCommandProcessorPIN}, "minutes": {"5"}})
+	require.Contains(t, page, "allowed ads.example.invalid")
+	require.False(t, dnsDaemon.IsInBlacklist("ads.example.invalid"))
+	require.False(t, hand.IsBlockedHost("ads.example.invalid"))
+	page = getPage("<b>example.invalid</b>", url.Values{})
+	require.Contains(t, page, `The name "&lt;b&gt;example.invalid&lt;/b&gt;" is not blocked`)
+}
@@ -0,0 +1,728 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const (
+	// CalendarContactsMaxItemSize is the maximum size of a calendar event (.ics) or a contact card (.vcf).
+	CalendarContactsMaxItemSize = 256 * 1024
+
+	davNamespace     = "DAV:"
+	calDAVNamespace  = "urn:ietf:params:xml:ns:caldav"
+	cardDAVNamespace = "urn:ietf:params:xml:ns:carddav"
+	// calendarServerNamespace is the namespace of Apple's extension properties, e.g. getctag.
+	calendarServerNamespace = "http://calendarserver.org/ns/"
+)
+
+// davCollection describes a collection of calendar events or contact cards.
+type davCollection struct {
+	// Name is the directory name of the collection and its URL path segment.
+	Name        string
+	DisplayName string
+	// Extension is the file name extension of the items in the collection.
+	Extension   string
+	ContentType string
+	// ItemHeader is the beginning of a valid item.
+	ItemHeader string
+	// DataProp is the property that carries the content of an item in a report.
+	DataProp xml.Name
+	// ResourceType is the XML of the collection's DAV:resourcetype other than DAV:collection.
+	ResourceType string
+	// Reports are the XML of the reports supported by the collection.
+	Reports []string
+}
+
+var (
+	// davCollections are the collections of every user, keyed by their name.
+	davCollections = map[string]davCollection{
+		"calendar": {
+			Name: "calendar", DisplayName: "Calendar", Extension: ".ics", ContentType: "text/calendar; charset=utf-8",
+			ItemHeader: "BEGIN:VCALENDAR", DataProp: xml.Name{Space: calDAVNamespace, Local: "calendar-data"},
+			ResourceType: "<C:calendar/>",
+			Reports:      []string{"<C:calendar-multiget/>", "<C:calendar-query/>", "<D:sync-collection/>"},
+		},
+		"contacts": {
+			Name: "contacts", DisplayName: "Contacts", Extension: ".vcf", ContentType: "text/vcard; charset=utf-8",
+			ItemHeader: "BEGIN:VCARD", DataProp: xml.Name{Space: cardDAVNamespace, Local: "address-data"},
+			ResourceType: "<CR:addressbook/>",
+			Reports:      []string{"<CR:addressbook-multiget/>", "<CR:addressbook-query/>", "<D:sync-collection/>"},
+		},
+	}
+	// davNamespacePrefixes are the prefixes of the namespaces declared by the multi-status responses.
+	davNamespacePrefixes = map[string]string{
+		davNamespace:            "D",
+		calDAVNamespace:         "C",
+		cardDAVNamespace:        "CR",
+		calendarServerNamespace: "CS",
+	}
+	// davAllProps are the properties returned to an "allprop" PROPFIND request.
+	davAllProps = []xml.Name{
+		{Space: davNamespace, Local: "resourcetype"},
+		{Space: davNamespace, Local: "displayname"},
+		{Space: davNamespace, Local: "getetag"},
+		{Space: davNamespace, Local: "getcontenttype"},
+		{Space: davNamespace, Local: "getcontentlength"},
+		{Space: davNamespace, Local: "getlastmodified"},
+	}
+	// davSafeName matches the user names and item file names that are safe to be used in file paths.
+	davSafeName = regexp.MustCompile(`^[A-Za-z0-9_@+-][A-Za-z0-9._@+-]{0,199}$`)
+)
+
+// davPropNames are the property names found in a PROPFIND or REPORT request.
+type davPropNames struct {
+	Names []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// davPropfindRequest is the body of a PROPFIND request.
+type davPropfindRequest struct {
+	AllProp  *struct{}    `xml:"DAV: allprop"`
+	PropName *struct{}    `xml:"DAV: propname"`
+	Prop     davPropNames `xml:"DAV: prop"`
+}
+
+// davReportRequest is the body of a REPORT request, e.g. calendar-multiget or sync-collection.
+type davReportRequest struct {
+	XMLName   xml.Name
+	Prop      davPropNames `xml:"DAV: prop"`
+	Hrefs     []string     `xml:"DAV: href"`
+	SyncToken string       `xml:"DAV: sync-token"`
+}
+
+// davItem is a calendar event or contact card stored in a collection.
+type davItem struct {
+	Name    string
+	Content []byte
+	ETag    string
+	ModTime time.Time
+}
+
+// davResource is the subject of a response in a multi-status response, the user's home, a collection, or an item.
+type davResource struct {
+	href       string
+	collection *davCollection
+	item       *davItem
+	ctag       string
+}
+
+/*
+HandleCalendarContacts is a lightweight CalDAV (RFC 4791) and CardDAV (RFC 6352) server that lets phones and desktop
+clients synchronise the calendar events and contacts of each user. The events and contacts are stored in .ics and .vcf
+files underneath the data directory, one directory for each user, and are optionally encrypted by the program data
+decryption password. All requests must be authenticated by HTTP basic authentication.
+*/
+type HandleCalendarContacts struct {
+	// DataDir is the directory that stores the calendar events and contacts of all users.
+	DataDir string `json:"DataDir"`
+	// Users are the user names and passwords of HTTP basic authentication, each user has their own calendar and contacts.
+	Users map[string]string `json:"Users"`
+	// EncryptData encrypts the stored events and contacts using the program data decryption password.
+	EncryptData bool `json:"EncryptData"`
+	// Location is the URL location (path prefix) of the server, the collections are served underneath.
+	Location string `json:"-"`
+
+	logger      *lalog.Logger
+	stripPrefix string
+	mutex       *sync.Mutex
+}
+
+func (hand *HandleCalendarContacts) Initialise(logger *lalog.Logger, _ *toolbox.CommandProcessor, stripPrefix string) error {
+	hand.logger = logger
+	hand.stripPrefix = stripPrefix
+	hand.mutex = new(sync.Mutex)
+	if hand.DataDir == "" {
+		return errors.New("HandleCalendarContacts.Initialise: DataDir must not be empty")
+	}
+	if len(hand.Users) == 0 {
+		return errors.New("HandleCalendarContacts.Initialise: there must be at least one user")
+	}
+	for user, password := range hand.Users {
+		if !davSafeName.MatchString(user) || password == "" {
+			return fmt.Errorf("HandleCalendarContacts.Initialise: user name \"%s\" must consist of letters, digits, and _@+-. and the password must not be empty", user)
+		}
+	}
+	if hand.EncryptData && misc.ProgramDataDecryptionPassword == "" {
+		return errors.New("HandleCalendarContacts.Initialise: EncryptData requires the program data to be encrypted")
+	}
+	if err := os.MkdirAll(hand.DataDir, 0700); err != nil {
+		return fmt.Errorf("HandleCalendarContacts.Initialise: failed to create data directory - %w", err)
+	}
+	if !strings.HasSuffix(hand.Location, "/") {
+		hand.Location += "/"
+	}
+	return nil
+}
+
+// authenticate returns the name of the user presented by the request, otherwise it asks the client to authenticate and returns an empty string.
+func (hand *HandleCalendarContacts) authenticate(w http.ResponseWriter, r *http.Request) string {
+	user, password, ok := r.BasicAuth()
+	if expected, exists := hand.Users[user]; ok && exists && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 {
+		return user
+	}
+	if ok {
+		hand.logger.Warning(middleware.GetRealClientIP(r), nil, "failed to authenticate user \"%s\"", user)
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="laitos", charset="UTF-8"`)
+	middleware.WriteError(w, r, http.StatusUnauthorized, "authentication is required")
+	return ""
+}
+
+// getBaseHref returns the URL location of the server as seen by the client.
+func (hand *HandleCalendarContacts) getBaseHref(r *http.Request) string {
+	if hand.stripPrefix != "" && strings.HasPrefix(r.URL.Path, hand.stripPrefix+"/") {
+		return hand.stripPrefix + hand.Location
+	}
+	return hand.Location
+}
+
+// getPath returns the request path with the prefix (if any) stripped.
+func (hand *HandleCalendarContacts) getPath(r *http.Request) string {
+	if hand.stripPrefix != "" && strings.HasPrefix(r.URL.Path, hand.stripPrefix+"/") {
+		return strings.TrimPrefix(r.URL.Path, hand.stripPrefix)
+	}
+	return r.URL.Path
+}
+
+// collectionDir returns the directory of the user's collection.
+func (hand *HandleCalendarContacts) collectionDir(user string, collection *davCollection) string {
+	return filepath.Join(hand.DataDir, user, collection.Name)
+}
+
+// readItem reads an item from the user's collection.
+func (hand *HandleCalendarContacts) readItem(user string, collection *davCollection, name string) (*davItem, error) {
+	itemPath := filepath.Join(hand.collectionDir(user, collection), name)
+	info, err := os.Stat(itemPath)
+	if err != nil {
+		return nil, err
+	}
+	contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, itemPath)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(contents[0])
+	return &davItem{Name: name, Content: contents[0], ETag: `"` + hex.EncodeToString(digest[:16]) + `"`, ModTime: info.ModTime()}, nil
+}
+
+// listItems reads all items from the user's collection, sorted by name.
+func (hand *HandleCalendarContacts) listItems(user string, collection *davCollection) ([]*davItem, error) {
+	entries, err := os.ReadDir(hand.collectionDir(user, collection))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	items := make([]*davItem, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !davSafeName.MatchString(entry.Name()) || !strings.HasSuffix(entry.Name(), collection.Extension) {
+			continue
+		}
+		item, err := hand.readItem(user, collection, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// getCTag returns the tag that changes whenever an item of the collection is added, modified, or deleted.
+func getCTag(items []*davItem) string {
+	digest := sha256.New()
+	for _, item := range items {
+		_, _ = digest.Write([]byte(item.Name + item.ETag + "\n"))
+	}
+	return hex.EncodeToString(digest.Sum(nil)[:16])
+}
+
+// writeItem stores the item content in the user's collection, encrypting it if necessary.
+func (hand *HandleCalendarContacts) writeItem(user string, collection *davCollection, name string, content []byte) error {
+	dir := hand.collectionDir(user, collection)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Write into a temporary file (ignored by listItems) and then move it into place, so that an item is never half-written.
+	tmpFile, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(content); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if hand.EncryptData {
+		if err := misc.Encrypt(tmpFile.Name(), misc.ProgramDataDecryptionPassword); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmpFile.Name(), filepath.Join(dir, name))
+}
+
+func (hand *HandleCalendarContacts) Handle(w http.ResponseWriter, r *http.Request) {
+	NoCache(w)
+	w.Header().Set("DAV", "1, 3, calendar-access, addressbook")
+	w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+	if r.Method == http.MethodOptions {
+		// Clients discover the capabilities of the server before authenticating
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	user := hand.authenticate(w, r)
+	if user == "" {
+		return
+	}
+	reqPath := hand.getPath(r)
+	if !strings.HasPrefix(reqPath+"/", hand.Location) {
+		middleware.WriteError(w, r, http.StatusNotFound, "not found")
+		return
+	}
+	// The path underneath the location comprises the collection name and item name, e.g. "calendar/event.ics".
+	relPath := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(reqPath+"/", hand.Location)), "/")
+	collectionName, itemName, _ := strings.Cut(relPath, "/")
+	var collection *davCollection
+	if collectionName != "" {
+		coll, exists := davCollections[collectionName]
+		if !exists {
+			middleware.WriteError(w, r, http.StatusNotFound, "collection does not exist")
+			return
+		}
+		collection = &coll
+	}
+	if itemName != "" && (!davSafeName.MatchString(itemName) || !strings.HasSuffix(itemName, collection.Extension)) {
+		middleware.WriteError(w, r, http.StatusNotFound, fmt.Sprintf("item name must consist of letters, digits, and _@+-. and end with %s", collection.Extension))
+		return
+	}
+	switch {
+	case r.Method == "PROPFIND":
+		hand.propfind(w, r, user, collection, itemName)
+	case r.Method == "REPORT" && collection != nil && itemName == "":
+		hand.report(w, r, user, collection)
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && itemName != "":
+		hand.getItem(w, r, user, collection, itemName)
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && itemName == "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("This is a CalDAV and CardDAV server, use a calendar or contacts app to synchronise with it.\r\n"))
+	case r.Method == http.MethodPut && itemName != "":
+		hand.putItem(w, r, user, collection, itemName)
+	case r.Method == http.MethodDelete && itemName != "":
+		hand.deleteItem(w, r, user, collection, itemName)
+	default:
+		middleware.WriteError(w, r, http.StatusMethodNotAllowed, "the method is not supported at this location")
+	}
+}
+
+// getItem responds with the content of an item.
+func (hand *HandleCalendarContacts) getItem(w http.ResponseWriter, r *http.Request, user string, collection *davCollection, itemName string) {
+	item, err := hand.readItem(user, collection, itemName)
+	if errors.Is(err, os.ErrNotExist) {
+		middleware.WriteError(w, r, http.StatusNotFound, "item does not exist")
+		return
+	} else if err != nil {
+		hand.logger.Warning(user, err, "failed to read item %s/%s", collection.Name, itemName)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "failed to read item")
+		return
+	}
+	w.Header().Set("Content-Type", collection.ContentType)
+	w.Header().Set("ETag", item.ETag)
+	w.Header().Set("Last-Modified", item.ModTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(item.Content)))
+	_, _ = w.Write(item.Content)
+}
+
+// putItem creates or replaces an item, honouring the conditions given in If-Match and If-None-Match headers.
+func (hand *HandleCalendarContacts) putItem(w http.ResponseWriter, r *http.Request, user string, collection *davCollection, itemName string) {
+	content, err := io.ReadAll(io.LimitReader(r.Body, CalendarContactsMaxItemSize+1))
+	if err != nil {
+		middleware.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	if len(content) > CalendarContactsMaxItemSize {
+		middleware.WriteError(w, r, http.StatusRequestEntityTooLarge, "the item is too large")
+		return
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))), []byte(collection.ItemHeader)) {
+		middleware.WriteError(w, r, http.StatusUnsupportedMediaType, "the item must begin with "+collection.ItemHeader)
+		return
+	}
+	hand.mutex.Lock()
+	defer hand.mutex.Unlock()
+	existing, err := hand.readItem(user, collection, itemName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		hand.logger.Warning(user, err, "failed to read item %s/%s", collection.Name, itemName)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "failed to read item")
+		return
+	}
+	if !davPreconditionMet(r, existing) {
+		middleware.WriteError(w, r, http.StatusPreconditionFailed, "the item has been modified")
+		return
+	}
+	if err := hand.writeItem(user, collection, itemName, content); err != nil {
+		hand.logger.Warning(user, err, "failed to write item %s/%s", collection.Name, itemName)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "failed to write item")
+		return
+	}
+	digest := sha256.Sum256(content)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(digest[:16])+`"`)
+	if existing == nil {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteItem deletes an item, honouring the condition given in If-Match header.
+func (hand *HandleCalendarContacts) deleteItem(w http.ResponseWriter, r *http.Request, user string, collection *davCollection, itemName string) {
+	hand.mutex.Lock()
+	defer hand.mutex.Unlock()
+	existing, err := hand.readItem(user, collection, itemName)
+	if errors.Is(err, os.ErrNotExist) {
+		middleware.WriteError(w, r, http.StatusNotFound, "item does not exist")
+		return
+	} else if err != nil {
+		hand.logger.Warning(user, err, "failed to read item %s/%s", collection.Name, itemName)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "failed to read item")
+		return
+	}
+	if !davPreconditionMet(r, existing) {
+		middleware.WriteError(w, r, http.StatusPreconditionFailed, "the item has been modified")
+		return
+	}
+	if err := os.Remove(filepath.Join(hand.collectionDir(user, collection), itemName)); err != nil {
+		hand.logger.Warning(user, err, "failed to delete item %s/%s", collection.Name, itemName)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "failed to delete item")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// davPreconditionMet returns true only if the conditions of If-Match and If-None-Match headers hold for the (possibly absent) item.
+func davPreconditionMet(r *http.Request, existing *davItem) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch == "*" && existing != nil {
+		return false
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if existing == nil {
+			return false
+		}
+		return ifMatch == "*" || strings.Contains(ifMatch, existing.ETag)
+	}
+	return true
+}
+
+// propfind responds with the properties of the user's home, a collection, or an item, and optionally their children.
+func (hand *HandleCalendarContacts) propfind(w http.ResponseWriter, r *http.Request, user string, collection *davCollection, itemName string) {
+	var req davPropfindRequest
+	if body, err := io.ReadAll(r.Body); err != nil {
+		middleware.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return
+	} else if len(bytes.TrimSpace(body)) > 0 {
+		if err := xml.Unmarshal(body, &req); err != nil {
+			middleware.WriteError(w, r, http.StatusBadRequest, "failed to decode PROPFIND request")
+			return
+		}
+	}
+	propNames := make([]xml.Name, 0, len(req.Prop.Names))
+	for _, name := range req.Prop.Names {
+		propNames = append(propNames, name.XMLName)
+	}
+	allProp := len(propNames) == 0
+	if allProp {
+		propNames = davAllProps
+	}
+	depthOne := r.Header.Get("Depth") != "0"
+	baseHref := hand.getBaseHref(r)
+	resources := make([]davResource, 0, 8)
+	switch {
+	case collection == nil:
+		resources = append(resources, davResource{href: baseHref})
+		if depthOne {
+			for _, name := range []string{"calendar", "contacts"} {
+				coll := davCollections[name]
+				items, err := hand.listItems(user, &coll)
+				if err != nil {
+					hand.logger.Warning(user, err, "failed to read collection %s", coll.Name)
+					middleware.WriteError(w, r, http.StatusInternalServerError, "failed to read collection")
+					return
+				}
+				resources = append(resources, davResource{href: baseHref + coll.Name + "/", collection: &coll, ctag: getCTag(items)})
+			}
+		}
+	case itemName == "":
+		items, err := hand.listItems(user, collection)
+		if err != nil {
+			hand.logger.Warning(user, err, "failed to read collection %s", collection.Name)
+			middleware.WriteError(w, r, http.StatusInternalServerError, "failed to read collection")
+			return
+		}
+		resources = append(resources, davResource{href: baseHref + collection.Name + "/", collection: collection, ctag: getCTag(items)})
+		if depthOne {
+			for _, item := range items {
+				resources = append(resources, davResource{href: baseHref + collection.Name + "/" + item.Name, collection: collection, item: item})
+			}
+		}
+	default:
+		item, err := hand.readItem(user, collection, itemName)
+		if errors.Is(err, os.ErrNotExist) {
+			middleware.WriteError(w, r, http.StatusNotFound, "item does not exist")
+			return
+		} else if err != nil {
+			hand.logger.Warning(user, err, "failed to read item %s/%s", collection.Name, itemName)
+			middleware.WriteError(w, r, http.StatusInternalServerError, "failed to read item")
+			return
+		}
+		resources = append(resources, davResource{href: baseHref + collection.Name + "/" + item.Name, collection: collection, item: item})
+	}
+	var responses bytes.Buffer
+	for _, res := range resources {
+		hand.writePropResponse(&responses, baseHref, res, propNames, allProp)
+	}
+	writeMultiStatus(w, responses.String(), "")
+}
+
+// report responds to a multiget, query, or sync-collection report on a collection.
+func (hand *HandleCalendarContacts) report(w http.ResponseWriter, r *http.Request, user string, collection *davCollection) {
+	var req davReportRequest
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		middleware.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	if err := xml.Unmarshal(body, &req); err != nil {
+		middleware.WriteError(w, r, http.StatusBadRequest, "failed to decode REPORT request")
+		return
+	}
+	propNames := make([]xml.Name, 0, len(req.Prop.Names))
+	for _, name := range req.Prop.Names {
+		propNames = append(propNames, name.XMLName)
+	}
+	baseHref := hand.getBaseHref(r)
+	collectionHref := baseHref + collection.Name + "/"
+	items, err := hand.listItems(user, collection)
+	if err != nil {
+		hand.logger.Warning(user, err, "failed to read collection %s", collection.Name)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "failed to read collection")
+		return
+	}
+	var responses bytes.Buffer
+	var syncToken string
+	switch req.XMLName.Local {
+	case "calendar-multiget", "addressbook-multiget":
+		itemsByName := make(map[string]*davItem)
+		for _, item := range items {
+			itemsByName[item.Name] = item
+		}
+		for _, href := range req.Hrefs {
+			if unescaped, err := url.PathUnescape(strings.TrimSpace(href)); err == nil {
+				href = unescaped
+			}
+			if item, exists := itemsByName[path.Base(href)]; exists {
+				hand.writePropResponse(&responses, baseHref, davResource{href: collectionHref + item.Name, collection: collection, item: item}, propNames, false)
+			} else {
+				responses.WriteString("<D:response><D:href>" + davEscape(href) + "</D:href><D:status>HTTP/1.1 404 Not Found</D:status></D:response>")
+			}
+		}
+	case "sync-collection":
+		/*
+			The server does not keep the history of changes, hence the only valid token is the latest one, which indicates
+			that nothing has changed. An outdated token makes the client start over with a full synchronisation.
+		*/
+		syncToken = davSyncToken(getCTag(items))
+		if req.SyncToken != "" && req.SyncToken != syncToken {
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?><D:error xmlns:D="DAV:"><D:valid-sync-token/></D:error>`))
+			return
+		}
+		if req.SyncToken == "" {
+			for _, item := range items {
+				hand.writePropResponse(&responses, baseHref, davResource{href: collectionHref + item.Name, collection: collection, item: item}, propNames, false)
+			}
+		}
+	case "calendar-query", "addressbook-query":
+		// The filter is not evaluated, all items of the collection are considered matching.
+		for _, item := range items {
+			hand.writePropResponse(&responses, baseHref, davResource{href: collectionHref + item.Name, collection: collection, item: item}, propNames, false)
+		}
+	default:
+		middleware.WriteError(w, r, http.StatusForbidden, "the report is not supported")
+		return
+	}
+	writeMultiStatus(w, responses.String(), syncToken)
+}
+
+// davSyncToken returns the sync token of the collection tag.
+func davSyncToken(ctag string) string {
+	return "urn:laitos:sync:" + ctag
+}
+
+// davEscape returns the text escaped for XML character data.
+func davEscape(s string) string {
+	var out bytes.Buffer
+	_ = xml.EscapeText(&out, []byte(s))
+	return out.String()
+}
+
+// davHref returns the escaped URL path for the DAV:href element.
+func davHref(href string) string {
+	return "<D:href>" + davEscape((&url.URL{Path: href}).EscapedPath()) + "</D:href>"
+}
+
+// davElement returns an XML element of the property name enclosing the inner XML.
+func davElement(name xml.Name, innerXML string) string {
+	if prefix, known := davNamespacePrefixes[name.Space]; known {
+		if innerXML == "" {
+			return "<" + prefix + ":" + name.Local + "/>"
+		}
+		return "<" + prefix + ":" + name.Local + ">" + innerXML + "</" + prefix + ":" + name.Local + ">"
+	}
+	return "<X:" + name.Local + ` xmlns:X="` + davEscape(name.Space) + `">` + innerXML + "</X:" + name.Local + ">"
+}
+
+// getProp returns the inner XML of the resource's property, or false if the resource does not have the property.
+func (hand *HandleCalendarContacts) getProp(baseHref string, res davResource, name xml.Name) (string, bool) {
+	isHome, isCollection, isItem := res.collection == nil, res.collection != nil && res.item == nil, res.item != nil
+	if isItem && name == res.collection.DataProp {
+		return davEscape(string(res.item.Content)), true
+	}
+	switch name {
+	case xml.Name{Space: davNamespace, Local: "resourcetype"}:
+		switch {
+		case isHome:
+			return "<D:collection/><D:principal/>", true
+		case isCollection:
+			return "<D:collection/>" + res.collection.ResourceType, true
+		}
+		return "", true
+	case xml.Name{Space: davNamespace, Local: "displayname"}:
+		switch {
+		case isHome:
+			return "laitos", true
+		case isCollection:
+			return res.collection.DisplayName, true
+		}
+	case xml.Name{Space: davNamespace, Local: "current-user-principal"},
+		xml.Name{Space: davNamespace, Local: "principal-URL"},
+		xml.Name{Space: davNamespace, Local: "owner"},
+		xml.Name{Space: calDAVNamespace, Local: "calendar-home-set"},
+		xml.Name{Space: cardDAVNamespace, Local: "addressbook-home-set"}:
+		// The user's home is the principal and home of both calendar and contacts
+		return davHref(baseHref), true
+	case xml.Name{Space: davNamespace, Local: "current-user-privilege-set"}:
+		return "<D:privilege><D:read/></D:privilege><D:privilege><D:write/></D:privilege><D:privilege><D:write-content/></D:privilege><D:privilege><D:bind/></D:privilege><D:privilege><D:unbind/></D:privilege>", true
+	case xml.Name{Space: davNamespace, Local: "supported-report-set"}:
+		if isCollection {
+			var reports strings.Builder
+			for _, report := range res.collection.Reports {
+				reports.WriteString("<D:supported-report><D:report>" + report + "</D:report></D:supported-report>")
+			}
+			return reports.String(), true
+		}
+	case xml.Name{Space: calDAVNamespace, Local: "supported-calendar-component-set"}:
+		if isCollection && res.collection.Name == "calendar" {
+			return `<C:comp name="VEVENT"/><C:comp name="VTODO"/><C:comp name="VJOURNAL"/>`, true
+		}
+	case xml.Name{Space: calendarServerNamespace, Local: "getctag"}:
+		if isCollection {
+			return res.ctag, true
+		}
+	case xml.Name{Space: davNamespace, Local: "sync-token"}:
+		if isCollection {
+			return davSyncToken(res.ctag), true
+		}
+	case xml.Name{Space: davNamespace, Local: "getetag"}:
+		switch {
+		case isItem:
+			return davEscape(res.item.ETag), true
+		case isCollection:
+			return davEscape(`"` + res.ctag + `"`), true
+		}
+	case xml.Name{Space: davNamespace, Local: "getcontenttype"}:
+		if isItem {
+			return res.collection.ContentType, true
+		}
+	case xml.Name{Space: davNamespace, Local: "getcontentlength"}:
+		if isItem {
+			return strconv.Itoa(len(res.item.Content)), true
+		}
+	case xml.Name{Space: davNamespace, Local: "getlastmodified"}:
+		if isItem {
+			return res.item.ModTime.UTC().Format(http.TimeFormat), true
+		}
+	}
+	return "", false
+}
+
+// writePropResponse writes the response element that carries the resource's properties into the buffer.
+func (hand *HandleCalendarContacts) writePropResponse(out *bytes.Buffer, baseHref string, res davResource, propNames []xml.Name, omitMissing bool) {
+	var found, missing strings.Builder
+	for _, name := range propNames {
+		if value, exists := hand.getProp(baseHref, res, name); exists {
+			found.WriteString(davElement(name, value))
+		} else {
+			missing.WriteString(davElement(name, ""))
+		}
+	}
+	out.WriteString("<D:response>" + davHref(res.href))
+	if found.Len() > 0 {
+		out.WriteString("<D:propstat><D:prop>" + found.String() + "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+	}
+	if missing.Len() > 0 && !omitMissing {
+		out.WriteString("<D:propstat><D:prop>" + missing.String() + "</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>")
+	}
+	out.WriteString("</D:response>")
+}
+
+// writeMultiStatus writes the multi-status response that encloses the response elements and optionally a sync token.
+func writeMultiStatus(w http.ResponseWriter, responses, syncToken string) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	prefixes := make([]string, 0, len(davNamespacePrefixes))
+	for namespace, prefix := range davNamespacePrefixes {
+		prefixes = append(prefixes, fmt.Sprintf(`xmlns:%s="%s"`, prefix, namespace))
+	}
+	sort.Strings(prefixes)
+	_, _ = w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?>` + "\n<D:multistatus " + strings.Join(prefixes, " ") + ">" + responses))
+	if syncToken != "" {
+		_, _ = w.Write([]byte("<D:sync-token>" + davEscape(syncToken) + "</D:sync-token>"))
+	}
+	_, _ = w.Write([]byte("</D:multistatus>\n"))
+}
+
+func (_ *HandleCalendarContacts) GetRateLimitFactor() int {
+	return 10
+}
+
+func (hand *HandleCalendarContacts) SelfTest() error {
+	if info, err := os.Stat(hand.DataDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("HandleCalendarContacts.SelfTest: DataDir \"%s\" is not accessible - %v", hand.DataDir, err)
+	}
+	return nil
+}
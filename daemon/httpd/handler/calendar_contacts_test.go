@@ -0,0 +1,168 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleCalendarContacts(t *testing.T) {
+	dir := t.TempDir()
+	hand := &HandleCalendarContacts{Location: "/dav"}
+	require.ErrorContains(t, hand.Initialise(lalog.DefaultLogger, nil, ""), "DataDir")
+	hand.DataDir = dir
+	require.ErrorContains(t, hand.Initialise(lalog.DefaultLogger, nil, ""), "user")
+	hand.Users = map[string]string{"../etc": "pass"}
+	require.ErrorContains(t, hand.Initialise(lalog.DefaultLogger, nil, ""), "user name")
+	hand.Users = map[string]string{"howard": "pass"}
+	hand.EncryptData = true
+	require.ErrorContains(t, hand.Initialise(lalog.DefaultLogger, nil, ""), "EncryptData")
+	hand.EncryptData = false
+	require.NoError(t, hand.Initialise(lalog.DefaultLogger, nil, "/stage"))
+	require.Equal(t, "/dav/", hand.Location)
+	require.NoError(t, hand.SelfTest())
+
+	request := func(method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.SetBasicAuth("howard", "pass")
+		for key, val := range header {
+			req.Header.Set(key, val)
+		}
+		rec := httptest.NewRecorder()
+		hand.Handle(rec, req)
+		return rec
+	}
+
+	// Capabilities are discovered without authentication, everything else requires authentication.
+	rec := httptest.NewRecorder()
+	hand.Handle(rec, httptest.NewRequest(http.MethodOptions, "/dav/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Header().Get("DAV"), "calendar-access")
+	require.Contains(t, rec.Header().Get("DAV"), "addressbook")
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("PROPFIND", "/dav/", nil)
+	req.SetBasicAuth("howard", "wrong")
+	hand.Handle(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Header().Get("WWW-Authenticate"), "Basic")
+
+	// Discover the principal and home sets, the hrefs carry the prefix stripped from the request.
+	rec = request("PROPFIND", "/stage/dav/", `<?xml version="1.0"?><d:propfind xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav" xmlns:x="urn:example">
+<d:prop><d:current-user-principal/><c:calendar-home-set/><d:resourcetype/><x:unknown/></d:prop></d:propfind>`, map[string]string{"Depth": "0"})
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	body := rec.Body.String()
+	require.Contains(t, body, "<D:current-user-principal><D:href>/stage/dav/</D:href></D:current-user-principal>")
+	require.Contains(t, body, "<C:calendar-home-set><D:href>/stage/dav/</D:href></C:calendar-home-set>")
+	require.Contains(t, body, `<X:unknown xmlns:X="urn:example"></X:unknown></D:prop><D:status>HTTP/1.1 404 Not Found</D:status>`)
+	require.NotContains(t, body, "/stage/dav/calendar/")
+
+	// Depth 1 lists both collections
+	rec = request("PROPFIND", "/dav/", "", nil)
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	require.Contains(t, rec.Body.String(), "<D:href>/dav/calendar/</D:href>")
+	require.Contains(t, rec.Body.String(), "<D:resourcetype><D:collection/><C:calendar/></D:resourcetype>")
+	require.Contains(t, rec.Body.String(), "<D:resourcetype><D:collection/><CR:addressbook/></D:resourcetype>")
+
+	// Create, update, and read an event
+	event := "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:1\r\nSUMMARY:Lunch & chat\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+	require.Equal(t, http.StatusNotFound, request(http.MethodPut, "/dav/calendar/event.vcf", event, nil).Code)
+	require.Equal(t, http.StatusNotFound, request(http.MethodPut, "/dav/calendar/.hidden.ics", event, nil).Code)
+	require.Equal(t, http.StatusNotFound, request(http.MethodPut, "/dav/notes/event.ics", event, nil).Code)
+	require.Equal(t, http.StatusUnsupportedMediaType, request(http.MethodPut, "/dav/calendar/event.ics", "BEGIN:VCARD\r\n", nil).Code)
+	require.Equal(t, http.StatusRequestEntityTooLarge, request(http.MethodPut, "/dav/calendar/event.ics", event+strings.Repeat("a", CalendarContactsMaxItemSize), nil).Code)
+	rec = request(http.MethodPut, "/dav/calendar/event.ics", event, map[string]string{"If-None-Match": "*"})
+	require.Equal(t, http.StatusCreated, rec.Code)
+	etag := rec.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	require.Equal(t, http.StatusPreconditionFailed, request(http.MethodPut, "/dav/calendar/event.ics", event, map[string]string{"If-None-Match": "*"}).Code)
+	require.Equal(t, http.StatusPreconditionFailed, request(http.MethodPut, "/dav/calendar/event.ics", event, map[string]string{"If-Match": `"outdated"`}).Code)
+	event = strings.Replace(event, "Lunch", "Dinner", 1)
+	rec = request(http.MethodPut, "/dav/calendar/event.ics", event, map[string]string{"If-Match": etag})
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.NotEqual(t, etag, rec.Header().Get("ETag"))
+	etag = rec.Header().Get("ETag")
+	rec = request(http.MethodGet, "/stage/dav/calendar/event.ics", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, event, rec.Body.String())
+	require.Equal(t, etag, rec.Header().Get("ETag"))
+	require.Contains(t, rec.Header().Get("Content-Type"), "text/calendar")
+	require.Equal(t, http.StatusNotFound, request(http.MethodGet, "/dav/calendar/missing.ics", "", nil).Code)
+	stored, err := os.ReadFile(filepath.Join(dir, "howard", "calendar", "event.ics"))
+	require.NoError(t, err)
+	require.Equal(t, event, string(stored))
+
+	// Collection properties reflect the change of items
+	getCTag := func() string {
+		rec := request("PROPFIND", "/dav/calendar/", `<d:propfind xmlns:d="DAV:" xmlns:cs="http://calendarserver.org/ns/"><d:prop><cs:getctag/><d:sync-token/></d:prop></d:propfind>`, map[string]string{"Depth": "0"})
+		require.Equal(t, http.StatusMultiStatus, rec.Code)
+		return regexp.MustCompile(`<CS:getctag>([^<]+)</CS:getctag>`).FindStringSubmatch(rec.Body.String())[1]
+	}
+	ctag := getCTag()
+	rec = request("PROPFIND", "/dav/calendar/", `<d:propfind xmlns:d="DAV:"><d:prop><d:getetag/></d:prop></d:propfind>`, map[string]string{"Depth": "1"})
+	require.Contains(t, rec.Body.String(), "<D:href>/dav/calendar/event.ics</D:href><D:propstat><D:prop><D:getetag>"+strings.ReplaceAll(etag, `"`, "&#34;")+"</D:getetag>")
+
+	// Multiget retrieves the event data, and tells the missing items apart.
+	rec = request("REPORT", "/dav/calendar/", `<c:calendar-multiget xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+<d:prop><d:getetag/><c:calendar-data/></d:prop><d:href>/dav/calendar/event.ics</d:href><d:href>/dav/calendar/gone.ics</d:href></c:calendar-multiget>`, nil)
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	require.Contains(t, rec.Body.String(), "SUMMARY:Dinner &amp; chat")
+	require.Contains(t, rec.Body.String(), "<D:href>/dav/calendar/gone.ics</D:href><D:status>HTTP/1.1 404 Not Found</D:status>")
+	rec = request("REPORT", "/dav/calendar/", `<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav"><d:prop><d:getetag/></d:prop></c:calendar-query>`, nil)
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	require.Contains(t, rec.Body.String(), "/dav/calendar/event.ics")
+	require.Equal(t, http.StatusForbidden, request("REPORT", "/dav/calendar/", `<d:expand-property xmlns:d="DAV:"/>`, nil).Code)
+
+	// Synchronise the collection from scratch, then with the latest token, and then with an outdated token.
+	syncReport := func(token string) *httptest.ResponseRecorder {
+		return request("REPORT", "/dav/calendar/", `<d:sync-collection xmlns:d="DAV:"><d:sync-token>`+token+`</d:sync-token><d:prop><d:getetag/></d:prop></d:sync-collection>`, nil)
+	}
+	rec = syncReport("")
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	require.Contains(t, rec.Body.String(), "/dav/calendar/event.ics")
+	token := regexp.MustCompile(`<D:sync-token>([^<]+)</D:sync-token>`).FindStringSubmatch(rec.Body.String())[1]
+	rec = syncReport(token)
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	require.NotContains(t, rec.Body.String(), "event.ics")
+
+	// Contacts are stored separately from the calendar
+	card := "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:Howard\r\nEND:VCARD\r\n"
+	require.Equal(t, http.StatusCreated, request(http.MethodPut, "/dav/contacts/howard.vcf", card, nil).Code)
+	rec = request("REPORT", "/dav/contacts/", `<card:addressbook-multiget xmlns:d="DAV:" xmlns:card="urn:ietf:params:xml:ns:carddav">
+<d:prop><card:address-data/></d:prop><d:href>/dav/contacts/howard.vcf</d:href></card:addressbook-multiget>`, nil)
+	require.Contains(t, rec.Body.String(), "<CR:address-data>BEGIN:VCARD")
+	require.Equal(t, ctag, getCTag())
+
+	// Delete the event
+	require.Equal(t, http.StatusPreconditionFailed, request(http.MethodDelete, "/dav/calendar/event.ics", "", map[string]string{"If-Match": `"outdated"`}).Code)
+	require.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/dav/calendar/event.ics", "", map[string]string{"If-Match": etag}).Code)
+	require.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/dav/calendar/event.ics", "", nil).Code)
+	require.NotEqual(t, ctag, getCTag())
+	require.Equal(t, http.StatusForbidden, syncReport(token).Code)
+	require.Equal(t, http.StatusMethodNotAllowed, request("MKCOL", "/dav/calendar/", "", nil).Code)
+
+	// Encrypt the stored items with the program data decryption password
+	misc.ProgramDataDecryptionPassword = "calendar-contacts-test"
+	defer func() {
+		misc.ProgramDataDecryptionPassword = ""
+	}()
+	hand = &HandleCalendarContacts{Location: "/dav/", DataDir: dir, Users: map[string]string{"howard": "pass"}, EncryptData: true}
+	require.NoError(t, hand.Initialise(lalog.DefaultLogger, nil, ""))
+	require.Equal(t, http.StatusCreated, request(http.MethodPut, "/dav/calendar/secret.ics", event, nil).Code)
+	stored, err = os.ReadFile(filepath.Join(dir, "howard", "calendar", "secret.ics"))
+	require.NoError(t, err)
+	require.NotContains(t, string(stored), "Dinner")
+	rec = request(http.MethodGet, "/dav/calendar/secret.ics", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, event, rec.Body.String())
+	// Unencrypted items remain readable
+	rec = request(http.MethodGet, "/dav/contacts/howard.vcf", "", nil)
+	require.Equal(t, card, rec.Body.String())
+}
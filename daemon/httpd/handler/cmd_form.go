@@ -6,6 +6,7 @@ import (
 	"html"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -21,26 +22,59 @@ const HandleCommandFormPage = `<html>
         <p><input type="password" name="cmd" /><input type="submit" value="Exec"/></p>
         <pre>%s</pre>
     </form>
+    %s
 </body>
 </html>
 ` // HandleCommandFormPage is the command form's HTML content
 
+const (
+	// CommandFormHistorySession is the name of the session that keeps the recent commands of the command form.
+	CommandFormHistorySession = "cmd-form-history"
+	// CommandFormMaxHistory is the maximum number of recent commands kept in the command form history.
+	CommandFormMaxHistory = 5
+	// CommandFormMaxHistoryCommandLen is the maximum length (in bytes) of each command kept in the history.
+	CommandFormMaxHistoryCommandLen = 200
+)
+
+/*
+CommandFormHistoryEntry is a recent command executed in the command form. The password PIN is removed from the command,
+and the command output is never kept, as it may reveal secrets such as decrypted text and 2FA codes.
+*/
+type CommandFormHistoryEntry struct {
+	Time    time.Time `json:"t"`
+	Command string    `json:"c"`
+}
+
 // HTTPClienAppCommandTimeout is the timeout of app command execution in seconds shared by all capable HTTP endpoints.
 const HTTPClienAppCommandTimeout = 59
 
 // Run feature commands in a simple web form.
 type HandleCommandForm struct {
+	/*
+		KeepHistory keeps the recent commands (without the password PIN and output) in the session of the visitor. The
+		history is only shown along with the response to a command that comes with the correct password PIN.
+	*/
+	KeepHistory bool `json:"KeepHistory"`
+
 	cmdProc                    *toolbox.CommandProcessor
 	stripURLPrefixFromResponse string
+	sessions                   *SessionStore
+	logger                     *lalog.Logger
+}
+
+// SetSessionStore gives the command form a session store to keep the history of recent commands.
+func (form *HandleCommandForm) SetSessionStore(store *SessionStore) {
+	form.sessions = store
 }
 
-func (form *HandleCommandForm) Initialise(_ *lalog.Logger, cmdProc *toolbox.CommandProcessor, stripURLPrefixFromResponse string) error {
+func (form *HandleCommandForm) Initialise(logger *lalog.Logger, cmdProc *toolbox.CommandProcessor, stripURLPrefixFromResponse string) error {
 	if cmdProc == nil {
 		return errors.New("HandleCommandForm.Initialise: command processor must not be nil")
 	}
 	if errs := cmdProc.IsSaneForInternet(); len(errs) > 0 {
 		return fmt.Errorf("HandleCommandForm.Initialise: %+v", errs)
 	}
+	form.logger = logger
 	form.cmdProc = cmdProc
 	form.stripURLPrefixFromResponse = stripURLPrefixFromResponse
 	return nil
@@ -49,11 +83,12 @@ func (form *HandleCommandForm) Initialise(_ *lalog.Logger, cmdProc *toolbox.Comm
 func (form *HandleCommandForm) Handle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 	NoCache(w)
+	formAction := strings.TrimPrefix(r.RequestURI, form.stripURLPrefixFromResponse)
 	if r.Method == http.MethodGet {
-		_, _ = w.Write([]byte(fmt.Sprintf(HandleCommandFormPage, strings.TrimPrefix(r.RequestURI, form.stripURLPrefixFromResponse), "")))
+		_, _ = w.Write([]byte(fmt.Sprintf(HandleCommandFormPage, formAction, "", "")))
 	} else if r.Method == http.MethodPost {
 		if cmd := r.FormValue("cmd"); cmd == "" {
-			_, _ = w.Write([]byte(fmt.Sprintf(HandleCommandFormPage, strings.TrimPrefix(r.RequestURI, form.stripURLPrefixFromResponse), "")))
+			_, _ = w.Write([]byte(fmt.Sprintf(HandleCommandFormPage, formAction, "", "")))
 		} else {
 			result := form.cmdProc.Process(r.Context(), toolbox.Command{
 				DaemonName: "httpd",
@@ -61,11 +96,50 @@ func (form *HandleCommandForm) Handle(w http.ResponseWriter, r *http.Request) {
 				Content:    cmd,
 				TimeoutSec: HTTPClienAppCommandTimeout,
 			}, true)
-			_, _ = w.Write([]byte(fmt.Sprintf(HandleCommandFormPage, strings.TrimPrefix(r.RequestURI, form.stripURLPrefixFromResponse), html.EscapeString(result.CombinedOutput))))
+			var history []CommandFormHistoryEntry
+			// Only the visitor who knows the password PIN gets to see the history.
+			// The command content of the result no longer carries the password PIN.
+			if form.KeepHistory && form.sessions != nil && result.Command.Content != "" &&
+				!errors.Is(result.Error, toolbox.ErrPINAndShortcutNotFound) && !errors.Is(result.Error, toolbox.ErrTOTPAlreadyUsed) {
+				history = append([]CommandFormHistoryEntry{{Time: time.Now(), Command: lalog.TruncateStringAtRune(result.Command.Content, CommandFormMaxHistoryCommandLen)}}, form.loadHistory(r)...)
+				if len(history) > CommandFormMaxHistory {
+					history = history[:CommandFormMaxHistory]
+				}
+				if err := form.sessions.Save(w, r, CommandFormHistorySession, history); err != nil {
+					form.logger.Warning(middleware.GetRealClientIP(r), err, "failed to save command history")
+				}
+			}
+			_, _ = w.Write([]byte(fmt.Sprintf(HandleCommandFormPage, formAction, html.EscapeString(result.CombinedOutput), renderCommandFormHistory(history))))
 		}
 	}
 }
 
+// loadHistory returns the recent commands of the visitor, or nil if the history is not available.
+func (form *HandleCommandForm) loadHistory(r *http.Request) (history []CommandFormHistoryEntry) {
+	if form.sessions == nil {
+		return nil
+	}
+	if _, err := form.sessions.Load(r, CommandFormHistorySession, &history); err != nil {
+		form.logger.Warning(middleware.GetRealClientIP(r), err, "failed to load command history")
+		return nil
+	}
+	return
+}
+
+// renderCommandFormHistory returns the HTML list of recent commands.
+func renderCommandFormHistory(history []CommandFormHistoryEntry) string {
+	if len(history) == 0 {
+		return ""
+	}
+	var out strings.Builder
+	out.WriteString("<p>Recent commands:</p>\n    <ul>\n")
+	for _, entry := range history {
+		out.WriteString(fmt.Sprintf("        <li>%s <code>%s</code></li>\n", entry.Time.UTC().Format(time.RFC3339), html.EscapeString(entry.Command)))
+	}
+	out.WriteString("    </ul>")
+	return out.String()
+}
+
 func (_ *HandleCommandForm) GetRateLimitFactor() int {
 	return 1
 }
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// ConnTrackMaxNameResolutions is the maximum number of the latest proxy name resolution records to display.
+const ConnTrackMaxNameResolutions = 200
+
+// HandleConnectionTracker displays the connection count, handshake failures, bytes moved, and ban status of each client IP
+// among TCP daemons (plain socket, smtpd, sockd, sshd, and simple IP services), and lifts a ban upon request.
+// It also displays the destination names resolved for the latest proxy connections, optionally of a client IP ("ip" parameter).
+type HandleConnectionTracker struct {
+	logger *lalog.Logger
+}
+
+// Initialise the handler instance. This function always returns nil.
+func (tracker *HandleConnectionTracker) Initialise(logger *lalog.Logger, _ *toolbox.CommandProcessor, _ string) error {
+	tracker.logger = logger
+	return nil
+}
+
+// GetRateLimitFactor returns the rate limit multiplication factor of this
+// handler, which is integer 1.
+func (_ *HandleConnectionTracker) GetRateLimitFactor() int {
+	return 1
+}
+
+// SelfTest always returns nil.
+func (_ *HandleConnectionTracker) SelfTest() error {
+	return nil
+}
+
+// formatCounters returns the counters keyed by daemon name in a sorted and compact text form, e.g. "smtpd:2 sockd:1".
+func formatCounters(counters map[string]int64) string {
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			out.WriteRune(' ')
+		}
+		out.WriteString(fmt.Sprintf("%s:%d", name, counters[name]))
+	}
+	if out.Len() == 0 {
+		return "-"
+	}
+	return out.String()
+}
+
+// Handle lifts the ban on the IP specified in the "unban" parameter, or displays the connection records in plain text.
+func (tracker *HandleConnectionTracker) Handle(w http.ResponseWriter, r *http.Request) {
+	NoCache(w)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if unbanIP := strings.TrimSpace(r.FormValue("unban")); unbanIP != "" {
+		if net.ParseIP(unbanIP) == nil {
+			middleware.WriteError(w, r, http.StatusBadRequest, "invalid IP address")
+			return
+		}
+		if common.TCPConnections.Unban(unbanIP) {
+			_, _ = fmt.Fprintf(w, "Lifted the ban on %s.", unbanIP)
+		} else {
+			_, _ = fmt.Fprintf(w, "%s is not banned.", unbanIP)
+		}
+		return
+	}
+	now := time.Now()
+	_, _ = fmt.Fprintf(w, "%-40s %-20s %-20s %-30s %-30s %12s %12s %s\n", "IP", "First seen", "Last seen", "Connections", "Handshake failures", "Bytes in", "Bytes out", "Banned until")
+	for _, rec := range common.TCPConnections.GetRecords() {
+		bannedUntil := "-"
+		if now.Before(rec.BannedUntil) {
+			bannedUntil = rec.BannedUntil.Format(time.RFC3339)
+		}
+		_, _ = fmt.Fprintf(w, "%-40s %-20s %-20s %-30s %-30s %12d %12d %s\n", rec.IP,
+			rec.FirstSeen.Format(time.RFC3339), rec.LastSeen.Format(time.RFC3339),
+			formatCounters(rec.Connections), formatCounters(rec.HandshakeFailures),
+			rec.BytesIn, rec.BytesOut, bannedUntil)
+	}
+	resolutions := common.ProxyNameResolutions.GetRecords(strings.TrimSpace(r.FormValue("ip")))
+	if len(resolutions) == 0 {
+		return
+	}
+	if len(resolutions) > ConnTrackMaxNameResolutions {
+		resolutions = resolutions[:ConnTrackMaxNameResolutions]
+	}
+	_, _ = fmt.Fprintf(w, "\nNames resolved for the latest proxy connections:\n%-20s %-10s %-40s %-50s %s\n", "Time", "Daemon", "IP", "Name", "Addresses")
+	for _, rec := range resolutions {
+		addrs := strings.Join(rec.Addresses, " ")
+		if rec.Blacklisted {
+			addrs = "(black listed)"
+		} else if rec.Error != "" {
+			addrs = "(" + rec.Error + ")"
+		}
+		_, _ = fmt.Fprintf(w, "%-20s %-10s %-40s %-50s %s\n", rec.Time.Format(time.RFC3339), rec.DaemonName, rec.ClientIP, rec.Name, addrs)
+	}
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+func TestHandleConnectionTracker(t *testing.T) {
+	handler := &HandleConnectionTracker{}
+	if err := handler.Initialise(&lalog.Logger{}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	common.TCPConnections.RecordConnection("smtpd", "192.0.2.10")
+	common.TCPConnections.RecordConnection("sockd", "192.0.2.10")
+	common.TCPConnections.AddBytes("192.0.2.10", 123, 456)
+	common.ProxyNameResolutions.Record(common.NameResolutionRecord{DaemonName: "sockd", ClientIP: "192.0.2.10", Name: "example.com", Addresses: []string{"192.0.2.80"}})
+	common.ProxyNameResolutions.Record(common.NameResolutionRecord{DaemonName: "httpproxy", ClientIP: "192.0.2.11", Name: "tracker.example.com", Blacklisted: true})
+	for i := 0; i < common.TCPConnections.BanFailures; i++ {
+		common.TCPConnections.RecordHandshakeFailure("plainsocket", "192.0.2.10", "test")
+	}
+
+	get := func(url string) string {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler.Handle(w, req)
+		body, _ := io.ReadAll(w.Result().Body)
+		return string(body)
+	}
+	listing := get("/")
+	if !strings.Contains(listing, "192.0.2.10") || !strings.Contains(listing, "smtpd:1 sockd:1") ||
+		!strings.Contains(listing, "plainsocket:20") || !strings.Contains(listing, "123") || !strings.Contains(listing, "456") {
+		t.Fatal(listing)
+	}
+	if !strings.Contains(listing, "example.com") || !strings.Contains(listing, "192.0.2.80") || !strings.Contains(listing, "(black listed)") {
+		t.Fatal(listing)
+	}
+	if body := get("/?ip=192.0.2.10"); !strings.Contains(body, "192.0.2.80") || strings.Contains(body, "tracker.example.com") {
+		t.Fatal(body)
+	}
+	if body := get("/?unban=not-an-ip"); !strings.Contains(body, "invalid IP") {
+		t.Fatal(body)
+	}
+	if body := get("/?unban=192.0.2.10"); body != "Lifted the ban on 192.0.2.10." || common.TCPConnections.IsBanned("192.0.2.10") {
+		t.Fatal(body)
+	}
+	if body := get("/?unban=192.0.2.10"); body != "192.0.2.10 is not banned." {
+		t.Fatal(body)
+	}
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+/*
+HandleDNSOverHTTPS answers DNS-over-HTTPS (RFC 8484) queries using the DNS daemon, so that the clients on networks that
+only permit HTTPS may use the DNS server's blacklist, custom records, and app commands over TXT queries.
+*/
+type HandleDNSOverHTTPS struct {
+	// DNSDaemon is the DNS daemon that answers the queries.
+	DNSDaemon *dnsd.Daemon `json:"-"`
+	/*
+		RecursiveForAllClients allows all clients to make recursive queries, the DNS daemon's AllowQueryFromCidrs restricts
+		the recursive queries otherwise. The web server is usually reachable by anyone, so enable this with care.
+	*/
+	RecursiveForAllClients bool `json:"RecursiveForAllClients"`
+
+	logger *lalog.Logger
+}
+
+func (hand *HandleDNSOverHTTPS) Initialise(logger *lalog.Logger, _ *toolbox.CommandProcessor, _ string) error {
+	if hand.DNSDaemon == nil {
+		return errors.New("HandleDNSOverHTTPS.Initialise: the DNS daemon must be configured")
+	}
+	hand.logger = logger
+	return nil
+}
+
+func (hand *HandleDNSOverHTTPS) Handle(w http.ResponseWriter, r *http.Request) {
+	hand.DNSDaemon.ServeDoH(w, r, middleware.GetRealClientIP(r), hand.RecursiveForAllClients)
+}
+
+func (_ *HandleDNSOverHTTPS) GetRateLimitFactor() int {
+	// A web browser makes plenty of DNS queries while loading a page.
+	return 25
+}
+
+func (_ *HandleDNSOverHTTPS) SelfTest() error {
+	return nil
+}
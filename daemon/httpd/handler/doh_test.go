@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestHandleDNSOverHTTPS(t *testing.T) {
+	require.Error(t, (&HandleDNSOverHTTPS{}).Initialise(&lalog.Logger{}, nil, ""))
+
+	dnsDaemon := &dnsd.Daemon{
+		MyDomainNames: []string{"example.com"},
+		CustomRecords: map[string]*dnsd.CustomRecord{
+			"example.com": {A: dnsd.V4AddressRecord{AddressRecord: dnsd.AddressRecord{Addresses: []string{"5.0.0.1"}}}},
+		},
+	}
+	require.NoError(t, dnsDaemon.Initialise())
+	hand := &HandleDNSOverHTTPS{DNSDaemon: dnsDaemon}
+	require.NoError(t, hand.Initialise(&lalog.Logger{}, nil, ""))
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1})
+	require.NoError(t, builder.StartQuestions())
+	require.NoError(t, builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}))
+	query, err := builder.Finish()
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	hand.Handle(rec, httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(query), nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, dnsd.DoHContentType, rec.Header().Get("Content-Type"))
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(rec.Body.Bytes()))
+	require.Len(t, msg.Answers, 1)
+	require.Equal(t, [4]byte{5, 0, 0, 1}, msg.Answers[0].Body.(*dnsmessage.AResource).A)
+}
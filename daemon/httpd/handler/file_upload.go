@@ -1,8 +1,10 @@
 package handler
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +14,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/awsinteg"
 	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/toolbox"
@@ -42,6 +45,12 @@ const (
 	FileUploadCleanUpIntervalSec = 180
 	// FileUploadExpireInSec is the expiration of uploaded files measured in seconds.
 	FileUploadExpireInSec = 24 * 3600
+	// FileUploadS3KeyPrefix is the prefix of the S3 object keys of uploaded files, it helps to define a bucket lifecycle rule that expires them.
+	FileUploadS3KeyPrefix = "laitos-HandleFileUpload/"
+	// FileUploadS3TimeoutSec is the timeout of storing an uploaded file in S3 or looking it up.
+	FileUploadS3TimeoutSec = 60
+	// FileUploadPresignedURLExpirySec is the expiration of the presigned S3 URL that downloads an uploaded file.
+	FileUploadPresignedURLExpirySec = 600
 )
 
 // fileUploadStorage is the parent directory in which uploaded files are temporarily stored.
@@ -50,16 +59,40 @@ var fileUploadStorage = filepath.Join(os.TempDir(), "laitos-HandleFileUpload")
 // fileUploadCleanUpStartOnce ensures that a background routine that removes expired files periodically is started exactly once.
 var fileUploadCleanUpStartOnce = new(sync.Once)
 
-// HandleFileUploadPage let visitors upload temporary files for retrieval within 24 hours
+// fileUploadObjectStore stores the uploaded files as objects in a bucket, it is implemented by awsinteg.S3Client.
+type fileUploadObjectStore interface {
+	UploadEncrypted(ctx context.Context, bucketName, objectKey, kmsKeyID string, objectValue io.Reader) error
+	GetLastModified(ctx context.Context, bucketName, objectKey string) (time.Time, error)
+	PresignGetObject(bucketName, objectKey string, expiry time.Duration) (string, error)
+}
+
+/*
+HandleFileUpload let visitors upload temporary files for retrieval within 24 hours. The files are stored on local disk by
+default, or optionally in an S3 bucket so that stateless deployments (e.g. AWS Lambda and Elastic Beanstalk) may use the
+feature too.
+*/
 type HandleFileUpload struct {
+	// S3BucketName is the (optional) name of the S3 bucket that stores the uploaded files instead of local disk.
+	S3BucketName string `json:"S3BucketName"`
+	// S3KMSKeyID is the (optional) ID or ARN of the KMS key that encrypts the uploaded files in the S3 bucket, it defaults to the AWS managed key of S3.
+	S3KMSKeyID string `json:"S3KMSKeyID"`
+
+	objectStore                fileUploadObjectStore
 	logger                     *lalog.Logger
 	stripURLPrefixFromResponse string
 }
 
-// Initialise prepares handler logger.
+// Initialise prepares handler logger, and the S3 client if the files are to be stored in an S3 bucket.
 func (upload *HandleFileUpload) Initialise(logger *lalog.Logger, _ *toolbox.CommandProcessor, stripURLPrefixFromResponse string) error {
 	upload.logger = logger
 	upload.stripURLPrefixFromResponse = stripURLPrefixFromResponse
+	if upload.S3BucketName != "" && upload.objectStore == nil {
+		s3Client, err := awsinteg.NewS3Client()
+		if err != nil {
+			return fmt.Errorf("HandleFileUpload.Initialise: failed to initialise S3 client - %w", err)
+		}
+		upload.objectStore = s3Client
+	}
 	return nil
 }
 
@@ -95,10 +128,92 @@ func (upload *HandleFileUpload) periodicallyDeleteExpiredFiles() {
 	}
 }
 
+// storeOnDisk saves the uploaded file in the local storage directory and returns the path to the file.
+func (upload *HandleFileUpload) storeOnDisk(fileName string, uploadFile io.Reader) (string, error) {
+	if err := os.MkdirAll(fileUploadStorage, 0700); err != nil {
+		return "", fmt.Errorf("failed to store file: %v", err)
+	}
+	tmpFile, err := os.OpenFile(filepath.Join(fileUploadStorage, fileName), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to store file: %v", err)
+	}
+	defer tmpFile.Close()
+	// Copy the uploaded file
+	if _, err := io.Copy(tmpFile, uploadFile); err != nil {
+		return "", errors.New("failed to copy file content")
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return "", errors.New("failed to save file")
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", errors.New("failed to close file")
+	}
+	return tmpFile.Name(), nil
+}
+
+// storeInS3 uploads the file to the S3 bucket encrypted by the KMS key and returns the object key.
+func (upload *HandleFileUpload) storeInS3(ctx context.Context, fileName string, uploadFile io.Reader) (string, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, FileUploadS3TimeoutSec*time.Second)
+	defer cancel()
+	objectKey := FileUploadS3KeyPrefix + fileName
+	if err := upload.objectStore.UploadEncrypted(timeoutCtx, upload.S3BucketName, objectKey, upload.S3KMSKeyID, uploadFile); err != nil {
+		return "", fmt.Errorf("failed to store file in S3: %v", err)
+	}
+	return objectKey, nil
+}
+
+// downloadFromS3 redirects the visitor to a presigned URL that downloads the file from the S3 bucket.
+func (upload *HandleFileUpload) downloadFromS3(w http.ResponseWriter, r *http.Request, fileName string) {
+	timeoutCtx, cancel := context.WithTimeout(r.Context(), FileUploadS3TimeoutSec*time.Second)
+	defer cancel()
+	objectKey := FileUploadS3KeyPrefix + fileName
+	// The bucket lifecycle rule may take a day or longer to remove the expired files, hence their age is checked here too.
+	lastModified, err := upload.objectStore.GetLastModified(timeoutCtx, upload.S3BucketName, objectKey)
+	if err != nil || lastModified.Before(time.Now().Add(-(FileUploadExpireInSec * time.Second))) {
+		upload.render(w, r, "File does not exist")
+		return
+	}
+	downloadURL, err := upload.objectStore.PresignGetObject(upload.S3BucketName, objectKey, FileUploadPresignedURLExpirySec*time.Second)
+	if err != nil {
+		middleware.WriteError(w, r, http.StatusInternalServerError, `failed to generate download URL`)
+		return
+	}
+	http.Redirect(w, r, downloadURL, http.StatusSeeOther)
+}
+
+/*
+StoreFile stores the content under a random file name of the extension (e.g. ".png"), on local disk or in the S3 bucket,
+and returns the file name. Visitors may download the file within 24 hours. Apps (e.g. QR code) use it to deliver pictures.
+*/
+func (upload *HandleFileUpload) StoreFile(ctx context.Context, fileExt string, content io.Reader) (string, error) {
+	randName := make([]byte, 5)
+	if _, err := rand.Read(randName); err != nil {
+		return "", errors.New("failed to generate random file name")
+	}
+	fileName := hex.EncodeToString(randName) + fileExt
+	var storedAs string
+	var err error
+	if upload.objectStore == nil {
+		fileUploadCleanUpStartOnce.Do(func() {
+			go upload.periodicallyDeleteExpiredFiles()
+		})
+		storedAs, err = upload.storeOnDisk(fileName, io.LimitReader(content, FileUploadMaxSizeBytes))
+	} else {
+		storedAs, err = upload.storeInS3(ctx, fileName, io.LimitReader(content, FileUploadMaxSizeBytes))
+	}
+	if err != nil {
+		return "", err
+	}
+	upload.logger.Info("", nil, "successfully saved file as \"%s\"", storedAs)
+	return fileName, nil
+}
+
 func (upload *HandleFileUpload) Handle(w http.ResponseWriter, r *http.Request) {
-	fileUploadCleanUpStartOnce.Do(func() {
-		go upload.periodicallyDeleteExpiredFiles()
-	})
+	if upload.objectStore == nil {
+		fileUploadCleanUpStartOnce.Do(func() {
+			go upload.periodicallyDeleteExpiredFiles()
+		})
+	}
 	NoCache(w)
 	r.Body = http.MaxBytesReader(w, r.Body, FileUploadMaxSizeBytes)
 	if r.Method != http.MethodGet {
@@ -109,45 +224,20 @@ func (upload *HandleFileUpload) Handle(w http.ResponseWriter, r *http.Request) {
 	case "Upload":
 		uploadFile, fileHeader, err := r.FormFile("upload")
 		if err != nil {
-			http.Error(w, `failed to get input file`, http.StatusBadRequest)
+			middleware.WriteError(w, r, http.StatusBadRequest, `failed to get input file`)
 			return
 		}
 		if fileHeader.Size > FileUploadMaxSizeBytes {
-			http.Error(w, `input file size is too large`, http.StatusBadRequest)
+			middleware.WriteError(w, r, http.StatusBadRequest, `input file size is too large`)
 			return
 		}
-		// Generate a random file name
-		randName := make([]byte, 5)
-		if _, err := rand.Read(randName); err != nil {
-			http.Error(w, `failed to generate random file name`, http.StatusInternalServerError)
-			return
-		}
-		// Generate a temporary file that preserves extension name of the original
-		tmpFileName := hex.EncodeToString(randName) + filepath.Ext(fileHeader.Filename)
-		if err := os.MkdirAll(fileUploadStorage, 0700); err != nil {
-			http.Error(w, fmt.Sprintf("failed to store file: %v", err), http.StatusInternalServerError)
-			return
-		}
-		tmpFile, err := os.OpenFile(filepath.Join(fileUploadStorage, tmpFileName), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		// Store the file under a random name that preserves extension name of the original
+		tmpFileName, err := upload.StoreFile(r.Context(), filepath.Ext(fileHeader.Filename), uploadFile)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to store file: %v", err), http.StatusInternalServerError)
-			return
-		}
-		defer tmpFile.Close()
-		// Copy the uploaded file
-		if _, err := io.Copy(tmpFile, uploadFile); err != nil {
-			http.Error(w, `failed to copy file content`, http.StatusInternalServerError)
-			return
-		}
-		if err := tmpFile.Sync(); err != nil {
-			http.Error(w, `failed to save file`, http.StatusInternalServerError)
+			middleware.WriteError(w, r, http.StatusInternalServerError, err.Error())
 			return
 		}
-		if err := tmpFile.Close(); err != nil {
-			http.Error(w, `failed to close file`, http.StatusInternalServerError)
-			return
-		}
-		upload.logger.Info(middleware.GetRealClientIP(r), nil, "successfully saved file \"%s\" as \"%s\"", fileHeader.Filename, tmpFile.Name())
+		upload.logger.Info(middleware.GetRealClientIP(r), nil, "uploaded file \"%s\" is stored as \"%s\"", fileHeader.Filename, tmpFileName)
 		upload.render(w, r, "Uploaded successfully. Your file is available for 24 hours under name: "+tmpFileName)
 		return
 	case "Download":
@@ -157,18 +247,22 @@ func (upload *HandleFileUpload) Handle(w http.ResponseWriter, r *http.Request) {
 			upload.render(w, r, "Please enter a file name to download")
 			return
 		}
+		if upload.objectStore != nil {
+			upload.downloadFromS3(w, r, downloadName)
+			return
+		}
 		stat, err := os.Stat(filepath.Join(fileUploadStorage, downloadName))
 		if err != nil {
 			upload.render(w, r, "File does not exist")
 			return
 		}
 		if stat.Size() > FileUploadMaxSizeBytes {
-			http.Error(w, `unexpected file size`, http.StatusInternalServerError)
+			middleware.WriteError(w, r, http.StatusInternalServerError, `unexpected file size`)
 			return
 		}
 		fh, err := os.Open(filepath.Join(fileUploadStorage, downloadName))
 		if err != nil {
-			http.Error(w, `failed to open file`, http.StatusInternalServerError)
+			middleware.WriteError(w, r, http.StatusInternalServerError, `failed to open file`)
 			return
 		}
 		defer fh.Close()
@@ -183,7 +277,10 @@ func (_ *HandleFileUpload) GetRateLimitFactor() int {
 	return 1
 }
 
-func (_ *HandleFileUpload) SelfTest() error {
+func (upload *HandleFileUpload) SelfTest() error {
+	if upload.objectStore != nil {
+		return nil
+	}
 	if err := os.MkdirAll(fileUploadStorage, 0700); err != nil {
 		return fmt.Errorf("HandleFileUpload.SelfTest: failed to read/create storage directory \"%s\" - %v", fileUploadStorage, err)
 	}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/stretchr/testify/require"
+)
+
+type dummyObjectStore struct {
+	objects      map[string][]byte
+	lastModified map[string]time.Time
+	kmsKeyIDs    map[string]string
+}
+
+func (store *dummyObjectStore) UploadEncrypted(_ context.Context, bucketName, objectKey, kmsKeyID string, objectValue io.Reader) error {
+	content, err := io.ReadAll(objectValue)
+	if err != nil {
+		return err
+	}
+	store.objects[bucketName+"/"+objectKey] = content
+	store.lastModified[bucketName+"/"+objectKey] = time.Now()
+	store.kmsKeyIDs[bucketName+"/"+objectKey] = kmsKeyID
+	return nil
+}
+
+func (store *dummyObjectStore) GetLastModified(_ context.Context, bucketName, objectKey string) (time.Time, error) {
+	lastModified, exists := store.lastModified[bucketName+"/"+objectKey]
+	if !exists {
+		return time.Time{}, errors.New("object does not exist")
+	}
+	return lastModified, nil
+}
+
+func (store *dummyObjectStore) PresignGetObject(bucketName, objectKey string, _ time.Duration) (string, error) {
+	return "https://" + bucketName + ".example.com/" + objectKey + "?signature=abc", nil
+}
+
+func TestHandleFileUpload_S3(t *testing.T) {
+	store := &dummyObjectStore{objects: map[string][]byte{}, lastModified: map[string]time.Time{}, kmsKeyIDs: map[string]string{}}
+	upload := &HandleFileUpload{S3BucketName: "bucket", S3KMSKeyID: "key-id", objectStore: store}
+	require.NoError(t, upload.Initialise(&lalog.Logger{}, nil, ""))
+	require.NoError(t, upload.SelfTest())
+
+	// Upload a file
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	require.NoError(t, form.WriteField("submit", "Upload"))
+	fileField, err := form.CreateFormFile("upload", "hello.txt")
+	require.NoError(t, err)
+	_, err = fileField.Write([]byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, form.Close())
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	upload.Handle(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, store.objects, 1)
+	var objectKey string
+	for key, content := range store.objects {
+		objectKey = strings.TrimPrefix(key, "bucket/")
+		require.Equal(t, []byte("hello world"), content)
+		require.Equal(t, "key-id", store.kmsKeyIDs[key])
+	}
+	require.True(t, strings.HasPrefix(objectKey, FileUploadS3KeyPrefix))
+	require.True(t, strings.HasSuffix(objectKey, ".txt"))
+	fileName := strings.TrimPrefix(objectKey, FileUploadS3KeyPrefix)
+	require.Contains(t, w.Body.String(), fileName)
+
+	download := func(name string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(url.Values{"submit": {"Download"}, "download": {name}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		upload.Handle(w, req)
+		return w
+	}
+	// Download the file via a presigned URL
+	w = download(fileName)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	require.Equal(t, "https://bucket.example.com/"+objectKey+"?signature=abc", w.Header().Get("Location"))
+	// Files that do not exist or expired cannot be downloaded
+	require.Contains(t, download("does-not-exist.txt").Body.String(), "File does not exist")
+	store.lastModified["bucket/"+objectKey] = time.Now().Add(-(FileUploadExpireInSec + 1) * time.Second)
+	require.Contains(t, download(fileName).Body.String(), "File does not exist")
+	require.Contains(t, download("../"+fileName).Body.String(), "Please enter a file name")
+}
@@ -112,6 +112,8 @@ func (lab *HandleGitlabBrowser) DownloadGitBlob(ctx context.Context, clientIP, p
 		Header:     map[string][]string{"PRIVATE-TOKEN": {lab.PrivateToken}},
 		TimeoutSec: GitlabAPITimeoutSec,
 		MaxBytes:   256 * 1048576,
+		// Do not hand a partially downloaded file to the visitor
+		RejectLargeResponse: true,
 	}, "https://gitlab.com/api/v4/projects/%s/repository/files/%s/raw?ref=master", projectID, path.Join(paths, fileName))
 	if err != nil {
 		return
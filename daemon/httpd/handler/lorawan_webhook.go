@@ -166,19 +166,19 @@ func (hand *HandleLoraWANWebhook) Handle(w http.ResponseWriter, r *http.Request)
 	var uplinkInfo WebHookPayload
 	if err := json.Unmarshal(body, &uplinkInfo); err != nil || len(uplinkInfo.EndDeviceIDs.DeviceID) == 0 {
 		hand.logger.Warning(middleware.GetRealClientIP(r), err, "failed to unmarshal webhook payload")
-		http.Error(w, "failed to decode uplink message", http.StatusBadRequest)
+		middleware.WriteError(w, r, http.StatusBadRequest, "failed to decode uplink message")
 		return
 	}
 	// Decode the raw payload sent by transmitter
 	payloadBytes, err := base64.StdEncoding.DecodeString(uplinkInfo.UplinkMessage.RawPayloadBase64)
 	if err != nil {
 		hand.logger.Warning(middleware.GetRealClientIP(r), err, "failed to unmarshal uplink message payload")
-		http.Error(w, "failed to decode uplink message payload", http.StatusBadRequest)
+		middleware.WriteError(w, r, http.StatusBadRequest, "failed to decode uplink message payload")
 		return
 	}
 	if len(payloadBytes) > 2048 {
 		hand.logger.Warning(middleware.GetRealClientIP(r), err, "received an unusually large uplink payload")
-		http.Error(w, "the size of raw payload is unusually large", http.StatusBadRequest)
+		middleware.WriteError(w, r, http.StatusBadRequest, "the size of raw payload is unusually large")
 		return
 	}
 	// Construct a report to save to message processor
@@ -212,6 +212,22 @@ func (hand *HandleLoraWANWebhook) Handle(w http.ResponseWriter, r *http.Request)
 		TimeAtReception: uplinkInfo.ReceivedByGatewayAt,
 		StringPayload:   string(payloadBytes),
 	}
+	// Keep track of the transceiver's GPS position for the location tracker app.
+	if loc := uplinkInfo.UplinkMessage.Locations.LocationFromPayload; hand.cmdProc.Features.LocationTracker.IsConfigured() && (loc.Latitude != 0 || loc.Longitude != 0) {
+		pos := toolbox.Position{
+			Latitude:  loc.Latitude,
+			Longitude: loc.Longitude,
+			Altitude:  loc.Altitude,
+			Accuracy:  loc.Accuracy,
+			Source:    toolbox.LocationSourceLoRaWAN,
+		}
+		if receivedAt, err := time.Parse(time.RFC3339Nano, uplinkInfo.ReceivedByGatewayAt); err == nil {
+			pos.Time = receivedAt
+		}
+		if err := hand.cmdProc.Features.LocationTracker.Record(uplinkInfo.EndDeviceIDs.DeviceID, pos); err != nil {
+			hand.logger.Warning(uplinkInfo.EndDeviceIDs.DeviceID, err, "failed to record the location of the transceiver")
+		}
+	}
 	report := toolbox.SubjectReportRequest{
 		SubjectIP:       uplinkInfo.EndDeviceIDs.DeviceEUI,
 		SubjectHostName: uplinkInfo.EndDeviceIDs.DeviceID,
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/daemon/smtpd"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+/*
+HandleMailQuarantine lets the visitor browse the mails kept in quarantine by the SMTP daemon due to blocked attachments,
+and release (deliver) or delete them. Each request must carry the password PIN in the "pin" form field.
+*/
+type HandleMailQuarantine struct {
+	// MailDaemon is the SMTP daemon that quarantines the mails.
+	MailDaemon *smtpd.Daemon `json:"-"`
+
+	cmdProc *toolbox.CommandProcessor
+	logger  *lalog.Logger
+}
+
+func (hand *HandleMailQuarantine) Initialise(logger *lalog.Logger, cmdProc *toolbox.CommandProcessor, _ string) error {
+	if cmdProc == nil || cmdProc.IsEmpty() {
+		return errors.New("HandleMailQuarantine.Initialise: command processor must have a password PIN")
+	}
+	hand.cmdProc = cmdProc
+	hand.logger = logger
+	return nil
+}
+
+func (hand *HandleMailQuarantine) Handle(w http.ResponseWriter, r *http.Request) {
+	NoCache(w)
+	if hand.MailDaemon == nil {
+		middleware.WriteError(w, r, http.StatusServiceUnavailable, "mail server is not enabled")
+		return
+	}
+	if !hand.cmdProc.IsPasswordAccepted(r.FormValue("pin")) {
+		middleware.WriteError(w, r, http.StatusUnauthorized, "incorrect password PIN")
+		return
+	}
+	idStr := r.FormValue("id")
+	id, _ := strconv.Atoi(idStr)
+	switch action := r.FormValue("action"); {
+	case action == "" && idStr == "":
+		// List the quarantined mails (/endpoint?pin=xxx)
+		w.Header().Set("Content-Type", "application/json")
+		jsonWriter := json.NewEncoder(w)
+		jsonWriter.SetIndent("", "  ")
+		if err := jsonWriter.Encode(hand.MailDaemon.GetQuarantinedMails()); err != nil {
+			hand.logger.Warning(middleware.GetRealClientIP(r), err, "failed to serialise JSON response")
+		}
+	case action == "":
+		// Read the entire message of a quarantined mail (/endpoint?pin=xxx&id=1)
+		mailBody, exists := hand.MailDaemon.GetQuarantinedMailBody(id)
+		if !exists {
+			middleware.WriteError(w, r, http.StatusNotFound, fmt.Sprintf("mail %d is not in quarantine", id))
+			return
+		}
+		// The message is presented as plain text so that its content (e.g. HTML) does not get rendered
+		w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		_, _ = w.Write([]byte(mailBody))
+	case r.Method != http.MethodPost:
+		middleware.WriteError(w, r, http.StatusMethodNotAllowed, "release and delete actions must use POST")
+	case action == "release":
+		if err := hand.MailDaemon.ReleaseQuarantinedMail(id); err != nil {
+			middleware.WriteError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		hand.logger.Info(middleware.GetRealClientIP(r), nil, "released quarantined mail %d", id)
+		_, _ = w.Write([]byte(fmt.Sprintf("Released mail %d.\r\n", id)))
+	case action == "delete":
+		if !hand.MailDaemon.DeleteQuarantinedMail(id) {
+			middleware.WriteError(w, r, http.StatusNotFound, fmt.Sprintf("mail %d is not in quarantine", id))
+			return
+		}
+		hand.logger.Info(middleware.GetRealClientIP(r), nil, "deleted quarantined mail %d", id)
+		_, _ = w.Write([]byte(fmt.Sprintf("Deleted mail %d.\r\n", id)))
+	default:
+		middleware.WriteError(w, r, http.StatusBadRequest, "action must be either release or delete")
+	}
+}
+
+func (*HandleMailQuarantine) GetRateLimitFactor() int {
+	return 1
+}
+
+func (*HandleMailQuarantine) SelfTest() error {
+	return nil
+}
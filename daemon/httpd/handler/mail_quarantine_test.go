@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/daemon/smtpd"
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMailQuarantine(t *testing.T) {
+	mailDaemon := &smtpd.Daemon{
+		MyDomains: []string{"example.com"},
+		ForwardTo: []string{"me@example.org"},
+		// The MTA does not exist and the released mail will not reach it.
+		ForwardMailClient: inet.MailClient{MailFrom: "me@example.com", MTAHost: "127.0.0.1", MTAPort: 1},
+	}
+	require.NoError(t, mailDaemon.Initialise())
+	mailDaemon.QuarantineMail("192.0.2.1", "friend@example.org", []string{"me@example.com"}, "From: friend@example.org\r\nSubject: hi\r\n\r\n<b>body</b>\r\n", "test")
+	mailDaemon.QuarantineMail("192.0.2.1", "friend@example.org", []string{"me@example.com"}, "From: friend@example.org\r\nSubject: again\r\n\r\nbody\r\n", "test")
+
+	hand := &HandleMailQuarantine{}
+	require.Error(t, hand.Initialise(&lalog.Logger{}, &toolbox.CommandProcessor{}, ""))
+	require.NoError(t, hand.Initialise(&lalog.Logger{}, toolbox.GetTestCommandProcessor(), ""))
+	request := func(method string, form url.Values) *httptest.ResponseRecorder {
+		var req *http.Request
+		if method == http.MethodGet {
+			req = httptest.NewRequest(method, "/quarantine?"+form.Encode(), nil)
+		} else {
+			req = httptest.NewRequest(method, "/quarantine", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		hand.Handle(w, req)
+		return w
+	}
+	// The mail daemon is not available
+	require.Equal(t, http.StatusServiceUnavailable, request(http.MethodGet, url.Values{"pin": {toolbox.TestCommandProcessorPIN}}).Code)
+	hand.MailDaemon = mailDaemon
+	// Every request must carry the password
+	require.Equal(t, http.StatusUnauthorized, request(http.MethodGet, url.Values{}).Code)
+	require.Equal(t, http.StatusUnauthorized, request(http.MethodPost, url.Values{"pin": {"wrong"}, "action": {"delete"}, "id": {"1"}}).Code)
+
+	// List the quarantined mails
+	resp := request(http.MethodPost, url.Values{"pin": {toolbox.TestCommandProcessorPIN}})
+	require.Equal(t, http.StatusOK, resp.Code)
+	var mails []smtpd.QuarantinedMail
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &mails))
+	require.Len(t, mails, 2)
+	require.Equal(t, "again", mails[0].Subject)
+	require.Equal(t, "hi", mails[1].Subject)
+
+	// Read a quarantined mail
+	resp = request(http.MethodGet, url.Values{"pin": {toolbox.TestCommandProcessorPIN}, "id": {"1"}})
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, "text/plain; charset=UTF-8", resp.Header().Get("Content-Type"))
+	require.Contains(t, resp.Body.String(), "<b>body</b>")
+	require.Equal(t, http.StatusNotFound, request(http.MethodGet, url.Values{"pin": {toolbox.TestCommandProcessorPIN}, "id": {"3"}}).Code)
+
+	// Release and delete the mails
+	require.Equal(t, http.StatusMethodNotAllowed, request(http.MethodGet, url.Values{"pin": {toolbox.TestCommandProcessorPIN}, "action": {"delete"}, "id": {"1"}}).Code)
+	require.Equal(t, http.StatusBadRequest, request(http.MethodPost, url.Values{"pin": {toolbox.TestCommandProcessorPIN}, "action": {"burn"}, "id": {"1"}}).Code)
+	resp = request(http.MethodPost, url.Values{"pin": {toolbox.TestCommandProcessorPIN}, "action": {"release"}, "id": {"1"}})
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, "Released mail 1.\r\n", resp.Body.String())
+	require.Equal(t, http.StatusInternalServerError, request(http.MethodPost, url.Values{"pin": {toolbox.TestCommandProcessorPIN}, "action": {"release"}, "id": {"1"}}).Code)
+	resp = request(http.MethodPost, url.Values{"pin": {toolbox.TestCommandProcessorPIN}, "action": {"delete"}, "id": {"2"}})
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, http.StatusNotFound, request(http.MethodPost, url.Values{"pin": {toolbox.TestCommandProcessorPIN}, "action": {"delete"}, "id": {"2"}}).Code)
+	require.Empty(t, mailDaemon.GetQuarantinedMails())
+}
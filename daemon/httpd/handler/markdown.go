@@ -0,0 +1,544 @@
+package handler
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// markdownEscapable are the punctuation characters that may be escaped by a backslash in markdown text.
+const markdownEscapable = "\\`*_{}[]()#+-.!|~<>\"'"
+
+// regexMarkdownClosingHashes matches the optional closing sequence of an ATX heading, e.g. "## Title ##".
+var regexMarkdownClosingHashes = regexp.MustCompile(`\s+#+\s*$`)
+
+/*
+renderMarkdown converts a markdown document into HTML. It supports the commonly used subset of CommonMark and GitHub
+flavoured markdown: headings, paragraphs, emphasis, strike-through, code spans and fenced code blocks, links, images,
+block quotes, nested lists, tables, and horizontal rules. Raw HTML in the document is escaped rather than interpreted,
+and links of scripting schemes (e.g. "javascript:") are neutralised.
+*/
+func renderMarkdown(doc string) string {
+	doc = strings.ReplaceAll(doc, "\x00", "")
+	doc = strings.ReplaceAll(doc, "\r\n", "\n")
+	doc = strings.ReplaceAll(doc, "\t", "    ")
+	var out strings.Builder
+	renderMarkdownBlocks(&out, strings.Split(doc, "\n"), false)
+	return out.String()
+}
+
+// renderMarkdownBlocks renders the block elements of the lines. A tight list item renders its paragraphs without <p>.
+func renderMarkdownBlocks(out *strings.Builder, lines []string, tight bool) {
+	for i := 0; i < len(lines); {
+		trimmed := strings.TrimSpace(lines[i])
+		switch {
+		case trimmed == "":
+			i++
+		case isMarkdownFence(trimmed):
+			i = renderMarkdownCodeBlock(out, lines, i)
+		case markdownHeadingLevel(trimmed) > 0:
+			level := markdownHeadingLevel(trimmed)
+			text := regexMarkdownClosingHashes.ReplaceAllString(strings.TrimSpace(trimmed[level:]), "")
+			if strings.Trim(text, "#") == "" {
+				text = ""
+			}
+			fmt.Fprintf(out, "<h%d id=\"%s\">%s</h%d>\n", level, markdownAnchor(text), renderMarkdownInline(text), level)
+			i++
+		case isMarkdownRule(trimmed):
+			out.WriteString("<hr>\n")
+			i++
+		case strings.HasPrefix(trimmed, ">"):
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">"), " "))
+			}
+			out.WriteString("<blockquote>\n")
+			renderMarkdownBlocks(out, quote, false)
+			out.WriteString("</blockquote>\n")
+		case isMarkdownListItem(lines[i]):
+			i = renderMarkdownList(out, lines, i)
+		case strings.Contains(trimmed, "|") && i+1 < len(lines) && isMarkdownTableDelimiter(lines[i+1]):
+			i = renderMarkdownTable(out, lines, i)
+		default:
+			var para []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				if len(para) > 0 && startsMarkdownBlock(lines[i]) {
+					break
+				}
+				line := strings.TrimLeft(lines[i], " ")
+				// A line ending in two spaces or a backslash breaks the line.
+				if strings.HasSuffix(line, "  ") || (strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\")) {
+					line = strings.TrimSuffix(strings.TrimRight(line, " "), "\\") + "\x00"
+				}
+				para = append(para, strings.TrimRight(line, " "))
+			}
+			text := strings.TrimSuffix(strings.Join(para, "\n"), "\x00")
+			rendered := strings.ReplaceAll(renderMarkdownInline(text), "\x00", "<br>")
+			if tight {
+				out.WriteString(rendered + "\n")
+			} else {
+				out.WriteString("<p>" + rendered + "</p>\n")
+			}
+		}
+	}
+}
+
+// startsMarkdownBlock returns true if the line starts a block element that interrupts a paragraph.
+func startsMarkdownBlock(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return isMarkdownFence(trimmed) || markdownHeadingLevel(trimmed) > 0 || isMarkdownRule(trimmed) ||
+		strings.HasPrefix(trimmed, ">") || isMarkdownListItem(line)
+}
+
+// isMarkdownFence returns true if the line opens or closes a fenced code block.
+func isMarkdownFence(trimmed string) bool {
+	return strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")
+}
+
+// renderMarkdownCodeBlock renders the fenced code block that starts at the line, and returns the index of the next line.
+func renderMarkdownCodeBlock(out *strings.Builder, lines []string, i int) int {
+	opening := strings.TrimSpace(lines[i])
+	fence := opening[:3]
+	lang := strings.Fields(strings.TrimLeft(opening, fence[:1]))
+	var code []string
+	for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+		code = append(code, lines[i])
+	}
+	if len(lang) > 0 {
+		fmt.Fprintf(out, "<pre><code class=\"language-%s\">", html.EscapeString(lang[0]))
+	} else {
+		out.WriteString("<pre><code>")
+	}
+	for _, line := range code {
+		out.WriteString(html.EscapeString(line) + "\n")
+	}
+	out.WriteString("</code></pre>\n")
+	// Skip the closing fence
+	return i + 1
+}
+
+// markdownHeadingLevel returns the level of an ATX heading (e.g. "## Title"), or 0 if the line is not a heading.
+func markdownHeadingLevel(trimmed string) int {
+	level := 0
+	for level < len(trimmed) && trimmed[level] == '#' {
+		level++
+	}
+	if level < 1 || level > 6 || (level < len(trimmed) && trimmed[level] != ' ') {
+		return 0
+	}
+	return level
+}
+
+// isMarkdownRule returns true if the line is a horizontal rule, e.g. "---" or "* * *".
+func isMarkdownRule(trimmed string) bool {
+	compact := strings.ReplaceAll(trimmed, " ", "")
+	if len(compact) < 3 || !strings.ContainsRune("-*_", rune(compact[0])) {
+		return false
+	}
+	return strings.Count(compact, compact[:1]) == len(compact)
+}
+
+// markdownAnchor returns the ID of a heading, which lets a link navigate to the heading, e.g. "#getting-started".
+func markdownAnchor(text string) string {
+	var anchor strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' {
+			anchor.WriteRune(r)
+		} else if r == ' ' {
+			anchor.WriteRune('-')
+		}
+	}
+	return html.EscapeString(anchor.String())
+}
+
+/*
+parseMarkdownListItem returns whether the line is an item of an ordered list, the starting number of the ordered
+list, and the column at which the item content begins. ok is false if the line is not a list item.
+*/
+func parseMarkdownListItem(line string) (ordered bool, start, contentCol int, ok bool) {
+	indent := len(line) - len(strings.TrimLeft(line, " "))
+	if indent > 3 {
+		return
+	}
+	rest := line[indent:]
+	if len(rest) >= 2 && strings.ContainsRune("-*+", rune(rest[0])) && rest[1] == ' ' && !isMarkdownRule(rest) {
+		return false, 0, indent + 2, true
+	}
+	digits := 0
+	for digits < len(rest) && digits < 9 && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	if digits > 0 && len(rest) > digits+1 && (rest[digits] == '.' || rest[digits] == ')') && rest[digits+1] == ' ' {
+		start, _ = strconv.Atoi(rest[:digits])
+		return true, start, indent + digits + 2, true
+	}
+	return
+}
+
+// isMarkdownListItem returns true if the line is an item of an ordered or unordered list.
+func isMarkdownListItem(line string) bool {
+	_, _, _, ok := parseMarkdownListItem(line)
+	return ok
+}
+
+// markdownIndent returns the number of leading spaces of the line.
+func markdownIndent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// renderMarkdownList renders the list that starts at the line, and returns the index of the next line.
+func renderMarkdownList(out *strings.Builder, lines []string, i int) int {
+	ordered, start, _, _ := parseMarkdownListItem(lines[i])
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+	}
+	if ordered && start != 1 {
+		fmt.Fprintf(out, "<ol start=\"%d\">\n", start)
+	} else {
+		fmt.Fprintf(out, "<%s>\n", tag)
+	}
+	for i < len(lines) {
+		// Blank lines may separate the items of the same list
+		next := i
+		for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+			next++
+		}
+		if next == len(lines) {
+			break
+		}
+		itemOrdered, _, contentCol, ok := parseMarkdownListItem(lines[next])
+		if !ok || itemOrdered != ordered {
+			break
+		}
+		i = next
+		item := []string{lines[i][contentCol:]}
+		tight := true
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if strings.TrimSpace(line) == "" {
+				// A blank line belongs to the item if the item continues after it
+				next := i
+				for next < len(lines) && strings.TrimSpace(lines[next]) == "" {
+					next++
+				}
+				if next == len(lines) || markdownIndent(lines[next]) < contentCol {
+					break
+				}
+				tight = false
+				item = append(item, "")
+				continue
+			}
+			if markdownIndent(line) >= contentCol {
+				item = append(item, line[contentCol:])
+				continue
+			}
+			if startsMarkdownBlock(line) {
+				break
+			}
+			// Lazy continuation of the item's paragraph
+			item = append(item, strings.TrimSpace(line))
+		}
+		out.WriteString("<li>")
+		renderMarkdownBlocks(out, item, tight)
+		out.WriteString("</li>\n")
+	}
+	fmt.Fprintf(out, "</%s>\n", tag)
+	return i
+}
+
+// splitMarkdownTableRow returns the cells of a table row, e.g. "| a | b |".
+func splitMarkdownTableRow(line string) (cells []string) {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, "\\|") {
+		line = strings.TrimSuffix(line, "|")
+	}
+	var cell strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+// isMarkdownTableDelimiter returns true if the line is the delimiter row under a table header, e.g. "|---|:---:|".
+func isMarkdownTableDelimiter(line string) bool {
+	if !strings.Contains(line, "|") || !strings.Contains(line, "-") {
+		return false
+	}
+	for _, cell := range splitMarkdownTableRow(line) {
+		if strings.Trim(strings.Trim(cell, ":"), "-") != "" || !strings.Contains(cell, "-") {
+			return false
+		}
+	}
+	return true
+}
+
+// renderMarkdownTable renders the table that starts at the line, and returns the index of the next line.
+func renderMarkdownTable(out *strings.Builder, lines []string, i int) int {
+	header := splitMarkdownTableRow(lines[i])
+	var aligns []string
+	for _, cell := range splitMarkdownTableRow(lines[i+1]) {
+		switch {
+		case strings.HasPrefix(cell, ":") && strings.HasSuffix(cell, ":"):
+			aligns = append(aligns, " style=\"text-align: center\"")
+		case strings.HasSuffix(cell, ":"):
+			aligns = append(aligns, " style=\"text-align: right\"")
+		case strings.HasPrefix(cell, ":"):
+			aligns = append(aligns, " style=\"text-align: left\"")
+		default:
+			aligns = append(aligns, "")
+		}
+	}
+	writeRow := func(cells []string, tag string) {
+		out.WriteString("<tr>")
+		for col := range header {
+			var text, align string
+			if col < len(cells) {
+				text = cells[col]
+			}
+			if col < len(aligns) {
+				align = aligns[col]
+			}
+			fmt.Fprintf(out, "<%s%s>%s</%s>", tag, align, renderMarkdownInline(text), tag)
+		}
+		out.WriteString("</tr>\n")
+	}
+	out.WriteString("<table>\n<thead>\n")
+	writeRow(header, "th")
+	out.WriteString("</thead>\n<tbody>\n")
+	for i += 2; i < len(lines) && strings.TrimSpace(lines[i]) != "" && strings.Contains(lines[i], "|"); i++ {
+		writeRow(splitMarkdownTableRow(lines[i]), "td")
+	}
+	out.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+// isMarkdownWordChar returns true if the byte is a letter or digit, which prevents underscores in a word from emphasising it.
+func isMarkdownWordChar(c byte) bool {
+	return c >= 0x80 || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// renderMarkdownInline renders the inline elements of the text, e.g. emphasis, links, and code spans.
+func renderMarkdownInline(text string) string {
+	var out strings.Builder
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\\' && i+1 < len(text) && strings.IndexByte(markdownEscapable, text[i+1]) != -1:
+			out.WriteString(html.EscapeString(text[i+1 : i+2]))
+			i += 2
+			continue
+		case c == '`':
+			run := len(text[i:]) - len(strings.TrimLeft(text[i:], "`"))
+			if end := strings.Index(text[i+run:], text[i:i+run]); end != -1 {
+				code := strings.ReplaceAll(text[i+run:i+run+end], "\n", " ")
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+					code = code[1 : len(code)-1]
+				}
+				out.WriteString("<code>" + html.EscapeString(code) + "</code>")
+				i += run + end + run
+			} else {
+				out.WriteString(text[i : i+run])
+				i += run
+			}
+			continue
+		case c == '!' && i+1 < len(text) && text[i+1] == '[':
+			if label, dest, title, end, ok := parseMarkdownLink(text, i+1); ok {
+				fmt.Fprintf(&out, "<img src=\"%s\" alt=\"%s\"%s>", html.EscapeString(sanitiseMarkdownURL(dest)), html.EscapeString(label), markdownTitleAttr(title))
+				i = end
+				continue
+			}
+		case c == '[':
+			if label, dest, title, end, ok := parseMarkdownLink(text, i); ok {
+				fmt.Fprintf(&out, "<a href=\"%s\"%s>%s</a>", html.EscapeString(sanitiseMarkdownURL(dest)), markdownTitleAttr(title), renderMarkdownInline(label))
+				i = end
+				continue
+			}
+		case c == '<':
+			if end := strings.IndexByte(text[i:], '>'); end > 1 {
+				addr := text[i+1 : i+end]
+				if !strings.ContainsAny(addr, " \n<") {
+					if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+						fmt.Fprintf(&out, "<a href=\"%s\">%s</a>", html.EscapeString(sanitiseMarkdownURL(addr)), html.EscapeString(addr))
+						i += end + 1
+						continue
+					} else if at := strings.IndexByte(addr, '@'); at > 0 && at < len(addr)-1 && !strings.Contains(addr, ":") {
+						fmt.Fprintf(&out, "<a href=\"mailto:%s\">%s</a>", html.EscapeString(addr), html.EscapeString(addr))
+						i += end + 1
+						continue
+					}
+				}
+			}
+		case c == 'h' && (i == 0 || !isMarkdownWordChar(text[i-1])) && (strings.HasPrefix(text[i:], "http://") || strings.HasPrefix(text[i:], "https://")):
+			// Bare URLs are turned into links as well, without the trailing punctuation.
+			end := strings.IndexAny(text[i:], " \n<")
+			if end == -1 {
+				end = len(text) - i
+			}
+			addr := strings.TrimRight(text[i:i+end], ".,;:!?*_~)'\"")
+			fmt.Fprintf(&out, "<a href=\"%s\">%s</a>", html.EscapeString(sanitiseMarkdownURL(addr)), html.EscapeString(addr))
+			i += len(addr)
+			continue
+		case c == '*' || c == '_' || c == '~':
+			if run, inner, end, ok := matchMarkdownEmphasis(text, i); ok {
+				opening, closing := "<em>", "</em>"
+				switch {
+				case c == '~':
+					opening, closing = "<del>", "</del>"
+				case run == 2:
+					opening, closing = "<strong>", "</strong>"
+				case run == 3:
+					opening, closing = "<em><strong>", "</strong></em>"
+				}
+				out.WriteString(opening + renderMarkdownInline(inner) + closing)
+				i = end
+				continue
+			}
+			// Write the whole run of delimiters, none of them emphasises the text.
+			run := len(text[i:]) - len(strings.TrimLeft(text[i:], string(c)))
+			out.WriteString(text[i : i+run])
+			i += run
+			continue
+		}
+		out.WriteString(html.EscapeString(text[i : i+1]))
+		i++
+	}
+	return out.String()
+}
+
+/*
+matchMarkdownEmphasis looks for the closing delimiter of the emphasis (e.g. "*", "**", "~~") that opens at the index.
+It returns the length of the delimiter, the emphasised text, and the index after the closing delimiter.
+*/
+func matchMarkdownEmphasis(text string, i int) (run int, inner string, end int, ok bool) {
+	c := text[i]
+	for run = 1; run < 3 && i+run < len(text) && text[i+run] == c; run++ {
+	}
+	if c == '~' && run != 2 {
+		return
+	}
+	delim := text[i : i+run]
+	// The opening delimiter must be followed by text, and an underscore must not be in the middle of a word.
+	if i+run >= len(text) || text[i+run] == ' ' || text[i+run] == '\n' || (c == '_' && i > 0 && isMarkdownWordChar(text[i-1])) {
+		return
+	}
+	for j := i + run + 1; j+run <= len(text); j++ {
+		switch {
+		case text[j] == '\\':
+			j++
+			continue
+		case text[j] == '`':
+			// Emphasis delimiters inside a code span do not count
+			if closing := strings.IndexByte(text[j+1:], '`'); closing != -1 {
+				j += closing + 1
+			}
+			continue
+		case text[j:j+run] != delim:
+			continue
+		}
+		// Skip a longer run of the delimiter (e.g. "**" inside "*a **b** c*")
+		closingRun := len(text[j:]) - len(strings.TrimLeft(text[j:], string(c)))
+		if closingRun != run {
+			j += closingRun - 1
+			continue
+		}
+		if text[j-1] == ' ' || text[j-1] == '\n' || (c == '_' && j+run < len(text) && isMarkdownWordChar(text[j+run])) {
+			continue
+		}
+		return run, text[i+run : j], j + run, true
+	}
+	return 0, "", 0, false
+}
+
+/*
+parseMarkdownLink parses a link (e.g. `[label](https://example.com "title")`) that starts with the bracket at the
+index. It returns the link label, destination, title, and the index after the link.
+*/
+func parseMarkdownLink(text string, i int) (label, dest, title string, end int, ok bool) {
+	depth := 0
+	closeBracket := -1
+	for j := i; j < len(text) && closeBracket == -1; j++ {
+		switch text[j] {
+		case '\\':
+			j++
+		case '[':
+			depth++
+		case ']':
+			if depth--; depth == 0 {
+				closeBracket = j
+			}
+		}
+	}
+	if closeBracket == -1 || closeBracket+1 >= len(text) || text[closeBracket+1] != '(' {
+		return
+	}
+	depth = 0
+	closeParen := -1
+	for j := closeBracket + 1; j < len(text) && closeParen == -1; j++ {
+		switch text[j] {
+		case '\\':
+			j++
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				closeParen = j
+			}
+		}
+	}
+	if closeParen == -1 {
+		return
+	}
+	target := strings.TrimSpace(text[closeBracket+2 : closeParen])
+	if strings.HasPrefix(target, "<") {
+		if closing := strings.IndexByte(target, '>'); closing != -1 {
+			dest, title = target[1:closing], strings.TrimSpace(target[closing+1:])
+		}
+	} else if space := strings.IndexAny(target, " \n"); space != -1 {
+		dest, title = target[:space], strings.TrimSpace(target[space+1:])
+	} else {
+		dest = target
+	}
+	if len(title) >= 2 && (title[0] == '"' || title[0] == '\'') && title[len(title)-1] == title[0] {
+		title = title[1 : len(title)-1]
+	} else if title != "" {
+		return
+	}
+	return text[i+1 : closeBracket], dest, title, closeParen + 1, true
+}
+
+// markdownTitleAttr returns the HTML title attribute of the link title, or an empty string if there is no title.
+func markdownTitleAttr(title string) string {
+	if title == "" {
+		return ""
+	}
+	return fmt.Sprintf(" title=\"%s\"", html.EscapeString(title))
+}
+
+// sanitiseMarkdownURL returns the URL if it is relative or uses a harmless scheme, or "#" otherwise (e.g. "javascript:").
+func sanitiseMarkdownURL(dest string) string {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "#"
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto", "ftp", "tel":
+		return dest
+	default:
+		return "#"
+	}
+}
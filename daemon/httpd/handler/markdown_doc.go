@@ -0,0 +1,323 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const (
+	// MarkdownIndexFileName is the name of an optional markdown document rendered on the index page above the navigation index.
+	MarkdownIndexFileName = "index.md"
+	// MaxMarkdownDocumentSize is the maximum size of a markdown document that will be rendered.
+	MaxMarkdownDocumentSize = 4 * 1048576
+)
+
+// HandleMarkdownDocumentPage is the default HTML template of the pages rendered from markdown documents.
+const HandleMarkdownDocumentPage = `<!doctype html>
+<html>
+<head>
+    <meta http-equiv="Content-Type" content="text/html; charset=UTF-8" />
+    <meta name="viewport" content="width=device-width, initial-scale=1" />
+    <title>{{.Title}}</title>
+    <style>
+        body { font-family: sans-serif; line-height: 1.5; margin: 0 auto; max-width: 60em; padding: 1em; }
+        nav { border-bottom: 1px solid #ccc; margin-bottom: 1em; }
+        pre { background: #f4f4f4; overflow-x: auto; padding: 0.5em; }
+        blockquote { border-left: 4px solid #ccc; color: #555; margin-left: 0; padding-left: 1em; }
+        table { border-collapse: collapse; }
+        th, td { border: 1px solid #ccc; padding: 0.25em 0.5em; }
+        img { max-width: 100%; }
+    </style>
+</head>
+<body>
+    <nav>
+        <a href="{{.IndexURL}}">{{.SiteTitle}}</a>
+        <ul>{{range .Index}}
+            <li><a href="{{.URL}}">{{.Title}}</a></li>{{end}}
+        </ul>
+    </nav>
+    <article>
+{{.Content}}
+    </article>
+</body>
+</html>
+`
+
+// MarkdownIndexEntry is a markdown document listed on the navigation index.
+type MarkdownIndexEntry struct {
+	// Title is the text of the document's first heading, or its file name if the document does not have a heading.
+	Title string
+	// URL is the location of the document relative to the page being rendered.
+	URL string
+}
+
+// MarkdownPage is the data given to the HTML template for rendering the index page or a markdown document.
+type MarkdownPage struct {
+	// Title is the title of the page.
+	Title string
+	// SiteTitle is the title of the index page.
+	SiteTitle string
+	// IndexURL is the location of the index page relative to the page being rendered.
+	IndexURL string
+	// Current is the document being rendered, it is nil on the index page.
+	Current *MarkdownIndexEntry
+	// Index lists all markdown documents in the order of their paths.
+	Index []MarkdownIndexEntry
+	// Content is the document rendered in HTML.
+	Content template.HTML
+}
+
+// markdownDocument is a markdown document rendered in HTML.
+type markdownDocument struct {
+	modTime time.Time
+	size    int64
+	title   string
+	content string
+}
+
+/*
+HandleMarkdownDocument renders the markdown documents (.md files) of a directory into HTML pages, so that notes written
+in markdown may be published without a static site generator. The pages are laid out by an HTML template with a
+navigation index of the documents, and the placeholders (for example "#LAITOS_3339TIME") are substituted in the same
+way as the HTML document handler.
+*/
+type HandleMarkdownDocument struct {
+	// DirPath is the directory of markdown documents, the documents in its sub-directories are rendered as well.
+	DirPath string `json:"DirPath"`
+	// Title is the title of the index page. It defaults to the name of the directory.
+	Title string `json:"Title"`
+	// TemplateFilePath is the file path to an HTML template (in the syntax of Go html/template) that lays out the pages. Optional.
+	TemplateFilePath string `json:"TemplateFilePath"`
+	// Location is the URL location (path prefix) of the index page, the documents are served underneath.
+	Location string `json:"-"`
+
+	tmpl        *template.Template
+	logger      *lalog.Logger
+	stripPrefix string
+	// documents are the rendered documents keyed by their path relative to the directory, they are rendered again when the file changes.
+	documents map[string]*markdownDocument
+	mutex     *sync.Mutex
+}
+
+func (hand *HandleMarkdownDocument) Initialise(logger *lalog.Logger, _ *toolbox.CommandProcessor, stripPrefix string) error {
+	hand.logger = logger
+	hand.stripPrefix = stripPrefix
+	if hand.DirPath == "" {
+		return errors.New("HandleMarkdownDocument.Initialise: DirPath must not be empty")
+	}
+	if info, err := os.Stat(hand.DirPath); err != nil || !info.IsDir() {
+		return fmt.Errorf("HandleMarkdownDocument.Initialise: DirPath \"%s\" must be a directory", hand.DirPath)
+	}
+	if hand.Title == "" {
+		hand.Title = filepath.Base(hand.DirPath)
+	}
+	if !strings.HasSuffix(hand.Location, "/") {
+		hand.Location += "/"
+	}
+	tmplContent := HandleMarkdownDocumentPage
+	if hand.TemplateFilePath != "" {
+		content, err := os.ReadFile(hand.TemplateFilePath)
+		if err != nil {
+			return fmt.Errorf("HandleMarkdownDocument.Initialise: failed to read template file at %s - %v", hand.TemplateFilePath, err)
+		}
+		tmplContent = string(content)
+	}
+	var err error
+	if hand.tmpl, err = template.New("markdown").Parse(tmplContent); err != nil {
+		return fmt.Errorf("HandleMarkdownDocument.Initialise: failed to parse template - %v", err)
+	}
+	hand.documents = make(map[string]*markdownDocument)
+	hand.mutex = new(sync.Mutex)
+	return nil
+}
+
+// getDocument returns the document of the path (e.g. "notes/a.md") relative to the directory, rendered in HTML.
+func (hand *HandleMarkdownDocument) getDocument(relPath string, info fs.FileInfo) (*markdownDocument, error) {
+	hand.mutex.Lock()
+	doc, exists := hand.documents[relPath]
+	hand.mutex.Unlock()
+	if exists && doc.modTime.Equal(info.ModTime()) && doc.size == info.Size() {
+		return doc, nil
+	}
+	if info.Size() > MaxMarkdownDocumentSize {
+		return nil, fmt.Errorf("the document is larger than %d bytes", MaxMarkdownDocumentSize)
+	}
+	content, err := os.ReadFile(filepath.Join(hand.DirPath, filepath.FromSlash(relPath)))
+	if err != nil {
+		return nil, err
+	}
+	doc = &markdownDocument{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		title:   strings.TrimSuffix(path.Base(relPath), ".md"),
+		content: renderMarkdown(string(content)),
+	}
+	// The first heading outside of code blocks is the title of the document
+	inCode := false
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if isMarkdownFence(line) {
+			inCode = !inCode
+		} else if level := markdownHeadingLevel(line); level > 0 && !inCode {
+			if title := strings.TrimSpace(regexMarkdownClosingHashes.ReplaceAllString(strings.TrimSpace(line[level:]), "")); title != "" {
+				doc.title = title
+			}
+			break
+		}
+	}
+	hand.mutex.Lock()
+	hand.documents[relPath] = doc
+	hand.mutex.Unlock()
+	return doc, nil
+}
+
+// isHiddenMarkdownPath returns true if the path (relative to the directory) is a hidden file or underneath a hidden directory.
+func isHiddenMarkdownPath(relPath string) bool {
+	for _, name := range strings.Split(relPath, "/") {
+		if strings.HasPrefix(name, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// getIndex returns all markdown documents of the directory, with their URLs relative to the directory of the page.
+func (hand *HandleMarkdownDocument) getIndex(pageDir string) (ret []MarkdownIndexEntry) {
+	walkErr := filepath.WalkDir(hand.DirPath, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		relPath, err := filepath.Rel(hand.DirPath, filePath)
+		if err != nil || relPath == "." {
+			return nil
+		}
+		relPath = filepath.ToSlash(relPath)
+		if isHiddenMarkdownPath(relPath) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() || !entry.Type().IsRegular() || !strings.HasSuffix(relPath, ".md") || relPath == MarkdownIndexFileName {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		doc, err := hand.getDocument(relPath, info)
+		if err != nil {
+			hand.logger.Warning(relPath, err, "failed to render document")
+			return nil
+		}
+		ret = append(ret, MarkdownIndexEntry{Title: doc.title, URL: relativeMarkdownURL(pageDir, relPath)})
+		return nil
+	})
+	hand.logger.MaybeMinorError(walkErr)
+	return
+}
+
+// relativeMarkdownURL returns the URL of the path relative to the directory of the page being rendered, both are relative to the document directory.
+func relativeMarkdownURL(pageDir, relPath string) string {
+	up := ""
+	if pageDir != "" {
+		up = strings.Repeat("../", strings.Count(pageDir, "/")+1)
+	}
+	if relPath == "" {
+		if up == "" {
+			return "./"
+		}
+		return up
+	}
+	return up + relPath
+}
+
+// getPath returns the request path without the prefix added by API gateway (e.g. lambda stage name).
+func (hand *HandleMarkdownDocument) getPath(r *http.Request) string {
+	if hand.stripPrefix != "" && strings.HasPrefix(r.URL.Path, hand.stripPrefix+"/") {
+		return strings.TrimPrefix(r.URL.Path, hand.stripPrefix)
+	}
+	return r.URL.Path
+}
+
+func (hand *HandleMarkdownDocument) Handle(w http.ResponseWriter, r *http.Request) {
+	reqPath := hand.getPath(r)
+	if !strings.HasPrefix(reqPath, hand.Location) {
+		middleware.WriteError(w, r, http.StatusNotFound, "the document does not exist")
+		return
+	}
+	// The cleaned path never goes outside of the directory
+	relPath := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(reqPath, hand.Location)), "/")
+	page := MarkdownPage{SiteTitle: hand.Title}
+	if relPath == "" {
+		// The index page
+		page.Title = hand.Title
+		page.IndexURL = "./"
+		page.Index = hand.getIndex("")
+		if info, err := os.Stat(filepath.Join(hand.DirPath, MarkdownIndexFileName)); err == nil && info.Mode().IsRegular() {
+			if doc, err := hand.getDocument(MarkdownIndexFileName, info); err == nil {
+				page.Content = template.HTML(doc.content)
+			}
+		}
+	} else {
+		info, err := os.Stat(filepath.Join(hand.DirPath, filepath.FromSlash(relPath)))
+		if !strings.HasSuffix(relPath, ".md") || isHiddenMarkdownPath(relPath) || err != nil || !info.Mode().IsRegular() {
+			middleware.WriteError(w, r, http.StatusNotFound, "the document does not exist")
+			return
+		}
+		doc, err := hand.getDocument(relPath, info)
+		if err != nil {
+			hand.logger.Warning(middleware.GetRealClientIP(r), err, "failed to render document %s", relPath)
+			middleware.WriteError(w, r, http.StatusInternalServerError, "failed to render the document")
+			return
+		}
+		pageDir := path.Dir(relPath)
+		if pageDir == "." {
+			pageDir = ""
+		}
+		page.Title = doc.title + " - " + hand.Title
+		page.IndexURL = relativeMarkdownURL(pageDir, "")
+		page.Current = &MarkdownIndexEntry{Title: doc.title, URL: path.Base(relPath)}
+		page.Index = hand.getIndex(pageDir)
+		page.Content = template.HTML(doc.content)
+	}
+	var buf bytes.Buffer
+	if err := hand.tmpl.Execute(&buf, page); err != nil {
+		hand.logger.Warning(middleware.GetRealClientIP(r), err, "failed to execute template")
+		middleware.WriteError(w, r, http.StatusInternalServerError, "failed to render the document")
+		return
+	}
+	// Inject browser client IP and current time into the page
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	NoCache(w)
+	content := strings.Replace(buf.String(), HTMLCurrentDateTime, time.Now().Format(time.RFC3339), -1)
+	content = strings.Replace(content, HTMLClientAddress, middleware.GetRealClientIP(r), -1)
+	_, _ = w.Write([]byte(content))
+}
+
+func (*HandleMarkdownDocument) GetRateLimitFactor() int {
+	// A visitor often navigates through several pages in a short while
+	return 4
+}
+
+// SelfTest makes sure that the directory of markdown documents is readable.
+func (hand *HandleMarkdownDocument) SelfTest() error {
+	if _, err := os.ReadDir(hand.DirPath); err != nil {
+		return fmt.Errorf("HandleMarkdownDocument.SelfTest: failed to read directory \"%s\" - %w", hand.DirPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		markdown string
+		html     string
+	}{
+		{"", ""},
+		{"# Title ##\n\n## Sub title", "<h1 id=\"title\">Title</h1>\n<h2 id=\"sub-title\">Sub title</h2>\n"},
+		{"#hashtag", "<p>#hashtag</p>\n"},
+		{"a\nb  \nc\\\nd", "<p>a\nb<br>\nc<br>\nd</p>\n"},
+		{"**bold** *italic* ***both*** ~~del~~ snake_case_name _under_", "<p><strong>bold</strong> <em>italic</em> <em><strong>both</strong></em> <del>del</del> snake_case_name <em>under</em></p>\n"},
+		{"*a **b** c* 2 * 3 * 4", "<p><em>a <strong>b</strong> c</em> 2 * 3 * 4</p>\n"},
+		{"`<b>*x*</b>` `` a`b ``", "<p><code>&lt;b&gt;*x*&lt;/b&gt;</code> <code>a`b</code></p>\n"},
+		{"\\*not\\* <script>alert(1)</script>", "<p>*not* &lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"[a *b*](https://example.com/x_(y) \"t\") ![pic](p.png)", "<p><a href=\"https://example.com/x_(y)\" title=\"t\">a <em>b</em></a> <img src=\"p.png\" alt=\"pic\"></p>\n"},
+		{"[bad](javascript:alert(1)) [rel](other.md#sec)", "<p><a href=\"#\">bad</a> <a href=\"other.md#sec\">rel</a></p>\n"},
+		{"<https://example.com> <me@example.com> see https://example.com/a.", "<p><a href=\"https://example.com\">https://example.com</a> <a href=\"mailto:me@example.com\">me@example.com</a> see <a href=\"https://example.com/a\">https://example.com/a</a>.</p>\n"},
+		{"```go\nfmt.Println(\"<hi>\")\n\n# not a heading\n```\nafter", "<pre><code class=\"language-go\">fmt.Println(&#34;&lt;hi&gt;&#34;)\n\n# not a heading\n</code></pre>\n<p>after</p>\n"},
+		{"> quote\n> **more**\n>\n> - item", "<blockquote>\n<p>quote\n<strong>more</strong></p>\n<ul>\n<li>item\n</li>\n</ul>\n</blockquote>\n"},
+		{"- a\n- b\n  - c\n  - d\n- e\n\n---", "<ul>\n<li>a\n</li>\n<li>b\n<ul>\n<li>c\n</li>\n<li>d\n</li>\n</ul>\n</li>\n<li>e\n</li>\n</ul>\n<hr>\n"},
+		{"3. three\n4. four\n\n   more of four\n\npara", "<ol start=\"3\">\n<li>three\n</li>\n<li><p>four</p>\n<p>more of four</p>\n</li>\n</ol>\n<p>para</p>\n"},
+		{"* * *\npara\n- item", "<hr>\n<p>para</p>\n<ul>\n<li>item\n</li>\n</ul>\n"},
+		{"| a | b \\| c | d |\n|:--|:-:|--:|\n| 1 | **2** |\n\nafter", "<table>\n<thead>\n<tr><th style=\"text-align: left\">a</th><th style=\"text-align: center\">b | c</th><th style=\"text-align: right\">d</th></tr>\n</thead>\n<tbody>\n<tr><td style=\"text-align: left\">1</td><td style=\"text-align: center\"><strong>2</strong></td><td style=\"text-align: right\"></td></tr>\n</tbody>\n</table>\n<p>after</p>\n"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.html, renderMarkdown(test.markdown), test.markdown)
+	}
+}
+
+func TestHandleMarkdownDocument(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0700))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, ".git"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "index.md"), []byte("Welcome #LAITOS_CLIENTADDR"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.md"), []byte("```\n# comment\n```\n# First <note>\n\nsee [b](sub/b.md)"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "b.md"), []byte("no heading #LAITOS_3339TIME"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "c.txt"), []byte("not markdown"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".git", "d.md"), []byte("hidden"), 0600))
+
+	hand := &HandleMarkdownDocument{Location: "/notes"}
+	require.Error(t, hand.Initialise(lalog.DefaultLogger, nil, ""))
+	hand.DirPath = filepath.Join(dir, "does-not-exist")
+	require.Error(t, hand.Initialise(lalog.DefaultLogger, nil, ""))
+	hand.DirPath = dir
+	require.NoError(t, hand.Initialise(lalog.DefaultLogger, nil, "/stage"))
+	require.NoError(t, hand.SelfTest())
+	require.Equal(t, filepath.Base(dir), hand.Title)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		w := httptest.NewRecorder()
+		hand.Handle(w, req)
+		return w
+	}
+	// The index page lists the documents
+	resp := get("/stage/notes/")
+	require.Equal(t, http.StatusOK, resp.Code)
+	body := resp.Body.String()
+	require.Contains(t, body, "<p>Welcome 192.0.2.1</p>")
+	require.Contains(t, body, `<li><a href="a.md">First &lt;note&gt;</a></li>`)
+	require.Contains(t, body, `<li><a href="sub/b.md">b</a></li>`)
+	require.NotContains(t, body, "d.md")
+	require.NotContains(t, body, "index.md")
+	// Render a document
+	resp = get("/notes/a.md")
+	require.Equal(t, http.StatusOK, resp.Code)
+	body = resp.Body.String()
+	require.Contains(t, body, "<title>First &lt;note&gt; - "+hand.Title+"</title>")
+	require.Contains(t, body, `<h1 id="first-note">First &lt;note&gt;</h1>`)
+	require.Contains(t, body, `<a href="sub/b.md">b</a>`)
+	resp = get("/notes/sub/b.md")
+	require.Equal(t, http.StatusOK, resp.Code)
+	body = resp.Body.String()
+	require.Contains(t, body, `<a href="../">`)
+	require.Contains(t, body, `<li><a href="../a.md">First &lt;note&gt;</a></li>`)
+	require.Contains(t, body, "no heading "+time.Now().Format("2006"))
+	// The document is rendered again after it changes
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "b.md"), []byte("# changed"), 0600))
+	require.Contains(t, get("/notes/sub/b.md").Body.String(), `<h1 id="changed">changed</h1>`)
+	// Only the markdown documents in the directory are served
+	for _, path := range []string{"/notes/sub/c.txt", "/notes/.git/d.md", "/notes/missing.md", "/notes/../../etc/passwd", "/other/a.md"} {
+		require.Equal(t, http.StatusNotFound, get(path).Code, path)
+	}
+
+	// Lay out the pages using a custom template
+	tmplPath := filepath.Join(t.TempDir(), "template.html")
+	require.NoError(t, os.WriteFile(tmplPath, []byte("{{.Title}}|{{len .Index}}|{{.Content}}"), 0600))
+	hand = &HandleMarkdownDocument{DirPath: dir, Title: "Site", TemplateFilePath: tmplPath}
+	require.NoError(t, hand.Initialise(lalog.DefaultLogger, nil, ""))
+	require.Equal(t, "Site|2|<p>Welcome 192.0.2.1</p>\n", get("/").Body.String())
+	require.True(t, strings.HasPrefix(get("/a.md").Body.String(), "First &lt;note&gt; - Site|2|"))
+}
@@ -1,11 +1,19 @@
 package handler
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"html"
+	"io"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
@@ -16,6 +24,10 @@ const (
 	// A longer message will be truncated before it is stored in the outgoing
 	// direction.
 	AppBankMaxMessageLength = 1024
+	// MessageBankAPIMaxRequestSize is the maximum size of a JSON request body accepted by the message bank API.
+	MessageBankAPIMaxRequestSize = 16 * 1024
+	// MessageBankWebhookTimeoutSec is the timeout of pushing a new message to the webhook.
+	MessageBankWebhookTimeoutSec = 10
 )
 
 const HandleMessageBankPage = `<html>
@@ -24,29 +36,56 @@ const HandleMessageBankPage = `<html>
 	<title>laitos message bank</title>
 </head>
 <body>
-    <p>Message bank "default", incoming direction:</p>
-    <pre>%s</pre>
-    <hr/>
-    <p>Message bank "default", outgoing direction:</p>
-    <pre>%s</pre>
+    %s
     <form action="%s" method="post">
-        <p><input type="text" name="messageForDefault" /><input type="submit" value="Submit outgoing message"/></p>
+        <p>
+            Start a conversation with correspondent <input type="text" name="tag" />:
+            <input type="text" name="message" /><input type="submit" value="Submit outgoing message"/>
+        </p>
     </form>
-    <hr/>
-    <p>Message bank "LoRaWAN", incoming direction:</p>
-    <pre>%s</pre>
-    <hr/>
-    <p>Message bank "LoRaWAN", outgoing direction:</p>
-    <pre>%s</pre>
-    <form action="%s" method="post">
-        <p><input type="text" name="messageForLoRaWAN" /><input type="submit" value="Submit outgoing message"/></p>
-    </form>
-    <hr/>
 </body>
 </html>
 `
 
+// HandleMessageBankThread renders the conversation thread of a message bank tag.
+const HandleMessageBankThread = `
+    <p>Message bank "%[1]s", incoming direction (%[2]d unread):</p>
+    <pre>%[3]s</pre>
+    <p>Message bank "%[1]s", outgoing direction (%[4]d not yet retrieved by the correspondent):</p>
+    <pre>%[5]s</pre>
+    <form action="%[6]s" method="post">
+        <p><input type="hidden" name="tag" value="%[1]s" /><input type="text" name="message" /><input type="submit" value="Submit outgoing message"/></p>
+    </form>
+    <hr/>
+`
+
+// MessageBankAPIMessage is the JSON request body of storing a message via the message bank API.
+type MessageBankAPIMessage struct {
+	Tag       string `json:"Tag"`
+	Direction string `json:"Direction"`
+	Content   string `json:"Content"`
+}
+
+// MessageBankWebhookMessage is the JSON body pushed to the webhook for each new message.
+type MessageBankWebhookMessage struct {
+	Tag       string      `json:"Tag"`
+	Direction string      `json:"Direction"`
+	Time      time.Time   `json:"Time"`
+	Content   interface{} `json:"Content"`
+}
+
+/*
+HandleMessageBank lets the operator read incoming messages and leave outgoing messages for each correspondent. Viewing
+the page marks the incoming messages read.
+The same endpoint also serves a REST JSON API when the request carries the query parameter "format=json", and optionally
+pushes each new message in the watched directions to a webhook.
+*/
 type HandleMessageBank struct {
+	// WebhookURL receives an HTTP POST of each new message in the watched directions, e.g. to notify a phone.
+	WebhookURL string `json:"WebhookURL"`
+	// WebhookDirections are the message directions watched by the webhook, they default to the incoming direction only.
+	WebhookDirections []string `json:"WebhookDirections"`
+
 	cmdProc                    *toolbox.CommandProcessor
 	stripURLPrefixFromResponse string
 	logger                     *lalog.Logger
@@ -56,41 +95,188 @@ func (bank *HandleMessageBank) Initialise(logger *lalog.Logger, cmdProc *toolbox
 	bank.cmdProc = cmdProc
 	bank.stripURLPrefixFromResponse = stripURLPrefixFromResponse
 	bank.logger = logger
+	for _, direction := range bank.WebhookDirections {
+		if direction != toolbox.MessageDirectionIncoming && direction != toolbox.MessageDirectionOutgoing {
+			return fmt.Errorf("HandleMessageBank.Initialise: unrecognised webhook direction %q", direction)
+		}
+	}
+	if bank.WebhookURL != "" {
+		if len(bank.WebhookDirections) == 0 {
+			bank.WebhookDirections = []string{toolbox.MessageDirectionIncoming}
+		}
+		cmdProc.Features.MessageBank.SetStoreListener(bank.pushToWebhook)
+	}
 	return nil
 }
 
+// pushToWebhook sends the newly stored message to the webhook in the background if its direction is watched.
+func (bank *HandleMessageBank) pushToWebhook(tag, direction string, msg toolbox.Message) {
+	if !slices.Contains(bank.WebhookDirections, direction) {
+		return
+	}
+	body, err := json.Marshal(MessageBankWebhookMessage{Tag: tag, Direction: direction, Time: msg.Time, Content: msg.Content})
+	if err != nil {
+		bank.logger.Warning(tag, err, "failed to serialise message for webhook")
+		return
+	}
+	go func() {
+		resp, err := inet.DoHTTP(context.Background(), inet.HTTPRequest{
+			Method:      http.MethodPost,
+			ContentType: "application/json",
+			TimeoutSec:  MessageBankWebhookTimeoutSec,
+			Body:        bytes.NewReader(body),
+		}, strings.ReplaceAll(bank.WebhookURL, "%", "%%"))
+		if err == nil {
+			err = resp.Non2xxToError()
+		}
+		if err != nil {
+			bank.logger.Warning(tag, err, "failed to push %s message to webhook", direction)
+		}
+	}()
+}
+
+// messagesToHTML returns the HTML-escaped messages, one message on each line, unread messages are marked as new.
+func messagesToHTML(messages []toolbox.Message) string {
+	var out bytes.Buffer
+	for _, msg := range messages {
+		if !msg.Read {
+			out.WriteString("(new) ")
+		}
+		out.WriteString(html.EscapeString(toolbox.MessagesToString([]toolbox.Message{msg})))
+	}
+	return out.String()
+}
+
 func (bank *HandleMessageBank) Handle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 	NoCache(w)
 	handlerURL := strings.TrimPrefix(r.RequestURI, bank.stripURLPrefixFromResponse)
+	msgBank := &bank.cmdProc.Features.MessageBank
+	if r.FormValue("format") == "json" {
+		bank.handleAPI(w, r, msgBank)
+		return
+	}
 	if r.Method == http.MethodPost {
+		tag, message := r.FormValue("tag"), r.FormValue("message")
+		// The form fields of the built-in tags were used by the earlier revision of this page
 		if messageForDefault := r.FormValue("messageForDefault"); messageForDefault != "" {
-			if len(messageForDefault) > AppBankMaxMessageLength {
-				messageForDefault = messageForDefault[:AppBankMaxMessageLength]
-			}
-			if err := bank.cmdProc.Features.MessageBank.Store(toolbox.MessageBankTagDefault, toolbox.MessageDirectionOutgoing, time.Now(), messageForDefault); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
-				return
-			}
+			tag, message = toolbox.MessageBankTagDefault, messageForDefault
 		} else if messageForLoRaWAN := r.FormValue("messageForLoRaWAN"); messageForLoRaWAN != "" {
-			if len(messageForLoRaWAN) > LoraWANMaxDownlinkMessageLength {
-				messageForLoRaWAN = messageForLoRaWAN[:LoraWANMaxDownlinkMessageLength]
+			tag, message = toolbox.MessageBankTagLoRaWAN, messageForLoRaWAN
+		}
+		if message != "" {
+			maxLen := AppBankMaxMessageLength
+			if tag == toolbox.MessageBankTagLoRaWAN {
+				maxLen = LoraWANMaxDownlinkMessageLength
 			}
-			if err := bank.cmdProc.Features.MessageBank.Store(toolbox.MessageBankTagLoRaWAN, toolbox.MessageDirectionOutgoing, time.Now(), messageForLoRaWAN); err != nil {
-				http.Error(w, err.Error(), http.StatusBadRequest)
+			if len(message) > maxLen {
+				message = message[:maxLen]
+			}
+			if err := msgBank.Store(tag, toolbox.MessageDirectionOutgoing, time.Now(), message); err != nil {
+				middleware.WriteError(w, r, http.StatusBadRequest, err.Error())
 				return
 			}
 		}
 	}
-	// Render the page.
-	_, _ = w.Write([]byte(fmt.Sprintf(
-		HandleMessageBankPage,
-		toolbox.MessagesToString(bank.cmdProc.Features.MessageBank.Get(toolbox.MessageBankTagDefault, toolbox.MessageDirectionIncoming)),
-		toolbox.MessagesToString(bank.cmdProc.Features.MessageBank.Get(toolbox.MessageBankTagDefault, toolbox.MessageDirectionOutgoing)),
-		handlerURL,
-		toolbox.MessagesToString(bank.cmdProc.Features.MessageBank.Get(toolbox.MessageBankTagLoRaWAN, toolbox.MessageDirectionIncoming)),
-		toolbox.MessagesToString(bank.cmdProc.Features.MessageBank.Get(toolbox.MessageBankTagLoRaWAN, toolbox.MessageDirectionOutgoing)),
-		handlerURL)))
+	// The built-in threads are always shown, even if they are empty.
+	tags := []string{toolbox.MessageBankTagDefault, toolbox.MessageBankTagLoRaWAN}
+	for _, thread := range msgBank.Threads() {
+		if thread.Tag != toolbox.MessageBankTagDefault && thread.Tag != toolbox.MessageBankTagLoRaWAN {
+			tags = append(tags, thread.Tag)
+		}
+	}
+	var threads bytes.Buffer
+	for _, tag := range tags {
+		incoming := msgBank.Get(tag, toolbox.MessageDirectionIncoming)
+		outgoing := msgBank.Get(tag, toolbox.MessageDirectionOutgoing)
+		threads.WriteString(fmt.Sprintf(HandleMessageBankThread,
+			html.EscapeString(tag), countUnread(incoming), messagesToHTML(incoming),
+			countUnread(outgoing), messagesToHTML(outgoing), handlerURL))
+		// The operator has now read the incoming messages.
+		msgBank.MarkRead(tag, toolbox.MessageDirectionIncoming)
+	}
+	_, _ = w.Write([]byte(fmt.Sprintf(HandleMessageBankPage, threads.String(), handlerURL)))
+}
+
+/*
+handleAPI serves the REST JSON API of the message bank:
+  - GET lists the threads, or the messages of a thread given "tag" and "direction" ("unread=true" retrieves the unread
+    messages and marks them read).
+  - POST stores a message given in the JSON body (MessageBankAPIMessage).
+  - PUT marks the messages of a thread read given "tag" and "direction".
+  - DELETE removes the messages of a thread given "tag", and optionally "direction".
+*/
+func (bank *HandleMessageBank) handleAPI(w http.ResponseWriter, r *http.Request, msgBank *toolbox.MessageBank) {
+	tag, direction := r.FormValue("tag"), r.FormValue("direction")
+	if direction != "" && direction != toolbox.MessageDirectionIncoming && direction != toolbox.MessageDirectionOutgoing {
+		middleware.WriteError(w, r, http.StatusBadRequest, "direction must be either in or out")
+		return
+	}
+	var resp interface{}
+	status := http.StatusOK
+	switch r.Method {
+	case http.MethodGet:
+		if tag == "" {
+			resp = msgBank.Threads()
+		} else if direction == "" {
+			middleware.WriteError(w, r, http.StatusBadRequest, "direction must be either in or out")
+			return
+		} else if r.FormValue("unread") == "true" {
+			resp = msgBank.GetUnread(tag, direction)
+		} else {
+			resp = msgBank.Get(tag, direction)
+		}
+	case http.MethodPost:
+		var req MessageBankAPIMessage
+		if err := json.NewDecoder(io.LimitReader(r.Body, MessageBankAPIMaxRequestSize)).Decode(&req); err != nil {
+			middleware.WriteError(w, r, http.StatusBadRequest, "failed to decode the message - "+err.Error())
+			return
+		}
+		if req.Content == "" {
+			middleware.WriteError(w, r, http.StatusBadRequest, "message content must not be empty")
+			return
+		}
+		if len(req.Content) > AppBankMaxMessageLength {
+			req.Content = req.Content[:AppBankMaxMessageLength]
+		}
+		msg := toolbox.Message{Time: time.Now(), Content: req.Content}
+		if err := msgBank.Store(req.Tag, req.Direction, msg.Time, msg.Content); err != nil {
+			middleware.WriteError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		resp = msg
+		status = http.StatusCreated
+	case http.MethodPut:
+		if tag == "" || direction == "" {
+			middleware.WriteError(w, r, http.StatusBadRequest, "tag and direction must not be empty")
+			return
+		}
+		resp = map[string]int{"MarkedRead": msgBank.MarkRead(tag, direction)}
+	case http.MethodDelete:
+		if tag == "" {
+			middleware.WriteError(w, r, http.StatusBadRequest, "tag must not be empty")
+			return
+		}
+		resp = map[string]int{"Deleted": msgBank.Delete(tag, direction)}
+	default:
+		middleware.WriteError(w, r, http.StatusMethodNotAllowed, "the API accepts GET, POST, PUT, and DELETE")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		bank.logger.Warning(middleware.GetRealClientIP(r), err, "failed to serialise JSON response")
+	}
+}
+
+// countUnread returns the number of unread messages.
+func countUnread(messages []toolbox.Message) (count int) {
+	for _, msg := range messages {
+		if !msg.Read {
+			count++
+		}
+	}
+	return
 }
 
 func (*HandleMessageBank) GetRateLimitFactor() int {
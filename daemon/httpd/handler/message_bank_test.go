@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleMessageBank(t *testing.T) {
+	cmdProc := toolbox.GetTestCommandProcessor()
+	hand := &HandleMessageBank{}
+	require.NoError(t, hand.Initialise(&lalog.Logger{}, cmdProc, ""))
+	msgBank := &cmdProc.Features.MessageBank
+	require.NoError(t, msgBank.Store("mum", toolbox.MessageDirectionIncoming, time.Now(), "<b>hello</b>"))
+
+	getPage := func(form url.Values) string {
+		req := httptest.NewRequest(http.MethodPost, "/bank", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		hand.Handle(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		body, err := io.ReadAll(w.Result().Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+	// The correspondent's thread is shown alongside the built-in threads, and viewing it marks the message read.
+	page := getPage(url.Values{})
+	require.Contains(t, page, `Message bank "default"`)
+	require.Contains(t, page, `Message bank "LoRaWAN"`)
+	require.Contains(t, page, `Message bank "mum", incoming direction (1 unread)`)
+	require.Contains(t, page, "(new) ")
+	require.Contains(t, page, "&lt;b&gt;hello&lt;/b&gt;")
+	require.Equal(t, []toolbox.MessageThread{{Tag: "mum", Latest: msgBank.Get("mum", toolbox.MessageDirectionIncoming)[0].Time}}, msgBank.Threads())
+	// Leave a message for a correspondent
+	page = getPage(url.Values{"tag": {"dad"}, "message": {"dinner is ready"}})
+	require.Contains(t, page, `Message bank "dad", outgoing direction (1 not yet retrieved by the correspondent)`)
+	require.Contains(t, page, "dinner is ready")
+	// The form field of the earlier revision of the page still works
+	getPage(url.Values{"messageForDefault": {"hi"}})
+	require.Len(t, msgBank.Get(toolbox.MessageBankTagDefault, toolbox.MessageDirectionOutgoing), 1)
+}
+
+func TestHandleMessageBank_API(t *testing.T) {
+	pushed := make(chan MessageBankWebhookMessage, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg MessageBankWebhookMessage
+		if err := json.NewDecoder(r.Body).Decode(&msg); err == nil && r.Header.Get("Content-Type") == "application/json" {
+			pushed <- msg
+		}
+	}))
+	defer webhook.Close()
+
+	cmdProc := toolbox.GetTestCommandProcessor()
+	hand := &HandleMessageBank{WebhookURL: webhook.URL, WebhookDirections: []string{"bad"}}
+	require.Error(t, hand.Initialise(&lalog.Logger{}, cmdProc, ""))
+	hand = &HandleMessageBank{WebhookURL: webhook.URL}
+	require.NoError(t, hand.Initialise(&lalog.Logger{}, cmdProc, ""))
+	require.Equal(t, []string{toolbox.MessageDirectionIncoming}, hand.WebhookDirections)
+	msgBank := &cmdProc.Features.MessageBank
+	defer msgBank.SetStoreListener(nil)
+
+	call := func(method, query, body string, expectedStatus int, resp interface{}) {
+		req := httptest.NewRequest(method, "/bank?format=json&"+query, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		hand.Handle(w, req)
+		require.Equal(t, expectedStatus, w.Result().StatusCode, method+" "+query)
+		if resp != nil {
+			require.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+			require.NoError(t, json.NewDecoder(w.Result().Body).Decode(resp))
+		}
+	}
+	// Store an incoming message, which is pushed to the webhook
+	var stored toolbox.Message
+	call(http.MethodPost, "", `{"Tag": "mum", "Direction": "in", "Content": "arrived at the hotel"}`, http.StatusCreated, &stored)
+	require.Equal(t, "arrived at the hotel", stored.Content)
+	select {
+	case msg := <-pushed:
+		require.Equal(t, "mum", msg.Tag)
+		require.Equal(t, toolbox.MessageDirectionIncoming, msg.Direction)
+		require.Equal(t, "arrived at the hotel", msg.Content)
+		require.True(t, stored.Time.Equal(msg.Time))
+	case <-time.After(10 * time.Second):
+		t.Fatal("the webhook did not receive the message")
+	}
+	// The outgoing direction is not watched
+	call(http.MethodPost, "", `{"Tag": "mum", "Direction": "out", "Content": "enjoy"}`, http.StatusCreated, nil)
+	call(http.MethodPost, "", `{"Tag": "mum", "Direction": "bad", "Content": "enjoy"}`, http.StatusBadRequest, nil)
+	call(http.MethodPost, "", `{"Tag": "mum", "Direction": "in"}`, http.StatusBadRequest, nil)
+	call(http.MethodPost, "", `not json`, http.StatusBadRequest, nil)
+
+	// Read the threads and messages
+	var threads []toolbox.MessageThread
+	call(http.MethodGet, "", "", http.StatusOK, &threads)
+	require.Len(t, threads, 1)
+	require.Equal(t, "mum", threads[0].Tag)
+	require.Equal(t, 1, threads[0].UnreadIncoming)
+	require.Equal(t, 1, threads[0].UnreadOutgoing)
+	var messages []toolbox.Message
+	call(http.MethodGet, "tag=mum&direction=out", "", http.StatusOK, &messages)
+	require.Len(t, messages, 1)
+	require.Equal(t, "enjoy", messages[0].Content)
+	require.False(t, messages[0].Read)
+	call(http.MethodGet, "tag=mum&direction=in&unread=true", "", http.StatusOK, &messages)
+	require.Len(t, messages, 1)
+	call(http.MethodGet, "tag=mum&direction=in&unread=true", "", http.StatusOK, &messages)
+	require.Empty(t, messages)
+	call(http.MethodGet, "tag=mum", "", http.StatusBadRequest, nil)
+	call(http.MethodGet, "tag=mum&direction=bad", "", http.StatusBadRequest, nil)
+
+	// Mark read and delete
+	var count map[string]int
+	call(http.MethodPut, "tag=mum&direction=out", "", http.StatusOK, &count)
+	require.Equal(t, map[string]int{"MarkedRead": 1}, count)
+	call(http.MethodPut, "tag=mum", "", http.StatusBadRequest, nil)
+	count = nil
+	call(http.MethodDelete, "tag=mum&direction=in", "", http.StatusOK, &count)
+	require.Equal(t, map[string]int{"Deleted": 1}, count)
+	count = nil
+	call(http.MethodDelete, "tag=mum", "", http.StatusOK, &count)
+	require.Equal(t, map[string]int{"Deleted": 1}, count)
+	call(http.MethodDelete, "", "", http.StatusBadRequest, nil)
+	call(http.MethodPatch, "", "", http.StatusMethodNotAllowed, nil)
+	require.Empty(t, msgBank.Threads())
+	require.Empty(t, pushed)
+}
@@ -1,17 +1,24 @@
 package handler
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/toolbox"
+	"golang.org/x/net/websocket"
 )
 
+// ReportsExportMaxRecords is the maximum number of reports exported at a time, unless the request asks for fewer.
+const ReportsExportMaxRecords = 100000
+
 /*
 HandleReportsRetrieval works as a frontend to the store&forward message processor, allowing visitors to view historical reports and
 assign an app command for a subject to retireve in its next report.
@@ -61,32 +68,142 @@ func (hand *HandleReportsRetrieval) Handle(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Browse subjects and retrieve their reports
-	w.Header().Set("Content-Type", "application/json")
-	jsonWriter := json.NewEncoder(w)
-	jsonWriter.SetIndent("", "  ")
-	limitStr := r.FormValue("n")
-	limitNum, _ := strconv.Atoi(limitStr)
-	if limitNum < 1 {
+	format := strings.ToLower(r.FormValue("format"))
+	if format != "" && format != "json" && format != "csv" && format != "ndjson" {
+		middleware.WriteError(w, r, http.StatusBadRequest, "format must be one of json, csv, ndjson")
+		return
+	}
+	limitNum, _ := strconv.Atoi(r.FormValue("n"))
+	since, err := parseReportsTime(r.FormValue("since"))
+	if err != nil {
+		middleware.WriteError(w, r, http.StatusBadRequest, "since: "+err.Error())
+		return
+	}
+	until, err := parseReportsTime(r.FormValue("until"))
+	if err != nil {
+		middleware.WriteError(w, r, http.StatusBadRequest, "until: "+err.Error())
+		return
+	}
+	if limitNum < 1 && (!since.IsZero() || !until.IsZero() || format == "csv" || format == "ndjson") {
+		// An export of the reports is not limited to the latest handful
+		limitNum = ReportsExportMaxRecords
+	}
+	var reports []toolbox.SubjectReport
+	if !since.IsZero() || !until.IsZero() {
+		// Get the historical reports received in a period of time (/endpoint?n=100&since=1700000000&until=1700086400)
+		if reports, err = hand.cmdProc.Features.MessageProcessor.GetHistoricalReports(host, since, until, limitNum); err != nil {
+			middleware.WriteError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+	} else if limitNum < 1 {
 		// Take a look at all subjects and count how many of their reports are currently stored in memory
-		hand.cmdProc.Features.MessageProcessor.GetSubjectReportCount()
+		w.Header().Set("Content-Type", "application/json")
+		jsonWriter := json.NewEncoder(w)
+		jsonWriter.SetIndent("", "  ")
 		w.WriteHeader(http.StatusOK)
 		if err := jsonWriter.Encode(hand.cmdProc.Features.MessageProcessor.GetSubjectReportCount()); err != nil {
 			lalog.DefaultLogger.Warning(r.Host, err, "failed to serialise JSON response")
 		}
+		return
+	} else if host == "" {
+		// Get the latest reports across all hosts
+		reports = hand.cmdProc.Features.MessageProcessor.GetLatestReports(limitNum)
 	} else {
-		if host == "" {
-			// Get the latest reports across all hosts
-			w.WriteHeader(http.StatusOK)
-			if err := jsonWriter.Encode(hand.cmdProc.Features.MessageProcessor.GetLatestReports(limitNum)); err != nil {
-				lalog.DefaultLogger.Warning(r.Host, err, "failed to serialise JSON response")
+		// Get the latest reports from a particular host
+		reports = hand.cmdProc.Features.MessageProcessor.GetLatestReportsFromSubject(host, limitNum)
+	}
+	if err := writeReports(w, format, reports); err != nil {
+		lalog.DefaultLogger.Warning(r.Host, err, "failed to write reports in %s format", format)
+	}
+}
+
+// parseReportsTime parses the time in Unix timestamp (seconds), RFC3339, or a date (e.g. 2024-01-31) of UTC.
+func parseReportsTime(str string) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+	if unixSec, err := strconv.ParseInt(str, 10, 64); err == nil {
+		if unixSec <= 0 {
+			return time.Time{}, nil
+		}
+		return time.Unix(unixSec, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", str); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("\"%s\" must be a Unix timestamp, an RFC3339 time, or a date in the format of 2006-01-02", str)
+}
+
+// ReportsCSVHeader are the column names of the reports exported in CSV.
+var ReportsCSVHeader = []string{
+	"ServerTime", "DaemonName", "SubjectClientTag", "SubjectHostName", "SubjectIP", "SubjectPlatform", "SubjectComment",
+	"CommandRequest", "CommandResponseCommand", "CommandResponseReceivedAt", "CommandResponseResult", "CommandResponseRunDurationSec",
+}
+
+/*
+csvSafeText returns the text for a CSV cell. The text received from the subjects is not trusted, the text that would
+otherwise be interpreted as a formula by spreadsheet software is prefixed with a single quote.
+*/
+func csvSafeText(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+// writeReports writes the reports in JSON (default), CSV, or newline-delimited JSON.
+func writeReports(w http.ResponseWriter, format string, reports []toolbox.SubjectReport) error {
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"reports.csv\"")
+		w.WriteHeader(http.StatusOK)
+		csvWriter := csv.NewWriter(w)
+		if err := csvWriter.Write(ReportsCSVHeader); err != nil {
+			return err
+		}
+		for _, report := range reports {
+			req := report.OriginalRequest
+			comment, isStr := req.SubjectComment.(string)
+			if !isStr && req.SubjectComment != nil {
+				commentJSON, _ := json.Marshal(req.SubjectComment)
+				comment = string(commentJSON)
 			}
-		} else {
-			// Get the latest reports from a particular host
-			w.WriteHeader(http.StatusOK)
-			if err := jsonWriter.Encode(hand.cmdProc.Features.MessageProcessor.GetLatestReportsFromSubject(host, limitNum)); err != nil {
-				lalog.DefaultLogger.Warning(r.Host, err, "failed to serialise JSON response")
+			var receivedAt string
+			if !req.CommandResponse.ReceivedAt.IsZero() {
+				receivedAt = req.CommandResponse.ReceivedAt.Format(time.RFC3339)
+			}
+			if err := csvWriter.Write([]string{
+				report.ServerTime.Format(time.RFC3339), report.DaemonName, csvSafeText(report.SubjectClientTag),
+				csvSafeText(req.SubjectHostName), csvSafeText(req.SubjectIP), csvSafeText(req.SubjectPlatform), csvSafeText(comment),
+				csvSafeText(req.CommandRequest.Command), csvSafeText(req.CommandResponse.Command), receivedAt,
+				csvSafeText(req.CommandResponse.Result), strconv.Itoa(req.CommandResponse.RunDurationSec),
+			}); err != nil {
+				return err
+			}
+		}
+		csvWriter.Flush()
+		return csvWriter.Error()
+	case "ndjson":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		// Each line is a report
+		jsonWriter := json.NewEncoder(w)
+		for _, report := range reports {
+			if err := jsonWriter.Encode(report); err != nil {
+				return err
 			}
 		}
+		return nil
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		jsonWriter := json.NewEncoder(w)
+		jsonWriter.SetIndent("", "  ")
+		return jsonWriter.Encode(reports)
 	}
 }
 
@@ -98,23 +215,57 @@ func (_ *HandleReportsRetrieval) SelfTest() error {
 	return nil
 }
 
-// HandleAppCommand executes app command from the incoming request.
+/*
+HandleAppCommand executes app command from the incoming request. A WebSocket client may keep a persistent session to run
+many commands, and receive the output of streaming features (e.g. shell) as it is produced.
+*/
 type HandleAppCommand struct {
+	/*
+		AuthorizerPrincipalTriggers maps the caller principals verified by AWS API gateway authorizer (e.g. a lambda
+		authorizer's principal ID, a cognito user name, or an IAM user ARN) to the feature triggers (e.g. ".s") they may
+		use without a password PIN. The principal is only trusted when it is relayed by the lambda handler.
+	*/
+	AuthorizerPrincipalTriggers map[string][]string `json:"AuthorizerPrincipalTriggers"`
+
 	cmdProc *toolbox.CommandProcessor
+	logger  *lalog.Logger
 }
 
-func (hand *HandleAppCommand) Initialise(_ *lalog.Logger, cmdProc *toolbox.CommandProcessor, _ string) error {
+func (hand *HandleAppCommand) Initialise(logger *lalog.Logger, cmdProc *toolbox.CommandProcessor, _ string) error {
 	if cmdProc == nil {
 		return errors.New("HandleAppCommand.Initialise: command processor must not be nil")
 	}
 	if errs := cmdProc.IsSaneForInternet(); len(errs) > 0 {
 		return fmt.Errorf("HandleAppCommand.Initialise: %+v", errs)
 	}
+	for principal, triggers := range hand.AuthorizerPrincipalTriggers {
+		if len(triggers) == 0 {
+			return fmt.Errorf("HandleAppCommand.Initialise: principal \"%s\" must be given at least one feature trigger", principal)
+		}
+	}
 	hand.cmdProc = cmdProc
+	hand.logger = logger
 	return nil
 }
 
+// getAuthorisedTriggers returns the feature triggers that the caller principal verified by API gateway authorizer may use without a PIN.
+func (hand *HandleAppCommand) getAuthorisedTriggers(r *http.Request) (triggers []toolbox.Trigger) {
+	if principal := RedeemAuthorizerPrincipalToken(r.Header.Get(AuthorizerPrincipalHeader)); principal != "" {
+		for _, trigger := range hand.AuthorizerPrincipalTriggers[principal] {
+			triggers = append(triggers, toolbox.Trigger(trigger))
+		}
+		hand.logger.Info(middleware.GetRealClientIP(r), nil, "authorizer principal \"%s\" is authorised to use features %v", principal, triggers)
+	}
+	return
+}
+
 func (hand *HandleAppCommand) Handle(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		// The app commands are authorised by password PIN, hence the session may be opened from any origin.
+		server := websocket.Server{Handler: hand.handleWebSocket}
+		server.ServeHTTP(w, r)
+		return
+	}
 	NoCache(w)
 	AllowAllOrigins(w)
 	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
@@ -124,12 +275,15 @@ func (hand *HandleAppCommand) Handle(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	result := hand.cmdProc.Process(r.Context(), toolbox.Command{
+	command := toolbox.Command{
 		DaemonName: "httpd",
 		ClientTag:  middleware.GetRealClientIP(r),
 		Content:    cmd,
 		TimeoutSec: HTTPClienAppCommandTimeout,
-	}, true)
+		// The caller principal verified by API gateway authorizer may use the authorised features without a PIN
+		AuthorisedTriggers: hand.getAuthorisedTriggers(r),
+	}
+	result := hand.cmdProc.Process(r.Context(), command, true)
 	_, _ = w.Write([]byte(result.CombinedOutput))
 }
 
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleReportsRetrieval_Export(t *testing.T) {
+	cmdProc := toolbox.GetTestCommandProcessor()
+	hand := &HandleReportsRetrieval{}
+	require.NoError(t, hand.Initialise(lalog.DefaultLogger, cmdProc, ""))
+	proc := cmdProc.Features.MessageProcessor
+	proc.StoreReport(context.Background(), toolbox.SubjectReportRequest{SubjectHostName: "host1", SubjectComment: map[string]interface{}{"a": 1}}, "192.0.2.1", "httpd")
+	proc.StoreReport(context.Background(), toolbox.SubjectReportRequest{SubjectHostName: "host2", SubjectComment: "=cmd|' /C calc'!A0"}, "192.0.2.2", "dnsd")
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		hand.Handle(w, httptest.NewRequest(http.MethodGet, "/reports?"+query, nil))
+		return w
+	}
+	// Export in CSV
+	resp := get("format=csv&since=2000-01-01")
+	require.Equal(t, http.StatusOK, resp.Code)
+	require.Equal(t, "text/csv; charset=UTF-8", resp.Header().Get("Content-Type"))
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, ReportsCSVHeader, records[0])
+	require.Equal(t, []string{"dnsd", "192.0.2.2", "host2", "'=cmd|' /C calc'!A0"}, []string{records[1][1], records[1][2], records[1][3], records[1][6]})
+	require.Equal(t, []string{"httpd", "192.0.2.1", "host1", `{"a":1}`}, []string{records[2][1], records[2][2], records[2][3], records[2][6]})
+	serverTime, err := time.Parse(time.RFC3339, records[1][0])
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), serverTime, time.Minute)
+
+	// Export in newline-delimited JSON
+	resp = get("format=ndjson&host=host1")
+	require.Equal(t, http.StatusOK, resp.Code)
+	lines := strings.Split(strings.TrimSpace(resp.Body.String()), "\n")
+	require.Len(t, lines, 1)
+	var report toolbox.SubjectReport
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &report))
+	require.Equal(t, "host1", report.OriginalRequest.SubjectHostName)
+
+	// Filter by a period of time in various formats
+	var reports []toolbox.SubjectReport
+	resp = get("since=" + time.Now().Add(-time.Hour).Format(time.RFC3339) + "&until=" + time.Now().Add(time.Hour).Format(time.RFC3339))
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &reports))
+	require.Len(t, reports, 2)
+	resp = get("n=1&since=2000-01-01&until=2000-02-01")
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &reports))
+	require.Len(t, reports, 0)
+	resp = get("n=1&until=" + time.Now().UTC().Add(24*time.Hour).Format("2006-01-02"))
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &reports))
+	require.Len(t, reports, 1)
+
+	// Bad parameters
+	require.Equal(t, http.StatusBadRequest, get("format=xml").Code)
+	require.Equal(t, http.StatusBadRequest, get("since=yesterday").Code)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/reports?format=xml", nil)
+	req.Header.Set("Accept", "application/json")
+	hand.Handle(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Equal(t, middleware.ProblemContentType, w.Header().Get("Content-Type"))
+	// Count the reports by subject without parameters
+	var count map[string]int
+	require.NoError(t, json.Unmarshal(get("").Body.Bytes(), &count))
+	require.Equal(t, map[string]int{"host1": 1, "host2": 1}, count)
+}
@@ -11,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
@@ -34,6 +35,11 @@ const (
 		is allowed to invoke bot command routine. This rate limit is designed to prevent spam chats.
 	*/
 	MicrosoftBotUserRateLimitIntervalSec = 5
+
+	// MicrosoftBotDefaultCardCollapseLength is the default length of command output shown in an adaptive card before the rest is collapsed.
+	MicrosoftBotDefaultCardCollapseLength = 500
+	// MicrosoftBotAdaptiveCardContentType is the attachment content type of an adaptive card.
+	MicrosoftBotAdaptiveCardContentType = "application/vnd.microsoft.card.adaptive"
 )
 
 // MicrosoftBotJwt is a JWT returned by Microsoft bot framework.
@@ -50,9 +56,17 @@ type HandleMicrosoftBot struct {
 	ClientAppID     string `json:"ClientAppID"`     // ClientAppID is the bot's "app ID".
 	ClientAppSecret string `json:"ClientAppSecret"` // ClientAppSecret is the bot's application "password".
 
-	latestJwtMutex        *sync.Mutex      // latestJwtMutex protects latestJWT from concurrent access.
-	latestJWT             MicrosoftBotJwt  // latestJWT is the last retrieved JWT
-	conversationRateLimit *lalog.RateLimit // conversationRateLimit prevents excessively chatty conversations from taking place
+	// UseAdaptiveCards replies with an adaptive card instead of plain text, Microsoft Teams renders the card nicely.
+	UseAdaptiveCards bool `json:"UseAdaptiveCards"`
+	// CardButtons are the commands (preferably shortcuts defined in PINAndShortcuts) offered as buttons in the adaptive card.
+	CardButtons []string `json:"CardButtons"`
+	// CardCollapseLength is the length of command output shown in the adaptive card before the rest is collapsed.
+	CardCollapseLength int `json:"CardCollapseLength"`
+
+	keySet                *MicrosoftBotKeySet // keySet verifies the tokens carried by incoming requests from Bot Framework.
+	latestJwtMutex        *sync.Mutex         // latestJwtMutex protects latestJWT from concurrent access.
+	latestJWT             MicrosoftBotJwt     // latestJWT is the last retrieved JWT
+	conversationRateLimit *lalog.RateLimit    // conversationRateLimit prevents excessively chatty conversations from taking place
 
 	logger  *lalog.Logger
 	cmdProc *toolbox.CommandProcessor
@@ -62,6 +76,10 @@ func (hand *HandleMicrosoftBot) Initialise(logger *lalog.Logger, cmdProc *toolbo
 	hand.logger = logger
 	hand.cmdProc = cmdProc
 	hand.latestJwtMutex = new(sync.Mutex)
+	hand.keySet = &MicrosoftBotKeySet{}
+	if hand.CardCollapseLength < 1 {
+		hand.CardCollapseLength = MicrosoftBotDefaultCardCollapseLength
+	}
 	// Allow maximum of 1 message to be received every 5 seconds, per conversation ID.
 	hand.conversationRateLimit = lalog.NewRateLimit(MicrosoftBotUserRateLimitIntervalSec, 1, logger)
 	return nil
@@ -120,6 +138,7 @@ type MicrosoftBotIncomingChat struct {
 	Locale       json.RawMessage                  `json:"locale"`       // Locale will go into reply's "locale" property.
 	Recipient    json.RawMessage                  `json:"recipient"`    // Recipient will go into reply's "from" property.
 	ID           json.RawMessage                  `json:"id"`           // ID will go into reply's "id" property.
+	ChannelID    string                           `json:"channelId"`    // ChannelID identifies the chat app, e.g. "msteams".
 	Text         string                           `json:"text"`         // Text is the content of incoming chat message.
 	ServiceURL   string                           `json:"serviceUrl"`   // ServiceURL is the prefix name of endpoint to send chat reply to.
 	Timestamp    string                           `json:"timestamp"`    // Timestamp is the timestamp of incoming chat message.
@@ -134,6 +153,55 @@ type MicrosoftBotReply struct {
 	ReplyToId    json.RawMessage                  `json:"replyToId"`    // ReplyToId  value comes from MicrosoftBotIncomingChat's "ID".
 	Type         string                           `json:"type"`         // Type must be "message".
 	Text         string                           `json:"text"`         // Text is the bot's response text.
+	Attachments  []MicrosoftBotAttachment         `json:"attachments,omitempty"`
+}
+
+// MicrosoftBotAttachment is a rich content attachment of a reply, such as an adaptive card.
+type MicrosoftBotAttachment struct {
+	ContentType string      `json:"contentType"`
+	Content     interface{} `json:"content"`
+}
+
+/*
+BuildMicrosoftBotAdaptiveCard returns an adaptive card that shows the command output. Output longer than the collapse
+length is cut short and the rest is revealed by a toggle button. Each of the button commands becomes a button that
+sends the command back to the bot.
+*/
+func BuildMicrosoftBotAdaptiveCard(output string, collapseLength int, buttons []string) map[string]interface{} {
+	body := make([]interface{}, 0, 2)
+	actions := make([]interface{}, 0, len(buttons)+1)
+	runes := []rune(output)
+	if collapseLength > 0 && len(runes) > collapseLength {
+		body = append(body,
+			map[string]interface{}{"type": "TextBlock", "text": string(runes[:collapseLength]), "wrap": true},
+			map[string]interface{}{"type": "TextBlock", "id": "remainder", "text": string(runes[collapseLength:]), "wrap": true, "isVisible": false},
+		)
+		actions = append(actions, map[string]interface{}{
+			"type":           "Action.ToggleVisibility",
+			"title":          fmt.Sprintf("Show/hide %d more characters", len(runes)-collapseLength),
+			"targetElements": []string{"remainder"},
+		})
+	} else {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": output, "wrap": true})
+	}
+	for _, button := range buttons {
+		// Teams sends the text of a "messageBack" action to the bot as if the user typed it.
+		actions = append(actions, map[string]interface{}{
+			"type":  "Action.Submit",
+			"title": button,
+			"data":  map[string]interface{}{"msteams": map[string]interface{}{"type": "messageBack", "text": button, "displayText": button}},
+		})
+	}
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.2",
+		"body":    body,
+	}
+	if len(actions) > 0 {
+		card["actions"] = actions
+	}
+	return card
 }
 
 func (hand *HandleMicrosoftBot) Handle(w http.ResponseWriter, r *http.Request) {
@@ -142,14 +210,21 @@ func (hand *HandleMicrosoftBot) Handle(w http.ResponseWriter, r *http.Request) {
 	body, err := misc.ReadAllUpTo(r.Body, 4*1048576)
 	if err != nil {
 		hand.logger.Warning("", err, "failed to read incoming chat HTTP request")
-		http.Error(w, "failed to read request body", http.StatusBadRequest)
+		middleware.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
 		return
 	}
 	// Deserialise chat message from incoming request
 	var incoming MicrosoftBotIncomingChat
 	if err := json.Unmarshal(body, &incoming); err != nil {
 		hand.logger.Warning("", err, "failed to interpret incoming chat request as JSON")
-		http.Error(w, "failed to read request body in JSON", http.StatusBadRequest)
+		middleware.WriteError(w, r, http.StatusBadRequest, "failed to read request body in JSON")
+		return
+	}
+	// Bot Framework signs each request with a token, the token also vouches for the service URL that receives the reply.
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, err := VerifyMicrosoftBotToken(r.Context(), hand.keySet, token, hand.ClientAppID, incoming.ChannelID, incoming.ServiceURL); err != nil {
+		hand.logger.Warning(incoming.ServiceURL, err, "rejected incoming chat request")
+		middleware.WriteError(w, r, http.StatusUnauthorized, "unauthorized")
 		return
 	}
 	// In the background, process the chat message and formulate a response.
@@ -203,7 +278,14 @@ func (hand *HandleMicrosoftBot) Handle(w http.ResponseWriter, r *http.Request) {
 		reply.Recipient = incoming.From
 		reply.ReplyToId = incoming.ID
 		reply.Type = "message"
-		reply.Text = result.CombinedOutput
+		if hand.UseAdaptiveCards {
+			reply.Attachments = []MicrosoftBotAttachment{{
+				ContentType: MicrosoftBotAdaptiveCardContentType,
+				Content:     BuildMicrosoftBotAdaptiveCard(result.CombinedOutput, hand.CardCollapseLength, hand.CardButtons),
+			}}
+		} else {
+			reply.Text = result.CombinedOutput
+		}
 		replyBody, err := json.Marshal(reply)
 		if err != nil {
 			hand.logger.Warning(convID, err, "failed to serialise chat reply")
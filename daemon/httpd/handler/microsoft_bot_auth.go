@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+const (
+	// MicrosoftBotOpenIDMetadataURL is the OpenID metadata document that points to the keys signing the Bot Framework tokens.
+	MicrosoftBotOpenIDMetadataURL = "https://login.botframework.com/v1/.well-known/openidconfiguration"
+	// MicrosoftBotTokenIssuer is the issuer of tokens carried by requests sent from Bot Framework to the bot.
+	MicrosoftBotTokenIssuer = "https://api.botframework.com"
+	// MicrosoftBotKeyRefreshIntervalSec is the interval of retrieving the latest signing keys.
+	MicrosoftBotKeyRefreshIntervalSec = 24 * 3600
+	// MicrosoftBotKeyMinRefreshIntervalSec prevents tokens signed by unknown keys from triggering key retrieval too often.
+	MicrosoftBotKeyMinRefreshIntervalSec = 5 * 60
+	// MicrosoftBotTokenClockSkewSec is the clock skew tolerated when checking the validity period of a token.
+	MicrosoftBotTokenClockSkewSec = 5 * 60
+)
+
+// MicrosoftBotSigningKey is a public key that signs Bot Framework tokens.
+type MicrosoftBotSigningKey struct {
+	PublicKey    *rsa.PublicKey
+	Endorsements []string // Endorsements are the channel IDs (e.g. "msteams") that the key is allowed to sign tokens for.
+}
+
+// microsoftBotJWK is a JSON web key as found in the Bot Framework key set document.
+type microsoftBotJWK struct {
+	KeyType      string   `json:"kty"`
+	KeyID        string   `json:"kid"`
+	Modulus      string   `json:"n"`
+	Exponent     string   `json:"e"`
+	Endorsements []string `json:"endorsements"`
+}
+
+// MicrosoftBotKeySet retrieves and caches the keys that sign Bot Framework tokens.
+type MicrosoftBotKeySet struct {
+	// MetadataURL is the URL of OpenID metadata document, it defaults to MicrosoftBotOpenIDMetadataURL.
+	MetadataURL string
+
+	keys        map[string]MicrosoftBotSigningKey
+	retrievedAt time.Time
+	mutex       sync.Mutex
+}
+
+// refresh retrieves the latest signing keys. Caller must hold the mutex.
+func (set *MicrosoftBotKeySet) refresh(ctx context.Context) error {
+	metadataURL := set.MetadataURL
+	if metadataURL == "" {
+		metadataURL = MicrosoftBotOpenIDMetadataURL
+	}
+	resp, err := inet.DoHTTP(ctx, inet.HTTPRequest{TimeoutSec: MicrosoftBotAPITimeoutSec}, strings.ReplaceAll(metadataURL, "%", "%%"))
+	if err != nil {
+		return fmt.Errorf("MicrosoftBotKeySet.refresh: failed to retrieve OpenID metadata - %w", err)
+	} else if err := resp.Non2xxToError(); err != nil {
+		return fmt.Errorf("MicrosoftBotKeySet.refresh: failed to retrieve OpenID metadata - %w", err)
+	}
+	var metadata struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := resp.DecodeJSON(&metadata); err != nil || metadata.JWKSURI == "" {
+		return fmt.Errorf("MicrosoftBotKeySet.refresh: OpenID metadata does not have a key set URI - %v", err)
+	}
+	resp, err = inet.DoHTTP(ctx, inet.HTTPRequest{TimeoutSec: MicrosoftBotAPITimeoutSec}, strings.ReplaceAll(metadata.JWKSURI, "%", "%%"))
+	if err != nil {
+		return fmt.Errorf("MicrosoftBotKeySet.refresh: failed to retrieve key set - %w", err)
+	} else if err := resp.Non2xxToError(); err != nil {
+		return fmt.Errorf("MicrosoftBotKeySet.refresh: failed to retrieve key set - %w", err)
+	}
+	var jwks struct {
+		Keys []microsoftBotJWK `json:"keys"`
+	}
+	if err := resp.DecodeJSON(&jwks); err != nil {
+		return fmt.Errorf("MicrosoftBotKeySet.refresh: failed to deserialise key set - %w", err)
+	}
+	keys := make(map[string]MicrosoftBotSigningKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyType != "RSA" {
+			continue
+		}
+		modulus, errN := base64.RawURLEncoding.DecodeString(jwk.Modulus)
+		exponent, errE := base64.RawURLEncoding.DecodeString(jwk.Exponent)
+		if errN != nil || errE != nil || len(exponent) == 0 {
+			continue
+		}
+		keys[jwk.KeyID] = MicrosoftBotSigningKey{
+			PublicKey:    &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(new(big.Int).SetBytes(exponent).Int64())},
+			Endorsements: jwk.Endorsements,
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("MicrosoftBotKeySet.refresh: key set does not have an RSA key")
+	}
+	set.keys = keys
+	set.retrievedAt = time.Now()
+	return nil
+}
+
+// GetKey returns the signing key of the key ID, the key set is retrieved again if it is outdated or lacks the key.
+func (set *MicrosoftBotKeySet) GetKey(ctx context.Context, keyID string) (MicrosoftBotSigningKey, error) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	key, found := set.keys[keyID]
+	age := time.Since(set.retrievedAt)
+	if (!found && age > MicrosoftBotKeyMinRefreshIntervalSec*time.Second) || age > MicrosoftBotKeyRefreshIntervalSec*time.Second {
+		if err := set.refresh(ctx); err != nil {
+			return MicrosoftBotSigningKey{}, err
+		}
+		key, found = set.keys[keyID]
+	}
+	if !found {
+		return MicrosoftBotSigningKey{}, fmt.Errorf("MicrosoftBotKeySet.GetKey: unknown signing key \"%s\"", keyID)
+	}
+	return key, nil
+}
+
+// MicrosoftBotTokenClaims are the claims of a Bot Framework token relevant to its validation.
+type MicrosoftBotTokenClaims struct {
+	Issuer     string          `json:"iss"`
+	Audience   json.RawMessage `json:"aud"`
+	Expiry     int64           `json:"exp"`
+	NotBefore  int64           `json:"nbf"`
+	ServiceURL string          `json:"serviceurl"`
+}
+
+// HasAudience returns true only if the audience claim, either a string or an array of strings, contains the audience.
+func (claims MicrosoftBotTokenClaims) HasAudience(audience string) bool {
+	var single string
+	if err := json.Unmarshal(claims.Audience, &single); err == nil {
+		return single == audience
+	}
+	var multiple []string
+	if err := json.Unmarshal(claims.Audience, &multiple); err == nil {
+		for _, aud := range multiple {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+VerifyMicrosoftBotToken verifies the RS256 signature of a JWT using the key set, and validates its issuer, audience, and
+validity period. If the channel ID is not empty, the signing key must be endorsed for the channel. The service URL, if
+not empty, must match the claim of the token.
+*/
+func VerifyMicrosoftBotToken(ctx context.Context, keySet *MicrosoftBotKeySet, token, audience, channelID, serviceURL string) (MicrosoftBotTokenClaims, error) {
+	var claims MicrosoftBotTokenClaims
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return claims, errors.New("VerifyMicrosoftBotToken: malformed token")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(segments[0])
+	if err != nil {
+		return claims, fmt.Errorf("VerifyMicrosoftBotToken: malformed token header - %w", err)
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return claims, fmt.Errorf("VerifyMicrosoftBotToken: malformed token header - %w", err)
+	}
+	if header.Algorithm != "RS256" {
+		return claims, fmt.Errorf("VerifyMicrosoftBotToken: unsupported signing algorithm \"%s\"", header.Algorithm)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(segments[2])
+	if err != nil {
+		return claims, fmt.Errorf("VerifyMicrosoftBotToken: malformed token signature - %w", err)
+	}
+	key, err := keySet.GetKey(ctx, header.KeyID)
+	if err != nil {
+		return claims, err
+	}
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+	if err := rsa.VerifyPKCS1v15(key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return claims, errors.New("VerifyMicrosoftBotToken: signature verification failed")
+	}
+	if channelID != "" && len(key.Endorsements) > 0 {
+		endorsed := false
+		for _, endorsement := range key.Endorsements {
+			if endorsement == channelID {
+				endorsed = true
+				break
+			}
+		}
+		if !endorsed {
+			return claims, fmt.Errorf("VerifyMicrosoftBotToken: signing key is not endorsed for channel \"%s\"", channelID)
+		}
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(segments[1])
+	if err != nil {
+		return claims, fmt.Errorf("VerifyMicrosoftBotToken: malformed token claims - %w", err)
+	}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return claims, fmt.Errorf("VerifyMicrosoftBotToken: malformed token claims - %w", err)
+	}
+	if claims.Issuer != MicrosoftBotTokenIssuer {
+		return claims, fmt.Errorf("VerifyMicrosoftBotToken: unexpected issuer \"%s\"", claims.Issuer)
+	}
+	if !claims.HasAudience(audience) {
+		return claims, errors.New("VerifyMicrosoftBotToken: the token is not issued for this bot")
+	}
+	now := time.Now().Unix()
+	if claims.Expiry == 0 || now > claims.Expiry+MicrosoftBotTokenClockSkewSec {
+		return claims, errors.New("VerifyMicrosoftBotToken: the token has expired")
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore-MicrosoftBotTokenClockSkewSec {
+		return claims, errors.New("VerifyMicrosoftBotToken: the token is not valid yet")
+	}
+	if serviceURL != "" && strings.TrimSuffix(claims.ServiceURL, "/") != strings.TrimSuffix(serviceURL, "/") {
+		return claims, errors.New("VerifyMicrosoftBotToken: service URL does not match the token")
+	}
+	return claims, nil
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// signTestMicrosoftBotToken returns an RS256 JWT carrying the claims.
+func signTestMicrosoftBotToken(t *testing.T, key *rsa.PrivateKey, keyID string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": keyID, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// newTestMicrosoftBotKeyServer serves OpenID metadata and key set of the key.
+func newTestMicrosoftBotKeyServer(key *rsa.PrivateKey, keyID string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata":
+			_, _ = fmt.Fprintf(w, `{"jwks_uri": "%s/keys"}`, server.URL)
+		case "/keys":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]interface{}{{
+				"kty":          "RSA",
+				"kid":          keyID,
+				"n":            base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":            base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				"endorsements": []string{"msteams"},
+			}}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+func TestVerifyMicrosoftBotToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestMicrosoftBotKeyServer(key, "key1")
+	defer server.Close()
+	keySet := &MicrosoftBotKeySet{MetadataURL: server.URL + "/metadata"}
+	now := time.Now().Unix()
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{"iss": MicrosoftBotTokenIssuer, "aud": "my-app-id", "exp": now + 3600, "nbf": now - 60, "serviceurl": "https://smba.example.com/"}
+	}
+	token := signTestMicrosoftBotToken(t, key, "key1", validClaims())
+	if _, err := VerifyMicrosoftBotToken(context.Background(), keySet, token, "my-app-id", "msteams", "https://smba.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	// Wrong audience, channel, and service URL
+	if _, err := VerifyMicrosoftBotToken(context.Background(), keySet, token, "other-app-id", "msteams", "https://smba.example.com"); err == nil {
+		t.Fatal("did not reject wrong audience")
+	}
+	if _, err := VerifyMicrosoftBotToken(context.Background(), keySet, token, "my-app-id", "skype", "https://smba.example.com"); err == nil {
+		t.Fatal("did not reject unendorsed channel")
+	}
+	if _, err := VerifyMicrosoftBotToken(context.Background(), keySet, token, "my-app-id", "msteams", "https://attacker.example.com"); err == nil {
+		t.Fatal("did not reject wrong service URL")
+	}
+	// Expired token and wrong issuer
+	claims := validClaims()
+	claims["exp"] = now - 3600
+	if _, err := VerifyMicrosoftBotToken(context.Background(), keySet, signTestMicrosoftBotToken(t, key, "key1", claims), "my-app-id", "msteams", ""); err == nil {
+		t.Fatal("did not reject expired token")
+	}
+	claims = validClaims()
+	claims["iss"] = "https://attacker.example.com"
+	if _, err := VerifyMicrosoftBotToken(context.Background(), keySet, signTestMicrosoftBotToken(t, key, "key1", claims), "my-app-id", "msteams", ""); err == nil {
+		t.Fatal("did not reject wrong issuer")
+	}
+	// Token signed by another key
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyMicrosoftBotToken(context.Background(), keySet, signTestMicrosoftBotToken(t, otherKey, "key1", validClaims()), "my-app-id", "msteams", ""); err == nil {
+		t.Fatal("did not reject bad signature")
+	}
+	if _, err := VerifyMicrosoftBotToken(context.Background(), keySet, signTestMicrosoftBotToken(t, otherKey, "key2", validClaims()), "my-app-id", "msteams", ""); err == nil {
+		t.Fatal("did not reject unknown key")
+	}
+	if _, err := VerifyMicrosoftBotToken(context.Background(), keySet, "not.a.token", "my-app-id", "msteams", ""); err == nil {
+		t.Fatal("did not reject malformed token")
+	}
+}
+
+func TestBuildMicrosoftBotAdaptiveCard(t *testing.T) {
+	card := BuildMicrosoftBotAdaptiveCard("short", 10, nil)
+	if len(card["body"].([]interface{})) != 1 || card["actions"] != nil {
+		t.Fatal(card)
+	}
+	card = BuildMicrosoftBotAdaptiveCard("0123456789abc", 10, []string{"watsup"})
+	body := card["body"].([]interface{})
+	if len(body) != 2 || body[0].(map[string]interface{})["text"] != "0123456789" || body[1].(map[string]interface{})["text"] != "abc" {
+		t.Fatal(body)
+	}
+	serialised, err := json.Marshal(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`"Action.ToggleVisibility"`, `"targetElements":["remainder"]`, `"type":"messageBack"`, `"text":"watsup"`} {
+		if !strings.Contains(string(serialised), expected) {
+			t.Fatal(expected, string(serialised))
+		}
+	}
+}
+
+func TestHandleMicrosoftBot_Authorization(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestMicrosoftBotKeyServer(key, "key1")
+	defer server.Close()
+	hand := &HandleMicrosoftBot{ClientAppID: "my-app-id", ClientAppSecret: "secret"}
+	if err := hand.Initialise(lalog.DefaultLogger, toolbox.GetTestCommandProcessor(), ""); err != nil {
+		t.Fatal(err)
+	}
+	hand.keySet.MetadataURL = server.URL + "/metadata"
+	// The chat is empty, hence the bot will not reply after accepting it.
+	chat, _ := json.Marshal(MicrosoftBotIncomingChat{ChannelID: "msteams", ServiceURL: "https://smba.example.com", Conversation: MicrosoftBotIncomingConversation{ID: "conv"}})
+	post := func(authorization string) int {
+		req := httptest.NewRequest(http.MethodPost, "/bot", bytes.NewReader(chat))
+		req.Header.Set("Authorization", authorization)
+		rec := httptest.NewRecorder()
+		hand.Handle(rec, req)
+		return rec.Code
+	}
+	if code := post(""); code != http.StatusUnauthorized {
+		t.Fatal(code)
+	}
+	now := time.Now().Unix()
+	token := signTestMicrosoftBotToken(t, key, "key1", map[string]interface{}{"iss": MicrosoftBotTokenIssuer, "aud": "my-app-id", "exp": now + 3600, "serviceurl": "https://smba.example.com"})
+	if code := post("Bearer " + token); code != http.StatusOK {
+		t.Fatal(code)
+	}
+}
@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const (
+	// MTASTSPolicyLocation is the well-known URL location of the MTA-STS policy file (RFC 8461).
+	MTASTSPolicyLocation = "/.well-known/mta-sts.txt"
+	// MTASTSDefaultMaxAgeSec is the default duration for which the senders cache the policy, which is one week.
+	MTASTSDefaultMaxAgeSec = 7 * 24 * 3600
+	// MTASTSMaxMaxAgeSec is the maximum duration for which the senders may cache the policy (RFC 8461).
+	MTASTSMaxMaxAgeSec = 31557600
+)
+
+/*
+HandleMTASTSPolicy serves the MTA-STS policy file (RFC 8461), which tells the mail servers sending mails to my domains
+to only deliver them over TLS to the listed MX hosts. The policy file must be hosted at the well-known location on
+"mta-sts.<domain>" with a valid TLS certificate, and announced by a DNS TXT record; a TLS-RPT (RFC 8460) TXT record
+further asks the senders to report their TLS failures.
+*/
+type HandleMTASTSPolicy struct {
+	// Mode is the policy mode: "enforce", "testing", or "none".
+	Mode string `json:"Mode"`
+	// MX are the host names (wildcard "*.example.com" is allowed) of the mail servers that receive mails over TLS.
+	MX []string `json:"MX"`
+	// MaxAgeSec is the duration for which the senders cache the policy.
+	MaxAgeSec int `json:"MaxAgeSec"`
+	// TLSRPTAddresses are the (optional) "mailto:" or "https:" addresses that receive TLS failure reports. They default
+	// to "mailto:tls-reports@<domain>", which is received by the laitos mail server if it serves the domain.
+	TLSRPTAddresses []string `json:"TLSRPTAddresses"`
+
+	policy []byte
+}
+
+// IsConfigured returns true if the policy has a mode.
+func (policy *HandleMTASTSPolicy) IsConfigured() bool {
+	return policy.Mode != ""
+}
+
+// Initialise validates the policy and prepares the policy file content.
+func (policy *HandleMTASTSPolicy) Initialise(_ *lalog.Logger, _ *toolbox.CommandProcessor, _ string) error {
+	switch policy.Mode {
+	case "enforce", "testing":
+		if len(policy.MX) == 0 {
+			return errors.New("HandleMTASTSPolicy.Initialise: MX must not be empty")
+		}
+	case "none":
+	default:
+		return errors.New(`HandleMTASTSPolicy.Initialise: Mode must be "enforce", "testing", or "none"`)
+	}
+	if policy.MaxAgeSec < 1 {
+		policy.MaxAgeSec = MTASTSDefaultMaxAgeSec
+	} else if policy.MaxAgeSec > MTASTSMaxMaxAgeSec {
+		return fmt.Errorf("HandleMTASTSPolicy.Initialise: MaxAgeSec must not exceed %d", MTASTSMaxMaxAgeSec)
+	}
+	for _, addr := range policy.TLSRPTAddresses {
+		if !strings.HasPrefix(addr, "mailto:") && !strings.HasPrefix(addr, "https://") {
+			return fmt.Errorf("HandleMTASTSPolicy.Initialise: TLS-RPT address \"%s\" must begin with mailto: or https://", addr)
+		}
+	}
+	policy.policy = []byte(policy.PolicyText())
+	return nil
+}
+
+// PolicyText returns the content of the policy file, each line is terminated by CRLF.
+func (policy *HandleMTASTSPolicy) PolicyText() string {
+	var text strings.Builder
+	text.WriteString("version: STSv1\r\n")
+	text.WriteString("mode: " + policy.Mode + "\r\n")
+	for _, mx := range policy.MX {
+		text.WriteString("mx: " + strings.TrimSuffix(strings.ToLower(strings.TrimSpace(mx)), ".") + "\r\n")
+	}
+	maxAgeSec := policy.MaxAgeSec
+	if maxAgeSec < 1 {
+		maxAgeSec = MTASTSDefaultMaxAgeSec
+	}
+	text.WriteString(fmt.Sprintf("max_age: %d\r\n", maxAgeSec))
+	return text.String()
+}
+
+// PolicyID returns the ID of the policy announced by DNS, the ID changes when the policy content changes.
+func (policy *HandleMTASTSPolicy) PolicyID() string {
+	digest := sha256.Sum256([]byte(policy.PolicyText()))
+	return hex.EncodeToString(digest[:10])
+}
+
+/*
+DNSRecords returns the DNS TXT record names (with a trailing full-stop) and values that announce the MTA-STS policy
+and the TLS-RPT report addresses of the mail domain.
+*/
+func (policy *HandleMTASTSPolicy) DNSRecords(domain string) map[string]string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	reportAddrs := policy.TLSRPTAddresses
+	if len(reportAddrs) == 0 {
+		reportAddrs = []string{"mailto:tls-reports@" + domain}
+	}
+	return map[string]string{
+		"_mta-sts." + domain + ".":   "v=STSv1; id=" + policy.PolicyID(),
+		"_smtp._tls." + domain + ".": "v=TLSRPTv1; rua=" + strings.Join(reportAddrs, ","),
+	}
+}
+
+func (policy *HandleMTASTSPolicy) Handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write(policy.policy)
+}
+
+func (*HandleMTASTSPolicy) GetRateLimitFactor() int {
+	return 1
+}
+
+func (*HandleMTASTSPolicy) SelfTest() error {
+	return nil
+}
@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+func TestHandleMTASTSPolicy(t *testing.T) {
+	for _, bad := range []HandleMTASTSPolicy{
+		{Mode: "strict", MX: []string{"mx.example.com"}},
+		{Mode: "enforce"},
+		{Mode: "testing", MX: []string{"mx.example.com"}, MaxAgeSec: MTASTSMaxMaxAgeSec + 1},
+		{Mode: "none", TLSRPTAddresses: []string{"reports@example.com"}},
+	} {
+		if err := bad.Initialise(lalog.DefaultLogger, nil, ""); err == nil {
+			t.Fatalf("did not reject %+v", bad)
+		}
+	}
+	policy := HandleMTASTSPolicy{Mode: "enforce", MX: []string{"MX.example.com.", "*.backup.example.com"}}
+	idBeforeInit := policy.PolicyID()
+	if err := policy.Initialise(lalog.DefaultLogger, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	policy.Handle(rec, httptest.NewRequest("GET", MTASTSPolicyLocation, nil))
+	if body := rec.Body.String(); body != "version: STSv1\r\nmode: enforce\r\nmx: mx.example.com\r\nmx: *.backup.example.com\r\nmax_age: 604800\r\n" {
+		t.Fatalf("%q", body)
+	}
+	// The policy ID is stable and changes along with the policy
+	if id := policy.PolicyID(); id != idBeforeInit || len(id) != 20 {
+		t.Fatal(id, idBeforeInit)
+	}
+	records := policy.DNSRecords("Example.com.")
+	if records["_mta-sts.example.com."] != "v=STSv1; id="+policy.PolicyID() || records["_smtp._tls.example.com."] != "v=TLSRPTv1; rua=mailto:tls-reports@example.com" {
+		t.Fatal(records)
+	}
+	policy.Mode = "testing"
+	policy.TLSRPTAddresses = []string{"mailto:a@example.net", "https://report.example.net/tlsrpt"}
+	records = policy.DNSRecords("example.com")
+	if strings.HasSuffix(records["_mta-sts.example.com."], idBeforeInit) || records["_smtp._tls.example.com."] != "v=TLSRPTv1; rua=mailto:a@example.net,https://report.example.net/tlsrpt" {
+		t.Fatal(records)
+	}
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// OwnTracksMaxPayloadSize is the maximum size of a location report sent by OwnTracks app.
+const OwnTracksMaxPayloadSize = 64 * 1024
+
+// OwnTracksLocation is the location report sent by OwnTracks app in HTTP mode, other types of messages share the "_type" field.
+type OwnTracksLocation struct {
+	Type      string  `json:"_type"`
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+	Altitude  float64 `json:"alt"`
+	Accuracy  float64 `json:"acc"`
+	Timestamp int64   `json:"tst"`
+	TrackerID string  `json:"tid"`
+}
+
+/*
+HandleOwnTracks collects location reports from the OwnTracks app in HTTP mode, and records the positions in the location
+tracker app. The device is identified by the device ID (or user name) configured in the app, which OwnTracks presents in
+the X-Limit-D (or X-Limit-U) header, or by the tracker ID when neither is present.
+*/
+type HandleOwnTracks struct {
+	cmdProc *toolbox.CommandProcessor
+	logger  *lalog.Logger
+}
+
+func (hand *HandleOwnTracks) Initialise(logger *lalog.Logger, cmdProc *toolbox.CommandProcessor, _ string) error {
+	if cmdProc == nil {
+		return errors.New("HandleOwnTracks.Initialise: command processor must not be nil")
+	}
+	if !cmdProc.Features.LocationTracker.IsConfigured() {
+		return errors.New("HandleOwnTracks.Initialise: the location tracker app must be configured")
+	}
+	hand.cmdProc = cmdProc
+	hand.logger = logger
+	return nil
+}
+
+func (hand *HandleOwnTracks) Handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		middleware.WriteError(w, r, http.StatusMethodNotAllowed, "OwnTracks reports locations via HTTP POST")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, OwnTracksMaxPayloadSize))
+	if err != nil {
+		return
+	}
+	var report OwnTracksLocation
+	if err := json.Unmarshal(body, &report); err != nil {
+		hand.logger.Warning(middleware.GetRealClientIP(r), err, "failed to decode OwnTracks message")
+		middleware.WriteError(w, r, http.StatusBadRequest, "failed to decode OwnTracks message")
+		return
+	}
+	// OwnTracks expects a JSON array in the response, which may carry messages for the app, there is none.
+	w.Header().Set("Content-Type", "application/json")
+	if report.Type != "location" {
+		_, _ = w.Write([]byte("[]"))
+		return
+	}
+	deviceName := r.Header.Get("X-Limit-D")
+	if deviceName == "" {
+		deviceName = r.Header.Get("X-Limit-U")
+	}
+	if deviceName == "" {
+		deviceName = report.TrackerID
+	}
+	pos := toolbox.Position{
+		Latitude:  report.Latitude,
+		Longitude: report.Longitude,
+		Altitude:  report.Altitude,
+		Accuracy:  report.Accuracy,
+		Source:    toolbox.LocationSourceOwnTracks,
+	}
+	if report.Timestamp > 0 {
+		pos.Time = time.Unix(report.Timestamp, 0)
+	}
+	if err := hand.cmdProc.Features.LocationTracker.Record(strings.TrimSpace(deviceName), pos); err != nil {
+		hand.logger.Warning(deviceName, err, "failed to record OwnTracks location")
+		middleware.WriteError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	_, _ = w.Write([]byte("[]"))
+}
+
+func (_ *HandleOwnTracks) GetRateLimitFactor() int {
+	return 6
+}
+
+func (_ *HandleOwnTracks) SelfTest() error {
+	return nil
+}
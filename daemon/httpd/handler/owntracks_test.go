@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleOwnTracks(t *testing.T) {
+	cmdProc := toolbox.GetTestCommandProcessor()
+	hand := &HandleOwnTracks{}
+	require.Error(t, hand.Initialise(&lalog.Logger{}, cmdProc, ""))
+	tracker := &cmdProc.Features.LocationTracker
+	tracker.FilePath = filepath.Join(t.TempDir(), "locations")
+	tracker.Passphrase = "pass"
+	require.NoError(t, tracker.Initialise())
+	require.NoError(t, hand.Initialise(&lalog.Logger{}, cmdProc, ""))
+
+	post := func(body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/owntracks", strings.NewReader(body))
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		w := httptest.NewRecorder()
+		hand.Handle(w, req)
+		return w
+	}
+	// Messages other than location reports are acknowledged
+	w := post(`{"_type":"transition","event":"enter"}`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "[]", w.Body.String())
+	require.Equal(t, http.StatusBadRequest, post(`not json`, nil).Code)
+	require.Equal(t, http.StatusBadRequest, post(`{"_type":"location","lat":0,"lon":0,"tid":"ph"}`, nil).Code)
+
+	// The device is identified by the device ID header, or the tracker ID.
+	w = post(`{"_type":"location","lat":52.5,"lon":13.4,"acc":15,"tst":1700000000,"tid":"ph"}`, http.Header{"X-Limit-U": {"alice"}, "X-Limit-D": {"phone"}})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "[]", w.Body.String())
+	require.Equal(t, http.StatusOK, post(`{"_type":"location","lat":-33.8,"lon":151.2,"tid":"ta"}`, nil).Code)
+	positions, err := tracker.GetPositions("phone")
+	require.NoError(t, err)
+	require.Equal(t, []toolbox.Position{{Latitude: 52.5, Longitude: 13.4, Accuracy: 15, Time: positions[0].Time, Source: toolbox.LocationSourceOwnTracks}}, positions)
+	require.Equal(t, int64(1700000000), positions[0].Time.Unix())
+	positions, err = tracker.GetPositions("ta")
+	require.NoError(t, err)
+	require.Len(t, positions, 1)
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/platform/procexp"
 	"github.com/HouzuoGuo/laitos/toolbox"
@@ -48,7 +49,7 @@ func (explorer *HandleProcessExplorer) Handle(w http.ResponseWriter, r *http.Req
 		// By contract, the function will retrieve the own process' status if the input PID is 0.
 		status, err := procexp.GetProcAndTaskStatus(pid)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("failed to read process status - %v", err), http.StatusInternalServerError)
+			middleware.WriteError(w, r, http.StatusInternalServerError, fmt.Sprintf("failed to read process status - %v", err))
 			return
 		}
 		_ = respEncoder.Encode(status)
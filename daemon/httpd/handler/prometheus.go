@@ -3,6 +3,8 @@ package handler
 import (
 	"net/http"
 
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/toolbox"
@@ -19,7 +21,9 @@ type HandlePrometheus struct {
 // Initialising the handler while prometheus integration is not enabled will not result in an error, and the handler
 // will simply respond with HTTP status Service Unavailable to the clients.
 func (prom *HandlePrometheus) Initialise(logger *lalog.Logger, _ *toolbox.CommandProcessor, stripURLPrefixFromResponse string) error {
-	if misc.EnablePrometheusIntegration {
+	if misc.PrometheusIntegration.IsEnabled() {
+		// Serve the daemon stats counters along with the metrics registered by the daemons
+		common.RegisterDaemonStatsMetrics(logger)
 		prom.metricHandler = promhttp.InstrumentMetricHandler(
 			prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{}),
 		)
@@ -30,7 +34,7 @@ func (prom *HandlePrometheus) Initialise(logger *lalog.Logger, _ *toolbox.Comman
 // Handle responds to the client request with prometheus metrics information in plain text.
 func (prom *HandlePrometheus) Handle(w http.ResponseWriter, r *http.Request) {
 	if prom.metricHandler == nil {
-		http.Error(w, "prometheus integration is not enabled (-prominteg=true)", http.StatusServiceUnavailable)
+		middleware.WriteError(w, r, http.StatusServiceUnavailable, "prometheus integration is not enabled (-prominteg=true)")
 		return
 	}
 	prom.metricHandler.ServeHTTP(w, r)
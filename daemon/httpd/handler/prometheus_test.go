@@ -12,7 +12,7 @@ import (
 )
 
 func TestHandlePrometheus_SelfTest(t *testing.T) {
-	misc.EnablePrometheusIntegration = true
+	misc.PrometheusIntegration.Set(true)
 	handler := &HandlePrometheus{}
 	if err := handler.Initialise(&lalog.Logger{}, nil, ""); err != nil {
 		t.Fatal(err)
@@ -23,7 +23,7 @@ func TestHandlePrometheus_SelfTest(t *testing.T) {
 }
 
 func TestHandlePrometheus_HandleWithPromIntegDisabled(t *testing.T) {
-	misc.EnablePrometheusIntegration = false
+	misc.PrometheusIntegration.Set(false)
 	handler := &HandlePrometheus{}
 	if err := handler.Initialise(&lalog.Logger{}, nil, ""); err != nil {
 		t.Fatal(err)
@@ -40,7 +40,7 @@ func TestHandlePrometheus_HandleWithPromIntegDisabled(t *testing.T) {
 }
 
 func TestHandlePrometheus_HandleWithPromIntegEnabled(t *testing.T) {
-	misc.EnablePrometheusIntegration = true
+	misc.PrometheusIntegration.Set(true)
 	handler := &HandlePrometheus{}
 	if err := handler.Initialise(&lalog.Logger{}, nil, ""); err != nil {
 		t.Fatal(err)
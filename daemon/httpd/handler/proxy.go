@@ -3,11 +3,13 @@ package handler
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/toolbox"
@@ -128,6 +130,8 @@ window.onload = laitos_replace_many;
 </script>
 `
 	ProxyTargetTimeoutSec = 120 // ProxyTimeoutSec is the IO timeout for downloading proxy's target URL.
+	// ProxyMaxResponseBytes is the maximum size of the response downloaded from the proxy's target URL.
+	ProxyMaxResponseBytes = 32 * 1048576
 )
 
 // HandleWebProxy is a pretty dumb client-side rendering web proxy, it does not support anonymity.
@@ -138,18 +142,46 @@ type HandleWebProxy struct {
 	*/
 	OwnEndpoint string `json:"-"`
 
+	// ImageMaxDimension is the maximum width and height of proxied images. Larger images are downscaled and
+	// recompressed in JPEG. Zero means images are not downscaled.
+	ImageMaxDimension int `json:"ImageMaxDimension"`
+	// ImageJPEGQuality is the JPEG quality (1-100) of recompressed images. If ImageMaxDimension is zero and the
+	// quality is greater than zero, images are recompressed without being downscaled.
+	ImageJPEGQuality int `json:"ImageJPEGQuality"`
+	// PageByteBudget is the maximum number of bytes served for each proxied page, including the page's own HTML
+	// and the resources it loads via the proxy. Heavy page elements are stripped to fit the HTML into the budget,
+	// and resources beyond the budget are withheld. Zero means unlimited.
+	PageByteBudget int `json:"PageByteBudget"`
+
+	pageBudget                 *proxyPageBudget
 	stripURLPrefixFromResponse string
+	sessions                   *SessionStore
 	logger                     *lalog.Logger
 }
 
-var ProxyRemoveRequestHeaders = []string{"Host", "Content-Length", "Accept-Encoding", "Content-Security-Policy", "Set-Cookie"}
-var ProxyRemoveResponseHeaders = []string{"Host", "Content-Length", "Transfer-Encoding", "Content-Security-Policy", "Set-Cookie"}
+// SetSessionStore gives the proxy a session store to keep the cookies set by proxied web sites.
+func (xy *HandleWebProxy) SetSessionStore(store *SessionStore) {
+	xy.sessions = store
+}
+
+/*
+ProxyRemoveRequestHeaders and ProxyRemoveResponseHeaders are not copied between the visitor and the proxy target. They
+include the connection-specific headers, which are meaningless for the other connection and not allowed in HTTP/2.
+*/
+var ProxyRemoveRequestHeaders = []string{"Host", "Content-Length", "Accept-Encoding", "Content-Security-Policy", "Set-Cookie",
+	"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Upgrade"}
+var ProxyRemoveResponseHeaders = []string{"Host", "Content-Length", "Transfer-Encoding", "Content-Security-Policy", "Set-Cookie",
+	"Connection", "Keep-Alive", "Proxy-Connection", "Upgrade"}
 
 func (xy *HandleWebProxy) Initialise(logger *lalog.Logger, _ *toolbox.CommandProcessor, stripURLPrefixFromResponse string) error {
 	xy.logger = logger
 	if xy.OwnEndpoint == "" {
 		return errors.New("HandleWebProxy.Initialise: MyEndpoint must not be empty")
 	}
+	if xy.ImageMaxDimension < 0 || xy.ImageJPEGQuality < 0 || xy.ImageJPEGQuality > 100 || xy.PageByteBudget < 0 {
+		return errors.New("HandleWebProxy.Initialise: ImageMaxDimension, ImageJPEGQuality, and PageByteBudget must be positive, and quality must not exceed 100")
+	}
+	xy.pageBudget = newProxyPageBudget()
 	xy.stripURLPrefixFromResponse = stripURLPrefixFromResponse
 	return nil
 }
@@ -166,18 +198,18 @@ func (xy *HandleWebProxy) Handle(w http.ResponseWriter, r *http.Request) {
 	// Figure out where user wants to go
 	browseURL := r.FormValue("u")
 	if browseURL == "" {
-		http.Error(w, "URL is empty", http.StatusInternalServerError)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "URL is empty")
 		return
 	}
 	if len(browseURL) > 1024 {
 		xy.logger.Warning(browseURL[0:64], nil, "proxy URL is unusually long at %d bytes", len(browseURL))
-		http.Error(w, "URL is unusually long", http.StatusInternalServerError)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "URL is unusually long")
 		return
 	}
 	urlParts, err := url.Parse(browseURL)
 	if err != nil {
 		xy.logger.Warning(browseURL, err, "failed to parse proxy URL")
-		http.Error(w, "Failed to parse proxy URL", http.StatusInternalServerError)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "Failed to parse proxy URL")
 		return
 	}
 
@@ -191,7 +223,7 @@ func (xy *HandleWebProxy) Handle(w http.ResponseWriter, r *http.Request) {
 	myReq, err := http.NewRequest(r.Method, browseSchemeHostPathQuery, r.Body)
 	if err != nil {
 		xy.logger.Warning(browseSchemeHostPathQuery, err, "failed to create request to URL")
-		http.Error(w, "Failed to create request to URL", http.StatusInternalServerError)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "Failed to create request to URL")
 		return
 	}
 	// Remove request headers that are not necessary
@@ -199,21 +231,49 @@ func (xy *HandleWebProxy) Handle(w http.ResponseWriter, r *http.Request) {
 	for _, name := range ProxyRemoveRequestHeaders {
 		myReq.Header.Del(name)
 	}
+	// Present the cookies previously set by the web site, and keep the session cookies of laitos to itself.
+	var cookieJar proxyCookieJar
+	if xy.sessions != nil {
+		if _, err := xy.sessions.Load(r, ProxyCookieJarSession, &cookieJar); err != nil {
+			xy.logger.Warning(browseSchemeHost, err, "failed to load cookie jar")
+		}
+	}
+	var cookies []string
+	for _, cookie := range r.Cookies() {
+		if !strings.HasPrefix(cookie.Name, SessionCookiePrefix) {
+			cookies = append(cookies, cookie.String())
+		}
+	}
+	if jarCookies := cookieJar.header(urlParts.Host, time.Now()); jarCookies != "" {
+		cookies = append(cookies, jarCookies)
+	}
+	myReq.Header.Del("Cookie")
+	if len(cookies) > 0 {
+		myReq.Header.Set("Cookie", strings.Join(cookies, "; "))
+	}
 	// Retrieve resource from remote
 	client := http.Client{Timeout: ProxyTargetTimeoutSec * time.Second}
 	remoteResp, err := client.Do(myReq)
 	if err != nil {
 		xy.logger.Warning(browseSchemeHostPathQuery, err, "failed to send request")
-		http.Error(w, "Failed to send request", http.StatusInternalServerError)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "Failed to send request")
 		return
 	}
 	defer remoteResp.Body.Close()
-	// Download up to 32MB of data from the proxy target
-	remoteRespBody, err := misc.ReadAllUpTo(remoteResp.Body, 32*1048576)
-	if err != nil {
-		xy.logger.Warning(browseSchemeHostPathQuery, err, "failed to download the URL")
-		http.Error(w, "Failed to download URL", http.StatusInternalServerError)
-		return
+	isHTML := strings.HasPrefix(remoteResp.Header.Get("Content-Type"), "text/html")
+	isImage := isTranscodableImage(remoteResp.Header.Get("Content-Type"))
+	page := proxyPageOfResource(r.Referer())
+	// The HTML page is rewritten, and the image may be transcoded or withheld, the other responses are streamed as they arrive.
+	streamResponse := !isHTML && !(isImage && (xy.ImageMaxDimension > 0 || xy.ImageJPEGQuality > 0)) && !(xy.PageByteBudget > 0 && page != "")
+	var remoteRespBody []byte
+	if !streamResponse {
+		// Download up to 32MB of data from the proxy target
+		remoteRespBody, err = misc.ReadAllUpTo(remoteResp.Body, ProxyMaxResponseBytes)
+		if err != nil {
+			xy.logger.Warning(browseSchemeHostPathQuery, err, "failed to download the URL")
+			middleware.WriteError(w, r, http.StatusInternalServerError, "Failed to download URL")
+			return
+		}
 	}
 	// Copy headers from remote response
 	for name, values := range remoteResp.Header {
@@ -225,6 +285,14 @@ func (xy *HandleWebProxy) Handle(w http.ResponseWriter, r *http.Request) {
 	for _, name := range ProxyRemoveResponseHeaders {
 		w.Header().Del(name)
 	}
+	// Memorise the cookies set by the web site in the visitor's session
+	if xy.sessions != nil {
+		if updatedJar, changed := cookieJar.update(urlParts.Host, remoteResp.Cookies(), time.Now()); changed {
+			if err := xy.sessions.Save(w, r, ProxyCookieJarSession, updatedJar); err != nil {
+				xy.logger.Warning(browseSchemeHost, err, "failed to save cookie jar")
+			}
+		}
+	}
 	// Just in case they become useful later on
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
@@ -232,11 +300,23 @@ func (xy *HandleWebProxy) Handle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 	w.Header().Set("Access-Control-Expose-Headers", "Content-Type, Authorization")
 	NoCache(w)
+	if streamResponse {
+		w.WriteHeader(remoteResp.StatusCode)
+		if err := streamProxyResponse(w, io.LimitReader(remoteResp.Body, ProxyMaxResponseBytes)); err != nil {
+			xy.logger.Info(browseSchemeHostPathQuery, err, "failed to stream the response")
+		}
+		return
+	}
 	// Rewrite HTML response to insert javascript
-	w.WriteHeader(remoteResp.StatusCode)
-	if strings.HasPrefix(remoteResp.Header.Get("Content-Type"), "text/html") {
+	if isHTML {
 		injectedJS := fmt.Sprintf(ProxyInjectJS, proxySchemeHost, proxyHandlePath, browseSchemeHost, browseSchemeHostPath)
 		strBody := string(remoteRespBody)
+		if xy.PageByteBudget > 0 {
+			// The page is loaded (again), its resources will be loaded again too.
+			strBody = StripHTMLToBudget(strBody, xy.PageByteBudget)
+			xy.pageBudget.reset(browseURL)
+			xy.pageBudget.charge(browseURL, len(strBody), xy.PageByteBudget)
+		}
 		headIndex := strings.Index(strBody, "<head>")
 		if headIndex == -1 {
 			bodyIndex := strings.Index(strBody, "<body")
@@ -248,10 +328,55 @@ func (xy *HandleWebProxy) Handle(w http.ResponseWriter, r *http.Request) {
 		} else {
 			strBody = strBody[0:headIndex+6] + injectedJS + strBody[headIndex+6:]
 		}
+		w.WriteHeader(remoteResp.StatusCode)
 		_, _ = w.Write([]byte(strBody))
 		xy.logger.Info(browseSchemeHostPathQuery, nil, "served modified HTML")
-	} else {
-		_, _ = w.Write(remoteRespBody)
+		return
+	}
+	if isImage && (xy.ImageMaxDimension > 0 || xy.ImageJPEGQuality > 0) {
+		if transcoded, ok := TranscodeImage(remoteRespBody, xy.ImageMaxDimension, xy.ImageJPEGQuality); ok {
+			remoteRespBody = transcoded
+			w.Header().Set("Content-Type", "image/jpeg")
+		}
+	}
+	if xy.PageByteBudget > 0 && page != "" {
+		if !xy.pageBudget.charge(page, len(remoteRespBody), xy.PageByteBudget) {
+			xy.logger.Info(browseSchemeHostPathQuery, nil, "withheld %d bytes of resource that exceeds the byte budget of page %s", len(remoteRespBody), page)
+			if isImage {
+				w.Header().Set("Content-Type", "image/gif")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write(proxyPlaceholderGIF)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return
+		}
+	}
+	w.WriteHeader(remoteResp.StatusCode)
+	_, _ = w.Write(remoteRespBody)
+}
+
+/*
+streamProxyResponse copies the response of the proxy target to the visitor, and flushes each piece of it as soon as it
+arrives. Over HTTP/2 the streamed response only occupies its own stream, leaving the connection free for the other
+resources of the page.
+*/
+func streamProxyResponse(w http.ResponseWriter, body io.Reader) error {
+	controller := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			_ = controller.Flush()
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
 	}
 }
 
@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	// Register the PNG decoder for image.Decode.
+	_ "image/png"
+
+	"github.com/HouzuoGuo/laitos/datastruct"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// ProxyDefaultImageJPEGQuality is the JPEG quality used for transcoding images when the handler does not specify one.
+	ProxyDefaultImageJPEGQuality = 40
+	// ProxyMaxTrackedPages is the maximum number of proxied pages whose byte budget usage is remembered.
+	ProxyMaxTrackedPages = 200
+	// ProxyMaxImagePixels is the maximum number of pixels (width x height) of an image that TranscodeImage decodes. A
+	// larger image is served as-is, the limit keeps a small image file that claims huge dimensions from exhausting the
+	// memory.
+	ProxyMaxImagePixels = 16 * 1000 * 1000
+)
+
+var (
+	// proxyHeavyHTMLElements matches the page elements that are stripped first to fit a page into its byte budget.
+	proxyHeavyHTMLElements = []*regexp.Regexp{
+		regexp.MustCompile(`(?is)<video\b.*?</video\s*>`),
+		regexp.MustCompile(`(?is)<audio\b.*?</audio\s*>`),
+		regexp.MustCompile(`(?is)<iframe\b.*?</iframe\s*>`),
+		regexp.MustCompile(`(?is)<object\b.*?</object\s*>`),
+		regexp.MustCompile(`(?is)<embed\b[^>]*>`),
+		regexp.MustCompile(`(?is)<noscript\b.*?</noscript\s*>`),
+		regexp.MustCompile(`(?is)<svg\b.*?</svg\s*>`),
+	}
+	// proxyScriptStyleHTMLElements matches the page elements that are stripped if the page still exceeds its byte budget
+	// after heavy elements are gone.
+	proxyScriptStyleHTMLElements = []*regexp.Regexp{
+		regexp.MustCompile(`(?is)<script\b.*?</script\s*>`),
+		regexp.MustCompile(`(?is)<style\b.*?</style\s*>`),
+		regexp.MustCompile(`(?is)<link\b[^>]*>`),
+	}
+	// proxyPlaceholderGIF is a 1x1 transparent GIF served in place of images that do not fit into page byte budget.
+	proxyPlaceholderGIF = func() []byte {
+		img := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Transparent})
+		var buf bytes.Buffer
+		if err := gif.Encode(&buf, img, nil); err != nil {
+			panic(err)
+		}
+		return buf.Bytes()
+	}()
+)
+
+// proxyPageBudget keeps track of the number of bytes served for each proxied page, including the page's own HTML and
+// the resources it subsequently loads via the proxy.
+type proxyPageBudget struct {
+	used  map[string]int
+	pages *datastruct.LeastRecentlyUsedBuffer
+	mutex *sync.Mutex
+}
+
+// newProxyPageBudget returns an initialised page budget tracker.
+func newProxyPageBudget() *proxyPageBudget {
+	return &proxyPageBudget{
+		used:  make(map[string]int),
+		pages: datastruct.NewLeastRecentlyUsedBuffer(ProxyMaxTrackedPages),
+		mutex: new(sync.Mutex),
+	}
+}
+
+// reset clears the usage of the page, this is called when the page's HTML is loaded (again).
+func (budget *proxyPageBudget) reset(page string) {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	if _, evicted := budget.pages.Add(page); evicted != "" {
+		delete(budget.used, evicted)
+	}
+	budget.used[page] = 0
+}
+
+// charge records the bytes served for the page if they fit into the total budget, and returns true. If the bytes
+// do not fit, the function does not record them and returns false.
+func (budget *proxyPageBudget) charge(page string, size, total int) bool {
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	if _, evicted := budget.pages.Add(page); evicted != "" {
+		delete(budget.used, evicted)
+	}
+	if budget.used[page]+size > total {
+		return false
+	}
+	budget.used[page] += size
+	return true
+}
+
+// proxyPageOfResource returns the proxied page that loaded the resource, determined by the referer of the proxy
+// request. It returns an empty string if the referer does not come from the proxy.
+func proxyPageOfResource(referer string) string {
+	refURL, err := url.Parse(referer)
+	if err != nil {
+		return ""
+	}
+	return refURL.Query().Get("u")
+}
+
+// StripHTMLToBudget removes heavy elements (videos, iframes, embedded objects, etc) from the HTML document, and if the
+// document still exceeds the budget, it removes scripts and style sheets too. As a last resort the document is
+// truncated to the budget, the cut never splits a tag, a character entity, or a UTF-8 character.
+func StripHTMLToBudget(html string, budget int) string {
+	for _, elements := range [][]*regexp.Regexp{proxyHeavyHTMLElements, proxyScriptStyleHTMLElements} {
+		for _, elem := range elements {
+			html = elem.ReplaceAllString(html, "")
+		}
+		if len(html) <= budget {
+			return html
+		}
+	}
+	html = lalog.TruncateStringAtRune(html, budget)
+	// Drop the tag that is cut short.
+	if lastOpen := strings.LastIndexByte(html, '<'); lastOpen > strings.LastIndexByte(html, '>') {
+		html = html[:lastOpen]
+	}
+	// Drop the character entity (e.g. "&amp;") that is cut short.
+	if lastAmp := strings.LastIndexByte(html, '&'); lastAmp >= 0 && !strings.ContainsAny(html[lastAmp:], "; \t\r\n>") {
+		html = html[:lastAmp]
+	}
+	return html
+}
+
+// TranscodeImage decodes a JPEG, PNG, or GIF image, downscales it to fit into the maximum width and height (if
+// maxDimension is greater than 0), and then encodes it in JPEG of the quality. If the transcoded image is not smaller
+// than the original, or the image cannot be decoded, or the image has more than ProxyMaxImagePixels pixels, the original
+// image is returned along with false.
+func TranscodeImage(original []byte, maxDimension, quality int) ([]byte, bool) {
+	// Check the dimensions before decoding the whole image.
+	config, _, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil || config.Width < 1 || config.Height < 1 || config.Width > ProxyMaxImagePixels/config.Height {
+		return original, false
+	}
+	img, _, err := image.Decode(bytes.NewReader(original))
+	if err != nil {
+		return original, false
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 {
+		return original, false
+	}
+	if maxDimension > 0 && (width > maxDimension || height > maxDimension) {
+		if width > height {
+			height = height * maxDimension / width
+			width = maxDimension
+		} else {
+			width = width * maxDimension / height
+			height = maxDimension
+		}
+		if width < 1 {
+			width = 1
+		}
+		if height < 1 {
+			height = 1
+		}
+	}
+	// JPEG does not support transparency, place the image on a white background.
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(scaled, scaled.Bounds(), image.White, image.Point{}, draw.Src)
+	downscaleBox(scaled, img)
+	if quality < 1 || quality > 100 {
+		quality = ProxyDefaultImageJPEGQuality
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: quality}); err != nil {
+		return original, false
+	}
+	if buf.Len() >= len(original) {
+		return original, false
+	}
+	return buf.Bytes(), true
+}
+
+// downscaleBox draws the source image onto the (smaller or equally sized) destination image, each destination pixel
+// takes the average colour of the source pixels it covers. The destination is expected to have an opaque background.
+func downscaleBox(dst *image.RGBA, src image.Image) {
+	srcBounds := src.Bounds()
+	dstWidth, dstHeight := dst.Bounds().Dx(), dst.Bounds().Dy()
+	for y := 0; y < dstHeight; y++ {
+		y0 := srcBounds.Min.Y + y*srcBounds.Dy()/dstHeight
+		y1 := srcBounds.Min.Y + (y+1)*srcBounds.Dy()/dstHeight
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dstWidth; x++ {
+			x0 := srcBounds.Min.X + x*srcBounds.Dx()/dstWidth
+			x1 := srcBounds.Min.X + (x+1)*srcBounds.Dx()/dstWidth
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			// The colour components are alpha-premultiplied, blend them over the white background.
+			bg := 0xffff - a/n
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r/n + bg) >> 8),
+				G: uint8((g/n + bg) >> 8),
+				B: uint8((b/n + bg) >> 8),
+				A: 0xff,
+			})
+		}
+	}
+}
+
+// isTranscodableImage returns true if the content type is an image format that TranscodeImage can decode.
+func isTranscodableImage(contentType string) bool {
+	for _, format := range []string{"image/jpeg", "image/png", "image/gif"} {
+		if strings.HasPrefix(contentType, format) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+func makeTestPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(rand.Intn(256)), G: uint8(x), B: uint8(y), A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTranscodeImage(t *testing.T) {
+	original := makeTestPNG(t, 400, 200)
+	transcoded, ok := TranscodeImage(original, 100, 30)
+	if !ok || len(transcoded) >= len(original) {
+		t.Fatal(ok, len(transcoded), len(original))
+	}
+	img, err := jpeg.Decode(bytes.NewReader(transcoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds := img.Bounds(); bounds.Dx() != 100 || bounds.Dy() != 50 {
+		t.Fatal(bounds)
+	}
+	// Not an image.
+	if out, ok := TranscodeImage([]byte("not an image"), 100, 30); ok || string(out) != "not an image" {
+		t.Fatal(ok, out)
+	}
+	// An image with too many pixels is not decoded.
+	huge := makeTestPNG(t, 1, 1)
+	// Overwrite the width in the IHDR chunk and fix up the chunk checksum.
+	binary.BigEndian.PutUint32(huge[16:20], ProxyMaxImagePixels+1)
+	binary.BigEndian.PutUint32(huge[29:33], crc32.ChecksumIEEE(huge[12:29]))
+	if config, err := png.DecodeConfig(bytes.NewReader(huge)); err != nil || config.Width != ProxyMaxImagePixels+1 {
+		t.Fatal(config, err)
+	}
+	if out, ok := TranscodeImage(huge, 100, 30); ok || !bytes.Equal(out, huge) {
+		t.Fatal(ok, len(out))
+	}
+}
+
+func TestStripHTMLToBudget(t *testing.T) {
+	page := `<html><head><script>var a=1;</script><style>p{}</style></head><body><video src="a.mp4"></video><IFRAME src="b"></IFRAME><p>hello</p></body></html>`
+	// A generous budget only strips heavy elements.
+	stripped := StripHTMLToBudget(page, 1000)
+	if stripped != `<html><head><script>var a=1;</script><style>p{}</style></head><body><p>hello</p></body></html>` {
+		t.Fatal(stripped)
+	}
+	// A tighter budget strips scripts and styles too.
+	stripped = StripHTMLToBudget(page, 60)
+	if stripped != `<html><head></head><body><p>hello</p></body></html>` {
+		t.Fatal(stripped)
+	}
+	// The last resort is to truncate.
+	if stripped = StripHTMLToBudget(page, 10); stripped != `<html>` {
+		t.Fatal(stripped)
+	}
+	// The cut does not split a character entity or a UTF-8 character.
+	if stripped = StripHTMLToBudget(`<p>a &amp; b</p>`, 8); stripped != `<p>a ` {
+		t.Fatal(stripped)
+	}
+	if stripped = StripHTMLToBudget(`<p>a &amp; b</p>`, 11); stripped != `<p>a &amp; ` {
+		t.Fatal(stripped)
+	}
+	if stripped = StripHTMLToBudget(`<p>你好</p>`, 8); stripped != `<p>你` {
+		t.Fatal(stripped)
+	}
+}
+
+func TestHandleWebProxy_PageByteBudget(t *testing.T) {
+	pngImage := makeTestPNG(t, 300, 300)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<html><head></head><body><video></video><img src="/img"/></body></html>`))
+		case "/img":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(pngImage)
+		case "/script":
+			w.Header().Set("Content-Type", "text/javascript")
+			_, _ = w.Write(bytes.Repeat([]byte{'a'}, 2000))
+		}
+	}))
+	defer remote.Close()
+
+	xy := &HandleWebProxy{OwnEndpoint: "/proxy", ImageMaxDimension: 50, PageByteBudget: 2000}
+	if err := xy.Initialise(&lalog.Logger{}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	pageURL := remote.URL + "/page"
+	proxyURL := func(target string) string {
+		return "http://laitos/proxy?u=" + url.QueryEscape(target)
+	}
+	get := func(target string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, proxyURL(target), nil)
+		req.Header.Set("Referer", proxyURL(pageURL))
+		w := httptest.NewRecorder()
+		xy.Handle(w, req)
+		return w.Result()
+	}
+
+	// The page's heavy elements are stripped.
+	resp := get(pageURL)
+	body, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(body), "<video>") || !strings.Contains(string(body), `<img src="/img"/>`) {
+		t.Fatal(string(body))
+	}
+	// The image is downscaled to fit the budget.
+	resp = get(remote.URL + "/img")
+	body, _ = io.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Type") != "image/jpeg" || len(body) > 2000 {
+		t.Fatal(resp.Header, len(body))
+	}
+	// The script no longer fits into the budget.
+	resp = get(remote.URL + "/script")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatal(resp.StatusCode)
+	}
+	// The budget is reset when the page loads again.
+	_ = get(pageURL)
+	resp = get(remote.URL + "/script")
+	if resp.StatusCode != http.StatusNoContent {
+		// The page itself and the script together exceed the budget.
+		t.Fatal(resp.StatusCode)
+	}
+	resp = get(remote.URL + "/img")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatal(resp.StatusCode, resp.Header)
+	}
+}
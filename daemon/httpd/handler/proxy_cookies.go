@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// ProxyCookieJarSession is the name of the session that keeps the cookies set by the proxied web sites.
+	ProxyCookieJarSession = "proxy-cookies"
+	// ProxyMaxCookies is the maximum number of cookies kept in the proxy cookie jar of each visitor.
+	ProxyMaxCookies = 64
+)
+
+// proxyCookie is a cookie set by a proxied web site, it is kept in the visitor's session.
+type proxyCookie struct {
+	Host    string `json:"h"`
+	Name    string `json:"n"`
+	Value   string `json:"v"`
+	Expires int64  `json:"e,omitempty"` // Expires is the expiry time in unix seconds, zero means the cookie lasts as long as the session.
+}
+
+/*
+proxyCookieJar keeps the cookies set by proxied web sites on behalf of the visitor. The cookies are matched by exact
+host name, which is a lot simpler than what the browsers do but is sufficient to keep the visitor signed into a web site.
+*/
+type proxyCookieJar []proxyCookie
+
+// header returns the value of Cookie header for a request to the host, or an empty string if there is no cookie.
+func (jar proxyCookieJar) header(host string, now time.Time) string {
+	var pairs []string
+	for _, cookie := range jar {
+		if cookie.Host == host && (cookie.Expires == 0 || cookie.Expires > now.Unix()) {
+			pairs = append(pairs, (&http.Cookie{Name: cookie.Name, Value: cookie.Value}).String())
+		}
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// update memorises the cookies set by the host in its response, and returns the updated jar along with whether the jar
+// has changed. Expired cookies are removed.
+func (jar proxyCookieJar) update(host string, setCookies []*http.Cookie, now time.Time) (proxyCookieJar, bool) {
+	changed := false
+	for _, setCookie := range setCookies {
+		var expires int64
+		if setCookie.MaxAge > 0 {
+			expires = now.Unix() + int64(setCookie.MaxAge)
+		} else if setCookie.MaxAge < 0 {
+			expires = -1
+		} else if !setCookie.Expires.IsZero() {
+			expires = setCookie.Expires.Unix()
+		}
+		// Replace the existing cookie of the same name
+		for i, cookie := range jar {
+			if cookie.Host == host && cookie.Name == setCookie.Name {
+				jar = append(jar[:i:i], jar[i+1:]...)
+				changed = true
+				break
+			}
+		}
+		if expires == 0 || expires > now.Unix() {
+			jar = append(jar, proxyCookie{Host: host, Name: setCookie.Name, Value: setCookie.Value, Expires: expires})
+			changed = true
+		}
+	}
+	// Forget the expired cookies and the oldest cookies in excess of the limit
+	unexpired := make(proxyCookieJar, 0, len(jar))
+	for _, cookie := range jar {
+		if cookie.Expires == 0 || cookie.Expires > now.Unix() {
+			unexpired = append(unexpired, cookie)
+		} else {
+			changed = true
+		}
+	}
+	if len(unexpired) > ProxyMaxCookies {
+		unexpired = unexpired[len(unexpired)-ProxyMaxCookies:]
+		changed = true
+	}
+	return unexpired, changed
+}
@@ -2,11 +2,16 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
@@ -34,20 +39,48 @@ const HandleRecurringCommandsSetupPage = `<html>
 </html>
 `
 
+// MaxRuntimeRecurringCommandChannels is the maximum number of recurring command channels that may be added at runtime.
+const MaxRuntimeRecurringCommandChannels = 32
+
 /*
 HandleRecurringCommands is an HTML form for user to manipulate recurring commands, such as adding/clearing transient
 commands and pushing text message directly into result.
+It also lets the recurring commands app add and remove channels at runtime, and persists those channels to a state file.
 */
 type HandleRecurringCommands struct {
-	RecurringCommands          map[string]*common.RecurringCommands `json:"RecurringCommands"` // are mappings between arbitrary ID string and associated command timer.
+	RecurringCommands map[string]*common.RecurringCommands `json:"RecurringCommands"` // are mappings between arbitrary ID string and associated command timer.
+	/*
+		StateFilePath is the path to a JSON file that persists the channels added at runtime, they are restored from the
+		file upon program startup. If it is empty, the channels added at runtime are lost upon program restart.
+	*/
+	StateFilePath string `json:"StateFilePath"`
+
+	runtimeChannels            map[string]bool // runtimeChannels are the names of channels added at runtime.
+	cmdProc                    *toolbox.CommandProcessor
+	mutex                      *sync.RWMutex
 	logger                     *lalog.Logger
 	stripURLPrefixFromResponse string
 }
 
 func (notif *HandleRecurringCommands) Initialise(logger *lalog.Logger, cmdProc *toolbox.CommandProcessor, stripURLPrefixFromResponse string) error {
 	notif.logger = logger
-	if notif.RecurringCommands == nil || len(notif.RecurringCommands) == 0 {
-		return fmt.Errorf("HandleRecurringCommands: there must be at least one recurring command channel in configuration")
+	notif.cmdProc = cmdProc
+	if notif.mutex == nil {
+		notif.mutex = new(sync.RWMutex)
+	}
+	notif.mutex.Lock()
+	defer notif.mutex.Unlock()
+	if notif.RecurringCommands == nil {
+		notif.RecurringCommands = make(map[string]*common.RecurringCommands)
+	}
+	if notif.runtimeChannels == nil {
+		notif.runtimeChannels = make(map[string]bool)
+	}
+	if err := notif.loadState(); err != nil {
+		return err
+	}
+	if len(notif.RecurringCommands) == 0 && notif.StateFilePath == "" {
+		return fmt.Errorf("HandleRecurringCommands: there must be at least one recurring command channel in configuration, or a StateFilePath for adding channels at runtime")
 	}
 	for _, timer := range notif.RecurringCommands {
 		timer.CommandProcessor = cmdProc
@@ -58,9 +91,166 @@ func (notif *HandleRecurringCommands) Initialise(logger *lalog.Logger, cmdProc *
 		// Because handlers do not have tear-down function, there is no way to stop them. Consider fixing this in the future?
 	}
 	notif.stripURLPrefixFromResponse = stripURLPrefixFromResponse
+	// Let the recurring commands app manage the channels
+	cmdProc.Features.RecurringCommands.SetChannels(notif)
 	return nil
 }
 
+// loadState restores the channels added at runtime from the state file. The caller must hold the mutex.
+func (notif *HandleRecurringCommands) loadState() error {
+	if notif.StateFilePath == "" {
+		return nil
+	}
+	content, err := os.ReadFile(notif.StateFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("HandleRecurringCommands: failed to read state file - %w", err)
+	}
+	var channels map[string]*common.RecurringCommands
+	if err := json.Unmarshal(content, &channels); err != nil {
+		return fmt.Errorf("HandleRecurringCommands: failed to parse state file - %w", err)
+	}
+	for name, timer := range channels {
+		if _, exists := notif.RecurringCommands[name]; exists {
+			if !notif.runtimeChannels[name] {
+				notif.logger.Warning(name, nil, "ignored the channel restored from state file because it is already configured in JSON")
+			}
+			continue
+		}
+		notif.RecurringCommands[name] = timer
+		notif.runtimeChannels[name] = true
+	}
+	return nil
+}
+
+// saveState writes the channels added at runtime into the state file. The caller must hold the mutex.
+func (notif *HandleRecurringCommands) saveState() error {
+	if notif.StateFilePath == "" {
+		return nil
+	}
+	channels := make(map[string]*common.RecurringCommands)
+	for name := range notif.runtimeChannels {
+		channels[name] = notif.RecurringCommands[name]
+	}
+	content, err := json.MarshalIndent(channels, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The commands carry the password PIN, hence the file must only be readable to the owner.
+	if err := os.WriteFile(notif.StateFilePath, content, 0600); err != nil {
+		return fmt.Errorf("failed to write state file - %w", err)
+	}
+	return nil
+}
+
+// ListChannels returns the summary of all channels sorted by name.
+func (notif *HandleRecurringCommands) ListChannels() []toolbox.RecurringCommandChannel {
+	notif.mutex.RLock()
+	defer notif.mutex.RUnlock()
+	ret := make([]toolbox.RecurringCommandChannel, 0, len(notif.RecurringCommands))
+	for name, timer := range notif.RecurringCommands {
+		ret = append(ret, toolbox.RecurringCommandChannel{
+			Name:        name,
+			IntervalSec: timer.IntervalSec,
+			MaxResults:  timer.MaxResults,
+			NumCommands: len(timer.PreConfiguredCommands) + len(timer.GetTransientCommands()),
+			Runtime:     notif.runtimeChannels[name],
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+// AddChannel adds a new channel at runtime and starts running its commands, which are added by AddChannelCommand.
+func (notif *HandleRecurringCommands) AddChannel(name string, intervalSec, maxResults int) error {
+	notif.mutex.Lock()
+	defer notif.mutex.Unlock()
+	if _, exists := notif.RecurringCommands[name]; exists {
+		return fmt.Errorf("channel %s already exists", name)
+	}
+	if len(notif.runtimeChannels) >= MaxRuntimeRecurringCommandChannels {
+		return fmt.Errorf("cannot add more than %d channels", MaxRuntimeRecurringCommandChannels)
+	}
+	timer := &common.RecurringCommands{
+		IntervalSec:      intervalSec,
+		MaxResults:       maxResults,
+		CommandProcessor: notif.cmdProc,
+	}
+	if err := timer.Initialise(); err != nil {
+		return err
+	}
+	notif.RecurringCommands[name] = timer
+	notif.runtimeChannels[name] = true
+	if err := notif.saveState(); err != nil {
+		delete(notif.RecurringCommands, name)
+		delete(notif.runtimeChannels, name)
+		return err
+	}
+	go timer.Start()
+	notif.logger.Info(name, nil, "added channel at runtime")
+	return nil
+}
+
+/*
+AddChannelCommand adds a command to a channel that was added at runtime. The command is persisted along with the channel,
+unlike the transient commands added by the HTML form.
+*/
+func (notif *HandleRecurringCommands) AddChannelCommand(name, cmd string) error {
+	notif.mutex.Lock()
+	defer notif.mutex.Unlock()
+	timer, exists := notif.RecurringCommands[name]
+	if !exists {
+		return fmt.Errorf("cannot find channel %s", name)
+	}
+	if !notif.runtimeChannels[name] {
+		return fmt.Errorf("channel %s is configured in JSON", name)
+	}
+	// The timer may be running the existing commands, hence give it a new slice instead of appending in-place.
+	oldCommands := timer.PreConfiguredCommands
+	newCommands := make([]string, 0, len(oldCommands)+1)
+	newCommands = append(newCommands, oldCommands...)
+	newCommands = append(newCommands, cmd)
+	timer.SetPreConfiguredCommands(newCommands)
+	if err := notif.saveState(); err != nil {
+		timer.SetPreConfiguredCommands(oldCommands)
+		return err
+	}
+	return nil
+}
+
+// RemoveChannel stops and removes a channel that was added at runtime.
+func (notif *HandleRecurringCommands) RemoveChannel(name string) error {
+	notif.mutex.Lock()
+	defer notif.mutex.Unlock()
+	timer, exists := notif.RecurringCommands[name]
+	if !exists {
+		return fmt.Errorf("cannot find channel %s", name)
+	}
+	if !notif.runtimeChannels[name] {
+		return fmt.Errorf("channel %s is configured in JSON", name)
+	}
+	delete(notif.RecurringCommands, name)
+	delete(notif.runtimeChannels, name)
+	if err := notif.saveState(); err != nil {
+		notif.RecurringCommands[name] = timer
+		notif.runtimeChannels[name] = true
+		return err
+	}
+	timer.Stop()
+	notif.logger.Info(name, nil, "removed channel at runtime")
+	return nil
+}
+
+// getChannel returns the recurring commands of the channel, or nil if the channel does not exist.
+func (notif *HandleRecurringCommands) getChannel(name string) *common.RecurringCommands {
+	notif.mutex.RLock()
+	defer notif.mutex.RUnlock()
+	return notif.RecurringCommands[name]
+}
+
 func (_ *HandleRecurringCommands) GetRateLimitFactor() int {
 	return 4
 }
@@ -84,8 +274,7 @@ func (notif *HandleRecurringCommands) Handle(w http.ResponseWriter, r *http.Requ
 				conclusion = "Please enter pre-configured channel ID."
 			} else if newCommand != "" {
 				// Store a new command
-				timer, exists := notif.RecurringCommands[channel]
-				if exists {
+				if timer := notif.getChannel(channel); timer != nil {
 					timer.AddTransientCommand(newCommand)
 					conclusion = "Successfully stored new command: " + newCommand
 				} else {
@@ -93,8 +282,7 @@ func (notif *HandleRecurringCommands) Handle(w http.ResponseWriter, r *http.Requ
 				}
 			} else if textToStore != "" {
 				// Store arbitrary text message
-				timer, exists := notif.RecurringCommands[channel]
-				if exists {
+				if timer := notif.getChannel(channel); timer != nil {
 					timer.AddArbitraryTextToResult(textToStore)
 					conclusion = "Successfully stored text message: " + textToStore
 				} else {
@@ -104,8 +292,7 @@ func (notif *HandleRecurringCommands) Handle(w http.ResponseWriter, r *http.Requ
 				conclusion = "Please enter a new command or text message to store."
 			}
 		case "Clear all entered commands":
-			timer, exists := notif.RecurringCommands[channel]
-			if exists {
+			if timer := notif.getChannel(channel); timer != nil {
 				timer.ClearTransientCommands()
 				conclusion = "All newly stored commands have been cleared for: " + channel
 			} else {
@@ -118,17 +305,16 @@ func (notif *HandleRecurringCommands) Handle(w http.ResponseWriter, r *http.Requ
 	} else {
 
 		// Retrieve results in JSON format
-		timer, exists := notif.RecurringCommands[retrieveFromChannel]
-		if exists {
+		if timer := notif.getChannel(retrieveFromChannel); timer != nil {
 			resp, err := json.Marshal(timer.GetResults())
 			if err == nil {
 				w.Header().Set("Content-Type", "application/json")
 				_, _ = w.Write(resp)
 			} else {
-				http.Error(w, "JSON serialisation failure: "+err.Error(), http.StatusInternalServerError)
+				middleware.WriteError(w, r, http.StatusInternalServerError, "JSON serialisation failure: "+err.Error())
 			}
 		} else {
-			http.Error(w, "Cannot find channel ID: "+retrieveFromChannel, http.StatusNotFound)
+			middleware.WriteError(w, r, http.StatusNotFound, "Cannot find channel ID: "+retrieveFromChannel)
 		}
 	}
 }
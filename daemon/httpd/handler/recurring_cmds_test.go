@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleRecurringCommands_RuntimeChannels(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "recurring_cmds.json")
+	hand := &HandleRecurringCommands{}
+	require.Error(t, hand.Initialise(&lalog.Logger{}, toolbox.GetTestCommandProcessor(), ""))
+
+	cmdProc := toolbox.GetTestCommandProcessor()
+	hand = &HandleRecurringCommands{
+		RecurringCommands: map[string]*common.RecurringCommands{
+			"json": {IntervalSec: 1, MaxResults: 1},
+		},
+		StateFilePath: stateFile,
+	}
+	require.NoError(t, hand.Initialise(&lalog.Logger{}, cmdProc, ""))
+	// The recurring commands app manages the channels
+	runCmd := func(cmd string) *toolbox.Result {
+		return cmdProc.Process(context.Background(), toolbox.Command{
+			DaemonName: "test",
+			TimeoutSec: 10,
+			Content:    toolbox.TestCommandProcessorPIN + ".rc " + cmd,
+		}, true)
+	}
+	require.NoError(t, runCmd("add chan 1 10").Error)
+	require.Error(t, runCmd("add chan 1 10").Error)
+	require.Error(t, runCmd("add json 1 10").Error)
+	require.NoError(t, runCmd("cmd chan "+toolbox.TestCommandProcessorPIN+".s echo hi").Error)
+	require.Error(t, runCmd("cmd json .s echo hi").Error)
+	require.Error(t, runCmd("rm json").Error)
+	require.Equal(t, []toolbox.RecurringCommandChannel{
+		{Name: "chan", IntervalSec: 1, MaxResults: 10, NumCommands: 1, Runtime: true},
+		{Name: "json", IntervalSec: 1, MaxResults: 1},
+	}, hand.ListChannels())
+	// The commands of the new channel run at regular interval
+	time.Sleep(2 * time.Second)
+	require.Contains(t, hand.getChannel("chan").GetResults(), "hi\n")
+
+	// The runtime channel is restored from the state file
+	restored := &HandleRecurringCommands{StateFilePath: stateFile}
+	require.NoError(t, restored.Initialise(&lalog.Logger{}, toolbox.GetTestCommandProcessor(), ""))
+	require.Equal(t, []toolbox.RecurringCommandChannel{
+		{Name: "chan", IntervalSec: 1, MaxResults: 10, NumCommands: 1, Runtime: true},
+	}, restored.ListChannels())
+	restored.getChannel("chan").Stop()
+
+	// Remove the runtime channel
+	require.NoError(t, runCmd("rm chan").Error)
+	require.Error(t, runCmd("rm chan").Error)
+	restored = &HandleRecurringCommands{StateFilePath: stateFile}
+	require.NoError(t, restored.Initialise(&lalog.Logger{}, toolbox.GetTestCommandProcessor(), ""))
+	require.Empty(t, restored.ListChannels())
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/platform"
 	"github.com/HouzuoGuo/laitos/remotevm"
@@ -25,6 +26,11 @@ const (
 	*/
 	DefaultLinuxDistributionURL = "http://distro.ibiblio.org/puppylinux/puppy-fossa/fossapup64-9.5.iso"
 
+	// DefaultFilmstripFrames is the default number of screenshots in a filmstrip.
+	DefaultFilmstripFrames = 8
+	// DefaultFilmstripIntervalMS is the default interval in milliseconds between filmstrip screenshots.
+	DefaultFilmstripIntervalMS = 500
+
 	// HandleVirtualMachinePage is the web template of the virtual machine remote control.
 	HandleVirtualMachinePage = `<html>
 <head>
@@ -54,6 +60,7 @@ const (
 		ISO URL:<input type="text" name="iso_url" value="%s"/>
 		<input type="submit" name="action" value="Start"/>
 		<input type="submit" name="action" value="Kill"/>
+		<a href="%s" target="_blank">Serial console</a>
 	</p>
 	<p>
 		Mouse:
@@ -73,26 +80,35 @@ const (
 		<input type="submit" name="action" value="Press One By One"/>
 		Codes: <input type="text" name="press_keys" value="%s" size="50"/> (e.g. ctrl shift s)
 	</p>
+	<p>
+		Filmstrip:
+		<input type="submit" name="action" value="Record Filmstrip"/>
+		Frames:<input type="text" name="filmstrip_frames" value="%d" size="2"/>
+		Interval (ms):<input type="text" name="filmstrip_interval_ms" value="%d" size="4"/>
+		(press the key codes one by one and then take timed screenshots, e.g. "ret" to load the URL typed into the browser)
+	</p>
 	<p>
 		Useful key codes:
 		f1-f12, 1-9, a-z, minus, equal, bracket_left, bracket_right, backslash<br/>
 		semicolon, apostrophe, comma, dot, slash, esc, backspace, tab, ret, spc<br/>
 		ctrl, shift, alt, up, down, left, right, home, end, pgup, pgdn, insert, delete<br/>
 	</p>
-	<p><img id="render" src="%s?rand=%d" alt="virtual machine screen" onclick="set_pointer_coord(event);"/></p>
+	<p><img id="render" src="%s?rand=%d%s" alt="virtual machine screen" onclick="set_pointer_coord(event);"/></p>
 </form>
 </body>
 </html>`
 )
 
-// HandleVirtualMachine is an HTTP handler that offers remote virtual machine controls, excluding the screenshot itself.
+// HandleVirtualMachine is an HTTP handler that offers remote virtual machine controls, excluding the screenshot and serial console themselves.
 type HandleVirtualMachine struct {
-	LocalUtilityPortNumber     int                             `json:"LocalUtilityPortNumber"`
-	ScreenshotEndpoint         string                          `json:"-"`
-	ScreenshotHandlerInstance  *HandleVirtualMachineScreenshot `json:"-"`
-	VM                         *remotevm.VM                    `json:"-"`
-	stripURLPrefixFromResponse string
-	logger                     *lalog.Logger
+	LocalUtilityPortNumber       int                                `json:"LocalUtilityPortNumber"`
+	ScreenshotEndpoint           string                             `json:"-"`
+	ScreenshotHandlerInstance    *HandleVirtualMachineScreenshot    `json:"-"`
+	SerialConsoleEndpoint        string                             `json:"-"`
+	SerialConsoleHandlerInstance *HandleVirtualMachineSerialConsole `json:"-"`
+	VM                           *remotevm.VM                       `json:"-"`
+	stripURLPrefixFromResponse   string
+	logger                       *lalog.Logger
 }
 
 // Initialise internal state of the HTTP handler.
@@ -115,12 +131,17 @@ func (handler *HandleVirtualMachine) Initialise(logger *lalog.Logger, _ *toolbox
 		MemSizeMB: memSizeMB,
 		// The TCP port for interacting with emulator comes from user configuration input
 		QMPPort: handler.LocalUtilityPortNumber,
+		// The serial console uses the port number right after
+		SerialPort: handler.LocalUtilityPortNumber + 1,
 	}
 	if err := handler.VM.Initialise(); err != nil {
 		return err
 	}
 	// Screenshots are taken from the same VM
 	handler.ScreenshotHandlerInstance.VM = handler.VM
+	if handler.SerialConsoleHandlerInstance != nil {
+		handler.SerialConsoleHandlerInstance.VM = handler.VM
+	}
 	handler.stripURLPrefixFromResponse = stripURLPrefixFromResponse
 	return nil
 }
@@ -129,26 +150,29 @@ func (handler *HandleVirtualMachine) Initialise(logger *lalog.Logger, _ *toolbox
 renderRemoteVMPage renders the HTML page that offers virtual machine control.
 Virtual machine screenshot sits in a <img> tag, though the image data is served by a differe, dedicated handler.
 */
-func (handler *HandleVirtualMachine) renderRemoteVMPage(requestURL string, err error, isoURL string, pointerX, pointerY int, pressKeys string) []byte {
+func (handler *HandleVirtualMachine) renderRemoteVMPage(requestURL string, err error, isoURL string, pointerX, pointerY int, pressKeys string, filmstripFrames, filmstripIntervalMS int, screenshotQuery string) []byte {
 	var errStr string
 	if err != nil {
 		errStr = err.Error()
 	}
 	return []byte(fmt.Sprintf(HandleVirtualMachinePage,
 		requestURL, errStr, handler.VM.GetDebugOutput(),
-		isoURL,
+		isoURL, strings.TrimPrefix(handler.SerialConsoleEndpoint, handler.stripURLPrefixFromResponse),
 		pointerX, pointerY,
 		pressKeys,
-		strings.TrimPrefix(handler.ScreenshotEndpoint, handler.stripURLPrefixFromResponse), time.Now().UnixNano()))
+		filmstripFrames, filmstripIntervalMS,
+		strings.TrimPrefix(handler.ScreenshotEndpoint, handler.stripURLPrefixFromResponse), time.Now().UnixNano(), screenshotQuery))
 }
 
 // parseSubmission reads form action (button) and form text fields input.
-func (handler *HandleVirtualMachine) parseSubmission(r *http.Request) (button, isoURL string, pointerX, pointerY int, pressKeys string) {
+func (handler *HandleVirtualMachine) parseSubmission(r *http.Request) (button, isoURL string, pointerX, pointerY int, pressKeys string, filmstripFrames, filmstripIntervalMS int) {
 	button = r.FormValue("action")
 	isoURL = r.FormValue("iso_url")
 	pointerX, _ = strconv.Atoi(r.FormValue("pointer_x"))
 	pointerY, _ = strconv.Atoi(r.FormValue("pointer_y"))
 	pressKeys = r.FormValue("press_keys")
+	filmstripFrames, _ = strconv.Atoi(r.FormValue("filmstrip_frames"))
+	filmstripIntervalMS, _ = strconv.Atoi(r.FormValue("filmstrip_interval_ms"))
 	return
 }
 
@@ -168,11 +192,12 @@ func (handler *HandleVirtualMachine) Handle(w http.ResponseWriter, r *http.Reque
 	NoCache(w)
 	if r.Method == http.MethodGet {
 		// Display the web page. Suggest user to download the default Linux distribution.
-		_, _ = w.Write(handler.renderRemoteVMPage(strings.TrimPrefix(r.RequestURI, handler.stripURLPrefixFromResponse), nil, DefaultLinuxDistributionURL, 0, 0, ""))
+		_, _ = w.Write(handler.renderRemoteVMPage(strings.TrimPrefix(r.RequestURI, handler.stripURLPrefixFromResponse), nil, DefaultLinuxDistributionURL, 0, 0, "", DefaultFilmstripFrames, DefaultFilmstripIntervalMS, ""))
 	} else if r.Method == http.MethodPost {
 		// Handle buttons
-		button, isoURL, pointerX, pointerY, pressKeys := handler.parseSubmission(r)
+		button, isoURL, pointerX, pointerY, pressKeys, filmstripFrames, filmstripIntervalMS := handler.parseSubmission(r)
 		var actionErr error
+		var screenshotQuery string
 		switch button {
 		case "Refresh Screen":
 			// Simply re-render the page, including the screenshot. No extra action is required.
@@ -247,10 +272,24 @@ func (handler *HandleVirtualMachine) Handle(w http.ResponseWriter, r *http.Reque
 			if len(keys) > 0 {
 				actionErr = handler.VM.PressKeysOneByOne(keys...)
 			}
+		case "Record Filmstrip":
+			if filmstripFrames < 1 || filmstripFrames > remotevm.MaxFilmstripFrames {
+				actionErr = fmt.Errorf("The number of frames must be within [1, %d]", remotevm.MaxFilmstripFrames)
+				break
+			}
+			if filmstripIntervalMS < remotevm.MinFilmstripIntervalMS || filmstripIntervalMS > remotevm.MaxFilmstripIntervalMS {
+				actionErr = fmt.Errorf("The interval must be within [%d, %d] milliseconds", remotevm.MinFilmstripIntervalMS, remotevm.MaxFilmstripIntervalMS)
+				break
+			}
+			if keys := regexp.MustCompile(`[a-zA-Z0-9_]+`).FindAllString(pressKeys, -1); len(keys) > 0 {
+				actionErr = handler.VM.PressKeysOneByOne(keys...)
+			}
+			// The screenshot handler takes the timed screenshots as soon as the browser loads the image
+			screenshotQuery = fmt.Sprintf("&frames=%d&interval_ms=%d", filmstripFrames, filmstripIntervalMS)
 		default:
 			actionErr = fmt.Errorf("Unknown button action: %s", button)
 		}
-		_, _ = w.Write(handler.renderRemoteVMPage(strings.TrimPrefix(r.RequestURI, handler.stripURLPrefixFromResponse), actionErr, isoURL, pointerX, pointerY, pressKeys))
+		_, _ = w.Write(handler.renderRemoteVMPage(strings.TrimPrefix(r.RequestURI, handler.stripURLPrefixFromResponse), actionErr, isoURL, pointerX, pointerY, pressKeys, filmstripFrames, filmstripIntervalMS, screenshotQuery))
 	}
 }
 
@@ -275,24 +314,33 @@ func (_ *HandleVirtualMachineScreenshot) Initialise(*lalog.Logger, *toolbox.Comm
 	return nil
 }
 
-// Handle takes a virtual machine screenshot and responds with JPEG image data completed with appropriate HTTP headers.
+/*
+Handle takes a virtual machine screenshot and responds with JPEG image data completed with appropriate HTTP headers.
+If the request specifies the number of "frames" and "interval_ms", the response is a filmstrip of timed screenshots instead.
+*/
 func (handler *HandleVirtualMachineScreenshot) Handle(w http.ResponseWriter, r *http.Request) {
 	NoCache(w)
 	// Store screenshot picture in a temporary file
 	screenshot, err := os.CreateTemp("", "laitos-handle-vm-screenshot")
 	if err != nil {
-		http.Error(w, "Failed to create temporary file: "+err.Error(), http.StatusInternalServerError)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "Failed to create temporary file: "+err.Error())
 		return
 	}
 	_ = screenshot.Close()
 	defer os.Remove(screenshot.Name())
-	if err := handler.VM.TakeScreenshot(screenshot.Name()); err != nil {
-		http.Error(w, "Failed to create temporary file: "+err.Error(), http.StatusInternalServerError)
+	if numFrames, _ := strconv.Atoi(r.FormValue("frames")); numFrames > 0 {
+		intervalMS, _ := strconv.Atoi(r.FormValue("interval_ms"))
+		if err := handler.VM.TakeFilmstrip(screenshot.Name(), numFrames, time.Duration(intervalMS)*time.Millisecond); err != nil {
+			middleware.WriteError(w, r, http.StatusInternalServerError, "Failed to take filmstrip: "+err.Error())
+			return
+		}
+	} else if err := handler.VM.TakeScreenshot(screenshot.Name()); err != nil {
+		middleware.WriteError(w, r, http.StatusInternalServerError, "Failed to create temporary file: "+err.Error())
 		return
 	}
 	jpegContent, err := os.ReadFile(screenshot.Name())
 	if err != nil {
-		http.Error(w, "Failed to read screenshot file: "+err.Error(), http.StatusInternalServerError)
+		middleware.WriteError(w, r, http.StatusInternalServerError, "Failed to read screenshot file: "+err.Error())
 		return
 	}
 	w.Header().Set("Content-Type", "image/jpeg")
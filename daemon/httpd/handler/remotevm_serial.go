@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/remotevm"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// SerialConsoleMaxSessionSec is the maximum duration of a serial console session, after which the browser has to reconnect.
+	SerialConsoleMaxSessionSec = 3 * 3600
+
+	// HandleVirtualMachineSerialConsolePage is the web page that renders the serial console in a terminal emulator.
+	HandleVirtualMachineSerialConsolePage = `<html>
+<head>
+    <title>laitos remote virtual machine serial console</title>
+    <link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/xterm@5.3.0/css/xterm.css"/>
+    <script type="text/javascript" src="https://cdn.jsdelivr.net/npm/xterm@5.3.0/lib/xterm.js"></script>
+</head>
+<body>
+<p>
+    The OS of the virtual machine should run a login terminal on its first serial port (e.g. with boot parameter console=ttyS0).
+    Press Enter to wake up the terminal.
+</p>
+<div id="terminal"></div>
+<script type="text/javascript">
+    var term = new Terminal({cols: 120, rows: 40});
+    term.open(document.getElementById('terminal'));
+    var ws = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + location.pathname);
+    ws.binaryType = 'arraybuffer';
+    ws.onmessage = function (ev) {
+        term.write(new Uint8Array(ev.data));
+    };
+    ws.onclose = function () {
+        term.write('\r\n[serial console disconnected, reload the page to reconnect]\r\n');
+    };
+    term.onData(function (data) {
+        if (ws.readyState === WebSocket.OPEN) {
+            ws.send(data);
+        }
+    });
+    term.focus();
+</script>
+</body>
+</html>`
+)
+
+// HandleVirtualMachineSerialConsole is an HTTP handler that streams the serial console of remote virtual machine over WebSocket.
+type HandleVirtualMachineSerialConsole struct {
+	VM *remotevm.VM `json:"-"`
+
+	logger *lalog.Logger
+}
+
+// Initialise prepares the handler logger, the VM is given to the handler by HandleVirtualMachine.Initialise.
+func (handler *HandleVirtualMachineSerialConsole) Initialise(logger *lalog.Logger, _ *toolbox.CommandProcessor, _ string) error {
+	handler.logger = logger
+	return nil
+}
+
+// verifySameOrigin prevents another web site from opening the serial console in a visitor's browser.
+func verifySameOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil || origin == nil || !strings.EqualFold(origin.Host, r.Host) {
+		return errors.New("HandleVirtualMachineSerialConsole: origin of the request does not match the host")
+	}
+	return nil
+}
+
+// pipeSerialConsole copies the input from the browser to the serial console, and the serial console output to the browser.
+func (handler *HandleVirtualMachineSerialConsole) pipeSerialConsole(ws *websocket.Conn) {
+	defer func() {
+		_ = ws.Close()
+	}()
+	ws.PayloadType = websocket.BinaryFrame
+	// The hijacked connection may carry the deadline of the web server, which is too short for an interactive session.
+	handler.logger.MaybeMinorError(ws.SetDeadline(time.Now().Add(SerialConsoleMaxSessionSec * time.Second)))
+	serial, err := handler.VM.ConnectSerialConsole()
+	if err != nil {
+		_, _ = ws.Write([]byte(err.Error() + "\r\n"))
+		return
+	}
+	defer func() {
+		_ = serial.Close()
+	}()
+	handler.logger.Info(ws.Request().RemoteAddr, nil, "serial console session has started")
+	go func() {
+		_, _ = io.Copy(serial, ws)
+		// Closing the serial console connection terminates the copy in the opposite direction
+		_ = serial.Close()
+	}()
+	_, _ = io.Copy(ws, serial)
+	handler.logger.Info(ws.Request().RemoteAddr, nil, "serial console session has ended")
+}
+
+// Handle renders the terminal emulator page, or streams the serial console to a WebSocket client.
+func (handler *HandleVirtualMachineSerialConsole) Handle(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		NoCache(w)
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		_, _ = w.Write([]byte(HandleVirtualMachineSerialConsolePage))
+		return
+	}
+	server := websocket.Server{Handshake: verifySameOrigin, Handler: handler.pipeSerialConsole}
+	server.ServeHTTP(w, r)
+}
+
+// GetRateLimitFactor returns 1, as a serial console session is long-lived.
+func (_ *HandleVirtualMachineSerialConsole) GetRateLimitFactor() int {
+	return 1
+}
+
+// SelfTest is not applicable to this HTTP handler.
+func (_ *HandleVirtualMachineSerialConsole) SelfTest() error {
+	return nil
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/remotevm"
+	"golang.org/x/net/websocket"
+)
+
+func TestHandleVirtualMachineSerialConsole(t *testing.T) {
+	// Pretend to be the emulator serial console by echoing each line in upper case
+	serialListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serialListener.Close()
+	go func() {
+		for {
+			conn, err := serialListener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				_, _ = conn.Write([]byte("login: "))
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\r')
+					if err != nil {
+						return
+					}
+					_, _ = conn.Write([]byte(strings.ToUpper(line)))
+				}
+			}(conn)
+		}
+	}()
+
+	vm := &remotevm.VM{SerialPort: serialListener.Addr().(*net.TCPAddr).Port}
+	if err := vm.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	handler := &HandleVirtualMachineSerialConsole{VM: vm}
+	if err := handler.Initialise(&lalog.Logger{}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(handler.Handle))
+	defer server.Close()
+
+	// Without an upgrade request the handler renders the terminal page
+	resp, err := http.Get(server.URL + "/serial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if !strings.Contains(string(page), "new WebSocket(") {
+		t.Fatal(string(page))
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/serial"
+	// Another web site must not open the serial console
+	if _, err := websocket.Dial(wsURL, "", "http://evil.example.com"); err == nil {
+		t.Fatal("should have rejected the foreign origin")
+	}
+	ws, err := websocket.Dial(wsURL, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_ = ws.SetDeadline(time.Now().Add(5 * time.Second))
+	readUntil := func(want string) {
+		var received string
+		buf := make([]byte, 64)
+		for !strings.Contains(received, want) {
+			n, err := ws.Read(buf)
+			if err != nil {
+				t.Fatal(received, err)
+			}
+			received += string(buf[:n])
+		}
+	}
+	readUntil("login: ")
+	if _, err := ws.Write([]byte("root\r")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil("ROOT\r")
+
+	// The handler tells the browser when the serial console is unavailable
+	handler.VM = &remotevm.VM{}
+	_ = handler.VM.Initialise()
+	ws2, err := websocket.Dial(wsURL, "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws2.Close()
+	_ = ws2.SetDeadline(time.Now().Add(5 * time.Second))
+	msg, _ := io.ReadAll(ws2)
+	if !strings.Contains(string(msg), "serial console is not configured") {
+		t.Fatal(string(msg))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
@@ -36,7 +37,7 @@ func (_ *HandleRequestInspector) Handle(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 	dump, err := httputil.DumpRequest(r, true)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("failed to dump request - %v", err), http.StatusInternalServerError)
+		middleware.WriteError(w, r, http.StatusInternalServerError, fmt.Sprintf("failed to dump request - %v", err))
 		return
 	}
 	_, _ = w.Write(dump)
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const (
+	// DefaultReverseProxyTimeoutSec is the default timeout of connecting to an upstream and waiting for its response header.
+	DefaultReverseProxyTimeoutSec = 30
+	/*
+		ReverseProxyMaxDurationSec is the maximum duration of a request forwarded to an upstream, including the transfer of
+		the response body and the WebSocket session. It is much longer than the IO timeout of the web server.
+	*/
+	ReverseProxyMaxDurationSec = 3 * 3600
+)
+
+// ReverseProxyUpstream is a web server (e.g. a small service on the same host) that serves the requests of a path prefix.
+type ReverseProxyUpstream struct {
+	// URL is the base URL of the upstream, e.g. "http://localhost:3000". The request path is appended to its path.
+	URL string `json:"URL"`
+	// StripPrefix removes the path prefix from the request path before the request is forwarded to the upstream.
+	StripPrefix bool `json:"StripPrefix"`
+	/*
+		TimeoutSec is the timeout of connecting to the upstream and waiting for its response header. It does not limit
+		the duration of the response body transfer, hence the downloads and WebSocket sessions may last longer.
+	*/
+	TimeoutSec int `json:"TimeoutSec"`
+	// RequestHeaders are set on the requests forwarded to the upstream. A header of empty value is removed instead.
+	RequestHeaders map[string]string `json:"RequestHeaders"`
+	// ResponseHeaders are set on the responses from the upstream. A header of empty value is removed instead.
+	ResponseHeaders map[string]string `json:"ResponseHeaders"`
+
+	prefix string
+	target *url.URL
+	proxy  *httputil.ReverseProxy
+}
+
+/*
+HandleReverseProxy forwards the requests to the upstream web servers by the longest matching path prefix, in the same
+way as a reverse proxy such as nginx. The WebSocket connections are passed through to the upstream as well.
+*/
+type HandleReverseProxy struct {
+	// Upstreams are keyed by path prefix, e.g. "/grafana/". A prefix always ends with a slash.
+	Upstreams map[string]*ReverseProxyUpstream `json:"Upstreams"`
+
+	// prefixes are the path prefixes sorted from the longest to the shortest.
+	prefixes    []string
+	logger      *lalog.Logger
+	stripPrefix string
+}
+
+// Locations returns the URL locations (path prefixes) of the upstreams.
+func (hand *HandleReverseProxy) Locations() (ret []string) {
+	for prefix := range hand.Upstreams {
+		ret = append(ret, normaliseReverseProxyPrefix(prefix))
+	}
+	sort.Strings(ret)
+	return
+}
+
+// normaliseReverseProxyPrefix returns the path prefix that starts and ends with a slash.
+func normaliseReverseProxyPrefix(prefix string) string {
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix
+}
+
+func (hand *HandleReverseProxy) Initialise(logger *lalog.Logger, _ *toolbox.CommandProcessor, stripPrefix string) error {
+	hand.logger = logger
+	hand.stripPrefix = stripPrefix
+	if len(hand.Upstreams) == 0 {
+		return errors.New("HandleReverseProxy.Initialise: there must be at least one upstream")
+	}
+	upstreams := make(map[string]*ReverseProxyUpstream)
+	hand.prefixes = nil
+	for prefix, upstream := range hand.Upstreams {
+		if upstream == nil {
+			return fmt.Errorf("HandleReverseProxy.Initialise: upstream of prefix \"%s\" must not be empty", prefix)
+		}
+		upstream.prefix = normaliseReverseProxyPrefix(prefix)
+		if err := hand.initialiseUpstream(upstream); err != nil {
+			return err
+		}
+		upstreams[upstream.prefix] = upstream
+		hand.prefixes = append(hand.prefixes, upstream.prefix)
+	}
+	hand.Upstreams = upstreams
+	sort.Slice(hand.prefixes, func(i, j int) bool {
+		return len(hand.prefixes[i]) > len(hand.prefixes[j])
+	})
+	return nil
+}
+
+// initialiseUpstream validates the upstream configuration and prepares its reverse proxy.
+func (hand *HandleReverseProxy) initialiseUpstream(upstream *ReverseProxyUpstream) error {
+	target, err := url.Parse(upstream.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("HandleReverseProxy.Initialise: URL \"%s\" of prefix \"%s\" must be an absolute http(s) URL", upstream.URL, upstream.prefix)
+	}
+	if upstream.TimeoutSec < 1 {
+		upstream.TimeoutSec = DefaultReverseProxyTimeoutSec
+	}
+	upstream.target = target
+	timeout := time.Duration(upstream.TimeoutSec) * time.Second
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSClientConfig = misc.DefaultTLS.ClientConfig(target.Host)
+	transport.ResponseHeaderTimeout = timeout
+	upstream.proxy = &httputil.ReverseProxy{
+		Rewrite:   func(pr *httputil.ProxyRequest) { hand.rewriteRequest(upstream, pr) },
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			setReverseProxyHeaders(resp.Header, upstream.ResponseHeaders)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			hand.logger.Warning(middleware.GetRealClientIP(r), err, "failed to forward %s %s to upstream %s", r.Method, r.URL.Path, upstream.URL)
+			var netErr net.Error
+			if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				middleware.WriteError(w, r, http.StatusGatewayTimeout, "upstream did not respond in time")
+			} else {
+				middleware.WriteError(w, r, http.StatusBadGateway, "upstream is unavailable")
+			}
+		},
+	}
+	return nil
+}
+
+// rewriteRequest turns the incoming request into the request destined to the upstream.
+func (hand *HandleReverseProxy) rewriteRequest(upstream *ReverseProxyUpstream, pr *httputil.ProxyRequest) {
+	path := hand.getPath(pr.In)
+	if upstream.StripPrefix {
+		path = "/" + strings.TrimPrefix(path, upstream.prefix)
+	}
+	pr.Out.URL.Scheme = upstream.target.Scheme
+	pr.Out.URL.Host = upstream.target.Host
+	pr.Out.URL.Path = strings.TrimSuffix(upstream.target.Path, "/") + path
+	pr.Out.URL.RawPath = ""
+	pr.Out.URL.RawQuery = pr.In.URL.RawQuery
+	// The upstream sees its own host name by default
+	pr.Out.Host = ""
+	pr.Out.Header.Set("X-Forwarded-For", middleware.GetRealClientIP(pr.In))
+	pr.Out.Header.Set("X-Forwarded-Host", pr.In.Host)
+	if pr.In.TLS == nil {
+		pr.Out.Header.Set("X-Forwarded-Proto", "http")
+	} else {
+		pr.Out.Header.Set("X-Forwarded-Proto", "https")
+	}
+	for name, value := range upstream.RequestHeaders {
+		if strings.EqualFold(name, "Host") {
+			pr.Out.Host = value
+		}
+	}
+	setReverseProxyHeaders(pr.Out.Header, upstream.RequestHeaders)
+}
+
+// setReverseProxyHeaders sets the headers, or removes those of empty value.
+func setReverseProxyHeaders(header http.Header, values map[string]string) {
+	for name, value := range values {
+		if value == "" {
+			header.Del(name)
+		} else {
+			header.Set(name, value)
+		}
+	}
+}
+
+// getPath returns the request path without the prefix added by API gateway (e.g. lambda stage name).
+func (hand *HandleReverseProxy) getPath(r *http.Request) string {
+	if hand.stripPrefix != "" && strings.HasPrefix(r.URL.Path, hand.stripPrefix+"/") {
+		return strings.TrimPrefix(r.URL.Path, hand.stripPrefix)
+	}
+	return r.URL.Path
+}
+
+func (hand *HandleReverseProxy) Handle(w http.ResponseWriter, r *http.Request) {
+	path := hand.getPath(r)
+	for _, prefix := range hand.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			// The deadlines of the connection carry over to the WebSocket session after the reverse proxy hijacks it.
+			deadline := time.Now().Add(ReverseProxyMaxDurationSec * time.Second)
+			controller := http.NewResponseController(w)
+			if err := controller.SetReadDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				hand.logger.Warning(middleware.GetRealClientIP(r), err, "failed to extend the read deadline")
+			}
+			if err := controller.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				hand.logger.Warning(middleware.GetRealClientIP(r), err, "failed to extend the write deadline")
+			}
+			hand.Upstreams[prefix].proxy.ServeHTTP(w, r)
+			return
+		}
+	}
+	middleware.WriteError(w, r, http.StatusNotFound, "there is no upstream for the path")
+}
+
+func (*HandleReverseProxy) GetRateLimitFactor() int {
+	// The upstreams are often web applications that make plenty of requests
+	return 32
+}
+
+// SelfTest makes sure that the upstreams accept connections.
+func (hand *HandleReverseProxy) SelfTest() error {
+	var errs []error
+	for _, prefix := range hand.prefixes {
+		upstream := hand.Upstreams[prefix]
+		port := upstream.target.Port()
+		if port == "" {
+			port = "80"
+			if upstream.target.Scheme == "https" {
+				port = "443"
+			}
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(upstream.target.Hostname(), port), time.Duration(upstream.TimeoutSec)*time.Second)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("upstream of prefix \"%s\" is unavailable: %w", prefix, err))
+			continue
+		}
+		_ = conn.Close()
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("HandleReverseProxy.SelfTest: %w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestHandleReverseProxy(t *testing.T) {
+	upstreamMux := http.NewServeMux()
+	upstreamMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Secret", "secret")
+		w.Header().Set("X-Upstream", "1")
+		_, _ = io.WriteString(w, r.Host+" "+r.URL.RequestURI()+" "+r.Header.Get("X-Custom")+" "+r.Header.Get("Cookie")+" "+r.Header.Get("X-Forwarded-Proto"))
+	})
+	upstreamMux.HandleFunc("/slow/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(3 * time.Second)
+	})
+	upstreamMux.Handle("/app/ws", websocket.Handler(func(ws *websocket.Conn) {
+		_, _ = io.Copy(ws, ws)
+	}))
+	upstream := httptest.NewServer(upstreamMux)
+	defer upstream.Close()
+
+	hand := &HandleReverseProxy{}
+	require.Error(t, hand.Initialise(lalog.DefaultLogger, nil, ""))
+	hand.Upstreams = map[string]*ReverseProxyUpstream{"/app": {URL: "ftp://example.com"}}
+	require.Error(t, hand.Initialise(lalog.DefaultLogger, nil, ""))
+	hand.Upstreams = map[string]*ReverseProxyUpstream{
+		"/app": {
+			URL:             upstream.URL,
+			RequestHeaders:  map[string]string{"X-Custom": "custom", "Cookie": ""},
+			ResponseHeaders: map[string]string{"X-Upstream-Secret": "", "X-Proxied": "yes"},
+		},
+		"app/sub/": {URL: upstream.URL + "/base/", StripPrefix: true, RequestHeaders: map[string]string{"Host": "sub.example.com"}},
+		"/slow":    {URL: upstream.URL, TimeoutSec: 1},
+		"/down/":   {URL: "http://127.0.0.1:1"},
+	}
+	require.Equal(t, []string{"/app/", "/app/sub/", "/down/", "/slow/"}, hand.Locations())
+	require.NoError(t, hand.Initialise(lalog.DefaultLogger, nil, ""))
+	require.Error(t, hand.SelfTest())
+	server := httptest.NewServer(http.HandlerFunc(hand.Handle))
+	defer server.Close()
+
+	get := func(path string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Cookie", "a=b")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+	// Forward to the upstream with the rewritten headers
+	resp, body := get("/app/a?b=c")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, strings.TrimPrefix(upstream.URL, "http://")+" /app/a?b=c custom  http", body)
+	require.Empty(t, resp.Header.Get("X-Upstream-Secret"))
+	require.Equal(t, "1", resp.Header.Get("X-Upstream"))
+	require.Equal(t, "yes", resp.Header.Get("X-Proxied"))
+	// The longest prefix wins
+	resp, body = get("/app/sub/a")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "sub.example.com /base/a  a=b http", body)
+	// Upstream errors
+	resp, _ = get("/other")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = get("/down/a")
+	require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	resp, _ = get("/slow/")
+	require.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+
+	// Pass WebSocket through to the upstream
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/app/ws", "", "http://localhost")
+	require.NoError(t, err)
+	defer ws.Close()
+	require.NoError(t, ws.SetDeadline(time.Now().Add(10*time.Second)))
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+	var msg string
+	require.NoError(t, websocket.Message.Receive(ws, &msg))
+	require.Equal(t, "hello", msg)
+}
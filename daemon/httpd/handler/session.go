@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+const (
+	// DefaultSessionMaxAgeSec is the default duration for which a session is kept after its latest update.
+	DefaultSessionMaxAgeSec = 7 * 24 * 3600
+	// SessionCookiePrefix is the name prefix of session cookies.
+	SessionCookiePrefix = "laitos-session-"
+	// MaxSessionCookieLen is the maximum length of a session cookie value, browsers usually reject cookies larger than 4KB.
+	MaxSessionCookieLen = 3800
+	// sessionIDLen is the number of random bytes that make up a session ID kept in a cookie when session data are stored in Redis.
+	sessionIDLen = 24
+)
+
+// ErrSessionTooLarge is returned when the session data do not fit into a cookie.
+var ErrSessionTooLarge = errors.New("session data are too large to fit into a cookie, consider storing the sessions in Redis")
+
+/*
+SessionUser is implemented by handlers that keep per-visitor data across requests. The HTTP server gives them its
+session store before they are initialised.
+*/
+type SessionUser interface {
+	SetSessionStore(store *SessionStore)
+}
+
+/*
+SessionStore keeps small pieces of per-visitor data (sessions) across requests. The session data are encrypted and
+placed in a cookie, or optionally stored in Redis in which case the cookie carries only a random session ID. Either way,
+the sessions do not depend on the visitor reaching the same program instance, hence the features relying on them
+continue to work when several laitos program instances serve the same visitors, e.g. behind a load balancer.
+*/
+type SessionStore struct {
+	// Secret is used to derive the key that encrypts and authenticates session data. All program instances serving the
+	// same visitors must share the same secret. If left empty, a random key is generated and sessions are lost upon
+	// program restart.
+	Secret string `json:"Secret"`
+	// MaxAgeSec is the duration for which a session is kept after its latest update.
+	MaxAgeSec int `json:"MaxAgeSec"`
+	// Redis (optional) stores the session data in Redis server instead of in cookies.
+	Redis *inet.RedisClient `json:"Redis"`
+
+	aead cipher.AEAD
+}
+
+// Initialise validates configuration and prepares the encryption key.
+func (store *SessionStore) Initialise() error {
+	if store.MaxAgeSec < 1 {
+		store.MaxAgeSec = DefaultSessionMaxAgeSec
+	}
+	key := make([]byte, 32)
+	if store.Secret == "" {
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("SessionStore.Initialise: failed to generate random key - %w", err)
+		}
+	} else {
+		digest := sha256.Sum256([]byte("laitos-session-store:" + store.Secret))
+		key = digest[:]
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("SessionStore.Initialise: %w", err)
+	}
+	if store.aead, err = cipher.NewGCM(block); err != nil {
+		return fmt.Errorf("SessionStore.Initialise: %w", err)
+	}
+	if store.Redis != nil {
+		if err := store.Redis.Initialise(); err != nil {
+			return fmt.Errorf("SessionStore.Initialise: %w", err)
+		}
+	}
+	return nil
+}
+
+// seal encrypts the plain text, the session name is authenticated along with the text so that a session cannot be
+// passed off as another.
+func (store *SessionStore) seal(name string, plain []byte) []byte {
+	nonce := make([]byte, store.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Errorf("SessionStore.seal: failed to read random nonce - %w", err))
+	}
+	return store.aead.Seal(nonce, nonce, plain, []byte(name))
+}
+
+// open decrypts and authenticates the sealed text.
+func (store *SessionStore) open(name string, sealed []byte) ([]byte, error) {
+	if len(sealed) < store.aead.NonceSize() {
+		return nil, errors.New("sealed session data are too short")
+	}
+	return store.aead.Open(nil, sealed[:store.aead.NonceSize()], sealed[store.aead.NonceSize():], []byte(name))
+}
+
+// redisKey returns the Redis key of the session data.
+func (store *SessionStore) redisKey(name, id string) string {
+	return fmt.Sprintf("laitos-session:%s:%s", name, id)
+}
+
+/*
+Load retrieves the session of the name from the request, and deserialises the session data into the value. It returns
+false if the visitor does not have the session yet, or the session has expired or been tampered with.
+*/
+func (store *SessionStore) Load(r *http.Request, name string, value interface{}) (bool, error) {
+	cookie, err := r.Cookie(SessionCookiePrefix + name)
+	if err != nil {
+		return false, nil
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return false, nil
+	}
+	if store.Redis != nil {
+		if len(sealed) != sessionIDLen {
+			return false, nil
+		}
+		reply, err := store.Redis.Do(r.Context(), "GET", store.redisKey(name, hex.EncodeToString(sealed)))
+		if err != nil {
+			return false, fmt.Errorf("SessionStore.Load: %w", err)
+		}
+		str, ok := reply.(string)
+		if !ok {
+			// The session has expired
+			return false, nil
+		}
+		sealed = []byte(str)
+	}
+	plain, err := store.open(name, sealed)
+	if err != nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(plain, value); err != nil {
+		return false, fmt.Errorf("SessionStore.Load: %w", err)
+	}
+	return true, nil
+}
+
+// Save serialises the value into session data of the name, and sets the session cookie in the response.
+func (store *SessionStore) Save(w http.ResponseWriter, r *http.Request, name string, value interface{}) error {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("SessionStore.Save: %w", err)
+	}
+	sealed := store.seal(name, plain)
+	cookieValue := base64.RawURLEncoding.EncodeToString(sealed)
+	if store.Redis != nil {
+		// Keep using the session ID of the visitor's existing session
+		var id []byte
+		if cookie, err := r.Cookie(SessionCookiePrefix + name); err == nil {
+			if existingID, err := base64.RawURLEncoding.DecodeString(cookie.Value); err == nil && len(existingID) == sessionIDLen {
+				id = existingID
+			}
+		}
+		if id == nil {
+			id = make([]byte, sessionIDLen)
+			if _, err := rand.Read(id); err != nil {
+				return fmt.Errorf("SessionStore.Save: failed to generate session ID - %w", err)
+			}
+		}
+		if _, err := store.Redis.Do(r.Context(), "SET", store.redisKey(name, hex.EncodeToString(id)), string(sealed), "EX", fmt.Sprint(store.MaxAgeSec)); err != nil {
+			return fmt.Errorf("SessionStore.Save: %w", err)
+		}
+		cookieValue = base64.RawURLEncoding.EncodeToString(id)
+	} else if len(cookieValue) > MaxSessionCookieLen {
+		return ErrSessionTooLarge
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookiePrefix + name,
+		Value:    cookieValue,
+		Path:     "/",
+		MaxAge:   store.MaxAgeSec,
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
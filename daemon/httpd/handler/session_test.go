@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// carryCookies copies the cookies set by the response into a new request.
+func carryCookies(resp *http.Response, req *http.Request) *http.Request {
+	for _, cookie := range resp.Cookies() {
+		req.AddCookie(cookie)
+	}
+	return req
+}
+
+func TestSessionStore_Cookie(t *testing.T) {
+	store := &SessionStore{Secret: "session-secret"}
+	if err := store.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	var value []string
+	if found, err := store.Load(httptest.NewRequest(http.MethodGet, "/", nil), "test", &value); found || err != nil {
+		t.Fatal(found, err)
+	}
+	w := httptest.NewRecorder()
+	if err := store.Save(w, httptest.NewRequest(http.MethodGet, "/", nil), "test", []string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	req := carryCookies(w.Result(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if found, err := store.Load(req, "test", &value); !found || err != nil || len(value) != 2 || value[1] != "b" {
+		t.Fatal(found, err, value)
+	}
+	// Another program instance sharing the same secret reads the session too
+	anotherStore := &SessionStore{Secret: "session-secret"}
+	if err := anotherStore.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	value = nil
+	if found, err := anotherStore.Load(req, "test", &value); !found || err != nil || len(value) != 2 {
+		t.Fatal(found, err, value)
+	}
+	// A store of a different secret cannot read the session
+	otherSecretStore := &SessionStore{Secret: "other-secret"}
+	if err := otherSecretStore.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := otherSecretStore.Load(req, "test", &value); found || err != nil {
+		t.Fatal(found, err)
+	}
+	// A session cannot be passed off as another
+	cookie, _ := req.Cookie(SessionCookiePrefix + "test")
+	forgedReq := httptest.NewRequest(http.MethodGet, "/", nil)
+	forgedReq.AddCookie(&http.Cookie{Name: SessionCookiePrefix + "other", Value: cookie.Value})
+	if found, err := store.Load(forgedReq, "other", &value); found || err != nil {
+		t.Fatal(found, err)
+	}
+	// Session data must fit into a cookie
+	if err := store.Save(httptest.NewRecorder(), req, "test", strings.Repeat("a", MaxSessionCookieLen)); err != ErrSessionTooLarge {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyCookieJar(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "user", Value: "me", MaxAge: 3600})
+		case "/check":
+			_, _ = w.Write([]byte("cookies: " + r.Header.Get("Cookie")))
+		}
+	}))
+	defer remote.Close()
+	store := &SessionStore{}
+	if err := store.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	xy := &HandleWebProxy{OwnEndpoint: "/proxy"}
+	xy.SetSessionStore(store)
+	if err := xy.Initialise(&lalog.Logger{}, nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	proxyRequest := func(target string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "http://laitos/proxy?u="+url.QueryEscape(remote.URL+target), nil)
+	}
+	// The cookie set by the web site is kept in the session instead of being passed to the browser directly
+	w := httptest.NewRecorder()
+	xy.Handle(w, proxyRequest("/login"))
+	loginResp := w.Result()
+	if len(loginResp.Cookies()) != 1 || loginResp.Cookies()[0].Name != SessionCookiePrefix+ProxyCookieJarSession {
+		t.Fatal(loginResp.Cookies())
+	}
+	// The web site receives its own cookie but not the session cookie of laitos
+	w = httptest.NewRecorder()
+	xy.Handle(w, carryCookies(loginResp, proxyRequest("/check")))
+	body, _ := io.ReadAll(w.Result().Body)
+	if string(body) != "cookies: user=me" {
+		t.Fatal(string(body))
+	}
+	// The cookie is removed once it expires
+	jar, changed := proxyCookieJar{{Host: "a", Name: "n", Value: "v", Expires: 1}}.update("a", nil, time.Unix(2, 0))
+	if len(jar) != 0 || !changed {
+		t.Fatal(jar, changed)
+	}
+}
+
+func TestHandleCommandForm_History(t *testing.T) {
+	store := &SessionStore{}
+	if err := store.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	form := &HandleCommandForm{KeepHistory: true}
+	form.SetSessionStore(store)
+	if err := form.Initialise(&lalog.Logger{}, toolbox.GetTestCommandProcessor(), ""); err != nil {
+		t.Fatal(err)
+	}
+	post := func(cookiesFrom *http.Response, cmd string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/cmd_form", strings.NewReader(url.Values{"cmd": {cmd}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookiesFrom != nil {
+			req = carryCookies(cookiesFrom, req)
+		}
+		w := httptest.NewRecorder()
+		form.Handle(w, req)
+		return w.Result()
+	}
+	resp := post(nil, toolbox.TestCommandProcessorPIN+".s echo history-test")
+	// The history is not shown without the password PIN
+	w := httptest.NewRecorder()
+	form.Handle(w, carryCookies(resp, httptest.NewRequest(http.MethodGet, "/cmd_form", nil)))
+	if body, _ := io.ReadAll(w.Result().Body); strings.Contains(string(body), "history-test") {
+		t.Fatal(string(body))
+	}
+	if body, _ := io.ReadAll(post(resp, "wrong-pin.s echo again").Body); strings.Contains(string(body), "history-test") {
+		t.Fatal(string(body))
+	}
+	// The history shows the command without the password PIN and output
+	body, _ := io.ReadAll(post(resp, toolbox.TestCommandProcessorPIN+".s echo second").Body)
+	history := string(body)[strings.Index(string(body), "Recent commands"):]
+	if !strings.Contains(history, "<code>.s echo history-test</code>") || !strings.Contains(history, "<code>.s echo second</code>") ||
+		strings.Contains(history, toolbox.TestCommandProcessorPIN) || strings.Contains(history, "<pre>") {
+		t.Fatal(history)
+	}
+	// The history is not kept unless it is enabled
+	form.KeepHistory = false
+	if resp := post(nil, toolbox.TestCommandProcessorPIN+".s echo history-test"); len(resp.Cookies()) != 0 {
+		t.Fatal(resp.Cookies())
+	}
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// HandleSpeechAudioPage is the HTML source code template of the speech audio page.
+const HandleSpeechAudioPage = `<html>
+<head>
+    <title>Speak command output</title>
+</head>
+<body>
+    <form action="%s" method="post">
+        <p><input type="password" name="cmd" /><input type="submit" value="Speak"/></p>
+        <pre>%s</pre>
+    </form>
+</body>
+</html>
+`
+
+const (
+	// SpeechAudioClipExpireSec is the number of seconds a synthesised audio clip remains available for retrieval.
+	SpeechAudioClipExpireSec = 10 * 60
+	// SpeechAudioMaxClips is the maximum number of audio clips kept in memory, the oldest clip is discarded to make room for a new one.
+	SpeechAudioMaxClips = 100
+)
+
+// speechAudioClip is a synthesised audio clip kept in memory for retrieval.
+type speechAudioClip struct {
+	audio       []byte
+	contentType string
+	expiry      time.Time
+}
+
+/*
+HandleSpeechAudio synthesises the speech of app command output into an audio reply for web visitors, and serves the audio
+clips synthesised for other handlers such as the Twilio call callback.
+*/
+type HandleSpeechAudio struct {
+	// TextToSpeech is the configuration of the speech synthesiser.
+	TextToSpeech toolbox.TextToSpeech `json:"TextToSpeech"`
+	// Location is the URL location of the handler itself, it is set by the launcher to construct the URL of audio clips.
+	Location string `json:"-"`
+
+	clips                      map[string]*speechAudioClip
+	clipsMutex                 *sync.Mutex
+	logger                     *lalog.Logger
+	cmdProc                    *toolbox.CommandProcessor
+	stripURLPrefixFromResponse string
+}
+
+func (speech *HandleSpeechAudio) Initialise(logger *lalog.Logger, cmdProc *toolbox.CommandProcessor, stripURLPrefixFromResponse string) error {
+	if cmdProc == nil {
+		return errors.New("HandleSpeechAudio.Initialise: command processor must not be nil")
+	}
+	if errs := cmdProc.IsSaneForInternet(); len(errs) > 0 {
+		return fmt.Errorf("HandleSpeechAudio.Initialise: %+v", errs)
+	}
+	if err := speech.TextToSpeech.Initialise(); err != nil {
+		return fmt.Errorf("HandleSpeechAudio.Initialise: %w", err)
+	}
+	speech.logger = logger
+	speech.cmdProc = cmdProc
+	speech.stripURLPrefixFromResponse = stripURLPrefixFromResponse
+	speech.clips = make(map[string]*speechAudioClip)
+	speech.clipsMutex = new(sync.Mutex)
+	return nil
+}
+
+/*
+SynthesiseClip synthesises the speech of the text and keeps the audio in memory for a short while. It returns the URL (without
+the stripped URL prefix) that retrieves the audio clip.
+*/
+func (speech *HandleSpeechAudio) SynthesiseClip(ctx context.Context, text string) (string, error) {
+	audio, contentType, err := speech.TextToSpeech.Synthesise(ctx, speech.cmdProc.Locale, text)
+	if err != nil {
+		return "", err
+	}
+	randBytes := make([]byte, 16)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", err
+	}
+	clipID := hex.EncodeToString(randBytes)
+	now := time.Now()
+	speech.clipsMutex.Lock()
+	var oldestID string
+	for id, clip := range speech.clips {
+		if now.After(clip.expiry) {
+			delete(speech.clips, id)
+		} else if oldestID == "" || clip.expiry.Before(speech.clips[oldestID].expiry) {
+			oldestID = id
+		}
+	}
+	if len(speech.clips) >= SpeechAudioMaxClips {
+		delete(speech.clips, oldestID)
+	}
+	speech.clips[clipID] = &speechAudioClip{audio: audio, contentType: contentType, expiry: now.Add(SpeechAudioClipExpireSec * time.Second)}
+	speech.clipsMutex.Unlock()
+	return strings.TrimPrefix(speech.Location, speech.stripURLPrefixFromResponse) + "?clip=" + clipID, nil
+}
+
+// getClip returns the audio clip of the ID, or nil if the clip does not exist or has expired.
+func (speech *HandleSpeechAudio) getClip(clipID string) *speechAudioClip {
+	speech.clipsMutex.Lock()
+	defer speech.clipsMutex.Unlock()
+	clip, exists := speech.clips[clipID]
+	if !exists || time.Now().After(clip.expiry) {
+		return nil
+	}
+	return clip
+}
+
+// writeAudio responds to the client with the audio content.
+func writeAudio(w http.ResponseWriter, contentType string, audio []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(audio)))
+	_, _ = w.Write(audio)
+}
+
+func (speech *HandleSpeechAudio) Handle(w http.ResponseWriter, r *http.Request) {
+	NoCache(w)
+	if clipID := r.FormValue("clip"); clipID != "" {
+		if clip := speech.getClip(clipID); clip == nil {
+			middleware.WriteError(w, r, http.StatusNotFound, "the audio clip does not exist or has expired")
+		} else {
+			writeAudio(w, clip.contentType, clip.audio)
+		}
+		return
+	}
+	formAction := strings.TrimPrefix(r.RequestURI, speech.stripURLPrefixFromResponse)
+	cmd := r.FormValue("cmd")
+	if r.Method != http.MethodPost || cmd == "" {
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		_, _ = w.Write([]byte(fmt.Sprintf(HandleSpeechAudioPage, formAction, "")))
+		return
+	}
+	result := speech.cmdProc.Process(r.Context(), toolbox.Command{
+		DaemonName: "httpd",
+		ClientTag:  middleware.GetRealClientIP(r),
+		Content:    cmd,
+		TimeoutSec: HTTPClienAppCommandTimeout,
+	}, true)
+	ctx, cancel := context.WithTimeout(r.Context(), toolbox.TextToSpeechTimeoutSec*time.Second)
+	defer cancel()
+	audio, contentType, err := speech.TextToSpeech.Synthesise(ctx, speech.cmdProc.Locale, result.CombinedOutput)
+	if err != nil {
+		// Show the command output in text if it cannot be spoken
+		speech.logger.Warning(middleware.GetRealClientIP(r), err, "failed to synthesise the speech of command output")
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		_, _ = w.Write([]byte(fmt.Sprintf(HandleSpeechAudioPage, formAction, html.EscapeString(result.CombinedOutput))))
+		return
+	}
+	writeAudio(w, contentType, audio)
+}
+
+func (_ *HandleSpeechAudio) GetRateLimitFactor() int {
+	return 3
+}
+
+func (speech *HandleSpeechAudio) SelfTest() error {
+	return speech.TextToSpeech.SelfTest()
+}
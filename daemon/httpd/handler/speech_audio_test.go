@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleSpeechAudio(t *testing.T) {
+	speechAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("mp3 audio"))
+	}))
+	defer speechAPI.Close()
+
+	speech := &HandleSpeechAudio{Location: "/prefix/speech", TextToSpeech: toolbox.TextToSpeech{APIURL: speechAPI.URL}}
+	require.Error(t, speech.Initialise(lalog.DefaultLogger, nil, "/prefix"))
+	require.NoError(t, speech.Initialise(lalog.DefaultLogger, toolbox.GetTestCommandProcessor(), "/prefix"))
+	require.NoError(t, speech.SelfTest())
+
+	serve := func(method, target string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		speech.Handle(rec, req)
+		return rec
+	}
+	// Visitor runs a command and listens to its output
+	rec := serve(http.MethodGet, "/speech", nil)
+	require.Contains(t, rec.Body.String(), `<form action="/speech"`)
+	rec = serve(http.MethodPost, "/speech", url.Values{"cmd": {toolbox.TestCommandProcessorPIN + ".s echo hi"}})
+	require.Equal(t, "audio/mpeg", rec.Header().Get("Content-Type"))
+	require.Equal(t, "mp3 audio", rec.Body.String())
+
+	// Synthesised clips are retrieved by their URL
+	clipURL, err := speech.SynthesiseClip(context.Background(), "hello")
+	require.NoError(t, err)
+	require.Regexp(t, `^/speech\?clip=[0-9a-f]{32}$`, clipURL)
+	rec = serve(http.MethodGet, clipURL, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "mp3 audio", rec.Body.String())
+	rec = serve(http.MethodGet, "/speech?clip=does-not-exist", nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	req := httptest.NewRequest(http.MethodGet, "/speech?clip=does-not-exist", nil)
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	speech.Handle(rec, req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, middleware.ProblemContentType, rec.Header().Get("Content-Type"))
+
+	// The oldest clips are discarded to make room for new ones
+	for i := 0; i < SpeechAudioMaxClips; i++ {
+		_, err := speech.SynthesiseClip(context.Background(), "hello")
+		require.NoError(t, err)
+	}
+	require.Len(t, speech.clips, SpeechAudioMaxClips)
+	rec = serve(http.MethodGet, clipURL, nil)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Twilio call plays the long command output as audio clip
+	callback := &HandleTwilioCallCallback{MyEndpoint: "/prefix/callback", Speech: speech}
+	require.NoError(t, callback.Initialise(lalog.DefaultLogger, speech.cmdProc, "/prefix"))
+	dtmfVerySecretDotSTrue := "88833777999777733222777338014207777087778833"
+	call := func(digits string) string {
+		req := httptest.NewRequest(http.MethodPost, "/prefix/callback", strings.NewReader(url.Values{"Digits": {digits}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		callback.Handle(rec, req)
+		return rec.Body.String()
+	}
+	twiml := call(TwilioPhoneticSpellingMagic + dtmfVerySecretDotSTrue)
+	require.Contains(t, twiml, `<Gather action="/callback"`)
+	plays := regexp.MustCompile(`<Play>/speech\?clip=([0-9a-f]{32})</Play>`).FindAllStringSubmatch(twiml, -1)
+	require.Len(t, plays, 3, twiml)
+	require.NotNil(t, speech.getClip(plays[0][1]))
+	// Short command output is spoken by Twilio
+	twiml = call(dtmfVerySecretDotSTrue)
+	require.NotContains(t, twiml, "<Play>")
+	require.Contains(t, twiml, "<Say>EMPTY OUTPUT.")
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"net/http"
 	"strings"
+	"sync/atomic"
 
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailcmd"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
@@ -15,7 +17,12 @@ import (
 
 type systemInfo struct {
 	Status platform.ProgramStatusSummary `json:"Status"`
-	Stats  misc.ProgramStats             `json:"Stats"`
+	/*
+		Stats are the daemon stats counters (misc.StatsDisplayValue) keyed by common.DaemonStats.Key, along with
+		"OutgoingMailBytes" - the total size of all outstanding mails waiting to be delivered.
+	*/
+	Stats   map[string]interface{} `json:"Stats"`
+	Daemons []misc.DaemonStatus    `json:"Daemons"`
 }
 
 // HandleSystemInfo inspects system and application environment and returns them in text report.
@@ -40,7 +47,9 @@ func (info *HandleSystemInfo) handlePlainText(w http.ResponseWriter, r *http.Req
 	result.WriteString(summary.String())
 	// Latest stats
 	result.WriteString("\nDaemon stats - low/avg/high/total seconds and (count):\n")
-	result.WriteString(misc.GetLatestStats())
+	result.WriteString(common.FormatDaemonStats())
+	result.WriteString("\nDaemon status:\n")
+	result.WriteString(common.GetDaemonStatusText())
 	// Warnings, logs, and stack traces, in that order.
 	result.WriteString("\nWarnings:\n")
 	result.WriteString(toolbox.GetLatestWarnings())
@@ -55,10 +64,15 @@ func (info *HandleSystemInfo) handleJson(w http.ResponseWriter, r *http.Request)
 	NoCache(w)
 	AllowAllOrigins(w)
 	w.Header().Set("Content-Type", "application/json")
+	stats := map[string]interface{}{"OutgoingMailBytes": atomic.LoadInt64(&misc.OutstandingMailBytes)}
+	for _, snapshot := range common.GetDaemonStatsSnapshots() {
+		stats[snapshot.Key] = snapshot.StatsDisplayValue
+	}
 	encoder := json.NewEncoder(w)
 	_ = encoder.Encode(systemInfo{
-		Status: platform.GetProgramStatusSummary(true),
-		Stats:  misc.GetLatestDisplayValues(),
+		Status:  platform.GetProgramStatusSummary(true),
+		Stats:   stats,
+		Daemons: common.GetDaemonStatuses(),
 	})
 }
 
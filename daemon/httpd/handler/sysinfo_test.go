@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleSystemInfo_JSON(t *testing.T) {
+	misc.AutoUnlockStats.Trigger(1)
+	atomic.StoreInt64(&misc.OutstandingMailBytes, 2048)
+	defer atomic.StoreInt64(&misc.OutstandingMailBytes, 0)
+
+	req := httptest.NewRequest(http.MethodGet, "/info", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	(&HandleSystemInfo{}).Handle(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var info struct {
+		Status  map[string]interface{}
+		Stats   map[string]json.RawMessage
+		Daemons []misc.DaemonStatus
+	}
+	require.NoError(t, json.NewDecoder(w.Result().Body).Decode(&info))
+	require.NotEmpty(t, info.Status)
+	// The stats counters and the outstanding mail size are all found under Stats, as they were before the stats registry.
+	for _, key := range []string{"AutoUnlock", "DNSOverTCP", "DNSOverUDP", "HTTP", "HTTPProxy", "TCPOverDNS", "PlainSocketTCP", "PlainSocketUDP",
+		"SimpleIPServiceTCP", "SimpleIPServiceUDP", "SMTP", "SSH", "SockdTCP", "SockdUDP", "SockdKnock", "TelegramBot"} {
+		var value misc.StatsDisplayValue
+		require.NoError(t, json.Unmarshal(info.Stats[key], &value), key)
+	}
+	var autoUnlock misc.StatsDisplayValue
+	require.NoError(t, json.Unmarshal(info.Stats["AutoUnlock"], &autoUnlock))
+	require.GreaterOrEqual(t, autoUnlock.Count, uint64(1))
+	require.Equal(t, "2048", string(info.Stats["OutgoingMailBytes"]))
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// HandleTCPOverHTTPS relays the segments carried by the TCP-over-DNS HTTPS
+// carrier to the TCP-over-DNS proxy of the DNS daemon.
+type HandleTCPOverHTTPS struct {
+	// TCPProxy is the TCP-over-DNS proxy of the DNS daemon.
+	TCPProxy http.Handler `json:"-"`
+}
+
+// Initialise always returns nil.
+func (hand *HandleTCPOverHTTPS) Initialise(*lalog.Logger, *toolbox.CommandProcessor, string) error {
+	return nil
+}
+
+// Handle relays the segment from request body to the TCP-over-DNS proxy, and
+// responds with the reply segment.
+func (hand *HandleTCPOverHTTPS) Handle(w http.ResponseWriter, r *http.Request) {
+	if hand.TCPProxy == nil {
+		middleware.WriteError(w, r, http.StatusServiceUnavailable, "TCP-over-DNS proxy is not enabled")
+		return
+	}
+	hand.TCPProxy.ServeHTTP(w, r)
+}
+
+// GetRateLimitFactor returns a high factor because each tunnelled connection
+// sends many segments per second.
+func (hand *HandleTCPOverHTTPS) GetRateLimitFactor() int {
+	return 25
+}
+
+// SelfTest always returns nil.
+func (hand *HandleTCPOverHTTPS) SelfTest() error {
+	return nil
+}
@@ -1,12 +1,15 @@
 package handler
 
 import (
+	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
@@ -36,59 +39,107 @@ const (
 		allowed to invoke SMS or voice call routine. This rate limit is designed to prevent spam SMS and calls.
 	*/
 	TwilioPhoneNumberRateLimitIntervalSec = 10
+
+	/*
+		TwilioSpeechAudioMinLength is the minimum length of command output to be played as a synthesised speech audio,
+		which is easier to comprehend than the speech of Twilio <Say> when the output is long.
+	*/
+	TwilioSpeechAudioMinLength = 100
 )
 
+// twilioSay returns the TwiML verb that speaks the text in the language of the locale.
+func twilioSay(locale, text string) string {
+	if locale == "" || locale == toolbox.LocaleEnglish {
+		return "<Say>" + text + "</Say>"
+	}
+	return fmt.Sprintf(`<Say language="%s">%s</Say>`, toolbox.Translate(locale, toolbox.TextSpeechLanguage), text)
+}
+
 // Handle Twilio phone number's SMS hook.
 type HandleTwilioSMSHook struct {
+	/*
+		MaxSegments is the maximum number of SMS segments to split a long reply into. Each segment is prefixed with its
+		sequence number (e.g. "1/3 "). The default value 1 sends the reply in a single message.
+	*/
+	MaxSegments int `json:"MaxSegments"`
+	// SegmentLength is the maximum length of each SMS segment, it defaults to TwilioSMSSegmentLength.
+	SegmentLength int `json:"SegmentLength"`
+
 	senderRateLimit *lalog.RateLimit // senderRateLimit prevents excessive SMS replies from being replied to spam numbers
+	reassembler     *SMSReassembler  // reassembler puts together the parts of multi-part SMS
 
 	logger  *lalog.Logger
 	cmdProc *toolbox.CommandProcessor
 }
 
 func (hand *HandleTwilioSMSHook) Initialise(logger *lalog.Logger, cmdProc *toolbox.CommandProcessor, _ string) error {
+	if hand.MaxSegments < 1 {
+		hand.MaxSegments = 1
+	} else if hand.MaxSegments > TwilioSMSMaxParts {
+		return fmt.Errorf("HandleTwilioSMSHook.Initialise: MaxSegments must not exceed %d", TwilioSMSMaxParts)
+	}
+	if hand.SegmentLength < 1 {
+		hand.SegmentLength = TwilioSMSSegmentLength
+	}
 	hand.logger = logger
 	hand.cmdProc = cmdProc
 	// Allow maximum of 1 SMS to be received every 5 seconds, per phone number.
 	hand.senderRateLimit = lalog.NewRateLimit(TwilioPhoneNumberRateLimitIntervalSec, 1, logger)
+	hand.reassembler = NewSMSReassembler()
 	return nil
 }
 
 func (hand *HandleTwilioSMSHook) Handle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
 	NoCache(w)
-	// Apply rate limit to the sender
 	phoneNumber := r.FormValue("From")
 	hand.logger.Info(phoneNumber, nil, "has received an SMS")
-	if phoneNumber != "" {
+	// SMS message is in "Body" parameter
+	body := r.FormValue("Body")
+	seq, total, content := ParseSMSPart(body)
+	// Apply rate limit to the sender, the subsequent parts of a multi-part SMS are not subjected to the rate limit.
+	if phoneNumber != "" && (seq == 0 || !hand.reassembler.IsOngoing(phoneNumber, total)) {
 		if !hand.senderRateLimit.Add(phoneNumber, true) {
 			/*
 				Twilio does not have a reject feature for incoming SMS. Use a non-2xx HTTP status code to inform Twilio
 				that an SMS reply isn't available. Twilio operator can inspect these failures from the Twilio console.
 			*/
-			http.Error(w, "rate limit is exceeded by sender "+phoneNumber, http.StatusServiceUnavailable)
+			middleware.WriteError(w, r, http.StatusServiceUnavailable, "rate limit is exceeded by sender "+phoneNumber)
+			return
+		}
+	}
+	// Put together the parts of a multi-part SMS
+	if seq > 0 {
+		var isComplete bool
+		if body, isComplete = hand.reassembler.Add(phoneNumber, seq, total, content); !isComplete {
+			hand.logger.Info(phoneNumber, nil, "received part %d of %d of an SMS", seq, total)
+			// Do not reply until all parts have arrived
+			_, _ = w.Write([]byte(xml.Header + `<Response></Response>`))
 			return
 		}
 	}
-	// SMS message is in "Body" parameter
 	ret := hand.cmdProc.Process(r.Context(), toolbox.Command{
 		DaemonName: "httpd",
 		ClientTag:  phoneNumber,
 		TimeoutSec: TwilioHandlerTimeoutSec,
-		Content:    r.FormValue("Body"),
+		Content:    body,
 	}, true)
 	if ret.CombinedOutput == toolbox.ErrPINAndShortcutNotFound.Error() {
 		/*
 			Twilio does not have a reject feature for incoming SMS. Use a non-2xx HTTP status code to inform Twilio
 			that an SMS reply isn't available. Twilio operator can inspect these failures from the Twilio console.
 		*/
-		http.Error(w, toolbox.ErrPINAndShortcutNotFound.Error(), http.StatusServiceUnavailable)
+		middleware.WriteError(w, r, http.StatusServiceUnavailable, toolbox.ErrPINAndShortcutNotFound.Error())
 		return
 	}
-	// Generate normal XML response
+	// Generate normal XML response, Twilio sends each message in a separate SMS in sequence.
+	var messages strings.Builder
+	for _, segment := range SplitSMS(ret.CombinedOutput, hand.SegmentLength, hand.MaxSegments) {
+		messages.WriteString("<Message>" + XMLEscape(segment) + "</Message>")
+	}
 	_, _ = w.Write([]byte(fmt.Sprintf(xml.Header+`
-<Response><Message>%s</Message></Response>
-`, XMLEscape(ret.CombinedOutput))))
+<Response>%s</Response>
+`, messages.String())))
 }
 func (hand *HandleTwilioSMSHook) GetRateLimitFactor() int {
 	return TwilioAPIRateLimitFactor
@@ -136,10 +187,10 @@ func (hand *HandleTwilioCallHook) Handle(w http.ResponseWriter, r *http.Request)
 	_, _ = w.Write([]byte(fmt.Sprintf(xml.Header+`
 <Response>
     <Gather action="%s" method="POST" timeout="60" finishOnKey="#" numDigits="1000">
-        <Say>%s</Say>
+        %s
     </Gather>
 </Response>
-`, strings.TrimPrefix(hand.CallbackEndpoint, hand.stripURLPrefixFromResponse), XMLEscape(hand.CallGreeting))))
+`, strings.TrimPrefix(hand.CallbackEndpoint, hand.stripURLPrefixFromResponse), twilioSay(hand.cmdProc.Locale, XMLEscape(hand.CallGreeting)))))
 }
 func (hand *HandleTwilioCallHook) GetRateLimitFactor() int {
 	return TwilioAPIRateLimitFactor
@@ -150,7 +201,8 @@ func (_ *HandleTwilioCallHook) SelfTest() error {
 
 // Carry on with command processing in Twilio telephone call conversation.
 type HandleTwilioCallCallback struct {
-	MyEndpoint string `json:"-"` // URL endpoint to the callback itself, including prefix /.
+	MyEndpoint string             `json:"-"` // URL endpoint to the callback itself, including prefix /.
+	Speech     *HandleSpeechAudio `json:"-"` // Speech (optional) synthesises long command output into audio played to the caller.
 
 	senderRateLimit            *lalog.RateLimit // senderRateLimit prevents excessive calls from being made by spam numbers
 	logger                     *lalog.Logger
@@ -178,7 +230,7 @@ func (hand *HandleTwilioCallCallback) Handle(w http.ResponseWriter, r *http.Requ
 	hand.logger.Info(phoneNumber, nil, "has received DTMF command via call")
 	if phoneNumber != "" {
 		if !hand.senderRateLimit.Add(phoneNumber, true) {
-			_, _ = w.Write([]byte(xml.Header + `<Response><Say>You are rate limited.</Say><Hangup/></Response>`))
+			_, _ = w.Write([]byte(xml.Header + `<Response>` + twilioSay(hand.cmdProc.Locale, XMLEscape(toolbox.Translate(hand.cmdProc.Locale, toolbox.TextCallRateLimited))) + `<Hangup/></Response>`))
 			return
 		}
 	}
@@ -191,35 +243,62 @@ func (hand *HandleTwilioCallCallback) Handle(w http.ResponseWriter, r *http.Requ
 		dtmfInput = dtmfInput[len(TwilioPhoneticSpellingMagic):]
 	}
 	// Run the toolbox command
+	handlerStart := time.Now()
 	ret := hand.cmdProc.Process(r.Context(), toolbox.Command{
 		DaemonName: "httpd",
 		ClientTag:  phoneNumber,
 		TimeoutSec: TwilioHandlerTimeoutSec,
 		Content:    toolbox.DTMFDecode(dtmfInput),
 	}, true)
+	locale := hand.cmdProc.Locale
 	combinedOutput := ret.CombinedOutput
 	if phoneticSpelling {
-		combinedOutput = toolbox.SpellPhonetically(combinedOutput)
+		combinedOutput = toolbox.SpellPhoneticallyInLocale(locale, combinedOutput)
+	}
+	repeat, over := XMLEscape(toolbox.Translate(locale, toolbox.TextCallRepeat)), XMLEscape(toolbox.Translate(locale, toolbox.TextCallOver))
+	if hand.Speech != nil && len(combinedOutput) >= TwilioSpeechAudioMinLength {
+		// Synthesise the speech within the remainder of Twilio's timeout, or fall back to <Say> if it cannot be done.
+		ctx, cancel := context.WithDeadline(r.Context(), handlerStart.Add(TwilioHandlerTimeoutSec*time.Second))
+		clipURL, err := hand.Speech.SynthesiseClip(ctx, combinedOutput)
+		cancel()
+		if err == nil {
+			play := "<Play>" + XMLEscape(clipURL) + "</Play>"
+			// Play the command output three times and listen for the next input
+			_, _ = w.Write([]byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Response>
+    <Gather action="%s" method="POST" timeout="30" finishOnKey="#" numDigits="1000">
+        %s
+        %s
+        %s
+        %s
+        %s
+        %s
+    </Gather>
+</Response>
+`, strings.TrimPrefix(hand.MyEndpoint, hand.stripURLPrefixFromResponse), play, twilioSay(locale, repeat+"."), play, twilioSay(locale, repeat+"."), play, twilioSay(locale, over+"."))))
+			return
+		}
+		hand.logger.Warning(phoneNumber, err, "failed to synthesise speech audio, falling back to Twilio speech")
 	}
 	combinedOutput = XMLEscape(combinedOutput)
 	// Repeat command output three times and listen for the next input
 	_, _ = w.Write([]byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
 <Response>
     <Gather action="%s" method="POST" timeout="30" finishOnKey="#" numDigits="1000">
-        <Say>%s.
+        %s
+    </Gather>
+</Response>
+`, strings.TrimPrefix(hand.MyEndpoint, hand.stripURLPrefixFromResponse), twilioSay(locale, fmt.Sprintf(`%s.
 
-    repeat again.    
+    %s.    
 
 %s.
 
-    repeat again.    
+    %s.    
 
 %s.
-over.
-</Say>
-    </Gather>
-</Response>
-`, strings.TrimPrefix(hand.MyEndpoint, hand.stripURLPrefixFromResponse), combinedOutput, combinedOutput, combinedOutput)))
+%s.
+`, combinedOutput, repeat, combinedOutput, repeat, combinedOutput, over)))))
 }
 
 func (hand *HandleTwilioCallCallback) GetRateLimitFactor() int {
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TwilioSMSSegmentLength is the default maximum length of each outbound SMS segment, which is the length of a single GSM-7 SMS.
+	TwilioSMSSegmentLength = 160
+	// TwilioSMSMaxParts is the maximum number of parts an inbound multi-part SMS or an outbound reply may consist of.
+	TwilioSMSMaxParts = 10
+	// TwilioSMSReassemblyTimeoutSec is the maximum amount of time to wait for all parts of an inbound multi-part SMS to arrive.
+	TwilioSMSReassemblyTimeoutSec = 120
+)
+
+/*
+RegexSMSPart matches the sequence prefix of an inbound SMS part, e.g. "1/3 " or "(1/3) ". Phones that do not concatenate
+long messages use the prefix to sequence the parts. Exactly one space after the prefix belongs to the prefix.
+*/
+var RegexSMSPart = regexp.MustCompile(`^\s*\(?(\d{1,2})/(\d{1,2})\)? `)
+
+// ParseSMSPart returns the sequence number (1-based) and total number of parts of an inbound SMS part, and its content.
+// If the message does not look like a part, the sequence number and total are both 0 and the content is unchanged.
+func ParseSMSPart(body string) (seq, total int, content string) {
+	submatches := RegexSMSPart.FindStringSubmatch(body)
+	if len(submatches) != 3 {
+		return 0, 0, body
+	}
+	seq, _ = strconv.Atoi(submatches[1])
+	total, _ = strconv.Atoi(submatches[2])
+	if total < 2 || total > TwilioSMSMaxParts || seq < 1 || seq > total {
+		return 0, 0, body
+	}
+	return seq, total, body[len(submatches[0]):]
+}
+
+/*
+SplitSMS splits the text into segments no longer than the segment length. Each segment is prefixed with its sequence
+number, e.g. "1/3 ", so that the recipient may put them in order. The text is truncated if it does not fit into the
+maximum number of segments. Text that fits into a single segment is returned as-is.
+*/
+func SplitSMS(text string, segmentLength, maxSegments int) []string {
+	runes := []rune(text)
+	if len(runes) <= segmentLength || maxSegments < 2 {
+		return []string{text}
+	}
+	// Reserve room for the longest sequence prefix, e.g. "10/10 ".
+	contentLength := segmentLength - len(fmt.Sprintf("%d/%d ", maxSegments, maxSegments))
+	if contentLength < 1 {
+		return []string{text}
+	}
+	numSegments := (len(runes) + contentLength - 1) / contentLength
+	if numSegments > maxSegments {
+		numSegments = maxSegments
+	}
+	segments := make([]string, 0, numSegments)
+	for i := 0; i < numSegments; i++ {
+		end := (i + 1) * contentLength
+		if end > len(runes) {
+			end = len(runes)
+		}
+		segments = append(segments, fmt.Sprintf("%d/%d %s", i+1, numSegments, string(runes[i*contentLength:end])))
+	}
+	return segments
+}
+
+// smsAssembly holds the parts of an inbound multi-part SMS received so far.
+type smsAssembly struct {
+	parts    []string
+	received []bool
+	numPart  int
+	begin    time.Time
+}
+
+// SMSReassembler puts together the parts of inbound multi-part SMS from each sender.
+type SMSReassembler struct {
+	assemblies map[string]*smsAssembly
+	mutex      *sync.Mutex
+}
+
+// NewSMSReassembler returns an initialised SMS reassembler.
+func NewSMSReassembler() *SMSReassembler {
+	return &SMSReassembler{assemblies: make(map[string]*smsAssembly), mutex: new(sync.Mutex)}
+}
+
+// discardExpired removes the incomplete messages that took too long to arrive. Caller must hold the mutex.
+func (re *SMSReassembler) discardExpired(now time.Time) {
+	for key, assembly := range re.assemblies {
+		if now.Sub(assembly.begin) > TwilioSMSReassemblyTimeoutSec*time.Second {
+			delete(re.assemblies, key)
+		}
+	}
+}
+
+// IsOngoing returns true only if some parts of a message of the same length have already arrived from the sender.
+func (re *SMSReassembler) IsOngoing(sender string, total int) bool {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+	re.discardExpired(time.Now())
+	assembly, exists := re.assemblies[sender]
+	return exists && len(assembly.parts) == total
+}
+
+/*
+Add stores a part of SMS from the sender. It returns the complete message and true after the last missing part has
+arrived. The parts of an incomplete message are discarded after TwilioSMSReassemblyTimeoutSec, or when a part of a
+message of different length arrives.
+*/
+func (re *SMSReassembler) Add(sender string, seq, total int, content string) (string, bool) {
+	re.mutex.Lock()
+	defer re.mutex.Unlock()
+	now := time.Now()
+	re.discardExpired(now)
+	assembly, exists := re.assemblies[sender]
+	if !exists || len(assembly.parts) != total {
+		assembly = &smsAssembly{parts: make([]string, total), received: make([]bool, total), begin: now}
+		re.assemblies[sender] = assembly
+	}
+	if !assembly.received[seq-1] {
+		assembly.received[seq-1] = true
+		assembly.numPart++
+	}
+	assembly.parts[seq-1] = content
+	if assembly.numPart < total {
+		return "", false
+	}
+	delete(re.assemblies, sender)
+	return strings.Join(assembly.parts, ""), true
+}
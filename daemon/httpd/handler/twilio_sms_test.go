@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+func TestParseSMSPart(t *testing.T) {
+	if seq, total, content := ParseSMSPart("1/3 verysecret .s"); seq != 1 || total != 3 || content != "verysecret .s" {
+		t.Fatal(seq, total, content)
+	}
+	if seq, total, content := ParseSMSPart("(2/2)  echo hi"); seq != 2 || total != 2 || content != " echo hi" {
+		t.Fatal(seq, total, content)
+	}
+	for _, body := range []string{"verysecret .s echo 1/2", "3/2 abc", "1/1 abc", "1/11 abc", "1/2abc"} {
+		if seq, total, content := ParseSMSPart(body); seq != 0 || total != 0 || content != body {
+			t.Fatal(body, seq, total, content)
+		}
+	}
+}
+
+func TestSplitSMS(t *testing.T) {
+	if segments := SplitSMS("short", 10, 3); !reflect.DeepEqual(segments, []string{"short"}) {
+		t.Fatal(segments)
+	}
+	if segments := SplitSMS("0123456789abc", 10, 1); !reflect.DeepEqual(segments, []string{"0123456789abc"}) {
+		t.Fatal(segments)
+	}
+	if segments := SplitSMS("0123456789abc", 10, 3); !reflect.DeepEqual(segments, []string{"1/3 012345", "2/3 6789ab", "3/3 c"}) {
+		t.Fatal(segments)
+	}
+	// Truncate the text that does not fit into the maximum number of segments
+	if segments := SplitSMS(strings.Repeat("a", 100), 10, 2); !reflect.DeepEqual(segments, []string{"1/2 aaaaaa", "2/2 aaaaaa"}) {
+		t.Fatal(segments)
+	}
+}
+
+func TestSMSReassembler(t *testing.T) {
+	re := NewSMSReassembler()
+	if re.IsOngoing("a", 3) {
+		t.Fatal("should not be ongoing")
+	}
+	if _, complete := re.Add("a", 3, 3, "c"); complete {
+		t.Fatal("should not be complete")
+	}
+	if !re.IsOngoing("a", 3) || re.IsOngoing("a", 2) || re.IsOngoing("b", 3) {
+		t.Fatal("wrong ongoing state")
+	}
+	if _, complete := re.Add("b", 1, 2, "x"); complete {
+		t.Fatal("should not be complete")
+	}
+	if _, complete := re.Add("a", 1, 3, "a"); complete {
+		t.Fatal("should not be complete")
+	}
+	// Duplicated part does not complete the message
+	if _, complete := re.Add("a", 1, 3, "a"); complete {
+		t.Fatal("should not be complete")
+	}
+	if msg, complete := re.Add("a", 2, 3, "b"); !complete || msg != "abc" {
+		t.Fatal(msg, complete)
+	}
+	if re.IsOngoing("a", 3) {
+		t.Fatal("should not be ongoing")
+	}
+}
+
+func TestHandleTwilioSMSHook(t *testing.T) {
+	hand := &HandleTwilioSMSHook{MaxSegments: 3, SegmentLength: 20}
+	if err := hand.Initialise(lalog.DefaultLogger, toolbox.GetTestCommandProcessor(), ""); err != nil {
+		t.Fatal(err)
+	}
+	sms := func(body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/sms", strings.NewReader(url.Values{"Body": {body}, "From": {"+123"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		hand.Handle(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+	if code, body := sms("1/2 " + toolbox.TestCommandProcessorPIN + ".s echo 0123456789"); code != http.StatusOK || !strings.Contains(body, "<Response></Response>") {
+		t.Fatal(code, body)
+	}
+	// The second part is not subjected to the sender rate limit
+	code, body := sms("2/2 abcdefghijklmnopqrstuvwxyz")
+	if code != http.StatusOK || !strings.Contains(body, "<Message>1/3 0123456789abcdef</Message><Message>2/3 ghijklmnopqrstuv</Message><Message>3/3 wxy</Message>") {
+		t.Fatal(code, body)
+	}
+	// A new message is subjected to the sender rate limit
+	if code, body := sms("1/2 " + toolbox.TestCommandProcessorPIN); code != http.StatusServiceUnavailable {
+		t.Fatal(code, body)
+	}
+	if err := (&HandleTwilioSMSHook{MaxSegments: TwilioSMSMaxParts + 1}).Initialise(lalog.DefaultLogger, toolbox.GetTestCommandProcessor(), ""); err == nil {
+		t.Fatal("did not reject excessive segments")
+	}
+}
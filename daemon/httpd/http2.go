@@ -0,0 +1,94 @@
+package httpd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	// DefaultHTTP2MaxConcurrentStreams is the default number of requests a client may make simultaneously over an HTTP/2 connection.
+	DefaultHTTP2MaxConcurrentStreams = 250
+	// DefaultIdleTimeoutSec is the default duration for which an idle keep-alive (HTTP/1.1) or HTTP/2 connection stays open.
+	DefaultIdleTimeoutSec = 120
+)
+
+/*
+HTTP2 configures the HTTP/2 protocol support of the web server. HTTP/2 multiplexes many requests over a single
+connection, which benefits the web pages that load plenty of resources (e.g. via the web proxy) as well as the
+simultaneous downloads from the directories.
+*/
+type HTTP2 struct {
+	// DisableTLS turns off HTTP/2 on the HTTPS listener, which otherwise negotiates HTTP/2 with the clients via ALPN.
+	DisableTLS bool `json:"DisableTLS"`
+	/*
+		EnableH2C additionally serves HTTP/2 over cleartext (h2c) on the plain HTTP and unix domain socket listeners, both
+		with prior knowledge and via the HTTP/1.1 upgrade. It suits a front proxy or load balancer that speaks h2c to the
+		server.
+	*/
+	EnableH2C bool `json:"EnableH2C"`
+	// MaxConcurrentStreams is the maximum number of requests a client may make simultaneously over an HTTP/2 connection.
+	MaxConcurrentStreams uint32 `json:"MaxConcurrentStreams"`
+	// IdleTimeoutSec is the duration for which an idle keep-alive (HTTP/1.1) or HTTP/2 connection stays open.
+	IdleTimeoutSec int `json:"IdleTimeoutSec"`
+}
+
+// Initialise validates the configuration and assigns the default values.
+func (conf *HTTP2) Initialise() error {
+	if conf.IdleTimeoutSec < 0 {
+		return errors.New("HTTP2.Initialise: IdleTimeoutSec must not be negative")
+	}
+	if conf.MaxConcurrentStreams == 0 {
+		conf.MaxConcurrentStreams = DefaultHTTP2MaxConcurrentStreams
+	}
+	if conf.IdleTimeoutSec == 0 {
+		conf.IdleTimeoutSec = DefaultIdleTimeoutSec
+	}
+	return nil
+}
+
+/*
+configureServer returns a new HTTP/2 server that works with the HTTP server. Each HTTP server needs its own HTTP/2 server,
+which keeps track of the HTTP/2 connections and closes them when the HTTP server shuts down.
+*/
+func (conf *HTTP2) configureServer(server *http.Server) (*http2.Server, error) {
+	server.IdleTimeout = time.Duration(conf.IdleTimeoutSec) * time.Second
+	h2Server := &http2.Server{
+		MaxConcurrentStreams: conf.MaxConcurrentStreams,
+		IdleTimeout:          server.IdleTimeout,
+	}
+	return h2Server, http2.ConfigureServer(server, h2Server)
+}
+
+// configureServerWithTLS enables or disables HTTP/2 on the HTTPS server according to the configuration.
+func (conf *HTTP2) configureServerWithTLS(server *http.Server) error {
+	if conf.DisableTLS {
+		server.IdleTimeout = time.Duration(conf.IdleTimeoutSec) * time.Second
+		// A non-nil and empty map stops the server from negotiating HTTP/2
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		return nil
+	}
+	if _, err := conf.configureServer(server); err != nil {
+		return fmt.Errorf("HTTP2.configureServerWithTLS: %w", err)
+	}
+	return nil
+}
+
+// configureServerNoTLS enables h2c on the HTTP server that does not use TLS, if it is configured to do so.
+func (conf *HTTP2) configureServerNoTLS(server *http.Server) error {
+	if !conf.EnableH2C {
+		server.IdleTimeout = time.Duration(conf.IdleTimeoutSec) * time.Second
+		return nil
+	}
+	h2Server, err := conf.configureServer(server)
+	if err != nil {
+		return fmt.Errorf("HTTP2.configureServerNoTLS: %w", err)
+	}
+	server.Handler = h2c.NewHandler(server.Handler, h2Server)
+	return nil
+}
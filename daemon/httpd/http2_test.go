@@ -0,0 +1,127 @@
+package httpd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestHTTP2_Initialise(t *testing.T) {
+	conf := HTTP2{}
+	require.NoError(t, conf.Initialise())
+	require.EqualValues(t, DefaultHTTP2MaxConcurrentStreams, conf.MaxConcurrentStreams)
+	require.Equal(t, DefaultIdleTimeoutSec, conf.IdleTimeoutSec)
+	require.Error(t, (&HTTP2{IdleTimeoutSec: -1}).Initialise())
+}
+
+// getHTTPProto makes a GET request using the client and returns the protocol version and body of the response.
+func getHTTPProto(t *testing.T, client *http.Client, url string) (string, string) {
+	var resp *http.Response
+	var err error
+	for i := 0; i < 30; i++ {
+		if resp, err = client.Get(url); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return resp.Proto, string(body)
+}
+
+func TestHTTPD_HTTP2WithTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCert(t, dir, time.Now().Add(time.Hour), "localhost")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0600))
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	for _, disable := range []bool{false, true} {
+		daemon := Daemon{
+			Address:          "localhost",
+			Port:             34871,
+			TLSCertPath:      filepath.Join(dir, "localhost.crt"),
+			TLSKeyPath:       filepath.Join(dir, "localhost.key"),
+			ServeDirectories: map[string]string{"/dir": dir},
+			HTTP2:            HTTP2{DisableTLS: disable, MaxConcurrentStreams: 10},
+		}
+		require.NoError(t, daemon.Initialise("", ""))
+		serverStopped := make(chan struct{})
+		go func() {
+			if err := daemon.StartAndBlockWithTLS(); err != nil {
+				t.Error(err)
+			}
+			close(serverStopped)
+		}()
+		require.True(t, misc.ProbePort(30*time.Second, daemon.Address, daemon.Port))
+		proto, body := getHTTPProto(t, client, fmt.Sprintf("https://localhost:%d/dir/a.txt", daemon.Port))
+		require.Equal(t, "hello", body)
+		if disable {
+			require.Equal(t, "HTTP/1.1", proto)
+		} else {
+			require.Equal(t, "HTTP/2.0", proto)
+		}
+		daemon.StopTLS()
+		<-serverStopped
+		client.CloseIdleConnections()
+	}
+}
+
+func TestHTTPD_H2C(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0600))
+	// The client speaks HTTP/2 over cleartext with prior knowledge
+	h2cClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, network, addr)
+		},
+	}}
+	for _, enable := range []bool{true, false} {
+		daemon := Daemon{
+			Address:          "localhost",
+			Port:             34872,
+			ServeDirectories: map[string]string{"/dir": dir},
+			HTTP2:            HTTP2{EnableH2C: enable},
+		}
+		require.NoError(t, daemon.Initialise("", ""))
+		serverStopped := make(chan struct{})
+		go func() {
+			if err := daemon.StartAndBlockNoTLS(0); err != nil {
+				t.Error(err)
+			}
+			close(serverStopped)
+		}()
+		require.True(t, misc.ProbePort(30*time.Second, daemon.Address, daemon.Port))
+		url := fmt.Sprintf("http://localhost:%d/dir/a.txt", daemon.Port)
+		// HTTP/1.1 clients are served as usual
+		proto, body := getHTTPProto(t, http.DefaultClient, url)
+		require.Equal(t, "HTTP/1.1", proto)
+		require.Equal(t, "hello", body)
+		if enable {
+			proto, body = getHTTPProto(t, h2cClient, url)
+			require.Equal(t, "HTTP/2.0", proto)
+			require.Equal(t, "hello", body)
+		} else {
+			_, err := h2cClient.Get(url)
+			require.Error(t, err)
+		}
+		daemon.StopNoTLS()
+		<-serverStopped
+	}
+}
@@ -1,17 +1,12 @@
 package httpd
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"mime/multipart"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"reflect"
 	"strconv"
@@ -21,21 +16,18 @@ import (
 
 	"github.com/HouzuoGuo/laitos/daemon/httpd/handler"
 	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
-	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
-	"github.com/HouzuoGuo/laitos/platform"
-	"github.com/HouzuoGuo/laitos/testingstub"
 	"github.com/HouzuoGuo/laitos/toolbox"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/stretchr/testify/assert"
-	"github.com/stretchr/testify/require"
 )
 
 const (
 	DirectoryHandlerRateLimitFactor = 8  // DirectoryHandlerRateLimitFactor is 7 times less expensive than the most expensive handler
 	RateLimitIntervalSec            = 1  // Rate limit is calculated at 1 second interval
 	IOTimeoutSec                    = 60 // IO timeout for both read and write operations
+	// DirectoryDownloadTimeoutSec is the write timeout of a download from the directories, a large file takes longer than IOTimeoutSec to download.
+	DirectoryDownloadTimeoutSec = 3600
 
 	// MaxRequestBodyBytes is the maximum size (in bytes) of a request body that HTTP server will process for a request.
 	MaxRequestBodyBytes = 1024 * 1024
@@ -55,6 +47,9 @@ const (
 	// variable content at "/", "/index.htm", and "/index.html".
 	// This environment variable value takes precedence over JSON configuration.
 	EnvironmentIndexPage = "LAITOS_INDEX_PAGE"
+
+	// DefaultUnixSocketMode is the file mode of the unix domain socket, it allows a front proxy of the same group to connect.
+	DefaultUnixSocketMode = "0660"
 )
 
 // HandlerCollection is a mapping between URL and implementation of handlers. It does not contain directory handlers.
@@ -91,8 +86,23 @@ type Daemon struct {
 	PlainPort        int               `json:"-"`                // PlainPort is assigned to the port used by NoTLS listener once it starts.
 	TLSCertPath      string            `json:"TLSCertPath"`      // (Optional) serve HTTPS via this certificate
 	TLSKeyPath       string            `json:"TLSKeyPath"`       // (Optional) serve HTTPS via this certificate (key)
+	ACMEDomains      []string          `json:"ACMEDomains"`      // (Optional) serve HTTPS via the certificate of these domain names obtained and renewed automatically via ACME
 	PerIPLimit       int               `json:"PerIPLimit"`       // PerIPLimit is approximately how many concurrent users are expected to be using the server from same IP address
 	ServeDirectories map[string]string `json:"ServeDirectories"` // Serve directories (value) on prefix paths (key)
+	ErrorPages       []ErrorPage       `json:"ErrorPages"`       // (Optional) replace responses of error status codes with custom documents
+	URLRewrites      []URLRewrite      `json:"URLRewrites"`      // (Optional) redirect or internally rewrite request URLs
+	TrailingSlash    string            `json:"TrailingSlash"`    // (Optional) "add" or "remove" trailing slash from request URLs via redirect
+	UnixSocketPath   string            `json:"UnixSocketPath"`   // (Optional) additionally listen on this unix domain socket path
+	UnixSocketMode   string            `json:"UnixSocketMode"`   // (Optional) octal file mode of the unix domain socket, e.g. "0660"
+
+	Compression middleware.ResponseCompression `json:"Compression"` // (Optional) compress responses of handlers and directories
+	Mirrors     []*middleware.RequestMirror    `json:"Mirrors"`     // (Optional) mirror sampled requests of handlers and directories to other servers
+	Sessions    handler.SessionStore           `json:"Sessions"`    // (Optional) keep visitors' sessions in encrypted cookies or Redis
+	Maintenance middleware.Maintenance         `json:"Maintenance"` // (Optional) customise the page served during maintenance and the services exempted from it
+	Archive     middleware.RequestArchive      `json:"Archive"`     // (Optional) archive the requests and responses of handlers and directories in S3
+	ACME        ACME                           `json:"ACME"`        // (Optional) customise the certificate authority and challenge type of ACMEDomains
+	HTTP2       HTTP2                          `json:"HTTP2"`       // (Optional) customise HTTP/2 support and enable h2c (HTTP/2 without TLS)
+	WebDAV      WebDAV                         `json:"WebDAV"`      // (Optional) let file manager clients browse and modify ServeDirectories via WebDAV
 
 	HandlerCollection HandlerCollection         `json:"-"` // Specialised handlers that implement handler.HandlerFactory interface
 	Processor         *toolbox.CommandProcessor `json:"-"` // Feature command processor
@@ -100,9 +110,13 @@ type Daemon struct {
 	ResourcePaths map[string]struct{} `json:"-"`
 
 	mux           *http.ServeMux
+	rootHandler   http.Handler // rootHandler applies URL rules and error pages before handing over to the mux.
 	serverWithTLS *http.Server // serverWithTLS is an instance of HTTP server that will be started with TLS listener.
 	serverNoTLS   *http.Server // serverWithTLS is an instance of HTTP server that will be started with an ordinary listener.
-	logger        *lalog.Logger
+	// serverUnixSocket is an instance of HTTP server that will be started with a unix domain socket listener.
+	serverUnixSocket *http.Server
+	unixSocketMode   os.FileMode
+	logger           *lalog.Logger
 }
 
 // Return path to Handler among special handlers that matches the specified type. Primarily used by test case code.
@@ -136,7 +150,7 @@ func (daemon *Daemon) Initialise(stripURLPrefixFromRequest string, stripURLPrefi
 		daemon.Address = "0.0.0.0"
 	}
 	if daemon.Port < 1 {
-		if daemon.TLSCertPath == "" {
+		if !daemon.isTLSEnabled() {
 			daemon.Port = 80
 		} else {
 			daemon.Port = 443
@@ -160,6 +174,57 @@ func (daemon *Daemon) Initialise(stripURLPrefixFromRequest string, stripURLPrefi
 	if (daemon.TLSCertPath != "" || daemon.TLSKeyPath != "") && (daemon.TLSCertPath == "" || daemon.TLSKeyPath == "") {
 		return errors.New("httpd.Initialise: missing TLS certificate or key path")
 	}
+	if len(daemon.ACMEDomains) > 0 {
+		if daemon.TLSCertPath != "" {
+			return errors.New("httpd.Initialise: ACMEDomains and TLSCertPath must not be used at the same time")
+		}
+		if err := daemon.ACME.Initialise(daemon.ACMEDomains, daemon.logger); err != nil {
+			return fmt.Errorf("httpd.Initialise: %w", err)
+		}
+	}
+	if err := daemon.initialiseURLRules(); err != nil {
+		return err
+	}
+	if err := daemon.HTTP2.Initialise(); err != nil {
+		return fmt.Errorf("httpd.Initialise: %w", err)
+	}
+	if err := daemon.Compression.Initialise(); err != nil {
+		return fmt.Errorf("httpd.Initialise: %w", err)
+	}
+	if err := daemon.Maintenance.Initialise(); err != nil {
+		return fmt.Errorf("httpd.Initialise: %w", err)
+	}
+	if err := daemon.Archive.Initialise(daemon.logger); err != nil {
+		return fmt.Errorf("httpd.Initialise: %w", err)
+	}
+	if err := daemon.WebDAV.Initialise(daemon.ServeDirectories, daemon.logger); err != nil {
+		return fmt.Errorf("httpd.Initialise: %w", err)
+	}
+	// Mirrors are looked up by the URL location of web service or directory
+	mirrors := make(map[string]*middleware.RequestMirror)
+	for _, mirror := range daemon.Mirrors {
+		if err := mirror.Initialise(daemon.logger); err != nil {
+			return fmt.Errorf("httpd.Initialise: %w", err)
+		}
+		if _, exists := mirrors[mirror.Location]; exists {
+			return fmt.Errorf("httpd.Initialise: there are more than one mirror for location \"%s\"", mirror.Location)
+		}
+		mirrors[mirror.Location] = mirror
+	}
+	if err := daemon.Sessions.Initialise(); err != nil {
+		return fmt.Errorf("httpd.Initialise: %w", err)
+	}
+	if daemon.Sessions.Secret == "" {
+		daemon.logger.Info("", nil, "sessions will not survive program restart or be shared by other program instances due to lack of session secret")
+	}
+	if daemon.UnixSocketMode == "" {
+		daemon.UnixSocketMode = DefaultUnixSocketMode
+	}
+	if mode, err := strconv.ParseUint(daemon.UnixSocketMode, 8, 32); err != nil || mode > 0777 {
+		return fmt.Errorf("httpd.Initialise: UnixSocketMode \"%s\" must be an octal file mode such as \"0660\"", daemon.UnixSocketMode)
+	} else {
+		daemon.unixSocketMode = os.FileMode(mode)
+	}
 
 	// Install handlers with rate-limiting middleware
 	daemon.mux = new(http.ServeMux)
@@ -170,7 +235,7 @@ func (daemon *Daemon) Initialise(stripURLPrefixFromRequest string, stripURLPrefi
 
 	// Prometheus histograms that use a label to tell the HTTP handler associated with the histogram metrics
 	var handlerDurationHistogram, responseTimeToFirstByteHistogram, responseSizeHistogram *prometheus.HistogramVec
-	if misc.EnablePrometheusIntegration {
+	if misc.PrometheusIntegration.IsEnabled() {
 		metricsLabelNames := []string{middleware.PrometheusHandlerTypeLabel, middleware.PrometheusHandlerLocationLabel}
 		handlerDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "laitos_httpd_handler_duration_seconds",
@@ -206,17 +271,33 @@ func (daemon *Daemon) Initialise(stripURLPrefixFromRequest string, stripURLPrefi
 			if urlLocation[len(urlLocation)-1] != '/' {
 				urlLocation += "/"
 			}
+			mirror := mirrors[urlLocation]
+			if mirror == nil {
+				// The location of a mirror may come without the trailing slash
+				mirror = mirrors[strings.TrimSuffix(urlLocation, "/")]
+			}
+			if mirror != nil {
+				delete(mirrors, mirror.Location)
+			}
+			configuredLocation := urlLocation
 			urlLocation = stripURLPrefixFromRequest + urlLocation
-			rl := lalog.NewRateLimit(RateLimitIntervalSec, DirectoryHandlerRateLimitFactor*daemon.PerIPLimit, daemon.logger)
+			rl := lalog.NewSharedRateLimit(fmt.Sprintf("httpd-%d%s", daemon.Port, urlLocation), RateLimitIntervalSec, DirectoryHandlerRateLimitFactor*daemon.PerIPLimit, daemon.logger)
 			daemon.ResourcePaths[urlLocation] = struct{}{}
 			decoratedHandlerFunc := middleware.LogRequestStats(daemon.logger,
 				middleware.RecordInternalStats(misc.HTTPDStats,
 					middleware.EmergencyLockdown(
-						middleware.RecordLatestRequests(daemon.logger,
-							middleware.RecordPrometheusStats("FileServer", urlLocation, handlerDurationHistogram, responseTimeToFirstByteHistogram, responseSizeHistogram,
-								middleware.RateLimit(rl,
-									middleware.RestrictMaxRequestSize(MaxRequestBodyBytes,
-										http.StripPrefix(urlLocation, http.FileServer(http.Dir(dirPath))).(http.HandlerFunc))))))))
+						middleware.ServeMaintenancePage(&daemon.Maintenance, configuredLocation,
+							middleware.RecordLatestRequests(daemon.logger,
+								middleware.RecordPrometheusStats("FileServer", urlLocation, handlerDurationHistogram, responseTimeToFirstByteHistogram, responseSizeHistogram,
+									middleware.RateLimit(rl,
+										// WebDAV requests manage the files, they are neither mirrored, compressed, nor archived.
+										// WebDAV uploads are limited by their own maximum size rather than MaxRequestBodyBytes.
+										daemon.WebDAV.serveDirectory(configuredLocation, urlLocation, dirPath,
+											middleware.MirrorRequest(mirror,
+												middleware.CompressResponse(daemon.Compression,
+													middleware.ArchiveRequests(&daemon.Archive, configuredLocation,
+														middleware.RestrictMaxRequestSize(MaxRequestBodyBytes,
+															serveDirectory(urlLocation, dirPath)))))))))))))
 			daemon.mux.Handle(urlLocation, decoratedHandlerFunc)
 			daemon.logger.Info("", nil, "installed directory listing handler at location \"%s\"", urlLocation)
 		}
@@ -233,10 +314,16 @@ func (daemon *Daemon) Initialise(stripURLPrefixFromRequest string, stripURLPrefi
 
 	// Install web service handlers.
 	for urlLocation, hand := range daemon.HandlerCollection {
+		if sessionUser, ok := hand.(handler.SessionUser); ok {
+			sessionUser.SetSessionStore(&daemon.Sessions)
+		}
 		if err := hand.Initialise(daemon.logger, daemon.Processor, stripURLPrefixFromResponse); err != nil {
 			return err
 		}
-		rl := lalog.NewRateLimit(RateLimitIntervalSec, hand.GetRateLimitFactor()*daemon.PerIPLimit, daemon.logger)
+		rl := lalog.NewSharedRateLimit(fmt.Sprintf("httpd-%d%s", daemon.Port, stripURLPrefixFromRequest+urlLocation), RateLimitIntervalSec, hand.GetRateLimitFactor()*daemon.PerIPLimit, daemon.logger)
+		mirror := mirrors[urlLocation]
+		delete(mirrors, urlLocation)
+		configuredLocation := urlLocation
 		urlLocation = stripURLPrefixFromRequest + urlLocation
 		daemon.ResourcePaths[urlLocation] = struct{}{}
 		// With the exception of file upload handler, all handlers will be subject to a limited request size.
@@ -249,16 +336,50 @@ func (daemon *Daemon) Initialise(stripURLPrefixFromRequest string, stripURLPrefi
 		decoratedHandlerFunc := middleware.LogRequestStats(daemon.logger,
 			middleware.RecordInternalStats(misc.HTTPDStats,
 				middleware.EmergencyLockdown(
-					middleware.RecordLatestRequests(daemon.logger,
-						middleware.RecordPrometheusStats(handlerTypeName, urlLocation, handlerDurationHistogram, responseTimeToFirstByteHistogram, responseSizeHistogram,
-							middleware.WithAWSXray(
-								middleware.RateLimit(rl, innerMostHandler)))))))
+					middleware.ServeMaintenancePage(&daemon.Maintenance, configuredLocation,
+						middleware.RecordLatestRequests(daemon.logger,
+							middleware.RecordPrometheusStats(handlerTypeName, urlLocation, handlerDurationHistogram, responseTimeToFirstByteHistogram, responseSizeHistogram,
+								middleware.WithAWSXray(
+									middleware.RateLimit(rl,
+										middleware.MirrorRequest(mirror,
+											middleware.CompressResponse(daemon.Compression,
+												middleware.ArchiveRequests(&daemon.Archive, configuredLocation, innerMostHandler)))))))))))
 		daemon.mux.Handle(urlLocation, decoratedHandlerFunc)
 		daemon.logger.Info("", nil, "installed web service \"%s\" at location \"%s\"", handlerTypeName, urlLocation)
 	}
+	for location := range mirrors {
+		return fmt.Errorf("httpd.Initialise: the mirror location \"%s\" does not match any web service or directory", location)
+	}
+	daemon.rootHandler = daemon.applyURLRules(daemon.mux)
+	// The DNS server directs visitors of black listed names here, serve them the block page regardless of the URL.
+	if location := daemon.GetHandlerByFactoryType(&handler.HandleBlockPage{}); location != "" {
+		blockPage := daemon.HandlerCollection[location].(*handler.HandleBlockPage)
+		daemon.rootHandler = blockPage.RedirectBlockedHosts(stripURLPrefixFromRequest+location, daemon.rootHandler)
+	}
+	// The certificate authority visits the HTTP server on port 80 for the tokens of HTTP-01 challenges.
+	if len(daemon.ACMEDomains) > 0 {
+		daemon.rootHandler = daemon.ACME.ServeHTTPChallenge(daemon.rootHandler)
+	}
 	return nil
 }
 
+// serveDirectory returns a handler function that serves the files of the directory at the URL location.
+func serveDirectory(urlLocation, dirPath string) http.HandlerFunc {
+	fileServer := http.StripPrefix(urlLocation, http.FileServer(http.Dir(dirPath)))
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extend the write deadline of the request, over HTTP/2 the deadline is only for the stream of this request.
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(DirectoryDownloadTimeoutSec * time.Second)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			lalog.DefaultLogger.Info(urlLocation, err, "failed to extend the write deadline")
+		}
+		fileServer.ServeHTTP(w, r)
+	}
+}
+
+// isTLSEnabled returns true if the daemon is configured to serve HTTPS with a certificate file or an ACME certificate.
+func (daemon *Daemon) isTLSEnabled() bool {
+	return daemon.TLSCertPath != "" || len(daemon.ACMEDomains) > 0
+}
+
 /*
 StartAndBlockNoTLS starts HTTP daemon and serve unencrypted connections. Blocks caller until StopNoTLS function is called.
 You may call this function only after having called Initialise()!
@@ -272,7 +393,7 @@ func (daemon *Daemon) StartAndBlockNoTLS(fallbackPort int) error {
 		Not very elegant, but it should help to launch HTTP daemon in TLS only, TLS + HTTP, and HTTP only scenarios.
 	*/
 	if envPort := strings.TrimSpace(os.Getenv(EnvironmentPortNumber)); envPort == "" {
-		if daemon.TLSCertPath == "" {
+		if !daemon.isTLSEnabled() {
 			daemon.PlainPort = daemon.Port
 		} else {
 			daemon.PlainPort = fallbackPort
@@ -287,10 +408,13 @@ func (daemon *Daemon) StartAndBlockNoTLS(fallbackPort int) error {
 	// Configure servers with rather generous and sane defaults
 	daemon.serverNoTLS = &http.Server{
 		Addr:         net.JoinHostPort(daemon.Address, strconv.Itoa(daemon.PlainPort)),
-		Handler:      daemon.mux,
+		Handler:      daemon.rootHandler,
 		ReadTimeout:  IOTimeoutSec * time.Second,
 		WriteTimeout: IOTimeoutSec * time.Second,
 	}
+	if err := daemon.HTTP2.configureServerNoTLS(daemon.serverNoTLS); err != nil {
+		return fmt.Errorf("httpd.StartAndBlockNoTLS: %w", err)
+	}
 	daemon.logger.Info("", nil, "going to listen for HTTP connections on port %d", daemon.PlainPort)
 	if err := daemon.serverNoTLS.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("httpd.StartAndBlockNoTLS: failed to listen on %s:%d - %v", daemon.Address, daemon.Port, err)
@@ -303,20 +427,34 @@ StartAndBlockWithTLS starts HTTP daemon and serve encrypted connections. Blocks
 You may call this function only after having called Initialise()!
 */
 func (daemon *Daemon) StartAndBlockWithTLS() error {
-	contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, daemon.TLSCertPath, daemon.TLSKeyPath)
-	if err != nil {
-		return err
-	}
-	tlsCert, err := tls.X509KeyPair(contents[0], contents[1])
-	if err != nil {
-		return fmt.Errorf("httpd.StartAndBlockWithTLS: failed to load certificate or key - %v", err)
+	var tlsConfig *tls.Config
+	if len(daemon.ACMEDomains) > 0 {
+		// Obtain and renew the certificate in the background, the server presents the latest certificate to each client.
+		acmeCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go daemon.ACME.StartAndBlock(acmeCtx)
+		tlsConfig = misc.DefaultTLS.ServerConfig()
+		tlsConfig.GetCertificate = daemon.ACME.GetCertificate
+	} else {
+		contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, daemon.TLSCertPath, daemon.TLSKeyPath)
+		if err != nil {
+			return err
+		}
+		tlsCert, err := tls.X509KeyPair(contents[0], contents[1])
+		if err != nil {
+			return fmt.Errorf("httpd.StartAndBlockWithTLS: failed to load certificate or key - %v", err)
+		}
+		tlsConfig = misc.DefaultTLS.ServerConfig(tlsCert)
 	}
 	daemon.serverWithTLS = &http.Server{
 		Addr:         net.JoinHostPort(daemon.Address, strconv.Itoa(daemon.Port)),
-		Handler:      daemon.mux,
+		Handler:      daemon.rootHandler,
 		ReadTimeout:  IOTimeoutSec * time.Second,
 		WriteTimeout: IOTimeoutSec * time.Second,
-		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{tlsCert}},
+		TLSConfig:    tlsConfig,
+	}
+	if err := daemon.HTTP2.configureServerWithTLS(daemon.serverWithTLS); err != nil {
+		return fmt.Errorf("httpd.StartAndBlockWithTLS: %w", err)
 	}
 	daemon.logger.Info("", nil, "going to listen for HTTPS connections on port %d", daemon.Port)
 
@@ -326,6 +464,52 @@ func (daemon *Daemon) StartAndBlockWithTLS() error {
 	return nil
 }
 
+/*
+StartAndBlockUnixSocket starts HTTP daemon and serve unencrypted connections on the unix domain socket path. Blocks caller
+until StopUnixSocket function is called.
+You may call this function only after having called Initialise()!
+*/
+func (daemon *Daemon) StartAndBlockUnixSocket() error {
+	if daemon.UnixSocketPath == "" {
+		return errors.New("httpd.StartAndBlockUnixSocket: UnixSocketPath is not configured")
+	}
+	// Remove the socket left behind by a previous run, but never remove an ordinary file.
+	if info, err := os.Lstat(daemon.UnixSocketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("httpd.StartAndBlockUnixSocket: %s already exists and is not a socket", daemon.UnixSocketPath)
+		}
+		if err := os.Remove(daemon.UnixSocketPath); err != nil {
+			return fmt.Errorf("httpd.StartAndBlockUnixSocket: failed to remove stale socket %s - %w", daemon.UnixSocketPath, err)
+		}
+	}
+	listener, err := net.Listen("unix", daemon.UnixSocketPath)
+	if err != nil {
+		return fmt.Errorf("httpd.StartAndBlockUnixSocket: failed to listen on %s - %w", daemon.UnixSocketPath, err)
+	}
+	if err := os.Chmod(daemon.UnixSocketPath, daemon.unixSocketMode); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("httpd.StartAndBlockUnixSocket: failed to change mode of %s - %w", daemon.UnixSocketPath, err)
+	}
+	daemon.serverUnixSocket = &http.Server{
+		// Clients of unix domain socket are local, which also lets the middleware trust the client IP forwarded by a front proxy.
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.RemoteAddr = "127.0.0.1:0"
+			daemon.rootHandler.ServeHTTP(w, r)
+		}),
+		ReadTimeout:  IOTimeoutSec * time.Second,
+		WriteTimeout: IOTimeoutSec * time.Second,
+	}
+	if err := daemon.HTTP2.configureServerNoTLS(daemon.serverUnixSocket); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("httpd.StartAndBlockUnixSocket: %w", err)
+	}
+	daemon.logger.Info("", nil, "going to listen for HTTP connections on unix domain socket %s", daemon.UnixSocketPath)
+	if err := daemon.serverUnixSocket.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("httpd.StartAndBlockUnixSocket: failed to serve on %s - %v", daemon.UnixSocketPath, err)
+	}
+	return nil
+}
+
 // Stop HTTP daemon - the listener without TLS.
 func (daemon *Daemon) StopNoTLS() {
 	if server := daemon.serverNoTLS; server != nil {
@@ -348,448 +532,13 @@ func (daemon *Daemon) StopTLS() {
 	}
 }
 
-// Run unit tests on API handlers of an already started HTTP daemon all API handlers. Essentially, it tests "handler" package.
-func TestAPIHandlers(httpd *Daemon, t testingstub.T) {
-	addr := fmt.Sprintf("http://%s:%d", httpd.Address, httpd.Port)
-	// System information
-	resp, err := inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/info")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "Stack traces:") {
-		t.Fatal(err, string(resp.Body))
-	}
-	// Command Form
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/cmd_form")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "submit") {
-		t.Fatal(err, string(resp.Body))
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{Method: http.MethodPost}, addr+"/cmd_form")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "submit") {
-		t.Fatal(err, string(resp.Body))
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body:   strings.NewReader(url.Values{"cmd": {"verysecret.secho cmd_form_test"}}.Encode()),
-	}, addr+"/cmd_form")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "cmd_form_test") {
-		t.Fatal(err, string(resp.Body))
-	}
-	// File upload - home page
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/upload")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "submit") {
-		t.Fatal(err, string(resp.Body))
-	}
-	// File upload - upload
-	fileUploadRequestBody := &bytes.Buffer{}
-	fileUploadRequestWriter := multipart.NewWriter(fileUploadRequestBody)
-	fileUploadPart, err := fileUploadRequestWriter.CreateFormFile("upload", "sample-upload.html")
-	if err != nil {
-		t.Fatal(err)
-	}
-	uploadSourceFile, err := os.Open("/tmp/test-laitos-index.html")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer uploadSourceFile.Close()
-	if _, err = io.Copy(fileUploadPart, uploadSourceFile); err != nil {
-		t.Fatal(err)
-	}
-	if err = fileUploadRequestWriter.WriteField("submit", "Upload"); err != nil {
-		t.Fatal(err)
-	}
-	if err = fileUploadRequestWriter.Close(); err != nil {
-		t.Fatal(err)
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method:      http.MethodPost,
-		ContentType: fileUploadRequestWriter.FormDataContentType(),
-		Body:        fileUploadRequestBody,
-	}, addr+"/upload")
-	assert.NoError(t, err)
-	assert.Equal(t, http.StatusOK, resp.StatusCode)
-	// File upload - download
-	var downloadFileName string
-	for _, line := range strings.Split(string(resp.Body), "\n") {
-		/*
-			The line looks like:
-			<pre>.... Your file is available for 24 hours under name: xxxx.nnn</pre>
-		*/
-		if strings.Contains(line, "Your file is available for 24 hours") {
-			downloadFileName = line[strings.IndexRune(line, ':')+1 : strings.LastIndexByte(line, '<')]
-		}
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method:      http.MethodPost,
-		ContentType: "application/x-www-form-urlencoded",
-		Body:        strings.NewReader(url.Values{"submit": []string{"Download"}, "download": []string{downloadFileName}}.Encode()),
-	}, addr+"/upload")
-	if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != TestLaitosIndexHTMLContent {
-		t.Fatal(err, resp, string(resp.Body))
-	}
-
-	// Gitlab handle
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/gitlab")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "Enter path to browse") {
-		t.Fatal(err, string(resp.Body), resp)
-	}
-	// HTML file
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/html")
-	expected := "this is index 127.0.0.1 " + time.Now().Format(time.RFC3339)
-	if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != expected {
-		t.Fatal(err, string(resp.Body), expected, resp)
-	}
-	// MailMe
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/mail_me")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "submit") {
-		t.Fatal(err, string(resp.Body))
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{Method: http.MethodPost}, addr+"/mail_me")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "submit") {
-		t.Fatal(err, string(resp.Body))
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body:   strings.NewReader(url.Values{"msg": {"又给你发了一个邮件"}}.Encode()),
-	}, addr+"/mail_me")
-	if err != nil || resp.StatusCode != http.StatusOK ||
-		(!strings.Contains(string(resp.Body), "发不出去") && !strings.Contains(string(resp.Body), "发出去了")) {
-		t.Fatal(err, string(resp.Body))
-	}
-	// Microsoft bot
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/microsoft_bot")
-	if err != nil || resp.StatusCode != http.StatusBadRequest {
-		t.Fatal(err, string(resp.Body))
-	}
-	microsoftBotDummyChat := handler.MicrosoftBotIncomingChat{}
-	var microsoftBotDummyChatRequest []byte
-	if microsoftBotDummyChatRequest, err = json.Marshal(microsoftBotDummyChat); err != nil {
-		t.Fatal(err)
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Body: bytes.NewReader(microsoftBotDummyChatRequest)}, addr+"/microsoft_bot")
-	if err != nil || resp.StatusCode != http.StatusOK {
-		t.Fatal(err, string(resp.Body))
-	}
-	// Recurring commands - setup page
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/recurring_cmds")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "submit") {
-		t.Fatal(err, string(resp.Body))
-	}
-	// Recurring commands - retrieve results
-	time.Sleep(time.Duration(httpd.HandlerCollection["/recurring_cmds"].(*handler.HandleRecurringCommands).RecurringCommands["channel2"].IntervalSec+1) * time.Second) // give timer commands a moment to trigger
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/recurring_cmds?retrieve=channel2")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "channel2") {
-		t.Fatal(err, string(resp.Body))
-	}
-	// Proxy (visit https://github.com)
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/proxy?u=https%%3A%%2F%%2Fgithub.com")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "github") || !strings.Contains(string(resp.Body), "laitos_rewrite_url") {
-		t.Fatal(err, resp.StatusCode, string(resp.Body))
-	}
-	// Twilio - exchange SMS with bad PIN
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body:   strings.NewReader(url.Values{"Body": {"incorrect PIN"}}.Encode()),
-	}, addr+httpd.GetHandlerByFactoryType(&handler.HandleTwilioSMSHook{}))
-	if err != nil || resp.StatusCode != http.StatusServiceUnavailable || strings.TrimSpace(string(resp.Body)) != toolbox.ErrPINAndShortcutNotFound.Error() {
-		t.Fatal(err, string(resp.Body))
-	}
-	// Twilio - exchange SMS, the extra spaces around prefix and PIN do not matter.
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body:   strings.NewReader(url.Values{"Body": {"verysecret .s echo 0123456789012345678901234567890123456789"}}.Encode()),
-	}, addr+httpd.GetHandlerByFactoryType(&handler.HandleTwilioSMSHook{}))
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `01234567890123456789012345678901234`) {
-		t.Fatal(err, string(resp.Body))
-	}
-	// Twilio - prevent SMS spam according to incoming phone number
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body: strings.NewReader(url.Values{
-			"Body": {"verysecret .s echo 0123456789012345678901234567890123456789"},
-			"From": {"sms number"},
-		}.Encode()),
-	}, addr+httpd.GetHandlerByFactoryType(&handler.HandleTwilioSMSHook{}))
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `01234567890123456789012345678901234`) {
-		t.Fatal(err, resp)
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body: strings.NewReader(url.Values{
-			"Body": {"verysecret .s echo 0123456789012345678901234567890123456789"},
-			"From": {"sms number"},
-		}.Encode()),
-	}, addr+httpd.GetHandlerByFactoryType(&handler.HandleTwilioSMSHook{}))
-	if err != nil || resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(resp.Body), `rate limit is exceeded by`) {
-		t.Fatalf("err? %v\nresp: %+v\nresp body: %s", err, resp, string(resp.Body))
-	}
-	// Twilio - check phone call greeting
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/call_greeting")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `<Say>Hi there</Say>`) {
-		t.Fatal(err, string(resp.Body))
-	}
-	// Twilio - prevent call spam according to incoming phone number
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body:   strings.NewReader(url.Values{"From": {"call number"}}.Encode()),
-	}, addr+"/call_greeting")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `<Say>Hi there</Say>`) {
-		t.Fatal(err, string(resp.Body))
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body:   strings.NewReader(url.Values{"From": {"call number"}}.Encode()),
-	}, addr+"/call_greeting")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `<Response><Reject/></Response>`) {
-		t.Fatal(err, string(resp.Body))
-	}
-	// Twilio - check phone call response to DTMF
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body:   strings.NewReader(url.Values{"Digits": {"0000000"}}.Encode()),
-	}, addr+httpd.GetHandlerByFactoryType(&handler.HandleTwilioCallCallback{}))
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), toolbox.ErrPINAndShortcutNotFound.Error()) {
-		t.Fatal(err, string(resp.Body))
-	}
-	//                         v  e r  y  s   e c  r  e t .   s    tr  u e
-	dtmfVerySecretDotSTrue := "88833777999777733222777338014207777087778833"
-	if !platform.HostIsWindows() {
-		// Twilio - check command execution result via phone call
-		resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-			Method: http.MethodPost,
-			Body:   strings.NewReader(url.Values{"Digits": {dtmfVerySecretDotSTrue}}.Encode())}, addr+httpd.GetHandlerByFactoryType(&handler.HandleTwilioCallCallback{}))
-		if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `<Say>EMPTY OUTPUT.
-
-    repeat again.    
-
-EMPTY OUTPUT.
-
-    repeat again.    
-
-EMPTY OUTPUT.
-over.
-</Say>`) {
-			t.Fatal(err, string(resp.Body))
-		}
-		// Twilio - check command execution result via phone call and ask output to be spelt phonetically
-		resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-			Method: http.MethodPost,
-			Body:   strings.NewReader(url.Values{"Digits": {handler.TwilioPhoneticSpellingMagic + dtmfVerySecretDotSTrue}}.Encode())}, addr+httpd.GetHandlerByFactoryType(&handler.HandleTwilioCallCallback{}))
-		phoneticOutput := `capital echo, capital mike, capital papa, capital tango, capital yankee, space, capital oscar, capital uniform, capital tango, capital papa, capital uniform, capital tango.
-
-    repeat again.    
-
-capital echo, capital mike, capital papa, capital tango, capital yankee, space, capital oscar, capital uniform, capital tango, capital papa, capital uniform, capital tango.
-
-    repeat again.    
-
-capital echo, capital mike, capital papa, capital tango, capital yankee, space, capital oscar, capital uniform, capital tango, capital papa, capital uniform, capital tango.
-over.`
-		sayResp := "<Say>" + phoneticOutput + "\n</Say>"
-		if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), sayResp) {
-			t.Fatal(err, string(resp.Body))
-		}
-		// Twilio - prevent DTMF command spam according to incoming phone number
-		resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-			Method: http.MethodPost,
-			Body:   strings.NewReader(url.Values{"Digits": {dtmfVerySecretDotSTrue}, "From": {"dtmf number"}}.Encode())}, addr+httpd.GetHandlerByFactoryType(&handler.HandleTwilioCallCallback{}))
-		if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `<Say>EMPTY OUTPUT.
-
-    repeat again.    
-
-EMPTY OUTPUT.
-
-    repeat again.    
-
-EMPTY OUTPUT.
-over.
-</Say>`) {
-			t.Fatal(err, string(resp.Body))
-		}
-		resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-			Method: http.MethodPost,
-			Body:   strings.NewReader(url.Values{"Digits": {dtmfVerySecretDotSTrue}, "From": {"dtmf number"}}.Encode())}, addr+httpd.GetHandlerByFactoryType(&handler.HandleTwilioCallCallback{}))
-		if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `<Say>You are rate limited.</Say><Hangup/>`) {
-			t.Fatal(err, string(resp.Body))
-		}
-	}
-
-	// Wait for phone number rate limit to expire for SMS, call, and DTMF command, then redo the tests
-	time.Sleep((handler.TwilioPhoneNumberRateLimitIntervalSec + 1) * time.Second)
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body: strings.NewReader(url.Values{
-			"Body": {"verysecret .s echo 0123456789012345678901234567890123456789"},
-			"From": {"sms number"},
-		}.Encode()),
-	}, addr+httpd.GetHandlerByFactoryType(&handler.HandleTwilioSMSHook{}))
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `01234567890123456789012345678901234`) {
-		t.Fatal(err, resp)
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body:   strings.NewReader(url.Values{"From": {"call number"}}.Encode()),
-	}, addr+"/call_greeting")
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `<Say>Hi there</Say>`) {
-		t.Fatal(err, string(resp.Body))
-	}
-	if !platform.HostIsWindows() {
-		resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-			Method: http.MethodPost,
-			Body:   strings.NewReader(url.Values{"Digits": {dtmfVerySecretDotSTrue}, "From": {"dtmf number"}}.Encode())}, addr+httpd.GetHandlerByFactoryType(&handler.HandleTwilioCallCallback{}))
-		if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), `<Say>EMPTY OUTPUT.
-
-    repeat again.    
-
-EMPTY OUTPUT.
-
-    repeat again.    
-
-EMPTY OUTPUT.
-over.
-</Say>`) {
-			t.Fatal(err, string(resp.Body))
-		}
-	}
-
-	// Test app command execution endpoint
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body:   strings.NewReader(url.Values{"cmd": {toolbox.TestCommandProcessorPIN + ".s echo hi"}}.Encode())}, addr+httpd.GetHandlerByFactoryType(&handler.HandleAppCommand{}))
-	if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != "hi" {
-		t.Fatal(err, string(resp.Body))
-	}
-
-	// Test reports endpoint
-	httpd.Processor.Features.MessageProcessor.StoreReport(context.Background(), toolbox.SubjectReportRequest{
-		SubjectHostName: "subject-host-name",
-	}, "client-ip1", "client-daemon1")
-	httpd.Processor.Features.MessageProcessor.StoreReport(context.Background(), toolbox.SubjectReportRequest{
-		SubjectHostName: "subject-host-name",
-	}, "client-ip2", "client-daemon2")
-	// Retrieve subjects and count of their reports - two reports from the same host, and one report coming from TTN.
-	var subjectCount map[string]int
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{Method: http.MethodPost}, addr+httpd.GetHandlerByFactoryType(&handler.HandleReportsRetrieval{}))
-	if err != nil || resp.StatusCode != http.StatusOK {
-		t.Fatal(err, string(resp.Body))
-	}
-	if err := json.Unmarshal(resp.Body, &subjectCount); err != nil {
-		t.Fatal(err)
-	}
-	if !reflect.DeepEqual(subjectCount, map[string]int{"subject-host-name": 2}) {
-		t.Fatalf("%+v", subjectCount)
-	}
-	// Retrieve TTN report + two host reports from the latest to oldest
-	var reports []toolbox.SubjectReport
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{Method: http.MethodPost}, addr+httpd.GetHandlerByFactoryType(&handler.HandleReportsRetrieval{})+"?n=100")
-	if err != nil || resp.StatusCode != http.StatusOK {
-		t.Fatal(err, string(resp.Body))
-	}
-	if err := json.Unmarshal(resp.Body, &reports); err != nil {
-		t.Fatal(err)
-	}
-	if len(reports) != 2 || reports[0].SubjectClientTag != "client-ip2" || reports[1].SubjectClientTag != "client-ip1" {
-		t.Fatalf("%+v", reports)
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body:   strings.NewReader(url.Values{"n": {"1"}, "host": {"subject-host-name"}}.Encode()),
-	}, addr+httpd.GetHandlerByFactoryType(&handler.HandleReportsRetrieval{}))
-	if err != nil || resp.StatusCode != http.StatusOK {
-		t.Fatal(err, string(resp.Body))
-	}
-	if err := json.Unmarshal(resp.Body, &reports); err != nil {
-		t.Fatal(err)
-	}
-	if len(reports) != 1 || reports[0].SubjectClientTag != "client-ip2" {
-		t.Fatalf("%+v", reports)
-	}
-	// Assign subject a command to run
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		Method: http.MethodPost,
-		Body:   strings.NewReader(url.Values{"host": {"subject-host-name"}, "cmd": {"test123"}}.Encode()),
-	}, addr+httpd.GetHandlerByFactoryType(&handler.HandleReportsRetrieval{}))
-	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "will carry an app command") {
-		t.Fatal(err, string(resp.Body))
-	}
-	if cmd := httpd.Processor.Features.MessageProcessor.OutgoingAppCommands["subject-host-name"]; cmd != "test123" {
-		t.Fatal(cmd)
-	}
-}
-
-const (
-	TestLaitosIndexHTMLContent = "this is index #LAITOS_CLIENTADDR #LAITOS_3339TIME"
-)
-
-// PrepareForTestHTTPD sets up a directory and HTML file to be hosted by HTTPD during tests.
-func PrepareForTestHTTPD(t testingstub.T) {
-	// Create a temporary file for index
-	_ = os.MkdirAll("/tmp", 1777)
-	indexFile := "/tmp/test-laitos-index.html"
-	if err := os.WriteFile(indexFile, []byte(TestLaitosIndexHTMLContent), 0644); err != nil {
-		panic(err)
-	}
-	htmlDir := "/tmp/test-laitos-dir"
-	if err := os.MkdirAll(htmlDir, 0755); err != nil {
-		t.Fatal(err)
-	}
-	if err := os.WriteFile(htmlDir+"/a.html", []byte("a html"), 0644); err != nil {
-		t.Fatal(err)
-	}
-	/*
-		Unfortunately due to the difficulty in making preparations for concurrent tests on multiple HTTP daemons, there
-		won't be automated clean up for these files.
-	*/
-	// Globally enable prometheus integration so to ensure that initialisation and metrics recording code will run during the test
-	misc.EnablePrometheusIntegration = true
-}
-
-// Run unit test on HTTP daemon. See TestHTTPD_StartAndBlock for daemon setup.
-func TestHTTPD(httpd *Daemon, t testingstub.T) {
-	addr := fmt.Sprintf("http://%s:%d", httpd.Address, httpd.Port)
-
-	// Directory handle
-	resp, err := inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/my/dir")
-	require.NoError(t, err)
-	require.Equal(t, http.StatusOK, resp.StatusCode)
-	require.Contains(t, string(resp.Body), "a.html")
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/my/dir/a.html")
-	if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != "a html" {
-		t.Fatal(err, string(resp.Body), resp)
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/dir")
-	require.NoError(t, err)
-	require.Equal(t, http.StatusOK, resp.StatusCode)
-	require.Contains(t, string(resp.Body), "a.html")
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/dir/a.html")
-	if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != "a html" {
-		t.Fatal(err, string(resp.Body), resp)
-	}
-	// Non-existent path in directory
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/my/dir/doesnotexist.html")
-	if err != nil || resp.StatusCode != http.StatusNotFound {
-		t.Fatal(err, string(resp.Body), resp)
-	}
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/doesnotexist")
-	// Non-existent path, but go is quite stupid that it produces response of /
-	if err != nil || resp.StatusCode != http.StatusOK {
-		t.Fatal(err, string(resp.Body), resp)
-	}
-	// Test hitting rate limits
-	time.Sleep(RateLimitIntervalSec * time.Second)
-	success := 0
-	for i := 0; i < httpd.PerIPLimit*DirectoryHandlerRateLimitFactor*2; i++ {
-		resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/my/dir/a.html")
-		if err == nil && resp.StatusCode == http.StatusOK {
-			success++
+// Stop HTTP daemon - the unix domain socket listener.
+func (daemon *Daemon) StopUnixSocket() {
+	if server := daemon.serverUnixSocket; server != nil {
+		constraints, cancel := context.WithTimeout(context.Background(), time.Duration(IOTimeoutSec+2)*time.Second)
+		defer cancel()
+		if err := server.Shutdown(constraints); err != nil {
+			daemon.logger.Warning(daemon.UnixSocketPath, err, "failed to shutdown")
 		}
 	}
-	if success < 1 || success > httpd.PerIPLimit*DirectoryHandlerRateLimitFactor*2 {
-		t.Fatal(success)
-	}
-	// Wait out rate limit (leave 3 seconds buffer for pending requests to complete)
-	time.Sleep((RateLimitIntervalSec + 3) * time.Second)
-	// Visit page again after rate limit resets
-	resp, err = inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/my/dir")
-	require.NoError(t, err)
-	require.Equal(t, http.StatusOK, resp.StatusCode)
-	require.Contains(t, string(resp.Body), "a.html")
 }
@@ -3,14 +3,19 @@ package httpd
 import (
 	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/daemon/httpd/handler"
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/toolbox"
@@ -164,7 +169,7 @@ func TestHTTPD_IndexPageFromEnv(t *testing.T) {
 		Address: "localhost",
 		Port:    21987,
 	}
-	os.Setenv(EnvironmentIndexPage, "hi from env")
+	t.Setenv(EnvironmentIndexPage, "hi from env")
 	if err := daemon.Initialise("/test-prefix", ""); err != nil {
 		t.Fatalf("%+v", err)
 	}
@@ -186,3 +191,109 @@ func TestHTTPD_IndexPageFromEnv(t *testing.T) {
 	}
 	daemon.StopNoTLS()
 }
+
+func TestHTTPD_UnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "laitos.sock")
+	daemon := Daemon{
+		Address:        "localhost",
+		Port:           21988,
+		UnixSocketPath: socketPath,
+		UnixSocketMode: "0600",
+		HandlerCollection: map[string]handler.Handler{
+			"/html": &handler.HandleHTMLDocument{HTMLContent: "hi #LAITOS_CLIENTADDR"},
+		},
+	}
+	daemon.UnixSocketMode = "0999"
+	require.Error(t, daemon.Initialise("", ""))
+	daemon.UnixSocketMode = "0600"
+	require.NoError(t, daemon.Initialise("", ""))
+	// Refuse to replace an ordinary file
+	require.NoError(t, os.WriteFile(socketPath, []byte("not a socket"), 0600))
+	require.Error(t, daemon.StartAndBlockUnixSocket())
+	require.NoError(t, os.Remove(socketPath))
+
+	serverStopped := make(chan struct{})
+	go func() {
+		if err := daemon.StartAndBlockUnixSocket(); err != nil {
+			t.Error(err)
+		}
+		close(serverStopped)
+	}()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	var resp *http.Response
+	var err error
+	for i := 0; i < 30; i++ {
+		if resp, err = client.Get("http://laitos/html"); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "hi 127.0.0.1", string(body))
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	daemon.StopUnixSocket()
+	<-serverStopped
+	daemon.StopUnixSocket()
+}
+
+func TestHTTPD_Mirrors(t *testing.T) {
+	mirrored := make(chan string, 10)
+	staging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.URL.Path
+	}))
+	defer staging.Close()
+	daemon := Daemon{
+		Address:          "localhost",
+		Port:             21989,
+		ServeDirectories: map[string]string{"/dir": t.TempDir()},
+		HandlerCollection: map[string]handler.Handler{
+			"/html": &handler.HandleHTMLDocument{HTMLContent: "hi"},
+		},
+		Mirrors: []*middleware.RequestMirror{{Location: "/does-not-exist", TargetURL: staging.URL, SamplePercent: 100}},
+	}
+	require.Error(t, daemon.Initialise("", ""))
+	daemon.Mirrors = []*middleware.RequestMirror{
+		{Location: "/html", TargetURL: staging.URL, SamplePercent: 100},
+		{Location: "/html", TargetURL: staging.URL, SamplePercent: 100},
+	}
+	require.Error(t, daemon.Initialise("", ""))
+	daemon.Mirrors = []*middleware.RequestMirror{
+		{Location: "/html", TargetURL: staging.URL, SamplePercent: 100},
+		{Location: "/dir", TargetURL: staging.URL, SamplePercent: 100},
+	}
+	daemon.WebDAV = WebDAV{Locations: map[string]WebDAVLocation{"/dir": {}}, Users: map[string]string{"user": "pass"}}
+	require.NoError(t, daemon.Initialise("", ""))
+	for _, path := range []string{"/html", "/dir/"} {
+		w := httptest.NewRecorder()
+		daemon.rootHandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		select {
+		case got := <-mirrored:
+			require.Equal(t, path, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("did not mirror request", path)
+		}
+	}
+	// WebDAV requests manage the files and must not be mirrored
+	req := httptest.NewRequest(http.MethodPut, "/dir/a.txt", strings.NewReader("file a"))
+	req.SetBasicAuth("user", "pass")
+	w := httptest.NewRecorder()
+	daemon.rootHandler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	select {
+	case got := <-mirrored:
+		t.Fatal("unexpectedly mirrored WebDAV request", got)
+	case <-time.After(1 * time.Second):
+	}
+}
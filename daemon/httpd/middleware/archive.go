@@ -0,0 +1,277 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/awsinteg"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// DefaultArchiveMaxBodyBytes is the default maximum size of request and response bodies kept in an archived exchange.
+	DefaultArchiveMaxBodyBytes = 64 * 1024
+	// DefaultArchiveQueueLength is the default number of archived exchanges waiting to be uploaded, further exchanges
+	// are not archived.
+	DefaultArchiveQueueLength = 100
+	// ArchiveUploadTimeoutSec is the timeout of uploading each archived exchange.
+	ArchiveUploadTimeoutSec = 30
+)
+
+// archiveObjectStore stores the archived exchanges as objects in a bucket, it is implemented by awsinteg.S3Client.
+type archiveObjectStore interface {
+	UploadEncrypted(ctx context.Context, bucketName, objectKey, kmsKeyID string, objectValue io.Reader) error
+}
+
+/*
+ArchivedExchange is an HTTP request and its response archived for audit purpose. The bodies are kept up to a maximum
+size, though their hashes and sizes always cover the entire bodies.
+*/
+type ArchivedExchange struct {
+	Sequence      uint64    `json:"Sequence"`
+	Time          time.Time `json:"Time"`
+	DurationMilli int64     `json:"DurationMilli"`
+	Location      string    `json:"Location"`
+	ClientIP      string    `json:"ClientIP"`
+
+	Method             string      `json:"Method"`
+	Host               string      `json:"Host"`
+	URL                string      `json:"URL"`
+	Proto              string      `json:"Proto"`
+	RequestHeader      http.Header `json:"RequestHeader"`
+	RequestBody        []byte      `json:"RequestBody"`
+	RequestBodyBytes   int64       `json:"RequestBodyBytes"`
+	RequestBodySHA256  string      `json:"RequestBodySHA256"`
+	StatusCode         int         `json:"StatusCode"`
+	ResponseHeader     http.Header `json:"ResponseHeader"`
+	ResponseBody       []byte      `json:"ResponseBody"`
+	ResponseBodyBytes  int64       `json:"ResponseBodyBytes"`
+	ResponseBodySHA256 string      `json:"ResponseBodySHA256"`
+
+	// PreviousSHA256 is the hash of the previous archived object, it chains the archived objects together so that
+	// a removed or altered object is evident. The chain starts over when the program starts.
+	PreviousSHA256 string `json:"PreviousSHA256"`
+}
+
+/*
+RequestArchive records the entire requests and responses of the selected web services and directories, and uploads
+each of them as an object encrypted at rest (SSE-KMS) to an S3 bucket. The recording never delays the response to the
+visitor, the uploads take place in the background one at a time.
+*/
+type RequestArchive struct {
+	// Locations are the URL locations of the web services and directories whose requests are archived, e.g. "/cmd".
+	Locations []string `json:"Locations"`
+	// S3BucketName is the name of the S3 bucket that stores the archived exchanges.
+	S3BucketName string `json:"S3BucketName"`
+	// S3KMSKeyID is the (optional) ID or ARN of the KMS key that encrypts the archived exchanges, it defaults to the AWS managed key of S3.
+	S3KMSKeyID string `json:"S3KMSKeyID"`
+	// S3KeyPrefix is the (optional) prefix of the object keys, e.g. "laitos-archive/".
+	S3KeyPrefix string `json:"S3KeyPrefix"`
+	// MaxBodyBytes is the maximum size of request and response bodies kept in an archived exchange.
+	MaxBodyBytes int `json:"MaxBodyBytes"`
+	// QueueLength is the maximum number of archived exchanges waiting to be uploaded.
+	QueueLength int `json:"QueueLength"`
+
+	locations    map[string]struct{}
+	objectStore  archiveObjectStore
+	queue        chan *ArchivedExchange
+	logger       *lalog.Logger
+	sequence     uint64
+	previousHash string
+	archived     int64
+	dropped      int64
+	failed       int64
+}
+
+// Initialise validates the configuration, gives default values to the unset attributes, and starts uploading archived
+// exchanges in the background. The archive is disabled when there are no locations to archive.
+func (archive *RequestArchive) Initialise(logger *lalog.Logger) error {
+	archive.locations = make(map[string]struct{})
+	if len(archive.Locations) == 0 {
+		return nil
+	}
+	if archive.S3BucketName == "" {
+		return errors.New("RequestArchive.Initialise: S3BucketName must not be empty")
+	}
+	for _, location := range archive.Locations {
+		if !strings.HasPrefix(location, "/") {
+			return errors.New("RequestArchive.Initialise: each of Locations must begin with a slash")
+		}
+		archive.locations[strings.TrimSuffix(location, "/")] = struct{}{}
+	}
+	if archive.MaxBodyBytes < 1 {
+		archive.MaxBodyBytes = DefaultArchiveMaxBodyBytes
+	}
+	if archive.QueueLength < 1 {
+		archive.QueueLength = DefaultArchiveQueueLength
+	}
+	if archive.objectStore == nil {
+		s3Client, err := awsinteg.NewS3Client()
+		if err != nil {
+			return fmt.Errorf("RequestArchive.Initialise: failed to initialise S3 client - %w", err)
+		}
+		archive.objectStore = s3Client
+	}
+	archive.logger = logger
+	archive.queue = make(chan *ArchivedExchange, archive.QueueLength)
+	go archive.uploadLoop()
+	return nil
+}
+
+// IsArchived returns true if the requests of the web service or directory at the URL location are archived.
+func (archive *RequestArchive) IsArchived(location string) bool {
+	_, archived := archive.locations[strings.TrimSuffix(location, "/")]
+	return archived
+}
+
+// GetStats returns the number of exchanges archived successfully, dropped due to the queue limit, and failed to upload.
+func (archive *RequestArchive) GetStats() (archived, dropped, failed int64) {
+	return atomic.LoadInt64(&archive.archived), atomic.LoadInt64(&archive.dropped), atomic.LoadInt64(&archive.failed)
+}
+
+// uploadLoop uploads the archived exchanges in the order they were recorded, chaining each to its predecessor. This function never returns.
+func (archive *RequestArchive) uploadLoop() {
+	for exchange := range archive.queue {
+		exchange.PreviousSHA256 = archive.previousHash
+		serialised, err := json.Marshal(exchange)
+		if err != nil {
+			atomic.AddInt64(&archive.failed, 1)
+			archive.logger.Warning(exchange.ClientIP, err, "failed to serialise archived exchange")
+			continue
+		}
+		objectKey := fmt.Sprintf("%s%s/%020d-%d.json", archive.S3KeyPrefix, exchange.Time.UTC().Format("2006/01/02"), exchange.Time.UnixNano(), exchange.Sequence)
+		ctx, cancel := context.WithTimeout(context.Background(), ArchiveUploadTimeoutSec*time.Second)
+		err = archive.objectStore.UploadEncrypted(ctx, archive.S3BucketName, objectKey, archive.S3KMSKeyID, bytes.NewReader(serialised))
+		cancel()
+		if err != nil {
+			atomic.AddInt64(&archive.failed, 1)
+			archive.logger.Warning(exchange.ClientIP, err, "failed to upload archived exchange \"%s\"", objectKey)
+		} else {
+			atomic.AddInt64(&archive.archived, 1)
+		}
+		// The next object refers to this one even if the upload failed, so that the gap in the chain is evident.
+		digest := sha256.Sum256(serialised)
+		archive.previousHash = hex.EncodeToString(digest[:])
+	}
+}
+
+/*
+ArchiveRequests decorates the HTTP handler function of the URL location by recording its requests and responses in
+the archive, provided that the location is to be archived. A protocol upgrade request (e.g. websocket) is not archived.
+*/
+func ArchiveRequests(archive *RequestArchive, location string, next http.HandlerFunc) http.HandlerFunc {
+	if !archive.IsArchived(location) {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			next(w, r)
+			return
+		}
+		exchange := &ArchivedExchange{
+			Sequence:      atomic.AddUint64(&archive.sequence, 1),
+			Time:          time.Now(),
+			Location:      location,
+			ClientIP:      GetRealClientIP(r),
+			Method:        r.Method,
+			Host:          r.Host,
+			URL:           r.URL.String(),
+			Proto:         r.Proto,
+			RequestHeader: r.Header.Clone(),
+		}
+		reqBody := &archiveCapture{limit: archive.MaxBodyBytes, hash: sha256.New()}
+		if r.Body != nil {
+			r.Body = &readCloser{Reader: io.TeeReader(r.Body, reqBody), Closer: r.Body}
+		}
+		archiveWriter := &archiveResponseWriter{ResponseWriter: w, body: &archiveCapture{limit: archive.MaxBodyBytes, hash: sha256.New()}}
+		next(archiveWriter, r)
+		exchange.DurationMilli = time.Since(exchange.Time).Milliseconds()
+		exchange.RequestBody, exchange.RequestBodyBytes, exchange.RequestBodySHA256 = reqBody.result()
+		if archiveWriter.header == nil {
+			// The handler did not write a response, the server responds with status OK and the header as it is.
+			archiveWriter.snapshot(http.StatusOK)
+		}
+		exchange.StatusCode = archiveWriter.statusCode
+		exchange.ResponseHeader = archiveWriter.header
+		exchange.ResponseBody, exchange.ResponseBodyBytes, exchange.ResponseBodySHA256 = archiveWriter.body.result()
+		select {
+		case archive.queue <- exchange:
+		default:
+			atomic.AddInt64(&archive.dropped, 1)
+			archive.logger.Warning(exchange.ClientIP, nil, "archive queue is full, dropped the exchange of %s %s", exchange.Method, exchange.URL)
+		}
+	}
+}
+
+// archiveCapture is an io.Writer that keeps the beginning of the data, and hashes and counts the entire data.
+type archiveCapture struct {
+	limit int
+	buf   []byte
+	hash  hash.Hash
+	size  int64
+}
+
+func (capture *archiveCapture) Write(data []byte) (int, error) {
+	if remaining := capture.limit - len(capture.buf); remaining > 0 {
+		capture.buf = append(capture.buf, data[:min(remaining, len(data))]...)
+	}
+	capture.hash.Write(data)
+	capture.size += int64(len(data))
+	return len(data), nil
+}
+
+// result returns the beginning of the data, the size of the entire data, and the hex-encoded hash of the entire data.
+func (capture *archiveCapture) result() ([]byte, int64, string) {
+	return capture.buf, capture.size, hex.EncodeToString(capture.hash.Sum(nil))
+}
+
+// archiveResponseWriter records the status code, header, and body of the response on their way to the client.
+type archiveResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	header     http.Header
+	body       *archiveCapture
+}
+
+// snapshot memorises the status code and the response header at the moment they are written.
+func (w *archiveResponseWriter) snapshot(statusCode int) {
+	if w.header == nil {
+		w.statusCode = statusCode
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+}
+
+func (w *archiveResponseWriter) WriteHeader(statusCode int) {
+	w.snapshot(statusCode)
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *archiveResponseWriter) Write(data []byte) (int, error) {
+	w.snapshot(http.StatusOK)
+	n, err := w.ResponseWriter.Write(data)
+	_, _ = w.body.Write(data[:n])
+	return n, err
+}
+
+// Flush sends buffered data to the client, it is used by handlers that stream their response.
+func (w *archiveResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (w *archiveResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/stretchr/testify/require"
+)
+
+type uploadedObject struct {
+	bucket, key, kmsKeyID string
+	value                 []byte
+}
+
+type fakeArchiveStore struct {
+	uploaded chan uploadedObject
+	fail     bool
+}
+
+func (store *fakeArchiveStore) UploadEncrypted(_ context.Context, bucketName, objectKey, kmsKeyID string, objectValue io.Reader) error {
+	value, _ := io.ReadAll(objectValue)
+	var err error
+	if store.fail {
+		err = errors.New("upload failure")
+	}
+	store.uploaded <- uploadedObject{bucketName, objectKey, kmsKeyID, value}
+	return err
+}
+
+func TestRequestArchive_Initialise(t *testing.T) {
+	// An archive without locations is disabled
+	disabled := &RequestArchive{}
+	require.NoError(t, disabled.Initialise(lalog.DefaultLogger))
+	require.False(t, disabled.IsArchived("/cmd"))
+	require.Error(t, (&RequestArchive{Locations: []string{"/cmd"}}).Initialise(lalog.DefaultLogger))
+	require.Error(t, (&RequestArchive{Locations: []string{"cmd"}, S3BucketName: "bucket", objectStore: &fakeArchiveStore{}}).Initialise(lalog.DefaultLogger))
+	archive := &RequestArchive{Locations: []string{"/cmd/"}, S3BucketName: "bucket", objectStore: &fakeArchiveStore{}}
+	require.NoError(t, archive.Initialise(lalog.DefaultLogger))
+	require.True(t, archive.IsArchived("/cmd"))
+	require.True(t, archive.IsArchived("/cmd/"))
+	require.False(t, archive.IsArchived("/other"))
+	require.Equal(t, DefaultArchiveMaxBodyBytes, archive.MaxBodyBytes)
+	require.Equal(t, DefaultArchiveQueueLength, archive.QueueLength)
+}
+
+func TestArchiveRequests(t *testing.T) {
+	store := &fakeArchiveStore{uploaded: make(chan uploadedObject, 10)}
+	archive := &RequestArchive{Locations: []string{"/cmd"}, S3BucketName: "bucket", S3KMSKeyID: "key", S3KeyPrefix: "audit/", MaxBodyBytes: 5, objectStore: store}
+	require.NoError(t, archive.Initialise(lalog.DefaultLogger))
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Test", "1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("response to " + string(body)))
+	}
+	// The location that is not archived is left alone
+	ArchiveRequests(archive, "/other", handler)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/other", nil))
+
+	archived := ArchiveRequests(archive, "/cmd", handler)
+	rec := httptest.NewRecorder()
+	archived(rec, httptest.NewRequest(http.MethodPost, "/cmd?a=b", strings.NewReader("request body")))
+	require.Equal(t, http.StatusCreated, rec.Code)
+	require.Equal(t, "response to request body", rec.Body.String())
+
+	var first, second ArchivedExchange
+	uploaded := <-store.uploaded
+	require.Equal(t, "bucket", uploaded.bucket)
+	require.Equal(t, "key", uploaded.kmsKeyID)
+	require.Regexp(t, `^audit/\d{4}/\d{2}/\d{2}/\d{20}-1\.json$`, uploaded.key)
+	require.NoError(t, json.Unmarshal(uploaded.value, &first))
+	require.Equal(t, http.MethodPost, first.Method)
+	require.Equal(t, "/cmd?a=b", first.URL)
+	require.Equal(t, "/cmd", first.Location)
+	// The bodies are truncated, but their sizes and hashes cover the entire bodies
+	require.Equal(t, "reque", string(first.RequestBody))
+	require.EqualValues(t, len("request body"), first.RequestBodyBytes)
+	requestDigest := sha256.Sum256([]byte("request body"))
+	require.Equal(t, hex.EncodeToString(requestDigest[:]), first.RequestBodySHA256)
+	require.Equal(t, http.StatusCreated, first.StatusCode)
+	require.Equal(t, "1", first.ResponseHeader.Get("X-Test"))
+	require.Equal(t, "respo", string(first.ResponseBody))
+	require.EqualValues(t, len("response to request body"), first.ResponseBodyBytes)
+	require.Empty(t, first.PreviousSHA256)
+
+	// The next exchange is chained to the previous one, even if the upload fails
+	store.fail = true
+	archived(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/cmd", nil))
+	uploaded2 := <-store.uploaded
+	require.NoError(t, json.Unmarshal(uploaded2.value, &second))
+	firstDigest := sha256.Sum256(uploaded.value)
+	require.Equal(t, hex.EncodeToString(firstDigest[:]), second.PreviousSHA256)
+	require.Equal(t, http.StatusCreated, second.StatusCode)
+	require.Eventually(t, func() bool {
+		archivedCount, dropped, failed := archive.GetStats()
+		return archivedCount == 1 && dropped == 0 && failed == 1
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Empty(t, store.uploaded)
+}
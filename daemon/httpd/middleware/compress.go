@@ -0,0 +1,263 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	// DefaultCompressionMinSizeBytes is the minimum size of a response to be compressed, smaller responses do not benefit from compression.
+	DefaultCompressionMinSizeBytes = 1024
+	// DefaultCompressionLevel balances the speed and size of compression, it is the same as gzip's default.
+	DefaultCompressionLevel = 6
+	// CompressionEncodingGzip is the gzip content encoding.
+	CompressionEncodingGzip = "gzip"
+	// CompressionEncodingDeflate is the deflate content encoding.
+	CompressionEncodingDeflate = "deflate"
+	// CompressionEncodingBrotli is the brotli content encoding.
+	CompressionEncodingBrotli = "br"
+)
+
+// compressionEncodingPreference ranks the encodings accepted by the client equally, brotli produces the smallest output.
+var compressionEncodingPreference = map[string]int{
+	CompressionEncodingBrotli:  3,
+	CompressionEncodingGzip:    2,
+	CompressionEncodingDeflate: 1,
+}
+
+// DefaultCompressionContentTypes are the content type prefixes of the responses that benefit from compression.
+var DefaultCompressionContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+}
+
+/*
+ResponseCompression compresses the HTTP responses in brotli, gzip, or deflate, whichever is preferred by the client.
+Only the responses of compressible content types (e.g. HTML, JSON) above a minimum size are compressed.
+*/
+type ResponseCompression struct {
+	// Enable turns on the response compression.
+	Enable bool `json:"Enable"`
+	// MinSizeBytes is the minimum size of a response to be compressed.
+	MinSizeBytes int `json:"MinSizeBytes"`
+	// ContentTypes are the content type prefixes of the responses to be compressed.
+	ContentTypes []string `json:"ContentTypes"`
+	// Level is the compression level between 1 (fastest) and 9 (smallest), by default it is 6. Brotli uses it as its quality.
+	Level int `json:"Level"`
+}
+
+// Initialise validates the configuration and gives default values to the unset attributes.
+func (comp *ResponseCompression) Initialise() error {
+	if comp.MinSizeBytes < 1 {
+		comp.MinSizeBytes = DefaultCompressionMinSizeBytes
+	}
+	if len(comp.ContentTypes) == 0 {
+		comp.ContentTypes = DefaultCompressionContentTypes
+	}
+	if comp.Level == 0 {
+		comp.Level = DefaultCompressionLevel
+	} else if comp.Level < gzip.BestSpeed || comp.Level > gzip.BestCompression {
+		return errors.New("ResponseCompression.Initialise: Level must be within [1, 9]")
+	}
+	return nil
+}
+
+// isCompressibleType returns true if the content type of a response benefits from compression.
+func (comp *ResponseCompression) isCompressibleType(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, prefix := range comp.ContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+GetAcceptedEncoding returns the compression encoding accepted by the client according to the Accept-Encoding request
+header. Among the encodings the client prefers equally, brotli is preferred over gzip, and gzip over deflate. It
+returns an empty string if the client does not accept any of them.
+*/
+func GetAcceptedEncoding(r *http.Request) string {
+	var chosen string
+	var chosenQuality float64
+	for _, entry := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(entry, ";")
+		encoding := strings.ToLower(strings.TrimSpace(params[0]))
+		if compressionEncodingPreference[encoding] == 0 {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			if q, found := strings.CutPrefix(strings.TrimSpace(param), "q="); found {
+				if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+					quality = parsed
+				}
+			}
+		}
+		if quality > chosenQuality || quality == chosenQuality && compressionEncodingPreference[encoding] > compressionEncodingPreference[chosen] {
+			chosen, chosenQuality = encoding, quality
+		}
+	}
+	if chosenQuality <= 0 {
+		return ""
+	}
+	return chosen
+}
+
+/*
+CompressResponse decorates the HTTP handler function by compressing its response if the client accepts compression.
+The request for a partial content (range) or a protocol upgrade (e.g. websocket) is left alone.
+*/
+func CompressResponse(comp ResponseCompression, next http.HandlerFunc) http.HandlerFunc {
+	if !comp.Enable {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := GetAcceptedEncoding(r)
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		compWriter := &compressResponseWriter{ResponseWriter: w, comp: &comp, encoding: encoding, statusCode: http.StatusOK}
+		defer compWriter.Close()
+		next(compWriter, r)
+	}
+}
+
+/*
+compressResponseWriter buffers the beginning of a response until it has enough data to decide whether the response is
+worth compressing, and then writes the response compressed or as-is.
+*/
+type compressResponseWriter struct {
+	http.ResponseWriter
+	comp       *ResponseCompression
+	encoding   string
+	statusCode int
+	buf        []byte
+	decided    bool
+	compressor io.WriteCloser
+}
+
+// WriteHeader memorises the status code, the header is only written after the decision on compression is made.
+func (w *compressResponseWriter) WriteHeader(statusCode int) {
+	if w.decided {
+		return
+	}
+	w.statusCode = statusCode
+	if statusCode < http.StatusOK || statusCode == http.StatusNoContent || statusCode == http.StatusNotModified {
+		// These responses do not have a body
+		_ = w.decide(false)
+	}
+}
+
+// Write buffers the response until the minimum size is reached, and then compresses it if it is worth compressing.
+func (w *compressResponseWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, data...)
+		if len(w.buf) < w.comp.MinSizeBytes {
+			return len(data), nil
+		}
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if w.compressor != nil {
+		return w.compressor.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// decide writes the response header with or without compression, and then writes the buffered data.
+func (w *compressResponseWriter) decide(sizeReached bool) error {
+	w.decided = true
+	header := w.ResponseWriter.Header()
+	if header.Get("Content-Type") == "" && len(w.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	compress := sizeReached && header.Get("Content-Encoding") == "" && w.comp.isCompressibleType(header.Get("Content-Type"))
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < w.comp.MinSizeBytes {
+		compress = false
+	}
+	if compress {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", w.encoding)
+		switch w.encoding {
+		case CompressionEncodingBrotli:
+			w.compressor = brotli.NewWriterLevel(w.ResponseWriter, w.comp.Level)
+		case CompressionEncodingGzip:
+			w.compressor, _ = gzip.NewWriterLevel(w.ResponseWriter, w.comp.Level)
+		default:
+			w.compressor, _ = flate.NewWriter(w.ResponseWriter, w.comp.Level)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.statusCode)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.compressor != nil {
+		_, err = w.compressor.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends buffered data to the client, it is used by handlers that stream their response.
+func (w *compressResponseWriter) Flush() {
+	if !w.decided {
+		// A streamed response is compressed regardless of its size so far
+		_ = w.decide(len(w.buf) > 0)
+	}
+	if flusher, ok := w.compressor.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets handlers take over the connection.
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		// The handler takes over the connection and writes its own response
+		w.decided = true
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("compressResponseWriter.Hijack: the response writer does not support hijacking")
+}
+
+// Unwrap returns the underlying response writer for http.ResponseController.
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close writes the remainder of the response after the handler has finished.
+func (w *compressResponseWriter) Close() {
+	if !w.decided {
+		_ = w.decide(false)
+	}
+	if w.compressor != nil {
+		_ = w.compressor.Close()
+	}
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetAcceptedEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                      "",
+		"br":                    "br",
+		"gzip, br, deflate":     "br",
+		"br;q=0.5, gzip":        "gzip",
+		"gzip":                  "gzip",
+		"deflate, gzip":         "gzip",
+		"deflate":               "deflate",
+		"gzip;q=0.5, deflate":   "deflate",
+		"gzip;q=0, deflate;q=0": "",
+		"br;q=0, GZIP;q=0.8":    "gzip",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", header)
+		require.Equal(t, want, GetAcceptedEncoding(req), header)
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	html := "<html><body>" + strings.Repeat("hello world ", 200) + "</body></html>"
+	handlerFunc := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/html":
+			_, _ = w.Write([]byte(html))
+		case "/small":
+			_, _ = w.Write([]byte("<html>small</html>"))
+		case "/binary":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte(html))
+		case "/notfound":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(html))
+		}
+	}
+	comp := ResponseCompression{Enable: true}
+	require.NoError(t, comp.Initialise())
+	// Initialising the configuration again should keep the same values
+	require.NoError(t, comp.Initialise())
+	require.Equal(t, DefaultCompressionLevel, comp.Level)
+	decorated := CompressResponse(comp, handlerFunc)
+
+	get := func(path, acceptEncoding string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		decorated(rec, req)
+		return rec.Result()
+	}
+
+	// Compress in gzip
+	resp := get("/html", "gzip, deflate")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	require.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	require.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"))
+	gzipReader, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gzipReader)
+	require.NoError(t, err)
+	require.Equal(t, html, string(body))
+
+	// Compress in brotli
+	resp = get("/html", "gzip, br")
+	require.Equal(t, "br", resp.Header.Get("Content-Encoding"))
+	body, err = io.ReadAll(brotli.NewReader(resp.Body))
+	require.NoError(t, err)
+	require.Equal(t, html, string(body))
+
+	// Compress in deflate
+	resp = get("/html", "deflate")
+	require.Equal(t, "deflate", resp.Header.Get("Content-Encoding"))
+	body, err = io.ReadAll(flate.NewReader(resp.Body))
+	require.NoError(t, err)
+	require.Equal(t, html, string(body))
+
+	// Preserve the status code
+	resp = get("/notfound", "gzip")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	// Leave alone the client that does not accept compression, small responses, and incompressible content types
+	for _, path := range []string{"/html", "/small", "/binary"} {
+		acceptEncoding := "gzip"
+		if path == "/html" {
+			acceptEncoding = ""
+		}
+		resp = get(path, acceptEncoding)
+		require.Empty(t, resp.Header.Get("Content-Encoding"), path)
+		body, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		if path == "/small" {
+			require.Equal(t, "<html>small</html>", string(body))
+		} else {
+			require.Equal(t, html, string(body))
+		}
+	}
+
+	// Compression is off unless enabled
+	req := httptest.NewRequest(http.MethodGet, "/html", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	CompressResponse(ResponseCompression{}, handlerFunc)(rec, req)
+	require.Empty(t, rec.Result().Header.Get("Content-Encoding"))
+
+	require.Error(t, (&ResponseCompression{Level: 10}).Initialise())
+}
@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// DefaultMaintenanceRetryAfterSec is the default number of seconds after which visitors are advised to try again
+	// during maintenance.
+	DefaultMaintenanceRetryAfterSec = 600
+	// DefaultMaintenancePageHTML is the default page served to visitors during maintenance.
+	DefaultMaintenancePageHTML = `<!doctype html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <title>Under maintenance</title>
+</head>
+<body>
+    <p>The web site is undergoing maintenance, please come back later.</p>
+</body>
+</html>`
+)
+
+/*
+Maintenance serves a "service unavailable" page with status 503 in place of web services and directories while the
+program-wide maintenance mode (misc.SetMaintenanceMode) is in effect. The web services and directories in the allow
+list continue to function.
+*/
+type Maintenance struct {
+	// PageHTML is the page served to visitors during maintenance.
+	PageHTML string `json:"PageHTML"`
+	// RetryAfterSec is the number of seconds after which visitors are advised (via Retry-After header) to try again.
+	RetryAfterSec int `json:"RetryAfterSec"`
+	// AllowedLocations are the URL locations of web services and directories that continue to function during maintenance.
+	AllowedLocations []string `json:"AllowedLocations"`
+
+	allowed map[string]struct{}
+}
+
+// Initialise validates the configuration and gives default values to the unset attributes.
+func (maint *Maintenance) Initialise() error {
+	if maint.PageHTML == "" {
+		maint.PageHTML = DefaultMaintenancePageHTML
+	}
+	if maint.RetryAfterSec < 0 {
+		return errors.New("Maintenance.Initialise: RetryAfterSec must not be negative")
+	} else if maint.RetryAfterSec == 0 {
+		maint.RetryAfterSec = DefaultMaintenanceRetryAfterSec
+	}
+	maint.allowed = make(map[string]struct{})
+	for _, location := range maint.AllowedLocations {
+		if !strings.HasPrefix(location, "/") {
+			return errors.New("Maintenance.Initialise: each of AllowedLocations must begin with a slash")
+		}
+		maint.allowed[strings.TrimSuffix(location, "/")] = struct{}{}
+	}
+	return nil
+}
+
+// IsAllowed returns true if the web service or directory at the URL location continues to function during maintenance.
+func (maint *Maintenance) IsAllowed(location string) bool {
+	_, allowed := maint.allowed[strings.TrimSuffix(location, "/")]
+	return allowed
+}
+
+// ServeMaintenancePage decorates the HTTP handler function of the URL location by serving the maintenance page in
+// place of it while the maintenance mode is in effect, unless the location is allowed to function during maintenance.
+func ServeMaintenancePage(maint *Maintenance, location string, next http.HandlerFunc) http.HandlerFunc {
+	if maint.IsAllowed(location) {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !misc.IsMaintenanceMode() {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Retry-After", strconv.Itoa(maint.RetryAfterSec))
+		if WantsJSON(r) {
+			WriteError(w, r, http.StatusServiceUnavailable, "the server is under maintenance")
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(maint.PageHTML))
+	}
+}
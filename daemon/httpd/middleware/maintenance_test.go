@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeMaintenancePage(t *testing.T) {
+	require.Error(t, (&Maintenance{AllowedLocations: []string{"no-slash"}}).Initialise())
+	maint := &Maintenance{AllowedLocations: []string{"/cmd_form/"}}
+	require.NoError(t, maint.Initialise())
+	next := func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("served"))
+	}
+	serve := func(location string) *http.Response {
+		w := httptest.NewRecorder()
+		ServeMaintenancePage(maint, location, next)(w, httptest.NewRequest(http.MethodGet, location, nil))
+		return w.Result()
+	}
+	// Handlers function normally outside of maintenance
+	resp := serve("/page")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	misc.SetMaintenanceMode(true)
+	defer misc.SetMaintenanceMode(false)
+	resp = serve("/page")
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "600", resp.Header.Get("Retry-After"))
+	// The allowed locations continue to function
+	resp = serve("/cmd_form")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -40,8 +40,19 @@ var (
 	EnableLatestRequestsRecording bool
 )
 
+// RetentionStoreLatestRequests is the name of the latest HTTP requests buffer in data retention configuration.
+const RetentionStoreLatestRequests = "LatestRequests"
+
 func init() {
 	LatestRequests = datastruct.NewRingBuffer(MaxLatestRequests)
+	misc.DefaultDataRetention.Register(misc.RetainedData{
+		Name: RetentionStoreLatestRequests,
+		PurgeClient: func(clientID string) int {
+			// The request dump carries the client IP as well as any other client identifier found in the request.
+			return LatestRequests.RemoveIf(func(req string) bool { return strings.Contains(req, clientID) })
+		},
+		ExpireBefore: func(before time.Time) int { return LatestRequests.RemoveOlderThan(before) },
+	})
 }
 
 /*
@@ -86,7 +97,7 @@ func RecordInternalStats(stats *misc.Stats, next http.HandlerFunc) http.HandlerF
 
 // WithAWSXray decorates the HTTP handler function using AWS x-ray library for distributed tracing.
 func WithAWSXray(next http.HandlerFunc) http.HandlerFunc {
-	if misc.EnableAWSIntegration && inet.IsAWS() {
+	if misc.AWSIntegration.IsEnabled() && inet.IsAWS() {
 		// Integrate the decorated handler with AWS x-ray. The crucial x-ray daemon program seems to be only capable of running on AWS compute resources.
 		return xray.Handler(xray.NewDynamicSegmentNamer("LaitosHTTPD", "*"), next).ServeHTTP
 	}
@@ -99,7 +110,7 @@ func RateLimit(rateLimit *lalog.RateLimit, next http.HandlerFunc) http.HandlerFu
 	return func(w http.ResponseWriter, r *http.Request) {
 		remoteIP := GetRealClientIP(r)
 		if !rateLimit.Add(remoteIP, true) {
-			http.Error(w, "", http.StatusTooManyRequests)
+			WriteError(w, r, http.StatusTooManyRequests, "")
 			return
 		}
 		next(w, r)
@@ -132,7 +143,7 @@ func RecordPrometheusStats(
 	durationHistogram, timeToFirstByteHistogram, responseSizeHistogram *prometheus.HistogramVec,
 	next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !misc.EnablePrometheusIntegration {
+		if !misc.PrometheusIntegration.IsEnabled() {
 			next(w, r)
 			return
 		}
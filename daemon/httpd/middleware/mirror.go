@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// DefaultMirrorTimeoutSec is the default timeout of each mirrored request.
+	DefaultMirrorTimeoutSec = 10
+	// DefaultMirrorMaxConcurrency is the default maximum number of mirrored requests in flight.
+	DefaultMirrorMaxConcurrency = 16
+	// MirrorMaxBodyBytes is the maximum size of a request body to be mirrored, larger requests are not mirrored.
+	MirrorMaxBodyBytes = 1024 * 1024
+	// MirroredRequestHeader marks a mirrored request, a laitos server does not mirror a request that carries it again.
+	MirroredRequestHeader = "X-Laitos-Mirrored"
+)
+
+// mirrorHopByHopHeaders are the request headers that only make sense to the original connection.
+var mirrorHopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+/*
+RequestMirror asynchronously sends a copy of a sampled percentage of the requests of a web service or directory to
+another server (e.g. a staging laitos server), in order to validate the other server against real traffic. The responses
+from the other server are discarded, and the mirroring never delays or alters the response to the visitor.
+*/
+type RequestMirror struct {
+	// Location is the URL location of the web service or directory whose requests are mirrored, e.g. "/cmd".
+	Location string `json:"Location"`
+	// TargetURL is the base URL of the other server, the request path and query are appended to it.
+	TargetURL string `json:"TargetURL"`
+	// SamplePercent is the percentage (1-100) of requests to mirror.
+	SamplePercent int `json:"SamplePercent"`
+	// TimeoutSec is the timeout of each mirrored request.
+	TimeoutSec int `json:"TimeoutSec"`
+	// MaxConcurrency is the maximum number of mirrored requests in flight, requests beyond the limit are not mirrored.
+	MaxConcurrency int `json:"MaxConcurrency"`
+
+	target    *url.URL
+	client    *http.Client
+	inFlight  chan struct{}
+	logger    *lalog.Logger
+	mirrored  int64
+	dropped   int64
+	failed    int64
+	randIntFn func(int) int
+}
+
+// Initialise validates the configuration and gives default values to the unset attributes.
+func (mirror *RequestMirror) Initialise(logger *lalog.Logger) error {
+	if mirror.Location == "" {
+		return errors.New("RequestMirror.Initialise: Location must not be empty")
+	}
+	target, err := url.Parse(mirror.TargetURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("RequestMirror.Initialise: TargetURL \"%s\" must be an absolute http(s) URL", mirror.TargetURL)
+	}
+	if mirror.SamplePercent < 1 || mirror.SamplePercent > 100 {
+		return errors.New("RequestMirror.Initialise: SamplePercent must be within [1, 100]")
+	}
+	if mirror.TimeoutSec < 1 {
+		mirror.TimeoutSec = DefaultMirrorTimeoutSec
+	}
+	if mirror.MaxConcurrency < 1 {
+		mirror.MaxConcurrency = DefaultMirrorMaxConcurrency
+	}
+	mirror.target = target
+	mirror.client = &http.Client{
+		Transport: inet.NewHTTPTransport(),
+		Timeout:   time.Duration(mirror.TimeoutSec) * time.Second,
+		// Do not follow redirects of the other server, the response is discarded anyway.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	mirror.inFlight = make(chan struct{}, mirror.MaxConcurrency)
+	mirror.logger = logger
+	mirror.randIntFn = rand.Intn
+	return nil
+}
+
+// GetStats returns the number of requests mirrored successfully, dropped due to the concurrency limit, and failed to mirror.
+func (mirror *RequestMirror) GetStats() (mirrored, dropped, failed int64) {
+	return atomic.LoadInt64(&mirror.mirrored), atomic.LoadInt64(&mirror.dropped), atomic.LoadInt64(&mirror.failed)
+}
+
+// newMirroredRequest returns a copy of the request destined to the target server.
+func (mirror *RequestMirror) newMirroredRequest(ctx context.Context, r *http.Request, body []byte) (*http.Request, error) {
+	destURL := *mirror.target
+	destURL.Path = strings.TrimSuffix(mirror.target.Path, "/") + r.URL.Path
+	destURL.RawPath = ""
+	destURL.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequestWithContext(ctx, r.Method, destURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	for _, name := range mirrorHopByHopHeaders {
+		req.Header.Del(name)
+	}
+	// The original host name is useful to a server that hosts several sites.
+	req.Host = r.Host
+	req.Header.Set(MirroredRequestHeader, "1")
+	req.Header.Set("X-Forwarded-For", GetRealClientIP(r))
+	return req, nil
+}
+
+// send makes the mirrored request and discards the response.
+func (mirror *RequestMirror) send(req *http.Request, clientIP string) {
+	defer func() {
+		<-mirror.inFlight
+	}()
+	resp, err := mirror.client.Do(req)
+	if err != nil {
+		atomic.AddInt64(&mirror.failed, 1)
+		mirror.logger.Info(clientIP, err, "failed to mirror request to %s", req.URL.Host)
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, MirrorMaxBodyBytes))
+	_ = resp.Body.Close()
+	atomic.AddInt64(&mirror.mirrored, 1)
+}
+
+// MirrorRequest decorates the HTTP handler function by mirroring a sampled percentage of requests to another server.
+func MirrorRequest(mirror *RequestMirror, next http.HandlerFunc) http.HandlerFunc {
+	if mirror == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Never mirror a mirrored request again, in case the two servers mirror to each other.
+		if r.Header.Get(MirroredRequestHeader) != "" || mirror.randIntFn(100) >= mirror.SamplePercent {
+			next(w, r)
+			return
+		}
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(r.Body, MirrorMaxBodyBytes+1))
+			if err != nil || len(body) > MirrorMaxBodyBytes {
+				// Do not mirror the request, present the portion already read along with the remainder to the next handler.
+				r.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+				next(w, r)
+				return
+			}
+			_ = r.Body.Close()
+			r.Body = &bytesReaderCloser{Reader: bytes.NewReader(body)}
+		}
+		select {
+		case mirror.inFlight <- struct{}{}:
+			// The mirrored request outlives the original request, hence it must not use the original request's context.
+			req, err := mirror.newMirroredRequest(context.Background(), r, body)
+			if err != nil {
+				<-mirror.inFlight
+				atomic.AddInt64(&mirror.failed, 1)
+				mirror.logger.Info(GetRealClientIP(r), err, "failed to construct mirrored request")
+			} else {
+				go mirror.send(req, GetRealClientIP(r))
+			}
+		default:
+			atomic.AddInt64(&mirror.dropped, 1)
+		}
+		next(w, r)
+	}
+}
+
+// readCloser combines a reader and a closer of different origins.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
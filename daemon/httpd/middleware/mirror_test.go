@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestMirror_Initialise(t *testing.T) {
+	require.Error(t, (&RequestMirror{}).Initialise(lalog.DefaultLogger))
+	require.Error(t, (&RequestMirror{Location: "/a", TargetURL: "/relative", SamplePercent: 10}).Initialise(lalog.DefaultLogger))
+	require.Error(t, (&RequestMirror{Location: "/a", TargetURL: "http://example.com", SamplePercent: 0}).Initialise(lalog.DefaultLogger))
+	require.Error(t, (&RequestMirror{Location: "/a", TargetURL: "http://example.com", SamplePercent: 101}).Initialise(lalog.DefaultLogger))
+	mirror := &RequestMirror{Location: "/a", TargetURL: "http://example.com", SamplePercent: 100}
+	require.NoError(t, mirror.Initialise(lalog.DefaultLogger))
+	require.Equal(t, DefaultMirrorTimeoutSec, mirror.TimeoutSec)
+	require.Equal(t, DefaultMirrorMaxConcurrency, mirror.MaxConcurrency)
+}
+
+func TestMirrorRequest(t *testing.T) {
+	type receivedRequest struct {
+		method, path, query, body, forwardedFor, mirrored, host string
+	}
+	received := make(chan receivedRequest, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedRequest{r.Method, r.URL.Path, r.URL.RawQuery, string(body), r.Header.Get("X-Forwarded-For"), r.Header.Get(MirroredRequestHeader), r.Host}
+		// The response of the mirror must not reach the visitor
+		http.Error(w, "staging error", http.StatusInternalServerError)
+	}))
+	defer target.Close()
+
+	mirror := &RequestMirror{Location: "/cmd", TargetURL: target.URL + "/staging/", SamplePercent: 50}
+	require.NoError(t, mirror.Initialise(lalog.DefaultLogger))
+	var sample int
+	mirror.randIntFn = func(int) int {
+		return sample
+	}
+	handlerFunc := MirrorRequest(mirror, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte("original " + string(body)))
+	})
+	serve := func(req *http.Request) string {
+		w := httptest.NewRecorder()
+		handlerFunc(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		return w.Body.String()
+	}
+
+	// The sampled request is mirrored along with its body
+	req := httptest.NewRequest(http.MethodPost, "http://laitos.example.com/cmd?a=b", strings.NewReader("hello"))
+	req.RemoteAddr = "1.2.3.4:5678"
+	require.Equal(t, "original hello", serve(req))
+	select {
+	case got := <-received:
+		require.Equal(t, receivedRequest{http.MethodPost, "/staging/cmd", "a=b", "hello", "1.2.3.4", "1", "laitos.example.com"}, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not receive mirrored request")
+	}
+
+	// A request outside of the sample is not mirrored
+	sample = 50
+	require.Equal(t, "original hello", serve(httptest.NewRequest(http.MethodPost, "/cmd", strings.NewReader("hello"))))
+	// A mirrored request is not mirrored again
+	sample = 0
+	req = httptest.NewRequest(http.MethodPost, "/cmd", strings.NewReader("hello"))
+	req.Header.Set(MirroredRequestHeader, "1")
+	require.Equal(t, "original hello", serve(req))
+	// An overly large request is not mirrored, though it reaches the handler intact
+	largeBody := strings.Repeat("a", MirrorMaxBodyBytes+10)
+	require.Equal(t, "original "+largeBody, serve(httptest.NewRequest(http.MethodPost, "/cmd", strings.NewReader(largeBody))))
+	select {
+	case got := <-received:
+		t.Fatalf("unexpected mirrored request %+v", got)
+	case <-time.After(1 * time.Second):
+	}
+	mirrored, dropped, failed := mirror.GetStats()
+	require.EqualValues(t, 1, mirrored)
+	require.EqualValues(t, 0, dropped)
+	require.EqualValues(t, 0, failed)
+}
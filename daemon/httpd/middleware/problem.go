@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ProblemContentType is the content type of an error response in the format of "Problem Details for HTTP APIs".
+const ProblemContentType = "application/problem+json"
+
+/*
+Problem is an error response in the format of "Problem Details for HTTP APIs" (RFC 9457). The handlers respond with
+a problem in place of a plain text error when the client asks for JSON, so that the API clients can tell the errors
+of all handlers apart in the same way.
+*/
+type Problem struct {
+	// Type is a URI that identifies the kind of problem, "about:blank" means the kind is described by the status alone.
+	Type string `json:"type"`
+	// Title is the short, human-readable summary of the status, e.g. "Bad Request".
+	Title string `json:"title"`
+	// Status is the HTTP status code.
+	Status int `json:"status"`
+	// Detail is the (optional) explanation specific to this occurrence of the problem.
+	Detail string `json:"detail,omitempty"`
+	// Instance is the URL path of the request that ran into the problem.
+	Instance string `json:"instance,omitempty"`
+}
+
+// WantsJSON returns true if the client accepts JSON responses, e.g. "Accept: application/json" or "application/problem+json".
+func WantsJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+WriteError responds to the client with the error status and detail. The response is a problem (RFC 9457) if the
+client accepts JSON, or the detail in plain text otherwise.
+*/
+func WriteError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	if !WantsJSON(r) {
+		http.Error(w, detail, status)
+		return
+	}
+	problem := Problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(problem)
+}
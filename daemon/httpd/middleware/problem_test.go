@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                  false,
+		"text/html,application/xhtml+xml":   false,
+		"application/json":                  true,
+		"text/html, application/json;q=0.9": true,
+		"application/problem+json":          true,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api", nil)
+		req.Header.Set("Accept", accept)
+		if got := WantsJSON(req); got != want {
+			t.Fatal(accept, got)
+		}
+	}
+
+	// Plain text
+	req := httptest.NewRequest(http.MethodGet, "/api?a=b", nil)
+	rec := httptest.NewRecorder()
+	WriteError(rec, req, http.StatusBadRequest, "invalid IP address")
+	if rec.Code != http.StatusBadRequest || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") || rec.Body.String() != "invalid IP address\n" {
+		t.Fatal(rec.Code, rec.Header(), rec.Body.String())
+	}
+
+	// Problem details
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	WriteError(rec, req, http.StatusBadRequest, "invalid IP address")
+	if rec.Code != http.StatusBadRequest || rec.Header().Get("Content-Type") != ProblemContentType {
+		t.Fatal(rec.Code, rec.Header())
+	}
+	var problem Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem != (Problem{Type: "about:blank", Title: "Bad Request", Status: http.StatusBadRequest, Detail: "invalid IP address", Instance: "/api"}) {
+		t.Fatalf("%+v", problem)
+	}
+}
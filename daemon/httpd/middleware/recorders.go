@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"bufio"
+	"errors"
 	"net"
 	"net/http"
 	"time"
@@ -32,6 +33,27 @@ func (rec *HTTPResponseRecorder) Write(b []byte) (int, error) {
 	return size, err
 }
 
+// Hijack lets the handler take over the connection, which is only possible with HTTP/1.x.
+func (rec *HTTPResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rec.Hijacker == nil {
+		// HTTP/2 multiplexes many requests over a connection, a handler cannot take over the connection of its request.
+		return nil, nil, errors.New("HTTPResponseRecorder.Hijack: the response writer does not support hijacking")
+	}
+	return rec.Hijacker.Hijack()
+}
+
+// Flush sends the buffered response data to the client, it is used by handlers that stream their response.
+func (rec *HTTPResponseRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying response writer, which lets http.ResponseController extend the write deadline of a request.
+func (rec *HTTPResponseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
 // ConnRecorder is a net.Conn that remembers the size and timing characteristics of bytes written.
 type ConnRecorder struct {
 	net.Conn
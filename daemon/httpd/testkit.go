@@ -0,0 +1,441 @@
+package httpd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/handler"
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/platform"
+	"github.com/HouzuoGuo/laitos/testingstub"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// ResponseMatcher returns an error if the HTTP response does not meet an expectation of a test case.
+type ResponseMatcher func(resp inet.HTTPResponse) error
+
+// ExpectStatus matches the response status code.
+func ExpectStatus(statusCode int) ResponseMatcher {
+	return func(resp inet.HTTPResponse) error {
+		if resp.StatusCode != statusCode {
+			return fmt.Errorf("expected status %d, got %d", statusCode, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// ExpectBodyContains matches a response body that contains all of the substrings.
+func ExpectBodyContains(substrings ...string) ResponseMatcher {
+	return func(resp inet.HTTPResponse) error {
+		for _, substring := range substrings {
+			if !strings.Contains(string(resp.Body), substring) {
+				return fmt.Errorf("expected body to contain %q", substring)
+			}
+		}
+		return nil
+	}
+}
+
+// ExpectBodyContainsAny matches a response body that contains at least one of the substrings.
+func ExpectBodyContainsAny(substrings ...string) ResponseMatcher {
+	return func(resp inet.HTTPResponse) error {
+		for _, substring := range substrings {
+			if strings.Contains(string(resp.Body), substring) {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected body to contain any of %q", substrings)
+	}
+}
+
+// ExpectBody matches a response body that is identical to the string.
+func ExpectBody(body string) ResponseMatcher {
+	return func(resp inet.HTTPResponse) error {
+		if string(resp.Body) != body {
+			return fmt.Errorf("expected body %q", body)
+		}
+		return nil
+	}
+}
+
+// ExpectTrimmedBody matches a response body that is identical to the string after trimming the surrounding spaces.
+func ExpectTrimmedBody(body string) ResponseMatcher {
+	return func(resp inet.HTTPResponse) error {
+		if strings.TrimSpace(string(resp.Body)) != body {
+			return fmt.Errorf("expected trimmed body %q", body)
+		}
+		return nil
+	}
+}
+
+// HandlerTestCase is a request made to an HTTP daemon and the expectations on its response.
+type HandlerTestCase struct {
+	// Name identifies the test case in the failure message.
+	Name string
+	// Path is the URL path and query of the request. If HandlerType is set, the path is relative to the handler location.
+	Path string
+	// HandlerType locates the handler installed at a location unknown to the test, e.g. a randomly generated one.
+	HandlerType handler.Handler
+	// Request carries the method, headers, and body of the request.
+	Request inet.HTTPRequest
+	// Prepare is invoked right before making the request, it may alter the request using the outcome of earlier test cases.
+	Prepare func(req *inet.HTTPRequest)
+	// Expect are the matchers that the response must satisfy, in addition to the absence of IO error.
+	Expect []ResponseMatcher
+	// SkipOnWindows skips the test case if the host is running Windows.
+	SkipOnWindows bool
+}
+
+/*
+RunHandlerTestCases makes the requests of the test cases one after another to the HTTP daemon listening at the base
+URL (e.g. "http://127.0.0.1:8080"), and fails the test upon the first response that does not meet the expectations.
+*/
+func RunHandlerTestCases(httpd *Daemon, t testingstub.T, baseURL string, testCases []HandlerTestCase) {
+	t.Helper()
+	for _, testCase := range testCases {
+		if testCase.SkipOnWindows && platform.HostIsWindows() {
+			continue
+		}
+		req := testCase.Request
+		if testCase.Prepare != nil {
+			testCase.Prepare(&req)
+		}
+		url := baseURL + testCase.Path
+		if testCase.HandlerType != nil {
+			location := httpd.GetHandlerByFactoryType(testCase.HandlerType)
+			if location == "" {
+				t.Fatalf("%s: the HTTP daemon does not have a handler of type %T", testCase.Name, testCase.HandlerType)
+				return
+			}
+			url = baseURL + location + testCase.Path
+		}
+		resp, err := inet.DoHTTP(context.Background(), req, url)
+		if err != nil {
+			t.Fatalf("%s: %s %s failed: %v", testCase.Name, methodOrGet(req.Method), url, err)
+			return
+		}
+		for _, match := range testCase.Expect {
+			if err := match(resp); err != nil {
+				t.Fatalf("%s: %s %s: %v\nresponse status: %d\nresponse body: %s", testCase.Name, methodOrGet(req.Method), url, err, resp.StatusCode, string(resp.Body))
+				return
+			}
+		}
+	}
+}
+
+// methodOrGet returns the HTTP method, or "GET" if it is empty.
+func methodOrGet(method string) string {
+	if method == "" {
+		return http.MethodGet
+	}
+	return method
+}
+
+const (
+	TestLaitosIndexHTMLContent = "this is index #LAITOS_CLIENTADDR #LAITOS_3339TIME"
+
+	// testDTMFVerySecretDotSTrue is the DTMF input of app command "verysecret.s true".
+	//                            v  e r  y  s   e c  r  e t .   s    tr  u e
+	testDTMFVerySecretDotSTrue = "88833777999777733222777338014207777087778833"
+	// testTwilioEmptyOutputSay is the phone call response to an app command that produces an empty output.
+	testTwilioEmptyOutputSay = `<Say>EMPTY OUTPUT.
+
+    repeat again.    
+
+EMPTY OUTPUT.
+
+    repeat again.    
+
+EMPTY OUTPUT.
+over.
+</Say>`
+	// testTwilioPhoneticOutput is the phonetic spelling of "EMPTY OUTPUT" spoken in a phone call.
+	testTwilioPhoneticOutput = `capital echo, capital mike, capital papa, capital tango, capital yankee, space, capital oscar, capital uniform, capital tango, capital papa, capital uniform, capital tango.
+
+    repeat again.    
+
+capital echo, capital mike, capital papa, capital tango, capital yankee, space, capital oscar, capital uniform, capital tango, capital papa, capital uniform, capital tango.
+
+    repeat again.    
+
+capital echo, capital mike, capital papa, capital tango, capital yankee, space, capital oscar, capital uniform, capital tango, capital papa, capital uniform, capital tango.
+over.`
+)
+
+// PrepareForTestHTTPD sets up a directory and HTML file to be hosted by HTTPD during tests.
+func PrepareForTestHTTPD(t testingstub.T) {
+	// Create a temporary file for index
+	_ = os.MkdirAll("/tmp", 1777)
+	indexFile := "/tmp/test-laitos-index.html"
+	if err := os.WriteFile(indexFile, []byte(TestLaitosIndexHTMLContent), 0644); err != nil {
+		panic(err)
+	}
+	htmlDir := "/tmp/test-laitos-dir"
+	if err := os.MkdirAll(htmlDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(htmlDir+"/a.html", []byte("a html"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	/*
+		Unfortunately due to the difficulty in making preparations for concurrent tests on multiple HTTP daemons, there
+		won't be automated clean up for these files.
+	*/
+	// Globally enable prometheus integration so to ensure that initialisation and metrics recording code will run during the test
+	misc.PrometheusIntegration.Set(true)
+}
+
+// Run unit tests on API handlers of an already started HTTP daemon all API handlers. Essentially, it tests "handler" package.
+func TestAPIHandlers(httpd *Daemon, t testingstub.T) {
+	addr := fmt.Sprintf("http://%s:%d", httpd.Address, httpd.Port)
+	var testCases []HandlerTestCase
+	testCases = append(testCases, pageHandlerTestCases(httpd)...)
+	testCases = append(testCases, fileUploadHandlerTestCases(t)...)
+	testCases = append(testCases, twilioHandlerTestCases()...)
+	testCases = append(testCases, appCommandHandlerTestCases(httpd)...)
+	RunHandlerTestCases(httpd, t, addr, testCases)
+}
+
+// pageHandlerTestCases return the test cases of the handlers that serve web pages and simple APIs.
+func pageHandlerTestCases(httpd *Daemon) []HandlerTestCase {
+	return []HandlerTestCase{
+		{Name: "system info", Path: "/info", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("Stack traces:")}},
+		{Name: "command form page", Path: "/cmd_form", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("submit")}},
+		{Name: "command form without command", Path: "/cmd_form", Request: inet.HTTPRequest{Method: http.MethodPost},
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("submit")}},
+		{Name: "command form with command", Path: "/cmd_form", Request: inet.HTTPRequest{
+			Method: http.MethodPost,
+			Body:   strings.NewReader(url.Values{"cmd": {"verysecret.secho cmd_form_test"}}.Encode()),
+		}, Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("cmd_form_test")}},
+		{Name: "gitlab browser", Path: "/gitlab", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("Enter path to browse")}},
+		{Name: "HTML document", Path: "/html", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), func(resp inet.HTTPResponse) error {
+			// The placeholders are substituted at the time of the request
+			return ExpectBody("this is index 127.0.0.1 " + time.Now().Format(time.RFC3339))(resp)
+		}}},
+		{Name: "mail me page", Path: "/mail_me", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("submit")}},
+		{Name: "mail me without message", Path: "/mail_me", Request: inet.HTTPRequest{Method: http.MethodPost},
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("submit")}},
+		{Name: "mail me with message", Path: "/mail_me", Request: inet.HTTPRequest{
+			Method: http.MethodPost,
+			Body:   strings.NewReader(url.Values{"msg": {"又给你发了一个邮件"}}.Encode()),
+		}, Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContainsAny("发不出去", "发出去了")}},
+		{Name: "microsoft bot without chat", Path: "/microsoft_bot", Expect: []ResponseMatcher{ExpectStatus(http.StatusBadRequest)}},
+		// The chat request does not carry a Bot Framework token
+		{Name: "microsoft bot without token", Path: "/microsoft_bot", Request: inet.HTTPRequest{Body: strings.NewReader(`{}`)},
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusUnauthorized)}},
+		{Name: "recurring commands setup page", Path: "/recurring_cmds", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("submit")}},
+		{Name: "recurring commands results", Path: "/recurring_cmds?retrieve=channel2", Prepare: func(*inet.HTTPRequest) {
+			// Give timer commands a moment to trigger
+			time.Sleep(time.Duration(httpd.HandlerCollection["/recurring_cmds"].(*handler.HandleRecurringCommands).RecurringCommands["channel2"].IntervalSec+1) * time.Second)
+		}, Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("channel2")}},
+		{Name: "proxy", Path: "/proxy?u=https%%3A%%2F%%2Fgithub.com", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("github", "laitos_rewrite_url")}},
+	}
+}
+
+// fileUploadHandlerTestCases return the test cases that upload a file and then download it.
+func fileUploadHandlerTestCases(t testingstub.T) []HandlerTestCase {
+	var downloadFileName string
+	return []HandlerTestCase{
+		{Name: "file upload page", Path: "/upload", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("submit")}},
+		{Name: "file upload", Path: "/upload", Request: inet.HTTPRequest{Method: http.MethodPost}, Prepare: func(req *inet.HTTPRequest) {
+			body := &bytes.Buffer{}
+			writer := multipart.NewWriter(body)
+			part, err := writer.CreateFormFile("upload", "sample-upload.html")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := part.Write([]byte(TestLaitosIndexHTMLContent)); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.WriteField("submit", "Upload"); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+			req.ContentType = writer.FormDataContentType()
+			req.Body = body
+		}, Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), func(resp inet.HTTPResponse) error {
+			for _, line := range strings.Split(string(resp.Body), "\n") {
+				/*
+					The line looks like:
+					<pre>.... Your file is available for 24 hours under name: xxxx.nnn</pre>
+				*/
+				if strings.Contains(line, "Your file is available for 24 hours") {
+					downloadFileName = line[strings.IndexRune(line, ':')+1 : strings.LastIndexByte(line, '<')]
+					return nil
+				}
+			}
+			return errors.New("the response does not carry the name of uploaded file")
+		}}},
+		{Name: "file download", Path: "/upload", Request: inet.HTTPRequest{Method: http.MethodPost, ContentType: "application/x-www-form-urlencoded"},
+			Prepare: func(req *inet.HTTPRequest) {
+				req.Body = strings.NewReader(url.Values{"submit": []string{"Download"}, "download": []string{downloadFileName}}.Encode())
+			}, Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBody(TestLaitosIndexHTMLContent)}},
+	}
+}
+
+// twilioHandlerTestCases return the test cases of Twilio SMS and phone call hooks, including their rate limits.
+func twilioHandlerTestCases() []HandlerTestCase {
+	smsFromNumber := func(from string) inet.HTTPRequest {
+		values := url.Values{"Body": {"verysecret .s echo 0123456789012345678901234567890123456789"}}
+		if from != "" {
+			values.Set("From", from)
+		}
+		return inet.HTTPRequest{Method: http.MethodPost, Body: strings.NewReader(values.Encode())}
+	}
+	callFromNumber := func() inet.HTTPRequest {
+		return inet.HTTPRequest{Method: http.MethodPost, Body: strings.NewReader(url.Values{"From": {"call number"}}.Encode())}
+	}
+	dtmf := func(digits, from string) inet.HTTPRequest {
+		values := url.Values{"Digits": {digits}}
+		if from != "" {
+			values.Set("From", from)
+		}
+		return inet.HTTPRequest{Method: http.MethodPost, Body: strings.NewReader(values.Encode())}
+	}
+	return []HandlerTestCase{
+		{Name: "twilio SMS with bad PIN", HandlerType: &handler.HandleTwilioSMSHook{}, Request: inet.HTTPRequest{
+			Method: http.MethodPost,
+			Body:   strings.NewReader(url.Values{"Body": {"incorrect PIN"}}.Encode()),
+		}, Expect: []ResponseMatcher{ExpectStatus(http.StatusServiceUnavailable), ExpectTrimmedBody(toolbox.ErrPINAndShortcutNotFound.Error())}},
+		// The extra spaces around prefix and PIN do not matter
+		{Name: "twilio SMS", HandlerType: &handler.HandleTwilioSMSHook{}, Request: smsFromNumber(""),
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("01234567890123456789012345678901234")}},
+		// Prevent SMS spam according to incoming phone number
+		{Name: "twilio SMS from a number", HandlerType: &handler.HandleTwilioSMSHook{}, Request: smsFromNumber("sms number"),
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("01234567890123456789012345678901234")}},
+		{Name: "twilio SMS rate limit", HandlerType: &handler.HandleTwilioSMSHook{}, Request: smsFromNumber("sms number"),
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusServiceUnavailable), ExpectBodyContains("rate limit is exceeded by")}},
+		{Name: "twilio call greeting", Path: "/call_greeting", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("<Say>Hi there</Say>")}},
+		// Prevent call spam according to incoming phone number
+		{Name: "twilio call greeting from a number", Path: "/call_greeting", Request: callFromNumber(),
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("<Say>Hi there</Say>")}},
+		{Name: "twilio call greeting rate limit", Path: "/call_greeting", Request: callFromNumber(),
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("<Response><Reject/></Response>")}},
+		{Name: "twilio call with bad PIN", HandlerType: &handler.HandleTwilioCallCallback{}, Request: dtmf("0000000", ""),
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains(toolbox.ErrPINAndShortcutNotFound.Error())}},
+		{Name: "twilio call command", HandlerType: &handler.HandleTwilioCallCallback{}, Request: dtmf(testDTMFVerySecretDotSTrue, ""), SkipOnWindows: true,
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains(testTwilioEmptyOutputSay)}},
+		// Ask the command output to be spelt phonetically
+		{Name: "twilio call command spelt phonetically", HandlerType: &handler.HandleTwilioCallCallback{}, Request: dtmf(handler.TwilioPhoneticSpellingMagic+testDTMFVerySecretDotSTrue, ""), SkipOnWindows: true,
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("<Say>" + testTwilioPhoneticOutput + "\n</Say>")}},
+		// Prevent DTMF command spam according to incoming phone number
+		{Name: "twilio call command from a number", HandlerType: &handler.HandleTwilioCallCallback{}, Request: dtmf(testDTMFVerySecretDotSTrue, "dtmf number"), SkipOnWindows: true,
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains(testTwilioEmptyOutputSay)}},
+		{Name: "twilio call command rate limit", HandlerType: &handler.HandleTwilioCallCallback{}, Request: dtmf(testDTMFVerySecretDotSTrue, "dtmf number"), SkipOnWindows: true,
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("<Say>You are rate limited.</Say><Hangup/>")}},
+		// Wait for phone number rate limit to expire for SMS, call, and DTMF command, then redo the tests
+		{Name: "twilio SMS after rate limit", HandlerType: &handler.HandleTwilioSMSHook{}, Request: smsFromNumber("sms number"), Prepare: func(*inet.HTTPRequest) {
+			time.Sleep((handler.TwilioPhoneNumberRateLimitIntervalSec + 1) * time.Second)
+		}, Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("01234567890123456789012345678901234")}},
+		{Name: "twilio call greeting after rate limit", Path: "/call_greeting", Request: callFromNumber(),
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("<Say>Hi there</Say>")}},
+		{Name: "twilio call command after rate limit", HandlerType: &handler.HandleTwilioCallCallback{}, Request: dtmf(testDTMFVerySecretDotSTrue, "dtmf number"), SkipOnWindows: true,
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains(testTwilioEmptyOutputSay)}},
+	}
+}
+
+// appCommandHandlerTestCases return the test cases of app command execution and subject reports retrieval.
+func appCommandHandlerTestCases(httpd *Daemon) []HandlerTestCase {
+	return []HandlerTestCase{
+		{Name: "app command", HandlerType: &handler.HandleAppCommand{}, Request: inet.HTTPRequest{
+			Method: http.MethodPost,
+			Body:   strings.NewReader(url.Values{"cmd": {toolbox.TestCommandProcessorPIN + ".s echo hi"}}.Encode()),
+		}, Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBody("hi")}},
+		// Retrieve subjects and count of their reports - two reports from the same host.
+		{Name: "reports subject count", HandlerType: &handler.HandleReportsRetrieval{}, Request: inet.HTTPRequest{Method: http.MethodPost}, Prepare: func(*inet.HTTPRequest) {
+			for _, clientIP := range []string{"client-ip1", "client-ip2"} {
+				httpd.Processor.Features.MessageProcessor.StoreReport(context.Background(), toolbox.SubjectReportRequest{
+					SubjectHostName: "subject-host-name",
+				}, clientIP, strings.Replace(clientIP, "ip", "daemon", 1))
+			}
+		}, Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), func(resp inet.HTTPResponse) error {
+			var subjectCount map[string]int
+			if err := json.Unmarshal(resp.Body, &subjectCount); err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(subjectCount, map[string]int{"subject-host-name": 2}) {
+				return fmt.Errorf("unexpected subject count %+v", subjectCount)
+			}
+			return nil
+		}}},
+		// Retrieve the host reports from the latest to oldest
+		{Name: "reports of all subjects", HandlerType: &handler.HandleReportsRetrieval{}, Path: "?n=100", Request: inet.HTTPRequest{Method: http.MethodPost},
+			Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), func(resp inet.HTTPResponse) error {
+				var reports []toolbox.SubjectReport
+				if err := json.Unmarshal(resp.Body, &reports); err != nil {
+					return err
+				}
+				if len(reports) != 2 || reports[0].SubjectClientTag != "client-ip2" || reports[1].SubjectClientTag != "client-ip1" {
+					return fmt.Errorf("unexpected reports %+v", reports)
+				}
+				return nil
+			}}},
+		{Name: "latest report of a subject", HandlerType: &handler.HandleReportsRetrieval{}, Request: inet.HTTPRequest{
+			Method: http.MethodPost,
+			Body:   strings.NewReader(url.Values{"n": {"1"}, "host": {"subject-host-name"}}.Encode()),
+		}, Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), func(resp inet.HTTPResponse) error {
+			var reports []toolbox.SubjectReport
+			if err := json.Unmarshal(resp.Body, &reports); err != nil {
+				return err
+			}
+			if len(reports) != 1 || reports[0].SubjectClientTag != "client-ip2" {
+				return fmt.Errorf("unexpected reports %+v", reports)
+			}
+			return nil
+		}}},
+		// Assign subject a command to run
+		{Name: "assign subject a command", HandlerType: &handler.HandleReportsRetrieval{}, Request: inet.HTTPRequest{
+			Method: http.MethodPost,
+			Body:   strings.NewReader(url.Values{"host": {"subject-host-name"}, "cmd": {"test123"}}.Encode()),
+		}, Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("will carry an app command"), func(inet.HTTPResponse) error {
+			if cmd := httpd.Processor.Features.MessageProcessor.OutgoingAppCommands["subject-host-name"]; cmd != "test123" {
+				return fmt.Errorf("unexpected outgoing app command %q", cmd)
+			}
+			return nil
+		}}},
+	}
+}
+
+// Run unit test on HTTP daemon. See TestHTTPD_StartAndBlock for daemon setup.
+func TestHTTPD(httpd *Daemon, t testingstub.T) {
+	addr := fmt.Sprintf("http://%s:%d", httpd.Address, httpd.Port)
+	dirListing := []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBodyContains("a.html")}
+	RunHandlerTestCases(httpd, t, addr, []HandlerTestCase{
+		{Name: "directory listing", Path: "/my/dir", Expect: dirListing},
+		{Name: "file in directory", Path: "/my/dir/a.html", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBody("a html")}},
+		{Name: "directory listing at the root", Path: "/dir", Expect: dirListing},
+		{Name: "file in directory at the root", Path: "/dir/a.html", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBody("a html")}},
+		{Name: "non-existent file in directory", Path: "/my/dir/doesnotexist.html", Expect: []ResponseMatcher{ExpectStatus(http.StatusNotFound)}},
+		// Non-existent path, but go is quite stupid that it produces response of /
+		{Name: "non-existent path", Path: "/doesnotexist", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK)}},
+	})
+	// Test hitting rate limits
+	time.Sleep(RateLimitIntervalSec * time.Second)
+	success := 0
+	for i := 0; i < httpd.PerIPLimit*DirectoryHandlerRateLimitFactor*2; i++ {
+		resp, err := inet.DoHTTP(context.Background(), inet.HTTPRequest{}, addr+"/my/dir/a.html")
+		if err == nil && resp.StatusCode == http.StatusOK {
+			success++
+		}
+	}
+	if success < 1 || success > httpd.PerIPLimit*DirectoryHandlerRateLimitFactor*2 {
+		t.Fatal(success)
+	}
+	// Wait out rate limit (leave 3 seconds buffer for pending requests to complete)
+	time.Sleep((RateLimitIntervalSec + 3) * time.Second)
+	// Visit page again after rate limit resets
+	RunHandlerTestCases(httpd, t, addr, []HandlerTestCase{{Name: "directory listing after rate limit", Path: "/my/dir", Expect: dirListing}})
+}
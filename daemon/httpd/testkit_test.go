@@ -0,0 +1,59 @@
+package httpd
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/handler"
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingT records the failures of a test run by RunHandlerTestCases.
+type recordingT struct {
+	*testing.T
+	failures []string
+}
+
+func (t *recordingT) Fatalf(format string, args ...interface{}) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+}
+
+func TestRunHandlerTestCases(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, " %s %s ", r.Method, r.URL.Path)
+	}))
+	defer server.Close()
+	daemon := &Daemon{HandlerCollection: HandlerCollection{"/app": &handler.HandleAppCommand{}}}
+
+	var prepared bool
+	rec := &recordingT{T: t}
+	RunHandlerTestCases(daemon, rec, server.URL, []HandlerTestCase{
+		{Name: "get", Path: "/a", Expect: []ResponseMatcher{ExpectStatus(http.StatusOK), ExpectBody(" GET /a "), ExpectTrimmedBody("GET /a")}},
+		{Name: "post", Path: "/b", Request: inet.HTTPRequest{Method: http.MethodPost}, Expect: []ResponseMatcher{ExpectBodyContains("POST", "/b")}},
+		{Name: "handler type", HandlerType: &handler.HandleAppCommand{}, Path: "/c", Expect: []ResponseMatcher{ExpectBodyContainsAny("nothing", "/app/c")}},
+		{Name: "prepare", Path: "/d", Prepare: func(req *inet.HTTPRequest) {
+			prepared = true
+			req.Method = http.MethodPut
+		}, Expect: []ResponseMatcher{ExpectBodyContains("PUT /d")}},
+	})
+	require.Empty(t, rec.failures)
+	require.True(t, prepared)
+
+	// Each mismatch fails the test with the name of test case
+	for _, testCase := range []HandlerTestCase{
+		{Name: "status", Path: "/a", Expect: []ResponseMatcher{ExpectStatus(http.StatusCreated)}},
+		{Name: "body", Path: "/a", Expect: []ResponseMatcher{ExpectBody("GET /a")}},
+		{Name: "contains", Path: "/a", Expect: []ResponseMatcher{ExpectBodyContains("GET", "POST")}},
+		{Name: "contains any", Path: "/a", Expect: []ResponseMatcher{ExpectBodyContainsAny("POST", "PUT")}},
+		{Name: "trimmed", Path: "/a", Expect: []ResponseMatcher{ExpectTrimmedBody("GET")}},
+		{Name: "missing handler", HandlerType: &handler.HandleSystemInfo{}},
+	} {
+		rec := &recordingT{T: t}
+		RunHandlerTestCases(daemon, rec, server.URL, []HandlerTestCase{testCase})
+		require.Len(t, rec.failures, 1, testCase.Name)
+		require.Contains(t, rec.failures[0], testCase.Name+": ")
+	}
+}
@@ -0,0 +1,234 @@
+package httpd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+)
+
+const (
+	// TrailingSlashAdd redirects visitors from "/a/b" to "/a/b/" unless "/a/b" is served by a handler.
+	TrailingSlashAdd = "add"
+	// TrailingSlashRemove redirects visitors from "/a/b/" to "/a/b" unless "/a/b/" is served by a handler.
+	TrailingSlashRemove = "remove"
+)
+
+/*
+URLRewrite redirects visitors from one URL path to another, or rewrites the path internally so that a different handler
+serves the request without the visitor noticing.
+*/
+type URLRewrite struct {
+	// From is the exact URL path to match, or a path prefix when it ends with an asterisk (e.g. "/blog/*").
+	From string `json:"From"`
+	// To is the destination path or URL. For a prefix match, an asterisk in the destination is substituted by the
+	// remainder of the path, e.g. From "/blog/*" and To "/articles/*" redirect "/blog/a.html" to "/articles/a.html".
+	To string `json:"To"`
+	// StatusCode is the HTTP redirect status code - 301, 302, 307, or 308. Use 0 to rewrite the path internally.
+	StatusCode int `json:"StatusCode"`
+}
+
+// Match returns the destination of the URL path if the path matches the rule, or an empty string if it does not match.
+func (rule URLRewrite) Match(urlPath string) string {
+	if strings.HasSuffix(rule.From, "*") {
+		prefix := strings.TrimSuffix(rule.From, "*")
+		if !strings.HasPrefix(urlPath, prefix) {
+			return ""
+		}
+		return strings.Replace(rule.To, "*", urlPath[len(prefix):], 1)
+	}
+	if urlPath == rule.From {
+		return strings.TrimSuffix(rule.To, "*")
+	}
+	return ""
+}
+
+// ErrorPage is a custom HTML document that replaces the response of an error status code.
+type ErrorPage struct {
+	// StatusCode is the HTTP status code (e.g. 404) of which the response is replaced by the document.
+	StatusCode int `json:"StatusCode"`
+	// Location is the URL path prefix where the document is used, it defaults to "/" - all locations.
+	Location string `json:"Location"`
+	// FilePath is the path to the HTML document file.
+	FilePath string `json:"FilePath"`
+
+	content []byte
+}
+
+// initialiseURLRules validates URL rewrite rules, trailing slash policy, and loads the error page documents.
+func (daemon *Daemon) initialiseURLRules() error {
+	for _, rule := range daemon.URLRewrites {
+		if !strings.HasPrefix(rule.From, "/") || rule.To == "" {
+			return fmt.Errorf("httpd.Initialise: URL rewrite from \"%s\" must have an absolute path and a destination", rule.From)
+		}
+		switch rule.StatusCode {
+		case 0:
+			if !strings.HasPrefix(rule.To, "/") {
+				return fmt.Errorf("httpd.Initialise: URL rewrite from \"%s\" must rewrite to an absolute path", rule.From)
+			}
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return fmt.Errorf("httpd.Initialise: URL rewrite from \"%s\" has an invalid status code %d", rule.From, rule.StatusCode)
+		}
+	}
+	switch daemon.TrailingSlash {
+	case "", TrailingSlashAdd, TrailingSlashRemove:
+	default:
+		return fmt.Errorf("httpd.Initialise: TrailingSlash must be either \"%s\" or \"%s\"", TrailingSlashAdd, TrailingSlashRemove)
+	}
+	for i := range daemon.ErrorPages {
+		page := &daemon.ErrorPages[i]
+		if page.StatusCode < 400 || page.StatusCode > 599 {
+			return fmt.Errorf("httpd.Initialise: error page status code %d must be within [400, 599]", page.StatusCode)
+		}
+		if page.Location == "" {
+			page.Location = "/"
+		}
+		content, err := os.ReadFile(page.FilePath)
+		if err != nil {
+			return fmt.Errorf("httpd.Initialise: failed to read error page - %w", err)
+		}
+		page.content = content
+	}
+	// Prefer the error page of the most specific location.
+	sort.SliceStable(daemon.ErrorPages, func(i, j int) bool {
+		return len(daemon.ErrorPages[i].Location) > len(daemon.ErrorPages[j].Location)
+	})
+	return nil
+}
+
+// getErrorPage returns the custom error document for the status code and URL path, or nil if there is none.
+func (daemon *Daemon) getErrorPage(statusCode int, urlPath string) []byte {
+	for _, page := range daemon.ErrorPages {
+		if page.StatusCode == statusCode && strings.HasPrefix(urlPath, page.Location) {
+			return page.content
+		}
+	}
+	return nil
+}
+
+// trailingSlashDestination returns the URL path to redirect to according to the trailing slash policy, or an empty string.
+func (daemon *Daemon) trailingSlashDestination(urlPath string) string {
+	if _, isResource := daemon.ResourcePaths[urlPath]; isResource || urlPath == "/" {
+		return ""
+	}
+	switch daemon.TrailingSlash {
+	case TrailingSlashAdd:
+		// Leave alone the paths that look like files, e.g. "/a/b.html".
+		if !strings.HasSuffix(urlPath, "/") && !strings.Contains(path.Base(urlPath), ".") {
+			return urlPath + "/"
+		}
+	case TrailingSlashRemove:
+		if strings.HasSuffix(urlPath, "/") {
+			// Directory listings are served at paths with trailing slash.
+			for resource := range daemon.ResourcePaths {
+				if resource != "/" && strings.HasSuffix(resource, "/") && strings.HasPrefix(urlPath, resource) {
+					return ""
+				}
+			}
+			return strings.TrimRight(urlPath, "/")
+		}
+	}
+	return ""
+}
+
+/*
+applyURLRules wraps the handler to redirect and rewrite request URLs according to the rewrite rules and trailing slash
+policy, and to replace error responses with custom error documents.
+*/
+func (daemon *Daemon) applyURLRules(next http.Handler) http.Handler {
+	if len(daemon.URLRewrites) == 0 && daemon.TrailingSlash == "" && len(daemon.ErrorPages) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range daemon.URLRewrites {
+			dest := rule.Match(r.URL.Path)
+			if dest == "" {
+				continue
+			}
+			if rule.StatusCode == 0 {
+				// Rewrite the path without letting the visitor know
+				r.URL.Path = dest
+				r.URL.RawPath = ""
+				break
+			}
+			if r.URL.RawQuery != "" && !strings.Contains(dest, "?") {
+				dest += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, dest, rule.StatusCode)
+			return
+		}
+		if dest := daemon.trailingSlashDestination(r.URL.Path); dest != "" {
+			if r.URL.RawQuery != "" {
+				dest += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, dest, http.StatusMovedPermanently)
+			return
+		}
+		// The API clients that ask for JSON receive the error responses of the handlers as they are
+		if len(daemon.ErrorPages) > 0 && !middleware.WantsJSON(r) {
+			w = &errorPageWriter{ResponseWriter: w, daemon: daemon, urlPath: r.URL.Path}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorPageWriter replaces the response of an error status code with the custom error document.
+type errorPageWriter struct {
+	http.ResponseWriter
+	daemon      *Daemon
+	urlPath     string
+	wroteHeader bool
+	replaced    bool
+}
+
+func (w *errorPageWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if page := w.daemon.getErrorPage(statusCode, w.urlPath); page != nil {
+		header := w.ResponseWriter.Header()
+		header.Del("Content-Length")
+		header.Del("Content-Encoding")
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		w.ResponseWriter.WriteHeader(statusCode)
+		_, _ = w.ResponseWriter.Write(page)
+		w.replaced = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *errorPageWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		// Discard the original error response
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush sends buffered data to the client, it is used by handlers that stream their response.
+func (w *errorPageWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets handlers (e.g. websocket) take over the connection.
+func (w *errorPageWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("errorPageWriter.Hijack: the response writer does not support hijacking")
+}
@@ -0,0 +1,117 @@
+package httpd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/handler"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestURLRewrite_Match(t *testing.T) {
+	exact := URLRewrite{From: "/old.html", To: "/new.html"}
+	require.Equal(t, "/new.html", exact.Match("/old.html"))
+	require.Equal(t, "", exact.Match("/old.htm"))
+
+	prefix := URLRewrite{From: "/blog/*", To: "/articles/*"}
+	require.Equal(t, "/articles/a/b.html", prefix.Match("/blog/a/b.html"))
+	require.Equal(t, "/articles/", prefix.Match("/blog/"))
+	require.Equal(t, "", prefix.Match("/blo"))
+
+	fixed := URLRewrite{From: "/shop/*", To: "https://example.com/"}
+	require.Equal(t, "https://example.com/", fixed.Match("/shop/item"))
+}
+
+func TestURLRules_Initialise(t *testing.T) {
+	daemon := Daemon{Processor: toolbox.GetTestCommandProcessor(), URLRewrites: []URLRewrite{{From: "relative", To: "/a"}}}
+	require.Error(t, daemon.Initialise("", ""))
+	daemon = Daemon{Processor: toolbox.GetTestCommandProcessor(), URLRewrites: []URLRewrite{{From: "/a", To: "/b", StatusCode: 200}}}
+	require.Error(t, daemon.Initialise("", ""))
+	daemon = Daemon{Processor: toolbox.GetTestCommandProcessor(), URLRewrites: []URLRewrite{{From: "/a", To: "https://example.com"}}}
+	require.Error(t, daemon.Initialise("", ""))
+	daemon = Daemon{Processor: toolbox.GetTestCommandProcessor(), TrailingSlash: "sometimes"}
+	require.Error(t, daemon.Initialise("", ""))
+	daemon = Daemon{Processor: toolbox.GetTestCommandProcessor(), ErrorPages: []ErrorPage{{StatusCode: 200, FilePath: "/dev/null"}}}
+	require.Error(t, daemon.Initialise("", ""))
+	daemon = Daemon{Processor: toolbox.GetTestCommandProcessor(), ErrorPages: []ErrorPage{{StatusCode: 404, FilePath: "/this/does/not/exist"}}}
+	require.Error(t, daemon.Initialise("", ""))
+}
+
+func TestURLRules_Handle(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.html"), []byte("file a"), 0644))
+	notFoundPath := filepath.Join(dir, "404.html")
+	require.NoError(t, os.WriteFile(notFoundPath, []byte("custom not found"), 0644))
+	filesNotFoundPath := filepath.Join(dir, "files-404.html")
+	require.NoError(t, os.WriteFile(filesNotFoundPath, []byte("custom file not found"), 0644))
+
+	daemon := Daemon{
+		Processor:        toolbox.GetTestCommandProcessor(),
+		ServeDirectories: map[string]string{"/files": dir},
+		HandlerCollection: map[string]handler.Handler{
+			"/index.html": &handler.HandleHTMLDocument{HTMLContent: "this is index"},
+			"/about":      &handler.HandleHTMLDocument{HTMLContent: "this is about"},
+		},
+		ErrorPages: []ErrorPage{
+			{StatusCode: http.StatusNotFound, FilePath: notFoundPath},
+			{StatusCode: http.StatusNotFound, Location: "/files/", FilePath: filesNotFoundPath},
+		},
+		URLRewrites: []URLRewrite{
+			{From: "/", To: "/index.html"},
+			{From: "/old-about", To: "/about", StatusCode: http.StatusMovedPermanently},
+			{From: "/docs/*", To: "/files/*", StatusCode: http.StatusFound},
+		},
+		TrailingSlash: TrailingSlashRemove,
+	}
+	require.NoError(t, daemon.Initialise("", ""))
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		daemon.rootHandler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+	// Internal rewrite
+	rec := serve("/")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "this is index", rec.Body.String())
+	// Exact redirect preserves the query string
+	rec = serve("/old-about?a=b")
+	require.Equal(t, http.StatusMovedPermanently, rec.Code)
+	require.Equal(t, "/about?a=b", rec.Header().Get("Location"))
+	// Prefix redirect
+	rec = serve("/docs/a.html")
+	require.Equal(t, http.StatusFound, rec.Code)
+	require.Equal(t, "/files/a.html", rec.Header().Get("Location"))
+	// Trailing slash is removed, except for the directory listing.
+	rec = serve("/about/")
+	require.Equal(t, http.StatusMovedPermanently, rec.Code)
+	require.Equal(t, "/about", rec.Header().Get("Location"))
+	rec = serve("/files/")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "a.html")
+	rec = serve("/files/a.html")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "file a", rec.Body.String())
+	// Error pages of the most specific location
+	rec = serve("/files/nonexistent.html")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, "custom file not found", rec.Body.String())
+	require.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	rec = serve("/nonexistent")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	require.Equal(t, "custom not found", rec.Body.String())
+
+	// Add trailing slash to paths that do not look like files.
+	daemon.TrailingSlash = TrailingSlashAdd
+	rec = serve("/blog")
+	require.Equal(t, http.StatusMovedPermanently, rec.Code)
+	require.Equal(t, "/blog/", rec.Header().Get("Location"))
+	rec = serve("/about")
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = serve("/files/a.html")
+	require.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,161 @@
+package httpd
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"golang.org/x/net/webdav"
+)
+
+// DefaultWebDAVMaxUploadMB is the default maximum size of a file uploaded by a WebDAV client.
+const DefaultWebDAVMaxUploadMB = 1024
+
+// webDAVReadMethods are the WebDAV request methods that do not modify the files.
+var webDAVReadMethods = map[string]bool{
+	http.MethodOptions: true,
+	"PROPFIND":         true,
+}
+
+// webDAVWriteMethods are the WebDAV request methods that modify the files or their locks.
+var webDAVWriteMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+	"MKCOL":           true,
+	"COPY":            true,
+	"MOVE":            true,
+	"PROPPATCH":       true,
+	"LOCK":            true,
+	"UNLOCK":          true,
+}
+
+// WebDAVLocation configures the WebDAV access to a directory of ServeDirectories.
+type WebDAVLocation struct {
+	// ReadOnly lets the WebDAV clients browse and download the files without modifying them.
+	ReadOnly bool `json:"ReadOnly"`
+}
+
+/*
+WebDAV lets file manager clients browse, upload, and modify the files of ServeDirectories using the WebDAV protocol, at
+the same URL location as the directory. The WebDAV requests are authenticated by HTTP basic authentication, whereas the
+ordinary downloads (GET) continue to be served to all visitors of the directory.
+*/
+type WebDAV struct {
+	// Locations are the URL locations of ServeDirectories (e.g. "/pictures/") accessible to WebDAV clients.
+	Locations map[string]WebDAVLocation `json:"Locations"`
+	// Users are the user names and passwords of HTTP basic authentication, which is required by all WebDAV requests.
+	Users map[string]string `json:"Users"`
+	// MaxUploadMB is the maximum size of a file uploaded by a WebDAV client.
+	MaxUploadMB int `json:"MaxUploadMB"`
+
+	logger *lalog.Logger
+}
+
+// normaliseDirectoryLocation returns the URL location of a directory that starts and ends with a slash.
+func normaliseDirectoryLocation(location string) string {
+	if !strings.HasPrefix(location, "/") {
+		location = "/" + location
+	}
+	if !strings.HasSuffix(location, "/") {
+		location += "/"
+	}
+	return location
+}
+
+// Initialise validates the configuration against the directories served by the web server.
+func (dav *WebDAV) Initialise(serveDirectories map[string]string, logger *lalog.Logger) error {
+	dav.logger = logger
+	if len(dav.Locations) == 0 {
+		return nil
+	}
+	if len(dav.Users) == 0 {
+		return errors.New("WebDAV.Initialise: there must be at least one user")
+	}
+	for user, password := range dav.Users {
+		if user == "" || password == "" {
+			return errors.New("WebDAV.Initialise: user name and password must not be empty")
+		}
+	}
+	if dav.MaxUploadMB < 1 {
+		dav.MaxUploadMB = DefaultWebDAVMaxUploadMB
+	}
+	dirLocations := make(map[string]bool)
+	for location := range serveDirectories {
+		dirLocations[normaliseDirectoryLocation(location)] = true
+	}
+	locations := make(map[string]WebDAVLocation)
+	for location, conf := range dav.Locations {
+		location = normaliseDirectoryLocation(location)
+		if !dirLocations[location] {
+			return fmt.Errorf("WebDAV.Initialise: location \"%s\" does not match any of ServeDirectories", location)
+		}
+		locations[location] = conf
+	}
+	dav.Locations = locations
+	return nil
+}
+
+// authenticate returns true if the request carries the name and password of a user, otherwise it asks the client to authenticate.
+func (dav *WebDAV) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if expected, exists := dav.Users[user]; ok && exists && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 {
+		return true
+	}
+	if ok {
+		dav.logger.Warning(middleware.GetRealClientIP(r), nil, "failed to authenticate user \"%s\"", user)
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="laitos", charset="UTF-8"`)
+	middleware.WriteError(w, r, http.StatusUnauthorized, "authentication is required")
+	return false
+}
+
+/*
+serveDirectory returns a handler function that serves the WebDAV requests of the directory at the URL location, and
+hands the other requests (e.g. downloads) over to the next handler. If the directory is not accessible to WebDAV
+clients, then it returns the next handler as-is.
+*/
+func (dav *WebDAV) serveDirectory(configuredLocation, urlLocation, dirPath string, next http.HandlerFunc) http.HandlerFunc {
+	conf, exists := dav.Locations[configuredLocation]
+	if !exists {
+		return next
+	}
+	davHandler := &webdav.Handler{
+		Prefix:     strings.TrimSuffix(urlLocation, "/"),
+		FileSystem: webdav.Dir(dirPath),
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				dav.logger.Info(middleware.GetRealClientIP(r), err, "failed to handle %s %s", r.Method, r.URL.Path)
+			}
+		},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !webDAVReadMethods[r.Method] && !webDAVWriteMethods[r.Method] {
+			next(w, r)
+			return
+		}
+		if !dav.authenticate(w, r) {
+			return
+		}
+		if conf.ReadOnly && webDAVWriteMethods[r.Method] {
+			middleware.WriteError(w, r, http.StatusForbidden, "the directory is read-only")
+			return
+		}
+		// A large file takes longer than IOTimeoutSec to upload or download.
+		deadline := time.Now().Add(DirectoryDownloadTimeoutSec * time.Second)
+		controller := http.NewResponseController(w)
+		if err := controller.SetReadDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			dav.logger.Info(urlLocation, err, "failed to extend the read deadline")
+		}
+		if err := controller.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			dav.logger.Info(urlLocation, err, "failed to extend the write deadline")
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(dav.MaxUploadMB)*1048576)
+		davHandler.ServeHTTP(w, r)
+	}
+}
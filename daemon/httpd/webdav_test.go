@@ -0,0 +1,94 @@
+package httpd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebDAV_Initialise(t *testing.T) {
+	dirs := map[string]string{"/files": "/tmp"}
+	require.NoError(t, (&WebDAV{}).Initialise(dirs, lalog.DefaultLogger))
+	require.Error(t, (&WebDAV{Locations: map[string]WebDAVLocation{"/files/": {}}}).Initialise(dirs, lalog.DefaultLogger))
+	require.Error(t, (&WebDAV{Locations: map[string]WebDAVLocation{"/files/": {}}, Users: map[string]string{"user": ""}}).Initialise(dirs, lalog.DefaultLogger))
+	require.Error(t, (&WebDAV{Locations: map[string]WebDAVLocation{"/other/": {}}, Users: map[string]string{"user": "pass"}}).Initialise(dirs, lalog.DefaultLogger))
+	dav := WebDAV{Locations: map[string]WebDAVLocation{"files": {ReadOnly: true}}, Users: map[string]string{"user": "pass"}}
+	require.NoError(t, dav.Initialise(dirs, lalog.DefaultLogger))
+	require.Equal(t, map[string]WebDAVLocation{"/files/": {ReadOnly: true}}, dav.Locations)
+	require.Equal(t, DefaultWebDAVMaxUploadMB, dav.MaxUploadMB)
+}
+
+func TestWebDAV_Handle(t *testing.T) {
+	rwDir := t.TempDir()
+	roDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(roDir, "a.txt"), []byte("file a"), 0644))
+	daemon := Daemon{
+		Processor:        toolbox.GetTestCommandProcessor(),
+		ServeDirectories: map[string]string{"/rw": rwDir, "/ro/": roDir, "/plain": roDir},
+		WebDAV: WebDAV{
+			Locations: map[string]WebDAVLocation{"/rw": {}, "/ro/": {ReadOnly: true}},
+			Users:     map[string]string{"user": "pass"},
+		},
+	}
+	require.NoError(t, daemon.Initialise("", ""))
+
+	serve := func(method, path, body string, auth bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if auth {
+			req.SetBasicAuth("user", "pass")
+		}
+		if method == "PROPFIND" {
+			req.Header.Set("Depth", "1")
+		}
+		rec := httptest.NewRecorder()
+		daemon.rootHandler.ServeHTTP(rec, req)
+		return rec
+	}
+	// WebDAV requests must be authenticated
+	rec := serve("PROPFIND", "/rw/", "", false)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Contains(t, rec.Header().Get("WWW-Authenticate"), "Basic")
+	req := httptest.NewRequest("PROPFIND", "/rw/", nil)
+	req.SetBasicAuth("user", "wrong")
+	rec = httptest.NewRecorder()
+	daemon.rootHandler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Equal(t, http.StatusUnauthorized, serve(http.MethodPut, "/rw/b.txt", "file b", false).Code)
+
+	// Upload, browse, and delete files
+	require.Equal(t, http.StatusCreated, serve("MKCOL", "/rw/sub", "", true).Code)
+	require.Equal(t, http.StatusCreated, serve(http.MethodPut, "/rw/sub/b.txt", strings.Repeat("b", 2*MaxRequestBodyBytes), true).Code)
+	content, err := os.ReadFile(filepath.Join(rwDir, "sub", "b.txt"))
+	require.NoError(t, err)
+	require.Len(t, content, 2*MaxRequestBodyBytes)
+	rec = serve("PROPFIND", "/rw/sub/", "", true)
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	require.Contains(t, rec.Body.String(), "<D:href>/rw/sub/b.txt</D:href>")
+	require.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "/rw/sub/b.txt", "", true).Code)
+	_, err = os.Stat(filepath.Join(rwDir, "sub", "b.txt"))
+	require.True(t, os.IsNotExist(err))
+
+	// Read-only locations may be browsed but not modified
+	rec = serve("PROPFIND", "/ro/", "", true)
+	require.Equal(t, http.StatusMultiStatus, rec.Code)
+	require.Contains(t, rec.Body.String(), "<D:href>/ro/a.txt</D:href>")
+	require.Equal(t, http.StatusForbidden, serve(http.MethodPut, "/ro/b.txt", "file b", true).Code)
+	require.Equal(t, http.StatusForbidden, serve(http.MethodDelete, "/ro/a.txt", "", true).Code)
+	require.Equal(t, http.StatusForbidden, serve("MKCOL", "/ro/sub", "", true).Code)
+	_, err = os.Stat(filepath.Join(roDir, "a.txt"))
+	require.NoError(t, err)
+
+	// Downloads remain available to all visitors
+	for _, path := range []string{"/rw/", "/ro/a.txt", "/plain/a.txt"} {
+		require.Equal(t, http.StatusOK, serve(http.MethodGet, path, "", false).Code, path)
+	}
+	// Directories without WebDAV access do not understand WebDAV requests
+	require.NotEqual(t, http.StatusMultiStatus, serve("PROPFIND", "/plain/", "", true).Code)
+}
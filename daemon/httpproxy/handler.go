@@ -1,11 +1,14 @@
 package httpproxy
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"net/http"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
 	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
 	"github.com/HouzuoGuo/laitos/misc"
 )
@@ -28,22 +31,67 @@ var httpTransport = &http.Transport{
 	ExpectContinueTimeout: 1 * time.Second,
 }
 
+// clientIPContextKey is the key of the context value that carries the client IP of a proxy request to the dialer.
+type clientIPContextKey struct{}
+
+/*
+dialViaDNSDaemon connects to the address (host:port) after resolving the host name using the DNS daemon. The client IP
+of the proxy request is carried by the context.
+*/
+func (daemon *Daemon) dialViaDNSDaemon(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	clientIP, _ := ctx.Value(clientIPContextKey{}).(string)
+	ips, err := daemon.DNSDaemon.LookupProxyDestination("httpproxy", clientIP, host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: IOTimeout}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
 // ProxyHandler is an HTTP handler function that implements an HTTP proxy capable of handling HTTPS as well.
-func (daemon Daemon) ProxyHandler(w http.ResponseWriter, r *http.Request) {
+func (daemon *Daemon) ProxyHandler(w http.ResponseWriter, r *http.Request) {
+	// Serve the proxy auto-config file to clients that ask for it directly
+	if isPACRequest(r) {
+		daemon.PACHandler(w, r)
+		return
+	}
+	if isSelfTestRequest(r) {
+		daemon.SelfTestHandler(w, r)
+		return
+	}
 	// Pass the intended destination through DNS daemon's blacklist filter
 	if daemon.DNSDaemon != nil && daemon.DNSDaemon.IsInBlacklist(r.Host) {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 	clientIP := middleware.GetRealClientIP(r)
+	r = r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, clientIP))
 	switch r.Method {
 	case http.MethodConnect:
 		// Open a connection to the destination and then entirely hand over the connection to the client
-		dstConn, err := net.DialTimeout("tcp", r.Host, IOTimeout)
-		if err != nil {
+		dialCtx, cancel := context.WithTimeout(r.Context(), IOTimeout)
+		dialStart := time.Now()
+		upstreamConn, err := daemon.dialUpstream(dialCtx, "tcp", r.Host)
+		cancel()
+		recordConnectDial(daemon.upstream, dialStart, err)
+		if errors.Is(err, dnsd.ErrBlacklistedName) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusBadGateway)
 			return
 		}
+		dstConn := &countingConn{Conn: upstreamConn}
 		// OK to CONNECT
 		w.WriteHeader(http.StatusOK)
 		// Data stream follows
@@ -69,13 +117,26 @@ func (daemon Daemon) ProxyHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		misc.TweakTCPConnection(innerMostReqConn.(*net.TCPConn), IOTimeout)
-		misc.TweakTCPConnection(dstConn.(*net.TCPConn), IOTimeout)
-		go misc.PipeConn(daemon.logger, true, IOTimeout, 1280, dstConn, reqConn)
+		// The connection of DNS tunnel is not a TCP connection
+		if tcpConn, ok := upstreamConn.(*net.TCPConn); ok {
+			misc.TweakTCPConnection(tcpConn, IOTimeout)
+		}
+		tunnelStart := time.Now()
+		pipeDone := make(chan struct{})
+		go func() {
+			misc.PipeConn(daemon.logger, true, IOTimeout, 1280, dstConn, reqConn)
+			close(pipeDone)
+		}()
 		misc.PipeConn(daemon.logger, true, IOTimeout, 1280, reqConn, dstConn)
+		<-pipeDone
+		recordConnectTunnel(daemon.upstream, time.Since(tunnelStart), dstConn)
 	default:
 		// Execute the request as-is without handling higher-level mechanisms such as cookies and redirects
-		resp, err := httpTransport.RoundTrip(r)
-		if err != nil {
+		resp, err := daemon.httpTransport.RoundTrip(r)
+		if errors.Is(err, dnsd.ErrBlacklistedName) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		} else if err != nil {
 			http.Error(w, err.Error(), http.StatusBadGateway)
 			return
 		}
@@ -49,14 +49,44 @@ type Daemon struct {
 	// This mechanism exists in the DNS daemon in a similar form.
 	CommandProcessor *toolbox.CommandProcessor `json:"-"`
 
+	// PACProxiedDomains are the domain names (including their sub-domains) that
+	// the auto-generated proxy auto-config file (/proxy.pac) routes through
+	// this proxy, everything else goes direct. If left empty, the PAC file
+	// routes all requests through this proxy.
+	PACProxiedDomains []string `json:"PACProxiedDomains"`
+	// PACProxyAddress is the address (host:port) of this proxy as seen by
+	// clients, used in the auto-generated proxy auto-config file. If left
+	// empty, the address is derived from the host name of the PAC request.
+	PACProxyAddress string `json:"PACProxyAddress"`
+
 	// DNSDaemon is an initialised DNS daemon that will provide protection against advertising, malware, and tracking to this web proxy.
 	DNSDaemon *dnsd.Daemon `json:"-"`
+	// DNSTunnel optionally reaches the destinations of proxy requests through the TCP-over-DNS tunnel of a laitos DNS
+	// server, instead of dialing the destinations directly. Its listener address and port are not used.
+	DNSTunnel *dnsd.HTTPProxyServer `json:"DNSTunnel"`
+	/*
+		ResolveViaDNSDaemon resolves the destination names using the DNS daemon (its black list, custom records, and
+		forwarders) instead of the resolver of operating system. This prevents the destination names from leaking to the
+		system resolver, and stops black listed destinations from being reached via their aliases. The names resolved
+		for each connection are recorded in common.ProxyNameResolutions.
+	*/
+	ResolveViaDNSDaemon bool `json:"ResolveViaDNSDaemon"`
+	// SelfTestURL is the URL fetched by the self test (/selftest) through the upstream of the proxy.
+	SelfTestURL string `json:"SelfTestURL"`
 
-	allowFromIPNets []*net.IPNet
-	proxyHandler    http.HandlerFunc
-	rateLimit       *lalog.RateLimit
-	logger          *lalog.Logger
-	httpServer      *http.Server
+	// upstream is the metrics label of the path taken to reach destinations, either direct or via the DNS tunnel.
+	upstream string
+	// dialUpstream establishes a connection to the destination of a proxy request.
+	dialUpstream func(ctx context.Context, network, addr string) (net.Conn, error)
+	// httpTransport is the HTTP round tripper used for HTTP (unencrypted) proxy requests.
+	httpTransport *http.Transport
+	// selfTestTLSConfig is the TLS configuration of self test requests. This is for internal testing only.
+	selfTestTLSConfig *tls.Config
+	allowFromIPNets   []*net.IPNet
+	proxyHandler      http.HandlerFunc
+	rateLimit         *lalog.RateLimit
+	logger            *lalog.Logger
+	httpServer        *http.Server
 }
 
 // Initialise validates configuration parameters and initialises the internal state of the daemon.
@@ -74,7 +104,35 @@ func (daemon *Daemon) Initialise() error {
 		daemon.CommandProcessor = toolbox.GetEmptyCommandProcessor()
 	}
 	daemon.logger = &lalog.Logger{ComponentName: "httpproxy", ComponentID: []lalog.LoggerIDField{{Key: "Port", Value: strconv.Itoa(daemon.Port)}}}
-	daemon.rateLimit = lalog.NewRateLimit(1, daemon.PerIPLimit, daemon.logger)
+	if daemon.SelfTestURL == "" {
+		daemon.SelfTestURL = DefaultSelfTestURL
+	}
+	if daemon.ResolveViaDNSDaemon {
+		if daemon.DNSDaemon == nil {
+			return errors.New("httpproxy.Initialise: DNS daemon must be assigned to resolve destination names")
+		} else if daemon.DNSTunnel != nil {
+			return errors.New("httpproxy.Initialise: destination names cannot be resolved by DNS daemon while using DNS tunnel")
+		}
+	}
+	if daemon.DNSTunnel != nil {
+		if err := daemon.DNSTunnel.Initialise(context.Background()); err != nil {
+			return fmt.Errorf("httpproxy.Initialise: failed to initialise DNS tunnel - %w", err)
+		}
+		daemon.upstream = UpstreamDNSTunnel
+		daemon.dialUpstream = daemon.DNSTunnel.DialContext
+		daemon.httpTransport = httpTransport.Clone()
+		daemon.httpTransport.DialContext = daemon.DNSTunnel.DialContext
+	} else if daemon.ResolveViaDNSDaemon {
+		daemon.upstream = UpstreamDirect
+		daemon.dialUpstream = daemon.dialViaDNSDaemon
+		daemon.httpTransport = httpTransport.Clone()
+		daemon.httpTransport.DialContext = daemon.dialViaDNSDaemon
+	} else {
+		daemon.upstream = UpstreamDirect
+		daemon.dialUpstream = (&net.Dialer{Timeout: IOTimeout}).DialContext
+		daemon.httpTransport = httpTransport
+	}
+	daemon.rateLimit = lalog.NewSharedRateLimit("httpproxy", 1, daemon.PerIPLimit, daemon.logger)
 	// Parse allowed CIDRs into IP nets
 	daemon.allowFromIPNets = make([]*net.IPNet, 0)
 	for _, cidrStr := range daemon.AllowFromCidrs {
@@ -84,9 +142,10 @@ func (daemon *Daemon) Initialise() error {
 		}
 		daemon.allowFromIPNets = append(daemon.allowFromIPNets, cidrNet)
 	}
+	registerPrometheusMetrics(daemon.logger)
 	// Collect proxy request and response stats in prometheus histograms
 	var handlerDurationHistogram, responseTimeToFirstByteHistogram, responseSizeHistogram *prometheus.HistogramVec
-	if misc.EnablePrometheusIntegration {
+	if misc.PrometheusIntegration.IsEnabled() {
 		metricsLabelNames := []string{middleware.PrometheusHandlerTypeLabel, middleware.PrometheusHandlerLocationLabel}
 		handlerDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "laitos_httpproxy_handler_duration_seconds",
@@ -1,14 +1,28 @@
 package httpproxy
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDaemon(t *testing.T) {
-	misc.EnableAWSIntegration = true
-	misc.EnablePrometheusIntegration = true
+	misc.AWSIntegration.Set(true)
+	misc.PrometheusIntegration.Set(true)
 	daemon := &Daemon{}
 	// Initialise with default configuration values
 	if err := daemon.Initialise(); err != nil {
@@ -30,3 +44,109 @@ func TestDaemon(t *testing.T) {
 	// Execute the remainder of daemon tests
 	TestHTTPProxyDaemon(daemon, t)
 }
+
+// getMetricValue returns the value of a counter or the sample count of a histogram that has the label value.
+func getMetricValue(t *testing.T, reg *prometheus.Registry, name, labelValue string) (ret float64) {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var labelValues []string
+			for _, label := range metric.GetLabel() {
+				labelValues = append(labelValues, label.GetValue())
+			}
+			if strings.Join(labelValues, " ") == labelValue {
+				ret += metric.GetCounter().GetValue() + float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return
+}
+
+func TestDaemon_ConnectMetricsAndSelfTest(t *testing.T) {
+	misc.PrometheusIntegration.Set(true)
+	defer func() {
+		misc.PrometheusIntegration.Set(false)
+	}()
+	dest := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello from destination"))
+	}))
+	defer dest.Close()
+
+	daemon := &Daemon{
+		Address:        "127.0.0.1",
+		Port:           TestPort + 1,
+		AllowFromCidrs: []string{"127.0.0.0/8"},
+		SelfTestURL:    dest.URL,
+	}
+	require.NoError(t, daemon.Initialise())
+	require.Equal(t, UpstreamDirect, daemon.upstream)
+	daemon.selfTestTLSConfig = dest.Client().Transport.(*http.Transport).TLSClientConfig
+	// Pretend that the destinations are reached through the DNS tunnel
+	var numDials atomic.Int32
+	daemon.upstream = UpstreamDNSTunnel
+	daemon.dialUpstream = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		numDials.Add(1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(connectDialDurationHistogram, connectDialErrorsCounter, connectDurationHistogram, connectBytesCounter, connectThroughputHistogram)
+	go func() {
+		_ = daemon.StartAndBlock()
+	}()
+	defer daemon.Stop()
+	require.True(t, misc.ProbePort(30*time.Second, daemon.Address, daemon.Port))
+
+	// Run the self test directly and via its URL
+	result, err := daemon.SelfTest(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, UpstreamDNSTunnel, result.Upstream)
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	require.EqualValues(t, len("hello from destination"), result.ResponseBytes)
+	require.Positive(t, result.TLSHandshakeDuration)
+	require.GreaterOrEqual(t, result.TotalDuration, result.DialDuration+result.TimeToFirstByte)
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", daemon.Port, SelfTestPath))
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "Upstream: dnstunnel")
+	require.Contains(t, string(body), "Time to first byte: ")
+	require.EqualValues(t, 2, numDials.Load())
+
+	// Make an HTTPS request via CONNECT
+	dialsBefore := getMetricValue(t, reg, "laitos_httpproxy_connect_dial_duration_seconds", UpstreamDNSTunnel)
+	proxyURL, err := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", daemon.Port))
+	require.NoError(t, err)
+	proxyClient := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	resp, err = proxyClient.Get(dest.URL)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hello from destination", string(body))
+	proxyClient.CloseIdleConnections()
+	require.EqualValues(t, 3, numDials.Load())
+	require.Equal(t, dialsBefore+1, getMetricValue(t, reg, "laitos_httpproxy_connect_dial_duration_seconds", UpstreamDNSTunnel))
+	// The tunnel stats are recorded after the tunnel is closed
+	require.Eventually(t, func() bool {
+		return getMetricValue(t, reg, "laitos_httpproxy_connect_duration_seconds", UpstreamDNSTunnel) > 0
+	}, 10*time.Second, 100*time.Millisecond)
+	require.Positive(t, getMetricValue(t, reg, "laitos_httpproxy_connect_bytes_total", "down "+UpstreamDNSTunnel))
+	require.Positive(t, getMetricValue(t, reg, "laitos_httpproxy_connect_bytes_total", "up "+UpstreamDNSTunnel))
+
+	// Destinations that cannot be reached count as dial errors
+	daemon.dialUpstream = func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("tunnel is down")
+	}
+	_, err = proxyClient.Get(dest.URL)
+	require.Error(t, err)
+	require.Positive(t, getMetricValue(t, reg, "laitos_httpproxy_connect_dial_errors_total", UpstreamDNSTunnel))
+	_, err = daemon.SelfTest(context.Background())
+	require.ErrorContains(t, err, "tunnel is down")
+}
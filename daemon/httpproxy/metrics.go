@@ -0,0 +1,109 @@
+package httpproxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// UpstreamDirect is the metrics label of CONNECT requests dialed directly to their destination.
+	UpstreamDirect = "direct"
+	// UpstreamDNSTunnel is the metrics label of CONNECT requests dialed through the TCP-over-DNS tunnel.
+	UpstreamDNSTunnel = "dnstunnel"
+)
+
+var (
+	connectDialDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "laitos_httpproxy_connect_dial_duration_seconds",
+		Help:    "The duration of establishing the upstream connection of HTTP CONNECT requests in seconds",
+		Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2, 3, 5, 8, 12, 20, 30},
+	}, []string{"upstream"})
+	connectDialErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "laitos_httpproxy_connect_dial_errors_total",
+		Help: "The number of HTTP CONNECT requests that failed to establish the upstream connection",
+	}, []string{"upstream"})
+	connectDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "laitos_httpproxy_connect_duration_seconds",
+		Help:    "The lifetime of HTTP CONNECT tunnels in seconds",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"upstream"})
+	connectBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "laitos_httpproxy_connect_bytes_total",
+		Help: "The number of bytes sent to (\"up\") and received from (\"down\") the destinations of HTTP CONNECT tunnels",
+	}, []string{"upstream", "direction"})
+	connectThroughputHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "laitos_httpproxy_connect_download_throughput_bytes_per_second",
+		Help:    "The average rate of bytes received from the destinations of HTTP CONNECT tunnels",
+		Buckets: []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216},
+	}, []string{"upstream"})
+	registerMetricsOnce = new(sync.Once)
+)
+
+// registerPrometheusMetrics registers the metrics collectors of HTTP CONNECT tunnels with prometheus once.
+func registerPrometheusMetrics(logger *lalog.Logger) {
+	if !misc.PrometheusIntegration.IsEnabled() {
+		return
+	}
+	registerMetricsOnce.Do(func() {
+		for _, collector := range []prometheus.Collector{
+			connectDialDurationHistogram, connectDialErrorsCounter, connectDurationHistogram, connectBytesCounter, connectThroughputHistogram,
+		} {
+			if err := prometheus.Register(collector); err != nil {
+				logger.Warning("", err, "failed to register prometheus metrics collectors")
+			}
+		}
+	})
+}
+
+// recordConnectDial records the duration of establishing an upstream connection, successful or not.
+func recordConnectDial(upstream string, start time.Time, err error) {
+	if !misc.PrometheusIntegration.IsEnabled() {
+		return
+	}
+	if err != nil {
+		connectDialErrorsCounter.WithLabelValues(upstream).Inc()
+		return
+	}
+	connectDialDurationHistogram.WithLabelValues(upstream).Observe(time.Since(start).Seconds())
+}
+
+// recordConnectTunnel records the lifetime, data transfer, and download throughput of a closed CONNECT tunnel.
+func recordConnectTunnel(upstream string, duration time.Duration, conn *countingConn) {
+	if !misc.PrometheusIntegration.IsEnabled() {
+		return
+	}
+	up, down := conn.bytesWritten.Load(), conn.bytesRead.Load()
+	connectDurationHistogram.WithLabelValues(upstream).Observe(duration.Seconds())
+	connectBytesCounter.WithLabelValues(upstream, "up").Add(float64(up))
+	connectBytesCounter.WithLabelValues(upstream, "down").Add(float64(down))
+	if duration > 0 && down > 0 {
+		connectThroughputHistogram.WithLabelValues(upstream).Observe(float64(down) / duration.Seconds())
+	}
+}
+
+// countingConn counts the bytes read from and written to the underlying connection.
+type countingConn struct {
+	net.Conn
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+}
+
+// Read reads from the underlying connection and counts the bytes.
+func (conn *countingConn) Read(b []byte) (int, error) {
+	n, err := conn.Conn.Read(b)
+	conn.bytesRead.Add(int64(n))
+	return n, err
+}
+
+// Write writes to the underlying connection and counts the bytes.
+func (conn *countingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.bytesWritten.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,64 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PACPath is the URL path at which the daemon serves the auto-generated
+	// proxy auto-config (PAC) file to clients that request it directly (i.e.
+	// not as a proxy request).
+	PACPath = "/proxy.pac"
+	// PACContentType is the MIME type of a proxy auto-config file.
+	PACContentType = "application/x-ns-proxy-autoconfig"
+)
+
+// GeneratePAC returns the content of a proxy auto-config (PAC) file that
+// routes the domain names (and their sub-domains) through the proxy address,
+// and everything else goes direct. If there are no domain names, then all
+// requests will go through the proxy.
+func GeneratePAC(proxyAddr string, domainNames []string) string {
+	var pac strings.Builder
+	pac.WriteString("function FindProxyForURL(url, host) {\n")
+	if len(domainNames) == 0 {
+		pac.WriteString(fmt.Sprintf("  return %q;\n}\n", "PROXY "+proxyAddr))
+		return pac.String()
+	}
+	for _, name := range domainNames {
+		name = strings.Trim(strings.ToLower(strings.TrimSpace(name)), ".")
+		if name == "" {
+			continue
+		}
+		pac.WriteString(fmt.Sprintf("  if (host == %q || dnsDomainIs(host, %q)) {\n", name, "."+name))
+		pac.WriteString(fmt.Sprintf("    return %q;\n  }\n", "PROXY "+proxyAddr))
+	}
+	pac.WriteString("  return \"DIRECT\";\n}\n")
+	return pac.String()
+}
+
+// isPACRequest returns true if the request asks for the PAC file rather than
+// being a proxy request.
+func isPACRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && !r.URL.IsAbs() && r.URL.Path == PACPath
+}
+
+// PACHandler responds to the client with an auto-generated proxy auto-config
+// file.
+func (daemon *Daemon) PACHandler(w http.ResponseWriter, r *http.Request) {
+	proxyAddr := daemon.PACProxyAddress
+	if proxyAddr == "" {
+		// Assume that the client reaches the proxy using the same host name.
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		proxyAddr = net.JoinHostPort(host, strconv.Itoa(daemon.Port))
+	}
+	w.Header().Set("Content-Type", PACContentType)
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	_, _ = w.Write([]byte(GeneratePAC(proxyAddr, daemon.PACProxiedDomains)))
+}
@@ -0,0 +1,53 @@
+package httpproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGeneratePAC(t *testing.T) {
+	want := `function FindProxyForURL(url, host) {
+  return "PROXY 1.2.3.4:210";
+}
+`
+	if got := GeneratePAC("1.2.3.4:210", nil); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	want = `function FindProxyForURL(url, host) {
+  if (host == "example.com" || dnsDomainIs(host, ".example.com")) {
+    return "PROXY 1.2.3.4:210";
+  }
+  if (host == "b.example.net" || dnsDomainIs(host, ".b.example.net")) {
+    return "PROXY 1.2.3.4:210";
+  }
+  return "DIRECT";
+}
+`
+	if got := GeneratePAC("1.2.3.4:210", []string{"Example.com", " .b.example.net. ", ""}); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPACHandler(t *testing.T) {
+	daemon := &Daemon{Port: TestPort, PACProxiedDomains: []string{"example.com"}}
+	req := httptest.NewRequest(http.MethodGet, "http://laitos.example:54112/proxy.pac", nil)
+	// A direct request carries a relative URL.
+	req.URL.Scheme = ""
+	req.URL.Host = ""
+	if !isPACRequest(req) {
+		t.Fatal("should have been a PAC request")
+	}
+	w := httptest.NewRecorder()
+	daemon.PACHandler(w, req)
+	if ct := w.Result().Header.Get("Content-Type"); ct != PACContentType {
+		t.Fatal(ct)
+	}
+	if got := w.Body.String(); got != GeneratePAC("laitos.example:54112", daemon.PACProxiedDomains) {
+		t.Fatal(got)
+	}
+	// A proxy request for the same path on another host is not a PAC request.
+	if isPACRequest(httptest.NewRequest(http.MethodGet, "http://example.com/proxy.pac", nil)) {
+		t.Fatal("should not have been a PAC request")
+	}
+}
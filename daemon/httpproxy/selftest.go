@@ -0,0 +1,147 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd/middleware"
+)
+
+const (
+	// SelfTestPath is the URL path of the self test, which fetches SelfTestURL through the upstream of the proxy.
+	SelfTestPath = "/selftest"
+	// DefaultSelfTestURL is the URL fetched by the self test in the absence of SelfTestURL specified by user.
+	DefaultSelfTestURL = "https://captive.apple.com/"
+	// SelfTestTimeout is the maximum duration of a self test. The TCP-over-DNS tunnel is slow to establish connections.
+	SelfTestTimeout = 2 * time.Minute
+)
+
+// SelfTestResult is the timing of each stage of a self test, which helps to tell whether the slowness comes from the
+// upstream (e.g. the TCP-over-DNS tunnel) or from the destination.
+type SelfTestResult struct {
+	// Upstream is the path taken to reach the destination, either "direct" or "dnstunnel".
+	Upstream string
+	// URL is the URL fetched by the self test.
+	URL string
+	// DialDuration is the time it took to establish the connection to the destination through the upstream.
+	DialDuration time.Duration
+	// TLSHandshakeDuration is the time it took to complete TLS handshake with the destination, zero for plain HTTP.
+	TLSHandshakeDuration time.Duration
+	// TimeToFirstByte is the time between having established the connection and receiving the first response byte.
+	TimeToFirstByte time.Duration
+	// TotalDuration is the time it took to complete the self test, including the response body.
+	TotalDuration time.Duration
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// ResponseBytes is the size of response body.
+	ResponseBytes int64
+}
+
+// String returns a human readable description of the self test result.
+func (result SelfTestResult) String() string {
+	return fmt.Sprintf("URL: %s\nUpstream: %s\nDial: %v\nTLS handshake: %v\nTime to first byte: %v\nTotal: %v\nStatus: %d\nResponse size: %d bytes\n",
+		result.URL, result.Upstream, result.DialDuration, result.TLSHandshakeDuration, result.TimeToFirstByte, result.TotalDuration, result.StatusCode, result.ResponseBytes)
+}
+
+// SelfTest fetches SelfTestURL through the upstream of the proxy - the same path taken by proxy requests - and
+// measures the timing of each stage.
+func (daemon *Daemon) SelfTest(ctx context.Context) (result SelfTestResult, err error) {
+	result.Upstream = daemon.upstream
+	result.URL = daemon.SelfTestURL
+	testURL, err := url.Parse(daemon.SelfTestURL)
+	if err != nil {
+		return result, fmt.Errorf("httpproxy.SelfTest: failed to parse self test URL - %w", err)
+	}
+	addr := testURL.Host
+	if testURL.Port() == "" {
+		port := "80"
+		if testURL.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(testURL.Hostname(), port)
+	}
+	ctx, cancel := context.WithTimeout(ctx, SelfTestTimeout)
+	defer cancel()
+	start := time.Now()
+	conn, err := daemon.dialUpstream(ctx, "tcp", addr)
+	if err != nil {
+		return result, fmt.Errorf("httpproxy.SelfTest: failed to dial %s via %s upstream - %w", addr, daemon.upstream, err)
+	}
+	result.DialDuration = time.Since(start)
+	defer func() {
+		// Close the connection in case the transport did not get to use it
+		if conn != nil {
+			_ = conn.Close()
+		}
+	}()
+	// The transport makes its request over the connection that has just been dialed, the timing of the remaining
+	// stages is therefore about the destination rather than the upstream.
+	transport := &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			if conn == nil {
+				return nil, errors.New("the self test connection has already been used")
+			}
+			ret := conn
+			conn = nil
+			return ret, nil
+		},
+		DisableKeepAlives: true,
+		TLSClientConfig:   daemon.selfTestTLSConfig,
+	}
+	defer transport.CloseIdleConnections()
+	var tlsStart, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			result.TLSHandshakeDuration = time.Since(tlsStart)
+		},
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, daemon.SelfTestURL, nil)
+	if err != nil {
+		return result, fmt.Errorf("httpproxy.SelfTest: failed to construct request - %w", err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return result, fmt.Errorf("httpproxy.SelfTest: failed to fetch %s - %w", daemon.SelfTestURL, err)
+	}
+	defer resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+	result.ResponseBytes, err = io.Copy(io.Discard, resp.Body)
+	result.TotalDuration = time.Since(start)
+	if !firstByte.IsZero() {
+		result.TimeToFirstByte = firstByte.Sub(start) - result.DialDuration
+	}
+	if err != nil {
+		return result, fmt.Errorf("httpproxy.SelfTest: failed to read response body - %w", err)
+	}
+	return result, nil
+}
+
+// isSelfTestRequest returns true if the request asks for a self test rather than being a proxy request.
+func isSelfTestRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && !r.URL.IsAbs() && r.URL.Path == SelfTestPath
+}
+
+// SelfTestHandler runs a self test and responds to the client with its result in plain text.
+func (daemon *Daemon) SelfTestHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := daemon.SelfTest(r.Context())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	if err != nil {
+		daemon.logger.Warning(middleware.GetRealClientIP(r), err, "self test failed")
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(result.String() + "Error: " + err.Error() + "\n"))
+		return
+	}
+	daemon.logger.Info(middleware.GetRealClientIP(r), nil, "self test completed - dial %v, time to first byte %v, total %v", result.DialDuration, result.TimeToFirstByte, result.TotalDuration)
+	_, _ = w.Write([]byte(result.String()))
+}
@@ -0,0 +1,162 @@
+package maintenance
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+const (
+	// DefaultConfigSnapshotIntervalSec is the default interval of taking configuration snapshots.
+	DefaultConfigSnapshotIntervalSec = 24 * 3600
+	// DefaultConfigSnapshotGenerations is the default number of configuration snapshots to keep.
+	DefaultConfigSnapshotGenerations = 7
+	// ConfigSnapshotFilePrefix is the file name prefix of configuration snapshots.
+	ConfigSnapshotFilePrefix = "laitos-config-snapshot-"
+	// ConfigSnapshotMaxDiffCells caps the amount of work (lines of old snapshot times lines of new snapshot) spent
+	// on comparing two snapshots line by line.
+	ConfigSnapshotMaxDiffCells = 4 * 1024 * 1024
+)
+
+// DiffLines compares the old and new text line by line, and returns the removed lines prefixed by "- " and the added
+// lines prefixed by "+ ", in the order of their appearance. It returns an empty string if the texts are identical.
+func DiffLines(oldText, newText string) string {
+	if oldText == newText {
+		return ""
+	}
+	a, b := strings.Split(oldText, "\n"), strings.Split(newText, "\n")
+	// Skip the common prefix and suffix to reduce the amount of work
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	var out bytes.Buffer
+	if len(a)*len(b) > ConfigSnapshotMaxDiffCells {
+		for _, line := range a {
+			out.WriteString("- " + line + "\n")
+		}
+		for _, line := range b {
+			out.WriteString("+ " + line + "\n")
+		}
+		return out.String()
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			out.WriteString("- " + a[i] + "\n")
+			i++
+		default:
+			out.WriteString("+ " + b[j] + "\n")
+			j++
+		}
+	}
+	return out.String()
+}
+
+// listConfigSnapshots returns the file paths of configuration snapshots, from the oldest to the latest.
+func (daemon *Daemon) listConfigSnapshots() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(daemon.ConfigSnapshotDir, ConfigSnapshotFilePrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	// The file names carry a fixed-width timestamp, hence they sort chronologically.
+	sort.Strings(paths)
+	return paths, nil
+}
+
+/*
+SnapshotConfig takes a snapshot of the configuration and runtime settings, and compares it against the latest snapshot
+kept in the snapshot directory. A new generation is kept only if the snapshot differs from the latest one, and the
+oldest generations are deleted to keep at most ConfigSnapshotGenerations of them. It returns the line by line
+difference between the latest and new snapshots, or an empty string if there is no change or no snapshot was kept
+previously.
+*/
+func (daemon *Daemon) SnapshotConfig(now time.Time) (string, error) {
+	if daemon.TakeConfigSnapshot == nil {
+		return "", fmt.Errorf("maintenance.SnapshotConfig: configuration snapshot is not available")
+	}
+	snapshot, err := daemon.TakeConfigSnapshot()
+	if err != nil {
+		return "", fmt.Errorf("maintenance.SnapshotConfig: failed to take snapshot - %w", err)
+	}
+	if err := os.MkdirAll(daemon.ConfigSnapshotDir, 0700); err != nil {
+		return "", fmt.Errorf("maintenance.SnapshotConfig: failed to create snapshot directory - %w", err)
+	}
+	paths, err := daemon.listConfigSnapshots()
+	if err != nil {
+		return "", fmt.Errorf("maintenance.SnapshotConfig: failed to list snapshots - %w", err)
+	}
+	var diff string
+	if len(paths) > 0 {
+		latest, err := os.ReadFile(paths[len(paths)-1])
+		if err != nil {
+			return "", fmt.Errorf("maintenance.SnapshotConfig: failed to read the latest snapshot - %w", err)
+		}
+		if bytes.Equal(latest, snapshot) {
+			return "", nil
+		}
+		diff = DiffLines(string(latest), string(snapshot))
+	}
+	newPath := filepath.Join(daemon.ConfigSnapshotDir, fmt.Sprintf("%s%020d.txt", ConfigSnapshotFilePrefix, now.UnixNano()))
+	if err := os.WriteFile(newPath, snapshot, 0600); err != nil {
+		return "", fmt.Errorf("maintenance.SnapshotConfig: failed to write snapshot - %w", err)
+	}
+	paths = append(paths, newPath)
+	for len(paths) > daemon.ConfigSnapshotGenerations {
+		if err := os.Remove(paths[0]); err != nil {
+			daemon.logger.Warning(paths[0], err, "failed to delete an old configuration snapshot")
+		}
+		paths = paths[1:]
+	}
+	return diff, nil
+}
+
+// runConfigSnapshot takes a configuration snapshot and sends an alert mail to recipients if the configuration changed.
+func (daemon *Daemon) runConfigSnapshot(_ context.Context) {
+	diff, err := daemon.SnapshotConfig(time.Now())
+	if err != nil {
+		daemon.logger.Warning(daemon.ConfigSnapshotDir, err, "failed to take configuration snapshot")
+		return
+	}
+	if diff == "" {
+		return
+	}
+	daemon.logger.Warning(daemon.ConfigSnapshotDir, nil, "configuration or runtime settings have changed since the previous snapshot")
+	if len(daemon.Recipients) == 0 {
+		return
+	}
+	body := fmt.Sprintf("Configuration or runtime settings have changed since the previous snapshot, secrets are masked:\n%s", diff)
+	if err := daemon.MailClient.Send(inet.OutgoingMailSubjectKeyword+"-config-change", body, daemon.Recipients...); err != nil {
+		daemon.logger.Warning("", err, "failed to send configuration change mail")
+	}
+}
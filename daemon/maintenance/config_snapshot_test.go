@@ -0,0 +1,66 @@
+package maintenance
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffLines(t *testing.T) {
+	require.Equal(t, "", DiffLines("a\nb\nc", "a\nb\nc"))
+	require.Equal(t, "- b\n+ B\n", DiffLines("a\nb\nc", "a\nB\nc"))
+	require.Equal(t, "+ d\n", DiffLines("a\nb\nc", "a\nb\nc\nd"))
+	require.Equal(t, "- a\n", DiffLines("a\nb\nc", "b\nc"))
+	require.Equal(t, "- b\n+ x\n+ y\n", DiffLines("a\nb\nc\nd", "a\nx\nc\ny\nd"))
+}
+
+func TestSnapshotConfig(t *testing.T) {
+	snapshot := "Port: 80\nPassword: ********\n"
+	daemon := Daemon{ConfigSnapshotDir: filepath.Join(t.TempDir(), "snapshots"), ConfigSnapshotGenerations: 2}
+	_, err := daemon.SnapshotConfig(time.Now())
+	require.Error(t, err)
+	require.NoError(t, daemon.Initialise())
+	require.Equal(t, DefaultConfigSnapshotIntervalSec, daemon.ConfigSnapshotIntervalSec)
+	daemon.TakeConfigSnapshot = func() ([]byte, error) {
+		return []byte(snapshot), nil
+	}
+
+	// The first snapshot is kept without a diff
+	now := time.Now()
+	diff, err := daemon.SnapshotConfig(now)
+	require.NoError(t, err)
+	require.Empty(t, diff)
+	// An identical snapshot is not kept
+	diff, err = daemon.SnapshotConfig(now.Add(time.Second))
+	require.NoError(t, err)
+	require.Empty(t, diff)
+	paths, err := daemon.listConfigSnapshots()
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	// A change is kept along with the previous generation
+	snapshot = "Port: 8080\nPassword: ********\n"
+	diff, err = daemon.SnapshotConfig(now.Add(2 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, "- Port: 80\n+ Port: 8080\n", diff)
+	// The oldest generation is deleted
+	snapshot = "Port: 8081\nPassword: ********\n"
+	diff, err = daemon.SnapshotConfig(now.Add(3 * time.Second))
+	require.NoError(t, err)
+	require.Equal(t, "- Port: 8080\n+ Port: 8081\n", diff)
+	paths, err = daemon.listConfigSnapshots()
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+	latest, err := os.ReadFile(paths[1])
+	require.NoError(t, err)
+	require.Equal(t, snapshot, string(latest))
+
+	daemon.TakeConfigSnapshot = func() ([]byte, error) {
+		return nil, errors.New("failure")
+	}
+	_, err = daemon.SnapshotConfig(now.Add(4 * time.Second))
+	require.Error(t, err)
+}
@@ -0,0 +1,215 @@
+package maintenance
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/platform"
+)
+
+const (
+	// DefaultDiskCheckIntervalSec is the default interval of disk health checks that run between maintenance routines.
+	DefaultDiskCheckIntervalSec = 3600
+	// SMARTCommandTimeoutSec is the timeout of each smartctl invocation.
+	SMARTCommandTimeoutSec = 60
+	// SMARTMaxPercentageUsed is the NVMe wear level (percentage of rated endurance used) at which a disk is considered worn out.
+	SMARTMaxPercentageUsed = 90
+)
+
+var (
+	// regexSMARTScanDevice captures the device name and type from each line of "smartctl --scan" output, e.g.
+	// "/dev/sda -d scsi # /dev/sda, SCSI device".
+	regexSMARTScanDevice = regexp.MustCompile(`^(/dev/\S+)(?:\s+-d\s+(\S+))?`)
+	// regexSMARTATAAttribute captures the attribute name and raw value from each row of the ATA SMART attribute table.
+	regexSMARTATAAttribute = regexp.MustCompile(`^\s*\d+\s+(\S+)\s+0x[0-9a-fA-F]+\s+\d+\s+\d+\s+\S+\s+\S+\s+\S+\s+\S+\s+(\d+)`)
+	// regexSMARTNVMeAttribute captures the attribute name and numeric value from each line of NVMe SMART/Health information.
+	regexSMARTNVMeAttribute = regexp.MustCompile(`^([A-Za-z][A-Za-z ]+):\s+([\d,]+)%?\s*$`)
+)
+
+// SMARTHealth is the health information of a disk parsed from smartctl output.
+type SMARTHealth struct {
+	// Device is the device name, e.g. /dev/sda.
+	Device string
+	// Assessed is true only if the output contains an overall health assessment.
+	Assessed bool
+	// Passed is the overall health self-assessment result.
+	Passed bool
+	// ReallocatedSectors, PendingSectors, and UncorrectableSectors are the raw values of ATA attributes that predict
+	// disk failure.
+	ReallocatedSectors, PendingSectors, UncorrectableSectors int64
+	// PercentageUsed is the NVMe wear level.
+	PercentageUsed int64
+	// MediaErrors is the number of NVMe media and data integrity errors.
+	MediaErrors int64
+}
+
+// Problems returns human-readable descriptions of the signs of disk failure. It returns an empty array if the disk is healthy.
+func (health SMARTHealth) Problems() (ret []string) {
+	ret = make([]string, 0)
+	if health.Assessed && !health.Passed {
+		ret = append(ret, fmt.Sprintf("%s failed SMART overall health self-assessment", health.Device))
+	}
+	if health.ReallocatedSectors > 0 {
+		ret = append(ret, fmt.Sprintf("%s has %d reallocated sectors", health.Device, health.ReallocatedSectors))
+	}
+	if health.PendingSectors > 0 {
+		ret = append(ret, fmt.Sprintf("%s has %d sectors pending reallocation", health.Device, health.PendingSectors))
+	}
+	if health.UncorrectableSectors > 0 {
+		ret = append(ret, fmt.Sprintf("%s has %d uncorrectable sectors", health.Device, health.UncorrectableSectors))
+	}
+	if health.PercentageUsed >= SMARTMaxPercentageUsed {
+		ret = append(ret, fmt.Sprintf("%s has used %d%% of its rated endurance", health.Device, health.PercentageUsed))
+	}
+	if health.MediaErrors > 0 {
+		ret = append(ret, fmt.Sprintf("%s has %d media and data integrity errors", health.Device, health.MediaErrors))
+	}
+	return
+}
+
+// ParseSmartctlOutput parses the output of "smartctl -H -A" for ATA, SCSI, and NVMe disks.
+func ParseSmartctlOutput(device, out string) (health SMARTHealth) {
+	health.Device = device
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		// ATA and NVMe disks report "SMART overall-health self-assessment test result: PASSED".
+		// SCSI disks report "SMART Health Status: OK".
+		if strings.Contains(line, "overall-health self-assessment test result:") || strings.Contains(line, "SMART Health Status:") {
+			result := strings.TrimSpace(line[strings.LastIndex(line, ":")+1:])
+			health.Assessed = true
+			health.Passed = result == "PASSED" || result == "OK"
+			continue
+		}
+		if submatches := regexSMARTATAAttribute.FindStringSubmatch(line); len(submatches) == 3 {
+			value, _ := strconv.ParseInt(submatches[2], 10, 64)
+			switch submatches[1] {
+			case "Reallocated_Sector_Ct":
+				health.ReallocatedSectors = value
+			case "Current_Pending_Sector":
+				health.PendingSectors = value
+			case "Offline_Uncorrectable":
+				health.UncorrectableSectors = value
+			}
+			continue
+		}
+		if submatches := regexSMARTNVMeAttribute.FindStringSubmatch(line); len(submatches) == 3 {
+			value, _ := strconv.ParseInt(strings.ReplaceAll(submatches[2], ",", ""), 10, 64)
+			switch strings.TrimSpace(submatches[1]) {
+			case "Percentage Used":
+				health.PercentageUsed = value
+			case "Media and Data Integrity Errors":
+				health.MediaErrors = value
+			}
+		}
+	}
+	return
+}
+
+// ParseSmartctlScan returns the device name and smartctl device type arguments of each disk from "smartctl --scan" output.
+func ParseSmartctlScan(out string) (devices [][]string) {
+	devices = make([][]string, 0)
+	for _, line := range strings.Split(out, "\n") {
+		submatches := regexSMARTScanDevice.FindStringSubmatch(strings.TrimSpace(line))
+		if len(submatches) != 3 {
+			continue
+		}
+		device := []string{submatches[1]}
+		if submatches[2] != "" {
+			device = append(device, "-d", submatches[2])
+		}
+		devices = append(devices, device)
+	}
+	return
+}
+
+// CheckSMART polls SMART health of all disks via smartctl, and returns signs of disk failure.
+func (daemon *Daemon) CheckSMART() (report []string, problems []string) {
+	report, problems = make([]string, 0), make([]string, 0)
+	if !daemon.CheckSMARTHealth {
+		return
+	}
+	if platform.HostIsWindows() {
+		report = append(report, "skipped on windows: SMART health check")
+		return
+	}
+	scanOut, err := platform.InvokeProgram([]string{"PATH=" + platform.CommonPATH}, SMARTCommandTimeoutSec, "smartctl", "--scan")
+	devices := ParseSmartctlScan(scanOut)
+	if len(devices) == 0 {
+		problems = append(problems, fmt.Sprintf("smartctl did not find any disk: %v - %s", err, strings.TrimSpace(scanOut)))
+		return
+	}
+	for _, device := range devices {
+		// smartctl uses the bits of its exit status to indicate disk conditions, hence the error is not conclusive.
+		out, err := platform.InvokeProgram([]string{"PATH=" + platform.CommonPATH}, SMARTCommandTimeoutSec, "smartctl", append([]string{"-H", "-A"}, device...)...)
+		health := ParseSmartctlOutput(device[0], out)
+		if !health.Assessed {
+			problems = append(problems, fmt.Sprintf("%s did not report SMART health: %v", device[0], err))
+			continue
+		}
+		report = append(report, fmt.Sprintf("%s SMART health passed: %v", device[0], health.Passed))
+		problems = append(problems, health.Problems()...)
+	}
+	return
+}
+
+// CheckDiskUsage compares the used space of each mount point against its threshold, and returns the mount points
+// exceeding their threshold.
+func (daemon *Daemon) CheckDiskUsage() (report []string, problems []string) {
+	report, problems = make([]string, 0), make([]string, 0)
+	mountPoints := make([]string, 0, len(daemon.DiskUsageThresholds))
+	for mountPoint := range daemon.DiskUsageThresholds {
+		mountPoints = append(mountPoints, mountPoint)
+	}
+	sort.Strings(mountPoints)
+	for _, mountPoint := range mountPoints {
+		threshold := daemon.DiskUsageThresholds[mountPoint]
+		usedKB, _, totalKB := platform.GetDiskUsageKB(mountPoint)
+		if totalKB == 0 {
+			problems = append(problems, fmt.Sprintf("failed to determine usage of %s", mountPoint))
+			continue
+		}
+		usedPercent := int(usedKB * 100 / totalKB)
+		report = append(report, fmt.Sprintf("%s is %d%% used (%d of %d MB), threshold %d%%", mountPoint, usedPercent, usedKB/1024, totalKB/1024, threshold))
+		if usedPercent >= threshold {
+			problems = append(problems, fmt.Sprintf("%s is %d%% used, at or above threshold %d%%", mountPoint, usedPercent, threshold))
+		}
+	}
+	return
+}
+
+// CheckDisks runs SMART health and disk usage checks, and returns the combined report and signs of disk trouble.
+func (daemon *Daemon) CheckDisks() (report []string, problems []string) {
+	smartReport, smartProblems := daemon.CheckSMART()
+	usageReport, usageProblems := daemon.CheckDiskUsage()
+	return append(smartReport, usageReport...), append(smartProblems, usageProblems...)
+}
+
+/*
+alertDiskProblems runs disk checks and sends an alert notification if there are signs of disk trouble. To avoid
+flooding the recipients, the alert is sent only when the problems are different from those of the previous check.
+*/
+func (daemon *Daemon) alertDiskProblems(_ context.Context) {
+	_, problems := daemon.CheckDisks()
+	summary := strings.Join(problems, "\n")
+	daemon.diskAlertMutex.Lock()
+	isNew := summary != daemon.lastDiskProblems
+	daemon.lastDiskProblems = summary
+	daemon.diskAlertMutex.Unlock()
+	if len(problems) == 0 || !isNew {
+		return
+	}
+	daemon.logger.Warning("", nil, "detected disk problems: %s", strings.Join(problems, "; "))
+	if len(daemon.Recipients) == 0 {
+		return
+	}
+	if err := daemon.MailClient.Send(inet.OutgoingMailSubjectKeyword+"-disk-alert", "Disk problems:\n"+summary+"\n", daemon.Recipients...); err != nil {
+		daemon.logger.Warning("", err, "failed to send disk alert mail")
+	}
+}
@@ -0,0 +1,82 @@
+package maintenance
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/platform"
+	"github.com/stretchr/testify/require"
+)
+
+const testSmartctlATA = `smartctl 7.2 2020-12-30 r5155 [x86_64-linux-5.10.0] (local build)
+
+=== START OF READ SMART DATA SECTION ===
+SMART overall-health self-assessment test result: PASSED
+
+SMART Attributes Data Structure revision number: 16
+Vendor Specific SMART Attributes with Thresholds:
+ID# ATTRIBUTE_NAME          FLAG     VALUE WORST THRESH TYPE      UPDATED  WHEN_FAILED RAW_VALUE
+  5 Reallocated_Sector_Ct   0x0033   100   100   010    Pre-fail  Always       -       8
+  9 Power_On_Hours          0x0032   095   095   000    Old_age   Always       -       21513
+197 Current_Pending_Sector  0x0012   100   100   000    Old_age   Always       -       0
+198 Offline_Uncorrectable   0x0010   100   100   000    Old_age   Offline      -       2
+`
+
+const testSmartctlNVMe = `=== START OF SMART DATA SECTION ===
+SMART overall-health self-assessment test result: FAILED!
+
+SMART/Health Information (NVMe Log 0x02)
+Critical Warning:                   0x00
+Temperature:                        35 Celsius
+Percentage Used:                    93%
+Data Units Read:                    1,234,567 [632 GB]
+Media and Data Integrity Errors:    0
+`
+
+const testSmartctlSCSI = `=== START OF READ SMART DATA SECTION ===
+SMART Health Status: OK
+`
+
+func TestParseSmartctlOutput(t *testing.T) {
+	ata := ParseSmartctlOutput("/dev/sda", testSmartctlATA)
+	require.Equal(t, SMARTHealth{Device: "/dev/sda", Assessed: true, Passed: true, ReallocatedSectors: 8, UncorrectableSectors: 2}, ata)
+	require.Equal(t, []string{"/dev/sda has 8 reallocated sectors", "/dev/sda has 2 uncorrectable sectors"}, ata.Problems())
+
+	nvme := ParseSmartctlOutput("/dev/nvme0", testSmartctlNVMe)
+	require.Equal(t, SMARTHealth{Device: "/dev/nvme0", Assessed: true, Passed: false, PercentageUsed: 93}, nvme)
+	require.Len(t, nvme.Problems(), 2)
+
+	scsi := ParseSmartctlOutput("/dev/sdb", testSmartctlSCSI)
+	require.True(t, scsi.Assessed)
+	require.True(t, scsi.Passed)
+	require.Empty(t, scsi.Problems())
+
+	require.False(t, ParseSmartctlOutput("/dev/sdc", "Smartctl open device: /dev/sdc failed").Assessed)
+}
+
+func TestParseSmartctlScan(t *testing.T) {
+	devices := ParseSmartctlScan("/dev/sda -d scsi # /dev/sda, SCSI device\n/dev/nvme0 -d nvme # /dev/nvme0, NVMe device\n/dev/sdb\n\n# comment")
+	require.Equal(t, [][]string{{"/dev/sda", "-d", "scsi"}, {"/dev/nvme0", "-d", "nvme"}, {"/dev/sdb"}}, devices)
+}
+
+func TestCheckDiskUsage(t *testing.T) {
+	if platform.HostIsWindows() {
+		t.Skip("disk usage is not determined on windows")
+	}
+	daemon := Daemon{DiskUsageThresholds: map[string]int{"/": 100, "/does-not-exist": 50}}
+	require.NoError(t, daemon.Initialise())
+	report, problems := daemon.CheckDiskUsage()
+	require.Len(t, report, 1)
+	require.True(t, strings.HasPrefix(report[0], "/ is "), report)
+	require.Equal(t, []string{"failed to determine usage of /does-not-exist"}, problems)
+	// Alert only once for the same problems.
+	daemon.alertDiskProblems(context.Background())
+	require.Equal(t, "failed to determine usage of /does-not-exist", daemon.lastDiskProblems)
+	daemon.DiskUsageThresholds = map[string]int{"/": 1}
+	_, problems = daemon.CheckDiskUsage()
+	require.Len(t, problems, 1)
+	// Reject invalid thresholds.
+	daemon.DiskUsageThresholds = map[string]int{"/": 101}
+	require.Error(t, daemon.Initialise())
+}
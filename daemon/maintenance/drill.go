@@ -0,0 +1,231 @@
+package maintenance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/phonehome"
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+const (
+	// DrillChannelDNS runs the drill command via a DNS TXT query of the laitos DNS server's domain name.
+	DrillChannelDNS = "dns"
+	// DrillChannelHTTP runs the drill command via the app command endpoint of the web server.
+	DrillChannelHTTP = "http"
+	// DrillChannelSMSHook runs the drill command via the Twilio SMS hook of the web server.
+	DrillChannelSMSHook = "smshook"
+	// DrillChannelTelegram verifies that the Telegram bot is able to receive messages.
+	DrillChannelTelegram = "telegram"
+
+	// DefaultDrillIntervalSec is the default interval of verifying the alternate access paths.
+	DefaultDrillIntervalSec = 6 * 3600
+	// DefaultDrillCommand is the app command run by the drill by default, it does not require any app configuration.
+	DefaultDrillCommand = ".e info"
+	// DefaultDrillExpectOutput is the text expected to appear in the output of the default drill command.
+	DefaultDrillExpectOutput = "Host name"
+	// DrillTimeoutSec is the timeout of each drill probe.
+	DrillTimeoutSec = 60
+	// DrillSMSSender is the phone number presented to the SMS hook by the drill.
+	DrillSMSSender = "laitos-drill"
+)
+
+// DrillProbe is an alternate access path to laitos that is verified by running an app command end-to-end.
+type DrillProbe struct {
+	// Channel is the access path - "dns", "http", "smshook", or "telegram".
+	Channel string `json:"Channel"`
+	/*
+		Target is the laitos DNS server's domain name (e.g. "example.com") for the dns channel, or the URL of the app
+		command endpoint or SMS hook (e.g. "https://example.com/sms") for the http and smshook channels.
+	*/
+	Target string `json:"Target"`
+	// Password is the app command password PIN of the channel.
+	Password string `json:"Password"`
+	// AuthorizationToken is the Telegram bot API token, it is the token of the Telegram bot by default.
+	AuthorizationToken string `json:"AuthorizationToken"`
+	// Command is the app command to run, excluding the password.
+	Command string `json:"Command"`
+	// ExpectOutput is the text expected to appear in the command output.
+	ExpectOutput string `json:"ExpectOutput"`
+}
+
+// Initialise validates the probe configuration and gives it default values.
+func (probe *DrillProbe) Initialise() error {
+	switch probe.Channel {
+	case DrillChannelDNS, DrillChannelHTTP, DrillChannelSMSHook:
+		if probe.Target == "" || probe.Password == "" {
+			return fmt.Errorf("DrillProbe.Initialise: %s drill requires Target and Password", probe.Channel)
+		}
+	case DrillChannelTelegram:
+		if probe.AuthorizationToken == "" {
+			return fmt.Errorf("DrillProbe.Initialise: %s drill requires the AuthorizationToken of the bot", probe.Channel)
+		}
+	default:
+		return fmt.Errorf("DrillProbe.Initialise: unknown drill channel \"%s\"", probe.Channel)
+	}
+	if probe.Command == "" {
+		probe.Command = DefaultDrillCommand
+		if probe.ExpectOutput == "" {
+			probe.ExpectOutput = DefaultDrillExpectOutput
+		}
+	}
+	return nil
+}
+
+// String returns the channel and target of the probe, without the secrets.
+func (probe *DrillProbe) String() string {
+	if probe.Target == "" {
+		return probe.Channel
+	}
+	return probe.Channel + " " + probe.Target
+}
+
+// Run runs the drill command via the access path and returns an error if the path is broken.
+func (probe *DrillProbe) Run(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, DrillTimeoutSec*time.Second)
+	defer cancel()
+	var output string
+	switch probe.Channel {
+	case DrillChannelDNS:
+		// Use a public resolver to verify the delegation of the domain name as well.
+		entries, err := inet.NeutralRecursiveResolver.LookupTXT(ctx, phonehome.GetDNSQuery(probe.Password+probe.Command, probe.Target))
+		if err != nil {
+			return fmt.Errorf("DNS query failed - %w", err)
+		}
+		output = strings.Join(entries, "")
+	case DrillChannelHTTP, DrillChannelSMSHook:
+		form := url.Values{"cmd": {probe.Password + probe.Command}}
+		if probe.Channel == DrillChannelSMSHook {
+			form = url.Values{"From": {DrillSMSSender}, "Body": {probe.Password + probe.Command}}
+		}
+		resp, err := inet.DoHTTP(ctx, inet.HTTPRequest{
+			Method:     http.MethodPost,
+			TimeoutSec: DrillTimeoutSec,
+			Body:       strings.NewReader(form.Encode()),
+			MaxRetry:   1,
+			// Use a public resolver to verify the domain name as well.
+			UseNeutralDNSResolver: true,
+		}, probe.Target)
+		if err == nil {
+			err = resp.Non2xxToError()
+		}
+		if err != nil {
+			return fmt.Errorf("HTTP request failed - %w", err)
+		}
+		output = string(resp.Body)
+	case DrillChannelTelegram:
+		return probe.checkTelegram(ctx)
+	}
+	if !strings.Contains(output, probe.ExpectOutput) {
+		return fmt.Errorf("the command output does not contain \"%s\": %s", probe.ExpectOutput, lintDrillOutput(output))
+	}
+	return nil
+}
+
+/*
+checkTelegram verifies that the bot is able to receive messages. A Telegram bot cannot send a message to itself, hence
+instead of running an app command, the drill verifies that the bot token is valid, and that the bot does not have a
+webhook that prevents the laitos Telegram bot from polling for messages.
+*/
+func (probe *DrillProbe) checkTelegram(ctx context.Context) error {
+	resp, err := inet.DoHTTP(ctx, inet.HTTPRequest{TimeoutSec: DrillTimeoutSec}, "https://api.telegram.org/bot%s/getWebhookInfo", probe.AuthorizationToken)
+	if err == nil {
+		err = resp.Non2xxToError()
+	}
+	if err != nil {
+		return fmt.Errorf("Telegram API call failed - %w", err)
+	}
+	var webhookInfo struct {
+		OK     bool `json:"ok"`
+		Result struct {
+			URL string `json:"url"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(resp.Body, &webhookInfo); err != nil || !webhookInfo.OK {
+		return fmt.Errorf("Telegram API responded with unexpected content: %s", lintDrillOutput(string(resp.Body)))
+	}
+	if webhookInfo.Result.URL != "" {
+		return errors.New("the bot has a webhook, which prevents it from polling for messages")
+	}
+	return nil
+}
+
+// lintDrillOutput shortens the command output for an alert.
+func lintDrillOutput(output string) string {
+	output = strings.Join(strings.Fields(output), " ")
+	if len(output) > 200 {
+		output = output[:200] + "..."
+	}
+	return output
+}
+
+// RunDrill runs all drill probes in parallel and returns the error of each broken access path, keyed by the probe number and name.
+func (daemon *Daemon) RunDrill(ctx context.Context) map[string]error {
+	problems := make(map[string]error)
+	problemsMutex := new(sync.Mutex)
+	wait := new(sync.WaitGroup)
+	for i := range daemon.DrillProbes {
+		wait.Add(1)
+		go func(i int, probe *DrillProbe) {
+			defer wait.Done()
+			if err := probe.Run(ctx); err != nil {
+				problemsMutex.Lock()
+				problems[fmt.Sprintf("#%d %s", i+1, probe)] = err
+				problemsMutex.Unlock()
+			}
+		}(i, &daemon.DrillProbes[i])
+	}
+	wait.Wait()
+	return problems
+}
+
+/*
+alertDrillProblems runs the drill and sends an alert notification if any access path is broken. To avoid repeated
+alerts, the notification is only sent when the broken paths differ from those found by the previous drill, including
+when all paths work again.
+*/
+func (daemon *Daemon) alertDrillProblems(ctx context.Context) {
+	problems := daemon.RunDrill(ctx)
+	brokenPaths := make([]string, 0, len(problems))
+	for path := range problems {
+		brokenPaths = append(brokenPaths, path)
+	}
+	sort.Strings(brokenPaths)
+	// The error details may differ from one drill to the next, only the broken paths are compared.
+	summary := strings.Join(brokenPaths, "\n")
+	daemon.drillAlertMutex.Lock()
+	previous := daemon.lastDrillProblems
+	daemon.lastDrillProblems = summary
+	daemon.drillAlertMutex.Unlock()
+	if summary == previous {
+		return
+	}
+	var subject string
+	var body strings.Builder
+	if len(problems) == 0 {
+		daemon.logger.Info("", nil, "all access paths are working again")
+		subject = "-drill-ok"
+		body.WriteString("All access paths are working again.\n")
+	} else {
+		daemon.logger.Warning("", nil, "drill found broken access paths: %s", strings.Join(brokenPaths, ", "))
+		subject = "-drill-alert"
+		body.WriteString("Broken access paths:\n")
+		for _, path := range brokenPaths {
+			body.WriteString(fmt.Sprintf("%s: %v\n", path, problems[path]))
+		}
+	}
+	if len(daemon.Recipients) == 0 {
+		return
+	}
+	if err := daemon.MailClient.Send(inet.OutgoingMailSubjectKeyword+subject, body.String(), daemon.Recipients...); err != nil {
+		daemon.logger.Warning("", err, "failed to send drill alert mail")
+	}
+}
@@ -0,0 +1,74 @@
+package maintenance
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrillProbe_Initialise(t *testing.T) {
+	require.Error(t, (&DrillProbe{Channel: "pigeon"}).Initialise())
+	require.Error(t, (&DrillProbe{Channel: DrillChannelDNS, Target: "example.com"}).Initialise())
+	require.Error(t, (&DrillProbe{Channel: DrillChannelTelegram}).Initialise())
+
+	probe := &DrillProbe{Channel: DrillChannelHTTP, Target: "https://example.com/cmd", Password: "pass"}
+	require.NoError(t, probe.Initialise())
+	require.Equal(t, DefaultDrillCommand, probe.Command)
+	require.Equal(t, DefaultDrillExpectOutput, probe.ExpectOutput)
+	require.Equal(t, "http https://example.com/cmd", probe.String())
+
+	// A custom command does not get the default expectation
+	probe = &DrillProbe{Channel: DrillChannelSMSHook, Target: "https://example.com/sms", Password: "pass", Command: ".s true"}
+	require.NoError(t, probe.Initialise())
+	require.Equal(t, "", probe.ExpectOutput)
+}
+
+func TestDaemon_RunDrill(t *testing.T) {
+	var working atomic.Bool
+	working.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cmd string
+		switch r.URL.Path {
+		case "/cmd":
+			cmd = r.FormValue("cmd")
+		case "/sms":
+			if r.FormValue("From") != DrillSMSSender {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			cmd = r.FormValue("Body")
+		}
+		if !working.Load() || cmd != "pass.e info" {
+			_, _ = w.Write([]byte("invalid password PIN or shortcut"))
+			return
+		}
+		_, _ = w.Write([]byte("Host name: laitos"))
+	}))
+	defer server.Close()
+
+	daemon := &Daemon{DrillProbes: []DrillProbe{
+		{Channel: DrillChannelHTTP, Target: server.URL + "/cmd", Password: "pass"},
+		{Channel: DrillChannelSMSHook, Target: server.URL + "/sms", Password: "pass"},
+		{Channel: DrillChannelHTTP, Target: server.URL + "/cmd", Password: "wrong"},
+	}}
+	require.NoError(t, daemon.Initialise())
+	problems := daemon.RunDrill(context.Background())
+	require.Len(t, problems, 1, problems)
+	require.Contains(t, problems["#3 http "+server.URL+"/cmd"].Error(), "invalid password")
+
+	// The broken paths are remembered to avoid repeated alerts
+	daemon.alertDrillProblems(context.Background())
+	require.Equal(t, "#3 http "+server.URL+"/cmd", daemon.lastDrillProblems)
+	working.Store(false)
+	daemon.alertDrillProblems(context.Background())
+	require.Equal(t, 3, len(strings.Split(daemon.lastDrillProblems, "\n")))
+	working.Store(true)
+	daemon.DrillProbes = daemon.DrillProbes[:2]
+	daemon.alertDrillProblems(context.Background())
+	require.Equal(t, "", daemon.lastDrillProblems)
+}
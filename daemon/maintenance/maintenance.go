@@ -3,6 +3,8 @@ package maintenance
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"fmt"
 	"net"
 	"os"
@@ -13,6 +15,7 @@ import (
 	"time"
 
 	"github.com/HouzuoGuo/laitos/awsinteg"
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/daemon/httpd"
 	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailcmd"
 	"github.com/HouzuoGuo/laitos/inet"
@@ -81,6 +84,9 @@ type Daemon struct {
 	SwapFileSizeMB int `json:"SwapFileSizeMB"`
 	// SetTimeZone changes system time zone to the specified value (such as "UTC" or "Europe/Dublin").
 	SetTimeZone string `json:"SetTimeZone"`
+	// NTPServers are the NTP servers (host name or host:port) queried for synchronising the system clock.
+	// If left empty, a handful of public NTP servers will be used.
+	NTPServers []string `json:"NTPServers"`
 	// RegisterPrometheusMetrics records process statistics (e.g. CPU time & context switches) in promehteus metrics.
 	RegisterPrometheusMetrics bool `json:"RegisterPrometheusMetrics"`
 	// RegsiterProcessActivityMetrics records process file and network activities powered by eBPF in prometheus metrics.
@@ -92,6 +98,39 @@ type Daemon struct {
 	PrometheusScrapeIntervalSec int `json:"PrometheusScrapeIntervalSec"`
 	// ShrinkSystemdJournalSizeMB is the threshold under which systemd journal will be shrunk. Older journal will be deleted.
 	ShrinkSystemdJournalSizeMB int `json:"ShrinkSystemdJournalSizeMB"`
+	// CheckSMARTHealth polls SMART health of all disks via smartctl, and alerts recipients about signs of disk failure.
+	CheckSMARTHealth bool `json:"CheckSMARTHealth"`
+	// DiskUsageThresholds maps mount points (e.g. "/" and "/var") to the used space percentage at which recipients are alerted.
+	DiskUsageThresholds map[string]int `json:"DiskUsageThresholds"`
+	// DiskCheckIntervalSec is the interval of disk health checks that run between maintenance routines.
+	DiskCheckIntervalSec int `json:"DiskCheckIntervalSec"`
+	// ResetDaemonStats clears the daemon stats counters after each report, so that the report shows the stats since the previous one.
+	ResetDaemonStats bool `json:"ResetDaemonStats"`
+
+	// SelfUpdateURL is the URL of laitos release binary, its ed25519 signature is downloaded from the URL suffixed by ".sig".
+	SelfUpdateURL string `json:"SelfUpdateURL"`
+	// SelfUpdatePublicKey is the base64-encoded ed25519 public key that verifies the signature of release binary.
+	SelfUpdatePublicKey string `json:"SelfUpdatePublicKey"`
+	// SelfUpdateWindowStartHour and SelfUpdateWindowEndHour determine the hours (0-23, system local time) during which
+	// a new release binary may be installed. When both are identical, the release may be installed at any time.
+	SelfUpdateWindowStartHour int `json:"SelfUpdateWindowStartHour"`
+	SelfUpdateWindowEndHour   int `json:"SelfUpdateWindowEndHour"`
+	// SelfUpdateCheckIntervalSec is the interval of checking for a new release binary.
+	SelfUpdateCheckIntervalSec int `json:"SelfUpdateCheckIntervalSec"`
+
+	// ConfigSnapshotDir is the directory that keeps the snapshots of configuration and runtime settings, secrets masked.
+	ConfigSnapshotDir string `json:"ConfigSnapshotDir"`
+	// ConfigSnapshotGenerations is the maximum number of distinct snapshots to keep, the oldest are deleted.
+	ConfigSnapshotGenerations int `json:"ConfigSnapshotGenerations"`
+	// ConfigSnapshotIntervalSec is the interval of taking configuration snapshots and comparing them against the latest one.
+	ConfigSnapshotIntervalSec int `json:"ConfigSnapshotIntervalSec"`
+	// TakeConfigSnapshot returns the snapshot of configuration and runtime settings in text, with secrets masked.
+	TakeConfigSnapshot func() ([]byte, error) `json:"-"`
+
+	// DrillProbes are the alternate access paths (e.g. DNS, SMS hook, Telegram) verified by an end-to-end app command at regular interval.
+	DrillProbes []DrillProbe `json:"DrillProbes"`
+	// DrillIntervalSec is the interval of verifying the alternate access paths, recipients are alerted when a path breaks.
+	DrillIntervalSec int `json:"DrillIntervalSec"`
 
 	/*
 		IntervalSec determines the rate of execution of maintenance routine. This is not a sleep duration. The constant
@@ -109,6 +148,11 @@ type Daemon struct {
 
 	lastStepTimestamp      int64 // lastStepTimestamp is the unix timestamp at which the last maintenance stage or a stage step took place
 	processExplorerMetrics *ProcessExplorerMetrics
+	lastDiskProblems       string      // lastDiskProblems are the disk problems found by the latest disk check
+	diskAlertMutex         *sync.Mutex // diskAlertMutex protects lastDiskProblems
+	lastDrillProblems      string      // lastDrillProblems are the broken access paths found by the latest drill
+	drillAlertMutex        *sync.Mutex // drillAlertMutex protects lastDrillProblems
+	selfUpdatePublicKey    ed25519.PublicKey
 
 	cancelFunc context.CancelFunc
 	logger     *lalog.Logger
@@ -156,10 +200,15 @@ func (daemon *Daemon) Execute(ctx context.Context) (string, bool) {
 	daemon.logger.Info("", nil, "running now")
 	// Conduct system maintenance first to ensure an accurate reading of runtime information later on
 	maintResult := daemon.SystemMaintenance()
-	// Do three checks in parallel - ports, toolbox features, and mail command runner
+	// Do the checks in parallel - ports, toolbox features, mail command runner, HTTP handlers, and disks
 	var portsErr, featureErr, mailCmdRunnerErr, httpHandlersErr error
+	var diskReport, diskProblems []string
 	waitAllChecks := new(sync.WaitGroup)
-	waitAllChecks.Add(4) // will wait for port checks, app tests, mail command runner, and HTTP handler tests.
+	waitAllChecks.Add(5) // will wait for port checks, app tests, mail command runner, HTTP handler tests, and disk checks.
+	go func() {
+		diskReport, diskProblems = daemon.CheckDisks()
+		waitAllChecks.Done()
+	}()
 	go func() {
 		// Port checks - the routine itself also uses concurrency internally
 		portsErr = daemon.runPortsCheck()
@@ -190,7 +239,7 @@ func (daemon *Daemon) Execute(ctx context.Context) (string, bool) {
 	waitAllChecks.Wait()
 
 	// Results are now ready. When composing the mail body, place the most important&interesting piece of information at top.
-	allOK := portsErr == nil && featureErr == nil && mailCmdRunnerErr == nil && httpHandlersErr == nil
+	allOK := portsErr == nil && featureErr == nil && mailCmdRunnerErr == nil && httpHandlersErr == nil && len(diskProblems) == 0
 	var result bytes.Buffer
 	if allOK {
 		result.WriteString("All OK\n")
@@ -200,7 +249,11 @@ func (daemon *Daemon) Execute(ctx context.Context) (string, bool) {
 	summary := platform.GetProgramStatusSummary(true)
 	result.WriteString(summary.String())
 	result.WriteString("\nDaemon stats - low/avg/high/total seconds and (count):\n")
-	result.WriteString(misc.GetLatestStats())
+	result.WriteString(common.FormatDaemonStats())
+	if daemon.ResetDaemonStats {
+		common.ResetDaemonStats("")
+		result.WriteString("(The daemon stats counters have been reset for the next report)\n")
+	}
 	if portsErr == nil {
 		result.WriteString("\nPorts: OK\n")
 	} else {
@@ -221,6 +274,14 @@ func (daemon *Daemon) Execute(ctx context.Context) (string, bool) {
 	} else {
 		result.WriteString(fmt.Sprintf("\nHTTP handler errors: %v\n", httpHandlersErr))
 	}
+	if len(diskProblems) == 0 {
+		result.WriteString("\nDisks (if checked): OK\n")
+	} else {
+		result.WriteString(fmt.Sprintf("\nDisk problems:\n%s\n", strings.Join(diskProblems, "\n")))
+	}
+	if len(diskReport) > 0 {
+		result.WriteString(strings.Join(diskReport, "\n") + "\n")
+	}
 	result.WriteString("\nWarnings:\n")
 	result.WriteString(toolbox.GetLatestWarnings())
 	result.WriteString("\nLogs:\n")
@@ -247,7 +308,7 @@ func (daemon *Daemon) Execute(ctx context.Context) (string, bool) {
 	if err := os.WriteFile(ReportFilePath, result.Bytes(), 0600); err != nil {
 		daemon.logger.Warning("", err, "failed to persist latest maintenance report in %s, you may still find the report in Email or laitos program output.", ReportFilePath)
 	}
-	if misc.EnableAWSIntegration {
+	if misc.AWSIntegration.IsEnabled() {
 		// Upload the latest maintenance report to S3 bucket, named the object after the date and time of the system wall clock.
 		go func() {
 			daemon.logger.Info("", nil, "will store a copy of the report in S3 bucket %s", daemon.UploadReportToS3Bucket)
@@ -274,8 +335,49 @@ func (daemon *Daemon) Initialise() error {
 	if daemon.PrometheusScrapeIntervalSec < 1 {
 		daemon.PrometheusScrapeIntervalSec = 60
 	}
+	if daemon.DiskCheckIntervalSec < 1 {
+		daemon.DiskCheckIntervalSec = DefaultDiskCheckIntervalSec
+	}
+	for mountPoint, threshold := range daemon.DiskUsageThresholds {
+		if threshold < 1 || threshold > 100 {
+			return fmt.Errorf("maintenance.Initialise: disk usage threshold of %s must be between 1 and 100", mountPoint)
+		}
+	}
+	daemon.diskAlertMutex = new(sync.Mutex)
+	for i := range daemon.DrillProbes {
+		if err := daemon.DrillProbes[i].Initialise(); err != nil {
+			return fmt.Errorf("maintenance.Initialise: %w", err)
+		}
+	}
+	if daemon.DrillIntervalSec < 1 {
+		daemon.DrillIntervalSec = DefaultDrillIntervalSec
+	}
+	daemon.drillAlertMutex = new(sync.Mutex)
+	if daemon.SelfUpdateURL != "" {
+		publicKey, err := base64.StdEncoding.DecodeString(daemon.SelfUpdatePublicKey)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("maintenance.Initialise: SelfUpdatePublicKey must be a base64-encoded ed25519 public key")
+		}
+		daemon.selfUpdatePublicKey = publicKey
+		for _, hour := range []int{daemon.SelfUpdateWindowStartHour, daemon.SelfUpdateWindowEndHour} {
+			if hour < 0 || hour > 23 {
+				return fmt.Errorf("maintenance.Initialise: self update window hours must be between 0 and 23")
+			}
+		}
+		if daemon.SelfUpdateCheckIntervalSec < 1 {
+			daemon.SelfUpdateCheckIntervalSec = DefaultSelfUpdateCheckIntervalSec
+		}
+	}
+	if daemon.ConfigSnapshotDir != "" {
+		if daemon.ConfigSnapshotGenerations < 1 {
+			daemon.ConfigSnapshotGenerations = DefaultConfigSnapshotGenerations
+		}
+		if daemon.ConfigSnapshotIntervalSec < 1 {
+			daemon.ConfigSnapshotIntervalSec = DefaultConfigSnapshotIntervalSec
+		}
+	}
 	daemon.logger = &lalog.Logger{ComponentName: "maintenance", ComponentID: []lalog.LoggerIDField{{Key: "Intv", Value: daemon.IntervalSec}}}
-	if daemon.RegisterPrometheusMetrics && misc.EnablePrometheusIntegration {
+	if daemon.RegisterPrometheusMetrics && misc.PrometheusIntegration.IsEnabled() {
 		daemon.processExplorerMetrics = NewProcessExplorerMetrics(lalog.DefaultLogger, daemon.PrometheusScrapeIntervalSec, daemon.RegsiterProcessActivityMetrics, daemon.RegisterSystemActivityMetrics)
 		if err := daemon.processExplorerMetrics.RegisterGlobally(); err != nil {
 			daemon.logger.Warning("prometheus", err, "failed to register metrics with prometheus")
@@ -316,6 +418,78 @@ func (daemon *Daemon) StartAndBlock() error {
 		return err
 	}
 
+	// Check disk health at regular interval and alert recipients about trouble ahead of the next maintenance run
+	if daemon.CheckSMARTHealth || len(daemon.DiskUsageThresholds) > 0 {
+		periodicDiskCheck := &misc.Periodic{
+			LogActorName: "check-disk-health",
+			Interval:     time.Duration(daemon.DiskCheckIntervalSec) * time.Second,
+			MaxInt:       1,
+			Func: func(ctx context.Context, _, _ int) error {
+				daemon.alertDiskProblems(ctx)
+				return nil
+			},
+		}
+		if err := periodicDiskCheck.Start(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Check for a new release binary at regular interval
+	if daemon.SelfUpdateURL != "" {
+		periodicSelfUpdate := &misc.Periodic{
+			LogActorName: "self-update",
+			Interval:     time.Duration(daemon.SelfUpdateCheckIntervalSec) * time.Second,
+			MaxInt:       1,
+			Func: func(ctx context.Context, _, _ int) error {
+				daemon.runSelfUpdate(ctx)
+				return nil
+			},
+		}
+		if err := periodicSelfUpdate.Start(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Snapshot configuration at regular interval and alert recipients about changes
+	if daemon.ConfigSnapshotDir != "" && daemon.TakeConfigSnapshot != nil {
+		periodicConfigSnapshot := &misc.Periodic{
+			LogActorName: "config-snapshot",
+			Interval:     time.Duration(daemon.ConfigSnapshotIntervalSec) * time.Second,
+			MaxInt:       1,
+			Func: func(ctx context.Context, _, _ int) error {
+				daemon.runConfigSnapshot(ctx)
+				return nil
+			},
+		}
+		if err := periodicConfigSnapshot.Start(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Verify the alternate access paths at regular interval and alert recipients about the broken ones
+	if len(daemon.DrillProbes) > 0 {
+		periodicDrill := &misc.Periodic{
+			LogActorName: "drill",
+			Interval:     time.Duration(daemon.DrillIntervalSec) * time.Second,
+			MaxInt:       1,
+			Func: func(ctx context.Context, round, _ int) error {
+				if round == 0 {
+					// Give the daemons a chance to start up before the first drill
+					select {
+					case <-time.After(InitialDelaySec * time.Second):
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+				daemon.alertDrillProblems(ctx)
+				return nil
+			},
+		}
+		if err := periodicDrill.Start(ctx); err != nil {
+			return err
+		}
+	}
+
 	// Collect latest performance measurements at regular interval
 	if daemon.processExplorerMetrics != nil {
 		daemon.logger.Info("", nil, "will regularly take program performance measurements and give them to prometheus metrics.")
@@ -118,7 +118,7 @@ type ProcessExplorerMetrics struct {
 
 // NewProcessExplorerMetrics creates a new ProcessExplorerMetrics with all of its metrics collectors initialised.
 func NewProcessExplorerMetrics(logger *lalog.Logger, scrapeIntervalSec int, collectProcessActivity, collectSystemActivity bool) *ProcessExplorerMetrics {
-	if !misc.EnablePrometheusIntegration {
+	if !misc.PrometheusIntegration.IsEnabled() {
 		return &ProcessExplorerMetrics{}
 	}
 	labels := []string{PrometheusMetricExeLabel}
@@ -174,7 +174,7 @@ func NewProcessExplorerMetrics(logger *lalog.Logger, scrapeIntervalSec int, coll
 
 // RegisterGlobally registers all program performance metrics with the global & default prometheus instance.
 func (metrics *ProcessExplorerMetrics) RegisterGlobally() error {
-	if !misc.EnablePrometheusIntegration {
+	if !misc.PrometheusIntegration.IsEnabled() {
 		return nil
 	}
 	for _, metric := range []prometheus.Collector{
@@ -209,7 +209,7 @@ func (metrics *ProcessExplorerMetrics) RegisterGlobally() error {
 
 // Refresh reads the latest program performance measurements and gives them to prometheus metrics.
 func (metrics *ProcessExplorerMetrics) Refresh() error {
-	if !misc.EnablePrometheusIntegration {
+	if !misc.PrometheusIntegration.IsEnabled() {
 		return nil
 	}
 	proc, err := procexp.GetProcAndTaskStatus(0)
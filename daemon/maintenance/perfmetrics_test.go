@@ -16,7 +16,7 @@ func TestProcessExplorerMetrics(t *testing.T) {
 	}
 
 	for _, enabled := range promInteg {
-		misc.EnablePrometheusIntegration = enabled.enabled
+		misc.PrometheusIntegration.Set(enabled.enabled)
 		metrics := NewProcessExplorerMetrics(lalog.DefaultLogger, 1, true, true)
 		if err := metrics.RegisterGlobally(); err != nil {
 			t.Fatal(err)
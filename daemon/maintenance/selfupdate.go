@@ -0,0 +1,224 @@
+package maintenance
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/platform"
+)
+
+const (
+	// DefaultSelfUpdateCheckIntervalSec is the default interval of checking for a new laitos release.
+	DefaultSelfUpdateCheckIntervalSec = 3600
+	// SelfUpdateDownloadTimeoutSec is the timeout of downloading a release binary.
+	SelfUpdateDownloadTimeoutSec = 600
+	// SelfUpdateMaxBinarySize is the maximum size of a release binary.
+	SelfUpdateMaxBinarySize = 256 * 1048576
+	// SelfUpdateSignatureSuffix is appended to the URL of release binary to form the URL of its ed25519 signature.
+	SelfUpdateSignatureSuffix = ".sig"
+	// SelfUpdateBackupSuffix is appended to the executable path to form the path of the previous executable kept for rollback.
+	SelfUpdateBackupSuffix = ".old"
+	// SelfUpdatePendingSuffix is appended to the executable path to form the path of the marker file, which indicates
+	// that the executable has been updated yet to prove itself to start and run successfully.
+	SelfUpdatePendingSuffix = ".update-pending"
+	// SelfUpdateRejectedSuffix is appended to the executable path to form the path of the file that keeps the SHA256
+	// hash of the release rolled back most recently, the release is not installed again.
+	SelfUpdateRejectedSuffix = ".update-rejected"
+)
+
+// selfUpdateRestart is called to exit the program after installing an update, the supervisor then restarts the program.
+var selfUpdateRestart = func() {
+	os.Exit(0)
+}
+
+// VerifySelfUpdate verifies the ed25519 signature of a release binary. The signature may be either the raw 64 bytes or
+// their base64 encoding.
+func VerifySelfUpdate(binary, signature []byte, publicKey ed25519.PublicKey) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("VerifySelfUpdate: public key must be %d bytes long", ed25519.PublicKeySize)
+	}
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil {
+			return fmt.Errorf("VerifySelfUpdate: the signature is neither raw nor base64 encoded - %w", err)
+		}
+		signature = decoded
+	}
+	if !ed25519.Verify(publicKey, binary, signature) {
+		return errors.New("VerifySelfUpdate: signature verification failed")
+	}
+	return nil
+}
+
+/*
+InstallSelfUpdate replaces the executable with the new binary. The previous executable is kept for rollback, and a
+marker file is left behind to indicate that the update is pending confirmation. The executable path is always occupied
+by either the previous or the new executable during the swap.
+*/
+func InstallSelfUpdate(executablePath string, binary []byte) error {
+	info, err := os.Stat(executablePath)
+	if err != nil {
+		return fmt.Errorf("InstallSelfUpdate: failed to read the executable - %w", err)
+	}
+	newPath := executablePath + ".new"
+	if err := os.WriteFile(newPath, binary, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("InstallSelfUpdate: failed to write new executable - %w", err)
+	}
+	backupPath := executablePath + SelfUpdateBackupSuffix
+	_ = os.Remove(backupPath)
+	if err := os.Link(executablePath, backupPath); err != nil {
+		_ = os.Remove(newPath)
+		return fmt.Errorf("InstallSelfUpdate: failed to keep a backup of the executable - %w", err)
+	}
+	if err := os.WriteFile(executablePath+SelfUpdatePendingSuffix, []byte(time.Now().Format(time.RFC3339)), 0600); err != nil {
+		_ = os.Remove(newPath)
+		return fmt.Errorf("InstallSelfUpdate: failed to write the update marker - %w", err)
+	}
+	if err := os.Rename(newPath, executablePath); err != nil {
+		_ = os.Remove(newPath)
+		_ = os.Remove(executablePath + SelfUpdatePendingSuffix)
+		return fmt.Errorf("InstallSelfUpdate: failed to swap the executable - %w", err)
+	}
+	return nil
+}
+
+// SelfUpdatePending returns true if the executable has been updated and yet to be confirmed.
+func SelfUpdatePending(executablePath string) bool {
+	_, err := os.Stat(executablePath + SelfUpdatePendingSuffix)
+	return err == nil
+}
+
+// ConfirmSelfUpdate confirms that the updated executable works, so that it will not be rolled back.
+func ConfirmSelfUpdate(executablePath string) error {
+	if err := os.Remove(executablePath + SelfUpdatePendingSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+RollbackSelfUpdate restores the previous executable if an update is pending confirmation. It returns true only if the
+previous executable has been restored. The hash of the rejected release is kept so that the release is not installed
+again.
+*/
+func RollbackSelfUpdate(executablePath string) (bool, error) {
+	if !SelfUpdatePending(executablePath) {
+		return false, nil
+	}
+	rejected, err := os.ReadFile(executablePath)
+	if err != nil {
+		return false, fmt.Errorf("RollbackSelfUpdate: failed to read the executable - %w", err)
+	}
+	rejectedSum := sha256.Sum256(rejected)
+	if err := os.WriteFile(executablePath+SelfUpdateRejectedSuffix, []byte(hex.EncodeToString(rejectedSum[:])), 0600); err != nil {
+		return false, fmt.Errorf("RollbackSelfUpdate: failed to record the rejected release - %w", err)
+	}
+	if err := os.Rename(executablePath+SelfUpdateBackupSuffix, executablePath); err != nil {
+		return false, fmt.Errorf("RollbackSelfUpdate: failed to restore the previous executable - %w", err)
+	}
+	return true, ConfirmSelfUpdate(executablePath)
+}
+
+// isSelfUpdateRejected returns true if the release of the SHA256 hash has been rolled back.
+func isSelfUpdateRejected(executablePath string, releaseSum []byte) bool {
+	rejected, err := os.ReadFile(executablePath + SelfUpdateRejectedSuffix)
+	return err == nil && strings.TrimSpace(string(rejected)) == hex.EncodeToString(releaseSum)
+}
+
+// inSelfUpdateWindow returns true if the time falls into the configured window (local hours) of installing updates.
+func (daemon *Daemon) inSelfUpdateWindow(now time.Time) bool {
+	start, end, hour := daemon.SelfUpdateWindowStartHour, daemon.SelfUpdateWindowEndHour, now.Hour()
+	if start == end {
+		return true
+	} else if start < end {
+		return hour >= start && hour < end
+	}
+	// The window spans across midnight.
+	return hour >= start || hour < end
+}
+
+/*
+CheckSelfUpdate downloads the release binary and its signature, and installs the binary in place of the executable if
+it differs from the executable and it has not been rolled back. It returns true only if a new binary has been installed.
+*/
+func (daemon *Daemon) CheckSelfUpdate(ctx context.Context, executablePath string) (bool, error) {
+	// The URL is used as a template, escape its percent signs.
+	urlTemplate := strings.ReplaceAll(daemon.SelfUpdateURL, "%", "%%")
+	binaryResp, err := inet.DoHTTP(ctx, inet.HTTPRequest{TimeoutSec: SelfUpdateDownloadTimeoutSec, MaxBytes: SelfUpdateMaxBinarySize, RejectLargeResponse: true}, urlTemplate)
+	if err != nil {
+		return false, fmt.Errorf("failed to download release binary - %w", err)
+	}
+	if err := binaryResp.Non2xxToError(); err != nil {
+		return false, fmt.Errorf("failed to download release binary - %w", err)
+	}
+	sigResp, err := inet.DoHTTP(ctx, inet.HTTPRequest{TimeoutSec: SelfUpdateDownloadTimeoutSec}, urlTemplate+SelfUpdateSignatureSuffix)
+	if err != nil {
+		return false, fmt.Errorf("failed to download release signature - %w", err)
+	}
+	if err := sigResp.Non2xxToError(); err != nil {
+		return false, fmt.Errorf("failed to download release signature - %w", err)
+	}
+	if err := VerifySelfUpdate(binaryResp.Body, sigResp.Body, daemon.selfUpdatePublicKey); err != nil {
+		return false, err
+	}
+	current, err := os.ReadFile(executablePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read the executable - %w", err)
+	}
+	currentSum, releaseSum := sha256.Sum256(current), sha256.Sum256(binaryResp.Body)
+	if bytes.Equal(currentSum[:], releaseSum[:]) {
+		return false, nil
+	}
+	// The release that failed to start and run is skipped until a newer release appears
+	if isSelfUpdateRejected(executablePath, releaseSum[:]) {
+		daemon.logger.Info(daemon.SelfUpdateURL, nil, "skipped the release that was rolled back previously")
+		return false, nil
+	}
+	if err := InstallSelfUpdate(executablePath, binaryResp.Body); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// runSelfUpdate checks for a new release binary during the update window, and restarts the program after installing it.
+func (daemon *Daemon) runSelfUpdate(ctx context.Context) {
+	if platform.HostIsWindows() {
+		daemon.logger.Info("", nil, "skipped on windows: self update")
+		return
+	}
+	if !daemon.inSelfUpdateWindow(time.Now()) {
+		return
+	}
+	executablePath, err := os.Executable()
+	if err != nil {
+		daemon.logger.Warning("", err, "failed to determine path to this program executable")
+		return
+	}
+	installed, err := daemon.CheckSelfUpdate(ctx, executablePath)
+	if err != nil {
+		daemon.logger.Warning(daemon.SelfUpdateURL, err, "failed to update this program")
+		return
+	}
+	if !installed {
+		return
+	}
+	if misc.IsSupervised() {
+		daemon.logger.Warning(daemon.SelfUpdateURL, nil, "installed a new release in %s, exiting now for the supervisor to restart the program", executablePath)
+		selfUpdateRestart()
+	} else {
+		// Without a supervisor there is nobody to roll back the update in case of a failure.
+		_ = ConfirmSelfUpdate(executablePath)
+		daemon.logger.Warning(daemon.SelfUpdateURL, nil, "installed a new release in %s, it will take effect after the program restarts", executablePath)
+	}
+}
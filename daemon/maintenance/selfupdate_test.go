@@ -0,0 +1,131 @@
+package maintenance
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySelfUpdate(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	binary := []byte("new release")
+	signature := ed25519.Sign(privateKey, binary)
+	require.NoError(t, VerifySelfUpdate(binary, signature, publicKey))
+	require.NoError(t, VerifySelfUpdate(binary, []byte(base64.StdEncoding.EncodeToString(signature)+"\n"), publicKey))
+	require.Error(t, VerifySelfUpdate([]byte("tampered release"), signature, publicKey))
+	require.Error(t, VerifySelfUpdate(binary, []byte("not a signature"), publicKey))
+	require.Error(t, VerifySelfUpdate(binary, signature, publicKey[:10]))
+}
+
+func TestSelfUpdate_InstallAndRollback(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	release := []byte("new release")
+	signature := ed25519.Sign(privateKey, release)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/laitos":
+			_, _ = w.Write(release)
+		case "/laitos" + SelfUpdateSignatureSuffix:
+			_, _ = w.Write(signature)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	executablePath := filepath.Join(t.TempDir(), "laitos")
+	require.NoError(t, os.WriteFile(executablePath, []byte("old release"), 0755))
+
+	daemon := Daemon{SelfUpdateURL: server.URL + "/laitos", SelfUpdatePublicKey: base64.StdEncoding.EncodeToString(publicKey)}
+	require.NoError(t, daemon.Initialise())
+	require.Equal(t, DefaultSelfUpdateCheckIntervalSec, daemon.SelfUpdateCheckIntervalSec)
+
+	// Install the new release.
+	installed, err := daemon.CheckSelfUpdate(context.Background(), executablePath)
+	require.NoError(t, err)
+	require.True(t, installed)
+	content, err := os.ReadFile(executablePath)
+	require.NoError(t, err)
+	require.Equal(t, release, content)
+	info, err := os.Stat(executablePath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	require.True(t, SelfUpdatePending(executablePath))
+	// The release is already installed.
+	installed, err = daemon.CheckSelfUpdate(context.Background(), executablePath)
+	require.NoError(t, err)
+	require.False(t, installed)
+
+	// Roll back to the old release.
+	rolledBack, err := RollbackSelfUpdate(executablePath)
+	require.NoError(t, err)
+	require.True(t, rolledBack)
+	content, err = os.ReadFile(executablePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("old release"), content)
+	require.False(t, SelfUpdatePending(executablePath))
+	// Nothing more to roll back.
+	rolledBack, err = RollbackSelfUpdate(executablePath)
+	require.NoError(t, err)
+	require.False(t, rolledBack)
+
+	// The release rolled back is not installed again.
+	installed, err = daemon.CheckSelfUpdate(context.Background(), executablePath)
+	require.NoError(t, err)
+	require.False(t, installed)
+	content, err = os.ReadFile(executablePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("old release"), content)
+
+	// Install a newer release and confirm.
+	release = []byte("newer release")
+	signature = ed25519.Sign(privateKey, release)
+	installed, err = daemon.CheckSelfUpdate(context.Background(), executablePath)
+	require.NoError(t, err)
+	require.True(t, installed)
+	require.NoError(t, ConfirmSelfUpdate(executablePath))
+	rolledBack, err = RollbackSelfUpdate(executablePath)
+	require.NoError(t, err)
+	require.False(t, rolledBack)
+
+	// A bad signature must not be installed.
+	signature = ed25519.Sign(privateKey, []byte("another release"))
+	release = []byte("tampered release")
+	_, err = daemon.CheckSelfUpdate(context.Background(), executablePath)
+	require.Error(t, err)
+	content, err = os.ReadFile(executablePath)
+	require.NoError(t, err)
+	require.Equal(t, []byte("newer release"), content)
+
+	// Reject an invalid public key.
+	daemon.SelfUpdatePublicKey = "aGVsbG8="
+	require.Error(t, daemon.Initialise())
+}
+
+func TestSelfUpdate_Window(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2020, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+	daemon := Daemon{}
+	require.True(t, daemon.inSelfUpdateWindow(at(13)))
+	daemon.SelfUpdateWindowStartHour, daemon.SelfUpdateWindowEndHour = 2, 5
+	require.False(t, daemon.inSelfUpdateWindow(at(1)))
+	require.True(t, daemon.inSelfUpdateWindow(at(2)))
+	require.True(t, daemon.inSelfUpdateWindow(at(4)))
+	require.False(t, daemon.inSelfUpdateWindow(at(5)))
+	daemon.SelfUpdateWindowStartHour, daemon.SelfUpdateWindowEndHour = 23, 2
+	require.True(t, daemon.inSelfUpdateWindow(at(23)))
+	require.True(t, daemon.inSelfUpdateWindow(at(0)))
+	require.False(t, daemon.inSelfUpdateWindow(at(2)))
+	require.False(t, daemon.inSelfUpdateWindow(at(12)))
+}
@@ -2,6 +2,7 @@ package maintenance
 
 import (
 	"bytes"
+	"context"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -18,22 +19,23 @@ const (
 	SwapFilePath = "/laitos-swap-file"
 )
 
-// SynchroniseSystemClock uses three different tools to immediately synchronise system clock via NTP servers.
+// SynchroniseSystemClock queries NTP servers and corrects the system clock using the built-in SNTP client.
 func (daemon *Daemon) SynchroniseSystemClock(out *bytes.Buffer) {
 	daemon.logPrintStage(out, "synchronise clock")
-	if platform.HostIsWindows() {
-		result, err := platform.InvokeProgram(nil, 120, `C:\Windows\system32\w32tm.exe`, "/config", `/manualpeerlist:"0.pool.ntp.org sg.pool.ntp.org us.pool.ntp.org fi.pool.ntp.org"`, "/syncfromflags:manual", "/reliable:yes", "/update")
-		daemon.logPrintStageStep(out, "w32tm config: %v - %s", err, strings.TrimSpace(result))
-		result, err = platform.InvokeProgram(nil, 120, `C:\Windows\system32\w32tm.exe`, "/resync", "/force")
-		daemon.logPrintStageStep(out, "w32tm resync: %v - %s", err, strings.TrimSpace(result))
+	servers := daemon.NTPServers
+	if len(servers) == 0 {
+		servers = platform.DefaultNTPServers
+	}
+	offset, slewed, samples, err := platform.SynchroniseClock(context.Background(), servers)
+	for _, sample := range samples {
+		daemon.logPrintStageStep(out, "agreed: %s", sample)
+	}
+	if err != nil {
+		daemon.logPrintStageStep(out, "failed to synchronise clock (offset %v): %v", offset, err)
+	} else if slewed {
+		daemon.logPrintStageStep(out, "slewing clock by %v", offset)
 	} else {
-		// Use three tools to immediately synchronise system clock
-		result, err := platform.InvokeProgram([]string{"PATH=" + platform.CommonPATH}, 120, "ntpdate", "-4", "1.pool.ntp.org", "us.pool.ntp.org", "de.pool.ntp.org", "au.pool.ntp.org")
-		daemon.logPrintStageStep(out, "ntpdate: %v - %s", err, strings.TrimSpace(result))
-		result, err = platform.InvokeProgram([]string{"PATH=" + platform.CommonPATH}, 120, "chronyd", "-q", "pool pool.ntp.org iburst")
-		daemon.logPrintStageStep(out, "chronyd: %v - %s", err, strings.TrimSpace(result))
-		result, err = platform.InvokeProgram([]string{"PATH=" + platform.CommonPATH}, 120, "busybox", "ntpd", "-n", "-q", "-p", "2.pool.ntp.org", "-p", "uk.pool.ntp.org", "-p", "ca.pool.ntp.org", "-p", "jp.pool.ntp.org")
-		daemon.logPrintStageStep(out, "busybox ntpd: %v - %s", err, strings.TrimSpace(result))
+		daemon.logPrintStageStep(out, "stepped clock by %v", offset)
 	}
 	daemon.CorrectStartupTime(out)
 }
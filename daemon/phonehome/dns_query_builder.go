@@ -2,6 +2,7 @@ package phonehome
 
 import (
 	"bytes"
+	"strings"
 
 	"github.com/HouzuoGuo/laitos/daemon/dnsd"
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -55,17 +56,40 @@ with DTMF encoded sequences, the domain name, and the mandatory command query pr
 If necessary, the app command will be truncated to fit into the maximum length of a name query.
 */
 func GetDNSQuery(appCmd, domainName string) string {
-	encodedAppCmd := EncodeToDTMF(appCmd)
+	query, _ := buildDNSQuery(string(dnsd.ToolboxCommandPrefix), EncodeToDTMF(appCmd), domainName)
+	return query
+}
+
+/*
+GetBinaryDNSQuery constructs a DNS name ready to be queried, the name carries the password and the report in compact
+binary encoding. The least important fields of the report are left out if necessary to fit into the maximum length of
+a name query.
+*/
+func GetBinaryDNSQuery(password string, report toolbox.SubjectReportRequest, domainName string) string {
+	for numFields := toolbox.SubjectReportBinaryNumFields; ; numFields-- {
+		encoded := strings.ToLower(dnsd.BinaryCommandEncoding.EncodeToString(toolbox.EncodeBinaryReportCommand(password, report, numFields)))
+		if query, complete := buildDNSQuery(dnsd.ToolboxBinaryCommandPrefix, encoded, domainName); complete || numFields <= 1 {
+			return query
+		}
+	}
+}
+
+/*
+buildDNSQuery splits the encoded string into DNS labels, places them in between the prefix label and the domain name,
+and returns the query name. If the encoded string does not entirely fit into the name, it will be truncated and the
+function returns false.
+*/
+func buildDNSQuery(prefix, encoded, domainName string) (string, bool) {
 	var out bytes.Buffer
 
 	// Be on the safe side and avoid filling up all 253 characters of a DNS name
-	labelsCapacity := 246 - len(domainName)
-	out.WriteRune(dnsd.ToolboxCommandPrefix)
+	labelsCapacity := 246 - len(domainName) - (len(prefix) - 1)
+	out.WriteString(prefix)
 	out.WriteRune('.')
 	for {
 		// Be on the safe side and avoid filling up all 63 characters of a DNS label
 		labelLen := 60
-		if l := len(encodedAppCmd); l < labelLen {
+		if l := len(encoded); l < labelLen {
 			labelLen = l
 		}
 		if labelsCapacity < labelLen {
@@ -74,11 +98,11 @@ func GetDNSQuery(appCmd, domainName string) string {
 		if labelLen < 1 {
 			break
 		}
-		out.WriteString(encodedAppCmd[:labelLen])
+		out.WriteString(encoded[:labelLen])
 		out.WriteRune('.')
-		encodedAppCmd = encodedAppCmd[labelLen:]
+		encoded = encoded[labelLen:]
 		labelsCapacity = labelsCapacity - labelLen - 1
 	}
 	out.WriteString(domainName)
-	return out.String()
+	return out.String(), len(encoded) == 0
 }
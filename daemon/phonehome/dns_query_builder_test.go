@@ -2,10 +2,12 @@ package phonehome
 
 import (
 	"fmt"
+	"math/rand"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
@@ -76,3 +78,60 @@ func TestGetDNSQuery(t *testing.T) {
 		t.Fatal(q)
 	}
 }
+
+func TestGetBinaryDNSQuery(t *testing.T) {
+	req := toolbox.SubjectReportRequest{
+		SubjectIP:       "1.2.3.4",
+		SubjectHostName: "hzgl-dev",
+		SubjectPlatform: "linux-amd64",
+		SubjectComment:  map[string]interface{}{"Load": "0.01 0.02 0.03", "Uptime": 123456},
+		CommandRequest: toolbox.AppCommandRequest{
+			Command: "pass.s date",
+		},
+		CommandResponse: toolbox.AppCommandResponse{
+			Command:        "pass.s date",
+			ReceivedAt:     time.Unix(1234567890, 0),
+			Result:         "result 1\nresult2",
+			RunDurationSec: 321,
+		},
+	}
+	// The binary encoding should take much fewer characters than DTMF
+	dtmfEncoded := EncodeToDTMF("987654987654" + toolbox.StoreAndForwardMessageProcessorTrigger + req.SerialiseCompact())
+	binQuery := GetBinaryDNSQuery("987654987654", req, "example.com")
+	if !strings.HasPrefix(binQuery, "__.") || !strings.HasSuffix(binQuery, ".example.com") || len(binQuery) > len(dtmfEncoded)*2/3 {
+		t.Fatal(binQuery, dtmfEncoded)
+	}
+	labels := strings.Split(strings.TrimSuffix(binQuery, ".example.com"), ".")
+	decoded, err := dnsd.DecodeBinaryCommandInput(labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "987654987654" + toolbox.StoreAndForwardMessageProcessorTrigger + req.SerialiseCompact(); decoded != want {
+		t.Fatalf("\n%q\n%q", decoded, want)
+	}
+	// Letter case randomised by a resolver must not matter
+	labels = strings.Split(strings.ToUpper(strings.TrimSuffix(binQuery, ".example.com")), ".")
+	labels[0] = dnsd.ToolboxBinaryCommandPrefix
+	if decodedUpper, err := dnsd.DecodeBinaryCommandInput(labels); err != nil || decodedUpper != decoded {
+		t.Fatal(err, decodedUpper)
+	}
+
+	// Leave out the least important fields of an oversized report
+	req.SubjectComment = fmt.Sprint(rand.New(rand.NewSource(0)).Perm(300))
+	req.CommandResponse.Result = "short result"
+	binQuery = GetBinaryDNSQuery("987654987654", req, "example.com")
+	if len(binQuery) > 253 {
+		t.Fatal(len(binQuery))
+	}
+	decoded, err = dnsd.DecodeBinaryCommandInput(strings.Split(strings.TrimSuffix(binQuery, ".example.com"), "."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decodedReport toolbox.SubjectReportRequest
+	if err := decodedReport.DeserialiseFromCompact(strings.TrimPrefix(decoded, "987654987654"+toolbox.StoreAndForwardMessageProcessorTrigger)); err != toolbox.ErrSubjectReportTruncated {
+		t.Fatal(err)
+	}
+	if decodedReport.SubjectHostName != "hzgl-dev" || decodedReport.CommandResponse.Result != "short result" || decodedReport.SubjectPlatform != "linux-amd64" {
+		t.Fatalf("%+v", decodedReport)
+	}
+}
@@ -22,6 +22,20 @@ import (
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
+const (
+	// DNSEncodingDTMF encodes the numbers and symbols of a report in DTMF sequences.
+	DNSEncodingDTMF = "dtmf"
+	// DNSEncodingBinary encodes a report in compressed binary and then base32.
+	DNSEncodingBinary = "binary"
+
+	// DefaultMaxOfflineReports is the default maximum number of reports buffered while all servers are unreachable.
+	DefaultMaxOfflineReports = 500
+	// OfflineReportFlushBatch is the maximum number of buffered reports forwarded to a server in one go.
+	OfflineReportFlushBatch = 10
+	// OfflineReportFlushIntervalSec is the interval between forwarding buffered reports, it helps to stay clear of server's rate limit.
+	OfflineReportFlushIntervalSec = 1
+)
+
 /*
 MessageProcessorServer contains server and password password configuration. If the server has an HTTP Endpoint URL,
 the report will be sent via an HTTP client. Otherwise if the server has a DNS domain name, the report will be sent
@@ -38,8 +52,19 @@ type MessageProcessorServer struct {
 		If this is set, then HTTPEndpointURL will be ignored.
 	*/
 	DNSDomainName string `json:"DNSDomainName"`
+	/*
+		DNSEncoding is the encoding of reports sent via DNS queries, it is either DNSEncodingDTMF (default) or
+		DNSEncodingBinary. The binary encoding is much more compact, it requires the server to run the same or a newer
+		version of laitos.
+	*/
+	DNSEncoding string `json:"DNSEncoding"`
 	// Password is the password PIN that the server accepts for command execution.
 	Passwords []string `json:"Passwords"`
+	/*
+		EncryptionKey (optional) is the key shared with the server, which uses the same key among its message processor's
+		SubjectKeys. The app commands and command results exchanged with the server are encrypted end-to-end using the key.
+	*/
+	EncryptionKey string `json:"EncryptionKey"`
 	// HostName is the host name portion of server app command execution URL, it is calculated by Initialise function.
 	HostName string `json:"-"`
 }
@@ -55,13 +80,28 @@ type Daemon struct {
 	// ReportIntervalSec is the interval in seconds at which this daemon reports to the servers.
 	ReportIntervalSec int `json:"ReportIntervalSec"`
 
+	/*
+		OfflineReportFile (optional) is the path to an encrypted file that buffers the reports made while all servers are
+		unreachable. The buffered reports are forwarded in the order they were made as soon as a server becomes
+		reachable again.
+	*/
+	OfflineReportFile string `json:"OfflineReportFile"`
+	// OfflineReportPassphrase is used to derive the encryption key of the offline report file.
+	OfflineReportPassphrase string `json:"OfflineReportPassphrase"`
+	// MaxOfflineReports is the maximum number of reports kept in the offline report file, the oldest reports are discarded first.
+	MaxOfflineReports int `json:"MaxOfflineReports"`
+
 	// LocalMessageProcessor answers to servers' app command requests
 	LocalMessageProcessor *toolbox.MessageProcessor `json:"-"`
 	// cmdProcessor runs app commands coming in from a store&forward message processor server.
 	Processor *toolbox.CommandProcessor `json:"-"`
 
-	cancelFunc context.CancelFunc
-	logger     *lalog.Logger
+	// offlineReports buffers the reports made while all servers are unreachable, it is nil if the buffer is not configured.
+	offlineReports *misc.EncryptedKVStore
+	// unreachableStreak is the number of consecutive failed attempts at sending a report.
+	unreachableStreak int
+	cancelFunc        context.CancelFunc
+	logger            *lalog.Logger
 }
 
 // Initialise validates the daemon configuration and initalises internal states.
@@ -81,15 +121,7 @@ func (daemon *Daemon) Initialise() error {
 			return fmt.Errorf("phonehome.Initialise: %+v", errs)
 		}
 	}
-	// There is no point in keeping many app command exchange reports in memory
-	daemon.LocalMessageProcessor = &toolbox.MessageProcessor{
-		OwnerName:             "phonehome-internal-tracking",
-		MaxReportsPerHostName: 10,
-		CmdProcessor:          daemon.Processor,
-	}
-	if err := daemon.LocalMessageProcessor.Initialise(); err != nil {
-		return fmt.Errorf("phonehome.Initialise: failed to initialise local message processor - %v", err)
-	}
+	serverKeys := make(map[string]string)
 	for _, srv := range daemon.MessageProcessorServers {
 		if srv.DNSDomainName == "" && srv.HTTPEndpointURL == "" {
 			return fmt.Errorf("phonehome.Initialise: a server configuration is missing both DNSDomainName and HTTPEndpointURL")
@@ -97,6 +129,13 @@ func (daemon *Daemon) Initialise() error {
 		if len(srv.Passwords) == 0 {
 			return fmt.Errorf("phonehome.Initialise: server configuration for %s must contain one or more app command execution password", srv.DNSDomainName+srv.HTTPEndpointURL)
 		}
+		switch srv.DNSEncoding {
+		case "":
+			srv.DNSEncoding = DNSEncodingDTMF
+		case DNSEncodingDTMF, DNSEncodingBinary:
+		default:
+			return fmt.Errorf("phonehome.Initialise: DNSEncoding of %s must be either %q or %q", srv.DNSDomainName+srv.HTTPEndpointURL, DNSEncodingDTMF, DNSEncodingBinary)
+		}
 		srv.HostName = srv.DNSDomainName
 		if srv.HTTPEndpointURL != "" {
 			// Calculate the host name portion of each URL, the host name is used by the local message processor.
@@ -106,6 +145,30 @@ func (daemon *Daemon) Initialise() error {
 			}
 			srv.HostName = u.Hostname()
 		}
+		if srv.EncryptionKey != "" {
+			serverKeys[srv.HostName] = srv.EncryptionKey
+		}
+	}
+	// There is no point in keeping many app command exchange reports in memory
+	daemon.LocalMessageProcessor = &toolbox.MessageProcessor{
+		OwnerName:             "phonehome-internal-tracking",
+		MaxReportsPerHostName: 10,
+		CmdProcessor:          daemon.Processor,
+		// The local message processor tracks the command exchange with each server under the server's host name
+		SubjectKeys: serverKeys,
+	}
+	if err := daemon.LocalMessageProcessor.Initialise(); err != nil {
+		return fmt.Errorf("phonehome.Initialise: failed to initialise local message processor - %v", err)
+	}
+	daemon.offlineReports = nil
+	if daemon.OfflineReportFile != "" {
+		if daemon.MaxOfflineReports < 1 {
+			daemon.MaxOfflineReports = DefaultMaxOfflineReports
+		}
+		daemon.offlineReports = &misc.EncryptedKVStore{FilePath: daemon.OfflineReportFile, Passphrase: daemon.OfflineReportPassphrase}
+		if err := daemon.offlineReports.Initialise(); err != nil {
+			return fmt.Errorf("phonehome.Initialise: failed to initialise offline report buffer - %w", err)
+		}
 	}
 	daemon.logger = &lalog.Logger{ComponentName: "phonehome"}
 	return nil
@@ -132,29 +195,141 @@ func (daemon *Daemon) getTwoFACode(server *MessageProcessorServer) string {
 	return cmdPassword1 + cmdPassword2
 }
 
-func (daemon *Daemon) getReportForServer(serverHostName string, shortenMyHostName bool) string {
-	// Ask local message processor for a pending app command request and/or app command response
-	cmdExchange := daemon.LocalMessageProcessor.StoreReport(context.Background(), toolbox.SubjectReportRequest{SubjectHostName: serverHostName}, serverHostName, "getReportForServer")
-	// Craft the report for this server
+// getStatusReport returns a report of the program status, which does not carry an app command exchange.
+func (daemon *Daemon) getStatusReport() toolbox.SubjectReportRequest {
 	hostname, _ := os.Hostname()
-	if shortenMyHostName && len(hostname) > 16 {
-		// Shorten the host name for a report transmitted via DNS. Length of 16 looks familiar to the nostalgic NetBIOS users.
-		hostname = hostname[:16]
-	}
-	report := toolbox.SubjectReportRequest{
+	return toolbox.SubjectReportRequest{
 		SubjectIP:       inet.GetPublicIP().String(),
 		SubjectHostName: strings.ToLower(hostname),
 		SubjectPlatform: fmt.Sprintf("%s-%s", runtime.GOOS, runtime.GOARCH),
 		SubjectComment:  platform.GetProgramStatusSummary(true),
-		CommandRequest:  cmdExchange.CommandRequest,
-		CommandResponse: cmdExchange.CommandResponse,
 	}
-	return report.SerialiseCompact()
+}
+
+func (daemon *Daemon) getReportForServer(serverHostName string) toolbox.SubjectReportRequest {
+	// Ask local message processor for a pending app command request and/or app command response
+	cmdExchange := daemon.LocalMessageProcessor.StoreReport(context.Background(), toolbox.SubjectReportRequest{SubjectHostName: serverHostName}, serverHostName, "getReportForServer")
+	// Craft the report for this server
+	report := daemon.getStatusReport()
+	report.CommandRequest = cmdExchange.CommandRequest
+	report.CommandResponse = cmdExchange.CommandResponse
+	return report
+}
+
+// sendReport sends the report to the server and returns the server's JSON response.
+func (daemon *Daemon) sendReport(srv *MessageProcessorServer, report toolbox.SubjectReportRequest, round int) ([]byte, error) {
+	if srv.DNSDomainName != "" {
+		// Send the report via DNS name query
+		if len(report.SubjectHostName) > 16 {
+			// Shorten the host name for a report transmitted via DNS. Length of 16 looks familiar to the nostalgic NetBIOS users.
+			report.SubjectHostName = report.SubjectHostName[:16]
+		}
+		var query string
+		if srv.DNSEncoding == DNSEncodingBinary {
+			query = GetBinaryDNSQuery(daemon.getTwoFACode(srv), report, srv.DNSDomainName)
+		} else {
+			query = GetDNSQuery(daemon.getTwoFACode(srv)+toolbox.StoreAndForwardMessageProcessorTrigger+report.SerialiseCompact(), srv.DNSDomainName)
+		}
+		queryResponse, err := net.LookupTXT(query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to send DNS request - %w", err)
+		}
+		return []byte(strings.Join(queryResponse, "")), nil
+	}
+	// Send the report via HTTP client
+	reportCmd := daemon.getTwoFACode(srv) + toolbox.StoreAndForwardMessageProcessorTrigger + report.SerialiseCompact()
+	resp, err := inet.DoHTTP(context.Background(), inet.HTTPRequest{
+		TimeoutSec: 15,
+		MaxBytes:   platform.MaxExternalProgramOutputBytes,
+		Method:     http.MethodPost,
+		Body:       strings.NewReader(url.Values{"cmd": {reportCmd}}.Encode()),
+		// In the even rounds, use the neutral & public recursive DNS resolver.
+		// In the odd rounds, use the DNS resolvers from host system.
+		UseNeutralDNSResolver: round%2 == 0,
+	}, srv.HTTPEndpointURL)
+	if err == nil {
+		err = resp.Non2xxToError()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to send HTTP request - %w", err)
+	}
+	return resp.Body, nil
+}
+
+// processReportResponse passes the app command request from the server's JSON response to the local message processor.
+func (daemon *Daemon) processReportResponse(ctx context.Context, srv *MessageProcessorServer, reportResponseJSON []byte, logTag string) {
+	// Deserialise the server JSON response and pass it to local message processor to process the command request
+	var reportResponse toolbox.SubjectReportResponse
+	if err := json.Unmarshal(reportResponseJSON, &reportResponse); err != nil {
+		daemon.logger.Info(srv.DNSDomainName+srv.HTTPEndpointURL, nil, "failed to deserialise JSON report response - %s", string(reportResponseJSON))
+		return
+	}
+	daemon.LocalMessageProcessor.StoreReport(ctx, toolbox.SubjectReportRequest{
+		SubjectHostName: srv.HostName,
+		ServerTime:      time.Time{},
+		CommandRequest:  reportResponse.CommandRequest,
+		CommandResponse: reportResponse.CommandResponse,
+	}, srv.HostName, logTag)
+}
+
+// bufferOfflineReport saves a status report in the offline report file, and discards the oldest reports beyond the capacity.
+func (daemon *Daemon) bufferOfflineReport() {
+	serialised, err := json.Marshal(daemon.getStatusReport())
+	if err != nil {
+		daemon.logger.Warning("", err, "failed to serialise offline report")
+		return
+	}
+	// The zero-padded timestamp keys sort in the order the reports were made
+	if err := daemon.offlineReports.Put(fmt.Sprintf("%020d", time.Now().UnixNano()), string(serialised)); err != nil {
+		daemon.logger.Warning("", err, "failed to buffer offline report")
+		return
+	}
+	keys := daemon.offlineReports.Keys()
+	for ; len(keys) > daemon.MaxOfflineReports; keys = keys[1:] {
+		if _, err := daemon.offlineReports.Delete(keys[0]); err != nil {
+			daemon.logger.Warning("", err, "failed to discard the oldest offline report")
+			return
+		}
+	}
+	daemon.logger.Info("", nil, "all servers are unreachable, %d reports are now buffered", len(keys))
+}
+
+// flushOfflineReports forwards a batch of buffered reports to the server in the order they were made, and stops at the first failure.
+func (daemon *Daemon) flushOfflineReports(ctx context.Context, srv *MessageProcessorServer, round int) {
+	keys := daemon.offlineReports.Keys()
+	if len(keys) > OfflineReportFlushBatch {
+		keys = keys[:OfflineReportFlushBatch]
+	}
+	for _, key := range keys {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(OfflineReportFlushIntervalSec * time.Second):
+		}
+		serialised, _ := daemon.offlineReports.Get(key)
+		var report toolbox.SubjectReportRequest
+		if err := json.Unmarshal([]byte(serialised), &report); err != nil {
+			daemon.logger.Warning(key, err, "discarding malformed offline report")
+			_, _ = daemon.offlineReports.Delete(key)
+			continue
+		}
+		reportResponseJSON, err := daemon.sendReport(srv, report, round)
+		if err != nil {
+			daemon.logger.Warning(srv.DNSDomainName+srv.HTTPEndpointURL, err, "failed to forward offline report")
+			return
+		}
+		if _, err := daemon.offlineReports.Delete(key); err != nil {
+			daemon.logger.Warning(key, err, "failed to remove forwarded offline report")
+			return
+		}
+		daemon.processReportResponse(ctx, srv, reportResponseJSON, fmt.Sprintf("round%d#offline", round))
+	}
 }
 
 // StartAndBlock starts the periodic reports and blocks caller until the daemon is stopped.
 func (daemon *Daemon) StartAndBlock() error {
 	daemon.logger.Info("", nil, "reporting to %d servers", len(daemon.MessageProcessorServers))
+	daemon.unreachableStreak = 0
 	periodicFunc := func(ctx context.Context, round, i int) error {
 		select {
 		case <-ctx.Done():
@@ -162,46 +337,21 @@ func (daemon *Daemon) StartAndBlock() error {
 		default:
 		}
 		srv := daemon.MessageProcessorServers[i]
-		var reportResponseJSON []byte
-		if srv.DNSDomainName != "" {
-			// Send the latest report via DNS name query
-			reportCmd := daemon.getTwoFACode(srv) + toolbox.StoreAndForwardMessageProcessorTrigger + daemon.getReportForServer(srv.HostName, true)
-			queryResponse, err := net.LookupTXT(GetDNSQuery(reportCmd, srv.DNSDomainName))
-			if err != nil {
-				daemon.logger.Warning(srv.DNSDomainName, err, "failed to send DNS request")
-				return nil
-			}
-			reportResponseJSON = []byte(strings.Join(queryResponse, ""))
-		} else if srv.HTTPEndpointURL != "" {
-			// Send the latest report via HTTP client
-			reportCmd := daemon.getTwoFACode(srv) + toolbox.StoreAndForwardMessageProcessorTrigger + daemon.getReportForServer(srv.HostName, false)
-			resp, err := inet.DoHTTP(context.Background(), inet.HTTPRequest{
-				TimeoutSec: 15,
-				MaxBytes:   platform.MaxExternalProgramOutputBytes,
-				Method:     http.MethodPost,
-				Body:       strings.NewReader(url.Values{"cmd": {reportCmd}}.Encode()),
-				// In the even rounds, use the neutral & public recursive DNS resolver.
-				// In the odd rounds, use the DNS resolvers from host system.
-				UseNeutralDNSResolver: round%2 == 0,
-			}, srv.HTTPEndpointURL)
-			if err != nil {
-				daemon.logger.Warning(srv.HTTPEndpointURL, err, "failed to send HTTP request")
-				return nil
+		reportResponseJSON, err := daemon.sendReport(srv, daemon.getReportForServer(srv.HostName), round)
+		if err != nil {
+			daemon.logger.Warning(srv.DNSDomainName+srv.HTTPEndpointURL, err, "failed to send report")
+			// Buffer a report after every server has failed to receive a report in a row
+			daemon.unreachableStreak++
+			if daemon.offlineReports != nil && daemon.unreachableStreak%len(daemon.MessageProcessorServers) == 0 {
+				daemon.bufferOfflineReport()
 			}
-			reportResponseJSON = resp.Body
-		}
-		// Deserialise the server JSON response and pass it to local message processor to process the command request
-		var reportResponse toolbox.SubjectReportResponse
-		if err := json.Unmarshal(reportResponseJSON, &reportResponse); err != nil {
-			daemon.logger.Info(srv.DNSDomainName+srv.HTTPEndpointURL, nil, "failed to deserialise JSON report response - %s", string(reportResponseJSON))
 			return nil
 		}
-		daemon.LocalMessageProcessor.StoreReport(ctx, toolbox.SubjectReportRequest{
-			SubjectHostName: srv.HostName,
-			ServerTime:      time.Time{},
-			CommandRequest:  reportResponse.CommandRequest,
-			CommandResponse: reportResponse.CommandResponse,
-		}, srv.HostName, fmt.Sprintf("round%d#%d", round, i))
+		daemon.unreachableStreak = 0
+		daemon.processReportResponse(ctx, srv, reportResponseJSON, fmt.Sprintf("round%d#%d", round, i))
+		if daemon.offlineReports != nil {
+			daemon.flushOfflineReports(ctx, srv, round)
+		}
 		return nil
 	}
 	/*
@@ -1,10 +1,20 @@
 package phonehome
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/platform"
 	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPhoneHomeDaemon(t *testing.T) {
@@ -17,8 +27,91 @@ func TestPhoneHomeDaemon(t *testing.T) {
 		t.Fatal(err)
 	}
 	daemon.Processor = toolbox.GetTestCommandProcessor()
-	if err := daemon.Initialise(); err != nil {
+	daemon.MessageProcessorServers[0].DNSEncoding = "base64"
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "DNSEncoding") {
+		t.Fatal(err)
+	}
+	daemon.MessageProcessorServers[0].DNSEncoding = ""
+	if err := daemon.Initialise(); err != nil || daemon.MessageProcessorServers[0].DNSEncoding != DNSEncodingDTMF {
 		t.Fatal(err)
 	}
 	TestServer(&daemon, t)
 }
+
+func TestPhoneHomeDaemon_OfflineReports(t *testing.T) {
+	// The server rejects reports until it becomes reachable.
+	var mutex sync.Mutex
+	reachable := false
+	var received []toolbox.SubjectReportRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !reachable {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		cmd := r.FormValue("cmd")
+		var report toolbox.SubjectReportRequest
+		require.NoError(t, report.DeserialiseFromCompact(cmd[strings.Index(cmd, toolbox.StoreAndForwardMessageProcessorTrigger)+len(toolbox.StoreAndForwardMessageProcessorTrigger):]))
+		received = append(received, report)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	offlineFile := filepath.Join(t.TempDir(), "offline-reports")
+	daemon := Daemon{
+		MessageProcessorServers: []*MessageProcessorServer{{Passwords: []string{toolbox.TestCommandProcessorPIN}, HTTPEndpointURL: server.URL}},
+		ReportIntervalSec:       1,
+		OfflineReportFile:       offlineFile,
+		MaxOfflineReports:       2,
+		Processor:               toolbox.GetTestCommandProcessor(),
+	}
+	require.ErrorContains(t, daemon.Initialise(), "offline report")
+	daemon.OfflineReportPassphrase = "offline-passphrase"
+	require.NoError(t, daemon.Initialise())
+	// Retrieve and cache the public IP ahead of the timing sensitive test
+	inet.GetPublicIP()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- daemon.StartAndBlock()
+	}()
+
+	// Reports are buffered while the server is unreachable, the oldest reports are discarded beyond the capacity.
+	var oldestKey string
+	require.Eventually(t, func() bool {
+		keys := daemon.offlineReports.Keys()
+		if len(keys) == 2 {
+			oldestKey = keys[0]
+			return true
+		}
+		return false
+	}, 30*time.Second, 100*time.Millisecond)
+	require.Eventually(t, func() bool {
+		keys := daemon.offlineReports.Keys()
+		return len(keys) == 2 && keys[0] != oldestKey
+	}, 30*time.Second, 100*time.Millisecond)
+	content, err := os.ReadFile(offlineFile)
+	require.NoError(t, err)
+	require.NotContains(t, string(content), "SubjectHostName")
+
+	// The buffered reports are forwarded in order after the latest report once the server becomes reachable.
+	mutex.Lock()
+	reachable = true
+	mutex.Unlock()
+	require.Eventually(t, func() bool {
+		return len(daemon.offlineReports.Keys()) == 0
+	}, 10*time.Second, 100*time.Millisecond)
+	daemon.Stop()
+	require.ErrorIs(t, <-stopped, context.Canceled)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.GreaterOrEqual(t, len(received), 3)
+	var clockTimes []time.Time
+	for _, report := range received[:3] {
+		var comment platform.ProgramStatusSummary
+		require.NoError(t, comment.DeserialiseFromJSON(report.SubjectComment))
+		clockTimes = append(clockTimes, comment.ClockTime)
+	}
+	require.True(t, clockTimes[1].Before(clockTimes[2]) && clockTimes[2].Before(clockTimes[0]), clockTimes)
+}
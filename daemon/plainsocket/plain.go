@@ -36,6 +36,7 @@ type Daemon struct {
 	Address    string                    `json:"Address"`    // Network address for both TCP and UDP to listen to, e.g. 0.0.0.0 for all network interfaces.
 	TCPPort    int                       `json:"TCPPort"`    // TCP port to listen on
 	UDPPort    int                       `json:"UDPPort"`    // UDP port to listen on
+	IPVersion  string                    `json:"IPVersion"`  // IPVersion is the IP version of clients to serve - "v4", "v6", or "both" (default).
 	PerIPLimit int                       `json:"PerIPLimit"` // PerIPLimit is approximately how many concurrent users are expected to be using the server from same IP address
 	Processor  *toolbox.CommandProcessor `json:"-"`          // Feature command processor
 
@@ -52,7 +53,10 @@ func (daemon *Daemon) Initialise() error {
 		return fmt.Errorf("plainsocket.Initialise: %+v", errs)
 	}
 	if daemon.Address == "" {
-		daemon.Address = "0.0.0.0"
+		daemon.Address = common.DefaultListenAddress(daemon.IPVersion)
+	}
+	if err := common.ValidateIPVersion(daemon.IPVersion, daemon.Address); err != nil {
+		return fmt.Errorf("plainsocket.Initialise: %w", err)
 	}
 	if daemon.PerIPLimit < 1 {
 		daemon.PerIPLimit = 3 // reasonable for personal use
@@ -63,6 +67,8 @@ func (daemon *Daemon) Initialise() error {
 	}
 	daemon.tcpServer = common.NewTCPServer(daemon.Address, daemon.TCPPort, "plainsocket", daemon, daemon.PerIPLimit)
 	daemon.udpServer = common.NewUDPServer(daemon.Address, daemon.UDPPort, "plainsocket", daemon, daemon.PerIPLimit)
+	daemon.tcpServer.IPVersion = daemon.IPVersion
+	daemon.udpServer.IPVersion = daemon.IPVersion
 	return nil
 }
 
@@ -108,6 +114,10 @@ func (daemon *Daemon) HandleTCPConnection(logger *lalog.Logger, ip string, conn
 			Content:    string(line),
 			TimeoutSec: CommandTimeoutSec,
 		}, true)
+		if result.Error == toolbox.ErrPINAndShortcutNotFound {
+			common.TCPConnections.RecordHandshakeFailure("plainsocket", ip, "incorrect PIN or shortcut")
+		}
+		common.TCPConnections.AddBytes(ip, int64(len(line)), int64(len(result.CombinedOutput)+2))
 		if err := conn.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second)); err != nil {
 			return
 		} else if _, err := conn.Write([]byte(result.CombinedOutput)); err != nil {
@@ -215,7 +225,7 @@ func TestServer(server *Daemon, t testingstub.T) {
 	}
 
 	// Prepare for TCP conversations
-	tcpClient, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(server.TCPPort))
+	tcpClient, err := net.Dial("tcp", net.JoinHostPort(common.LoopbackAddress(server.IPVersion), strconv.Itoa(server.TCPPort)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -249,7 +259,7 @@ func TestServer(server *Daemon, t testingstub.T) {
 	}
 
 	// Prepare for UDP conversations
-	udpClient, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(server.UDPPort))
+	udpClient, err := net.Dial("udp", net.JoinHostPort(common.LoopbackAddress(server.IPVersion), strconv.Itoa(server.UDPPort)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -9,6 +9,7 @@ package simpleipsvcd
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"net"
 	"strconv"
@@ -33,6 +34,7 @@ type Daemon struct {
 	ActiveUsersPort int    `json:"ActiveUsersPort"` // ActiveUsersPort is the port number (TCP and UDP) to listen on for the sysstat (active user names) service.
 	DayTimePort     int    `json:"DayTimePort"`     // DayTimePort is the port number (TCP and UDP) to listen on for the daytime service.
 	QOTDPort        int    `json:"QOTDPort"`        // QOTDPort is the port number (TCP and UDP) to listen on for the QOTD service.
+	IPVersion       string `json:"IPVersion"`       // IPVersion is the IP version of clients to serve - "v4", "v6", or "both" (default).
 	PerIPLimit      int    `json:"PerIPLimit"`      // PerIPLimit is approximately how many requests are allowed from an IP within a designated interval.
 	ActiveUserNames string `json:"ActiveUserNames"` // ActiveUserNames are CRLF-separated list of user names to appear in the response of "sysstat" network service.
 	QOTD            string `json:"QOTD"`            // QOTD is the message to appear in the response of "QOTD" network service.
@@ -48,7 +50,10 @@ type Daemon struct {
 // Initialise validates configuration and initialises internal states.
 func (daemon *Daemon) Initialise() error {
 	if daemon.Address == "" {
-		daemon.Address = "0.0.0.0"
+		daemon.Address = common.DefaultListenAddress(daemon.IPVersion)
+	}
+	if err := common.ValidateIPVersion(daemon.IPVersion, daemon.Address); err != nil {
+		return fmt.Errorf("simpleipsvcd.Initialise: %w", err)
 	}
 	if daemon.PerIPLimit < 1 {
 		// The default is sufficient for 1 request per second on all three services via both TCP and UDP
@@ -94,6 +99,7 @@ func (daemon *Daemon) StartAndBlock() error {
 		tcpServer := &common.TCPServer{
 			ListenAddr:  daemon.Address,
 			ListenPort:  port,
+			IPVersion:   daemon.IPVersion,
 			AppName:     "simpleipsvc",
 			App:         &TCPService{ResponseFun: daemon.serverResponseFun[port]},
 			LimitPerSec: daemon.PerIPLimit,
@@ -111,6 +117,7 @@ func (daemon *Daemon) StartAndBlock() error {
 		udpServer := &common.UDPServer{
 			ListenAddr:  daemon.Address,
 			ListenPort:  port,
+			IPVersion:   daemon.IPVersion,
 			AppName:     "simpleipsvc",
 			App:         &UDPService{ResponseFun: daemon.serverResponseFun[port]},
 			LimitPerSec: daemon.PerIPLimit,
@@ -196,7 +203,7 @@ func TestSimpleIPSvcD(daemon *Daemon, t testingstub.T) {
 	// Test each of the three services
 	for _, port := range []int{daemon.ActiveUsersPort, daemon.DayTimePort, daemon.QOTDPort} {
 		// Test TCP implementation of the service
-		tcpClient, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		tcpClient, err := net.Dial("tcp", net.JoinHostPort(common.LoopbackAddress(daemon.IPVersion), strconv.Itoa(port)))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -209,7 +216,7 @@ func TestSimpleIPSvcD(daemon *Daemon, t testingstub.T) {
 			t.Fatal(port, string(response))
 		}
 		// Test UDP implementation of the service
-		udpClient, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(port))
+		udpClient, err := net.Dial("udp", net.JoinHostPort(common.LoopbackAddress(daemon.IPVersion), strconv.Itoa(port)))
 		if err != nil {
 			t.Fatal(err)
 		}
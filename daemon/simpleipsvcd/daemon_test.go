@@ -25,3 +25,28 @@ func TestSimpleIPDaemon(t *testing.T) {
 	}
 	TestSimpleIPSvcD(daemon, t)
 }
+
+func TestSimpleIPDaemon_IPv6(t *testing.T) {
+	daemon := &Daemon{IPVersion: "v6", Address: "127.0.0.1"}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	daemon = &Daemon{IPVersion: "v6"}
+	if err := daemon.Initialise(); err != nil || daemon.Address != "::" {
+		t.Fatal(err, daemon)
+	}
+
+	daemon = &Daemon{
+		Address:         "::1",
+		IPVersion:       "v6",
+		ActiveUserNames: "howard (houzuo) guo",
+		QOTD:            "hello from howard",
+		ActiveUsersPort: 15237,
+		DayTimePort:     11674,
+		QOTDPort:        31679,
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	TestSimpleIPSvcD(daemon, t)
+}
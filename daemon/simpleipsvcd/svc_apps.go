@@ -4,6 +4,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
 )
@@ -20,9 +21,10 @@ func (svc *TCPService) GetTCPStatsCollector() *misc.Stats {
 }
 
 // HandleTCPConnection
-func (svc *TCPService) HandleTCPConnection(logger *lalog.Logger, _ string, client *net.TCPConn) {
+func (svc *TCPService) HandleTCPConnection(logger *lalog.Logger, ip string, client *net.TCPConn) {
 	logger.MaybeMinorError(client.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second)))
-	_, err := client.Write([]byte(svc.ResponseFun() + "\r\n"))
+	n, err := client.Write([]byte(svc.ResponseFun() + "\r\n"))
+	common.TCPConnections.AddBytes(ip, 0, int64(n))
 	logger.MaybeMinorError(err)
 }
 
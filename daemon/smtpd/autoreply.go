@@ -0,0 +1,194 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+const (
+	// DefaultAutoReplyIntervalSec is the default minimum interval between auto replies to the same sender, the
+	// interval of 7 days is recommended by RFC 3834.
+	DefaultAutoReplyIntervalSec = 7 * 24 * 3600
+	// MaxAutoReplySenders is the maximum number of senders to memorise for rate limiting auto replies. Once the limit is
+	// reached, auto replies are suspended until the earliest senders are forgotten.
+	MaxAutoReplySenders = 10000
+)
+
+// regexNoAutoReplySender matches the addresses of automated senders that must never receive an auto reply.
+var regexNoAutoReplySender = regexp.MustCompile(`(?i)^(mailer-daemon|postmaster|no-?reply|do-?not-?reply|bounces?|owner-.*|.*-request)[@+]`)
+
+// AutoReplyTemplateData is given to the subject and body templates of an auto reply.
+type AutoReplyTemplateData struct {
+	Sender    string // Sender is the address of the sender who receives the auto reply.
+	Recipient string // Recipient is the address of the recipient on whose behalf the auto reply is sent.
+	Subject   string // Subject is the subject of the incoming mail.
+}
+
+/*
+AutoReply responds to the incoming mails addressed to recipients of matching addresses, for example to send a vacation
+notice. Each sender receives at most one reply from the rule within the interval.
+*/
+type AutoReply struct {
+	// RecipientPattern is a case-insensitive regular expression matched against recipient addresses, e.g. "^me@example\.com$".
+	RecipientPattern string `json:"RecipientPattern"`
+	// Subject is the template of reply subject, it defaults to "Auto: " followed by the subject of the incoming mail.
+	Subject string `json:"Subject"`
+	// Body is the template of reply body in plain text.
+	Body string `json:"Body"`
+	// IntervalSec is the minimum interval between auto replies to the same sender.
+	IntervalSec int `json:"IntervalSec"`
+
+	recipientRegex  *regexp.Regexp
+	subjectTemplate *template.Template
+	bodyTemplate    *template.Template
+}
+
+// Initialise validates the rule and prepares its templates.
+func (rule *AutoReply) Initialise() (err error) {
+	if rule.RecipientPattern == "" || rule.Body == "" {
+		return fmt.Errorf("AutoReply.Initialise: RecipientPattern and Body must be present")
+	}
+	if rule.recipientRegex, err = regexp.Compile("(?i)" + rule.RecipientPattern); err != nil {
+		return fmt.Errorf("AutoReply.Initialise: failed to compile recipient pattern \"%s\" - %w", rule.RecipientPattern, err)
+	}
+	if rule.Subject == "" {
+		rule.Subject = "Auto: {{.Subject}}"
+	}
+	if rule.subjectTemplate, err = template.New("subject").Parse(rule.Subject); err != nil {
+		return fmt.Errorf("AutoReply.Initialise: failed to parse subject template - %w", err)
+	}
+	if rule.bodyTemplate, err = template.New("body").Parse(rule.Body); err != nil {
+		return fmt.Errorf("AutoReply.Initialise: failed to parse body template - %w", err)
+	}
+	if rule.IntervalSec < 1 {
+		rule.IntervalSec = DefaultAutoReplyIntervalSec
+	}
+	return nil
+}
+
+// BuildMessage returns the reply mail message sent from recipient to sender, in response to the incoming mail.
+func (rule *AutoReply) BuildMessage(sender, recipient string, incoming inet.BasicMail, messageID string) ([]byte, error) {
+	data := AutoReplyTemplateData{Sender: sender, Recipient: recipient, Subject: incoming.Subject}
+	var subject, body bytes.Buffer
+	if err := rule.subjectTemplate.Execute(&subject, data); err != nil {
+		return nil, fmt.Errorf("AutoReply.BuildMessage: failed to render subject - %w", err)
+	}
+	if err := rule.bodyTemplate.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("AutoReply.BuildMessage: failed to render body - %w", err)
+	}
+	// Header values must not break out of their line
+	headerValue := strings.NewReplacer("\r", " ", "\n", " ").Replace
+	var msg bytes.Buffer
+	msg.WriteString("MIME-Version: 1.0\r\nContent-type: text/plain; charset=utf-8\r\n")
+	msg.WriteString(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n", headerValue(recipient), headerValue(sender), headerValue(subject.String())))
+	msg.WriteString("Auto-Submitted: auto-replied\r\n")
+	if messageID != "" {
+		msg.WriteString(fmt.Sprintf("In-Reply-To: %s\r\nReferences: %s\r\n", headerValue(messageID), headerValue(messageID)))
+	}
+	msg.WriteString("\r\n")
+	msg.WriteString(body.String())
+	return msg.Bytes(), nil
+}
+
+/*
+isAutomatedMail returns true if the mail is sent by an automated sender or a mailing list, in which case an auto reply
+must not be sent, as recommended by RFC 3834.
+*/
+func (daemon *Daemon) isAutomatedMail(sender string, headers map[string]string) bool {
+	if sender == "" || regexNoAutoReplySender.MatchString(sender) {
+		return true
+	}
+	if atSign := strings.LastIndexByte(sender, '@'); atSign == -1 {
+		return true
+	} else if _, isMine := daemon.myDomainsHash[strings.ToLower(sender[atSign+1:])]; isMine {
+		// Do not reply to myself to avoid loops
+		return true
+	}
+	if autoSubmitted := strings.ToLower(headers["Auto-Submitted"]); autoSubmitted != "" && autoSubmitted != "no" {
+		return true
+	}
+	switch strings.ToLower(headers["Precedence"]) {
+	case "bulk", "list", "junk":
+		return true
+	}
+	return headers["List-Id"] != "" || headers["List-Unsubscribe"] != ""
+}
+
+/*
+allowAutoReply returns true if the sender has not received an auto reply from the rule within the rule's interval, and
+memorises the time at which the sender may receive the next reply.
+*/
+func (daemon *Daemon) allowAutoReply(ruleIndex int, sender string, now time.Time) bool {
+	daemon.autoReplyMutex.Lock()
+	defer daemon.autoReplyMutex.Unlock()
+	key := fmt.Sprintf("%d %s", ruleIndex, strings.ToLower(sender))
+	if notBefore, exists := daemon.autoReplyNotBefore[key]; exists && now.Before(notBefore) {
+		return false
+	}
+	if len(daemon.autoReplyNotBefore) >= MaxAutoReplySenders {
+		// Forget the senders whose interval has elapsed
+		for existingKey, notBefore := range daemon.autoReplyNotBefore {
+			if !now.Before(notBefore) {
+				delete(daemon.autoReplyNotBefore, existingKey)
+			}
+		}
+		if len(daemon.autoReplyNotBefore) >= MaxAutoReplySenders {
+			return false
+		}
+	}
+	daemon.autoReplyNotBefore[key] = now.Add(time.Duration(daemon.AutoReplies[ruleIndex].IntervalSec) * time.Second)
+	return true
+}
+
+/*
+ReplyAutomatically sends an auto reply to the sender of an incoming mail, using the first rule that matches one of the
+recipients. The reply is sent on behalf of the matching recipient, and at most one reply is sent for each incoming mail.
+*/
+func (daemon *Daemon) ReplyAutomatically(fromAddr string, toAddrs []string, mailBody string) {
+	if len(daemon.AutoReplies) == 0 {
+		return
+	}
+	prop, parsedMail, err := inet.ReadMailMessage([]byte(mailBody))
+	if err != nil {
+		daemon.logger.Info(fromAddr, err, "failed to parse mail for auto reply")
+		return
+	}
+	headers := make(map[string]string)
+	for _, name := range []string{"Auto-Submitted", "Precedence", "List-Id", "List-Unsubscribe", "Message-Id"} {
+		headers[name] = strings.TrimSpace(parsedMail.Header.Get(name))
+	}
+	if daemon.isAutomatedMail(fromAddr, headers) {
+		return
+	}
+	for _, toAddr := range toAddrs {
+		for i, rule := range daemon.AutoReplies {
+			if !rule.recipientRegex.MatchString(toAddr) {
+				continue
+			}
+			if !daemon.allowAutoReply(i, fromAddr, time.Now()) {
+				daemon.logger.Info(fromAddr, nil, "skipped auto reply on behalf of %s because the sender received one recently", toAddr)
+				return
+			}
+			reply, err := rule.BuildMessage(fromAddr, toAddr, prop, headers["Message-Id"])
+			if err != nil {
+				daemon.logger.Warning(fromAddr, err, "failed to construct auto reply")
+				return
+			}
+			if daemon.autoReplyTestCaseFunc != nil {
+				daemon.autoReplyTestCaseFunc(fromAddr, string(reply))
+			}
+			if err := daemon.ForwardMailClient.SendRaw(toAddr, reply, fromAddr); err == nil {
+				daemon.logger.Info(fromAddr, nil, "sent auto reply on behalf of %s", toAddr)
+			} else {
+				daemon.logger.Warning(fromAddr, err, "failed to send auto reply")
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package smtpd
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoReply_Initialise(t *testing.T) {
+	require.Error(t, (&AutoReply{Body: "away"}).Initialise())
+	require.Error(t, (&AutoReply{RecipientPattern: "me@example.com"}).Initialise())
+	require.Error(t, (&AutoReply{RecipientPattern: "(", Body: "away"}).Initialise())
+	require.Error(t, (&AutoReply{RecipientPattern: "me", Body: "{{.Sender"}).Initialise())
+	rule := &AutoReply{RecipientPattern: "me", Body: "away"}
+	require.NoError(t, rule.Initialise())
+	require.Equal(t, DefaultAutoReplyIntervalSec, rule.IntervalSec)
+}
+
+func TestAutoReply_BuildMessage(t *testing.T) {
+	rule := &AutoReply{RecipientPattern: "^me@example\\.com$", Body: "Hi {{.Sender}}, {{.Recipient}} is away. Re: {{.Subject}}"}
+	require.NoError(t, rule.Initialise())
+	require.True(t, rule.recipientRegex.MatchString("ME@example.com"))
+	require.False(t, rule.recipientRegex.MatchString("me@example.company"))
+
+	reply, err := rule.BuildMessage("friend@example.org", "me@example.com", inet.BasicMail{Subject: "lunch?\r\nBcc: victim@example.org"}, "<abc@example.org>")
+	require.NoError(t, err)
+	prop, parsed, err := inet.ReadMailMessage(reply)
+	require.NoError(t, err)
+	require.Equal(t, "Auto: lunch?  Bcc: victim@example.org", prop.Subject)
+	require.Equal(t, "me@example.com", prop.FromAddress)
+	require.Equal(t, "friend@example.org", parsed.Header.Get("To"))
+	require.Equal(t, "", parsed.Header.Get("Bcc"))
+	require.Equal(t, "auto-replied", parsed.Header.Get("Auto-Submitted"))
+	require.Equal(t, "<abc@example.org>", parsed.Header.Get("In-Reply-To"))
+	require.True(t, strings.HasSuffix(string(reply), "\r\n\r\nHi friend@example.org, me@example.com is away. Re: lunch?\r\nBcc: victim@example.org"))
+}
+
+func TestDaemon_ReplyAutomatically(t *testing.T) {
+	daemon := Daemon{
+		MyDomains: []string{"example.com"},
+		AutoReplies: []*AutoReply{
+			{RecipientPattern: "^me@example\\.com$", Body: "away", IntervalSec: 3600},
+			{RecipientPattern: "@example\\.com$", Body: "catch-all"},
+		},
+		// The MTA does not exist, the test case inspects the replies instead.
+		ForwardMailClient: inet.MailClient{MailFrom: "me@example.com", MTAHost: "127.0.0.1", MTAPort: 1},
+		myDomainsHash:     map[string]struct{}{"example.com": {}},
+	}
+	for _, rule := range daemon.AutoReplies {
+		require.NoError(t, rule.Initialise())
+	}
+	daemon.autoReplyNotBefore = make(map[string]time.Time)
+	daemon.autoReplyMutex = new(sync.Mutex)
+	daemon.logger = &lalog.Logger{ComponentName: "smtpd"}
+	var replies []string
+	daemon.autoReplyTestCaseFunc = func(to, reply string) {
+		replies = append(replies, to+"|"+reply)
+	}
+	mail := "From: friend@example.org\r\nSubject: hello\r\n\r\nbody\r\n"
+
+	// Reply with the first matching rule, only once per mail
+	daemon.ReplyAutomatically("friend@example.org", []string{"other@elsewhere.com", "me@example.com", "you@example.com"}, mail)
+	require.Len(t, replies, 1)
+	require.True(t, strings.HasPrefix(replies[0], "friend@example.org|"))
+	require.True(t, strings.HasSuffix(replies[0], "\r\n\r\naway"))
+	// The sender does not receive another reply within the interval
+	daemon.ReplyAutomatically("FRIEND@example.org", []string{"me@example.com"}, mail)
+	require.Len(t, replies, 1)
+	// The other rule replies to the same sender
+	daemon.ReplyAutomatically("friend@example.org", []string{"you@example.com"}, mail)
+	require.Len(t, replies, 2)
+	require.True(t, strings.HasSuffix(replies[1], "catch-all"))
+	// The sender may receive a reply again after the interval
+	require.True(t, daemon.allowAutoReply(0, "friend@example.org", time.Now().Add(2*time.Hour)))
+
+	// Automated mails do not receive a reply
+	daemon.ReplyAutomatically("mailer-daemon@example.org", []string{"me@example.com"}, mail)
+	daemon.ReplyAutomatically("noreply@example.org", []string{"me@example.com"}, mail)
+	daemon.ReplyAutomatically("someone@example.com", []string{"me@example.com"}, mail)
+	daemon.ReplyAutomatically("", []string{"me@example.com"}, mail)
+	daemon.ReplyAutomatically("list@example.org", []string{"me@example.com"}, "From: list@example.org\r\nList-Id: <list.example.org>\r\n\r\nbody\r\n")
+	daemon.ReplyAutomatically("bulk@example.org", []string{"me@example.com"}, "From: bulk@example.org\r\nPrecedence: bulk\r\n\r\nbody\r\n")
+	daemon.ReplyAutomatically("robot@example.org", []string{"me@example.com"}, "From: robot@example.org\r\nAuto-Submitted: auto-generated\r\n\r\nbody\r\n")
+	require.Len(t, replies, 2)
+	// A human marks the mail as not auto-submitted
+	daemon.ReplyAutomatically("human@example.org", []string{"me@example.com"}, "From: human@example.org\r\nAuto-Submitted: no\r\n\r\nbody\r\n")
+	require.Len(t, replies, 3)
+}
@@ -0,0 +1,583 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// MailAuthTimeoutSec is the timeout of evaluating SPF, DKIM, and DMARC of an incoming mail.
+	MailAuthTimeoutSec = 20
+	// MaxSPFLookups is the maximum number of DNS-querying mechanisms and modifiers evaluated in an SPF check (RFC 7208 4.6.4).
+	MaxSPFLookups = 10
+
+	SPFPass      = "pass"
+	SPFFail      = "fail"
+	SPFSoftFail  = "softfail"
+	SPFNeutral   = "neutral"
+	SPFNone      = "none"
+	SPFTempError = "temperror"
+	SPFPermError = "permerror"
+
+	DMARCPass      = "pass"
+	DMARCFail      = "fail"
+	DMARCNone      = "none"
+	DMARCTempError = "temperror"
+	DMARCPermError = "permerror"
+)
+
+// mailAuthResolver looks up the DNS records required for evaluating SPF, DKIM, and DMARC. It is satisfied by *net.Resolver.
+type mailAuthResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// isDNSNotFound returns true only if the DNS lookup error says that the name or record does not exist.
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// MailAuthResult is the outcome of evaluating SPF, DKIM signatures, and DMARC policy of an incoming mail.
+type MailAuthResult struct {
+	SPF       string // SPF is the result of checking the client IP against the SPF policy of the MAIL FROM (or HELO) domain.
+	SPFDomain string // SPFDomain is the domain whose SPF policy was checked.
+	// DKIM are the results of verifying the DKIM signatures, it is empty if the mail is not signed.
+	DKIM []inet.DKIMResult
+	// DMARC is the result of evaluating the DMARC policy of the header From domain.
+	DMARC string
+	// DMARCPolicy is the policy (none, quarantine, or reject) demanded by the header From domain when DMARC fails.
+	DMARCPolicy string
+	// FromDomain is the domain name of the header From address.
+	FromDomain string
+}
+
+/*
+GetRejectionReason returns a brief reason if the mail should be rejected by a cautious mail server, or an empty string
+if the mail should be accepted. A mail is rejected if it fails DMARC verification of a domain that demands rejection,
+or if it fails SPF verification of a domain that hard-fails unauthorised senders without passing DMARC verification.
+*/
+func (result *MailAuthResult) GetRejectionReason() string {
+	if result.DMARC == DMARCFail && result.DMARCPolicy == "reject" {
+		return fmt.Sprintf("DMARC verification of %s failed", result.FromDomain)
+	}
+	if result.SPF == SPFFail && result.DMARC != DMARCPass {
+		return fmt.Sprintf("SPF verification of %s failed", result.SPFDomain)
+	}
+	return ""
+}
+
+// AuthenticationResults returns the Authentication-Results header field (RFC 8601) that records the results, including the trailing CRLF.
+func (result *MailAuthResult) AuthenticationResults(authServID string) string {
+	var ret strings.Builder
+	ret.WriteString("Authentication-Results: " + authServID + ";\r\n\tspf=" + result.SPF)
+	if result.SPFDomain != "" {
+		ret.WriteString(" smtp.mailfrom=" + result.SPFDomain)
+	}
+	if len(result.DKIM) == 0 {
+		ret.WriteString(";\r\n\tdkim=none")
+	}
+	for _, dkim := range result.DKIM {
+		ret.WriteString(";\r\n\tdkim=" + dkim.Result)
+		if dkim.Reason != "" {
+			ret.WriteString(" (" + dkim.Reason + ")")
+		}
+		if dkim.Domain != "" {
+			ret.WriteString(" header.d=" + dkim.Domain)
+		}
+		if dkim.Selector != "" {
+			ret.WriteString(" header.s=" + dkim.Selector)
+		}
+	}
+	ret.WriteString(";\r\n\tdmarc=" + result.DMARC)
+	if result.DMARCPolicy != "" {
+		ret.WriteString(" (p=" + result.DMARCPolicy + ")")
+	}
+	if result.FromDomain != "" {
+		ret.WriteString(" header.from=" + result.FromDomain)
+	}
+	ret.WriteString("\r\n")
+	return ret.String()
+}
+
+/*
+Annotate returns the mail with the Authentication-Results header field inserted at the top. The existing
+Authentication-Results header fields that claim to come from the same authentication service are removed, so that a
+sender cannot forge the results.
+*/
+func (result *MailAuthResult) Annotate(authServID, mailBody string) string {
+	// The mail received by the daemon usually uses LF line endings, while a mail released from quarantine may use CRLF.
+	lineEnding := "\n"
+	header, body, hasBody := strings.Cut(mailBody, "\n\n")
+	if crlfHeader, crlfBody, crlfHasBody := strings.Cut(mailBody, "\r\n\r\n"); crlfHasBody && (!hasBody || len(crlfHeader) < len(header)) {
+		header, body, hasBody, lineEnding = crlfHeader, crlfBody, true, "\r\n"
+	}
+	if hasBody {
+		header += lineEnding
+	}
+	var kept strings.Builder
+	var dropping bool
+	for _, line := range strings.SplitAfter(header, "\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// Continuation of a folded header field
+			if !dropping {
+				kept.WriteString(line)
+			}
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		dropping = strings.EqualFold(strings.TrimSpace(name), "Authentication-Results") &&
+			strings.HasPrefix(strings.ToLower(value), strings.ToLower(authServID)) &&
+			(len(value) == len(authServID) || strings.ContainsRune("; \t\r", rune(value[len(authServID)])))
+		if !dropping {
+			kept.WriteString(line)
+		}
+	}
+	ret := strings.ReplaceAll(result.AuthenticationResults(authServID), "\r\n", lineEnding) + kept.String()
+	if hasBody {
+		ret += lineEnding + body
+	}
+	return ret
+}
+
+/*
+AuthenticateMail evaluates SPF policy of the MAIL FROM domain (or HELO domain if MAIL FROM is empty) for the client IP,
+verifies DKIM signatures of the mail, and evaluates the DMARC policy of the header From domain.
+*/
+func (daemon *Daemon) AuthenticateMail(ctx context.Context, clientIP, heloName, fromAddr, mailBody string) *MailAuthResult {
+	result := &MailAuthResult{SPF: SPFNone, DMARC: DMARCNone}
+	// Evaluate SPF
+	_, result.SPFDomain = GetMailAddressComponents(fromAddr)
+	if result.SPFDomain == "" {
+		result.SPFDomain = heloName
+	}
+	result.SPFDomain = strings.ToLower(strings.TrimSuffix(result.SPFDomain, "."))
+	if ip := net.ParseIP(clientIP); ip != nil && result.SPFDomain != "" {
+		spf := &spfEvaluator{resolver: daemon.resolver, ip: ip, sender: fromAddr, heloName: heloName}
+		if spf.sender == "" {
+			spf.sender = "postmaster@" + heloName
+		}
+		result.SPF = spf.check(ctx, result.SPFDomain)
+	}
+	// Verify DKIM signatures
+	result.DKIM = inet.VerifyDKIM(ctx, daemon.resolver.LookupTXT, []byte(mailBody))
+	// Evaluate DMARC
+	msg, err := mail.ReadMessage(strings.NewReader(mailBody))
+	if err != nil {
+		result.DMARC = DMARCPermError
+		return result
+	}
+	fromAddrs, err := msg.Header.AddressList("From")
+	if err != nil || len(fromAddrs) != 1 {
+		// DMARC requires exactly one From address
+		result.DMARC = DMARCPermError
+		return result
+	}
+	_, result.FromDomain = GetMailAddressComponents(fromAddrs[0].Address)
+	result.FromDomain = strings.ToLower(result.FromDomain)
+	result.DMARC, result.DMARCPolicy = daemon.checkDMARC(ctx, result)
+	return result
+}
+
+// getOrganisationalDomain returns the organisational domain (e.g. "example.co.uk" for "mail.example.co.uk") according to the public suffix list.
+func getOrganisationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		// The domain is a public suffix itself, or it is not a domain name at all (e.g. "localhost").
+		return domain
+	}
+	return orgDomain
+}
+
+// isDMARCAligned returns true only if the authenticated domain is aligned with the header From domain in the alignment mode ("r" or "s").
+func isDMARCAligned(fromDomain, authDomain, mode string) bool {
+	if mode == "s" {
+		return strings.EqualFold(fromDomain, authDomain)
+	}
+	return getOrganisationalDomain(fromDomain) == getOrganisationalDomain(authDomain)
+}
+
+// getDMARCRecord looks up the DMARC policy record of the domain, returning nil tags if the domain does not publish a policy.
+func (daemon *Daemon) getDMARCRecord(ctx context.Context, domain string) (tags map[string]string, err error) {
+	records, err := daemon.resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if isDNSNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, record := range records {
+		if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(record)), "v=dmarc1") {
+			continue
+		}
+		tags = make(map[string]string)
+		for _, tag := range strings.Split(record, ";") {
+			name, value, _ := strings.Cut(tag, "=")
+			tags[strings.ToLower(strings.TrimSpace(name))] = strings.ToLower(strings.TrimSpace(value))
+		}
+		return tags, nil
+	}
+	return nil, nil
+}
+
+// checkDMARC evaluates the DMARC policy (RFC 7489) of the header From domain using the SPF and DKIM results.
+func (daemon *Daemon) checkDMARC(ctx context.Context, result *MailAuthResult) (dmarcResult, policy string) {
+	tags, err := daemon.getDMARCRecord(ctx, result.FromDomain)
+	if err != nil {
+		return DMARCTempError, ""
+	}
+	policyName := "p"
+	if orgDomain := getOrganisationalDomain(result.FromDomain); tags == nil && orgDomain != result.FromDomain {
+		// Fall back to the policy of the organisational domain, which may specify a distinct policy for sub-domains.
+		if tags, err = daemon.getDMARCRecord(ctx, orgDomain); err != nil {
+			return DMARCTempError, ""
+		}
+		if tags["sp"] != "" {
+			policyName = "sp"
+		}
+	}
+	if tags == nil {
+		return DMARCNone, ""
+	}
+	policy = tags[policyName]
+	switch policy {
+	case "none", "quarantine", "reject":
+	default:
+		return DMARCPermError, ""
+	}
+	if result.SPF == SPFPass && isDMARCAligned(result.FromDomain, result.SPFDomain, tags["aspf"]) {
+		return DMARCPass, ""
+	}
+	for _, dkim := range result.DKIM {
+		if dkim.Result == inet.DKIMPass && isDMARCAligned(result.FromDomain, dkim.Domain, tags["adkim"]) {
+			return DMARCPass, ""
+		}
+	}
+	return DMARCFail, policy
+}
+
+// spfEvaluator checks the client IP against the SPF policy (RFC 7208) of a domain.
+type spfEvaluator struct {
+	resolver mailAuthResolver
+	ip       net.IP
+	sender   string
+	heloName string
+	// lookups counts the DNS-querying mechanisms and modifiers evaluated so far.
+	lookups int
+}
+
+// errSPFPermanent is a permanent error that makes the SPF check result in permerror.
+var errSPFPermanent = errors.New("spf permanent error")
+
+// check evaluates the SPF policy of the domain and returns the SPF result.
+func (spf *spfEvaluator) check(ctx context.Context, domain string) string {
+	records, err := spf.resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		if isDNSNotFound(err) {
+			return SPFNone
+		}
+		return SPFTempError
+	}
+	var policy string
+	var numPolicies int
+	for _, record := range records {
+		if lower := strings.ToLower(record); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			policy = record
+			numPolicies++
+		}
+	}
+	if numPolicies == 0 {
+		return SPFNone
+	} else if numPolicies > 1 {
+		return SPFPermError
+	}
+	var redirect string
+	for _, term := range strings.Fields(policy)[1:] {
+		// Modifiers
+		if name, value, isModifier := strings.Cut(term, "="); isModifier && !strings.ContainsAny(name, ":/") {
+			if strings.EqualFold(name, "redirect") {
+				redirect = value
+			}
+			continue
+		}
+		// Mechanisms
+		qualifier := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftFail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
+		}
+		matched, err := spf.matchMechanism(ctx, domain, term)
+		if err != nil {
+			if errors.Is(err, errSPFPermanent) {
+				return SPFPermError
+			}
+			return SPFTempError
+		}
+		if matched {
+			return qualifier
+		}
+	}
+	if redirect != "" {
+		if spf.lookups++; spf.lookups > MaxSPFLookups {
+			return SPFPermError
+		}
+		target, err := spf.expandMacros(redirect, domain)
+		if err != nil {
+			return SPFPermError
+		}
+		if result := spf.check(ctx, target); result != SPFNone {
+			return result
+		}
+		return SPFPermError
+	}
+	return SPFNeutral
+}
+
+// matchMechanism returns true if the client IP matches the SPF mechanism.
+func (spf *spfEvaluator) matchMechanism(ctx context.Context, domain, mechanism string) (bool, error) {
+	name, value, hasValue := strings.Cut(mechanism, ":")
+	// The "a" and "mx" mechanisms may come with CIDR prefix lengths but without a domain, e.g. "a/24".
+	cidr4, cidr6 := 32, 128
+	if !hasValue {
+		name, value, _ = strings.Cut(mechanism, "/")
+		if value != "" {
+			value = "/" + value
+		}
+	}
+	name = strings.ToLower(name)
+	if name == "a" || name == "mx" {
+		var err error
+		if value, cidr4, cidr6, err = parseSPFDualCIDR(value); err != nil {
+			return false, err
+		}
+	}
+	switch name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.Contains(value, "/") {
+			if name == "ip4" {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil || (network.IP.To4() != nil) != (name == "ip4") {
+			return false, fmt.Errorf("%w: bad %s network %s", errSPFPermanent, name, value)
+		}
+		return network.Contains(spf.ip), nil
+	case "a", "mx", "include", "exists", "ptr":
+		if spf.lookups++; spf.lookups > MaxSPFLookups {
+			return false, fmt.Errorf("%w: too many DNS lookups", errSPFPermanent)
+		}
+	default:
+		return false, fmt.Errorf("%w: unknown mechanism %s", errSPFPermanent, name)
+	}
+	target := domain
+	if value != "" {
+		var err error
+		if target, err = spf.expandMacros(value, domain); err != nil {
+			return false, err
+		}
+	}
+	switch name {
+	case "include":
+		if !hasValue {
+			return false, fmt.Errorf("%w: include without a domain", errSPFPermanent)
+		}
+		switch spf.check(ctx, target) {
+		case SPFPass:
+			return true, nil
+		case SPFTempError:
+			return false, errors.New("include lookup failed")
+		case SPFPermError, SPFNone:
+			return false, fmt.Errorf("%w: include of %s failed", errSPFPermanent, target)
+		}
+		return false, nil
+	case "exists":
+		addrs, err := spf.resolver.LookupIPAddr(ctx, target)
+		if err != nil && !isDNSNotFound(err) {
+			return false, err
+		}
+		return len(addrs) > 0, nil
+	case "a":
+		return spf.matchHostIPs(ctx, target, cidr4, cidr6)
+	case "mx":
+		mxs, err := spf.resolver.LookupMX(ctx, target)
+		if err != nil {
+			if isDNSNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		if len(mxs) > MaxSPFLookups {
+			return false, fmt.Errorf("%w: too many MX records", errSPFPermanent)
+		}
+		for _, mx := range mxs {
+			if matched, err := spf.matchHostIPs(ctx, mx.Host, cidr4, cidr6); err != nil || matched {
+				return matched, err
+			}
+		}
+		return false, nil
+	}
+	// The "ptr" mechanism is deprecated and slow, it never matches.
+	return false, nil
+}
+
+// matchHostIPs returns true if the client IP is within the network of one of the host's IP addresses.
+func (spf *spfEvaluator) matchHostIPs(ctx context.Context, host string, cidr4, cidr6 int) (bool, error) {
+	addrs, err := spf.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if isDNSNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, addr := range addrs {
+		var mask net.IPMask
+		if addr.IP.To4() != nil {
+			mask = net.CIDRMask(cidr4, 32)
+		} else {
+			mask = net.CIDRMask(cidr6, 128)
+		}
+		if addr.IP.Mask(mask).Equal(spf.ip.Mask(mask)) && (addr.IP.To4() != nil) == (spf.ip.To4() != nil) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseSPFDualCIDR splits the optional IPv4 and IPv6 prefix lengths (e.g. "example.com/24//64") from the domain of "a" and "mx" mechanisms.
+func parseSPFDualCIDR(value string) (domain string, cidr4, cidr6 int, err error) {
+	cidr4, cidr6 = 32, 128
+	domain, cidr6Str, hasCIDR6 := strings.Cut(value, "//")
+	domain, cidr4Str, hasCIDR4 := strings.Cut(domain, "/")
+	if hasCIDR4 {
+		if cidr4, err = strconv.Atoi(cidr4Str); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, fmt.Errorf("%w: bad IPv4 prefix length in %s", errSPFPermanent, value)
+		}
+	}
+	if hasCIDR6 {
+		if cidr6, err = strconv.Atoi(cidr6Str); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, fmt.Errorf("%w: bad IPv6 prefix length in %s", errSPFPermanent, value)
+		}
+	}
+	return domain, cidr4, cidr6, nil
+}
+
+// expandMacros expands the macros (RFC 7208 7) in the domain specification, e.g. "%{ir}.%{v}._spf.%{d}".
+func (spf *spfEvaluator) expandMacros(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+	var ret strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			ret.WriteByte(spec[i])
+			continue
+		}
+		if i++; i == len(spec) {
+			return "", fmt.Errorf("%w: incomplete macro in %s", errSPFPermanent, spec)
+		}
+		switch spec[i] {
+		case '%':
+			ret.WriteByte('%')
+			continue
+		case '_':
+			ret.WriteByte(' ')
+			continue
+		case '-':
+			ret.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("%w: bad macro in %s", errSPFPermanent, spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", fmt.Errorf("%w: bad macro in %s", errSPFPermanent, spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+		// Macro letter, followed by optional number of right-hand parts to keep, reversal, and delimiters.
+		var value string
+		localPart, senderDomain := GetMailAddressComponents(spf.sender)
+		switch strings.ToLower(macro[:1]) {
+		case "s":
+			value = spf.sender
+		case "l":
+			value = localPart
+		case "o":
+			value = senderDomain
+		case "d":
+			value = domain
+		case "h":
+			value = spf.heloName
+		case "i":
+			if ip4 := spf.ip.To4(); ip4 != nil {
+				value = ip4.String()
+			} else {
+				// Each nibble of an IPv6 address is separated by a dot
+				nibbles := make([]string, 0, 32)
+				for _, b := range spf.ip.To16() {
+					nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&0xf), 16))
+				}
+				value = strings.Join(nibbles, ".")
+			}
+		case "v":
+			if spf.ip.To4() != nil {
+				value = "in-addr"
+			} else {
+				value = "ip6"
+			}
+		default:
+			return "", fmt.Errorf("%w: unsupported macro %%{%s}", errSPFPermanent, macro)
+		}
+		transformers := macro[1:]
+		var keep int
+		for len(transformers) > 0 && transformers[0] >= '0' && transformers[0] <= '9' {
+			keep = keep*10 + int(transformers[0]-'0')
+			transformers = transformers[1:]
+		}
+		reverse := strings.HasPrefix(strings.ToLower(transformers), "r")
+		if reverse {
+			transformers = transformers[1:]
+		}
+		delimiters := transformers
+		if delimiters == "" {
+			delimiters = "."
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+		if reverse {
+			for left, right := 0, len(parts)-1; left < right; left, right = left+1, right-1 {
+				parts[left], parts[right] = parts[right], parts[left]
+			}
+		}
+		if keep > 0 && keep < len(parts) {
+			parts = parts[len(parts)-keep:]
+		}
+		ret.WriteString(strings.Join(parts, "."))
+	}
+	return ret.String(), nil
+}
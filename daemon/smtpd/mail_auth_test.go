@@ -0,0 +1,242 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	netSMTP "net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMailAuthResolver answers DNS lookups from its maps, a name absent from the maps does not exist.
+type fakeMailAuthResolver struct {
+	txt map[string][]string
+	ips map[string][]string
+	mx  map[string][]string
+}
+
+func (fake *fakeMailAuthResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if name == "broken.example" {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name}
+	}
+	if records, exists := fake.txt[name]; exists {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (fake *fakeMailAuthResolver) LookupIPAddr(_ context.Context, host string) (ret []net.IPAddr, err error) {
+	addrs, exists := fake.ips[host]
+	if !exists {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	for _, addr := range addrs {
+		ret = append(ret, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	return
+}
+
+func (fake *fakeMailAuthResolver) LookupMX(_ context.Context, name string) (ret []*net.MX, err error) {
+	hosts, exists := fake.mx[name]
+	if !exists {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	for _, host := range hosts {
+		ret = append(ret, &net.MX{Host: host, Pref: 10})
+	}
+	return
+}
+
+func TestSPF(t *testing.T) {
+	resolver := &fakeMailAuthResolver{
+		txt: map[string][]string{
+			"example.com":            {"google-site-verification=abc", "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a:www.example.com/30 mx include:_spf.example.net -all"},
+			"_spf.example.net":       {"v=spf1 ip4:203.0.113.1 ~all"},
+			"redirect.example":       {"v=spf1 redirect=example.com"},
+			"soft.example":           {"v=spf1 a ?ip4:198.51.100.1 ~all"},
+			"duplicated.example":     {"v=spf1 -all", "v=spf1 +all"},
+			"macro.example":          {"v=spf1 exists:%{ir}.%{l1r-}.allow.macro.example -all"},
+			"loop.example":           {"v=spf1 include:loop.example -all"},
+			"bad.example":            {"v=spf1 ip4:1.2.3.4/33 -all"},
+			"include-broken.example": {"v=spf1 include:broken.example -all"},
+			"neutral.example":        {"v=spf1 ip4:192.0.2.1"},
+		},
+		ips: map[string][]string{
+			"www.example.com":                        {"198.51.100.4"},
+			"mx.example.com":                         {"198.51.100.200", "2001:db9::1"},
+			"soft.example":                           {"198.51.100.2"},
+			"1.113.0.203.a.allow.macro.example":      {"127.0.0.2"},
+			"2.113.0.203.laitos.allow.macro.example": {"127.0.0.2"},
+		},
+		mx: map[string][]string{"example.com": {"mx.example.com"}},
+	}
+	for _, tc := range []struct {
+		domain, ip, sender, result string
+	}{
+		{"example.com", "192.0.2.99", "a@example.com", SPFPass},
+		{"example.com", "2001:db8::1", "a@example.com", SPFPass},
+		{"example.com", "198.51.100.6", "a@example.com", SPFPass},
+		{"example.com", "198.51.100.8", "a@example.com", SPFFail},
+		{"example.com", "198.51.100.200", "a@example.com", SPFPass},
+		{"example.com", "2001:db9::1", "a@example.com", SPFPass},
+		{"example.com", "203.0.113.1", "a@example.com", SPFPass},
+		{"example.com", "203.0.113.2", "a@example.com", SPFFail},
+		{"redirect.example", "192.0.2.1", "a@redirect.example", SPFPass},
+		{"redirect.example", "10.0.0.1", "a@redirect.example", SPFFail},
+		{"soft.example", "198.51.100.2", "a@soft.example", SPFPass},
+		{"soft.example", "198.51.100.1", "a@soft.example", SPFNeutral},
+		{"soft.example", "10.0.0.1", "a@soft.example", SPFSoftFail},
+		{"neutral.example", "10.0.0.1", "a@neutral.example", SPFNeutral},
+		{"duplicated.example", "10.0.0.1", "a@duplicated.example", SPFPermError},
+		{"macro.example", "203.0.113.1", "a@macro.example", SPFPass},
+		{"macro.example", "203.0.113.2", "laitos-howard@macro.example", SPFPass},
+		{"macro.example", "203.0.113.3", "a@macro.example", SPFFail},
+		{"loop.example", "10.0.0.1", "a@loop.example", SPFPermError},
+		{"bad.example", "10.0.0.1", "a@bad.example", SPFPermError},
+		{"include-broken.example", "10.0.0.1", "a@include-broken.example", SPFTempError},
+		{"broken.example", "10.0.0.1", "a@broken.example", SPFTempError},
+		{"absent.example", "10.0.0.1", "a@absent.example", SPFNone},
+	} {
+		spf := &spfEvaluator{resolver: resolver, ip: net.ParseIP(tc.ip), sender: tc.sender, heloName: "mail.example"}
+		require.Equal(t, tc.result, spf.check(context.Background(), tc.domain), "%+v", tc)
+	}
+}
+
+func TestGetOrganisationalDomain(t *testing.T) {
+	require.Equal(t, "example.com", getOrganisationalDomain("example.com"))
+	require.Equal(t, "example.com", getOrganisationalDomain("a.b.Example.com."))
+	require.Equal(t, "example.co.uk", getOrganisationalDomain("mail.example.co.uk"))
+	require.Equal(t, "example.de", getOrganisationalDomain("mail.example.de"))
+	require.Equal(t, "localhost", getOrganisationalDomain("localhost"))
+	// The public suffix of multiple labels
+	require.Equal(t, "a.github.io", getOrganisationalDomain("mail.a.github.io"))
+	require.Equal(t, "github.io", getOrganisationalDomain("github.io"))
+	require.True(t, isDMARCAligned("a.github.io", "mail.a.github.io", "r"))
+	require.False(t, isDMARCAligned("a.github.io", "b.github.io", "r"))
+	require.False(t, isDMARCAligned("a.example.co.uk", "b.example2.co.uk", "r"))
+}
+
+func TestDaemon_AuthenticateMail(t *testing.T) {
+	// Sign the mails with a DKIM key of example.com
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edKeyDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "ed25519.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edKeyDER}), 0600))
+	dkim := &inet.MailDKIM{Domain: "mail.example.com", Selector: "laitos", PrivateKeyPath: keyPath}
+	dkimRecord, err := dkim.DNSRecord()
+	require.NoError(t, err)
+
+	daemon := &Daemon{
+		MyDomains:          []string{"mx.example.org"},
+		ForwardTo:          []string{"me@example.org"},
+		ForwardMailClient:  inet.MailClient{MailFrom: "me@example.org", MTAHost: "127.0.0.1", MTAPort: 1},
+		RejectAuthFailures: true,
+		resolver: &fakeMailAuthResolver{txt: map[string][]string{
+			"example.com":                        {"v=spf1 ip4:192.0.2.1 -all"},
+			"laitos._domainkey.mail.example.com": {dkimRecord},
+			"_dmarc.example.com":                 {"v=DMARC1; p=reject; sp=quarantine; rua=mailto:dmarc@example.com"},
+			"_dmarc.lenient.example":             {"v=DMARC1; p=none"},
+		}},
+	}
+	require.NoError(t, daemon.Initialise())
+	require.True(t, daemon.AuthenticateSenders)
+
+	// The mail received by the daemon uses LF line endings
+	message := "From: Howard <howard@example.com>\r\nTo: me@mx.example.org\r\nSubject: hi\r\n\r\nhello\r\n"
+	signed, err := dkim.Sign([]byte(message))
+	require.NoError(t, err)
+	signedMessage := strings.ReplaceAll(string(signed), "\r\n", "\n")
+	message = strings.ReplaceAll(message, "\r\n", "\n")
+
+	// SPF and DKIM pass, both are aligned with the From domain in relaxed mode.
+	result := daemon.AuthenticateMail(context.Background(), "192.0.2.1", "mail.example.com", "bounce@example.com", signedMessage)
+	require.Equal(t, &MailAuthResult{
+		SPF: SPFPass, SPFDomain: "example.com",
+		DKIM:  []inet.DKIMResult{{Domain: "mail.example.com", Selector: "laitos", Result: inet.DKIMPass}},
+		DMARC: DMARCPass, FromDomain: "example.com",
+	}, result)
+	require.Empty(t, result.GetRejectionReason())
+	// A mail forwarded by a mailing list fails SPF yet passes DMARC by DKIM
+	result = daemon.AuthenticateMail(context.Background(), "10.0.0.1", "list.example", "bounce@example.com", signedMessage)
+	require.Equal(t, SPFFail, result.SPF)
+	require.Equal(t, DMARCPass, result.DMARC)
+	require.Empty(t, result.GetRejectionReason())
+	// A spoofed mail fails both
+	result = daemon.AuthenticateMail(context.Background(), "10.0.0.1", "spoofer.example", "bounce@example.com", message)
+	require.Equal(t, &MailAuthResult{SPF: SPFFail, SPFDomain: "example.com", DKIM: []inet.DKIMResult{}, DMARC: DMARCFail, DMARCPolicy: "reject", FromDomain: "example.com"}, result)
+	require.Equal(t, "DMARC verification of example.com failed", result.GetRejectionReason())
+	require.Equal(t, "Authentication-Results: mx.example.org;\n\tspf=fail smtp.mailfrom=example.com;\n\tdkim=none;\n\tdmarc=fail (p=reject) header.from=example.com\n"+message,
+		result.Annotate("mx.example.org", message))
+	// A sub-domain without its own policy uses the organisational domain's policy for sub-domains
+	subDomainMessage := strings.Replace(message, "howard@example.com", "howard@sub.example.com", 1)
+	result = daemon.AuthenticateMail(context.Background(), "10.0.0.1", "spoofer.example", "bounce@spoofer.example", subDomainMessage)
+	require.Equal(t, SPFNone, result.SPF)
+	require.Equal(t, DMARCFail, result.DMARC)
+	require.Equal(t, "quarantine", result.DMARCPolicy)
+	require.Empty(t, result.GetRejectionReason())
+	// SPF hard failure of a domain without a strict DMARC policy
+	lenientMessage := strings.Replace(message, "howard@example.com", "howard@lenient.example", 1)
+	result = daemon.AuthenticateMail(context.Background(), "10.0.0.1", "spoofer.example", "bounce@example.com", lenientMessage)
+	require.Equal(t, "none", result.DMARCPolicy)
+	require.Equal(t, "SPF verification of example.com failed", result.GetRejectionReason())
+	// DMARC cannot be evaluated without a From address, and the HELO name is checked in the absence of MAIL FROM.
+	result = daemon.AuthenticateMail(context.Background(), "192.0.2.1", "example.com", "", "Subject: hi\n\nhello\n")
+	require.Equal(t, SPFPass, result.SPF)
+	require.Equal(t, DMARCPermError, result.DMARC)
+}
+
+func TestMailAuthResult_Annotate(t *testing.T) {
+	result := &MailAuthResult{
+		SPF: SPFPass, SPFDomain: "example.com",
+		DKIM: []inet.DKIMResult{
+			{Domain: "example.com", Selector: "s1", Result: inet.DKIMPass},
+			{Domain: "example.net", Selector: "s2", Result: inet.DKIMFail, Reason: "body hash mismatch"},
+		},
+		DMARC: DMARCPass, FromDomain: "example.com",
+	}
+	header := "Authentication-Results: mx.example.org;\r\n\tspf=pass smtp.mailfrom=example.com;\r\n\tdkim=pass header.d=example.com header.s=s1;\r\n\tdkim=fail (body hash mismatch) header.d=example.net header.s=s2;\r\n\tdmarc=pass header.from=example.com\r\n"
+	require.Equal(t, header, result.AuthenticationResults("mx.example.org"))
+	// The forged results claiming to come from this server are removed, while those of other servers are kept.
+	forged := "Authentication-Results: MX.example.org; spf=pass\r\n\tdkim=pass\r\nAuthentication-Results: mx.example.org.evil; spf=pass\r\nSubject: hi\r\n\r\nAuthentication-Results: mx.example.org\r\n"
+	require.Equal(t, header+"Authentication-Results: mx.example.org.evil; spf=pass\r\nSubject: hi\r\n\r\nAuthentication-Results: mx.example.org\r\n", result.Annotate("mx.example.org", forged))
+	require.Equal(t, strings.ReplaceAll(header, "\r\n", "\n")+"Subject: hi", result.Annotate("mx.example.org", "Subject: hi"))
+}
+
+func TestDaemon_RejectAuthFailures(t *testing.T) {
+	daemon := &Daemon{
+		MyDomains:          []string{"mx.example.org"},
+		ForwardTo:          []string{"me@example.org"},
+		ForwardMailClient:  inet.MailClient{MailFrom: "me@example.org", MTAHost: "127.0.0.1", MTAPort: 1},
+		RejectAuthFailures: true,
+		resolver:           &fakeMailAuthResolver{txt: map[string][]string{"example.com": {"v=spf1 ip4:192.0.2.1 -all"}}},
+	}
+	require.NoError(t, daemon.Initialise())
+	daemon.processMailTestCaseFunc = func(from, _ string) {
+		t.Errorf("should not have forwarded the mail from %s", from)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		daemon.HandleTCPConnection(lalog.DefaultLogger, "10.0.0.1", conn.(*net.TCPConn))
+	}()
+	err = netSMTP.SendMail(listener.Addr().String(), nil, "spoofer@example.com", []string{"me@mx.example.org"}, []byte("From: spoofer@example.com\r\nSubject: hi\r\n\r\nhello\r\n"))
+	require.ErrorContains(t, err, "554")
+}
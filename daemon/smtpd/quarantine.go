@@ -0,0 +1,171 @@
+package smtpd
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+// maxNestedMultipartDepth is the maximum depth of nested multipart messages inspected for blocked attachments.
+const maxNestedMultipartDepth = 4
+
+// QuarantinedMail is a mail that the daemon received but did not deliver, due to a blocked attachment.
+type QuarantinedMail struct {
+	ID       int       `json:"ID"`
+	Received time.Time `json:"Received"`
+	ClientIP string    `json:"ClientIP"`
+	FromAddr string    `json:"FromAddr"`
+	ToAddrs  []string  `json:"ToAddrs"`
+	Subject  string    `json:"Subject"`
+	Size     int       `json:"Size"`
+	// Reason explains why the mail was quarantined, e.g. the name of the blocked attachment.
+	Reason string `json:"Reason"`
+
+	mailBody string
+}
+
+/*
+GetBlockedAttachment looks for an attachment of the blocked types among the parts of the mail message, and returns a
+description of the first blocked attachment found. It returns an empty string if the mail does not carry a blocked
+attachment.
+*/
+func (daemon *Daemon) GetBlockedAttachment(mailBody string) (reason string) {
+	if len(daemon.BlockedAttachmentTypes) == 0 {
+		return ""
+	}
+	daemon.walkAttachments([]byte(mailBody), 0, func(fileName, mediaType string) bool {
+		for _, blockedType := range daemon.BlockedAttachmentTypes {
+			if strings.HasPrefix(blockedType, ".") && strings.HasSuffix(strings.ToLower(fileName), blockedType) ||
+				strings.HasSuffix(blockedType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(blockedType, "*")) ||
+				blockedType == mediaType {
+				reason = fmt.Sprintf("blocked attachment \"%s\" (%s)", fileName, mediaType)
+				return false
+			}
+		}
+		return true
+	})
+	return
+}
+
+// walkAttachments calls the function with the file name and media type of each attachment in the mail message, until the function returns false.
+func (daemon *Daemon) walkAttachments(mailMessage []byte, depth int, fun func(fileName, mediaType string) bool) (next bool) {
+	next = true
+	// A malformed mail message does not carry a recognisable attachment
+	_ = inet.WalkMailMessage(mailMessage, func(prop inet.BasicMail, body []byte) (bool, error) {
+		mediaType, typeParams, _ := mime.ParseMediaType(prop.ContentType)
+		mediaType = strings.ToLower(mediaType)
+		if strings.HasPrefix(mediaType, "multipart/") && depth < maxNestedMultipartDepth {
+			// The body of a nested multipart comes without its headers
+			next = daemon.walkAttachments(append([]byte("Content-Type: "+prop.ContentType+"\r\n\r\n"), body...), depth+1, fun)
+			return next, nil
+		}
+		disposition, dispositionParams, _ := mime.ParseMediaType(prop.ContentDisposition)
+		fileName := dispositionParams["filename"]
+		if fileName == "" {
+			fileName = typeParams["name"]
+		}
+		if strings.EqualFold(disposition, "attachment") || fileName != "" {
+			next = fun(fileName, mediaType)
+		}
+		return next, nil
+	})
+	return
+}
+
+// QuarantineMail keeps the mail in quarantine, the oldest quarantined mail is discarded if the quarantine is full.
+func (daemon *Daemon) QuarantineMail(clientIP, fromAddr string, toAddrs []string, mailBody, reason string) {
+	var subject string
+	if prop, _, err := inet.ReadMailMessage([]byte(mailBody)); err == nil {
+		subject = prop.Subject
+	}
+	daemon.quarantineMutex.Lock()
+	defer daemon.quarantineMutex.Unlock()
+	daemon.lastQuarantineID++
+	daemon.quarantine = append(daemon.quarantine, &QuarantinedMail{
+		ID:       daemon.lastQuarantineID,
+		Received: time.Now(),
+		ClientIP: clientIP,
+		FromAddr: fromAddr,
+		ToAddrs:  append([]string{}, toAddrs...),
+		Subject:  subject,
+		Size:     len(mailBody),
+		Reason:   reason,
+		mailBody: mailBody,
+	})
+	if len(daemon.quarantine) > daemon.MaxQuarantinedMails {
+		daemon.quarantine = daemon.quarantine[len(daemon.quarantine)-daemon.MaxQuarantinedMails:]
+	}
+	daemon.logger.Warning(clientIP, nil, "quarantined mail %d from \"%s\" due to %s", daemon.lastQuarantineID, fromAddr, reason)
+}
+
+// GetQuarantinedMails returns the properties of quarantined mails, latest first.
+func (daemon *Daemon) GetQuarantinedMails() []QuarantinedMail {
+	daemon.quarantineMutex.Lock()
+	defer daemon.quarantineMutex.Unlock()
+	ret := make([]QuarantinedMail, 0, len(daemon.quarantine))
+	for i := len(daemon.quarantine) - 1; i >= 0; i-- {
+		mail := *daemon.quarantine[i]
+		mail.mailBody = ""
+		ret = append(ret, mail)
+	}
+	return ret
+}
+
+// GetQuarantinedMailBody returns the entire message of the quarantined mail.
+func (daemon *Daemon) GetQuarantinedMailBody(id int) (mailBody string, exists bool) {
+	daemon.quarantineMutex.Lock()
+	defer daemon.quarantineMutex.Unlock()
+	for _, mail := range daemon.quarantine {
+		if mail.ID == id {
+			return mail.mailBody, true
+		}
+	}
+	return "", false
+}
+
+// takeQuarantinedMail removes the mail from quarantine and returns it.
+func (daemon *Daemon) takeQuarantinedMail(id int) *QuarantinedMail {
+	daemon.quarantineMutex.Lock()
+	defer daemon.quarantineMutex.Unlock()
+	for i, mail := range daemon.quarantine {
+		if mail.ID == id {
+			daemon.quarantine = append(daemon.quarantine[:i], daemon.quarantine[i+1:]...)
+			return mail
+		}
+	}
+	return nil
+}
+
+// DeleteQuarantinedMail discards the quarantined mail, it returns false if the mail is not in quarantine.
+func (daemon *Daemon) DeleteQuarantinedMail(id int) bool {
+	if mail := daemon.takeQuarantinedMail(id); mail != nil {
+		daemon.logger.Info(mail.ClientIP, nil, "deleted quarantined mail %d from \"%s\"", id, mail.FromAddr)
+		return true
+	}
+	return false
+}
+
+/*
+ReleaseQuarantinedMail forwards the quarantined mail to the forward addresses and removes it from quarantine. The
+toolbox commands in the mail body are not run. Should the mail fail to be forwarded, it stays in quarantine.
+*/
+func (daemon *Daemon) ReleaseQuarantinedMail(id int) error {
+	mail := daemon.takeQuarantinedMail(id)
+	if mail == nil {
+		return fmt.Errorf("smtpd.ReleaseQuarantinedMail: mail %d is not in quarantine", id)
+	}
+	daemon.logger.Info(mail.ClientIP, nil, "releasing quarantined mail %d from \"%s\"", id, mail.FromAddr)
+	if err := daemon.forwardMail(mail.FromAddr, []byte(mail.mailBody)); err != nil {
+		// Put the mail back to its original position
+		daemon.quarantineMutex.Lock()
+		pos := sort.Search(len(daemon.quarantine), func(i int) bool { return daemon.quarantine[i].ID > mail.ID })
+		daemon.quarantine = append(daemon.quarantine[:pos], append([]*QuarantinedMail{mail}, daemon.quarantine[pos:]...)...)
+		daemon.quarantineMutex.Unlock()
+		return fmt.Errorf("smtpd.ReleaseQuarantinedMail: failed to forward mail %d - %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package smtpd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/stretchr/testify/require"
+)
+
+// buildTestMailWithAttachment returns a multipart mail message carrying a text part and an attachment nested in another multipart.
+func buildTestMailWithAttachment(contentType, disposition string) string {
+	return "From: friend@example.org\r\nSubject: see attachment\r\nContent-Type: multipart/mixed; boundary=outer\r\n\r\n" +
+		"--outer\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+		"--outer\r\nContent-Type: multipart/related; boundary=inner\r\n\r\n" +
+		"--inner\r\nContent-Type: " + contentType + "\r\nContent-Disposition: " + disposition + "\r\n\r\nAAAA\r\n" +
+		"--inner--\r\n" +
+		"--outer--\r\n"
+}
+
+func TestDaemon_GetBlockedAttachment(t *testing.T) {
+	daemon := &Daemon{
+		MyDomains:         []string{"example.com"},
+		ForwardTo:         []string{"me@example.org"},
+		ForwardMailClient: inet.MailClient{MailFrom: "me@example.com", MTAHost: "127.0.0.1", MTAPort: 1},
+	}
+	daemon.BlockedAttachmentTypes = []string{"exe"}
+	require.ErrorContains(t, daemon.Initialise(), "blocked attachment type")
+	daemon.BlockedAttachmentTypes = []string{" .EXE", "application/x-msdownload", "audio/*"}
+	require.NoError(t, daemon.Initialise())
+	require.Equal(t, []string{".exe", "application/x-msdownload", "audio/*"}, daemon.BlockedAttachmentTypes)
+	require.Equal(t, inet.MaxMailBodySize, daemon.MaxMessageSize)
+	require.Equal(t, DefaultMaxQuarantinedMails, daemon.MaxQuarantinedMails)
+
+	for _, tc := range []struct {
+		contentType, disposition, reason string
+	}{
+		{"application/octet-stream", `attachment; filename="Setup.Exe"`, `blocked attachment "Setup.Exe" (application/octet-stream)`},
+		{`application/octet-stream; name="setup.exe"`, "inline", `blocked attachment "setup.exe" (application/octet-stream)`},
+		{"Application/X-MSDownload", "attachment", `blocked attachment "" (application/x-msdownload)`},
+		{"audio/mpeg", `attachment; filename="song.mp3"`, `blocked attachment "song.mp3" (audio/mpeg)`},
+		{"application/pdf", `attachment; filename="doc.pdf"`, ""},
+		{"image/png", "inline", ""},
+	} {
+		require.Equal(t, tc.reason, daemon.GetBlockedAttachment(buildTestMailWithAttachment(tc.contentType, tc.disposition)), "%+v", tc)
+	}
+	require.Empty(t, daemon.GetBlockedAttachment("From: friend@example.org\r\nSubject: hi\r\n\r\nsetup.exe\r\n"))
+	require.Empty(t, daemon.GetBlockedAttachment("malformed"))
+}
+
+func TestDaemon_Quarantine(t *testing.T) {
+	daemon := &Daemon{
+		MyDomains: []string{"example.com"},
+		ForwardTo: []string{"me@example.org"},
+		// The MTA does not exist, the test case inspects the forwarded mails instead.
+		ForwardMailClient:   inet.MailClient{MailFrom: "me@example.com", MTAHost: "127.0.0.1", MTAPort: 1},
+		MaxQuarantinedMails: 2,
+	}
+	require.NoError(t, daemon.Initialise())
+	var forwarded []string
+	daemon.processMailTestCaseFunc = func(from, body string) {
+		forwarded = append(forwarded, from)
+	}
+	for i := 1; i <= 3; i++ {
+		daemon.QuarantineMail("192.0.2.1", fmt.Sprintf("sender%d@example.org", i), []string{"me@example.com"}, buildTestMailWithAttachment("application/octet-stream", "attachment"), "test")
+	}
+	// The oldest mail is discarded to make room for the latest
+	mails := daemon.GetQuarantinedMails()
+	require.Len(t, mails, 2)
+	require.Equal(t, 3, mails[0].ID)
+	require.Equal(t, "sender3@example.org", mails[0].FromAddr)
+	require.Equal(t, "see attachment", mails[0].Subject)
+	require.Equal(t, []string{"me@example.com"}, mails[0].ToAddrs)
+	require.Equal(t, 2, mails[1].ID)
+	_, exists := daemon.GetQuarantinedMailBody(1)
+	require.False(t, exists)
+	body, exists := daemon.GetQuarantinedMailBody(2)
+	require.True(t, exists)
+	require.True(t, strings.HasPrefix(body, "From: friend@example.org"))
+
+	// The released mail is forwarded and leaves the quarantine
+	require.NoError(t, daemon.ReleaseQuarantinedMail(2))
+	require.Equal(t, []string{"sender2@example.org"}, forwarded)
+	require.Error(t, daemon.ReleaseQuarantinedMail(2))
+	require.Error(t, daemon.ReleaseQuarantinedMail(1))
+	mails = daemon.GetQuarantinedMails()
+	require.Len(t, mails, 1)
+	require.Equal(t, 3, mails[0].ID)
+
+	require.True(t, daemon.DeleteQuarantinedMail(3))
+	require.False(t, daemon.DeleteQuarantinedMail(3))
+	require.Empty(t, daemon.GetQuarantinedMails())
+	require.Equal(t, []string{"sender2@example.org"}, forwarded)
+}
@@ -8,10 +8,12 @@ package smtp
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto"
+	"strings"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -23,6 +25,9 @@ The maximum length does not apply to mail message and attachments.
 */
 const MaxCommandLength = 4096
 
+// MaxAuthFailures is the maximum number of failed authentication attempts in a conversation before the connection is closed.
+const MaxAuthFailures = 3
+
 /*
 commandStage is an enumeration of stages of an SMTP conversation. The stages determine what kind of protocol verbs are
 anticipated for the upcoming protocol command.
@@ -66,6 +71,8 @@ var stageExpectations = map[ProtocolVerb]verbExpectation{
 type Config struct {
 	// TLSConfig grants SMTP server StartTLS capability.
 	TLSConfig *tls.Config
+	// RequireTLS refuses to receive mails until the client has started TLS successfully.
+	RequireTLS bool
 	// IOTimeout governs the timeout of each read and write operation.
 	IOTimeout time.Duration
 	/*
@@ -84,6 +91,16 @@ type Config struct {
 		use the greeting to further establish authenticity of the mail server.
 	*/
 	ServerName string
+	/*
+		Authenticate checks the user name and password presented by a client via the AUTH command (mechanism PLAIN or
+		LOGIN). The AUTH command is only available when this function is present, and only after TLS has been started
+		if the server supports TLS.
+	*/
+	Authenticate func(username, password string) bool
+	// AuthFailed is called upon each failed authentication attempt, such as an incorrect password or an undecodable response.
+	AuthFailed func()
+	// RequireAuth refuses to receive mails until the client has authenticated successfully.
+	RequireAuth bool
 }
 
 /*
@@ -100,6 +117,8 @@ type Connection struct {
 	TLSState tls.ConnectionState
 	// TLSHelp contains a text description that explains the latest TLS error from SMTP conversation's perspective.
 	TLSHelp string
+	// AuthenticatedUser is the user name that the client has successfully authenticated as.
+	AuthenticatedUser string
 
 	// netConn is the underlying TCP connection
 	netConn net.Conn
@@ -109,6 +128,8 @@ type Connection struct {
 	textReader *textproto.Reader
 	// consecutiveUnrecognisedCommands counts the number of consecutive unrecognised commands.
 	consecutiveUnrecognisedCommands int
+	// authFailures counts the number of failed authentication attempts.
+	authFailures int
 	// latestProtocolVerb is the protocol verb received from the latest protocol command.
 	latestProtocolVerb ProtocolVerb
 	// state memorises the latest stage of the ongoing SMTP conversation.
@@ -163,6 +184,10 @@ func (conn *Connection) readMailData() string {
 	conn.logger.MaybeMinorError(conn.netConn.SetReadDeadline(time.Now().Add(conn.Config.IOTimeout)))
 	decodedBytes, err := conn.textReader.ReadDotBytes()
 	if err != nil || conn.limitReader.N == 0 {
+		if conn.limitReader.N == 0 {
+			// Tell the client why the conversation cannot carry on, the remainder of the oversized message is not read.
+			conn.reply("552 5.3.4 Message size exceeds fixed maximum message size")
+		}
 		conn.stage = StageAbort
 		return ""
 	}
@@ -198,9 +223,13 @@ func (conn *Connection) answerOK() {
 		conn.reply("250-%s", conn.Config.ServerName)
 		conn.reply("250-8BITMIME")
 		conn.reply("250-PIPELINING")
+		conn.reply("250-SIZE %d", conn.Config.MaxMessageLength)
 		if conn.Config.TLSConfig != nil && !conn.TLSAttempted {
 			conn.reply("250-STARTTLS")
 		}
+		if conn.canAuthenticate() {
+			conn.reply("250-AUTH PLAIN LOGIN")
+		}
 		conn.reply("250 OK")
 	case VerbMAILFROM:
 		conn.reply("250 2.1.0 OK")
@@ -242,6 +271,98 @@ func (conn *Connection) AnswerRateLimited() {
 	conn.stage = StageAbort
 }
 
+// canAuthenticate returns true only if the client may authenticate itself at this stage of the conversation.
+func (conn *Connection) canAuthenticate() bool {
+	return conn.Config.Authenticate != nil && conn.AuthenticatedUser == "" && (conn.Config.TLSConfig == nil || conn.TLSAttempted)
+}
+
+// readAuthResponse reads and decodes the base64-encoded response of an authentication challenge.
+func (conn *Connection) readAuthResponse(challenge string) (string, bool) {
+	conn.reply("334 %s", base64.StdEncoding.EncodeToString([]byte(challenge)))
+	line := conn.readCommand()
+	if line == "*" {
+		// The client cancels the authentication exchange
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(line)
+	return string(decoded), err == nil
+}
+
+/*
+authenticate carries out the authentication exchange of the AUTH command, using mechanism PLAIN (RFC 4616) or LOGIN.
+The exchange may begin with an initial response given along with the mechanism name.
+*/
+func (conn *Connection) authenticate(param string) {
+	if conn.Config.Authenticate == nil {
+		conn.consecutiveUnrecognisedCommands++
+		conn.reply("502 Command not implemented")
+		return
+	}
+	if conn.stage != StageHello || conn.AuthenticatedUser != "" {
+		conn.reply("503 Bad sequence of commands")
+		return
+	}
+	if !conn.canAuthenticate() {
+		conn.reply("538 5.7.11 Encryption required for requested authentication mechanism")
+		return
+	}
+	mechanism, initialResponse, _ := strings.Cut(param, " ")
+	var username, password string
+	var ok bool
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		var response string
+		if initialResponse == "" {
+			response, ok = conn.readAuthResponse("")
+		} else {
+			decoded, err := base64.StdEncoding.DecodeString(initialResponse)
+			response, ok = string(decoded), err == nil
+		}
+		// The response comprises authorisation identity, user name, and password, separated by NUL.
+		if fields := strings.Split(response, "\x00"); ok && len(fields) == 3 {
+			username, password = fields[1], fields[2]
+		} else {
+			ok = false
+		}
+	case "LOGIN":
+		if initialResponse == "" {
+			username, ok = conn.readAuthResponse("Username:")
+		} else {
+			decoded, err := base64.StdEncoding.DecodeString(initialResponse)
+			username, ok = string(decoded), err == nil
+		}
+		if ok {
+			password, ok = conn.readAuthResponse("Password:")
+		}
+	default:
+		conn.reply("504 5.5.4 Unrecognised authentication mechanism")
+		return
+	}
+	if conn.stage == StageAbort {
+		return
+	}
+	if ok && username != "" && conn.Config.Authenticate(username, password) {
+		conn.AuthenticatedUser = username
+		conn.reply("235 2.7.0 Authentication successful")
+		return
+	}
+	// An undecodable response counts as a failed attempt too
+	conn.authFailures++
+	if conn.Config.AuthFailed != nil {
+		conn.Config.AuthFailed()
+	}
+	if conn.authFailures >= MaxAuthFailures {
+		conn.reply("421 4.7.0 Too many failed authentication attempts")
+		conn.stage = StageAbort
+		return
+	}
+	if !ok {
+		conn.reply("501 5.5.2 Cannot decode the authentication response")
+		return
+	}
+	conn.reply("535 5.7.8 Authentication credentials invalid")
+}
+
 // setupReaders initialises text reader and limit reader to operate on the underlying network connection.
 func (conn *Connection) setupReaders(netConn net.Conn) {
 	conn.netConn = netConn
@@ -311,6 +432,14 @@ func (conn *Connection) CarryOn() Command {
 			conn.reply("503 Bad sequence of commands")
 			continue
 		}
+		if thisCmd.Verb == VerbMAILFROM && conn.Config.RequireTLS && !conn.TLSAttempted {
+			conn.reply("530 5.7.0 Must issue a STARTTLS command first")
+			continue
+		}
+		if thisCmd.Verb == VerbMAILFROM && conn.Config.RequireAuth && conn.AuthenticatedUser == "" {
+			conn.reply("530 5.7.0 Authentication required")
+			continue
+		}
 		if verbStage.ValidInStages == 0 {
 			switch thisCmd.Verb {
 			case VerbRSET:
@@ -322,6 +451,8 @@ func (conn *Connection) CarryOn() Command {
 				conn.reply("250 OK")
 			case VerbVRFY:
 				conn.reply("252 OK")
+			case VerbAUTH:
+				conn.authenticate(thisCmd.Parameter)
 			case VerbQUIT:
 				conn.stage = StageQuit
 				conn.reply("221 2.0.0 Bye")
@@ -1,6 +1,7 @@
 package smtpd
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	netSMTP "net/smtp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/daemon/common"
@@ -25,6 +27,8 @@ const (
 	IOTimeoutSec          = 60  // IO timeout for both read and write operations
 	MaxConversationLength = 256 // Only converse up to this number of exchanges in an SMTP connection
 	MaxNumRecipients      = 100 // MaxNumRecipients is the maximum number of recipients an SMTP conversation will accept
+	// DefaultMaxQuarantinedMails is the default maximum number of mails kept in quarantine.
+	DefaultMaxQuarantinedMails = 100
 )
 
 // Daemon implements an SMTP server that receives mails addressed to configured set of domain names, and optionally forward the received mails to other addresses.
@@ -34,10 +38,46 @@ type Daemon struct {
 	TLSCertPath string `json:"TLSCertPath"` // TLSCertPath is the path to server's TLS certificate for StartTLS operation. This is optional.
 	TLSKeyPath  string `json:"TLSKeyPath"`  // TLSCertPath is the path to server's TLS certificate key for StartTLS operation. This is optional.
 	PerIPLimit  int    `json:"PerIPLimit"`  // PerIPLimit is the maximum number of approximately how many concurrent users are expected to be using the server from same IP address
+	// RequireTLS refuses to receive mails from the clients that have not started TLS, it requires a TLS certificate and key.
+	RequireTLS bool `json:"RequireTLS"`
 	// MyDomains is an array of domain names that this SMTP server receives mails for. Mails addressed to domain names other than these will be rejected.
 	MyDomains []string `json:"MyDomains"`
 	// ForwardTo are the recipients (email addresses) to receive emails that are delivered to this SMTP server.
 	ForwardTo []string `json:"ForwardTo"`
+	// AutoReplies are the rules of automatic replies (e.g. vacation notices) sent to the senders of incoming mails.
+	AutoReplies []*AutoReply `json:"AutoReplies"`
+	// MaxMessageSize is the maximum size (in bytes) of an incoming mail message, a larger message is refused. It defaults to and cannot exceed 32MB.
+	MaxMessageSize int `json:"MaxMessageSize"`
+	/*
+		BlockedAttachmentTypes are the file name extensions (e.g. ".exe") and MIME types (e.g. "application/x-msdownload"
+		or "application/*") of the attachments that must not be delivered. Instead of forwarding a mail that carries such an
+		attachment, the daemon keeps the mail in quarantine, where it may be released or deleted.
+	*/
+	BlockedAttachmentTypes []string `json:"BlockedAttachmentTypes"`
+	// MaxQuarantinedMails is the maximum number of mails kept in quarantine, the oldest mail is discarded to make room for a new one.
+	MaxQuarantinedMails int `json:"MaxQuarantinedMails"`
+	/*
+		AuthenticateSenders evaluates SPF policy, DKIM signatures, and DMARC policy of the incoming mails, and records the
+		results in an Authentication-Results header field of the forwarded mails.
+	*/
+	AuthenticateSenders bool `json:"AuthenticateSenders"`
+	/*
+		RejectAuthFailures rejects the incoming mails that fail DMARC verification of a domain that demands rejection, or
+		fail SPF verification of a domain that hard-fails unauthorised senders. It implies AuthenticateSenders.
+	*/
+	RejectAuthFailures bool `json:"RejectAuthFailures"`
+	/*
+		SubmissionPort is the port number of mail submission listener, which relays the mails sent by authenticated users
+		to recipients of any domain. The listener requires TLS certificate and key, and is disabled if the port is 0.
+	*/
+	SubmissionPort int `json:"SubmissionPort"`
+	// SubmissionUsers are the user names and passwords of the users allowed to send mails via the submission listener.
+	SubmissionUsers map[string]string `json:"SubmissionUsers"`
+	/*
+		SubmissionRelayViaMX delivers the submitted mails directly to the mail exchangers of the recipient domains,
+		instead of relaying them via the MTA of forward mail client.
+	*/
+	SubmissionRelayViaMX bool `json:"SubmissionRelayViaMX"`
 
 	CommandRunner     *mailcmd.CommandRunner `json:"-"` // Process feature commands from incoming mails
 	ForwardMailClient inet.MailClient        `json:"-"` // ForwardMailClient is used to forward arriving emails.
@@ -47,9 +87,24 @@ type Daemon struct {
 	tlsCert       tls.Certificate
 	tcpServer     *common.TCPServer
 	logger        *lalog.Logger
+	resolver      mailAuthResolver // resolver looks up the DNS records for sender authentication and mail relay.
+
+	submissionConfig smtp.Config
+	submissionServer *common.TCPServer
+
+	autoReplyNotBefore map[string]time.Time // autoReplyNotBefore is keyed by rule index and sender address
+	autoReplyMutex     *sync.Mutex
+
+	quarantine       []*QuarantinedMail // quarantine keeps the mails that are not delivered due to blocked attachments, oldest first.
+	lastQuarantineID int
+	quarantineMutex  *sync.Mutex
 
 	// processMailTestCaseFunc works along side normal delivery routine, it offers mail message to test case for inspection.
 	processMailTestCaseFunc func(string, string)
+	// submitMailTestCaseFunc offers the sender, recipients, and message of submitted mails to test case for inspection.
+	submitMailTestCaseFunc func(string, []string, string)
+	// autoReplyTestCaseFunc offers the recipient and message of auto replies to test case for inspection.
+	autoReplyTestCaseFunc func(string, string)
 }
 
 // Check configuration and initialise internal states.
@@ -87,17 +142,38 @@ func (daemon *Daemon) Initialise() error {
 			return fmt.Errorf("smtpd.Initialise: failed to load certificate or key - %v", err)
 		}
 	}
+	if daemon.RequireTLS && daemon.TLSCertPath == "" {
+		return errors.New("smtpd.Initialise: RequireTLS requires TLS certificate and key")
+	}
+	if daemon.MaxMessageSize < 1 || daemon.MaxMessageSize > inet.MaxMailBodySize {
+		daemon.MaxMessageSize = inet.MaxMailBodySize
+	}
+	for i, attachmentType := range daemon.BlockedAttachmentTypes {
+		attachmentType = strings.ToLower(strings.TrimSpace(attachmentType))
+		if len(attachmentType) < 2 || !strings.HasPrefix(attachmentType, ".") && !strings.Contains(attachmentType, "/") {
+			return fmt.Errorf("smtpd.Initialise: blocked attachment type \"%s\" must be a file name extension (e.g. \".exe\") or a MIME type", daemon.BlockedAttachmentTypes[i])
+		}
+		daemon.BlockedAttachmentTypes[i] = attachmentType
+	}
+	if daemon.MaxQuarantinedMails < 1 {
+		daemon.MaxQuarantinedMails = DefaultMaxQuarantinedMails
+	}
+	if daemon.RejectAuthFailures {
+		daemon.AuthenticateSenders = true
+	}
+	if daemon.resolver == nil {
+		daemon.resolver = net.DefaultResolver
+	}
 	daemon.smtpConfig = smtp.Config{
 		IOTimeout:                          IOTimeoutSec * time.Second, // IO timeout is a reasonable minute
-		MaxMessageLength:                   inet.MaxMailBodySize,
+		MaxMessageLength:                   int64(daemon.MaxMessageSize),
 		MaxConsecutiveUnrecognisedCommands: MaxConversationLength / 2, // Abort connection after consecutive bad commands
 		// Greet SMTP clients with a list of domain names that this server receives emails for
 		ServerName: strings.Join(daemon.MyDomains, " "),
 	}
 	if daemon.TLSCertPath != "" {
-		daemon.smtpConfig.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{daemon.tlsCert},
-		}
+		daemon.smtpConfig.TLSConfig = misc.DefaultTLS.ServerConfig(daemon.tlsCert)
+		daemon.smtpConfig.RequireTLS = daemon.RequireTLS
 	}
 
 	// Do not allow forward to this daemon itself
@@ -123,6 +199,15 @@ func (daemon *Daemon) Initialise() error {
 			return fmt.Errorf("smtpd.Initialise: forward address \"%s\" must not loop back to this mail server's domain", fwd)
 		}
 	}
+	for i, rule := range daemon.AutoReplies {
+		if err := rule.Initialise(); err != nil {
+			return fmt.Errorf("smtpd.Initialise: auto reply rule %d - %w", i, err)
+		}
+	}
+	daemon.autoReplyNotBefore = make(map[string]time.Time)
+	daemon.autoReplyMutex = new(sync.Mutex)
+	daemon.quarantine = make([]*QuarantinedMail, 0)
+	daemon.quarantineMutex = new(sync.Mutex)
 	// Initialise the optional toolbox command runner
 	if daemon.CommandRunner == nil || daemon.CommandRunner.Processor == nil || daemon.CommandRunner.Processor.IsEmpty() {
 		daemon.logger.Info("", nil, "daemon will not be able to execute toolbox commands due to lack of command processor filter configuration")
@@ -150,7 +235,7 @@ func (daemon *Daemon) Initialise() error {
 		LimitPerSec: daemon.PerIPLimit,
 	}
 	daemon.tcpServer.Initialise()
-	return nil
+	return daemon.initialiseSubmission()
 }
 
 // Unconditionally forward the mail to forward addresses, then process feature commands if they are found.
@@ -162,6 +247,11 @@ func (daemon *Daemon) ProcessMail(clientIP, fromAddr, mailBody string) {
 			daemon.logger.Info(fromAddr, nil, "failed to process toolbox command from mail body - %v", err)
 		}
 	}
+	_ = daemon.forwardMail(fromAddr, bodyBytes)
+}
+
+// forwardMail forwards the mail to all forward addresses, working around the DMARC policy of the sender's domain if necessary.
+func (daemon *Daemon) forwardMail(fromAddr string, bodyBytes []byte) (err error) {
 	// Determine whether the sender enforces DMARC policy
 	fromAddrWithoutDmarc := GetFromAddressWithDmarcWorkaround(fromAddr, rand.Intn(100000))
 	if fromAddrWithoutDmarc != fromAddr {
@@ -172,7 +262,7 @@ func (daemon *Daemon) ProcessMail(clientIP, fromAddr, mailBody string) {
 		bodyBytes = WithHeaderFromAddr(bodyBytes, fromAddrWithoutDmarc)
 	}
 	// Forward the mail to all recipients
-	if err := daemon.ForwardMailClient.SendRaw(daemon.ForwardMailClient.MailFrom, bodyBytes, daemon.ForwardTo...); err == nil {
+	if err = daemon.ForwardMailClient.SendRaw(daemon.ForwardMailClient.MailFrom, bodyBytes, daemon.ForwardTo...); err == nil {
 		daemon.logger.Info(fromAddr, nil, "successfully forwarded mail to %v", daemon.ForwardTo)
 	} else {
 		daemon.logger.Warning(fromAddr, err, "failed to forward email")
@@ -181,6 +271,21 @@ func (daemon *Daemon) ProcessMail(clientIP, fromAddr, mailBody string) {
 	if daemon.processMailTestCaseFunc != nil {
 		daemon.processMailTestCaseFunc(fromAddr, string(bodyBytes))
 	}
+	return
+}
+
+// authenticateMail evaluates the sender authentication of an incoming mail and logs the results.
+func (daemon *Daemon) authenticateMail(clientIP, heloName, fromAddr, mailBody string) *MailAuthResult {
+	ctx, cancel := context.WithTimeout(context.Background(), MailAuthTimeoutSec*time.Second)
+	defer cancel()
+	result := daemon.AuthenticateMail(ctx, clientIP, heloName, fromAddr, mailBody)
+	dkimResults := make([]string, 0, len(result.DKIM))
+	for _, dkim := range result.DKIM {
+		dkimResults = append(dkimResults, dkim.Result+"("+dkim.Domain+")")
+	}
+	daemon.logger.Info(clientIP, nil, "sender authentication of mail from \"%s\": spf=%s(%s) dkim=%v dmarc=%s(%s) %s",
+		fromAddr, result.SPF, result.SPFDomain, dkimResults, result.DMARC, result.FromDomain, result.DMARCPolicy)
+	return result
 }
 
 // GetTCPStatsCollector returns the stats collector that counts and times client connections for the TCP application.
@@ -195,8 +300,10 @@ func (daemon *Daemon) HandleTCPConnection(logger *lalog.Logger, ip string, clien
 	var completionStatus string
 	// memorise latest conversations for logging purpose
 	latestConv := datastruct.NewRingBuffer(4)
-	// fromAddr, mailBody, and toAddrs will be filled as SMTP conversation goes on
-	var fromAddr, mailBody string
+	// heloName, fromAddr, mailBody, and toAddrs will be filled as SMTP conversation goes on
+	var heloName, fromAddr, mailBody string
+	// authRejection is the reason of rejecting the mail that failed sender authentication
+	var authRejection string
 	toAddrs := make([]string, 0, 4)
 
 	smtpConn := smtp.NewConnection(client, daemon.smtpConfig, daemon.logger)
@@ -228,6 +335,8 @@ func (daemon *Daemon) HandleTCPConnection(logger *lalog.Logger, ip string, clien
 			goto done
 		case smtp.ConvReceivedCommand:
 			switch ev.Verb {
+			case smtp.VerbHELO, smtp.VerbEHLO:
+				heloName = ev.Parameter
 			case smtp.VerbMAILFROM:
 				fromAddr = ev.Parameter
 			case smtp.VerbRCPTTO:
@@ -246,15 +355,35 @@ func (daemon *Daemon) HandleTCPConnection(logger *lalog.Logger, ip string, clien
 			}
 		case smtp.ConvReceivedData:
 			mailBody = ev.Parameter
+			authRejection = ""
+			if daemon.AuthenticateSenders && fromAddr != "" && len(toAddrs) > 0 {
+				authResult := daemon.authenticateMail(ip, heloName, fromAddr, mailBody)
+				if authRejection = authResult.GetRejectionReason(); daemon.RejectAuthFailures && authRejection != "" {
+					// Reject the mail data before the client considers the mail delivered
+					smtpConn.AnswerNegative()
+				} else {
+					authRejection = ""
+					mailBody = authResult.Annotate(daemon.MyDomains[0], mailBody)
+				}
+			}
 		}
 	}
 done:
-	if fromAddr != "" && len(toAddrs) > 0 && mailBody != "" {
+	if authRejection != "" {
+		completionStatus += " & rejected mail due to " + authRejection
+	} else if fromAddr != "" && len(toAddrs) > 0 && mailBody != "" {
 		daemon.logger.Info(ip, nil, "received mail from \"%s\" addressed to %s", fromAddr, strings.Join(toAddrs, ", "))
 		// Check sender IP against blacklist, do not proceed further if the sender IP has been blacklisted.
 		if blacklistDomainName := IsSuspectIPBlacklisted(ip); blacklistDomainName == "" {
-			// Forward the mail to forward-recipients, hence the original To-Addresses are not relevant.
-			daemon.ProcessMail(ip, fromAddr, mailBody)
+			if reason := daemon.GetBlockedAttachment(mailBody); reason != "" {
+				// Neither forward the mail nor run the commands in it, the mail waits in quarantine to be released.
+				completionStatus += " & quarantined mail due to " + reason
+				daemon.QuarantineMail(ip, fromAddr, toAddrs, mailBody, reason)
+			} else {
+				// Forward the mail to forward-recipients, hence the original To-Addresses are not relevant.
+				daemon.ProcessMail(ip, fromAddr, mailBody)
+				daemon.ReplyAutomatically(fromAddr, toAddrs, mailBody)
+			}
 		} else {
 			completionStatus += " & rejected mail due to blacklist"
 			daemon.logger.Warning(ip, nil, "not going to process the mail further because the client IP was blacklisted by %s. The mail content was: %s", blacklistDomainName, mailBody)
@@ -264,6 +393,10 @@ done:
 		smtpConn.AnswerNegative()
 		completionStatus += " & rejected mail due to missing parameters or blacklist"
 	}
+	common.TCPConnections.AddBytes(ip, int64(len(mailBody)), 0)
+	if strings.HasPrefix(smtpConn.TLSHelp, "handshake failure") {
+		common.TCPConnections.RecordHandshakeFailure("smtpd", ip, smtpConn.TLSHelp)
+	}
 	daemon.logger.Info(ip, nil, "%s after %d conversations (TLS: %s), last commands: %s",
 		completionStatus, numCommands, smtpConn.TLSHelp, strings.Join(latestConv.GetAll(), " | "))
 }
@@ -273,12 +406,31 @@ You may call this function only after having called Initialise()!
 Start SMTP daemon and block until daemon is told to stop.
 */
 func (daemon *Daemon) StartAndBlock() (err error) {
-	return daemon.tcpServer.StartAndBlock()
+	if daemon.submissionServer == nil {
+		return daemon.tcpServer.StartAndBlock()
+	}
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- daemon.tcpServer.StartAndBlock()
+	}()
+	go func() {
+		errChan <- daemon.submissionServer.StartAndBlock()
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errChan; err != nil {
+			daemon.Stop()
+			return err
+		}
+	}
+	return nil
 }
 
 // If SMTP daemon has started (i.e. listener is set), close the listener so that its connection loop will terminate.
 func (daemon *Daemon) Stop() {
 	daemon.tcpServer.Stop()
+	if daemon.submissionServer != nil {
+		daemon.submissionServer.Stop()
+	}
 }
 
 // Run unit tests on Daemon. See TestSMTPD_StartAndBlock for daemon setup.
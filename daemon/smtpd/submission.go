@@ -0,0 +1,270 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/smtp"
+	"github.com/HouzuoGuo/laitos/datastruct"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+// MXLookupTimeoutSec is the timeout of looking up the mail exchangers of a recipient domain.
+const MXLookupTimeoutSec = 10
+
+// ErrNullMX is returned when the recipient domain publishes a null MX record (RFC 7505) to indicate that it does not accept mails.
+var ErrNullMX = errors.New("the domain does not accept mails (null MX)")
+
+// submissionServer is the TCP application that accepts mails from authenticated users and relays them to their recipients.
+type submissionServer struct {
+	daemon *Daemon
+}
+
+// initialiseSubmission prepares the mail submission listener if the submission port is configured.
+func (daemon *Daemon) initialiseSubmission() error {
+	if daemon.SubmissionPort < 1 {
+		return nil
+	}
+	if daemon.TLSCertPath == "" {
+		return errors.New("smtpd.Initialise: mail submission requires TLS certificate and key")
+	}
+	if len(daemon.SubmissionUsers) == 0 {
+		return errors.New("smtpd.Initialise: mail submission requires at least one user")
+	}
+	for username, password := range daemon.SubmissionUsers {
+		if username == "" || password == "" {
+			return errors.New("smtpd.Initialise: mail submission user name and password must not be empty")
+		}
+	}
+	if daemon.SubmissionPort == daemon.Port {
+		return fmt.Errorf("smtpd.Initialise: mail submission port must not be the same as SMTP port %d", daemon.Port)
+	}
+	// The submission listener shares the TLS certificate and IO limits with the SMTP listener
+	daemon.submissionConfig = daemon.smtpConfig
+	daemon.submissionConfig.RequireTLS = true
+	daemon.submissionConfig.RequireAuth = true
+	daemon.submissionConfig.Authenticate = daemon.authenticateSubmissionUser
+	daemon.submissionServer = common.NewTCPServer(daemon.Address, daemon.SubmissionPort, "smtpd-submission", &submissionServer{daemon: daemon}, daemon.PerIPLimit)
+	return nil
+}
+
+// authenticateSubmissionUser returns true only if the user name and password match one of the submission users.
+func (daemon *Daemon) authenticateSubmissionUser(username, password string) bool {
+	expected, exists := daemon.SubmissionUsers[username]
+	if !exists {
+		// Spend roughly the same amount of time as comparing the password of an existing user
+		subtle.ConstantTimeCompare([]byte(password), []byte(password))
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+/*
+isSubmissionSenderAllowed returns true only if the authenticated user may send the mail from the address. A user whose
+name is a mail address may only use that address, any other user may only use the user name at one of MyDomains.
+*/
+func (daemon *Daemon) isSubmissionSenderAllowed(username, fromAddr string) bool {
+	if strings.ContainsRune(username, '@') {
+		return strings.EqualFold(username, fromAddr)
+	}
+	atSign := strings.LastIndexByte(fromAddr, '@')
+	if atSign < 1 || !strings.EqualFold(fromAddr[:atSign], username) {
+		return false
+	}
+	_, isMine := daemon.myDomainsHash[strings.ToLower(fromAddr[atSign+1:])]
+	return isMine
+}
+
+// GetTCPStatsCollector returns the stats collector that counts and times client connections for the TCP application.
+func (sub *submissionServer) GetTCPStatsCollector() *misc.Stats {
+	return misc.SMTPDStats
+}
+
+/*
+HandleTCPConnection converses with a mail client that must start TLS and authenticate itself before submitting a mail.
+Unlike the SMTP listener, the mail may be addressed to recipients of any domain, and it is relayed to the recipients
+instead of the forward addresses. A client may submit several mails in a conversation. The client connection is closed by server upon returning from the implementation.
+*/
+func (sub *submissionServer) HandleTCPConnection(logger *lalog.Logger, ip string, client *net.TCPConn) {
+	daemon := sub.daemon
+	var numCommands int
+	// The status string is only used for logging
+	var completionStatus string
+	// memorise latest conversations for logging purpose
+	latestConv := datastruct.NewRingBuffer(4)
+	var fromAddr string
+	var numSubmitted int
+	toAddrs := make([]string, 0, 4)
+
+	// Each failed login counts towards the ban of the client IP among all TCP daemons
+	smtpConfig := daemon.submissionConfig
+	smtpConfig.AuthFailed = func() {
+		common.TCPConnections.RecordHandshakeFailure("smtpd-submission", ip, "authentication failure")
+	}
+	smtpConn := smtp.NewConnection(client, smtpConfig, daemon.logger)
+	for {
+		if misc.EmergencyLockDown {
+			daemon.logger.Warning("", misc.ErrEmergencyLockDown, "")
+			return
+		}
+		if numCommands >= MaxConversationLength {
+			smtpConn.AnswerRateLimited()
+			completionStatus = "conversation is taking too long"
+			goto done
+		}
+		numCommands++
+		ev := smtpConn.CarryOn()
+		// Memorise latest conversation for logging, the credentials exchanged by AUTH command never show up here.
+		logConv := fmt.Sprintf("%v[%v](%v)", ev.State, ev.Verb, ev.Parameter)
+		if len(logConv) > 80 {
+			logConv = logConv[:80]
+		}
+		latestConv.Push(logConv)
+		switch ev.State {
+		case smtp.ConvCompleted:
+			completionStatus = "done"
+			goto done
+		case smtp.ConvAborted:
+			completionStatus = fmt.Sprintf("aborted (%s)", ev.Parameter)
+			goto done
+		case smtp.ConvReceivedCommand:
+			switch ev.Verb {
+			case smtp.VerbMAILFROM:
+				// A user may not send mails on behalf of others
+				if !daemon.isSubmissionSenderAllowed(smtpConn.AuthenticatedUser, ev.Parameter) {
+					daemon.logger.Info(ip, nil, "user \"%s\" may not send mail from \"%s\"", smtpConn.AuthenticatedUser, ev.Parameter)
+					smtpConn.AnswerNegative()
+					continue
+				}
+				fromAddr = ev.Parameter
+			case smtp.VerbRCPTTO:
+				if atSign := strings.IndexRune(ev.Parameter, '@'); atSign > 0 {
+					if len(toAddrs) >= MaxNumRecipients {
+						completionStatus = "too many recipients"
+						smtpConn.AnswerNegative()
+						goto done
+					}
+					// Refuse the recipient right away if its domain does not accept mails
+					if daemon.SubmissionRelayViaMX {
+						if _, err := daemon.getMailExchanger(ev.Parameter[atSign+1:]); err != nil {
+							daemon.logger.Info(ip, err, "refused recipient \"%s\"", ev.Parameter)
+							smtpConn.AnswerNegative()
+							continue
+						}
+					}
+					toAddrs = append(toAddrs, ev.Parameter)
+				}
+			}
+		case smtp.ConvReceivedData:
+			common.TCPConnections.AddBytes(ip, int64(len(ev.Parameter)), 0)
+			if smtpConn.AuthenticatedUser == "" || fromAddr == "" || len(toAddrs) == 0 {
+				smtpConn.AnswerNegative()
+				completionStatus = "rejected mail due to missing parameters"
+				goto done
+			}
+			daemon.logger.Info(ip, nil, "user \"%s\" submitted mail from \"%s\" addressed to %s", smtpConn.AuthenticatedUser, fromAddr, strings.Join(toAddrs, ", "))
+			if err := daemon.relaySubmittedMail(fromAddr, toAddrs, ev.Parameter); err != nil {
+				smtpConn.AnswerNegative()
+				completionStatus = fmt.Sprintf("failed to relay mail - %v", err)
+				goto done
+			}
+			numSubmitted++
+			// Get ready for the next mail in the same conversation
+			fromAddr = ""
+			toAddrs = toAddrs[:0]
+		}
+	}
+done:
+	if strings.HasPrefix(smtpConn.TLSHelp, "handshake failure") {
+		common.TCPConnections.RecordHandshakeFailure("smtpd-submission", ip, smtpConn.TLSHelp)
+	}
+	daemon.logger.Info(ip, nil, "submission %s after %d conversations and %d mails (TLS: %s, user: %s), last commands: %s",
+		completionStatus, numCommands, numSubmitted, smtpConn.TLSHelp, smtpConn.AuthenticatedUser, strings.Join(latestConv.GetAll(), " | "))
+}
+
+/*
+relaySubmittedMail sends the mail to its recipients via the forward mail client's MTA, or if SubmissionRelayViaMX is
+enabled, delivers the mail directly to the mail exchanger of each recipient domain. The mail client delivers the mail in
+the background and retries the failed deliveries for up to couple of days, therefore, once the mail is queued for any of
+the recipients, it counts as accepted and the client must not submit it again.
+*/
+func (daemon *Daemon) relaySubmittedMail(fromAddr string, toAddrs []string, mailBody string) error {
+	// Offer the submitted mail to test case
+	if daemon.submitMailTestCaseFunc != nil {
+		daemon.submitMailTestCaseFunc(fromAddr, toAddrs, mailBody)
+	}
+	if !daemon.SubmissionRelayViaMX {
+		if err := daemon.ForwardMailClient.SendRaw(fromAddr, []byte(mailBody), toAddrs...); err != nil {
+			daemon.logger.Warning(fromAddr, err, "failed to relay submitted mail")
+			return err
+		}
+		daemon.logger.Info(fromAddr, nil, "relaying submitted mail to %v via %s", toAddrs, daemon.ForwardMailClient.MTAHost)
+		return nil
+	}
+	// Group the recipients by their domain so that each mail exchanger receives the mail once
+	recipientsByDomain := make(map[string][]string)
+	for _, addr := range toAddrs {
+		domain := strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+		recipientsByDomain[domain] = append(recipientsByDomain[domain], addr)
+	}
+	var numQueued int
+	var lastErr error
+	for domain, recipients := range recipientsByDomain {
+		mx, err := daemon.getMailExchanger(domain)
+		if err != nil {
+			daemon.logger.Warning(fromAddr, err, "will not relay submitted mail to %v", recipients)
+			lastErr = err
+			continue
+		}
+		// Deliver the mail without authentication, in the same way as one MTA delivers to another.
+		client := daemon.ForwardMailClient
+		client.MailFrom = fromAddr
+		client.MTAHost = mx
+		client.MTAPort = 25
+		client.AuthUsername = ""
+		client.AuthPassword = ""
+		client.OAuth2 = nil
+		if err := client.SendRaw(fromAddr, []byte(mailBody), recipients...); err != nil {
+			daemon.logger.Warning(fromAddr, err, "failed to relay submitted mail to %s", mx)
+			lastErr = err
+			continue
+		}
+		numQueued++
+		daemon.logger.Info(fromAddr, nil, "relaying submitted mail to %v via %s", recipients, mx)
+	}
+	// The mail is rejected only if it has not been queued for any recipient, or the client would deliver duplicates by submitting it again.
+	if numQueued == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+/*
+getMailExchanger returns the most preferred mail exchanger of the domain, or the domain itself if it does not have an MX
+record. It returns ErrNullMX if the domain publishes a null MX record to indicate that it does not accept mails.
+*/
+func (daemon *Daemon) getMailExchanger(domain string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), MXLookupTimeoutSec*time.Second)
+	defer cancel()
+	mxs, err := daemon.resolver.LookupMX(ctx, domain)
+	if err != nil || len(mxs) == 0 {
+		return domain, nil
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	for _, mx := range mxs {
+		if host := strings.TrimSuffix(mx.Host, "."); host == "" {
+			return "", fmt.Errorf("smtpd.getMailExchanger: %s - %w", domain, ErrNullMX)
+		}
+	}
+	return strings.TrimSuffix(mxs[0].Host, "."), nil
+}
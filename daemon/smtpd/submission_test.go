@@ -0,0 +1,252 @@
+package smtpd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	netSMTP "net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSubmissionTestCert writes a self-signed certificate and its key into the directory.
+func writeSubmissionTestCert(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPath, keyPath = filepath.Join(dir, "smtpd.crt"), filepath.Join(dir, "smtpd.key")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which is not offered by net/smtp.
+type loginAuth struct {
+	username, password string
+}
+
+func (auth *loginAuth) Start(*netSMTP.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (auth *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(auth.username), nil
+	case "Password:":
+		return []byte(auth.password), nil
+	}
+	return nil, errors.New("unexpected challenge " + string(fromServer))
+}
+
+func TestDaemon_Submission(t *testing.T) {
+	certPath, keyPath := writeSubmissionTestCert(t, t.TempDir())
+	newDaemon := func() *Daemon {
+		return &Daemon{
+			Port:              2525,
+			MyDomains:         []string{"mx.example.org"},
+			ForwardTo:         []string{"me@example.org"},
+			ForwardMailClient: inet.MailClient{MailFrom: "me@example.org", MTAHost: "127.0.0.1", MTAPort: 1},
+			SubmissionPort:    2587,
+			SubmissionUsers:   map[string]string{"howard@example.org": "pass"},
+			resolver:          &fakeMailAuthResolver{mx: map[string][]string{"example.net": {"mx.example.net."}, "nomail.example.net": {"."}}},
+		}
+	}
+	// Submission requires TLS certificate and users
+	daemon := newDaemon()
+	require.ErrorContains(t, daemon.Initialise(), "TLS")
+	daemon = newDaemon()
+	daemon.TLSCertPath, daemon.TLSKeyPath, daemon.SubmissionUsers = certPath, keyPath, nil
+	require.ErrorContains(t, daemon.Initialise(), "user")
+	daemon = newDaemon()
+	daemon.TLSCertPath, daemon.TLSKeyPath, daemon.SubmissionPort = certPath, keyPath, daemon.Port
+	require.ErrorContains(t, daemon.Initialise(), "same")
+	daemon = newDaemon()
+	daemon.TLSCertPath, daemon.TLSKeyPath = certPath, keyPath
+	require.NoError(t, daemon.Initialise())
+
+	// The SMTP listener does not offer authentication
+	require.Nil(t, daemon.smtpConfig.Authenticate)
+	require.False(t, daemon.smtpConfig.RequireAuth)
+
+	type submittedMail struct {
+		from    string
+		toAddrs []string
+		body    string
+	}
+	submitted := make(chan submittedMail, 10)
+	daemon.submitMailTestCaseFunc = func(from string, toAddrs []string, body string) {
+		submitted <- submittedMail{from: from, toAddrs: append([]string{}, toAddrs...), body: body}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				(&submissionServer{daemon: daemon}).HandleTCPConnection(lalog.DefaultLogger, "10.0.0.1", conn.(*net.TCPConn))
+			}()
+		}
+	}()
+	dial := func() *netSMTP.Client {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		client, err := netSMTP.NewClient(conn, "localhost")
+		require.NoError(t, err)
+		require.NoError(t, client.Hello("client.example.net"))
+		return client
+	}
+	tlsConfig := &tls.Config{ServerName: "localhost", InsecureSkipVerify: true}
+
+	// Authentication is neither offered nor accepted before starting TLS
+	client := dial()
+	hasAuth, _ := client.Extension("AUTH")
+	require.False(t, hasAuth)
+	require.ErrorContains(t, client.Mail("howard@example.org"), "530")
+	require.NoError(t, client.Quit())
+
+	// Wrong password is rejected
+	client = dial()
+	require.NoError(t, client.StartTLS(tlsConfig))
+	hasAuth, mechanisms := client.Extension("AUTH")
+	require.True(t, hasAuth)
+	require.Equal(t, "PLAIN LOGIN", mechanisms)
+	require.ErrorContains(t, client.Auth(netSMTP.PlainAuth("", "howard@example.org", "wrong", "localhost")), "535")
+	client.Close()
+	// An undecodable response is a failed attempt too
+	client = dial()
+	require.NoError(t, client.StartTLS(tlsConfig))
+	id, err := client.Text.Cmd("AUTH PLAIN !!!")
+	require.NoError(t, err)
+	client.Text.StartResponse(id)
+	_, _, err = client.Text.ReadResponse(501)
+	client.Text.EndResponse(id)
+	require.NoError(t, err)
+	client.Close()
+	failures := map[string]int64{}
+	for _, rec := range common.TCPConnections.GetRecords() {
+		if rec.IP == "10.0.0.1" {
+			failures = rec.HandshakeFailures
+		}
+	}
+	require.Equal(t, int64(2), failures["smtpd-submission"])
+
+	// Mail cannot be submitted without authentication
+	client = dial()
+	require.NoError(t, client.StartTLS(tlsConfig))
+	require.ErrorContains(t, client.Mail("howard@example.org"), "Authentication required")
+	require.NoError(t, client.Quit())
+
+	// Submit two mails using PLAIN authentication in a single conversation
+	client = dial()
+	require.NoError(t, client.StartTLS(tlsConfig))
+	require.NoError(t, client.Auth(netSMTP.PlainAuth("", "howard@example.org", "pass", "localhost")))
+	for _, to := range []string{"friend@example.net", "colleague@example.com"} {
+		require.NoError(t, client.Mail("howard@example.org"))
+		require.NoError(t, client.Rcpt(to))
+		writer, err := client.Data()
+		require.NoError(t, err)
+		_, err = writer.Write([]byte("From: howard@example.org\r\nSubject: hi\r\n\r\nhello\r\n"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+		mail := <-submitted
+		require.Equal(t, "howard@example.org", mail.from)
+		require.Equal(t, []string{to}, mail.toAddrs)
+		require.Equal(t, "From: howard@example.org\nSubject: hi\n\nhello\n", mail.body)
+	}
+	// Authentication takes place only once in a conversation
+	require.ErrorContains(t, client.Auth(netSMTP.PlainAuth("", "howard@example.org", "pass", "localhost")), "503")
+	client.Close()
+
+	// Submit a mail using LOGIN authentication
+	client = dial()
+	require.NoError(t, client.StartTLS(tlsConfig))
+	require.NoError(t, client.Auth(&loginAuth{username: "howard@example.org", password: "pass"}))
+	require.NoError(t, client.Mail("howard@example.org"))
+	require.NoError(t, client.Rcpt("friend@example.net"))
+	writer, err := client.Data()
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("Subject: login\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.NoError(t, client.Quit())
+	require.Equal(t, "Subject: login\n\nhello\n", (<-submitted).body)
+
+	// A user may only send mails from their own address
+	client = dial()
+	require.NoError(t, client.StartTLS(tlsConfig))
+	require.NoError(t, client.Auth(netSMTP.PlainAuth("", "howard@example.org", "pass", "localhost")))
+	require.ErrorContains(t, client.Mail("ceo@example.org"), "550")
+	client.Close()
+	require.True(t, daemon.isSubmissionSenderAllowed("howard@example.org", "Howard@Example.org"))
+	require.False(t, daemon.isSubmissionSenderAllowed("howard@example.org", "howard@example.net"))
+	require.True(t, daemon.isSubmissionSenderAllowed("howard", "howard@mx.example.org"))
+	require.False(t, daemon.isSubmissionSenderAllowed("howard", "howard@example.org"))
+	require.False(t, daemon.isSubmissionSenderAllowed("howard", "ceo@mx.example.org"))
+
+	// Relaying via MX uses the most preferred mail exchanger, or the domain itself if it does not have one.
+	mx, err := daemon.getMailExchanger("example.net")
+	require.NoError(t, err)
+	require.Equal(t, "mx.example.net", mx)
+	mx, err = daemon.getMailExchanger("example.com")
+	require.NoError(t, err)
+	require.Equal(t, "example.com", mx)
+	_, err = daemon.getMailExchanger("nomail.example.net")
+	require.ErrorIs(t, err, ErrNullMX)
+
+	// The recipient of a domain that does not accept mails is refused
+	daemon.SubmissionRelayViaMX = true
+	client = dial()
+	require.NoError(t, client.StartTLS(tlsConfig))
+	require.NoError(t, client.Auth(netSMTP.PlainAuth("", "howard@example.org", "pass", "localhost")))
+	require.NoError(t, client.Mail("howard@example.org"))
+	require.ErrorContains(t, client.Rcpt("a@nomail.example.net"), "550")
+	require.NoError(t, client.Rcpt("friend@example.net"))
+	writer, err = client.Data()
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("Subject: mx\r\n\r\nhello\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.NoError(t, client.Quit())
+	require.Equal(t, []string{"friend@example.net"}, (<-submitted).toAddrs)
+	require.ErrorIs(t, daemon.relaySubmittedMail("howard@example.org", []string{"a@nomail.example.net"}, "hello"), ErrNullMX)
+	<-submitted
+	// The mail is accepted once it is queued for any of the recipients
+	require.NoError(t, daemon.relaySubmittedMail("howard@example.org", []string{"a@nomail.example.net", "friend@example.net"}, "hello"))
+	<-submitted
+	require.True(t, daemon.authenticateSubmissionUser("howard@example.org", "pass"))
+	require.False(t, daemon.authenticateSubmissionUser("howard@example.org", "pas"))
+	require.False(t, daemon.authenticateSubmissionUser("nobody", "pass"))
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/asn1"
 	"runtime"
 	"sort"
+	"sync/atomic"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/misc"
 )
@@ -53,23 +55,23 @@ var (
 		},
 		/// 1.3.6.1.4.1.52535.121.110 Integer - number of command execution attempts
 		110: func() interface{} {
-			return int64(misc.CommandStats.Count())
+			return int64(common.GetDaemonRequestCount("toolbox"))
 		},
 		// 1.3.6.1.4.1.52535.121.111 Integer - number of web server requests processed
 		111: func() interface{} {
-			return int64(misc.HTTPDStats.Count())
+			return int64(common.GetDaemonRequestCount("httpd"))
 		},
 		// 1.3.6.1.4.1.52535.121.112 Integer - number of SMTP conversations
 		112: func() interface{} {
-			return int64(misc.SMTPDStats.Count())
+			return int64(common.GetDaemonRequestCount("smtpd"))
 		},
-		// 1.3.6.1.4.1.52535.121.114 Integer - number of SMTP conversations
+		// 1.3.6.1.4.1.52535.121.114 Integer - number of auto-unlock events
 		114: func() interface{} {
-			return int64(misc.AutoUnlockStats.Count())
+			return int64(common.GetDaemonRequestCount("autounlock"))
 		},
 		// 1.3.6.1.4.1.52535.121.115 Integer - size of outstanding mails to deliver in bytes
 		115: func() interface{} {
-			return int64(misc.OutstandingMailBytes)
+			return atomic.LoadInt64(&misc.OutstandingMailBytes)
 		},
 	}
 	/*
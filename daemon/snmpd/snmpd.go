@@ -26,6 +26,7 @@ const (
 type Daemon struct {
 	Address    string `json:"Address"`    // Address to listen on, e.g. 0.0.0.0 to listen on all network interfaces.
 	Port       int    `json:"Port"`       // Port to listen on, by default SNMP uses port 161.
+	IPVersion  string `json:"IPVersion"`  // IPVersion is the IP version of clients to serve - "v4", "v6", or "both" (default).
 	PerIPLimit int    `json:"PerIPLimit"` // PerIPLimit is approximately how many requests are allowed from an IP within a designated interval.
 
 	/*
@@ -40,7 +41,10 @@ type Daemon struct {
 // Initialise validates configuration and initialises internal states.
 func (daemon *Daemon) Initialise() error {
 	if daemon.Address == "" {
-		daemon.Address = "0.0.0.0"
+		daemon.Address = common.DefaultListenAddress(daemon.IPVersion)
+	}
+	if err := common.ValidateIPVersion(daemon.IPVersion, daemon.Address); err != nil {
+		return fmt.Errorf("snmpd.Initialise: %w", err)
 	}
 	if daemon.Port == 0 {
 		daemon.Port = 161
@@ -58,6 +62,7 @@ func (daemon *Daemon) Initialise() error {
 	daemon.udpServer = &common.UDPServer{
 		ListenAddr:  daemon.Address,
 		ListenPort:  daemon.Port,
+		IPVersion:   daemon.IPVersion,
 		AppName:     "snmpd",
 		App:         daemon,
 		LimitPerSec: daemon.PerIPLimit,
@@ -178,7 +183,7 @@ func TestSNMPD(daemon *Daemon, t testingstub.T) {
 	time.Sleep(2 * time.Second)
 
 	// Create a UDP client
-	serverAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:"+strconv.Itoa(daemon.Port))
+	serverAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(common.LoopbackAddress(daemon.IPVersion), strconv.Itoa(daemon.Port)))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,202 @@
+package sockd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// LenKnockNonce is the length of the random nonce carried by a knock packet.
+	LenKnockNonce = 16
+	// LenKnockPacket is the length of a knock packet - timestamp, nonce, and HMAC-SHA256 signature of both and the client IP.
+	LenKnockPacket = 8 + LenKnockNonce + sha256.Size
+	// KnockMaxClockSkewSec is the maximum difference in seconds between the knock timestamp and the server clock.
+	KnockMaxClockSkewSec = 60
+	// DefaultKnockValidSec is the default number of seconds a knocking client IP may use the proxy ports for.
+	DefaultKnockValidSec = 3600
+	// MagicKnockKeyInfo distinguishes the knock signing key from the proxy encryption key derived from the same password.
+	MagicKnockKeyInfo = "laitos-sockd-knock"
+)
+
+var ErrKnockRejected = errors.New("knock packet is malformed, expired, replayed, or incorrectly signed")
+
+// getKnockKey returns the HMAC key that signs knock packets.
+func getKnockKey(password string) []byte {
+	mac := hmac.New(sha256.New, GetDerivedKey(password))
+	mac.Write([]byte(MagicKnockKeyInfo))
+	return mac.Sum(nil)
+}
+
+// signKnock returns the HMAC-SHA256 signature of the knock timestamp and nonce, together with the client IP the knock opens the gate to.
+func signKnock(key, timeAndNonce []byte, clientIP net.IP) []byte {
+	if ipv4 := clientIP.To4(); ipv4 != nil {
+		clientIP = ipv4
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(timeAndNonce)
+	mac.Write(clientIP)
+	return mac.Sum(nil)
+}
+
+/*
+NewKnockPacket returns a knock packet signed by the password and stamped with the time. The knock only opens the gate to
+the client IP, which is the IP address of the client as seen by the server, e.g. the public IP of a client behind NAT.
+*/
+func NewKnockPacket(password string, clientIP net.IP, now time.Time) []byte {
+	packet := make([]byte, LenKnockPacket)
+	binary.BigEndian.PutUint64(packet[:8], uint64(now.Unix()))
+	if _, err := rand.Read(packet[8 : 8+LenKnockNonce]); err != nil {
+		panic(err)
+	}
+	copy(packet[8+LenKnockNonce:], signKnock(getKnockKey(password), packet[:8+LenKnockNonce], clientIP))
+	return packet
+}
+
+/*
+Knock sends a signed knock packet to the knock port of a sockd server, e.g. "example.com:12345", to open the gate to the
+client IP. The "laitos knock" command uses it to open the proxy ports to the computer it runs on.
+*/
+func Knock(serverAddr, password string, clientIP net.IP) error {
+	conn, err := net.Dial("udp", serverAddr)
+	if err != nil {
+		return fmt.Errorf("sockd.Knock: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(NewKnockPacket(password, clientIP, time.Now())); err != nil {
+		return fmt.Errorf("sockd.Knock: %w", err)
+	}
+	return nil
+}
+
+/*
+KnockGate keeps the proxy ports closed to a client IP until the client sends a signed knock packet (single packet
+authorisation) to the knock port. The gate never responds to a knock, hence port scanners cannot tell whether the knock
+port is open. The proxy TCP port still completes the TCP handshake before checking the gate, after which the connection
+is reset right away, and the proxy UDP port drops the packets without a response.
+*/
+type KnockGate struct {
+	Address   string
+	Password  string
+	UDPPort   int
+	IPVersion string
+	// ValidSec is the number of seconds a client IP may use the proxy ports for after a successful knock.
+	ValidSec int
+
+	knockKey   []byte
+	mutex      *sync.Mutex
+	allowedIPs map[string]time.Time
+	seenNonces map[string]time.Time
+	udpServer  *common.UDPServer
+	logger     *lalog.Logger
+}
+
+// Initialise validates configuration and prepares the knock server.
+func (gate *KnockGate) Initialise() error {
+	if gate.UDPPort < 1 {
+		return errors.New("KnockGate.Initialise: knock UDP port must be greater than 0")
+	}
+	if gate.ValidSec < 1 {
+		gate.ValidSec = DefaultKnockValidSec
+	}
+	gate.knockKey = getKnockKey(gate.Password)
+	gate.mutex = new(sync.Mutex)
+	gate.allowedIPs = make(map[string]time.Time)
+	gate.seenNonces = make(map[string]time.Time)
+	gate.logger = &lalog.Logger{
+		ComponentName: "sockd",
+		ComponentID:   []lalog.LoggerIDField{{Key: "Knock", Value: strconv.Itoa(gate.UDPPort)}},
+	}
+	gate.udpServer = &common.UDPServer{
+		ListenAddr: gate.Address,
+		ListenPort: gate.UDPPort,
+		IPVersion:  gate.IPVersion,
+		AppName:    "sockd-knock",
+		App:        gate,
+		// Each client only needs to knock occasionally
+		LimitPerSec: 2,
+	}
+	gate.udpServer.Initialise()
+	return nil
+}
+
+// GetUDPStatsCollector returns the stats collector that counts and times knock packets.
+func (gate *KnockGate) GetUDPStatsCollector() *misc.Stats {
+	return misc.SOCKDStatsKnock
+}
+
+// HandleUDPClient verifies a knock packet and lets the client IP through the gate. It does not respond to the client.
+func (gate *KnockGate) HandleUDPClient(logger *lalog.Logger, ip string, _ *net.UDPAddr, packet []byte, _ *net.UDPConn) {
+	if err := gate.Verify(ip, packet, time.Now()); err != nil {
+		logger.Info(ip, nil, "rejected knock - %v", err)
+		return
+	}
+	logger.Info(ip, nil, "client IP may use the proxy for %d seconds", gate.ValidSec)
+}
+
+/*
+Verify checks the signature, timestamp, and nonce of a knock packet, and lets the client IP through the gate if they are
+valid. The signature must cover the client IP, an eavesdropper cannot use the knock to open the gate to another IP.
+*/
+func (gate *KnockGate) Verify(ip string, packet []byte, now time.Time) error {
+	clientIP := net.ParseIP(ip)
+	if len(packet) != LenKnockPacket || clientIP == nil {
+		return ErrKnockRejected
+	}
+	if !hmac.Equal(signKnock(gate.knockKey, packet[:8+LenKnockNonce], clientIP), packet[8+LenKnockNonce:]) {
+		return ErrKnockRejected
+	}
+	knockTime := time.Unix(int64(binary.BigEndian.Uint64(packet[:8])), 0)
+	if skew := now.Sub(knockTime); skew > KnockMaxClockSkewSec*time.Second || skew < -KnockMaxClockSkewSec*time.Second {
+		return ErrKnockRejected
+	}
+	nonce := string(packet[8 : 8+LenKnockNonce])
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	// A nonce older than the clock skew cannot pass the timestamp check again, hence there is no need to remember it.
+	for seenNonce, seenAt := range gate.seenNonces {
+		if now.Sub(seenAt) > 2*KnockMaxClockSkewSec*time.Second {
+			delete(gate.seenNonces, seenNonce)
+		}
+	}
+	for allowedIP, expiry := range gate.allowedIPs {
+		if now.After(expiry) {
+			delete(gate.allowedIPs, allowedIP)
+		}
+	}
+	if _, replayed := gate.seenNonces[nonce]; replayed {
+		return ErrKnockRejected
+	}
+	gate.seenNonces[nonce] = now
+	gate.allowedIPs[ip] = now.Add(time.Duration(gate.ValidSec) * time.Second)
+	return nil
+}
+
+// IsAllowed returns true only if the client IP has knocked successfully and its knock has not yet expired.
+func (gate *KnockGate) IsAllowed(ip string) bool {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	expiry, exists := gate.allowedIPs[ip]
+	return exists && time.Now().Before(expiry)
+}
+
+// StartAndBlock starts the knock server and blocks until the server is stopped.
+func (gate *KnockGate) StartAndBlock() error {
+	return gate.udpServer.StartAndBlock()
+}
+
+// Stop terminates the knock server.
+func (gate *KnockGate) Stop() {
+	gate.udpServer.Stop()
+}
@@ -0,0 +1,112 @@
+package sockd
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+)
+
+func TestKnockGate_Verify(t *testing.T) {
+	gate := &KnockGate{Password: "abcdefg", UDPPort: 27102}
+	if err := gate.Initialise(); err != nil || gate.ValidSec != DefaultKnockValidSec {
+		t.Fatal(err, gate.ValidSec)
+	}
+	now := time.Now()
+	if gate.IsAllowed("1.1.1.1") {
+		t.Fatal("should not have been allowed")
+	}
+	// Malformed, incorrectly signed, and expired knocks
+	if err := gate.Verify("1.1.1.1", []byte{1, 2, 3}, now); err != ErrKnockRejected {
+		t.Fatal(err)
+	}
+	if err := gate.Verify("1.1.1.1", NewKnockPacket("wrong password", net.ParseIP("1.1.1.1"), now), now); err != ErrKnockRejected {
+		t.Fatal(err)
+	}
+	if err := gate.Verify("1.1.1.1", NewKnockPacket("abcdefg", net.ParseIP("1.1.1.1"), now.Add(-(KnockMaxClockSkewSec+1)*time.Second)), now); err != ErrKnockRejected {
+		t.Fatal(err)
+	}
+	if err := gate.Verify("1.1.1.1", NewKnockPacket("abcdefg", net.ParseIP("1.1.1.1"), now.Add((KnockMaxClockSkewSec+1)*time.Second)), now); err != ErrKnockRejected {
+		t.Fatal(err)
+	}
+	if gate.IsAllowed("1.1.1.1") {
+		t.Fatal("should not have been allowed")
+	}
+	// A valid knock lets the IP through
+	knock := NewKnockPacket("abcdefg", net.ParseIP("1.1.1.1"), now)
+	if err := gate.Verify("1.1.1.1", knock, now); err != nil {
+		t.Fatal(err)
+	}
+	if !gate.IsAllowed("1.1.1.1") || gate.IsAllowed("2.2.2.2") {
+		t.Fatal("incorrect gate state")
+	}
+	// The same knock cannot be replayed from another IP, even before it is used.
+	if err := gate.Verify("2.2.2.2", knock, now); err != ErrKnockRejected || gate.IsAllowed("2.2.2.2") {
+		t.Fatal(err)
+	}
+	if err := gate.Verify("2.2.2.2", NewKnockPacket("abcdefg", net.ParseIP("1.1.1.1"), now), now); err != ErrKnockRejected || gate.IsAllowed("2.2.2.2") {
+		t.Fatal(err)
+	}
+	// An IPv4-mapped IPv6 address is the same client IP
+	if err := gate.Verify("::ffff:2.2.2.2", NewKnockPacket("abcdefg", net.ParseIP("2.2.2.2"), now), now); err != nil {
+		t.Fatal(err)
+	}
+	// The IP is no longer allowed after the knock expires
+	gate.ValidSec = 1
+	if err := gate.Verify("3.3.3.3", NewKnockPacket("abcdefg", net.ParseIP("3.3.3.3"), now), now.Add(-2*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if gate.IsAllowed("3.3.3.3") {
+		t.Fatal("should have expired")
+	}
+}
+
+func TestSockd_KnockGate(t *testing.T) {
+	daemon := Daemon{
+		Address:      "127.0.0.1",
+		Password:     "abcdefg",
+		TCPPorts:     []int{27103},
+		UDPPorts:     []int{27104},
+		KnockUDPPort: 27105,
+		DNSDaemon:    &dnsd.Daemon{},
+	}
+	if err := daemon.Initialise(); err != nil || daemon.KnockValidSec != DefaultKnockValidSec {
+		t.Fatal(err, daemon.KnockValidSec)
+	}
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(2 * time.Second)
+	defer daemon.Stop()
+
+	knockAndRead := func() []byte {
+		conn, err := net.Dial("tcp", net.JoinHostPort(daemon.Address, strconv.Itoa(daemon.TCPPorts[0])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := conn.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = conn.Write(make([]byte, 1000))
+		resp, _ := io.ReadAll(conn)
+		return resp
+	}
+	// Without a knock the proxy port resets the connection without responding
+	if resp := knockAndRead(); len(resp) != 0 {
+		t.Fatal(resp)
+	}
+	// After a knock the proxy port responds with random bytes due to incorrect shared key magic
+	if err := Knock(net.JoinHostPort(daemon.Address, strconv.Itoa(daemon.KnockUDPPort)), daemon.Password, net.ParseIP(daemon.Address)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Second)
+	if resp := knockAndRead(); len(resp) < 10 {
+		t.Fatal(resp)
+	}
+}
@@ -18,8 +18,9 @@ PipeTCPConnection receives data from the first connection and copies the data in
 The function returns after the first connection is closed or other IO error occurs, and before returning
 the function closes the second connection and optionally writes a random amount of data into the supposedly
 already terminated first connection.
+The function returns the number of bytes written into the second connection.
 */
-func PipeTCPConnection(src, dest net.Conn, doWriteRand bool) {
+func PipeTCPConnection(src, dest net.Conn, doWriteRand bool) (totalBytes int64) {
 	defer func() {
 		lalog.DefaultLogger.MaybeMinorError(dest.Close())
 	}()
@@ -40,7 +41,9 @@ func PipeTCPConnection(src, dest net.Conn, doWriteRand bool) {
 			return
 		}
 		lalog.DefaultLogger.MaybeMinorError(dest.SetWriteDeadline(time.Now().Add(IOTimeout)))
-		if _, err := WriteWithRetry(dest, buf[:n]); err != nil {
+		written, err := WriteWithRetry(dest, buf[:n])
+		totalBytes += int64(written)
+		if err != nil {
 			return
 		}
 	}
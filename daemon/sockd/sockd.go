@@ -15,6 +15,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/daemon/dnsd"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/testingstub"
@@ -84,6 +85,23 @@ func IsReservedAddr(addr net.IP) bool {
 	return false
 }
 
+/*
+LookupDestination resolves the destination name of a proxy connection using the DNS daemon, and returns the first
+resolved address that is not reserved.
+*/
+func LookupDestination(dnsDaemon *dnsd.Daemon, clientIP, destNameOrIP string) (net.IP, error) {
+	addrs, err := dnsDaemon.LookupProxyDestination("sockd", clientIP, destNameOrIP)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if !IsReservedAddr(addr) {
+			return addr, nil
+		}
+	}
+	return nil, fmt.Errorf("%s resolves into reserved addresses only", destNameOrIP)
+}
+
 func GetDerivedKey(password string) []byte {
 	var sum, remaining []byte
 	md5Sum := md5.New()
@@ -130,7 +148,7 @@ func TestSockd(sockd *Daemon, t testingstub.T) {
 	// Knock on each of the TCP and UDP ports and anticipate random response due to incorrect shared key magic
 	for _, port := range sockd.TCPPorts {
 		fmt.Println("knocking on port", port)
-		if conn, err := net.Dial("tcp", sockd.Address+":"+strconv.Itoa(port)); err != nil {
+		if conn, err := net.Dial("tcp", net.JoinHostPort(sockd.Address, strconv.Itoa(port))); err != nil {
 			t.Fatal(err)
 		} else if n, err := conn.Write(bytes.Repeat([]byte{0}, 1000)); err != nil && n != 10 {
 			t.Fatal(err, n)
@@ -143,7 +161,7 @@ func TestSockd(sockd *Daemon, t testingstub.T) {
 	for _, port := range sockd.UDPPorts {
 		fmt.Println("knocking on port", port)
 		resp := make([]byte, 100)
-		if conn, err := net.Dial("udp", sockd.Address+":"+strconv.Itoa(port)); err != nil {
+		if conn, err := net.Dial("udp", net.JoinHostPort(sockd.Address, strconv.Itoa(port))); err != nil {
 			t.Fatal(err)
 		} else if n, err := conn.Write(bytes.Repeat([]byte{0}, 1000)); err != nil && n != 10 {
 			t.Fatal(err, n)
@@ -169,19 +187,39 @@ type Daemon struct {
 	PerIPLimit int    `json:"PerIPLimit"`
 	TCPPorts   []int  `json:"TCPPorts"`
 	UDPPorts   []int  `json:"UDPPorts"`
+	IPVersion  string `json:"IPVersion"`
+
+	/*
+		KnockUDPPort is the UDP port that receives signed knock packets. When it is set, the proxy ports serve only the
+		client IPs that have knocked, and reset connections and silently drop packets from everyone else.
+	*/
+	KnockUDPPort int `json:"KnockUDPPort"`
+	// KnockValidSec is the number of seconds a client IP may use the proxy ports for after a successful knock.
+	KnockValidSec int `json:"KnockValidSec"`
+	/*
+		ResolveViaDNSDaemon resolves the destination names using the DNS daemon (its black list, custom records, and
+		forwarders) instead of the resolver of operating system, so that the names do not leak to the system resolver
+		and the black listed destinations cannot be reached via their aliases. The names resolved for each connection
+		are recorded in common.ProxyNameResolutions.
+	*/
+	ResolveViaDNSDaemon bool `json:"ResolveViaDNSDaemon"`
 
 	// DNSDaemon is an initialised DNS daemon. It must not be nil.
 	DNSDaemon *dnsd.Daemon `json:"-"`
 
 	tcpDaemons []*TCPDaemon
 	udpDaemons []*UDPDaemon
+	knockGate  *KnockGate
 
 	logger *lalog.Logger
 }
 
 func (daemon *Daemon) Initialise() error {
 	if daemon.Address == "" {
-		daemon.Address = "0.0.0.0"
+		daemon.Address = common.DefaultListenAddress(daemon.IPVersion)
+	}
+	if err := common.ValidateIPVersion(daemon.IPVersion, daemon.Address); err != nil {
+		return fmt.Errorf("sockd.Initialise: %w", err)
 	}
 	if daemon.PerIPLimit < 1 {
 		daemon.PerIPLimit = 96
@@ -199,6 +237,12 @@ func (daemon *Daemon) Initialise() error {
 	if len(daemon.Password) < 7 {
 		return errors.New("sockd.Initialise: password must be at least 7 characters long")
 	}
+	if daemon.KnockUDPPort < 0 {
+		return errors.New("sockd.Initialise: knock UDP port must not be negative")
+	}
+	if daemon.KnockValidSec < 1 {
+		daemon.KnockValidSec = DefaultKnockValidSec
+	}
 	daemon.tcpDaemons = make([]*TCPDaemon, 0)
 	daemon.udpDaemons = make([]*UDPDaemon, 0)
 	return nil
@@ -208,6 +252,25 @@ func (daemon *Daemon) StartAndBlock() error {
 	defer daemon.Stop()
 	wg := new(sync.WaitGroup)
 
+	if daemon.KnockUDPPort > 0 {
+		daemon.knockGate = &KnockGate{
+			Address:   daemon.Address,
+			Password:  daemon.Password,
+			UDPPort:   daemon.KnockUDPPort,
+			IPVersion: daemon.IPVersion,
+			ValidSec:  daemon.KnockValidSec,
+		}
+		if err := daemon.knockGate.Initialise(); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func(knockGate *KnockGate) {
+			defer wg.Done()
+			if knockErr := knockGate.StartAndBlock(); knockErr != nil {
+				daemon.logger.Warning(fmt.Sprintf("Knock-%d", knockGate.UDPPort), knockErr, "failed to start knock gate")
+			}
+		}(daemon.knockGate)
+	}
 	if daemon.TCPPorts != nil {
 		for _, tcpPort := range daemon.TCPPorts {
 			tcpDaemon := &TCPDaemon{
@@ -215,7 +278,11 @@ func (daemon *Daemon) StartAndBlock() error {
 				Password:   daemon.Password,
 				PerIPLimit: daemon.PerIPLimit,
 				TCPPort:    tcpPort,
+				IPVersion:  daemon.IPVersion,
 				DNSDaemon:  daemon.DNSDaemon,
+				KnockGate:  daemon.knockGate,
+
+				ResolveViaDNSDaemon: daemon.ResolveViaDNSDaemon,
 			}
 			if err := tcpDaemon.Initialise(); err != nil {
 				daemon.Stop()
@@ -238,7 +305,11 @@ func (daemon *Daemon) StartAndBlock() error {
 				Password:   daemon.Password,
 				PerIPLimit: daemon.PerIPLimit,
 				UDPPort:    udpPort,
+				IPVersion:  daemon.IPVersion,
 				DNSDaemon:  daemon.DNSDaemon,
+				KnockGate:  daemon.knockGate,
+
+				ResolveViaDNSDaemon: daemon.ResolveViaDNSDaemon,
 			}
 			if err := udpDaemon.Initialise(); err != nil {
 				daemon.Stop()
@@ -258,8 +329,12 @@ func (daemon *Daemon) StartAndBlock() error {
 	return nil
 }
 
-// Stop terminates all TCP and UDP servers.
+// Stop terminates all TCP and UDP servers, as well as the knock gate.
 func (daemon *Daemon) Stop() {
+	if daemon.knockGate != nil {
+		daemon.knockGate.Stop()
+		daemon.knockGate = nil
+	}
 	if daemon.tcpDaemons != nil {
 		for _, tcpDaemon := range daemon.tcpDaemons {
 			if tcpDaemon != nil {
@@ -22,8 +22,12 @@ type TCPDaemon struct {
 	Password   string `json:"Password"`
 	PerIPLimit int    `json:"PerIPLimit"`
 	TCPPort    int    `json:"TCPPort"`
+	IPVersion  string `json:"IPVersion"`
 
 	DNSDaemon *dnsd.Daemon `json:"-"` // it is assumed to be already initialised
+	KnockGate *KnockGate   `json:"-"` // optional, it is assumed to be already initialised
+
+	ResolveViaDNSDaemon bool `json:"-"` // resolve destination names using the DNS daemon instead of the system resolver
 
 	derivedPassword []byte
 	tcpServer       *common.TCPServer
@@ -34,6 +38,7 @@ func (daemon *TCPDaemon) Initialise() error {
 	daemon.tcpServer = &common.TCPServer{
 		ListenAddr:  daemon.Address,
 		ListenPort:  daemon.TCPPort,
+		IPVersion:   daemon.IPVersion,
 		AppName:     "sockd",
 		App:         daemon,
 		LimitPerSec: daemon.PerIPLimit,
@@ -49,17 +54,24 @@ func (daemon *TCPDaemon) GetTCPStatsCollector() *misc.Stats {
 }
 
 func (daemon *TCPDaemon) HandleTCPConnection(logger *lalog.Logger, ip string, client *net.TCPConn) {
+	if daemon.KnockGate != nil && !daemon.KnockGate.IsAllowed(ip) {
+		// Reset the connection without a word, the way a closed port answers a connection attempt.
+		logger.MaybeMinorError(client.SetLinger(0))
+		return
+	}
 	logger.MaybeMinorError(client.SetReadDeadline(time.Now().Add(IOTimeout)))
 	encryptedClientConn := &EncryptedTCPConn{Conn: client, DerivedPassword: daemon.derivedPassword}
 	proxyDestAddr, err := ReadProxyDestAddr(encryptedClientConn, make([]byte, LenProxyConnectRequest))
 	if err != nil {
 		logger.Info(ip, nil, "failed to get destination address - %v", err)
+		common.TCPConnections.RecordHandshakeFailure("sockd", ip, "failed to get destination address")
 		WriteRandomToTCP(client)
 		return
 	}
 	destNameOrIP, destPort := proxyDestAddr.HostPort()
 	if destNameOrIP == "" || destPort == 0 || strings.ContainsRune(destNameOrIP, 0) {
 		logger.Info(ip, nil, "invalid destination IP (%s) or port (%d)", destNameOrIP, destPort)
+		common.TCPConnections.RecordHandshakeFailure("sockd", ip, "invalid destination")
 		WriteRandomToTCP(client)
 		return
 	}
@@ -78,15 +90,26 @@ func (daemon *TCPDaemon) HandleTCPConnection(logger *lalog.Logger, ip string, cl
 		WriteRandomToTCP(client)
 		return
 	}
-	proxyDestConn, err := net.Dial("tcp", net.JoinHostPort(destNameOrIP, strconv.Itoa(destPort)))
+	destAddr := destNameOrIP
+	if daemon.ResolveViaDNSDaemon {
+		resolvedIP, err := LookupDestination(daemon.DNSDaemon, ip, destNameOrIP)
+		if err != nil {
+			logger.Info(ip, err, "will not serve destination %s", destNameOrIP)
+			return
+		}
+		destAddr = resolvedIP.String()
+	}
+	proxyDestConn, err := net.Dial("tcp", net.JoinHostPort(destAddr, strconv.Itoa(destPort)))
 	if err != nil {
 		logger.Info(ip, err, "failed to connect to destination \"%s:%d\"", destNameOrIP, destPort)
 		return
 	}
 	misc.TweakTCPConnection(encryptedClientConn.Conn.(*net.TCPConn), IOTimeout)
 	misc.TweakTCPConnection(proxyDestConn.(*net.TCPConn), IOTimeout)
-	go PipeTCPConnection(encryptedClientConn, proxyDestConn, true)
-	PipeTCPConnection(proxyDestConn, encryptedClientConn, false)
+	go func() {
+		common.TCPConnections.AddBytes(ip, PipeTCPConnection(encryptedClientConn, proxyDestConn, true), 0)
+	}()
+	common.TCPConnections.AddBytes(ip, 0, PipeTCPConnection(proxyDestConn, encryptedClientConn, false))
 }
 
 func (daemon *TCPDaemon) StartAndBlock() error {
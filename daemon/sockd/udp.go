@@ -20,8 +20,12 @@ type UDPDaemon struct {
 	Password   string
 	PerIPLimit int
 	UDPPort    int
+	IPVersion  string
 
 	DNSDaemon *dnsd.Daemon
+	KnockGate *KnockGate
+
+	ResolveViaDNSDaemon bool // resolve destination names using the DNS daemon instead of the system resolver
 
 	logger          *lalog.Logger
 	udpBacklog      *UDPBacklog
@@ -33,6 +37,7 @@ func (daemon *UDPDaemon) Initialise() error {
 	daemon.udpServer = &common.UDPServer{
 		ListenAddr:  daemon.Address,
 		ListenPort:  daemon.UDPPort,
+		IPVersion:   daemon.IPVersion,
 		AppName:     "sockd",
 		App:         daemon,
 		LimitPerSec: daemon.PerIPLimit,
@@ -52,6 +57,10 @@ func (daemon *UDPDaemon) GetUDPStatsCollector() *misc.Stats {
 }
 
 func (daemon *UDPDaemon) HandleUDPClient(logger *lalog.Logger, ip string, client *net.UDPAddr, packet []byte, srv *net.UDPConn) {
+	if daemon.KnockGate != nil && !daemon.KnockGate.IsAllowed(ip) {
+		// Drop the packet without a word as if the port was not open
+		return
+	}
 	decryptedLen, err := DecryptUDPPacket(len(packet), packet, daemon.derivedPassword)
 	if err != nil {
 		logger.Info(ip, nil, "failed to decrypt packet - %v", err)
@@ -81,8 +90,15 @@ func (daemon *UDPDaemon) HandleUDPClient(logger *lalog.Logger, ip string, client
 		logger.Info(ip, nil, "will not serve blacklisted destination %s", destNameOrIP)
 		return
 	}
-	resolvedAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(destNameOrIP, strconv.Itoa(destPort)))
-	if err != nil {
+	var resolvedAddr *net.UDPAddr
+	if daemon.ResolveViaDNSDaemon {
+		resolvedIP, err := LookupDestination(daemon.DNSDaemon, ip, destNameOrIP)
+		if err != nil {
+			logger.Info(ip, err, "will not serve destination %s", destNameOrIP)
+			return
+		}
+		resolvedAddr = &net.UDPAddr{IP: resolvedIP, Port: destPort}
+	} else if resolvedAddr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(destNameOrIP, strconv.Itoa(destPort))); err != nil {
 		logger.Info(ip, err, "failed to resolve destination \"%s\"", destNameOrIP)
 		return
 	}
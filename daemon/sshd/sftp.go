@@ -0,0 +1,627 @@
+package sshd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+// SFTP version 3 packet types, as defined in draft-ietf-secsh-filexfer-02.
+const (
+	sftpPacketInit     = 1
+	sftpPacketVersion  = 2
+	sftpPacketOpen     = 3
+	sftpPacketClose    = 4
+	sftpPacketRead     = 5
+	sftpPacketWrite    = 6
+	sftpPacketLstat    = 7
+	sftpPacketFstat    = 8
+	sftpPacketSetstat  = 9
+	sftpPacketFsetstat = 10
+	sftpPacketOpendir  = 11
+	sftpPacketReaddir  = 12
+	sftpPacketRemove   = 13
+	sftpPacketMkdir    = 14
+	sftpPacketRmdir    = 15
+	sftpPacketRealpath = 16
+	sftpPacketStat     = 17
+	sftpPacketRename   = 18
+	sftpPacketStatus   = 101
+	sftpPacketHandle   = 102
+	sftpPacketData     = 103
+	sftpPacketName     = 104
+	sftpPacketAttrs    = 105
+)
+
+// SFTP status codes.
+const (
+	sftpStatusOK               = 0
+	sftpStatusEOF              = 1
+	sftpStatusNoSuchFile       = 2
+	sftpStatusPermissionDenied = 3
+	sftpStatusFailure          = 4
+	sftpStatusBadMessage       = 5
+	sftpStatusOpUnsupported    = 8
+)
+
+// SFTP file attribute flags and file open flags.
+const (
+	sftpAttrSize        = 0x1
+	sftpAttrUIDGID      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrACModTime   = 0x8
+	sftpAttrExtended    = 0x80000000
+
+	sftpOpenRead   = 0x1
+	sftpOpenWrite  = 0x2
+	sftpOpenAppend = 0x4
+	sftpOpenCreate = 0x8
+	sftpOpenTrunc  = 0x10
+	sftpOpenExcl   = 0x20
+)
+
+const (
+	// SFTPMaxPacketBytes is the maximum size of an SFTP request packet, it comfortably accommodates the 256KB writes of OpenSSH client.
+	SFTPMaxPacketBytes = 512 * 1024
+	// SFTPMaxReadBytes is the maximum amount of file data returned by a read request.
+	SFTPMaxReadBytes = 256 * 1024
+	// SFTPMaxOpenHandles is the maximum number of files and directories kept open by an SFTP session.
+	SFTPMaxOpenHandles = 128
+	// sftpReadDirBatch is the number of directory entries returned by a read-directory request.
+	sftpReadDirBatch = 100
+)
+
+var errSFTPBadMessage = errors.New("malformed SFTP packet")
+
+// sftpStatusError is an error that carries an SFTP status code.
+type sftpStatusError struct {
+	code uint32
+	msg  string
+}
+
+func (err *sftpStatusError) Error() string {
+	return err.msg
+}
+
+var (
+	errSFTPPermissionDenied = &sftpStatusError{code: sftpStatusPermissionDenied, msg: "permission denied"}
+	errSFTPOpUnsupported    = &sftpStatusError{code: sftpStatusOpUnsupported, msg: "operation unsupported"}
+	errSFTPNoSuchHandle     = &sftpStatusError{code: sftpStatusFailure, msg: "invalid handle"}
+)
+
+// sftpPacket reads the fields of an SFTP request packet one after another.
+type sftpPacket struct {
+	data []byte
+	err  error
+}
+
+func (pkt *sftpPacket) uint32() uint32 {
+	if len(pkt.data) < 4 {
+		pkt.err = errSFTPBadMessage
+		return 0
+	}
+	ret := binary.BigEndian.Uint32(pkt.data)
+	pkt.data = pkt.data[4:]
+	return ret
+}
+
+func (pkt *sftpPacket) uint64() uint64 {
+	if len(pkt.data) < 8 {
+		pkt.err = errSFTPBadMessage
+		return 0
+	}
+	ret := binary.BigEndian.Uint64(pkt.data)
+	pkt.data = pkt.data[8:]
+	return ret
+}
+
+func (pkt *sftpPacket) string() string {
+	length := pkt.uint32()
+	if pkt.err != nil || uint32(len(pkt.data)) < length {
+		pkt.err = errSFTPBadMessage
+		return ""
+	}
+	ret := string(pkt.data[:length])
+	pkt.data = pkt.data[length:]
+	return ret
+}
+
+// sftpAttrs are the file attributes understood by the SFTP server.
+type sftpAttrs struct {
+	flags       uint32
+	size        uint64
+	permissions uint32
+	atime       uint32
+	mtime       uint32
+}
+
+func (pkt *sftpPacket) attrs() (attrs sftpAttrs) {
+	attrs.flags = pkt.uint32()
+	if attrs.flags&sftpAttrSize != 0 {
+		attrs.size = pkt.uint64()
+	}
+	if attrs.flags&sftpAttrUIDGID != 0 {
+		// The owner of the file cannot be changed via SFTP.
+		pkt.uint32()
+		pkt.uint32()
+	}
+	if attrs.flags&sftpAttrPermissions != 0 {
+		attrs.permissions = pkt.uint32()
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		attrs.atime = pkt.uint32()
+		attrs.mtime = pkt.uint32()
+	}
+	if attrs.flags&sftpAttrExtended != 0 {
+		for i := pkt.uint32(); i > 0 && pkt.err == nil; i-- {
+			pkt.string()
+			pkt.string()
+		}
+	}
+	return
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(buf, v)
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(appendUint32(buf, uint32(len(s))), s...)
+}
+
+// appendFileAttrs appends the SFTP encoding of the file's attributes to the buffer.
+func appendFileAttrs(buf []byte, info os.FileInfo) []byte {
+	perm := uint32(info.Mode().Perm())
+	switch {
+	case info.IsDir():
+		perm |= 0040000
+	case info.Mode()&os.ModeSymlink != 0:
+		perm |= 0120000
+	case info.Mode().IsRegular():
+		perm |= 0100000
+	}
+	buf = appendUint32(buf, sftpAttrSize|sftpAttrPermissions|sftpAttrACModTime)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(info.Size()))
+	buf = appendUint32(buf, perm)
+	buf = appendUint32(buf, uint32(info.ModTime().Unix()))
+	return appendUint32(buf, uint32(info.ModTime().Unix()))
+}
+
+// sftpLongName returns the directory listing of the file in the style of "ls -l".
+func sftpLongName(info os.FileInfo) string {
+	return fmt.Sprintf("%s 1 laitos laitos %12d %s %s", info.Mode().String(), info.Size(), info.ModTime().Format("Jan _2 15:04"), info.Name())
+}
+
+// sftpHandle is an open file or directory of an SFTP session.
+type sftpHandle struct {
+	file   *os.File
+	append bool
+}
+
+/*
+sftpServer serves an SFTP (version 3) session over an SSH channel. The session sees the root directory as "/", and it
+may neither reach nor follow symbolic links to the files outside of the root directory.
+*/
+type sftpServer struct {
+	root     string
+	readOnly bool
+	clientIP string
+	logger   *lalog.Logger
+
+	handles    map[string]*sftpHandle
+	lastHandle uint64
+}
+
+// newSFTPServer returns an SFTP server that serves the files under the root directory.
+func newSFTPServer(root string, readOnly bool, clientIP string, logger *lalog.Logger) (*sftpServer, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if absRoot, err = filepath.EvalSymlinks(absRoot); err != nil {
+		return nil, err
+	}
+	return &sftpServer{root: absRoot, readOnly: readOnly, clientIP: clientIP, logger: logger, handles: make(map[string]*sftpHandle)}, nil
+}
+
+// resolve returns the path on the file system corresponding to the path seen by the SFTP client.
+func (srv *sftpServer) resolve(clientPath string) (string, error) {
+	realPath := filepath.Join(srv.root, filepath.FromSlash(path.Clean("/"+clientPath)))
+	// Look for the closest existing ancestor, symbolic links along the way must not lead outside of the root.
+	for ancestor := realPath; ; ancestor = filepath.Dir(ancestor) {
+		resolved, err := filepath.EvalSymlinks(ancestor)
+		if err == nil {
+			if resolved != srv.root && !strings.HasPrefix(resolved, srv.root+string(filepath.Separator)) {
+				return "", errSFTPPermissionDenied
+			}
+			return realPath, nil
+		}
+		if info, lstatErr := os.Lstat(ancestor); lstatErr == nil && info.Mode()&os.ModeSymlink != 0 {
+			// A dangling symbolic link could otherwise lead to the creation of a file outside of the root.
+			return "", errSFTPPermissionDenied
+		}
+		if ancestor == srv.root || ancestor == filepath.Dir(ancestor) {
+			return "", err
+		}
+	}
+}
+
+// Serve converses with the SFTP client until the client disconnects, and then closes all open handles.
+func (srv *sftpServer) Serve(channel io.ReadWriter) error {
+	defer func() {
+		for _, handle := range srv.handles {
+			srv.logger.MaybeMinorError(handle.file.Close())
+		}
+	}()
+	lengthBuf := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(channel, lengthBuf); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		length := binary.BigEndian.Uint32(lengthBuf)
+		if length < 1 || length > SFTPMaxPacketBytes {
+			return fmt.Errorf("SFTP packet length %d is out of range", length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(channel, data); err != nil {
+			return err
+		}
+		resp := srv.handlePacket(data[0], &sftpPacket{data: data[1:]})
+		if _, err := channel.Write(appendUint32(make([]byte, 0, 4+len(resp)), uint32(len(resp)))); err != nil {
+			return err
+		}
+		if _, err := channel.Write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// handlePacket carries out the request and returns the response packet without its length prefix.
+func (srv *sftpServer) handlePacket(packetType byte, pkt *sftpPacket) []byte {
+	if packetType == sftpPacketInit {
+		// This server speaks version 3 regardless of the client version, and it does not support extensions.
+		return appendUint32([]byte{sftpPacketVersion}, 3)
+	}
+	id := pkt.uint32()
+	if pkt.err != nil {
+		return srv.status(id, pkt.err)
+	}
+	var resp []byte
+	var err error
+	switch packetType {
+	case sftpPacketRealpath:
+		clientPath := path.Clean("/" + pkt.string())
+		resp = appendUint32(appendUint32([]byte{sftpPacketName}, id), 1)
+		resp = appendString(appendString(resp, clientPath), clientPath)
+		resp = appendUint32(resp, 0)
+	case sftpPacketStat, sftpPacketLstat:
+		resp, err = srv.stat(id, pkt.string(), packetType == sftpPacketLstat)
+	case sftpPacketFstat:
+		resp, err = srv.fstat(id, pkt.string())
+	case sftpPacketOpen:
+		resp, err = srv.open(id, pkt.string(), pkt.uint32(), pkt.attrs(), pkt)
+	case sftpPacketOpendir:
+		resp, err = srv.openDir(id, pkt.string())
+	case sftpPacketClose:
+		err = srv.close(pkt.string())
+	case sftpPacketRead:
+		resp, err = srv.read(id, pkt.string(), pkt.uint64(), pkt.uint32())
+	case sftpPacketReaddir:
+		resp, err = srv.readDir(id, pkt.string())
+	case sftpPacketWrite:
+		err = srv.write(pkt.string(), pkt.uint64(), pkt.string(), pkt)
+	case sftpPacketSetstat:
+		err = srv.setStat(pkt.string(), "", pkt.attrs(), pkt)
+	case sftpPacketFsetstat:
+		err = srv.setStat("", pkt.string(), pkt.attrs(), pkt)
+	case sftpPacketRemove, sftpPacketRmdir:
+		err = srv.modify(pkt.string(), pkt, os.Remove)
+	case sftpPacketMkdir:
+		clientPath := pkt.string()
+		pkt.attrs()
+		err = srv.modify(clientPath, pkt, func(realPath string) error {
+			return os.Mkdir(realPath, 0755)
+		})
+	case sftpPacketRename:
+		err = srv.rename(pkt.string(), pkt.string(), pkt)
+	default:
+		err = errSFTPOpUnsupported
+	}
+	if pkt.err != nil {
+		err = pkt.err
+	}
+	if resp == nil || err != nil {
+		return srv.status(id, err)
+	}
+	return resp
+}
+
+// status returns a status response that reflects the error.
+func (srv *sftpServer) status(id uint32, err error) []byte {
+	code, msg := uint32(sftpStatusOK), "OK"
+	var statusErr *sftpStatusError
+	switch {
+	case err == nil:
+	case errors.As(err, &statusErr):
+		code, msg = statusErr.code, statusErr.msg
+	case errors.Is(err, io.EOF):
+		code, msg = sftpStatusEOF, "EOF"
+	case errors.Is(err, errSFTPBadMessage):
+		code, msg = sftpStatusBadMessage, err.Error()
+	case errors.Is(err, os.ErrNotExist):
+		code, msg = sftpStatusNoSuchFile, "no such file"
+	case errors.Is(err, os.ErrPermission):
+		code, msg = sftpStatusPermissionDenied, "permission denied"
+	default:
+		// Do not reveal the path on the file system to the client.
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		code, msg = sftpStatusFailure, err.Error()
+	}
+	resp := appendUint32(appendUint32([]byte{sftpPacketStatus}, id), code)
+	return appendString(appendString(resp, msg), "en")
+}
+
+func (srv *sftpServer) stat(id uint32, clientPath string, lstat bool) ([]byte, error) {
+	realPath, err := srv.resolve(clientPath)
+	if err != nil {
+		return nil, err
+	}
+	var info os.FileInfo
+	if lstat {
+		info, err = os.Lstat(realPath)
+	} else {
+		info, err = os.Stat(realPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return appendFileAttrs(appendUint32([]byte{sftpPacketAttrs}, id), info), nil
+}
+
+func (srv *sftpServer) fstat(id uint32, handleID string) ([]byte, error) {
+	handle, exists := srv.handles[handleID]
+	if !exists {
+		return nil, errSFTPNoSuchHandle
+	}
+	info, err := handle.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return appendFileAttrs(appendUint32([]byte{sftpPacketAttrs}, id), info), nil
+}
+
+// addHandle remembers the open file and returns a handle response.
+func (srv *sftpServer) addHandle(id uint32, handle *sftpHandle) ([]byte, error) {
+	if len(srv.handles) >= SFTPMaxOpenHandles {
+		srv.logger.MaybeMinorError(handle.file.Close())
+		return nil, &sftpStatusError{code: sftpStatusFailure, msg: "too many open files"}
+	}
+	srv.lastHandle++
+	handleID := strconv.FormatUint(srv.lastHandle, 10)
+	srv.handles[handleID] = handle
+	return appendString(appendUint32([]byte{sftpPacketHandle}, id), handleID), nil
+}
+
+func (srv *sftpServer) open(id uint32, clientPath string, pflags uint32, attrs sftpAttrs, pkt *sftpPacket) ([]byte, error) {
+	if pkt.err != nil {
+		return nil, pkt.err
+	}
+	realPath, err := srv.resolve(clientPath)
+	if err != nil {
+		return nil, err
+	}
+	flags := 0
+	switch {
+	case pflags&sftpOpenRead != 0 && pflags&sftpOpenWrite != 0:
+		flags = os.O_RDWR
+	case pflags&sftpOpenWrite != 0:
+		flags = os.O_WRONLY
+	}
+	if pflags&sftpOpenAppend != 0 {
+		flags |= os.O_APPEND
+	}
+	if pflags&sftpOpenCreate != 0 {
+		flags |= os.O_CREATE
+	}
+	if pflags&sftpOpenTrunc != 0 {
+		flags |= os.O_TRUNC
+	}
+	if pflags&sftpOpenExcl != 0 {
+		flags |= os.O_EXCL
+	}
+	if srv.readOnly && flags != os.O_RDONLY {
+		return nil, errSFTPPermissionDenied
+	}
+	perm := os.FileMode(0644)
+	if attrs.flags&sftpAttrPermissions != 0 {
+		perm = os.FileMode(attrs.permissions & 0777)
+	}
+	file, err := os.OpenFile(realPath, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := file.Stat(); err != nil || info.IsDir() {
+		srv.logger.MaybeMinorError(file.Close())
+		return nil, &sftpStatusError{code: sftpStatusFailure, msg: "not a regular file"}
+	}
+	if flags != os.O_RDONLY {
+		srv.logger.Info(srv.clientIP, nil, "opened \"%s\" for writing", clientPath)
+	}
+	return srv.addHandle(id, &sftpHandle{file: file, append: pflags&sftpOpenAppend != 0})
+}
+
+func (srv *sftpServer) openDir(id uint32, clientPath string) ([]byte, error) {
+	realPath, err := srv.resolve(clientPath)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := os.Open(realPath)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := dir.Stat(); err != nil || !info.IsDir() {
+		srv.logger.MaybeMinorError(dir.Close())
+		return nil, &sftpStatusError{code: sftpStatusFailure, msg: "not a directory"}
+	}
+	return srv.addHandle(id, &sftpHandle{file: dir})
+}
+
+func (srv *sftpServer) close(handleID string) error {
+	handle, exists := srv.handles[handleID]
+	if !exists {
+		return errSFTPNoSuchHandle
+	}
+	delete(srv.handles, handleID)
+	return handle.file.Close()
+}
+
+func (srv *sftpServer) read(id uint32, handleID string, offset uint64, length uint32) ([]byte, error) {
+	handle, exists := srv.handles[handleID]
+	if !exists {
+		return nil, errSFTPNoSuchHandle
+	}
+	if length > SFTPMaxReadBytes {
+		length = SFTPMaxReadBytes
+	}
+	buf := make([]byte, length)
+	n, err := handle.file.ReadAt(buf, int64(offset))
+	if n == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	return appendString(appendUint32([]byte{sftpPacketData}, id), string(buf[:n])), nil
+}
+
+func (srv *sftpServer) readDir(id uint32, handleID string) ([]byte, error) {
+	handle, exists := srv.handles[handleID]
+	if !exists {
+		return nil, errSFTPNoSuchHandle
+	}
+	entries, err := handle.file.ReadDir(sftpReadDirBatch)
+	if len(entries) == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	resp := appendUint32(appendUint32([]byte{sftpPacketName}, id), 0)
+	count := uint32(0)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			// The file may have disappeared after listing the directory.
+			continue
+		}
+		resp = appendString(appendString(resp, entry.Name()), sftpLongName(info))
+		resp = appendFileAttrs(resp, info)
+		count++
+	}
+	binary.BigEndian.PutUint32(resp[5:], count)
+	return resp, nil
+}
+
+func (srv *sftpServer) write(handleID string, offset uint64, data string, pkt *sftpPacket) error {
+	if pkt.err != nil {
+		return pkt.err
+	}
+	handle, exists := srv.handles[handleID]
+	if !exists {
+		return errSFTPNoSuchHandle
+	}
+	var err error
+	if handle.append {
+		// The operating system positions the writes of a file opened for appending.
+		_, err = handle.file.Write([]byte(data))
+	} else {
+		_, err = handle.file.WriteAt([]byte(data), int64(offset))
+	}
+	return err
+}
+
+func (srv *sftpServer) setStat(clientPath, handleID string, attrs sftpAttrs, pkt *sftpPacket) error {
+	if pkt.err != nil {
+		return pkt.err
+	}
+	if srv.readOnly {
+		return errSFTPPermissionDenied
+	}
+	realPath := ""
+	if handleID != "" {
+		handle, exists := srv.handles[handleID]
+		if !exists {
+			return errSFTPNoSuchHandle
+		}
+		realPath = handle.file.Name()
+	} else {
+		var err error
+		if realPath, err = srv.resolve(clientPath); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrSize != 0 {
+		if err := os.Truncate(realPath, int64(attrs.size)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrPermissions != 0 {
+		if err := os.Chmod(realPath, os.FileMode(attrs.permissions&0777)); err != nil {
+			return err
+		}
+	}
+	if attrs.flags&sftpAttrACModTime != 0 {
+		if err := os.Chtimes(realPath, time.Unix(int64(attrs.atime), 0), time.Unix(int64(attrs.mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modify carries out an operation that modifies the file at the path.
+func (srv *sftpServer) modify(clientPath string, pkt *sftpPacket, fun func(realPath string) error) error {
+	if pkt.err != nil {
+		return pkt.err
+	}
+	if srv.readOnly {
+		return errSFTPPermissionDenied
+	}
+	realPath, err := srv.resolve(clientPath)
+	if err != nil {
+		return err
+	}
+	if realPath == srv.root {
+		return errSFTPPermissionDenied
+	}
+	srv.logger.Info(srv.clientIP, nil, "modifying \"%s\"", clientPath)
+	return fun(realPath)
+}
+
+func (srv *sftpServer) rename(oldPath, newPath string, pkt *sftpPacket) error {
+	realNewPath, err := srv.resolve(newPath)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(realNewPath); err == nil {
+		// SFTP version 3 does not overwrite the existing file.
+		return &sftpStatusError{code: sftpStatusFailure, msg: "file already exists"}
+	}
+	return srv.modify(oldPath, pkt, func(realOldPath string) error {
+		return os.Rename(realOldPath, realNewPath)
+	})
+}
@@ -0,0 +1,524 @@
+/*
+sshd implements an SSH server that offers access to all toolbox features via an interactive shell or a one-off command
+execution, as well as file transfer via the SFTP subsystem. The app commands go through the same command processor as
+the other daemons, hence they still require the password PIN after the SSH client has authenticated.
+*/
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/testingstub"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// IOTimeoutSec is the number of seconds an SSH connection may stay idle before it is closed.
+	IOTimeoutSec = 10 * 60
+	// CommandTimeoutSec is the timeout of each app command.
+	CommandTimeoutSec = 60
+	// MaxCommandLength is the maximum length of an app command line.
+	MaxCommandLength = 64 * 1024
+	// DefaultHostKeyPath is the default path to the host key file, relative to the working directory.
+	DefaultHostKeyPath = "laitos-sshd-host-key"
+	// ShellPrompt is the prompt of the interactive shell in a pseudo terminal.
+	ShellPrompt = "> "
+)
+
+// Daemon is an SSH server that runs app commands via an interactive shell or one-off execution, and serves files via SFTP.
+type Daemon struct {
+	Address    string `json:"Address"`    // Address to listen on, e.g. 0.0.0.0 to listen on all network interfaces.
+	Port       int    `json:"Port"`       // Port to listen on, by default SSH uses port 22.
+	IPVersion  string `json:"IPVersion"`  // IPVersion is the IP version of clients to serve - "v4", "v6", or "both" (default).
+	PerIPLimit int    `json:"PerIPLimit"` // PerIPLimit is approximately how many connections and commands are allowed from an IP within a second.
+
+	// HostKeyPath is the path to the PEM private key that identifies the server, the key is generated if the file does not yet exist.
+	HostKeyPath string `json:"HostKeyPath"`
+	// Users are the user names and passwords that may sign in with password authentication.
+	Users map[string]string `json:"Users"`
+	// AuthorizedKeys are the public keys (in the format of authorized_keys file) that may sign in as any user.
+	AuthorizedKeys []string `json:"AuthorizedKeys"`
+	// SFTPDirectory is the directory served to SFTP clients, the SFTP subsystem is not available if it is left empty.
+	SFTPDirectory string `json:"SFTPDirectory"`
+	// SFTPReadOnly prevents SFTP clients from modifying the files of SFTPDirectory.
+	SFTPReadOnly bool `json:"SFTPReadOnly"`
+
+	Processor *toolbox.CommandProcessor `json:"-"` // Processor runs the app commands.
+
+	serverConfig   *ssh.ServerConfig
+	authorizedKeys map[string]bool
+	tcpServer      *common.TCPServer
+	logger         *lalog.Logger
+}
+
+// Initialise validates configuration and initialises internal states.
+func (daemon *Daemon) Initialise() error {
+	if daemon.Processor == nil || daemon.Processor.IsEmpty() {
+		return errors.New("sshd.Initialise: command processor and its filters must be configured")
+	}
+	if errs := daemon.Processor.IsSaneForInternet(); len(errs) > 0 {
+		return fmt.Errorf("sshd.Initialise: %+v", errs)
+	}
+	if daemon.Address == "" {
+		daemon.Address = common.DefaultListenAddress(daemon.IPVersion)
+	}
+	if err := common.ValidateIPVersion(daemon.IPVersion, daemon.Address); err != nil {
+		return fmt.Errorf("sshd.Initialise: %w", err)
+	}
+	if daemon.Port < 1 {
+		daemon.Port = 22
+	}
+	if daemon.PerIPLimit < 1 {
+		daemon.PerIPLimit = 6 // reasonable for personal use
+	}
+	if daemon.HostKeyPath == "" {
+		daemon.HostKeyPath = DefaultHostKeyPath
+	}
+	daemon.logger = &lalog.Logger{
+		ComponentName: "sshd",
+		ComponentID:   []lalog.LoggerIDField{{Key: "Port", Value: daemon.Port}},
+	}
+	if len(daemon.Users) == 0 && len(daemon.AuthorizedKeys) == 0 {
+		return errors.New("sshd.Initialise: there must be at least one user or authorized key")
+	}
+	for user, password := range daemon.Users {
+		if user == "" || len(password) < 7 {
+			return errors.New("sshd.Initialise: user name must not be empty and password must be at least 7 characters long")
+		}
+	}
+	daemon.authorizedKeys = make(map[string]bool)
+	for _, line := range daemon.AuthorizedKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("sshd.Initialise: failed to parse authorized key \"%s\" - %w", line, err)
+		}
+		daemon.authorizedKeys[string(key.Marshal())] = true
+	}
+	if daemon.SFTPDirectory != "" {
+		if info, err := os.Stat(daemon.SFTPDirectory); err != nil || !info.IsDir() {
+			return fmt.Errorf("sshd.Initialise: SFTPDirectory \"%s\" must be an existing directory", daemon.SFTPDirectory)
+		}
+	}
+	hostKey, err := daemon.loadHostKey()
+	if err != nil {
+		return fmt.Errorf("sshd.Initialise: %w", err)
+	}
+	daemon.serverConfig = &ssh.ServerConfig{
+		MaxAuthTries:      3,
+		PasswordCallback:  daemon.checkPassword,
+		PublicKeyCallback: daemon.checkPublicKey,
+		ServerVersion:     "SSH-2.0-laitos",
+	}
+	daemon.serverConfig.AddHostKey(hostKey)
+	daemon.tcpServer = common.NewTCPServer(daemon.Address, daemon.Port, "sshd", daemon, daemon.PerIPLimit)
+	daemon.tcpServer.IPVersion = daemon.IPVersion
+	return nil
+}
+
+// loadHostKey reads the host key from its file, or generates a new host key and saves it if the file does not yet exist.
+func (daemon *Daemon) loadHostKey() (ssh.Signer, error) {
+	content, err := os.ReadFile(daemon.HostKeyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		_, privKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(privKey, "laitos sshd host key")
+		if err != nil {
+			return nil, err
+		}
+		content = pem.EncodeToMemory(block)
+		if err := os.MkdirAll(filepath.Dir(daemon.HostKeyPath), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(daemon.HostKeyPath, content, 0600); err != nil {
+			return nil, fmt.Errorf("failed to save the new host key - %w", err)
+		}
+		daemon.logger.Info("", nil, "generated a new host key and saved it to %s", daemon.HostKeyPath)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read host key - %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key \"%s\" - %w", daemon.HostKeyPath, err)
+	}
+	daemon.logger.Info("", nil, "the host key fingerprint is %s", ssh.FingerprintSHA256(signer.PublicKey()))
+	return signer, nil
+}
+
+// checkPassword authenticates a client by its user name and password.
+func (daemon *Daemon) checkPassword(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if expected, exists := daemon.Users[conn.User()]; exists && subtle.ConstantTimeCompare(password, []byte(expected)) == 1 {
+		return nil, nil
+	}
+	daemon.recordAuthFailure(conn, "incorrect user name or password")
+	return nil, errors.New("incorrect user name or password")
+}
+
+// checkPublicKey authenticates a client by its public key.
+func (daemon *Daemon) checkPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	if daemon.authorizedKeys[string(key.Marshal())] {
+		return nil, nil
+	}
+	// An SSH client usually offers its public keys one after another, a rejected key is not necessarily a failure.
+	return nil, errors.New("the public key is not authorized")
+}
+
+// recordAuthFailure logs an authentication failure of the client and lets the connection tracker know about it.
+func (daemon *Daemon) recordAuthFailure(conn ssh.ConnMetadata, reason string) {
+	clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	daemon.logger.Warning(clientIP, nil, "user \"%s\" failed to authenticate - %s", conn.User(), reason)
+	common.TCPConnections.RecordHandshakeFailure("sshd", clientIP, reason)
+}
+
+// GetTCPStatsCollector returns the stats collector that counts and times client connections.
+func (daemon *Daemon) GetTCPStatsCollector() *misc.Stats {
+	return misc.SSHDStats
+}
+
+// idleTimeoutConn extends the IO deadline of the connection each time it is read from or written to.
+type idleTimeoutConn struct {
+	net.Conn
+}
+
+func (conn *idleTimeoutConn) Read(b []byte) (int, error) {
+	_ = conn.Conn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+	return conn.Conn.Read(b)
+}
+
+func (conn *idleTimeoutConn) Write(b []byte) (int, error) {
+	_ = conn.Conn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+	return conn.Conn.Write(b)
+}
+
+// HandleTCPConnection carries out the SSH handshake and then serves the sessions of the client.
+func (daemon *Daemon) HandleTCPConnection(logger *lalog.Logger, clientIP string, client *net.TCPConn) {
+	sshConn, channels, requests, err := ssh.NewServerConn(&idleTimeoutConn{Conn: client}, daemon.serverConfig)
+	if err != nil {
+		logger.Info(clientIP, err, "failed to complete SSH handshake")
+		return
+	}
+	defer func() {
+		logger.MaybeMinorError(sshConn.Close())
+	}()
+	logger.Info(clientIP, nil, "user \"%s\" signed in with client %q", sshConn.User(), sshConn.ClientVersion())
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if misc.EmergencyLockDown {
+			logger.Warning(clientIP, misc.ErrEmergencyLockDown, "")
+			return
+		}
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only session channel is supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			logger.Info(clientIP, err, "failed to accept session channel")
+			continue
+		}
+		go daemon.handleSession(logger, clientIP, channel, channelRequests)
+	}
+}
+
+// sshString decodes the leading string field of an SSH request payload.
+func sshString(payload []byte) (string, bool) {
+	if len(payload) < 4 {
+		return "", false
+	}
+	length := binary.BigEndian.Uint32(payload)
+	if uint32(len(payload)-4) < length {
+		return "", false
+	}
+	return string(payload[4 : 4+length]), true
+}
+
+// handleSession serves the first shell, exec, or subsystem request of a session channel, and then closes the channel.
+func (daemon *Daemon) handleSession(logger *lalog.Logger, clientIP string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer func() {
+		logger.MaybeMinorError(channel.Close())
+	}()
+	usePTY := false
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			usePTY = true
+			_ = req.Reply(true, nil)
+		case "env", "window-change":
+			_ = req.Reply(false, nil)
+		case "shell":
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			daemon.runShell(logger, clientIP, channel, usePTY)
+			return
+		case "exec":
+			command, ok := sshString(req.Payload)
+			_ = req.Reply(ok, nil)
+			if !ok {
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			if isSCPCommand(command) {
+				// Tell the legacy SCP client about the error using the SCP protocol, instead of running it as an app command.
+				logger.Info(clientIP, nil, "refused legacy SCP command %q", command)
+				_, _ = channel.Write([]byte("\x01scp: the legacy SCP protocol is not supported, transfer the files via SFTP instead\n"))
+				sendExitStatus(channel, errors.New("legacy SCP is not supported"))
+				return
+			}
+			result := daemon.runCommand(logger, clientIP, command)
+			output := result.CombinedOutput + "\n"
+			if usePTY {
+				output = strings.ReplaceAll(output, "\n", "\r\n")
+			}
+			_, _ = channel.Write([]byte(output))
+			sendExitStatus(channel, result.Error)
+			return
+		case "subsystem":
+			name, ok := sshString(req.Payload)
+			if !ok || name != "sftp" || daemon.SFTPDirectory == "" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			sftpServer, err := newSFTPServer(daemon.SFTPDirectory, daemon.SFTPReadOnly, clientIP, logger)
+			if err != nil {
+				logger.Warning(clientIP, err, "failed to start SFTP subsystem")
+				_ = req.Reply(false, nil)
+				return
+			}
+			_ = req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			if err := sftpServer.Serve(channel); err != nil {
+				logger.Info(clientIP, err, "SFTP session ended abnormally")
+			}
+			sendExitStatus(channel, nil)
+			return
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// isSCPCommand returns true if the exec command line starts a legacy SCP transfer, e.g. "scp -t /dir" or "scp -f file".
+func isSCPCommand(command string) bool {
+	fields := strings.Fields(command)
+	return len(fields) > 0 && fields[0] == "scp"
+}
+
+// sendExitStatus tells the client the exit status of a shell or command.
+func sendExitStatus(channel ssh.Channel, err error) {
+	var status uint32
+	if err != nil {
+		status = 1
+	}
+	_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+// runCommand runs an app command line via the command processor.
+func (daemon *Daemon) runCommand(logger *lalog.Logger, clientIP, line string) *toolbox.Result {
+	daemon.Processor.SetLogger(logger)
+	result := daemon.Processor.Process(context.TODO(), toolbox.Command{
+		DaemonName: "sshd",
+		ClientTag:  clientIP,
+		Content:    line,
+		TimeoutSec: CommandTimeoutSec,
+	}, true)
+	if result.Error == toolbox.ErrPINAndShortcutNotFound {
+		common.TCPConnections.RecordHandshakeFailure("sshd", clientIP, "incorrect PIN or shortcut")
+	}
+	common.TCPConnections.AddBytes(clientIP, int64(len(line)), int64(len(result.CombinedOutput)+1))
+	return result
+}
+
+/*
+runShell reads app command lines from the client, runs them one after another, and writes the results back. In a pseudo
+terminal, the shell echoes the keystrokes and handles backspace, because the terminal of the client does not.
+*/
+func (daemon *Daemon) runShell(logger *lalog.Logger, clientIP string, channel ssh.Channel, usePTY bool) {
+	newLine := "\n"
+	if usePTY {
+		newLine = "\r\n"
+		_, _ = channel.Write([]byte(ShellPrompt))
+	}
+	reader := bufio.NewReader(channel)
+	var line bytes.Buffer
+	for {
+		if misc.EmergencyLockDown {
+			logger.Warning(clientIP, misc.ErrEmergencyLockDown, "")
+			return
+		}
+		char, err := reader.ReadByte()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Info(clientIP, err, "failed to read from client")
+			}
+			sendExitStatus(channel, nil)
+			return
+		}
+		switch {
+		case char == '\r' || char == '\n':
+			if usePTY {
+				_, _ = channel.Write([]byte(newLine))
+			} else if char == '\r' {
+				// Treat CR LF as a single line break.
+				if next, err := reader.Peek(1); err == nil && next[0] == '\n' {
+					_, _ = reader.ReadByte()
+				}
+			}
+			if command := strings.TrimSpace(line.String()); command != "" {
+				// Check against conversation rate limit
+				if !daemon.tcpServer.AddAndCheckRateLimit(clientIP) {
+					return
+				}
+				result := daemon.runCommand(logger, clientIP, command)
+				_, _ = channel.Write([]byte(strings.ReplaceAll(result.CombinedOutput, "\n", newLine) + newLine))
+			}
+			line.Reset()
+			if usePTY {
+				_, _ = channel.Write([]byte(ShellPrompt))
+			}
+		case usePTY && (char == 3 || char == 4):
+			// Ctrl-C and Ctrl-D end the session.
+			_, _ = channel.Write([]byte(newLine))
+			sendExitStatus(channel, nil)
+			return
+		case usePTY && (char == 127 || char == 8):
+			if line.Len() > 0 {
+				line.Truncate(line.Len() - 1)
+				_, _ = channel.Write([]byte("\b \b"))
+			}
+		default:
+			if line.Len() >= MaxCommandLength {
+				logger.Info(clientIP, nil, "command line is too long")
+				return
+			}
+			line.WriteByte(char)
+			if usePTY {
+				_, _ = channel.Write([]byte{char})
+			}
+		}
+	}
+}
+
+// StartAndBlock starts the TCP listener to serve SSH clients. You may call this function only after having called Initialise().
+func (daemon *Daemon) StartAndBlock() error {
+	return daemon.tcpServer.StartAndBlock()
+}
+
+// Stop closes the TCP listener so that it will cease to accept new connections.
+func (daemon *Daemon) Stop() {
+	daemon.tcpServer.Stop()
+}
+
+// TestSSHD contains the comprehensive test case for the SSH server.
+func TestSSHD(daemon *Daemon, t testingstub.T) {
+	serverStopped := make(chan struct{}, 1)
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+			return
+		}
+		serverStopped <- struct{}{}
+	}()
+	if !misc.ProbePort(30*time.Second, daemon.Address, daemon.Port) {
+		t.Fatal("server did not start in time")
+	}
+	serverAddr := net.JoinHostPort(common.LoopbackAddress(daemon.IPVersion), strconv.Itoa(daemon.Port))
+	var user, password string
+	for user, password = range daemon.Users {
+		break
+	}
+	// Sign in with an incorrect password
+	clientConfig := &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password("incorrect password")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         IOTimeoutSec * time.Second,
+	}
+	if _, err := ssh.Dial("tcp", serverAddr, clientConfig); err == nil {
+		t.Fatal("did not reject incorrect password")
+	}
+	// Sign in with the correct password
+	clientConfig.Auth = []ssh.AuthMethod{ssh.Password(password)}
+	client, err := ssh.Dial("tcp", serverAddr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	// Run one-off commands with bad and good PIN
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := session.CombinedOutput("pin mismatch"); err == nil || string(out) != toolbox.ErrPINAndShortcutNotFound.Error()+"\n" {
+		t.Fatal(err, string(out))
+	}
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := session.CombinedOutput("verysecret .s echo hi"); err != nil || string(out) != "hi\n" {
+		t.Fatal(err, string(out))
+	}
+	// Run commands in an interactive shell
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Stdin = strings.NewReader("verysecret .s echo a\r\n\nverysecret .s echo b\n")
+	var shellOut bytes.Buffer
+	session.Stdout = &shellOut
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Wait(); err != nil || shellOut.String() != "a\nb\n" {
+		t.Fatal(err, shellOut.String())
+	}
+	// Run commands in an interactive shell of a pseudo terminal, which echoes the keystrokes.
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.RequestPty("xterm", 25, 80, ssh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	session.Stdin = strings.NewReader("verysecret .s echo cx\x7f\r\x04")
+	shellOut.Reset()
+	session.Stdout = &shellOut
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Wait(); err != nil || shellOut.String() != "> verysecret .s echo cx\b \b\r\nc\r\n> \r\n" {
+		t.Fatalf("%v %q", err, shellOut.String())
+	}
+
+	// Daemon should stop within a second
+	daemon.Stop()
+	<-serverStopped
+	// Repeatedly stopping the daemon should have no negative consequence
+	daemon.Stop()
+	daemon.Stop()
+}
@@ -0,0 +1,240 @@
+package sshd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHD_Initialise(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "host-key")
+	daemon := Daemon{HostKeyPath: keyPath, Users: map[string]string{"howard": "password"}}
+	require.ErrorContains(t, daemon.Initialise(), "command processor")
+	daemon.Processor = toolbox.GetInsaneCommandProcessor()
+	require.Error(t, daemon.Initialise())
+	daemon.Processor = toolbox.GetTestCommandProcessor()
+	daemon.Users = nil
+	require.ErrorContains(t, daemon.Initialise(), "at least one user")
+	daemon.Users = map[string]string{"howard": "short"}
+	require.Error(t, daemon.Initialise())
+	daemon.Users = map[string]string{"howard": "password"}
+	daemon.AuthorizedKeys = []string{"not a key"}
+	require.ErrorContains(t, daemon.Initialise(), "authorized key")
+	daemon.AuthorizedKeys = nil
+	daemon.SFTPDirectory = filepath.Join(t.TempDir(), "does-not-exist")
+	require.ErrorContains(t, daemon.Initialise(), "SFTPDirectory")
+	daemon.SFTPDirectory = ""
+
+	// The host key is generated on the first start, and reused afterwards.
+	require.NoError(t, daemon.Initialise())
+	require.Equal(t, 22, daemon.Port)
+	require.Equal(t, 6, daemon.PerIPLimit)
+	key, err := os.ReadFile(keyPath)
+	require.NoError(t, err)
+	require.NoError(t, daemon.Initialise())
+	sameKey, err := os.ReadFile(keyPath)
+	require.NoError(t, err)
+	require.Equal(t, key, sameKey)
+}
+
+func TestSSHD_StartAndBlock(t *testing.T) {
+	daemon := Daemon{
+		Address:     "127.0.0.1",
+		Port:        18622,
+		HostKeyPath: filepath.Join(t.TempDir(), "host-key"),
+		Users:       map[string]string{"howard": "password"},
+		Processor:   toolbox.GetTestCommandProcessor(),
+	}
+	require.NoError(t, daemon.Initialise())
+	TestSSHD(&daemon, t)
+}
+
+// sftpClient converses with the SFTP subsystem using raw packets.
+type sftpClient struct {
+	t      *testing.T
+	stdin  io.Writer
+	stdout io.Reader
+	lastID uint32
+}
+
+// request sends a request packet with the fields, and returns the type and payload (after request ID) of the response.
+func (client *sftpClient) request(packetType byte, fields ...interface{}) (byte, *sftpPacket) {
+	client.lastID++
+	pkt := appendUint32([]byte{packetType}, client.lastID)
+	for _, field := range fields {
+		switch value := field.(type) {
+		case string:
+			pkt = appendString(pkt, value)
+		case uint32:
+			pkt = appendUint32(pkt, value)
+		case uint64:
+			pkt = binary.BigEndian.AppendUint64(pkt, value)
+		}
+	}
+	_, err := client.stdin.Write(append(appendUint32(nil, uint32(len(pkt))), pkt...))
+	require.NoError(client.t, err)
+	lengthBuf := make([]byte, 4)
+	_, err = io.ReadFull(client.stdout, lengthBuf)
+	require.NoError(client.t, err)
+	resp := make([]byte, binary.BigEndian.Uint32(lengthBuf))
+	_, err = io.ReadFull(client.stdout, resp)
+	require.NoError(client.t, err)
+	respPkt := &sftpPacket{data: resp[1:]}
+	require.Equal(client.t, client.lastID, respPkt.uint32())
+	return resp[0], respPkt
+}
+
+// status sends a request packet and returns the status code of the response.
+func (client *sftpClient) status(packetType byte, fields ...interface{}) uint32 {
+	respType, resp := client.request(packetType, fields...)
+	require.EqualValues(client.t, sftpPacketStatus, respType)
+	return resp.uint32()
+}
+
+// handle sends a request packet and returns the handle of the response.
+func (client *sftpClient) handle(packetType byte, fields ...interface{}) string {
+	respType, resp := client.request(packetType, fields...)
+	require.EqualValues(client.t, sftpPacketHandle, respType, resp.data)
+	return resp.string()
+}
+
+func startSFTP(t *testing.T, sshClient *ssh.Client) *sftpClient {
+	session, err := sshClient.NewSession()
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = session.Close()
+	})
+	stdin, err := session.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := session.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, session.RequestSubsystem("sftp"))
+	_, err = stdin.Write([]byte{0, 0, 0, 5, sftpPacketInit, 0, 0, 0, 3})
+	require.NoError(t, err)
+	version := make([]byte, 9)
+	_, err = io.ReadFull(stdout, version)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 5, sftpPacketVersion, 0, 0, 0, 3}, version)
+	return &sftpClient{t: t, stdin: stdin, stdout: stdout}
+}
+
+func TestSSHD_SFTP(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644))
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "escape")))
+
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPubKey, err := ssh.NewPublicKey(pubKey)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(privKey)
+	require.NoError(t, err)
+
+	daemon := Daemon{
+		Address:        "127.0.0.1",
+		Port:           18623,
+		HostKeyPath:    filepath.Join(t.TempDir(), "host-key"),
+		AuthorizedKeys: []string{string(ssh.MarshalAuthorizedKey(sshPubKey))},
+		SFTPDirectory:  dir,
+		Processor:      toolbox.GetTestCommandProcessor(),
+	}
+	require.NoError(t, daemon.Initialise())
+	go func() {
+		_ = daemon.StartAndBlock()
+	}()
+	t.Cleanup(daemon.Stop)
+	require.True(t, misc.ProbePort(30*time.Second, daemon.Address, daemon.Port))
+	sshClient, err := ssh.Dial("tcp", net.JoinHostPort(common.LoopbackAddress(daemon.IPVersion), strconv.Itoa(daemon.Port)), &ssh.ClientConfig{
+		User:            "anyone",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	defer sshClient.Close()
+	client := startSFTP(t, sshClient)
+
+	// Resolve paths within the root directory
+	respType, resp := client.request(sftpPacketRealpath, "../../etc/./")
+	require.EqualValues(t, sftpPacketName, respType)
+	require.EqualValues(t, 1, resp.uint32())
+	require.Equal(t, "/etc", resp.string())
+	// Read a file
+	respType, resp = client.request(sftpPacketStat, "/a.txt")
+	require.EqualValues(t, sftpPacketAttrs, respType)
+	require.EqualValues(t, 5, resp.attrs().size)
+	handle := client.handle(sftpPacketOpen, "a.txt", uint32(sftpOpenRead), uint32(0))
+	respType, resp = client.request(sftpPacketRead, handle, uint64(1), uint32(100))
+	require.EqualValues(t, sftpPacketData, respType)
+	require.Equal(t, "ello", resp.string())
+	require.EqualValues(t, sftpStatusEOF, client.status(sftpPacketRead, handle, uint64(5), uint32(100)))
+	require.EqualValues(t, sftpStatusOK, client.status(sftpPacketClose, handle))
+	require.EqualValues(t, sftpStatusFailure, client.status(sftpPacketRead, handle, uint64(0), uint32(100)))
+	require.EqualValues(t, sftpStatusNoSuchFile, client.status(sftpPacketOpen, "missing.txt", uint32(sftpOpenRead), uint32(0)))
+	// Write a file in a new directory
+	require.EqualValues(t, sftpStatusOK, client.status(sftpPacketMkdir, "/sub", uint32(0)))
+	handle = client.handle(sftpPacketOpen, "/sub/b.txt", uint32(sftpOpenWrite|sftpOpenCreate|sftpOpenTrunc), uint32(0))
+	require.EqualValues(t, sftpStatusOK, client.status(sftpPacketWrite, handle, uint64(0), "hello "))
+	require.EqualValues(t, sftpStatusOK, client.status(sftpPacketWrite, handle, uint64(6), "world"))
+	require.EqualValues(t, sftpStatusOK, client.status(sftpPacketClose, handle))
+	content, err := os.ReadFile(filepath.Join(dir, "sub", "b.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(content))
+	// List a directory
+	handle = client.handle(sftpPacketOpendir, "/sub")
+	respType, resp = client.request(sftpPacketReaddir, handle)
+	require.EqualValues(t, sftpPacketName, respType)
+	require.EqualValues(t, 1, resp.uint32())
+	require.Equal(t, "b.txt", resp.string())
+	require.Contains(t, resp.string(), " b.txt")
+	require.EqualValues(t, 11, resp.attrs().size)
+	require.EqualValues(t, sftpStatusEOF, client.status(sftpPacketReaddir, handle))
+	require.EqualValues(t, sftpStatusOK, client.status(sftpPacketClose, handle))
+	// Rename and remove
+	require.EqualValues(t, sftpStatusOK, client.status(sftpPacketRename, "/sub/b.txt", "/sub/c.txt"))
+	require.EqualValues(t, sftpStatusFailure, client.status(sftpPacketRename, "/sub/c.txt", "/a.txt"))
+	require.EqualValues(t, sftpStatusOK, client.status(sftpPacketRemove, "/sub/c.txt"))
+	require.EqualValues(t, sftpStatusOK, client.status(sftpPacketRmdir, "/sub"))
+	_, err = os.Stat(filepath.Join(dir, "sub"))
+	require.True(t, os.IsNotExist(err))
+	require.EqualValues(t, sftpStatusPermissionDenied, client.status(sftpPacketRmdir, "/"))
+	// Symbolic links must not lead outside of the root directory
+	require.EqualValues(t, sftpStatusPermissionDenied, client.status(sftpPacketOpen, "/escape/secret.txt", uint32(sftpOpenRead), uint32(0)))
+	require.EqualValues(t, sftpStatusPermissionDenied, client.status(sftpPacketOpendir, "/escape"))
+	require.EqualValues(t, sftpStatusOpUnsupported, client.status(19, "/escape"))
+
+	// A read-only session may not modify the files
+	daemon.SFTPReadOnly = true
+	client = startSFTP(t, sshClient)
+	handle = client.handle(sftpPacketOpen, "a.txt", uint32(sftpOpenRead), uint32(0))
+	require.EqualValues(t, sftpStatusOK, client.status(sftpPacketClose, handle))
+	require.EqualValues(t, sftpStatusPermissionDenied, client.status(sftpPacketOpen, "a.txt", uint32(sftpOpenWrite), uint32(0)))
+	require.EqualValues(t, sftpStatusPermissionDenied, client.status(sftpPacketRemove, "a.txt"))
+	require.EqualValues(t, sftpStatusPermissionDenied, client.status(sftpPacketMkdir, "sub", uint32(0)))
+	require.EqualValues(t, sftpStatusPermissionDenied, client.status(sftpPacketSetstat, "a.txt", uint32(sftpAttrPermissions), uint32(0777)))
+	_, err = os.Stat(filepath.Join(dir, "a.txt"))
+	require.NoError(t, err)
+
+	// The legacy SCP protocol is refused rather than run as an app command
+	session, err := sshClient.NewSession()
+	require.NoError(t, err)
+	output, err := session.CombinedOutput("scp -t /reports/")
+	var exitErr *ssh.ExitError
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, 1, exitErr.ExitStatus())
+	require.Contains(t, string(output), "\x01scp: the legacy SCP protocol is not supported")
+}
@@ -2,6 +2,7 @@ package datastruct
 
 import (
 	"sync"
+	"time"
 )
 
 // RingBuffer is a rudimentary implementation of a fixed-size circular buffer.
@@ -10,6 +11,7 @@ type RingBuffer struct {
 	size    int64
 	counter int64
 	buf     []string
+	pushed  []time.Time // pushed are the timestamps of when each buffered element was pushed.
 	mutex   *sync.RWMutex
 }
 
@@ -19,9 +21,10 @@ func NewRingBuffer(size int64) *RingBuffer {
 		panic("NewRingBuffer: size must be greater than 0")
 	}
 	return &RingBuffer{
-		size:  size,
-		buf:   make([]string, size),
-		mutex: new(sync.RWMutex),
+		size:   size,
+		buf:    make([]string, size),
+		pushed: make([]time.Time, size),
+		mutex:  new(sync.RWMutex),
 	}
 }
 
@@ -31,6 +34,7 @@ func (r *RingBuffer) Push(elem string) {
 	defer r.mutex.Unlock()
 	r.counter++
 	r.buf[r.counter%r.size] = elem
+	r.pushed[r.counter%r.size] = time.Now()
 }
 
 /*
@@ -41,6 +45,33 @@ func (r *RingBuffer) Clear() {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.buf = make([]string, r.size)
+	r.pushed = make([]time.Time, r.size)
+}
+
+// RemoveIf removes the buffered elements for which the function returns true, and returns the number of elements removed.
+func (r *RingBuffer) RemoveIf(fun func(string) bool) (removed int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, value := range r.buf {
+		if value != "" && fun(value) {
+			r.buf[i] = ""
+			removed++
+		}
+	}
+	return
+}
+
+// RemoveOlderThan removes the elements pushed before the specified time, and returns the number of elements removed.
+func (r *RingBuffer) RemoveOlderThan(t time.Time) (removed int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, value := range r.buf {
+		if value != "" && r.pushed[i].Before(t) {
+			r.buf[i] = ""
+			removed++
+		}
+	}
+	return
 }
 
 /*
@@ -2,7 +2,9 @@ package datastruct
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRingBuffer_Push(t *testing.T) {
@@ -36,3 +38,24 @@ func TestRingBuffer_Push(t *testing.T) {
 		t.Fatal(r.GetAll())
 	}
 }
+
+func TestRingBuffer_Remove(t *testing.T) {
+	r := NewRingBuffer(4)
+	r.Push("from 1.2.3.4")
+	r.Push("from 5.6.7.8")
+	r.Push("from 1.2.3.4 again")
+	if removed := r.RemoveIf(func(elem string) bool { return strings.Contains(elem, "1.2.3.4") }); removed != 2 {
+		t.Fatal(removed)
+	}
+	if !reflect.DeepEqual(r.GetAll(), []string{"from 5.6.7.8"}) {
+		t.Fatal(r.GetAll())
+	}
+	cutOff := time.Now()
+	r.Push("new")
+	if removed := r.RemoveOlderThan(cutOff); removed != 1 {
+		t.Fatal(removed)
+	}
+	if !reflect.DeepEqual(r.GetAll(), []string{"new"}) {
+		t.Fatal(r.GetAll())
+	}
+}
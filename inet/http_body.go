@@ -0,0 +1,216 @@
+package inet
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+var (
+	// ErrHTTPResponseTooLarge is returned by DoHTTP when the response body exceeds the maximum size and the request asks
+	// to reject large responses.
+	ErrHTTPResponseTooLarge = errors.New("HTTP response body exceeds the maximum size")
+	// ErrHTTPRequestTooLarge is returned by DoHTTP when the request body exceeds the maximum size.
+	ErrHTTPRequestTooLarge = errors.New("HTTP request body exceeds the maximum size")
+)
+
+// windows1252HighRunes are the characters of Windows-1252 code points 0x80-0x9F, the remaining code points are
+// identical to ISO-8859-1.
+var windows1252HighRunes = [32]rune{
+	'€', '�', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '�', 'Ž', '�',
+	'�', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '�', 'ž', 'Ÿ',
+}
+
+/*
+readResponseBody reads the response body up to the maximum size, and decompresses the body if the server compressed it
+by itself (Go HTTP client only decompresses the body automatically when it asked for compression). The maximum size
+applies to the decompressed body. The boolean return value is true if the body exceeds the maximum size.
+*/
+func readResponseBody(httpResp *http.Response, maxBytes int) ([]byte, bool, error) {
+	if httpResp.ContentLength > int64(maxBytes) {
+		// Do not bother downloading the body that is already known to be too large
+		body, err := misc.ReadAllUpTo(httpResp.Body, maxBytes)
+		return body, true, err
+	}
+	var reader io.Reader = httpResp.Body
+	switch strings.ToLower(strings.TrimSpace(httpResp.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(httpResp.Body)
+		if err != nil {
+			return nil, false, fmt.Errorf("readResponseBody: failed to decompress gzip body - %w", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case "deflate":
+		flateReader := flate.NewReader(httpResp.Body)
+		defer flateReader.Close()
+		reader = flateReader
+	}
+	if reader != httpResp.Body {
+		// The body is no longer encoded
+		httpResp.Header.Del("Content-Encoding")
+		httpResp.Header.Del("Content-Length")
+	}
+	body, err := misc.ReadAllUpTo(reader, maxBytes+1)
+	if len(body) > maxBytes {
+		return body[:maxBytes], true, err
+	}
+	return body, false, err
+}
+
+// Charset returns the lower case character set name specified by the response content type, or an empty string if the
+// content type does not specify one.
+func (resp *HTTPResponse) Charset() string {
+	if resp.Header == nil {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(params["charset"]))
+}
+
+// Text returns the response body converted into UTF-8 text according to the character set of the response content type
+// or the byte order mark of the body.
+func (resp *HTTPResponse) Text() (string, error) {
+	return DecodeCharset(resp.Body, resp.Charset())
+}
+
+// DecodeJSON converts the response body into UTF-8 text and deserialises the JSON text into the value.
+func (resp *HTTPResponse) DecodeJSON(value interface{}) error {
+	if resp.Truncated {
+		return fmt.Errorf("HTTPResponse.DecodeJSON: %w", ErrHTTPResponseTooLarge)
+	}
+	text, err := resp.Text()
+	if err != nil {
+		return fmt.Errorf("HTTPResponse.DecodeJSON: %w", err)
+	}
+	if err := json.Unmarshal([]byte(text), value); err != nil {
+		return fmt.Errorf("HTTPResponse.DecodeJSON: %w", err)
+	}
+	return nil
+}
+
+// DecodeXML deserialises the XML response body into the value, the body may use any character set supported by DecodeCharset.
+func (resp *HTTPResponse) DecodeXML(value interface{}) error {
+	if resp.Truncated {
+		return fmt.Errorf("HTTPResponse.DecodeXML: %w", ErrHTTPResponseTooLarge)
+	}
+	decoder := NewXMLDecoder(bytes.NewReader(resp.Body))
+	if charset := resp.Charset(); !isUTF8Charset(charset) {
+		// The content type takes precedence over the character set of XML declaration, which may not be specified at all
+		text, err := resp.Text()
+		if err != nil {
+			return fmt.Errorf("HTTPResponse.DecodeXML: %w", err)
+		}
+		decoder = xml.NewDecoder(strings.NewReader(text))
+		decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+			return input, nil
+		}
+	}
+	if err := decoder.Decode(value); err != nil {
+		return fmt.Errorf("HTTPResponse.DecodeXML: %w", err)
+	}
+	return nil
+}
+
+// NewXMLDecoder returns an XML decoder that understands documents declaring any character set supported by DecodeCharset.
+func NewXMLDecoder(r io.Reader) *xml.Decoder {
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = CharsetReader
+	return decoder
+}
+
+// CharsetReader converts the text of the character set into UTF-8, it is suitable for xml.Decoder.CharsetReader.
+func CharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	body, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	text, err := DecodeCharset(body, charset)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(text), nil
+}
+
+// isUTF8Charset returns true if the text of the character set is also valid UTF-8.
+func isUTF8Charset(charset string) bool {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return true
+	}
+	return false
+}
+
+/*
+DecodeCharset converts the text of the character set into UTF-8. A byte order mark takes precedence over the character
+set. Supported character sets are UTF-8, US-ASCII, ISO-8859-1, Windows-1252, and UTF-16. Invalid UTF-8 sequences are
+replaced by the Unicode replacement character.
+*/
+func DecodeCharset(body []byte, charset string) (string, error) {
+	switch {
+	case bytes.HasPrefix(body, []byte{0xef, 0xbb, 0xbf}):
+		return strings.ToValidUTF8(string(body[3:]), "�"), nil
+	case bytes.HasPrefix(body, []byte{0xff, 0xfe}):
+		return decodeUTF16(body[2:], false), nil
+	case bytes.HasPrefix(body, []byte{0xfe, 0xff}):
+		return decodeUTF16(body[2:], true), nil
+	}
+	switch charset = strings.ToLower(strings.TrimSpace(charset)); charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		if utf8.Valid(body) {
+			return string(body), nil
+		}
+		return strings.ToValidUTF8(string(body), "�"), nil
+	case "iso-8859-1", "iso8859-1", "latin1", "l1":
+		var text strings.Builder
+		for _, b := range body {
+			text.WriteRune(rune(b))
+		}
+		return text.String(), nil
+	case "windows-1252", "cp1252":
+		var text strings.Builder
+		for _, b := range body {
+			if b >= 0x80 && b <= 0x9f {
+				text.WriteRune(windows1252HighRunes[b-0x80])
+			} else {
+				text.WriteRune(rune(b))
+			}
+		}
+		return text.String(), nil
+	case "utf-16", "utf-16be":
+		// UTF-16 without a byte order mark is big endian
+		return decodeUTF16(body, true), nil
+	case "utf-16le":
+		return decodeUTF16(body, false), nil
+	default:
+		return "", fmt.Errorf("DecodeCharset: unsupported character set %q", charset)
+	}
+}
+
+// decodeUTF16 converts UTF-16 text into UTF-8, a trailing odd byte is discarded.
+func decodeUTF16(body []byte, bigEndian bool) string {
+	units := make([]uint16, len(body)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(body[2*i])<<8 | uint16(body[2*i+1])
+		} else {
+			units[i] = uint16(body[2*i+1])<<8 | uint16(body[2*i])
+		}
+	}
+	return string(utf16.Decode(units))
+}
@@ -0,0 +1,111 @@
+package inet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDoHTTP_SizeLimits(t *testing.T) {
+	var numRequests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		numRequests++
+		switch r.URL.Path {
+		case "/gzip":
+			// Compress the response regardless of the request
+			w.Header().Set("Content-Encoding", "gzip")
+			gzipWriter := gzip.NewWriter(w)
+			_, _ = gzipWriter.Write(bytes.Repeat([]byte("a"), 1000))
+			_ = gzipWriter.Close()
+		default:
+			_, _ = w.Write(bytes.Repeat([]byte("a"), 1000))
+		}
+	}))
+	defer srv.Close()
+	// Truncate large response
+	resp, err := DoHTTP(context.Background(), HTTPRequest{MaxBytes: 100}, srv.URL+"/plain")
+	if err != nil || len(resp.Body) != 100 || !resp.Truncated {
+		t.Fatal(err, len(resp.Body), resp.Truncated)
+	}
+	resp, err = DoHTTP(context.Background(), HTTPRequest{MaxBytes: 1000}, srv.URL+"/plain")
+	if err != nil || len(resp.Body) != 1000 || resp.Truncated {
+		t.Fatal(err, len(resp.Body), resp.Truncated)
+	}
+	// Reject large response without retrying
+	numRequests = 0
+	resp, err = DoHTTP(context.Background(), HTTPRequest{MaxBytes: 100, RejectLargeResponse: true}, srv.URL+"/plain")
+	if !errors.Is(err, ErrHTTPResponseTooLarge) || numRequests != 1 {
+		t.Fatal(err, numRequests)
+	}
+	if err := resp.DecodeJSON(new(interface{})); !errors.Is(err, ErrHTTPResponseTooLarge) {
+		t.Fatal(err)
+	}
+	// The limit applies to the decompressed body
+	resp, err = DoHTTP(context.Background(), HTTPRequest{MaxBytes: 100, RejectLargeResponse: true}, srv.URL+"/gzip")
+	if !errors.Is(err, ErrHTTPResponseTooLarge) {
+		t.Fatal(err, len(resp.Body))
+	}
+	resp, err = DoHTTP(context.Background(), HTTPRequest{}, srv.URL+"/gzip")
+	if err != nil || !bytes.Equal(resp.Body, bytes.Repeat([]byte("a"), 1000)) || resp.Header.Get("Content-Encoding") != "" {
+		t.Fatal(err, string(resp.Body))
+	}
+	// Reject large request
+	numRequests = 0
+	_, err = DoHTTP(context.Background(), HTTPRequest{Method: http.MethodPost, Body: strings.NewReader("0123456789"), MaxRequestBytes: 9}, srv.URL)
+	if !errors.Is(err, ErrHTTPRequestTooLarge) || numRequests != 0 {
+		t.Fatal(err, numRequests)
+	}
+	if _, err = DoHTTP(context.Background(), HTTPRequest{Method: http.MethodPost, Body: strings.NewReader("0123456789"), MaxRequestBytes: 10}, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	for _, test := range []struct {
+		body    []byte
+		charset string
+		want    string
+	}{
+		{body: []byte("héllo"), charset: "", want: "héllo"},
+		{body: []byte{0xef, 0xbb, 0xbf, 'h', 'i'}, charset: "iso-8859-1", want: "hi"},
+		{body: []byte{'h', 0xe9}, charset: "ISO-8859-1", want: "hé"},
+		{body: []byte{'h', 0xe9}, charset: "utf-8", want: "h�"},
+		{body: []byte{0x80, 0x93, 0xe9}, charset: "windows-1252", want: "€“é"},
+		{body: []byte{0, 'h', 0, 'i'}, charset: "utf-16", want: "hi"},
+		{body: []byte{0xff, 0xfe, 'h', 0, 'i', 0}, charset: "", want: "hi"},
+	} {
+		if got, err := DecodeCharset(test.body, test.charset); err != nil || got != test.want {
+			t.Fatal(test, got, err)
+		}
+	}
+	if _, err := DecodeCharset([]byte("a"), "koi8-r"); err == nil {
+		t.Fatal("should have failed")
+	}
+}
+
+func TestHTTPResponse_Decode(t *testing.T) {
+	var jsonValue struct{ Name string }
+	resp := HTTPResponse{Header: http.Header{"Content-Type": {"application/json; charset=iso-8859-1"}}, Body: []byte("{\"Name\": \"caf\xe9\"}")}
+	if err := resp.DecodeJSON(&jsonValue); err != nil || jsonValue.Name != "café" {
+		t.Fatal(err, jsonValue)
+	}
+	var xmlValue struct {
+		Name string `xml:"name"`
+	}
+	// The character set comes from XML declaration
+	resp = HTTPResponse{Header: http.Header{"Content-Type": {"text/xml"}}, Body: []byte("<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><doc><name>caf\xe9</name></doc>")}
+	if err := resp.DecodeXML(&xmlValue); err != nil || xmlValue.Name != "café" {
+		t.Fatal(err, xmlValue)
+	}
+	// The character set comes from content type and is also declared by XML declaration
+	resp.Header.Set("Content-Type", "text/xml; charset=windows-1252")
+	xmlValue.Name = ""
+	if err := resp.DecodeXML(&xmlValue); err != nil || xmlValue.Name != "café" {
+		t.Fatal(err, xmlValue)
+	}
+}
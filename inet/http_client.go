@@ -3,6 +3,7 @@ package inet
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"math/rand"
@@ -64,8 +65,14 @@ type HTTPRequest struct {
 	Body io.Reader
 	// RequestFunc is invoked shortly before executing the HTTP request, allowing caller to further customise the request, defaults to nil.
 	RequestFunc func(*http.Request) error
-	// MaxBytes is the maximum size of response body to read, defaults to 4MB.
+	// MaxBytes is the maximum size of response body to read, defaults to 4MB. A compressed response body is limited by
+	// its decompressed size.
 	MaxBytes int
+	// RejectLargeResponse fails the request with ErrHTTPResponseTooLarge instead of returning a truncated response body
+	// if the body exceeds MaxBytes.
+	RejectLargeResponse bool
+	// MaxRequestBytes is the maximum size of request body, which is kept in memory for retries, defaults to 0 (unlimited).
+	MaxRequestBytes int
 	// MaxRetry is the maximum number of retries to make in case of an IO error, 4xx, or 5xx response, defaults to 3.
 	MaxRetry int
 	// UseNeutralDNSResolver instructs the HTTP client to use the neutral & recursive public DNS resolver instead of the default resolver of the system.
@@ -96,6 +103,8 @@ type HTTPResponse struct {
 	StatusCode int
 	Header     http.Header
 	Body       []byte
+	// Truncated is true if the response body exceeded the maximum size and only the beginning of it was read.
+	Truncated bool
 }
 
 // Non2xxToError returns an error only if the HTTP response status is not 2xx.
@@ -129,6 +138,35 @@ func (resp *HTTPResponse) GetBodyUpTo(nBytes int) []byte {
 	return ret
 }
 
+/*
+NewHTTPTransport returns an HTTP transport that applies the program-wide TLS settings (misc.DefaultTLS) to the connection
+made with each destination host, including the optional exemption of the host from certificate verification.
+*/
+func NewHTTPTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// The settings apply to the connections made via a proxy, which do not go through DialTLSContext.
+	transport.TLSClientConfig = misc.DefaultTLS.ClientConfig("")
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialContext := transport.DialContext
+		if dialContext == nil {
+			dialContext = (&net.Dialer{}).DialContext
+		}
+		conn, err := dialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := misc.DefaultTLS.ClientConfig(addr)
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return transport
+}
+
 // doHTTPRequestUsingClient makes an HTTP request via the input HTTP client.Placeholders in the URL template must always use %s.
 func doHTTPRequestUsingClient(ctx context.Context, client *http.Client, reqParam HTTPRequest, urlTemplate string, urlValues ...interface{}) (HTTPResponse, error) {
 	defer client.CloseIdleConnections()
@@ -160,6 +198,15 @@ func doHTTPRequestUsingClient(ctx context.Context, client *http.Client, reqParam
 		encodedURLValues[i] = url.QueryEscape(fmt.Sprint(val))
 	}
 	fullURL := fmt.Sprintf(urlTemplate, encodedURLValues...)
+	if reqParam.Body != nil && reqParam.MaxRequestBytes > 0 {
+		reqBody, err := misc.ReadAllUpTo(reqParam.Body, reqParam.MaxRequestBytes+1)
+		if err != nil {
+			return HTTPResponse{}, err
+		} else if len(reqBody) > reqParam.MaxRequestBytes {
+			return HTTPResponse{}, ErrHTTPRequestTooLarge
+		}
+		reqParam.Body = bytes.NewReader(reqBody)
+	}
 	// Retain a copy of request body for retry
 	reqBodyCopy := new(bytes.Buffer)
 	var lastHTTPErr error
@@ -202,8 +249,12 @@ func doHTTPRequestUsingClient(ctx context.Context, client *http.Client, reqParam
 				Header:     httpResp.Header,
 				StatusCode: httpResp.StatusCode,
 			}
-			lastResponse.Body, lastHTTPErr = misc.ReadAllUpTo(httpResp.Body, reqParam.MaxBytes)
+			lastResponse.Body, lastResponse.Truncated, lastHTTPErr = readResponseBody(httpResp, reqParam.MaxBytes)
 			lalog.DefaultLogger.MaybeMinorError(httpResp.Body.Close())
+			if lastHTTPErr == nil && lastResponse.Truncated && reqParam.RejectLargeResponse {
+				// Retrying will not make the response any smaller
+				return lastResponse, ErrHTTPResponseTooLarge
+			}
 			if lastHTTPErr == nil && httpResp.StatusCode/400 != 1 && httpResp.StatusCode/500 != 1 {
 				// Return the response upon success
 				if retry > 0 {
@@ -222,10 +273,10 @@ func doHTTPRequestUsingClient(ctx context.Context, client *http.Client, reqParam
 
 // DoHTTP makes an HTTP request and returns its HTTP response. Placeholders in the URL template must always use %s.
 func DoHTTP(ctx context.Context, reqParam HTTPRequest, urlTemplate string, urlValues ...interface{}) (resp HTTPResponse, err error) {
-	client := &http.Client{}
+	client := &http.Client{Transport: NewHTTPTransport()}
 	// Integrate the decorated handler with AWS x-ray. Be aware that the x-ray daemon program mandatory for collecting traces only runs on AWS EC2.
 	// The x-ray library gracefully does nothing when it runs on non-EC2 instances.
-	if misc.EnableAWSIntegration && IsAWS() {
+	if misc.AWSIntegration.IsEnabled() && IsAWS() {
 		client = xray.Client(client)
 	}
 	return doHTTPRequestUsingClient(ctx, client, reqParam, urlTemplate, urlValues...)
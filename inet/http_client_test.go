@@ -3,10 +3,12 @@ package inet
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -158,6 +160,38 @@ func TestDoHTTPGoodServer(t *testing.T) {
 	}
 }
 
+func TestDoHTTPSelfSignedServer(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("response from self-signed server"))
+	}))
+	defer server.Close()
+	defer func() {
+		if err := misc.DefaultTLS.SetSettings(misc.TLSSettings{}); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	// The certificate of the test server is not trusted by default
+	if _, err := DoHTTP(context.Background(), HTTPRequest{MaxRetry: 1}, server.URL); err == nil {
+		t.Fatal("did not error")
+	}
+	// Skip verification for the test server
+	if err := misc.DefaultTLS.SetSettings(misc.TLSSettings{InsecureSkipVerifyHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := DoHTTP(context.Background(), HTTPRequest{}, server.URL)
+	if err != nil || string(resp.Body) != "response from self-signed server" {
+		t.Fatal(err, string(resp.Body))
+	}
+	// The minimum version applies to the client
+	if err := misc.DefaultTLS.SetSettings(misc.TLSSettings{MinVersion: "1.3", InsecureSkipVerifyHosts: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	server.TLS.MaxVersion = tls.VersionTLS12
+	if _, err := DoHTTP(context.Background(), HTTPRequest{MaxRetry: 1}, server.URL); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
 func TestDoHTTPPublicServer(t *testing.T) {
 	resp, err := DoHTTP(context.Background(), HTTPRequest{
 		TimeoutSec: 30,
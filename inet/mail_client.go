@@ -39,7 +39,7 @@ func dialMTA(host string, serverTLSName string, port int) (smtpClient *smtp.Clie
 		return
 	}
 	// Try TLS on the connection
-	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverTLSName})
+	tlsConn := tls.Client(conn, misc.DefaultTLS.ClientConfig(serverTLSName))
 	if err = tlsConn.Handshake(); err == nil {
 		// TLS is successful
 		smtpClient, err = smtp.NewClient(tlsConn, host)
@@ -76,7 +76,7 @@ func sendMail(smtpClient *smtp.Client, serverTLSName string, auth smtp.Auth, fro
 	}
 	defer smtpClient.Close()
 	if canStartTLS, _ := smtpClient.Extension("STARTTLS"); canStartTLS {
-		if err := smtpClient.StartTLS(&tls.Config{ServerName: serverTLSName}); err != nil {
+		if err := smtpClient.StartTLS(misc.DefaultTLS.ClientConfig(serverTLSName)); err != nil {
 			return err
 		}
 	}
@@ -121,6 +121,11 @@ type MailClient struct {
 	MTAPort      int    `json:"MTAPort"`      // Port number of SMTP service on mail transportation agent
 	AuthUsername string `json:"AuthUsername"` // (Optional) Username for plain authentication, if the SMTP server requires it.
 	AuthPassword string `json:"AuthPassword"` // (Optional) Password for plain authentication, if the SMTP server requires it.
+	// OAuth2 (optional) authenticates with an access token using XOAUTH2 mechanism instead of password. The user name
+	// is AuthUsername, or MailFrom if AuthUsername is empty.
+	OAuth2 *MailOAuth2 `json:"OAuth2"`
+	// DKIM (optional) signs the outgoing mails with DKIM signature so that they are less likely to be treated as spam.
+	DKIM *MailDKIM `json:"DKIM"`
 }
 
 // Return true only if all mail parameters are present.
@@ -128,6 +133,27 @@ func (client *MailClient) IsConfigured() bool {
 	return client.MailFrom != "" && client.MTAHost != "" && client.MTAPort != 0
 }
 
+// getOAuth2Username returns the user name presented along with the OAuth2 access token.
+func (client *MailClient) getOAuth2Username() string {
+	if client.AuthUsername != "" {
+		return client.AuthUsername
+	}
+	return client.MailFrom
+}
+
+// signMessage returns the mail signed with DKIM signature if DKIM is configured, or the unmodified mail otherwise.
+func (client *MailClient) signMessage(message []byte) []byte {
+	if !client.DKIM.IsConfigured() {
+		return message
+	}
+	signed, err := client.DKIM.Sign(message)
+	if err != nil {
+		CommonMailLogger.Warning(client.MailFrom, err, "failed to sign the mail with DKIM, the mail will be delivered without a signature")
+		return message
+	}
+	return signed
+}
+
 /*
 sendMailWithRetry collects addresses of the MTA host via DNS lookup, and tries to deliver the input mail using a
 randomly selected MTA IP for up to 12 times within couple of days. The function blocks caller until it has exhausted
@@ -149,6 +175,7 @@ func (client *MailClient) sendMailWithRetry(from string, recipients []string, me
 		var smtpClient *smtp.Client
 		var mtaIP string
 		var tlsErr error
+		var accessToken string
 
 		// Find the latest set of IP addresses belonging to the MTA
 		timeout, cancel := context.WithTimeout(context.Background(), MailIOTimeoutSec*time.Second)
@@ -158,7 +185,12 @@ func (client *MailClient) sendMailWithRetry(from string, recipients []string, me
 		}
 		// Try connecting to one of the MTA's IP addresses to deliver the mail
 		mtaIP = mtaIPs[i%len(mtaIPs)].IP.String()
-		if client.AuthUsername != "" {
+		if client.OAuth2.IsConfigured() {
+			if accessToken, err = client.OAuth2.GetAccessToken(timeout); err != nil {
+				goto sleepAndRetry
+			}
+			auth = XOAuth2Auth(client.getOAuth2Username(), accessToken, mtaIP)
+		} else if client.AuthUsername != "" {
 			auth = smtp.PlainAuth("", client.AuthUsername, client.AuthPassword, mtaIP)
 		}
 		smtpClient, tlsErr, err = dialMTA(mtaIP, client.MTAHost, client.MTAPort)
@@ -167,6 +199,10 @@ func (client *MailClient) sendMailWithRetry(from string, recipients []string, me
 		}
 		if err = sendMail(smtpClient, client.MTAHost, auth, from, recipients, message); err != nil {
 			smtpClient.Close()
+			if client.OAuth2.IsConfigured() {
+				// The access token may have been revoked, obtain a new one in the next attempt.
+				client.OAuth2.ForgetAccessToken()
+			}
 			goto sleepAndRetry
 		}
 		// Success!
@@ -197,7 +233,7 @@ func (client *MailClient) Send(subject string, textBody string, recipients ...st
 	// Construct appropriate mail headers
 	mailBody := fmt.Sprintf("MIME-Version: 1.0\r\nContent-type: text/plain; charset=utf-8\r\nFrom: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s",
 		client.MailFrom, strings.Join(recipients, ", "), subject, textBody)
-	go client.sendMailWithRetry(client.MailFrom, recipients, []byte(mailBody))
+	go client.sendMailWithRetry(client.MailFrom, recipients, client.signMessage([]byte(mailBody)))
 	return nil
 }
 
@@ -206,7 +242,7 @@ func (client *MailClient) SendRaw(fromAddr string, rawMailBody []byte, recipient
 	if len(recipients) == 0 {
 		return fmt.Errorf("no recipient specified for mail from \"%s\"", fromAddr)
 	}
-	go client.sendMailWithRetry(client.MailFrom, recipients, rawMailBody)
+	go client.sendMailWithRetry(client.MailFrom, recipients, client.signMessage(rawMailBody))
 	return nil
 }
 
@@ -217,5 +253,17 @@ func (client *MailClient) SelfTest() error {
 		return fmt.Errorf("MailClient.SelfTest: connection test failed - %v (TLS error? %v)", err, tlsErr)
 	}
 	lalog.DefaultLogger.MaybeMinorError(smtpClient.Close())
+	if client.OAuth2.IsConfigured() {
+		ctx, cancel := context.WithTimeout(context.Background(), MailIOTimeoutSec*time.Second)
+		defer cancel()
+		if _, err := client.OAuth2.GetAccessToken(ctx); err != nil {
+			return fmt.Errorf("MailClient.SelfTest: OAuth2 test failed - %v", err)
+		}
+	}
+	if client.DKIM.IsConfigured() {
+		if _, err := client.DKIM.GetPrivateKey(); err != nil {
+			return fmt.Errorf("MailClient.SelfTest: DKIM test failed - %v", err)
+		}
+	}
 	return nil
 }
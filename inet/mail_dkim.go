@@ -0,0 +1,227 @@
+package inet
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+// MailDKIMSignedHeaders are the names of mail headers covered by the DKIM signature if they are present in the mail.
+var MailDKIMSignedHeaders = []string{"From", "To", "Cc", "Subject", "Date", "Message-ID", "Reply-To", "In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+/*
+MailDKIM signs outgoing mails with DomainKeys Identified Mail (RFC 6376) signature, which helps the mails to pass spam
+filters of the recipients. The public key must be published in DNS as a TXT record of "<Selector>._domainkey.<Domain>",
+see DNSRecord for its content.
+*/
+type MailDKIM struct {
+	// Domain is the signing domain, usually the domain name of the FROM address, e.g. "example.com".
+	Domain string `json:"Domain"`
+	// Selector distinguishes the key among those published for the domain, e.g. "laitos".
+	Selector string `json:"Selector"`
+	// PrivateKeyPath is the path to the PEM-encoded RSA or ed25519 private key file, which may be encrypted by laitos.
+	PrivateKeyPath string `json:"PrivateKeyPath"`
+}
+
+// IsConfigured returns true only if the domain, selector, and private key path are present.
+func (dkim *MailDKIM) IsConfigured() bool {
+	return dkim != nil && dkim.Domain != "" && dkim.Selector != "" && dkim.PrivateKeyPath != ""
+}
+
+var (
+	// mailDKIMKeys are the private keys read for all mail clients, keyed by file path. MailClient is often copied by
+	// value, hence the keys are not kept in the client itself.
+	mailDKIMKeys      = make(map[string]crypto.Signer)
+	mailDKIMKeysMutex = new(sync.Mutex)
+)
+
+// GetPrivateKey reads and decodes the private key file, or returns the key that has been read earlier.
+func (dkim *MailDKIM) GetPrivateKey() (crypto.Signer, error) {
+	mailDKIMKeysMutex.Lock()
+	defer mailDKIMKeysMutex.Unlock()
+	if key, exists := mailDKIMKeys[dkim.PrivateKeyPath]; exists {
+		return key, nil
+	}
+	contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, dkim.PrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("MailDKIM.GetPrivateKey: failed to read private key file - %w", err)
+	}
+	block, _ := pem.Decode(contents[0])
+	if block == nil {
+		return nil, fmt.Errorf("MailDKIM.GetPrivateKey: %s is not a PEM file", dkim.PrivateKeyPath)
+	}
+	var key crypto.Signer
+	if rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = rsaKey
+	} else {
+		anyKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("MailDKIM.GetPrivateKey: failed to parse private key - %w", err)
+		}
+		switch typedKey := anyKey.(type) {
+		case *rsa.PrivateKey:
+			key = typedKey
+		case ed25519.PrivateKey:
+			key = typedKey
+		default:
+			return nil, fmt.Errorf("MailDKIM.GetPrivateKey: unsupported private key type %T, use RSA or ed25519", anyKey)
+		}
+	}
+	mailDKIMKeys[dkim.PrivateKeyPath] = key
+	return key, nil
+}
+
+// DNSRecord returns the content of the TXT record that publishes the public key, e.g. "v=DKIM1; k=rsa; p=MIIBIj...".
+func (dkim *MailDKIM) DNSRecord() (string, error) {
+	key, err := dkim.GetPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	switch pubKey := key.Public().(type) {
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pubKey), nil
+	default:
+		der, err := x509.MarshalPKIXPublicKey(pubKey)
+		if err != nil {
+			return "", fmt.Errorf("MailDKIM.DNSRecord: failed to encode public key - %w", err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der), nil
+	}
+}
+
+// mailHeaderField is a single (possibly folded) mail header field.
+type mailHeaderField struct {
+	name string
+	// raw is the entire header field, including the name and the trailing CRLF.
+	raw string
+}
+
+// normaliseCRLF converts bare LF and CR line endings to CRLF, which is how the mail is transmitted over SMTP.
+func normaliseCRLF(message []byte) string {
+	return strings.NewReplacer("\r\n", "\r\n", "\r", "\r\n", "\n", "\r\n").Replace(string(message))
+}
+
+// splitMailHeaderBody splits a mail that uses CRLF line endings into header fields and body.
+func splitMailHeaderBody(message string) (fields []mailHeaderField, body string) {
+	header := message
+	if pos := strings.Index(message, "\r\n\r\n"); pos != -1 {
+		header, body = message[:pos+2], message[pos+4:]
+	} else if !strings.HasSuffix(header, "\r\n") {
+		header += "\r\n"
+	}
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			// Continuation of a folded header field
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		fields = append(fields, mailHeaderField{name: strings.TrimSpace(name), raw: line})
+	}
+	return
+}
+
+// compressWSP replaces each sequence of space and tab characters by a single space.
+func compressWSP(s string) string {
+	var ret strings.Builder
+	inWSP := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			if !inWSP {
+				ret.WriteRune(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		ret.WriteRune(r)
+	}
+	return ret.String()
+}
+
+// dkimRelaxedHeader returns the header field in the "relaxed" canonical form (RFC 6376 3.4.2), including the trailing CRLF.
+func dkimRelaxedHeader(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.NewReplacer("\r\n", "", "\r", "", "\n", "").Replace(value)
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(compressWSP(value)) + "\r\n"
+}
+
+// dkimRelaxedBody returns the mail body in the "relaxed" canonical form (RFC 6376 3.4.4).
+func dkimRelaxedBody(body string) string {
+	lines := strings.Split(body, "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(compressWSP(line), " ")
+	}
+	// Remove the empty lines at the end of the body
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// Sign returns the mail with a DKIM-Signature header field inserted at the top. The mail line endings are converted to CRLF.
+func (dkim *MailDKIM) Sign(message []byte) ([]byte, error) {
+	key, err := dkim.GetPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	normalised := normaliseCRLF(message)
+	fields, body := splitMailHeaderBody(normalised)
+	// Hash the body
+	bodyHash := sha256.Sum256([]byte(dkimRelaxedBody(body)))
+	// Collect the header fields to sign, when a field occurs more than once the last occurrence is signed.
+	var signedNames []string
+	var signedHeaders strings.Builder
+	for _, name := range MailDKIMSignedHeaders {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.EqualFold(fields[i].name, name) {
+				signedNames = append(signedNames, strings.ToLower(name))
+				signedHeaders.WriteString(dkimRelaxedHeader(fields[i].raw))
+				break
+			}
+		}
+	}
+	if len(signedNames) == 0 || signedNames[0] != "from" {
+		return nil, errors.New("MailDKIM.Sign: the mail does not have a From header")
+	}
+	algorithm := "rsa-sha256"
+	if _, isEd25519 := key.(ed25519.PrivateKey); isEd25519 {
+		algorithm = "ed25519-sha256"
+	}
+	sigHeader := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%s; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algorithm, dkim.Domain, dkim.Selector, strconv.FormatInt(time.Now().Unix(), 10), strings.Join(signedNames, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	// The signature covers the signed header fields followed by the DKIM-Signature field itself without the trailing CRLF
+	signedData := signedHeaders.String() + strings.TrimSuffix(dkimRelaxedHeader(sigHeader), "\r\n")
+	dataHash := sha256.Sum256([]byte(signedData))
+	var signature []byte
+	if algorithm == "ed25519-sha256" {
+		// RFC 8463 signs the SHA-256 digest rather than the data itself
+		signature, err = key.Sign(rand.Reader, dataHash[:], crypto.Hash(0))
+	} else {
+		signature, err = key.Sign(rand.Reader, dataHash[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("MailDKIM.Sign: failed to sign the mail - %w", err)
+	}
+	return []byte(sigHeader + base64.StdEncoding.EncodeToString(signature) + "\r\n" + normalised), nil
+}
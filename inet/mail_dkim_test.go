@@ -0,0 +1,195 @@
+package inet
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDKIMCanonicalisation(t *testing.T) {
+	// The example from RFC 6376 3.4.5
+	fields, body := splitMailHeaderBody(normaliseCRLF([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n")))
+	require.Len(t, fields, 2)
+	require.Equal(t, "a:X\r\n", dkimRelaxedHeader(fields[0].raw))
+	require.Equal(t, "b:Y Z\r\n", dkimRelaxedHeader(fields[1].raw))
+	require.Equal(t, " C\r\nD E\r\n", dkimRelaxedBody(body))
+	require.Equal(t, "", dkimRelaxedBody("\r\n\r\n"))
+	require.Equal(t, "a\r\nb\r\n", dkimRelaxedBody("a\r\nb"))
+	require.Equal(t, "a\r\nb\r\nc\r\n", normaliseCRLF([]byte("a\nb\rc\r\n")))
+}
+
+// verifyDKIM verifies the DKIM signature at the top of the mail using the public key.
+func verifyDKIM(t *testing.T, signed []byte, pubKey crypto.PublicKey) {
+	fields, body := splitMailHeaderBody(string(signed))
+	require.Equal(t, "DKIM-Signature", fields[0].name)
+	tags := make(map[string]string)
+	_, sigValue, _ := strings.Cut(fields[0].raw, ":")
+	for _, tag := range strings.Split(sigValue, ";") {
+		name, value, _ := strings.Cut(tag, "=")
+		tags[strings.TrimSpace(name)] = regexp.MustCompile(`\s`).ReplaceAllString(value, "")
+	}
+	bodyHash := sha256.Sum256([]byte(dkimRelaxedBody(body)))
+	require.Equal(t, base64.StdEncoding.EncodeToString(bodyHash[:]), tags["bh"])
+	var signedData string
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i > 0; i-- {
+			if strings.EqualFold(fields[i].name, name) {
+				signedData += dkimRelaxedHeader(fields[i].raw)
+				break
+			}
+		}
+	}
+	sigWithoutB := regexp.MustCompile(`b=[A-Za-z0-9+/=\s]+\r\n$`).ReplaceAllString(fields[0].raw, "b=")
+	signedData += strings.TrimSuffix(dkimRelaxedHeader(sigWithoutB), "\r\n")
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	require.NoError(t, err)
+	dataHash := sha256.Sum256([]byte(signedData))
+	switch typedKey := pubKey.(type) {
+	case *rsa.PublicKey:
+		require.Equal(t, "rsa-sha256", tags["a"])
+		require.NoError(t, rsa.VerifyPKCS1v15(typedKey, crypto.SHA256, dataHash[:], signature))
+	case ed25519.PublicKey:
+		require.Equal(t, "ed25519-sha256", tags["a"])
+		require.True(t, ed25519.Verify(typedKey, dataHash[:], signature))
+	}
+}
+
+func TestMailDKIM_Sign(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaKeyPath := filepath.Join(dir, "rsa.pem")
+	require.NoError(t, os.WriteFile(rsaKeyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), 0600))
+	edPubKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edKeyDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	edKeyPath := filepath.Join(dir, "ed25519.pem")
+	require.NoError(t, os.WriteFile(edKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edKeyDER}), 0600))
+
+	message := []byte("MIME-Version: 1.0\r\nFrom: howard@example.com\r\nTo: a@example.com,\r\n\tb@example.com\r\nSubject:  laitos   test\r\nX-Unsigned: 1\r\n\r\nhello  world \nsecond line\n\n")
+	for _, tc := range []struct {
+		keyPath string
+		pubKey  crypto.PublicKey
+		record  string
+	}{
+		{rsaKeyPath, &rsaKey.PublicKey, "v=DKIM1; k=rsa; p="},
+		{edKeyPath, edPubKey, "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPubKey)},
+	} {
+		dkim := &MailDKIM{Domain: "example.com", Selector: "laitos", PrivateKeyPath: tc.keyPath}
+		require.True(t, dkim.IsConfigured())
+		record, err := dkim.DNSRecord()
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(record, tc.record), record)
+		signed, err := dkim.Sign(message)
+		require.NoError(t, err)
+		require.Contains(t, string(signed), "d=example.com; s=laitos;")
+		require.Contains(t, string(signed), "h=from:to:subject:mime-version;")
+		require.True(t, strings.HasSuffix(string(signed), "\r\n\r\nhello  world \r\nsecond line\r\n\r\n"))
+		verifyDKIM(t, signed, tc.pubKey)
+	}
+
+	// Mails without a From header cannot be signed
+	dkim := &MailDKIM{Domain: "example.com", Selector: "laitos", PrivateKeyPath: rsaKeyPath}
+	_, err = dkim.Sign([]byte("Subject: hi\r\n\r\nbody"))
+	require.ErrorContains(t, err, "From")
+	// Signing fails with a bad key file, the mail client delivers the mail unsigned.
+	badKeyPath := filepath.Join(dir, "bad.pem")
+	require.NoError(t, os.WriteFile(badKeyPath, []byte("not a key"), 0600))
+	dkim.PrivateKeyPath = badKeyPath
+	_, err = dkim.Sign(message)
+	require.ErrorContains(t, err, "PEM")
+	client := &MailClient{MailFrom: "howard@example.com", DKIM: dkim}
+	require.Equal(t, message, client.signMessage(message))
+	require.False(t, (&MailDKIM{Domain: "example.com"}).IsConfigured())
+	require.False(t, (*MailDKIM)(nil).IsConfigured())
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edKeyDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "ed25519.pem")
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edKeyDER}), 0600))
+	dkim := &MailDKIM{Domain: "example.com", Selector: "laitos", PrivateKeyPath: keyPath}
+	record, err := dkim.DNSRecord()
+	require.NoError(t, err)
+	lookupTXT := func(_ context.Context, name string) ([]string, error) {
+		switch name {
+		case "laitos._domainkey.example.com":
+			return []string{record}, nil
+		case "revoked._domainkey.example.com":
+			return []string{"v=DKIM1; k=ed25519; p="}, nil
+		case "broken._domainkey.example.com":
+			return nil, &net.DNSError{Err: "server misbehaving", Name: name}
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	message := []byte("From: howard@example.com\nTo: a@example.com\nSubject: laitos  test\n\nhello world\n")
+	signed, err := dkim.Sign(message)
+	require.NoError(t, err)
+	require.Empty(t, VerifyDKIM(context.Background(), lookupTXT, message))
+	// The mail received by the SMTP server uses LF line endings
+	received := []byte(strings.ReplaceAll(string(signed), "\r\n", "\n"))
+	require.Equal(t, []DKIMResult{{Domain: "example.com", Selector: "laitos", Result: DKIMPass}}, VerifyDKIM(context.Background(), lookupTXT, received))
+	// Relaxed canonicalisation tolerates changes of whitespace
+	relaxed := strings.Replace(string(signed), "Subject: laitos  test", "Subject:  laitos test ", 1)
+	require.Equal(t, DKIMPass, VerifyDKIM(context.Background(), lookupTXT, []byte(relaxed))[0].Result)
+
+	for _, tc := range []struct {
+		message []byte
+		result  DKIMResult
+	}{
+		{[]byte(strings.Replace(string(signed), "hello world", "hello there", 1)), DKIMResult{"example.com", "laitos", DKIMFail, "body hash mismatch"}},
+		{[]byte(strings.Replace(string(signed), "Subject: laitos", "Subject: altered", 1)), DKIMResult{"example.com", "laitos", DKIMFail, "signature mismatch"}},
+		{[]byte(strings.Replace(string(signed), "s=laitos", "s=revoked", 1)), DKIMResult{"example.com", "revoked", DKIMPermError, "key revoked"}},
+		{[]byte(strings.Replace(string(signed), "s=laitos", "s=broken", 1)), DKIMResult{"example.com", "broken", DKIMTempError, "key unavailable"}},
+		{[]byte(strings.Replace(string(signed), "s=laitos", "s=absent", 1)), DKIMResult{"example.com", "absent", DKIMPermError, "no key for signature"}},
+		{[]byte(strings.Replace(string(signed), "a=ed25519-sha256", "a=rsa-sha1", 1)), DKIMResult{"example.com", "laitos", DKIMNeutral, "unsupported algorithm rsa-sha1"}},
+		{[]byte(strings.Replace(string(signed), "h=from:", "h=", 1)), DKIMResult{"example.com", "laitos", DKIMPermError, "From header is not signed"}},
+		{[]byte(strings.Replace(string(signed), " d=example.com;", "", 1)), DKIMResult{"", "laitos", DKIMPermError, "missing tag d="}},
+	} {
+		require.Equal(t, []DKIMResult{tc.result}, VerifyDKIM(context.Background(), lookupTXT, tc.message))
+	}
+}
+
+func TestVerifyDKIM_SimpleCanonicalisation(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pubKeyDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	lookupTXT := func(_ context.Context, name string) ([]string, error) {
+		require.Equal(t, "sel._domainkey.example.org", name)
+		return []string{"v=DKIM1; p=" + base64.StdEncoding.EncodeToString(pubKeyDER)}, nil
+	}
+	// Sign the mail with simple/simple canonicalisation and a body length limit
+	header := "From: Someone <someone@example.org>\r\nSubject:  Hi\r\n"
+	body := "first line \r\nsecond line\r\n\r\n"
+	bodyHash := sha256.Sum256([]byte("first line \r\n"))
+	sigField := "DKIM-Signature: v=1; a=rsa-sha256; d=example.org; s=sel; l=13;\r\n\th=subject:from:from; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+	dataHash := sha256.Sum256([]byte("Subject:  Hi\r\nFrom: Someone <someone@example.org>\r\n" + sigField))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, dataHash[:])
+	require.NoError(t, err)
+	signed := sigField + base64.StdEncoding.EncodeToString(signature) + "\r\n" + header + "\r\n" + body
+	require.Equal(t, []DKIMResult{{Domain: "example.org", Selector: "sel", Result: DKIMPass}}, VerifyDKIM(context.Background(), lookupTXT, []byte(signed)))
+	// Content beyond the body length limit is not signed
+	require.Equal(t, DKIMPass, VerifyDKIM(context.Background(), lookupTXT, []byte(signed+"appended\r\n"))[0].Result)
+	// Simple canonicalisation does not tolerate changes of whitespace
+	require.Equal(t, DKIMFail, VerifyDKIM(context.Background(), lookupTXT, []byte(strings.Replace(signed, "Subject:  Hi", "Subject: Hi", 1)))[0].Result)
+}
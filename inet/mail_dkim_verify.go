@@ -0,0 +1,262 @@
+package inet
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DKIMPass      = "pass"      // DKIMPass means the signature is valid.
+	DKIMFail      = "fail"      // DKIMFail means the signature or body hash does not match the mail.
+	DKIMNeutral   = "neutral"   // DKIMNeutral means the signature uses a feature not supported by the verifier.
+	DKIMTempError = "temperror" // DKIMTempError means the public key could not be retrieved due to a DNS failure.
+	DKIMPermError = "permerror" // DKIMPermError means the signature or public key is malformed or absent.
+
+	// MaxDKIMSignaturesToVerify is the maximum number of signatures verified in a single mail.
+	MaxDKIMSignaturesToVerify = 5
+)
+
+// DKIMResult is the outcome of verifying a single DKIM signature of an incoming mail.
+type DKIMResult struct {
+	Domain   string // Domain is the signing domain (d=).
+	Selector string // Selector is the key selector (s=).
+	Result   string // Result is one of DKIMPass, DKIMFail, DKIMNeutral, DKIMTempError, and DKIMPermError.
+	Reason   string // Reason briefly explains a result other than pass.
+}
+
+// dkimSignatureBTag matches the signature data (b=) of a DKIM-Signature header field, without matching the body hash (bh=).
+var dkimSignatureBTag = regexp.MustCompile(`([;:][ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// parseDKIMTags parses a tag list (RFC 6376 3.2) such as the value of DKIM-Signature, and removes all whitespace from the values.
+func parseDKIMTags(tagList string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(tagList, ";") {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+		name, value, found := strings.Cut(tag, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("malformed tag \"%s\"", strings.TrimSpace(tag))
+		}
+		if _, duplicated := tags[name]; duplicated {
+			return nil, fmt.Errorf("duplicated tag \"%s\"", name)
+		}
+		tags[name] = strings.Join(strings.Fields(value), "")
+	}
+	return tags, nil
+}
+
+// dkimSimpleBody returns the mail body in the "simple" canonical form (RFC 6376 3.4.3).
+func dkimSimpleBody(body string) string {
+	for strings.HasSuffix(body, "\r\n") {
+		body = strings.TrimSuffix(body, "\r\n")
+	}
+	return body + "\r\n"
+}
+
+/*
+VerifyDKIM verifies up to MaxDKIMSignaturesToVerify DKIM signatures (RFC 6376) of the mail, retrieving the public keys
+by looking up DNS TXT records via the lookup function. The mail line endings may be either LF or CRLF. The function
+returns an empty slice if the mail does not carry a signature.
+*/
+func VerifyDKIM(ctx context.Context, lookupTXT func(context.Context, string) ([]string, error), message []byte) []DKIMResult {
+	fields, body := splitMailHeaderBody(normaliseCRLF(message))
+	ret := make([]DKIMResult, 0)
+	for i, field := range fields {
+		if !strings.EqualFold(field.name, "DKIM-Signature") {
+			continue
+		}
+		if len(ret) == MaxDKIMSignaturesToVerify {
+			break
+		}
+		ret = append(ret, verifyDKIMSignature(ctx, lookupTXT, fields, i, body))
+	}
+	return ret
+}
+
+// verifyDKIMSignature verifies the DKIM signature carried by the header field at the index.
+func verifyDKIMSignature(ctx context.Context, lookupTXT func(context.Context, string) ([]string, error), fields []mailHeaderField, sigIndex int, body string) (result DKIMResult) {
+	_, sigValue, _ := strings.Cut(fields[sigIndex].raw, ":")
+	tags, err := parseDKIMTags(sigValue)
+	if err != nil {
+		return DKIMResult{Result: DKIMPermError, Reason: err.Error()}
+	}
+	result.Domain, result.Selector = strings.ToLower(tags["d"]), tags["s"]
+	fail := func(res, format string, a ...interface{}) DKIMResult {
+		result.Result = res
+		result.Reason = fmt.Sprintf(format, a...)
+		return result
+	}
+	// Validate the signature tags
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[name] == "" {
+			return fail(DKIMPermError, "missing tag %s=", name)
+		}
+	}
+	if tags["v"] != "1" {
+		return fail(DKIMPermError, "unsupported version %s", tags["v"])
+	}
+	algorithm := strings.ToLower(tags["a"])
+	if algorithm != "rsa-sha256" && algorithm != "ed25519-sha256" {
+		return fail(DKIMNeutral, "unsupported algorithm %s", algorithm)
+	}
+	signedNames := strings.Split(tags["h"], ":")
+	var signsFrom bool
+	for _, name := range signedNames {
+		signsFrom = signsFrom || strings.EqualFold(name, "From")
+	}
+	if !signsFrom {
+		return fail(DKIMPermError, "From header is not signed")
+	}
+	headerCanon, bodyCanon, _ := strings.Cut(strings.ToLower(tags["c"]), "/")
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+	if headerCanon != "simple" && headerCanon != "relaxed" || bodyCanon != "simple" && bodyCanon != "relaxed" {
+		return fail(DKIMPermError, "unsupported canonicalisation %s", tags["c"])
+	}
+	if expiry := tags["x"]; expiry != "" {
+		if expiryUnix, err := strconv.ParseInt(expiry, 10, 64); err != nil {
+			return fail(DKIMPermError, "malformed expiry x=%s", expiry)
+		} else if time.Now().Unix() > expiryUnix {
+			return fail(DKIMFail, "signature expired")
+		}
+	}
+	// Verify the body hash
+	var canonBody string
+	if bodyCanon == "relaxed" {
+		canonBody = dkimRelaxedBody(body)
+	} else {
+		canonBody = dkimSimpleBody(body)
+	}
+	if bodyLength := tags["l"]; bodyLength != "" {
+		length, err := strconv.Atoi(bodyLength)
+		if err != nil || length < 0 || length > len(canonBody) {
+			return fail(DKIMPermError, "bad body length l=%s", bodyLength)
+		}
+		canonBody = canonBody[:length]
+	}
+	bodyHash := sha256.Sum256([]byte(canonBody))
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return fail(DKIMFail, "body hash mismatch")
+	}
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fail(DKIMPermError, "malformed signature b=")
+	}
+	// Collect the signed header fields, the last unused occurrence of a field name is signed first.
+	canonHeader := func(raw string) string {
+		if headerCanon == "relaxed" {
+			return dkimRelaxedHeader(raw)
+		}
+		return raw
+	}
+	var signedData strings.Builder
+	usedFields := make(map[int]bool)
+	for _, name := range signedNames {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if i != sigIndex && !usedFields[i] && strings.EqualFold(fields[i].name, strings.TrimSpace(name)) {
+				usedFields[i] = true
+				signedData.WriteString(canonHeader(fields[i].raw))
+				break
+			}
+		}
+	}
+	// The signature header field itself is signed without its signature data and trailing CRLF
+	sigField := dkimSignatureBTag.ReplaceAllString(strings.TrimSuffix(fields[sigIndex].raw, "\r\n"), "$1")
+	signedData.WriteString(strings.TrimSuffix(canonHeader(sigField+"\r\n"), "\r\n"))
+	dataHash := sha256.Sum256([]byte(signedData.String()))
+	// Retrieve the public key
+	pubKey, res, reason := getDKIMPublicKey(ctx, lookupTXT, result.Selector+"._domainkey."+result.Domain)
+	if res != "" {
+		return fail(res, "%s", reason)
+	}
+	switch typedKey := pubKey.(type) {
+	case *rsa.PublicKey:
+		if algorithm != "rsa-sha256" {
+			return fail(DKIMPermError, "key type does not match algorithm %s", algorithm)
+		}
+		if err := rsa.VerifyPKCS1v15(typedKey, crypto.SHA256, dataHash[:], signature); err != nil {
+			return fail(DKIMFail, "signature mismatch")
+		}
+	case ed25519.PublicKey:
+		if algorithm != "ed25519-sha256" {
+			return fail(DKIMPermError, "key type does not match algorithm %s", algorithm)
+		}
+		if !ed25519.Verify(typedKey, dataHash[:], signature) {
+			return fail(DKIMFail, "signature mismatch")
+		}
+	}
+	result.Result = DKIMPass
+	return result
+}
+
+// getDKIMPublicKey looks up the public key published in the DNS TXT record. If the key is not usable, the function returns a DKIM result and reason.
+func getDKIMPublicKey(ctx context.Context, lookupTXT func(context.Context, string) ([]string, error), name string) (pubKey crypto.PublicKey, result, reason string) {
+	records, err := lookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, DKIMPermError, "no key for signature"
+		}
+		return nil, DKIMTempError, "key unavailable"
+	}
+	if len(records) == 0 {
+		return nil, DKIMPermError, "no key for signature"
+	}
+	tags, err := parseDKIMTags(records[0])
+	if err != nil {
+		return nil, DKIMPermError, "malformed key record"
+	}
+	if version, exists := tags["v"]; exists && version != "DKIM1" {
+		return nil, DKIMPermError, "malformed key record"
+	}
+	if tags["p"] == "" {
+		return nil, DKIMPermError, "key revoked"
+	}
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, DKIMPermError, "malformed public key"
+	}
+	switch strings.ToLower(tags["k"]) {
+	case "", "rsa":
+		anyKey, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			// A few signers publish the bare PKCS1 key instead
+			if anyKey, err = x509.ParsePKCS1PublicKey(der); err != nil {
+				return nil, DKIMPermError, "malformed public key"
+			}
+		}
+		rsaKey, isRSA := anyKey.(*rsa.PublicKey)
+		if !isRSA {
+			return nil, DKIMPermError, "malformed public key"
+		}
+		if rsaKey.N.BitLen() < 1024 {
+			return nil, DKIMPermError, "key is too short"
+		}
+		return rsaKey, "", ""
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, DKIMPermError, "malformed public key"
+		}
+		return ed25519.PublicKey(der), "", ""
+	default:
+		return nil, DKIMNeutral, "unsupported key type " + tags["k"]
+	}
+}
@@ -34,6 +34,8 @@ type BasicMail struct {
 	FromAddress  string // From address of mail, minus person's name.
 	ReplyAddress string // Address to which a reply to this mail shall be delivered
 	ContentType  string // Mail content type
+	// ContentDisposition tells whether the mail part is an attachment, and optionally its file name.
+	ContentDisposition string
 }
 
 // Parse headers of the mail message and return some basic properties about the mail.
@@ -48,6 +50,7 @@ func ReadMailMessage(mailMessage []byte) (prop BasicMail, parsedMail *mail.Messa
 	}
 	prop.Subject = strings.TrimSpace(parsedMail.Header.Get("Subject"))
 	prop.ContentType = strings.TrimSpace(parsedMail.Header.Get("Content-Type"))
+	prop.ContentDisposition = strings.TrimSpace(parsedMail.Header.Get("Content-Disposition"))
 	// Extract mail address using regex
 	if fromAddr := RegexMailAddress.FindString(parsedMail.Header.Get("From")); fromAddr != "" {
 		prop.FromAddress = strings.TrimSpace(fromAddr)
@@ -109,6 +112,7 @@ func WalkMailMessage(mailMessage []byte, fun func(BasicMail, []byte) (bool, erro
 			// Invoke function with properties of the current part
 			partProp := prop
 			partProp.ContentType = part.Header.Get("Content-Type")
+			partProp.ContentDisposition = part.Header.Get("Content-Disposition")
 			next, err := fun(partProp, body)
 			if err != nil {
 				return err
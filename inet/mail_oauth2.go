@@ -0,0 +1,152 @@
+package inet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MailOAuth2TokenRenewalSec is the amount of time before an access token expires when it will be renewed.
+	MailOAuth2TokenRenewalSec = 5 * 60
+	// MailOAuth2DefaultTokenLifetimeSec is the lifetime assumed for an access token that does not come with an expiry.
+	MailOAuth2DefaultTokenLifetimeSec = 30 * 60
+)
+
+/*
+MailOAuth2 obtains OAuth2 access tokens for the SMTP XOAUTH2 authentication mechanism, which is required by mail
+providers that no longer accept password authentication, such as Gmail and Office365.
+If a refresh token is present, the access token is obtained via refresh token grant, otherwise via client credentials
+grant.
+*/
+type MailOAuth2 struct {
+	// TokenURL is the OAuth2 token endpoint, e.g. "https://oauth2.googleapis.com/token" or
+	// "https://login.microsoftonline.com/<tenant ID>/oauth2/v2.0/token".
+	TokenURL string `json:"TokenURL"`
+	// ClientID is the OAuth2 client (application) ID.
+	ClientID string `json:"ClientID"`
+	// ClientSecret is the OAuth2 client secret.
+	ClientSecret string `json:"ClientSecret"`
+	// RefreshToken is the (optional) long-lived refresh token issued to the mail account owner, e.g. for Gmail.
+	RefreshToken string `json:"RefreshToken"`
+	// Scope is the (optional) scope of access token, e.g. "https://outlook.office365.com/.default" for client credentials grant.
+	Scope string `json:"Scope"`
+}
+
+// IsConfigured returns true only if the token endpoint and client ID are present.
+func (oauth *MailOAuth2) IsConfigured() bool {
+	return oauth != nil && oauth.TokenURL != "" && oauth.ClientID != ""
+}
+
+// cacheKey returns a string that identifies the grant, mail clients of identical OAuth2 configuration share the same token.
+func (oauth *MailOAuth2) cacheKey() string {
+	return strings.Join([]string{oauth.TokenURL, oauth.ClientID, oauth.RefreshToken, oauth.Scope}, "\x00")
+}
+
+// mailOAuth2Token is an access token cached in memory until shortly before it expires.
+type mailOAuth2Token struct {
+	accessToken string
+	expiresAt   time.Time
+}
+
+var (
+	// mailOAuth2Tokens are the access tokens cached for all mail clients. MailClient is often copied by value, hence the
+	// tokens are not kept in the client itself.
+	mailOAuth2Tokens      = make(map[string]mailOAuth2Token)
+	mailOAuth2TokensMutex = new(sync.Mutex)
+)
+
+// GetAccessToken returns a cached access token, or obtains a new one from the token endpoint if the cached token is about to expire.
+func (oauth *MailOAuth2) GetAccessToken(ctx context.Context) (string, error) {
+	mailOAuth2TokensMutex.Lock()
+	defer mailOAuth2TokensMutex.Unlock()
+	key := oauth.cacheKey()
+	if token, exists := mailOAuth2Tokens[key]; exists && time.Now().Before(token.expiresAt.Add(-MailOAuth2TokenRenewalSec*time.Second)) {
+		return token.accessToken, nil
+	}
+	form := url.Values{"client_id": {oauth.ClientID}}
+	if oauth.ClientSecret != "" {
+		form.Set("client_secret", oauth.ClientSecret)
+	}
+	if oauth.RefreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", oauth.RefreshToken)
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if oauth.Scope != "" {
+		form.Set("scope", oauth.Scope)
+	}
+	resp, err := DoHTTP(ctx, HTTPRequest{
+		TimeoutSec: MailIOTimeoutSec,
+		Method:     "POST",
+		Body:       strings.NewReader(form.Encode()),
+		MaxRetry:   1,
+	}, strings.ReplaceAll(oauth.TokenURL, "%", "%%"))
+	if err != nil {
+		return "", fmt.Errorf("MailOAuth2.GetAccessToken: failed to contact token endpoint - %w", err)
+	} else if err := resp.Non2xxToError(); err != nil {
+		return "", fmt.Errorf("MailOAuth2.GetAccessToken: token endpoint refused the request - %w", err)
+	}
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := resp.DecodeJSON(&tokenResp); err != nil {
+		return "", fmt.Errorf("MailOAuth2.GetAccessToken: failed to deserialise token response - %w", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", errors.New("MailOAuth2.GetAccessToken: token response does not have an access token")
+	}
+	if tokenResp.ExpiresIn < 1 {
+		tokenResp.ExpiresIn = MailOAuth2DefaultTokenLifetimeSec
+	}
+	mailOAuth2Tokens[key] = mailOAuth2Token{
+		accessToken: tokenResp.AccessToken,
+		expiresAt:   time.Now().Add(time.Duration(tokenResp.ExpiresIn) * time.Second),
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// ForgetAccessToken removes the cached access token, so that the next GetAccessToken call obtains a new one.
+func (oauth *MailOAuth2) ForgetAccessToken() {
+	mailOAuth2TokensMutex.Lock()
+	defer mailOAuth2TokensMutex.Unlock()
+	delete(mailOAuth2Tokens, oauth.cacheKey())
+}
+
+// xoauth2Auth implements the SASL XOAUTH2 mechanism as an smtp.Auth.
+type xoauth2Auth struct {
+	username, accessToken, host string
+}
+
+// XOAuth2Auth returns an smtp.Auth that authenticates the user with an OAuth2 access token using the XOAUTH2 mechanism.
+// Similar to smtp.PlainAuth, it only sends the token over a TLS connection or to localhost.
+func XOAuth2Auth(username, accessToken, host string) smtp.Auth {
+	return &xoauth2Auth{username: username, accessToken: accessToken, host: host}
+}
+
+// Start sends the initial response that carries the user name and the bearer token.
+func (auth *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("XOAuth2Auth: unencrypted connection")
+	}
+	if server.Name != auth.host {
+		return "", nil, errors.New("XOAuth2Auth: wrong host name")
+	}
+	return "XOAUTH2", []byte("user=" + auth.username + "\x01auth=Bearer " + auth.accessToken + "\x01\x01"), nil
+}
+
+// Next responds to the server's error challenge with an empty response, after which the server concludes the failure.
+func (auth *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server challenge is a JSON document describing the error, the client must respond with an empty line.
+		return []byte{}, nil
+	}
+	return nil, nil
+}
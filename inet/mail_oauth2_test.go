@@ -0,0 +1,79 @@
+package inet
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMailOAuth2_GetAccessToken(t *testing.T) {
+	var numRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		require.NoError(t, r.ParseForm())
+		if r.Form.Get("client_id") != "my-client" || r.Form.Get("client_secret") != "my-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Form.Get("grant_type") {
+		case "refresh_token":
+			require.Equal(t, "my-refresh-token", r.Form.Get("refresh_token"))
+			_, _ = w.Write([]byte(`{"access_token": "token-from-refresh", "expires_in": 3600}`))
+		case "client_credentials":
+			require.Equal(t, "https://outlook.office365.com/.default", r.Form.Get("scope"))
+			// An expiry shorter than the renewal window causes the token to be renewed every time.
+			_, _ = w.Write([]byte(`{"access_token": "token-from-client-credentials", "expires_in": 60}`))
+		}
+	}))
+	defer server.Close()
+
+	refreshGrant := &MailOAuth2{TokenURL: server.URL, ClientID: "my-client", ClientSecret: "my-secret", RefreshToken: "my-refresh-token"}
+	require.True(t, refreshGrant.IsConfigured())
+	for i := 0; i < 3; i++ {
+		token, err := refreshGrant.GetAccessToken(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "token-from-refresh", token)
+	}
+	require.EqualValues(t, 1, atomic.LoadInt32(&numRequests))
+	refreshGrant.ForgetAccessToken()
+	_, err := refreshGrant.GetAccessToken(context.Background())
+	require.NoError(t, err)
+	require.EqualValues(t, 2, atomic.LoadInt32(&numRequests))
+
+	credsGrant := &MailOAuth2{TokenURL: server.URL, ClientID: "my-client", ClientSecret: "my-secret", Scope: "https://outlook.office365.com/.default"}
+	for i := 0; i < 2; i++ {
+		token, err := credsGrant.GetAccessToken(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "token-from-client-credentials", token)
+	}
+	require.EqualValues(t, 4, atomic.LoadInt32(&numRequests))
+
+	badSecret := &MailOAuth2{TokenURL: server.URL, ClientID: "my-client", ClientSecret: "wrong"}
+	_, err = badSecret.GetAccessToken(context.Background())
+	require.Error(t, err)
+
+	var notConfigured *MailOAuth2
+	require.False(t, notConfigured.IsConfigured())
+}
+
+func TestXOAuth2Auth(t *testing.T) {
+	auth := XOAuth2Auth("howard@example.com", "my-token", "mail.example.com")
+	_, _, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: false})
+	require.Error(t, err)
+	_, _, err = auth.Start(&smtp.ServerInfo{Name: "other.example.com", TLS: true})
+	require.Error(t, err)
+	proto, resp, err := auth.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true})
+	require.NoError(t, err)
+	require.Equal(t, "XOAUTH2", proto)
+	require.Equal(t, "user=howard@example.com\x01auth=Bearer my-token\x01\x01", string(resp))
+	// The error challenge is answered by an empty response.
+	resp, err = auth.Next([]byte(`{"status":"401"}`), true)
+	require.NoError(t, err)
+	require.Empty(t, resp)
+	require.NotNil(t, resp)
+}
@@ -0,0 +1,245 @@
+package inet
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// DefaultRedisTimeoutMillis is the default timeout of connecting to Redis server and each command round trip.
+	DefaultRedisTimeoutMillis = 300
+	// DefaultRedisMaxIdleConns is the default number of idle connections kept for reuse.
+	DefaultRedisMaxIdleConns = 8
+	// MaxRedisBulkStringLen is the maximum length of a bulk string reply accepted from Redis server.
+	MaxRedisBulkStringLen = 1048576
+	// MaxRedisArrayLen is the maximum number of elements of an array reply accepted from Redis server.
+	MaxRedisArrayLen = 1024
+)
+
+/*
+redisIncrementCounterScript increases the counter and sets its expiry upon creation, atomically in a single round trip.
+KEYS[1] is the counter key, ARGV[1] is the expiry in milliseconds.
+*/
+const redisIncrementCounterScript = `local c = redis.call('INCR', KEYS[1]) if c == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end return c`
+
+// RedisError is an error reply from Redis server.
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to Redis server along with its buffered reader.
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+/*
+RedisClient is a minimal client of Redis server that speaks the RESP protocol. It offers just enough to keep shared
+state, such as rate limit counters, among several laitos program instances.
+*/
+type RedisClient struct {
+	// Address is the host and port of Redis server, e.g. "redis.example.com:6379".
+	Address string `json:"Address"`
+	// Username is the optional user name of Redis 6 ACL authentication.
+	Username string `json:"Username"`
+	// Password is the optional password used for authentication.
+	Password string `json:"Password"`
+	// DB is the numeric database to select.
+	DB int `json:"DB"`
+	// UseTLS connects to Redis server over TLS.
+	UseTLS bool `json:"UseTLS"`
+	// TimeoutMillis is the timeout of connecting to Redis server and each command round trip.
+	TimeoutMillis int `json:"TimeoutMillis"`
+	// MaxIdleConns is the maximum number of idle connections kept for reuse.
+	MaxIdleConns int `json:"MaxIdleConns"`
+
+	idleConns chan *redisConn
+}
+
+// Initialise validates configuration and prepares internal states.
+func (client *RedisClient) Initialise() error {
+	if _, _, err := net.SplitHostPort(client.Address); err != nil {
+		return fmt.Errorf("RedisClient.Initialise: Address must be in the form of host:port - %w", err)
+	}
+	if client.TimeoutMillis < 1 {
+		client.TimeoutMillis = DefaultRedisTimeoutMillis
+	}
+	if client.MaxIdleConns < 1 {
+		client.MaxIdleConns = DefaultRedisMaxIdleConns
+	}
+	client.idleConns = make(chan *redisConn, client.MaxIdleConns)
+	return nil
+}
+
+// dial connects to Redis server, authenticates, and selects the database.
+func (client *RedisClient) dial(ctx context.Context) (*redisConn, error) {
+	dialer := net.Dialer{Timeout: time.Duration(client.TimeoutMillis) * time.Millisecond}
+	conn, err := dialer.DialContext(ctx, "tcp", client.Address)
+	if err != nil {
+		return nil, err
+	}
+	if client.UseTLS {
+		host, _, _ := net.SplitHostPort(client.Address)
+		tlsConn := tls.Client(conn, misc.DefaultTLS.ClientConfig(host))
+		_ = tlsConn.SetDeadline(time.Now().Add(time.Duration(client.TimeoutMillis) * time.Millisecond))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if client.Password != "" {
+		args := []string{"AUTH", client.Password}
+		if client.Username != "" {
+			args = []string{"AUTH", client.Username, client.Password}
+		}
+		if _, err := client.roundTrip(rc, args...); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if client.DB != 0 {
+		if _, err := client.roundTrip(rc, "SELECT", strconv.Itoa(client.DB)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// roundTrip sends a command and reads its reply.
+func (client *RedisClient) roundTrip(rc *redisConn, args ...string) (interface{}, error) {
+	if err := rc.conn.SetDeadline(time.Now().Add(time.Duration(client.TimeoutMillis) * time.Millisecond)); err != nil {
+		return nil, err
+	}
+	var cmd strings.Builder
+	cmd.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		cmd.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
+	}
+	if _, err := io.WriteString(rc.conn, cmd.String()); err != nil {
+		return nil, err
+	}
+	return ReadRedisReply(rc.reader)
+}
+
+/*
+Do sends a command to Redis server and returns its reply, which is a string, an int64, nil, or an array of them.
+An error reply from the server is returned as RedisError.
+*/
+func (client *RedisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-client.idleConns:
+	default:
+		var err error
+		if rc, err = client.dial(ctx); err != nil {
+			return nil, fmt.Errorf("RedisClient.Do: failed to connect - %w", err)
+		}
+	}
+	reply, err := client.roundTrip(rc, args...)
+	var redisErr RedisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection is in an unknown state
+		_ = rc.conn.Close()
+		return nil, err
+	}
+	select {
+	case client.idleConns <- rc:
+	default:
+		_ = rc.conn.Close()
+	}
+	return reply, err
+}
+
+// IncrementCounter increases the counter of the key by one and returns the latest count. The counter is deleted after the duration elapses.
+func (client *RedisClient) IncrementCounter(key string, expireAfter time.Duration) (int64, error) {
+	reply, err := client.Do(context.Background(), "EVAL", redisIncrementCounterScript, "1", key, strconv.FormatInt(expireAfter.Milliseconds(), 10))
+	if err != nil {
+		return 0, err
+	}
+	count, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("RedisClient.IncrementCounter: unexpected reply %v", reply)
+	}
+	return count, nil
+}
+
+// SelfTest pings Redis server.
+func (client *RedisClient) SelfTest() error {
+	if reply, err := client.Do(context.Background(), "PING"); err != nil {
+		return fmt.Errorf("RedisClient.SelfTest: %w", err)
+	} else if reply != "PONG" {
+		return fmt.Errorf("RedisClient.SelfTest: unexpected reply %v", reply)
+	}
+	return nil
+}
+
+// ReadRedisReply reads a RESP reply, which is a string, an int64, nil, or an array of them. An error reply is returned
+// as RedisError, or as an element of RedisError in an array.
+func ReadRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("ReadRedisReply: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length > MaxRedisBulkStringLen {
+			return nil, fmt.Errorf("ReadRedisReply: malformed bulk string length %q", line)
+		} else if length < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:length]), nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length > MaxRedisArrayLen {
+			return nil, fmt.Errorf("ReadRedisReply: malformed array length %q", line)
+		} else if length < 0 {
+			return nil, nil
+		}
+		elements := make([]interface{}, length)
+		for i := range elements {
+			elem, err := ReadRedisReply(reader)
+			var redisErr RedisError
+			if errors.As(err, &redisErr) {
+				// An element of error reply does not fail the entire array
+				elements[i] = redisErr
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			elements[i] = elem
+		}
+		return elements, nil
+	default:
+		return nil, fmt.Errorf("ReadRedisReply: unknown reply type %q", line)
+	}
+}
@@ -0,0 +1,168 @@
+package inet
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readRedisCommand reads a command sent by the client in an array of bulk strings.
+func readRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	numArgs, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, numArgs)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		length, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:length])
+	}
+	return args, nil
+}
+
+// startFakeRedis starts a server that understands just enough commands to test the client.
+func startFakeRedis(t *testing.T, password string) (addr string, numConns *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	counters := make(map[string]int64)
+	expiry := make(map[string]string)
+	mutex := new(sync.Mutex)
+	numConns = new(int32)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(numConns, 1)
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				authenticated := password == ""
+				for {
+					args, err := readRedisCommand(reader)
+					if err != nil {
+						return
+					}
+					mutex.Lock()
+					var reply string
+					switch {
+					case args[0] == "AUTH":
+						if args[len(args)-1] == password {
+							authenticated = true
+							reply = "+OK\r\n"
+						} else {
+							reply = "-WRONGPASS invalid password\r\n"
+						}
+					case !authenticated:
+						reply = "-NOAUTH Authentication required.\r\n"
+					case args[0] == "PING":
+						reply = "+PONG\r\n"
+					case args[0] == "SELECT":
+						reply = "+OK\r\n"
+					case args[0] == "EVAL" && args[1] == redisIncrementCounterScript:
+						counters[args[3]]++
+						if counters[args[3]] == 1 {
+							expiry[args[3]] = args[4]
+						}
+						reply = fmt.Sprintf(":%d\r\n", counters[args[3]])
+					case args[0] == "PTTL":
+						reply = fmt.Sprintf("$%d\r\n%s\r\n", len(expiry[args[1]]), expiry[args[1]])
+					case args[0] == "MGET":
+						reply = "*3\r\n$1\r\na\r\n$-1\r\n-ERR oops\r\n"
+					default:
+						reply = "-ERR unknown command\r\n"
+					}
+					mutex.Unlock()
+					if _, err := conn.Write([]byte(reply)); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String(), numConns
+}
+
+func TestReadRedisReply(t *testing.T) {
+	for input, expected := range map[string]interface{}{
+		"+OK\r\n":                 "OK",
+		":-12\r\n":                int64(-12),
+		"$5\r\nhello\r\n":         "hello",
+		"$0\r\n\r\n":              "",
+		"$-1\r\n":                 nil,
+		"*2\r\n:1\r\n$1\r\na\r\n": []interface{}{int64(1), "a"},
+		"*1\r\n*1\r\n+nested\r\n": []interface{}{[]interface{}{"nested"}},
+		"*2\r\n-ERR a\r\n+b\r\n":  []interface{}{RedisError("ERR a"), "b"},
+		"*0\r\n":                  []interface{}{},
+		"*-1\r\n":                 nil,
+	} {
+		reply, err := ReadRedisReply(bufio.NewReader(strings.NewReader(input)))
+		require.NoError(t, err, input)
+		require.Equal(t, expected, reply, input)
+	}
+	_, err := ReadRedisReply(bufio.NewReader(strings.NewReader("-ERR bad\r\n")))
+	require.Equal(t, RedisError("ERR bad"), err)
+	for _, input := range []string{"", "+OK\n", "?\r\n", ":abc\r\n", "$99999999\r\n", "$5\r\nab\r\n", "*99999\r\n"} {
+		_, err := ReadRedisReply(bufio.NewReader(strings.NewReader(input)))
+		require.Error(t, err, input)
+	}
+}
+
+func TestRedisClient(t *testing.T) {
+	require.Error(t, (&RedisClient{Address: "no-port"}).Initialise())
+
+	addr, numConns := startFakeRedis(t, "secret")
+	client := &RedisClient{Address: addr, Password: "wrong", DB: 1}
+	require.NoError(t, client.Initialise())
+	require.Equal(t, DefaultRedisTimeoutMillis, client.TimeoutMillis)
+	require.Error(t, client.SelfTest())
+
+	client = &RedisClient{Address: addr, Password: "secret", DB: 1, MaxIdleConns: 1}
+	require.NoError(t, client.Initialise())
+	require.NoError(t, client.SelfTest())
+	for i := int64(1); i <= 3; i++ {
+		count, err := client.IncrementCounter("key", 2500*time.Millisecond)
+		require.NoError(t, err)
+		require.Equal(t, i, count)
+	}
+	ttl, err := client.Do(context.Background(), "PTTL", "key")
+	require.NoError(t, err)
+	require.Equal(t, "2500", ttl)
+	// An error reply does not spoil the connection
+	_, err = client.Do(context.Background(), "UNKNOWN")
+	require.Equal(t, RedisError("ERR unknown command"), err)
+	reply, err := client.Do(context.Background(), "MGET", "a", "b", "c")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"a", nil, RedisError("ERR oops")}, reply)
+	// The idle connection has been reused throughout, the other connection came from the failed authentication.
+	require.EqualValues(t, 2, atomic.LoadInt32(numConns))
+
+	// The server is unavailable
+	client = &RedisClient{Address: "127.0.0.1:1"}
+	require.NoError(t, client.Initialise())
+	_, err = client.IncrementCounter("key", time.Second)
+	require.Error(t, err)
+}
@@ -12,6 +12,7 @@ import (
 	"sync/atomic"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/HouzuoGuo/laitos/datastruct"
 )
@@ -252,6 +253,21 @@ func TruncateString(in string, maxLength int) string {
 	return in
 }
 
+// TruncateStringAtRune returns the beginning of the input string no longer than the maximum length in bytes, the cut never
+// splits a UTF-8 character.
+func TruncateStringAtRune(in string, maxLength int) string {
+	if maxLength < 0 {
+		maxLength = 0
+	}
+	if len(in) <= maxLength {
+		return in
+	}
+	for maxLength > 0 && !utf8.RuneStart(in[maxLength]) {
+		maxLength--
+	}
+	return in[:maxLength]
+}
+
 /*
 LintString returns a copy of the input string with unusual characters (such as non-printable characters and record
 separators) replaced by an underscore. Consequently, printable characters such as CJK languages are also replaced.
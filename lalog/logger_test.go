@@ -215,3 +215,25 @@ func TestLintString(t *testing.T) {
 		t.Fatalf("\n%s\n%s\n%v\n%v\n", a, match, []byte(a), []byte(match))
 	}
 }
+
+func TestTruncateStringAtRune(t *testing.T) {
+	for _, tc := range []struct {
+		in        string
+		maxLength int
+		want      string
+	}{
+		{"", -1, ""},
+		{"abc", 0, ""},
+		{"abc", 3, "abc"},
+		{"abc", 2, "ab"},
+		{"a你好", 1, "a"},
+		{"a你好", 3, "a"},
+		{"a你好", 4, "a你"},
+		{"a你好", 6, "a你"},
+		{"a你好", 7, "a你好"},
+	} {
+		if s := TruncateStringAtRune(tc.in, tc.maxLength); s != tc.want {
+			t.Fatal(tc, s)
+		}
+	}
+}
@@ -1,10 +1,33 @@
 package lalog
 
 import (
+	"fmt"
 	"sync"
 	"time"
 )
 
+/*
+SharedRateLimitState keeps the counters of rate limits in a location shared by all program instances, such as a Redis
+server, so that the limits are enforced across all replicas of a deployment behind a load balancer.
+*/
+type SharedRateLimitState interface {
+	// IncrementCounter increases the counter of the key by one and returns the latest count. The counter is deleted
+	// after the duration elapses.
+	IncrementCounter(key string, expireAfter time.Duration) (int64, error)
+}
+
+var (
+	sharedRateLimitState      SharedRateLimitState
+	sharedRateLimitStateMutex = new(sync.Mutex)
+)
+
+// SetSharedRateLimitState sets the shared state for the rate limits constructed afterwards by NewSharedRateLimit.
+func SetSharedRateLimitState(state SharedRateLimitState) {
+	sharedRateLimitStateMutex.Lock()
+	defer sharedRateLimitStateMutex.Unlock()
+	sharedRateLimitState = state
+}
+
 /*
 RateLimit tracks number of hits performed by each source ("actor") to determine whether a source has exceeded
 specified rate limit. Instead of being a rolling counter, the tracking data is reset to empty at regular interval.
@@ -14,11 +37,14 @@ type RateLimit struct {
 	UnitSecs int64
 	MaxCount int
 	Logger   *Logger
+	// Namespace distinguishes the counters of this rate limit from those of other rate limits in the shared state.
+	Namespace string
 
 	lastTimestamp int64
 	counter       map[string]int
 	logged        map[string]struct{}
 	counterMutex  *sync.Mutex
+	shared        SharedRateLimitState
 }
 
 // NewRateLimit constructs a new rate limiter.
@@ -50,24 +76,70 @@ func NewRateLimit(unitSecs int64, maxCount int, logger *Logger) (limit *RateLimi
 	return
 }
 
+/*
+NewSharedRateLimit constructs a new rate limiter that keeps its counters in the shared state, if one has been set by
+SetSharedRateLimitState. Otherwise, the rate limiter works just like the one constructed by NewRateLimit.
+The namespace must be identical among all program instances that enforce the same limit.
+*/
+func NewSharedRateLimit(namespace string, unitSecs int64, maxCount int, logger *Logger) (limit *RateLimit) {
+	limit = NewRateLimit(unitSecs, maxCount, logger)
+	limit.Namespace = namespace
+	sharedRateLimitStateMutex.Lock()
+	limit.shared = sharedRateLimitState
+	sharedRateLimitStateMutex.Unlock()
+	return
+}
+
+// resetIfElapsed resets all counters after the interval. Caller must hold the counter mutex.
+func (limit *RateLimit) resetIfElapsed(now int64) {
+	if now-limit.lastTimestamp >= limit.UnitSecs {
+		limit.counter = make(map[string]int)
+		limit.logged = make(map[string]struct{})
+		limit.lastTimestamp = now
+	}
+}
+
+// logLimitHit logs the actor that exceeded the limit, once per interval.
+func (limit *RateLimit) logLimitHit(actor string) {
+	if _, hasLogged := limit.logged[actor]; !hasLogged {
+		limit.Logger.Info("RateLimit", nil, "%s exceeded limit of %d hits per %d seconds", actor, limit.MaxCount, limit.UnitSecs)
+		limit.logged[actor] = struct{}{}
+	}
+}
+
 /*
 Add increases the current counter by one for the actor name/ID if the max count per time interval has not been exceeded, and returns true.
 Otherwise, the actor's current counter stays until the interval passes, and the function will return false.
+With a shared state, the counter is shared by all program instances. Should the shared state become unavailable, the
+limit is enforced by this program instance alone.
 */
 func (limit *RateLimit) Add(actor string, logIfLimitHit bool) bool {
+	now := time.Now().Unix()
+	if limit.shared != nil {
+		// All program instances count the hits of the same interval in the same key
+		key := fmt.Sprintf("laitos-ratelimit:%s:%s:%d", limit.Namespace, actor, now/limit.UnitSecs)
+		count, err := limit.shared.IncrementCounter(key, time.Duration(limit.UnitSecs)*time.Second)
+		if err == nil {
+			if count <= int64(limit.MaxCount) {
+				return true
+			}
+			if logIfLimitHit {
+				limit.counterMutex.Lock()
+				limit.resetIfElapsed(now)
+				limit.logLimitHit(actor)
+				limit.counterMutex.Unlock()
+			}
+			return false
+		}
+		limit.Logger.Warning(limit.Namespace, err, "failed to update the shared rate limit counter, enforcing the limit locally")
+	}
 	limit.counterMutex.Lock()
 	defer limit.counterMutex.Unlock()
-	// Reset all counters after the interval.
-	if now := time.Now().Unix(); now-limit.lastTimestamp >= limit.UnitSecs {
-		limit.counter = make(map[string]int)
-		limit.logged = make(map[string]struct{})
-		limit.lastTimestamp = now
-	}
+	limit.resetIfElapsed(now)
 	if count, exists := limit.counter[actor]; exists {
 		if count >= limit.MaxCount {
-			if _, hasLogged := limit.logged[actor]; !hasLogged && logIfLimitHit {
-				limit.Logger.Info("RateLimit", nil, "%s exceeded limit of %d hits per %d seconds", actor, limit.MaxCount, limit.UnitSecs)
-				limit.logged[actor] = struct{}{}
+			if logIfLimitHit {
+				limit.logLimitHit(actor)
 			}
 			return false
 		} else {
@@ -1,6 +1,7 @@
 package lalog
 
 import (
+	"errors"
 	"strconv"
 	"sync"
 	"testing"
@@ -79,3 +80,55 @@ func TestRateLimit2(t *testing.T) {
 	}
 	successMutex.Unlock()
 }
+
+type fakeSharedRateLimitState struct {
+	counters map[string]int64
+	fail     bool
+	mutex    sync.Mutex
+}
+
+func (state *fakeSharedRateLimitState) IncrementCounter(key string, _ time.Duration) (int64, error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.fail {
+		return 0, errors.New("unavailable")
+	}
+	state.counters[key]++
+	return state.counters[key], nil
+}
+
+func TestSharedRateLimit(t *testing.T) {
+	state := &fakeSharedRateLimitState{counters: make(map[string]int64)}
+	SetSharedRateLimitState(state)
+	defer SetSharedRateLimitState(nil)
+	// Two rate limits of the same namespace act like two program instances sharing the limit
+	limit1 := NewSharedRateLimit("test", 100, 4, DefaultLogger)
+	limit2 := NewSharedRateLimit("test", 100, 4, DefaultLogger)
+	for i := 0; i < 2; i++ {
+		if !limit1.Add("1.1.1.1", true) || !limit2.Add("1.1.1.1", true) {
+			t.Fatal("should have allowed")
+		}
+	}
+	if limit1.Add("1.1.1.1", true) || limit2.Add("1.1.1.1", true) {
+		t.Fatal("should have denied")
+	}
+	// Another actor and another namespace are counted separately
+	if !limit1.Add("2.2.2.2", true) || !NewSharedRateLimit("other", 100, 4, DefaultLogger).Add("1.1.1.1", true) {
+		t.Fatal("should have allowed")
+	}
+	// Without the shared state, the limit is enforced locally
+	state.fail = true
+	for i := 0; i < 4; i++ {
+		if !limit1.Add("1.1.1.1", true) {
+			t.Fatal("should have allowed")
+		}
+	}
+	if limit1.Add("1.1.1.1", true) {
+		t.Fatal("should have denied")
+	}
+	// A rate limit constructed without shared state never uses it
+	SetSharedRateLimitState(nil)
+	if limit := NewSharedRateLimit("test", 100, 4, DefaultLogger); limit.shared != nil {
+		t.Fatal("should not have shared state")
+	}
+}
@@ -11,8 +11,10 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/httpd/handler"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/launcher"
@@ -39,6 +41,13 @@ It behaves similar to one of the laitos daemon programs, and uses a similar conv
 */
 type Handler struct {
 	logger *lalog.Logger
+
+	// webSocketBridges are the bridges of API gateway WebSocket API clients, keyed by connection ID.
+	webSocketBridges map[string]*webSocketBridge
+	// webSocketConnections are the clients of API gateway management API, keyed by the callback URL of WebSocket API stage.
+	webSocketConnections    map[string]webSocketConnections
+	newWebSocketConnections func(endpoint string) (webSocketConnections, error)
+	webSocketMutex          *sync.Mutex
 }
 
 func (hand *Handler) Initialise() {
@@ -46,6 +55,10 @@ func (hand *Handler) Initialise() {
 		ComponentName: "lambda",
 		ComponentID:   nil,
 	}
+	hand.webSocketBridges = make(map[string]*webSocketBridge)
+	hand.webSocketConnections = make(map[string]webSocketConnections)
+	hand.newWebSocketConnections = newWebSocketConnectionsClient
+	hand.webSocketMutex = new(sync.Mutex)
 }
 
 /*
@@ -105,7 +118,8 @@ func (hand *Handler) getAndProcessLambdaInvocation(lambdaAPIHostNamePort string,
 
 /*
 decodeAndHandleHTTPRequest proxies the HTTP request deserialised and decoded from lambda invocation event to laitos web server,
-and returns a lambda invocation response that encapsulates web server's response.
+and returns a lambda invocation response that encapsulates web server's response. The events of API gateway WebSocket API
+are handled by handleWebSocketEvent instead.
 */
 func (hand *Handler) decodeAndHandleHTTPRequest(awsRequestID string, invocationJSON []byte, webServerPort int) (lambdaResponse []byte, err error) {
 	var input InvocationInput
@@ -126,6 +140,10 @@ func (hand *Handler) decodeAndHandleHTTPRequest(awsRequestID string, invocationJ
 			misc.ProgramDataDecryptionPasswordInput <- decryptionPass
 		}
 	}
+	// The events of API gateway WebSocket API are bridged to an app command WebSocket session of the web server.
+	if input.RequestContext.ConnectionID != "" {
+		return hand.handleWebSocketEvent(awsRequestID, input, webServerPort)
+	}
 	// Prepare HTTP request for laitos web server
 	var reqBody []byte
 	if input.IsBase64Encoded {
@@ -137,6 +155,19 @@ func (hand *Handler) decodeAndHandleHTTPRequest(awsRequestID string, invocationJ
 	} else {
 		reqBody = []byte(input.Body)
 	}
+	// Never trust a principal header from the client, the principal verified by API gateway authorizer goes in its place.
+	for headerName := range input.MultiValueHeaders {
+		if strings.EqualFold(headerName, handler.AuthorizerPrincipalHeader) {
+			delete(input.MultiValueHeaders, headerName)
+		}
+	}
+	if principal := input.RequestContext.GetAuthorizerPrincipal(); principal != "" {
+		if input.MultiValueHeaders == nil {
+			input.MultiValueHeaders = make(map[string][]string)
+		}
+		input.MultiValueHeaders[handler.AuthorizerPrincipalHeader] = []string{handler.IssueAuthorizerPrincipalToken(principal)}
+		hand.logger.Info(awsRequestID, nil, "the request comes from authorizer principal \"%s\"", principal)
+	}
 	reqParams := inet.HTTPRequest{
 		// Be very generous with the constraints
 		TimeoutSec: 60,
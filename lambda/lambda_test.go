@@ -1,17 +1,25 @@
 package lambda
 
 import (
+	"context"
 	"encoding/json"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/httpd/handler"
+	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/launcher"
 	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLambdaHandler(t *testing.T) {
@@ -47,6 +55,7 @@ func TestLambdaHandler(t *testing.T) {
 			Path:       "/stage-dev/resource1",
 			HTTPMethod: "DELETE",
 			Stage:      "dev",
+			Authorizer: map[string]interface{}{"principalId": "alice"},
 		},
 		MultiValueQueryStringParameters: map[string][]string{
 			"i": {"1"},
@@ -55,6 +64,8 @@ func TestLambdaHandler(t *testing.T) {
 		MultiValueHeaders: map[string][]string{
 			"X-Head1": {"h1"},
 			"X-Head2": {"h2"},
+			// The client must not be able to forge the principal
+			"x-laitos-authorizer-principal": {"forged"},
 		},
 		IsBase64Encoded: true,
 		Body:            "YQ==", // "a"
@@ -100,9 +111,106 @@ func TestLambdaHandler(t *testing.T) {
 	if !reflect.DeepEqual(lastHeaders["X-Head1"], []string{"h1"}) || !reflect.DeepEqual(lastHeaders["X-Head2"], []string{"h2"}) {
 		t.Fatalf("%+v", lastHeaders)
 	}
+	if principalToken := lastHeaders.Values(handler.AuthorizerPrincipalHeader); len(principalToken) != 1 || handler.RedeemAuthorizerPrincipalToken(principalToken[0]) != "alice" {
+		t.Fatalf("%+v", lastHeaders)
+	}
 	// Check HTTP response
 	if invocationOutput.StatusCode != http.StatusOK || !invocationOutput.IsBase64Encoded ||
 		invocationOutput.Headers["X-Custom-Header"] != "header-value" || invocationOutput.Body != "Yg==" {
 		t.Fatalf("%+v", invocationOutput)
 	}
 }
+
+func TestRequestContext_GetAuthorizerPrincipal(t *testing.T) {
+	for principal, reqCtx := range map[string]RequestContext{
+		"":                            {},
+		"lambda-authorizer-principal": {Authorizer: map[string]interface{}{"principalId": "lambda-authorizer-principal"}},
+		"cognito-user":                {Authorizer: map[string]interface{}{"claims": map[string]interface{}{"sub": "subject", "cognito:username": "cognito-user"}}},
+		"subject":                     {Authorizer: map[string]interface{}{"claims": map[string]interface{}{"sub": "subject"}}},
+		"arn:aws:iam::1:user/bob":     {Identity: RequestIdentity{UserArn: "arn:aws:iam::1:user/bob", CognitoIdentityID: "identity"}},
+		"identity":                    {Identity: RequestIdentity{CognitoIdentityID: "identity"}},
+	} {
+		if actual := reqCtx.GetAuthorizerPrincipal(); actual != principal {
+			t.Fatalf("expected %q, got %q", principal, actual)
+		}
+	}
+}
+
+// testWebSocketConnections records the messages sent to the clients of API gateway WebSocket API.
+type testWebSocketConnections struct {
+	mutex    sync.Mutex
+	messages map[string][]string
+	deleted  []string
+}
+
+func (conns *testWebSocketConnections) PostToConnection(_ context.Context, connectionID string, data []byte) error {
+	conns.mutex.Lock()
+	defer conns.mutex.Unlock()
+	conns.messages[connectionID] = append(conns.messages[connectionID], string(data))
+	return nil
+}
+
+func (conns *testWebSocketConnections) DeleteConnection(_ context.Context, connectionID string) error {
+	conns.mutex.Lock()
+	defer conns.mutex.Unlock()
+	conns.deleted = append(conns.deleted, connectionID)
+	return nil
+}
+
+func TestLambdaHandler_WebSocket(t *testing.T) {
+	t.Setenv(launcher.EnvironmentStripURLPrefixFromRequest, "")
+	appCmd := &handler.HandleAppCommand{}
+	require.NoError(t, appCmd.Initialise(lalog.DefaultLogger, toolbox.GetTestCommandProcessor(), ""))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cmd", appCmd.Handle)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	webServerPort := server.Listener.Addr().(*net.TCPAddr).Port
+
+	conns := &testWebSocketConnections{messages: make(map[string][]string)}
+	var callbackURL string
+	hand := Handler{}
+	hand.Initialise()
+	hand.newWebSocketConnections = func(endpoint string) (webSocketConnections, error) {
+		callbackURL = endpoint
+		return conns, nil
+	}
+	invoke := func(eventType, body string, stageVars map[string]string) int {
+		input, err := json.Marshal(InvocationInput{
+			StageVariables: stageVars,
+			RequestContext: RequestContext{
+				Stage:        "dev",
+				ConnectionID: "conn1",
+				EventType:    eventType,
+				DomainName:   "abcdef.execute-api.us-east-1.amazonaws.com",
+				Identity:     RequestIdentity{SourceIP: "192.0.2.1"},
+			},
+			Body: body,
+		})
+		require.NoError(t, err)
+		lambdaResponse, err := hand.decodeAndHandleHTTPRequest("test-request-id", input, webServerPort)
+		require.NoError(t, err)
+		var output InvocationOutput
+		require.NoError(t, json.Unmarshal(lambdaResponse, &output))
+		return output.StatusCode
+	}
+	stageVars := map[string]string{WebSocketEndpointStageVar: "/cmd"}
+	// The stage variable must tell the app command endpoint
+	require.Equal(t, http.StatusBadGateway, invoke("CONNECT", "", nil))
+	require.Equal(t, http.StatusOK, invoke("CONNECT", "", stageVars))
+	require.Equal(t, "https://abcdef.execute-api.us-east-1.amazonaws.com/dev", callbackURL)
+
+	// The app command output and result are relayed to the client
+	require.Equal(t, http.StatusOK, invoke("MESSAGE", `{"id": "1", "cmd": "`+toolbox.TestCommandProcessorPIN+`.s echo hi"}`, stageVars))
+	conns.mutex.Lock()
+	require.Equal(t, []string{`{"id":"1","output":"hi\n"}`, `{"id":"1","done":true,"result":"hi"}`}, conns.messages["conn1"])
+	conns.mutex.Unlock()
+
+	require.Equal(t, http.StatusOK, invoke("DISCONNECT", "", stageVars))
+	require.Empty(t, hand.webSocketBridges)
+	// The client has disconnected by itself
+	time.Sleep(500 * time.Millisecond)
+	conns.mutex.Lock()
+	require.Empty(t, conns.deleted)
+	conns.mutex.Unlock()
+}
@@ -4,11 +4,54 @@ import (
 	"net/url"
 )
 
+// RequestIdentity is the caller identity of HTTP request coming from AWS API gateway, it is present for IAM authorisation.
+type RequestIdentity struct {
+	UserArn           string `json:"userArn"`
+	CognitoIdentityID string `json:"cognitoIdentityId"`
+	// SourceIP is the IP address of the client.
+	SourceIP string `json:"sourceIp"`
+}
+
 // RequestContext is a component of HTTP request coming from AWS API gateway.
 type RequestContext struct {
-	Stage      string `json:"stage"`
-	Path       string `json:"path"`
-	HTTPMethod string `json:"httpMethod"`
+	Stage      string          `json:"stage"`
+	Path       string          `json:"path"`
+	HTTPMethod string          `json:"httpMethod"`
+	Identity   RequestIdentity `json:"identity"`
+	/*
+		Authorizer is the context returned by the API gateway authorizer that has approved the request. A lambda
+		authorizer gives "principalId", and a cognito user pool authorizer gives the token "claims".
+	*/
+	Authorizer map[string]interface{} `json:"authorizer"`
+
+	// ConnectionID identifies the client connection of an API gateway WebSocket API, it is empty for an HTTP request.
+	ConnectionID string `json:"connectionId"`
+	// EventType is the WebSocket connection event - CONNECT, MESSAGE, or DISCONNECT.
+	EventType string `json:"eventType"`
+	// DomainName is the domain name of the API gateway WebSocket API.
+	DomainName string `json:"domainName"`
+}
+
+/*
+GetAuthorizerPrincipal returns the caller principal verified by API gateway, in the order of preference: the principal
+ID of lambda authorizer, the user name and then subject of cognito user pool, the IAM user ARN, and the cognito
+identity ID. It returns an empty string if API gateway has not verified the caller.
+*/
+func (reqCtx RequestContext) GetAuthorizerPrincipal() string {
+	if principal, _ := reqCtx.Authorizer["principalId"].(string); principal != "" {
+		return principal
+	}
+	if claims, ok := reqCtx.Authorizer["claims"].(map[string]interface{}); ok {
+		for _, claimName := range []string{"cognito:username", "sub"} {
+			if principal, _ := claims[claimName].(string); principal != "" {
+				return principal
+			}
+		}
+	}
+	if reqCtx.Identity.UserArn != "" {
+		return reqCtx.Identity.UserArn
+	}
+	return reqCtx.Identity.CognitoIdentityID
 }
 
 // InvocationInput describes an HTTP request coming from AWS API gateway to be processed by lambda function.
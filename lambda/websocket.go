@@ -0,0 +1,222 @@
+package lambda
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/awsinteg"
+	"github.com/HouzuoGuo/laitos/daemon/httpd/handler"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/launcher"
+	"github.com/HouzuoGuo/laitos/misc"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	/*
+		WebSocketEndpointStageVar is the name of API gateway stage variable that tells the URL location of the app command
+		endpoint, which serves the app command WebSocket sessions bridged from API gateway WebSocket API.
+	*/
+	WebSocketEndpointStageVar = "LAITOS_APP_COMMAND_ENDPOINT"
+	/*
+		WebSocketCommandWaitSec is the maximum duration for which an invocation waits for the result of an app command
+		sent by a WebSocket client. Lambda freezes the handler in between invocations, hence the output of a command that
+		takes longer is relayed to the client during the later invocations.
+	*/
+	WebSocketCommandWaitSec = 60
+)
+
+// webSocketConnections sends messages to and disconnects the clients connected to an API gateway WebSocket API.
+type webSocketConnections interface {
+	PostToConnection(ctx context.Context, connectionID string, data []byte) error
+	DeleteConnection(ctx context.Context, connectionID string) error
+}
+
+// newWebSocketConnectionsClient returns a client of API gateway management API using the callback URL of a WebSocket API stage.
+func newWebSocketConnectionsClient(endpoint string) (webSocketConnections, error) {
+	return awsinteg.NewWebSocketConnectionsClient(endpoint)
+}
+
+/*
+webSocketBridge relays the messages between a client connected to API gateway WebSocket API and the app command
+WebSocket session of laitos web server.
+*/
+type webSocketBridge struct {
+	logger       *lalog.Logger
+	connectionID string
+	ws           *websocket.Conn
+	connections  webSocketConnections
+	// doneIDs receives the ID of each app command as its result is relayed to the client.
+	doneIDs chan string
+	// disconnected is true after the client has disconnected from API gateway.
+	disconnected bool
+}
+
+// relay sends the messages from the web server to the client until the web server ends the session.
+func (bridge *webSocketBridge) relay() {
+	for {
+		var msg string
+		if err := websocket.Message.Receive(bridge.ws, &msg); err != nil {
+			break
+		}
+		if err := bridge.connections.PostToConnection(context.Background(), bridge.connectionID, []byte(msg)); err != nil {
+			bridge.logger.Warning(bridge.connectionID, err, "failed to send a message to the client")
+		}
+		var resp handler.AppCommandWebSocketResponse
+		if err := json.Unmarshal([]byte(msg), &resp); err == nil && resp.Done {
+			select {
+			case bridge.doneIDs <- resp.ID:
+			default:
+			}
+		}
+	}
+}
+
+// run sends an app command message from the client to the web server, and waits for the command result to be relayed to the client.
+func (bridge *webSocketBridge) run(msg string, timeout time.Duration) error {
+	// Find the command ID in the same way as the web server.
+	var req handler.AppCommandWebSocketRequest
+	if err := json.Unmarshal([]byte(msg), &req); err != nil || req.Cmd == "" {
+		req = handler.AppCommandWebSocketRequest{Cmd: msg}
+	}
+	if err := websocket.Message.Send(bridge.ws, msg); err != nil {
+		return err
+	}
+	deadline := time.After(timeout)
+	for {
+		select {
+		case id := <-bridge.doneIDs:
+			if id == req.ID {
+				return nil
+			}
+		case <-deadline:
+			bridge.logger.Info(bridge.connectionID, nil, "command \"%s\" is still running, its output will be relayed in the later invocations", req.ID)
+			return nil
+		}
+	}
+}
+
+/*
+handleWebSocketEvent handles a connection event of API gateway WebSocket API by bridging the client to an app command
+WebSocket session of laitos web server, and returns a lambda invocation response that tells API gateway the outcome.
+*/
+func (hand *Handler) handleWebSocketEvent(awsRequestID string, input InvocationInput, webServerPort int) (lambdaResponse []byte, err error) {
+	connectionID := input.RequestContext.ConnectionID
+	hand.logger.Info(awsRequestID, nil, "WebSocket %s event of connection \"%s\"", input.RequestContext.EventType, connectionID)
+	output := InvocationOutput{StatusCode: http.StatusOK}
+	switch input.RequestContext.EventType {
+	case "CONNECT", "MESSAGE":
+		var bridge *webSocketBridge
+		if bridge, err = hand.getWebSocketBridge(input, webServerPort); err != nil {
+			hand.logger.Warning(awsRequestID, err, "failed to bridge connection \"%s\" to the web server", connectionID)
+			output.StatusCode = http.StatusBadGateway
+			break
+		}
+		if input.RequestContext.EventType == "CONNECT" {
+			break
+		}
+		msg := []byte(input.Body)
+		if input.IsBase64Encoded {
+			if msg, err = base64.StdEncoding.DecodeString(input.Body); err != nil {
+				hand.logger.Warning(awsRequestID, err, "failed to decode base64-encoded message")
+				output.StatusCode = http.StatusBadRequest
+				break
+			}
+		}
+		if err = bridge.run(string(msg), WebSocketCommandWaitSec*time.Second); err != nil {
+			hand.logger.Warning(awsRequestID, err, "failed to send the message of connection \"%s\" to the web server", connectionID)
+			hand.closeWebSocketBridge(connectionID)
+			output.StatusCode = http.StatusBadGateway
+		}
+	case "DISCONNECT":
+		hand.closeWebSocketBridge(connectionID)
+	default:
+		output.StatusCode = http.StatusBadRequest
+	}
+	lambdaResponse, err = json.Marshal(output)
+	return
+}
+
+/*
+getWebSocketBridge returns the bridge of the WebSocket client connection. If the connection is new to this lambda
+instance, then it opens a new app command WebSocket session with the web server.
+*/
+func (hand *Handler) getWebSocketBridge(input InvocationInput, webServerPort int) (*webSocketBridge, error) {
+	hand.webSocketMutex.Lock()
+	defer hand.webSocketMutex.Unlock()
+	connectionID := input.RequestContext.ConnectionID
+	if bridge, exists := hand.webSocketBridges[connectionID]; exists {
+		return bridge, nil
+	}
+	endpoint := input.StageVariables[WebSocketEndpointStageVar]
+	if endpoint == "" {
+		return nil, fmt.Errorf("lambda.getWebSocketBridge: stage variable %s must tell the app command endpoint", WebSocketEndpointStageVar)
+	}
+	callbackURL := fmt.Sprintf("https://%s/%s", input.RequestContext.DomainName, input.RequestContext.Stage)
+	connections, exists := hand.webSocketConnections[callbackURL]
+	if !exists {
+		var err error
+		if connections, err = hand.newWebSocketConnections(callbackURL); err != nil {
+			return nil, fmt.Errorf("lambda.getWebSocketBridge: %w", err)
+		}
+		hand.webSocketConnections[callbackURL] = connections
+	}
+	// Wait for HTTP server to start
+	if !misc.ProbePort(30*time.Second, "localhost", webServerPort) {
+		return nil, errors.New("lambda.getWebSocketBridge: the web server failed to start in time")
+	}
+	wsURL := fmt.Sprintf("ws://localhost:%d%s%s", webServerPort, os.Getenv(launcher.EnvironmentStripURLPrefixFromRequest), endpoint)
+	config, err := websocket.NewConfig(wsURL, "http://localhost")
+	if err != nil {
+		return nil, fmt.Errorf("lambda.getWebSocketBridge: %w", err)
+	}
+	if sourceIP := input.RequestContext.Identity.SourceIP; sourceIP != "" {
+		config.Header.Set("X-Real-Ip", sourceIP)
+	}
+	if principal := input.RequestContext.GetAuthorizerPrincipal(); principal != "" {
+		config.Header.Set(handler.AuthorizerPrincipalHeader, handler.IssueAuthorizerPrincipalToken(principal))
+	}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("lambda.getWebSocketBridge: %w", err)
+	}
+	bridge := &webSocketBridge{
+		logger:       hand.logger,
+		connectionID: connectionID,
+		ws:           ws,
+		connections:  connections,
+		doneIDs:      make(chan string, 64),
+	}
+	hand.webSocketBridges[connectionID] = bridge
+	go func() {
+		bridge.relay()
+		// The web server has ended the session (e.g. the session has expired), disconnect the client too.
+		hand.webSocketMutex.Lock()
+		disconnected := bridge.disconnected
+		if hand.webSocketBridges[connectionID] == bridge {
+			delete(hand.webSocketBridges, connectionID)
+		}
+		hand.webSocketMutex.Unlock()
+		if !disconnected {
+			hand.logger.MaybeMinorError(connections.DeleteConnection(context.Background(), connectionID))
+		}
+	}()
+	return bridge, nil
+}
+
+// closeWebSocketBridge closes the app command WebSocket session of the client that has disconnected from API gateway.
+func (hand *Handler) closeWebSocketBridge(connectionID string) {
+	hand.webSocketMutex.Lock()
+	defer hand.webSocketMutex.Unlock()
+	if bridge, exists := hand.webSocketBridges[connectionID]; exists {
+		bridge.disconnected = true
+		delete(hand.webSocketBridges, connectionID)
+		hand.logger.MaybeMinorError(bridge.ws.Close())
+	}
+}
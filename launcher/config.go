@@ -4,7 +4,10 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"os"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/HouzuoGuo/laitos/awsinteg"
@@ -24,9 +27,11 @@ import (
 	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailcmd"
 	"github.com/HouzuoGuo/laitos/daemon/snmpd"
 	"github.com/HouzuoGuo/laitos/daemon/sockd"
+	"github.com/HouzuoGuo/laitos/daemon/sshd"
 	"github.com/HouzuoGuo/laitos/daemon/telegrambot"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/platform"
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
@@ -65,14 +70,27 @@ type StandardFilters struct {
 
 	// For command execution result
 	NotifyViaEmail toolbox.NotifyViaEmail `json:"NotifyViaEmail"`
+	NotifyViaSMS   toolbox.NotifyViaSMS   `json:"NotifyViaSMS"`
 	LintText       toolbox.LintText       `json:"LintText"`
+
+	// Locale determines the language of canned responses and phonetic spelling, it defaults to English ("en").
+	Locale string `json:"Locale"`
 }
 
 // Configure path to HTTP handlers and handler themselves.
 type HTTPHandlers struct {
 	AppCommandEndpoint              string                          `json:"AppCommandEndpoint"`
+	AppCommandEndpointConfig        handler.HandleAppCommand        `json:"AppCommandEndpointConfig"`
+	BlockPageEndpoint               string                          `json:"BlockPageEndpoint"`
+	CalendarContactsEndpoint        string                          `json:"CalendarContactsEndpoint"`
+	CalendarContactsEndpointConfig  handler.HandleCalendarContacts  `json:"CalendarContactsEndpointConfig"`
 	CommandFormEndpoint             string                          `json:"CommandFormEndpoint"`
+	CommandFormEndpointConfig       handler.HandleCommandForm       `json:"CommandFormEndpointConfig"`
+	ConnectionTrackerEndpoint       string                          `json:"ConnectionTrackerEndpoint"`
+	DNSOverHTTPSEndpoint            string                          `json:"DNSOverHTTPSEndpoint"`
+	DNSOverHTTPSEndpointConfig      handler.HandleDNSOverHTTPS      `json:"DNSOverHTTPSEndpointConfig"`
 	FileUploadEndpoint              string                          `json:"FileUploadEndpoint"`
+	FileUploadEndpointConfig        handler.HandleFileUpload        `json:"FileUploadEndpointConfig"`
 	GitlabBrowserEndpoint           string                          `json:"GitlabBrowserEndpoint"`
 	GitlabBrowserEndpointConfig     handler.HandleGitlabBrowser     `json:"GitlabBrowserEndpointConfig"`
 	IndexEndpointConfig             handler.HandleHTMLDocument      `json:"IndexEndpointConfig"`
@@ -81,7 +99,12 @@ type HTTPHandlers struct {
 	LatestRequestsInspectorEndpoint string                          `json:"LatestRequestsInspectorEndpoint"`
 	MailMeEndpoint                  string                          `json:"MailMeEndpoint"`
 	MailMeEndpointConfig            handler.HandleMailMe            `json:"MailMeEndpointConfig"`
+	MailQuarantineEndpoint          string                          `json:"MailQuarantineEndpoint"`
+	MarkdownEndpoint                string                          `json:"MarkdownEndpoint"`
+	MarkdownEndpointConfig          handler.HandleMarkdownDocument  `json:"MarkdownEndpointConfig"`
 	MessageBankEndpoint             string                          `json:"MessageBankEndpoint"`
+	MessageBankEndpointConfig       handler.HandleMessageBank       `json:"MessageBankEndpointConfig"`
+	MTASTSPolicyConfig              handler.HandleMTASTSPolicy      `json:"MTASTSPolicyConfig"`
 	MicrosoftBotEndpoint1           string                          `json:"MicrosoftBotEndpoint1"`
 	MicrosoftBotEndpoint2           string                          `json:"MicrosoftBotEndpoint2"`
 	MicrosoftBotEndpoint3           string                          `json:"MicrosoftBotEndpoint3"`
@@ -93,14 +116,21 @@ type HTTPHandlers struct {
 	RecurringCommandsEndpoint       string                          `json:"RecurringCommandsEndpoint"`
 	RecurringCommandsEndpointConfig handler.HandleRecurringCommands `json:"RecurringCommandsEndpointConfig"`
 	ReportsRetrievalEndpoint        string                          `json:"ReportsRetrievalEndpoint"`
+	ReverseProxyConfig              handler.HandleReverseProxy      `json:"ReverseProxyConfig"`
 	RequestInspectorEndpoint        string                          `json:"RequestInspectorEndpoint"`
+	SpeechAudioEndpoint             string                          `json:"SpeechAudioEndpoint"`
+	SpeechAudioEndpointConfig       handler.HandleSpeechAudio       `json:"SpeechAudioEndpointConfig"`
+	TCPOverHTTPSEndpoint            string                          `json:"TCPOverHTTPSEndpoint"`
 	LoraWANWebhookEndpoint          string                          `json:"LoraWANWebhookEndpoint"`
+	OwnTracksEndpoint               string                          `json:"OwnTracksEndpoint"`
 	TwilioCallEndpoint              string                          `json:"TwilioCallEndpoint"`
 	TwilioCallEndpointConfig        handler.HandleTwilioCallHook    `json:"TwilioCallEndpointConfig"`
 	TwilioSMSEndpoint               string                          `json:"TwilioSMSEndpoint"`
+	TwilioSMSEndpointConfig         handler.HandleTwilioSMSHook     `json:"TwilioSMSEndpointConfig"`
 	VirtualMachineEndpoint          string                          `json:"VirtualMachineEndpoint"`
 	VirtualMachineEndpointConfig    handler.HandleVirtualMachine    `json:"VirtualMachineEndpointConfig"`
 	WebProxyEndpoint                string                          `json:"WebProxyEndpoint"`
+	WebProxyEndpointConfig          handler.HandleWebProxy          `json:"WebProxyEndpointConfig"`
 }
 
 // AWSIntegration contains configuration properties for global behaviours (e.g. logger) of laitos program to integrate with AWS
@@ -117,6 +147,17 @@ type AWSIntegration struct {
 	ForwardMessageProcessorReportsToSNSTopicARN string `json:"ForwardMessageProcessorReportsToSNSTopicARN"`
 }
 
+/*
+DataRetention configures how long the program keeps the data that may carry personal information of its users in memory,
+such as the latest HTTP requests, message bank, store&forward reports, and log buffers.
+*/
+type DataRetention struct {
+	// MaxAgeSec is a map of data store name and the maximum age (in seconds) of data kept in the store.
+	MaxAgeSec map[string]int `json:"MaxAgeSec"`
+	// IntervalSec is the interval at which expired data are removed.
+	IntervalSec int `json:"IntervalSec"`
+}
+
 // Config is an aggregated structure of configuration properties that include daemon settings, mail settings, cloud integration
 // settings, app settings, and so on.
 // The entry point of laitos program deserialises this structure from a (often) hand-crafted configuration file written in JSON.
@@ -153,10 +194,15 @@ type Config struct {
 	PlainSocketDaemon  *plainsocket.Daemon `json:"PlainSocketDaemon"`  // Plain text protocol TCP and UDP daemon configuration
 	PlainSocketFilters StandardFilters     `json:"PlainSocketFilters"` // Plain text daemon filter configuration
 
+	ConsoleFilters StandardFilters `json:"ConsoleFilters"` // ConsoleFilters configure command processor of the app command console on terminal
+
 	SockDaemon *sockd.Daemon `json:"SockDaemon"` // Intentionally undocumented
 
 	SNMPDaemon *snmpd.Daemon `json:"SNMPDaemon"` // SNMPDaemon configuration and instance
 
+	SSHDaemon   *sshd.Daemon    `json:"SSHDaemon"`   // SSH server daemon configuration, it offers app command shell and SFTP file transfer
+	SSHDFilters StandardFilters `json:"SSHDFilters"` // SSH server daemon command processor configuration
+
 	SimpleIPSvcDaemon *simpleipsvcd.Daemon `json:"SimpleIPSvcDaemon"` // SimpleIPSvcDaemon is the simple TCP/UDP service daemon configuration and instance
 
 	TelegramBot     *telegrambot.Daemon `json:"TelegramBot"`     // Telegram bot configuration
@@ -168,12 +214,42 @@ type Config struct {
 	// HTTPProxyDaemon offers an HTTP proxy capable of handling both HTTP and HTTPS destinations.
 	HTTPProxyDaemon *httpproxy.Daemon `json:"HTTPProxyDaemon"`
 
-	SupervisorNotificationRecipients []string `json:"SupervisorNotificationRecipients"` // Email addresses of supervisor notification recipients
+	SupervisorNotificationRecipients   []string `json:"SupervisorNotificationRecipients"`   // Email addresses of supervisor notification recipients
+	SupervisorNotificationPhoneNumbers []string `json:"SupervisorNotificationPhoneNumbers"` // Phone numbers that receive supervisor notification calls
+	// SupervisorShedPolicy customises the order in which the supervisor sheds daemons and program flags after repeated crashes.
+	SupervisorShedPolicy ShedPolicy `json:"SupervisorShedPolicy"`
 
 	// AWSIntegration are settings for integrating with various AWS services, such as S3 and SQS.
 	AWSIntegration AWSIntegration `json:"AWSIntegration"`
 
-	logger                *lalog.Logger // logger handles log output from configuration serialisation and initialisation routines.
+	// DataRetention configures the maximum age of data kept in memory, the ".purge" app wipes data on demand regardless.
+	DataRetention DataRetention `json:"DataRetention"`
+
+	// HelperProcessLimits are the resource limits of external processes spawned by laitos, such as shell commands.
+	HelperProcessLimits platform.HelperProcessLimits `json:"HelperProcessLimits"`
+
+	// TLS are the TLS settings shared by the web and mail servers, as well as the outgoing HTTP and mail clients.
+	TLS misc.TLSSettings `json:"TLS"`
+
+	/*
+		FeatureFlags turn the program-global feature flags (e.g. "PrometheusIntegration") on or off. The flags absent from
+		the configuration keep their values from the command line.
+	*/
+	FeatureFlags map[string]bool `json:"FeatureFlags"`
+
+	// SharedRateLimitRedis keeps the per-IP rate limit counters in a Redis server shared by all program instances.
+	SharedRateLimitRedis *inet.RedisClient `json:"SharedRateLimitRedis"`
+
+	// Profiles are the named configuration profiles, each selects the daemons to start and overrides some of the properties above.
+	Profiles map[string]ConfigProfile `json:"Profiles"`
+
+	profileName string   // profileName is the name of the profile applied to this configuration, it is empty if none.
+	daemonNames []string // daemonNames are the names of the daemons to start, they are empty if unknown.
+
+	logger *lalog.Logger // logger handles log output from configuration serialisation and initialisation routines.
+	// collectInitErrors makes the daemon getters keep the initialisation errors in initErrors rather than aborting the program.
+	collectInitErrors     bool
+	initErrors            []error
 	maintenanceInit       *sync.Once
 	dnsDaemonInit         *sync.Once
 	snmpDaemonInit        *sync.Once
@@ -184,6 +260,7 @@ type Config struct {
 	phoneHomeDaemonInit   *sync.Once
 	plainSocketDaemonInit *sync.Once
 	sockDaemonInit        *sync.Once
+	sshDaemonInit         *sync.Once
 	telegramBotInit       *sync.Once
 	autoUnlockInit        *sync.Once
 	passwdrpcDaemonInit   *sync.Once
@@ -196,11 +273,15 @@ func (config *Config) Initialise() error {
 	if config.Features == nil {
 		config.Features = &toolbox.FeatureSet{}
 	}
+	// The feature flags are configured first, they determine whether to integrate with AWS and prometheus.
+	if err := misc.FeatureFlags.Configure(config.FeatureFlags); err != nil {
+		return err
+	}
 
 	// Initialise the optional AWS kinesis firehose client for a stream to get a copy of every report received by message processor
 	var firehoseClient *awsinteg.KinesisHoseClient
 	var err error
-	if streamName := config.AWSIntegration.ForwardMessageProcessorReportsToFirehoseStreamName; streamName != "" && misc.EnableAWSIntegration {
+	if streamName := config.AWSIntegration.ForwardMessageProcessorReportsToFirehoseStreamName; streamName != "" && misc.AWSIntegration.IsEnabled() {
 		config.logger.Info("", nil, "initialising kinesis firehose client for stream \"%s\"", streamName)
 		firehoseClient, err = awsinteg.NewKinesisHoseClient()
 		if err != nil {
@@ -209,7 +290,7 @@ func (config *Config) Initialise() error {
 	}
 	// Initialise the optional AWS SNS client for a topic to get a copy of every report received by message processor
 	var snsClient *awsinteg.SNSClient
-	if arn := config.AWSIntegration.ForwardMessageProcessorReportsToSNSTopicARN; arn != "" && misc.EnableAWSIntegration {
+	if arn := config.AWSIntegration.ForwardMessageProcessorReportsToSNSTopicARN; arn != "" && misc.AWSIntegration.IsEnabled() {
 		config.logger.Info("", nil, "initialising SNS client for topic ARN \"%s\"", arn)
 		snsClient, err = awsinteg.NewSNSClient()
 		if err != nil {
@@ -224,14 +305,16 @@ func (config *Config) Initialise() error {
 	if len(config.MessageProcessorFilters.PINAndShortcuts.Passwords) != 0 {
 		messageProcessorCommandProcessor := &toolbox.CommandProcessor{
 			Features: config.Features,
+			Locale:   config.MessageProcessorFilters.Locale,
 			CommandFilters: []toolbox.CommandFilter{
 				&config.MessageProcessorFilters.PINAndShortcuts,
 				&config.MessageProcessorFilters.TranslateSequences,
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.MessageProcessorFilters.LintText,
-				&toolbox.SayEmptyOutput{},
+				&toolbox.SayEmptyOutput{Locale: config.MessageProcessorFilters.Locale},
 				&config.MessageProcessorFilters.NotifyViaEmail,
+				&config.MessageProcessorFilters.NotifyViaSMS,
 			},
 		}
 		config.Features.MessageProcessor = toolbox.MessageProcessor{
@@ -241,6 +324,10 @@ func (config *Config) Initialise() error {
 			KinesisFirehoseStreamName:       config.AWSIntegration.ForwardMessageProcessorReportsToFirehoseStreamName,
 			ForwardReportsToSNS:             snsClient,
 			SNSTopicARN:                     config.AWSIntegration.ForwardMessageProcessorReportsToSNSTopicARN,
+			// Retain the settings that come from the configuration file
+			MaxReportsPerHostName: config.Features.MessageProcessor.MaxReportsPerHostName,
+			SubjectKeys:           config.Features.MessageProcessor.SubjectKeys,
+			PersistentStore:       config.Features.MessageProcessor.PersistentStore,
 		}
 	}
 	/*
@@ -289,6 +376,10 @@ func (config *Config) Initialise() error {
 	if config.SockDaemon == nil {
 		config.SockDaemon = &sockd.Daemon{}
 	}
+	config.sshDaemonInit = new(sync.Once)
+	if config.SSHDaemon == nil {
+		config.SSHDaemon = &sshd.Daemon{}
+	}
 	config.telegramBotInit = new(sync.Once)
 	if config.TelegramBot == nil {
 		config.TelegramBot = &telegrambot.Daemon{}
@@ -312,12 +403,38 @@ func (config *Config) Initialise() error {
 	config.MailFilters.NotifyViaEmail.MailClient = config.MailClient
 	config.PhoneHomeFilters.NotifyViaEmail.MailClient = config.MailClient
 	config.PlainSocketFilters.NotifyViaEmail.MailClient = config.MailClient
+	config.SSHDFilters.NotifyViaEmail.MailClient = config.MailClient
 	config.TelegramFilters.NotifyViaEmail.MailClient = config.MailClient
+	// SMS notification filters share the Twilio account of the Twilio feature
+	config.MessageProcessorFilters.NotifyViaSMS.Twilio = &config.Features.Twilio
+	config.DNSFilters.NotifyViaSMS.Twilio = &config.Features.Twilio
+	config.HTTPFilters.NotifyViaSMS.Twilio = &config.Features.Twilio
+	config.MailFilters.NotifyViaSMS.Twilio = &config.Features.Twilio
+	config.PhoneHomeFilters.NotifyViaSMS.Twilio = &config.Features.Twilio
+	config.PlainSocketFilters.NotifyViaSMS.Twilio = &config.Features.Twilio
+	config.SSHDFilters.NotifyViaSMS.Twilio = &config.Features.Twilio
+	config.TelegramFilters.NotifyViaSMS.Twilio = &config.Features.Twilio
 	// SendMail feature also shares the common mail client
 	config.Features.SendMail.MailClient = config.MailClient
 	if err := config.Features.Initialise(); err != nil {
 		return err
 	}
+	if err := misc.DefaultDataRetention.SetMaxAgeSec(config.DataRetention.MaxAgeSec); err != nil {
+		return err
+	}
+	if err := platform.DefaultHelperProcesses.SetLimits(config.HelperProcessLimits); err != nil {
+		return err
+	}
+	if err := misc.DefaultTLS.SetSettings(config.TLS); err != nil {
+		return err
+	}
+	if config.SharedRateLimitRedis != nil {
+		if err := config.SharedRateLimitRedis.Initialise(); err != nil {
+			return err
+		}
+		// Daemons are initialised afterwards, their rate limits will use the shared state.
+		lalog.SetSharedRateLimitState(config.SharedRateLimitRedis)
+	}
 	// Password RPC daemon shares the embedded gRPC service with the network bound file encryption app
 	config.PasswordRPCDaemon.PasswordRegister = config.Features.NetBoundFileEncryption.PasswordRegister
 
@@ -330,36 +447,110 @@ DeserialiseFromJSON deserialised configuration of all daemons and toolbox featur
 itself for daemon operations.
 */
 func (config *Config) DeserialiseFromJSON(in []byte) error {
+	return config.DeserialiseProfileFromJSON(in, "")
+}
+
+/*
+DeserialiseProfileFromJSON deserialises the configuration from JSON input with the named profile applied on top of it, and
+then prepares itself for daemon operations. An empty profile name deserialises the base configuration.
+*/
+func (config *Config) DeserialiseProfileFromJSON(in []byte, profileName string) error {
 	config.logger = &lalog.Logger{ComponentName: "config"}
+	// Read the secrets referred to by file paths and systemd credential names
+	in, err := ResolveSecretReferences(in)
+	if err != nil {
+		return err
+	}
+	if in, _, err = ApplyConfigProfile(in, profileName); err != nil {
+		return err
+	}
 	if err := json.Unmarshal(in, config); err != nil {
 		return err
 	}
+	if _, exists := config.Profiles[misc.BaseConfigProfile]; exists {
+		return fmt.Errorf("Config.DeserialiseProfileFromJSON: \"%s\" is reserved for the base configuration and cannot be a profile name", misc.BaseConfigProfile)
+	}
+	for name, profile := range config.Profiles {
+		if err := profile.Validate(); err != nil {
+			return fmt.Errorf("Config.DeserialiseProfileFromJSON: profile \"%s\" - %w", name, err)
+		}
+	}
+	if profileName != misc.BaseConfigProfile {
+		config.profileName = profileName
+	}
+	if profileName != "" {
+		config.logger.Info("", nil, "applied configuration profile \"%s\"", profileName)
+	}
 	if err := config.Initialise(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// GetProfileName returns the name of the configuration profile in effect, or misc.BaseConfigProfile if none is.
+func (config *Config) GetProfileName() string {
+	if config.profileName == "" {
+		return misc.BaseConfigProfile
+	}
+	return config.profileName
+}
+
+// GetProfileDaemons returns the names of daemons selected by the configuration profile in effect, or nil if there is none.
+func (config *Config) GetProfileDaemons() []string {
+	return config.Profiles[config.profileName].Daemons
+}
+
+// SetDaemonNames tells the configuration the names of the daemons to start, call it before constructing any daemon.
+func (config *Config) SetDaemonNames(daemonNames []string) {
+	config.daemonNames = append([]string{}, daemonNames...)
+}
+
+// daemonInitFailed aborts the program due to the daemon initialisation error, unless the errors are being collected.
+func (config *Config) daemonInitFailed(err error) {
+	if config.collectInitErrors {
+		config.initErrors = append(config.initErrors, err)
+		return
+	}
+	config.logger.Abort("", err, "the daemon failed to initialise")
+}
+
 // Construct a DNS daemon from configuration and return.
 func (config *Config) GetDNSD() *dnsd.Daemon {
 	config.dnsDaemonInit.Do(func() {
 		// Assemble DNS command prcessor from features and filters
 		config.DNSDaemon.Processor = &toolbox.CommandProcessor{
 			Features: config.Features,
+			Locale:   config.DNSFilters.Locale,
 			CommandFilters: []toolbox.CommandFilter{
 				&config.DNSFilters.PINAndShortcuts,
 				&config.DNSFilters.TranslateSequences,
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.DNSFilters.LintText,
-				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&toolbox.SayEmptyOutput{Locale: config.DNSFilters.Locale}, // this is mandatory but not configured by user's config file
 				&config.DNSFilters.NotifyViaEmail,
+				&config.DNSFilters.NotifyViaSMS,
 			},
 		}
+		// Announce the MTA-STS policy and TLS-RPT addresses of the mail domains
+		if config.HTTPHandlers.MTASTSPolicyConfig.IsConfigured() {
+			if config.DNSDaemon.CustomRecords == nil {
+				config.DNSDaemon.CustomRecords = make(map[string]*dnsd.CustomRecord)
+			}
+			for _, domain := range config.MailDaemon.MyDomains {
+				for name, value := range config.HTTPHandlers.MTASTSPolicyConfig.DNSRecords(domain) {
+					if _, exists := config.DNSDaemon.CustomRecords[name]; !exists {
+						config.DNSDaemon.CustomRecords[name] = &dnsd.CustomRecord{TXT: dnsd.TextRecord{Entries: []string{value}}}
+					}
+				}
+			}
+		}
 		if err := config.DNSDaemon.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
+		// The app command temporarily allows the names black listed by this daemon
+		config.Features.DNSAllow.SetBlacklist(config.DNSDaemon)
 	})
 	return config.DNSDaemon
 }
@@ -368,7 +559,7 @@ func (config *Config) GetDNSD() *dnsd.Daemon {
 func (config *Config) GetSNMPD() *snmpd.Daemon {
 	config.snmpDaemonInit.Do(func() {
 		if err := config.SNMPDaemon.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
@@ -379,7 +570,7 @@ func (config *Config) GetSNMPD() *snmpd.Daemon {
 func (config *Config) GetSimpleIPSvcD() *simpleipsvcd.Daemon {
 	config.simpleIPSvcDaemonInit.Do(func() {
 		if err := config.SimpleIPSvcDaemon.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
@@ -393,8 +584,15 @@ func (config *Config) GetMaintenance() *maintenance.Daemon {
 		config.Maintenance.MailClient = config.MailClient
 		config.Maintenance.MailCommandRunnerSelfTest = config.GetMailCommandRunner()
 		config.Maintenance.HttpHandlersSelfTest = config.GetHTTPD().HandlerCollection
+		config.Maintenance.TakeConfigSnapshot = config.GetConfigSnapshot
+		// The Telegram drill uses the token of the bot by default
+		for i, probe := range config.Maintenance.DrillProbes {
+			if probe.Channel == maintenance.DrillChannelTelegram && probe.AuthorizationToken == "" && config.TelegramBot != nil {
+				config.Maintenance.DrillProbes[i].AuthorizationToken = config.TelegramBot.AuthorizationToken
+			}
+		}
 		if err := config.Maintenance.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
@@ -407,18 +605,24 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 		// Assemble command processor from features and filters
 		config.HTTPDaemon.Processor = &toolbox.CommandProcessor{
 			Features: config.Features,
+			Locale:   config.HTTPFilters.Locale,
 			CommandFilters: []toolbox.CommandFilter{
 				&config.HTTPFilters.PINAndShortcuts,
 				&config.HTTPFilters.TranslateSequences,
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.HTTPFilters.LintText,
-				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&toolbox.SayEmptyOutput{Locale: config.HTTPFilters.Locale}, // this is mandatory but not configured by user's config file
 				&config.HTTPFilters.NotifyViaEmail,
+				&config.HTTPFilters.NotifyViaSMS,
 			},
 		}
 		// Make handler factories
 		handlers := httpd.HandlerCollection{}
+		// The reverse proxy serves its path prefixes unless they are taken by the other web services
+		for _, location := range config.HTTPHandlers.ReverseProxyConfig.Locations() {
+			handlers[location] = &config.HTTPHandlers.ReverseProxyConfig
+		}
 		if config.HTTPHandlers.InformationEndpoint != "" {
 			handlers[config.HTTPHandlers.InformationEndpoint] = &handler.HandleSystemInfo{
 				FeaturesToCheck: config.Features,
@@ -439,17 +643,40 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 			vmHandler := config.HTTPHandlers.VirtualMachineEndpointConfig
 			screenshotEndpoint := "/vm-screenshot-" + hex.EncodeToString(randBytes)
 			handlers[screenshotEndpoint] = vmScreenshotHandler
-			// The VM control endpoint is given the screenshot endpoint location and instance
+			// The serial console endpoint
+			if _, err := rand.Read(randBytes); err != nil {
+				config.logger.Abort("", err, "failed to read random number")
+				return
+			}
+			vmSerialConsoleHandler := &handler.HandleVirtualMachineSerialConsole{}
+			serialConsoleEndpoint := "/vm-serial-console-" + hex.EncodeToString(randBytes)
+			handlers[serialConsoleEndpoint] = vmSerialConsoleHandler
+			// The VM control endpoint is given the screenshot and serial console endpoint locations and instances
 			vmHandler.ScreenshotEndpoint = screenshotEndpoint
 			vmHandler.ScreenshotHandlerInstance = vmScreenshotHandler
+			vmHandler.SerialConsoleEndpoint = serialConsoleEndpoint
+			vmHandler.SerialConsoleHandlerInstance = vmSerialConsoleHandler
 			handlers[config.HTTPHandlers.VirtualMachineEndpoint] = &vmHandler
 		}
 
+		if config.HTTPHandlers.CalendarContactsEndpoint != "" {
+			hand := config.HTTPHandlers.CalendarContactsEndpointConfig
+			// The calendar and contacts collections are served underneath the endpoint, hence it always ends with a slash.
+			hand.Location = config.HTTPHandlers.CalendarContactsEndpoint
+			if !strings.HasSuffix(hand.Location, "/") {
+				hand.Location += "/"
+			}
+			handlers[hand.Location] = &hand
+		}
 		if config.HTTPHandlers.CommandFormEndpoint != "" {
-			handlers[config.HTTPHandlers.CommandFormEndpoint] = &handler.HandleCommandForm{}
+			hand := config.HTTPHandlers.CommandFormEndpointConfig
+			handlers[config.HTTPHandlers.CommandFormEndpoint] = &hand
 		}
 		if config.HTTPHandlers.FileUploadEndpoint != "" {
-			handlers[config.HTTPHandlers.FileUploadEndpoint] = &handler.HandleFileUpload{}
+			hand := config.HTTPHandlers.FileUploadEndpointConfig
+			handlers[config.HTTPHandlers.FileUploadEndpoint] = &hand
+			// The QR code app stores its pictures for download from the file upload endpoint
+			config.Features.QRCode.SetFileStorage(&hand)
 		}
 		if config.HTTPHandlers.GitlabBrowserEndpoint != "" {
 			config.HTTPHandlers.GitlabBrowserEndpointConfig.MailClient = config.MailClient
@@ -465,6 +692,15 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 			hand.MailClient = config.MailClient
 			handlers[config.HTTPHandlers.MailMeEndpoint] = &hand
 		}
+		if config.HTTPHandlers.MarkdownEndpoint != "" {
+			hand := config.HTTPHandlers.MarkdownEndpointConfig
+			// The documents are served underneath the endpoint, hence it always ends with a slash.
+			hand.Location = config.HTTPHandlers.MarkdownEndpoint
+			if !strings.HasSuffix(hand.Location, "/") {
+				hand.Location += "/"
+			}
+			handlers[hand.Location] = &hand
+		}
 		// I (howard) personally need three bots, hence this ugly repetition.
 		if config.HTTPHandlers.MicrosoftBotEndpoint1 != "" {
 			hand := config.HTTPHandlers.MicrosoftBotEndpointConfig1
@@ -478,20 +714,38 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 			hand := config.HTTPHandlers.MicrosoftBotEndpointConfig3
 			handlers[config.HTTPHandlers.MicrosoftBotEndpoint3] = &hand
 		}
+		if config.HTTPHandlers.MTASTSPolicyConfig.IsConfigured() {
+			handlers[handler.MTASTSPolicyLocation] = &config.HTTPHandlers.MTASTSPolicyConfig
+		}
 		if config.HTTPHandlers.RecurringCommandsEndpoint != "" {
 			handlers[config.HTTPHandlers.RecurringCommandsEndpoint] = &config.HTTPHandlers.RecurringCommandsEndpointConfig
 		}
 		if proxyEndpoint := config.HTTPHandlers.WebProxyEndpoint; proxyEndpoint != "" {
-			handlers[proxyEndpoint] = &handler.HandleWebProxy{OwnEndpoint: proxyEndpoint}
+			hand := config.HTTPHandlers.WebProxyEndpointConfig
+			hand.OwnEndpoint = proxyEndpoint
+			handlers[proxyEndpoint] = &hand
 		}
 		if endpoint := config.HTTPHandlers.LoraWANWebhookEndpoint; endpoint != "" {
 			handlers[endpoint] = &handler.HandleLoraWANWebhook{}
 		}
 		if config.HTTPHandlers.MessageBankEndpoint != "" {
-			handlers[config.HTTPHandlers.MessageBankEndpoint] = &handler.HandleMessageBank{}
+			hand := config.HTTPHandlers.MessageBankEndpointConfig
+			handlers[config.HTTPHandlers.MessageBankEndpoint] = &hand
+		}
+		if endpoint := config.HTTPHandlers.OwnTracksEndpoint; endpoint != "" {
+			handlers[endpoint] = &handler.HandleOwnTracks{}
+		}
+		// The speech audio handler also plays long command output to Twilio callers
+		var speechHandler *handler.HandleSpeechAudio
+		if config.HTTPHandlers.SpeechAudioEndpoint != "" {
+			hand := config.HTTPHandlers.SpeechAudioEndpointConfig
+			hand.Location = config.HTTPHandlers.SpeechAudioEndpoint
+			speechHandler = &hand
+			handlers[config.HTTPHandlers.SpeechAudioEndpoint] = speechHandler
 		}
 		if config.HTTPHandlers.TwilioSMSEndpoint != "" {
-			handlers[config.HTTPHandlers.TwilioSMSEndpoint] = &handler.HandleTwilioSMSHook{}
+			smsEndpointConfig := config.HTTPHandlers.TwilioSMSEndpointConfig
+			handlers[config.HTTPHandlers.TwilioSMSEndpoint] = &smsEndpointConfig
 		}
 		if config.HTTPHandlers.TwilioCallEndpoint != "" {
 			/*
@@ -511,10 +765,11 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 			callEndpointConfig.CallbackEndpoint = callbackEndpoint
 			handlers[config.HTTPHandlers.TwilioCallEndpoint] = &callEndpointConfig
 			// The callback handler will use the callback point that points to itself to carry on with phone conversation
-			handlers[callbackEndpoint] = &handler.HandleTwilioCallCallback{MyEndpoint: callbackEndpoint}
+			handlers[callbackEndpoint] = &handler.HandleTwilioCallCallback{MyEndpoint: callbackEndpoint, Speech: speechHandler}
 		}
 		if config.HTTPHandlers.AppCommandEndpoint != "" {
-			handlers[config.HTTPHandlers.AppCommandEndpoint] = &handler.HandleAppCommand{}
+			hand := config.HTTPHandlers.AppCommandEndpointConfig
+			handlers[config.HTTPHandlers.AppCommandEndpoint] = &hand
 		}
 		if config.HTTPHandlers.ReportsRetrievalEndpoint != "" {
 			handlers[config.HTTPHandlers.ReportsRetrievalEndpoint] = &handler.HandleReportsRetrieval{}
@@ -531,12 +786,43 @@ func (config *Config) GetHTTPD() *httpd.Daemon {
 		if config.HTTPHandlers.LatestRequestsInspectorEndpoint != "" {
 			handlers[config.HTTPHandlers.LatestRequestsInspectorEndpoint] = &handler.HandleLatestRequestsInspector{}
 		}
+		if config.HTTPHandlers.ConnectionTrackerEndpoint != "" {
+			handlers[config.HTTPHandlers.ConnectionTrackerEndpoint] = &handler.HandleConnectionTracker{}
+		}
+		// The certificate authority visits the plain HTTP server on port 80 for the HTTP-01 challenges of the HTTPS server
+		config.HTTPDaemon.ACME.PlainHTTPAvailable = !slices.Contains(config.daemonNames, HTTPDName) || slices.Contains(config.daemonNames, InsecureHTTPDName)
+		if config.HTTPDaemon.ACME.Challenge == httpd.ACMEChallengeDNS01 {
+			// The DNS daemon answers the DNS-01 challenges of the certificate authority
+			config.HTTPDaemon.ACME.DNSDaemon = config.GetDNSD()
+		}
+		if config.HTTPHandlers.BlockPageEndpoint != "" {
+			// The DNS daemon answers the queries of black listed names with the address of this web server
+			handlers[config.HTTPHandlers.BlockPageEndpoint] = &handler.HandleBlockPage{DNSDaemon: config.GetDNSD()}
+		}
+		if config.HTTPHandlers.MailQuarantineEndpoint != "" {
+			// The SMTP daemon keeps the mails carrying blocked attachments in quarantine
+			handlers[config.HTTPHandlers.MailQuarantineEndpoint] = &handler.HandleMailQuarantine{MailDaemon: config.GetMailDaemon()}
+		}
+		if config.HTTPHandlers.DNSOverHTTPSEndpoint != "" {
+			// The DNS daemon answers the queries received over HTTPS in the same way as those over UDP and TCP
+			hand := config.HTTPHandlers.DNSOverHTTPSEndpointConfig
+			hand.DNSDaemon = config.GetDNSD()
+			handlers[config.HTTPHandlers.DNSOverHTTPSEndpoint] = &hand
+		}
+		if config.HTTPHandlers.TCPOverHTTPSEndpoint != "" {
+			hand := &handler.HandleTCPOverHTTPS{}
+			// The TCP-over-DNS proxy is started by the DNS daemon.
+			if tcpProxy := config.DNSDaemon.TCPProxy; tcpProxy != nil && tcpProxy.RequestOTPSecret != "" {
+				hand.TCPProxy = tcpProxy
+			}
+			handlers[config.HTTPHandlers.TCPOverHTTPSEndpoint] = hand
+		}
 		config.HTTPDaemon.HandlerCollection = handlers
 		stripURLPrefixFromRequest := os.Getenv(EnvironmentStripURLPrefixFromRequest)
 		stripURLPrefixFromResponse := os.Getenv(EnvironmentStripURLPrefixFromResponse)
 		config.logger.Info("", nil, "will strip \"%s\" from requested URLs and strip \"%s\" from HTML response", stripURLPrefixFromRequest, stripURLPrefixFromResponse)
 		if err := config.HTTPDaemon.Initialise(stripURLPrefixFromRequest, stripURLPrefixFromResponse); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
@@ -554,14 +840,16 @@ func (config *Config) GetMailCommandRunner() *mailcmd.CommandRunner {
 		// Assemble command processor from features and filters
 		config.MailCommandRunner.Processor = &toolbox.CommandProcessor{
 			Features: config.Features,
+			Locale:   config.MailFilters.Locale,
 			CommandFilters: []toolbox.CommandFilter{
 				&config.MailFilters.PINAndShortcuts,
 				&config.MailFilters.TranslateSequences,
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.MailFilters.LintText,
-				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&toolbox.SayEmptyOutput{Locale: config.MailFilters.Locale}, // this is mandatory but not configured by user's config file
 				&config.MailFilters.NotifyViaEmail,
+				&config.MailFilters.NotifyViaSMS,
 			},
 		}
 		config.MailCommandRunner.ReplyMailClient = config.MailClient
@@ -578,7 +866,7 @@ func (config *Config) GetMailDaemon() *smtpd.Daemon {
 		config.MailDaemon.CommandRunner = config.GetMailCommandRunner()
 		config.MailDaemon.ForwardMailClient = config.MailClient
 		if err := config.MailDaemon.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
@@ -590,19 +878,21 @@ func (config *Config) GetPhoneHomeDaemon() *phonehome.Daemon {
 	config.phoneHomeDaemonInit.Do(func() {
 		config.PhoneHomeDaemon.Processor = &toolbox.CommandProcessor{
 			Features: config.Features,
+			Locale:   config.PhoneHomeFilters.Locale,
 			CommandFilters: []toolbox.CommandFilter{
 				&config.PhoneHomeFilters.PINAndShortcuts,
 				&config.PhoneHomeFilters.TranslateSequences,
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.PhoneHomeFilters.LintText,
-				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&toolbox.SayEmptyOutput{Locale: config.PhoneHomeFilters.Locale}, // this is mandatory but not configured by user's config file
 				&config.PhoneHomeFilters.NotifyViaEmail,
+				&config.PhoneHomeFilters.NotifyViaSMS,
 			},
 		}
 		// Call initialise so that daemon is ready to start
 		if err := config.PhoneHomeDaemon.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
@@ -618,31 +908,78 @@ func (config *Config) GetPlainSocketDaemon() *plainsocket.Daemon {
 		// Assemble command processor from features and filters
 		config.PlainSocketDaemon.Processor = &toolbox.CommandProcessor{
 			Features: config.Features,
+			Locale:   config.PlainSocketFilters.Locale,
 			CommandFilters: []toolbox.CommandFilter{
 				&config.PlainSocketFilters.PINAndShortcuts,
 				&config.PlainSocketFilters.TranslateSequences,
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.PlainSocketFilters.LintText,
-				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&toolbox.SayEmptyOutput{Locale: config.PlainSocketFilters.Locale}, // this is mandatory but not configured by user's config file
 				&config.PlainSocketFilters.NotifyViaEmail,
+				&config.PlainSocketFilters.NotifyViaSMS,
 			},
 		}
 		// Call initialise so that daemon is ready to start
 		if err := config.PlainSocketDaemon.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
 	return config.PlainSocketDaemon
 }
 
+// GetSSHD constructs an SSH server daemon and returns it.
+func (config *Config) GetSSHD() *sshd.Daemon {
+	config.sshDaemonInit.Do(func() {
+		// Assemble command processor from features and filters
+		config.SSHDaemon.Processor = &toolbox.CommandProcessor{
+			Features: config.Features,
+			Locale:   config.SSHDFilters.Locale,
+			CommandFilters: []toolbox.CommandFilter{
+				&config.SSHDFilters.PINAndShortcuts,
+				&config.SSHDFilters.TranslateSequences,
+			},
+			ResultFilters: []toolbox.ResultFilter{
+				&config.SSHDFilters.LintText,
+				&toolbox.SayEmptyOutput{Locale: config.SSHDFilters.Locale}, // this is mandatory but not configured by user's config file
+				&config.SSHDFilters.NotifyViaEmail,
+				&config.SSHDFilters.NotifyViaSMS,
+			},
+		}
+		// Call initialise so that daemon is ready to start
+		if err := config.SSHDaemon.Initialise(); err != nil {
+			config.daemonInitFailed(err)
+			return
+		}
+	})
+	return config.SSHDaemon
+}
+
+// GetConsoleCommandProcessor returns the command processor of the app command console on terminal.
+func (config *Config) GetConsoleCommandProcessor() *toolbox.CommandProcessor {
+	return &toolbox.CommandProcessor{
+		Features: config.Features,
+		Locale:   config.ConsoleFilters.Locale,
+		CommandFilters: []toolbox.CommandFilter{
+			&config.ConsoleFilters.PINAndShortcuts,
+			&config.ConsoleFilters.TranslateSequences,
+		},
+		ResultFilters: []toolbox.ResultFilter{
+			&config.ConsoleFilters.LintText,
+			&toolbox.SayEmptyOutput{Locale: config.ConsoleFilters.Locale}, // this is mandatory but not configured by user's config file
+			&config.ConsoleFilters.NotifyViaEmail,
+			&config.ConsoleFilters.NotifyViaSMS,
+		},
+	}
+}
+
 // Intentionally undocumented
 func (config *Config) GetSockDaemon() *sockd.Daemon {
 	config.sockDaemonInit.Do(func() {
 		config.SockDaemon.DNSDaemon = config.GetDNSD()
 		if err := config.SockDaemon.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
@@ -655,18 +992,20 @@ func (config *Config) GetTelegramBot() *telegrambot.Daemon {
 		// Assemble telegram bot from features and filters
 		config.TelegramBot.Processor = &toolbox.CommandProcessor{
 			Features: config.Features,
+			Locale:   config.TelegramFilters.Locale,
 			CommandFilters: []toolbox.CommandFilter{
 				&config.TelegramFilters.PINAndShortcuts,
 				&config.TelegramFilters.TranslateSequences,
 			},
 			ResultFilters: []toolbox.ResultFilter{
 				&config.TelegramFilters.LintText,
-				&toolbox.SayEmptyOutput{}, // this is mandatory but not configured by user's config file
+				&toolbox.SayEmptyOutput{Locale: config.TelegramFilters.Locale}, // this is mandatory but not configured by user's config file
 				&config.TelegramFilters.NotifyViaEmail,
+				&config.TelegramFilters.NotifyViaSMS,
 			},
 		}
 		if err := config.TelegramBot.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
@@ -677,7 +1016,7 @@ func (config *Config) GetTelegramBot() *telegrambot.Daemon {
 func (config *Config) GetAutoUnlock() *autounlock.Daemon {
 	config.autoUnlockInit.Do(func() {
 		if err := config.AutoUnlock.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
@@ -689,7 +1028,7 @@ func (config *Config) GetAutoUnlock() *autounlock.Daemon {
 func (config *Config) GetPasswdRPCDaemon() *passwdrpc.Daemon {
 	config.passwdrpcDaemonInit.Do(func() {
 		if err := config.PasswordRPCDaemon.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
@@ -703,7 +1042,7 @@ func (config *Config) GetHTTPProxyDaemon() *httpproxy.Daemon {
 		config.HTTPProxyDaemon.CommandProcessor.Features = config.Features
 		config.HTTPProxyDaemon.DNSDaemon = config.GetDNSD()
 		if err := config.HTTPProxyDaemon.Initialise(); err != nil {
-			config.logger.Abort("", err, "the daemon failed to initialise")
+			config.daemonInitFailed(err)
 			return
 		}
 	})
@@ -0,0 +1,107 @@
+package launcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// ProfileFlagName is the CLI string flag of the configuration profile to apply on top of the base configuration.
+	ProfileFlagName = "profile"
+	// ProfilesConfigKey is the top-level configuration property that defines the named configuration profiles.
+	ProfilesConfigKey = "Profiles"
+)
+
+/*
+ConfigProfile is a named variation of the program configuration (e.g. "home", "travel", and "lockdown"). A profile selects
+the daemons to start and overrides some of the configuration properties, so that a single configuration file serves
+several occasions.
+*/
+type ConfigProfile struct {
+	// Daemons are the names of the daemons to start, they are used when the command line does not specify -daemons.
+	Daemons []string `json:"Daemons"`
+	/*
+		Config are the top-level configuration properties that override those of the base configuration. A JSON object
+		is merged into its counterpart of the base configuration property by property, any other value replaces its
+		counterpart entirely.
+	*/
+	Config map[string]interface{} `json:"Config"`
+}
+
+// Validate returns an error if the profile refers to an unknown daemon or attempts to override the profiles.
+func (profile ConfigProfile) Validate() error {
+	for _, name := range profile.Daemons {
+		if !slices.Contains(AllDaemons, name) {
+			return fmt.Errorf("unrecognised daemon name \"%s\"", name)
+		}
+	}
+	if _, exists := profile.Config[ProfilesConfigKey]; exists {
+		return fmt.Errorf("the profile must not override %s", ProfilesConfigKey)
+	}
+	return nil
+}
+
+/*
+ApplyConfigProfile merges the configuration properties of the named profile into the base configuration (JSON), and returns
+the merged configuration along with the daemons selected by the profile. An empty profile name or misc.BaseConfigProfile
+returns the base configuration as-is.
+*/
+func ApplyConfigProfile(configJSON []byte, profileName string) (merged []byte, daemonNames []string, err error) {
+	if profileName == "" || profileName == misc.BaseConfigProfile {
+		return configJSON, nil, nil
+	}
+	var props map[string]interface{}
+	if err := json.Unmarshal(configJSON, &props); err != nil {
+		return nil, nil, fmt.Errorf("ApplyConfigProfile: failed to deserialise the configuration - %w", err)
+	}
+	var profiles map[string]ConfigProfile
+	if profilesJSON, exists := props[ProfilesConfigKey]; exists {
+		// Take a detour through JSON to decode the profiles into their structure
+		serialised, err := json.Marshal(profilesJSON)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ApplyConfigProfile: %w", err)
+		}
+		if err := json.Unmarshal(serialised, &profiles); err != nil {
+			return nil, nil, fmt.Errorf("ApplyConfigProfile: failed to deserialise %s - %w", ProfilesConfigKey, err)
+		}
+	}
+	profile, exists := profiles[profileName]
+	if !exists {
+		return nil, nil, fmt.Errorf("ApplyConfigProfile: profile \"%s\" is not among the configured profiles %v", profileName, GetConfigProfileNames(profiles))
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("ApplyConfigProfile: profile \"%s\" - %w", profileName, err)
+	}
+	mergeConfigProps(props, profile.Config)
+	if merged, err = json.Marshal(props); err != nil {
+		return nil, nil, fmt.Errorf("ApplyConfigProfile: %w", err)
+	}
+	return merged, profile.Daemons, nil
+}
+
+// mergeConfigProps merges the override properties into the base properties, JSON objects are merged recursively.
+func mergeConfigProps(base, override map[string]interface{}) {
+	for key, overrideValue := range override {
+		baseObj, baseIsObj := base[key].(map[string]interface{})
+		overrideObj, overrideIsObj := overrideValue.(map[string]interface{})
+		if baseIsObj && overrideIsObj {
+			mergeConfigProps(baseObj, overrideObj)
+		} else {
+			base[key] = overrideValue
+		}
+	}
+}
+
+// GetConfigProfileNames returns the names of the profiles in sorted order.
+func GetConfigProfileNames(profiles map[string]ConfigProfile) []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,81 @@
+package launcher
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplyConfigProfile(t *testing.T) {
+	configJSON := []byte(`{
+  "HTTPDaemon": {"Address": "0.0.0.0", "Port": 443, "PerIPLimit": 10},
+  "HTTPFilters": {"LintText": {"MaxLength": 1000}},
+  "Profiles": {
+    "travel": {
+      "Daemons": ["httpd", "dnsd"],
+      "Config": {"HTTPDaemon": {"PerIPLimit": 2}, "HTTPFilters": {"LintText": null}, "SNMPDaemon": {"Port": 161}}
+    },
+    "lockdown": {"Daemons": ["httpd"]},
+    "bad-daemon": {"Daemons": ["doesnotexist"]},
+    "bad-override": {"Config": {"Profiles": {}}}
+  }
+}`)
+	// The base configuration is returned as-is
+	merged, daemons, err := ApplyConfigProfile(configJSON, "")
+	require.NoError(t, err)
+	require.Equal(t, configJSON, merged)
+	require.Empty(t, daemons)
+	merged, _, err = ApplyConfigProfile(configJSON, misc.BaseConfigProfile)
+	require.NoError(t, err)
+	require.Equal(t, configJSON, merged)
+
+	// Objects are merged property by property, other values are replaced.
+	merged, daemons, err = ApplyConfigProfile(configJSON, "travel")
+	require.NoError(t, err)
+	require.Equal(t, []string{HTTPDName, DNSDName}, daemons)
+	var props map[string]interface{}
+	require.NoError(t, json.Unmarshal(merged, &props))
+	require.Equal(t, map[string]interface{}{"Address": "0.0.0.0", "Port": 443.0, "PerIPLimit": 2.0}, props["HTTPDaemon"])
+	require.Equal(t, map[string]interface{}{"LintText": nil}, props["HTTPFilters"])
+	require.Equal(t, map[string]interface{}{"Port": 161.0}, props["SNMPDaemon"])
+	require.Contains(t, props, ProfilesConfigKey)
+
+	for _, name := range []string{"does-not-exist", "bad-daemon", "bad-override"} {
+		_, _, err = ApplyConfigProfile(configJSON, name)
+		require.Error(t, err, name)
+	}
+	_, _, err = ApplyConfigProfile([]byte(`{"Profiles": []}`), "travel")
+	require.Error(t, err)
+}
+
+func TestConfig_DeserialiseProfileFromJSON(t *testing.T) {
+	configJSON := []byte(`{
+  "PlainSocketDaemon": {"Address": "127.0.0.1", "TCPPort": 23871, "PerIPLimit": 10},
+  "Profiles": {
+    "travel": {"Daemons": ["plainsocket"], "Config": {"PlainSocketDaemon": {"PerIPLimit": 2}}},
+    "lockdown": {}
+  }
+}`)
+	var config Config
+	require.NoError(t, config.DeserialiseFromJSON(configJSON))
+	require.Equal(t, misc.BaseConfigProfile, config.GetProfileName())
+	require.Empty(t, config.GetProfileDaemons())
+	require.Equal(t, 10, config.PlainSocketDaemon.PerIPLimit)
+
+	config = Config{}
+	require.NoError(t, config.DeserialiseProfileFromJSON(configJSON, "travel"))
+	require.Equal(t, "travel", config.GetProfileName())
+	require.Equal(t, []string{PlainSocketName}, config.GetProfileDaemons())
+	require.Equal(t, 2, config.PlainSocketDaemon.PerIPLimit)
+	require.Equal(t, 23871, config.PlainSocketDaemon.TCPPort)
+
+	config = Config{}
+	require.Error(t, config.DeserialiseProfileFromJSON(configJSON, "does-not-exist"))
+	// A profile must not hide behind the name of the base configuration, and every profile must be valid.
+	config = Config{}
+	require.Error(t, config.DeserialiseFromJSON([]byte(`{"Profiles": {"base": {}}}`)))
+	config = Config{}
+	require.Error(t, config.DeserialiseFromJSON([]byte(`{"Profiles": {"travel": {"Daemons": ["doesnotexist"]}}}`)))
+}
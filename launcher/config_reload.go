@@ -0,0 +1,418 @@
+package launcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+var (
+	/*
+		ReloadSharedConfigKeys are the top-level configuration properties shared by all daemons, such as the app features.
+		A change made to any of them restarts all daemons during a configuration reload.
+	*/
+	ReloadSharedConfigKeys = []string{"Features", "MailClient", "MessageProcessorFilters", "AWSIntegration", "TLS", "SharedRateLimitRedis"}
+	// ReloadRestartRequiredConfigKeys are the top-level configuration properties that only take effect after the program restarts.
+	ReloadRestartRequiredConfigKeys = []string{"SupervisorNotificationRecipients", "SupervisorNotificationPhoneNumbers", "SupervisorShedPolicy"}
+	/*
+		DaemonConfigKeys are the top-level configuration properties that each daemon is constructed from, including those of
+		the other daemons and components it uses, such as the DNS daemon's blacklist and the mail command runner.
+		The properties that are neither listed here nor shared by all daemons (e.g. DataRetention and HelperProcessLimits)
+		take effect during a configuration reload without restarting any daemon.
+	*/
+	DaemonConfigKeys = map[string][]string{
+		DNSDName:          {"DNSDaemon", "DNSFilters", "HTTPHandlers", "MailDaemon"},
+		HTTPDName:         {"HTTPDaemon", "HTTPFilters", "HTTPHandlers", "MailCommandRunner", "MailFilters", "DNSDaemon", "DNSFilters", "MailDaemon"},
+		InsecureHTTPDName: {"HTTPDaemon", "HTTPFilters", "HTTPHandlers", "MailCommandRunner", "MailFilters", "DNSDaemon", "DNSFilters", "MailDaemon"},
+		MaintenanceName:   {"Maintenance", "TelegramBot", "HTTPDaemon", "HTTPFilters", "HTTPHandlers", "MailCommandRunner", "MailFilters", "DNSDaemon", "DNSFilters", "MailDaemon"},
+		PhoneHomeName:     {"PhoneHomeDaemon", "PhoneHomeFilters"},
+		PlainSocketName:   {"PlainSocketDaemon", "PlainSocketFilters"},
+		SimpleIPSvcName:   {"SimpleIPSvcDaemon"},
+		SMTPDName:         {"MailDaemon", "MailCommandRunner", "MailFilters"},
+		SNMPDName:         {"SNMPDaemon"},
+		SOCKDName:         {"SockDaemon", "DNSDaemon", "DNSFilters", "HTTPHandlers", "MailDaemon"},
+		SSHDName:          {"SSHDaemon", "SSHDFilters"},
+		TelegramName:      {"TelegramBot", "TelegramFilters"},
+		AutoUnlockName:    {"AutoUnlock"},
+		PasswdRPCName:     {"PasswordRPCDaemon"},
+		HTTPProxyName:     {"HTTPProxyDaemon", "DNSDaemon", "DNSFilters", "HTTPHandlers", "MailDaemon"},
+	}
+)
+
+/*
+GetChangedConfigKeys compares the top-level properties of two configurations (JSON) and returns the names of those that
+differ, in sorted order. Formatting differences such as indentation and the order of properties are disregarded.
+*/
+func GetChangedConfigKeys(oldConfig, newConfig []byte) ([]string, error) {
+	var oldProps, newProps map[string]interface{}
+	if err := json.Unmarshal(oldConfig, &oldProps); err != nil {
+		return nil, fmt.Errorf("GetChangedConfigKeys: failed to deserialise the old configuration - %w", err)
+	}
+	if err := json.Unmarshal(newConfig, &newProps); err != nil {
+		return nil, fmt.Errorf("GetChangedConfigKeys: failed to deserialise the new configuration - %w", err)
+	}
+	changed := make([]string, 0)
+	for key, oldValue := range oldProps {
+		if newValue, exists := newProps[key]; !exists || !reflect.DeepEqual(oldValue, newValue) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range newProps {
+		if _, exists := oldProps[key]; !exists {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// GetChangedDaemons returns the daemons, among those of the input names, that are affected by the changed configuration properties.
+func GetChangedDaemons(daemonNames, changedKeys []string) []string {
+	if isSharedConfigChanged(changedKeys) {
+		return append([]string{}, daemonNames...)
+	}
+	changed := make(map[string]bool)
+	for _, key := range changedKeys {
+		changed[key] = true
+	}
+	ret := make([]string, 0)
+	for _, name := range daemonNames {
+		for _, key := range DaemonConfigKeys[name] {
+			if changed[key] {
+				ret = append(ret, name)
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// isSharedConfigChanged returns true only if any of the changed configuration properties are shared by all daemons.
+func isSharedConfigChanged(changedKeys []string) bool {
+	for _, key := range changedKeys {
+		if slices.Contains(ReloadSharedConfigKeys, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// StopDaemon gracefully stops the daemon of the input name, connections that are being served are given time to complete.
+func (config *Config) StopDaemon(daemonName string) error {
+	switch daemonName {
+	case DNSDName:
+		config.GetDNSD().Stop()
+	case HTTPDName:
+		config.GetHTTPD().StopTLS()
+		config.GetHTTPD().StopUnixSocket()
+	case InsecureHTTPDName:
+		config.GetHTTPD().StopNoTLS()
+		config.GetHTTPD().StopUnixSocket()
+	case MaintenanceName:
+		config.GetMaintenance().Stop()
+	case PhoneHomeName:
+		config.GetPhoneHomeDaemon().Stop()
+	case PlainSocketName:
+		config.GetPlainSocketDaemon().Stop()
+	case SimpleIPSvcName:
+		config.GetSimpleIPSvcD().Stop()
+	case SMTPDName:
+		config.GetMailDaemon().Stop()
+	case SNMPDName:
+		config.GetSNMPD().Stop()
+	case SOCKDName:
+		config.GetSockDaemon().Stop()
+	case SSHDName:
+		config.GetSSHD().Stop()
+	case TelegramName:
+		config.GetTelegramBot().Stop()
+	case AutoUnlockName:
+		config.GetAutoUnlock().Stop()
+	case PasswdRPCName:
+		config.GetPasswdRPCDaemon().Stop()
+	case HTTPProxyName:
+		config.GetHTTPProxyDaemon().Stop()
+	default:
+		return fmt.Errorf("Config.StopDaemon: unrecognised daemon name \"%s\"", daemonName)
+	}
+	return nil
+}
+
+/*
+InitialiseDaemon constructs and initialises the daemon of the input name without starting it. Unlike the daemon getters,
+it returns the initialisation error rather than aborting the program.
+*/
+func (config *Config) InitialiseDaemon(daemonName string) (err error) {
+	config.collectInitErrors = true
+	config.initErrors = nil
+	defer func() {
+		// A daemon missing from the configuration cannot be constructed
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("Config.InitialiseDaemon: failed to construct daemon \"%s\" - %v", daemonName, recovered)
+		} else if len(config.initErrors) > 0 {
+			err = fmt.Errorf("Config.InitialiseDaemon: daemon \"%s\" failed to initialise - %w", daemonName, errors.Join(config.initErrors...))
+		}
+		config.collectInitErrors = false
+		config.initErrors = nil
+	}()
+	switch daemonName {
+	case DNSDName:
+		config.GetDNSD()
+	case HTTPDName, InsecureHTTPDName:
+		config.GetHTTPD()
+	case MaintenanceName:
+		config.GetMaintenance()
+	case PhoneHomeName:
+		config.GetPhoneHomeDaemon()
+	case PlainSocketName:
+		config.GetPlainSocketDaemon()
+	case SimpleIPSvcName:
+		config.GetSimpleIPSvcD()
+	case SMTPDName:
+		config.GetMailDaemon()
+	case SNMPDName:
+		config.GetSNMPD()
+	case SOCKDName:
+		config.GetSockDaemon()
+	case SSHDName:
+		config.GetSSHD()
+	case TelegramName:
+		config.GetTelegramBot()
+	case AutoUnlockName:
+		config.GetAutoUnlock()
+	case PasswdRPCName:
+		config.GetPasswdRPCDaemon()
+	case HTTPProxyName:
+		config.GetHTTPProxyDaemon()
+	default:
+		return fmt.Errorf("Config.InitialiseDaemon: unrecognised daemon name \"%s\"", daemonName)
+	}
+	return nil
+}
+
+/*
+adoptDaemon takes over the running daemon of the input name from the other configuration, so that the daemon keeps
+serving, and the daemons constructed by this configuration use the running daemon rather than a new one.
+*/
+func (config *Config) adoptDaemon(from *Config, daemonName string) {
+	switch daemonName {
+	case DNSDName:
+		config.DNSDaemon, config.dnsDaemonInit = from.DNSDaemon, from.dnsDaemonInit
+	case HTTPDName, InsecureHTTPDName:
+		config.HTTPDaemon, config.httpDaemonInit = from.HTTPDaemon, from.httpDaemonInit
+	case MaintenanceName:
+		config.Maintenance, config.maintenanceInit = from.Maintenance, from.maintenanceInit
+	case PhoneHomeName:
+		config.PhoneHomeDaemon, config.phoneHomeDaemonInit = from.PhoneHomeDaemon, from.phoneHomeDaemonInit
+	case PlainSocketName:
+		config.PlainSocketDaemon, config.plainSocketDaemonInit = from.PlainSocketDaemon, from.plainSocketDaemonInit
+	case SimpleIPSvcName:
+		config.SimpleIPSvcDaemon, config.simpleIPSvcDaemonInit = from.SimpleIPSvcDaemon, from.simpleIPSvcDaemonInit
+	case SMTPDName:
+		config.MailDaemon, config.mailDaemonInit = from.MailDaemon, from.mailDaemonInit
+	case SNMPDName:
+		config.SNMPDaemon, config.snmpDaemonInit = from.SNMPDaemon, from.snmpDaemonInit
+	case SOCKDName:
+		config.SockDaemon, config.sockDaemonInit = from.SockDaemon, from.sockDaemonInit
+	case SSHDName:
+		config.SSHDaemon, config.sshDaemonInit = from.SSHDaemon, from.sshDaemonInit
+	case TelegramName:
+		config.TelegramBot, config.telegramBotInit = from.TelegramBot, from.telegramBotInit
+	case AutoUnlockName:
+		config.AutoUnlock, config.autoUnlockInit = from.AutoUnlock, from.autoUnlockInit
+	case PasswdRPCName:
+		config.PasswordRPCDaemon, config.passwdrpcDaemonInit = from.PasswordRPCDaemon, from.passwdrpcDaemonInit
+	case HTTPProxyName:
+		config.HTTPProxyDaemon, config.httpProxyDaemonInit = from.HTTPProxyDaemon, from.httpProxyDaemonInit
+	}
+}
+
+/*
+ConfigReloader re-reads the program configuration on demand (e.g. upon SIGHUP), and restarts only the daemons affected
+by the configuration changes. The affected daemons are stopped gracefully so that connections being served are given
+time to complete, the other daemons keep running without interruption.
+It also switches the configuration profile in the same way, starting and stopping the daemons selected by the profiles.
+*/
+type ConfigReloader struct {
+	// Config is the configuration that the daemons have been started with. It is replaced by each successful reload.
+	Config *Config
+	// DaemonNames are the names of the daemons that have been started.
+	DaemonNames []string
+	// ProfileName is the name of the configuration profile that the daemons have been started with, it is empty if none.
+	ProfileName string
+	// ReadConfig returns the latest program configuration (JSON), decrypted if necessary.
+	ReadConfig func() ([]byte, error)
+	// StartDaemon starts the daemon of the configuration and blocks until the daemon stops.
+	StartDaemon func(config *Config, daemonName string)
+	// Logger is used to log reload progress.
+	Logger *lalog.Logger
+
+	configJSON []byte
+	mutex      *sync.Mutex
+}
+
+// Initialise reads the configuration that the daemons have been started with, as the baseline of the next reload.
+func (reloader *ConfigReloader) Initialise() error {
+	if reloader.Config == nil || reloader.ReadConfig == nil || reloader.StartDaemon == nil {
+		return fmt.Errorf("ConfigReloader.Initialise: Config, ReadConfig, and StartDaemon must be present")
+	}
+	if reloader.Logger == nil {
+		reloader.Logger = &lalog.Logger{ComponentName: "ConfigReloader"}
+	}
+	reloader.mutex = new(sync.Mutex)
+	content, err := reloader.ReadConfig()
+	if err != nil {
+		return fmt.Errorf("ConfigReloader.Initialise: failed to read configuration - %w", err)
+	}
+	resolved, err := ResolveSecretReferences(content)
+	if err != nil {
+		return fmt.Errorf("ConfigReloader.Initialise: %w", err)
+	}
+	if reloader.configJSON, _, err = ApplyConfigProfile(resolved, reloader.ProfileName); err != nil {
+		return fmt.Errorf("ConfigReloader.Initialise: %w", err)
+	}
+	return nil
+}
+
+/*
+Reload reads the configuration again and restarts the daemons affected by the changes, it returns the names of the
+restarted daemons. If the new configuration cannot be read or fails to initialise, the daemons keep running with the
+current configuration.
+*/
+func (reloader *ConfigReloader) Reload() ([]string, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	return reloader.reload(reloader.ProfileName)
+}
+
+/*
+SwitchProfile reads the configuration again and applies the configuration profile of the name (misc.BaseConfigProfile
+for none), it returns the names of the daemons restarted or started. The daemons that are not selected by the profile
+are stopped, and a profile that does not select any daemon keeps the current daemons. If the profile cannot be applied,
+the daemons keep running with the current configuration.
+*/
+func (reloader *ConfigReloader) SwitchProfile(profileName string) ([]string, error) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	if profileName == misc.BaseConfigProfile {
+		profileName = ""
+	}
+	return reloader.reload(profileName)
+}
+
+// GetProfiles returns the name of the configuration profile in effect (misc.BaseConfigProfile if none) and the names of all profiles.
+func (reloader *ConfigReloader) GetProfiles() (active string, all []string) {
+	reloader.mutex.Lock()
+	defer reloader.mutex.Unlock()
+	return reloader.Config.GetProfileName(), GetConfigProfileNames(reloader.Config.Profiles)
+}
+
+// reload reads the configuration and applies the profile, then restarts, starts, and stops the daemons accordingly.
+func (reloader *ConfigReloader) reload(profileName string) ([]string, error) {
+	content, err := reloader.ReadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("ConfigReloader.Reload: failed to read configuration - %w", err)
+	}
+	// Secrets are read from files and systemd credentials, a change made to them counts as a configuration change too.
+	resolved, err := ResolveSecretReferences(content)
+	if err != nil {
+		return nil, fmt.Errorf("ConfigReloader.Reload: %w", err)
+	}
+	merged, profileDaemons, err := ApplyConfigProfile(resolved, profileName)
+	if err != nil {
+		return nil, fmt.Errorf("ConfigReloader.Reload: %w", err)
+	}
+	changedKeys, err := GetChangedConfigKeys(reloader.configJSON, merged)
+	if err != nil {
+		return nil, fmt.Errorf("ConfigReloader.Reload: %w", err)
+	}
+	daemonNames := reloader.DaemonNames
+	if len(profileDaemons) > 0 {
+		daemonNames = profileDaemons
+	}
+	// The daemons selected by the previous profile alone are stopped, and those selected by the new profile alone are started.
+	var keep, start, stop []string
+	for _, name := range daemonNames {
+		if slices.Contains(reloader.DaemonNames, name) {
+			keep = append(keep, name)
+		} else {
+			start = append(start, name)
+		}
+	}
+	for _, name := range reloader.DaemonNames {
+		if !slices.Contains(daemonNames, name) {
+			stop = append(stop, name)
+		}
+	}
+	if len(changedKeys) == 0 && len(start) == 0 && len(stop) == 0 {
+		reloader.Logger.Info("", nil, "the configuration is unchanged")
+		reloader.ProfileName = profileName
+		return []string{}, nil
+	}
+	reloader.Logger.Info("", nil, "changed configuration properties are: %v", changedKeys)
+	for _, key := range changedKeys {
+		if slices.Contains(ReloadRestartRequiredConfigKeys, key) {
+			reloader.Logger.Warning("", nil, "the change made to %s will take effect after the program restarts", key)
+		}
+	}
+	newConfig := new(Config)
+	if err := newConfig.DeserialiseProfileFromJSON(content, profileName); err != nil {
+		return nil, fmt.Errorf("ConfigReloader.Reload: failed to initialise the new configuration - %w", err)
+	}
+	newConfig.SetDaemonNames(daemonNames)
+	restart := GetChangedDaemons(keep, changedKeys)
+	// The daemons unaffected by the changes keep running, and so do the app features unless they changed.
+	if !isSharedConfigChanged(changedKeys) {
+		newConfig.Features = reloader.Config.Features
+	}
+	for _, name := range keep {
+		if !slices.Contains(restart, name) {
+			newConfig.adoptDaemon(reloader.Config, name)
+		}
+	}
+	restart = append(restart, start...)
+	// The daemons are constructed from the new configuration first, the old daemons keep running if any of them fails.
+	for _, name := range restart {
+		if err := newConfig.InitialiseDaemon(name); err != nil {
+			return nil, fmt.Errorf("ConfigReloader.Reload: %w", err)
+		}
+	}
+	for _, name := range restart {
+		if slices.Contains(start, name) {
+			continue
+		}
+		reloader.Logger.Info(name, nil, "stopping the daemon to apply the new configuration")
+		if err := reloader.Config.StopDaemon(name); err != nil {
+			return nil, fmt.Errorf("ConfigReloader.Reload: %w", err)
+		}
+	}
+	for _, name := range stop {
+		reloader.Logger.Info(name, nil, "stopping the daemon as it is not selected by configuration profile \"%s\"", newConfig.GetProfileName())
+		if err := reloader.Config.StopDaemon(name); err != nil {
+			return nil, fmt.Errorf("ConfigReloader.Reload: %w", err)
+		}
+	}
+	reloader.Config = newConfig
+	reloader.configJSON = merged
+	reloader.DaemonNames = append([]string{}, daemonNames...)
+	reloader.ProfileName = profileName
+	starter := &DaemonStarter{
+		IsReady: newConfig.IsDaemonReady,
+		Logger:  reloader.Logger,
+		Start: func(name string) {
+			reloader.StartDaemon(newConfig, name)
+		},
+	}
+	if _, err := starter.StartAll(restart); err != nil {
+		return nil, fmt.Errorf("ConfigReloader.Reload: %w", err)
+	}
+	reloader.Logger.Info("", nil, "restarted daemons %v with the new configuration", restart)
+	return restart, nil
+}
@@ -0,0 +1,162 @@
+package launcher
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetChangedConfigKeys(t *testing.T) {
+	changed, err := GetChangedConfigKeys([]byte(`{"A": {"B": 1, "C": [2]}, "D": "e", "F": 1}`), []byte(`{
+  "F": 1,
+  "D": "changed",
+  "A": {"C": [2], "B": 1},
+  "G": true
+}`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"D", "G"}, changed)
+
+	_, err = GetChangedConfigKeys([]byte(`{}`), []byte(`{`))
+	require.Error(t, err)
+}
+
+func TestGetChangedDaemons(t *testing.T) {
+	running := []string{DNSDName, HTTPDName, SOCKDName, SNMPDName}
+	require.Equal(t, []string{}, GetChangedDaemons(running, []string{"DataRetention", "PlainSocketDaemon"}))
+	require.Equal(t, []string{SNMPDName}, GetChangedDaemons(running, []string{"SNMPDaemon"}))
+	// The daemons using the DNS daemon are restarted along with it.
+	require.Equal(t, []string{DNSDName, HTTPDName, SOCKDName}, GetChangedDaemons(running, []string{"DNSDaemon"}))
+	require.Equal(t, running, GetChangedDaemons(running, []string{"Features"}))
+}
+
+func TestConfigReloader_Reload(t *testing.T) {
+	configJSON := []byte(`{
+  "PlainSocketDaemon": {"Address": "127.0.0.1", "TCPPort": 23871},
+  "PlainSocketFilters": {"LintText": {"MaxLength": 1000}, "PINAndShortcuts": {"Passwords": ["verysecret"]}},
+  "SNMPDaemon": {"Address": "127.0.0.1", "CommunityName": "public", "Port": 23872}
+}`)
+	var config Config
+	require.NoError(t, config.DeserialiseFromJSON(configJSON))
+
+	var mutex sync.Mutex
+	started := make(map[string]int)
+	stopped := make(chan string, 10)
+	startDaemon := func(config *Config, name string) {
+		mutex.Lock()
+		started[name]++
+		mutex.Unlock()
+		var err error
+		switch name {
+		case PlainSocketName:
+			err = config.GetPlainSocketDaemon().StartAndBlock()
+		case SNMPDName:
+			err = config.GetSNMPD().StartAndBlock()
+		}
+		require.NoError(t, err)
+		stopped <- name
+	}
+	reloader := &ConfigReloader{
+		Config:      &config,
+		DaemonNames: []string{PlainSocketName, SNMPDName},
+		ReadConfig: func() ([]byte, error) {
+			return configJSON, nil
+		},
+		StartDaemon: startDaemon,
+	}
+	require.NoError(t, reloader.Initialise())
+	go startDaemon(&config, PlainSocketName)
+	go startDaemon(&config, SNMPDName)
+	time.Sleep(2 * time.Second)
+
+	// An unchanged configuration does not restart any daemon.
+	restarted, err := reloader.Reload()
+	require.NoError(t, err)
+	require.Empty(t, restarted)
+
+	// Only the daemon of the changed configuration is restarted.
+	oldPlainSocket, oldSNMPD := config.GetPlainSocketDaemon(), config.GetSNMPD()
+	configJSON = []byte(`{
+  "PlainSocketDaemon": {"TCPPort": 23871, "Address": "127.0.0.1"},
+  "PlainSocketFilters": {"LintText": {"MaxLength": 1000}, "PINAndShortcuts": {"Passwords": ["verysecret"]}},
+  "SNMPDaemon": {"Address": "127.0.0.1", "CommunityName": "public", "Port": 23873}
+}`)
+	restarted, err = reloader.Reload()
+	require.NoError(t, err)
+	require.Equal(t, []string{SNMPDName}, restarted)
+	require.Equal(t, SNMPDName, <-stopped)
+	require.Same(t, oldPlainSocket, reloader.Config.GetPlainSocketDaemon())
+	require.NotSame(t, oldSNMPD, reloader.Config.GetSNMPD())
+	require.Equal(t, 23873, reloader.Config.GetSNMPD().Port)
+	time.Sleep(2 * time.Second)
+	mutex.Lock()
+	require.Equal(t, map[string]int{PlainSocketName: 1, SNMPDName: 2}, started)
+	mutex.Unlock()
+
+	// Switching profile stops the daemons not selected by the profile, and starts those newly selected.
+	configJSON = []byte(`{
+  "PlainSocketDaemon": {"TCPPort": 23871, "Address": "127.0.0.1"},
+  "PlainSocketFilters": {"LintText": {"MaxLength": 1000}, "PINAndShortcuts": {"Passwords": ["verysecret"]}},
+  "SNMPDaemon": {"Address": "127.0.0.1", "CommunityName": "public", "Port": 23873},
+  "Profiles": {
+    "quiet": {"Daemons": ["plainsocket"]},
+    "moved": {"Daemons": ["plainsocket", "snmpd"], "Config": {"SNMPDaemon": {"Port": 23874}}}
+  }
+}`)
+	restarted, err = reloader.SwitchProfile("quiet")
+	require.NoError(t, err)
+	require.Empty(t, restarted)
+	require.Equal(t, SNMPDName, <-stopped)
+	require.Equal(t, []string{PlainSocketName}, reloader.DaemonNames)
+	active, all := reloader.GetProfiles()
+	require.Equal(t, "quiet", active)
+	require.Equal(t, []string{"moved", "quiet"}, all)
+
+	restarted, err = reloader.SwitchProfile("moved")
+	require.NoError(t, err)
+	require.Equal(t, []string{SNMPDName}, restarted)
+	require.Same(t, oldPlainSocket, reloader.Config.GetPlainSocketDaemon())
+	require.Equal(t, 23874, reloader.Config.GetSNMPD().Port)
+	require.Equal(t, "127.0.0.1", reloader.Config.GetSNMPD().Address)
+	time.Sleep(2 * time.Second)
+
+	_, err = reloader.SwitchProfile("does-not-exist")
+	require.Error(t, err)
+	require.Equal(t, "moved", reloader.ProfileName)
+
+	// The base configuration keeps the current daemons as it does not select any.
+	restarted, err = reloader.SwitchProfile(misc.BaseConfigProfile)
+	require.NoError(t, err)
+	require.Equal(t, []string{SNMPDName}, restarted)
+	require.Equal(t, SNMPDName, <-stopped)
+	require.Equal(t, 23873, reloader.Config.GetSNMPD().Port)
+	require.Equal(t, []string{PlainSocketName, SNMPDName}, reloader.DaemonNames)
+	time.Sleep(2 * time.Second)
+
+	// A daemon that fails to initialise from the new configuration leaves the old daemon running.
+	configJSON = []byte(`{
+  "PlainSocketDaemon": {"TCPPort": 23871, "Address": "127.0.0.1"},
+  "PlainSocketFilters": {"LintText": {"MaxLength": 1000}, "PINAndShortcuts": {"Passwords": ["verysecret"]}},
+  "SNMPDaemon": {"Address": "127.0.0.1", "CommunityName": "short", "Port": 23875}
+}`)
+	_, err = reloader.Reload()
+	require.ErrorContains(t, err, "CommunityName")
+	require.Equal(t, 23873, reloader.Config.GetSNMPD().Port)
+	require.Empty(t, stopped)
+	mutex.Lock()
+	require.Equal(t, map[string]int{PlainSocketName: 1, SNMPDName: 4}, started)
+	mutex.Unlock()
+
+	// A broken configuration leaves the daemons running.
+	configJSON = []byte(`{"SNMPDaemon": {"Port": "not a number"}}`)
+	_, err = reloader.Reload()
+	require.Error(t, err)
+	require.Equal(t, 23873, reloader.Config.GetSNMPD().Port)
+
+	require.NoError(t, reloader.Config.StopDaemon(PlainSocketName))
+	require.NoError(t, reloader.Config.StopDaemon(SNMPDName))
+	<-stopped
+	<-stopped
+}
@@ -0,0 +1,138 @@
+package launcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// SecretFileKeySuffix is the suffix of a config key that refers to a file holding the secret value of the key without the suffix.
+	SecretFileKeySuffix = "File"
+	// SecretCredentialKeySuffix is the suffix of a config key that refers to a systemd credential (LoadCredential=) holding the secret value.
+	SecretCredentialKeySuffix = "Credential"
+	// EnvironmentCredentialsDirectory is the environment variable set by systemd, it is the directory of the credentials of the service.
+	EnvironmentCredentialsDirectory = "CREDENTIALS_DIRECTORY"
+)
+
+/*
+ResolveSecretReferences substitutes the references to secrets in the JSON configuration with the secret values, so that the
+secrets do not have to sit in the configuration at rest. A secret key (e.g. "Password", the same keys that are masked in
+the config snapshot) may be given as:
+- "PasswordFile": "/path/to/file" - the secret value is read from the file.
+- "PasswordCredential": "name" - the secret value is read from the systemd credential of the name.
+Either reference may also be an array of paths or names, for a secret key that takes an array of values (e.g. "Passwords").
+The trailing line break of each secret value is removed. The input is returned as-is if it does not refer to any secret.
+*/
+func ResolveSecretReferences(in []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(in))
+	// Keep the large integers intact when serialising the configuration again.
+	decoder.UseNumber()
+	var config interface{}
+	if err := decoder.Decode(&config); err != nil {
+		return nil, err
+	}
+	resolved, err := resolveSecretReferences(config)
+	if err != nil {
+		return nil, err
+	}
+	if resolved == 0 {
+		return in, nil
+	}
+	return json.Marshal(config)
+}
+
+// resolveSecretReferences walks through the JSON value and substitutes the secret references in-place, and returns the number of substitutions.
+func resolveSecretReferences(in interface{}) (resolved int, err error) {
+	switch value := in.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			var secretKey, suffix string
+			for _, candidate := range []string{SecretFileKeySuffix, SecretCredentialKeySuffix} {
+				if len(key) > len(candidate) && strings.HasSuffix(strings.ToLower(key), strings.ToLower(candidate)) {
+					secretKey, suffix = key[:len(key)-len(candidate)], candidate
+				}
+			}
+			// A key of other value types is not a reference, e.g. the encrypted "SecretFile" of the 2FA code generator.
+			if secretKey == "" || !RegexSecretConfigKey.MatchString(secretKey) || !isSecretReference(child) {
+				n, err := resolveSecretReferences(child)
+				if err != nil {
+					return 0, err
+				}
+				resolved += n
+				continue
+			}
+			for existingKey := range value {
+				if strings.EqualFold(existingKey, secretKey) {
+					return 0, fmt.Errorf("ResolveSecretReferences: \"%s\" and \"%s\" must not be both present", existingKey, key)
+				}
+			}
+			var secret interface{}
+			if ref, isString := child.(string); isString {
+				if secret, err = readSecret(suffix, ref); err != nil {
+					return 0, err
+				}
+			} else {
+				refs := child.([]interface{})
+				secrets := make([]interface{}, len(refs))
+				for i, ref := range refs {
+					if secrets[i], err = readSecret(suffix, ref.(string)); err != nil {
+						return 0, err
+					}
+				}
+				secret = secrets
+			}
+			delete(value, key)
+			value[secretKey] = secret
+			resolved++
+		}
+	case []interface{}:
+		for _, child := range value {
+			n, err := resolveSecretReferences(child)
+			if err != nil {
+				return 0, err
+			}
+			resolved += n
+		}
+	}
+	return
+}
+
+// isSecretReference returns true if the value is a string or an array of strings.
+func isSecretReference(in interface{}) bool {
+	switch value := in.(type) {
+	case string:
+		return true
+	case []interface{}:
+		for _, elem := range value {
+			if _, isString := elem.(string); !isString {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// readSecret reads a secret value from the file or the systemd credential, depending on the suffix of the referring key.
+func readSecret(suffix, ref string) (string, error) {
+	path := ref
+	if suffix == SecretCredentialKeySuffix {
+		credDir := os.Getenv(EnvironmentCredentialsDirectory)
+		if credDir == "" {
+			return "", fmt.Errorf("readSecret: credential \"%s\" is unavailable because %s is not set, is the program started by systemd with LoadCredential?", ref, EnvironmentCredentialsDirectory)
+		}
+		if ref == "" || strings.ContainsAny(ref, `/\`) || ref == "." || ref == ".." {
+			return "", fmt.Errorf("readSecret: \"%s\" is not a valid credential name", ref)
+		}
+		path = filepath.Join(credDir, ref)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("readSecret: failed to read secret - %w", err)
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
@@ -0,0 +1,66 @@
+package launcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSecretReferences(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pin"), []byte("pin1\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pin2"), []byte("pin2"), 0600))
+	pinPath, _ := filepath.Abs(filepath.Join(dir, "pin"))
+	pin2Path, _ := filepath.Abs(filepath.Join(dir, "pin2"))
+
+	// The input is returned as-is without a secret reference.
+	in := []byte(`{"HTTPDaemon": {"Port": 80}, "TwoFACodeGenerator": {"SecretFile": {"FilePath": "a"}}, "LogFile": "/tmp/log"}`)
+	out, err := ResolveSecretReferences(in)
+	require.NoError(t, err)
+	require.Equal(t, string(in), string(out))
+
+	// Secrets are read from files.
+	out, err = ResolveSecretReferences([]byte(`{
+		"MailClient": {"AuthPasswordFile": "` + pinPath + `", "LogFile": "/tmp/log"},
+		"HTTPHandlers": {"AppCommandEndpoint": "/cmd", "MaxInt": 9007199254740993},
+		"PINAndShortcuts": {"PasswordsFile": ["` + pinPath + `", "` + pin2Path + `"]}
+	}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"MailClient": {"AuthPassword": "pin1", "LogFile": "/tmp/log"},
+		"HTTPHandlers": {"AppCommandEndpoint": "/cmd", "MaxInt": 9007199254740993},
+		"PINAndShortcuts": {"Passwords": ["pin1", "pin2"]}
+	}`, string(out))
+	require.Contains(t, string(out), "9007199254740993")
+
+	// Secrets are read from systemd credentials.
+	t.Setenv(EnvironmentCredentialsDirectory, "")
+	_, err = ResolveSecretReferences([]byte(`{"Twilio": {"AuthTokenCredential": "pin"}}`))
+	require.Error(t, err)
+	t.Setenv(EnvironmentCredentialsDirectory, dir)
+	out, err = ResolveSecretReferences([]byte(`{"Twilio": {"AuthTokenCredential": "pin"}, "PINAndShortcuts": {"passwordsCredential": ["pin2"]}}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Twilio": {"AuthToken": "pin1"}, "PINAndShortcuts": {"passwords": ["pin2"]}}`, string(out))
+	for _, name := range []string{"", ".", "..", "../pin", pinPath} {
+		_, err = ResolveSecretReferences([]byte(`{"Twilio": {"AuthTokenCredential": "` + name + `"}}`))
+		require.Error(t, err, name)
+	}
+
+	// A secret must not be given alongside its reference.
+	_, err = ResolveSecretReferences([]byte(`{"Twilio": {"AuthToken": "a", "AuthTokenFile": "` + pinPath + `"}}`))
+	require.Error(t, err)
+	// The file must exist.
+	_, err = ResolveSecretReferences([]byte(`{"Twilio": {"AuthTokenFile": "` + filepath.Join(dir, "doesnotexist") + `"}}`))
+	require.Error(t, err)
+}
+
+func TestConfig_DeserialiseSecretReferences(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "pin"), []byte("verysecret\n"), 0600))
+	t.Setenv(EnvironmentCredentialsDirectory, dir)
+	var config Config
+	require.NoError(t, config.DeserialiseFromJSON([]byte(`{"HTTPFilters": {"PINAndShortcuts": {"PasswordsCredential": ["pin"]}}}`)))
+	require.Equal(t, []string{"verysecret"}, config.HTTPFilters.PINAndShortcuts.Passwords)
+}
@@ -0,0 +1,57 @@
+package launcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+/*
+GetConfigSnapshot reads the configuration file from disk, decrypting it if necessary, and returns a text snapshot that
+comprises the digests of the configuration file and program executable, the enabled toolbox features, and the
+configuration with secrets masked. The digest of configuration file reveals changes made to the secrets, without
+revealing the secrets themselves.
+*/
+func (config *Config) GetConfigSnapshot() ([]byte, error) {
+	if misc.ConfigFilePath == "" {
+		return nil, errors.New("Config.GetConfigSnapshot: configuration file path is unknown")
+	}
+	contents, isEncrypted, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, misc.ConfigFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Config.GetConfigSnapshot: failed to read configuration file - %w", err)
+	}
+	var fileConfig interface{}
+	if err := json.Unmarshal(contents[0], &fileConfig); err != nil {
+		return nil, fmt.Errorf("Config.GetConfigSnapshot: failed to deserialise configuration file - %w", err)
+	}
+	// The keys of JSON objects are serialised in sorted order, which makes the snapshot stable.
+	maskedConfig, err := json.MarshalIndent(MaskSecrets(fileConfig), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("Config.GetConfigSnapshot: failed to serialise configuration - %w", err)
+	}
+	var out bytes.Buffer
+	out.WriteString(fmt.Sprintf("Configuration file: %s\n", misc.ConfigFilePath))
+	out.WriteString(fmt.Sprintf("Configuration file is encrypted: %v\n", isEncrypted[0]))
+	out.WriteString(fmt.Sprintf("Configuration SHA256: %x\n", sha256.Sum256(contents[0])))
+	executableDigest := "(unavailable)"
+	if executablePath, err := os.Executable(); err == nil {
+		if executable, err := os.ReadFile(executablePath); err == nil {
+			executableDigest = fmt.Sprintf("%x", sha256.Sum256(executable))
+		}
+	}
+	out.WriteString(fmt.Sprintf("Program executable SHA256: %s\n", executableDigest))
+	features := config.Features.GetTriggers()
+	sort.Strings(features)
+	out.WriteString(fmt.Sprintf("Enabled app features: %s\n", strings.Join(features, " ")))
+	out.WriteString("Configuration (secrets masked):\n")
+	out.Write(maskedConfig)
+	out.WriteString("\n")
+	return out.Bytes(), nil
+}
@@ -0,0 +1,52 @@
+package launcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_GetConfigSnapshot(t *testing.T) {
+	var config Config
+	require.NoError(t, config.DeserialiseFromJSON([]byte(sampleConfigJSON)))
+	originalPath := misc.ConfigFilePath
+	defer func() {
+		misc.ConfigFilePath = originalPath
+	}()
+	misc.ConfigFilePath = ""
+	_, err := config.GetConfigSnapshot()
+	require.Error(t, err)
+
+	misc.ConfigFilePath = filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(misc.ConfigFilePath, []byte(`{"HTTPDaemon": {"Port": 80}, "MailClient": {"AuthPassword": "verysecret"}}`), 0600))
+	snapshot, err := config.GetConfigSnapshot()
+	require.NoError(t, err)
+	require.NotContains(t, string(snapshot), "verysecret")
+	require.Contains(t, string(snapshot), `"AuthPassword": "`+MaskedSecret+`"`)
+	require.Contains(t, string(snapshot), `"Port": 80`)
+	require.Contains(t, string(snapshot), "Configuration file is encrypted: false")
+	// The snapshot is stable
+	again, err := config.GetConfigSnapshot()
+	require.NoError(t, err)
+	require.Equal(t, snapshot, again)
+
+	// A change of secret alters the digest but not the masked configuration
+	require.NoError(t, os.WriteFile(misc.ConfigFilePath, []byte(`{"HTTPDaemon": {"Port": 80}, "MailClient": {"AuthPassword": "newsecret"}}`), 0600))
+	changed, err := config.GetConfigSnapshot()
+	require.NoError(t, err)
+	require.NotEqual(t, snapshot, changed)
+	digestLine := func(s []byte) string {
+		for _, line := range strings.Split(string(s), "\n") {
+			if strings.HasPrefix(line, "Configuration SHA256") {
+				return line
+			}
+		}
+		return ""
+	}
+	require.NotEqual(t, digestLine(snapshot), digestLine(changed))
+	require.NotContains(t, string(changed), "newsecret")
+}
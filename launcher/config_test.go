@@ -397,8 +397,8 @@ var sampleConfigJSON = `
 `
 
 func TestConfig(t *testing.T) {
-	misc.EnableAWSIntegration = true
-	misc.EnablePrometheusIntegration = true
+	misc.AWSIntegration.Set(true)
+	misc.PrometheusIntegration.Set(true)
 	var config Config
 	if err := config.DeserialiseFromJSON([]byte(sampleConfigJSON)); err != nil {
 		t.Fatal(err)
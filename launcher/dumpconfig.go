@@ -0,0 +1,255 @@
+package launcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const (
+	// DumpConfigFlagName is the CLI boolean flag that tells main function to print the effective configuration and exit.
+	DumpConfigFlagName = "dumpconfig"
+	// MaskedSecret substitutes the value of a secret (e.g. password, API token) in the effective configuration.
+	MaskedSecret = "********"
+)
+
+/*
+RegexSecretConfigKey matches the names of configuration properties that carry secrets. Command shortcuts are secrets too,
+because each one of them works without a password PIN, and so are the pre-configured commands that begin with a PIN.
+*/
+var RegexSecretConfigKey = regexp.MustCompile(`(?i)^(.*(password|passwords|passwd|secret|secrets|token)|appid|accountsid|hexkeyprefix|shortcuts|preconfiguredcommands)$`)
+
+// DaemonWiring describes how a daemon is put together from the configuration, that is, its handlers and filters.
+type DaemonWiring struct {
+	// CommandFilters are the filters that alter the input command before execution, in the order of application.
+	CommandFilters []string `json:"CommandFilters,omitempty"`
+	// ResultFilters are the filters that alter the command result after execution, in the order of application.
+	ResultFilters []string `json:"ResultFilters,omitempty"`
+	// Endpoints are the URL locations served by the HTTP daemon and the handler or directory behind each one of them.
+	Endpoints map[string]string `json:"Endpoints,omitempty"`
+	// Middleware are the server-wide features of the HTTP daemon that apply to all endpoints.
+	Middleware []string `json:"Middleware,omitempty"`
+}
+
+// EffectiveConfig is the fully resolved configuration after defaults are applied, with secrets masked.
+type EffectiveConfig struct {
+	// Profile is the name of the configuration profile in effect.
+	Profile string `json:"Profile"`
+	// Daemons are the names of daemons that were initialised in order to resolve their configuration.
+	Daemons []string `json:"Daemons"`
+	// EnabledFeatures are the triggers of the toolbox features that have been configured.
+	EnabledFeatures []string `json:"EnabledFeatures"`
+	// Configuration is the program configuration with default values filled in and secrets masked.
+	Configuration interface{} `json:"Configuration"`
+	// Wiring is keyed by daemon name.
+	Wiring map[string]DaemonWiring `json:"Wiring"`
+}
+
+/*
+GetEffectiveConfig initialises the daemons of the input names so that they fill in their default configuration, and then
+returns the resolved configuration and daemon wiring. The daemons are not started.
+*/
+func (config *Config) GetEffectiveConfig(daemonNames []string) (*EffectiveConfig, error) {
+	ret := &EffectiveConfig{
+		Profile:         config.GetProfileName(),
+		Daemons:         daemonNames,
+		EnabledFeatures: config.Features.GetTriggers(),
+		Wiring:          make(map[string]DaemonWiring),
+	}
+	sort.Strings(ret.EnabledFeatures)
+	for _, name := range daemonNames {
+		var wiring DaemonWiring
+		switch name {
+		case DNSDName:
+			wiring = describeCommandProcessor(config.GetDNSD().Processor)
+		case HTTPDName, InsecureHTTPDName:
+			wiring = describeHTTPD(config.GetHTTPD(), os.Getenv(EnvironmentStripURLPrefixFromRequest))
+		case MaintenanceName:
+			config.GetMaintenance()
+		case PhoneHomeName:
+			wiring = describeCommandProcessor(config.GetPhoneHomeDaemon().Processor)
+		case PlainSocketName:
+			wiring = describeCommandProcessor(config.GetPlainSocketDaemon().Processor)
+		case SimpleIPSvcName:
+			config.GetSimpleIPSvcD()
+		case SMTPDName:
+			wiring = describeCommandProcessor(config.GetMailDaemon().CommandRunner.Processor)
+		case SNMPDName:
+			config.GetSNMPD()
+		case SOCKDName:
+			config.GetSockDaemon()
+		case SSHDName:
+			wiring = describeCommandProcessor(config.GetSSHD().Processor)
+		case TelegramName:
+			wiring = describeCommandProcessor(config.GetTelegramBot().Processor)
+		case AutoUnlockName:
+			config.GetAutoUnlock()
+		case PasswdRPCName:
+			config.GetPasswdRPCDaemon()
+		case HTTPProxyName:
+			wiring = describeCommandProcessor(config.GetHTTPProxyDaemon().CommandProcessor)
+		default:
+			return nil, fmt.Errorf("Config.GetEffectiveConfig: unrecognised daemon name \"%s\"", name)
+		}
+		ret.Wiring[name] = wiring
+	}
+	if processor := config.Features.MessageProcessor.CmdProcessor; processor != nil {
+		ret.Wiring["MessageProcessor"] = describeCommandProcessor(processor)
+	}
+	// Go through JSON to get the configuration in the same shape as the configuration file
+	serialised, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("Config.GetEffectiveConfig: failed to serialise configuration - %w", err)
+	}
+	if err := json.Unmarshal(serialised, &ret.Configuration); err != nil {
+		return nil, fmt.Errorf("Config.GetEffectiveConfig: failed to deserialise configuration - %w", err)
+	}
+	ret.Configuration = MaskSecrets(ret.Configuration)
+	return ret, nil
+}
+
+// DumpEffectiveConfig writes the effective configuration and daemon wiring of the input daemons in indented JSON.
+func (config *Config) DumpEffectiveConfig(out io.Writer, daemonNames []string) error {
+	effective, err := config.GetEffectiveConfig(daemonNames)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(effective)
+}
+
+/*
+MaskSecrets walks through the deserialised JSON value and substitutes the values of secret properties with a mask.
+An empty secret is left empty so that it is clear which secrets are not configured.
+*/
+func MaskSecrets(in interface{}) interface{} {
+	switch value := in.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if RegexSecretConfigKey.MatchString(key) {
+				value[key] = maskSecretValue(child)
+			} else {
+				value[key] = MaskSecrets(child)
+			}
+		}
+	case []interface{}:
+		for i, child := range value {
+			value[i] = MaskSecrets(child)
+		}
+	}
+	return in
+}
+
+// maskSecretValue substitutes the non-empty strings in the secret value with a mask, and keeps the shape of the value.
+func maskSecretValue(in interface{}) interface{} {
+	switch value := in.(type) {
+	case string:
+		if value == "" {
+			return value
+		}
+		return MaskedSecret
+	case []interface{}:
+		for i, child := range value {
+			value[i] = maskSecretValue(child)
+		}
+		return value
+	case map[string]interface{}:
+		// Keys of a secret map (e.g. command shortcuts) are secrets as well
+		masked := make(map[string]interface{})
+		for i := 0; i < len(value); i++ {
+			masked[fmt.Sprintf("%s%d", MaskedSecret, i)] = MaskedSecret
+		}
+		return masked
+	case nil:
+		return nil
+	default:
+		return MaskedSecret
+	}
+}
+
+// describeCommandProcessor returns the command and result filters of the command processor in the order of application.
+func describeCommandProcessor(processor *toolbox.CommandProcessor) (ret DaemonWiring) {
+	if processor == nil {
+		return
+	}
+	for _, filter := range processor.CommandFilters {
+		ret.CommandFilters = append(ret.CommandFilters, describeFilter(filter))
+	}
+	for _, filter := range processor.ResultFilters {
+		ret.ResultFilters = append(ret.ResultFilters, describeFilter(filter))
+	}
+	return
+}
+
+// describeFilter returns the name of a command or result filter along with a summary of its configuration.
+func describeFilter(filter interface{}) string {
+	switch f := filter.(type) {
+	case *toolbox.PINAndShortcuts:
+		return fmt.Sprintf("PINAndShortcuts(passwords=%d, shortcuts=%d)", len(f.Passwords), len(f.Shortcuts))
+	case *toolbox.TranslateSequences:
+		return fmt.Sprintf("TranslateSequences(sequences=%d)", len(f.Sequences))
+	case *toolbox.LintText:
+		return fmt.Sprintf("LintText(transforms=%s, maxLength=%d)", strings.Join(f.GetTransforms(), ","), f.MaxLength)
+	case *toolbox.NotifyViaEmail:
+		if !f.IsConfigured() {
+			return "NotifyViaEmail(inactive)"
+		}
+		return fmt.Sprintf("NotifyViaEmail(recipients=%d)", len(f.Recipients))
+	case *toolbox.NotifyViaSMS:
+		if !f.IsConfigured() {
+			return "NotifyViaSMS(inactive)"
+		}
+		return fmt.Sprintf("NotifyViaSMS(recipients=%d)", len(f.Recipients))
+	case *toolbox.SayEmptyOutput:
+		return "SayEmptyOutput"
+	default:
+		return reflect.TypeOf(filter).String()
+	}
+}
+
+// describeHTTPD returns the endpoints, server-wide middleware, and command processor filters of the HTTP daemon.
+func describeHTTPD(daemon *httpd.Daemon, urlPrefix string) DaemonWiring {
+	ret := describeCommandProcessor(daemon.Processor)
+	ret.Endpoints = make(map[string]string)
+	for location, dirPath := range daemon.ServeDirectories {
+		ret.Endpoints[urlPrefix+location] = fmt.Sprintf("directory %s (rate limit %d/sec per IP)", dirPath, httpd.DirectoryHandlerRateLimitFactor*daemon.PerIPLimit)
+	}
+	for location, hand := range daemon.HandlerCollection {
+		ret.Endpoints[urlPrefix+location] = fmt.Sprintf("%s (rate limit %d/sec per IP)", reflect.TypeOf(hand).String(), hand.GetRateLimitFactor()*daemon.PerIPLimit)
+	}
+	if len(daemon.URLRewrites) > 0 {
+		ret.Middleware = append(ret.Middleware, fmt.Sprintf("URLRewrites(rules=%d)", len(daemon.URLRewrites)))
+	}
+	if daemon.TrailingSlash != "" {
+		ret.Middleware = append(ret.Middleware, fmt.Sprintf("TrailingSlash(%s)", daemon.TrailingSlash))
+	}
+	if len(daemon.ErrorPages) > 0 {
+		ret.Middleware = append(ret.Middleware, fmt.Sprintf("ErrorPages(pages=%d)", len(daemon.ErrorPages)))
+	}
+	if daemon.Compression.Enable {
+		ret.Middleware = append(ret.Middleware, fmt.Sprintf("Compression(minSize=%d, level=%d)", daemon.Compression.MinSizeBytes, daemon.Compression.Level))
+	}
+	for _, mirror := range daemon.Mirrors {
+		ret.Middleware = append(ret.Middleware, fmt.Sprintf("Mirror(%s%s -> %s, sample=%d%%)", urlPrefix, mirror.Location, mirror.TargetURL, mirror.SamplePercent))
+	}
+	if len(daemon.WebDAV.Locations) > 0 {
+		ret.Middleware = append(ret.Middleware, fmt.Sprintf("WebDAV(locations=%d, users=%d)", len(daemon.WebDAV.Locations), len(daemon.WebDAV.Users)))
+	}
+	if misc.PrometheusIntegration.IsEnabled() {
+		ret.Middleware = append(ret.Middleware, "PrometheusStats")
+	}
+	if misc.AWSIntegration.IsEnabled() {
+		ret.Middleware = append(ret.Middleware, "AWSXray")
+	}
+	return ret
+}
@@ -0,0 +1,61 @@
+package launcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/daemon/httpd"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaskSecrets(t *testing.T) {
+	var in interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"PINAndShortcuts": {"Passwords": ["pass1", "pass2"], "Shortcuts": {"abc": ".s echo"}, "TOTPSecrets": {"pass1": "JBSWY3DPEHPK3PXP"}},
+		"MailClient": {"AuthUsername": "user", "AuthPassword": ""},
+		"Twilio": {"AccountSID": "sid", "AuthToken": "token"},
+		"Handlers": [{"ClientAppSecret": "secret", "ClientAppID": "id"}],
+		"PasswordRPCDaemon": {"Port": 123}
+	}`), &in))
+	masked, err := json.Marshal(MaskSecrets(in))
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"PINAndShortcuts": {"Passwords": ["********", "********"], "Shortcuts": {"********0": "********"}, "TOTPSecrets": {"********0": "********"}},
+		"MailClient": {"AuthUsername": "user", "AuthPassword": ""},
+		"Twilio": {"AccountSID": "********", "AuthToken": "********"},
+		"Handlers": [{"ClientAppSecret": "********", "ClientAppID": "id"}],
+		"PasswordRPCDaemon": {"Port": 123}
+	}`, string(masked))
+}
+
+func TestConfig_DumpEffectiveConfig(t *testing.T) {
+	var config Config
+	require.NoError(t, config.DeserialiseFromJSON([]byte(sampleConfigJSON)))
+	httpd.PrepareForTestHTTPD(t)
+
+	_, err := config.GetEffectiveConfig([]string{"doesnotexist"})
+	require.Error(t, err)
+
+	var out bytes.Buffer
+	require.NoError(t, config.DumpEffectiveConfig(&out, []string{HTTPDName, PlainSocketName}))
+	// Secrets must not appear in the output
+	for _, secret := range []string{"verysecret", "httpshortcut", "plainsocketshortcut", "just a dummy token", "password does not matter"} {
+		require.NotContains(t, out.String(), secret)
+	}
+	var effective EffectiveConfig
+	require.NoError(t, json.Unmarshal(out.Bytes(), &effective))
+	require.Equal(t, []string{HTTPDName, PlainSocketName}, effective.Daemons)
+	require.NotEmpty(t, effective.EnabledFeatures)
+	// Default values are filled in
+	httpDaemon := effective.Configuration.(map[string]interface{})["HTTPDaemon"].(map[string]interface{})
+	require.EqualValues(t, config.GetHTTPD().PerIPLimit, httpDaemon["PerIPLimit"])
+	// Endpoints and filters are wired
+	httpWiring := effective.Wiring[HTTPDName]
+	require.True(t, strings.HasPrefix(httpWiring.Endpoints["/gitlab"], "*handler.HandleGitlabBrowser"), httpWiring.Endpoints)
+	require.True(t, strings.HasPrefix(httpWiring.Endpoints["/my/dir"], "directory /tmp/test-laitos-dir"), httpWiring.Endpoints)
+	require.Equal(t, "PINAndShortcuts(passwords=1, shortcuts=1)", httpWiring.CommandFilters[0])
+	require.Contains(t, httpWiring.ResultFilters[0], "LintText(")
+	require.NotEmpty(t, effective.Wiring[PlainSocketName].CommandFilters)
+}
@@ -0,0 +1,161 @@
+package launcher
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	/*
+		DaemonReadinessTimeoutSec is the maximum amount of time a daemon waits for its prerequisite daemons to become
+		ready. After the timeout the daemon starts regardless, as it may still operate in a degraded manner.
+	*/
+	DaemonReadinessTimeoutSec = 60
+	// DaemonReadinessPollIntervalMilli is the interval at which a prerequisite daemon is checked for readiness.
+	DaemonReadinessPollIntervalMilli = 200
+)
+
+/*
+DaemonDependencies declares the prerequisite daemons of each daemon. When both a daemon and its prerequisites are
+enabled, the daemon is started only after its prerequisites are ready to serve. A prerequisite that is not enabled is
+not waited for.
+*/
+var DaemonDependencies = map[string][]string{
+	// sockd and httpproxy use the DNS daemon's blacklist to refuse connections to advertising and malware domains.
+	SOCKDName:     {DNSDName},
+	HTTPProxyName: {DNSDName},
+}
+
+/*
+OrderDaemons returns the daemon names sorted so that each daemon comes after its prerequisites. Daemons that do not
+depend on one another keep their relative order from the input. An error is returned if the dependencies are circular.
+*/
+func OrderDaemons(daemonNames []string, dependencies map[string][]string) ([]string, error) {
+	enabled := make(map[string]bool)
+	for _, name := range daemonNames {
+		enabled[name] = true
+	}
+	ordered := make([]string, 0, len(daemonNames))
+	// Each daemon is either unvisited (absent), being visited (false), or visited (true).
+	visited := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if done, seen := visited[name]; seen {
+			if !done {
+				return fmt.Errorf("OrderDaemons: circular dependency among daemons %v", append(path, name))
+			}
+			return nil
+		}
+		visited[name] = false
+		for _, prerequisite := range dependencies[name] {
+			if !enabled[prerequisite] {
+				continue
+			}
+			if err := visit(prerequisite, append(path, name)); err != nil {
+				return err
+			}
+		}
+		visited[name] = true
+		ordered = append(ordered, name)
+		return nil
+	}
+	for _, name := range daemonNames {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+/*
+DaemonStarter starts daemons in the order of their dependencies, each in its own goroutine. A daemon with enabled
+prerequisites waits for all of them to become ready before it starts, while the other daemons start right away.
+*/
+type DaemonStarter struct {
+	// Dependencies declares the prerequisite daemons of each daemon. It defaults to DaemonDependencies.
+	Dependencies map[string][]string
+	// IsReady returns true only if the daemon is ready to serve. The daemons without a readiness probe should be
+	// reported ready as soon as they are started.
+	IsReady func(daemonName string) bool
+	// Start runs the daemon and blocks until the daemon stops.
+	Start func(daemonName string)
+	// TimeoutSec is the maximum amount of time to wait for prerequisites. It defaults to DaemonReadinessTimeoutSec.
+	TimeoutSec int
+	// Logger is used to log startup progress.
+	Logger *lalog.Logger
+}
+
+/*
+StartAll starts the daemons in background goroutines in the order of their dependencies. It returns a wait group that
+is done when every daemon has been started (i.e. its prerequisites are ready or have timed out).
+*/
+func (starter *DaemonStarter) StartAll(daemonNames []string) (*sync.WaitGroup, error) {
+	if starter.Dependencies == nil {
+		starter.Dependencies = DaemonDependencies
+	}
+	if starter.TimeoutSec < 1 {
+		starter.TimeoutSec = DaemonReadinessTimeoutSec
+	}
+	if starter.Logger == nil {
+		starter.Logger = &lalog.Logger{ComponentName: "DaemonStarter"}
+	}
+	ordered, err := OrderDaemons(daemonNames, starter.Dependencies)
+	if err != nil {
+		return nil, err
+	}
+	enabled := make(map[string]bool)
+	for _, name := range ordered {
+		enabled[name] = true
+	}
+	started := new(sync.WaitGroup)
+	for _, name := range ordered {
+		prerequisites := make([]string, 0)
+		for _, prerequisite := range starter.Dependencies[name] {
+			if enabled[prerequisite] {
+				prerequisites = append(prerequisites, prerequisite)
+			}
+		}
+		sort.Strings(prerequisites)
+		started.Add(1)
+		go func(name string, prerequisites []string) {
+			starter.waitForPrerequisites(name, prerequisites)
+			started.Done()
+			starter.Start(name)
+		}(name, prerequisites)
+	}
+	return started, nil
+}
+
+// waitForPrerequisites blocks until all prerequisites of the daemon are ready, or until the readiness timeout elapses.
+func (starter *DaemonStarter) waitForPrerequisites(daemonName string, prerequisites []string) {
+	if len(prerequisites) == 0 {
+		return
+	}
+	starter.Logger.Info(daemonName, nil, "waiting for prerequisite daemons %v to become ready", prerequisites)
+	deadline := time.Now().Add(time.Duration(starter.TimeoutSec) * time.Second)
+	for _, prerequisite := range prerequisites {
+		for !starter.IsReady(prerequisite) {
+			if time.Now().After(deadline) {
+				starter.Logger.Warning(daemonName, nil, "prerequisite daemon %s is still not ready after %d seconds, starting anyway", prerequisite, starter.TimeoutSec)
+				return
+			}
+			time.Sleep(DaemonReadinessPollIntervalMilli * time.Millisecond)
+		}
+	}
+}
+
+/*
+IsDaemonReady returns true only if the daemon is ready to serve. Daemons that others depend on provide a readiness probe,
+all other daemons are considered ready.
+*/
+func (config *Config) IsDaemonReady(daemonName string) bool {
+	switch daemonName {
+	case DNSDName:
+		return config.GetDNSD().IsRunning()
+	}
+	return true
+}
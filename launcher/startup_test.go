@@ -0,0 +1,76 @@
+package launcher
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOrderDaemons(t *testing.T) {
+	ordered, err := OrderDaemons([]string{SOCKDName, HTTPDName, HTTPProxyName, DNSDName}, DaemonDependencies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ordered, []string{DNSDName, SOCKDName, HTTPDName, HTTPProxyName}) {
+		t.Fatal(ordered)
+	}
+	// Prerequisites that are not enabled are ignored.
+	ordered, err = OrderDaemons([]string{SOCKDName, HTTPDName}, DaemonDependencies)
+	if err != nil || !reflect.DeepEqual(ordered, []string{SOCKDName, HTTPDName}) {
+		t.Fatal(ordered, err)
+	}
+	// Circular dependencies are rejected.
+	if _, err := OrderDaemons([]string{"a", "b", "c"}, map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}}); err == nil {
+		t.Fatal("did not detect circular dependency")
+	}
+}
+
+func TestDaemonStarter(t *testing.T) {
+	var dnsdReady int32
+	startMutex := new(sync.Mutex)
+	startSequence := make([]string, 0)
+	starter := &DaemonStarter{
+		IsReady: func(daemonName string) bool {
+			return daemonName != DNSDName || atomic.LoadInt32(&dnsdReady) == 1
+		},
+		Start: func(daemonName string) {
+			startMutex.Lock()
+			startSequence = append(startSequence, daemonName)
+			startMutex.Unlock()
+			if daemonName == DNSDName {
+				time.Sleep(500 * time.Millisecond)
+				atomic.StoreInt32(&dnsdReady, 1)
+			}
+		},
+	}
+	started, err := starter.StartAll([]string{SOCKDName, DNSDName, HTTPDName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started.Wait()
+	// Give the last daemon a moment to be recorded.
+	time.Sleep(100 * time.Millisecond)
+	startMutex.Lock()
+	defer startMutex.Unlock()
+	if len(startSequence) != 3 || startSequence[2] != SOCKDName {
+		t.Fatal(startSequence)
+	}
+
+	// A prerequisite that never becomes ready does not hold back the dependent daemon forever.
+	starter = &DaemonStarter{
+		IsReady:    func(string) bool { return false },
+		Start:      func(string) {},
+		TimeoutSec: 1,
+	}
+	begin := time.Now()
+	started, err = starter.StartAll([]string{DNSDName, HTTPProxyName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	started.Wait()
+	if elapsed := time.Since(begin); elapsed < time.Second || elapsed > 3*time.Second {
+		t.Fatal(elapsed)
+	}
+}
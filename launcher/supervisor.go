@@ -1,17 +1,22 @@
 package launcher
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/maintenance"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/platform"
+	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
 const (
@@ -30,6 +35,7 @@ const (
 	SMTPDName         = "smtpd"
 	SNMPDName         = "snmpd"
 	SOCKDName         = "sockd"
+	SSHDName          = "sshd"
 	TelegramName      = "telegram"
 	AutoUnlockName    = "autounlock"
 	PhoneHomeName     = "phonehome"
@@ -45,13 +51,25 @@ const (
 	StartAttemptIntervalSec = 30
 	// MemoriseOutputCapacity is the size of laitos main program output to memorise for notification purpose.
 	MemoriseOutputCapacity = 4 * 1024
+	/*
+		CallAfterRapidFailures is the number of consecutive failures, each occurring within FailureThresholdSec of the
+		previous start attempt, that prompt the supervisor to place notification voice calls.
+	*/
+	CallAfterRapidFailures = 3
+	// NotificationCallTimeoutSec is the timeout of Twilio API call that places each notification voice call.
+	NotificationCallTimeoutSec = 30
+	/*
+		SelfUpdateProbationSec is the amount of time an updated main program must run without crashing before the
+		supervisor confirms the update. Should the updated program crash earlier, the previous executable is restored.
+	*/
+	SelfUpdateProbationSec = 5 * 60
 )
 
 // AllDaemons is an unsorted list of string daemon names.
 var AllDaemons = []string{
 	AutoUnlockName, DNSDName, HTTPDName, InsecureHTTPDName, MaintenanceName, PhoneHomeName,
 	PlainSocketName, SimpleIPSvcName, SMTPDName, SNMPDName, SOCKDName, TelegramName,
-	PasswdRPCName, HTTPProxyName,
+	PasswdRPCName, HTTPProxyName, SSHDName,
 }
 
 /*
@@ -74,12 +92,71 @@ daemons, and all daemons will be re-enabled, the user will have to make diagnosi
 var ShedOrder = []string{
 	MaintenanceName,                // 1
 	SimpleIPSvcName, PasswdRPCName, // 2
-	SNMPDName, HTTPProxyName, DNSDName, // 3
+	SNMPDName, HTTPProxyName, DNSDName, SSHDName, // 3
 	SOCKDName, SMTPDName, HTTPDName, // 4
 	InsecureHTTPDName, PlainSocketName, TelegramName, PhoneHomeName, // 5
 	// Never shed - AutoUnlockName
 }
 
+/*
+ShedPolicy customises the order in which the supervisor sheds daemons and program flags when the main program crashes
+rapidly and repeatedly.
+*/
+type ShedPolicy struct {
+	/*
+		ShedOrder are the daemon names to be shed first, one after another, in the order of appearance. The daemons absent
+		from this list are shed afterwards in the order of the default ShedOrder.
+	*/
+	ShedOrder []string `json:"ShedOrder"`
+	// NeverShed are the daemon names to be kept online throughout all rounds of shedding.
+	NeverShed []string `json:"NeverShed"`
+	/*
+		KeepFlags are the names of program flags (e.g. "gomaxprocs") to be kept when the supervisor drops the
+		non-essential flags. The flags "-config" and "-awslambda" are always kept.
+	*/
+	KeepFlags []string `json:"KeepFlags"`
+}
+
+// GetShedOrder returns the complete sequence of daemon names to shed, with the never-shed daemons removed.
+func (policy ShedPolicy) GetShedOrder() []string {
+	ret := make([]string, 0, len(AllDaemons))
+	seen := make(map[string]struct{})
+	for _, name := range append(append([]string{}, policy.ShedOrder...), ShedOrder...) {
+		if _, exists := seen[name]; exists {
+			continue
+		}
+		seen[name] = struct{}{}
+		var neverShed bool
+		for _, keep := range policy.NeverShed {
+			if name == keep {
+				neverShed = true
+				break
+			}
+		}
+		if !neverShed {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// Validate returns an error if the policy refers to an unknown daemon name.
+func (policy ShedPolicy) Validate() error {
+	for _, name := range append(append([]string{}, policy.ShedOrder...), policy.NeverShed...) {
+		var known bool
+		for _, daemon := range AllDaemons {
+			if name == daemon {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("ShedPolicy.Validate: unrecognised daemon name \"%s\"", name)
+		}
+	}
+	return nil
+}
+
 /*
 RemoveFromFlags removes CLI flag from input flags, eligibility for removal is determined by the input function.
 The flags must not contain the executable path in its first element.
@@ -122,18 +199,31 @@ helping healthy daemons to stay online as long as possible.
 type Supervisor struct {
 	// CLIFlags are the thorough list of original program flags to launch laitos. This must not include the leading executable path.
 	CLIFlags []string
+	// Subcommand is the program subcommand (e.g. "serve") that precedes the flags, or empty if the flags are used without a subcommand.
+	Subcommand string
 	// NotificationRecipients are the mail address that will receive notification emails generated by this supervisor.
 	NotificationRecipients []string
 	// MailClient is used for sending notification emails.
 	MailClient inet.MailClient
+	// NotificationPhoneNumbers are the phone numbers that will receive a voice call when main program fails repeatedly.
+	NotificationPhoneNumbers []string
+	// Twilio is used for placing notification voice calls.
+	Twilio *toolbox.Twilio
 	// DaemonNames are the original set of daemon names that user asked to start.
 	DaemonNames []string
+	// ShedPolicy customises the order of shedding daemons and the program flags to keep.
+	ShedPolicy ShedPolicy
 	// shedSequence is the sequence at which daemon shedding takes place. Each latter array has one daemon less than the previous.
 	shedSequence [][]string
 	// mainStdout keeps last several KB of program stdout content for failure notification and forwards everything to stdout.
 	mainStdout *lalog.ByteLogWriter
 	// mainStderr keeps last several KB of program stderr content for failure notification and forward everything to stderr.
 	mainStderr *lalog.ByteLogWriter
+	// rapidFailures is the number of consecutive failures that occurred in short succession.
+	rapidFailures int
+	// mainProcess is the running main program, it is nil while the main program is not running.
+	mainProcess      *os.Process
+	mainProcessMutex sync.Mutex
 
 	logger *lalog.Logger
 }
@@ -153,7 +243,10 @@ func (sup *Supervisor) initialise() {
 	// Construct daemon shedding sequence
 	sup.shedSequence = make([][]string, 0, len(sup.DaemonNames))
 	remainingDaemons := sup.DaemonNames
-	for _, toShed := range ShedOrder {
+	if err := sup.ShedPolicy.Validate(); err != nil {
+		sup.logger.Warning("", err, "the shedding policy refers to unknown daemons, they will be ignored")
+	}
+	for _, toShed := range sup.ShedPolicy.GetShedOrder() {
 		// Do not shed the very last daemon
 		if len(remainingDaemons) == 1 {
 			break
@@ -176,7 +269,7 @@ func (sup *Supervisor) initialise() {
 }
 
 // notifyFailure sends an Email notification to inform administrator about a main program crash or launch failure.
-func (sup *Supervisor) notifyFailure(cliFlags []string, launchErr error) {
+func (sup *Supervisor) notifyFailure(cliFlags []string, launchErr error, shedding string) {
 	if !sup.MailClient.IsConfigured() || sup.NotificationRecipients == nil || len(sup.NotificationRecipients) == 0 {
 		sup.logger.Warning("", nil, "will not send Email notification due to missing recipients or mail client config")
 		return
@@ -190,6 +283,8 @@ Failure: %v
 
 CLI flags used to launch laitos main program: %v
 
+Capabilities shed for the next start: %s
+
 Supervisor process and  system information summary: %s
 
 Latest stdout: %s
@@ -198,6 +293,7 @@ Latest stderr: %s
 `,
 		launchErr,
 		cliFlags,
+		shedding,
 		summary.String(),
 		string(sup.mainStdout.Retrieve(false)),
 		string(sup.mainStderr.Retrieve(false)))
@@ -210,6 +306,60 @@ Latest stderr: %s
 	}
 }
 
+/*
+recordFailure updates the count of consecutive failures that occurred in short succession, and returns true if the
+count has just reached the threshold of placing notification voice calls.
+*/
+func (sup *Supervisor) recordFailure(rapid bool) bool {
+	if rapid {
+		sup.rapidFailures++
+	} else {
+		sup.rapidFailures = 1
+	}
+	return sup.rapidFailures == CallAfterRapidFailures
+}
+
+// notifyFailureByCall places a voice call to each notification phone number to inform administrator about repeated failures.
+func (sup *Supervisor) notifyFailureByCall(launchErr error) {
+	if sup.Twilio == nil || !sup.Twilio.IsConfigured() || len(sup.NotificationPhoneNumbers) == 0 {
+		sup.logger.Warning("", nil, "will not place notification call due to missing phone numbers or Twilio config")
+		return
+	}
+	hostName, _ := os.Hostname()
+	message := fmt.Sprintf("laitos supervisor on %s has detected %d failures in a row. The latest failure is: %s",
+		hostName, sup.rapidFailures, lalog.LintString(fmt.Sprint(launchErr), 200))
+	for _, phoneNumber := range sup.NotificationPhoneNumbers {
+		if err := sup.Twilio.DeliverVoiceCall(context.Background(), NotificationCallTimeoutSec, phoneNumber, message); err != nil {
+			sup.logger.Warning(phoneNumber, err, "failed to place failure notification call")
+		}
+	}
+}
+
+// rollbackSelfUpdate restores the previous executable if the main program fails shortly after a self update.
+func (sup *Supervisor) rollbackSelfUpdate(executablePath string) {
+	if rolledBack, err := maintenance.RollbackSelfUpdate(executablePath); err != nil {
+		sup.logger.Warning(executablePath, err, "failed to roll back the self update")
+	} else if rolledBack {
+		sup.logger.Warning(executablePath, nil, "rolled back the self update after main program failed")
+	}
+}
+
+// confirmSelfUpdateAfterProbation confirms a pending self update if main program keeps running throughout the probation.
+func (sup *Supervisor) confirmSelfUpdateAfterProbation(executablePath string, mainExited <-chan struct{}) {
+	if !maintenance.SelfUpdatePending(executablePath) {
+		return
+	}
+	select {
+	case <-time.After(SelfUpdateProbationSec * time.Second):
+		if err := maintenance.ConfirmSelfUpdate(executablePath); err != nil {
+			sup.logger.Warning(executablePath, err, "failed to confirm the self update")
+		} else {
+			sup.logger.Info(executablePath, nil, "confirmed the self update after main program ran successfully")
+		}
+	case <-mainExited:
+	}
+}
+
 // FeedDecryptionPasswordToStdinAndStart starts the main program and writes the universal decryption password into its stdin.
 func FeedDecryptionPasswordToStdinAndStart(decryptionPassword string, cmd *exec.Cmd) error {
 	// Start laitos main program
@@ -231,7 +381,8 @@ func FeedDecryptionPasswordToStdinAndStart(decryptionPassword string, cmd *exec.
 Start will fork and launch laitos main program and restarts it in case of crash.
 If consecutive crashes occur within 20 minutes, each crash will lead to reduced set of daemons being restarted
 with the main program. If Email notification recipients are configured, a crash report will be delivered to those
-recipients.
+recipients. If notification phone numbers are configured, repeated crashes in short succession will prompt a voice
+call to those numbers.
 The function blocks caller indefinitely.
 */
 func (sup *Supervisor) Start() {
@@ -247,29 +398,56 @@ func (sup *Supervisor) Start() {
 	for {
 		cliFlags, _ := sup.GetLaunchParameters(paramChoice)
 		sup.logger.Info(strconv.Itoa(paramChoice), nil, "attempting to start main program with CLI flags - %v", cliFlags)
+		if paramChoice > 0 {
+			sup.logger.Warning(strconv.Itoa(paramChoice), nil, "capabilities shed for this start: %s", sup.DescribeShedding(paramChoice))
+		}
 
+		if sup.Subcommand != "" {
+			cliFlags = append([]string{sup.Subcommand}, cliFlags...)
+		}
 		mainProgram := exec.Command(executablePath, cliFlags...)
+		mainProgram.Env = append(os.Environ(), misc.EnvironmentSupervised+"=true")
 		mainProgram.Stdout = sup.mainStdout
 		mainProgram.Stderr = sup.mainStderr
 		if err := FeedDecryptionPasswordToStdinAndStart(misc.ProgramDataDecryptionPassword, mainProgram); err != nil {
 			sup.logger.Warning(strconv.Itoa(paramChoice), err, "failed to start main program")
+			sup.rollbackSelfUpdate(executablePath)
 			// Avoid incidentally overwhelming the user with notification emails
 			time.Sleep(StartAttemptIntervalSec * time.Second)
-			sup.notifyFailure(cliFlags, err)
-			if time.Now().Unix()-lastAttemptTime < FailureThresholdSec {
+			rapid := time.Now().Unix()-lastAttemptTime < FailureThresholdSec
+			if rapid {
 				paramChoice++
 			}
+			sup.notifyFailure(cliFlags, err, sup.DescribeShedding(paramChoice))
+			if sup.recordFailure(rapid) {
+				sup.notifyFailureByCall(err)
+			}
 			continue
 		}
 		lastAttemptTime = time.Now().Unix()
-		if err := mainProgram.Wait(); err != nil {
+		sup.mainProcessMutex.Lock()
+		sup.mainProcess = mainProgram.Process
+		sup.mainProcessMutex.Unlock()
+		mainExited := make(chan struct{})
+		go sup.confirmSelfUpdateAfterProbation(executablePath, mainExited)
+		err := mainProgram.Wait()
+		close(mainExited)
+		sup.mainProcessMutex.Lock()
+		sup.mainProcess = nil
+		sup.mainProcessMutex.Unlock()
+		if err != nil {
 			sup.logger.Warning(strconv.Itoa(paramChoice), err, "main program has crashed")
+			sup.rollbackSelfUpdate(executablePath)
 			// Avoid incidentally overwhelming the user with notification emails
 			time.Sleep(StartAttemptIntervalSec * time.Second)
-			sup.notifyFailure(cliFlags, err)
-			if time.Now().Unix()-lastAttemptTime < FailureThresholdSec {
+			rapid := time.Now().Unix()-lastAttemptTime < FailureThresholdSec
+			if rapid {
 				paramChoice++
 			}
+			sup.notifyFailure(cliFlags, err, sup.DescribeShedding(paramChoice))
+			if sup.recordFailure(rapid) {
+				sup.notifyFailureByCall(err)
+			}
 			time.Sleep(StartAttemptIntervalSec * time.Second)
 			continue
 		}
@@ -277,6 +455,21 @@ func (sup *Supervisor) Start() {
 	}
 }
 
+// ReloadMainProgram asks the running main program to reload its configuration by sending it SIGHUP.
+func (sup *Supervisor) ReloadMainProgram() {
+	sup.mainProcessMutex.Lock()
+	defer sup.mainProcessMutex.Unlock()
+	if sup.mainProcess == nil {
+		lalog.DefaultLogger.Warning("supervisor", nil, "the main program is not running, its configuration cannot be reloaded at the moment")
+		return
+	}
+	if err := sup.mainProcess.Signal(syscall.SIGHUP); err != nil {
+		sup.logger.Warning("", err, "failed to ask the main program to reload its configuration")
+		return
+	}
+	sup.logger.Info("", nil, "asked the main program (PID %d) to reload its configuration", sup.mainProcess.Pid)
+}
+
 /*
 GetLaunchParameters returns the parameters used for launching laitos program for the N-th attempt.
 The very first attempt is the 0th attempt.
@@ -297,18 +490,18 @@ func (sup *Supervisor) GetLaunchParameters(nthAttempt int) (cliFlags []string, d
 	}
 	if nthAttempt >= 1 {
 		/*
-			The second attempt removes all but essential program flag (-config, -awslambda), this means system environment
-			will not be altered by the advanced start option such as -gomaxprocs.
+			The second attempt removes all but essential program flag (-config, -profile, -awslambda), this means system
+			environment will not be altered by the advanced start option such as -gomaxprocs.
 		*/
 		cliFlags = RemoveFromFlags(func(f string) bool {
-			return !strings.HasPrefix(f, "-"+ConfigFlagName) && !strings.HasPrefix(f, "-"+LambdaFlagName)
+			return !strings.HasPrefix(f, "-"+ConfigFlagName) && !strings.HasPrefix(f, "-"+ProfileFlagName) && !strings.HasPrefix(f, "-"+LambdaFlagName) && !sup.isKeptFlag(f)
 		}, cliFlags)
 	}
-	if nthAttempt > 1 && nthAttempt < len(sup.DaemonNames)+1 {
+	if nthAttempt > 1 && nthAttempt-2 < len(sup.shedSequence) {
 		// More attempts will shed daemons
 		daemonNames = sup.shedSequence[nthAttempt-2]
 	}
-	if nthAttempt > len(sup.DaemonNames)+1 {
+	if nthAttempt > len(sup.shedSequence)+2 {
 		// After shedding daemons, further attempts will not shed any daemons but only remove non-essential flags.
 		copy(cliFlags, sup.CLIFlags)
 		copy(daemonNames, sup.DaemonNames)
@@ -318,3 +511,58 @@ func (sup *Supervisor) GetLaunchParameters(nthAttempt int) (cliFlags []string, d
 	cliFlags = append(cliFlags, "-"+DaemonsFlagName, strings.Join(daemonNames, ","))
 	return
 }
+
+// isKeptFlag returns true if the program flag (e.g. "-gomaxprocs=16" or "--gomaxprocs") is among the flags to keep.
+func (sup *Supervisor) isKeptFlag(flag string) bool {
+	name := strings.TrimLeft(flag, "-")
+	if equalSign := strings.IndexRune(name, '='); equalSign != -1 {
+		name = name[:equalSign]
+	}
+	for _, keep := range sup.ShedPolicy.KeepFlags {
+		if name == strings.TrimLeft(keep, "-") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+DescribeShedding returns a human-readable description of the daemons and program flags that are shed for the N-th
+attempt of starting the main program, in contrast to the original launch parameters.
+*/
+func (sup *Supervisor) DescribeShedding(nthAttempt int) string {
+	cliFlags, daemonNames := sup.GetLaunchParameters(nthAttempt)
+	shedDaemons := make([]string, 0)
+	for _, original := range sup.DaemonNames {
+		var kept bool
+		for _, name := range daemonNames {
+			if name == original {
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			shedDaemons = append(shedDaemons, original)
+		}
+	}
+	droppedFlags := make([]string, 0)
+	for _, original := range sup.CLIFlags {
+		if !strings.HasPrefix(original, "-") || strings.HasPrefix(original, "-"+SupervisorFlagName) {
+			continue
+		}
+		var kept bool
+		for _, flag := range cliFlags {
+			if flag == original {
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			droppedFlags = append(droppedFlags, original)
+		}
+	}
+	if len(shedDaemons) == 0 && len(droppedFlags) == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("daemons [%s], flags [%s]", strings.Join(shedDaemons, ", "), strings.Join(droppedFlags, ", "))
+}
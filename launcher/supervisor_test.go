@@ -116,3 +116,85 @@ func TestSupervisor_GetLaunchParameters(t *testing.T) {
 		}
 	}
 }
+
+func TestSupervisor_ShedPolicy(t *testing.T) {
+	if err := (ShedPolicy{ShedOrder: []string{"doesnotexist"}}).Validate(); err == nil {
+		t.Fatal("did not reject unknown daemon")
+	}
+	if err := (ShedPolicy{NeverShed: []string{"doesnotexist"}}).Validate(); err == nil {
+		t.Fatal("did not reject unknown daemon")
+	}
+	policy := ShedPolicy{
+		ShedOrder: []string{TelegramName, SMTPDName},
+		NeverShed: []string{HTTPDName},
+		KeepFlags: []string{"gomaxprocs", "-debug"},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if order := policy.GetShedOrder(); !reflect.DeepEqual(order[:3], []string{TelegramName, SMTPDName, MaintenanceName}) || len(order) != len(ShedOrder)-1 {
+		t.Fatal(order)
+	}
+
+	originalCLIFlags := []string{"-awslambda", "-debug=false", "-tunesystem", "-gomaxprocs", "16", "-config", "config.json", "-profile", "travel", "-daemons", "httpd,maintenance,smtpd,telegram,dnsd"}
+	sup := &Supervisor{CLIFlags: originalCLIFlags, DaemonNames: []string{"httpd", "maintenance", "smtpd", "telegram", "dnsd"}, ShedPolicy: policy}
+	sup.initialise()
+	// HTTP daemon is never shed
+	shedSequenceMatch := [][]string{
+		{"httpd", "maintenance", "smtpd", "dnsd"},
+		{"httpd", "maintenance", "dnsd"},
+		{"httpd", "dnsd"},
+		{"httpd"},
+	}
+	if !reflect.DeepEqual(shedSequenceMatch, sup.shedSequence) {
+		t.Fatal(sup.shedSequence)
+	}
+	if desc := sup.DescribeShedding(0); desc != "none" {
+		t.Fatal(desc)
+	}
+	// The kept flags and the configuration profile survive
+	flags, _ := sup.GetLaunchParameters(1)
+	if !reflect.DeepEqual(flags, []string{"-awslambda", "-debug=false", "-gomaxprocs", "16", "-config", "config.json", "-profile", "travel", "-supervisor=false", "-daemons", "httpd,maintenance,smtpd,telegram,dnsd"}) {
+		t.Fatal(flags)
+	}
+	if desc := sup.DescribeShedding(1); desc != "daemons [], flags [-tunesystem]" {
+		t.Fatal(desc)
+	}
+	if desc := sup.DescribeShedding(3); desc != "daemons [smtpd, telegram], flags [-tunesystem]" {
+		t.Fatal(desc)
+	}
+	// Shed all but the never-shed daemon, then restore the daemons
+	if _, daemons := sup.GetLaunchParameters(5); !reflect.DeepEqual(daemons, []string{"httpd"}) {
+		t.Fatal(daemons)
+	}
+	if _, daemons := sup.GetLaunchParameters(6); !reflect.DeepEqual(daemons, sup.DaemonNames) {
+		t.Fatal(daemons)
+	}
+	if desc := sup.DescribeShedding(7); desc != "none" {
+		t.Fatal(desc)
+	}
+}
+
+func TestSupervisor_RecordFailure(t *testing.T) {
+	sup := &Supervisor{}
+	sup.initialise()
+	// The first failure is never considered rapid, as it comes after a successful start.
+	if sup.recordFailure(false) || sup.recordFailure(true) {
+		t.Fatal("should not call too early")
+	}
+	if !sup.recordFailure(true) {
+		t.Fatal("should call after reaching the threshold")
+	}
+	// Only call once for the consecutive failures.
+	if sup.recordFailure(true) {
+		t.Fatal("should not call again")
+	}
+	// The count starts over after a slow failure.
+	if sup.recordFailure(false) || sup.recordFailure(true) || !sup.recordFailure(true) {
+		t.Fatal("should call after reaching the threshold again")
+	}
+	// Without phone numbers or Twilio configuration, it simply must not panic.
+	sup.notifyFailureByCall(nil)
+	sup.NotificationPhoneNumbers = []string{"+123"}
+	sup.notifyFailureByCall(nil)
+}
@@ -20,11 +20,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/HouzuoGuo/laitos/cli"
 	"github.com/HouzuoGuo/laitos/daemon/httpd"
@@ -44,72 +48,116 @@ var (
 	logger        = &lalog.Logger{ComponentName: "main", ComponentID: []lalog.LoggerIDField{{Key: "PID", Value: os.Getpid()}}}
 )
 
-/*
-main runs one of several distinct routines according to the presented combination of command line flags:
-
-- Maintain encrypted program data files: -datautil=encrypt|decrypt
+// configOptions are the flags that locate and decrypt the program configuration.
+type configOptions struct {
+	profile               string
+	passwordUnlockServers string
+	pwdServer             bool
+	pwdServerPort         int
+	pwdServerURL          string
+}
 
-  - Launch an AWS Lambda handler that proxies HTTP requests to laitos web server: -awslambda=true
-    This routine handles the requests in an independent goroutine, it is compatible with supervisor but incompatible with "-pwdserver".
+func (opts *configOptions) defineFlags(flags *flag.FlagSet) {
+	flags.StringVar(&misc.ConfigFilePath, launcher.ConfigFlagName, "", "(Mandatory) path to configuration file in JSON syntax")
+	flags.StringVar(&opts.profile, launcher.ProfileFlagName, "", "(Optional) name of the configuration profile to apply on top of the base configuration")
+	flags.StringVar(&opts.passwordUnlockServers, "passwordunlockservers", "", "(Optional) comma-separated list of server:port combos that offer password unlocking service (daemon \"passwdrpc\") over gRPC")
+	// Decryption password collector (password input server) flags
+	flags.BoolVar(&opts.pwdServer, passwdserver.CLIFlag, false, "(Optional) launch web server to accept password for decrypting encrypted program data")
+	flags.IntVar(&opts.pwdServerPort, passwdserver.CLIFlag+"port", 80, "(Optional) port number of the password web server")
+	flags.StringVar(&opts.pwdServerURL, passwdserver.CLIFlag+"url", "", "(Optional) password input URL")
+}
 
-  - Launch a supervisor that automatically restarts laitos main process in case of crash: -supervisor=true (already true by default)
-    This is the routine of choice for launching laitos as an OS daemon service.
+// readConfig reads unencrypted configuration data from environment variable, or possibly encrypted configuration from JSON file.
+func (opts *configOptions) readConfig() (config launcher.Config) {
+	if err := config.DeserialiseProfileFromJSON(cli.GetConfig(logger, opts.pwdServer, opts.pwdServerPort, opts.pwdServerURL, opts.passwordUnlockServers), opts.profile); err != nil {
+		logger.Abort(nil, err, "failed to retrieve/deserialise program configuration")
+	}
+	return
+}
 
-  - Launch all specified daemons: -config c.json -daemons httpd,smtpd... -supervisor=false
-    Supervisor launches laitos main process this way.
+// serveOptions are the flags of the routine that launches daemons.
+type serveOptions struct {
+	configOptions
+	daemonList                          string
+	disableConflicts, debug, dumpConfig bool
+	awsLambda, isSupervisor             bool
+	gomaxprocs                          int
+	// Program integrity attestation
+	integrityManifest, integrityPubKey string
+	integrityEnforce                   bool
+}
 
-  - Launch a benchmark routine that feeds random input to (nearly) all started daemons: -benchmark=true
-    This routine is occasionally used for fuzzy-test daemons.
-*/
-func main() {
-	hzgl.HZGL()
-	// Process command line flags
-	var daemonList, passwordUnlockServers string
-	var disableConflicts, debug, awsLambda bool
-	var gomaxprocs int
-	flag.StringVar(&misc.ConfigFilePath, launcher.ConfigFlagName, "", "(Mandatory) path to configuration file in JSON syntax")
-	flag.StringVar(&daemonList, launcher.DaemonsFlagName, "", "(Mandatory) comma-separated list of daemon names to start (autounlock, dnsd, httpd, httpproxy, insecurehttpd, maintenance, passwdrpc, phonehome, plainsocket, simpleipsvcd, smtpd, snmpd, sockd, telegram)")
-	flag.BoolVar(&awsLambda, launcher.LambdaFlagName, false, "(Optional) run AWS Lambda handler to proxy HTTP requests to laitos web server")
+func (opts *serveOptions) defineFlags(flags *flag.FlagSet) {
+	opts.configOptions.defineFlags(flags)
+	flags.StringVar(&opts.daemonList, launcher.DaemonsFlagName, "", "(Mandatory unless the configuration profile selects the daemons) comma-separated list of daemon names to start ("+strings.Join(sortedDaemonNames(), ", ")+")")
+	flags.BoolVar(&opts.dumpConfig, launcher.DumpConfigFlagName, false, "(Optional) print the effective configuration (secrets masked) and wiring of the daemons (-daemons) in JSON, and then exit")
 	// Internal supervisor flag
-	var isSupervisor = true
-	flag.BoolVar(&isSupervisor, launcher.SupervisorFlagName, true, "(Internal use only) launch a supervisor process to auto-restart laitos main process in case of crash")
+	flags.BoolVar(&opts.isSupervisor, launcher.SupervisorFlagName, true, "(Internal use only) launch a supervisor process to auto-restart laitos main process in case of crash")
 	// Auxiliary features
-	flag.BoolVar(&disableConflicts, "disableconflicts", false, "(Optional) automatically stop and disable other daemon programs that may cause port usage conflicts")
-	flag.StringVar(&passwordUnlockServers, "passwordunlockservers", "", "(Optional) comma-separated list of server:port combos that offer password unlocking service (daemon \"passwdrpc\") over gRPC")
+	flags.BoolVar(&opts.disableConflicts, "disableconflicts", false, "(Optional) automatically stop and disable other daemon programs that may cause port usage conflicts")
+	flags.StringVar(&opts.integrityManifest, "integritymanifest", "", "(Optional) path to the signed manifest of program file hashes, verified before the program starts")
+	flags.StringVar(&opts.integrityPubKey, "integritypubkey", "", "(Optional) base64-encoded ed25519 public key that verifies the integrity manifest signature")
+	flags.BoolVar(&opts.integrityEnforce, "integrityenforce", false, "(Optional) refuse to start if the program files do not match the integrity manifest")
 	// Optional integration features
-	flag.BoolVar(&misc.EnableAWSIntegration, "awsinteg", false, "(Optional) activate all points of integration with various AWS services such as sending warning log entries to SQS")
-	flag.BoolVar(&misc.EnablePrometheusIntegration, "prominteg", false, "(Optional) activate all points of integration with Prometheus such as collecting performance metrics and serving them over HTTP")
+	flags.Var(featureFlagValue{misc.AWSIntegration}, "awsinteg", "(Optional) activate all points of integration with various AWS services such as sending warning log entries to SQS")
+	flags.Var(featureFlagValue{misc.PrometheusIntegration}, "prominteg", "(Optional) activate all points of integration with Prometheus such as collecting performance metrics and serving them over HTTP")
 	// Diagnosis features
-	flag.BoolVar(&debug, "debug", false, "(Optional) print goroutine stack traces upon receiving interrupt signal")
-	flag.IntVar(&pprofHTTPPort, "profhttpport", pprofHTTPPort, "(Optional) serve program profiling data (pprof) over HTTP on this port at localhost")
-	flag.IntVar(&gomaxprocs, "gomaxprocs", 0, "(Optional) set gomaxprocs")
-	// Decryption password collector (password input server) flags
-	var pwdServer bool
-	var pwdServerPort int
-	var pwdServerURL string
-	flag.BoolVar(&pwdServer, passwdserver.CLIFlag, false, "(Optional) launch web server to accept password for decrypting encrypted program data")
-	flag.IntVar(&pwdServerPort, passwdserver.CLIFlag+"port", 80, "(Optional) port number of the password web server")
-	flag.StringVar(&pwdServerURL, passwdserver.CLIFlag+"url", "", "(Optional) password input URL")
-	// Data encryption utility flags
-	var dataUtil, dataUtilFile string
-	flag.StringVar(&dataUtil, "datautil", "", "(Optional) program data encryption utility: encrypt|decrypt")
-	flag.StringVar(&dataUtilFile, "datautilfile", "", "(Optional) program data encryption utility: encrypt/decrypt file location")
-	// TCP-over-DNS proxy client flags.
+	defineDiagnosisFlags(flags, &opts.debug)
+	flags.IntVar(&opts.gomaxprocs, "gomaxprocs", 0, "(Optional) set gomaxprocs")
+}
 
-	var proxyOpts cli.ProxyCLIOptions
-	flag.IntVar(&proxyOpts.Port, "proxyport", 8080, "(TCP-over-DNS optional) override the port of the local HTTP(S) proxy server on 127.0.0.12")
-	flag.BoolVar(&proxyOpts.Debug, "proxydebug", false, "(TCP-over-DNS optional) turn on debug logs")
-	flag.BoolVar(&proxyOpts.EnableDNSRelay, "proxyenablednsrelay", false, "(TCP-over-DNS optional) start a recursive resolver on 127.0.0.12:53 to relay queries to laitos DNS server")
-	flag.StringVar(&proxyOpts.RecursiveResolverAddress, "proxyresolver", "", `(TCP-over-DNS optional) local/public recursive DNS resolver address ("ip:port") or empty for auto detection`)
-	flag.IntVar(&proxyOpts.MaxSegmentLength, "proxyseglen", 0, "(TCP-over-DNS optional) override max segment length")
-	flag.StringVar(&proxyOpts.LaitosDNSName, "proxydnsname", "", "(TCP-over-DNS mandatory) the DNS name of laitos DNS server")
-	flag.StringVar(&proxyOpts.AccessOTPSecret, "proxyotpsecret", "", "(TCP-over-DNS mandatory) authorise connection requests using this OTP secret")
-	flag.BoolVar(&proxyOpts.EnableTXT, "proxyenabletxt", false, "(TCP-over-DNS optional) send TXT queries instead of CNAME queries for higher bandwidth")
-	flag.IntVar(&proxyOpts.DownstreamSegmentLength, "proxydownstreamseglen", 0, "(TCP-over-DNS optional) responder (downstream) maximum segment length")
-
-	flag.Parse()
-
-	// Enable common diagnosis and security features.
+// featureFlagValue lets a boolean command line flag turn a feature flag on or off.
+type featureFlagValue struct {
+	flag *misc.FeatureFlag
+}
+
+func (value featureFlagValue) String() string {
+	return strconv.FormatBool(value.flag != nil && value.flag.IsEnabled())
+}
+
+func (value featureFlagValue) Set(str string) error {
+	enabled, err := strconv.ParseBool(str)
+	if err != nil {
+		return err
+	}
+	value.flag.Set(enabled)
+	return nil
+}
+
+func (featureFlagValue) IsBoolFlag() bool {
+	return true
+}
+
+// defineDiagnosisFlags defines the flags of diagnosis features that are available to all routines.
+func defineDiagnosisFlags(flags *flag.FlagSet, debug *bool) {
+	flags.BoolVar(debug, "debug", false, "(Optional) turn on verbose debug logs and print goroutine stack traces upon receiving interrupt signal")
+	flags.IntVar(&pprofHTTPPort, "profhttpport", pprofHTTPPort, "(Optional) serve program profiling data (pprof) over HTTP on this port at localhost")
+}
+
+// defineProxyFlags defines the flags of TCP-over-DNS proxy client, each flag name begins with the prefix.
+func defineProxyFlags(flags *flag.FlagSet, prefix string, proxyOpts *cli.ProxyCLIOptions) {
+	flags.IntVar(&proxyOpts.Port, prefix+"port", 8080, "(TCP-over-DNS optional) override the port of the local HTTP(S) proxy server on 127.0.0.12")
+	flags.BoolVar(&proxyOpts.EnableDNSRelay, prefix+"enablednsrelay", false, "(TCP-over-DNS optional) start a recursive resolver on 127.0.0.12:53 to relay queries to laitos DNS server")
+	flags.StringVar(&proxyOpts.RecursiveResolverAddress, prefix+"resolver", "", `(TCP-over-DNS optional) local/public recursive DNS resolver address ("ip:port") or empty for auto detection`)
+	flags.IntVar(&proxyOpts.MaxSegmentLength, prefix+"seglen", 0, "(TCP-over-DNS optional) override max segment length")
+	flags.StringVar(&proxyOpts.LaitosDNSName, prefix+"dnsname", "", "(TCP-over-DNS mandatory) the DNS name of laitos DNS server")
+	flags.StringVar(&proxyOpts.AccessOTPSecret, prefix+"otpsecret", "", "(TCP-over-DNS mandatory) authorise connection requests using this OTP secret")
+	flags.BoolVar(&proxyOpts.EnableTXT, prefix+"enabletxt", false, "(TCP-over-DNS optional) send TXT queries instead of CNAME queries for higher bandwidth")
+	flags.IntVar(&proxyOpts.DownstreamSegmentLength, prefix+"downstreamseglen", 0, "(TCP-over-DNS optional) responder (downstream) maximum segment length")
+	flags.StringVar(&proxyOpts.Carrier, prefix+"carrier", "dns", "(TCP-over-DNS optional) transport segments using this carrier (dns, https, icmp)")
+	flags.StringVar(&proxyOpts.CarrierAddress, prefix+"carrieraddr", "", "(TCP-over-DNS optional) laitos server address of https (URL) or icmp (IP) carrier")
+	flags.BoolVar(&proxyOpts.Multiplex, prefix+"mux", false, "(TCP-over-DNS optional) multiplex all proxy connections over a single tunnel to reduce latency")
+}
+
+// sortedDaemonNames returns the names of all daemons in alphabetical order.
+func sortedDaemonNames() []string {
+	names := append([]string{}, launcher.AllDaemons...)
+	sort.Strings(names)
+	return names
+}
+
+// startDiagnosis enables common diagnosis and security features.
+func startDiagnosis(debug bool) {
 	logger.Info(nil, nil, "program startup summary:\n%s", platform.GetProgramStatusSummary(false))
 	platform.LockMemory()
 	cli.ClearDedupBuffersInBackground()
@@ -118,23 +166,201 @@ func main() {
 	if debug {
 		cli.DumpGoroutinesOnInterrupt()
 	}
+}
 
-	// ========================================================================
-	// Non-daemon utility routines - laitos configuration data encryption.
-	// ========================================================================
-	if dataUtil != "" {
-		cli.HandleSecurityDataUtil(dataUtil, dataUtilFile, logger)
-		return
-	}
+/*
+newCommandSet returns the subcommands of the program:
 
-	// ========================================================================
-	// Non-daemon utility routines - TCP-over-DNS client.
-	// ========================================================================
-	if proxyOpts.LaitosDNSName != "" {
-		cli.HandleTCPOverDNSClient(logger, proxyOpts)
-		return
+  - serve: launch a supervisor that automatically restarts laitos main process in case of crash (-supervisor=true, already
+    true by default), the supervisor launches laitos main process to run the specified daemons (-supervisor=false).
+    This is the routine of choice for launching laitos as an OS daemon service.
+
+  - serve -dumpconfig: print the effective configuration and wiring of the specified daemons without starting them.
+
+  - lambda: serve the daemons and launch an AWS Lambda handler that proxies HTTP requests to laitos web server.
+    This routine handles the requests in an independent goroutine, it is compatible with supervisor but incompatible with "-pwdserver".
+
+  - proxy: run the TCP-over-DNS proxy client.
+
+  - datautil: maintain encrypted program data files.
+
+  - console: run app commands typed on the terminal.
+
+  - knock: send a signed knock packet to open the proxy ports of a sockd server to this computer.
+
+  - completion: print the shell completion script.
+
+For backward compatibility, the program flags that are used without a subcommand are the combination of the flags of
+serve, proxy (prefixed by "proxy"), and datautil (-datautil=encrypt|decrypt -datautilfile=FILE), and -awslambda.
+*/
+func newCommandSet() *cli.CommandSet {
+	var serveOpts serveOptions
+	var proxyOpts cli.ProxyCLIOptions
+	var consoleOpts configOptions
+	var knockClientIP string
+	var dataUtil, dataUtilFile string
+	daemonValues := map[string][]string{launcher.DaemonsFlagName: sortedDaemonNames()}
+	proxyValues := map[string][]string{"carrier": {"dns", "https", "icmp"}}
+	set := &cli.CommandSet{Program: "laitos"}
+	set.Commands = []*cli.Command{
+		{
+			Name:        "serve",
+			Summary:     "launch daemons under the protection of a supervisor",
+			DefineFlags: serveOpts.defineFlags,
+			FlagValues:  daemonValues,
+			Run: func(_ *flag.FlagSet) {
+				startDiagnosis(serveOpts.debug)
+				serve(serveOpts, "serve")
+			},
+		},
+		{
+			Name:        "lambda",
+			Summary:     "launch daemons and an AWS Lambda handler that proxies HTTP requests to laitos web server",
+			DefineFlags: serveOpts.defineFlags,
+			FlagValues:  daemonValues,
+			Run: func(_ *flag.FlagSet) {
+				startDiagnosis(serveOpts.debug)
+				serveOpts.awsLambda = true
+				serve(serveOpts, "lambda")
+			},
+		},
+		{
+			Name:    "proxy",
+			Summary: "run TCP-over-DNS proxy client that relays local HTTP(S) proxy traffic via laitos DNS server",
+			DefineFlags: func(flags *flag.FlagSet) {
+				defineProxyFlags(flags, "", &proxyOpts)
+				defineDiagnosisFlags(flags, &proxyOpts.Debug)
+			},
+			FlagValues: proxyValues,
+			Run: func(_ *flag.FlagSet) {
+				startDiagnosis(proxyOpts.Debug)
+				if proxyOpts.LaitosDNSName == "" || proxyOpts.AccessOTPSecret == "" {
+					logger.Abort(nil, nil, "please provide the DNS name (-dnsname) and OTP secret (-otpsecret) of laitos DNS server")
+					return
+				}
+				cli.HandleTCPOverDNSClient(logger, proxyOpts)
+			},
+		},
+		{
+			Name:       "datautil",
+			Summary:    "encrypt or decrypt program configuration and data files",
+			Synopsis:   "encrypt|decrypt FILE",
+			FlagValues: map[string][]string{"": {"encrypt", "decrypt"}},
+			Run: func(flags *flag.FlagSet) {
+				if flags.NArg() != 2 {
+					flags.Usage()
+					os.Exit(2)
+				}
+				cli.HandleSecurityDataUtil(flags.Arg(0), flags.Arg(1), logger)
+			},
+		},
+		{
+			Name:       "integrity",
+			Summary:    "generate a signing key, sign or verify the manifest of program file hashes",
+			Synopsis:   "keygen PRIVATE_KEY_FILE | sign PRIVATE_KEY_FILE MANIFEST_FILE FILE... | verify PUBLIC_KEY MANIFEST_FILE",
+			FlagValues: map[string][]string{"": {"keygen", "sign", "verify"}},
+			Run: func(flags *flag.FlagSet) {
+				if err := cli.HandleIntegrityUtil(logger, flags.Args()); err != nil {
+					logger.Abort(nil, err, "integrity utility failed")
+				}
+			},
+		},
+		{
+			Name:        "console",
+			Summary:     "run app commands typed on the terminal, using the command processor configured by ConsoleFilters",
+			DefineFlags: consoleOpts.defineFlags,
+			Run: func(_ *flag.FlagSet) {
+				config := consoleOpts.readConfig()
+				processor := config.GetConsoleCommandProcessor()
+				if processor.IsEmpty() {
+					logger.Abort(nil, nil, "please configure the command processor filters (ConsoleFilters) for the console")
+					return
+				}
+				if err := cli.RunConsole(context.Background(), processor, os.Stdin, os.Stdout); err != nil {
+					logger.Abort(nil, err, "failed to read app commands from standard input")
+				}
+			},
+		},
+		{
+			Name:     "knock",
+			Summary:  "send a signed knock packet to the knock port of sockd, the sockd password is read from standard input",
+			Synopsis: "HOST:KNOCK_PORT",
+			DefineFlags: func(flags *flag.FlagSet) {
+				flags.StringVar(&knockClientIP, "ip", "", "(Optional) open the proxy ports to this client IP instead of the IP of this computer as seen by the server")
+			},
+			Run: func(flags *flag.FlagSet) {
+				if flags.NArg() != 1 {
+					flags.Usage()
+					os.Exit(2)
+				}
+				platform.SetTermEcho(false)
+				logger.Info(nil, nil, "please enter the sockd password (terminal won't echo):")
+				err := cli.KnockSockd(os.Stdin, flags.Arg(0), knockClientIP)
+				platform.SetTermEcho(true)
+				if err != nil {
+					logger.Abort(nil, err, "failed to knock")
+					return
+				}
+				logger.Info(nil, nil, "knocked on %s, the proxy ports are open to this computer's IP for a while", flags.Arg(0))
+			},
+		},
+		{
+			Name:       "completion",
+			Summary:    "print the shell completion script of bash or zsh",
+			Synopsis:   "bash|zsh",
+			FlagValues: map[string][]string{"": {"bash", "zsh"}},
+			Run: func(flags *flag.FlagSet) {
+				switch flags.Arg(0) {
+				case "bash":
+					set.WriteBashCompletion(os.Stdout)
+				case "zsh":
+					set.WriteZshCompletion(os.Stdout)
+				default:
+					flags.Usage()
+					os.Exit(2)
+				}
+			},
+		},
 	}
+	set.Legacy = &cli.Command{
+		DefineFlags: func(flags *flag.FlagSet) {
+			serveOpts.defineFlags(flags)
+			flags.BoolVar(&serveOpts.awsLambda, launcher.LambdaFlagName, false, "(Optional) run AWS Lambda handler to proxy HTTP requests to laitos web server")
+			flags.BoolVar(&proxyOpts.Debug, "proxydebug", false, "(TCP-over-DNS optional) turn on debug logs")
+			defineProxyFlags(flags, "proxy", &proxyOpts)
+			flags.StringVar(&dataUtil, "datautil", "", "(Optional) program data encryption utility: encrypt|decrypt")
+			flags.StringVar(&dataUtilFile, "datautilfile", "", "(Optional) program data encryption utility: encrypt/decrypt file location")
+		},
+		Run: func(_ *flag.FlagSet) {
+			startDiagnosis(serveOpts.debug)
+			if dataUtil != "" {
+				cli.HandleSecurityDataUtil(dataUtil, dataUtilFile, logger)
+				return
+			}
+			if proxyOpts.LaitosDNSName != "" {
+				cli.HandleTCPOverDNSClient(logger, proxyOpts)
+				return
+			}
+			serve(serveOpts, "")
+		},
+	}
+	return set
+}
+
+func main() {
+	hzgl.HZGL()
+	newCommandSet().Run(os.Args[1:])
+}
 
+/*
+serve launches the supervisor, which then launches laitos main process to run the daemons. The subcommand is given to
+the supervisor for launching the main process in the same way.
+*/
+func serve(opts serveOptions, subcommand string) {
+	daemonList := opts.daemonList
+	if opts.debug {
+		misc.Debug.Set(true)
+	}
 	// Manipulate the daemon list parameter if running on Google App Engine.
 	if newDaemonList := cli.GAEDaemonList(logger); newDaemonList != "" {
 		daemonList = newDaemonList
@@ -146,7 +372,7 @@ func main() {
 	// The handler also retrieves the decryption password for the program
 	// configuration from API gateway stage configuration, if provided.
 	// ========================================================================
-	if awsLambda {
+	if opts.awsLambda {
 		// Use environment variable PORT to tell HTTP (not HTTPS) server to listen on port expected by lambda handler
 		_ = os.Setenv(httpd.EnvironmentPortNumber, strconv.Itoa(lambda.UpstreamWebServerPort))
 		// Unfortunately without encrypting program config file it is impossible to set LAITOS_HTTP_URL_ROUTE_PREFIX
@@ -156,11 +382,13 @@ func main() {
 		// Proceed to launch the daemons, including the HTTP web server that lambda handler forwards incoming request to.
 	}
 
-	// Read unencrypted configuration data from environment variable, or possibly encrypted configuration from JSON file.
-	var config launcher.Config
-	if err := config.DeserialiseFromJSON(cli.GetConfig(logger, pwdServer, pwdServerPort, pwdServerURL, passwordUnlockServers)); err != nil {
-		logger.Abort(nil, err, "failed to retrieve/deserialise program configuration")
-		return
+	// Verify the program files against the signed manifest before reading the configuration file
+	cli.AttestProgramIntegrity(logger, opts.integrityManifest, opts.integrityPubKey, opts.integrityEnforce)
+
+	config := opts.readConfig()
+	// The daemons selected by the configuration profile are started unless the command line specifies them.
+	if daemonList == "" {
+		daemonList = strings.Join(config.GetProfileDaemons(), ",")
 	}
 	// Figure out which daemons to start, make sure the names are valid.
 	daemonNames := regexp.MustCompile(`\w+`).FindAllString(daemonList, -1)
@@ -179,6 +407,18 @@ func main() {
 			logger.Abort(nil, nil, "unrecognised daemon name \"%s\"", daemonName)
 		}
 	}
+	config.SetDaemonNames(daemonNames)
+
+	// ========================================================================
+	// Non-daemon utility routine - print the effective configuration of the
+	// daemons without starting them.
+	// ========================================================================
+	if opts.dumpConfig {
+		if err := config.DumpEffectiveConfig(os.Stdout, daemonNames); err != nil {
+			logger.Abort(nil, err, "failed to print the effective configuration")
+		}
+		return
+	}
 
 	// ========================================================================
 	// Supervisor routine - launch an independent laitos process to run daemons.
@@ -186,30 +426,36 @@ func main() {
 	// always protected by the supervisor by default. There is no good reason
 	// for a user to turn it off manually.
 	// ========================================================================
-	cli.HandleDaemonSignals()
-	if isSupervisor {
+	cli.HandleDaemonSignals(nil)
+	if opts.isSupervisor {
 		supervisor := &launcher.Supervisor{
-			CLIFlags:               os.Args[1:],
-			NotificationRecipients: config.SupervisorNotificationRecipients,
-			MailClient:             config.MailClient,
-			DaemonNames:            daemonNames,
+			CLIFlags:                 supervisorFlags(subcommand),
+			Subcommand:               subcommand,
+			NotificationRecipients:   config.SupervisorNotificationRecipients,
+			MailClient:               config.MailClient,
+			NotificationPhoneNumbers: config.SupervisorNotificationPhoneNumbers,
+			Twilio:                   &config.Features.Twilio,
+			DaemonNames:              daemonNames,
+			ShedPolicy:               config.SupervisorShedPolicy,
 		}
+		// The supervisor passes SIGHUP on to the main program, which reloads its configuration.
+		cli.HandleDaemonSignals(supervisor.ReloadMainProgram)
 		supervisor.Start()
 		return
 	}
 	// The code after this point are supervised by the launcher supervisor,
 	// which will automatically recover from crashes and shed components/options
 	// as needed.
-	if gomaxprocs > 0 {
-		oldGomaxprocs := runtime.GOMAXPROCS(gomaxprocs)
-		logger.Warning(nil, nil, "GOMAXPROCS has been changed from %d to %d", oldGomaxprocs, gomaxprocs)
+	if opts.gomaxprocs > 0 {
+		oldGomaxprocs := runtime.GOMAXPROCS(opts.gomaxprocs)
+		logger.Warning(nil, nil, "GOMAXPROCS has been changed from %d to %d", oldGomaxprocs, opts.gomaxprocs)
 	} else {
 		logger.Warning(nil, nil, "GOMAXPROCS is unchanged at %d", runtime.GOMAXPROCS(0))
 	}
-	if disableConflicts {
+	if opts.disableConflicts {
 		cli.DisableConflicts(logger)
 	}
-	if misc.EnableAWSIntegration {
+	if misc.AWSIntegration.IsEnabled() {
 		cli.InitialiseAWS()
 	}
 	cli.CopyNonEssentialUtilitiesInBackground(logger)
@@ -219,49 +465,113 @@ func main() {
 	// Daemon routine - launch all daemons at once.
 	// ========================================================================
 
-	// Prepare environmental changes
-	for _, daemonName := range daemonNames {
-		// Daemons are started asynchronously and the order does not matter
+	/*
+		Daemons are started asynchronously. Those depending on other daemons
+		(e.g. sockd and httpproxy use the blacklist of dnsd) wait for their
+		prerequisites to become ready.
+	*/
+	// The HTTP daemon optionally listens on a unix domain socket, in addition to the listener with and/or without TLS.
+	// Each HTTP daemon instance starts the listener once, a configuration reload may construct a new instance.
+	httpdUnixSocketStarted := new(sync.Map)
+	startHTTPDUnixSocket := func(config *launcher.Config) {
+		httpDaemon := config.GetHTTPD()
+		if _, started := httpdUnixSocketStarted.LoadOrStore(httpDaemon, true); !started && httpDaemon.UnixSocketPath != "" {
+			go cli.AutoRestart(logger, "httpd-unix-socket", httpDaemon.StartAndBlockUnixSocket)
+		}
+	}
+	startDaemon := func(config *launcher.Config, daemonName string) {
 		switch daemonName {
 		case launcher.DNSDName:
-			go cli.AutoRestart(logger, daemonName, config.GetDNSD().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetDNSD().StartAndBlock)
 		case launcher.HTTPDName:
-			go cli.AutoRestart(logger, daemonName, config.GetHTTPD().StartAndBlockWithTLS)
+			startHTTPDUnixSocket(config)
+			cli.AutoRestart(logger, daemonName, config.GetHTTPD().StartAndBlockWithTLS)
 		case launcher.InsecureHTTPDName:
 			/*
 				There is not an independent port settings for launching both TLS-enabled and TLS-free HTTP servers
 				at the same time. If user really wishes to launch both at the same time, the TLS-free HTTP server
 				will fallback to use port number 80.
 			*/
-			go cli.AutoRestart(logger, daemonName, func() error {
+			startHTTPDUnixSocket(config)
+			cli.AutoRestart(logger, daemonName, func() error {
 				return config.GetHTTPD().StartAndBlockNoTLS(80)
 			})
 		case launcher.MaintenanceName:
-			go cli.AutoRestart(logger, daemonName, config.GetMaintenance().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetMaintenance().StartAndBlock)
 		case launcher.PhoneHomeName:
-			go cli.AutoRestart(logger, daemonName, config.GetPhoneHomeDaemon().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetPhoneHomeDaemon().StartAndBlock)
 		case launcher.PlainSocketName:
-			go cli.AutoRestart(logger, daemonName, config.GetPlainSocketDaemon().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetPlainSocketDaemon().StartAndBlock)
 		case launcher.SimpleIPSvcName:
-			go cli.AutoRestart(logger, daemonName, config.GetSimpleIPSvcD().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetSimpleIPSvcD().StartAndBlock)
 		case launcher.SMTPDName:
-			go cli.AutoRestart(logger, daemonName, config.GetMailDaemon().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetMailDaemon().StartAndBlock)
 		case launcher.SNMPDName:
-			go cli.AutoRestart(logger, daemonName, config.GetSNMPD().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetSNMPD().StartAndBlock)
 		case launcher.SOCKDName:
-			go cli.AutoRestart(logger, daemonName, config.GetSockDaemon().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetSockDaemon().StartAndBlock)
+		case launcher.SSHDName:
+			cli.AutoRestart(logger, daemonName, config.GetSSHD().StartAndBlock)
 		case launcher.TelegramName:
-			go cli.AutoRestart(logger, daemonName, config.GetTelegramBot().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetTelegramBot().StartAndBlock)
 		case launcher.AutoUnlockName:
-			go cli.AutoRestart(logger, daemonName, config.GetAutoUnlock().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetAutoUnlock().StartAndBlock)
 		case launcher.PasswdRPCName:
-			go cli.AutoRestart(logger, daemonName, config.GetPasswdRPCDaemon().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetPasswdRPCDaemon().StartAndBlock)
 		case launcher.HTTPProxyName:
-			go cli.AutoRestart(logger, daemonName, config.GetHTTPProxyDaemon().StartAndBlock)
+			cli.AutoRestart(logger, daemonName, config.GetHTTPProxyDaemon().StartAndBlock)
+		}
+	}
+	starter := &launcher.DaemonStarter{
+		IsReady: config.IsDaemonReady,
+		Logger:  logger,
+		Start: func(daemonName string) {
+			startDaemon(&config, daemonName)
+		},
+	}
+	if _, err := starter.StartAll(daemonNames); err != nil {
+		logger.Abort(nil, err, "failed to start daemons")
+		return
+	}
+	// Remove expired data from memory according to the retention configuration.
+	if len(config.DataRetention.MaxAgeSec) > 0 {
+		if err := misc.DefaultDataRetention.StartPeriodicExpiry(context.Background(), config.DataRetention.IntervalSec); err != nil {
+			logger.Abort(nil, err, "failed to start data retention")
+			return
 		}
 	}
+	// Reload the configuration upon SIGHUP, and restart the daemons affected by the configuration changes.
+	reloader := &launcher.ConfigReloader{
+		Config:      &config,
+		DaemonNames: daemonNames,
+		ProfileName: opts.profile,
+		ReadConfig:  cli.RereadConfig,
+		StartDaemon: startDaemon,
+		Logger:      logger,
+	}
+	if err := reloader.Initialise(); err != nil {
+		logger.Warning(nil, err, "failed to initialise configuration reload, SIGHUP will be ignored")
+	} else {
+		cli.HandleDaemonSignals(func() {
+			if _, err := reloader.Reload(); err != nil {
+				logger.Warning(nil, err, "failed to reload configuration, the daemons keep running with the current configuration")
+			}
+		})
+		// Let the apps switch the configuration profile upon request, in the same way as a configuration reload.
+		misc.SetConfigProfileSwitch(&misc.ConfigProfileSwitch{GetProfiles: reloader.GetProfiles, SwitchTo: reloader.SwitchProfile})
+	}
+	// Reap the orphaned zombie processes left behind by helper processes, which only happens when laitos is the init process.
+	platform.DefaultHelperProcesses.StartReaper(context.Background(), platform.HelperProcessReapIntervalSec)
 
 	// At this point the enabled daemons are running in their own background
 	// goroutines. the main function now waits/blocks indefinitely.
 	select {}
 }
+
+// supervisorFlags returns the program flags that follow the subcommand, for the supervisor to launch the main process.
+func supervisorFlags(subcommand string) []string {
+	if subcommand == "" {
+		return os.Args[1:]
+	}
+	return os.Args[2:]
+}
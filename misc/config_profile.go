@@ -0,0 +1,40 @@
+package misc
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// BaseConfigProfile is the name that refers to the base configuration, without any configuration profile applied.
+const BaseConfigProfile = "base"
+
+// ErrConfigProfileUnavailable is returned when the running program cannot switch its configuration profile.
+var ErrConfigProfileUnavailable = errors.New("configuration profiles are unavailable to this program")
+
+/*
+ConfigProfileSwitch inspects and switches the configuration profile of the running program. The launcher installs the
+implementation after the daemons have started, the apps use it to switch profile upon request.
+*/
+type ConfigProfileSwitch struct {
+	// GetProfiles returns the name of the active profile (BaseConfigProfile if none) and the names of all profiles.
+	GetProfiles func() (active string, all []string)
+	// SwitchTo applies the profile of the name (BaseConfigProfile for none) and returns the names of the restarted daemons.
+	SwitchTo func(name string) ([]string, error)
+}
+
+// configProfileSwitch is installed by SetConfigProfileSwitch.
+var configProfileSwitch atomic.Pointer[ConfigProfileSwitch]
+
+// SetConfigProfileSwitch installs the implementation of configuration profile switch.
+func SetConfigProfileSwitch(profileSwitch *ConfigProfileSwitch) {
+	configProfileSwitch.Store(profileSwitch)
+}
+
+// GetConfigProfileSwitch returns the implementation of configuration profile switch, or ErrConfigProfileUnavailable if it is not installed.
+func GetConfigProfileSwitch() (*ConfigProfileSwitch, error) {
+	profileSwitch := configProfileSwitch.Load()
+	if profileSwitch == nil {
+		return nil, ErrConfigProfileUnavailable
+	}
+	return profileSwitch, nil
+}
@@ -0,0 +1,80 @@
+package misc
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	daemonStatuses     = make(map[string]*DaemonStatus)
+	daemonStatusesLock = new(sync.Mutex)
+)
+
+// DaemonStatus describes the life cycle of a daemon and the number of requests it served, for a quick health glance.
+type DaemonStatus struct {
+	Name    string
+	Running bool
+	// StartedAt is the time the daemon started most recently.
+	StartedAt time.Time
+	// UptimeSec is the number of seconds since the most recent start, or 0 if the daemon is not running.
+	UptimeSec int64
+	// Restarts is the number of times the daemon started again after it had stopped.
+	Restarts int
+	/*
+		RequestsServed is the number of requests served by the daemon, the HTTP daemons share the same counter. It is
+		filled in from the daemon stats counters by daemon/common.GetDaemonStatuses.
+	*/
+	RequestsServed int
+	LastError      string
+	LastErrorAt    time.Time
+}
+
+// DaemonStarted records that the daemon has (re)started.
+func DaemonStarted(name string) {
+	daemonStatusesLock.Lock()
+	defer daemonStatusesLock.Unlock()
+	status, exists := daemonStatuses[name]
+	if !exists {
+		status = &DaemonStatus{Name: name}
+		daemonStatuses[name] = status
+	} else {
+		status.Restarts++
+	}
+	status.Running = true
+	status.StartedAt = time.Now()
+}
+
+// DaemonStopped records that the daemon has stopped, the error (if any) tells why.
+func DaemonStopped(name string, err error) {
+	daemonStatusesLock.Lock()
+	defer daemonStatusesLock.Unlock()
+	status, exists := daemonStatuses[name]
+	if !exists {
+		status = &DaemonStatus{Name: name}
+		daemonStatuses[name] = status
+	}
+	status.Running = false
+	if err != nil {
+		status.LastError = err.Error()
+		status.LastErrorAt = time.Now()
+	}
+}
+
+// GetDaemonStatuses returns the status of all daemons that have started, sorted by daemon name.
+func GetDaemonStatuses() []DaemonStatus {
+	daemonStatusesLock.Lock()
+	defer daemonStatusesLock.Unlock()
+	ret := make([]DaemonStatus, 0, len(daemonStatuses))
+	for _, status := range daemonStatuses {
+		copied := *status
+		if copied.Running {
+			copied.UptimeSec = int64(time.Since(copied.StartedAt).Seconds())
+		}
+		ret = append(ret, copied)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
@@ -0,0 +1,24 @@
+package misc
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDaemonStatus(t *testing.T) {
+	DaemonStarted("snmpd")
+	DaemonStopped("snmpd", errors.New("listener failed"))
+	DaemonStarted("snmpd")
+	var found bool
+	for _, status := range GetDaemonStatuses() {
+		if status.Name == "snmpd" {
+			found = true
+			if !status.Running || status.Restarts != 1 || status.LastError != "listener failed" || status.LastErrorAt.IsZero() {
+				t.Fatalf("%+v", status)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("missing daemon status")
+	}
+}
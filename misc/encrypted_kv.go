@@ -0,0 +1,142 @@
+package misc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+/*
+EncryptedKVStore is a small key-value store kept in a file on disk. The file content is the JSON serialisation of all
+keys and values encrypted by AES-256-GCM, using a key derived from the configured passphrase. The entire store is held
+in memory and the file is rewritten upon every update, hence it is suitable for small amounts of personal data.
+*/
+type EncryptedKVStore struct {
+	// FilePath is the location of the encrypted store file, it is created upon the first update.
+	FilePath string `json:"FilePath"`
+	// Passphrase is used to derive the encryption key of the store file.
+	Passphrase string `json:"Passphrase"`
+
+	aead  cipher.AEAD
+	data  map[string]string
+	mutex *sync.RWMutex
+}
+
+// Initialise derives the encryption key and reads the store file into memory if it exists.
+func (store *EncryptedKVStore) Initialise() error {
+	if store.FilePath == "" || store.Passphrase == "" {
+		return errors.New("EncryptedKVStore.Initialise: FilePath and Passphrase must not be empty")
+	}
+	digest := sha256.Sum256([]byte("laitos-encrypted-kv-store:" + store.Passphrase))
+	block, err := aes.NewCipher(digest[:])
+	if err != nil {
+		return fmt.Errorf("EncryptedKVStore.Initialise: %w", err)
+	}
+	if store.aead, err = cipher.NewGCM(block); err != nil {
+		return fmt.Errorf("EncryptedKVStore.Initialise: %w", err)
+	}
+	store.mutex = new(sync.RWMutex)
+	store.data = make(map[string]string)
+	sealed, err := os.ReadFile(store.FilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("EncryptedKVStore.Initialise: failed to read \"%s\" - %w", store.FilePath, err)
+	}
+	nonceSize := store.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return fmt.Errorf("EncryptedKVStore.Initialise: \"%s\" is not an encrypted store", store.FilePath)
+	}
+	plain, err := store.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return fmt.Errorf("EncryptedKVStore.Initialise: failed to decrypt \"%s\", is the passphrase correct? - %w", store.FilePath, err)
+	}
+	if err := json.Unmarshal(plain, &store.data); err != nil {
+		return fmt.Errorf("EncryptedKVStore.Initialise: failed to deserialise \"%s\" - %w", store.FilePath, err)
+	}
+	return nil
+}
+
+// Get returns the value of the key, or false if the key does not exist.
+func (store *EncryptedKVStore) Get(key string) (string, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	value, exists := store.data[key]
+	return value, exists
+}
+
+// Keys returns all keys of the store in sorted order.
+func (store *EncryptedKVStore) Keys() []string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	keys := make([]string, 0, len(store.data))
+	for key := range store.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Put sets the value of the key and saves the store file.
+func (store *EncryptedKVStore) Put(key, value string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	oldValue, existed := store.data[key]
+	store.data[key] = value
+	if err := store.save(); err != nil {
+		// Keep the memory consistent with the file
+		if existed {
+			store.data[key] = oldValue
+		} else {
+			delete(store.data, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the key and saves the store file. It returns false if the key did not exist.
+func (store *EncryptedKVStore) Delete(key string) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	oldValue, existed := store.data[key]
+	if !existed {
+		return false, nil
+	}
+	delete(store.data, key)
+	if err := store.save(); err != nil {
+		store.data[key] = oldValue
+		return false, err
+	}
+	return true, nil
+}
+
+// save encrypts all keys and values and replaces the store file. Caller must hold the mutex.
+func (store *EncryptedKVStore) save() error {
+	plain, err := json.Marshal(store.data)
+	if err != nil {
+		return fmt.Errorf("EncryptedKVStore.save: %w", err)
+	}
+	nonce := make([]byte, store.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("EncryptedKVStore.save: failed to read random nonce - %w", err)
+	}
+	sealed := store.aead.Seal(nonce, nonce, plain, nil)
+	// Replace the file on disk atomically, so that a crash does not leave a half-written file behind.
+	tmpPath := store.FilePath + ".tmp"
+	if err := os.WriteFile(tmpPath, sealed, 0600); err != nil {
+		return fmt.Errorf("EncryptedKVStore.save: failed to write \"%s\" - %w", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, store.FilePath); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("EncryptedKVStore.save: failed to replace \"%s\" - %w", store.FilePath, err)
+	}
+	return nil
+}
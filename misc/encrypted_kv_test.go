@@ -0,0 +1,53 @@
+package misc
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEncryptedKVStore(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "store")
+	if err := (&EncryptedKVStore{FilePath: filePath}).Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+	store := &EncryptedKVStore{FilePath: filePath, Passphrase: "pass"}
+	if err := store.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if value, exists := store.Get("a"); !exists || value != "1" {
+		t.Fatal(value, exists)
+	}
+	if deleted, err := store.Delete("b"); !deleted || err != nil {
+		t.Fatal(deleted, err)
+	}
+	if deleted, err := store.Delete("b"); deleted || err != nil {
+		t.Fatal(deleted, err)
+	}
+	// The file does not reveal the content
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(filePath); info.Mode().Perm() != 0600 || reflect.DeepEqual(content, []byte(`{"a":"1"}`)) {
+		t.Fatal(info.Mode(), string(content))
+	}
+	// Read the store from the file again
+	store = &EncryptedKVStore{FilePath: filePath, Passphrase: "pass"}
+	if err := store.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := store.Keys(); !reflect.DeepEqual(keys, []string{"a"}) {
+		t.Fatal(keys)
+	}
+	if err := (&EncryptedKVStore{FilePath: filePath, Passphrase: "wrong"}).Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+}
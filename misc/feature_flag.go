@@ -0,0 +1,175 @@
+package misc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// FlagAWSIntegration is the name of the feature flag AWSIntegration.
+	FlagAWSIntegration = "AWSIntegration"
+	// FlagPrometheusIntegration is the name of the feature flag PrometheusIntegration.
+	FlagPrometheusIntegration = "PrometheusIntegration"
+	// FlagDebug is the name of the feature flag Debug.
+	FlagDebug = "Debug"
+)
+
+// ErrFlagNotLive is returned when toggling a feature flag that only takes effect during program startup.
+var ErrFlagNotLive = errors.New("the flag takes effect at program startup, change it in the configuration file and restart the program")
+
+/*
+FeatureFlag is a program-global switch of an optional behaviour. A flag is turned on or off at program startup by the
+command line or the configuration file, and a live flag may be toggled at runtime by the operator, in which case the
+subscribers apply the change as it happens.
+*/
+type FeatureFlag struct {
+	// Name is the name of the flag, as used by the configuration file and the admin command.
+	Name string
+	// Description tells the behaviour switched on by the flag.
+	Description string
+	// Live is true if the flag may be toggled while the program is running.
+	Live bool
+
+	enabled     atomic.Bool
+	mutex       sync.Mutex
+	subscribers map[int]func(enabled bool)
+	lastSubID   int
+}
+
+// IsEnabled returns true if the flag is turned on.
+func (flag *FeatureFlag) IsEnabled() bool {
+	return flag.enabled.Load()
+}
+
+// Set turns the flag on or off, and lets the subscribers know about the change.
+func (flag *FeatureFlag) Set(enabled bool) {
+	flag.mutex.Lock()
+	defer flag.mutex.Unlock()
+	if flag.enabled.Swap(enabled) == enabled {
+		return
+	}
+	logger.Info(flag.Name, nil, "feature flag is now enabled? %v", enabled)
+	for _, fun := range flag.subscribers {
+		fun(enabled)
+	}
+}
+
+/*
+Subscribe registers a function to be called with the new value each time the flag changes, and returns a function that
+cancels the subscription. The function is called while the flag is being changed, it should return quickly.
+*/
+func (flag *FeatureFlag) Subscribe(fun func(enabled bool)) (unsubscribe func()) {
+	flag.mutex.Lock()
+	defer flag.mutex.Unlock()
+	if flag.subscribers == nil {
+		flag.subscribers = make(map[int]func(enabled bool))
+	}
+	flag.lastSubID++
+	id := flag.lastSubID
+	flag.subscribers[id] = fun
+	return func() {
+		flag.mutex.Lock()
+		defer flag.mutex.Unlock()
+		delete(flag.subscribers, id)
+	}
+}
+
+// FeatureFlagRegistry keeps track of the feature flags by name.
+type FeatureFlagRegistry struct {
+	flags map[string]*FeatureFlag
+	// configured is true after the flags have been configured for the first time.
+	configured bool
+	mutex      sync.Mutex
+}
+
+// Register adds a new flag to the registry and returns it.
+func (reg *FeatureFlagRegistry) Register(name, description string, live bool) *FeatureFlag {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	if reg.flags == nil {
+		reg.flags = make(map[string]*FeatureFlag)
+	}
+	if _, exists := reg.flags[name]; exists {
+		panic(fmt.Sprintf("FeatureFlagRegistry.Register: flag %s is already registered", name))
+	}
+	flag := &FeatureFlag{Name: name, Description: description, Live: live}
+	reg.flags[name] = flag
+	return flag
+}
+
+// Get returns the flag of the name, or nil if there is no such flag.
+func (reg *FeatureFlagRegistry) Get(name string) *FeatureFlag {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	return reg.flags[name]
+}
+
+// GetAll returns all flags sorted by name.
+func (reg *FeatureFlagRegistry) GetAll() (ret []*FeatureFlag) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	for _, flag := range reg.flags {
+		ret = append(ret, flag)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return
+}
+
+/*
+Configure turns the flags on or off according to the configuration file. The flags absent from the configuration are
+left alone (e.g. those turned on by the command line). After the first time, the non-live flags are no longer changed
+(e.g. by a configuration reload), because they only take effect at program startup.
+*/
+func (reg *FeatureFlagRegistry) Configure(values map[string]bool) error {
+	for name := range values {
+		if reg.Get(name) == nil {
+			return fmt.Errorf("FeatureFlagRegistry.Configure: unknown feature flag \"%s\"", name)
+		}
+	}
+	reg.mutex.Lock()
+	configured := reg.configured
+	reg.configured = true
+	reg.mutex.Unlock()
+	for name, enabled := range values {
+		flag := reg.Get(name)
+		if configured && !flag.Live {
+			if flag.IsEnabled() != enabled {
+				logger.Warning(name, nil, "the new value (enabled? %v) will take effect after the program restarts", enabled)
+			}
+			continue
+		}
+		flag.Set(enabled)
+	}
+	return nil
+}
+
+// Toggle turns a live flag on or off at runtime.
+func (reg *FeatureFlagRegistry) Toggle(name string, enabled bool) error {
+	flag := reg.Get(name)
+	if flag == nil {
+		return fmt.Errorf("unknown feature flag \"%s\"", name)
+	}
+	if !flag.Live {
+		return ErrFlagNotLive
+	}
+	flag.Set(enabled)
+	return nil
+}
+
+var (
+	// FeatureFlags is the program-global registry of feature flags.
+	FeatureFlags = &FeatureFlagRegistry{}
+
+	// AWSIntegration determines whether to integrate with various AWS services for the normal operation of laitos,
+	// an example of such integration feature is to send incoming store&forward message to kinesis firehose.
+	AWSIntegration = FeatureFlags.Register(FlagAWSIntegration, "integrate with AWS services such as SQS, SNS, kinesis firehose, and X-Ray", false)
+	// PrometheusIntegration determines whether to enable integration with prometheus by collecting and serving metrics readings.
+	PrometheusIntegration = FeatureFlags.Register(FlagPrometheusIntegration, "collect performance metrics and serve them to prometheus", false)
+	// Debug turns on the diagnosis behaviours, such as the verbose logs of TCP-over-DNS proxy.
+	Debug = FeatureFlags.Register(FlagDebug, "verbose logs of TCP-over-DNS proxy", true)
+)
@@ -0,0 +1,44 @@
+package misc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeatureFlag(t *testing.T) {
+	reg := &FeatureFlagRegistry{}
+	live := reg.Register("Live", "a live flag", true)
+	startup := reg.Register("Startup", "a startup flag", false)
+	require.Panics(t, func() { reg.Register("Live", "", true) })
+	require.Equal(t, []*FeatureFlag{live, startup}, reg.GetAll())
+	require.Nil(t, reg.Get("DoesNotExist"))
+
+	// Subscribers learn about the changes only
+	var changes []bool
+	unsubscribe := live.Subscribe(func(enabled bool) { changes = append(changes, enabled) })
+	live.Set(true)
+	live.Set(true)
+	live.Set(false)
+	require.Equal(t, []bool{true, false}, changes)
+	unsubscribe()
+	live.Set(true)
+	require.Equal(t, []bool{true, false}, changes)
+
+	// The first configuration sets all flags
+	require.Error(t, reg.Configure(map[string]bool{"DoesNotExist": true}))
+	require.NoError(t, reg.Configure(map[string]bool{"Live": false, "Startup": true}))
+	require.False(t, live.IsEnabled())
+	require.True(t, startup.IsEnabled())
+	// The later configuration leaves the startup flags alone
+	require.NoError(t, reg.Configure(map[string]bool{"Live": true, "Startup": false}))
+	require.True(t, live.IsEnabled())
+	require.True(t, startup.IsEnabled())
+
+	// Only the live flags may be toggled at runtime
+	require.NoError(t, reg.Toggle("Live", false))
+	require.False(t, live.IsEnabled())
+	require.ErrorIs(t, reg.Toggle("Startup", false), ErrFlagNotLive)
+	require.True(t, startup.IsEnabled())
+	require.Error(t, reg.Toggle("DoesNotExist", true))
+}
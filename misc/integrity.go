@@ -0,0 +1,179 @@
+package misc
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IntegrityManifestFile is the hash of a file recorded in an integrity manifest.
+type IntegrityManifestFile struct {
+	// Path is the absolute path, or a path relative to the working directory of laitos.
+	Path string `json:"Path"`
+	// SHA256 is the hex-encoded SHA-256 hash of the file content.
+	SHA256 string `json:"SHA256"`
+}
+
+/*
+IntegrityManifest records the hashes of the laitos program, its configuration file, and supplementary utilities, signed
+by the operator's ed25519 key. Verifying the manifest at startup detects tampering of the files, e.g. on a server
+hosted in a colocation facility.
+*/
+type IntegrityManifest struct {
+	Files []IntegrityManifestFile `json:"Files"`
+	// SignedAt is the time of signing in RFC3339 format.
+	SignedAt string `json:"SignedAt"`
+	// Signature is the base64-encoded ed25519 signature of the file hashes and signing time.
+	Signature string `json:"Signature"`
+}
+
+// ErrIntegrityMismatch is returned when the files recorded in a validly signed integrity manifest have been modified.
+var ErrIntegrityMismatch = errors.New("the files do not match the integrity manifest")
+
+// hashFile returns the hex-encoded SHA-256 hash of the file content.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// signedContent returns the content covered by the signature - the signing time followed by one line for each file in the sha256sum format.
+func (manifest *IntegrityManifest) signedContent() []byte {
+	files := make([]IntegrityManifestFile, len(manifest.Files))
+	copy(files, manifest.Files)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	var content strings.Builder
+	content.WriteString("laitos integrity manifest " + manifest.SignedAt + "\n")
+	for _, file := range files {
+		content.WriteString(strings.ToLower(file.SHA256) + "  " + file.Path + "\n")
+	}
+	return []byte(content.String())
+}
+
+// SignIntegrityManifest hashes the files and returns a manifest signed by the private key.
+func SignIntegrityManifest(privKey ed25519.PrivateKey, paths ...string) (*IntegrityManifest, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("SignIntegrityManifest: there must be at least one file to sign")
+	}
+	manifest := &IntegrityManifest{SignedAt: time.Now().UTC().Format(time.RFC3339)}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		hash, err := hashFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("SignIntegrityManifest: failed to hash \"%s\" - %w", path, err)
+		}
+		manifest.Files = append(manifest.Files, IntegrityManifestFile{Path: path, SHA256: hash})
+	}
+	manifest.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privKey, manifest.signedContent()))
+	return manifest, nil
+}
+
+/*
+Verify checks the manifest signature against the public key, and then hashes each file recorded in the manifest. If
+the signature is valid yet some files are missing or modified, the function returns their paths along with
+ErrIntegrityMismatch.
+*/
+func (manifest *IntegrityManifest) Verify(pubKey ed25519.PublicKey) (mismatches []string, err error) {
+	signature, err := base64.StdEncoding.DecodeString(manifest.Signature)
+	if err != nil || !ed25519.Verify(pubKey, manifest.signedContent(), signature) {
+		return nil, errors.New("IntegrityManifest.Verify: the manifest signature is invalid")
+	}
+	for _, file := range manifest.Files {
+		hash, err := hashFile(file.Path)
+		if err != nil {
+			mismatches = append(mismatches, fmt.Sprintf("%s (%v)", file.Path, err))
+		} else if hash != strings.ToLower(file.SHA256) {
+			mismatches = append(mismatches, file.Path)
+		}
+	}
+	if len(mismatches) > 0 {
+		return mismatches, ErrIntegrityMismatch
+	}
+	return nil, nil
+}
+
+// ReadIntegrityManifest reads and deserialises a manifest from the JSON file.
+func ReadIntegrityManifest(path string) (*IntegrityManifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadIntegrityManifest: %w", err)
+	}
+	var manifest IntegrityManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("ReadIntegrityManifest: failed to deserialise \"%s\" - %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// WriteIntegrityManifest serialises the manifest into the JSON file.
+func WriteIntegrityManifest(path string, manifest *IntegrityManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("WriteIntegrityManifest: %w", err)
+	}
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
+
+// GenerateIntegrityKey generates a new ed25519 key pair, returning the PEM-encoded private key and base64-encoded public key.
+func GenerateIntegrityKey() (privKeyPEM []byte, pubKey string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", fmt.Errorf("GenerateIntegrityKey: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, "", fmt.Errorf("GenerateIntegrityKey: %w", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// ParseIntegrityPrivateKey decodes a PEM-encoded ed25519 private key, e.g. one generated by "openssl genpkey -algorithm ed25519".
+func ParseIntegrityPrivateKey(privKeyPEM []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(privKeyPEM)
+	if block == nil {
+		return nil, errors.New("ParseIntegrityPrivateKey: the key is not PEM-encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ParseIntegrityPrivateKey: %w", err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("ParseIntegrityPrivateKey: unsupported key type %T, use ed25519", key)
+	}
+	return edKey, nil
+}
+
+// ParseIntegrityPublicKey decodes a base64-encoded ed25519 public key.
+func ParseIntegrityPublicKey(pubKey string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pubKey))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("ParseIntegrityPublicKey: the key must be a base64-encoded ed25519 public key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
@@ -0,0 +1,67 @@
+package misc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntegrityManifest(t *testing.T) {
+	dir := t.TempDir()
+	binPath := filepath.Join(dir, "laitos")
+	configPath := filepath.Join(dir, "config.json")
+	require.NoError(t, os.WriteFile(binPath, []byte("program"), 0755))
+	require.NoError(t, os.WriteFile(configPath, []byte("{}"), 0600))
+
+	privKeyPEM, pubKeyStr, err := GenerateIntegrityKey()
+	require.NoError(t, err)
+	privKey, err := ParseIntegrityPrivateKey(privKeyPEM)
+	require.NoError(t, err)
+	pubKey, err := ParseIntegrityPublicKey(pubKeyStr)
+	require.NoError(t, err)
+	_, err = ParseIntegrityPublicKey("aGVsbG8=")
+	require.Error(t, err)
+	_, err = ParseIntegrityPrivateKey([]byte("not a key"))
+	require.Error(t, err)
+
+	_, err = SignIntegrityManifest(privKey)
+	require.Error(t, err)
+	_, err = SignIntegrityManifest(privKey, filepath.Join(dir, "does-not-exist"))
+	require.Error(t, err)
+	manifest, err := SignIntegrityManifest(privKey, configPath, binPath, configPath)
+	require.NoError(t, err)
+	require.Len(t, manifest.Files, 2)
+	// The manifest survives a round trip through the file
+	manifestPath := filepath.Join(dir, "manifest.json")
+	require.NoError(t, WriteIntegrityManifest(manifestPath, manifest))
+	manifest, err = ReadIntegrityManifest(manifestPath)
+	require.NoError(t, err)
+	mismatches, err := manifest.Verify(pubKey)
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	// Tampering with the files is detected
+	require.NoError(t, os.WriteFile(binPath, []byte("tampered program"), 0755))
+	require.NoError(t, os.Remove(configPath))
+	mismatches, err = manifest.Verify(pubKey)
+	require.ErrorIs(t, err, ErrIntegrityMismatch)
+	require.Len(t, mismatches, 2)
+	require.Contains(t, mismatches[0], configPath)
+	require.Equal(t, binPath, mismatches[1])
+
+	// Tampering with the manifest itself is detected
+	require.NoError(t, os.WriteFile(binPath, []byte("program"), 0755))
+	manifest.Files[1].SHA256 = manifest.Files[0].SHA256
+	_, err = manifest.Verify(pubKey)
+	require.ErrorContains(t, err, "signature is invalid")
+	_, otherPubKey, err := GenerateIntegrityKey()
+	require.NoError(t, err)
+	otherKey, err := ParseIntegrityPublicKey(otherPubKey)
+	require.NoError(t, err)
+	manifest, err = ReadIntegrityManifest(manifestPath)
+	require.NoError(t, err)
+	_, err = manifest.Verify(otherKey)
+	require.ErrorContains(t, err, "signature is invalid")
+}
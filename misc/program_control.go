@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -14,6 +15,9 @@ const (
 	// EnvironmentDecryptionPassword is a name of environment variable, the value of which supplies decryption password
 	// to laitos program when it is started using encrypted config file (and or data files).
 	EnvironmentDecryptionPassword = "LAITOS_DECRYPTION_PASSWORD"
+	// EnvironmentSupervised is a name of environment variable, the supervisor sets its value to "true" when it
+	// launches laitos main program, letting the main program know that it will be restarted after exiting.
+	EnvironmentSupervised = "LAITOS_SUPERVISED"
 )
 
 var (
@@ -22,12 +26,6 @@ var (
 	// ConfigFilePath is the absolute path to JSON configuration file that was used to launch this program.
 	ConfigFilePath string
 
-	// EnableAWSIntegration is a program-global flag that determines whether to integrate with various AWS services for the normal operation of laitos,
-	// an example of such integration feature is to send incoming store&forward message to kinesis firehose.
-	EnableAWSIntegration bool
-	// EnablePrometheusIntegration is a program-global flag that determines whether to enable integration with prometheus by collecting and
-	// serving metrics readings.
-	EnablePrometheusIntegration bool
 	// EmergencyLockDown is a flag checked by features and daemons, they should stop functioning or refuse to serve when the flag is true.
 	EmergencyLockDown bool
 	// ErrEmergencyLockDown is returned by some daemons to inform user that lock-down is in effect.
@@ -48,10 +46,33 @@ var (
 	// side of programming mistakes.
 	ProgramDataDecryptionPasswordInput = make(chan string, 10)
 
+	// maintenanceMode is turned on and off by the operator via SetMaintenanceMode.
+	maintenanceMode atomic.Bool
+
 	// logger is used by some of the miscellaneous actions affecting laitos process globally.
 	logger = &lalog.Logger{ComponentName: "misc", ComponentID: []lalog.LoggerIDField{{Key: "PID", Value: os.Getpid()}}}
 )
 
+// IsSupervised returns true if this program was launched by laitos supervisor, which restarts the program after it exits.
+func IsSupervised() bool {
+	return os.Getenv(EnvironmentSupervised) == "true"
+}
+
+/*
+SetMaintenanceMode turns the maintenance mode on or off. In maintenance mode, web servers respond to most requests with
+a "service unavailable" page while the other daemons continue to function, giving the operator a chance to work on the
+web backend without disrupting e.g. the DNS and mail services that run in the same program.
+*/
+func SetMaintenanceMode(on bool) {
+	logger.Warning("", nil, "web server maintenance mode is now on? %v", on)
+	maintenanceMode.Store(on)
+}
+
+// IsMaintenanceMode returns true if the maintenance mode is in effect.
+func IsMaintenanceMode() bool {
+	return maintenanceMode.Load()
+}
+
 /*
 TriggerEmergencyLockDown turns on EmergencyLockDown flag, so that features and daemons will immediately (or very soon)
 stop functioning or refuse to serve more requests. The program process will keep running (i.e. not going to crash).
@@ -0,0 +1,157 @@
+package misc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// RetentionStoreLogs is the name of the in-memory buffer of the latest log messages.
+	RetentionStoreLogs = "Logs"
+	// RetentionStoreWarnings is the name of the in-memory buffer of the latest warning log messages.
+	RetentionStoreWarnings = "Warnings"
+	// DataRetentionIntervalSec is the default interval at which expired data are removed from the stores.
+	DataRetentionIntervalSec = 10 * 60
+)
+
+// DefaultDataRetention keeps track of all data stores of the program, it comes with the in-memory log buffers.
+var DefaultDataRetention = NewDataRetention()
+
+/*
+RetainedData is a store of data (e.g. request records, messages, reports) that may carry personal information of a client.
+Client identifier is a string that identifies a client in the data, such as an IP address, phone number, or host name.
+*/
+type RetainedData struct {
+	// Name is a unique name of the store, it is used in the retention configuration.
+	Name string
+	// PurgeClient removes all data related to the client identifier and returns the number of records removed.
+	PurgeClient func(clientID string) int
+	// ExpireBefore removes all data recorded before the timestamp and returns the number of records removed.
+	ExpireBefore func(time.Time) int
+}
+
+// DataRetention removes data from the stores when they expire, and wipes data of a client from all stores on demand.
+type DataRetention struct {
+	stores    map[string]RetainedData
+	maxAgeSec map[string]int
+	mutex     *sync.Mutex
+	periodic  *Periodic
+}
+
+// NewDataRetention returns an initialised data retention manager that comes with the in-memory log buffers.
+func NewDataRetention() *DataRetention {
+	ret := &DataRetention{
+		stores:    make(map[string]RetainedData),
+		maxAgeSec: make(map[string]int),
+		mutex:     new(sync.Mutex),
+	}
+	ret.Register(RetainedData{
+		Name: RetentionStoreLogs,
+		PurgeClient: func(clientID string) int {
+			return lalog.LatestLogs.RemoveIf(func(msg string) bool { return strings.Contains(msg, clientID) })
+		},
+		ExpireBefore: lalog.LatestLogs.RemoveOlderThan,
+	})
+	ret.Register(RetainedData{
+		Name: RetentionStoreWarnings,
+		PurgeClient: func(clientID string) int {
+			return lalog.LatestWarnings.RemoveIf(func(msg string) bool { return strings.Contains(msg, clientID) })
+		},
+		ExpireBefore: lalog.LatestWarnings.RemoveOlderThan,
+	})
+	return ret
+}
+
+// Register adds a store to the retention manager, it replaces the existing store of the same name.
+func (retention *DataRetention) Register(store RetainedData) {
+	retention.mutex.Lock()
+	defer retention.mutex.Unlock()
+	retention.stores[store.Name] = store
+}
+
+// GetStoreNames returns the names of all registered stores in alphabetical order.
+func (retention *DataRetention) GetStoreNames() []string {
+	retention.mutex.Lock()
+	defer retention.mutex.Unlock()
+	ret := make([]string, 0, len(retention.stores))
+	for name := range retention.stores {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+/*
+SetMaxAgeSec configures the maximum age of data kept in each store, the key is store name and value is the maximum age
+in seconds. Stores without a maximum age keep their data until they are evicted by the store's own capacity limit.
+*/
+func (retention *DataRetention) SetMaxAgeSec(maxAgeSec map[string]int) error {
+	retention.mutex.Lock()
+	defer retention.mutex.Unlock()
+	newMaxAge := make(map[string]int)
+	for name, sec := range maxAgeSec {
+		if sec < 1 {
+			return fmt.Errorf("DataRetention.SetMaxAgeSec: maximum age of store \"%s\" must be a positive integer", name)
+		}
+		newMaxAge[name] = sec
+	}
+	retention.maxAgeSec = newMaxAge
+	return nil
+}
+
+// Purge removes data related to the client identifier from all stores, and returns the number of records removed from each store.
+func (retention *DataRetention) Purge(clientID string) map[string]int {
+	retention.mutex.Lock()
+	defer retention.mutex.Unlock()
+	ret := make(map[string]int)
+	if strings.TrimSpace(clientID) == "" {
+		return ret
+	}
+	for name, store := range retention.stores {
+		ret[name] = store.PurgeClient(clientID)
+	}
+	// Do not log the client identifier, or it would end up in the log buffer again.
+	logger.Info("", nil, "purged client data - %v", ret)
+	return ret
+}
+
+// Expire removes expired data from the stores that have a maximum age, and returns the number of records removed from each store.
+func (retention *DataRetention) Expire(now time.Time) map[string]int {
+	retention.mutex.Lock()
+	defer retention.mutex.Unlock()
+	ret := make(map[string]int)
+	for name, sec := range retention.maxAgeSec {
+		if store, exists := retention.stores[name]; exists {
+			ret[name] = store.ExpireBefore(now.Add(-time.Duration(sec) * time.Second))
+		}
+	}
+	return ret
+}
+
+// StartPeriodicExpiry removes expired data from the stores at regular interval, until the context is cancelled.
+func (retention *DataRetention) StartPeriodicExpiry(ctx context.Context, intervalSec int) error {
+	if intervalSec < 1 {
+		intervalSec = DataRetentionIntervalSec
+	}
+	retention.mutex.Lock()
+	defer retention.mutex.Unlock()
+	if retention.periodic != nil {
+		retention.periodic.Stop()
+	}
+	retention.periodic = &Periodic{
+		LogActorName: "DataRetention",
+		Interval:     time.Duration(intervalSec) * time.Second,
+		MaxInt:       1,
+		Func: func(context.Context, int, int) error {
+			retention.Expire(time.Now())
+			return nil
+		},
+	}
+	return retention.periodic.Start(ctx)
+}
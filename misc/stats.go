@@ -94,9 +94,17 @@ func (s *Stats) DisplayValue() StatsDisplayValue {
 	return StatsDisplayValue{
 		Lowest:  s.lowest / s.DisplayFormat.DivisionFactor,
 		Average: s.average / s.DisplayFormat.DivisionFactor,
-		Highest: s.average / s.DisplayFormat.DivisionFactor,
+		Highest: s.highest / s.DisplayFormat.DivisionFactor,
 		Total:   s.total / s.DisplayFormat.DivisionFactor,
 		Count:   s.count,
 		Summary: fmt.Sprintf(format, s.lowest/s.DisplayFormat.DivisionFactor, s.average/s.DisplayFormat.DivisionFactor, s.highest/s.DisplayFormat.DivisionFactor, s.total/s.DisplayFormat.DivisionFactor, s.count),
 	}
 }
+
+// Reset clears the counter and numeric statistics, as if the stats structure has just been initialised.
+func (s *Stats) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.count = 0
+	s.lowest, s.highest, s.average, s.total = 0, 0, 0, 0
+}
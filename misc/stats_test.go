@@ -48,7 +48,7 @@ func TestStats(t *testing.T) {
 		want := StatsDisplayValue{
 			Lowest:  0.1,
 			Average: 0.3,
-			Highest: 0.3,
+			Highest: 0.6,
 			Total:   1.2,
 			Count:   4,
 			Summary: "0.10/0.30/0.60,1.20(4)",
@@ -58,4 +58,14 @@ func TestStats(t *testing.T) {
 			t.Fatalf("got: %+v, want: %+v", got, want)
 		}
 	})
+	t.Run("reset", func(t *testing.T) {
+		s.Reset()
+		if s.lowest != 0 || s.highest != 0 || s.average != 0 || s.total != 0 || s.count != 0 {
+			t.Fatalf("%+v", s)
+		}
+		s.Trigger(2.0)
+		if s.lowest != 2 || s.highest != 2 || s.average != 2 || s.total != 2 || s.count != 1 {
+			t.Fatalf("%+v", s)
+		}
+	})
 }
@@ -0,0 +1,140 @@
+package misc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultTLSMinVersion is the minimum TLS version of servers and clients unless configured otherwise.
+	DefaultTLSMinVersion = "1.2"
+	// DefaultTLSClientSessionCacheSize is the number of TLS sessions cached by clients for resumption.
+	DefaultTLSClientSessionCacheSize = 64
+)
+
+// TLSVersions maps the TLS version names used in the configuration to their protocol constants.
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// DefaultTLS is the TLS configuration shared by the servers (e.g. web and mail servers) and clients (e.g. HTTP clients).
+var DefaultTLS = NewTLSPolicy()
+
+// TLSSettings are the program-wide TLS settings of servers and clients.
+type TLSSettings struct {
+	// MinVersion is the minimum TLS version - "1.0", "1.1", "1.2", or "1.3". It defaults to "1.2".
+	MinVersion string `json:"MinVersion"`
+	/*
+		CipherSuites are the names of the permitted cipher suites (e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256") of TLS
+		1.2 and older versions. TLS 1.3 cipher suites are not configurable. It defaults to the secure suites of Go.
+	*/
+	CipherSuites []string `json:"CipherSuites"`
+	// ClientSessionCacheSize is the number of sessions cached by clients for resumption, a negative number turns off the cache.
+	ClientSessionCacheSize int `json:"ClientSessionCacheSize"`
+	/*
+		InsecureSkipVerifyHosts are the host names (or IP addresses) of the destinations that clients connect to
+		without verifying their certificates, it is useful for servers using self-signed certificates.
+	*/
+	InsecureSkipVerifyHosts []string `json:"InsecureSkipVerifyHosts"`
+}
+
+// TLSPolicy constructs TLS configuration of servers and clients from the program-wide TLS settings.
+type TLSPolicy struct {
+	minVersion         uint16
+	cipherSuites       []uint16
+	sessionCache       tls.ClientSessionCache
+	insecureSkipVerify map[string]struct{}
+	mutex              *sync.RWMutex
+}
+
+// NewTLSPolicy returns a TLS policy initialised with the default settings.
+func NewTLSPolicy() *TLSPolicy {
+	ret := &TLSPolicy{mutex: new(sync.RWMutex)}
+	if err := ret.SetSettings(TLSSettings{}); err != nil {
+		panic(err)
+	}
+	return ret
+}
+
+// SetSettings validates and applies the TLS settings, it leaves the policy unchanged in case of an error.
+func (policy *TLSPolicy) SetSettings(settings TLSSettings) error {
+	if settings.MinVersion == "" {
+		settings.MinVersion = DefaultTLSMinVersion
+	}
+	minVersion, exists := TLSVersions[settings.MinVersion]
+	if !exists {
+		return fmt.Errorf("TLSPolicy.SetSettings: unknown MinVersion \"%s\"", settings.MinVersion)
+	}
+	var cipherSuites []uint16
+	for _, name := range settings.CipherSuites {
+		id, found := getCipherSuiteID(name)
+		if !found {
+			return fmt.Errorf("TLSPolicy.SetSettings: unknown or insecure cipher suite \"%s\"", name)
+		}
+		cipherSuites = append(cipherSuites, id)
+	}
+	var sessionCache tls.ClientSessionCache
+	if settings.ClientSessionCacheSize == 0 {
+		sessionCache = tls.NewLRUClientSessionCache(DefaultTLSClientSessionCacheSize)
+	} else if settings.ClientSessionCacheSize > 0 {
+		sessionCache = tls.NewLRUClientSessionCache(settings.ClientSessionCacheSize)
+	}
+	insecureSkipVerify := make(map[string]struct{})
+	for _, host := range settings.InsecureSkipVerifyHosts {
+		insecureSkipVerify[strings.ToLower(host)] = struct{}{}
+	}
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	policy.minVersion = minVersion
+	policy.cipherSuites = cipherSuites
+	policy.sessionCache = sessionCache
+	policy.insecureSkipVerify = insecureSkipVerify
+	return nil
+}
+
+// getCipherSuiteID returns the ID of a secure cipher suite by its name.
+func getCipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// ServerConfig returns a TLS configuration for a server that presents the certificates.
+func (policy *TLSPolicy) ServerConfig(certs ...tls.Certificate) *tls.Config {
+	policy.mutex.RLock()
+	defer policy.mutex.RUnlock()
+	return &tls.Config{
+		Certificates: certs,
+		MinVersion:   policy.minVersion,
+		CipherSuites: policy.cipherSuites,
+	}
+}
+
+/*
+ClientConfig returns a TLS configuration for a client that connects to the server of the name. The server name may
+come with a port number, which is ignored.
+*/
+func (policy *TLSPolicy) ClientConfig(serverName string) *tls.Config {
+	if host, _, err := net.SplitHostPort(serverName); err == nil {
+		serverName = host
+	}
+	policy.mutex.RLock()
+	defer policy.mutex.RUnlock()
+	_, insecure := policy.insecureSkipVerify[strings.ToLower(serverName)]
+	return &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         policy.minVersion,
+		CipherSuites:       policy.cipherSuites,
+		ClientSessionCache: policy.sessionCache,
+		InsecureSkipVerify: insecure,
+	}
+}
@@ -0,0 +1,48 @@
+package misc
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	policy := NewTLSPolicy()
+	// Default settings
+	if conf := policy.ServerConfig(); conf.MinVersion != tls.VersionTLS12 || conf.CipherSuites != nil {
+		t.Fatalf("%+v", conf)
+	}
+	if conf := policy.ClientConfig("example.com:443"); conf.ServerName != "example.com" || conf.ClientSessionCache == nil || conf.InsecureSkipVerify {
+		t.Fatalf("%+v", conf)
+	}
+	// Bad settings leave the policy unchanged
+	if err := policy.SetSettings(TLSSettings{MinVersion: "1.4"}); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := policy.SetSettings(TLSSettings{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}}); err == nil {
+		t.Fatal("did not error")
+	}
+	if conf := policy.ServerConfig(); conf.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("%+v", conf)
+	}
+	// Custom settings
+	if err := policy.SetSettings(TLSSettings{
+		MinVersion:              "1.3",
+		CipherSuites:            []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		ClientSessionCacheSize:  -1,
+		InsecureSkipVerifyHosts: []string{"Self-Signed.example.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{{1}}}
+	if conf := policy.ServerConfig(cert); conf.MinVersion != tls.VersionTLS13 || len(conf.Certificates) != 1 ||
+		!reflect.DeepEqual(conf.CipherSuites, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}) {
+		t.Fatalf("%+v", conf)
+	}
+	if conf := policy.ClientConfig("self-signed.example.com:8443"); !conf.InsecureSkipVerify || conf.ClientSessionCache != nil {
+		t.Fatalf("%+v", conf)
+	}
+	if conf := policy.ClientConfig("example.com"); conf.InsecureSkipVerify || conf.ServerName != "example.com" {
+		t.Fatalf("%+v", conf)
+	}
+}
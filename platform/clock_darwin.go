@@ -0,0 +1,19 @@
+package platform
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// slewSystemClock asks the kernel to gradually correct the system clock by the offset.
+func slewSystemClock(offset time.Duration) error {
+	delta := unix.NsecToTimeval(offset.Nanoseconds())
+	return unix.Adjtime(&delta, nil)
+}
+
+// stepSystemClock immediately corrects the system clock by the offset.
+func stepSystemClock(offset time.Duration) error {
+	now := unix.NsecToTimeval(time.Now().Add(offset).UnixNano())
+	return unix.Settimeofday(&now)
+}
@@ -0,0 +1,27 @@
+package platform
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// slewSystemClock asks the kernel to gradually correct the system clock by the offset, in the same way as adjtime(3).
+func slewSystemClock(offset time.Duration) error {
+	// The kernel expects the single-shot offset in microseconds, the offset is small enough to fit in the Usec field.
+	magnitude := unix.NsecToTimeval(offset.Abs().Nanoseconds())
+	timex := unix.Timex{Modes: unix.ADJ_OFFSET_SINGLESHOT, Offset: magnitude.Usec}
+	if offset < 0 {
+		timex.Offset = -timex.Offset
+	}
+	_, err := unix.Adjtimex(&timex)
+	return err
+}
+
+// stepSystemClock immediately corrects the system clock by the offset.
+func stepSystemClock(offset time.Duration) error {
+	// ADJ_SETOFFSET adds the offset to the clock atomically, unaffected by the delay between reading and setting the clock.
+	timex := unix.Timex{Modes: unix.ADJ_SETOFFSET, Time: unix.NsecToTimeval(offset.Nanoseconds())}
+	_, err := unix.Adjtimex(&timex)
+	return err
+}
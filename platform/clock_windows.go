@@ -0,0 +1,35 @@
+package platform
+
+import (
+	"errors"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var procSetSystemTime = windows.NewLazySystemDLL("kernel32.dll").NewProc("SetSystemTime")
+
+// slewSystemClock is not supported on Windows, the caller steps the clock instead.
+func slewSystemClock(offset time.Duration) error {
+	return errors.ErrUnsupported
+}
+
+// stepSystemClock immediately corrects the system clock by the offset.
+func stepSystemClock(offset time.Duration) error {
+	now := time.Now().Add(offset).UTC()
+	sysTime := windows.Systemtime{
+		Year:         uint16(now.Year()),
+		Month:        uint16(now.Month()),
+		DayOfWeek:    uint16(now.Weekday()),
+		Day:          uint16(now.Day()),
+		Hour:         uint16(now.Hour()),
+		Minute:       uint16(now.Minute()),
+		Second:       uint16(now.Second()),
+		Milliseconds: uint16(now.Nanosecond() / int(time.Millisecond)),
+	}
+	if ret, _, err := procSetSystemTime.Call(uintptr(unsafe.Pointer(&sysTime))); ret == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// HelperProcessReapTimeoutSec is the maximum number of seconds to wait for a killed helper process to exit.
+	HelperProcessReapTimeoutSec = 10
+	// HelperProcessReapIntervalSec is the default interval at which orphaned zombie processes are reaped.
+	HelperProcessReapIntervalSec = 60
+)
+
+/*
+HelperProcessLimits are the resource limits enforced on each external helper process (and its child processes) spawned
+by laitos, such as shell commands and emulators. On Linux the limits are enforced by cgroup (v2), and on Windows by job
+object. A zero value means unlimited.
+*/
+type HelperProcessLimits struct {
+	// MaxMemoryMB is the maximum amount of memory used by the process and its children.
+	MaxMemoryMB int `json:"MaxMemoryMB"`
+	// MaxCPUPercent is the maximum CPU time the process and its children may use, 100 equals to one CPU core on Linux
+	// and all CPU cores on Windows.
+	MaxCPUPercent int `json:"MaxCPUPercent"`
+	// MaxProcesses is the maximum number of processes (and threads on Linux) that the helper process may run.
+	MaxProcesses int `json:"MaxProcesses"`
+}
+
+// IsEmpty returns true if none of the limits is in effect.
+func (limits HelperProcessLimits) IsEmpty() bool {
+	return limits.MaxMemoryMB < 1 && limits.MaxCPUPercent < 1 && limits.MaxProcesses < 1
+}
+
+// helperProcessLimiter enforces resource limits on a helper process using OS-specific facilities.
+type helperProcessLimiter interface {
+	// killAll kills all processes under the limiter.
+	killAll() bool
+	// release frees the OS resources held by the limiter.
+	release()
+}
+
+// HelperProcess is an external process started and tracked by HelperProcessManager.
+type HelperProcess struct {
+	Name      string    // Name is the name of the helper program, usually its executable.
+	PID       int       // PID is the process ID.
+	StartedAt time.Time // StartedAt is the time at which the process started.
+
+	cmd     *exec.Cmd
+	limiter helperProcessLimiter
+	exited  chan struct{}
+	exitErr error
+}
+
+// Exited returns a channel that is closed after the process exits and its exit status has been retrieved.
+func (helper *HelperProcess) Exited() <-chan struct{} {
+	return helper.exited
+}
+
+// Wait blocks until the process exits and then returns the error of its exit status (e.g. abnormal exit code) if any.
+func (helper *HelperProcess) Wait() error {
+	<-helper.exited
+	return helper.exitErr
+}
+
+/*
+Kill kills the process and its child processes, and then waits for the process manager to retrieve the exit status.
+The function gives the processes a second to clean up after themselves.
+*/
+func (helper *HelperProcess) Kill() (success bool) {
+	select {
+	case <-helper.exited:
+		return true
+	default:
+	}
+	success = terminateProcess(helper.cmd.Process)
+	// Descendants that have left the process group are still under the limiter.
+	if helper.limiter != nil && helper.limiter.killAll() {
+		success = true
+	}
+	select {
+	case <-helper.exited:
+	case <-time.After(HelperProcessReapTimeoutSec * time.Second):
+		logger.Warning(helper.Name, nil, "process %d did not exit after being killed", helper.PID)
+		success = false
+	}
+	return
+}
+
+/*
+HelperProcessManager starts and keeps track of the external processes spawned by laitos. It enforces resource limits on
+them, retrieves their exit status as soon as they exit, and kills them on demand. When laitos runs as the init process
+(e.g. in a container), the manager also reaps the orphaned zombie processes that are left behind by helpers.
+*/
+type HelperProcessManager struct {
+	helpers map[int]*HelperProcess
+	limits  HelperProcessLimits
+	// zombies are the orphaned zombie processes found in the previous round of reaping.
+	zombies map[int]struct{}
+	mutex   *sync.Mutex
+	cancel  context.CancelFunc
+}
+
+// DefaultHelperProcesses is the process manager of all external helper processes spawned by laitos.
+var DefaultHelperProcesses = NewHelperProcessManager()
+
+// NewHelperProcessManager returns an initialised helper process manager without resource limits.
+func NewHelperProcessManager() *HelperProcessManager {
+	return &HelperProcessManager{
+		helpers: make(map[int]*HelperProcess),
+		zombies: make(map[int]struct{}),
+		mutex:   new(sync.Mutex),
+	}
+}
+
+// SetLimits changes the resource limits of helper processes started from now on.
+func (mgr *HelperProcessManager) SetLimits(limits HelperProcessLimits) error {
+	if limits.MaxMemoryMB < 0 || limits.MaxCPUPercent < 0 || limits.MaxProcesses < 0 {
+		return errors.New("HelperProcessManager.SetLimits: limits must not be negative")
+	}
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	mgr.limits = limits
+	return nil
+}
+
+/*
+Start starts the command and keeps track of the process until it exits. The process is placed into a new process group
+unless the command already comes with its own process attributes. Resource limits are enforced on a best-effort basis,
+the process continues to run without limits if the OS does not support them.
+*/
+func (mgr *HelperProcessManager) Start(name string, cmd *exec.Cmd) (*HelperProcess, error) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = extProcAttr
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("HelperProcessManager.Start: failed to start %s - %w", name, err)
+	}
+	helper := &HelperProcess{
+		Name:      name,
+		PID:       cmd.Process.Pid,
+		StartedAt: time.Now(),
+		cmd:       cmd,
+		exited:    make(chan struct{}),
+	}
+	mgr.mutex.Lock()
+	limits := mgr.limits
+	mgr.helpers[helper.PID] = helper
+	mgr.mutex.Unlock()
+	if !limits.IsEmpty() {
+		limiter, err := newHelperProcessLimiter(helper.Name, helper.PID, limits)
+		if err != nil {
+			logger.Warning(name, err, "process %d will run without resource limits", helper.PID)
+		}
+		helper.limiter = limiter
+	}
+	// Retrieve the exit status as soon as the process exits, so that it does not become a zombie.
+	go func() {
+		helper.exitErr = cmd.Wait()
+		if helper.limiter != nil {
+			helper.limiter.release()
+		}
+		mgr.mutex.Lock()
+		delete(mgr.helpers, helper.PID)
+		mgr.mutex.Unlock()
+		close(helper.exited)
+	}()
+	return helper, nil
+}
+
+// List returns the helper processes that are still running, ordered by PID.
+func (mgr *HelperProcessManager) List() []*HelperProcess {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	ret := make([]*HelperProcess, 0, len(mgr.helpers))
+	for _, helper := range mgr.helpers {
+		ret = append(ret, helper)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].PID < ret[j].PID
+	})
+	return ret
+}
+
+// KillAll kills all running helper processes and returns the number of processes killed.
+func (mgr *HelperProcessManager) KillAll() (killed int) {
+	for _, helper := range mgr.List() {
+		if helper.Kill() {
+			killed++
+		}
+	}
+	return
+}
+
+// ReapOrphans retrieves the exit status of orphaned zombie processes and returns the number of processes reaped.
+func (mgr *HelperProcessManager) ReapOrphans() int {
+	mgr.mutex.Lock()
+	defer mgr.mutex.Unlock()
+	reaped, zombies := reapOrphans(func(pid int) bool {
+		_, tracked := mgr.helpers[pid]
+		return tracked
+	}, mgr.zombies)
+	mgr.zombies = zombies
+	if reaped > 0 {
+		logger.Info("", nil, "reaped %d orphaned zombie processes", reaped)
+	}
+	return reaped
+}
+
+// StartReaper reaps orphaned zombie processes at regular interval, until the context is cancelled.
+func (mgr *HelperProcessManager) StartReaper(ctx context.Context, intervalSec int) {
+	if intervalSec < 1 {
+		intervalSec = HelperProcessReapIntervalSec
+	}
+	mgr.mutex.Lock()
+	if mgr.cancel != nil {
+		mgr.cancel()
+	}
+	ctx, mgr.cancel = context.WithCancel(ctx)
+	mgr.mutex.Unlock()
+	go func() {
+		ticker := time.NewTicker(time.Duration(intervalSec) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mgr.ReapOrphans()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,13 @@
+package platform
+
+import "errors"
+
+// newHelperProcessLimiter returns an error because there is no resource limit facility on macOS comparable to cgroup.
+func newHelperProcessLimiter(name string, pid int, limits HelperProcessLimits) (helperProcessLimiter, error) {
+	return nil, errors.New("newHelperProcessLimiter: resource limits are not supported on macOS")
+}
+
+// reapOrphans does nothing because laitos does not run as the init process on macOS.
+func reapOrphans(isTracked func(int) bool, previous map[int]struct{}) (int, map[int]struct{}) {
+	return 0, make(map[int]struct{})
+}
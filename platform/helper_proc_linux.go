@@ -0,0 +1,108 @@
+package platform
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// HelperProcessCgroupDir is the cgroup (v2) directory under which each helper process gets its own cgroup.
+var HelperProcessCgroupDir = "/sys/fs/cgroup/laitos-helpers"
+
+// cgroupLimiter places a helper process into its own cgroup.
+type cgroupLimiter struct {
+	dir string
+}
+
+// newHelperProcessLimiter creates a cgroup for the process, writes the limits, and then moves the process into the cgroup.
+func newHelperProcessLimiter(name string, pid int, limits HelperProcessLimits) (helperProcessLimiter, error) {
+	if err := os.MkdirAll(HelperProcessCgroupDir, 0755); err != nil {
+		return nil, fmt.Errorf("newHelperProcessLimiter: failed to create cgroup directory - %w", err)
+	}
+	// The controllers are usually enabled already, ignore the error of enabling them again.
+	_ = os.WriteFile(filepath.Join(HelperProcessCgroupDir, "cgroup.subtree_control"), []byte("+memory +cpu +pids"), 0644)
+	limiter := &cgroupLimiter{dir: filepath.Join(HelperProcessCgroupDir, strconv.Itoa(pid))}
+	if err := os.Mkdir(limiter.dir, 0755); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("newHelperProcessLimiter: failed to create cgroup for %s - %w", name, err)
+	}
+	settings := make(map[string]string)
+	if limits.MaxMemoryMB > 0 {
+		settings["memory.max"] = strconv.FormatInt(int64(limits.MaxMemoryMB)*1048576, 10)
+	}
+	if limits.MaxCPUPercent > 0 {
+		// The quota is the CPU time (in microseconds) available to the cgroup in each period of 100 milliseconds.
+		settings["cpu.max"] = fmt.Sprintf("%d 100000", limits.MaxCPUPercent*1000)
+	}
+	if limits.MaxProcesses > 0 {
+		settings["pids.max"] = strconv.Itoa(limits.MaxProcesses)
+	}
+	settings["cgroup.procs"] = strconv.Itoa(pid)
+	for _, file := range []string{"memory.max", "cpu.max", "pids.max", "cgroup.procs"} {
+		if value, exists := settings[file]; exists {
+			if err := os.WriteFile(filepath.Join(limiter.dir, file), []byte(value), 0644); err != nil {
+				limiter.release()
+				return nil, fmt.Errorf("newHelperProcessLimiter: failed to write %s for %s - %w", file, name, err)
+			}
+		}
+	}
+	return limiter, nil
+}
+
+// killAll kills all processes in the cgroup, it requires Linux kernel 5.14 or newer.
+func (limiter *cgroupLimiter) killAll() bool {
+	return os.WriteFile(filepath.Join(limiter.dir, "cgroup.kill"), []byte("1"), 0644) == nil
+}
+
+// release removes the cgroup, which only succeeds after all of its processes have exited.
+func (limiter *cgroupLimiter) release() {
+	_ = os.Remove(limiter.dir)
+}
+
+/*
+reapOrphans retrieves the exit status of orphaned zombie processes when laitos runs as the init process (PID 1), which
+inherits the orphans left behind by helper processes. A zombie is only reaped if it was already found in the previous
+round and it is not a tracked helper, this avoids stealing the exit status from the goroutines waiting for their own
+child processes. The function returns the number of processes reaped and the zombies found in this round.
+*/
+func reapOrphans(isTracked func(int) bool, previous map[int]struct{}) (int, map[int]struct{}) {
+	zombies := make(map[int]struct{})
+	if os.Getpid() != 1 {
+		return 0, zombies
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, zombies
+	}
+	var reaped int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || isTracked(pid) {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The format is "pid (comm) state ppid ...", comm may contain space and parentheses.
+		closeParen := strings.LastIndexByte(string(stat), ')')
+		if closeParen < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[closeParen+1:]))
+		if len(fields) < 2 || fields[0] != "Z" || fields[1] != "1" {
+			continue
+		}
+		if _, found := previous[pid]; !found {
+			zombies[pid] = struct{}{}
+			continue
+		}
+		var status syscall.WaitStatus
+		if wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && wpid == pid {
+			reaped++
+		}
+	}
+	return reaped, zombies
+}
@@ -0,0 +1,51 @@
+package platform
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHelperProcessManager(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test requires unix-like shell")
+	}
+	mgr := NewHelperProcessManager()
+	require.Error(t, mgr.SetLimits(HelperProcessLimits{MaxMemoryMB: -1}))
+	require.NoError(t, mgr.SetLimits(HelperProcessLimits{}))
+
+	_, err := mgr.Start("does-not-exist", exec.Command("/this/program/does/not/exist"))
+	require.Error(t, err)
+
+	// A process that exits by itself is no longer tracked.
+	helper, err := mgr.Start("true", exec.Command("/bin/sh", "-c", "exit 0"))
+	require.NoError(t, err)
+	require.NoError(t, helper.Wait())
+	require.Empty(t, mgr.List())
+	helper, err = mgr.Start("false", exec.Command("/bin/sh", "-c", "exit 1"))
+	require.NoError(t, err)
+	require.Error(t, helper.Wait())
+
+	// Kill a process along with its child process.
+	helper, err = mgr.Start("sleep", exec.Command("/bin/sh", "-c", "sleep 60; sleep 60"))
+	require.NoError(t, err)
+	require.Len(t, mgr.List(), 1)
+	require.Equal(t, helper.PID, mgr.List()[0].PID)
+	begin := time.Now()
+	require.Equal(t, 1, mgr.KillAll())
+	require.Less(t, time.Since(begin), HelperProcessReapTimeoutSec*time.Second)
+	select {
+	case <-helper.Exited():
+	default:
+		t.Fatal("process did not exit")
+	}
+	require.Empty(t, mgr.List())
+	// Killing an exited process is harmless.
+	require.True(t, helper.Kill())
+
+	// The test program is not the init process, there is nothing to reap.
+	require.Zero(t, mgr.ReapOrphans())
+}
@@ -0,0 +1,85 @@
+package platform
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	jobObjectCPURateControlEnable  = 0x1
+	jobObjectCPURateControlHardCap = 0x4
+)
+
+// jobObjectCPURateControlInformation is the JOBOBJECT_CPU_RATE_CONTROL_INFORMATION structure.
+type jobObjectCPURateControlInformation struct {
+	ControlFlags uint32
+	CPURate      uint32
+}
+
+// jobObjectLimiter places a helper process into its own job object.
+type jobObjectLimiter struct {
+	job windows.Handle
+}
+
+// newHelperProcessLimiter creates a job object with the limits, and then assigns the process to the job object.
+func newHelperProcessLimiter(name string, pid int, limits HelperProcessLimits) (helperProcessLimiter, error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("newHelperProcessLimiter: failed to create job object for %s - %w", name, err)
+	}
+	limiter := &jobObjectLimiter{job: job}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	// Closing the job object kills the processes that are left behind.
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	if limits.MaxMemoryMB > 0 {
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_JOB_MEMORY
+		info.JobMemoryLimit = uintptr(limits.MaxMemoryMB) * 1048576
+	}
+	if limits.MaxProcesses > 0 {
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_ACTIVE_PROCESS
+		info.BasicLimitInformation.ActiveProcessLimit = uint32(limits.MaxProcesses)
+	}
+	if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		limiter.release()
+		return nil, fmt.Errorf("newHelperProcessLimiter: failed to set limits for %s - %w", name, err)
+	}
+	if limits.MaxCPUPercent > 0 && limits.MaxCPUPercent < 100 {
+		// The CPU rate is the portion of all CPU cores in 1/10000.
+		cpuInfo := jobObjectCPURateControlInformation{
+			ControlFlags: jobObjectCPURateControlEnable | jobObjectCPURateControlHardCap,
+			CPURate:      uint32(limits.MaxCPUPercent) * 100,
+		}
+		if _, err := windows.SetInformationJobObject(job, windows.JobObjectCpuRateControlInformation, uintptr(unsafe.Pointer(&cpuInfo)), uint32(unsafe.Sizeof(cpuInfo))); err != nil {
+			limiter.release()
+			return nil, fmt.Errorf("newHelperProcessLimiter: failed to set CPU limit for %s - %w", name, err)
+		}
+	}
+	proc, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(pid))
+	if err != nil {
+		limiter.release()
+		return nil, fmt.Errorf("newHelperProcessLimiter: failed to open process of %s - %w", name, err)
+	}
+	defer windows.CloseHandle(proc)
+	if err := windows.AssignProcessToJobObject(job, proc); err != nil {
+		limiter.release()
+		return nil, fmt.Errorf("newHelperProcessLimiter: failed to assign %s to job object - %w", name, err)
+	}
+	return limiter, nil
+}
+
+// killAll terminates all processes in the job object.
+func (limiter *jobObjectLimiter) killAll() bool {
+	return windows.TerminateJobObject(limiter.job, 1) == nil
+}
+
+// release closes the job object.
+func (limiter *jobObjectLimiter) release() {
+	_ = windows.CloseHandle(limiter.job)
+}
+
+// reapOrphans does nothing because there are no zombie processes on Windows.
+func reapOrphans(isTracked func(int) bool, previous map[int]struct{}) (int, map[int]struct{}) {
+	return 0, make(map[int]struct{})
+}
@@ -24,7 +24,7 @@ const (
 	/*
 	   UtilityDir is an element of PATH that points to a directory where laitos bundled utility programs are stored. The
 	   utility programs are not essential to most of laitos operations, however they come in handy in certain scenarios:
-	   - statically linked "busybox" (maintenance daemon uses it to synchronise system clock)
+	   - statically linked "busybox" (its rich set of utilities help with shell usage)
 	   - statically linked "toybox" (its rich set of utilities help with shell usage)
 	*/
 	UtilityDir = "/tmp/laitos-util"
@@ -561,6 +561,17 @@ func SetTimeZone(zone string) error {
 	return nil
 }
 
+// IsSensitiveEnvName returns true if the environment variable name suggests that its value may reveal API secrets or
+// passwords.
+func IsSensitiveEnvName(envKey string) bool {
+	for _, needle := range []string{"access", "cred", "key", "pass", "secret", "token", misc.EnvironmentDecryptionPassword} {
+		if strings.Contains(strings.ToLower(envKey), needle) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetRedactedEnviron returns the program's environment varibles in "Key=Value" string array similar to those returned
 // by os.Environ. Sensitive environment variables that amy reveal API secrets or passwords will be present, though their
 // values will be string "REDACTED".
@@ -572,16 +583,9 @@ func GetRedactedEnviron() []string {
 		if len(components) < 2 {
 			continue
 		}
-		envKey := components[0]
-		var redacted bool
-		for _, needle := range []string{"access", "cred", "key", "pass", "secret", "token", misc.EnvironmentDecryptionPassword} {
-			if strings.Contains(strings.ToLower(envKey), needle) {
-				ret = append(ret, envKey+"=REDACTED")
-				redacted = true
-				break
-			}
-		}
-		if !redacted {
+		if envKey := components[0]; IsSensitiveEnvName(envKey) {
+			ret = append(ret, envKey+"=REDACTED")
+		} else {
 			ret = append(ret, keyValue)
 		}
 	}
@@ -15,8 +15,13 @@ var extProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
 // GetRootDiskUsageKB returns used and total space of the file system mounted on /. Returns 0 if they cannot be determined.
 func GetRootDiskUsageKB() (usedKB, freeKB, totalKB int64) {
+	return GetDiskUsageKB("/")
+}
+
+// GetDiskUsageKB returns used and total space of the file system mounted on the path. Returns 0 if they cannot be determined.
+func GetDiskUsageKB(mountPoint string) (usedKB, freeKB, totalKB int64) {
 	fs := syscall.Statfs_t{}
-	err := syscall.Statfs("/", &fs)
+	err := syscall.Statfs(mountPoint, &fs)
 	if err != nil {
 		return
 	}
@@ -31,10 +36,23 @@ func KillProcess(proc *os.Process) (success bool) {
 	if proc == nil {
 		return true
 	}
-	pid := proc.Pid
-	if pid < 1 {
+	if proc.Pid < 1 {
 		return true
 	}
+	success = terminateProcess(proc)
+	/*
+		A killed process remains in process table, laitos as the parent process must retrieve
+		the exit status, or the killed process will become a zombie.
+	*/
+	_, _ = proc.Wait()
+	_ = proc.Release()
+	return
+}
+
+// terminateProcess kills the process and its child processes without retrieving the exit status.
+// The function gives the processes a second to clean up after themselves.
+func terminateProcess(proc *os.Process) (success bool) {
+	pid := proc.Pid
 	// Send SIGTERM to the process group (if any) and the process itself
 	if killErr := syscall.Kill(-pid, syscall.SIGTERM); killErr == nil {
 		success = true
@@ -54,12 +72,6 @@ func KillProcess(proc *os.Process) (success bool) {
 	if proc.Kill() == nil {
 		success = true
 	}
-	/*
-		A killed process remains in process table, laitos as the parent process must retrieve
-		the exit status, or the killed process will become a zombie.
-	*/
-	_, _ = proc.Wait()
-	_ = proc.Release()
 	return
 }
 
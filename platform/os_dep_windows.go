@@ -15,15 +15,33 @@ func GetRootDiskUsageKB() (usedKB, freeKB, totalKB int64) {
 	return 0, 0, 0
 }
 
+// GetDiskUsageKB returns used and total space of the file system mounted on the path. Returns 0 if they cannot be determined.
+func GetDiskUsageKB(mountPoint string) (usedKB, freeKB, totalKB int64) {
+	return 0, 0, 0
+}
+
 // KillProcess kills the process and its child processes. The function gives the processes a second to clean up after themselves.
 func KillProcess(proc *os.Process) (success bool) {
 	if proc == nil {
 		return true
 	}
-	pid := proc.Pid
-	if pid < 1 {
+	if proc.Pid < 1 {
 		return true
 	}
+	success = terminateProcess(proc)
+	/*
+		For Linux system it is necessary to use proc.Wait() to clean up after the process, or there will be a zombie process.
+		For Windows it is rather strange, calling proc.Wait() on an already killed process hangs indefinitely.
+		Therefore instead of calling proc.Wait(), just call proc.Release() in case go has some "resource" to release.
+	*/
+	_ = proc.Release()
+	return
+}
+
+// terminateProcess kills the process and its child processes without releasing the process resources.
+// The function gives the processes a second to clean up after themselves.
+func terminateProcess(proc *os.Process) (success bool) {
+	pid := proc.Pid
 	// Usage of taskkill.exe is explained in: https://docs.microsoft.com/en-us/windows-server/administration/windows-commands/taskkill
 	// Terminate the process and its children without forcing
 	err := exec.Command(`C:\Windows\system32\taskkill.exe`, "/t", "/pid", strconv.Itoa(pid)).Run()
@@ -40,12 +58,6 @@ func KillProcess(proc *os.Process) (success bool) {
 	if proc.Kill() == nil {
 		success = true
 	}
-	/*
-		For Linux system it is necessary to use proc.Wait() to clean up after the process, or there will be a zombie process.
-		For Windows it is rather strange, calling proc.Wait() on an already killed process hangs indefinitely.
-		Therefore instead of calling proc.Wait(), just call proc.Release() in case go has some "resource" to release.
-	*/
-	_ = proc.Release()
 	return
 }
 
@@ -31,6 +31,27 @@ type (
 	ExternalProcessStarter func([]string, int, io.WriteCloser, io.WriteCloser, chan<- error, <-chan struct{}, string, ...string) error
 )
 
+// ProgramOptions customise the execution of an external program by InvokeProgramWithOptions.
+type ProgramOptions struct {
+	// OnOutput is called with each chunk of the combined stdout and stderr as soon as the program produces it.
+	OnOutput func(chunk []byte)
+	/*
+		UsePTY runs the program in a pseudo terminal, which makes the program produce output as it does in an
+		interactive session, e.g. line-buffered and with progress indicators. Stdout and stderr are indistinguishable
+		in a pseudo terminal. This is only supported on Linux.
+	*/
+	UsePTY bool
+}
+
+// outputCallbackWriter calls the function with each chunk of output written to it.
+type outputCallbackWriter func(chunk []byte)
+
+func (fun outputCallbackWriter) Write(p []byte) (int, error) {
+	// The writer may reuse the buffer after Write returns.
+	fun(append([]byte(nil), p...))
+	return len(p), nil
+}
+
 // InvokeShell starts the shell interpreter and passes the script content to "-c" flag.
 // Nearly all shell interpreters across Linux and Windows accept the "-c" convention.
 // Return stdout+stderr combined, the maximum size is capped to MaxExternalProgramOutputBytes.
@@ -38,9 +59,22 @@ func InvokeShell(timeoutSec int, interpreter string, content string) (out string
 	return InvokeProgram(nil, timeoutSec, interpreter, "-c", content)
 }
 
+// InvokeShellWithLiveOutput works like InvokeShell, and additionally copies stdout+stderr to the live output writer
+// as the output is produced.
+func InvokeShellWithLiveOutput(timeoutSec int, interpreter string, content string, liveOutput io.Writer) (out string, err error) {
+	outBuf := lalog.NewByteLogWriter(liveOutput, MaxExternalProgramOutputBytes)
+	err = StartProgram(nil, timeoutSec, outBuf, outBuf, make(chan<- error, 1), make(<-chan struct{}), interpreter, "-c", content)
+	return string(outBuf.Retrieve(false)), err
+}
+
 // StartProgram starts an external process, with optionally added environment variables and timeout monitor.
 // The function waits for the process to terminate, and then returns the error at termination (e.g. abnormal exit codde) if any.
 func StartProgram(envVars []string, timeoutSec int, stdout, stderr io.WriteCloser, start chan<- error, terminate <-chan struct{}, program string, args ...string) error {
+	return startProgram(envVars, timeoutSec, false, stdout, stderr, start, terminate, program, args...)
+}
+
+// startProgram works like StartProgram, and optionally runs the program in a pseudo terminal whose output goes to stdout.
+func startProgram(envVars []string, timeoutSec int, usePTY bool, stdout, stderr io.WriteCloser, start chan<- error, terminate <-chan struct{}, program string, args ...string) error {
 	if timeoutSec < 1 {
 		return errors.New("invalid time limit")
 	}
@@ -68,6 +102,9 @@ func StartProgram(envVars []string, timeoutSec int, stdout, stderr io.WriteClose
 		return fmt.Errorf("failed to determine abs path of the program %q: %w", program, err)
 	}
 	var process *os.Process
+	var helper *HelperProcess
+	// ptyOutputDone is closed after the output of the pseudo terminal (if used) has been fully copied to stdout.
+	var ptyOutputDone chan struct{}
 	if localAppData := os.Getenv("LOCALAPPDATA"); len(localAppData) > 0 && strings.Contains(program, localAppData) {
 		// The Windows execution path. os.Exec is incompatible with Windows.
 		logger.Info(program, nil, "using os.StartProcess workaround to execute the program and will be unable to read program output")
@@ -89,23 +126,65 @@ func StartProgram(envVars []string, timeoutSec int, stdout, stderr io.WriteClose
 		proc.Stdout = stdout
 		proc.Stderr = stderr
 		proc.SysProcAttr = extProcAttr
-		startErr := proc.Start()
+		var ptyMaster, ptySlave *os.File
+		if usePTY {
+			var ptyErr error
+			if ptyMaster, ptySlave, ptyErr = openPTY(); ptyErr != nil {
+				start <- ptyErr
+				return fmt.Errorf("failed to allocate pseudo terminal for program %q: %w", program, ptyErr)
+			}
+			proc.Stdin, proc.Stdout, proc.Stderr = ptySlave, ptySlave, ptySlave
+			proc.SysProcAttr = ptyProcAttr
+		}
+		var startErr error
+		helper, startErr = DefaultHelperProcesses.Start(program, proc)
+		if ptySlave != nil {
+			// Only the program needs the slave end, the master end reaches EOF after the program closes it.
+			_ = ptySlave.Close()
+		}
 		if startErr != nil {
+			if ptyMaster != nil {
+				_ = ptyMaster.Close()
+			}
 			start <- startErr
-			return fmt.Errorf("failed to execute program %q: %v", program, err)
+			return fmt.Errorf("failed to execute program %q: %v", program, startErr)
 		}
 		close(start)
+		if ptyMaster != nil {
+			ptyOutputDone = make(chan struct{})
+			go func() {
+				_, _ = io.Copy(stdout, ptyMaster)
+				_ = ptyMaster.Close()
+				close(ptyOutputDone)
+			}()
+			defer func() {
+				// A background process left behind by the program may hold on to the terminal, do not wait for it forever.
+				select {
+				case <-ptyOutputDone:
+				case <-time.After(1 * time.Second):
+					_ = ptyMaster.Close()
+					<-ptyOutputDone
+				}
+			}()
+		}
 		process = proc.Process
 		go func() {
-			exitErr := proc.Wait()
+			exitErr := helper.Wait()
 			if exitErr == nil {
-				logger.Info(program, exitErr, "process %d exited normally after %d seconds", proc.Process.Pid, time.Now().Unix()-unixSecAtStart)
+				logger.Info(program, exitErr, "process %d exited normally after %d seconds", helper.PID, time.Now().Unix()-unixSecAtStart)
 			} else {
-				logger.Info(program, exitErr, "process %d exited abnormally after %d seconds", proc.Process.Pid, time.Now().Unix()-unixSecAtStart)
+				logger.Info(program, exitErr, "process %d exited abnormally after %d seconds", helper.PID, time.Now().Unix()-unixSecAtStart)
 			}
 			processExitChan <- exitErr
 		}()
 	}
+	// killProcess kills the helper process via the process manager, or the process started by the Windows workaround.
+	killProcess := func() bool {
+		if helper != nil {
+			return helper.Kill()
+		}
+		return KillProcess(process)
+	}
 	for {
 		// Monitor long-duration process, time-out condition, and regular process exit.
 		select {
@@ -123,14 +202,14 @@ func StartProgram(envVars []string, timeoutSec int, stdout, stderr io.WriteClose
 			// Forcibly kill the process upon exceeding time limit
 			if process != nil {
 				logger.Warning(program, nil, "killing process %d due to time limit (%d seconds)", process.Pid, timeoutSec)
-				if !KillProcess(process) {
+				if !killProcess() {
 					logger.Warning(program, nil, "failed to kill PID %d after time limit exceeded", process.Pid)
 				}
 			}
 		case <-terminate:
 			if process != nil {
 				logger.Info(program, nil, "killing process %d by request", process.Pid)
-				if !KillProcess(process) {
+				if !killProcess() {
 					logger.Warning(program, nil, "failed to kill PID %d", process.Pid)
 				}
 			}
@@ -144,7 +223,19 @@ func StartProgram(envVars []string, timeoutSec int, stdout, stderr io.WriteClose
 // and kills it before reacing the maximum execution timeout to prevent a runaway.
 // It returns stdout+stderr combined, the maximum size is capped to MaxExternalProgramOutputBytes.
 func InvokeProgram(envVars []string, timeoutSec int, program string, args ...string) (string, error) {
-	outBuf := lalog.NewByteLogWriter(io.Discard, MaxExternalProgramOutputBytes)
-	err := StartProgram(envVars, timeoutSec, outBuf, outBuf, make(chan<- error, 1), make(<-chan struct{}), program, args...)
+	return InvokeProgramWithOptions(envVars, timeoutSec, ProgramOptions{}, program, args...)
+}
+
+/*
+InvokeProgramWithOptions works like InvokeProgram, and additionally streams the output to a callback as the program
+produces it, or runs the program in a pseudo terminal, which allows a long-running program to show its progress.
+*/
+func InvokeProgramWithOptions(envVars []string, timeoutSec int, opts ProgramOptions, program string, args ...string) (string, error) {
+	var liveOutput io.Writer = io.Discard
+	if opts.OnOutput != nil {
+		liveOutput = outputCallbackWriter(opts.OnOutput)
+	}
+	outBuf := lalog.NewByteLogWriter(liveOutput, MaxExternalProgramOutputBytes)
+	err := startProgram(envVars, timeoutSec, opts.UsePTY, outBuf, outBuf, make(chan<- error, 1), make(<-chan struct{}), program, args...)
 	return string(outBuf.Retrieve(false)), err
 }
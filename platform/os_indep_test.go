@@ -3,6 +3,7 @@ package platform
 import (
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -112,3 +113,45 @@ func TestStartProgramTermination(t *testing.T) {
 		}
 	}
 }
+
+func TestInvokeProgramWithOptions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pseudo terminal is only supported on Linux")
+	}
+	// The output is streamed to the callback as the program produces it
+	var mutex sync.Mutex
+	var chunks []string
+	opts := ProgramOptions{OnOutput: func(chunk []byte) {
+		mutex.Lock()
+		chunks = append(chunks, string(chunk))
+		mutex.Unlock()
+	}}
+	out, err := InvokeProgramWithOptions(nil, 10, opts, "/bin/sh", "-c", "echo first; sleep 1; echo second >&2")
+	if err != nil || out != "first\nsecond\n" {
+		t.Fatal(err, out)
+	}
+	mutex.Lock()
+	if strings.Join(chunks, "") != out || len(chunks) < 2 {
+		t.Fatalf("%q", chunks)
+	}
+	mutex.Unlock()
+
+	// Without a pseudo terminal the program does not see a terminal
+	out, err = InvokeProgramWithOptions(nil, 10, ProgramOptions{}, "/bin/sh", "-c", "test -t 1 && echo tty || echo notty")
+	if err != nil || out != "notty\n" {
+		t.Fatal(err, out)
+	}
+	// The pseudo terminal translates line endings
+	out, err = InvokeProgramWithOptions(nil, 10, ProgramOptions{UsePTY: true}, "/bin/sh", "-c", "test -t 0 && test -t 1 && echo tty || echo notty")
+	if err != nil || out != "tty\r\n" {
+		t.Fatal(err, out)
+	}
+	// The program in a pseudo terminal is killed after timing out
+	begin := time.Now()
+	if _, err = InvokeProgramWithOptions(nil, 1, ProgramOptions{UsePTY: true}, "/bin/sh", "-c", "sleep 10"); err == nil {
+		t.Fatal("did not timeout")
+	}
+	if time.Since(begin) > 5*time.Second {
+		t.Fatal("did not kill before timeout")
+	}
+}
@@ -0,0 +1,14 @@
+package platform
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var ptyProcAttr *syscall.SysProcAttr = nil
+
+// openPTY is not supported on MacOS.
+func openPTY() (master, slave *os.File, err error) {
+	return nil, nil, errors.New("openPTY: pseudo terminal is not supported on MacOS")
+}
@@ -0,0 +1,41 @@
+package platform
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ptyProcAttr makes the new process a session leader with the pseudo terminal (its stdin) as the controlling terminal.
+// Being the session leader, the process also leads its own process group, so that its child processes are also killed
+// after timing out.
+var ptyProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+
+// openPTY allocates a pseudo terminal of 80 columns by 24 rows and returns its master and slave ends.
+func openPTY() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("openPTY: failed to open pseudo terminal multiplexer - %w", err)
+	}
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		_ = master.Close()
+		return nil, nil, fmt.Errorf("openPTY: failed to unlock pseudo terminal - %w", err)
+	}
+	num, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, fmt.Errorf("openPTY: failed to get pseudo terminal number - %w", err)
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", num), os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, fmt.Errorf("openPTY: failed to open pseudo terminal slave - %w", err)
+	}
+	if err := unix.IoctlSetWinsize(int(slave.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: 24, Col: 80}); err != nil {
+		logger.Info("openPTY", err, "failed to set pseudo terminal size")
+	}
+	return master, slave, nil
+}
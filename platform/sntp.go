@@ -0,0 +1,211 @@
+package platform
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SNTPQueryTimeoutSec is the timeout of each query made to an NTP server.
+	SNTPQueryTimeoutSec = 5
+	// SNTPMaxRoundTrip is the longest round trip of an NTP query that is still considered accurate enough.
+	SNTPMaxRoundTrip = 2 * time.Second
+	// SNTPMaxDisagreement is the maximum difference between the offset reported by an NTP server and the median offset
+	// of all servers, beyond which the server is considered to be a false ticker.
+	SNTPMaxDisagreement = 1 * time.Second
+	// MaxClockSlewOffset is the largest clock offset that is corrected by gradually slewing the system clock, a larger
+	// offset is corrected by stepping the system clock immediately.
+	MaxClockSlewOffset = 128 * time.Millisecond
+
+	// ntpEpochOffsetSec is the number of seconds between the NTP epoch (1900-01-01) and the Unix epoch (1970-01-01).
+	ntpEpochOffsetSec = 2208988800
+	ntpPacketLen      = 48
+)
+
+// DefaultNTPServers are public NTP servers queried for synchronising the system clock.
+var DefaultNTPServers = []string{"0.pool.ntp.org", "1.pool.ntp.org", "2.pool.ntp.org", "3.pool.ntp.org", "time.cloudflare.com"}
+
+// SNTPSample is the clock offset measured by querying an NTP server.
+type SNTPSample struct {
+	Server    string
+	Stratum   int
+	Offset    time.Duration // Offset is the difference to add to the system clock to match the server clock.
+	RoundTrip time.Duration
+}
+
+func (sample SNTPSample) String() string {
+	return fmt.Sprintf("%s (stratum %d) offset %v round trip %v", sample.Server, sample.Stratum, sample.Offset, sample.RoundTrip)
+}
+
+// toNTPTime converts the time into the 64-bit NTP timestamp format.
+func toNTPTime(t time.Time) uint64 {
+	nanos := uint64(t.UnixNano()) + ntpEpochOffsetSec*uint64(time.Second)
+	sec := nanos / uint64(time.Second)
+	frac := (nanos % uint64(time.Second)) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+// fromNTPTime converts the 64-bit NTP timestamp into time.
+func fromNTPTime(ntpTime uint64) time.Time {
+	sec := int64(ntpTime >> 32)
+	// The most significant bit is clear in the timestamps after 2036-02-07, which belong to the next NTP era (RFC 4330).
+	if sec&0x80000000 == 0 {
+		sec += 1 << 32
+	}
+	frac := int64(ntpTime & 0xffffffff)
+	return time.Unix(sec-ntpEpochOffsetSec, frac*int64(time.Second)>>32)
+}
+
+/*
+QuerySNTP queries the NTP server (host name or host:port) using the simple network time protocol (RFC 4330), and
+returns the clock offset between the system and the server. The server response is validated against the query, and
+a server that is unsynchronised or asks the client to stop querying (kiss-o'-death) results in an error.
+*/
+func QuerySNTP(ctx context.Context, server string) (sample SNTPSample, err error) {
+	sample.Server = server
+	addr := server
+	if _, _, splitErr := net.SplitHostPort(server); splitErr != nil {
+		addr = net.JoinHostPort(server, "123")
+	}
+	ctx, cancel := context.WithTimeout(ctx, SNTPQueryTimeoutSec*time.Second)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return sample, fmt.Errorf("QuerySNTP: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	// LI = 0 (no warning), VN = 4, Mode = 3 (client)
+	query := make([]byte, ntpPacketLen)
+	query[0] = 0<<6 | 4<<3 | 3
+	sentAt := time.Now()
+	// The server echoes the transmit timestamp back as the origin timestamp, which proves the response answers this query.
+	originTime := toNTPTime(sentAt)
+	binary.BigEndian.PutUint64(query[40:], originTime)
+	if _, err := conn.Write(query); err != nil {
+		return sample, fmt.Errorf("QuerySNTP: %w", err)
+	}
+	resp := make([]byte, 512)
+	var n int
+	for {
+		if n, err = conn.Read(resp); err != nil {
+			return sample, fmt.Errorf("QuerySNTP: %w", err)
+		}
+		// Ignore the stray responses that do not answer this query
+		if n >= ntpPacketLen && binary.BigEndian.Uint64(resp[24:]) == originTime {
+			break
+		}
+	}
+	// The monotonic clock reading of sentAt keeps the round trip accurate even if the system clock changes meanwhile
+	receivedAt := sentAt.Add(time.Since(sentAt))
+	leap, mode := resp[0]>>6, resp[0]&0x7
+	sample.Stratum = int(resp[1])
+	switch {
+	case mode != 4 && mode != 5:
+		return sample, fmt.Errorf("QuerySNTP: unexpected response mode %d", mode)
+	case sample.Stratum == 0:
+		return sample, fmt.Errorf("QuerySNTP: server sent kiss code %q", strings.TrimRight(string(resp[12:16]), "\x00"))
+	case leap == 3 || sample.Stratum > 15:
+		return sample, errors.New("QuerySNTP: server clock is not synchronised")
+	}
+	serverReceiveTime, serverTransmitTime := binary.BigEndian.Uint64(resp[32:]), binary.BigEndian.Uint64(resp[40:])
+	if serverTransmitTime == 0 {
+		return sample, errors.New("QuerySNTP: server response does not carry transmit timestamp")
+	}
+	serverReceivedAt, serverTransmittedAt := fromNTPTime(serverReceiveTime), fromNTPTime(serverTransmitTime)
+	sample.Offset = (serverReceivedAt.Sub(sentAt) + serverTransmittedAt.Sub(receivedAt)) / 2
+	sample.RoundTrip = receivedAt.Sub(sentAt) - serverTransmittedAt.Sub(serverReceivedAt)
+	if sample.RoundTrip < 0 {
+		sample.RoundTrip = 0
+	}
+	return sample, nil
+}
+
+/*
+GetClockOffset queries all of the NTP servers in parallel and returns the clock offset agreed by a majority of the
+servers that answered. The samples that took too long to arrive or disagree with the majority are discarded.
+*/
+func GetClockOffset(ctx context.Context, servers []string) (offset time.Duration, samples []SNTPSample, err error) {
+	if len(servers) == 0 {
+		return 0, nil, errors.New("GetClockOffset: no NTP server to query")
+	}
+	var mutex sync.Mutex
+	var queryErrs []string
+	wg := new(sync.WaitGroup)
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			sample, err := QuerySNTP(ctx, server)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == nil && sample.RoundTrip > SNTPMaxRoundTrip {
+				err = fmt.Errorf("round trip %v is too long", sample.RoundTrip)
+			}
+			if err != nil {
+				queryErrs = append(queryErrs, fmt.Sprintf("%s: %v", server, err))
+				return
+			}
+			samples = append(samples, sample)
+		}(server)
+	}
+	wg.Wait()
+	if len(samples) == 0 {
+		return 0, nil, fmt.Errorf("GetClockOffset: none of the NTP servers answered - %s", strings.Join(queryErrs, "; "))
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Offset < samples[j].Offset
+	})
+	median := samples[len(samples)/2].Offset
+	agreed := make([]SNTPSample, 0, len(samples))
+	for _, sample := range samples {
+		if diff := sample.Offset - median; diff <= SNTPMaxDisagreement && diff >= -SNTPMaxDisagreement {
+			agreed = append(agreed, sample)
+		}
+	}
+	if len(agreed)*2 <= len(samples) && len(samples) > 1 {
+		return 0, samples, fmt.Errorf("GetClockOffset: the NTP servers do not agree with each other - %v", samples)
+	}
+	// Prefer the offset measured with the shortest round trip, which is the most accurate.
+	best := agreed[0]
+	for _, sample := range agreed[1:] {
+		if sample.RoundTrip < best.RoundTrip {
+			best = sample
+		}
+	}
+	return best.Offset, agreed, nil
+}
+
+/*
+SynchroniseClock measures the system clock offset by querying the NTP servers, and then corrects the system clock
+by slewing it gradually if the offset is small, or by stepping it immediately otherwise. It returns the measured
+offset and whether the clock was slewed. Correcting the system clock usually requires root/administrator privilege.
+*/
+func SynchroniseClock(ctx context.Context, servers []string) (offset time.Duration, slewed bool, samples []SNTPSample, err error) {
+	offset, samples, err = GetClockOffset(ctx, servers)
+	if err != nil {
+		return
+	}
+	if offset <= MaxClockSlewOffset && offset >= -MaxClockSlewOffset {
+		if err = slewSystemClock(offset); err == nil {
+			return offset, true, samples, nil
+		} else if !errors.Is(err, errors.ErrUnsupported) {
+			return offset, false, samples, fmt.Errorf("SynchroniseClock: failed to slew system clock - %w", err)
+		}
+		// Fall back to stepping the clock
+	}
+	if err = stepSystemClock(offset); err != nil {
+		return offset, false, samples, fmt.Errorf("SynchroniseClock: failed to step system clock - %w", err)
+	}
+	return offset, false, samples, nil
+}
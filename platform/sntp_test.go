@@ -0,0 +1,75 @@
+package platform
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// startFakeNTPServer answers NTP queries with a clock that runs ahead of the system clock by the offset.
+func startFakeNTPServer(t *testing.T, offset time.Duration, stratum byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, client, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < ntpPacketLen {
+				continue
+			}
+			resp := make([]byte, ntpPacketLen)
+			resp[0] = 0<<6 | 4<<3 | 4
+			resp[1] = stratum
+			copy(resp[24:32], buf[40:48])
+			binary.BigEndian.PutUint64(resp[32:], toNTPTime(time.Now().Add(offset)))
+			binary.BigEndian.PutUint64(resp[40:], toNTPTime(time.Now().Add(offset)))
+			_, _ = conn.WriteTo(resp, client)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestNTPTime(t *testing.T) {
+	for _, want := range []time.Time{
+		time.Date(2024, 2, 29, 1, 2, 3, 456789000, time.UTC),
+		time.Date(2040, 1, 1, 0, 0, 0, 500000000, time.UTC),
+	} {
+		if got := fromNTPTime(toNTPTime(want)); got.Sub(want).Abs() > time.Microsecond {
+			t.Fatal(want, got)
+		}
+	}
+}
+
+func TestQuerySNTP(t *testing.T) {
+	ahead := startFakeNTPServer(t, 10*time.Second, 2)
+	sample, err := QuerySNTP(context.Background(), ahead)
+	if err != nil || sample.Stratum != 2 || (sample.Offset-10*time.Second).Abs() > 100*time.Millisecond || sample.RoundTrip > time.Second {
+		t.Fatal(sample, err)
+	}
+	if _, err := QuerySNTP(context.Background(), startFakeNTPServer(t, 0, 0)); err == nil {
+		t.Fatal("did not reject kiss-o'-death")
+	}
+	if _, err := QuerySNTP(context.Background(), startFakeNTPServer(t, 0, 16)); err == nil {
+		t.Fatal("did not reject unsynchronised server")
+	}
+	// The majority of servers agree on the offset, the false ticker is discarded.
+	behind := startFakeNTPServer(t, -time.Hour, 2)
+	offset, samples, err := GetClockOffset(context.Background(), []string{ahead, behind, startFakeNTPServer(t, 10*time.Second, 3)})
+	if err != nil || (offset-10*time.Second).Abs() > 100*time.Millisecond || len(samples) != 2 {
+		t.Fatal(offset, samples, err)
+	}
+	if _, _, err := GetClockOffset(context.Background(), []string{ahead, behind}); err == nil {
+		t.Fatal("did not reject disagreeing servers")
+	}
+	if _, _, err := GetClockOffset(context.Background(), nil); err == nil {
+		t.Fatal("did not reject empty server list")
+	}
+}
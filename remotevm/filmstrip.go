@@ -0,0 +1,111 @@
+package remotevm
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"time"
+)
+
+const (
+	// MaxFilmstripFrames is the maximum number of screenshots in a filmstrip.
+	MaxFilmstripFrames = 16
+	// MinFilmstripIntervalMS is the minimum interval in milliseconds between filmstrip screenshots.
+	MinFilmstripIntervalMS = 100
+	// MaxFilmstripIntervalMS is the maximum interval in milliseconds between filmstrip screenshots.
+	MaxFilmstripIntervalMS = 10000
+	// FilmstripFrameWidth is the width in pixels of each screenshot scaled down for the filmstrip.
+	FilmstripFrameWidth = 320
+	// FilmstripColumns is the number of screenshots in each row of the filmstrip.
+	FilmstripColumns = 4
+	// FilmstripFrameGap is the number of pixels between adjacent screenshots of the filmstrip.
+	FilmstripFrameGap = 4
+	// FilmstripJPEGQuality is the JPEG encoding quality of the filmstrip, it is lower than default to save bandwidth.
+	FilmstripJPEGQuality = 60
+)
+
+// scaleDown returns the image scaled down to the width while keeping its aspect ratio, using nearest-neighbour sampling.
+func scaleDown(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	if bounds.Dx() <= width || bounds.Dy() == 0 {
+		return src
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+	dest := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		srcY := bounds.Min.Y + y*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			dest.Set(x, y, src.At(bounds.Min.X+x*bounds.Dx()/width, srcY))
+		}
+	}
+	return dest
+}
+
+/*
+composeFilmstrip scales down the screenshots and places them in chronological order, left to right and then top to
+bottom, on a single image with a dark background.
+*/
+func composeFilmstrip(frames []image.Image) image.Image {
+	scaled := make([]image.Image, len(frames))
+	var cellWidth, cellHeight int
+	for i, frame := range frames {
+		scaled[i] = scaleDown(frame, FilmstripFrameWidth)
+		if size := scaled[i].Bounds().Size(); size.X > cellWidth {
+			cellWidth = size.X
+		}
+		if size := scaled[i].Bounds().Size(); size.Y > cellHeight {
+			cellHeight = size.Y
+		}
+	}
+	columns := FilmstripColumns
+	if len(frames) < columns {
+		columns = len(frames)
+	}
+	rows := (len(frames) + columns - 1) / columns
+	composite := image.NewRGBA(image.Rect(0, 0,
+		columns*cellWidth+(columns+1)*FilmstripFrameGap,
+		rows*cellHeight+(rows+1)*FilmstripFrameGap))
+	draw.Draw(composite, composite.Bounds(), image.NewUniform(color.Gray{Y: 32}), image.Point{}, draw.Src)
+	for i, frame := range scaled {
+		topLeft := image.Pt(
+			FilmstripFrameGap+(i%columns)*(cellWidth+FilmstripFrameGap),
+			FilmstripFrameGap+(i/columns)*(cellHeight+FilmstripFrameGap))
+		draw.Draw(composite, image.Rectangle{Min: topLeft, Max: topLeft.Add(frame.Bounds().Size())}, frame, frame.Bounds().Min, draw.Src)
+	}
+	return composite
+}
+
+/*
+TakeFilmstrip takes the specified number of screenshots at regular interval, for example to observe the sequence of a
+web page loading in the VM's browser, and saves the scaled down screenshots in a single JPEG composite. The composite is
+much smaller than the full screenshots combined, which makes it suitable for low-bandwidth connections.
+*/
+func (vm *VM) TakeFilmstrip(outputFileName string, numFrames int, interval time.Duration) error {
+	if numFrames < 1 || numFrames > MaxFilmstripFrames {
+		return fmt.Errorf("VM.TakeFilmstrip: number of frames must be within [1, %d]", MaxFilmstripFrames)
+	}
+	if interval < MinFilmstripIntervalMS*time.Millisecond || interval > MaxFilmstripIntervalMS*time.Millisecond {
+		return fmt.Errorf("VM.TakeFilmstrip: interval must be within [%d, %d] milliseconds", MinFilmstripIntervalMS, MaxFilmstripIntervalMS)
+	}
+	frames := make([]image.Image, 0, numFrames)
+	nextFrameAt := time.Now()
+	for i := 0; i < numFrames; i++ {
+		time.Sleep(time.Until(nextFrameAt))
+		nextFrameAt = nextFrameAt.Add(interval)
+		screen, err := vm.captureScreen()
+		if err != nil {
+			return err
+		}
+		frames = append(frames, screen)
+	}
+	if len(frames) == 0 {
+		return errors.New("VM.TakeFilmstrip: no screenshot was taken")
+	}
+	return saveJPEG(composeFilmstrip(frames), outputFileName, &jpeg.Options{Quality: FilmstripJPEGQuality})
+}
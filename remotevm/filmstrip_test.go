@@ -0,0 +1,58 @@
+package remotevm
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestComposeFilmstrip(t *testing.T) {
+	// Six frames of 1024x768 in different shades
+	frames := make([]image.Image, 6)
+	for i := range frames {
+		frame := image.NewRGBA(image.Rect(0, 0, 1024, 768))
+		for y := 0; y < 768; y++ {
+			for x := 0; x < 1024; x++ {
+				frame.Set(x, y, color.Gray{Y: uint8(100 + i*20)})
+			}
+		}
+		frames[i] = frame
+	}
+	composite := composeFilmstrip(frames)
+	// 4 columns and 2 rows of 320x240 cells
+	wantWidth := 4*FilmstripFrameWidth + 5*FilmstripFrameGap
+	wantHeight := 2*240 + 3*FilmstripFrameGap
+	if size := composite.Bounds().Size(); size.X != wantWidth || size.Y != wantHeight {
+		t.Fatal(size)
+	}
+	// Frames are placed in chronological order
+	for i := range frames {
+		x := FilmstripFrameGap + (i%4)*(FilmstripFrameWidth+FilmstripFrameGap) + 10
+		y := FilmstripFrameGap + (i/4)*(240+FilmstripFrameGap) + 10
+		if r, _, _, _ := composite.At(x, y).RGBA(); uint8(r>>8) != uint8(100+i*20) {
+			t.Fatal(i, r>>8)
+		}
+	}
+	// A single small frame is not scaled
+	small := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	if size := composeFilmstrip([]image.Image{small}).Bounds().Size(); size.X != 100+2*FilmstripFrameGap || size.Y != 50+2*FilmstripFrameGap {
+		t.Fatal(size)
+	}
+}
+
+func TestTakeFilmstrip_Validation(t *testing.T) {
+	vm := VM{}
+	if err := vm.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := vm.TakeFilmstrip("", 0, time.Second); err == nil {
+		t.Fatal("should have rejected 0 frames")
+	}
+	if err := vm.TakeFilmstrip("", MaxFilmstripFrames+1, time.Second); err == nil {
+		t.Fatal("should have rejected too many frames")
+	}
+	if err := vm.TakeFilmstrip("", 4, time.Millisecond); err == nil {
+		t.Fatal("should have rejected a short interval")
+	}
+}
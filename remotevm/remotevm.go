@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
 	"image/jpeg"
 	"io"
 	"net"
@@ -36,9 +37,11 @@ type VM struct {
 	NumCPU    int   // NumCPU is the number of CPU cores allocated to emulator
 	MemSizeMB int64 // MemSizeMB is the amount of memory allocated to emulator
 	QMPPort   int   // QMPPort is the TCP port number used for interacting with emulator
+	// SerialPort is the TCP port number of the emulated serial console, the serial console is not available if it is 0.
+	SerialPort int
 
 	emulatorExecutable  string
-	emulatorCmd         *exec.Cmd
+	emulator            *platform.HelperProcess
 	emulatorDebugOutput *lalog.ByteLogWriter
 	qmpConn             *net.TCPConn
 	qmpClient           *textproto.Conn
@@ -115,12 +118,12 @@ func (vm *VM) Start(isoFilePath string) error {
 		return fmt.Errorf("VM.Start: failed to read OS ISO file \"%s\" - %v", isoFilePath, err)
 	}
 	// Prevent repeated startup of the same VM
-	if vm.emulatorCmd != nil {
+	if vm.emulator != nil {
 		return errors.New("VM.Start: already started")
 	}
 	vm.logger.Info(isoFilePath, nil, "starting emulator %s, this may take a minute", vm.emulatorExecutable)
 	fmt.Fprintf(vm.emulatorDebugOutput, "Starting emulator %s for ISO file %s, this may take a minute.\n", vm.emulatorExecutable, isoFilePath)
-	vm.emulatorCmd = exec.Command(vm.emulatorExecutable,
+	emulatorArgs := []string{
 		"-smp", strconv.Itoa(vm.NumCPU), "-m", fmt.Sprintf("%dM", vm.MemSizeMB),
 		/*
 			"nographic" tells emulator not to create a GUI window for interacting with VM. The emulator still gets a graphics card.
@@ -137,12 +140,20 @@ func (vm *VM) Start(isoFilePath string) error {
 		// Boot from CD which is an ISO file, usually that of a live Linux distribution.
 		"-boot", "order=d", "-cdrom", isoFilePath,
 		// Start command server
-		"-qmp", fmt.Sprintf("tcp:127.0.0.1:%d,server,nowait", vm.QMPPort))
-	vm.emulatorCmd.Stdout = vm.emulatorDebugOutput
-	vm.emulatorCmd.Stderr = vm.emulatorDebugOutput
-	if err := vm.emulatorCmd.Start(); err != nil {
+		"-qmp", fmt.Sprintf("tcp:127.0.0.1:%d,server,nowait", vm.QMPPort),
+	}
+	if vm.SerialPort > 0 {
+		// The serial console accepts one client at a time, "nodelay" reduces the latency of interactive typing.
+		emulatorArgs = append(emulatorArgs, "-serial", fmt.Sprintf("tcp:127.0.0.1:%d,server,nowait,nodelay", vm.SerialPort))
+	}
+	emulatorCmd := exec.Command(vm.emulatorExecutable, emulatorArgs...)
+	emulatorCmd.Stdout = vm.emulatorDebugOutput
+	emulatorCmd.Stderr = vm.emulatorDebugOutput
+	emulator, err := platform.DefaultHelperProcesses.Start(vm.emulatorExecutable, emulatorCmd)
+	if err != nil {
 		return err
 	}
+	vm.emulator = emulator
 	vm.logger.Info(vm.emulatorExecutable, nil, "emulator successfully started %s", isoFilePath)
 	fmt.Fprintf(vm.emulatorDebugOutput, "emulator %s successfully started %s\n", vm.emulatorExecutable, isoFilePath)
 	return nil
@@ -203,15 +214,28 @@ func (vm *VM) Kill() {
 		vm.logger.MaybeMinorError(conn.Close())
 	}
 	vm.qmpConn = nil
-	if cmd := vm.emulatorCmd; cmd != nil {
-		if proc := cmd.Process; proc != nil {
-			vm.logger.Info("", nil, "killing emulator process PID %d", proc.Pid)
-			if !platform.KillProcess(proc) {
-				vm.logger.Warning("", nil, "failed to kill emulator process")
-			}
+	if emulator := vm.emulator; emulator != nil {
+		vm.logger.Info("", nil, "killing emulator process PID %d", emulator.PID)
+		if !emulator.Kill() {
+			vm.logger.Warning("", nil, "failed to kill emulator process")
 		}
 	}
-	vm.emulatorCmd = nil
+	vm.emulator = nil
+}
+
+/*
+ConnectSerialConsole connects to the serial console of the emulator. The emulator serves one serial console client at a
+time, the caller should close the connection as soon as it is no longer used.
+*/
+func (vm *VM) ConnectSerialConsole() (net.Conn, error) {
+	if vm.SerialPort < 1 {
+		return nil, errors.New("VM.ConnectSerialConsole: serial console is not configured")
+	}
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", vm.SerialPort), 3*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("VM.ConnectSerialConsole: failed to connect, is the VM running? - %w", err)
+	}
+	return conn, nil
 }
 
 // GetDebugOutput returns the QEMU/KVM emulator output along with recent QMP command and responses.
@@ -223,14 +247,14 @@ func (vm *VM) GetDebugOutput() string {
 }
 
 /*
-TakeScreenshot takes a screenshot of the emulator video display, the screenshot image format is JPEG.
+captureScreen takes a screenshot of the emulator video display and decodes it.
 The function also updates the screen total resolution tracked internally for calculating mouse movement coordinates.
 */
-func (vm *VM) TakeScreenshot(outputFileName string) error {
+func (vm *VM) captureScreen() (image.Image, error) {
 	// Create a temporary file to store the screenshot output
 	tmpFile, err := os.CreateTemp("", "laitos-vm-take-screenshot*.ppm")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	_ = tmpFile.Close()
 	defer os.Remove(tmpFile.Name())
@@ -242,7 +266,7 @@ func (vm *VM) TakeScreenshot(outputFileName string) error {
 		},
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// QEMU takes a short while to finish taking the screenshot even if the positive response comes instantenously
 	var fileSize int64
@@ -265,35 +289,51 @@ anticiateGrowingFile:
 		time.Sleep(50 * time.Millisecond)
 	}
 	if fileSize == 0 {
-		return errors.New("VM.TakeScreenshot: screenshot command was sent, however the result screenshot file is empty.")
+		return nil, errors.New("VM.TakeScreenshot: screenshot command was sent, however the result screenshot file is empty.")
 	}
 	// Decode screenshot in PPM format
 	ppmFile, err := os.Open(tmpFile.Name())
 	if err != nil {
-		return fmt.Errorf("VM.TakeScreenshot: failed to open screenshot file - %w", err)
+		return nil, fmt.Errorf("VM.TakeScreenshot: failed to open screenshot file - %w", err)
 	}
 	ppmImage, err := readPPM(ppmFile)
+	_ = ppmFile.Close()
 	if err != nil {
-		return fmt.Errorf("VM.TakeScreenshot: failed to decode screenshot file - %w", err)
+		return nil, fmt.Errorf("VM.TakeScreenshot: failed to decode screenshot file - %w", err)
 	}
-	_ = ppmFile.Close()
 	// Memorise the latest screen resolution to help calculating mouse movement coordinates
 	vm.lastScreenWidth = ppmImage.Bounds().Size().X
 	vm.lastScreenHeight = ppmImage.Bounds().Size().Y
-	// Encode the screenshot in JPEG and save to output file
-	jpegFile, err := os.OpenFile(outputFileName, os.O_CREATE|os.O_WRONLY, 0600)
+	return ppmImage, nil
+}
+
+// saveJPEG encodes the image in JPEG and saves it to the output file.
+func saveJPEG(img image.Image, outputFileName string, options *jpeg.Options) error {
+	jpegFile, err := os.OpenFile(outputFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
 		return fmt.Errorf("VM.TakeScreenshot: failed to create screenshot file - %w", err)
 	}
 	defer func() {
 		_ = jpegFile.Close()
 	}()
-	if err := jpeg.Encode(jpegFile, ppmImage, nil); err != nil {
+	if err := jpeg.Encode(jpegFile, img, options); err != nil {
 		return fmt.Errorf("VM.TakeScreenshot: failed to save screenshot file - %w", err)
 	}
 	return nil
 }
 
+/*
+TakeScreenshot takes a screenshot of the emulator video display, the screenshot image format is JPEG.
+The function also updates the screen total resolution tracked internally for calculating mouse movement coordinates.
+*/
+func (vm *VM) TakeScreenshot(outputFileName string) error {
+	screen, err := vm.captureScreen()
+	if err != nil {
+		return err
+	}
+	return saveJPEG(screen, outputFileName, nil)
+}
+
 /*
 MoveMouse moves the mouse cursor to the input location.
 Prior to calling this function the caller should have quite recently taken a screenshot of the VM, because
@@ -483,7 +523,7 @@ emulator's response.
 For the simplicity of implementation, each command makes a new TCP connection to the emulator's TCP server.
 */
 func (vm *VM) executeQMP(in interface{}) (resp string, err error) {
-	if vm.emulatorCmd == nil {
+	if vm.emulator == nil {
 		return "", errors.New("emulator is not running yet")
 	}
 	// Serialise incoming command
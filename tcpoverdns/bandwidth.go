@@ -0,0 +1,104 @@
+package tcpoverdns
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// BandwidthLimiter is a token bucket that shapes the throughput of a data
+// stream to a steady number of bytes per second, with allowance for a short
+// burst.
+type BandwidthLimiter struct {
+	// BytesPerSec is the steady rate at which tokens (bytes) are replenished.
+	BytesPerSec int
+	// Burst is the maximum number of tokens (bytes) the bucket can hold.
+	Burst int
+
+	tokens     float64
+	lastRefill time.Time
+	mutex      *sync.Mutex
+}
+
+// NewBandwidthLimiter returns a newly initialised bandwidth limiter with a
+// full bucket. If burst is smaller than bytesPerSec, the burst will be set to
+// bytesPerSec.
+func NewBandwidthLimiter(bytesPerSec, burst int) *BandwidthLimiter {
+	if bytesPerSec < 1 {
+		panic("bandwidth limiter BytesPerSec must be greater than 0")
+	}
+	if burst < bytesPerSec {
+		burst = bytesPerSec
+	}
+	return &BandwidthLimiter{
+		BytesPerSec: bytesPerSec,
+		Burst:       burst,
+		tokens:      float64(burst),
+		lastRefill:  time.Now(),
+		mutex:       new(sync.Mutex),
+	}
+}
+
+// refill adds tokens accumulated since the previous refill. The caller must
+// hold the mutex.
+func (limiter *BandwidthLimiter) refill() {
+	now := time.Now()
+	limiter.tokens += now.Sub(limiter.lastRefill).Seconds() * float64(limiter.BytesPerSec)
+	if limiter.tokens > float64(limiter.Burst) {
+		limiter.tokens = float64(limiter.Burst)
+	}
+	limiter.lastRefill = now
+}
+
+// WaitN blocks until n bytes worth of tokens are taken from the bucket, or the
+// context is cancelled. n is capped to the burst size.
+func (limiter *BandwidthLimiter) WaitN(ctx context.Context, n int) error {
+	if n > limiter.Burst {
+		n = limiter.Burst
+	}
+	limiter.mutex.Lock()
+	limiter.refill()
+	// Take the tokens right away, the balance may go negative and subsequent
+	// callers will wait for it to recover.
+	limiter.tokens -= float64(n)
+	deficit := -limiter.tokens
+	limiter.mutex.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Duration(deficit / float64(limiter.BytesPerSec) * float64(time.Second))):
+		return nil
+	}
+}
+
+// ThrottledReader shapes the throughput of an underlying reader using a
+// bandwidth limiter.
+type ThrottledReader struct {
+	ctx     context.Context
+	limiter *BandwidthLimiter
+	reader  io.Reader
+}
+
+// NewThrottledReader returns a reader that reads from the underlying reader no
+// faster than the limiter permits. Multiple readers may share a limiter to
+// shape their combined throughput.
+func NewThrottledReader(ctx context.Context, limiter *BandwidthLimiter, reader io.Reader) *ThrottledReader {
+	return &ThrottledReader{ctx: ctx, limiter: limiter, reader: reader}
+}
+
+func (throttled *ThrottledReader) Read(buf []byte) (int, error) {
+	if len(buf) > throttled.limiter.Burst {
+		buf = buf[:throttled.limiter.Burst]
+	}
+	n, err := throttled.reader.Read(buf)
+	if n > 0 {
+		if waitErr := throttled.limiter.WaitN(throttled.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
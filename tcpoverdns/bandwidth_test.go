@@ -0,0 +1,55 @@
+package tcpoverdns
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	limiter := NewBandwidthLimiter(1000, 500)
+	if limiter.Burst != 1000 {
+		t.Fatalf("unexpected burst: %d", limiter.Burst)
+	}
+	// The bucket starts full, the burst goes through right away.
+	start := time.Now()
+	if err := limiter.WaitN(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("burst took too long: %v", elapsed)
+	}
+	// The bucket is now empty, the next 500 bytes take about half a second.
+	start = time.Now()
+	if err := limiter.WaitN(context.Background(), 500); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 1*time.Second {
+		t.Fatalf("unexpected wait duration: %v", elapsed)
+	}
+	// Cancelled context interrupts the wait.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.WaitN(ctx, 1000); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	data := bytes.Repeat([]byte{'a'}, 3000)
+	reader := NewThrottledReader(context.Background(), NewBandwidthLimiter(2000, 1000), bytes.NewReader(data))
+	start := time.Now()
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("unexpected data length %d", len(got))
+	}
+	// 2000 bytes from the initial burst and 1000 bytes of deficit at 2000 bytes/sec.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("unexpected read duration: %v", elapsed)
+	}
+}
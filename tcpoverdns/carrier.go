@@ -0,0 +1,77 @@
+package tcpoverdns
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Carrier transports outgoing segments of an initiator transmission control to
+// the responder, and brings back the responder's reply segments.
+// A carrier does not need to guarantee delivery, the transmission control
+// takes care of retransmission.
+type Carrier interface {
+	// Exchange sends a segment to the responder and returns a reply segment.
+	// A reply segment carrying the FlagMalformed flag is as good as an error.
+	Exchange(ctx context.Context, seg Segment) (Segment, error)
+}
+
+// CarrierParams are the configuration parameters commonly used by carriers.
+// Each carrier uses a subset of the parameters.
+type CarrierParams struct {
+	// Address is the carrier-specific address of the responder, for example,
+	// the DNS host name of the DNS carrier, the URL of the HTTPS carrier, or
+	// the IP address of the ICMP carrier.
+	Address string
+	// ResolverAddress is the address (ip:port) of a recursive DNS resolver,
+	// used by the DNS carrier alone.
+	ResolverAddress string
+	// EnableTXT tells the DNS carrier to use TXT queries in place of CNAME
+	// queries.
+	EnableTXT bool
+	// DropPercentage is the percentage of replies to be dropped. This is for
+	// internal testing only.
+	DropPercentage int
+	// Debug enables verbose logging for IO activities.
+	Debug bool
+}
+
+// CarrierFactory constructs a carrier from the parameters.
+type CarrierFactory func(params CarrierParams) (Carrier, error)
+
+var (
+	carrierFactories     = make(map[string]CarrierFactory)
+	carrierFactoriesLock = new(sync.RWMutex)
+)
+
+// RegisterCarrier makes a carrier available under the name. Registering a
+// carrier under an existing name replaces the previous one.
+func RegisterCarrier(name string, factory CarrierFactory) {
+	carrierFactoriesLock.Lock()
+	defer carrierFactoriesLock.Unlock()
+	carrierFactories[name] = factory
+}
+
+// NewCarrier constructs a carrier registered under the name.
+func NewCarrier(name string, params CarrierParams) (Carrier, error) {
+	carrierFactoriesLock.RLock()
+	factory, exists := carrierFactories[name]
+	carrierFactoriesLock.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("NewCarrier: unknown carrier %q, the available carriers are %v", name, CarrierNames())
+	}
+	return factory(params)
+}
+
+// CarrierNames returns the sorted names of registered carriers.
+func CarrierNames() []string {
+	carrierFactoriesLock.RLock()
+	defer carrierFactoriesLock.RUnlock()
+	ret := make([]string, 0, len(carrierFactories))
+	for name := range carrierFactories {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,87 @@
+package tcpoverdns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// HTTPSCarrierName is the registered name of the HTTPS long-poll carrier.
+	HTTPSCarrierName = "https"
+	// HTTPSCarrierContentType is the content type of HTTPS carrier requests and
+	// responses, each carries a single segment packet.
+	HTTPSCarrierContentType = "application/octet-stream"
+	// HTTPSCarrierTimeout is the timeout of each HTTPS carrier round trip.
+	// The responder holds on to the request until a reply segment is
+	// available, hence the generous timeout.
+	HTTPSCarrierTimeout = 30 * time.Second
+	// HTTPSCarrierLongPollDuration is the maximum duration the responder holds
+	// on to a keep-alive request while waiting for a reply segment. The
+	// carrier sends one segment at a time, hence the duration is well below
+	// HTTPSCarrierTimeout to let the initiator send data again shortly.
+	HTTPSCarrierLongPollDuration = 10 * time.Second
+)
+
+func init() {
+	RegisterCarrier(HTTPSCarrierName, NewHTTPSCarrier)
+}
+
+// HTTPSCarrier transports each segment in the body of an HTTP(S) POST request,
+// and reads the reply segment from the response body. The responder
+// long-polls keep-alive segments, it holds on to the request until a reply
+// segment is available or HTTPSCarrierLongPollDuration elapses.
+type HTTPSCarrier struct {
+	url            string
+	dropPercentage int
+	client         *http.Client
+}
+
+// NewHTTPSCarrier returns an HTTPS carrier that sends segments to the URL in
+// the params address.
+func NewHTTPSCarrier(params CarrierParams) (Carrier, error) {
+	if !strings.HasPrefix(params.Address, "https://") && !strings.HasPrefix(params.Address, "http://") {
+		return nil, fmt.Errorf("NewHTTPSCarrier: address %q must be an HTTP(S) URL", params.Address)
+	}
+	return &HTTPSCarrier{
+		url:            params.Address,
+		dropPercentage: params.DropPercentage,
+		client:         &http.Client{Timeout: HTTPSCarrierTimeout},
+	}, nil
+}
+
+// Exchange sends the segment in an HTTP POST request and returns the reply
+// segment from the response.
+func (carrier *HTTPSCarrier) Exchange(ctx context.Context, seg Segment) (Segment, error) {
+	malformedSegment := Segment{Flags: FlagMalformed}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, carrier.url, bytes.NewReader(seg.Packet()))
+	if err != nil {
+		return malformedSegment, err
+	}
+	req.Header.Set("Content-Type", HTTPSCarrierContentType)
+	resp, err := carrier.client.Do(req)
+	if err != nil {
+		return malformedSegment, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, SegmentHeaderLen+MaxSegmentDataLen))
+	if err != nil {
+		return malformedSegment, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return malformedSegment, fmt.Errorf("HTTPSCarrier.Exchange: HTTP status %d - %s", resp.StatusCode, string(body))
+	}
+	if len(body) == 0 {
+		return malformedSegment, errors.New("HTTPSCarrier.Exchange: the response did not carry a segment")
+	}
+	if rand.Intn(100) < carrier.dropPercentage {
+		return malformedSegment, errors.New("dropped for testing")
+	}
+	return SegmentFromPacket(body), nil
+}
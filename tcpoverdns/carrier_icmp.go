@@ -0,0 +1,146 @@
+package tcpoverdns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// ICMPCarrierName is the registered name of the ICMP echo carrier.
+	ICMPCarrierName = "icmp"
+	// ICMPCarrierTimeout is the timeout of each ICMP echo round trip.
+	ICMPCarrierTimeout = 10 * time.Second
+	// protocolICMP is the IANA protocol number of ICMP for IPv4.
+	protocolICMP = 1
+)
+
+// ICMPCarrierMagic is the prefix of ICMP echo payload that carries a segment,
+// the prefix distinguishes the carrier's echo messages from ordinary pings.
+var ICMPCarrierMagic = []byte("LTcp")
+
+func init() {
+	RegisterCarrier(ICMPCarrierName, NewICMPCarrier)
+}
+
+// ICMPPayload returns the ICMP echo payload that carries the segment.
+func ICMPPayload(seg Segment) []byte {
+	return append(append([]byte{}, ICMPCarrierMagic...), seg.Packet()...)
+}
+
+// SegmentFromICMPPayload decodes a segment from ICMP echo payload. It returns
+// false if the payload does not carry a segment.
+func SegmentFromICMPPayload(payload []byte) (Segment, bool) {
+	if !bytes.HasPrefix(payload, ICMPCarrierMagic) {
+		return Segment{}, false
+	}
+	return SegmentFromPacket(payload[len(ICMPCarrierMagic):]), true
+}
+
+// ICMPCarrier transports each segment in the payload of an ICMP echo request,
+// and reads the reply segment from the payload of the echo reply. It helps to
+// escape networks that proxy or inspect DNS traffic but leave ping alone.
+type ICMPCarrier struct {
+	dest           net.IP
+	echoID         int
+	echoSeq        uint32
+	dropPercentage int
+}
+
+// NewICMPCarrier returns an ICMP carrier that sends segments to the IPv4
+// address (or host name) in the params address.
+func NewICMPCarrier(params CarrierParams) (Carrier, error) {
+	addr, err := net.ResolveIPAddr("ip4", params.Address)
+	if err != nil {
+		return nil, fmt.Errorf("NewICMPCarrier: failed to resolve %q - %w", params.Address, err)
+	}
+	return &ICMPCarrier{
+		dest:           addr.IP,
+		echoID:         os.Getpid() & 0xffff,
+		echoSeq:        uint32(rand.Int31()),
+		dropPercentage: params.DropPercentage,
+	}, nil
+}
+
+// listen opens a privileged raw ICMP socket, or an unprivileged datagram
+// ICMP socket if the program lacks the privilege.
+func (carrier *ICMPCarrier) listen() (*icmp.PacketConn, net.Addr, error) {
+	if conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0"); err == nil {
+		return conn, &net.IPAddr{IP: carrier.dest}, nil
+	}
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, &net.UDPAddr{IP: carrier.dest}, nil
+}
+
+// Exchange sends the segment in an ICMP echo request and returns the reply
+// segment from the echo reply.
+func (carrier *ICMPCarrier) Exchange(ctx context.Context, seg Segment) (Segment, error) {
+	malformedSegment := Segment{Flags: FlagMalformed}
+	conn, dest, err := carrier.listen()
+	if err != nil {
+		return malformedSegment, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(ICMPCarrierTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return malformedSegment, err
+	}
+	payload := ICMPPayload(seg)
+	seq := int(atomic.AddUint32(&carrier.echoSeq, 1) & 0xffff)
+	req := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: carrier.echoID, Seq: seq, Data: payload},
+	}
+	reqBytes, err := req.Marshal(nil)
+	if err != nil {
+		return malformedSegment, err
+	}
+	if _, err := conn.WriteTo(reqBytes, dest); err != nil {
+		return malformedSegment, err
+	}
+	buf := make([]byte, 2*(SegmentHeaderLen+MaxSegmentDataLen))
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return malformedSegment, err
+		}
+		resp, err := icmp.ParseMessage(protocolICMP, buf[:n])
+		if err != nil || resp.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := resp.Body.(*icmp.Echo)
+		// The unprivileged datagram socket rewrites the echo ID, hence only
+		// the sequence number is checked.
+		if !ok || echo.Seq != seq {
+			continue
+		}
+		// The operating system of the responder may reply to the echo request
+		// on its own, by returning an identical payload.
+		if bytes.Equal(echo.Data, payload) {
+			continue
+		}
+		replySeg, isSeg := SegmentFromICMPPayload(echo.Data)
+		if !isSeg {
+			continue
+		}
+		if rand.Intn(100) < carrier.dropPercentage {
+			return malformedSegment, errors.New("dropped for testing")
+		}
+		return replySeg, nil
+	}
+}
@@ -0,0 +1,55 @@
+package tcpoverdns
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCarrierRegistry(t *testing.T) {
+	if names := CarrierNames(); !reflect.DeepEqual(names, []string{HTTPSCarrierName, ICMPCarrierName}) {
+		t.Fatalf("unexpected carrier names: %v", names)
+	}
+	if _, err := NewCarrier("does-not-exist", CarrierParams{}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := NewCarrier(HTTPSCarrierName, CarrierParams{Address: "not-a-url"}); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestICMPPayload(t *testing.T) {
+	seg := Segment{ID: 1, Flags: FlagKeepAlive, SeqNum: 2, AckNum: 3, Data: []byte{4}}
+	got, isSeg := SegmentFromICMPPayload(ICMPPayload(seg))
+	if !isSeg || !got.Equals(seg) {
+		t.Fatalf("got %+v, want %+v", got, seg)
+	}
+	if _, isSeg := SegmentFromICMPPayload([]byte("ordinary ping")); isSeg {
+		t.Fatal("ordinary ping should not carry a segment")
+	}
+}
+
+func TestHTTPSCarrier(t *testing.T) {
+	// The responder replies with the same segment and an incremented ack.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seg := SegmentFromPacket(body)
+		seg.AckNum++
+		_, _ = w.Write(seg.Packet())
+	}))
+	defer server.Close()
+	carrier, err := NewCarrier(HTTPSCarrierName, CarrierParams{Address: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := carrier.Exchange(context.Background(), Segment{ID: 1, AckNum: 2, Data: []byte{3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Segment{ID: 1, AckNum: 3, Data: []byte{3}}); !reply.Equals(want) {
+		t.Fatalf("got %+v, want %+v", reply, want)
+	}
+}
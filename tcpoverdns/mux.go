@@ -0,0 +1,526 @@
+package tcpoverdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+// MuxFrameType identifies the purpose of a frame exchanged between two muxes.
+type MuxFrameType byte
+
+const (
+	// MuxFrameOpen opens a new stream, the frame data is the (optional) open
+	// data of the stream, e.g. the proxy destination.
+	MuxFrameOpen = MuxFrameType(1)
+	// MuxFrameData carries the stream data.
+	MuxFrameData = MuxFrameType(2)
+	// MuxFrameWindow grants the peer more room (a 4-byte integer in the frame
+	// data) to send stream data.
+	MuxFrameWindow = MuxFrameType(3)
+	// MuxFrameClose closes the stream in both directions.
+	MuxFrameClose = MuxFrameType(4)
+)
+
+const (
+	// MuxFrameHeaderLen is the length of a frame header - stream ID (2 bytes),
+	// frame type (1 byte), and data length (2 bytes).
+	MuxFrameHeaderLen = 5
+	// MuxMaxFrameDataLen is the maximum length of data carried by a single
+	// frame. The frames are kept short so that a busy stream does not hold up
+	// the others for long.
+	MuxMaxFrameDataLen = 1024
+	// MuxStreamWindow is the maximum amount of data a stream may send without
+	// the peer consuming it, which is the per-stream flow control window.
+	MuxStreamWindow = 32 * 1024
+	// MuxDefaultMaxStreams is the default maximum number of concurrent streams.
+	MuxDefaultMaxStreams = 256
+)
+
+var (
+	// ErrMuxClosed is returned when the mux or the stream is already closed.
+	ErrMuxClosed = errors.New("the mux stream is closed")
+)
+
+// Mux multiplexes many logical streams over a single connection, usually a
+// transmission control. Opening a stream does not involve a handshake, hence
+// the streams enjoy a much lower latency than individual transmission controls
+// would, at the cost of sharing the bandwidth and fate of the connection.
+// Each stream has its own flow control window so that a slow reader does not
+// block the other streams.
+type Mux struct {
+	// Conn is the underlying connection that transports the frames.
+	Conn io.ReadWriteCloser
+	// Initiator opens streams with odd-numbered IDs, whereas the responder opens
+	// streams with even-numbered IDs.
+	Initiator bool
+	// MaxStreams is the maximum number of concurrent streams. Further streams
+	// opened by the peer are closed immediately.
+	MaxStreams int
+	// Debug enables verbose logging for IO activities.
+	Debug bool
+	// LogTag is a string that shows up in all log entries.
+	LogTag string
+
+	streams    map[uint16]*MuxStream
+	nextID     uint16
+	accept     chan *MuxStream
+	writeMutex *sync.Mutex
+	mutex      *sync.Mutex
+	closed     bool
+	context    context.Context
+	cancelFun  func()
+	logger     *lalog.Logger
+}
+
+// Start initialises the internal state of the mux and starts a background
+// goroutine to read frames from the connection. The mux closes itself when the
+// connection is closed or the context is cancelled.
+func (mux *Mux) Start(ctx context.Context) {
+	if mux.MaxStreams < 1 {
+		mux.MaxStreams = MuxDefaultMaxStreams
+	}
+	mux.streams = make(map[uint16]*MuxStream)
+	mux.nextID = 2
+	if mux.Initiator {
+		mux.nextID = 1
+	}
+	mux.accept = make(chan *MuxStream, mux.MaxStreams)
+	mux.writeMutex = new(sync.Mutex)
+	mux.mutex = new(sync.Mutex)
+	mux.context, mux.cancelFun = context.WithCancel(ctx)
+	mux.logger = &lalog.Logger{
+		ComponentName: "Mux",
+		ComponentID:   []lalog.LoggerIDField{{Key: "Tag", Value: mux.LogTag}},
+	}
+	go mux.readLoop()
+	go func() {
+		<-mux.context.Done()
+		_ = mux.Close()
+	}()
+}
+
+// OpenStream opens a new stream and returns it immediately. The open data is
+// delivered to the peer alongside the request to open the stream. The caller
+// may write to the stream right away without waiting for the peer.
+func (mux *Mux) OpenStream(openData []byte) (*MuxStream, error) {
+	if len(openData) > 0xffff {
+		return nil, fmt.Errorf("Mux.OpenStream: open data must not exceed %d bytes", 0xffff)
+	}
+	mux.mutex.Lock()
+	if mux.closed {
+		mux.mutex.Unlock()
+		return nil, ErrMuxClosed
+	}
+	if len(mux.streams) >= mux.MaxStreams {
+		mux.mutex.Unlock()
+		return nil, fmt.Errorf("Mux.OpenStream: there are already %d streams", len(mux.streams))
+	}
+	// Find an unused ID, skip over 0.
+	for _, exists := mux.streams[mux.nextID]; exists || mux.nextID == 0; _, exists = mux.streams[mux.nextID] {
+		mux.nextID += 2
+	}
+	stream := newMuxStream(mux, mux.nextID, openData)
+	mux.streams[stream.ID] = stream
+	mux.nextID += 2
+	mux.mutex.Unlock()
+	if err := mux.writeFrame(stream.ID, MuxFrameOpen, openData); err != nil {
+		mux.removeStream(stream.ID)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept blocks until the peer opens a new stream, and returns the stream.
+func (mux *Mux) Accept(ctx context.Context) (*MuxStream, error) {
+	select {
+	case stream := <-mux.accept:
+		return stream, nil
+	case <-mux.context.Done():
+		return nil, ErrMuxClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// NumStreams returns the number of streams that are currently open.
+func (mux *Mux) NumStreams() int {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	return len(mux.streams)
+}
+
+// Done returns a channel that is closed when the mux is closed.
+func (mux *Mux) Done() <-chan struct{} {
+	return mux.context.Done()
+}
+
+// IsClosed returns true if the mux has been closed.
+func (mux *Mux) IsClosed() bool {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	return mux.closed
+}
+
+// Close closes all streams and the underlying connection.
+func (mux *Mux) Close() error {
+	mux.mutex.Lock()
+	if mux.closed {
+		mux.mutex.Unlock()
+		return nil
+	}
+	mux.closed = true
+	streams := mux.streams
+	mux.streams = make(map[uint16]*MuxStream)
+	mux.mutex.Unlock()
+	mux.cancelFun()
+	for _, stream := range streams {
+		stream.terminate()
+	}
+	return mux.Conn.Close()
+}
+
+// writeFrame writes a single frame to the connection.
+func (mux *Mux) writeFrame(id uint16, frameType MuxFrameType, data []byte) error {
+	frame := make([]byte, MuxFrameHeaderLen+len(data))
+	binary.BigEndian.PutUint16(frame[0:2], id)
+	frame[2] = byte(frameType)
+	binary.BigEndian.PutUint16(frame[3:5], uint16(len(data)))
+	copy(frame[MuxFrameHeaderLen:], data)
+	if mux.Debug {
+		mux.logger.Info(id, nil, "writing frame type %d, data: %v", frameType, lalog.ByteArrayLogString(data))
+	}
+	mux.writeMutex.Lock()
+	defer mux.writeMutex.Unlock()
+	if mux.IsClosed() {
+		return ErrMuxClosed
+	}
+	_, err := mux.Conn.Write(frame)
+	return err
+}
+
+// readFull reads exactly len(buf) bytes from the connection. Unlike
+// io.ReadFull it tolerates the read timeouts of an idle transmission control.
+func (mux *Mux) readFull(buf []byte) error {
+	for i := 0; i < len(buf); {
+		n, err := mux.Conn.Read(buf[i:])
+		i += n
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && mux.context.Err() == nil {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// readLoop continuously reads frames from the connection and dispatches them
+// to the streams, until the connection is closed.
+func (mux *Mux) readLoop() {
+	defer func() {
+		_ = mux.Close()
+	}()
+	header := make([]byte, MuxFrameHeaderLen)
+	for {
+		if err := mux.readFull(header); err != nil {
+			if mux.Debug {
+				mux.logger.Info("", err, "stop reading frames")
+			}
+			return
+		}
+		id := binary.BigEndian.Uint16(header[0:2])
+		frameType := MuxFrameType(header[2])
+		data := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+		if err := mux.readFull(data); err != nil {
+			mux.logger.Warning(id, err, "failed to read frame data")
+			return
+		}
+		if mux.Debug {
+			mux.logger.Info(id, nil, "read frame type %d, data: %v", frameType, lalog.ByteArrayLogString(data))
+		}
+		mux.mutex.Lock()
+		stream, exists := mux.streams[id]
+		mux.mutex.Unlock()
+		switch frameType {
+		case MuxFrameOpen:
+			// The peer is the initiator if this mux is not, and vice versa.
+			if peerOpensOdd := !mux.Initiator; exists || id == 0 || (id%2 == 1) != peerOpensOdd {
+				mux.logger.Warning(id, nil, "the peer opened a stream with a conflicting ID")
+				continue
+			}
+			mux.mutex.Lock()
+			if len(mux.streams) >= mux.MaxStreams {
+				mux.mutex.Unlock()
+				mux.logger.Warning(id, nil, "refusing the stream in excess of %d streams", mux.MaxStreams)
+				_ = mux.writeFrame(id, MuxFrameClose, nil)
+				continue
+			}
+			stream = newMuxStream(mux, id, data)
+			mux.streams[id] = stream
+			mux.mutex.Unlock()
+			mux.accept <- stream
+		case MuxFrameData:
+			if exists {
+				stream.receive(data)
+			}
+		case MuxFrameWindow:
+			if exists && len(data) == 4 {
+				stream.grant(binary.BigEndian.Uint32(data))
+			}
+		case MuxFrameClose:
+			if exists {
+				mux.removeStream(id)
+				stream.terminate()
+			}
+		default:
+			mux.logger.Warning(id, nil, "received a frame of unknown type %d", frameType)
+		}
+	}
+}
+
+// removeStream stops tracking the stream.
+func (mux *Mux) removeStream(id uint16) {
+	mux.mutex.Lock()
+	defer mux.mutex.Unlock()
+	delete(mux.streams, id)
+}
+
+// MuxStream is a logical, bi-directional data stream of a mux.
+type MuxStream struct {
+	net.Conn
+	// ID is the stream ID unique among the streams of the mux.
+	ID uint16
+	// OpenData is the data delivered alongside the request to open the stream.
+	OpenData []byte
+
+	mux      *Mux
+	inputBuf []byte
+	// sendWindow is the amount of data that may be sent before the peer grants
+	// more room.
+	sendWindow uint32
+	// consumed is the amount of data read by the caller since the latest
+	// window update sent to the peer.
+	consumed uint32
+	closed   bool
+	// readDeadline and writeDeadline are the deadlines of the blocked
+	// readers and writers, the timers wake them up upon the deadlines.
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer       *time.Timer
+	mutex                       *sync.Mutex
+	cond                        *sync.Cond
+}
+
+// MuxAddr is the placeholder network address of a mux stream, which is
+// transported by the mux rather than a network connection of its own.
+type MuxAddr struct {
+	// LogTag is the log tag of the mux.
+	LogTag string
+	// ID is the stream ID.
+	ID uint16
+}
+
+// Network always returns "mux".
+func (addr MuxAddr) Network() string { return "mux" }
+
+// String returns the mux log tag and the stream ID.
+func (addr MuxAddr) String() string { return fmt.Sprintf("%s/%d", addr.LogTag, addr.ID) }
+
+func newMuxStream(mux *Mux, id uint16, openData []byte) *MuxStream {
+	stream := &MuxStream{
+		ID:         id,
+		OpenData:   openData,
+		mux:        mux,
+		sendWindow: MuxStreamWindow,
+		mutex:      new(sync.Mutex),
+	}
+	stream.cond = sync.NewCond(stream.mutex)
+	return stream
+}
+
+// receive buffers the data arrived from the peer.
+func (stream *MuxStream) receive(data []byte) {
+	stream.mutex.Lock()
+	if len(stream.inputBuf)+len(data) > MuxStreamWindow {
+		stream.mutex.Unlock()
+		stream.mux.logger.Warning(stream.ID, nil, "the peer exceeded the flow control window, closing the stream.")
+		_ = stream.Close()
+		return
+	}
+	stream.inputBuf = append(stream.inputBuf, data...)
+	stream.mutex.Unlock()
+	stream.cond.Broadcast()
+}
+
+// grant gives the stream more room to send data.
+func (stream *MuxStream) grant(n uint32) {
+	stream.mutex.Lock()
+	stream.sendWindow += n
+	if stream.sendWindow > MuxStreamWindow {
+		stream.sendWindow = MuxStreamWindow
+	}
+	stream.mutex.Unlock()
+	stream.cond.Broadcast()
+}
+
+// terminate marks the stream closed and wakes up the blocked readers and
+// writers.
+func (stream *MuxStream) terminate() {
+	stream.mutex.Lock()
+	stream.closed = true
+	stream.mutex.Unlock()
+	stream.cond.Broadcast()
+}
+
+// Read reads the data sent by the peer. It blocks until data arrives, the
+// stream is closed, or the read deadline passes.
+func (stream *MuxStream) Read(buf []byte) (int, error) {
+	stream.mutex.Lock()
+	for len(stream.inputBuf) == 0 && !stream.closed {
+		if isDeadlinePassed(stream.readDeadline) {
+			stream.mutex.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		stream.cond.Wait()
+	}
+	if len(stream.inputBuf) == 0 {
+		stream.mutex.Unlock()
+		return 0, io.EOF
+	}
+	n := copy(buf, stream.inputBuf)
+	stream.inputBuf = stream.inputBuf[n:]
+	stream.consumed += uint32(n)
+	var update uint32
+	if stream.consumed >= MuxStreamWindow/2 && !stream.closed {
+		update = stream.consumed
+		stream.consumed = 0
+	}
+	stream.mutex.Unlock()
+	if update > 0 {
+		// Let the peer send more.
+		increment := make([]byte, 4)
+		binary.BigEndian.PutUint32(increment, update)
+		if err := stream.mux.writeFrame(stream.ID, MuxFrameWindow, increment); err != nil {
+			stream.mux.logger.Warning(stream.ID, err, "failed to send window update")
+		}
+	}
+	return n, nil
+}
+
+// Write sends the data to the peer. It blocks while the flow control window is
+// exhausted, until the write deadline passes.
+func (stream *MuxStream) Write(buf []byte) (int, error) {
+	var written int
+	for written < len(buf) {
+		stream.mutex.Lock()
+		for stream.sendWindow == 0 && !stream.closed {
+			if isDeadlinePassed(stream.writeDeadline) {
+				stream.mutex.Unlock()
+				return written, os.ErrDeadlineExceeded
+			}
+			stream.cond.Wait()
+		}
+		if stream.closed {
+			stream.mutex.Unlock()
+			return written, ErrMuxClosed
+		}
+		frameLen := len(buf) - written
+		if frameLen > MuxMaxFrameDataLen {
+			frameLen = MuxMaxFrameDataLen
+		}
+		if frameLen > int(stream.sendWindow) {
+			frameLen = int(stream.sendWindow)
+		}
+		stream.sendWindow -= uint32(frameLen)
+		stream.mutex.Unlock()
+		if err := stream.mux.writeFrame(stream.ID, MuxFrameData, buf[written:written+frameLen]); err != nil {
+			return written, err
+		}
+		written += frameLen
+	}
+	return written, nil
+}
+
+// Close closes the stream in both directions and tells the peer to close it
+// too. The data already received but not yet read is discarded.
+func (stream *MuxStream) Close() error {
+	stream.mutex.Lock()
+	if stream.closed {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.closed = true
+	stream.inputBuf = nil
+	stream.mutex.Unlock()
+	stream.cond.Broadcast()
+	stream.mux.removeStream(stream.ID)
+	if err := stream.mux.writeFrame(stream.ID, MuxFrameClose, nil); err != nil && !errors.Is(err, ErrMuxClosed) {
+		return err
+	}
+	return nil
+}
+
+// LocalAddr returns the placeholder address of the stream.
+func (stream *MuxStream) LocalAddr() net.Addr {
+	return MuxAddr{LogTag: stream.mux.LogTag, ID: stream.ID}
+}
+
+// RemoteAddr returns the placeholder address of the stream.
+func (stream *MuxStream) RemoteAddr() net.Addr {
+	return MuxAddr{LogTag: stream.mux.LogTag, ID: stream.ID}
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (stream *MuxStream) SetDeadline(t time.Time) error {
+	_ = stream.SetReadDeadline(t)
+	return stream.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of the blocked and future reads, a zero
+// value means no deadline.
+func (stream *MuxStream) SetReadDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.readDeadline = t
+	stream.readTimer = stream.resetDeadlineTimer(stream.readTimer, t)
+	stream.mutex.Unlock()
+	stream.cond.Broadcast()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of the blocked and future writes, a zero
+// value means no deadline. A write that has already started sending a frame
+// is not interrupted.
+func (stream *MuxStream) SetWriteDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	stream.writeDeadline = t
+	stream.writeTimer = stream.resetDeadlineTimer(stream.writeTimer, t)
+	stream.mutex.Unlock()
+	stream.cond.Broadcast()
+	return nil
+}
+
+// resetDeadlineTimer stops the timer of the previous deadline, and returns a
+// new timer that wakes up the blocked readers and writers upon the deadline.
+// The caller must hold the stream mutex.
+func (stream *MuxStream) resetDeadlineTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), stream.cond.Broadcast)
+}
+
+// isDeadlinePassed returns true if the deadline is set and has passed.
+func isDeadlinePassed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
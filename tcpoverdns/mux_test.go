@@ -0,0 +1,237 @@
+package tcpoverdns
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMux(t *testing.T) {
+	initiatorConn, responderConn := net.Pipe()
+	initiator := &Mux{Conn: initiatorConn, Initiator: true, LogTag: "initiator"}
+	responder := &Mux{Conn: responderConn, MaxStreams: 10, LogTag: "responder"}
+	initiator.Start(context.Background())
+	responder.Start(context.Background())
+
+	// The responder echoes the data of each stream.
+	go func() {
+		for {
+			stream, err := responder.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			if string(stream.OpenData) == "no-echo" {
+				continue
+			}
+			go func() {
+				_, _ = io.Copy(stream, stream)
+				_ = stream.Close()
+			}()
+		}
+	}()
+
+	// Many streams transfer data in parallel, each exceeding the flow control window.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, err := initiator.OpenStream([]byte(fmt.Sprint(i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if stream.ID%2 != 1 {
+				t.Errorf("unexpected stream ID %d", stream.ID)
+			}
+			data := make([]byte, 3*MuxStreamWindow+123)
+			_, _ = rand.Read(data)
+			go func() {
+				if n, err := stream.Write(data); err != nil || n != len(data) {
+					t.Errorf("write: %v %v", n, err)
+				}
+			}()
+			readBack := make([]byte, len(data))
+			if _, err := io.ReadFull(stream, readBack); err != nil || !bytes.Equal(readBack, data) {
+				t.Errorf("read back: %v", err)
+			}
+			_ = stream.Close()
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	// The writer blocks when the peer does not consume the data.
+	stream, err := initiator.OpenStream([]byte("no-echo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeDone := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(make([]byte, MuxStreamWindow+1))
+		writeDone <- err
+	}()
+	select {
+	case err := <-writeDone:
+		t.Fatal("write should have been blocked by flow control", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+	// Closing the stream unblocks the writer.
+	_ = stream.Close()
+	if err := <-writeDone; err != ErrMuxClosed {
+		t.Fatal(err)
+	}
+
+	// The deadlines wake up the blocked reader and writer.
+	stream, err = initiator.OpenStream([]byte("no-echo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := stream.RemoteAddr().String(); addr != fmt.Sprintf("initiator/%d", stream.ID) {
+		t.Fatal(addr)
+	}
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(make([]byte, 1))
+		readDone <- err
+	}()
+	go func() {
+		_, err := stream.Write(make([]byte, MuxStreamWindow+1))
+		writeDone <- err
+	}()
+	_ = stream.SetDeadline(time.Now().Add(200 * time.Millisecond))
+	for _, done := range []chan error{readDone, writeDone} {
+		select {
+		case err := <-done:
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("the deadline did not wake up the stream")
+		}
+	}
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal(err)
+	}
+	// Clearing the deadline lets the stream block again.
+	_ = stream.SetReadDeadline(time.Time{})
+	go func() {
+		_, err := stream.Read(make([]byte, 1))
+		readDone <- err
+	}()
+	select {
+	case err := <-readDone:
+		t.Fatal("read should have been blocked", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	_ = stream.Close()
+	if err := <-readDone; err != io.EOF {
+		t.Fatal(err)
+	}
+
+	// The responder refuses streams in excess of its maximum.
+	for i := 0; i < 10; i++ {
+		if _, err := initiator.OpenStream([]byte("no-echo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excess, err := initiator.OpenStream([]byte("no-echo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := excess.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatal(n, err)
+	}
+
+	// Closing the mux closes its streams.
+	_ = responder.Close()
+	<-initiator.Done()
+	if _, err := initiator.OpenStream(nil); err != ErrMuxClosed {
+		t.Fatal(err)
+	}
+	if initiator.NumStreams() != 0 {
+		t.Fatal(initiator.NumStreams())
+	}
+}
+
+func TestMux_TransmissionControl(t *testing.T) {
+	leftIn, leftInTransport := net.Pipe()
+	rightIn, rightInTransport := net.Pipe()
+	timing := TimingConfig{
+		SlidingWindowWaitDuration: 500 * time.Millisecond,
+		RetransmissionInterval:    1000 * time.Millisecond,
+		AckDelay:                  50 * time.Millisecond,
+		KeepAliveInterval:         300 * time.Millisecond,
+		ReadTimeout:               1000 * time.Millisecond,
+		WriteTimeout:              10 * time.Second,
+	}
+	initiatorTC := &TransmissionControl{
+		ID:              1111,
+		InputTransport:  leftInTransport,
+		OutputTransport: rightIn,
+		Initiator:       true,
+		InitiatorConfig: InitiatorConfig{SetConfig: true, MaxSegmentLenExclHeader: 20, Timing: timing},
+		InitialTiming:   timing,
+	}
+	responderTC := &TransmissionControl{
+		ID:              1111,
+		InputTransport:  rightInTransport,
+		OutputTransport: leftIn,
+	}
+	initiatorTC.Start(context.Background())
+	responderTC.Start(context.Background())
+	initiator := &Mux{Conn: initiatorTC, Initiator: true, LogTag: "initiator"}
+	responder := &Mux{Conn: responderTC, LogTag: "responder"}
+	initiator.Start(context.Background())
+	responder.Start(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			stream, err := initiator.OpenStream([]byte(fmt.Sprint(i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := stream.Write([]byte(fmt.Sprintf("hello %d", i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	received := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		stream, err := responder.Accept(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 7)
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			t.Fatal(err)
+		}
+		received[string(stream.OpenData)] = string(buf)
+	}
+	wg.Wait()
+	for i := 0; i < 3; i++ {
+		if received[fmt.Sprint(i)] != fmt.Sprintf("hello %d", i) {
+			t.Fatalf("%+v", received)
+		}
+	}
+	_ = initiator.Close()
+	select {
+	case <-responder.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatal("responder mux did not close with the transmission control")
+	}
+}
@@ -5,22 +5,35 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 var (
 	// RegexAESShortcutKeySearch finds a shortcut name, encryption key, and search string.
-	RegexAESShortcutKeySearch = regexp.MustCompile(`(\w+)[^\w]+(\w+)[^\w]+(.*)`)
-	ErrBadAESDecryptParam     = errors.New(`example: shortcut key to_search`)
+	RegexAESShortcutKeySearch = regexp.MustCompile(`(\w+)[^\w]+(\w+)[^\w+!]+(.*)`)
+	// RegexAESSearchWindow finds the number of matched lines to skip in front of the (optional) search string, e.g. "+10 john".
+	RegexAESSearchWindow = regexp.MustCompile(`^\+(\d+)\s*(.*)`)
+	// RegexAESReEncrypt finds the new key suffix of a re-encryption command, e.g. "!rekey 1a2b".
+	RegexAESReEncrypt     = regexp.MustCompile(`^!rekey\s+(\w+)$`)
+	ErrBadAESDecryptParam = errors.New(`example: shortcut key to_search | shortcut key +skip to_search | shortcut key !rekey new_key`)
 )
 
-const OpensslSaltedContentOffset = 16 // openssl writes down irrelevant salt in position 8:16
+const (
+	OpensslSaltedContentOffset = 16 // openssl writes down irrelevant salt in position 8:16
+	opensslSaltedMagic         = "Salted__"
+
+	// AESDefaultResultWindowSize is the default number of matched lines in a window of search result.
+	AESDefaultResultWindowSize = 10
+)
 
 /*
 Attributes about an AES-256-CBC encrypted file.
@@ -34,6 +47,8 @@ type AESEncryptedFile struct {
 	IV           []byte `json:"-"`            // IV in bytes
 	HexKeyPrefix string `json:"HexKeyPrefix"` // Hex-encoded encryption key, to be prepended to the key given in the command.
 	KeyPrefix    []byte `json:"-"`            // Key prefix in bytes
+
+	mutex *sync.RWMutex // mutex protects file content from concurrent re-encryption
 }
 
 // Initialise reads encrypted file into memory.
@@ -41,6 +56,7 @@ func (file *AESEncryptedFile) Initialise() error {
 	if file.HexIV == "" || file.FilePath == "" || file.HexKeyPrefix == "" {
 		return fmt.Errorf("AESEncryptedFile.Initialise: file \"%s\" is missing configuration", file.FilePath)
 	}
+	file.mutex = new(sync.RWMutex)
 	var err error
 	if file.FileContent, err = os.ReadFile(file.FilePath); err != nil {
 		return fmt.Errorf("AESEncryptedFile.Initialise: failed to read AES encrypted file \"%s\" - %v", file.FilePath, err)
@@ -57,26 +73,99 @@ func (file *AESEncryptedFile) Initialise() error {
 	return nil
 }
 
-// Decrypt uses combination of encryption key from configuration and parameter to decrypt the entire file.
-func (file *AESEncryptedFile) Decrypt(keySuffix []byte) (plainContent []byte, err error) {
+// getKey returns the combination of encryption key prefix from configuration and the key suffix.
+func (file *AESEncryptedFile) getKey(keySuffix []byte) []byte {
 	keyTogether := make([]byte, len(file.KeyPrefix)+len(keySuffix))
 	copy(keyTogether, file.KeyPrefix[:])
 	copy(keyTogether[len(file.KeyPrefix):], keySuffix[:])
-	aesCipher, err := aes.NewCipher(keyTogether)
+	return keyTogether
+}
+
+// Decrypt uses combination of encryption key from configuration and parameter to decrypt the entire file.
+func (file *AESEncryptedFile) Decrypt(keySuffix []byte) (plainContent []byte, err error) {
+	if file.mutex != nil {
+		file.mutex.RLock()
+		defer file.mutex.RUnlock()
+	}
+	return file.decrypt(keySuffix)
+}
+
+// decrypt decrypts the entire file content. Caller should hold the mutex.
+func (file *AESEncryptedFile) decrypt(keySuffix []byte) (plainContent []byte, err error) {
+	aesCipher, err := aes.NewCipher(file.getKey(keySuffix))
 	if err != nil {
 		return
 	}
+	if (len(file.FileContent)-OpensslSaltedContentOffset)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("AESEncryptedFile.Decrypt: \"%s\" is not a multiple of AES block size", file.FilePath)
+	}
 	decryptor := cipher.NewCBCDecrypter(aesCipher, file.IV)
 	plainContent = make([]byte, len(file.FileContent))
-	decryptor.CryptBlocks(plainContent, file.FileContent[16:])
+	decryptor.CryptBlocks(plainContent, file.FileContent[OpensslSaltedContentOffset:])
 	return
 }
 
+/*
+ReEncrypt decrypts the file using the current key suffix, and encrypts the content again using the new key suffix in the
+same format as openssl-enc. The key prefix and IV remain unchanged, hence the configuration does not need to be updated.
+The new key suffix must be of the same length as the current one. The encrypted file is replaced on disk.
+*/
+func (file *AESEncryptedFile) ReEncrypt(keySuffix, newKeySuffix []byte) error {
+	if file.mutex == nil {
+		return errors.New("AESEncryptedFile.ReEncrypt: the file has not been initialised")
+	}
+	if len(keySuffix) != len(newKeySuffix) {
+		return errors.New("AESEncryptedFile.ReEncrypt: the new key must be as long as the current key")
+	}
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+	plainContent, err := file.decrypt(keySuffix)
+	if err != nil {
+		return err
+	}
+	// The decrypted content is followed by PKCS#7 padding, which also helps to tell whether the current key is correct.
+	plainContent = plainContent[:len(file.FileContent)-OpensslSaltedContentOffset]
+	numPadding := 0
+	if len(plainContent) > 0 {
+		numPadding = int(plainContent[len(plainContent)-1])
+	}
+	if numPadding < 1 || numPadding > aes.BlockSize || numPadding > len(plainContent) ||
+		!bytes.Equal(plainContent[len(plainContent)-numPadding:], bytes.Repeat([]byte{byte(numPadding)}, numPadding)) {
+		return errors.New("AESEncryptedFile.ReEncrypt: the current key is incorrect")
+	}
+	aesCipher, err := aes.NewCipher(file.getKey(newKeySuffix))
+	if err != nil {
+		return err
+	}
+	newContent := make([]byte, len(file.FileContent))
+	copy(newContent, opensslSaltedMagic)
+	if _, err := rand.Read(newContent[len(opensslSaltedMagic):OpensslSaltedContentOffset]); err != nil {
+		return err
+	}
+	cipher.NewCBCEncrypter(aesCipher, file.IV).CryptBlocks(newContent[OpensslSaltedContentOffset:], plainContent)
+	// Replace the file on disk atomically, so that a crash does not leave a half-written file behind.
+	tmpPath := file.FilePath + ".rekey"
+	if err := os.WriteFile(tmpPath, newContent, 0600); err != nil {
+		return fmt.Errorf("AESEncryptedFile.ReEncrypt: failed to write \"%s\" - %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, file.FilePath); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("AESEncryptedFile.ReEncrypt: failed to replace \"%s\" - %v", file.FilePath, err)
+	}
+	file.FileContent = newContent
+	return nil
+}
+
 const AESDecryptTrigger = ".a" // AESDecryptTrigger is the trigger prefix string of AESDecrypt feature.
 
-// Decrypt AES-encrypted file and return lines sought by incoming command.
+/*
+Decrypt AES-encrypted file and return lines sought by incoming command. Each of the encrypted files is a named vault
+decrypted by its own key.
+*/
 type AESDecrypt struct {
 	EncryptedFiles map[string]*AESEncryptedFile `json:"EncryptedFiles"` // shortcut (\w+) vs file attributes
+	// ResultWindowSize is the number of matched lines returned when a search skips over some of the matches.
+	ResultWindowSize int `json:"ResultWindowSize"`
 }
 
 func (crypt *AESDecrypt) IsConfigured() bool {
@@ -96,6 +185,9 @@ func (crypt *AESDecrypt) SelfTest() error {
 }
 
 func (crypt *AESDecrypt) Initialise() error {
+	if crypt.ResultWindowSize < 1 {
+		crypt.ResultWindowSize = AESDefaultResultWindowSize
+	}
 	// Read all encrypted files into memory
 	for _, encrypted := range crypt.EncryptedFiles {
 		if err := encrypted.Initialise(); err != nil {
@@ -124,11 +216,29 @@ func (crypt *AESDecrypt) Execute(ctx context.Context, cmd Command) (ret *Result)
 	if err != nil {
 		return &Result{Error: errors.New("failed to decode hex key")}
 	}
-	searchString := strings.ToLower(params[3])
 	file, found := crypt.EncryptedFiles[shortcutName]
 	if !found {
 		return &Result{Error: errors.New("cannot find " + shortcutName)}
 	}
+	// Re-encrypt the file using a new key suffix
+	if rekeyParams := RegexAESReEncrypt.FindStringSubmatch(params[3]); len(rekeyParams) == 2 {
+		newKeySuffix, err := hex.DecodeString(rekeyParams[1])
+		if err != nil {
+			return &Result{Error: errors.New("failed to decode new hex key")}
+		}
+		if err := file.ReEncrypt(keySuffix, newKeySuffix); err != nil {
+			return &Result{Error: err}
+		}
+		return &Result{Output: fmt.Sprintf("re-encrypted %s", shortcutName)}
+	}
+	// Optionally skip over some of the matched lines and return a window of the remaining matches
+	searchString := strings.ToLower(params[3])
+	skip, windowSize := 0, -1
+	if windowParams := RegexAESSearchWindow.FindStringSubmatch(searchString); len(windowParams) == 3 {
+		skip, _ = strconv.Atoi(windowParams[1])
+		windowSize = crypt.ResultWindowSize
+		searchString = windowParams[2]
+	}
 	plainContent, err := file.Decrypt(keySuffix)
 	if err != nil {
 		return &Result{Error: err}
@@ -138,7 +248,9 @@ func (crypt *AESDecrypt) Execute(ctx context.Context, cmd Command) (ret *Result)
 	var numMatch int
 	for _, line := range strings.Split(string(plainContent), "\n") {
 		if strings.Contains(strings.ToLower(line), searchString) {
-			match.WriteString(line)
+			if numMatch >= skip && (windowSize < 0 || numMatch < skip+windowSize) {
+				match.WriteString(line)
+			}
 			numMatch++
 		}
 	}
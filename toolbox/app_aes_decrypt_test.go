@@ -2,8 +2,12 @@ package toolbox
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestAESDecrypt_Execute(t *testing.T) {
@@ -64,3 +68,45 @@ func TestAESDecrypt_Execute(t *testing.T) {
 		t.Fatal(ret)
 	}
 }
+
+func TestAESDecrypt_WindowAndReEncrypt(t *testing.T) {
+	decrypt := GetTestAESDecrypt()
+	// Re-encryption replaces the file, use a copy of the sample file.
+	sample, err := os.ReadFile(decrypt.EncryptedFiles[TestAESDecryptFileBetaName].FilePath)
+	require.NoError(t, err)
+	vaultPath := filepath.Join(t.TempDir(), "vault")
+	require.NoError(t, os.WriteFile(vaultPath, sample, 0600))
+	decrypt.EncryptedFiles[TestAESDecryptFileBetaName].FilePath = vaultPath
+	decrypt.ResultWindowSize = 1
+	require.NoError(t, decrypt.Initialise())
+
+	// Each line of "abc\ndef\nghi\n" contains a lower case letter, skip over the first match and return a window of one match.
+	ret := decrypt.Execute(context.Background(), Command{TimeoutSec: 10, Content: TestAESDecryptFileBetaName + " 44a4 +1 "})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "4 def", ret.Output)
+	ret = decrypt.Execute(context.Background(), Command{TimeoutSec: 10, Content: TestAESDecryptFileBetaName + " 44a4 +5 h"})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "1 ", ret.Output)
+
+	// Re-encryption refuses an incorrect key and a new key of different length.
+	ret = decrypt.Execute(context.Background(), Command{TimeoutSec: 10, Content: TestAESDecryptFileBetaName + " 0000 !rekey 1234"})
+	require.Error(t, ret.Error)
+	ret = decrypt.Execute(context.Background(), Command{TimeoutSec: 10, Content: TestAESDecryptFileBetaName + " 44a4 !rekey 123456"})
+	require.Error(t, ret.Error)
+	// Re-encrypt using a new key and search again.
+	ret = decrypt.Execute(context.Background(), Command{TimeoutSec: 10, Content: TestAESDecryptFileBetaName + " 44a4 !rekey 1234"})
+	require.NoError(t, ret.Error)
+	ret = decrypt.Execute(context.Background(), Command{TimeoutSec: 10, Content: TestAESDecryptFileBetaName + " 1234 a"})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "1 abc", ret.Output)
+	ret = decrypt.Execute(context.Background(), Command{TimeoutSec: 10, Content: TestAESDecryptFileBetaName + " 44a4 a"})
+	require.NoError(t, ret.Error)
+	require.NotEqual(t, "1 abc", ret.Output)
+	// The file on disk is encrypted using the new key too.
+	reloaded := GetTestAESDecrypt()
+	reloaded.EncryptedFiles[TestAESDecryptFileBetaName].FilePath = vaultPath
+	require.NoError(t, reloaded.Initialise())
+	ret = reloaded.Execute(context.Background(), Command{TimeoutSec: 10, Content: TestAESDecryptFileBetaName + " 1234 g"})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "1 ghi", ret.Output)
+}
@@ -0,0 +1,207 @@
+package toolbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// ContactBookTrigger is the trigger prefix string of ContactBook feature.
+	ContactBookTrigger = ".contact"
+	// MaxContactFieldLen is the maximum length of a contact's name and each of its details.
+	MaxContactFieldLen = 200
+)
+
+var (
+	// RegexContactField finds the detail field names of a contact, e.g. "phone=".
+	RegexContactField      = regexp.MustCompile(`(?i)\b(phone|email|callsign|note)\s*=`)
+	ErrBadContactBookParam = errors.New(`example: search_text | set name: phone=+1234 email=me@example.com callsign=AB1CD note=text | del name`)
+)
+
+// Contact is an entry of the contact book.
+type Contact struct {
+	Name     string `json:"name"`
+	Phone    string `json:"phone,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Callsign string `json:"callsign,omitempty"`
+	Note     string `json:"note,omitempty"`
+}
+
+// String returns the name followed by the contact details that are present.
+func (contact Contact) String() string {
+	details := make([]string, 0, 4)
+	for _, field := range []struct{ name, value string }{
+		{"phone", contact.Phone},
+		{"email", contact.Email},
+		{"callsign", contact.Callsign},
+		{"note", contact.Note},
+	} {
+		if field.value != "" {
+			details = append(details, field.name+" "+field.value)
+		}
+	}
+	return contact.Name + ": " + strings.Join(details, ", ")
+}
+
+// Contains returns true if the lower case search text appears among the name and details, case insensitive.
+func (contact Contact) Contains(lowerText string) bool {
+	for _, value := range []string{contact.Name, contact.Phone, contact.Email, contact.Callsign, contact.Note} {
+		if strings.Contains(strings.ToLower(value), lowerText) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ContactBook keeps names, phone numbers, email addresses, and radio callsigns in an encrypted file, the contacts may be
+looked up and updated via app commands from any channel, e.g. when the phone carrying the address book is unavailable.
+*/
+type ContactBook struct {
+	// FilePath is the location of the encrypted contact book file, it is created upon the first update.
+	FilePath string `json:"FilePath"`
+	// Passphrase is used to derive the encryption key of the contact book file.
+	Passphrase string `json:"Passphrase"`
+
+	store *misc.EncryptedKVStore
+}
+
+func (book *ContactBook) IsConfigured() bool {
+	return book.FilePath != "" && book.Passphrase != ""
+}
+
+func (book *ContactBook) SelfTest() error {
+	if !book.IsConfigured() {
+		return ErrIncompleteConfig
+	}
+	return nil
+}
+
+func (book *ContactBook) Initialise() error {
+	book.store = &misc.EncryptedKVStore{FilePath: book.FilePath, Passphrase: book.Passphrase}
+	if err := book.store.Initialise(); err != nil {
+		return fmt.Errorf("ContactBook.Initialise: %w", err)
+	}
+	return nil
+}
+
+// Trigger returns the trigger prefix string ".contact".
+func (book *ContactBook) Trigger() Trigger {
+	return ContactBookTrigger
+}
+
+func (book *ContactBook) Execute(ctx context.Context, cmd Command) (ret *Result) {
+	if errResult := cmd.Trim(); errResult != nil {
+		return errResult
+	}
+	action, param := splitFirstWord(cmd.Content)
+	switch strings.ToLower(action) {
+	case "set":
+		return book.set(param)
+	case "del":
+		return book.delete(param)
+	default:
+		return book.search(cmd.Content)
+	}
+}
+
+// Get returns the contact of the name, case insensitive.
+func (book *ContactBook) Get(name string) (contact Contact, found bool, err error) {
+	serialised, found := book.store.Get(strings.ToLower(name))
+	if !found {
+		return
+	}
+	err = json.Unmarshal([]byte(serialised), &contact)
+	return
+}
+
+// search returns the contacts that contain the search text.
+func (book *ContactBook) search(text string) *Result {
+	lowerText := strings.ToLower(strings.TrimSpace(text))
+	matches := make([]string, 0)
+	for _, key := range book.store.Keys() {
+		contact, _, err := book.Get(key)
+		if err != nil {
+			return &Result{Error: err}
+		}
+		if contact.Contains(lowerText) {
+			matches = append(matches, contact.String())
+		}
+	}
+	// Output is number of matched contacts followed by their details
+	return &Result{Output: fmt.Sprintf("%d %s", len(matches), strings.Join(matches, "\n"))}
+}
+
+// set creates a contact or updates the details of an existing contact. A detail given an empty value is removed.
+func (book *ContactBook) set(param string) *Result {
+	colon := strings.IndexRune(param, ':')
+	if colon < 1 {
+		return &Result{Error: ErrBadContactBookParam}
+	}
+	name := strings.TrimSpace(param[:colon])
+	if len(name) > MaxContactFieldLen {
+		return &Result{Error: fmt.Errorf("the name must not exceed %d characters", MaxContactFieldLen)}
+	}
+	details := param[colon+1:]
+	fieldLocs := RegexContactField.FindAllStringSubmatchIndex(details, -1)
+	if name == "" || len(fieldLocs) == 0 || strings.TrimSpace(details[:fieldLocs[0][0]]) != "" {
+		return &Result{Error: ErrBadContactBookParam}
+	}
+	contact, found, err := book.Get(name)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if !found {
+		contact.Name = name
+	}
+	for i, loc := range fieldLocs {
+		// The value of a field extends to the start of the next field
+		valueEnd := len(details)
+		if i+1 < len(fieldLocs) {
+			valueEnd = fieldLocs[i+1][0]
+		}
+		value := strings.TrimSpace(details[loc[1]:valueEnd])
+		if len(value) > MaxContactFieldLen {
+			return &Result{Error: fmt.Errorf("the value of %s must not exceed %d characters", details[loc[2]:loc[3]], MaxContactFieldLen)}
+		}
+		switch strings.ToLower(details[loc[2]:loc[3]]) {
+		case "phone":
+			contact.Phone = value
+		case "email":
+			contact.Email = value
+		case "callsign":
+			contact.Callsign = strings.ToUpper(value)
+		case "note":
+			contact.Note = value
+		}
+	}
+	serialised, err := json.Marshal(contact)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if err := book.store.Put(strings.ToLower(contact.Name), string(serialised)); err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: contact.String()}
+}
+
+// delete removes the contact of the name.
+func (book *ContactBook) delete(name string) *Result {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return &Result{Error: ErrBadContactBookParam}
+	}
+	deleted, err := book.store.Delete(strings.ToLower(name))
+	if err != nil {
+		return &Result{Error: err}
+	} else if !deleted {
+		return &Result{Error: errors.New("cannot find " + name)}
+	}
+	return &Result{Output: "deleted " + name}
+}
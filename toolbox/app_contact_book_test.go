@@ -0,0 +1,68 @@
+package toolbox
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestContactBook(t *testing.T) {
+	book := ContactBook{}
+	if book.IsConfigured() {
+		t.Fatal("should not be configured")
+	}
+	book.FilePath = filepath.Join(t.TempDir(), "contacts")
+	book.Passphrase = "pass"
+	if !book.IsConfigured() {
+		t.Fatal("should be configured")
+	}
+	if err := book.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := book.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	// Bad input
+	for _, content := range []string{"set", "set john", "set john: tel=123", "set : phone=123", "set john: x phone=123", "del"} {
+		if ret := book.Execute(context.Background(), Command{Content: content}); ret.Error != ErrBadContactBookParam {
+			t.Fatal(content, ret)
+		}
+	}
+	// Add contacts
+	if ret := book.Execute(context.Background(), Command{Content: "set John Smith: phone=+61 2 1234 email=john@example.com note=met at the club, Sydney"}); ret.Error != nil || ret.Output != "John Smith: phone +61 2 1234, email john@example.com, note met at the club, Sydney" {
+		t.Fatal(ret)
+	}
+	if ret := book.Execute(context.Background(), Command{Content: "set Jane: callsign=vk2abc"}); ret.Error != nil || ret.Output != "Jane: callsign VK2ABC" {
+		t.Fatal(ret)
+	}
+	// Update a contact, a detail given an empty value is removed
+	if ret := book.Execute(context.Background(), Command{Content: "SET john smith: Email=js@example.com note="}); ret.Error != nil || ret.Output != "John Smith: phone +61 2 1234, email js@example.com" {
+		t.Fatal(ret)
+	}
+	// Search among names and details
+	if ret := book.Execute(context.Background(), Command{Content: "j"}); ret.Error != nil || ret.Output != "2 Jane: callsign VK2ABC\nJohn Smith: phone +61 2 1234, email js@example.com" {
+		t.Fatal(ret)
+	}
+	if ret := book.Execute(context.Background(), Command{Content: "vk2"}); ret.Error != nil || !strings.HasPrefix(ret.Output, "1 Jane") {
+		t.Fatal(ret)
+	}
+	// The contacts survive program restart
+	book = ContactBook{FilePath: book.FilePath, Passphrase: "pass"}
+	if err := book.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if contact, found, err := book.Get("JANE"); !found || err != nil || contact.Callsign != "VK2ABC" {
+		t.Fatal(contact, found, err)
+	}
+	// Delete a contact
+	if ret := book.Execute(context.Background(), Command{Content: "del jane"}); ret.Error != nil || ret.Output != "deleted jane" {
+		t.Fatal(ret)
+	}
+	if ret := book.Execute(context.Background(), Command{Content: "del jane"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	if ret := book.Execute(context.Background(), Command{Content: "vk2"}); ret.Error != nil || ret.Output != "0 " {
+		t.Fatal(ret)
+	}
+}
@@ -0,0 +1,271 @@
+package toolbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+const (
+	// ConversionTrigger is the trigger prefix string of Conversion feature.
+	ConversionTrigger = ".conv"
+	// ConversionDefaultRatesURL is the default API endpoint of daily currency exchange rates, it does not require an API key.
+	ConversionDefaultRatesURL = "https://open.er-api.com/v6/latest/USD"
+	// ConversionDefaultRatesCacheSec is the default number of seconds for which the exchange rates are cached.
+	ConversionDefaultRatesCacheSec = 24 * 3600
+)
+
+var ErrBadConversionParam = errors.New(`example: [amount] from-unit [to] to-unit (e.g. 100 usd eur, 5 km mi, 30 c f)`)
+
+// RegexCurrencyCode matches an ISO 4217 currency code.
+var RegexCurrencyCode = regexp.MustCompile(`^[A-Za-z]{3}$`)
+
+// conversionUnit is a unit of measurement, its factor converts a quantity of the unit into the base unit of its kind.
+type conversionUnit struct {
+	name   string
+	kind   string
+	factor float64
+}
+
+// conversionUnits are the units of common measurements keyed by their names and aliases in lower case.
+var conversionUnits = func() map[string]conversionUnit {
+	ret := make(map[string]conversionUnit)
+	for _, def := range []struct {
+		kind    string
+		factor  float64
+		aliases []string
+	}{
+		// Length in metres
+		{"length", 1, []string{"m", "metre", "metres", "meter", "meters"}},
+		{"length", 1000, []string{"km", "kilometre", "kilometres", "kilometer", "kilometers"}},
+		{"length", 0.01, []string{"cm", "centimetre", "centimetres", "centimeter", "centimeters"}},
+		{"length", 0.001, []string{"mm", "millimetre", "millimetres", "millimeter", "millimeters"}},
+		{"length", 1609.344, []string{"mi", "mile", "miles"}},
+		{"length", 0.9144, []string{"yd", "yard", "yards"}},
+		{"length", 0.3048, []string{"ft", "foot", "feet"}},
+		{"length", 0.0254, []string{"in", "inch", "inches"}},
+		{"length", 1852, []string{"nmi", "nm"}},
+		// Mass in kilograms
+		{"mass", 1, []string{"kg", "kilogram", "kilograms"}},
+		{"mass", 0.001, []string{"g", "gram", "grams"}},
+		{"mass", 0.000001, []string{"mg", "milligram", "milligrams"}},
+		{"mass", 1000, []string{"t", "tonne", "tonnes"}},
+		{"mass", 0.45359237, []string{"lb", "lbs", "pound", "pounds"}},
+		{"mass", 0.028349523125, []string{"oz", "ounce", "ounces"}},
+		{"mass", 6.35029318, []string{"st", "stone"}},
+		// Volume in litres
+		{"volume", 1, []string{"l", "litre", "litres", "liter", "liters"}},
+		{"volume", 0.001, []string{"ml", "millilitre", "millilitres", "milliliter", "milliliters"}},
+		{"volume", 3.785411784, []string{"gal", "gallon", "gallons"}},
+		{"volume", 0.946352946, []string{"qt", "quart", "quarts"}},
+		{"volume", 0.473176473, []string{"pt", "pint", "pints"}},
+		{"volume", 0.0295735295625, []string{"floz"}},
+		{"volume", 0.2365882365, []string{"cup", "cups"}},
+		// Speed in metres per second
+		{"speed", 1, []string{"m/s", "mps"}},
+		{"speed", 1 / 3.6, []string{"km/h", "kmh", "kph"}},
+		{"speed", 0.44704, []string{"mph"}},
+		{"speed", 1852.0 / 3600, []string{"kn", "kt", "knot", "knots"}},
+		// Area in square metres
+		{"area", 1, []string{"m2", "sqm"}},
+		{"area", 1000000, []string{"km2", "sqkm"}},
+		{"area", 10000, []string{"ha", "hectare", "hectares"}},
+		{"area", 4046.8564224, []string{"acre", "acres"}},
+		{"area", 0.09290304, []string{"ft2", "sqft"}},
+		// Temperature is converted by formula rather than factor
+		{"temperature", 0, []string{"c", "celsius"}},
+		{"temperature", 0, []string{"f", "fahrenheit"}},
+		{"temperature", 0, []string{"k", "kelvin"}},
+	} {
+		for _, alias := range def.aliases {
+			ret[alias] = conversionUnit{name: def.aliases[0], kind: def.kind, factor: def.factor}
+		}
+	}
+	return ret
+}()
+
+/*
+Conversion converts an amount of money between currencies using the daily exchange rates, and a quantity between the
+units of common measurements - length, mass, volume, speed, area, and temperature.
+*/
+type Conversion struct {
+	/*
+		RatesURL is the API endpoint of currency exchange rates, it defaults to ConversionDefaultRatesURL. The API responds
+		with the rates in a JSON object "rates" keyed by currency code, along with the base currency in "base_code" or
+		"base", which works with open.er-api.com and frankfurter.app.
+	*/
+	RatesURL string `json:"RatesURL"`
+	// RatesCacheSec is the number of seconds for which the exchange rates are cached, it defaults to ConversionDefaultRatesCacheSec.
+	RatesCacheSec int `json:"RatesCacheSec"`
+
+	rates      map[string]float64 // rates are the exchange rates of currencies relative to the base currency
+	ratesTime  time.Time          // ratesTime is the time at which the rates were retrieved
+	ratesMutex *sync.Mutex
+}
+
+// IsConfigured always returns true because the unit conversion and the default exchange rates API do not require configuration.
+func (conv *Conversion) IsConfigured() bool {
+	return true
+}
+
+// SelfTest retrieves the latest exchange rates.
+func (conv *Conversion) SelfTest() error {
+	ctx, cancel := context.WithTimeout(context.Background(), SelfTestTimeoutSec*time.Second)
+	defer cancel()
+	if _, err := conv.getRates(ctx, SelfTestTimeoutSec, true); err != nil {
+		return fmt.Errorf("Conversion.SelfTest: %w", err)
+	}
+	return nil
+}
+
+func (conv *Conversion) Initialise() error {
+	if conv.RatesURL == "" {
+		conv.RatesURL = ConversionDefaultRatesURL
+	}
+	if conv.RatesCacheSec < 1 {
+		conv.RatesCacheSec = ConversionDefaultRatesCacheSec
+	}
+	conv.ratesMutex = new(sync.Mutex)
+	return nil
+}
+
+func (conv *Conversion) Trigger() Trigger {
+	return ConversionTrigger
+}
+
+// getRates returns the cached exchange rates, or retrieves the latest rates if the cache has expired or a refresh is forced.
+func (conv *Conversion) getRates(ctx context.Context, timeoutSec int, forceRefresh bool) (map[string]float64, error) {
+	conv.ratesMutex.Lock()
+	defer conv.ratesMutex.Unlock()
+	if !forceRefresh && conv.rates != nil && time.Since(conv.ratesTime) < time.Duration(conv.RatesCacheSec)*time.Second {
+		return conv.rates, nil
+	}
+	resp, err := inet.DoHTTP(ctx, inet.HTTPRequest{TimeoutSec: timeoutSec}, strings.ReplaceAll(conv.RatesURL, "%", "%%"))
+	if errResult := HTTPErrorToResult(resp, err); errResult != nil {
+		return nil, errResult.Error
+	}
+	var body struct {
+		Rates    map[string]float64 `json:"rates"`
+		BaseCode string             `json:"base_code"`
+		Base     string             `json:"base"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return nil, fmt.Errorf("failed to decode exchange rates - %w", err)
+	} else if len(body.Rates) == 0 {
+		return nil, errors.New("the exchange rates API did not respond with any rate")
+	}
+	rates := make(map[string]float64)
+	for code, rate := range body.Rates {
+		if rate > 0 {
+			rates[strings.ToUpper(code)] = rate
+		}
+	}
+	// The base currency is not always among the rates (e.g. frankfurter.app)
+	if base := strings.ToUpper(body.BaseCode + body.Base); RegexCurrencyCode.MatchString(base) {
+		rates[base] = 1
+	}
+	conv.rates = rates
+	conv.ratesTime = time.Now()
+	return rates, nil
+}
+
+// ConvertUnit converts the quantity from one unit into another of the same kind.
+func ConvertUnit(quantity float64, fromName, toName string) (float64, error) {
+	from, fromExists := conversionUnits[strings.ToLower(fromName)]
+	to, toExists := conversionUnits[strings.ToLower(toName)]
+	if !fromExists || !toExists {
+		return 0, fmt.Errorf("unknown unit %s or %s", fromName, toName)
+	} else if from.kind != to.kind {
+		return 0, fmt.Errorf("cannot convert %s (%s) into %s (%s)", from.name, from.kind, to.name, to.kind)
+	}
+	if from.kind != "temperature" {
+		return quantity * from.factor / to.factor, nil
+	}
+	// Convert the temperature into Celsius and then into the destination unit
+	celsius := quantity
+	switch from.name {
+	case "f":
+		celsius = (quantity - 32) * 5 / 9
+	case "k":
+		celsius = quantity - 273.15
+	}
+	switch to.name {
+	case "f":
+		return celsius*9/5 + 32, nil
+	case "k":
+		return celsius + 273.15, nil
+	}
+	return celsius, nil
+}
+
+// formatQuantity returns the quantity in a compact form with up to 4 significant digits for fractions.
+func formatQuantity(quantity float64) string {
+	if math.Abs(quantity) >= 1 || quantity == 0 {
+		return strconv.FormatFloat(math.Round(quantity*100)/100, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(quantity, 'g', 4, 64)
+}
+
+// parseConversion parses the amount and the names of units from the command content, the amount defaults to 1.
+func parseConversion(content string) (amount float64, from, to string, err error) {
+	fields := strings.Fields(content)
+	amount = 1
+	if len(fields) > 0 {
+		if parsed, parseErr := strconv.ParseFloat(strings.ReplaceAll(fields[0], ",", ""), 64); parseErr == nil {
+			amount = parsed
+			fields = fields[1:]
+		}
+	}
+	if len(fields) == 3 && (strings.EqualFold(fields[1], "to") || strings.EqualFold(fields[1], "in")) {
+		fields = []string{fields[0], fields[2]}
+	}
+	if len(fields) != 2 || math.IsNaN(amount) || math.IsInf(amount, 0) {
+		return 0, "", "", ErrBadConversionParam
+	}
+	return amount, fields[0], fields[1], nil
+}
+
+func (conv *Conversion) Execute(ctx context.Context, cmd Command) *Result {
+	if errResult := cmd.Trim(); errResult != nil {
+		return &Result{Error: ErrBadConversionParam}
+	}
+	amount, from, to, err := parseConversion(cmd.Content)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	// The units of measurement take precedence over the currency codes of the same name (e.g. "cup")
+	_, fromIsUnit := conversionUnits[strings.ToLower(from)]
+	_, toIsUnit := conversionUnits[strings.ToLower(to)]
+	if fromIsUnit || toIsUnit {
+		converted, err := ConvertUnit(amount, from, to)
+		if err != nil {
+			return &Result{Error: err}
+		}
+		return &Result{Output: fmt.Sprintf("%s %s = %s %s", formatQuantity(amount), strings.ToLower(from), formatQuantity(converted), strings.ToLower(to))}
+	}
+	if !RegexCurrencyCode.MatchString(from) || !RegexCurrencyCode.MatchString(to) {
+		return &Result{Error: ErrBadConversionParam}
+	}
+	rates, err := conv.getRates(ctx, cmd.TimeoutSec, false)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+	fromRate, fromExists := rates[from]
+	toRate, toExists := rates[to]
+	if !fromExists {
+		return &Result{Error: fmt.Errorf("exchange rate of %s is unavailable", from)}
+	} else if !toExists {
+		return &Result{Error: fmt.Errorf("exchange rate of %s is unavailable", to)}
+	}
+	return &Result{Output: fmt.Sprintf("%.2f %s = %.2f %s (1 %s = %s %s)", amount, from, amount/fromRate*toRate, to, from, formatQuantity(toRate/fromRate), to)}
+}
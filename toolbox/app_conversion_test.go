@@ -0,0 +1,75 @@
+package toolbox
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConversion(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/frankfurter" {
+			_, _ = w.Write([]byte(`{"amount": 1.0, "base": "EUR", "date": "2024-06-01", "rates": {"USD": 1.1}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"result": "success", "base_code": "USD", "rates": {"USD": 1, "EUR": 0.9, "JPY": 150, "BAD": 0}}`))
+	}))
+	defer server.Close()
+
+	conv := Conversion{RatesURL: server.URL + "/er-api"}
+	require.True(t, conv.IsConfigured())
+	require.NoError(t, conv.Initialise())
+	require.Equal(t, ConversionDefaultRatesCacheSec, conv.RatesCacheSec)
+	require.NoError(t, conv.SelfTest())
+	run := func(content string) *Result {
+		return conv.Execute(context.Background(), Command{TimeoutSec: 10, Content: content})
+	}
+
+	// Currency conversion uses the cached rates
+	for content, expected := range map[string]string{
+		"100 usd eur":      "100.00 USD = 90.00 EUR (1 USD = 0.9 EUR)",
+		"EUR to JPY":       "1.00 EUR = 166.67 JPY (1 EUR = 166.67 JPY)",
+		"1,000 jpy in usd": "1000.00 JPY = 6.67 USD (1 JPY = 0.006667 USD)",
+	} {
+		result := run(content)
+		require.NoError(t, result.Error, content)
+		require.Equal(t, expected, result.Output, content)
+	}
+	require.EqualValues(t, 1, requests.Load())
+	require.ErrorContains(t, run("1 usd xyz").Error, "exchange rate of XYZ is unavailable")
+	require.ErrorContains(t, run("1 bad usd").Error, "exchange rate of BAD is unavailable")
+
+	// Unit conversion does not need the rates
+	for content, expected := range map[string]string{
+		"5 km mi":       "5 km = 3.11 mi",
+		"30 c to f":     "30 c = 86 f",
+		"-40 F C":       "-40 f = -40 c",
+		"0 c k":         "0 c = 273.15 k",
+		"1 in in cm":    "1 in = 2.54 cm",
+		"100 kmh mph":   "100 kmh = 62.14 mph",
+		"cup ml":        "1 cup = 236.59 ml",
+		"2 acres ha":    "2 acres = 0.8094 ha",
+		"1 pound grams": "1 pound = 453.59 grams",
+	} {
+		result := run(content)
+		require.NoError(t, result.Error, content)
+		require.Equal(t, expected, result.Output, content)
+	}
+	require.ErrorContains(t, run("1 km kg").Error, "cannot convert km (length) into kg (mass)")
+	for _, content := range []string{"", "hello", "1 2 3 4", "1 usd to", "1 dollars euros"} {
+		require.ErrorIs(t, run(content).Error, ErrBadConversionParam, content)
+	}
+
+	// The base currency is added to the rates if the API leaves it out
+	conv = Conversion{RatesURL: server.URL + "/frankfurter"}
+	require.NoError(t, conv.Initialise())
+	result := run("10 eur usd")
+	require.NoError(t, result.Error)
+	require.Equal(t, "10.00 EUR = 11.00 USD (1 EUR = 1.1 USD)", result.Output)
+}
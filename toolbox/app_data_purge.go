@@ -0,0 +1,69 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// DataPurgeTrigger is the trigger prefix string of DataPurge feature.
+	DataPurgeTrigger = ".purge"
+	// RetentionStoreMessageBank is the name of the message bank in data retention configuration.
+	RetentionStoreMessageBank = "MessageBank"
+	// RetentionStoreSubjectReports is the name of the store&forward message processor reports in data retention configuration.
+	RetentionStoreSubjectReports = "SubjectReports"
+)
+
+/*
+DataPurge wipes the data related to a client identifier (e.g. IP address, phone number, or host name) from all data stores
+of the program, such as the latest HTTP requests, message bank, subject reports, and log buffers.
+*/
+type DataPurge struct {
+	// Retention is the data retention manager that knows about the data stores, it defaults to misc.DefaultDataRetention.
+	Retention *misc.DataRetention `json:"-"`
+}
+
+// IsConfigured always returns true because configuration is not required for this feature.
+func (purge *DataPurge) IsConfigured() bool {
+	return true
+}
+
+// SelfTest always returns nil.
+func (purge *DataPurge) SelfTest() error {
+	return nil
+}
+
+// Initialise uses the default data retention manager if none was given.
+func (purge *DataPurge) Initialise() error {
+	if purge.Retention == nil {
+		purge.Retention = misc.DefaultDataRetention
+	}
+	return nil
+}
+
+// Trigger returns the trigger prefix string ".purge".
+func (purge *DataPurge) Trigger() Trigger {
+	return DataPurgeTrigger
+}
+
+// Execute wipes the data related to the client identifier given in the command, and responds with the number of records removed.
+func (purge *DataPurge) Execute(ctx context.Context, cmd Command) *Result {
+	if errResult := cmd.Trim(); errResult != nil {
+		return &Result{Error: fmt.Errorf("%s client-ID (known stores: %s)", DataPurgeTrigger, strings.Join(purge.Retention.GetStoreNames(), ", "))}
+	}
+	clientID := cmd.Content
+	if len(clientID) < 3 {
+		// Avoid wiping nearly everything with a very short identifier that matches too much data.
+		return &Result{Error: errors.New("client ID must be at least 3 characters long")}
+	}
+	removed := purge.Retention.Purge(clientID)
+	var out strings.Builder
+	for _, name := range purge.Retention.GetStoreNames() {
+		out.WriteString(fmt.Sprintf("%s: %d\n", name, removed[name]))
+	}
+	return &Result{Output: out.String()}
+}
@@ -0,0 +1,68 @@
+package toolbox
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataPurge_Execute(t *testing.T) {
+	bank := &MessageBank{}
+	require.NoError(t, bank.Initialise())
+	require.NoError(t, bank.Store(MessageBankTagDefault, MessageDirectionIncoming, time.Now(), "hello from +123456789"))
+	require.NoError(t, bank.Store(MessageBankTagDefault, MessageDirectionIncoming, time.Now().Add(-time.Hour), "hello from +987654321"))
+
+	retention := misc.NewDataRetention()
+	retention.Register(misc.RetainedData{Name: RetentionStoreMessageBank, PurgeClient: bank.PurgeClient, ExpireBefore: bank.ExpireBefore})
+	purge := &DataPurge{Retention: retention}
+	require.True(t, purge.IsConfigured())
+	require.NoError(t, purge.Initialise())
+	require.NoError(t, purge.SelfTest())
+
+	result := purge.Execute(context.Background(), Command{Content: ""})
+	require.Error(t, result.Error)
+	require.Contains(t, result.Error.Error(), RetentionStoreMessageBank)
+	result = purge.Execute(context.Background(), Command{Content: "+1"})
+	require.Error(t, result.Error)
+
+	result = purge.Execute(context.Background(), Command{Content: "+123456789"})
+	require.NoError(t, result.Error)
+	require.Contains(t, result.Output, RetentionStoreMessageBank+": 1\n")
+	messages := bank.Get(MessageBankTagDefault, MessageDirectionIncoming)
+	require.Len(t, messages, 1)
+	require.Equal(t, "hello from +987654321", messages[0].Content)
+
+	// Expire the remaining message that is an hour old.
+	require.Error(t, retention.SetMaxAgeSec(map[string]int{RetentionStoreMessageBank: 0}))
+	require.NoError(t, retention.SetMaxAgeSec(map[string]int{RetentionStoreMessageBank: 60}))
+	require.Equal(t, map[string]int{RetentionStoreMessageBank: 1}, retention.Expire(time.Now()))
+	require.Empty(t, bank.Get(MessageBankTagDefault, MessageDirectionIncoming))
+}
+
+func TestMessageProcessor_PurgeClient(t *testing.T) {
+	proc := &MessageProcessor{}
+	require.NoError(t, proc.Initialise())
+	proc.StoreReport(context.Background(), SubjectReportRequest{SubjectHostName: "host-a"}, "1.1.1.1", "test")
+	proc.StoreReport(context.Background(), SubjectReportRequest{SubjectHostName: "host-b"}, "2.2.2.2", "test")
+	proc.SetOutgoingCommand("host-a", ".s echo hi")
+
+	require.Equal(t, 1, proc.PurgeClient("HOST-A"))
+	require.Empty(t, proc.GetLatestReportsFromSubject("host-a", 10))
+	require.Empty(t, proc.GetAllOutgoingCommands())
+	require.False(t, proc.HasClientTag("1.1.1.1"))
+
+	require.Equal(t, 1, proc.PurgeClient("2.2.2.2"))
+	require.Empty(t, proc.GetSubjectReportCount())
+	require.Zero(t, proc.ExpireBefore(time.Now()))
+}
+
+func TestCommandProcessor_LongestTrigger(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	result := proc.Process(context.Background(), Command{TimeoutSec: 10, Content: TestCommandProcessorPIN + DataPurgeTrigger + " nobody-in-particular"}, true)
+	require.NoError(t, result.Error)
+	require.True(t, strings.Contains(result.Output, misc.RetentionStoreLogs+": "), result.Output)
+}
@@ -0,0 +1,101 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DNSAllowTrigger is the trigger prefix string of DNSAllow feature.
+	DNSAllowTrigger = ".da"
+	// DefaultDNSAllowMinutes is the number of minutes a black listed name is allowed for when the command does not specify.
+	DefaultDNSAllowMinutes = 15
+)
+
+var (
+	DNSAllowRegex = regexp.MustCompile(`^([\w.-]+)(?:\s+(\d+))?$`)
+
+	ErrDNSAllowNotConfigured = errors.New("DNS black list is not available")
+)
+
+// DNSBlacklistExemptions temporarily exempts black listed names from the DNS black list.
+type DNSBlacklistExemptions interface {
+	// AllowTemporarily exempts a black listed name and its sub-domain names from the black list for the duration.
+	AllowTemporarily(name string, duration time.Duration) error
+}
+
+/*
+DNSAllow temporarily allows a name black listed by the DNS server, e.g. an advertisement domain that a web page of
+interest depends on. The exemption expires on its own.
+*/
+type DNSAllow struct {
+	exemptions DNSBlacklistExemptions
+	mutex      *sync.Mutex
+}
+
+// IsConfigured always returns true, though the command will not work until the black list is made available by SetBlacklist.
+func (allow *DNSAllow) IsConfigured() bool {
+	return true
+}
+
+// SelfTest always returns nil.
+func (allow *DNSAllow) SelfTest() error {
+	return nil
+}
+
+// Initialise prepares the internal states of the feature.
+func (allow *DNSAllow) Initialise() error {
+	if allow.mutex == nil {
+		allow.mutex = new(sync.Mutex)
+	}
+	return nil
+}
+
+// Trigger returns the trigger prefix string ".da".
+func (allow *DNSAllow) Trigger() Trigger {
+	return DNSAllowTrigger
+}
+
+// SetBlacklist gives the feature the DNS black list to exempt names from.
+func (allow *DNSAllow) SetBlacklist(exemptions DNSBlacklistExemptions) {
+	if allow.mutex == nil {
+		allow.mutex = new(sync.Mutex)
+	}
+	allow.mutex.Lock()
+	defer allow.mutex.Unlock()
+	allow.exemptions = exemptions
+}
+
+func (allow *DNSAllow) getBlacklist() DNSBlacklistExemptions {
+	allow.mutex.Lock()
+	defer allow.mutex.Unlock()
+	return allow.exemptions
+}
+
+// Execute temporarily allows the black listed name for the number of minutes.
+func (allow *DNSAllow) Execute(ctx context.Context, cmd Command) *Result {
+	if errResult := cmd.Trim(); errResult != nil {
+		return errResult
+	}
+	exemptions := allow.getBlacklist()
+	if exemptions == nil {
+		return &Result{Error: ErrDNSAllowNotConfigured}
+	}
+	params := DNSAllowRegex.FindStringSubmatch(cmd.Content)
+	if len(params) != 3 {
+		return &Result{Error: errors.New("name [minutes]")}
+	}
+	minutes := DefaultDNSAllowMinutes
+	if params[2] != "" {
+		minutes, _ = strconv.Atoi(params[2])
+	}
+	if err := exemptions.AllowTemporarily(params[1], time.Duration(minutes)*time.Minute); err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: fmt.Sprintf("allowed %s for %d minutes", params[1], minutes)}
+}
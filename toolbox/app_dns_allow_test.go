@@ -0,0 +1,39 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type dummyDNSBlacklistExemptions struct {
+	allowed map[string]time.Duration
+}
+
+func (dummy *dummyDNSBlacklistExemptions) AllowTemporarily(name string, duration time.Duration) error {
+	if name == "example.com" {
+		return errors.New("not black listed")
+	}
+	dummy.allowed[name] = duration
+	return nil
+}
+
+func TestDNSAllow_Execute(t *testing.T) {
+	allow := &DNSAllow{}
+	require.True(t, allow.IsConfigured())
+	require.NoError(t, allow.Initialise())
+	require.NoError(t, allow.SelfTest())
+	require.Equal(t, ErrDNSAllowNotConfigured, allow.Execute(context.Background(), Command{Content: "ads.example.com"}).Error)
+
+	dummy := &dummyDNSBlacklistExemptions{allowed: make(map[string]time.Duration)}
+	allow.SetBlacklist(dummy)
+	require.Error(t, allow.Execute(context.Background(), Command{Content: ""}).Error)
+	require.Error(t, allow.Execute(context.Background(), Command{Content: "ads.example.com abc"}).Error)
+	require.EqualError(t, allow.Execute(context.Background(), Command{Content: "example.com"}).Error, "not black listed")
+	require.Equal(t, &Result{Output: "allowed ads.example.com for 15 minutes"}, allow.Execute(context.Background(), Command{Content: " ads.example.com "}))
+	require.Equal(t, &Result{Output: "allowed t.example.com for 60 minutes"}, allow.Execute(context.Background(), Command{Content: "t.example.com 60"}))
+	require.Equal(t, map[string]time.Duration{"ads.example.com": 15 * time.Minute, "t.example.com": time.Hour}, dummy.allowed)
+}
@@ -5,6 +5,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"os"
+	"regexp"
 	"runtime"
 	"runtime/pprof"
 	"strconv"
@@ -15,10 +17,17 @@ import (
 	"github.com/HouzuoGuo/laitos/platform"
 )
 
-var ErrBadEnvInfoChoice = errors.New(`lock | stop | kill | log | warn | runtime | stack | tune`)
+var ErrBadEnvInfoChoice = errors.New(`lock | stop | kill | maint [on|off] | flag [NAME on|off] | profile [NAME] | log | warn | runtime | stack | tune | getenv NAME | [dry] setenv NAME VALUE | [dry] unsetenv NAME`)
+
+// RegexEnvVarName matches a valid environment variable name.
+var RegexEnvVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
 
 // Retrieve environment information and trigger emergency stop upon request.
 type EnvControl struct {
+	// ModifiableEnvVars are the names of program environment variables that may be inspected and modified via the app.
+	ModifiableEnvVars []string `json:"ModifiableEnvVars"`
+
+	logger *lalog.Logger
 }
 
 func (info *EnvControl) IsConfigured() bool {
@@ -30,6 +39,12 @@ func (info *EnvControl) SelfTest() error {
 }
 
 func (info *EnvControl) Initialise() error {
+	info.logger = &lalog.Logger{ComponentName: "EnvControl"}
+	for _, name := range info.ModifiableEnvVars {
+		if !RegexEnvVarName.MatchString(name) {
+			return fmt.Errorf("EnvControl.Initialise: \"%s\" is not a valid environment variable name", name)
+		}
+	}
 	return nil
 }
 
@@ -41,6 +56,16 @@ func (info *EnvControl) Execute(ctx context.Context, cmd Command) *Result {
 	if errResult := cmd.Trim(); errResult != nil {
 		return errResult
 	}
+	if verb, param := splitFirstWord(cmd.Content); strings.ToLower(verb) == "maint" {
+		return info.controlMaintenanceMode(cmd, param)
+	} else if strings.ToLower(verb) == "flag" {
+		return info.controlFeatureFlag(cmd, param)
+	} else if strings.ToLower(verb) == "profile" {
+		return info.controlConfigProfile(cmd, param)
+	}
+	if fields := strings.Fields(cmd.Content); len(fields) > 1 {
+		return info.controlEnvVar(cmd)
+	}
 	switch strings.ToLower(cmd.Content) {
 	case "lock":
 		misc.TriggerEmergencyLockDown()
@@ -67,6 +92,194 @@ func (info *EnvControl) Execute(ctx context.Context, cmd Command) *Result {
 	}
 }
 
+// controlMaintenanceMode turns the maintenance mode of web servers on or off, or tells whether it is in effect.
+func (info *EnvControl) controlMaintenanceMode(cmd Command, param string) *Result {
+	switch strings.ToLower(param) {
+	case "":
+		return &Result{Output: fmt.Sprintf("maintenance mode is on? %v", misc.IsMaintenanceMode())}
+	case "on", "off":
+		on := strings.ToLower(param) == "on"
+		info.logger.Warning(fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientTag), nil, "turning maintenance mode on? %v", on)
+		misc.SetMaintenanceMode(on)
+		return &Result{Output: "OK - maintenance mode " + strings.ToLower(param)}
+	default:
+		return &Result{Error: ErrBadEnvInfoChoice}
+	}
+}
+
+// controlFeatureFlag lists the feature flags, or turns a live feature flag on or off.
+func (info *EnvControl) controlFeatureFlag(cmd Command, param string) *Result {
+	name, value := splitFirstWord(param)
+	if name == "" {
+		var out strings.Builder
+		for _, flag := range misc.FeatureFlags.GetAll() {
+			state, kind := "off", "startup"
+			if flag.IsEnabled() {
+				state = "on"
+			}
+			if flag.Live {
+				kind = "live"
+			}
+			out.WriteString(fmt.Sprintf("%s=%s (%s) - %s\n", flag.Name, state, kind, flag.Description))
+		}
+		return &Result{Output: out.String()}
+	}
+	value = strings.ToLower(value)
+	if value != "on" && value != "off" {
+		return &Result{Error: ErrBadEnvInfoChoice}
+	}
+	on := value == "on"
+	if err := misc.FeatureFlags.Toggle(name, on); err != nil {
+		return &Result{Error: err}
+	}
+	info.logger.Warning(fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientTag), nil, "turning feature flag %s on? %v", name, on)
+	return &Result{Output: fmt.Sprintf("OK - feature flag %s %s", name, value)}
+}
+
+/*
+controlConfigProfile lists the configuration profiles, or switches the running program to another profile, which restarts
+the daemons affected by the change.
+*/
+func (info *EnvControl) controlConfigProfile(cmd Command, name string) *Result {
+	profileSwitch, err := misc.GetConfigProfileSwitch()
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if name == "" {
+		active, all := profileSwitch.GetProfiles()
+		return &Result{Output: fmt.Sprintf("active profile is %s, available profiles are: %s", active, strings.Join(append([]string{misc.BaseConfigProfile}, all...), ", "))}
+	}
+	info.logger.Warning(fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientTag), nil, "switching to configuration profile %s", name)
+	restarted, err := profileSwitch.SwitchTo(name)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: fmt.Sprintf("OK - profile %s, restarted daemons: %s", name, strings.Join(restarted, ", "))}
+}
+
+/*
+controlEnvVar inspects or modifies a program environment variable of the allowed names. A modification may be
+previewed (dry run) without being carried out, and every modification is logged for audit.
+*/
+func (info *EnvControl) controlEnvVar(cmd Command) *Result {
+	content := cmd.Content
+	dryRun := false
+	if verb, rest := splitFirstWord(content); strings.ToLower(verb) == "dry" {
+		dryRun = true
+		content = rest
+	}
+	verb, rest := splitFirstWord(content)
+	name, value := splitFirstWord(rest)
+	verb = strings.ToLower(verb)
+	switch {
+	case verb == "getenv" && value == "" && !dryRun:
+	case verb == "setenv" && value != "":
+	case verb == "unsetenv" && value == "":
+	default:
+		return &Result{Error: ErrBadEnvInfoChoice}
+	}
+	if !info.isModifiable(name) {
+		return &Result{Error: fmt.Errorf("environment variable \"%s\" is not among the modifiable ones - %v", name, info.ModifiableEnvVars)}
+	}
+	oldValue, oldExists := os.LookupEnv(name)
+	if verb == "getenv" {
+		if !oldExists {
+			return &Result{Output: name + " is not set"}
+		}
+		return &Result{Output: fmt.Sprintf("%s=%s", name, oldValue)}
+	}
+	if strings.ContainsRune(value, 0) {
+		return &Result{Error: errors.New("the value must not contain NUL character")}
+	}
+	newExists := verb == "setenv"
+	effect := DescribeEnvVarChange(name, oldValue, oldExists, value, newExists)
+	if dryRun {
+		return &Result{Output: "Dry run, nothing is changed. " + effect}
+	}
+	var err error
+	if newExists {
+		err = os.Setenv(name, value)
+	} else {
+		err = os.Unsetenv(name)
+	}
+	auditOld, auditNew := oldValue, value
+	if platform.IsSensitiveEnvName(name) {
+		auditOld, auditNew = "REDACTED", "REDACTED"
+	}
+	actor := fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientTag)
+	if err != nil {
+		info.logger.Warning(actor, err, "failed to %s %s (old value %q, new value %q)", verb, name, auditOld, auditNew)
+		return &Result{Error: err}
+	}
+	info.logger.Warning(actor, nil, "did %s %s (old value %q, existed? %v; new value %q, exists? %v)", verb, name, auditOld, oldExists, auditNew, newExists)
+	return &Result{Output: "OK - " + effect}
+}
+
+// isModifiable returns true if the environment variable is among the modifiable ones.
+func (info *EnvControl) isModifiable(name string) bool {
+	for _, allowed := range info.ModifiableEnvVars {
+		if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// splitFirstWord returns the first word of the text and the remainder with leading spaces removed.
+func splitFirstWord(text string) (string, string) {
+	text = strings.TrimSpace(text)
+	if space := strings.IndexAny(text, " \t"); space != -1 {
+		return text[:space], strings.TrimSpace(text[space+1:])
+	}
+	return text, ""
+}
+
+/*
+DescribeEnvVarChange returns a human-readable description of the effect of changing an environment variable. The
+entries of a path list, such as PATH, are compared individually, and a warning is given if the variable becomes empty.
+*/
+func DescribeEnvVarChange(name, oldValue string, oldExists bool, newValue string, newExists bool) string {
+	var desc strings.Builder
+	describe := func(value string, exists bool) string {
+		if !exists {
+			return "(unset)"
+		}
+		if platform.IsSensitiveEnvName(name) {
+			return fmt.Sprintf("(%d characters)", len(value))
+		}
+		return strconv.Quote(value)
+	}
+	desc.WriteString(fmt.Sprintf("%s: %s -> %s.", name, describe(oldValue, oldExists), describe(newValue, newExists)))
+	separator := string(os.PathListSeparator)
+	if oldExists && newExists && (strings.Contains(oldValue, separator) || strings.Contains(newValue, separator)) {
+		oldEntries, newEntries := strings.Split(oldValue, separator), strings.Split(newValue, separator)
+		if removed := subtractStrings(oldEntries, newEntries); len(removed) > 0 {
+			desc.WriteString(fmt.Sprintf(" Removes entries %v.", removed))
+		}
+		if added := subtractStrings(newEntries, oldEntries); len(added) > 0 {
+			desc.WriteString(fmt.Sprintf(" Adds entries %v.", added))
+		}
+	}
+	if oldExists && oldValue != "" && (!newExists || newValue == "") {
+		desc.WriteString(fmt.Sprintf(" WARNING: %s becomes empty.", name))
+	}
+	return desc.String()
+}
+
+// subtractStrings returns the elements of a that are not present in b.
+func subtractStrings(a, b []string) (ret []string) {
+	present := make(map[string]struct{}, len(b))
+	for _, elem := range b {
+		present[elem] = struct{}{}
+	}
+	for _, elem := range a {
+		if _, exists := present[elem]; !exists {
+			ret = append(ret, elem)
+		}
+	}
+	return
+}
+
 // Return latest log entry of all kinds in a multi-line text, one log entry per line. Latest log entry comes first.
 func GetLatestLog() string {
 	buf := new(bytes.Buffer)
@@ -3,6 +3,7 @@ package toolbox
 import (
 	"context"
 	"fmt"
+	"os"
 	"strings"
 	"testing"
 
@@ -55,4 +56,108 @@ func TestEnvControl_Execute(t *testing.T) {
 		t.Fatal("did not lockdown")
 	}
 	misc.EmergencyLockDown = false
+	// Test maintenance mode
+	if ret := info.Execute(context.Background(), Command{Content: "maint on"}); ret.Error != nil || !misc.IsMaintenanceMode() {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "maint"}); ret.Error != nil || ret.Output != "maintenance mode is on? true" {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "maint off"}); ret.Error != nil || misc.IsMaintenanceMode() {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "maint bad"}); ret.Error != ErrBadEnvInfoChoice {
+		t.Fatal(ret)
+	}
+	// Test feature flags
+	if ret := info.Execute(context.Background(), Command{Content: "flag"}); ret.Error != nil || !strings.Contains(ret.Output, "Debug=off (live)") || !strings.Contains(ret.Output, "AWSIntegration=off (startup)") {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "flag Debug on"}); ret.Error != nil || !misc.Debug.IsEnabled() {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "flag Debug OFF"}); ret.Error != nil || misc.Debug.IsEnabled() {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "flag AWSIntegration on"}); ret.Error != misc.ErrFlagNotLive || misc.AWSIntegration.IsEnabled() {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "flag DoesNotExist on"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "flag Debug bad"}); ret.Error != ErrBadEnvInfoChoice {
+		t.Fatal(ret)
+	}
+
+	// Test configuration profiles
+	if ret := info.Execute(context.Background(), Command{Content: "profile"}); ret.Error != misc.ErrConfigProfileUnavailable {
+		t.Fatal(ret)
+	}
+	var switchedTo string
+	misc.SetConfigProfileSwitch(&misc.ConfigProfileSwitch{
+		GetProfiles: func() (string, []string) { return "home", []string{"home", "travel"} },
+		SwitchTo: func(name string) ([]string, error) {
+			switchedTo = name
+			return []string{"httpd"}, nil
+		},
+	})
+	defer misc.SetConfigProfileSwitch(nil)
+	if ret := info.Execute(context.Background(), Command{Content: "profile"}); ret.Error != nil || ret.Output != "active profile is home, available profiles are: base, home, travel" {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "profile travel"}); ret.Error != nil || ret.Output != "OK - profile travel, restarted daemons: httpd" || switchedTo != "travel" {
+		t.Fatal(ret)
+	}
+}
+
+func TestEnvControl_EnvVars(t *testing.T) {
+	info := EnvControl{ModifiableEnvVars: []string{"LAITOS_TEST_ENV_PATH"}}
+	if err := info.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&EnvControl{ModifiableEnvVars: []string{"bad name"}}).Initialise(); err == nil {
+		t.Fatal("did not reject bad name")
+	}
+	t.Setenv("LAITOS_TEST_ENV_PATH", "/a:/b")
+	// Variables outside of the allowed ones are untouchable
+	if ret := info.Execute(context.Background(), Command{Content: "getenv PATH"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "unsetenv PATH"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "getenv LAITOS_TEST_ENV_PATH"}); ret.Error != nil || ret.Output != "LAITOS_TEST_ENV_PATH=/a:/b" {
+		t.Fatal(ret)
+	}
+	// Dry run describes the effect without changing the variable
+	ret := info.Execute(context.Background(), Command{Content: "dry setenv LAITOS_TEST_ENV_PATH /b:/c d"})
+	if ret.Error != nil || !strings.Contains(ret.Output, "Dry run") || !strings.Contains(ret.Output, "Removes entries [/a]") || !strings.Contains(ret.Output, "Adds entries [/c d]") {
+		t.Fatal(ret)
+	}
+	if os.Getenv("LAITOS_TEST_ENV_PATH") != "/a:/b" {
+		t.Fatal("dry run changed the variable")
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "dry unsetenv LAITOS_TEST_ENV_PATH"}); ret.Error != nil || !strings.Contains(ret.Output, "WARNING") {
+		t.Fatal(ret)
+	}
+	// Modify the variable for real
+	if ret := info.Execute(context.Background(), Command{Content: "setenv LAITOS_TEST_ENV_PATH /b:/c d"}); ret.Error != nil || !strings.HasPrefix(ret.Output, "OK") {
+		t.Fatal(ret)
+	}
+	if os.Getenv("LAITOS_TEST_ENV_PATH") != "/b:/c d" {
+		t.Fatal(os.Getenv("LAITOS_TEST_ENV_PATH"))
+	}
+	if !strings.Contains(GetLatestWarnings(), "did setenv LAITOS_TEST_ENV_PATH") {
+		t.Fatal("missing audit log")
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "unsetenv LAITOS_TEST_ENV_PATH"}); ret.Error != nil {
+		t.Fatal(ret)
+	}
+	if _, exists := os.LookupEnv("LAITOS_TEST_ENV_PATH"); exists {
+		t.Fatal("did not unset")
+	}
+	// Values of sensitive variables are not revealed in the description
+	if desc := DescribeEnvVarChange("API_TOKEN", "abc", true, "defg", true); desc != "API_TOKEN: (3 characters) -> (4 characters)." {
+		t.Fatal(desc)
+	}
 }
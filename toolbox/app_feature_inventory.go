@@ -0,0 +1,142 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FeatureInventoryTrigger is the trigger prefix string of FeatureInventory feature.
+const FeatureInventoryTrigger = ".features"
+
+// FeatureUsage counts the invocations of an app since the program started.
+type FeatureUsage struct {
+	// Count is the number of times the app has been invoked.
+	Count int
+	// Errors is the number of invocations that resulted in an error.
+	Errors int
+	// LastUsed is the time of the latest invocation.
+	LastUsed time.Time
+}
+
+/*
+FeatureInventory lists the enabled apps along with their self test result and usage since the program started, which
+helps to spot broken integrations (e.g. an expired API key) and the ones that are no longer used.
+*/
+type FeatureInventory struct {
+	// features is the set of apps to inventory, it is assigned by FeatureSet.Initialise.
+	features *FeatureSet
+}
+
+// IsConfigured always returns true because configuration is not required for this feature.
+func (inv *FeatureInventory) IsConfigured() bool {
+	return true
+}
+
+// SelfTest always returns nil.
+func (inv *FeatureInventory) SelfTest() error {
+	return nil
+}
+
+// Initialise does nothing.
+func (inv *FeatureInventory) Initialise() error {
+	return nil
+}
+
+// Trigger returns the trigger prefix string ".features".
+func (inv *FeatureInventory) Trigger() Trigger {
+	return FeatureInventoryTrigger
+}
+
+// Execute runs the self test of all enabled apps in parallel, and responds with a line of health and usage for each app.
+func (inv *FeatureInventory) Execute(ctx context.Context, cmd Command) *Result {
+	if inv.features == nil {
+		return &Result{Error: ErrIncompleteConfig}
+	}
+	triggers := inv.features.GetTriggers()
+	selfTestErrs := make([]error, len(triggers))
+	mutex := new(sync.Mutex)
+	wait := new(sync.WaitGroup)
+	for i, trigger := range triggers {
+		// The self tests that do not complete before the command times out are reported as such.
+		selfTestErrs[i] = errors.New("self test did not complete in time")
+		app := inv.features.LookupByTrigger[Trigger(trigger)]
+		if app == Feature(inv) {
+			selfTestErrs[i] = nil
+			continue
+		}
+		wait.Add(1)
+		go func(i int, app Feature) {
+			defer wait.Done()
+			err := app.SelfTest()
+			mutex.Lock()
+			selfTestErrs[i] = err
+			mutex.Unlock()
+		}(i, app)
+	}
+	allDone := make(chan struct{})
+	go func() {
+		wait.Wait()
+		close(allDone)
+	}()
+	select {
+	case <-allDone:
+	case <-ctx.Done():
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	lines := make([]string, 0, len(triggers))
+	for i, trigger := range triggers {
+		var line strings.Builder
+		line.WriteString(fmt.Sprintf("%s %s: ", trigger, reflect.TypeOf(inv.features.LookupByTrigger[Trigger(trigger)]).Elem().Name()))
+		if selfTestErrs[i] == nil {
+			line.WriteString("OK")
+		} else {
+			line.WriteString(fmt.Sprintf("FAIL (%v)", selfTestErrs[i]))
+		}
+		usage := inv.features.GetUsage(Trigger(trigger))
+		if usage.Count == 0 {
+			line.WriteString(", never used")
+		} else {
+			line.WriteString(fmt.Sprintf(", used %d times (%d errors), last %s ago", usage.Count, usage.Errors, time.Since(usage.LastUsed).Truncate(time.Second)))
+		}
+		lines = append(lines, line.String())
+	}
+	return &Result{Output: strings.Join(lines, "\n")}
+}
+
+// RecordUsage counts an invocation of the app.
+func (fs *FeatureSet) RecordUsage(trigger Trigger, err error) {
+	if fs.usageMutex == nil {
+		return
+	}
+	fs.usageMutex.Lock()
+	defer fs.usageMutex.Unlock()
+	usage, exists := fs.usage[trigger]
+	if !exists {
+		usage = &FeatureUsage{}
+		fs.usage[trigger] = usage
+	}
+	usage.Count++
+	if err != nil {
+		usage.Errors++
+	}
+	usage.LastUsed = time.Now()
+}
+
+// GetUsage returns the invocation counter of the app.
+func (fs *FeatureSet) GetUsage(trigger Trigger) FeatureUsage {
+	if fs.usageMutex == nil {
+		return FeatureUsage{}
+	}
+	fs.usageMutex.Lock()
+	defer fs.usageMutex.Unlock()
+	if usage, exists := fs.usage[trigger]; exists {
+		return *usage
+	}
+	return FeatureUsage{}
+}
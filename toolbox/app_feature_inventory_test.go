@@ -0,0 +1,34 @@
+package toolbox
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeatureInventory_Execute(t *testing.T) {
+	require.NotNil(t, (&FeatureInventory{}).Execute(context.Background(), Command{}).Error)
+
+	features := &FeatureSet{Shell: Shell{Unrestricted: true}, TwoFACodeGenerator: GetTestTwoFACodeGenerator()}
+	require.NoError(t, features.Initialise())
+	proc := &CommandProcessor{
+		Features:       features,
+		CommandFilters: []CommandFilter{&PINAndShortcuts{Passwords: []string{TestCommandProcessorPIN}}},
+		ResultFilters:  []ResultFilter{&LintText{MaxLength: 1000}},
+	}
+	proc.SetLogger(nil)
+	require.NoError(t, proc.Process(context.Background(), Command{TimeoutSec: 10, Content: TestCommandProcessorPIN + ".s echo hi"}, true).Error)
+	require.Error(t, proc.Process(context.Background(), Command{TimeoutSec: 10, Content: TestCommandProcessorPIN + ".s false"}, true).Error)
+	usage := features.GetUsage((&Shell{}).Trigger())
+	require.Equal(t, 2, usage.Count)
+	require.Equal(t, 1, usage.Errors)
+	require.False(t, usage.LastUsed.IsZero())
+
+	result := proc.Process(context.Background(), Command{TimeoutSec: 10, Content: TestCommandProcessorPIN + ".features"}, true)
+	require.NoError(t, result.Error)
+	require.Contains(t, result.Output, ".s Shell: OK, used 2 times (1 errors), last ")
+	require.Contains(t, result.Output, ".2 TwoFACodeGenerator: OK, never used")
+	require.Contains(t, result.Output, ".features FeatureInventory: OK, never used")
+	require.Equal(t, 1, features.GetUsage(FeatureInventoryTrigger).Count)
+}
@@ -0,0 +1,310 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// HomeAssistantTrigger is the trigger prefix string of HomeAssistant feature.
+	HomeAssistantTrigger = ".ha"
+	// HomeAssistantMaxListEntities is the maximum number of entities listed in a response, to keep the response short
+	// enough for SMS and satellite terminals.
+	HomeAssistantMaxListEntities = 50
+)
+
+var (
+	ErrBadHomeAssistantParam = errors.New(`example: get entity | list [domain] | on entity | off entity | call domain.service entity [key=value...]`)
+	// RegexHomeAssistantEntityID matches an entity ID, e.g. "climate.living_room".
+	RegexHomeAssistantEntityID = regexp.MustCompile(`^[a-z0-9_]+\.[a-z0-9_]+$`)
+	// homeAssistantShownAttributes are the entity state attributes displayed along with the state, in this order.
+	homeAssistantShownAttributes = []string{"current_temperature", "temperature", "hvac_action", "current_position", "brightness", "battery_level"}
+)
+
+// HomeAssistantState is the state of an entity returned by Home Assistant REST API.
+type HomeAssistantState struct {
+	EntityID    string                 `json:"entity_id"`
+	State       string                 `json:"state"`
+	Attributes  map[string]interface{} `json:"attributes"`
+	LastChanged time.Time              `json:"last_changed"`
+}
+
+// describe returns the state of the entity in a single line of text, e.g. "Front door (binary_sensor.front_door): on".
+func (state HomeAssistantState) describe() string {
+	var ret strings.Builder
+	if name, _ := state.Attributes["friendly_name"].(string); name != "" && name != state.EntityID {
+		ret.WriteString(fmt.Sprintf("%s (%s): %s", name, state.EntityID, state.State))
+	} else {
+		ret.WriteString(fmt.Sprintf("%s: %s", state.EntityID, state.State))
+	}
+	if unit, _ := state.Attributes["unit_of_measurement"].(string); unit != "" {
+		ret.WriteString(" " + unit)
+	}
+	for _, attr := range homeAssistantShownAttributes {
+		if value, exists := state.Attributes[attr]; exists && value != nil {
+			ret.WriteString(fmt.Sprintf(", %s %v", attr, value))
+		}
+	}
+	return ret.String()
+}
+
+/*
+HomeAssistant reads entity states and calls services of a Home Assistant instance via its REST API, which makes the
+channels of limited capacity such as SMS and satellite terminals a last-resort remote control of the smart home.
+*/
+type HomeAssistant struct {
+	// URL is the base URL of the Home Assistant instance, e.g. "http://homeassistant.local:8123".
+	URL string `json:"URL"`
+	// AccessToken is a long-lived access token created in the Home Assistant user profile.
+	AccessToken string `json:"AccessToken"`
+	// Aliases are the short names of entities that are easier to type on a phone keypad, e.g. "heat": "climate.living_room".
+	Aliases map[string]string `json:"Aliases"`
+	// AllowedServices are the services (e.g. "climate.set_temperature") that may be called via the app. If left empty,
+	// the app may call any service.
+	AllowedServices []string `json:"AllowedServices"`
+
+	logger *lalog.Logger
+}
+
+func (ha *HomeAssistant) IsConfigured() bool {
+	return ha.URL != "" && ha.AccessToken != ""
+}
+
+func (ha *HomeAssistant) SelfTest() error {
+	if !ha.IsConfigured() {
+		return ErrIncompleteConfig
+	}
+	resp, err := ha.request(context.Background(), SelfTestTimeoutSec, http.MethodGet, "/api/", nil)
+	if errResult := HTTPErrorToResult(resp, err); errResult != nil {
+		return fmt.Errorf("HomeAssistant.SelfTest: API test failed - %v", errResult.Error)
+	}
+	return nil
+}
+
+func (ha *HomeAssistant) Initialise() error {
+	ha.logger = &lalog.Logger{ComponentName: "HomeAssistant"}
+	ha.URL = strings.TrimRight(ha.URL, "/")
+	if !strings.HasPrefix(ha.URL, "http://") && !strings.HasPrefix(ha.URL, "https://") {
+		return fmt.Errorf("HomeAssistant.Initialise: URL \"%s\" must begin with http:// or https://", ha.URL)
+	}
+	for alias, entityID := range ha.Aliases {
+		if !RegexHomeAssistantEntityID.MatchString(entityID) {
+			return fmt.Errorf("HomeAssistant.Initialise: alias \"%s\" refers to an invalid entity ID \"%s\"", alias, entityID)
+		}
+	}
+	for _, service := range ha.AllowedServices {
+		if !RegexHomeAssistantEntityID.MatchString(service) {
+			return fmt.Errorf("HomeAssistant.Initialise: \"%s\" is not a valid service name such as switch.turn_on", service)
+		}
+	}
+	return nil
+}
+
+func (ha *HomeAssistant) Trigger() Trigger {
+	return HomeAssistantTrigger
+}
+
+// request makes an authorised request to Home Assistant REST API. Requests that carry a body are not retried.
+func (ha *HomeAssistant) request(ctx context.Context, timeoutSec int, method, path string, body []byte, pathValues ...interface{}) (inet.HTTPResponse, error) {
+	req := inet.HTTPRequest{
+		TimeoutSec: timeoutSec,
+		Method:     method,
+		Header:     http.Header{"Authorization": {"Bearer " + ha.AccessToken}},
+	}
+	if body != nil {
+		req.ContentType = "application/json"
+		req.Body = bytes.NewReader(body)
+		req.MaxRetry = 1
+	}
+	return inet.DoHTTP(ctx, req, strings.ReplaceAll(ha.URL, "%", "%%")+path, pathValues...)
+}
+
+// resolveEntity returns the entity ID of an alias (case insensitive), or the input itself if it is a valid entity ID.
+func (ha *HomeAssistant) resolveEntity(name string) (string, error) {
+	for alias, entityID := range ha.Aliases {
+		if strings.EqualFold(alias, name) {
+			return entityID, nil
+		}
+	}
+	if entityID := strings.ToLower(name); RegexHomeAssistantEntityID.MatchString(entityID) {
+		return entityID, nil
+	}
+	return "", fmt.Errorf("\"%s\" is neither an alias nor an entity ID such as switch.heater", name)
+}
+
+// GetState returns the state of an entity.
+func (ha *HomeAssistant) GetState(ctx context.Context, timeoutSec int, entityID string) (state HomeAssistantState, err error) {
+	resp, err := ha.request(ctx, timeoutSec, http.MethodGet, "/api/states/%s", nil, entityID)
+	if errResult := HTTPErrorToResult(resp, err); errResult != nil {
+		if resp.StatusCode == http.StatusNotFound {
+			return state, fmt.Errorf("entity %s does not exist", entityID)
+		}
+		return state, errResult.Error
+	}
+	err = json.Unmarshal(resp.Body, &state)
+	return
+}
+
+// ListStates returns the states of all entities, or those of the domain (e.g. "light") if it is specified, sorted by entity ID.
+func (ha *HomeAssistant) ListStates(ctx context.Context, timeoutSec int, domain string) ([]HomeAssistantState, error) {
+	resp, err := ha.request(ctx, timeoutSec, http.MethodGet, "/api/states", nil)
+	if errResult := HTTPErrorToResult(resp, err); errResult != nil {
+		return nil, errResult.Error
+	}
+	var states []HomeAssistantState
+	if err := json.Unmarshal(resp.Body, &states); err != nil {
+		return nil, err
+	}
+	ret := make([]HomeAssistantState, 0, len(states))
+	for _, state := range states {
+		if domain == "" || strings.HasPrefix(state.EntityID, domain+".") {
+			ret = append(ret, state)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].EntityID < ret[j].EntityID
+	})
+	return ret, nil
+}
+
+// CallService calls the service (e.g. "switch.turn_on") on an entity and returns the states that changed as a result.
+func (ha *HomeAssistant) CallService(ctx context.Context, timeoutSec int, service, entityID string, data map[string]interface{}) ([]HomeAssistantState, error) {
+	if len(ha.AllowedServices) > 0 && !slices.Contains(ha.AllowedServices, service) {
+		return nil, fmt.Errorf("service %s is not among the allowed: %s", service, strings.Join(ha.AllowedServices, ", "))
+	}
+	domain, serviceName, _ := strings.Cut(service, ".")
+	payload := map[string]interface{}{"entity_id": entityID}
+	for key, value := range data {
+		payload[key] = value
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	ha.logger.Info(entityID, nil, "calling service %s", service)
+	resp, err := ha.request(ctx, timeoutSec, http.MethodPost, "/api/services/%s/%s", body, domain, serviceName)
+	if errResult := HTTPErrorToResult(resp, err); errResult != nil {
+		return nil, errResult.Error
+	}
+	var changed []HomeAssistantState
+	if err := json.Unmarshal(resp.Body, &changed); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// parseServiceData converts key=value pairs into service data, the values that look like numbers and booleans are converted accordingly.
+func parseServiceData(pairs []string) (map[string]interface{}, error) {
+	ret := make(map[string]interface{})
+	for _, pair := range pairs {
+		key, value, found := strings.Cut(pair, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("\"%s\" must be in the form of key=value", pair)
+		}
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			ret[key] = number
+		} else if value == "true" || value == "false" {
+			ret[key] = value == "true"
+		} else {
+			ret[key] = value
+		}
+	}
+	return ret, nil
+}
+
+func (ha *HomeAssistant) Execute(ctx context.Context, cmd Command) *Result {
+	if errResult := cmd.Trim(); errResult != nil {
+		return &Result{Error: ErrBadHomeAssistantParam, Output: ha.describeAliases()}
+	}
+	params := strings.Fields(cmd.Content)
+	verb := strings.ToLower(params[0])
+	switch {
+	case verb == "list" && len(params) <= 2:
+		domain := ""
+		if len(params) == 2 {
+			domain = strings.ToLower(params[1])
+		}
+		states, err := ha.ListStates(ctx, cmd.TimeoutSec, domain)
+		if err != nil {
+			return &Result{Error: err}
+		}
+		var lines []string
+		for i, state := range states {
+			if i == HomeAssistantMaxListEntities {
+				lines = append(lines, fmt.Sprintf("(%d more)", len(states)-i))
+				break
+			}
+			lines = append(lines, state.EntityID+": "+state.State)
+		}
+		return &Result{Output: fmt.Sprintf("%d entities\n%s", len(states), strings.Join(lines, "\n"))}
+	case verb == "get" && len(params) == 2:
+		entityID, err := ha.resolveEntity(params[1])
+		if err != nil {
+			return &Result{Error: err}
+		}
+		state, err := ha.GetState(ctx, cmd.TimeoutSec, entityID)
+		if err != nil {
+			return &Result{Error: err}
+		}
+		return &Result{Output: fmt.Sprintf("%s, changed %s ago", state.describe(), time.Since(state.LastChanged).Round(time.Minute))}
+	case (verb == "on" || verb == "off") && len(params) == 2:
+		return ha.callAndDescribe(ctx, cmd, "homeassistant.turn_"+verb, params[1], nil)
+	case verb == "call" && len(params) >= 3:
+		if !RegexHomeAssistantEntityID.MatchString(params[1]) {
+			return &Result{Error: fmt.Errorf("\"%s\" is not a valid service name such as switch.turn_on", params[1])}
+		}
+		return ha.callAndDescribe(ctx, cmd, params[1], params[2], params[3:])
+	default:
+		return &Result{Error: ErrBadHomeAssistantParam}
+	}
+}
+
+// callAndDescribe calls the service on the entity and responds with the latest state of the entity.
+func (ha *HomeAssistant) callAndDescribe(ctx context.Context, cmd Command, service, entityName string, dataPairs []string) *Result {
+	entityID, err := ha.resolveEntity(entityName)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	data, err := parseServiceData(dataPairs)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	changed, err := ha.CallService(ctx, cmd.TimeoutSec, service, entityID, data)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	for _, state := range changed {
+		if state.EntityID == entityID {
+			return &Result{Output: state.describe()}
+		}
+	}
+	// The service call may not have changed the state immediately, e.g. when a thermostat is already heating.
+	state, err := ha.GetState(ctx, cmd.TimeoutSec, entityID)
+	if err != nil {
+		return &Result{Output: fmt.Sprintf("called %s, %d states changed", service, len(changed))}
+	}
+	return &Result{Output: state.describe()}
+}
+
+// describeAliases returns the aliases and their entity IDs, sorted by alias.
+func (ha *HomeAssistant) describeAliases() string {
+	aliases := make([]string, 0, len(ha.Aliases))
+	for alias, entityID := range ha.Aliases {
+		aliases = append(aliases, alias+"="+entityID)
+	}
+	sort.Strings(aliases)
+	return strings.Join(aliases, " ")
+}
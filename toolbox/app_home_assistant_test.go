@@ -0,0 +1,133 @@
+package toolbox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHomeAssistant(t *testing.T) {
+	changed := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	states := map[string]string{
+		"binary_sensor.front_door": `{"entity_id": "binary_sensor.front_door", "state": "off", "attributes": {"friendly_name": "Front door"}, "last_changed": "` + changed + `"}`,
+		"climate.living_room":      `{"entity_id": "climate.living_room", "state": "heat", "attributes": {"friendly_name": "Living room", "current_temperature": 19.5, "temperature": 21, "hvac_action": "heating"}, "last_changed": "` + changed + `"}`,
+		"sensor.outside":           `{"entity_id": "sensor.outside", "state": "4.2", "attributes": {"unit_of_measurement": "°C"}, "last_changed": "` + changed + `"}`,
+	}
+	var serviceCalls []string
+	var serviceCallsMutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer my-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/api/":
+			_, _ = w.Write([]byte(`{"message": "API running."}`))
+		case r.URL.Path == "/api/states":
+			_, _ = w.Write([]byte("[" + states["sensor.outside"] + "," + states["binary_sensor.front_door"] + "," + states["climate.living_room"] + "]"))
+		case strings.HasPrefix(r.URL.Path, "/api/states/"):
+			state, exists := states[strings.TrimPrefix(r.URL.Path, "/api/states/")]
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write([]byte(state))
+		case strings.HasPrefix(r.URL.Path, "/api/services/") && r.Method == http.MethodPost:
+			var data map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&data)
+			dataJSON, _ := json.Marshal(data)
+			serviceCallsMutex.Lock()
+			serviceCalls = append(serviceCalls, r.URL.Path+" "+string(dataJSON))
+			serviceCallsMutex.Unlock()
+			if data["entity_id"] == "climate.living_room" {
+				_, _ = w.Write([]byte("[" + states["climate.living_room"] + "]"))
+			} else {
+				_, _ = w.Write([]byte("[]"))
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ha := HomeAssistant{}
+	require.False(t, ha.IsConfigured())
+	ha = HomeAssistant{URL: "homeassistant.local", AccessToken: "my-token"}
+	require.True(t, ha.IsConfigured())
+	require.ErrorContains(t, ha.Initialise(), "http://")
+	ha.URL = server.URL + "/"
+	ha.Aliases = map[string]string{"heat": "Climate Living Room"}
+	require.ErrorContains(t, ha.Initialise(), "invalid entity ID")
+	ha.Aliases = map[string]string{"heat": "climate.living_room", "door": "binary_sensor.front_door"}
+	require.NoError(t, ha.Initialise())
+	require.NoError(t, ha.SelfTest())
+	badToken := ha
+	badToken.AccessToken = "wrong"
+	require.Error(t, badToken.SelfTest())
+
+	ret := ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: ""})
+	require.ErrorIs(t, ret.Error, ErrBadHomeAssistantParam)
+	require.Equal(t, "door=binary_sensor.front_door heat=climate.living_room", ret.Output)
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "get"})
+	require.ErrorIs(t, ret.Error, ErrBadHomeAssistantParam)
+
+	// Read entity states
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "get DOOR"})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "Front door (binary_sensor.front_door): off, changed 1h0m0s ago", ret.Output)
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "get sensor.outside"})
+	require.NoError(t, ret.Error)
+	require.True(t, strings.HasPrefix(ret.Output, "sensor.outside: 4.2 °C, changed"), ret.Output)
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "get sensor.does_not_exist"})
+	require.ErrorContains(t, ret.Error, "does not exist")
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "get ../config"})
+	require.ErrorContains(t, ret.Error, "neither an alias nor an entity ID")
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "list"})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "3 entities\nbinary_sensor.front_door: off\nclimate.living_room: heat\nsensor.outside: 4.2", ret.Output)
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "list climate"})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "1 entities\nclimate.living_room: heat", ret.Output)
+
+	// Call services
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "on heat"})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "Living room (climate.living_room): heat, current_temperature 19.5, temperature 21, hvac_action heating", ret.Output)
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "call climate.set_temperature heat temperature=22.5 hvac_mode=heat"})
+	require.NoError(t, ret.Error)
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "off door"})
+	require.NoError(t, ret.Error)
+	require.True(t, strings.HasPrefix(ret.Output, "Front door (binary_sensor.front_door): off"), ret.Output)
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "call climate.set_temperature heat 22"})
+	require.ErrorContains(t, ret.Error, "key=value")
+	serviceCallsMutex.Lock()
+	require.Equal(t, []string{
+		`/api/services/homeassistant/turn_on {"entity_id":"climate.living_room"}`,
+		`/api/services/climate/set_temperature {"entity_id":"climate.living_room","hvac_mode":"heat","temperature":22.5}`,
+		`/api/services/homeassistant/turn_off {"entity_id":"binary_sensor.front_door"}`,
+	}, serviceCalls)
+	serviceCallsMutex.Unlock()
+
+	// Only the allowed services may be called
+	ha.AllowedServices = []string{"climate.set_temperature"}
+	require.NoError(t, ha.Initialise())
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "on heat"})
+	require.ErrorContains(t, ret.Error, "not among the allowed")
+	ret = ha.Execute(context.Background(), Command{TimeoutSec: 10, Content: "call climate.set_temperature heat temperature=20"})
+	require.NoError(t, ret.Error)
+}
+
+func TestParseServiceData(t *testing.T) {
+	data, err := parseServiceData([]string{"brightness=128", "flash=true", "effect=colorloop", "rgb=1,2,3"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"brightness": 128.0, "flash": true, "effect": "colorloop", "rgb": "1,2,3"}, data)
+	_, err = parseServiceData([]string{"=1"})
+	require.Error(t, err)
+}
@@ -12,6 +12,7 @@ import (
 	"net"
 	"net/textproto"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,18 +20,30 @@ import (
 
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
 )
 
 const (
-	MailboxList    = "l" // Prefix string to trigger listing messages.
-	MailboxRead    = "r" // Prefix string to trigger reading message body.
-	IMAPTimeoutSec = 30  // IMAPTimeoutSec is the IO timeout (in seconds) used for each IMAP conversation.
+	MailboxList       = "l" // Prefix string to trigger listing messages.
+	MailboxRead       = "r" // Prefix string to trigger reading message body.
+	MailboxFolders    = "f" // Prefix string to trigger listing folders (mailboxes) of an account.
+	MailboxSearch     = "s" // Prefix string to trigger searching for messages.
+	MailboxReadUID    = "u" // Prefix string to trigger reading message body by its UID.
+	MailboxWait       = "w" // Prefix string to trigger waiting for new messages.
+	IMAPTimeoutSec    = 30  // IMAPTimeoutSec is the IO timeout (in seconds) used for each IMAP conversation.
+	MaxSearchResults  = 50  // MaxSearchResults is the maximum number of latest messages listed from search results.
+	MaxIMAPSearchText = 200 // MaxIMAPSearchText is the maximum length of the text to search for.
 )
 
 var (
 	RegexMailboxAndNumber     = regexp.MustCompile(`(\w+)[^\w]+(\d+)`)            // Capture one mailbox shortcut name and a number
 	RegexMailboxAndTwoNumbers = regexp.MustCompile(`(\w+)[^\w]+(\d+)[^\d]+(\d+)`) // Capture one mailbox shortcut name and two numbers
-	ErrBadMailboxParam        = fmt.Errorf("%s box skip# count# | %s box to-read#", MailboxList, MailboxRead)
+	ErrBadMailboxParam        = fmt.Errorf("%s box skip# count# | %s box to-read# | %s box | %s box text | %s box uid# | %s box",
+		MailboxList, MailboxRead, MailboxFolders, MailboxSearch, MailboxReadUID, MailboxWait)
+
+	regexIMAPList   = regexp.MustCompile(`(?i)^\* LIST \([^)]*\) (?:"(?:[^"\\]|\\.)*"|NIL) (.+)$`) // Capture the mailbox name of a LIST response
+	regexIMAPExists = regexp.MustCompile(`(?i)^\* (\d+) EXISTS`)                                   // Capture the number of messages of an EXISTS response
+	regexIMAPUID    = regexp.MustCompile(`UID (\d+)`)                                              // Capture the UID among FETCH response items
 )
 
 // IMAPSConnection is an established TLS client connection that is ready for IMAP conversations.
@@ -158,7 +171,16 @@ func (conn *IMAPSConnection) GetHeaders(from, to int) (ret map[int]string, err e
 	if err != nil {
 		return
 	}
-	// Walk through body line by line to find boundary of messages
+	ret = parseFetchedHeaders(body, false)
+	return
+}
+
+/*
+parseFetchedHeaders walks through the FETCH response body line by line to find the boundary of messages, and returns
+the mail headers keyed by message sequence number, or by UID if byUID is true.
+*/
+func parseFetchedHeaders(body string, byUID bool) map[int]string {
+	ret := make(map[int]string)
 	var thisNumber int
 	var thisMessage bytes.Buffer
 	for _, line := range strings.Split(body, "\n") {
@@ -175,11 +197,21 @@ func (conn *IMAPSConnection) GetHeaders(from, to int) (ret map[int]string, err e
 			}
 			// Parse current message number
 			thisNumberStr := regexp.MustCompile(`\d+`).FindString(trimmedLine)
+			if byUID {
+				thisNumberStr = ""
+				if uid := regexIMAPUID.FindStringSubmatch(trimmedLine); len(uid) == 2 {
+					thisNumberStr = uid[1]
+				}
+			}
 			thisNumber, _ = strconv.Atoi(thisNumberStr)
-		} else if trimmedLine == ")" {
-			// ) on its own line signifies end of message
+		} else if trimmedLine == ")" || byUID && strings.HasSuffix(trimmedLine, ")") && regexIMAPUID.MatchString(trimmedLine) {
+			// ) on its own line signifies end of message, some servers place the UID in the end.
+			if uid := regexIMAPUID.FindStringSubmatch(trimmedLine); byUID && len(uid) == 2 {
+				thisNumber, _ = strconv.Atoi(uid[1])
+			}
 			if thisMessage.Len() > 0 {
 				ret[thisNumber] = thisMessage.String()
+				thisMessage.Reset()
 			}
 		} else {
 			// Place the line in the current message buffer
@@ -187,7 +219,7 @@ func (conn *IMAPSConnection) GetHeaders(from, to int) (ret map[int]string, err e
 			thisMessage.WriteRune('\n')
 		}
 	}
-	return
+	return ret
 }
 
 // GetMessage retrieves one mail message, including its entire headers, body content, and attachments if any.
@@ -196,8 +228,14 @@ func (conn *IMAPSConnection) GetMessage(num int) (message string, err error) {
 		err = errors.New("message number must be positive")
 		return
 	}
-	var entireMessage bytes.Buffer
 	_, body, err := conn.Converse(fmt.Sprintf("FETCH %d BODY[]", num))
+	message = stripFetchBoundary(body)
+	return
+}
+
+// stripFetchBoundary removes the FETCH response boundary lines from the response body of a single message.
+func stripFetchBoundary(body string) string {
+	var entireMessage bytes.Buffer
 	for _, line := range strings.Split(body, "\n") {
 		if len(line) > 0 {
 			switch line[0] {
@@ -209,8 +247,160 @@ func (conn *IMAPSConnection) GetMessage(num int) (message string, err error) {
 		entireMessage.WriteString(line)
 		entireMessage.WriteRune('\n')
 	}
-	message = entireMessage.String()
-	return
+	return entireMessage.String()
+}
+
+// GetMessageByUID retrieves one mail message identified by its UID, including its entire headers, body content, and attachments if any.
+func (conn *IMAPSConnection) GetMessageByUID(uid int) (string, error) {
+	if uid < 1 {
+		return "", errors.New("message UID must be positive")
+	}
+	_, body, err := conn.Converse(fmt.Sprintf("UID FETCH %d BODY[]", uid))
+	if err != nil {
+		return "", err
+	}
+	// The server responds with an empty OK if the UID does not exist
+	if !strings.HasPrefix(strings.TrimSpace(body), "*") {
+		return "", fmt.Errorf("IMAPS.GetMessageByUID: cannot find message UID %d", uid)
+	}
+	return stripFetchBoundary(body), nil
+}
+
+// GetHeadersByUID retrieves mail headers of the messages identified by the UIDs, the headers are keyed by UID.
+func (conn *IMAPSConnection) GetHeadersByUID(uids []int) (map[int]string, error) {
+	if len(uids) == 0 {
+		return map[int]string{}, nil
+	}
+	uidStrs := make([]string, len(uids))
+	for i, uid := range uids {
+		uidStrs[i] = strconv.Itoa(uid)
+	}
+	_, body, err := conn.Converse(fmt.Sprintf("UID FETCH %s (UID BODY.PEEK[HEADER])", strings.Join(uidStrs, ",")))
+	if err != nil {
+		return nil, err
+	}
+	return parseFetchedHeaders(body, true), nil
+}
+
+// ListMailboxes returns the names of all mailboxes (folders) of the account.
+func (conn *IMAPSConnection) ListMailboxes() ([]string, error) {
+	_, body, err := conn.Converse(`LIST "" "*"`)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(body, "\n") {
+		match := regexIMAPList.FindStringSubmatch(strings.TrimSpace(line))
+		if len(match) != 2 {
+			continue
+		}
+		name := match[1]
+		if unquoted, err := strconv.Unquote(name); err == nil {
+			name = unquoted
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// SearchUIDs returns the UIDs of messages that contain the text in their headers or body, in ascending order.
+func (conn *IMAPSConnection) SearchUIDs(text string) ([]int, error) {
+	if text == "" || len(text) > MaxIMAPSearchText || strings.ContainsAny(text, "\r\n") {
+		return nil, fmt.Errorf("IMAPS.SearchUIDs: the search text must be a single line of up to %d characters", MaxIMAPSearchText)
+	}
+	charset := ""
+	for _, r := range text {
+		if r > 127 {
+			charset = "CHARSET UTF-8 "
+			break
+		}
+	}
+	quoted := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text)
+	_, body, err := conn.Converse(fmt.Sprintf(`UID SEARCH %sTEXT "%s"`, charset, quoted))
+	if err != nil {
+		return nil, err
+	}
+	var uids []int
+	for _, line := range strings.Split(body, "\n") {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "*" && strings.EqualFold(fields[1], "SEARCH") {
+			for _, field := range fields[2:] {
+				if uid, err := strconv.Atoi(field); err == nil {
+					uids = append(uids, uid)
+				}
+			}
+		}
+	}
+	sort.Ints(uids)
+	return uids, nil
+}
+
+/*
+Idle uses the IDLE command to wait up to the timeout for the server to announce a change in the number of messages in
+the selected mailbox. It returns the latest number of messages, which is the input number if nothing has changed.
+*/
+func (conn *IMAPSConnection) Idle(numMessages int, timeout time.Duration) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.tlsConn == nil {
+		return numMessages, errors.New("programming mistake - IMAPS connection is missing")
+	}
+	_ = conn.tlsConn.SetDeadline(time.Now().Add(time.Duration(IMAPTimeoutSec) * time.Second))
+	challenge := randomChallenge()
+	if _, err := conn.tlsConn.Write([]byte(challenge + " IDLE\r\n")); err != nil {
+		conn.disconnect()
+		return numMessages, err
+	}
+	// The same reader is used throughout the conversation, for the server may send several lines at once.
+	reader := textproto.NewReader(bufio.NewReader(io.LimitReader(conn.tlsConn, 32*1048576)))
+	// Wait for the continuation request that tells the server is now idling
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			conn.disconnect()
+			return numMessages, err
+		}
+		if strings.HasPrefix(line, "+") {
+			break
+		} else if strings.HasPrefix(line, challenge) {
+			return numMessages, fmt.Errorf("IMAPS.Idle: the server refused to idle - %s", strings.TrimSpace(line[len(challenge):]))
+		} else if exists := regexIMAPExists.FindStringSubmatch(line); len(exists) == 2 {
+			numMessages, _ = strconv.Atoi(exists[1])
+		}
+	}
+	// Wait for the server to announce new messages
+	latest := numMessages
+	_ = conn.tlsConn.SetReadDeadline(time.Now().Add(timeout))
+	for latest == numMessages {
+		line, err := reader.ReadLine()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			break
+		} else if err != nil {
+			conn.disconnect()
+			return numMessages, err
+		}
+		if exists := regexIMAPExists.FindStringSubmatch(line); len(exists) == 2 {
+			latest, _ = strconv.Atoi(exists[1])
+		}
+	}
+	// Conclude the IDLE command
+	_ = conn.tlsConn.SetDeadline(time.Now().Add(time.Duration(IMAPTimeoutSec) * time.Second))
+	if _, err := conn.tlsConn.Write([]byte("DONE\r\n")); err != nil {
+		conn.disconnect()
+		return latest, err
+	}
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			conn.disconnect()
+			return latest, err
+		}
+		if strings.HasPrefix(line, challenge) {
+			return latest, nil
+		} else if exists := regexIMAPExists.FindStringSubmatch(line); len(exists) == 2 {
+			latest, _ = strconv.Atoi(exists[1])
+		}
+	}
 }
 
 // Retrieve emails via IMAPS.
@@ -237,10 +427,9 @@ func (mbox *IMAPS) ConnectLoginSelect() (conn *IMAPSConnection, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("IMAPS.ConnectLoginSelect: connection error - %v", err)
 	}
-	tlsWrapper := tls.Client(clientConn, &tls.Config{
-		ServerName:         mbox.Host,
-		InsecureSkipVerify: mbox.InsecureSkipVerify,
-	})
+	tlsConfig := misc.DefaultTLS.ClientConfig(mbox.Host)
+	tlsConfig.InsecureSkipVerify = tlsConfig.InsecureSkipVerify || mbox.InsecureSkipVerify
+	tlsWrapper := tls.Client(clientConn, tlsConfig)
 	if err = tlsWrapper.Handshake(); err != nil {
 		lalog.DefaultLogger.MaybeMinorError(clientConn.Close())
 		return nil, fmt.Errorf("IMAPS.ConnectLoginSelect: TLS connection error - %v", err)
@@ -425,9 +614,13 @@ func (imap *IMAPAccounts) ReadMessage(cmd Command) *Result {
 	if err != nil {
 		return &Result{Error: err}
 	}
-	// If mail is multi-part, prefer to retrieve the plain text mail body.
+	return getMailText(entireMessage)
+}
+
+// getMailText returns the text body of the mail message, if the message is multi-part then the plain text body is preferred.
+func getMailText(entireMessage string) *Result {
 	var anyText, plainText string
-	err = inet.WalkMailMessage([]byte(entireMessage), func(prop inet.BasicMail, body []byte) (bool, error) {
+	err := inet.WalkMailMessage([]byte(entireMessage), func(prop inet.BasicMail, body []byte) (bool, error) {
 		if !strings.Contains(prop.ContentType, "plain") {
 			anyText = string(body)
 		} else {
@@ -445,6 +638,139 @@ func (imap *IMAPAccounts) ReadMessage(cmd Command) *Result {
 	}
 }
 
+// connectAccount looks up the account by its nick name, and then connects to its IMAP server and logs in.
+func (imap *IMAPAccounts) connectAccount(funcName, mbox string) (*IMAPS, *IMAPSConnection, error) {
+	account, found := imap.Accounts[mbox]
+	if !found {
+		return nil, nil, fmt.Errorf("IMAPAccounts.%s: cannot find mailbox \"%s\"", funcName, mbox)
+	}
+	conn, err := account.ConnectLoginSelect()
+	if err != nil {
+		return nil, nil, err
+	}
+	return account, conn, nil
+}
+
+// formatHeaders returns one line of sender and subject for each mail header, the lines are ordered by the message numbers in descending order.
+func formatHeaders(headers map[int]string) string {
+	numbers := make([]int, 0, len(headers))
+	for num := range headers {
+		numbers = append(numbers, num)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(numbers)))
+	var output bytes.Buffer
+	for _, num := range numbers {
+		// Append \r\n\r\n to make it look like a complete message with empty body
+		prop, _, err := inet.ReadMailMessage([]byte(headers[num] + "\r\n\r\n"))
+		if err != nil {
+			continue
+		}
+		output.WriteString(fmt.Sprintf("%d %s %s\n", num, prop.FromAddress, prop.Subject))
+	}
+	return output.String()
+}
+
+// ListFolders lists the names of all folders (mailboxes) of an account.
+func (imap *IMAPAccounts) ListFolders(cmd Command) *Result {
+	mbox, _ := splitFirstWord(cmd.Content)
+	if mbox == "" {
+		return &Result{Error: ErrBadMailboxParam}
+	}
+	_, conn, err := imap.connectAccount("ListFolders", mbox)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	defer conn.LogoutDisconnect()
+	names, err := conn.ListMailboxes()
+	if err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: strings.Join(names, "\n")}
+}
+
+// SearchMails lists the latest messages that contain the text, each message is identified by its UID.
+func (imap *IMAPAccounts) SearchMails(cmd Command) *Result {
+	mbox, text := splitFirstWord(cmd.Content)
+	if mbox == "" || text == "" {
+		return &Result{Error: ErrBadMailboxParam}
+	}
+	_, conn, err := imap.connectAccount("SearchMails", mbox)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	defer conn.LogoutDisconnect()
+	uids, err := conn.SearchUIDs(text)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if len(uids) == 0 {
+		return &Result{Output: "no matching message"}
+	}
+	if len(uids) > MaxSearchResults {
+		uids = uids[len(uids)-MaxSearchResults:]
+	}
+	headers, err := conn.GetHeadersByUID(uids)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: formatHeaders(headers)}
+}
+
+// ReadMessageByUID reads the body of a message identified by its UID.
+func (imap *IMAPAccounts) ReadMessageByUID(cmd Command) *Result {
+	mbox, uidStr := splitFirstWord(cmd.Content)
+	uid, intErr := strconv.Atoi(uidStr)
+	if mbox == "" || intErr != nil {
+		return &Result{Error: ErrBadMailboxParam}
+	}
+	_, conn, err := imap.connectAccount("ReadMessageByUID", mbox)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	defer conn.LogoutDisconnect()
+	entireMessage, err := conn.GetMessageByUID(uid)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	return getMailText(entireMessage)
+}
+
+/*
+WaitForMails waits for new messages to arrive in an account for up to two thirds of the command timeout, and then lists
+the new messages.
+*/
+func (imap *IMAPAccounts) WaitForMails(cmd Command) *Result {
+	mbox, _ := splitFirstWord(cmd.Content)
+	if mbox == "" {
+		return &Result{Error: ErrBadMailboxParam}
+	}
+	account, conn, err := imap.connectAccount("WaitForMails", mbox)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	defer conn.LogoutDisconnect()
+	numMessages, err := conn.GetNumberMessages(account.MailboxName)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	waitSec := cmd.TimeoutSec * 2 / 3
+	if waitSec < 1 {
+		waitSec = 1
+	}
+	latest, err := conn.Idle(numMessages, time.Duration(waitSec)*time.Second)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if latest <= numMessages {
+		return &Result{Output: "no new message"}
+	}
+	headers, err := conn.GetHeaders(numMessages+1, latest)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: formatHeaders(headers)}
+}
+
 func (imap *IMAPAccounts) Execute(ctx context.Context, cmd Command) (ret *Result) {
 	if errResult := cmd.Trim(); errResult != nil {
 		return errResult
@@ -453,6 +779,14 @@ func (imap *IMAPAccounts) Execute(ctx context.Context, cmd Command) (ret *Result
 		ret = imap.ListMails(cmd)
 	} else if cmd.FindAndRemovePrefix(MailboxRead) {
 		ret = imap.ReadMessage(cmd)
+	} else if cmd.FindAndRemovePrefix(MailboxFolders) {
+		ret = imap.ListFolders(cmd)
+	} else if cmd.FindAndRemovePrefix(MailboxSearch) {
+		ret = imap.SearchMails(cmd)
+	} else if cmd.FindAndRemovePrefix(MailboxReadUID) {
+		ret = imap.ReadMessageByUID(cmd)
+	} else if cmd.FindAndRemovePrefix(MailboxWait) {
+		ret = imap.WaitForMails(cmd)
 	} else {
 		ret = &Result{Error: ErrBadMailboxParam}
 	}
@@ -1,11 +1,23 @@
 package toolbox
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIMAPS(t *testing.T) {
@@ -135,3 +147,136 @@ func TestIMAPAccounts_Execute(t *testing.T) {
 		t.Fatal(ret)
 	}
 }
+
+// fakeIMAPMessages are the messages of the fake IMAP server keyed by UID, the message sequence numbers are 1, 2, 3.
+var fakeIMAPMessages = map[int]string{
+	11: "From: alice@example.com\r\nSubject: hello there\r\nContent-Type: text/plain\r\n\r\nfirst body\r\n",
+	12: "From: bob@example.com\r\nSubject: hello again\r\nContent-Type: text/plain\r\n\r\nsecond body\r\n",
+	13: "From: carol@example.com\r\nSubject: new arrival\r\nContent-Type: text/plain\r\n\r\nthird body\r\n",
+}
+
+/*
+startFakeIMAPServer starts an IMAPS server that answers the commands used by the app with canned responses, and
+returns its port number. Of the three messages, the last one arrives during IDLE if the user name is "wait".
+*/
+func startFakeIMAPServer(t *testing.T) int {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), DNSNames: []string{"localhost"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	fetchResponse := func(seq, uid int, item, message string) string {
+		return fmt.Sprintf("* %d FETCH (UID %d %s {%d}\r\n%s)\r\n", seq, uid, item, len(message), message)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				_, _ = conn.Write([]byte("* OK fake IMAP server is ready\r\n"))
+				var user string
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					tag, request, _ := strings.Cut(strings.TrimSpace(line), " ")
+					var resp string
+					switch {
+					case strings.HasPrefix(request, "LOGIN "):
+						user = strings.Fields(request)[1]
+					case strings.HasPrefix(request, "SELECT "), strings.HasPrefix(request, "EXAMINE "):
+						resp = "* 2 EXISTS\r\n"
+					case request == `LIST "" "*"`:
+						resp = "* LIST (\\HasNoChildren) \"/\" \"INBOX\"\r\n* LIST (\\HasNoChildren) \"/\" \"Junk \\\"Mail\\\"\"\r\n* LIST (\\Noselect) NIL Archive\r\n"
+					case request == `UID SEARCH TEXT "hello"`:
+						resp = "* SEARCH 12 11\r\n"
+					case strings.HasPrefix(request, "UID SEARCH "):
+						resp = "* SEARCH\r\n"
+					case strings.HasPrefix(request, "UID FETCH ") && strings.HasSuffix(request, "(UID BODY.PEEK[HEADER])"):
+						for _, uidStr := range strings.Split(strings.Fields(request)[2], ",") {
+							uid, _ := strconv.Atoi(uidStr)
+							header, _, _ := strings.Cut(fakeIMAPMessages[uid], "\r\n\r\n")
+							resp += fetchResponse(uid-10, uid, "BODY[HEADER]", header+"\r\n\r\n")
+						}
+					case strings.HasPrefix(request, "UID FETCH "):
+						uid, _ := strconv.Atoi(strings.Fields(request)[2])
+						if message, exists := fakeIMAPMessages[uid]; exists {
+							resp = fetchResponse(uid-10, uid, "BODY[]", message)
+						}
+					case request == "FETCH 3:3 BODY.PEEK[HEADER]":
+						header, _, _ := strings.Cut(fakeIMAPMessages[13], "\r\n\r\n")
+						resp = fetchResponse(3, 13, "BODY[HEADER]", header+"\r\n\r\n")
+					case request == "IDLE":
+						_, _ = conn.Write([]byte("+ idling\r\n"))
+						if user == "wait" {
+							time.Sleep(500 * time.Millisecond)
+							_, _ = conn.Write([]byte("* 3 EXISTS\r\n"))
+						}
+						if done, err := reader.ReadString('\n'); err != nil || strings.TrimSpace(done) != "DONE" {
+							return
+						}
+					case request == "LOGOUT":
+						_, _ = conn.Write([]byte("* BYE\r\n" + tag + " OK LOGOUT completed\r\n"))
+						return
+					default:
+						_, _ = conn.Write([]byte(tag + " BAD unknown command\r\n"))
+						continue
+					}
+					_, _ = conn.Write([]byte(resp + tag + " OK completed\r\n"))
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestIMAPAccounts_FakeServer(t *testing.T) {
+	port := startFakeIMAPServer(t)
+	accounts := IMAPAccounts{
+		Accounts: map[string]*IMAPS{
+			"personal-mail": {Host: "127.0.0.1", Port: port, AuthUsername: "howard", AuthPassword: "pass", InsecureSkipVerify: true},
+			"wait":          {Host: "127.0.0.1", Port: port, AuthUsername: "wait", AuthPassword: "pass", InsecureSkipVerify: true},
+		},
+	}
+	require.NoError(t, accounts.Initialise())
+	execute := func(content string) *Result {
+		return accounts.Execute(context.Background(), Command{TimeoutSec: 3, Content: content})
+	}
+
+	// List folders
+	result := execute(MailboxFolders + "personal-mail")
+	require.NoError(t, result.Error)
+	require.Equal(t, "INBOX\nJunk \"Mail\"\nArchive", result.Output)
+	require.ErrorContains(t, execute(MailboxFolders+"does-not-exist").Error, "find mailbox")
+	// Search for messages, the latest match comes first.
+	result = execute(MailboxSearch + "personal-mail hello")
+	require.NoError(t, result.Error)
+	require.Equal(t, "12 bob@example.com hello again\n11 alice@example.com hello there\n", result.Output)
+	result = execute(MailboxSearch + "personal-mail nothing")
+	require.NoError(t, result.Error)
+	require.Equal(t, "no matching message", result.Output)
+	require.Equal(t, ErrBadMailboxParam, execute(MailboxSearch+"personal-mail").Error)
+	// Read a message by UID
+	result = execute(MailboxReadUID + "personal-mail 12")
+	require.NoError(t, result.Error)
+	require.Equal(t, "second body", strings.TrimSpace(result.Output))
+	require.ErrorContains(t, execute(MailboxReadUID+"personal-mail 99").Error, "cannot find message UID 99")
+	require.Equal(t, ErrBadMailboxParam, execute(MailboxReadUID+"personal-mail abc").Error)
+	// Wait for new messages
+	result = execute(MailboxWait + "personal-mail")
+	require.NoError(t, result.Error)
+	require.Equal(t, "no new message", result.Output)
+	result = execute(MailboxWait + "wait")
+	require.NoError(t, result.Error)
+	require.Equal(t, "3 carol@example.com new arrival\n", result.Output)
+}
@@ -0,0 +1,216 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+const (
+	// LLMChatTrigger is the trigger prefix string of LLMChat feature.
+	LLMChatTrigger = ".ai"
+	// LLMChatDefaultURL is the default chat completion API endpoint.
+	LLMChatDefaultURL = "https://api.openai.com/v1/chat/completions"
+	// LLMChatDefaultModel is the default name of language model used for chat completion.
+	LLMChatDefaultModel = "gpt-4o-mini"
+	// LLMChatDefaultSystemPrompt is the default instruction given to the language model at the beginning of each conversation.
+	LLMChatDefaultSystemPrompt = "You are a helpful assistant reached by telephone, SMS, and satellite terminals. Reply concisely in plain text without formatting."
+	// LLMChatDefaultMaxContextMessages is the default maximum number of recent messages kept as the context of a conversation.
+	LLMChatDefaultMaxContextMessages = 10
+	// LLMChatDefaultConversationExpirySec is the default number of seconds after which an idle conversation is forgotten.
+	LLMChatDefaultConversationExpirySec = 30 * 60
+	// LLMChatDefaultMaxTokens is the default maximum number of tokens of a reply.
+	LLMChatDefaultMaxTokens = 500
+	// LLMChatNewConversation is the command prefix that forgets the context and begins a new conversation.
+	LLMChatNewConversation = "new"
+)
+
+var ErrBadLLMChatParam = errors.New(`example: prompt | new [prompt]`)
+
+// LLMChatMessage is a message of the conversation between the user and language model.
+type LLMChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// llmChatConversation is the recent messages of a conversation with a user.
+type llmChatConversation struct {
+	messages []LLMChatMessage
+	lastUse  time.Time
+}
+
+/*
+LLMChat relays prompts to a language model via an OpenAI compatible chat completion API, and remembers the recent
+messages of each user so that the follow-up prompts are answered in context.
+*/
+type LLMChat struct {
+	// URL is the chat completion API endpoint, it defaults to LLMChatDefaultURL. Self-hosted services such as Ollama work too.
+	URL string `json:"URL"`
+	// APIKey is the bearer token that authorises requests made to the API.
+	APIKey string `json:"APIKey"`
+	// Model is the name of language model, it defaults to LLMChatDefaultModel.
+	Model string `json:"Model"`
+	// SystemPrompt is the instruction given to the language model at the beginning of each conversation, it defaults to LLMChatDefaultSystemPrompt.
+	SystemPrompt string `json:"SystemPrompt"`
+	// MaxContextMessages is the maximum number of recent messages kept as the context of a conversation, it defaults to LLMChatDefaultMaxContextMessages.
+	MaxContextMessages int `json:"MaxContextMessages"`
+	// ConversationExpirySec is the number of seconds after which an idle conversation is forgotten, it defaults to LLMChatDefaultConversationExpirySec.
+	ConversationExpirySec int `json:"ConversationExpirySec"`
+	// MaxTokens is the maximum number of tokens of a reply, it defaults to LLMChatDefaultMaxTokens.
+	MaxTokens int `json:"MaxTokens"`
+
+	// conversations are the recent conversations, keyed by daemon name and client tag of the user.
+	conversations      map[string]*llmChatConversation
+	conversationsMutex *sync.Mutex
+}
+
+func (chat *LLMChat) IsConfigured() bool {
+	return chat.APIKey != "" || (chat.URL != "" && chat.URL != LLMChatDefaultURL)
+}
+
+func (chat *LLMChat) SelfTest() error {
+	if !chat.IsConfigured() {
+		return ErrIncompleteConfig
+	}
+	if _, err := chat.Complete(context.Background(), SelfTestTimeoutSec, []LLMChatMessage{{Role: "user", Content: "Reply with the word OK."}}); err != nil {
+		return fmt.Errorf("LLMChat.SelfTest: %w", err)
+	}
+	return nil
+}
+
+func (chat *LLMChat) Initialise() error {
+	if chat.URL == "" {
+		chat.URL = LLMChatDefaultURL
+	}
+	if !strings.HasPrefix(chat.URL, "http://") && !strings.HasPrefix(chat.URL, "https://") {
+		return fmt.Errorf("LLMChat.Initialise: URL \"%s\" must begin with http:// or https://", chat.URL)
+	}
+	if chat.Model == "" {
+		chat.Model = LLMChatDefaultModel
+	}
+	if chat.SystemPrompt == "" {
+		chat.SystemPrompt = LLMChatDefaultSystemPrompt
+	}
+	if chat.MaxContextMessages < 1 {
+		chat.MaxContextMessages = LLMChatDefaultMaxContextMessages
+	}
+	if chat.ConversationExpirySec < 1 {
+		chat.ConversationExpirySec = LLMChatDefaultConversationExpirySec
+	}
+	if chat.MaxTokens < 1 {
+		chat.MaxTokens = LLMChatDefaultMaxTokens
+	}
+	chat.conversations = make(map[string]*llmChatConversation)
+	chat.conversationsMutex = new(sync.Mutex)
+	return nil
+}
+
+func (chat *LLMChat) Trigger() Trigger {
+	return LLMChatTrigger
+}
+
+// Complete asks the language model to reply to the messages of a conversation, and returns the reply.
+func (chat *LLMChat) Complete(ctx context.Context, timeoutSec int, messages []LLMChatMessage) (string, error) {
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"model":      chat.Model,
+		"messages":   append([]LLMChatMessage{{Role: "system", Content: chat.SystemPrompt}}, messages...),
+		"max_tokens": chat.MaxTokens,
+	})
+	if err != nil {
+		return "", err
+	}
+	req := inet.HTTPRequest{
+		TimeoutSec:  timeoutSec,
+		Method:      http.MethodPost,
+		ContentType: "application/json",
+		Body:        bytes.NewReader(reqBody),
+		// The completion takes a while and is not free, hence do not retry it.
+		MaxRetry: 1,
+	}
+	if chat.APIKey != "" {
+		req.Header = http.Header{"Authorization": {"Bearer " + chat.APIKey}}
+	}
+	resp, err := inet.DoHTTP(ctx, req, strings.ReplaceAll(chat.URL, "%", "%%"))
+	if errResult := HTTPErrorToResult(resp, err); errResult != nil {
+		return "", errResult.Error
+	}
+	var completion struct {
+		Choices []struct {
+			Message LLMChatMessage `json:"message"`
+		} `json:"choices"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(resp.Body, &completion); err != nil {
+		return "", fmt.Errorf("failed to decode API response - %w", err)
+	} else if completion.Error != nil {
+		return "", fmt.Errorf("API error - %s", completion.Error.Message)
+	} else if len(completion.Choices) == 0 {
+		return "", errors.New("API response does not contain a reply")
+	}
+	return strings.TrimSpace(completion.Choices[0].Message.Content), nil
+}
+
+// getContext returns the recent messages of the user's conversation, or nil if there is none.
+func (chat *LLMChat) getContext(userKey string) []LLMChatMessage {
+	chat.conversationsMutex.Lock()
+	defer chat.conversationsMutex.Unlock()
+	now := time.Now()
+	for key, conv := range chat.conversations {
+		if now.Sub(conv.lastUse) > time.Duration(chat.ConversationExpirySec)*time.Second {
+			delete(chat.conversations, key)
+		}
+	}
+	if conv, exists := chat.conversations[userKey]; exists {
+		return append([]LLMChatMessage{}, conv.messages...)
+	}
+	return nil
+}
+
+// setContext memorises the recent messages of the user's conversation, and discards the oldest exchanges that do not fit.
+func (chat *LLMChat) setContext(userKey string, messages []LLMChatMessage) {
+	chat.conversationsMutex.Lock()
+	defer chat.conversationsMutex.Unlock()
+	if len(messages) > chat.MaxContextMessages {
+		messages = messages[len(messages)-chat.MaxContextMessages:]
+	}
+	chat.conversations[userKey] = &llmChatConversation{messages: messages, lastUse: time.Now()}
+}
+
+// forgetContext discards the user's conversation.
+func (chat *LLMChat) forgetContext(userKey string) {
+	chat.conversationsMutex.Lock()
+	defer chat.conversationsMutex.Unlock()
+	delete(chat.conversations, userKey)
+}
+
+func (chat *LLMChat) Execute(ctx context.Context, cmd Command) *Result {
+	if errResult := cmd.Trim(); errResult != nil {
+		return &Result{Error: ErrBadLLMChatParam}
+	}
+	// Each user of each daemon (e.g. a phone number calling in via Twilio) has a conversation of their own
+	userKey := cmd.DaemonName + "/" + cmd.ClientTag
+	prompt := cmd.Content
+	if word, rest, _ := strings.Cut(prompt, " "); strings.EqualFold(word, LLMChatNewConversation) {
+		chat.forgetContext(userKey)
+		if prompt = strings.TrimSpace(rest); prompt == "" {
+			return &Result{Output: "started a new conversation"}
+		}
+	}
+	messages := append(chat.getContext(userKey), LLMChatMessage{Role: "user", Content: prompt})
+	reply, err := chat.Complete(ctx, cmd.TimeoutSec, messages)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	chat.setContext(userKey, append(messages, LLMChatMessage{Role: "assistant", Content: reply}))
+	return &Result{Output: reply}
+}
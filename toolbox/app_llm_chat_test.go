@@ -0,0 +1,100 @@
+package toolbox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLLMChat(t *testing.T) {
+	var requests []map[string]interface{}
+	var requestsMutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer my-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error": {"message": "bad key"}}`))
+			return
+		}
+		var req map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requestsMutex.Lock()
+		requests = append(requests, req)
+		requestsMutex.Unlock()
+		// Reply to the latest prompt
+		messages := req["messages"].([]interface{})
+		lastPrompt := messages[len(messages)-1].(map[string]interface{})["content"].(string)
+		if lastPrompt == "fail" {
+			_, _ = w.Write([]byte(`{"error": {"message": "model is overloaded"}}`))
+			return
+		}
+		reply, _ := json.Marshal(map[string]interface{}{
+			"choices": []interface{}{map[string]interface{}{"message": map[string]string{"role": "assistant", "content": " reply to " + lastPrompt + " "}}},
+		})
+		_, _ = w.Write(reply)
+	}))
+	defer server.Close()
+
+	chat := LLMChat{}
+	require.False(t, chat.IsConfigured())
+	require.ErrorIs(t, chat.SelfTest(), ErrIncompleteConfig)
+	chat = LLMChat{URL: "ftp://example.com", APIKey: "my-key"}
+	require.Error(t, chat.Initialise())
+	chat = LLMChat{URL: server.URL, APIKey: "my-key", MaxContextMessages: 4}
+	require.True(t, chat.IsConfigured())
+	require.NoError(t, chat.Initialise())
+	require.NoError(t, chat.SelfTest())
+	require.Equal(t, LLMChatDefaultModel, requests[0]["model"])
+	require.EqualValues(t, LLMChatDefaultMaxTokens, requests[0]["max_tokens"])
+
+	run := func(clientTag, content string) *Result {
+		return chat.Execute(context.Background(), Command{DaemonName: "smtpd", ClientTag: clientTag, TimeoutSec: 10, Content: content})
+	}
+	numMessages := func() int {
+		requestsMutex.Lock()
+		defer requestsMutex.Unlock()
+		return len(requests[len(requests)-1]["messages"].([]interface{}))
+	}
+	require.ErrorIs(t, run("alice", " ").Error, ErrBadLLMChatParam)
+	// The system prompt and the first prompt
+	result := run("alice", "hello")
+	require.NoError(t, result.Error)
+	require.Equal(t, "reply to hello", result.Output)
+	require.Equal(t, 2, numMessages())
+	// The follow-up prompt carries the context of the conversation
+	require.Equal(t, "reply to and then", run("alice", "and then").Output)
+	require.Equal(t, 4, numMessages())
+	// Each user has their own conversation
+	require.Equal(t, "reply to hi", run("bob", "hi").Output)
+	require.Equal(t, 2, numMessages())
+	// The oldest messages are discarded to keep the context short
+	require.Equal(t, "reply to more", run("alice", "more").Output)
+	require.Equal(t, 6, numMessages())
+	require.Equal(t, "reply to again", run("alice", "again").Output)
+	require.Equal(t, 6, numMessages())
+	systemPrompt := requests[len(requests)-1]["messages"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"role": "system", "content": LLMChatDefaultSystemPrompt}, systemPrompt)
+	// A failed completion does not change the context
+	result = run("alice", "fail")
+	require.ErrorContains(t, result.Error, "model is overloaded")
+	require.Len(t, chat.getContext("smtpd/alice"), 4)
+	// Begin a new conversation
+	require.Equal(t, "started a new conversation", run("alice", "NEW").Output)
+	require.Nil(t, chat.getContext("smtpd/alice"))
+	require.Equal(t, "reply to bye", run("alice", "new bye").Output)
+	require.Equal(t, 2, numMessages())
+
+	// An unauthorised request fails
+	chat.APIKey = "wrong"
+	result = run("alice", "hello")
+	require.Error(t, result.Error)
+	require.True(t, strings.Contains(result.Error.Error(), "401") || strings.Contains(result.Error.Error(), "bad key"), result.Error.Error())
+}
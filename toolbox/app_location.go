@@ -0,0 +1,202 @@
+package toolbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+const (
+	// LocationTrackerTrigger is the trigger prefix string of LocationTracker feature.
+	LocationTrackerTrigger = ".where"
+	// DefaultLocationMaxPositions is the default number of recent positions kept for each device.
+	DefaultLocationMaxPositions = 20
+	// MaxLocationDeviceNameLen is the maximum length of a device name.
+	MaxLocationDeviceNameLen = 100
+	// LocationMapURL is the template of the link to a map centred at the latitude and longitude of a position.
+	LocationMapURL = "https://www.openstreetmap.org/?mlat=%.6f&mlon=%.6f#map=15/%.6f/%.6f"
+	// LocationSourceOwnTracks identifies the positions reported by the OwnTracks app.
+	LocationSourceOwnTracks = "owntracks"
+	// LocationSourceLoRaWAN identifies the positions reported by LoRaWAN transceivers.
+	LocationSourceLoRaWAN = "lorawan"
+)
+
+// Position is a location report made by a device.
+type Position struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+	// Altitude is in metres, zero if unknown.
+	Altitude float64 `json:"alt,omitempty"`
+	// Accuracy is the radius of uncertainty in metres, zero if unknown.
+	Accuracy float64 `json:"acc,omitempty"`
+	// Time is when the device determined its position.
+	Time time.Time `json:"time"`
+	// Source is the channel that delivered the report, e.g. "owntracks" or "lorawan".
+	Source string `json:"source,omitempty"`
+}
+
+// Validate returns an error if the coordinates are out of range, or are at exactly 0,0 which indicates the lack of a fix.
+func (pos Position) Validate() error {
+	if math.IsNaN(pos.Latitude) || math.IsNaN(pos.Longitude) || math.Abs(pos.Latitude) > 90 || math.Abs(pos.Longitude) > 180 {
+		return fmt.Errorf("coordinates %f,%f are out of range", pos.Latitude, pos.Longitude)
+	}
+	if pos.Latitude == 0 && pos.Longitude == 0 {
+		return errors.New("the position does not have a fix")
+	}
+	return nil
+}
+
+// MapURL returns the link to a map centred at the position.
+func (pos Position) MapURL() string {
+	return fmt.Sprintf(LocationMapURL, pos.Latitude, pos.Longitude, pos.Latitude, pos.Longitude)
+}
+
+// String returns the coordinates, accuracy, altitude, and age of the position, followed by a map link.
+func (pos Position) String() string {
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("%.6f,%.6f", pos.Latitude, pos.Longitude))
+	if pos.Accuracy > 0 {
+		out.WriteString(fmt.Sprintf(" acc %.0fm", pos.Accuracy))
+	}
+	if pos.Altitude != 0 {
+		out.WriteString(fmt.Sprintf(" alt %.0fm", pos.Altitude))
+	}
+	out.WriteString(fmt.Sprintf(" %s ago", time.Since(pos.Time).Truncate(time.Second)))
+	if pos.Source != "" {
+		out.WriteString(" via " + pos.Source)
+	}
+	out.WriteString(" " + pos.MapURL())
+	return out.String()
+}
+
+/*
+LocationTracker keeps the recent positions reported by devices (e.g. phones running OwnTracks and LoRaWAN GPS trackers)
+in an encrypted file, and tells the latest position of a device, which is useful for finding a lost device or a family
+member over any channel.
+*/
+type LocationTracker struct {
+	// FilePath is the location of the encrypted file of positions, it is created upon the first report.
+	FilePath string `json:"FilePath"`
+	// Passphrase is used to derive the encryption key of the file.
+	Passphrase string `json:"Passphrase"`
+	// MaxPositions is the number of recent positions kept for each device.
+	MaxPositions int `json:"MaxPositions"`
+
+	store *misc.EncryptedKVStore
+	// mutex serialises the updates made to the positions of a device.
+	mutex *sync.Mutex
+}
+
+func (tracker *LocationTracker) IsConfigured() bool {
+	return tracker.FilePath != "" && tracker.Passphrase != ""
+}
+
+func (tracker *LocationTracker) SelfTest() error {
+	if !tracker.IsConfigured() {
+		return ErrIncompleteConfig
+	}
+	return nil
+}
+
+func (tracker *LocationTracker) Initialise() error {
+	if tracker.MaxPositions < 1 {
+		tracker.MaxPositions = DefaultLocationMaxPositions
+	}
+	tracker.mutex = new(sync.Mutex)
+	tracker.store = &misc.EncryptedKVStore{FilePath: tracker.FilePath, Passphrase: tracker.Passphrase}
+	if err := tracker.store.Initialise(); err != nil {
+		return fmt.Errorf("LocationTracker.Initialise: %w", err)
+	}
+	return nil
+}
+
+// Trigger returns the trigger prefix string ".where".
+func (tracker *LocationTracker) Trigger() Trigger {
+	return LocationTrackerTrigger
+}
+
+// Record stores a position reported by the device, only the most recent positions of each device are kept.
+func (tracker *LocationTracker) Record(deviceName string, pos Position) error {
+	if tracker.store == nil {
+		return errors.New("LocationTracker.Record: the app is not configured")
+	}
+	deviceName = strings.TrimSpace(deviceName)
+	if deviceName == "" || len(deviceName) > MaxLocationDeviceNameLen {
+		return fmt.Errorf("LocationTracker.Record: device name must be between 1 and %d characters long", MaxLocationDeviceNameLen)
+	}
+	if err := pos.Validate(); err != nil {
+		return fmt.Errorf("LocationTracker.Record: %w", err)
+	}
+	if pos.Time.IsZero() {
+		pos.Time = time.Now()
+	}
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	positions, err := tracker.GetPositions(deviceName)
+	if err != nil {
+		return fmt.Errorf("LocationTracker.Record: %w", err)
+	}
+	// Reports may arrive out of order, e.g. OwnTracks sends the positions queued while the phone was offline.
+	positions = append(positions, pos)
+	sort.SliceStable(positions, func(i, j int) bool {
+		return positions[i].Time.Before(positions[j].Time)
+	})
+	if len(positions) > tracker.MaxPositions {
+		positions = positions[len(positions)-tracker.MaxPositions:]
+	}
+	serialised, err := json.Marshal(positions)
+	if err != nil {
+		return fmt.Errorf("LocationTracker.Record: %w", err)
+	}
+	if err := tracker.store.Put(strings.ToLower(deviceName), string(serialised)); err != nil {
+		return fmt.Errorf("LocationTracker.Record: %w", err)
+	}
+	return nil
+}
+
+// GetPositions returns the recent positions of the device (case insensitive) from the oldest to the latest.
+func (tracker *LocationTracker) GetPositions(deviceName string) ([]Position, error) {
+	serialised, found := tracker.store.Get(strings.ToLower(strings.TrimSpace(deviceName)))
+	if !found {
+		return []Position{}, nil
+	}
+	var positions []Position
+	if err := json.Unmarshal([]byte(serialised), &positions); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+func (tracker *LocationTracker) Execute(ctx context.Context, cmd Command) *Result {
+	deviceName := strings.TrimSpace(cmd.Content)
+	if deviceName == "" {
+		// List the latest position of every device
+		devices := tracker.store.Keys()
+		lines := make([]string, 0, len(devices))
+		for _, device := range devices {
+			positions, err := tracker.GetPositions(device)
+			if err != nil {
+				return &Result{Error: err}
+			}
+			if len(positions) > 0 {
+				lines = append(lines, device+": "+positions[len(positions)-1].String())
+			}
+		}
+		return &Result{Output: fmt.Sprintf("%d %s", len(lines), strings.Join(lines, "\n"))}
+	}
+	positions, err := tracker.GetPositions(deviceName)
+	if err != nil {
+		return &Result{Error: err}
+	} else if len(positions) == 0 {
+		return &Result{Error: fmt.Errorf("there is not a position of %s, the known devices are: %s", deviceName, strings.Join(tracker.store.Keys(), ", "))}
+	}
+	return &Result{Output: positions[len(positions)-1].String()}
+}
@@ -0,0 +1,57 @@
+package toolbox
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocationTracker(t *testing.T) {
+	tracker := LocationTracker{}
+	require.False(t, tracker.IsConfigured())
+	tracker.FilePath = filepath.Join(t.TempDir(), "locations")
+	tracker.Passphrase = "pass"
+	tracker.MaxPositions = 2
+	require.True(t, tracker.IsConfigured())
+	require.NoError(t, tracker.Initialise())
+	require.NoError(t, tracker.SelfTest())
+
+	// Bad reports
+	require.Error(t, tracker.Record("", Position{Latitude: 1, Longitude: 1}))
+	require.Error(t, tracker.Record("phone", Position{Latitude: 91, Longitude: 1}))
+	require.Error(t, tracker.Record("phone", Position{}))
+	ret := tracker.Execute(context.Background(), Command{Content: "phone"})
+	require.Error(t, ret.Error)
+
+	// Reports may arrive out of order, only the most recent positions are kept.
+	now := time.Now()
+	require.NoError(t, tracker.Record("Phone", Position{Latitude: 1, Longitude: 2, Time: now.Add(-time.Hour)}))
+	require.NoError(t, tracker.Record("phone", Position{Latitude: 3, Longitude: 4, Accuracy: 10, Source: LocationSourceOwnTracks, Time: now.Add(-time.Minute)}))
+	require.NoError(t, tracker.Record("phone", Position{Latitude: 5, Longitude: 6, Time: now.Add(-2 * time.Hour)}))
+	require.NoError(t, tracker.Record("tracker", Position{Latitude: -33.8, Longitude: 151.2, Altitude: 50, Source: LocationSourceLoRaWAN}))
+	positions, err := tracker.GetPositions("PHONE")
+	require.NoError(t, err)
+	require.Len(t, positions, 2)
+	require.Equal(t, 1.0, positions[0].Latitude)
+	require.Equal(t, 3.0, positions[1].Latitude)
+
+	ret = tracker.Execute(context.Background(), Command{Content: "phone"})
+	require.NoError(t, ret.Error)
+	require.True(t, strings.HasPrefix(ret.Output, "3.000000,4.000000 acc 10m 1m"), ret.Output)
+	require.Contains(t, ret.Output, "ago via owntracks https://www.openstreetmap.org/?mlat=3.000000&mlon=4.000000")
+	ret = tracker.Execute(context.Background(), Command{Content: ""})
+	require.NoError(t, ret.Error)
+	require.True(t, strings.HasPrefix(ret.Output, "2 phone: 3.000000,4.000000"), ret.Output)
+	require.Contains(t, ret.Output, "\ntracker: -33.800000,151.200000 alt 50m")
+
+	// The positions survive program restart
+	tracker = LocationTracker{FilePath: tracker.FilePath, Passphrase: "pass"}
+	require.NoError(t, tracker.Initialise())
+	positions, err = tracker.GetPositions("tracker")
+	require.NoError(t, err)
+	require.Len(t, positions, 1)
+}
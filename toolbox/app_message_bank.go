@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,13 +19,20 @@ const (
 	MessageBankTagDefault              = "default"
 	MessageBankTagLoRaWAN              = "LoRaWAN"
 	MessageBankDefaultStoreResponse    = "message has been stored"
+	// MessageBankMaxThreads is the maximum number of conversation threads, including those of the built-in tags.
+	MessageBankMaxThreads = 32
 )
 
 var (
 	allTags = map[string]bool{MessageBankTagDefault: true, MessageBankTagLoRaWAN: true}
 
-	MessageBankRegexStore = regexp.MustCompile(`s[^\w]+([\w]+)[^\w]+([\w]+)[^\w]+(.*)`)
-	MessageBankRegexGet   = regexp.MustCompile(`g[^\w]+([\w]+)[^\w]+([\w]+)`)
+	// MessageBankRegexCorrespondentTag matches the tag of a correspondent's conversation thread, e.g. "mum".
+	MessageBankRegexCorrespondentTag = regexp.MustCompile(`^\w{1,32}$`)
+
+	MessageBankRegexStore   = regexp.MustCompile(`s[^\w]+([\w]+)[^\w]+([\w]+)[^\w]+(.*)`)
+	MessageBankRegexGet     = regexp.MustCompile(`g[^\w]+([\w]+)[^\w]+([\w]+)`)
+	MessageBankRegexUnread  = regexp.MustCompile(`^u[^\w]+([\w]+)[^\w]+([\w]+)$`)
+	MessageBankRegexThreads = regexp.MustCompile(`^t$`)
 
 	MessageBankDateFormat = "20060102T150405Z"
 )
@@ -32,12 +41,30 @@ var (
 type Message struct {
 	Time    time.Time
 	Content interface{}
+	// Read is true after the message has been retrieved by its recipient.
+	Read bool
+}
+
+// MessageBankStoreListener is notified of each message after it has been stored.
+type MessageBankStoreListener func(tag, direction string, msg Message)
+
+// MessageThread summarises the conversation with a correspondent.
+type MessageThread struct {
+	Tag            string
+	UnreadIncoming int
+	UnreadOutgoing int
+	// Latest is the time of the latest message in either direction.
+	Latest time.Time
 }
 
-// MessageBank stores two-way text messages for on-demand retrieval.
+/*
+MessageBank stores two-way text messages for on-demand retrieval. The messages are organised into conversation threads
+keyed by tag - the built-in tags "default" and "LoRaWAN", as well as a tag for each correspondent (e.g. "mum" or "dad").
+*/
 type MessageBank struct {
-	mutex       *sync.Mutex
-	allMessages map[string]map[string][]Message
+	mutex         *sync.Mutex
+	allMessages   map[string]map[string][]Message
+	storeListener MessageBankStoreListener
 }
 
 // IsConfigured always returns true.
@@ -64,19 +91,36 @@ func MessagesToString(messages []Message) string {
 // messages is reached for the combination of tag and direction, then the oldest
 // message will be evicted prior to storing this message.
 func (bank *MessageBank) Store(tag, direction string, timestamp time.Time, content interface{}) error {
-	if exists := allTags[tag]; !exists {
-		return fmt.Errorf("Store: unrecognised tag %q", tag)
+	msg := Message{Time: timestamp, Content: content}
+	listener, err := bank.store(tag, direction, msg)
+	if err != nil {
+		return err
+	}
+	// The listener is notified outside of the critical section so that it may use the message bank too
+	if listener != nil {
+		listener(tag, direction, msg)
+	}
+	return nil
+}
+
+// store memorises the message and returns the store listener.
+func (bank *MessageBank) store(tag, direction string, msg Message) (MessageBankStoreListener, error) {
+	if exists := allTags[tag]; !exists && !MessageBankRegexCorrespondentTag.MatchString(tag) {
+		return nil, fmt.Errorf("Store: unrecognised tag %q", tag)
 	}
 	if direction != MessageDirectionIncoming && direction != MessageDirectionOutgoing {
-		return fmt.Errorf("Store: unrecognised direction %q", direction)
+		return nil, fmt.Errorf("Store: unrecognised direction %q", direction)
 	}
-	if content == nil {
-		return errors.New("Store: content must not be nil")
+	if msg.Content == nil {
+		return nil, errors.New("Store: content must not be nil")
 	}
 	bank.mutex.Lock()
 	defer bank.mutex.Unlock()
 	dirMessages, exists := bank.allMessages[tag]
 	if !exists {
+		if len(bank.allMessages) >= MessageBankMaxThreads {
+			return nil, fmt.Errorf("Store: there are already %d conversation threads", MessageBankMaxThreads)
+		}
 		dirMessages = make(map[string][]Message)
 	}
 	messages, exists := dirMessages[direction]
@@ -87,24 +131,150 @@ func (bank *MessageBank) Store(tag, direction string, timestamp time.Time, conte
 		// Evict the oldest message.
 		messages = messages[1:]
 	}
-	messages = append(messages, Message{Time: timestamp, Content: content})
+	messages = append(messages, msg)
 	dirMessages[direction] = messages
 	bank.allMessages[tag] = dirMessages
-	return nil
+	return bank.storeListener, nil
 }
 
 // Get retrieves the messages currently stored under the specified tag and
-// direction.
+// direction. It does not change the read state of the messages.
 func (bank *MessageBank) Get(tag, direction string) []Message {
 	bank.mutex.Lock()
 	defer bank.mutex.Unlock()
-	if dirMessages, exists := bank.allMessages[tag]; !exists {
-		return []Message{}
-	} else if messages, exists := dirMessages[direction]; !exists {
-		return []Message{}
-	} else {
-		return messages
+	return append([]Message{}, bank.allMessages[tag][direction]...)
+}
+
+// GetUnread retrieves the unread messages stored under the specified tag and
+// direction, and then marks them read.
+func (bank *MessageBank) GetUnread(tag, direction string) []Message {
+	bank.mutex.Lock()
+	defer bank.mutex.Unlock()
+	ret := make([]Message, 0)
+	for i, msg := range bank.allMessages[tag][direction] {
+		if !msg.Read {
+			ret = append(ret, msg)
+			bank.allMessages[tag][direction][i].Read = true
+		}
+	}
+	return ret
+}
+
+// MarkRead marks all messages stored under the specified tag and direction
+// read, and returns the number of messages that were unread.
+func (bank *MessageBank) MarkRead(tag, direction string) int {
+	return len(bank.GetUnread(tag, direction))
+}
+
+// Threads returns the summary of all conversation threads sorted by tag.
+func (bank *MessageBank) Threads() []MessageThread {
+	bank.mutex.Lock()
+	defer bank.mutex.Unlock()
+	ret := make([]MessageThread, 0, len(bank.allMessages))
+	for tag, dirMessages := range bank.allMessages {
+		thread := MessageThread{Tag: tag}
+		for direction, messages := range dirMessages {
+			for _, msg := range messages {
+				if msg.Time.After(thread.Latest) {
+					thread.Latest = msg.Time
+				}
+				if msg.Read {
+					continue
+				}
+				if direction == MessageDirectionIncoming {
+					thread.UnreadIncoming++
+				} else {
+					thread.UnreadOutgoing++
+				}
+			}
+		}
+		ret = append(ret, thread)
 	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Tag < ret[j].Tag
+	})
+	return ret
+}
+
+// Delete removes the messages stored under the specified tag and direction (or both directions if the direction is
+// empty), and returns the number of messages removed.
+func (bank *MessageBank) Delete(tag, direction string) (removed int) {
+	bank.mutex.Lock()
+	defer bank.mutex.Unlock()
+	dirMessages, exists := bank.allMessages[tag]
+	if !exists {
+		return 0
+	}
+	for dir, messages := range dirMessages {
+		if direction == "" || dir == direction {
+			removed += len(messages)
+			delete(dirMessages, dir)
+		}
+	}
+	// Forget about the empty thread so that it does not count toward the maximum number of threads
+	if len(dirMessages) == 0 {
+		delete(bank.allMessages, tag)
+	}
+	return
+}
+
+// SetStoreListener gives the message bank a listener to notify of each newly stored message, or nil to stop notifying.
+func (bank *MessageBank) SetStoreListener(listener MessageBankStoreListener) {
+	bank.mutex.Lock()
+	defer bank.mutex.Unlock()
+	bank.storeListener = listener
+}
+
+// markLatestRead marks the latest message stored under the specified tag and direction read.
+func (bank *MessageBank) markLatestRead(tag, direction string) {
+	bank.mutex.Lock()
+	defer bank.mutex.Unlock()
+	if messages := bank.allMessages[tag][direction]; len(messages) > 0 {
+		messages[len(messages)-1].Read = true
+	}
+}
+
+// PurgeClient removes the messages that mention the client identifier and returns the number of messages removed.
+func (bank *MessageBank) PurgeClient(clientID string) int {
+	return bank.removeIf(func(msg Message) bool {
+		return strings.Contains(fmt.Sprintf("%+v", msg.Content), clientID)
+	})
+}
+
+// ExpireBefore removes the messages stored before the timestamp and returns the number of messages removed.
+func (bank *MessageBank) ExpireBefore(before time.Time) int {
+	return bank.removeIf(func(msg Message) bool {
+		return msg.Time.Before(before)
+	})
+}
+
+// removeIf removes the messages for which the function returns true, and returns the number of messages removed.
+func (bank *MessageBank) removeIf(fun func(Message) bool) (removed int) {
+	if bank.mutex == nil {
+		return 0
+	}
+	bank.mutex.Lock()
+	defer bank.mutex.Unlock()
+	for tag, dirMessages := range bank.allMessages {
+		var remaining int
+		for direction, messages := range dirMessages {
+			kept := make([]Message, 0, len(messages))
+			for _, msg := range messages {
+				if fun(msg) {
+					removed++
+				} else {
+					kept = append(kept, msg)
+				}
+			}
+			dirMessages[direction] = kept
+			remaining += len(kept)
+		}
+		// Forget about the empty threads so that they do not count toward the maximum number of threads
+		if remaining == 0 {
+			delete(bank.allMessages, tag)
+		}
+	}
+	return
 }
 
 // Initialise initialises the internal states of the app.
@@ -134,12 +304,21 @@ func (bank *MessageBank) Execute(ctx context.Context, cmd Command) *Result {
 		messages := bank.Get(storeParams[1], MessageDirectionOutgoing)
 		if len(messages) > 0 {
 			latest := messages[len(messages)-1]
+			bank.markLatestRead(storeParams[1], MessageDirectionOutgoing)
 			return &Result{Output: fmt.Sprintf("Stored. Last outbound message was: %s %+v", latest.Time.UTC().Format(MessageBankDateFormat), latest.Content)}
 		}
 		return &Result{Output: MessageBankDefaultStoreResponse}
+	} else if unreadParams := MessageBankRegexUnread.FindStringSubmatch(cmd.Content); len(unreadParams) == 3 {
+		return &Result{Output: MessagesToString(bank.GetUnread(unreadParams[1], unreadParams[2]))}
 	} else if getParams := MessageBankRegexGet.FindStringSubmatch(cmd.Content); len(getParams) == 3 {
 		return &Result{Output: MessagesToString(bank.Get(getParams[1], getParams[2]))}
+	} else if MessageBankRegexThreads.MatchString(cmd.Content) {
+		var out bytes.Buffer
+		for _, thread := range bank.Threads() {
+			out.WriteString(fmt.Sprintf("%s %s unread in:%d out:%d\n", thread.Tag, thread.Latest.UTC().Format(MessageBankDateFormat), thread.UnreadIncoming, thread.UnreadOutgoing))
+		}
+		return &Result{Output: out.String()}
 	} else {
-		return &Result{Error: errors.New(".b s Tag Direction Text | g Tag Direction")}
+		return &Result{Error: errors.New(".b s Tag Dir Text|g/u Tag Dir|t")}
 	}
 }
@@ -105,3 +105,134 @@ func TestMessageBank_Execute(t *testing.T) {
 		t.Fatalf("%+v", result)
 	}
 }
+
+func TestMessageBank_Threads(t *testing.T) {
+	bank := &MessageBank{}
+	if err := bank.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bank.Store("not a tag", MessageDirectionIncoming, time.Now(), "haha"); err == nil || !strings.Contains(err.Error(), "unrecognised tag") {
+		t.Fatal(err)
+	}
+	// Each correspondent has a thread of their own
+	earlier := time.Date(2002, 03, 04, 05, 06, 07, 00, time.UTC)
+	later := earlier.Add(time.Hour)
+	for _, msg := range []struct {
+		tag, direction string
+		time           time.Time
+	}{{"mum", MessageDirectionIncoming, earlier}, {"mum", MessageDirectionIncoming, later}, {"dad", MessageDirectionOutgoing, earlier}} {
+		if err := bank.Store(msg.tag, msg.direction, msg.time, "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantThreads := []MessageThread{
+		{Tag: "dad", UnreadOutgoing: 1, Latest: earlier},
+		{Tag: "mum", UnreadIncoming: 2, Latest: later},
+	}
+	if threads := bank.Threads(); !reflect.DeepEqual(wantThreads, threads) {
+		t.Fatalf("%+v", threads)
+	}
+	// Retrieving unread messages marks them read
+	if unread := bank.GetUnread("mum", MessageDirectionIncoming); len(unread) != 2 || unread[0].Read {
+		t.Fatalf("%+v", unread)
+	}
+	if unread := bank.GetUnread("mum", MessageDirectionIncoming); len(unread) != 0 {
+		t.Fatalf("%+v", unread)
+	}
+	if messages := bank.Get("mum", MessageDirectionIncoming); len(messages) != 2 || !messages[0].Read || !messages[1].Read {
+		t.Fatalf("%+v", messages)
+	}
+	if n := bank.MarkRead("dad", MessageDirectionOutgoing); n != 1 {
+		t.Fatal(n)
+	}
+	// The number of threads is limited
+	for i := len(bank.Threads()); i < MessageBankMaxThreads; i++ {
+		if err := bank.Store(fmt.Sprintf("tag%d", i), MessageDirectionIncoming, earlier, "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bank.Store("onetoomany", MessageDirectionIncoming, earlier, "hello"); err == nil {
+		t.Fatal("should have failed")
+	}
+	// Expired threads no longer count toward the limit
+	if removed := bank.ExpireBefore(later); removed != MessageBankMaxThreads {
+		t.Fatal(removed)
+	}
+	if err := bank.Store("onetoomany", MessageDirectionIncoming, earlier, "hello"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessageBank_ExecuteThreads(t *testing.T) {
+	bank := &MessageBank{}
+	if err := bank.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if result := bank.Execute(context.Background(), Command{Content: "s mum in alpha"}); result.Error != nil || result.Output != MessageBankDefaultStoreResponse {
+		t.Fatalf("%+v", result)
+	}
+	if err := bank.Store("mum", MessageDirectionOutgoing, time.Now(), "beta"); err != nil {
+		t.Fatal(err)
+	}
+	if result := bank.Execute(context.Background(), Command{Content: "t"}); result.Error != nil || !strings.Contains(result.Output, "mum") || !strings.Contains(result.Output, "unread in:1 out:1") {
+		t.Fatalf("%+v", result)
+	}
+	// The operator reads the incoming message
+	if result := bank.Execute(context.Background(), Command{Content: "u mum in"}); result.Error != nil || !strings.Contains(result.Output, "alpha") {
+		t.Fatalf("%+v", result)
+	}
+	if result := bank.Execute(context.Background(), Command{Content: "u mum in"}); result.Error != nil || result.Output != "" {
+		t.Fatalf("%+v", result)
+	}
+	// The correspondent receives the latest outgoing message in response to their message
+	if result := bank.Execute(context.Background(), Command{Content: "s mum in gamma"}); result.Error != nil || !strings.Contains(result.Output, "beta") {
+		t.Fatalf("%+v", result)
+	}
+	if result := bank.Execute(context.Background(), Command{Content: "t"}); result.Error != nil || !strings.Contains(result.Output, "unread in:1 out:0") {
+		t.Fatalf("%+v", result)
+	}
+}
+
+func TestMessageBank_DeleteAndListener(t *testing.T) {
+	bank := &MessageBank{}
+	if err := bank.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	var notified []string
+	bank.SetStoreListener(func(tag, direction string, msg Message) {
+		// The listener may use the message bank
+		notified = append(notified, fmt.Sprintf("%s %s %v %d", tag, direction, msg.Content, len(bank.Get(tag, direction))))
+	})
+	if err := bank.Store("mum", MessageDirectionIncoming, time.Now(), "alpha"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bank.Store("mum", MessageDirectionOutgoing, time.Now(), "beta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bank.Store("mum", "bad", time.Now(), "gamma"); err == nil {
+		t.Fatal("did not error")
+	}
+	if !reflect.DeepEqual(notified, []string{"mum in alpha 1", "mum out beta 1"}) {
+		t.Fatalf("%+v", notified)
+	}
+	bank.SetStoreListener(nil)
+	if err := bank.Store("dad", MessageDirectionIncoming, time.Now(), "delta"); err != nil || len(notified) != 2 {
+		t.Fatal(err, notified)
+	}
+	// Delete a direction and then the entire thread
+	if removed := bank.Delete("mum", MessageDirectionIncoming); removed != 1 {
+		t.Fatal(removed)
+	}
+	if threads := bank.Threads(); len(threads) != 2 || threads[1].UnreadOutgoing != 1 {
+		t.Fatalf("%+v", threads)
+	}
+	if removed := bank.Delete("mum", ""); removed != 1 {
+		t.Fatal(removed)
+	}
+	if removed := bank.Delete("nobody", ""); removed != 0 {
+		t.Fatal(removed)
+	}
+	if threads := bank.Threads(); len(threads) != 1 || threads[0].Tag != "dad" {
+		t.Fatalf("%+v", threads)
+	}
+}
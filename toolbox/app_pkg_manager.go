@@ -0,0 +1,207 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/platform"
+)
+
+// PackageManagerTrigger is the trigger prefix string of PackageManager feature.
+const PackageManagerTrigger = ".pkg"
+
+var ErrBadPackageManagerUsage = errors.New(`search NAME | install NAME | remove NAME | updates`)
+
+// RegexPackageName matches a software package name, which must not look like a command line flag.
+var RegexPackageName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.+_:@-]*$`)
+
+// packageManagerCommands are the command line arguments that carry out the operations of a system package manager.
+type packageManagerCommands struct {
+	env []string
+	// refresh updates the package manifests ahead of installing a package or listing updates.
+	refresh []string
+	search  []string
+	install []string
+	remove  []string
+	updates []string
+	// updatesExitCode is the exit status of listing updates when there are updates available, it is not an error.
+	updatesExitCode int
+}
+
+// packageManagers are the supported system package managers, in the order of preference.
+var packageManagers = []struct {
+	name     string
+	commands packageManagerCommands
+}{
+	{"dnf", packageManagerCommands{
+		search: []string{"-q", "search"}, install: []string{"-y", "install"}, remove: []string{"-y", "remove"},
+		updates: []string{"-q", "check-update"}, updatesExitCode: 100,
+	}},
+	{"yum", packageManagerCommands{
+		search: []string{"-q", "search"}, install: []string{"-y", "install"}, remove: []string{"-y", "remove"},
+		updates: []string{"-q", "check-update"}, updatesExitCode: 100,
+	}},
+	// Prefer zypper over apt because opensuse has a weird "apt wrapper" that is not remotely functional.
+	{"zypper", packageManagerCommands{
+		search: []string{"--non-interactive", "search"}, install: []string{"--non-interactive", "install", "--auto-agree-with-licenses"},
+		remove: []string{"--non-interactive", "remove"}, updates: []string{"--non-interactive", "list-updates"},
+	}},
+	{"apt", packageManagerCommands{
+		env: []string{"DEBIAN_FRONTEND=noninteractive"}, refresh: []string{"-q", "update"},
+		search: []string{"-q", "search", "--names-only"}, install: []string{"-q", "-y", "install"}, remove: []string{"-q", "-y", "remove"},
+		updates: []string{"-q", "list", "--upgradable"},
+	}},
+	{"choco", packageManagerCommands{
+		search: []string{"search", "--limit-output"}, install: []string{"install", "-y", "--no-progress"},
+		remove: []string{"uninstall", "-y"}, updates: []string{"outdated", "--limit-output"},
+	}},
+}
+
+/*
+PackageManager uses the system package manager to search for software, install and remove the software packages from
+an approved list, and list the available updates. It lets the operator install a missing diagnosis tool remotely
+without having to grant access to the unrestricted shell.
+*/
+type PackageManager struct {
+	// AllowedPackages are the names of the software packages that may be installed and removed.
+	AllowedPackages []string `json:"AllowedPackages"`
+	// Name is the name of the package manager - dnf, yum, zypper, apt, or choco. It is automatically discovered by default.
+	Name string `json:"Name"`
+	// ExecutablePath is the path to the package manager executable. It is automatically discovered by default.
+	ExecutablePath string `json:"ExecutablePath"`
+
+	commands packageManagerCommands
+	logger   *lalog.Logger
+}
+
+// findPackageManager returns the path to the executable of the package manager, or an empty string if it is not found.
+func findPackageManager(name string) string {
+	var candidates []string
+	if platform.HostIsWindows() {
+		if name == "choco" && os.Getenv("ChocolateyInstall") != "" {
+			candidates = append(candidates, filepath.Join(os.Getenv("ChocolateyInstall"), "bin", "choco.exe"))
+		}
+	} else {
+		for _, binPrefix := range []string{"/sbin", "/bin", "/usr/sbin", "/usr/bin", "/usr/local/sbin", "/usr/local/bin"} {
+			candidates = append(candidates, filepath.Join(binPrefix, name))
+		}
+	}
+	for _, execPath := range candidates {
+		if _, err := os.Stat(execPath); err == nil {
+			return execPath
+		}
+	}
+	execPath, _ := exec.LookPath(name)
+	return execPath
+}
+
+func (pkg *PackageManager) IsConfigured() bool {
+	return len(pkg.AllowedPackages) > 0
+}
+
+func (pkg *PackageManager) SelfTest() error {
+	if _, err := os.Stat(pkg.ExecutablePath); err != nil {
+		return fmt.Errorf("PackageManager.SelfTest: failed to find %s executable - %w", pkg.Name, err)
+	}
+	return nil
+}
+
+func (pkg *PackageManager) Initialise() error {
+	pkg.logger = &lalog.Logger{ComponentName: "PackageManager"}
+	for _, name := range pkg.AllowedPackages {
+		if !RegexPackageName.MatchString(name) {
+			return fmt.Errorf("PackageManager.Initialise: \"%s\" is not a valid package name", name)
+		}
+	}
+	if pkg.Name == "" && pkg.ExecutablePath != "" {
+		pkg.Name = strings.TrimSuffix(strings.ToLower(filepath.Base(pkg.ExecutablePath)), ".exe")
+	}
+	for _, manager := range packageManagers {
+		if pkg.Name != "" && pkg.Name != manager.name {
+			continue
+		}
+		execPath := pkg.ExecutablePath
+		if execPath == "" {
+			execPath = findPackageManager(manager.name)
+		}
+		if execPath != "" {
+			pkg.Name = manager.name
+			pkg.ExecutablePath = execPath
+			pkg.commands = manager.commands
+			return nil
+		}
+	}
+	if pkg.Name != "" {
+		return fmt.Errorf("PackageManager.Initialise: failed to find package manager \"%s\", it must be one of dnf, yum, zypper, apt, or choco", pkg.Name)
+	}
+	return errors.New("PackageManager.Initialise: failed to find a supported package manager (dnf, yum, zypper, apt, or choco)")
+}
+
+func (pkg *PackageManager) Trigger() Trigger {
+	return PackageManagerTrigger
+}
+
+func (pkg *PackageManager) Execute(ctx context.Context, cmd Command) *Result {
+	if errResult := cmd.Trim(); errResult != nil {
+		return &Result{Error: fmt.Errorf("%v (approved packages: %s)", ErrBadPackageManagerUsage, strings.Join(pkg.AllowedPackages, ", "))}
+	}
+	verb, name := splitFirstWord(cmd.Content)
+	verb = strings.ToLower(verb)
+	switch verb {
+	case "updates":
+		if name != "" {
+			return &Result{Error: ErrBadPackageManagerUsage}
+		}
+		return pkg.invoke(cmd, true, pkg.commands.updatesExitCode, pkg.commands.updates)
+	case "search":
+		if !RegexPackageName.MatchString(name) {
+			return &Result{Error: errors.New("the search term must be a package name")}
+		}
+		return pkg.invoke(cmd, false, 0, pkg.commands.search, name)
+	case "install", "remove":
+		if !slices.Contains(pkg.AllowedPackages, name) {
+			return &Result{Error: fmt.Errorf("\"%s\" is not among the approved packages: %s", name, strings.Join(pkg.AllowedPackages, ", "))}
+		}
+		pkg.logger.Info(name, nil, "%s the package as requested", verb)
+		if verb == "install" {
+			return pkg.invoke(cmd, true, 0, pkg.commands.install, name)
+		}
+		return pkg.invoke(cmd, false, 0, pkg.commands.remove, name)
+	default:
+		return &Result{Error: ErrBadPackageManagerUsage}
+	}
+}
+
+/*
+invoke runs the package manager with the arguments of an operation followed by the package name (if any), and returns
+its output. If refresh is true, the package manifests are refreshed ahead of the operation. The non-zero exit status
+okExitCode does not indicate an error.
+*/
+func (pkg *PackageManager) invoke(cmd Command, refresh bool, okExitCode int, args []string, name ...string) *Result {
+	opts := platform.ProgramOptions{}
+	if cmd.LiveOutput != nil {
+		opts.OnOutput = func(chunk []byte) {
+			_, _ = cmd.LiveOutput.Write(chunk)
+		}
+	}
+	// The failure to refresh package manifests is not fatal, the operation may still succeed with the existing manifests.
+	if refresh && len(pkg.commands.refresh) > 0 {
+		if out, err := platform.InvokeProgramWithOptions(pkg.commands.env, cmd.TimeoutSec, opts, pkg.ExecutablePath, pkg.commands.refresh...); err != nil {
+			pkg.logger.Info("", err, "failed to refresh package manifests - %s", strings.TrimSpace(out))
+		}
+	}
+	out, err := platform.InvokeProgramWithOptions(pkg.commands.env, cmd.TimeoutSec, opts, pkg.ExecutablePath, append(slices.Clone(args), name...)...)
+	var exitErr *exec.ExitError
+	if okExitCode != 0 && errors.As(err, &exitErr) && exitErr.ExitCode() == okExitCode {
+		err = nil
+	}
+	return &Result{Error: err, Output: strings.TrimSpace(out)}
+}
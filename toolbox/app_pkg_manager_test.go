@@ -0,0 +1,57 @@
+package toolbox
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/platform"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageManager_Execute(t *testing.T) {
+	platform.SkipIfWindows(t)
+	// The fake package manager prints its arguments, and exits with status 100 when checking for updates like dnf does.
+	execPath := filepath.Join(t.TempDir(), "dnf")
+	require.NoError(t, os.WriteFile(execPath, []byte("#!/bin/sh\necho \"$@\"\n[ \"$2\" = check-update ] && exit 100\nexit 0\n"), 0700))
+
+	pkg := PackageManager{}
+	require.False(t, pkg.IsConfigured())
+	pkg = PackageManager{AllowedPackages: []string{"-rf"}, ExecutablePath: execPath}
+	require.Error(t, pkg.Initialise())
+	pkg = PackageManager{AllowedPackages: []string{"htop"}, Name: "pacman"}
+	require.Error(t, pkg.Initialise())
+	pkg = PackageManager{AllowedPackages: []string{"htop", "tcpdump"}, ExecutablePath: execPath}
+	require.True(t, pkg.IsConfigured())
+	require.NoError(t, pkg.Initialise())
+	require.Equal(t, "dnf", pkg.Name)
+	require.NoError(t, pkg.SelfTest())
+
+	execute := func(content string) *Result {
+		return pkg.Execute(context.Background(), Command{TimeoutSec: 10, Content: content})
+	}
+	result := execute("")
+	require.ErrorContains(t, result.Error, "htop, tcpdump")
+	require.ErrorIs(t, execute("upgrade everything").Error, ErrBadPackageManagerUsage)
+
+	result = execute("search net-tools")
+	require.NoError(t, result.Error)
+	require.Equal(t, "-q search net-tools", result.Output)
+	require.Error(t, execute("search --help").Error)
+	require.Error(t, execute("search a;b").Error)
+
+	result = execute("install htop")
+	require.NoError(t, result.Error)
+	require.Equal(t, "-y install htop", result.Output)
+	result = execute("REMOVE tcpdump")
+	require.NoError(t, result.Error)
+	require.Equal(t, "-y remove tcpdump", result.Output)
+	require.ErrorContains(t, execute("install nmap").Error, "not among the approved packages")
+	require.Error(t, execute("remove htop tcpdump").Error)
+
+	// The exit status 100 of dnf tells that there are updates available.
+	result = execute("updates")
+	require.NoError(t, result.Error)
+	require.Equal(t, "-q check-update", result.Output)
+}
@@ -0,0 +1,323 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/platform"
+)
+
+const (
+	// PresenceTrigger is the trigger prefix string of Presence feature.
+	PresenceTrigger = ".home"
+	// PresenceProbeTimeoutSec is the timeout of each probe (ping, l2ping, arp) made to detect a device.
+	PresenceProbeTimeoutSec = 5
+	// PresenceDefaultAwayAfterSec is the default number of seconds since a device was last seen before it is considered away.
+	PresenceDefaultAwayAfterSec = 600
+	// PresenceActionTimeoutSec is the timeout of the shell command that runs when presence changes.
+	PresenceActionTimeoutSec = 60
+)
+
+var (
+	ErrBadPresenceParam = errors.New(`example: (empty) | anyone | name`)
+	// regexNeighbourMAC finds the MAC addresses in the output of "arp -a", the leading zero may be absent (e.g. "a:b:c:d:e:f").
+	regexNeighbourMAC = regexp.MustCompile(`\b([0-9a-fA-F]{1,2}[:-]){5}[0-9a-fA-F]{1,2}\b`)
+)
+
+// normaliseMAC returns the MAC address in lower case, colon-separated, and with leading zeros, or an empty string if it is not valid.
+func normaliseMAC(mac string) string {
+	octets := strings.FieldsFunc(strings.TrimSpace(mac), func(r rune) bool { return r == ':' || r == '-' })
+	if len(octets) != 6 {
+		return ""
+	}
+	for i, octet := range octets {
+		if len(octet) == 1 {
+			octets[i] = "0" + octet
+		}
+	}
+	hwAddr, err := net.ParseMAC(strings.Join(octets, ":"))
+	if err != nil {
+		return ""
+	}
+	return hwAddr.String()
+}
+
+// readNeighbourMACs returns the MAC addresses of the devices in the ARP neighbour table of the host.
+func readNeighbourMACs() (map[string]struct{}, error) {
+	ret := make(map[string]struct{})
+	if content, err := os.ReadFile("/proc/net/arp"); err == nil {
+		// IP address, HW type, flags, HW address, mask, device
+		for _, line := range strings.Split(string(content), "\n")[1:] {
+			if fields := strings.Fields(line); len(fields) >= 4 && fields[2] != "0x0" {
+				if mac := normaliseMAC(fields[3]); mac != "" && mac != "00:00:00:00:00:00" {
+					ret[mac] = struct{}{}
+				}
+			}
+		}
+		return ret, nil
+	}
+	args := []string{"-an"}
+	if runtime.GOOS == "windows" {
+		args = []string{"-a"}
+	}
+	out, err := platform.InvokeProgram(nil, PresenceProbeTimeoutSec, "arp", args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range regexNeighbourMAC.FindAllString(out, -1) {
+		if mac := normaliseMAC(match); mac != "" {
+			ret[mac] = struct{}{}
+		}
+	}
+	return ret, nil
+}
+
+// pingHost returns true if the host answers a single ICMP echo request.
+func pingHost(host string) bool {
+	var args []string
+	switch runtime.GOOS {
+	case "windows":
+		args = []string{"-n", "1", "-w", "2000", host}
+	case "darwin":
+		args = []string{"-c", "1", "-W", "2000", host}
+	default:
+		args = []string{"-c", "1", "-W", "2", host}
+	}
+	_, err := platform.InvokeProgram(nil, PresenceProbeTimeoutSec, "ping", args...)
+	return err == nil
+}
+
+// pingBluetooth returns true if the bluetooth device is within range, the device does not have to be paired.
+func pingBluetooth(addr string) bool {
+	if _, err := platform.InvokeProgram(nil, PresenceProbeTimeoutSec, "l2ping", "-c", "1", "-t", "3", addr); err == nil {
+		return true
+	}
+	out, err := platform.InvokeProgram(nil, PresenceProbeTimeoutSec, "bluetoothctl", "info", addr)
+	return err == nil && strings.Contains(out, "Connected: yes")
+}
+
+// PresenceDevice is a device (e.g. a phone) carried by a household member, its presence on the LAN tells whether the member is home.
+type PresenceDevice struct {
+	// Name is the name of the device or its owner, e.g. "alice".
+	Name string `json:"Name"`
+	// MACAddress is the (optional) Wi-Fi MAC address of the device, which is looked up in the ARP neighbour table.
+	MACAddress string `json:"MACAddress"`
+	// HostName is the (optional) host name or IP address of the device, which is pinged.
+	HostName string `json:"HostName"`
+	// BluetoothAddress is the (optional) bluetooth MAC address of the device, which is pinged via l2ping or bluetoothctl.
+	BluetoothAddress string `json:"BluetoothAddress"`
+	// OnArrival is an (optional) shell command to run when the device arrives.
+	OnArrival string `json:"OnArrival"`
+	// OnDeparture is an (optional) shell command to run when the device departs.
+	OnDeparture string `json:"OnDeparture"`
+
+	lastSeen  time.Time
+	seenVia   string
+	isPresent bool
+}
+
+/*
+Presence detects whether the household members are home by looking for their devices on the LAN, via the ARP neighbour
+table, ping, and bluetooth. A device is considered away only after it has not been seen for a while, as phones often
+doze off the network. The presence is determined each time the app command runs, running the app command regularly
+(e.g. as recurring commands) allows the shell commands associated with arrival and departure to automate the home.
+*/
+type Presence struct {
+	// Devices are the devices to look for on the LAN.
+	Devices []*PresenceDevice `json:"Devices"`
+	// AwayAfterSec is the number of seconds since a device was last seen before it is considered away.
+	AwayAfterSec int `json:"AwayAfterSec"`
+	// OnFirstArrival is an (optional) shell command to run when a device arrives at an empty home.
+	OnFirstArrival string `json:"OnFirstArrival"`
+	// OnEveryoneLeft is an (optional) shell command to run when the last device departs.
+	OnEveryoneLeft string `json:"OnEveryoneLeft"`
+
+	// probe returns the method by which the device is seen, or an empty string if the device is not seen.
+	probe func(device *PresenceDevice, neighbours map[string]struct{}) string
+	// runAction runs the shell command associated with a change of presence.
+	runAction func(shellCommand string)
+	mutex     *sync.Mutex
+	logger    *lalog.Logger
+}
+
+func (presence *Presence) IsConfigured() bool {
+	return len(presence.Devices) > 0
+}
+
+func (presence *Presence) SelfTest() error {
+	if !presence.IsConfigured() {
+		return ErrIncompleteConfig
+	}
+	return nil
+}
+
+func (presence *Presence) Initialise() error {
+	presence.logger = &lalog.Logger{ComponentName: "Presence"}
+	presence.mutex = new(sync.Mutex)
+	if presence.AwayAfterSec < 1 {
+		presence.AwayAfterSec = PresenceDefaultAwayAfterSec
+	}
+	names := make(map[string]struct{})
+	for i, device := range presence.Devices {
+		if device == nil || device.Name == "" {
+			return fmt.Errorf("Presence.Initialise: device at index %d must have a name", i)
+		}
+		if _, exists := names[strings.ToLower(device.Name)]; exists {
+			return fmt.Errorf("Presence.Initialise: device name \"%s\" is used more than once", device.Name)
+		}
+		names[strings.ToLower(device.Name)] = struct{}{}
+		if device.MACAddress == "" && device.HostName == "" && device.BluetoothAddress == "" {
+			return fmt.Errorf("Presence.Initialise: device \"%s\" must have a MAC address, host name, or bluetooth address", device.Name)
+		}
+		if device.MACAddress != "" {
+			if device.MACAddress = normaliseMAC(device.MACAddress); device.MACAddress == "" {
+				return fmt.Errorf("Presence.Initialise: device \"%s\" has an invalid MAC address", device.Name)
+			}
+		}
+		if device.BluetoothAddress != "" {
+			if normaliseMAC(device.BluetoothAddress) == "" {
+				return fmt.Errorf("Presence.Initialise: device \"%s\" has an invalid bluetooth address", device.Name)
+			}
+			device.BluetoothAddress = strings.ToUpper(normaliseMAC(device.BluetoothAddress))
+		}
+	}
+	if presence.probe == nil {
+		presence.probe = probeDevice
+	}
+	if presence.runAction == nil {
+		presence.runAction = func(shellCommand string) {
+			if out, err := platform.InvokeShell(PresenceActionTimeoutSec, platform.GetDefaultShellInterpreter(), shellCommand); err != nil {
+				presence.logger.Warning("", err, "the shell command failed - %s", out)
+			}
+		}
+	}
+	return nil
+}
+
+// Trigger returns the trigger prefix string ".home".
+func (presence *Presence) Trigger() Trigger {
+	return PresenceTrigger
+}
+
+// probeDevice looks for the device on the LAN via ping, the ARP neighbour table, and bluetooth, in that order.
+func probeDevice(device *PresenceDevice, neighbours map[string]struct{}) string {
+	if device.HostName != "" && pingHost(device.HostName) {
+		return "ping"
+	}
+	if device.MACAddress != "" {
+		if _, found := neighbours[device.MACAddress]; found {
+			return "arp"
+		}
+	}
+	if device.BluetoothAddress != "" && pingBluetooth(device.BluetoothAddress) {
+		return "bluetooth"
+	}
+	return ""
+}
+
+// detect probes all devices in parallel, updates their presence, and runs the shell commands associated with the changes.
+func (presence *Presence) detect() {
+	neighbours, err := readNeighbourMACs()
+	if err != nil {
+		presence.logger.Warning("", err, "failed to read ARP neighbour table")
+	}
+	seenVia := make([]string, len(presence.Devices))
+	wg := new(sync.WaitGroup)
+	for i, device := range presence.Devices {
+		wg.Add(1)
+		go func(i int, device *PresenceDevice) {
+			defer wg.Done()
+			seenVia[i] = presence.probe(device, neighbours)
+		}(i, device)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	wasOccupied, isOccupied := false, false
+	actions := make([]string, 0)
+	for i, device := range presence.Devices {
+		wasOccupied = wasOccupied || device.isPresent
+		if seenVia[i] != "" {
+			device.lastSeen = now
+			device.seenVia = seenVia[i]
+		}
+		nowPresent := !device.lastSeen.IsZero() && now.Sub(device.lastSeen) < time.Duration(presence.AwayAfterSec)*time.Second
+		if nowPresent && !device.isPresent && device.OnArrival != "" {
+			actions = append(actions, device.OnArrival)
+		} else if !nowPresent && device.isPresent && device.OnDeparture != "" {
+			actions = append(actions, device.OnDeparture)
+		}
+		if nowPresent != device.isPresent {
+			presence.logger.Info(device.Name, nil, "presence changed to %v", nowPresent)
+		}
+		device.isPresent = nowPresent
+		isOccupied = isOccupied || nowPresent
+	}
+	if isOccupied && !wasOccupied && presence.OnFirstArrival != "" {
+		actions = append(actions, presence.OnFirstArrival)
+	} else if !isOccupied && wasOccupied && presence.OnEveryoneLeft != "" {
+		actions = append(actions, presence.OnEveryoneLeft)
+	}
+	// Run the shell commands in the background so that they do not delay the app command response
+	for _, action := range actions {
+		go presence.runAction(action)
+	}
+}
+
+// describe returns the presence of the device in a short sentence.
+func (device *PresenceDevice) describe() string {
+	if device.isPresent {
+		return fmt.Sprintf("%s is home (%s)", device.Name, device.seenVia)
+	} else if device.lastSeen.IsZero() {
+		return fmt.Sprintf("%s is away", device.Name)
+	}
+	return fmt.Sprintf("%s is away (last seen %s)", device.Name, device.lastSeen.Format("2006-01-02 15:04"))
+}
+
+func (presence *Presence) Execute(ctx context.Context, cmd Command) *Result {
+	presence.mutex.Lock()
+	defer presence.mutex.Unlock()
+	presence.detect()
+	param := strings.ToLower(strings.TrimSpace(cmd.Content))
+	switch param {
+	case "":
+		lines := make([]string, 0, len(presence.Devices))
+		numHome := 0
+		for _, device := range presence.Devices {
+			if device.isPresent {
+				numHome++
+			}
+			lines = append(lines, device.describe())
+		}
+		return &Result{Output: fmt.Sprintf("%d of %d home\n%s", numHome, len(presence.Devices), strings.Join(lines, "\n"))}
+	case "anyone":
+		home := make([]string, 0)
+		for _, device := range presence.Devices {
+			if device.isPresent {
+				home = append(home, device.Name)
+			}
+		}
+		if len(home) == 0 {
+			return &Result{Output: "no"}
+		}
+		sort.Strings(home)
+		return &Result{Output: "yes - " + strings.Join(home, ", ")}
+	default:
+		for _, device := range presence.Devices {
+			if strings.ToLower(device.Name) == param {
+				return &Result{Output: device.describe()}
+			}
+		}
+		return &Result{Error: ErrBadPresenceParam}
+	}
+}
@@ -0,0 +1,93 @@
+package toolbox
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNormaliseMAC(t *testing.T) {
+	for input, want := range map[string]string{
+		"AA-BB-CC-DD-EE-FF": "aa:bb:cc:dd:ee:ff",
+		"a:b:c:d:e:f":       "0a:0b:0c:0d:0e:0f",
+		"aa:bb:cc:dd:ee":    "",
+		"zz:bb:cc:dd:ee:ff": "",
+	} {
+		if got := normaliseMAC(input); got != want {
+			t.Fatal(input, got)
+		}
+	}
+}
+
+func TestPresence_Execute(t *testing.T) {
+	presence := Presence{}
+	if presence.IsConfigured() {
+		t.Fatal("should not be configured")
+	}
+	presence.Devices = []*PresenceDevice{{Name: "alice"}}
+	if err := presence.Initialise(); err == nil {
+		t.Fatal("did not reject device without address")
+	}
+	presence.Devices = []*PresenceDevice{{Name: "alice", MACAddress: "1:2:3:4:5"}}
+	if err := presence.Initialise(); err == nil {
+		t.Fatal("did not reject invalid MAC address")
+	}
+
+	var mutex sync.Mutex
+	seen := map[string]string{"Alice": "arp"}
+	actions := make(chan string, 10)
+	presence = Presence{
+		Devices: []*PresenceDevice{
+			{Name: "Alice", MACAddress: "AA-BB-CC-DD-EE-FF", OnArrival: "alice-arrived", OnDeparture: "alice-left"},
+			{Name: "bob", BluetoothAddress: "aa:bb:cc:dd:ee:00"},
+		},
+		AwayAfterSec:   1,
+		OnFirstArrival: "first-arrival",
+		OnEveryoneLeft: "everyone-left",
+		probe: func(device *PresenceDevice, _ map[string]struct{}) string {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return seen[device.Name]
+		},
+		runAction: func(shellCommand string) { actions <- shellCommand },
+	}
+	if err := presence.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if presence.Devices[0].MACAddress != "aa:bb:cc:dd:ee:ff" || presence.Devices[1].BluetoothAddress != "AA:BB:CC:DD:EE:00" {
+		t.Fatal(presence.Devices[0], presence.Devices[1])
+	}
+	// Alice is seen at home
+	if ret := presence.Execute(context.Background(), Command{Content: ""}); ret.Error != nil || ret.Output != "1 of 2 home\nAlice is home (arp)\nbob is away" {
+		t.Fatal(ret)
+	}
+	got := map[string]bool{<-actions: true, <-actions: true}
+	if !got["alice-arrived"] || !got["first-arrival"] {
+		t.Fatal(got)
+	}
+	if ret := presence.Execute(context.Background(), Command{Content: "anyone"}); ret.Error != nil || ret.Output != "yes - Alice" {
+		t.Fatal(ret)
+	}
+	if ret := presence.Execute(context.Background(), Command{Content: "BOB"}); ret.Error != nil || ret.Output != "bob is away" {
+		t.Fatal(ret)
+	}
+	if ret := presence.Execute(context.Background(), Command{Content: "carol"}); ret.Error != ErrBadPresenceParam {
+		t.Fatal(ret)
+	}
+	// Alice is no longer seen, she remains home until AwayAfterSec elapses.
+	mutex.Lock()
+	delete(seen, "Alice")
+	mutex.Unlock()
+	if ret := presence.Execute(context.Background(), Command{Content: "alice"}); ret.Error != nil || ret.Output != "Alice is home (arp)" {
+		t.Fatal(ret)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if ret := presence.Execute(context.Background(), Command{Content: "anyone"}); ret.Error != nil || ret.Output != "no" {
+		t.Fatal(ret)
+	}
+	got = map[string]bool{<-actions: true, <-actions: true}
+	if !got["alice-left"] || !got["everyone-left"] {
+		t.Fatal(got)
+	}
+}
@@ -0,0 +1,111 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	// QRCodeTrigger is the trigger prefix string of QRCode feature.
+	QRCodeTrigger = ".qr"
+	// QRCodePNGPrefix asks the feature to store the QR code in a PNG picture instead of drawing it in text.
+	QRCodePNGPrefix = "png "
+	// QRCodePNGScale is the size in pixels of each module of a QR code PNG picture.
+	QRCodePNGScale = 8
+)
+
+var ErrQRCodeStorageNotConfigured = errors.New("file storage is not available")
+
+// QRCodeFileStorage stores the QR code pictures for visitors to download.
+type QRCodeFileStorage interface {
+	// StoreFile stores the content in a file of the extension name (e.g. ".png") and returns the random file name.
+	StoreFile(ctx context.Context, fileExt string, content io.Reader) (string, error)
+}
+
+/*
+QRCode renders a short text or URL as a QR code, e.g. to transfer wifi credentials or a URL to a phone. The QR code is
+drawn in text by default, or stored as a PNG picture in the file storage of the web server.
+*/
+type QRCode struct {
+	storage QRCodeFileStorage
+	mutex   *sync.Mutex
+}
+
+// IsConfigured always returns true, though PNG pictures cannot be stored until the file storage is made available by SetFileStorage.
+func (qr *QRCode) IsConfigured() bool {
+	return true
+}
+
+// SelfTest always returns nil.
+func (qr *QRCode) SelfTest() error {
+	return nil
+}
+
+// Initialise prepares the internal states of the feature.
+func (qr *QRCode) Initialise() error {
+	if qr.mutex == nil {
+		qr.mutex = new(sync.Mutex)
+	}
+	return nil
+}
+
+// Trigger returns the trigger prefix string ".qr".
+func (qr *QRCode) Trigger() Trigger {
+	return QRCodeTrigger
+}
+
+// SetFileStorage gives the feature the file storage to store QR code pictures in.
+func (qr *QRCode) SetFileStorage(storage QRCodeFileStorage) {
+	if qr.mutex == nil {
+		qr.mutex = new(sync.Mutex)
+	}
+	qr.mutex.Lock()
+	defer qr.mutex.Unlock()
+	qr.storage = storage
+}
+
+func (qr *QRCode) getFileStorage() QRCodeFileStorage {
+	qr.mutex.Lock()
+	defer qr.mutex.Unlock()
+	return qr.storage
+}
+
+// Execute encodes the text in a QR code and draws it in text, or stores it as a PNG picture if the text begins with "png".
+func (qr *QRCode) Execute(ctx context.Context, cmd Command) *Result {
+	if errResult := cmd.Trim(); errResult != nil {
+		return &Result{Error: errors.New("[png] text")}
+	}
+	if cmd.Content != strings.TrimSpace(QRCodePNGPrefix) && !strings.HasPrefix(cmd.Content, QRCodePNGPrefix) {
+		code, err := EncodeQRCode([]byte(cmd.Content))
+		if err != nil {
+			return &Result{Error: err}
+		}
+		return &Result{Output: code.Text()}
+	}
+	text := strings.TrimSpace(strings.TrimPrefix(cmd.Content, strings.TrimSpace(QRCodePNGPrefix)))
+	if text == "" {
+		return &Result{Error: errors.New("[png] text")}
+	}
+	storage := qr.getFileStorage()
+	if storage == nil {
+		return &Result{Error: ErrQRCodeStorageNotConfigured}
+	}
+	code, err := EncodeQRCode([]byte(text))
+	if err != nil {
+		return &Result{Error: err}
+	}
+	picture, err := code.PNG(QRCodePNGScale)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	fileName, err := storage.StoreFile(ctx, ".png", bytes.NewReader(picture))
+	if err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: fmt.Sprintf("download %s from file storage within 24 hours", fileName)}
+}
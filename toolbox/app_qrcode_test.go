@@ -0,0 +1,55 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type dummyQRCodeFileStorage struct {
+	files map[string][]byte
+}
+
+func (dummy *dummyQRCodeFileStorage) StoreFile(_ context.Context, fileExt string, content io.Reader) (string, error) {
+	if fileExt != ".png" {
+		return "", errors.New("unexpected extension name")
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return "", err
+	}
+	dummy.files["0123456789.png"] = data
+	return "0123456789.png", nil
+}
+
+func TestQRCode_Execute(t *testing.T) {
+	qr := &QRCode{}
+	require.True(t, qr.IsConfigured())
+	require.NoError(t, qr.Initialise())
+	require.NoError(t, qr.SelfTest())
+	require.EqualError(t, qr.Execute(context.Background(), Command{Content: " "}).Error, "[png] text")
+	require.Error(t, qr.Execute(context.Background(), Command{Content: strings.Repeat("a", 300)}).Error)
+
+	// Draw the QR code in text
+	result := qr.Execute(context.Background(), Command{Content: "https://example.com"})
+	require.NoError(t, result.Error)
+	symbol, err := EncodeQRCode([]byte("https://example.com"))
+	require.NoError(t, err)
+	require.Equal(t, symbol.Text(), result.Output)
+
+	// Store the QR code in a PNG picture
+	require.Equal(t, ErrQRCodeStorageNotConfigured, qr.Execute(context.Background(), Command{Content: "png https://example.com"}).Error)
+	storage := &dummyQRCodeFileStorage{files: make(map[string][]byte)}
+	qr.SetFileStorage(storage)
+	require.EqualError(t, qr.Execute(context.Background(), Command{Content: "png  "}).Error, "[png] text")
+	result = qr.Execute(context.Background(), Command{Content: "png https://example.com"})
+	require.NoError(t, result.Error)
+	require.Equal(t, "download 0123456789.png from file storage within 24 hours", result.Output)
+	picture, err := symbol.PNG(QRCodePNGScale)
+	require.NoError(t, err)
+	require.Equal(t, picture, storage.files["0123456789.png"])
+}
@@ -0,0 +1,136 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// RecurringCommandsControlTrigger is the trigger prefix string of RecurringCommandsControl feature.
+	RecurringCommandsControlTrigger = ".rc"
+)
+
+var (
+	RecurringCommandsRegexAdd    = regexp.MustCompile(`^add\s+([\w-]+)\s+(\d+)\s+(\d+)$`)
+	RecurringCommandsRegexCmd    = regexp.MustCompile(`^cmd\s+([\w-]+)\s+(.+)$`)
+	RecurringCommandsRegexRemove = regexp.MustCompile(`^rm\s+([\w-]+)$`)
+	RecurringCommandsRegexList   = regexp.MustCompile(`^list$`)
+
+	ErrRecurringCommandsNotConfigured = errors.New("recurring commands are not configured")
+)
+
+// RecurringCommandChannel summarises a channel of recurring commands.
+type RecurringCommandChannel struct {
+	Name        string
+	IntervalSec int
+	MaxResults  int
+	// NumCommands is the number of commands that run at regular interval.
+	NumCommands int
+	// Runtime is true if the channel was added at runtime, as opposed to being configured in JSON.
+	Runtime bool
+}
+
+// RecurringCommandChannels manages the channels of recurring commands.
+type RecurringCommandChannels interface {
+	// ListChannels returns the summary of all channels sorted by name.
+	ListChannels() []RecurringCommandChannel
+	// AddChannel adds a new channel at runtime.
+	AddChannel(name string, intervalSec, maxResults int) error
+	// AddChannelCommand adds a command to a channel that was added at runtime.
+	AddChannelCommand(name, cmd string) error
+	// RemoveChannel removes a channel that was added at runtime.
+	RemoveChannel(name string) error
+}
+
+/*
+RecurringCommandsControl adds, removes, and lists the channels of recurring commands at runtime, so that a new scheduled
+job does not require editing the JSON configuration and restarting the program.
+*/
+type RecurringCommandsControl struct {
+	channels RecurringCommandChannels
+	mutex    *sync.Mutex
+}
+
+// IsConfigured always returns true, though the commands will not work until the channels are made available by SetChannels.
+func (ctl *RecurringCommandsControl) IsConfigured() bool {
+	return true
+}
+
+// SelfTest always returns nil.
+func (ctl *RecurringCommandsControl) SelfTest() error {
+	return nil
+}
+
+// Initialise prepares the internal states of the feature.
+func (ctl *RecurringCommandsControl) Initialise() error {
+	if ctl.mutex == nil {
+		ctl.mutex = new(sync.Mutex)
+	}
+	return nil
+}
+
+// Trigger returns the trigger prefix string ".rc".
+func (ctl *RecurringCommandsControl) Trigger() Trigger {
+	return RecurringCommandsControlTrigger
+}
+
+// SetChannels gives the feature the recurring command channels to manage.
+func (ctl *RecurringCommandsControl) SetChannels(channels RecurringCommandChannels) {
+	if ctl.mutex == nil {
+		ctl.mutex = new(sync.Mutex)
+	}
+	ctl.mutex.Lock()
+	defer ctl.mutex.Unlock()
+	ctl.channels = channels
+}
+
+func (ctl *RecurringCommandsControl) getChannels() RecurringCommandChannels {
+	ctl.mutex.Lock()
+	defer ctl.mutex.Unlock()
+	return ctl.channels
+}
+
+// Execute adds, removes, or lists the channels of recurring commands.
+func (ctl *RecurringCommandsControl) Execute(ctx context.Context, cmd Command) *Result {
+	if errResult := cmd.Trim(); errResult != nil {
+		return &Result{Error: errors.New("list|add ch sec max|cmd ch cmd|rm ch")}
+	}
+	channels := ctl.getChannels()
+	if channels == nil {
+		return &Result{Error: ErrRecurringCommandsNotConfigured}
+	}
+	if params := RecurringCommandsRegexAdd.FindStringSubmatch(cmd.Content); len(params) == 4 {
+		intervalSec, _ := strconv.Atoi(params[2])
+		maxResults, _ := strconv.Atoi(params[3])
+		if err := channels.AddChannel(params[1], intervalSec, maxResults); err != nil {
+			return &Result{Error: err}
+		}
+		return &Result{Output: "added channel " + params[1]}
+	} else if params := RecurringCommandsRegexCmd.FindStringSubmatch(cmd.Content); len(params) == 3 {
+		if err := channels.AddChannelCommand(params[1], strings.TrimSpace(params[2])); err != nil {
+			return &Result{Error: err}
+		}
+		return &Result{Output: "added command to channel " + params[1]}
+	} else if params := RecurringCommandsRegexRemove.FindStringSubmatch(cmd.Content); len(params) == 2 {
+		if err := channels.RemoveChannel(params[1]); err != nil {
+			return &Result{Error: err}
+		}
+		return &Result{Output: "removed channel " + params[1]}
+	} else if RecurringCommandsRegexList.MatchString(cmd.Content) {
+		var out strings.Builder
+		for _, channel := range channels.ListChannels() {
+			origin := "json"
+			if channel.Runtime {
+				origin = "runtime"
+			}
+			out.WriteString(fmt.Sprintf("%s %s every %ds, %d cmds, %d results\n", channel.Name, origin, channel.IntervalSec, channel.NumCommands, channel.MaxResults))
+		}
+		return &Result{Output: out.String()}
+	}
+	return &Result{Error: errors.New("list|add ch sec max|cmd ch cmd|rm ch")}
+}
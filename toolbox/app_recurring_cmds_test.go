@@ -0,0 +1,50 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type dummyRecurringCommandChannels struct {
+	channels []RecurringCommandChannel
+	commands []string
+}
+
+func (dummy *dummyRecurringCommandChannels) ListChannels() []RecurringCommandChannel {
+	return dummy.channels
+}
+
+func (dummy *dummyRecurringCommandChannels) AddChannel(name string, intervalSec, maxResults int) error {
+	dummy.channels = append(dummy.channels, RecurringCommandChannel{Name: name, IntervalSec: intervalSec, MaxResults: maxResults, Runtime: true})
+	return nil
+}
+
+func (dummy *dummyRecurringCommandChannels) AddChannelCommand(name, cmd string) error {
+	dummy.commands = append(dummy.commands, name+":"+cmd)
+	return nil
+}
+
+func (dummy *dummyRecurringCommandChannels) RemoveChannel(name string) error {
+	return errors.New("cannot remove " + name)
+}
+
+func TestRecurringCommandsControl_Execute(t *testing.T) {
+	ctl := &RecurringCommandsControl{}
+	require.True(t, ctl.IsConfigured())
+	require.NoError(t, ctl.Initialise())
+	require.NoError(t, ctl.SelfTest())
+	require.Equal(t, ErrRecurringCommandsNotConfigured, ctl.Execute(context.Background(), Command{Content: "list"}).Error)
+
+	dummy := &dummyRecurringCommandChannels{}
+	ctl.SetChannels(dummy)
+	require.Error(t, ctl.Execute(context.Background(), Command{Content: ""}).Error)
+	require.Error(t, ctl.Execute(context.Background(), Command{Content: "add chan"}).Error)
+	require.Equal(t, &Result{Output: "added channel chan"}, ctl.Execute(context.Background(), Command{Content: "add chan 60 10"}))
+	require.Equal(t, &Result{Output: "added command to channel chan"}, ctl.Execute(context.Background(), Command{Content: "cmd chan  pin.s echo  hi "}))
+	require.Equal(t, []string{"chan:pin.s echo  hi"}, dummy.commands)
+	require.EqualError(t, ctl.Execute(context.Background(), Command{Content: "rm chan"}).Error, "cannot remove chan")
+	require.Equal(t, &Result{Output: "chan runtime every 60s, 0 cmds, 10 results\n"}, ctl.Execute(context.Background(), Command{Content: "list"}))
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"html"
 	"regexp"
 	"sort"
 	"strconv"
@@ -18,13 +19,19 @@ import (
 
 const (
 	RSSDownloadTimeoutSec = 10 // RSSDownloadTimeoutSec is the IO timeout used for testing RSS sources.
+	// RSSTrigger is the trigger prefix string of RSS feature.
+	RSSTrigger = ".rss"
+	// RSSDefaultCacheTTLSec is the default duration for which the downloaded feed items are reused before being downloaded again.
+	RSSDefaultCacheTTLSec = 10 * 60
+	// RSSDefaultHeadlines is the number of headlines to list if the command does not specify the count.
+	RSSDefaultHeadlines = 10
 )
 
 var RegexTwoNumbers = regexp.MustCompile(`(\d+)[^\d]+(\d+)`)
 
 var (
 	// ErrBadRSSParam is the error response for incorrectly entering numeric parameters for retrieving RSS feeds.
-	ErrBadRSSParam = errors.New("example: .r skip# count#")
+	ErrBadRSSParam = errors.New("example: .rss [skip# count#] | read item# | refresh")
 
 	// DefaultRSSSources is a list of RSS of news headlines published by major news agencies around the world.
 	DefaultRSSSources = []string{
@@ -37,14 +44,27 @@ var (
 		// "Top news" from CNBC
 		"https://www.cnbc.com/id/100003114/device/rss/rss.html",
 	}
+
+	// regexHTMLTag matches an HTML tag found in the description of a feed item.
+	regexHTMLTag = regexp.MustCompile(`<[^>]*>`)
 )
 
+/*
+RSS reads news headlines and article summaries from RSS and Atom feeds. The feed items are cached for a while, so that
+the item numbers shown along with the headlines stay the same when reading an article shortly afterwards.
+*/
 type RSS struct {
 	/*
-		Sources are URLs pointing toward RSS feeds in XML format. If left unspecified, the built-in list of sources that
-		point to news headlines will be used.
+		Sources are URLs pointing toward RSS or Atom feeds in XML format. If left unspecified, the built-in list of
+		sources that point to news headlines will be used.
 	*/
 	Sources []string `json:"Sources"`
+	// CacheTTLSec is the duration in seconds for which the downloaded feed items are reused before being downloaded again.
+	CacheTTLSec int `json:"CacheTTLSec"`
+
+	cachedItems []RSSItem
+	cachedAt    time.Time
+	cacheMutex  *sync.Mutex
 }
 
 func (rss *RSS) IsConfigured() bool {
@@ -67,35 +87,80 @@ func (rss *RSS) Initialise() error {
 		rss.Sources = make([]string, len(DefaultRSSSources))
 		copy(rss.Sources, DefaultRSSSources)
 	}
+	if rss.CacheTTLSec < 1 {
+		rss.CacheTTLSec = RSSDefaultCacheTTLSec
+	}
+	rss.cacheMutex = new(sync.Mutex)
 	return nil
 }
 
 func (rss *RSS) Trigger() Trigger {
-	return ".r"
+	return RSSTrigger
+}
+
+// getItems returns the cached feed items, or downloads them again if the cache has expired or refresh is demanded.
+func (rss *RSS) getItems(ctx context.Context, timeoutSec int, refresh bool) ([]RSSItem, error) {
+	rss.cacheMutex.Lock()
+	defer rss.cacheMutex.Unlock()
+	if !refresh && len(rss.cachedItems) > 0 && time.Since(rss.cachedAt) < time.Duration(rss.CacheTTLSec)*time.Second {
+		return rss.cachedItems, nil
+	}
+	items, _ := DownloadRSSFeeds(ctx, timeoutSec, rss.Sources...)
+	if len(items) == 0 {
+		// Fall back to the expired cache rather than responding with nothing
+		if len(rss.cachedItems) > 0 {
+			return rss.cachedItems, nil
+		}
+		return nil, errors.New("all RSS sources failed to respond or gave no response")
+	}
+	rss.cachedItems = items
+	rss.cachedAt = time.Now()
+	return items, nil
 }
 
 func (rss *RSS) Execute(ctx context.Context, cmd Command) *Result {
+	params := strings.Fields(strings.ToLower(cmd.Content))
+	switch {
+	case len(params) == 2 && params[0] == "read":
+		num, err := strconv.Atoi(strings.TrimPrefix(params[1], "#"))
+		if err != nil {
+			return &Result{Error: ErrBadRSSParam}
+		}
+		return rss.readItem(ctx, cmd.TimeoutSec, num)
+	case len(params) == 1 && params[0] == "refresh":
+		return rss.listHeadlines(ctx, cmd.TimeoutSec, true, 0, RSSDefaultHeadlines)
+	case len(params) == 1:
+		// A single number reads the item of that number
+		if num, err := strconv.Atoi(strings.TrimPrefix(params[0], "#")); err == nil {
+			return rss.readItem(ctx, cmd.TimeoutSec, num)
+		}
+	}
 	// Input command looks like: skip# count#, find the two numeric parameters among the content
 	var skip, count int
-	params := RegexTwoNumbers.FindStringSubmatch(cmd.Content)
-	if len(params) >= 3 {
+	numbers := RegexTwoNumbers.FindStringSubmatch(cmd.Content)
+	if len(numbers) >= 3 {
 		var intErr error
-		skip, intErr = strconv.Atoi(params[1])
+		skip, intErr = strconv.Atoi(numbers[1])
 		if intErr != nil {
 			return &Result{Error: ErrBadRSSParam}
 		}
-		count, intErr = strconv.Atoi(params[2])
+		count, intErr = strconv.Atoi(numbers[2])
 		if intErr != nil {
 			return &Result{Error: ErrBadRSSParam}
 		}
 	}
 	// If count is not given in the input command, retrieve 10 latest items.
 	if count == 0 {
-		count = 10
+		count = RSSDefaultHeadlines
 	}
-	sortedItems, _ := DownloadRSSFeeds(ctx, cmd.TimeoutSec, rss.Sources...)
-	if len(sortedItems) == 0 {
-		return &Result{Error: errors.New("all RSS sources failed to respond or gave no response")}
+	return rss.listHeadlines(ctx, cmd.TimeoutSec, false, skip, count)
+}
+
+// listHeadlines responds with the numbered headlines of the latest feed items, one on each line.
+func (rss *RSS) listHeadlines(ctx context.Context, timeoutSec int, refresh bool, skip, count int) *Result {
+	sortedItems, err := rss.getItems(ctx, timeoutSec, refresh)
+	if err != nil {
+		return &Result{Error: err}
 	}
 	// Skip and limit number of items, but make sure at least one feed will be returned.
 	begin := skip
@@ -106,21 +171,54 @@ func (rss *RSS) Execute(ctx context.Context, cmd Command) *Result {
 	if end > len(sortedItems) {
 		end = len(sortedItems)
 	}
-	sortedItems = sortedItems[begin:end]
-	// Place an item title and its associated description on each line
+	// Place the item number and title on each line, the number is used for reading the item.
 	var out bytes.Buffer
-	for _, item := range sortedItems {
-		out.WriteString(item.Title)
-		out.WriteRune('-')
-		out.WriteString(item.Description)
+	for i := begin; i < end; i++ {
+		out.WriteString(strconv.Itoa(i + 1))
+		out.WriteString(". ")
+		out.WriteString(sortedItems[i].Headline())
 		out.WriteRune('\n')
 	}
 	return &Result{Output: out.String()}
 }
 
-// RSSRoot is the root element in an RSS XML document.
+// readItem responds with the headline, publication time, summary, and link of an item identified by its number.
+func (rss *RSS) readItem(ctx context.Context, timeoutSec int, num int) *Result {
+	if num < 1 {
+		return &Result{Error: ErrBadRSSParam}
+	}
+	items, err := rss.getItems(ctx, timeoutSec, false)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if num > len(items) {
+		return &Result{Error: fmt.Errorf("there are only %d items", len(items))}
+	}
+	item := items[num-1]
+	var out bytes.Buffer
+	out.WriteString(item.Headline())
+	if !item.PubDate.IsZero() {
+		out.WriteString(" (" + item.PubDate.UTC().Format("2006-01-02 15:04 MST") + ")")
+	}
+	out.WriteRune('\n')
+	if summary := item.Summary(); summary != "" {
+		out.WriteString(summary)
+		out.WriteRune('\n')
+	}
+	if item.Link != "" {
+		out.WriteString(strings.TrimSpace(item.Link))
+		out.WriteRune('\n')
+	}
+	return &Result{Output: out.String()}
+}
+
+// RSSRoot is the root element in an RSS or Atom XML document.
 type RSSRoot struct {
 	Channel RSSChannel `xml:"channel"`
+	// Items are placed directly underneath the root element by RSS 1.0 (RDF) documents.
+	Items []RSSItem `xml:"item"`
+	// Entries are the items of an Atom document.
+	Entries []AtomEntry `xml:"entry"`
 }
 
 // RSSChannel represents an information channel in RSS XML document.
@@ -132,9 +230,63 @@ type RSSChannel struct {
 type RSSItem struct {
 	Title       string     `xml:"title"`
 	Description string     `xml:"description"`
+	Link        string     `xml:"link"`
 	PubDate     RSSPubDate `xml:"pubDate"`
 }
 
+// Headline returns the item title in plain text.
+func (item RSSItem) Headline() string {
+	return plainText(item.Title)
+}
+
+// Summary returns the item description in plain text, with HTML tags removed and white spaces collapsed.
+func (item RSSItem) Summary() string {
+	return plainText(regexHTMLTag.ReplaceAllString(item.Description, " "))
+}
+
+// plainText returns the text with HTML entities unescaped and white spaces collapsed.
+func plainText(text string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+}
+
+// AtomEntry represents a news item in Atom XML document.
+type AtomEntry struct {
+	Title     string     `xml:"title"`
+	Summary   string     `xml:"summary"`
+	Content   string     `xml:"content"`
+	Links     []AtomLink `xml:"link"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+}
+
+// AtomLink represents a link of a news item in Atom XML document.
+type AtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+// ToRSSItem converts the Atom entry into an RSS item. The publication time is left zero if it cannot be interpreted.
+func (entry AtomEntry) ToRSSItem() RSSItem {
+	item := RSSItem{Title: entry.Title, Description: entry.Summary}
+	if strings.TrimSpace(item.Description) == "" {
+		item.Description = entry.Content
+	}
+	for _, link := range entry.Links {
+		// The alternate link (also the default) leads to the article
+		if link.Rel == "" || link.Rel == "alternate" {
+			item.Link = link.Href
+			break
+		}
+	}
+	for _, timeStr := range []string{entry.Published, entry.Updated} {
+		if parsed, err := time.Parse(time.RFC3339, strings.TrimSpace(timeStr)); err == nil {
+			item.PubDate = RSSPubDate{parsed}
+			break
+		}
+	}
+	return item
+}
+
 // RSSPubDate represents a publication date/time stamp in RSS XML document.
 type RSSPubDate struct {
 	time.Time
@@ -161,8 +313,14 @@ func (pubDate *RSSPubDate) UnmarshalXML(d *xml.Decoder, start xml.StartElement)
 
 		// With additional day of week & second
 		`Mon, 02 Jan 06 15:04:05 MST`, `Mon, 02 Jan 06 15:04:05 -0700`,
-		`Mon, 02 Jan 2006 15:04:05 MST`, `Mon, 02 Jan 2006 15:04:05 -0700`} {
-		if parsed, err := time.Parse(format, pubDateStr); err == nil {
+		`Mon, 02 Jan 2006 15:04:05 MST`, `Mon, 02 Jan 2006 15:04:05 -0700`,
+
+		// Single digit day of month
+		`Mon, 2 Jan 2006 15:04:05 MST`, `Mon, 2 Jan 2006 15:04:05 -0700`,
+
+		// ISO 8601, which is often used by feeds converted from Atom.
+		time.RFC3339} {
+		if parsed, err := time.Parse(format, strings.TrimSpace(pubDateStr)); err == nil {
 			*pubDate = RSSPubDate{parsed}
 			return nil
 		}
@@ -171,13 +329,17 @@ func (pubDate *RSSPubDate) UnmarshalXML(d *xml.Decoder, start xml.StartElement)
 }
 
 /*
-DeserialiseRSSItems deserialises RSS feeds from input XML and returns news items among them in their original order.
-In case of an error, the error along with an empty array will be returned.
+DeserialiseRSSItems deserialises RSS or Atom feeds from input XML and returns news items among them in their original
+order. In case of an error, the error along with an empty array will be returned.
 */
 func DeserialiseRSSItems(input []byte) (items []RSSItem, err error) {
 	var root RSSRoot
-	err = xml.Unmarshal(input, &root)
-	items = root.Channel.Items
+	// Many feeds are not encoded in UTF-8
+	err = inet.NewXMLDecoder(bytes.NewReader(input)).Decode(&root)
+	items = append(root.Channel.Items, root.Items...)
+	for _, entry := range root.Entries {
+		items = append(items, entry.ToRSSItem())
+	}
 	if items == nil {
 		items = []RSSItem{}
 	}
@@ -205,7 +367,7 @@ func DownloadRSSFeeds(ctx context.Context, timeoutSec int, xmlURLs ...string) (i
 				if feedErr == nil {
 					items = append(items, feedItems...)
 				} else {
-					errs[aURL] = err
+					errs[aURL] = feedErr
 				}
 			} else {
 				errs[aURL] = err
@@ -214,7 +376,7 @@ func DownloadRSSFeeds(ctx context.Context, timeoutSec int, xmlURLs ...string) (i
 	}
 	wait.Wait()
 	// Sort feeds latest to oldest according to publication date
-	sort.Slice(items, func(i1, i2 int) bool {
+	sort.SliceStable(items, func(i1, i2 int) bool {
 		return items[i1].PubDate.After(items[i2].PubDate.Time)
 	})
 	// Collect error information
@@ -2,7 +2,13 @@ package toolbox
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestDeserialiseRSSItems(t *testing.T) {
@@ -98,3 +104,87 @@ func TestRSS_Execute(t *testing.T) {
 		t.Fatal(ret)
 	}
 }
+
+func TestDeserialiseAtomItems(t *testing.T) {
+	sample := `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Example Feed</title>
+  <entry>
+    <title>Atom &amp; entry 1</title>
+    <link rel="self" href="http://example.org/self"/>
+    <link href="http://example.org/2003/12/13/atom03"/>
+    <updated>2003-12-13T18:30:02Z</updated>
+    <summary>Some text.</summary>
+  </entry>
+  <entry>
+    <title>Atom entry 2</title>
+    <link rel="alternate" href="http://example.org/2"/>
+    <published>2003-12-14T18:30:02+01:00</published>
+    <updated>bad time</updated>
+    <content type="html">&lt;p&gt;Content   &lt;b&gt;text&lt;/b&gt;&lt;/p&gt;</content>
+  </entry>
+</feed>`
+	items, err := DeserialiseRSSItems([]byte(sample))
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.Equal(t, "Atom & entry 1", items[0].Headline())
+	require.Equal(t, "Some text.", items[0].Summary())
+	require.Equal(t, "http://example.org/2003/12/13/atom03", items[0].Link)
+	require.Equal(t, time.Date(2003, 12, 13, 18, 30, 2, 0, time.UTC), items[0].PubDate.UTC())
+	require.Equal(t, "Content text", items[1].Summary())
+	require.Equal(t, "http://example.org/2", items[1].Link)
+	require.Equal(t, time.Date(2003, 12, 14, 17, 30, 2, 0, time.UTC), items[1].PubDate.UTC())
+}
+
+func TestRSS_CacheAndRead(t *testing.T) {
+	var numRequests int
+	var mutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		numRequests++
+		mutex.Unlock()
+		if r.URL.Path == "/atom" {
+			_, _ = w.Write([]byte(`<feed xmlns="http://www.w3.org/2005/Atom"><entry><title>Newest</title><updated>2030-01-02T00:00:00Z</updated>
+<link href="http://example.org/newest"/><summary>&lt;p&gt;The &lt;i&gt;latest&lt;/i&gt; news&lt;/p&gt;</summary></entry></feed>`))
+			return
+		}
+		_, _ = w.Write([]byte(`<rss version="2.0"><channel>
+<item><title>Older</title><description>Older news</description><link>http://example.org/older</link><pubDate>Mon, 02 Jan 2006 15:04:05 -0700</pubDate></item>
+<item><title>Middle</title><description>Middle news</description><pubDate>Tue, 03 Jan 2006 15:04:05 -0700</pubDate></item>
+</channel></rss>`))
+	}))
+	defer server.Close()
+
+	rss := RSS{Sources: []string{server.URL + "/atom", server.URL + "/rss"}}
+	require.NoError(t, rss.Initialise())
+	require.Equal(t, RSSDefaultCacheTTLSec, rss.CacheTTLSec)
+	// Headlines are numbered from the latest to oldest
+	ret := rss.Execute(context.Background(), Command{TimeoutSec: 10})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "1. Newest\n2. Middle\n3. Older\n", ret.Output)
+	require.Equal(t, 2, numRequests)
+	ret = rss.Execute(context.Background(), Command{TimeoutSec: 10, Content: "1, 1"})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "2. Middle\n", ret.Output)
+	// Read an article from the cache
+	ret = rss.Execute(context.Background(), Command{TimeoutSec: 10, Content: "1"})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "Newest (2030-01-02 00:00 UTC)\nThe latest news\nhttp://example.org/newest\n", ret.Output)
+	ret = rss.Execute(context.Background(), Command{TimeoutSec: 10, Content: "read #2"})
+	require.NoError(t, ret.Error)
+	require.Equal(t, "Middle (2006-01-03 22:04 UTC)\nMiddle news\n", ret.Output)
+	require.Error(t, rss.Execute(context.Background(), Command{TimeoutSec: 10, Content: "read 4"}).Error)
+	require.ErrorIs(t, rss.Execute(context.Background(), Command{TimeoutSec: 10, Content: "read 0"}).Error, ErrBadRSSParam)
+	require.ErrorIs(t, rss.Execute(context.Background(), Command{TimeoutSec: 10, Content: "read x"}).Error, ErrBadRSSParam)
+	require.Equal(t, 2, numRequests)
+	// Refresh the cache on demand
+	ret = rss.Execute(context.Background(), Command{TimeoutSec: 10, Content: "refresh"})
+	require.NoError(t, ret.Error)
+	require.Equal(t, 4, numRequests)
+	// The cached items continue to serve when the sources become unavailable
+	rss.Sources = []string{"http://127.0.0.1:1/does-not-exist"}
+	rss.cachedAt = time.Time{}
+	ret = rss.Execute(context.Background(), Command{TimeoutSec: 1, Content: "3"})
+	require.NoError(t, ret.Error)
+	require.Contains(t, ret.Output, "Older")
+}
@@ -7,6 +7,8 @@ import (
 	"sort"
 	"strings"
 	"sync"
+
+	"github.com/HouzuoGuo/laitos/misc"
 )
 
 /*
@@ -16,22 +18,39 @@ and receive configuration from JSON.
 type FeatureSet struct {
 	LookupByTrigger map[Trigger]Feature `json:"-"`
 
-	AESDecrypt             AESDecrypt             `json:"AESDecrypt"`
-	EnvControl             EnvControl             `json:"EnvControl"`
-	IMAPAccounts           IMAPAccounts           `json:"IMAPAccounts"`
-	Joke                   Joke                   `json:"Joke"`
-	MessageBank            MessageBank            `json:"MessageBank"`
-	NetBoundFileEncryption NetBoundFileEncryption `json:"NetBoundFileEncryption"`
-	PublicContact          PublicContact          `json:"PublicContact"`
-	RSS                    RSS                    `json:"RSS"`
-	SendMail               SendMail               `json:"SendMail"`
-	Shell                  Shell                  `json:"Shell"`
-	TextSearch             TextSearch             `json:"TextSearch"`
-	Twilio                 Twilio                 `json:"Twilio"`
-	TwoFACodeGenerator     TwoFACodeGenerator     `json:"TwoFACodeGenerator"`
-	WolframAlpha           WolframAlpha           `json:"WolframAlpha"`
+	AESDecrypt             AESDecrypt               `json:"AESDecrypt"`
+	ContactBook            ContactBook              `json:"ContactBook"`
+	Conversion             Conversion               `json:"Conversion"`
+	DataPurge              DataPurge                `json:"-"`
+	DNSAllow               DNSAllow                 `json:"-"`
+	EnvControl             EnvControl               `json:"EnvControl"`
+	FeatureInventory       FeatureInventory         `json:"-"`
+	HomeAssistant          HomeAssistant            `json:"HomeAssistant"`
+	IMAPAccounts           IMAPAccounts             `json:"IMAPAccounts"`
+	Joke                   Joke                     `json:"Joke"`
+	LLMChat                LLMChat                  `json:"LLMChat"`
+	LocationTracker        LocationTracker          `json:"LocationTracker"`
+	MessageBank            MessageBank              `json:"MessageBank"`
+	NetBoundFileEncryption NetBoundFileEncryption   `json:"NetBoundFileEncryption"`
+	PackageManager         PackageManager           `json:"PackageManager"`
+	Presence               Presence                 `json:"Presence"`
+	PublicContact          PublicContact            `json:"PublicContact"`
+	QRCode                 QRCode                   `json:"-"`
+	RecurringCommands      RecurringCommandsControl `json:"-"`
+	RSS                    RSS                      `json:"RSS"`
+	SendMail               SendMail                 `json:"SendMail"`
+	Shell                  Shell                    `json:"Shell"`
+	TextSearch             TextSearch               `json:"TextSearch"`
+	Twilio                 Twilio                   `json:"Twilio"`
+	TwoFACodeGenerator     TwoFACodeGenerator       `json:"TwoFACodeGenerator"`
+	Weather                Weather                  `json:"Weather"`
+	WolframAlpha           WolframAlpha             `json:"WolframAlpha"`
 
 	MessageProcessor MessageProcessor `json:"MessageProcessor"`
+
+	// usage counts the invocations of each app by its trigger.
+	usage      map[Trigger]*FeatureUsage
+	usageMutex *sync.Mutex
 }
 
 //var TestFeatureSet = FeatureSet{} // Features are assigned by init_test.go
@@ -39,21 +58,37 @@ type FeatureSet struct {
 // Run initialisation routine on all features, and then populate lookup table for all configured features.
 func (fs *FeatureSet) Initialise() error {
 	fs.LookupByTrigger = map[Trigger]Feature{}
+	fs.usage = make(map[Trigger]*FeatureUsage)
+	fs.usageMutex = new(sync.Mutex)
+	fs.FeatureInventory.features = fs
 	// Initialise the apps that do not reference this FeatureSet
 	apps := map[Trigger]Feature{
 		fs.AESDecrypt.Trigger():             &fs.AESDecrypt,             // a
+		fs.ContactBook.Trigger():            &fs.ContactBook,            // contact
+		fs.Conversion.Trigger():             &fs.Conversion,             // conv
+		fs.DataPurge.Trigger():              &fs.DataPurge,              // purge
+		fs.DNSAllow.Trigger():               &fs.DNSAllow,               // da
 		fs.EnvControl.Trigger():             &fs.EnvControl,             // e
+		fs.FeatureInventory.Trigger():       &fs.FeatureInventory,       // features
+		fs.HomeAssistant.Trigger():          &fs.HomeAssistant,          // ha
 		fs.IMAPAccounts.Trigger():           &fs.IMAPAccounts,           // i
 		fs.Joke.Trigger():                   &fs.Joke,                   // j
+		fs.LLMChat.Trigger():                &fs.LLMChat,                // ai
+		fs.LocationTracker.Trigger():        &fs.LocationTracker,        // where
 		fs.MessageBank.Trigger():            &fs.MessageBank,            // b
 		fs.NetBoundFileEncryption.Trigger(): &fs.NetBoundFileEncryption, // nbe
+		fs.PackageManager.Trigger():         &fs.PackageManager,         // pkg
+		fs.Presence.Trigger():               &fs.Presence,               // home
 		fs.PublicContact.Trigger():          &fs.PublicContact,          // c
-		fs.RSS.Trigger():                    &fs.RSS,                    // r
+		fs.QRCode.Trigger():                 &fs.QRCode,                 // qr
+		fs.RecurringCommands.Trigger():      &fs.RecurringCommands,      // rc
+		fs.RSS.Trigger():                    &fs.RSS,                    // rss
 		fs.SendMail.Trigger():               &fs.SendMail,               // m
 		fs.Shell.Trigger():                  &fs.Shell,                  // s
 		fs.TextSearch.Trigger():             &fs.TextSearch,             // g
 		fs.Twilio.Trigger():                 &fs.Twilio,                 // p
 		fs.TwoFACodeGenerator.Trigger():     &fs.TwoFACodeGenerator,     // 2
+		fs.Weather.Trigger():                &fs.Weather,                // weather
 		fs.WolframAlpha.Trigger():           &fs.WolframAlpha,           // w
 	}
 	errs := make([]string, 0)
@@ -83,6 +118,17 @@ func (fs *FeatureSet) Initialise() error {
 	if len(errs) != 0 {
 		return errors.New(strings.Join(errs, " | "))
 	}
+	// Let the data purge and retention reach the messages and reports kept in memory.
+	misc.DefaultDataRetention.Register(misc.RetainedData{
+		Name:         RetentionStoreMessageBank,
+		PurgeClient:  fs.MessageBank.PurgeClient,
+		ExpireBefore: fs.MessageBank.ExpireBefore,
+	})
+	misc.DefaultDataRetention.Register(misc.RetainedData{
+		Name:         RetentionStoreSubjectReports,
+		PurgeClient:  msgProcessorApp.PurgeClient,
+		ExpireBefore: msgProcessorApp.ExpireBefore,
+	})
 	return nil
 }
 
@@ -120,9 +166,11 @@ func (fs *FeatureSet) DeserialiseFromJSON(configJSON json.RawMessage) error {
 	// Here are the feature keys
 	features := map[string]Feature{
 		"AESDecrypt":         &fs.AESDecrypt,
+		"ContactBook":        &fs.ContactBook,
 		"EnvControl":         &fs.EnvControl,
 		"IMAPAccounts":       &fs.IMAPAccounts,
 		"Joke":               &fs.Joke,
+		"Presence":           &fs.Presence,
 		"RSS":                &fs.RSS,
 		"SendMail":           &fs.SendMail,
 		"Shell":              &fs.Shell,
@@ -26,14 +26,21 @@ func TestFeatureSet_InitSelfTest(t *testing.T) {
 		t.Fatal(err)
 	}
 	enabledByDefaultApps := []Trigger{
+		(&Conversion{}).Trigger(),
+		(&DataPurge{}).Trigger(),
+		(&DNSAllow{}).Trigger(),
 		(&EnvControl{}).Trigger(),
+		(&FeatureInventory{}).Trigger(),
 		(&Joke{}).Trigger(),
 		(&MessageBank{}).Trigger(),
 		(&MessageProcessor{}).Trigger(),
 		(&NetBoundFileEncryption{}).Trigger(),
 		(&PublicContact{}).Trigger(),
+		(&QRCode{}).Trigger(),
+		(&RecurringCommandsControl{}).Trigger(),
 		(&RSS{}).Trigger(),
 		(&Shell{}).Trigger(),
+		(&Weather{}).Trigger(),
 	}
 	if len(apps.LookupByTrigger) != len(enabledByDefaultApps) {
 		t.Fatal(apps.LookupByTrigger)
@@ -55,7 +62,7 @@ func TestFeatureSet_InitSelfTest(t *testing.T) {
 	if err := apps.SelfTest(); err != nil {
 		t.Fatal(err)
 	}
-	if triggers := apps.GetTriggers(); !reflect.DeepEqual(triggers, []string{".0m", ".2", ".a", ".b", ".c", ".e", ".j", ".nbe", ".r", ".s"}) {
+	if triggers := apps.GetTriggers(); !reflect.DeepEqual(triggers, []string{".0m", ".2", ".a", ".b", ".c", ".conv", ".da", ".e", ".features", ".j", ".nbe", ".qr", ".rc", ".rss", ".s", ".weather"}) {
 		t.Fatal(triggers)
 	}
 }
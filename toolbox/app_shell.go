@@ -72,6 +72,10 @@ func (sh *Shell) Execute(ctx context.Context, cmd Command) *Result {
 			return &Result{Error: ErrRestrictedShell}
 		}
 	}
+	if cmd.LiveOutput != nil {
+		procOut, procErr := platform.InvokeShellWithLiveOutput(cmd.TimeoutSec, sh.InterpreterPath, cmd.Content, cmd.LiveOutput)
+		return &Result{Error: procErr, Output: procOut}
+	}
 	procOut, procErr := platform.InvokeShell(cmd.TimeoutSec, sh.InterpreterPath, cmd.Content)
 	return &Result{Error: procErr, Output: procOut}
 }
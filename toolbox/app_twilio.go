@@ -1,8 +1,11 @@
 package toolbox
 
 import (
+	"bytes"
 	"context"
+	"encoding/xml"
 	"fmt"
+	"html"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -10,11 +13,15 @@ import (
 	"strings"
 
 	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
 )
 
 const (
 	TwilioMakeCall = "c" // Prefix string to trigger outgoing call
 	TwilioSendSMS  = "t" // Prefix string to trigger outgoing SMS
+
+	TwilioAPIURL        = "https://api.twilio.com/2010-04-01" // TwilioAPIURL is the base URL of Twilio REST API
+	TwilioMaxSMSBodyLen = 1600                                // TwilioMaxSMSBodyLen is the maximum length of an outbound SMS body accepted by Twilio
 )
 
 var (
@@ -26,8 +33,18 @@ type Twilio struct {
 	PhoneNumber string `json:"PhoneNumber"` // Twilio telephone country code and number (the number you purchased from Twilio)
 	AccountSID  string `json:"AccountSID"`  // Twilio account SID ("Account Settings - LIVE Credentials - Account SID")
 	AuthToken   string `json:"AuthToken"`   // Twilio authentication secret token ("Account Settings - LIVE Credentials - Auth Token")
+	/*
+		SMSFrom optionally overrides PhoneNumber as the sender of outbound SMS. It may be another purchased phone
+		number, an alphanumeric sender ID, or the SID of a messaging service (begins with "MG").
+	*/
+	SMSFrom string `json:"SMSFrom"`
+	// SayVoice optionally chooses the text-to-speech voice of outbound calls, e.g. "alice" or "Polly.Joanna".
+	SayVoice string `json:"SayVoice"`
+	// SayLanguage optionally chooses the text-to-speech language of outbound calls, e.g. "en-GB".
+	SayLanguage string `json:"SayLanguage"`
 
 	TestPhoneNumber string `json:"-"` // Set by init_test.go for running test case, not a configuration.
+	apiURL          string // apiURL overrides TwilioAPIURL in test cases.
 }
 
 var TestTwilio = Twilio{} // API credentials are set by init_feature_test.go
@@ -47,7 +64,7 @@ func (twi *Twilio) SelfTest() error {
 			req.SetBasicAuth(twi.AccountSID, twi.AuthToken)
 			return nil
 		},
-	}, "https://api.twilio.com/2010-04-01/Accounts/%s", twi.AccountSID)
+	}, twi.getAPIURL()+"/Accounts/%s", twi.AccountSID)
 	if err != nil {
 		return fmt.Errorf("Twilio.SelfTest: API IO error - %v", err)
 	}
@@ -87,61 +104,107 @@ func (twi *Twilio) MakeCall(cmd Command) *Result {
 	}
 	toNumber := params[1]
 	message := params[2]
-	formParams := url.Values{
-		"From": {twi.PhoneNumber},
-		"To":   {toNumber},
-		"Url": {"http://twimlets.com/message?Message=" + url.QueryEscape(fmt.Sprintf(`%s.
-
-repeat again.
-
-%s.
+	if err := twi.DeliverVoiceCall(context.Background(), cmd.TimeoutSec, toNumber, message); err != nil {
+		return &Result{Error: err}
+	}
+	// The OK output is simply the length of number + message
+	return &Result{Error: nil, Output: strconv.Itoa(len(toNumber) + len(message))}
+}
 
-repeat again.
+// VoiceCallTwiML returns the TwiML instructions of an outbound call that speaks the message three times.
+func (twi *Twilio) VoiceCallTwiML(message string) string {
+	var escaped bytes.Buffer
+	_ = xml.EscapeText(&escaped, []byte(message))
+	sayAttrs := ""
+	if twi.SayVoice != "" {
+		sayAttrs += fmt.Sprintf(` voice="%s"`, html.EscapeString(twi.SayVoice))
+	}
+	if twi.SayLanguage != "" {
+		sayAttrs += fmt.Sprintf(` language="%s"`, html.EscapeString(twi.SayLanguage))
+	}
+	say := fmt.Sprintf(`<Say%s>%s</Say>`, sayAttrs, escaped.String())
+	repeat := fmt.Sprintf(`<Say%s>repeat again.</Say>`, sayAttrs)
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?><Response>%s%s%s%s%s<Say%s>over.</Say></Response>`,
+		say, repeat, say, repeat, say, sayAttrs)
+}
 
-%s.
-over.`, message, message, message))},
+// DeliverVoiceCall places an outbound call to the phone number (including country code) via Twilio REST API, and
+// the call speaks the message using text-to-speech when answered.
+func (twi *Twilio) DeliverVoiceCall(ctx context.Context, timeoutSec int, toNumber, message string) error {
+	formParams := url.Values{
+		"From":  {twi.PhoneNumber},
+		"To":    {toNumber},
+		"Twiml": {twi.VoiceCallTwiML(message)},
 	}
-	resp, err := inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		TimeoutSec: cmd.TimeoutSec,
+	resp, err := inet.DoHTTP(ctx, inet.HTTPRequest{
+		TimeoutSec: timeoutSec,
 		Method:     http.MethodPost,
 		Body:       strings.NewReader(formParams.Encode()),
 		RequestFunc: func(req *http.Request) error {
 			req.SetBasicAuth(twi.AccountSID, twi.AuthToken)
 			return nil
 		},
-	}, "https://api.twilio.com/2010-04-01/Accounts/%s/Calls.json", twi.AccountSID)
-	if errResult := HTTPErrorToResult(resp, err); errResult != nil {
-		return errResult
+	}, twi.getAPIURL()+"/Accounts/%s/Calls.json", twi.AccountSID)
+	if err != nil {
+		return fmt.Errorf("Twilio.DeliverVoiceCall: API IO error - %v", err)
 	}
-	// The OK output is simply the length of number + message
-	return &Result{Error: nil, Output: strconv.Itoa(len(toNumber) + len(message))}
+	if err = resp.Non2xxToError(); err != nil {
+		return fmt.Errorf("Twilio.DeliverVoiceCall: API response error - %v", err)
+	}
+	return nil
 }
 
 func (twi *Twilio) SendSMS(cmd Command) *Result {
-	params := RegexPhoneNumberAndMessage.FindStringSubmatch(strings.TrimSpace(strings.TrimPrefix(cmd.Content, TwilioMakeCall)))
+	params := RegexPhoneNumberAndMessage.FindStringSubmatch(strings.TrimSpace(strings.TrimPrefix(cmd.Content, TwilioSendSMS)))
 	if len(params) < 3 {
 		return &Result{Error: ErrBadTwilioParam}
 	}
 	toNumber := params[1]
 	message := params[2]
+	if err := twi.DeliverSMS(context.Background(), cmd.TimeoutSec, toNumber, message); err != nil {
+		return &Result{Error: err}
+	}
+	// The OK output is simply the length of number + message
+	return &Result{Error: nil, Output: strconv.Itoa(len(toNumber) + len(message))}
+}
 
+// DeliverSMS sends an SMS to the phone number (including country code) via Twilio REST API. Text beyond the maximum
+// SMS body length accepted by Twilio is discarded, the cut never splits a UTF-8 character.
+func (twi *Twilio) DeliverSMS(ctx context.Context, timeoutSec int, toNumber, message string) error {
+	message = lalog.TruncateStringAtRune(message, TwilioMaxSMSBodyLen)
 	formParams := url.Values{
-		"From": {twi.PhoneNumber},
 		"To":   {toNumber},
 		"Body": {message},
 	}
-	resp, err := inet.DoHTTP(context.Background(), inet.HTTPRequest{
-		TimeoutSec: cmd.TimeoutSec,
+	if strings.HasPrefix(twi.SMSFrom, "MG") {
+		formParams.Set("MessagingServiceSid", twi.SMSFrom)
+	} else if twi.SMSFrom != "" {
+		formParams.Set("From", twi.SMSFrom)
+	} else {
+		formParams.Set("From", twi.PhoneNumber)
+	}
+	resp, err := inet.DoHTTP(ctx, inet.HTTPRequest{
+		TimeoutSec: timeoutSec,
 		Method:     http.MethodPost,
 		Body:       strings.NewReader(formParams.Encode()),
 		RequestFunc: func(req *http.Request) error {
 			req.SetBasicAuth(twi.AccountSID, twi.AuthToken)
 			return nil
 		},
-	}, "https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", twi.AccountSID)
-	if errResult := HTTPErrorToResult(resp, err); errResult != nil {
-		return errResult
+	}, twi.getAPIURL()+"/Accounts/%s/Messages.json", twi.AccountSID)
+	if err != nil {
+		return fmt.Errorf("Twilio.DeliverSMS: API IO error - %v", err)
 	}
-	// The OK output is simply the length of number + message
-	return &Result{Error: nil, Output: strconv.Itoa(len(toNumber) + len(message))}
+	if err = resp.Non2xxToError(); err != nil {
+		return fmt.Errorf("Twilio.DeliverSMS: API response error - %v", err)
+	}
+	return nil
+}
+
+// getAPIURL returns the base URL of Twilio REST API.
+func (twi *Twilio) getAPIURL() string {
+	if twi.apiURL != "" {
+		return twi.apiURL
+	}
+	return TwilioAPIURL
 }
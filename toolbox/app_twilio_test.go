@@ -2,8 +2,12 @@ package toolbox
 
 import (
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestTwilio_Execute(t *testing.T) {
@@ -39,3 +43,84 @@ func TestTwilio_Execute(t *testing.T) {
 		t.Fatal(ret)
 	}
 }
+
+// newTwilioAPIServer returns a fake Twilio REST API server that records the form of each SMS and call request.
+func newTwilioAPIServer(t *testing.T, received chan<- map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "sid" || pass != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/Accounts/sid/Messages.json" && r.URL.Path != "/Accounts/sid/Calls.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		form := make(map[string]string)
+		for key := range r.PostForm {
+			form[key] = r.PostForm.Get(key)
+		}
+		received <- form
+		w.WriteHeader(http.StatusCreated)
+	}))
+}
+
+func TestTwilio_DeliverSMS(t *testing.T) {
+	received := make(chan map[string]string, 10)
+	server := newTwilioAPIServer(t, received)
+	defer server.Close()
+
+	twi := Twilio{PhoneNumber: "+100", AccountSID: "sid", AuthToken: "token", apiURL: server.URL}
+	if ret := twi.Execute(context.Background(), Command{TimeoutSec: 10, Content: TwilioSendSMS + " +123, hello there"}); ret.Error != nil || ret.Output != "15" {
+		t.Fatal(ret)
+	}
+	if form := <-received; form["From"] != "+100" || form["To"] != "+123" || form["Body"] != "hello there" {
+		t.Fatal(form)
+	}
+	// Send from a messaging service and truncate the long message
+	twi.SMSFrom = "MG0123"
+	if err := twi.DeliverSMS(context.Background(), 10, "+123", strings.Repeat("a", TwilioMaxSMSBodyLen+1)); err != nil {
+		t.Fatal(err)
+	}
+	if form := <-received; form["MessagingServiceSid"] != "MG0123" || form["From"] != "" || len(form["Body"]) != TwilioMaxSMSBodyLen {
+		t.Fatal(form)
+	}
+	// The truncation does not split a UTF-8 character
+	if err := twi.DeliverSMS(context.Background(), 10, "+123", "ab"+strings.Repeat("你", TwilioMaxSMSBodyLen)); err != nil {
+		t.Fatal(err)
+	}
+	if form := <-received; !utf8.ValidString(form["Body"]) || len(form["Body"]) != TwilioMaxSMSBodyLen-2 {
+		t.Fatal(len(form["Body"]))
+	}
+	// Bad credentials
+	twi.AuthToken = "wrong"
+	if err := twi.DeliverSMS(context.Background(), 10, "+123", "hi"); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestTwilio_DeliverVoiceCall(t *testing.T) {
+	received := make(chan map[string]string, 10)
+	server := newTwilioAPIServer(t, received)
+	defer server.Close()
+
+	twi := Twilio{PhoneNumber: "+100", AccountSID: "sid", AuthToken: "token", apiURL: server.URL}
+	if ret := twi.Execute(context.Background(), Command{TimeoutSec: 10, Content: TwilioMakeCall + " +123, disk <full>"}); ret.Error != nil || ret.Output != "15" {
+		t.Fatal(ret)
+	}
+	form := <-received
+	if form["From"] != "+100" || form["To"] != "+123" {
+		t.Fatal(form)
+	}
+	if strings.Count(form["Twiml"], "<Say>disk &lt;full&gt;</Say>") != 3 {
+		t.Fatal(form["Twiml"])
+	}
+	// Customise the voice and language
+	twi.SayVoice = "alice"
+	twi.SayLanguage = "en-GB"
+	if twiml := twi.VoiceCallTwiML("hi"); !strings.Contains(twiml, `<Say voice="alice" language="en-GB">hi</Say>`) {
+		t.Fatal(twiml)
+	}
+}
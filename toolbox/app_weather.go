@@ -0,0 +1,454 @@
+package toolbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+const (
+	// WeatherTrigger is the trigger prefix string of Weather feature.
+	WeatherTrigger = ".weather"
+	// WeatherProviderOpenMeteo is the name of the forecast provider open-meteo.com, which is the default provider.
+	WeatherProviderOpenMeteo = "open-meteo"
+	// WeatherProviderMETNorway is the name of the forecast provider of the Norwegian Meteorological Institute (api.met.no).
+	WeatherProviderMETNorway = "met.no"
+	// WeatherDefaultOpenMeteoURL is the default forecast API endpoint of open-meteo.com.
+	WeatherDefaultOpenMeteoURL = "https://api.open-meteo.com/v1/forecast"
+	// WeatherDefaultMETNorwayURL is the default forecast API endpoint of api.met.no.
+	WeatherDefaultMETNorwayURL = "https://api.met.no/weatherapi/locationforecast/2.0/compact"
+	// WeatherDefaultGeocodingURL is the default API endpoint that finds the coordinates of a place name.
+	WeatherDefaultGeocodingURL = "https://geocoding-api.open-meteo.com/v1/search"
+	// WeatherDefaultDays is the default number of days covered by a forecast.
+	WeatherDefaultDays = 3
+	// WeatherMaxDays is the maximum number of days covered by a forecast.
+	WeatherMaxDays = 7
+	// WeatherUserAgent identifies laitos to the forecast providers, api.met.no refuses requests without an identification.
+	WeatherUserAgent = "laitos (https://github.com/HouzuoGuo/laitos)"
+)
+
+var ErrBadWeatherParam = errors.New(`example: place name | latitude,longitude`)
+
+// RegexWeatherCoordinates matches a pair of latitude and longitude separated by a comma or space.
+var RegexWeatherCoordinates = regexp.MustCompile(`^(-?[0-9]+(?:\.[0-9]+)?)\s*[,\s]\s*(-?[0-9]+(?:\.[0-9]+)?)$`)
+
+// WeatherDay is the forecast of a single day, temperatures are in Celsius and precipitation is in millimetres.
+type WeatherDay struct {
+	Date          time.Time
+	MinTemp       float64
+	MaxTemp       float64
+	Precipitation float64
+	Summary       string
+}
+
+// WeatherForecast is the current weather and daily forecast of a place, temperature is in Celsius and wind speed is in m/s.
+type WeatherForecast struct {
+	Place       string
+	CurrentTemp float64
+	CurrentWind float64
+	Summary     string
+	Days        []WeatherDay
+}
+
+/*
+Weather looks up the current weather and the forecast of the next few days of a place name or coordinates, using a free
+forecast provider that does not require an API key. The output is compact enough for SMS and DNS TXT replies.
+*/
+type Weather struct {
+	// Provider is the name of the forecast provider, either WeatherProviderOpenMeteo (default) or WeatherProviderMETNorway.
+	Provider string `json:"Provider"`
+	// APIURL is the forecast API endpoint of the provider, it defaults to the public endpoint of the provider.
+	APIURL string `json:"APIURL"`
+	// GeocodingURL is the API endpoint that finds the coordinates of a place name, it defaults to WeatherDefaultGeocodingURL.
+	GeocodingURL string `json:"GeocodingURL"`
+	// DefaultPlace is the place name or coordinates to look up when the command does not name a place.
+	DefaultPlace string `json:"DefaultPlace"`
+	// Days is the number of days covered by the forecast, it defaults to WeatherDefaultDays.
+	Days int `json:"Days"`
+	// Imperial presents the temperature in Fahrenheit, wind speed in mph, and precipitation in inches.
+	Imperial bool `json:"Imperial"`
+}
+
+// IsConfigured always returns true because the forecast providers do not require an API key.
+func (weather *Weather) IsConfigured() bool {
+	return true
+}
+
+// SelfTest looks up the forecast of a well known place.
+func (weather *Weather) SelfTest() error {
+	ctx, cancel := context.WithTimeout(context.Background(), SelfTestTimeoutSec*time.Second)
+	defer cancel()
+	if _, err := weather.Forecast(ctx, SelfTestTimeoutSec, "51.5072,-0.1276"); err != nil {
+		return fmt.Errorf("Weather.SelfTest: %w", err)
+	}
+	return nil
+}
+
+func (weather *Weather) Initialise() error {
+	if weather.Provider == "" {
+		weather.Provider = WeatherProviderOpenMeteo
+	}
+	switch weather.Provider {
+	case WeatherProviderOpenMeteo:
+		if weather.APIURL == "" {
+			weather.APIURL = WeatherDefaultOpenMeteoURL
+		}
+	case WeatherProviderMETNorway:
+		if weather.APIURL == "" {
+			weather.APIURL = WeatherDefaultMETNorwayURL
+		}
+	default:
+		return fmt.Errorf("Weather.Initialise: provider must be either \"%s\" or \"%s\"", WeatherProviderOpenMeteo, WeatherProviderMETNorway)
+	}
+	if weather.GeocodingURL == "" {
+		weather.GeocodingURL = WeatherDefaultGeocodingURL
+	}
+	if weather.Days < 1 {
+		weather.Days = WeatherDefaultDays
+	} else if weather.Days > WeatherMaxDays {
+		weather.Days = WeatherMaxDays
+	}
+	return nil
+}
+
+func (weather *Weather) Trigger() Trigger {
+	return WeatherTrigger
+}
+
+// httpRequest returns the parameters of an HTTP request made to the forecast and geocoding APIs.
+func (weather *Weather) httpRequest(timeoutSec int) inet.HTTPRequest {
+	return inet.HTTPRequest{
+		TimeoutSec: timeoutSec,
+		Header:     http.Header{"User-Agent": {WeatherUserAgent}},
+	}
+}
+
+// Geocode returns the coordinates and full name of a place name, or the coordinates as-is if the place is given in coordinates.
+func (weather *Weather) Geocode(ctx context.Context, timeoutSec int, place string) (lat, long float64, name string, err error) {
+	if match := RegexWeatherCoordinates.FindStringSubmatch(place); match != nil {
+		lat, _ = strconv.ParseFloat(match[1], 64)
+		long, _ = strconv.ParseFloat(match[2], 64)
+		if lat < -90 || lat > 90 || long < -180 || long > 180 {
+			return 0, 0, "", errors.New("latitude must be within -90 and 90, and longitude must be within -180 and 180")
+		}
+		return lat, long, fmt.Sprintf("%.4f,%.4f", lat, long), nil
+	}
+	resp, err := inet.DoHTTP(ctx, weather.httpRequest(timeoutSec), strings.ReplaceAll(weather.GeocodingURL, "%", "%%")+"?name=%s&count=1&format=json", place)
+	if errResult := HTTPErrorToResult(resp, err); errResult != nil {
+		return 0, 0, "", errResult.Error
+	}
+	var geocode struct {
+		Results []struct {
+			Name      string  `json:"name"`
+			Latitude  float64 `json:"latitude"`
+			Longitude float64 `json:"longitude"`
+			Admin1    string  `json:"admin1"`
+			Country   string  `json:"country"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(resp.Body, &geocode); err != nil {
+		return 0, 0, "", fmt.Errorf("failed to decode geocoding response - %w", err)
+	} else if len(geocode.Results) == 0 {
+		return 0, 0, "", fmt.Errorf("cannot find place \"%s\"", place)
+	}
+	result := geocode.Results[0]
+	nameParts := []string{result.Name}
+	for _, part := range []string{result.Admin1, result.Country} {
+		if part != "" && part != nameParts[len(nameParts)-1] {
+			nameParts = append(nameParts, part)
+		}
+	}
+	return result.Latitude, result.Longitude, strings.Join(nameParts, ", "), nil
+}
+
+// Forecast looks up the current weather and daily forecast of a place name or coordinates.
+func (weather *Weather) Forecast(ctx context.Context, timeoutSec int, place string) (WeatherForecast, error) {
+	lat, long, name, err := weather.Geocode(ctx, timeoutSec, place)
+	if err != nil {
+		return WeatherForecast{}, err
+	}
+	var forecast WeatherForecast
+	if weather.Provider == WeatherProviderMETNorway {
+		forecast, err = weather.forecastByMETNorway(ctx, timeoutSec, lat, long)
+	} else {
+		forecast, err = weather.forecastByOpenMeteo(ctx, timeoutSec, lat, long)
+	}
+	forecast.Place = name
+	return forecast, err
+}
+
+// forecastByOpenMeteo retrieves the forecast from open-meteo.com.
+func (weather *Weather) forecastByOpenMeteo(ctx context.Context, timeoutSec int, lat, long float64) (WeatherForecast, error) {
+	resp, err := inet.DoHTTP(ctx, weather.httpRequest(timeoutSec),
+		strings.ReplaceAll(weather.APIURL, "%", "%%")+"?latitude=%s&longitude=%s&current=%s&daily=%s&timezone=auto&forecast_days=%s&wind_speed_unit=ms",
+		strconv.FormatFloat(lat, 'f', 4, 64), strconv.FormatFloat(long, 'f', 4, 64),
+		"temperature_2m,wind_speed_10m,weather_code", "weather_code,temperature_2m_max,temperature_2m_min,precipitation_sum", weather.Days)
+	if errResult := HTTPErrorToResult(resp, err); errResult != nil {
+		return WeatherForecast{}, errResult.Error
+	}
+	var body struct {
+		Current struct {
+			Temperature float64 `json:"temperature_2m"`
+			WindSpeed   float64 `json:"wind_speed_10m"`
+			WeatherCode int     `json:"weather_code"`
+		} `json:"current"`
+		Daily struct {
+			Time          []string  `json:"time"`
+			WeatherCode   []int     `json:"weather_code"`
+			MaxTemp       []float64 `json:"temperature_2m_max"`
+			MinTemp       []float64 `json:"temperature_2m_min"`
+			Precipitation []float64 `json:"precipitation_sum"`
+		} `json:"daily"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return WeatherForecast{}, fmt.Errorf("failed to decode forecast response - %w", err)
+	}
+	daily := body.Daily
+	if len(daily.Time) == 0 || len(daily.WeatherCode) != len(daily.Time) || len(daily.MaxTemp) != len(daily.Time) ||
+		len(daily.MinTemp) != len(daily.Time) || len(daily.Precipitation) != len(daily.Time) {
+		return WeatherForecast{}, errors.New("forecast response does not contain daily forecast")
+	}
+	forecast := WeatherForecast{
+		CurrentTemp: body.Current.Temperature,
+		CurrentWind: body.Current.WindSpeed,
+		Summary:     wmoWeatherCodeText(body.Current.WeatherCode),
+	}
+	for i, dateStr := range daily.Time {
+		date, err := time.Parse("2006-01-02", dateStr)
+		if err != nil {
+			return WeatherForecast{}, fmt.Errorf("forecast response contains malformed date - %w", err)
+		}
+		forecast.Days = append(forecast.Days, WeatherDay{
+			Date:          date,
+			MinTemp:       daily.MinTemp[i],
+			MaxTemp:       daily.MaxTemp[i],
+			Precipitation: daily.Precipitation[i],
+			Summary:       wmoWeatherCodeText(daily.WeatherCode[i]),
+		})
+	}
+	return forecast, nil
+}
+
+// metNorwayPeriod is the summary and precipitation of the hours following a point of time in the forecast of api.met.no.
+type metNorwayPeriod struct {
+	Summary struct {
+		SymbolCode string `json:"symbol_code"`
+	} `json:"summary"`
+	Details struct {
+		Precipitation *float64 `json:"precipitation_amount"`
+	} `json:"details"`
+}
+
+// forecastByMETNorway retrieves the forecast from api.met.no and summarises its time series into daily forecast.
+func (weather *Weather) forecastByMETNorway(ctx context.Context, timeoutSec int, lat, long float64) (WeatherForecast, error) {
+	// api.met.no asks for coordinates of no more than 4 decimals
+	resp, err := inet.DoHTTP(ctx, weather.httpRequest(timeoutSec), strings.ReplaceAll(weather.APIURL, "%", "%%")+"?lat=%s&lon=%s",
+		strconv.FormatFloat(lat, 'f', 4, 64), strconv.FormatFloat(long, 'f', 4, 64))
+	if errResult := HTTPErrorToResult(resp, err); errResult != nil {
+		return WeatherForecast{}, errResult.Error
+	}
+	var body struct {
+		Properties struct {
+			Timeseries []struct {
+				Time time.Time `json:"time"`
+				Data struct {
+					Instant struct {
+						Details struct {
+							Temperature float64 `json:"air_temperature"`
+							WindSpeed   float64 `json:"wind_speed"`
+						} `json:"details"`
+					} `json:"instant"`
+					Next1Hours  *metNorwayPeriod `json:"next_1_hours"`
+					Next6Hours  *metNorwayPeriod `json:"next_6_hours"`
+					Next12Hours *metNorwayPeriod `json:"next_12_hours"`
+				} `json:"data"`
+			} `json:"timeseries"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		return WeatherForecast{}, fmt.Errorf("failed to decode forecast response - %w", err)
+	}
+	series := body.Properties.Timeseries
+	if len(series) == 0 {
+		return WeatherForecast{}, errors.New("forecast response does not contain time series")
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		return series[i].Time.Before(series[j].Time)
+	})
+	// The time series is in UTC, approximate the local time of the place by its longitude to tell the days apart.
+	localZone := time.FixedZone("", int(math.Round(long/15))*3600)
+	forecast := WeatherForecast{
+		CurrentTemp: series[0].Data.Instant.Details.Temperature,
+		CurrentWind: series[0].Data.Instant.Details.WindSpeed,
+	}
+	for _, period := range []*metNorwayPeriod{series[0].Data.Next1Hours, series[0].Data.Next6Hours, series[0].Data.Next12Hours} {
+		if period != nil && period.Summary.SymbolCode != "" {
+			forecast.Summary = metNorwaySymbolText(period.Summary.SymbolCode)
+			break
+		}
+	}
+	// The summary of a day comes from the point of time closest to the noon
+	noonDistance := make(map[int]time.Duration)
+	// The series is hourly in the near future and then 6-hourly, the precipitation of each hour is counted only once.
+	var precipitationUntil time.Time
+	for _, point := range series {
+		localTime := point.Time.In(localZone)
+		date := time.Date(localTime.Year(), localTime.Month(), localTime.Day(), 0, 0, 0, 0, time.UTC)
+		if len(forecast.Days) == 0 || !forecast.Days[len(forecast.Days)-1].Date.Equal(date) {
+			if len(forecast.Days) == weather.Days {
+				break
+			}
+			forecast.Days = append(forecast.Days, WeatherDay{Date: date, MinTemp: math.Inf(1), MaxTemp: math.Inf(-1)})
+		}
+		dayIndex := len(forecast.Days) - 1
+		day := &forecast.Days[dayIndex]
+		temp := point.Data.Instant.Details.Temperature
+		day.MinTemp = math.Min(day.MinTemp, temp)
+		day.MaxTemp = math.Max(day.MaxTemp, temp)
+		if !point.Time.Before(precipitationUntil) {
+			if next := point.Data.Next1Hours; next != nil && next.Details.Precipitation != nil {
+				day.Precipitation += *next.Details.Precipitation
+				precipitationUntil = point.Time.Add(1 * time.Hour)
+			} else if next := point.Data.Next6Hours; next != nil && next.Details.Precipitation != nil {
+				day.Precipitation += *next.Details.Precipitation
+				precipitationUntil = point.Time.Add(6 * time.Hour)
+			}
+		}
+		distance := time.Duration(localTime.Hour())*time.Hour + time.Duration(localTime.Minute())*time.Minute - 12*time.Hour
+		if distance < 0 {
+			distance = -distance
+		}
+		for _, period := range []*metNorwayPeriod{point.Data.Next6Hours, point.Data.Next12Hours, point.Data.Next1Hours} {
+			if period == nil || period.Summary.SymbolCode == "" {
+				continue
+			}
+			if closest, exists := noonDistance[dayIndex]; !exists || distance < closest {
+				noonDistance[dayIndex] = distance
+				day.Summary = metNorwaySymbolText(period.Summary.SymbolCode)
+			}
+			break
+		}
+	}
+	return forecast, nil
+}
+
+// wmoWeatherCodeText returns the description of a WMO weather interpretation code used by open-meteo.com.
+func wmoWeatherCodeText(code int) string {
+	switch {
+	case code == 0:
+		return "clear"
+	case code == 1:
+		return "mostly clear"
+	case code == 2:
+		return "partly cloudy"
+	case code == 3:
+		return "overcast"
+	case code == 45 || code == 48:
+		return "fog"
+	case code >= 51 && code <= 55:
+		return "drizzle"
+	case code == 56 || code == 57:
+		return "freezing drizzle"
+	case code >= 61 && code <= 65:
+		return "rain"
+	case code == 66 || code == 67:
+		return "freezing rain"
+	case code >= 71 && code <= 77:
+		return "snow"
+	case code >= 80 && code <= 82:
+		return "rain showers"
+	case code == 85 || code == 86:
+		return "snow showers"
+	case code >= 95 && code <= 99:
+		return "thunderstorm"
+	}
+	return fmt.Sprintf("weather code %d", code)
+}
+
+// metNorwaySymbolWords are the words that make up the weather symbol codes of api.met.no, e.g. "lightrainshowersandthunder".
+var metNorwaySymbolWords = []string{"clearsky", "cloudy", "fair", "fog", "partly", "light", "heavy", "rain", "sleet", "snow", "showers", "and", "thunder"}
+
+// metNorwaySymbolText returns the description of a weather symbol code used by api.met.no, e.g. "partlycloudy_day" becomes "partly cloudy".
+func metNorwaySymbolText(code string) string {
+	code, _, _ = strings.Cut(code, "_")
+	var words []string
+	for rest := code; rest != ""; {
+		var matched string
+		for _, word := range metNorwaySymbolWords {
+			if strings.HasPrefix(rest, word) {
+				matched = word
+				break
+			}
+		}
+		if matched == "" {
+			return code
+		}
+		switch matched {
+		case "clearsky":
+			words = append(words, "clear")
+		case "fair":
+			words = append(words, "mostly clear")
+		default:
+			words = append(words, matched)
+		}
+		rest = rest[len(matched):]
+	}
+	return strings.Join(words, " ")
+}
+
+// Format returns the forecast in compact text, one line for the current weather and one line for each day.
+func (weather *Weather) Format(forecast WeatherForecast) string {
+	tempUnit, windUnit, precipUnit := "C", "m/s", "mm"
+	temp, wind, precip := func(c float64) float64 { return c }, func(ms float64) float64 { return ms }, func(mm float64) float64 { return mm }
+	precipFormat := "%.1f"
+	if weather.Imperial {
+		tempUnit, windUnit, precipUnit = "F", "mph", "in"
+		temp = func(c float64) float64 { return c*9/5 + 32 }
+		wind = func(ms float64) float64 { return ms * 2.23694 }
+		precip = func(mm float64) float64 { return mm / 25.4 }
+		precipFormat = "%.2f"
+	}
+	var lines []string
+	lines = append(lines, forecast.Place)
+	now := fmt.Sprintf("Now %.0f%s wind %.0f%s", temp(forecast.CurrentTemp), tempUnit, wind(forecast.CurrentWind), windUnit)
+	if forecast.Summary != "" {
+		now += " " + forecast.Summary
+	}
+	lines = append(lines, now)
+	for _, day := range forecast.Days {
+		line := fmt.Sprintf("%s %.0f~%.0f%s", day.Date.Format("Mon 2"), temp(day.MinTemp), temp(day.MaxTemp), tempUnit)
+		if day.Precipitation >= 0.1 {
+			line += " " + fmt.Sprintf(precipFormat, precip(day.Precipitation)) + precipUnit
+		}
+		if day.Summary != "" {
+			line += " " + day.Summary
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (weather *Weather) Execute(ctx context.Context, cmd Command) *Result {
+	place := weather.DefaultPlace
+	if errResult := cmd.Trim(); errResult == nil {
+		place = cmd.Content
+	}
+	if place == "" {
+		return &Result{Error: ErrBadWeatherParam}
+	}
+	forecast, err := weather.Forecast(ctx, cmd.TimeoutSec, place)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: weather.Format(forecast)}
+}
@@ -0,0 +1,102 @@
+package toolbox
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeather(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/geocoding", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("name") != "Helsinki" {
+			_, _ = w.Write([]byte(`{"generationtime_ms": 0.1}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"results": [{"name": "Helsinki", "latitude": 60.16952, "longitude": 24.93546, "admin1": "Uusimaa", "country": "Finland"}]}`))
+	})
+	mux.HandleFunc("/open-meteo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != WeatherUserAgent || r.FormValue("latitude") != "60.1695" || r.FormValue("longitude") != "24.9355" ||
+			r.FormValue("forecast_days") != "3" || r.FormValue("wind_speed_unit") != "ms" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{
+"current": {"time": "2024-06-01T10:00", "temperature_2m": 3.4, "wind_speed_10m": 5.2, "weather_code": 3},
+"daily": {
+	"time": ["2024-06-01", "2024-06-02"],
+	"weather_code": [61, 0],
+	"temperature_2m_max": [6.2, 8],
+	"temperature_2m_min": [1, 2],
+	"precipitation_sum": [2.14, 0]
+}}`))
+	})
+	mux.HandleFunc("/met.no", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != WeatherUserAgent || r.FormValue("lat") != "60.1695" || r.FormValue("lon") != "24.9355" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"properties": {"timeseries": [
+{"time": "2024-06-01T09:00:00Z", "data": {"instant": {"details": {"air_temperature": 18, "wind_speed": 4}},
+	"next_1_hours": {"summary": {"symbol_code": "lightrain"}, "details": {"precipitation_amount": 0.5}}}},
+{"time": "2024-06-01T08:00:00Z", "data": {"instant": {"details": {"air_temperature": 15, "wind_speed": 3}},
+	"next_1_hours": {"summary": {"symbol_code": "partlycloudy_day"}, "details": {"precipitation_amount": 0}},
+	"next_6_hours": {"summary": {"symbol_code": "cloudy"}, "details": {"precipitation_amount": 1}}}},
+{"time": "2024-06-01T10:00:00Z", "data": {"instant": {"details": {"air_temperature": 20, "wind_speed": 5}},
+	"next_1_hours": {"summary": {"symbol_code": "rain"}, "details": {"precipitation_amount": 1.5}},
+	"next_6_hours": {"summary": {"symbol_code": "rainshowersandthunder_day"}, "details": {"precipitation_amount": 3}}}},
+{"time": "2024-06-01T23:00:00Z", "data": {"instant": {"details": {"air_temperature": 10, "wind_speed": 2}},
+	"next_6_hours": {"summary": {"symbol_code": "fair_night"}, "details": {"precipitation_amount": 0}}}},
+{"time": "2024-06-02T10:00:00Z", "data": {"instant": {"details": {"air_temperature": 22, "wind_speed": 2}},
+	"next_6_hours": {"summary": {"symbol_code": "heavysnow"}, "details": {"precipitation_amount": 4}}}}
+]}}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	weather := Weather{Provider: "bad"}
+	require.True(t, weather.IsConfigured())
+	require.Error(t, weather.Initialise())
+	weather = Weather{APIURL: server.URL + "/open-meteo", GeocodingURL: server.URL + "/geocoding"}
+	require.NoError(t, weather.Initialise())
+	require.Equal(t, WeatherProviderOpenMeteo, weather.Provider)
+	require.Equal(t, WeatherDefaultDays, weather.Days)
+
+	run := func(content string) *Result {
+		return weather.Execute(context.Background(), Command{TimeoutSec: 10, Content: content})
+	}
+	require.ErrorIs(t, run("").Error, ErrBadWeatherParam)
+	require.ErrorContains(t, run("Atlantis").Error, "cannot find place")
+	require.ErrorContains(t, run("91,0").Error, "latitude must be within")
+	result := run("Helsinki")
+	require.NoError(t, result.Error)
+	require.Equal(t, "Helsinki, Uusimaa, Finland\nNow 3C wind 5m/s overcast\nSat 1 1~6C 2.1mm rain\nSun 2 2~8C clear", result.Output)
+	// Look up the coordinates and the default place, in imperial units
+	weather.Imperial = true
+	weather.DefaultPlace = "60.16952 24.93546"
+	result = run("")
+	require.NoError(t, result.Error)
+	require.Equal(t, "60.1695,24.9355\nNow 38F wind 12mph overcast\nSat 1 34~43F 0.08in rain\nSun 2 36~46F clear", result.Output)
+
+	// Summarise the time series of met.no into daily forecast
+	weather = Weather{Provider: WeatherProviderMETNorway, APIURL: server.URL + "/met.no", GeocodingURL: server.URL + "/geocoding"}
+	require.NoError(t, weather.Initialise())
+	result = run("Helsinki")
+	require.NoError(t, result.Error)
+	require.Equal(t, "Helsinki, Uusimaa, Finland\nNow 15C wind 3m/s partly cloudy\nSat 1 15~20C 2.0mm rain showers and thunder\nSun 2 10~22C 4.0mm heavy snow", result.Output)
+	weather.Days = 1
+	result = run("Helsinki")
+	require.NoError(t, result.Error)
+	require.Equal(t, "Helsinki, Uusimaa, Finland\nNow 15C wind 3m/s partly cloudy\nSat 1 15~20C 2.0mm rain showers and thunder", result.Output)
+}
+
+func TestMETNorwaySymbolText(t *testing.T) {
+	require.Equal(t, "clear", metNorwaySymbolText("clearsky_day"))
+	require.Equal(t, "mostly clear", metNorwaySymbolText("fair_polartwilight"))
+	require.Equal(t, "partly cloudy", metNorwaySymbolText("partlycloudy_night"))
+	require.Equal(t, "light sleet showers and thunder", metNorwaySymbolText("lightsleetshowersandthunder_day"))
+	require.Equal(t, "unknownsymbol", metNorwaySymbolText("unknownsymbol"))
+}
@@ -4,6 +4,7 @@ package toolbox
 import (
 	"context"
 	"errors"
+	"io"
 	"strings"
 
 	"github.com/HouzuoGuo/laitos/inet"
@@ -30,6 +31,28 @@ type Command struct {
 	TimeoutSec int
 	// Content is the app command input.
 	Content string
+	/*
+		AuthorisedTriggers are the feature triggers that the daemon has authorised the command to use without a password
+		PIN, for example, after an API gateway authorizer has verified the caller's identity. The PIN filter lets such
+		command through as-is, and the command processor refuses to run features outside of these triggers.
+		Leave it empty to require a password PIN as usual.
+	*/
+	AuthorisedTriggers []Trigger
+	/*
+		LiveOutput (optional) receives the output of the features that support streaming (e.g. shell) as the output is
+		produced, in addition to the output of the command result. The result filters do not apply to the live output.
+	*/
+	LiveOutput io.Writer
+}
+
+// IsTriggerAuthorised returns true if the command has been authorised to use the feature of the trigger without a PIN.
+func (cmd *Command) IsTriggerAuthorised(trigger Trigger) bool {
+	for _, authorised := range cmd.AuthorisedTriggers {
+		if strings.EqualFold(string(authorised), string(trigger)) {
+			return true
+		}
+	}
+	return false
 }
 
 // Modify command content to remove leading and trailing white spaces. Return error result if command becomes empty afterwards.
@@ -4,8 +4,11 @@ package toolbox
 import (
 	"crypto/subtle"
 	"errors"
+	"fmt"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
 )
@@ -57,6 +60,64 @@ func canExecuteCommandUsingTOTP(commandContent, totp, password string) bool {
 	}
 }
 
+// TOTPStepWithCommand contains the time step of a second factor TOTP code and the toolbox command authenticated by it.
+type TOTPStepWithCommand struct {
+	Step           int64
+	ToolboxCommand string
+}
+
+/*
+lastSecondFactorCommand is a mapping between a TOTP secret and the most recent toolbox command authenticated by a second
+factor code derived from that secret. The state prevents an eavesdropper from replaying an intercepted code.
+*/
+var lastSecondFactorCommand = map[string]TOTPStepWithCommand{}
+
+/*
+canExecuteCommandUsingSecondFactor determines whether the toolbox command may proceed to execute using the second factor
+code of the time step that has been proven valid. The function returns true only if the code belongs to a time step
+later than that of the previously used code, or, if the identical toolbox command was executed using the code of the
+same time step. A code of an earlier time step is never accepted again.
+*/
+func canExecuteCommandUsingSecondFactor(commandContent string, step int64, secret string) bool {
+	lastTOTPCommandContentMutex.Lock()
+	defer lastTOTPCommandContentMutex.Unlock()
+	if last, exists := lastSecondFactorCommand[secret]; exists {
+		if step < last.Step {
+			return false
+		} else if step == last.Step {
+			// It is OK to reuse the code to authenticate the same toolbox command (e.g. a retransmitted DNS query)
+			return last.ToolboxCommand == commandContent
+		}
+	}
+	lastSecondFactorCommand[secret] = TOTPStepWithCommand{Step: step, ToolboxCommand: commandContent}
+	return true
+}
+
+// passwordCheckAction is the name of the action that uses a second factor code to check the password alone, without an app command.
+const passwordCheckAction = "password check"
+
+/*
+lastSecondFactorActionStep is a mapping between an action name together with a TOTP secret, and the time step of the
+second factor code most recently used for the action.
+*/
+var lastSecondFactorActionStep = map[string]int64{}
+
+/*
+canPerformActionUsingSecondFactor determines whether the action may proceed using the second factor code of the time
+step that has been proven valid. Unlike an app command, the action cannot be told apart from its replay, therefore the
+function returns true only if the code belongs to a time step later than that of the code previously used for the action.
+*/
+func canPerformActionUsingSecondFactor(action string, step int64, secret string) bool {
+	lastTOTPCommandContentMutex.Lock()
+	defer lastTOTPCommandContentMutex.Unlock()
+	key := action + "\x00" + secret
+	if last, exists := lastSecondFactorActionStep[key]; exists && step <= last {
+		return false
+	}
+	lastSecondFactorActionStep[key] = step
+	return true
+}
+
 /*
 PINAndShortcuts looks for:
 - Any of the recognised password PIN found at the beginning of any of the input lines.
@@ -66,11 +127,122 @@ The filter's Transform function will return an error if nothing is found.
 type PINAndShortcuts struct {
 	Passwords []string          `json:"Passwords"`
 	Shortcuts map[string]string `json:"Shortcuts"`
+	/*
+		TOTPSecrets are the base32 TOTP secrets (as used by authenticator apps) keyed by password PIN. An app command using
+		a password that has a TOTP secret must carry the 6-digit code immediately after the password PIN, e.g.
+		"mypassword123456.s echo hi". The 12-digit TOTP derived from the password PIN alone is not accepted for such a
+		password.
+	*/
+	TOTPSecrets map[string]string `json:"TOTPSecrets"`
+	/*
+		TOTPSkewSteps is the number of 30-second time steps before and after the current one, in which a TOTP code is
+		accepted. It defaults to DefaultTOTPSkewSteps when left at 0, and NoTOTPSkewSteps accepts only the code of the
+		current time step.
+	*/
+	TOTPSkewSteps int `json:"TOTPSkewSteps"`
 }
 
+const (
+	// DefaultTOTPSkewSteps is the default number of 30-second time steps of clock skew tolerated for TOTP codes.
+	DefaultTOTPSkewSteps = 1
+	// NoTOTPSkewSteps turns off the clock skew tolerance, only the code of the current time step is accepted.
+	NoTOTPSkewSteps = -1
+	// MaxTOTPSkewSteps is the maximum number of 30-second time steps of clock skew tolerated for TOTP codes.
+	MaxTOTPSkewSteps = 10
+	// SecondFactorCodeLength is the number of digits of a TOTP code that follows the password PIN.
+	SecondFactorCodeLength = 6
+)
+
 var ErrPINAndShortcutNotFound = errors.New("invalid password PIN or shortcut")
 var ErrTOTPAlreadyUsed = errors.New("the TOTP has already been used with a different command")
 
+// ValidateTOTPSecrets returns an error if a TOTP secret does not belong to a password PIN or cannot be decoded.
+func (pin *PINAndShortcuts) ValidateTOTPSecrets() error {
+	if pin.TOTPSkewSteps < NoTOTPSkewSteps || pin.TOTPSkewSteps > MaxTOTPSkewSteps {
+		return fmt.Errorf("TOTPSkewSteps must be between %d (no tolerance) and %d, 0 uses the default", NoTOTPSkewSteps, MaxTOTPSkewSteps)
+	}
+	for password, secret := range pin.TOTPSecrets {
+		if !slices.Contains(pin.Passwords, password) {
+			return errors.New("each of the TOTPSecrets must be keyed by one of the passwords")
+		}
+		if _, err := GetTwoFACodeForTimeDivision(secret, 0); err != nil || strings.TrimSpace(secret) == "" {
+			return errors.New("each of the TOTPSecrets must be a base32 encoded secret")
+		}
+	}
+	return nil
+}
+
+// getTOTPSkewSteps returns the number of time steps of clock skew tolerated for TOTP codes.
+func (pin *PINAndShortcuts) getTOTPSkewSteps() int64 {
+	switch {
+	case pin.TOTPSkewSteps == 0:
+		return DefaultTOTPSkewSteps
+	case pin.TOTPSkewSteps < 0:
+		return 0
+	default:
+		return int64(pin.TOTPSkewSteps)
+	}
+}
+
+// matchSecondFactor returns the time step of the TOTP code if it is valid for the secret within the clock skew tolerance.
+func (pin *PINAndShortcuts) matchSecondFactor(secret, code string) (step int64, matched bool) {
+	skew := pin.getTOTPSkewSteps()
+	currentStep := time.Now().Unix() / 30
+	for step := currentStep - skew; step <= currentStep+skew; step++ {
+		expected, err := GetTwoFACodeForTimeDivision(secret, step)
+		if err != nil {
+			lalog.DefaultLogger.Info(nil, err, "failed to calculate TOTP")
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+/*
+checkSecondFactor looks for a valid TOTP code at the beginning of the command content that follows the password PIN,
+and returns the content after the code.
+*/
+func (pin *PINAndShortcuts) checkSecondFactor(secret, originalContent, content string) (string, error) {
+	if len(content) <= SecondFactorCodeLength {
+		return "", ErrPINAndShortcutNotFound
+	}
+	step, matched := pin.matchSecondFactor(secret, content[:SecondFactorCodeLength])
+	if !matched {
+		return "", ErrPINAndShortcutNotFound
+	}
+	// Determine whether the valid code may execute this toolbox command
+	if !canExecuteCommandUsingSecondFactor(originalContent, step, secret) {
+		return "", ErrTOTPAlreadyUsed
+	}
+	return content[SecondFactorCodeLength:], nil
+}
+
+/*
+IsPasswordAccepted returns true only if the input is one of the passwords, followed by a valid TOTP code if the password
+has a TOTP secret. A TOTP code is not accepted again once it has been used to check the password.
+*/
+func (pin *PINAndShortcuts) IsPasswordAccepted(input string) bool {
+	for _, password := range pin.Passwords {
+		secret := pin.TOTPSecrets[password]
+		if secret == "" {
+			if subtle.ConstantTimeCompare([]byte(input), []byte(password)) == 1 {
+				return true
+			}
+			continue
+		}
+		if len(input) == len(password)+SecondFactorCodeLength && subtle.ConstantTimeCompare([]byte(input[:len(password)]), []byte(password)) == 1 {
+			// Each code is accepted only once, an eavesdropper cannot replay it within the clock skew tolerance.
+			if step, matched := pin.matchSecondFactor(secret, input[len(password):]); matched && canPerformActionUsingSecondFactor(passwordCheckAction, step, secret) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 /*
 getTOTP returns TOTP-based PINs that work as alternative to password PIN text input.
 TOTP based PINs are calculated based on system clock, therefore, the function returns a set of acceptable numbers in 90 seconds interval
@@ -122,6 +294,10 @@ func (pin *PINAndShortcuts) Transform(cmd Command) (Command, error) {
 	if len(pin.Passwords) == 0 && len(pin.Shortcuts) == 0 {
 		return Command{}, errors.New("PINAndShortcut must define security password(s), shortcut(s), or both.")
 	}
+	// The daemon has authorised the command to run without a PIN, the command processor restricts it to the authorised features.
+	if len(cmd.AuthorisedTriggers) > 0 {
+		return cmd, nil
+	}
 
 	// Among the input lines, look for a shortcut match, password PIN match, or TOTP code match, and leave command alone for further processing.
 	for _, line := range cmd.Lines() {
@@ -138,14 +314,23 @@ func (pin *PINAndShortcuts) Transform(cmd Command) (Command, error) {
 		// Look for a password PIN match
 		for _, password := range pin.Passwords {
 			// Calculate password-derived TOTP codes that can be used in place of password PIN
+			secret := pin.TOTPSecrets[password]
 			if len(line) > len(password) && subtle.ConstantTimeCompare([]byte(line[:len(password)]), []byte(password)) == 1 {
 				ret := cmd
 				// Remove matched password from the input, leave the app command in-place.
 				ret.Content = line[len(password):]
+				if secret != "" {
+					// The password must be followed by the second factor code, which is removed from the input too.
+					var err error
+					if ret.Content, err = pin.checkSecondFactor(secret, cmd.Content, ret.Content); err != nil {
+						return cmd, err
+					}
+				}
 				return ret, nil
 			}
 			// Look for a TOTP code match. The code is made of two TOTP numbers with six digits each.
-			if len(line) > 12 {
+			// The password-derived TOTP is a single factor, hence it does not work for a password that has a TOTP secret.
+			if len(line) > 12 && secret == "" {
 				totpCodes := getTOTP(password)
 				totpInput := line[:12]
 				if totpCodes[totpInput] {
@@ -3,6 +3,7 @@ package toolbox
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 func TestCanExecuteCommandUsingTOTP(t *testing.T) {
@@ -114,6 +115,88 @@ func TestPINAndShortcuts_Transform(t *testing.T) {
 	}
 }
 
+func TestPINAndShortcuts_SecondFactor(t *testing.T) {
+	secret := "JBSWY3DPEHPK3PXP"
+	pin := PINAndShortcuts{
+		Passwords:   []string{"mypassword", "otherpassword"},
+		TOTPSecrets: map[string]string{"mypassword": secret},
+	}
+	if err := pin.ValidateTOTPSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	currentStep := time.Now().Unix() / 30
+	codeOfStep := func(step int64) string {
+		code, err := GetTwoFACodeForTimeDivision(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	// The password alone, a wrong code, or the password-derived TOTP does not work
+	for _, content := range []string{"mypassword.s echo hi", "mypassword123", "mypassword" + codeOfStep(currentStep+3) + ".s echo hi"} {
+		if _, err := pin.Transform(Command{Content: content}); err != ErrPINAndShortcutNotFound {
+			t.Fatal(content, err)
+		}
+	}
+	_, current1, _, _ := GetTwoFACodes("mypassword")
+	_, current2, _, _ := GetTwoFACodes("drowssapym")
+	if _, err := pin.Transform(Command{Content: current1 + current2 + ".s echo hi"}); err != ErrPINAndShortcutNotFound {
+		t.Fatal(err)
+	}
+	// A password without TOTP secret does not need the code
+	if out, err := pin.Transform(Command{Content: "otherpassword.s echo hi"}); err != nil || out.Content != ".s echo hi" {
+		t.Fatal(out, err)
+	}
+	// The code of an upcoming time step within the skew works, and it may be reused for the identical command
+	content := "\nline1\n mypassword" + codeOfStep(currentStep+1) + ".s echo hi\nline2"
+	for i := 0; i < 2; i++ {
+		if out, err := pin.Transform(Command{Content: content}); err != nil || out.Content != ".s echo hi" {
+			t.Fatal(out, err)
+		}
+	}
+	// Replaying the code for a different command, or using the code of an earlier time step, does not work
+	if _, err := pin.Transform(Command{Content: "mypassword" + codeOfStep(currentStep+1) + ".s rm -rf /"}); err != ErrTOTPAlreadyUsed {
+		t.Fatal(err)
+	}
+	if _, err := pin.Transform(Command{Content: "mypassword" + codeOfStep(currentStep) + ".s echo bye"}); err != ErrTOTPAlreadyUsed {
+		t.Fatal(err)
+	}
+	// A wider skew accepts a code further away from the current time step
+	pin.TOTPSkewSteps = 3
+	if out, err := pin.Transform(Command{Content: "mypassword" + codeOfStep(currentStep+3) + ".s echo bye"}); err != nil || out.Content != ".s echo bye" {
+		t.Fatal(out, err)
+	}
+
+	// Turn off the clock skew tolerance
+	pin.TOTPSkewSteps = NoTOTPSkewSteps
+	if skew := pin.getTOTPSkewSteps(); skew != 0 {
+		t.Fatal(skew)
+	}
+	if _, err := pin.Transform(Command{Content: "mypassword" + codeOfStep(currentStep+5) + ".s echo bye"}); err != ErrPINAndShortcutNotFound {
+		t.Fatal(err)
+	}
+	if err := pin.ValidateTOTPSecrets(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Validate the configuration
+	for _, skew := range []int{NoTOTPSkewSteps - 1, MaxTOTPSkewSteps + 1} {
+		pin.TOTPSkewSteps = skew
+		if err := pin.ValidateTOTPSecrets(); err == nil {
+			t.Fatal("did not error")
+		}
+	}
+	pin.TOTPSkewSteps = 0
+	pin.TOTPSecrets = map[string]string{"nopassword": secret}
+	if err := pin.ValidateTOTPSecrets(); err == nil {
+		t.Fatal("did not error")
+	}
+	pin.TOTPSecrets = map[string]string{"mypassword": "not base32!"}
+	if err := pin.ValidateTOTPSecrets(); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
 func TestTranslateSequences_Transform(t *testing.T) {
 	tr := TranslateSequences{}
 	if out, err := tr.Transform(Command{Content: "abc"}); err != nil || out.Content != "abc" {
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -39,6 +40,9 @@ const (
 // ErrBadPrefix is a command execution error triggered if the command does not contain a valid toolbox feature trigger.
 var ErrBadPrefix = errors.New("bad prefix or feature is not configured")
 
+// ErrTriggerNotAuthorised is a command execution error indicating that the feature is outside of the authorised triggers of a PIN-less command.
+var ErrTriggerNotAuthorised = errors.New("feature not authorised for caller")
+
 // ErrBadPLT reminds user of the proper syntax to invoke PLT magic.
 var ErrBadPLT = errors.New(PrefixCommandPLT + " P L T command")
 
@@ -71,7 +75,12 @@ type CommandProcessor struct {
 		from large range of source IP addresses in an attempt to bypass daemon's own per-IP rate limit mechanism.
 	*/
 	MaxCmdPerSec int
-	rateLimit    *lalog.RateLimit
+	/*
+		Locale determines the language of canned responses (such as the rate limit error) and the spelling alphabet of
+		phonetic output. It defaults to English.
+	*/
+	Locale    string
+	rateLimit *lalog.RateLimit
 	// initOnce helps to initialise the command processor in preparation for processing command for the first time.
 	initOnce sync.Once
 
@@ -123,6 +132,25 @@ func (proc *CommandProcessor) IsEmpty() bool {
 	return false
 }
 
+/*
+IsPasswordAccepted returns true only if the input is one of the password PINs of the command processor, followed by a
+valid TOTP code if the password has a TOTP secret. It helps the daemons to authenticate users for the features that are
+not app commands. The internal rate limit of command processing applies to the password checks too, which slows down an
+attacker trying to guess the password.
+*/
+func (proc *CommandProcessor) IsPasswordAccepted(password string) bool {
+	proc.initialiseOnce()
+	if password == "" || misc.EmergencyLockDown || !proc.rateLimit.Add("instance", true) {
+		return false
+	}
+	for _, cmdFilter := range proc.CommandFilters {
+		if pinFilter, ok := cmdFilter.(*PINAndShortcuts); ok && pinFilter.IsPasswordAccepted(password) {
+			return true
+		}
+	}
+	return false
+}
+
 /*
 From the prospect of Internet-facing mail processor and Twilio hooks, check that parameters are within sane range.
 Return a zero-length slice if everything looks OK.
@@ -153,6 +181,9 @@ func (proc *CommandProcessor) IsSaneForInternet() (errs []error) {
 						break
 					}
 				}
+				if err := pin.ValidateTOTPSecrets(); err != nil {
+					errs = append(errs, errors.New(ErrBadProcessorConfig+err.Error()))
+				}
 				seenPIN = true
 				break
 			}
@@ -171,6 +202,11 @@ func (proc *CommandProcessor) IsSaneForInternet() (errs []error) {
 				if linter.MaxLength < 35 || linter.MaxLength > 4096 {
 					errs = append(errs, errors.New(ErrBadProcessorConfig+"Maximum output length for LintText must be within [35, 4096]"))
 				}
+				for _, name := range linter.Transforms {
+					if !IsLintTransform(name) {
+						errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"LintText transform \"%s\" is not supported", name))
+					}
+				}
 				seenLinter = true
 				break
 			}
@@ -179,6 +215,9 @@ func (proc *CommandProcessor) IsSaneForInternet() (errs []error) {
 			errs = append(errs, errors.New(ErrBadProcessorConfig+"\"LintText\" filter must be defined to restrict command output length"))
 		}
 	}
+	if !IsSupportedLocale(proc.Locale) {
+		errs = append(errs, fmt.Errorf(ErrBadProcessorConfig+"Locale \"%s\" is not supported", proc.Locale))
+	}
 	return
 }
 
@@ -196,7 +235,10 @@ func (proc *CommandProcessor) Process(ctx context.Context, cmd Command, runResul
 	}
 	// Refuse to execute a command if the internal rate limit has been reached
 	if !proc.rateLimit.Add("instance", true) {
-		return &Result{Error: ErrRateLimitExceeded}
+		if proc.Locale == "" || proc.Locale == LocaleEnglish {
+			return &Result{Error: ErrRateLimitExceeded}
+		}
+		return &Result{Error: errors.New(Translate(proc.Locale, TextRateLimitExceeded))}
 	}
 	// Refuse to execute a command if it is exceedingly long
 	if len(cmd.Content) > MaxCmdLength {
@@ -218,6 +260,7 @@ func (proc *CommandProcessor) Process(ctx context.Context, cmd Command, runResul
 	beginTimeNano := time.Now().UnixNano()
 	var filterDisapproval error
 	var matchedFeature Feature
+	var matchedPrefix Trigger
 	var overrideLintText LintText
 	var hasOverrideLintText bool
 	var logCommandContent string
@@ -282,35 +325,47 @@ func (proc *CommandProcessor) Process(ctx context.Context, cmd Command, runResul
 		content.
 	*/
 	logCommandContent = cmd.Content
-	// Look for command's prefix among configured features
-	for prefix, configuredFeature := range proc.Features.LookupByTrigger {
-		if cmd.FindAndRemovePrefix(string(prefix)) {
-			// Hacky workaround - do not log content of AES decryption commands as they can reveal encryption key
-			if prefix == AESDecryptTrigger || prefix == TwoFATrigger || prefix == NBETrigger {
-				logCommandContent = "<hidden due to AESDecryptTrigger or TwoFATrigger or NBETrigger>"
-			}
-			// Prevent result filters from being run for the store&forward
-			// message processor.
-			// Over here they are disabled after the command filters have
-			// successfully authorised the command to execute.
-			if prefix == StoreAndForwardMessageProcessorTrigger {
-				runResultFilters = false
-			}
-			matchedFeature = configuredFeature
-			break
+	// Look for command's prefix among configured features, prefer the longest prefix (e.g. ".purge" over ".p").
+	for prefix := range proc.Features.LookupByTrigger {
+		if len(prefix) > len(matchedPrefix) && strings.HasPrefix(strings.ToLower(strings.TrimSpace(cmd.Content)), strings.ToLower(string(prefix))) {
+			matchedPrefix = prefix
 		}
 	}
+	if matchedPrefix != "" && cmd.FindAndRemovePrefix(string(matchedPrefix)) {
+		// Hacky workaround - do not log content of AES decryption commands as they can reveal encryption key
+		if matchedPrefix == AESDecryptTrigger || matchedPrefix == TwoFATrigger || matchedPrefix == NBETrigger {
+			logCommandContent = "<hidden due to AESDecryptTrigger or TwoFATrigger or NBETrigger>"
+		}
+		// Do not log the client identifier of which the data is being purged.
+		if matchedPrefix == DataPurgeTrigger {
+			logCommandContent = "<hidden due to DataPurgeTrigger>"
+		}
+		// Prevent result filters from being run for the store&forward
+		// message processor.
+		// Over here they are disabled after the command filters have
+		// successfully authorised the command to execute.
+		if matchedPrefix == StoreAndForwardMessageProcessorTrigger {
+			runResultFilters = false
+		}
+		matchedFeature = proc.Features.LookupByTrigger[matchedPrefix]
+	}
 	// Unknown command prefix or the requested feature is not configured
 	if matchedFeature == nil {
 		ret = &Result{Error: ErrBadPrefix}
 		goto result
 	}
+	// A command authorised without password PIN may only use the features it has been authorised for
+	if len(cmd.AuthorisedTriggers) > 0 && !cmd.IsTriggerAuthorised(matchedPrefix) {
+		ret = &Result{Error: ErrTriggerNotAuthorised}
+		goto result
+	}
 	// Run the feature
 	proc.logger.Info(fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientTag), nil, "running \"%s\" (post-process result? %v)", logCommandContent, runResultFilters)
 	defer func() {
 		proc.logger.Info(fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientTag), nil, "completed \"%s\" (ok? %v post-process reslt? %v)", logCommandContent, ret.Error == nil, runResultFilters)
 	}()
 	ret = matchedFeature.Execute(ctx, cmd)
+	proc.Features.RecordUsage(matchedPrefix, ret.Error)
 result:
 	// Command in the result structure is mainly used for logging purpose
 	ret.Command = cmd
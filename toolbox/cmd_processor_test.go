@@ -115,6 +115,69 @@ func TestCommandProcessor_LengthLimit(t *testing.T) {
 	}
 }
 
+func TestCommandProcessor_AuthorisedTriggers(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	// An authorised command runs without PIN
+	result := proc.Process(context.Background(), Command{Content: ".s echo hi", TimeoutSec: 10, AuthorisedTriggers: []Trigger{".S"}}, true)
+	if result.Error != nil || result.CombinedOutput != "hi" {
+		t.Fatalf("%+v", result)
+	}
+	// The authorisation does not extend to other features
+	result = proc.Process(context.Background(), Command{Content: ".elog", TimeoutSec: 10, AuthorisedTriggers: []Trigger{".s"}}, true)
+	if result.Error != ErrTriggerNotAuthorised {
+		t.Fatalf("%+v", result)
+	}
+	// Without authorisation the PIN is required as usual
+	result = proc.Process(context.Background(), Command{Content: ".s echo hi", TimeoutSec: 10}, true)
+	if result.Error != ErrPINAndShortcutNotFound {
+		t.Fatalf("%+v", result)
+	}
+}
+
+func TestCommandProcessor_IsPasswordAccepted(t *testing.T) {
+	proc := GetTestCommandProcessor()
+	if !proc.IsPasswordAccepted(TestCommandProcessorPIN) {
+		t.Fatal("did not accept the password")
+	}
+	for _, password := range []string{"", "verysecre", TestCommandProcessorPIN + "t", TestCommandProcessorPIN + ".s echo hi"} {
+		if proc.IsPasswordAccepted(password) {
+			t.Fatalf("should not have accepted %q", password)
+		}
+	}
+	if GetEmptyCommandProcessor().IsPasswordAccepted(TestCommandProcessorPIN) {
+		t.Fatal("empty command processor should not have accepted the password")
+	}
+	// A password with a TOTP secret must be followed by a valid TOTP code
+	secret := "JBSWY3DPEHPK3PXP"
+	proc.CommandFilters[0].(*PINAndShortcuts).TOTPSecrets = map[string]string{TestCommandProcessorPIN: secret}
+	_, currentCode, _, err := GetTwoFACodes(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongCode, err := GetTwoFACodeForTimeDivision(secret, time.Now().Unix()/30+5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{TestCommandProcessorPIN, TestCommandProcessorPIN + wrongCode, TestCommandProcessorPIN + currentCode[:5], currentCode} {
+		if proc.IsPasswordAccepted(password) {
+			t.Fatalf("should not have accepted %q", password)
+		}
+	}
+	if !proc.IsPasswordAccepted(TestCommandProcessorPIN + currentCode) {
+		t.Fatal("did not accept the password and TOTP code")
+	}
+	// The same code cannot be used twice, neither can an earlier one.
+	prevCode, err := GetTwoFACodeForTimeDivision(secret, time.Now().Unix()/30-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{TestCommandProcessorPIN + currentCode, TestCommandProcessorPIN + prevCode} {
+		if proc.IsPasswordAccepted(password) {
+			t.Fatalf("should not have accepted the used code %q", password)
+		}
+	}
+}
+
 func TestCommandProcessor_RateLimit(t *testing.T) {
 	proc := GetTestCommandProcessor()
 	proc.MaxCmdPerSec = 2
@@ -218,6 +281,11 @@ func TestCommandProcessorIsSaneForInternet(t *testing.T) {
 	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
 		t.Fatal(errs)
 	}
+	// Linter bridge has an unknown transform
+	proc.ResultFilters = []ResultFilter{&LintText{MaxLength: 35, Transforms: []string{LintStripANSI, "Rot13"}}}
+	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
+		t.Fatal(errs)
+	}
 	// Good linter bridge
 	proc.ResultFilters = []ResultFilter{&LintText{MaxLength: 35}}
 	if errs := proc.IsSaneForInternet(); len(errs) != 0 {
@@ -1,15 +1,16 @@
 package toolbox
 
 import (
-	"bytes"
+	"context"
 	"regexp"
-	"strings"
-	"unicode"
 
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 )
 
+// NotifyViaSMSTimeoutSec is the timeout of Twilio API call that delivers each notification SMS.
+const NotifyViaSMSTimeoutSec = 30
+
 // RegexConsecutiveSpaces matches one or more whitespace characters excluding line breaks.
 var RegexConsecutiveSpaces = regexp.MustCompile(`[ \a\f\t\v]+`)
 
@@ -27,6 +28,10 @@ Lint combined text string in the following order (each step is turned on by resp
 4. Compress consecutive spaces into single space - this will also cause all lines to squeeze.
 5. Remove a number of leading character.
 6. Remove excessive characters at end of the string.
+
+Alternatively, Transforms may name the steps explicitly to form a pipeline, in which case the attributes of steps 1-4
+are ignored. The pipeline offers additional transforms, such as stripping ANSI escape sequences, for a daemon (e.g. SMS)
+that needs to mangle the text differently from the others.
 */
 type LintText struct {
 	TrimSpaces              bool `json:"TrimSpaces"`
@@ -35,39 +40,62 @@ type LintText struct {
 	CompressSpaces          bool `json:"CompressSpaces"`
 	BeginPosition           int  `json:"BeginPosition"`
 	MaxLength               int  `json:"MaxLength"`
+
+	/*
+		Transforms is the ordered list of transform names (e.g. "StripANSI", "Transliterate", "Truncate"). The removal
+		of leading and excessive characters ("Truncate") takes place at the end of the pipeline unless it is named.
+	*/
+	Transforms []string `json:"Transforms"`
+	// EllipsisMarker is placed at the end of the text in place of the excessive characters, e.g. "...".
+	EllipsisMarker string `json:"EllipsisMarker"`
 }
 
-func (lint *LintText) Transform(result *Result) error {
-	ret := result.CombinedOutput
-	// Trim spaces from beginning and end of each line, preserve line breaks.
-	if lint.TrimSpaces {
-		var out bytes.Buffer
-		for _, line := range strings.Split(ret, "\n") {
-			out.WriteString(strings.TrimSpace(line))
-			out.WriteRune('\n')
+// GetTransforms returns the names of transforms in the order they are applied.
+func (lint *LintText) GetTransforms() []string {
+	if len(lint.Transforms) > 0 {
+		for _, name := range lint.Transforms {
+			if name == LintTruncate {
+				return lint.Transforms
+			}
 		}
-		ret = strings.TrimSpace(out.String())
+		return append(append([]string{}, lint.Transforms...), LintTruncate)
 	}
-	// Substitute line breaks with a semicolon to compress all lines into a single line.
-	if lint.CompressToSingleLine {
-		ret = strings.Replace(ret, "\n", ";", -1)
+	ret := make([]string, 0, 5)
+	for _, step := range []struct {
+		on   bool
+		name string
+	}{
+		{lint.TrimSpaces, LintTrimSpaces},
+		{lint.CompressToSingleLine, LintCompressToSingleLine},
+		{lint.KeepVisible7BitCharOnly, LintKeepVisible7BitCharOnly},
+		{lint.CompressSpaces, LintCompressSpaces},
+	} {
+		if step.on {
+			ret = append(ret, step.name)
+		}
 	}
-	// Retain only printable ASCII characters
-	if lint.KeepVisible7BitCharOnly {
-		var out bytes.Buffer
-		for _, r := range ret {
-			if r < 128 && (unicode.IsPrint(r) || unicode.IsSpace(r)) {
-				out.WriteRune(r)
-			} else {
-				out.WriteRune('?')
-			}
+	return append(ret, LintTruncate)
+}
+
+func (lint *LintText) Transform(result *Result) error {
+	ret := result.CombinedOutput
+	for _, name := range lint.GetTransforms() {
+		if name == LintTruncate {
+			ret = lint.truncate(ret)
+		} else if transform, exists := lintTransforms[name]; exists {
+			ret = transform(ret)
 		}
-		ret = out.String()
 	}
-	// Compress consecutive spaces and leave line breaks (if any) in-place
-	if lint.CompressSpaces {
-		ret = RegexConsecutiveSpaces.ReplaceAllString(ret, " ")
+	// A transform that comes after truncation must not lengthen the output beyond the maximum length
+	if lint.MaxLength > 0 && len(ret) > lint.MaxLength {
+		ret = ret[0:lint.MaxLength]
 	}
+	result.CombinedOutput = ret
+	return nil
+}
+
+// truncate removes a number of leading characters and the excessive characters at the end.
+func (lint *LintText) truncate(ret string) string {
 	// Cut leading characters
 	if lint.BeginPosition > 0 {
 		if len(ret) > lint.BeginPosition {
@@ -79,11 +107,14 @@ func (lint *LintText) Transform(result *Result) error {
 	// Cut trailing characters
 	if lint.MaxLength > 0 {
 		if len(ret) > lint.MaxLength {
-			ret = ret[0:lint.MaxLength]
+			if lint.EllipsisMarker != "" && len(lint.EllipsisMarker) < lint.MaxLength {
+				ret = ret[0:lint.MaxLength-len(lint.EllipsisMarker)] + lint.EllipsisMarker
+			} else {
+				ret = ret[0:lint.MaxLength]
+			}
 		}
 	}
-	result.CombinedOutput = ret
-	return nil
+	return ret
 }
 
 func (_ *LintText) SetLogger(_ *lalog.Logger) {
@@ -118,8 +149,39 @@ func (notify *NotifyViaEmail) SetLogger(logger *lalog.Logger) {
 	notify.logger = logger
 }
 
+// Send SMS notification for command result via Twilio.
+type NotifyViaSMS struct {
+	Recipients []string `json:"Recipients"` // Phone numbers including country code
+	Twilio     *Twilio  `json:"-"`          // Twilio account that delivers outgoing notification SMS
+
+	logger *lalog.Logger
+}
+
+// Return true only if there are recipients and Twilio account is configured.
+func (notify *NotifyViaSMS) IsConfigured() bool {
+	return len(notify.Recipients) > 0 && notify.Twilio != nil && notify.Twilio.IsConfigured()
+}
+
+func (notify *NotifyViaSMS) Transform(result *Result) error {
+	if notify.IsConfigured() && result.Error != ErrPINAndShortcutNotFound && result.Error != ErrTOTPAlreadyUsed {
+		for _, recipient := range notify.Recipients {
+			go func(recipient string) {
+				if err := notify.Twilio.DeliverSMS(context.Background(), NotifyViaSMSTimeoutSec, recipient, result.CombinedOutput); err != nil {
+					notify.logger.Warning(recipient, err, "failed to send notification for command \"%s\"", result.Command.Content)
+				}
+			}(recipient)
+		}
+	}
+	return nil
+}
+
+func (notify *NotifyViaSMS) SetLogger(logger *lalog.Logger) {
+	notify.logger = logger
+}
+
 // If there is no graph character among the combined output, replace it by "EMPTY OUTPUT".
 type SayEmptyOutput struct {
+	Locale string // Locale determines the language of the substitute text, it defaults to English.
 }
 
 var RegexGraphChar = regexp.MustCompile("[[:graph:]]") // Match any visible character
@@ -127,7 +189,7 @@ const EmptyOutputText = "EMPTY OUTPUT"                 // Text to substitute emp
 
 func (empty *SayEmptyOutput) Transform(result *Result) error {
 	if !RegexGraphChar.MatchString(result.CombinedOutput) {
-		result.CombinedOutput = EmptyOutputText
+		result.CombinedOutput = Translate(empty.Locale, TextEmptyOutput)
 	}
 	return nil
 }
@@ -2,10 +2,13 @@ package toolbox
 
 import (
 	"net"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
 )
 
 func TestLintText_Transform(t *testing.T) {
@@ -68,6 +71,51 @@ func TestLintText_Transform_RetainLineBreaks(t *testing.T) {
 	}
 }
 
+func TestLintText_Transform_Pipeline(t *testing.T) {
+	lint := LintText{MaxLength: 35}
+	if transforms := lint.GetTransforms(); !reflect.DeepEqual(transforms, []string{LintTruncate}) {
+		t.Fatal(transforms)
+	}
+	lint.TrimSpaces = true
+	lint.CompressSpaces = true
+	if transforms := lint.GetTransforms(); !reflect.DeepEqual(transforms, []string{LintTrimSpaces, LintCompressSpaces, LintTruncate}) {
+		t.Fatal(transforms)
+	}
+	// Named transforms take precedence over the attributes
+	lint.Transforms = []string{LintStripANSI, LintTransliterate, LintCollapseWhitespace, LintKeepVisible7BitCharOnly}
+	if transforms := lint.GetTransforms(); !reflect.DeepEqual(transforms, append(lint.Transforms, LintTruncate)) {
+		t.Fatal(transforms)
+	}
+	result := &Result{CombinedOutput: "\x1b[1;31mCafé\x1b[0m  “naïve”\n\t—  Łódź 任意"}
+	if err := lint.Transform(result); err != nil || result.CombinedOutput != `Cafe "naive" - Lodz ??` {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	// Truncate with an ellipsis marker
+	lint.EllipsisMarker = "..."
+	result.CombinedOutput = strings.Repeat("a", 40)
+	if err := lint.Transform(result); err != nil || result.CombinedOutput != strings.Repeat("a", 32)+"..." {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	// Base64 encode binary output
+	lint.Transforms = []string{LintBase64Binary}
+	lint.MaxLength = 100
+	result.CombinedOutput = "text\n\tonly"
+	if err := lint.Transform(result); err != nil || result.CombinedOutput != "text\n\tonly" {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	result.CombinedOutput = "\x00\x01\xff"
+	if err := lint.Transform(result); err != nil || result.CombinedOutput != "AAH/" {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	// Output is still limited in length when a transform comes after truncation
+	lint.Transforms = []string{LintTruncate, LintBase64Binary}
+	lint.MaxLength = 35
+	result.CombinedOutput = strings.Repeat("\x00", 35)
+	if err := lint.Transform(result); err != nil || len(result.CombinedOutput) != 35 {
+		t.Fatal(err, result.CombinedOutput)
+	}
+}
+
 func TestNotifyViaEmail_Transform(t *testing.T) {
 	notify := NotifyViaEmail{}
 	if notify.IsConfigured() {
@@ -100,6 +148,49 @@ func TestNotifyViaEmail_Transform(t *testing.T) {
 	}
 }
 
+func TestNotifyViaSMS_Transform(t *testing.T) {
+	notify := NotifyViaSMS{}
+	if notify.IsConfigured() {
+		t.Fatal("should not be configured")
+	}
+	// It simply must not panic
+	if err := notify.Transform(&Result{}); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan map[string]string, 10)
+	server := newTwilioAPIServer(t, received)
+	defer server.Close()
+	notify.Twilio = &Twilio{PhoneNumber: "+100", AccountSID: "sid", AuthToken: "token", apiURL: server.URL}
+	notify.Recipients = []string{"+123", "+456"}
+	notify.SetLogger(lalog.DefaultLogger)
+	if !notify.IsConfigured() {
+		t.Fatal("should be configured now")
+	}
+	// Failed authorisation does not lead to notification
+	if err := notify.Transform(&Result{Error: ErrPINAndShortcutNotFound}); err != nil {
+		t.Fatal(err)
+	}
+	if err := notify.Transform(&Result{CombinedOutput: "command output"}); err != nil {
+		t.Fatal(err)
+	}
+	recipients := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case form := <-received:
+			if form["Body"] != "command output" {
+				t.Fatal(form)
+			}
+			recipients[form["To"]] = true
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for notification")
+		}
+	}
+	if !recipients["+123"] || !recipients["+456"] {
+		t.Fatal(recipients)
+	}
+}
+
 func TestSayEmptyOutput_Transform(t *testing.T) {
 	empty := SayEmptyOutput{}
 	result := &Result{CombinedOutput: "    \t\r\n    "}
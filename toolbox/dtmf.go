@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"strings"
-	"unicode"
 
 	"github.com/HouzuoGuo/laitos/lalog"
 )
@@ -180,29 +179,5 @@ E.g. given input "abc123", the function returns "alpha, beta, charlie, one, two,
 Spaces and consecutive spaces are simply spelt "space".
 */
 func SpellPhonetically(text string) string {
-	words := make([]string, 0, len(text))
-	var prevCharIsSpace bool
-	for _, c := range text {
-		if unicode.IsSpace(c) {
-			if !prevCharIsSpace {
-				words = append(words, "space")
-				prevCharIsSpace = true
-			}
-		} else {
-			prevCharIsSpace = false
-			var thisWord string
-			if unicode.IsUpper(c) {
-				// The trailing space is intentional in order to form a word such as "capital beta"
-				thisWord = "capital "
-				c = unicode.ToLower(c)
-			}
-			if phoneticSpelling, found := SpellTable[c]; found {
-				thisWord += phoneticSpelling
-			} else {
-				thisWord = fmt.Sprintf("%c", c)
-			}
-			words = append(words, thisWord)
-		}
-	}
-	return strings.Join(words, ", ")
+	return SpellPhoneticallyInLocale(LocaleEnglish, text)
 }
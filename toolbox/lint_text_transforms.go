@@ -0,0 +1,153 @@
+package toolbox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Names of the transforms that may appear in the LintText pipeline.
+const (
+	LintTrimSpaces              = "TrimSpaces"
+	LintCompressToSingleLine    = "CompressToSingleLine"
+	LintKeepVisible7BitCharOnly = "KeepVisible7BitCharOnly"
+	LintCompressSpaces          = "CompressSpaces"
+	LintStripANSI               = "StripANSI"
+	LintCollapseWhitespace      = "CollapseWhitespace"
+	LintTransliterate           = "Transliterate"
+	LintBase64Binary            = "Base64Binary"
+	LintTruncate                = "Truncate"
+)
+
+var (
+	// RegexANSIEscape matches ANSI escape sequences such as terminal colours and cursor movements.
+	RegexANSIEscape = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(\x07|\x1b\\)|[@-Z\\-_])`)
+	// RegexAllWhitespace matches one or more whitespace characters including line breaks.
+	RegexAllWhitespace = regexp.MustCompile(`\s+`)
+)
+
+// lintTransforms are the named text transforms of the LintText pipeline, except for "Truncate".
+var lintTransforms = map[string]func(string) string{
+	LintTrimSpaces:              lintTrimSpaces,
+	LintCompressToSingleLine:    lintCompressToSingleLine,
+	LintKeepVisible7BitCharOnly: lintKeepVisible7BitCharOnly,
+	LintCompressSpaces:          lintCompressSpaces,
+	LintStripANSI:               lintStripANSI,
+	LintCollapseWhitespace:      lintCollapseWhitespace,
+	LintTransliterate:           lintTransliterate,
+	LintBase64Binary:            lintBase64Binary,
+}
+
+// IsLintTransform returns true if the name belongs to a transform supported by the LintText pipeline.
+func IsLintTransform(name string) bool {
+	_, exists := lintTransforms[name]
+	return exists || name == LintTruncate
+}
+
+// lintTrimSpaces trims spaces from beginning and end of each line, and preserves line breaks.
+func lintTrimSpaces(in string) string {
+	var out bytes.Buffer
+	for _, line := range strings.Split(in, "\n") {
+		out.WriteString(strings.TrimSpace(line))
+		out.WriteRune('\n')
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// lintCompressToSingleLine substitutes line breaks with a semicolon to compress all lines into a single line.
+func lintCompressToSingleLine(in string) string {
+	return strings.Replace(in, "\n", ";", -1)
+}
+
+// lintKeepVisible7BitCharOnly retains only printable ASCII characters, and substitutes the others with question mark.
+func lintKeepVisible7BitCharOnly(in string) string {
+	var out bytes.Buffer
+	for _, r := range in {
+		if r < 128 && (unicode.IsPrint(r) || unicode.IsSpace(r)) {
+			out.WriteRune(r)
+		} else {
+			out.WriteRune('?')
+		}
+	}
+	return out.String()
+}
+
+// lintCompressSpaces compresses consecutive spaces and leaves line breaks (if any) in-place.
+func lintCompressSpaces(in string) string {
+	return RegexConsecutiveSpaces.ReplaceAllString(in, " ")
+}
+
+// lintStripANSI removes ANSI escape sequences, which are often found in the output of shell commands.
+func lintStripANSI(in string) string {
+	return RegexANSIEscape.ReplaceAllString(in, "")
+}
+
+// lintCollapseWhitespace collapses all consecutive whitespace characters including line breaks into a single space.
+func lintCollapseWhitespace(in string) string {
+	return strings.TrimSpace(RegexAllWhitespace.ReplaceAllString(in, " "))
+}
+
+// lintTransliterate substitutes common unicode letters and punctuations with their closest ASCII equivalent.
+func lintTransliterate(in string) string {
+	var out strings.Builder
+	for _, r := range in {
+		if r < 128 {
+			out.WriteRune(r)
+		} else if ascii, exists := TransliterationTable[r]; exists {
+			out.WriteString(ascii)
+		} else if unicode.IsSpace(r) {
+			out.WriteRune(' ')
+		} else {
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+/*
+lintBase64Binary encodes the text in base64 if it looks like binary data, that is, either it is not valid UTF-8 or it
+contains control characters other than whitespace.
+*/
+func lintBase64Binary(in string) string {
+	if !utf8.ValidString(in) {
+		return base64.StdEncoding.EncodeToString([]byte(in))
+	}
+	for _, r := range in {
+		if unicode.IsControl(r) && !unicode.IsSpace(r) {
+			return base64.StdEncoding.EncodeToString([]byte(in))
+		}
+	}
+	return in
+}
+
+// TransliterationTable maps unicode letters and punctuations to their closest ASCII equivalent.
+var TransliterationTable = map[rune]string{
+	// Punctuations and symbols
+	'‘': "'", '’': "'", '‚': "'", '‛': "'", '′': "'",
+	'“': `"`, '”': `"`, '„': `"`, '‟': `"`, '″': `"`, '«': `"`, '»': `"`,
+	'‐': "-", '‑': "-", '‒': "-", '–': "-", '—': "-", '―': "-", '−': "-",
+	'…': "...", '•': "*", '·': ".", '×': "x", '÷': "/", '±': "+-",
+	'€': "EUR", '£': "GBP", '¥': "JPY", '¢': "c", '©': "(c)", '®': "(R)", '™': "TM", '°': "deg",
+	'¡': "!", '¿': "?", '§': "S", '¶': "P", '¼': "1/4", '½': "1/2", '¾': "3/4",
+	// Latin-1 supplement
+	'À': "A", 'Á': "A", 'Â': "A", 'Ã': "A", 'Ä': "Ae", 'Å': "A", 'Æ': "AE", 'Ç': "C",
+	'È': "E", 'É': "E", 'Ê': "E", 'Ë': "E", 'Ì': "I", 'Í': "I", 'Î': "I", 'Ï': "I",
+	'Ð': "D", 'Ñ': "N", 'Ò': "O", 'Ó': "O", 'Ô': "O", 'Õ': "O", 'Ö': "Oe", 'Ø': "O",
+	'Ù': "U", 'Ú': "U", 'Û': "U", 'Ü': "Ue", 'Ý': "Y", 'Þ': "Th", 'ß': "ss",
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "ae", 'å': "a", 'æ': "ae", 'ç': "c",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i",
+	'ð': "d", 'ñ': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "oe", 'ø': "o",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "ue", 'ý': "y", 'þ': "th", 'ÿ': "y",
+	// Latin extended-A
+	'Ā': "A", 'ā': "a", 'Ă': "A", 'ă': "a", 'Ą': "A", 'ą': "a", 'Ć': "C", 'ć': "c", 'Č': "C", 'č': "c",
+	'Ď': "D", 'ď': "d", 'Đ': "D", 'đ': "d", 'Ē': "E", 'ē': "e", 'Ė': "E", 'ė': "e", 'Ę': "E", 'ę': "e",
+	'Ě': "E", 'ě': "e", 'Ğ': "G", 'ğ': "g", 'Ī': "I", 'ī': "i", 'Į': "I", 'į': "i", 'İ': "I", 'ı': "i",
+	'Ķ': "K", 'ķ': "k", 'Ĺ': "L", 'ĺ': "l", 'Ļ': "L", 'ļ': "l", 'Ľ': "L", 'ľ': "l", 'Ł': "L", 'ł': "l",
+	'Ń': "N", 'ń': "n", 'Ņ': "N", 'ņ': "n", 'Ň': "N", 'ň': "n", 'Ō': "O", 'ō': "o", 'Ő': "O", 'ő': "o",
+	'Œ': "OE", 'œ': "oe", 'Ŕ': "R", 'ŕ': "r", 'Ř': "R", 'ř': "r", 'Ś': "S", 'ś': "s", 'Ş': "S", 'ş': "s",
+	'Š': "S", 'š': "s", 'Ţ': "T", 'ţ': "t", 'Ť': "T", 'ť': "t", 'Ū': "U", 'ū': "u", 'Ů': "U", 'ů': "u",
+	'Ű': "U", 'ű': "u", 'Ų': "U", 'ų': "u", 'Ÿ': "Y", 'Ź': "Z", 'ź': "z", 'Ż': "Z", 'ż': "z", 'Ž': "Z", 'ž': "z",
+}
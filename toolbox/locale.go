@@ -0,0 +1,181 @@
+package toolbox
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// LocaleEnglish is the default locale of canned responses and phonetic spelling.
+	LocaleEnglish = "en"
+	// LocaleGerman translates canned responses into German and spells output using the German spelling alphabet (DIN 5009).
+	LocaleGerman = "de"
+)
+
+// Keys of the canned response texts that are translated according to the locale.
+const (
+	TextEmptyOutput       = "EmptyOutput"       // TextEmptyOutput substitutes an empty command output (SayEmptyOutput).
+	TextRateLimitExceeded = "RateLimitExceeded" // TextRateLimitExceeded is the command processor internal rate limit error.
+	TextCallRateLimited   = "CallRateLimited"   // TextCallRateLimited is spoken to a caller who calls too frequently.
+	TextCallRepeat        = "CallRepeat"        // TextCallRepeat is spoken in between repetitions of command output.
+	TextCallOver          = "CallOver"          // TextCallOver is spoken after the last repetition of command output.
+	TextSpellSpace        = "SpellSpace"        // TextSpellSpace is the phonetic spelling of spaces.
+	TextSpellCapital      = "SpellCapital"      // TextSpellCapital is spelt before a capital letter.
+	TextSpeechLanguage    = "SpeechLanguage"    // TextSpeechLanguage is the language code of text-to-speech (e.g. Twilio <Say>).
+)
+
+// CannedTexts is a mapping between locale and its translation of canned response texts.
+var CannedTexts = map[string]map[string]string{
+	LocaleEnglish: {
+		TextEmptyOutput:       EmptyOutputText,
+		TextRateLimitExceeded: ErrRateLimitExceeded.Error(),
+		TextCallRateLimited:   "You are rate limited.",
+		TextCallRepeat:        "repeat again",
+		TextCallOver:          "over",
+		TextSpellSpace:        "space",
+		TextSpellCapital:      "capital",
+		TextSpeechLanguage:    "en-US",
+	},
+	LocaleGerman: {
+		TextEmptyOutput:       "KEINE AUSGABE",
+		TextRateLimitExceeded: "die interne Befehlsrate des Befehlsprozessors wurde überschritten",
+		TextCallRateLimited:   "Zu viele Anrufe, bitte versuchen Sie es später erneut.",
+		TextCallRepeat:        "noch einmal",
+		TextCallOver:          "Ende",
+		TextSpellSpace:        "Leerzeichen",
+		TextSpellCapital:      "groß",
+		TextSpeechLanguage:    "de-DE",
+	},
+}
+
+// SpellTableGerman spells out individual letters and symbols using the German spelling alphabet (DIN 5009).
+var SpellTableGerman = map[rune]string{
+	'`': "Gravis", '~': "Tilde", '!': "Ausrufezeichen", '@': "at", '#': "Raute", '$': "Dollar", '%': "Prozent",
+	'^': "Zirkumflex", '&': "und-Zeichen", '*': "Stern", '(': "Klammer auf", ')': "Klammer zu",
+	'-': "Bindestrich",
+	'_': "Unterstrich",
+	'=': "gleich",
+	'+': "plus",
+
+	'[':  "eckige Klammer auf",
+	'{':  "geschweifte Klammer auf",
+	']':  "eckige Klammer zu",
+	'}':  "geschweifte Klammer zu",
+	'\\': "Backslash",
+	'|':  "senkrechter Strich",
+	';':  "Semikolon",
+	':':  "Doppelpunkt",
+	'\'': "Apostroph",
+	'"':  "Anführungszeichen",
+	',':  "Komma",
+	'<':  "kleiner als",
+	'.':  "Punkt",
+	'>':  "größer als",
+	'/':  "Schrägstrich",
+	'?':  "Fragezeichen",
+
+	'1': "eins",
+	'2': "zwei",
+	'3': "drei",
+	'4': "vier",
+	'5': "fünf",
+	'6': "sechs",
+	'7': "sieben",
+	'8': "acht",
+	'9': "neun",
+	'0': "null",
+
+	'a': "Anton",
+	'ä': "Ärger",
+	'b': "Berta",
+	'c': "Cäsar",
+	'd': "Dora",
+	'e': "Emil",
+	'f': "Friedrich",
+	'g': "Gustav",
+	'h': "Heinrich",
+	'i': "Ida",
+	'j': "Julius",
+	'k': "Kaufmann",
+	'l': "Ludwig",
+	'm': "Martha",
+	'n': "Nordpol",
+	'o': "Otto",
+	'ö': "Ökonom",
+	'p': "Paula",
+	'q': "Quelle",
+	'r': "Richard",
+	's': "Samuel",
+	'ß': "Eszett",
+	't': "Theodor",
+	'u': "Ulrich",
+	'ü': "Übermut",
+	'v': "Viktor",
+	'w': "Wilhelm",
+	'x': "Xanthippe",
+	'y': "Ypsilon",
+	'z': "Zacharias",
+}
+
+// SpellTables is a mapping between locale and its phonetic spelling alphabet.
+var SpellTables = map[string]map[rune]string{
+	LocaleEnglish: SpellTable,
+	LocaleGerman:  SpellTableGerman,
+}
+
+// IsSupportedLocale returns true only if the locale is empty (default) or has its canned response translations.
+func IsSupportedLocale(locale string) bool {
+	if locale == "" {
+		return true
+	}
+	_, found := CannedTexts[locale]
+	return found
+}
+
+// Translate returns the canned response text in the locale. It falls back to English if the locale is not supported.
+func Translate(locale, key string) string {
+	if texts, found := CannedTexts[locale]; found {
+		if text, found := texts[key]; found {
+			return text
+		}
+	}
+	return CannedTexts[LocaleEnglish][key]
+}
+
+/*
+SpellPhoneticallyInLocale returns input text with every letter, number, and symbol spelt phonetically using the spelling
+alphabet of the locale. It falls back to English if the locale is not supported.
+*/
+func SpellPhoneticallyInLocale(locale, text string) string {
+	spellTable, found := SpellTables[locale]
+	if !found {
+		spellTable = SpellTable
+	}
+	space, capital := Translate(locale, TextSpellSpace), Translate(locale, TextSpellCapital)
+	words := make([]string, 0, len(text))
+	var prevCharIsSpace bool
+	for _, c := range text {
+		if unicode.IsSpace(c) {
+			if !prevCharIsSpace {
+				words = append(words, space)
+				prevCharIsSpace = true
+			}
+		} else {
+			prevCharIsSpace = false
+			var thisWord string
+			if unicode.IsUpper(c) {
+				// The trailing space is intentional in order to form a word such as "capital beta"
+				thisWord = capital + " "
+				c = unicode.ToLower(c)
+			}
+			if phoneticSpelling, found := spellTable[c]; found {
+				thisWord += phoneticSpelling
+			} else {
+				thisWord += fmt.Sprintf("%c", c)
+			}
+			words = append(words, thisWord)
+		}
+	}
+	return strings.Join(words, ", ")
+}
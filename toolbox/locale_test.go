@@ -0,0 +1,60 @@
+package toolbox
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	if s := Translate("", TextEmptyOutput); s != EmptyOutputText {
+		t.Fatal(s)
+	}
+	if s := Translate(LocaleGerman, TextEmptyOutput); s != "KEINE AUSGABE" {
+		t.Fatal(s)
+	}
+	// Unsupported locale falls back to English
+	if s := Translate("xx", TextCallOver); s != "over" {
+		t.Fatal(s)
+	}
+	if !IsSupportedLocale("") || !IsSupportedLocale(LocaleGerman) || IsSupportedLocale("xx") {
+		t.Fatal("wrong locale support")
+	}
+	// Every locale translates every canned text
+	for locale, texts := range CannedTexts {
+		if len(texts) != len(CannedTexts[LocaleEnglish]) {
+			t.Fatal(locale)
+		}
+	}
+}
+
+func TestSpellPhoneticallyInLocale(t *testing.T) {
+	if s := SpellPhoneticallyInLocale(LocaleGerman, "Ab 1.ü"); s != "groß Anton, Berta, Leerzeichen, eins, Punkt, Übermut" {
+		t.Fatal(s)
+	}
+	if s := SpellPhoneticallyInLocale("xx", "Ab"); s != "capital alpha, beta" {
+		t.Fatal(s)
+	}
+}
+
+func TestSayEmptyOutput_Locale(t *testing.T) {
+	result := &Result{CombinedOutput: " "}
+	if err := (&SayEmptyOutput{Locale: LocaleGerman}).Transform(result); err != nil || result.CombinedOutput != "KEINE AUSGABE" {
+		t.Fatal(err, result.CombinedOutput)
+	}
+	proc := GetTestCommandProcessor()
+	proc.Locale = "xx"
+	if errs := proc.IsSaneForInternet(); len(errs) != 1 {
+		t.Fatal(errs)
+	}
+	// Exhaust the rate limit to get a translated error
+	proc = GetTestCommandProcessor()
+	proc.Locale = LocaleGerman
+	proc.MaxCmdPerSec = 1
+	var result2 *Result
+	for i := 0; i < 5; i++ {
+		result2 = proc.Process(context.Background(), Command{TimeoutSec: 5, Content: TestCommandProcessorPIN + ".s echo hi"}, true)
+	}
+	if result2.Error == nil || result2.Error.Error() != Translate(LocaleGerman, TextRateLimitExceeded) {
+		t.Fatal(result2.Error)
+	}
+}
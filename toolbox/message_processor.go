@@ -2,9 +2,11 @@ package toolbox
 
 import (
 	"context"
+	"crypto/cipher"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"regexp"
 	"sort"
 	"strings"
@@ -93,6 +95,12 @@ type MessageProcessor struct {
 		self reported host name.
 	*/
 	MaxReportsPerHostName int `json:"MaxReportsPerHostName"`
+	/*
+		SubjectKeys is a map of subject's self-reported host name and the key shared with the subject. The app commands
+		and command results exchanged with the subject are encrypted end-to-end using the key, protecting them from the
+		intermediate network (e.g. radio and satellite) providers.
+	*/
+	SubjectKeys map[string]string `json:"SubjectKeys"`
 	// OwnerName is the name of the component that carries this message processor. This is used for logging purpose.
 	OwnerName string `json:"-"`
 	// ForwardReportsToKinesis is an optional kinesis client that will get a copy of every subject report.
@@ -103,7 +111,14 @@ type MessageProcessor struct {
 	ForwardReportsToSNS *awsinteg.SNSClient `json:"-"`
 	// SNSTopicARN is an optional ARN (Amazon Resource Name) of an SNS topic that will get a copy of every subject report.
 	SNSTopicARN string `json:"-"`
+	/*
+		PersistentStore optionally keeps the subject reports in a file, so that their history survives a restart of the
+		program and can be queried beyond the reports kept in memory.
+	*/
+	PersistentStore ReportStore `json:"PersistentStore"`
 
+	// e2eCiphers are the ciphers derived from SubjectKeys, keyed by lower case host name.
+	e2eCiphers map[string]cipher.AEAD
 	// totalReports is the total number of reports received thus far.
 	totalReports int
 	// mutex prevents concurrent modifications made to internal structures.
@@ -143,12 +158,17 @@ func (proc *MessageProcessor) StoreReport(ctx context.Context, request SubjectRe
 		// All reports must have a host name, or object name.
 		return SubjectReportResponse{}
 	}
-	// Ensure that the request attributes are not exceedingly long
-	request.Lint()
 	// Host name (DNS name) is not case sensitive
 	request.SubjectHostName = strings.TrimSpace(strings.ToLower(request.SubjectHostName))
+	// Decrypt the command exchange before the length of the encrypted content is checked
+	aead := proc.e2eCiphers[request.SubjectHostName]
+	if aead != nil {
+		request = proc.decryptRequest(aead, request, clientTag)
+	}
+	// Ensure that the request attributes are not exceedingly long
+	request.Lint()
 	// Send kinesis firehose a copy of the report
-	if misc.EnableAWSIntegration {
+	if misc.AWSIntegration.IsEnabled() {
 		if proc.ForwardReportsToKinesisFirehose != nil && proc.KinesisFirehoseStreamName != "" {
 			go func() {
 				recordData, err := json.Marshal(request)
@@ -196,24 +216,41 @@ func (proc *MessageProcessor) StoreReport(ctx context.Context, request SubjectRe
 	proc.SubjectClientTags[clientTag] = struct{}{}
 	// Scan and remove expired subjects every couple of thousands of reports
 	proc.totalReports++
+	compactStore := false
 	if proc.totalReports%proc.MaxReportsPerHostName == 0 {
 		proc.removeExpiredSubjects()
+		compactStore = true
 	}
 	outgoingCommandForSubject := proc.OutgoingAppCommands[request.SubjectHostName]
 	// Release the lock for report handling is now completed. The app command (if requested) will run without holding the lock.
 	proc.mutex.Unlock()
+	if proc.PersistentStore.IsConfigured() {
+		if err := proc.PersistentStore.Append(newReport); err != nil {
+			proc.logger.Warning(request.SubjectHostName, err, "failed to persist the report")
+		}
+		if compactStore {
+			// Remove the reports past the retention period from the store
+			if _, err := proc.PersistentStore.RemoveExpired(); err != nil {
+				proc.logger.Warning("", err, "failed to remove expired reports from the persistent store")
+			}
+		}
+	}
 	cmdResponse := proc.processCommandRequest(ctx, request, clientTag, daemonName)
 	if outgoingCommandForSubject == "" {
 		proc.logger.Info(fmt.Sprintf("%s-%s", request.SubjectHostName, clientTag), nil, "store report from %s", daemonName)
 	} else {
 		proc.logger.Info(fmt.Sprintf("%s-%s", request.SubjectHostName, clientTag), nil, "store report from %s, replying with a pending app command.", daemonName)
 	}
-	return SubjectReportResponse{
+	resp := SubjectReportResponse{
 		CommandRequest: AppCommandRequest{
 			Command: outgoingCommandForSubject,
 		},
 		CommandResponse: cmdResponse,
 	}
+	if aead != nil {
+		resp = encryptResponse(aead, resp)
+	}
+	return resp
 }
 
 /*
@@ -384,6 +421,60 @@ func (proc *MessageProcessor) GetLatestReports(maxLimit int) (ret []SubjectRepor
 	return
 }
 
+/*
+GetHistoricalReports returns the reports received between the two timestamps (a zero timestamp means unbounded),
+optionally from the host name alone. The reports come from the persistent store if it is configured, or otherwise from
+memory. The returned values are sorted from latest to oldest, there will be up to maxLimit of them.
+*/
+func (proc *MessageProcessor) GetHistoricalReports(hostName string, since, until time.Time, maxLimit int) ([]SubjectReport, error) {
+	if maxLimit < 1 {
+		return []SubjectReport{}, nil
+	}
+	if proc.PersistentStore.IsConfigured() {
+		return proc.PersistentStore.Query(hostName, since, until, maxLimit)
+	}
+	var candidates []SubjectReport
+	if hostName == "" {
+		candidates = proc.GetLatestReports(math.MaxInt32)
+	} else {
+		candidates = proc.GetLatestReportsFromSubject(hostName, math.MaxInt32)
+	}
+	ret := make([]SubjectReport, 0)
+	for _, report := range candidates {
+		if len(ret) >= maxLimit {
+			break
+		}
+		if !since.IsZero() && report.ServerTime.Before(since) || !until.IsZero() && report.ServerTime.After(until) {
+			continue
+		}
+		ret = append(ret, report)
+	}
+	return ret, nil
+}
+
+// restoreReports reads the reports from the persistent store into memory, up to the maximum number of reports per subject.
+func (proc *MessageProcessor) restoreReports() error {
+	for _, hostName := range proc.PersistentStore.HostNames() {
+		reports, err := proc.PersistentStore.Query(hostName, time.Time{}, time.Time{}, proc.MaxReportsPerHostName)
+		if err != nil {
+			return err
+		}
+		proc.mutex.Lock()
+		// The reports are sorted from latest to oldest, whereas the memory keeps them from oldest to latest.
+		subjectReports := make([]SubjectReport, 0, proc.MaxReportsPerHostName)
+		for i := len(reports) - 1; i >= 0; i-- {
+			subjectReports = append(subjectReports, reports[i])
+			proc.SubjectClientTags[reports[i].SubjectClientTag] = struct{}{}
+		}
+		proc.SubjectReports[hostName] = &subjectReports
+		proc.mutex.Unlock()
+	}
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	proc.removeExpiredSubjects()
+	return nil
+}
+
 // GetSubjectReportCount returns the count of reports held in memory, collected from each subject.
 func (proc *MessageProcessor) GetSubjectReportCount() (ret map[string]int) {
 	proc.mutex.Lock()
@@ -403,6 +494,75 @@ func (proc *MessageProcessor) HasClientTag(tag string) bool {
 	return exists
 }
 
+/*
+PurgeClient removes the reports and app commands of the subject that self-reported the client identifier as its host
+name, as well as the reports collected from the client identifier (e.g. client IP). It returns the number of reports
+removed.
+*/
+func (proc *MessageProcessor) PurgeClient(clientID string) int {
+	fun := func(subject string, report SubjectReport) bool {
+		return subject == strings.ToLower(clientID) || report.SubjectClientTag == clientID
+	}
+	removed := proc.removeReportsIf(fun)
+	if proc.PersistentStore.IsConfigured() && proc.mutex != nil {
+		// The reports kept in memory are also in the persistent store, in addition to the older ones.
+		removedFromStore, err := proc.PersistentStore.RemoveIf(func(report SubjectReport) bool {
+			return fun(report.OriginalRequest.SubjectHostName, report)
+		})
+		if err != nil {
+			proc.logger.Warning("", err, "failed to purge client from the persistent store")
+		}
+		if removedFromStore > removed {
+			removed = removedFromStore
+		}
+	}
+	return removed
+}
+
+// ExpireBefore removes the reports received before the timestamp and returns the number of reports removed.
+func (proc *MessageProcessor) ExpireBefore(before time.Time) int {
+	return proc.removeReportsIf(func(_ string, report SubjectReport) bool {
+		return report.ServerTime.Before(before)
+	})
+}
+
+/*
+removeReportsIf removes the reports for which the function returns true, and returns the number of reports removed.
+Subjects left without a report are forgotten altogether, including their pending app commands.
+*/
+func (proc *MessageProcessor) removeReportsIf(fun func(subject string, report SubjectReport) bool) (removed int) {
+	if proc.mutex == nil {
+		return 0
+	}
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	for subject, reports := range proc.SubjectReports {
+		kept := make([]SubjectReport, 0, len(*reports))
+		for _, report := range *reports {
+			if fun(subject, report) {
+				removed++
+			} else {
+				kept = append(kept, report)
+			}
+		}
+		if len(kept) == 0 {
+			delete(proc.SubjectReports, subject)
+			delete(proc.IncomingAppCommands, subject)
+			delete(proc.OutgoingAppCommands, subject)
+		} else {
+			*reports = kept
+		}
+	}
+	// Rebuild the client tags from the remaining reports.
+	proc.SubjectClientTags = make(map[string]struct{})
+	for _, reports := range proc.SubjectReports {
+		for _, report := range *reports {
+			proc.SubjectClientTags[report.SubjectClientTag] = struct{}{}
+		}
+	}
+	return
+}
+
 /*
 removeExpiredSubjects is an internal function that looks at the most recent report made by each subject and removes subjects that have not
 made any report for a long time. The internal function assumes that its caller is holding the mutex.
@@ -448,6 +608,17 @@ func (proc *MessageProcessor) Initialise() error {
 	proc.IncomingAppCommands = make(map[string]*IncomingAppCommand)
 	proc.OutgoingAppCommands = make(map[string]string)
 	proc.mutex = new(sync.Mutex)
+	proc.e2eCiphers = make(map[string]cipher.AEAD)
+	for hostName, key := range proc.SubjectKeys {
+		if key == "" {
+			return fmt.Errorf("MessageProcessor.Initialise: the key of subject \"%s\" must not be empty", hostName)
+		}
+		aead, err := NewE2ECipher(key)
+		if err != nil {
+			return fmt.Errorf("MessageProcessor.Initialise: %w", err)
+		}
+		proc.e2eCiphers[strings.TrimSpace(strings.ToLower(hostName))] = aead
+	}
 	if proc.CmdProcessor != nil {
 		if errs := proc.CmdProcessor.IsSaneForInternet(); len(errs) > 0 {
 			return fmt.Errorf("MessageProcessor.Initialise: %+v", errs)
@@ -457,6 +628,14 @@ func (proc *MessageProcessor) Initialise() error {
 		ComponentName: "MessageProcessor",
 		ComponentID:   []lalog.LoggerIDField{{Key: "Owner", Value: proc.OwnerName}},
 	}
+	if proc.PersistentStore.IsConfigured() {
+		if err := proc.PersistentStore.Initialise(); err != nil {
+			return fmt.Errorf("MessageProcessor.Initialise: %w", err)
+		}
+		if err := proc.restoreReports(); err != nil {
+			return fmt.Errorf("MessageProcessor.Initialise: failed to restore reports from the persistent store - %w", err)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,93 @@
+package toolbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// E2EEncryptedPrefix is the prefix of an end-to-end encrypted app command or command result exchanged between a
+	// message processor and a subject.
+	E2EEncryptedPrefix = "e2e:"
+	// e2eFieldCommand and e2eFieldResult tell the encrypted fields apart, so that one cannot be passed off as the other.
+	e2eFieldCommand = "command"
+	e2eFieldResult  = "result"
+)
+
+// ErrNotE2EEncrypted is returned when an app command or result arrives unencrypted from a peer that shares a key.
+var ErrNotE2EEncrypted = errors.New("the peer shares an encryption key but the content is not end-to-end encrypted")
+
+// NewE2ECipher derives an AES-256-GCM cipher from the key shared by a message processor and a subject.
+func NewE2ECipher(key string) (cipher.AEAD, error) {
+	digest := sha256.Sum256([]byte("laitos-message-processor-e2e:" + key))
+	block, err := aes.NewCipher(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptE2E encrypts the content of the field, an empty content remains empty.
+func EncryptE2E(aead cipher.AEAD, field, content string) string {
+	if content == "" {
+		return ""
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Errorf("EncryptE2E: failed to read random nonce - %w", err))
+	}
+	return E2EEncryptedPrefix + base64.RawStdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(content), []byte(field)))
+}
+
+// DecryptE2E decrypts the content of the field encrypted by EncryptE2E, an empty content remains empty.
+func DecryptE2E(aead cipher.AEAD, field, content string) (string, error) {
+	if content == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(content, E2EEncryptedPrefix) {
+		return "", ErrNotE2EEncrypted
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(content[len(E2EEncryptedPrefix):])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("DecryptE2E: malformed encrypted content")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(field))
+	if err != nil {
+		return "", errors.New("DecryptE2E: failed to decrypt, the keys may not match")
+	}
+	return string(plain), nil
+}
+
+/*
+decryptRequest decrypts the app command and command result carried by a report from the peer that shares the key. The
+content that fails to decrypt is discarded, leaving an error message in place of the command result.
+*/
+func (proc *MessageProcessor) decryptRequest(aead cipher.AEAD, request SubjectReportRequest, clientTag string) SubjectReportRequest {
+	actor := fmt.Sprintf("%s-%s", request.SubjectHostName, clientTag)
+	var err error
+	if request.CommandRequest.Command, err = DecryptE2E(aead, e2eFieldCommand, request.CommandRequest.Command); err != nil {
+		proc.logger.Warning(actor, err, "discarded the app command request")
+	}
+	if request.CommandResponse.Command, err = DecryptE2E(aead, e2eFieldCommand, request.CommandResponse.Command); err != nil {
+		proc.logger.Warning(actor, err, "discarded the app command response")
+		request.CommandResponse.Result = "error: " + err.Error()
+	} else if request.CommandResponse.Result, err = DecryptE2E(aead, e2eFieldResult, request.CommandResponse.Result); err != nil {
+		proc.logger.Warning(actor, err, "discarded the app command result")
+		request.CommandResponse.Result = "error: " + err.Error()
+	}
+	return request
+}
+
+// encryptResponse encrypts the app command and command result carried by a reply to the peer that shares the key.
+func encryptResponse(aead cipher.AEAD, resp SubjectReportResponse) SubjectReportResponse {
+	resp.CommandRequest.Command = EncryptE2E(aead, e2eFieldCommand, resp.CommandRequest.Command)
+	resp.CommandResponse.Command = EncryptE2E(aead, e2eFieldCommand, resp.CommandResponse.Command)
+	resp.CommandResponse.Result = EncryptE2E(aead, e2eFieldResult, resp.CommandResponse.Result)
+	return resp
+}
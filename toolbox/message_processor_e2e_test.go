@@ -0,0 +1,64 @@
+package toolbox
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMessageProcessor_E2E(t *testing.T) {
+	if err := (&MessageProcessor{SubjectKeys: map[string]string{"subject": ""}}).Initialise(); err == nil {
+		t.Fatal("did not reject empty key")
+	}
+	// The server tracks the subject, and the subject tracks the server, by each other's host name
+	server := &MessageProcessor{CmdProcessor: GetTestCommandProcessor(), SubjectKeys: map[string]string{"Subject": "shared-key"}}
+	if err := server.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	subject := &MessageProcessor{CmdProcessor: GetTestCommandProcessor(), SubjectKeys: map[string]string{"server": "shared-key"}}
+	if err := subject.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	// The server sends an encrypted app command to the subject
+	server.SetOutgoingCommand("subject", TestCommandProcessorPIN+".s echo e2e-test")
+	resp := server.StoreReport(ctx, SubjectReportRequest{SubjectHostName: "subject"}, "1.1.1.1", "test")
+	if !strings.HasPrefix(resp.CommandRequest.Command, E2EEncryptedPrefix) || strings.Contains(resp.CommandRequest.Command, "echo") {
+		t.Fatal(resp)
+	}
+	// The subject runs the command and replies with the encrypted result in its next report
+	subject.StoreReport(ctx, SubjectReportRequest{SubjectHostName: "server", CommandRequest: resp.CommandRequest}, "server", "test")
+	exchange := subject.StoreReport(ctx, SubjectReportRequest{SubjectHostName: "server"}, "server", "test")
+	if !strings.HasPrefix(exchange.CommandResponse.Result, E2EEncryptedPrefix) || strings.Contains(exchange.CommandResponse.Result, "e2e-test") {
+		t.Fatal(exchange)
+	}
+	server.StoreReport(ctx, SubjectReportRequest{SubjectHostName: "subject", CommandResponse: exchange.CommandResponse}, "1.1.1.1", "test")
+	report := server.GetLatestReportsFromSubject("subject", 1)[0]
+	if report.OriginalRequest.CommandResponse.Command != TestCommandProcessorPIN+".s echo e2e-test" || report.OriginalRequest.CommandResponse.Result != "e2e-test" {
+		t.Fatalf("%+v", report)
+	}
+	// An unencrypted result is discarded
+	server.StoreReport(ctx, SubjectReportRequest{SubjectHostName: "subject", CommandResponse: AppCommandResponse{Command: "cmd", Result: "forged"}}, "1.1.1.1", "test")
+	report = server.GetLatestReportsFromSubject("subject", 1)[0]
+	if report.OriginalRequest.CommandResponse.Command != "" || report.OriginalRequest.CommandResponse.Result != "error: "+ErrNotE2EEncrypted.Error() {
+		t.Fatalf("%+v", report)
+	}
+	// A result encrypted by a different key is discarded
+	otherCipher, err := NewE2ECipher("other-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.StoreReport(ctx, SubjectReportRequest{SubjectHostName: "subject", CommandResponse: AppCommandResponse{
+		Command: EncryptE2E(otherCipher, e2eFieldCommand, "cmd"),
+		Result:  EncryptE2E(otherCipher, e2eFieldResult, "forged"),
+	}}, "1.1.1.1", "test")
+	report = server.GetLatestReportsFromSubject("subject", 1)[0]
+	if report.OriginalRequest.CommandResponse.Command != "" || !strings.HasPrefix(report.OriginalRequest.CommandResponse.Result, "error: ") {
+		t.Fatalf("%+v", report)
+	}
+	// The subjects without a key exchange commands in plain
+	server.SetOutgoingCommand("other", "plain")
+	if resp := server.StoreReport(ctx, SubjectReportRequest{SubjectHostName: "other"}, "1.1.1.1", "test"); resp.CommandRequest.Command != "plain" {
+		t.Fatal(resp)
+	}
+}
@@ -0,0 +1,401 @@
+package toolbox
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReportStoreRetentionSec is the default number of seconds to keep a subject report in the persistent store.
+	DefaultReportStoreRetentionSec = 30 * 24 * 3600
+	// ReportStoreMaxLineLen is the maximum length of an encrypted subject report in the persistent store.
+	ReportStoreMaxLineLen = 2 * 1024 * 1024
+	// ReportStoreCompactFraction is the fraction (1/N) of the store file taken up by expired reports that triggers a compaction.
+	ReportStoreCompactFraction = 4
+)
+
+// reportIndexEntry locates a report in the store file, along with the report properties used to answer queries.
+type reportIndexEntry struct {
+	offset     int64
+	length     int
+	hostName   string
+	serverTime time.Time
+}
+
+/*
+ReportStore keeps subject reports in a file, each line of which is a report serialised in JSON and encrypted by
+AES-256-GCM, using a key derived from the configured passphrase. The message processor appends each incoming report to
+the file and reads the reports back upon restart, so that the history of subjects survives a restart of the program.
+The store keeps an index of the reports in memory, hence a query only reads the reports it returns from the file. The
+file is rewritten from time to time to remove the reports past the retention period.
+*/
+type ReportStore struct {
+	// FilePath is the location of the file that stores the reports. The file is created if it does not yet exist.
+	FilePath string `json:"FilePath"`
+	// Passphrase is used to derive the encryption key of the reports in the file.
+	Passphrase string `json:"Passphrase"`
+	// RetentionSec is the maximum age (in seconds) of a report kept in the file.
+	RetentionSec int `json:"RetentionSec"`
+
+	aead cipher.AEAD
+	// index locates the reports in the file, from oldest to latest.
+	index []reportIndexEntry
+	// fileSize is the size of the store file, the next report is appended at this offset.
+	fileSize int64
+	mutex    *sync.Mutex
+}
+
+// IsConfigured returns true only if the file path of the store is present.
+func (store *ReportStore) IsConfigured() bool {
+	return store.FilePath != ""
+}
+
+// Initialise creates the store file if it does not yet exist, indexes its reports, and removes the reports past the retention period.
+func (store *ReportStore) Initialise() error {
+	if store.Passphrase == "" {
+		return errors.New("ReportStore.Initialise: Passphrase must not be empty")
+	}
+	if store.RetentionSec < 1 {
+		store.RetentionSec = DefaultReportStoreRetentionSec
+	}
+	digest := sha256.Sum256([]byte("laitos-report-store:" + store.Passphrase))
+	block, err := aes.NewCipher(digest[:])
+	if err != nil {
+		return fmt.Errorf("ReportStore.Initialise: %w", err)
+	}
+	if store.aead, err = cipher.NewGCM(block); err != nil {
+		return fmt.Errorf("ReportStore.Initialise: %w", err)
+	}
+	store.mutex = new(sync.Mutex)
+	if err := os.MkdirAll(filepath.Dir(store.FilePath), 0700); err != nil {
+		return fmt.Errorf("ReportStore.Initialise: failed to create directory for the store - %w", err)
+	}
+	file, err := os.OpenFile(store.FilePath, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("ReportStore.Initialise: failed to open store file - %w", err)
+	}
+	defer file.Close()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.index = make([]reportIndexEntry, 0)
+	store.fileSize = 0
+	var skipped int
+	reader := bufio.NewReaderSize(file, 64*1024)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			// Read the rest of the long line
+			longLine := append([]byte{}, line...)
+			for errors.Is(err, bufio.ErrBufferFull) && len(longLine) <= ReportStoreMaxLineLen {
+				line, err = reader.ReadSlice('\n')
+				longLine = append(longLine, line...)
+			}
+			line = longLine
+		}
+		if len(line) > 0 {
+			offset := store.fileSize
+			store.fileSize += int64(len(line))
+			if report, decryptErr := store.decrypt(line); decryptErr == nil && line[len(line)-1] == '\n' {
+				store.index = append(store.index, reportIndexEntry{
+					offset:     offset,
+					length:     len(line),
+					hostName:   report.OriginalRequest.SubjectHostName,
+					serverTime: report.ServerTime,
+				})
+			} else {
+				// Skip the report that was not completely written, e.g. due to a power outage.
+				skipped++
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return fmt.Errorf("ReportStore.Initialise: failed to read store file - %w", err)
+		}
+	}
+	if skipped > 0 && len(store.index) == 0 {
+		return fmt.Errorf("ReportStore.Initialise: failed to decrypt any of the reports in \"%s\", is the passphrase correct?", store.FilePath)
+	}
+	// Rewrite the file without the damaged and expired reports
+	if skipped > 0 || store.countExpired() > 0 {
+		if err := store.rewrite(file, func(entry reportIndexEntry) bool { return !store.isExpired(entry.serverTime) }); err != nil {
+			return fmt.Errorf("ReportStore.Initialise: %w", err)
+		}
+	}
+	return nil
+}
+
+// isExpired returns true if the report server time is past the retention period.
+func (store *ReportStore) isExpired(serverTime time.Time) bool {
+	return serverTime.Before(time.Now().Add(-time.Duration(store.RetentionSec) * time.Second))
+}
+
+// countExpired returns the number of reports past the retention period. The caller must hold the mutex.
+func (store *ReportStore) countExpired() (count int) {
+	for _, entry := range store.index {
+		if store.isExpired(entry.serverTime) {
+			count++
+		}
+	}
+	return
+}
+
+// encrypt serialises and encrypts the report into a line of the store file.
+func (store *ReportStore) encrypt(report SubjectReport) ([]byte, error) {
+	plain, err := json.Marshal(report)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialise the report - %w", err)
+	}
+	nonce := make([]byte, store.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to read random nonce - %w", err)
+	}
+	sealed := store.aead.Seal(nonce, nonce, plain, nil)
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(sealed))+1)
+	base64.StdEncoding.Encode(line, sealed)
+	line[len(line)-1] = '\n'
+	return line, nil
+}
+
+// decrypt decrypts and deserialises the report from a line of the store file.
+func (store *ReportStore) decrypt(line []byte) (report SubjectReport, err error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(line)))
+	if err != nil {
+		return
+	}
+	nonceSize := store.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		err = errors.New("the report is too short")
+		return
+	}
+	plain, err := store.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(plain, &report); err != nil {
+		return
+	}
+	// The server time of the original request is not serialised on its own.
+	report.OriginalRequest.ServerTime = report.ServerTime
+	return
+}
+
+// Append writes the report to the end of the store file.
+func (store *ReportStore) Append(report SubjectReport) error {
+	line, err := store.encrypt(report)
+	if err != nil {
+		return fmt.Errorf("ReportStore.Append: %w", err)
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	file, err := os.OpenFile(store.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("ReportStore.Append: failed to open store file - %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(line); err != nil {
+		// Discard the partially written report so that the file continues to match the index.
+		_ = file.Truncate(store.fileSize)
+		return fmt.Errorf("ReportStore.Append: failed to write the report - %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Truncate(store.fileSize)
+		return fmt.Errorf("ReportStore.Append: failed to sync the store file - %w", err)
+	}
+	store.index = append(store.index, reportIndexEntry{
+		offset:     store.fileSize,
+		length:     len(line),
+		hostName:   report.OriginalRequest.SubjectHostName,
+		serverTime: report.ServerTime,
+	})
+	store.fileSize += int64(len(line))
+	return nil
+}
+
+// readEntry reads the report located by the index entry from the store file.
+func (store *ReportStore) readEntry(file *os.File, entry reportIndexEntry) (SubjectReport, error) {
+	line := make([]byte, entry.length)
+	if _, err := file.ReadAt(line, entry.offset); err != nil {
+		return SubjectReport{}, err
+	}
+	return store.decrypt(line)
+}
+
+// HostNames returns the host names of all subjects that have reports in the store, sorted alphabetically.
+func (store *ReportStore) HostNames() []string {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	names := make(map[string]struct{})
+	for _, entry := range store.index {
+		if !store.isExpired(entry.serverTime) {
+			names[entry.hostName] = struct{}{}
+		}
+	}
+	ret := make([]string, 0, len(names))
+	for name := range names {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+/*
+Query returns the reports received between the two timestamps (a zero timestamp means unbounded), optionally from the
+host name alone. The reports are sorted from latest to oldest, there will be up to maxLimit of them.
+*/
+func (store *ReportStore) Query(hostName string, since, until time.Time, maxLimit int) ([]SubjectReport, error) {
+	hostName = strings.ToLower(hostName)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	// Look up the matching reports in the index, and only read those from the file.
+	matched := make([]reportIndexEntry, 0)
+	for i := len(store.index) - 1; i >= 0 && len(matched) < maxLimit; i-- {
+		entry := store.index[i]
+		if hostName != "" && entry.hostName != hostName ||
+			!since.IsZero() && entry.serverTime.Before(since) ||
+			!until.IsZero() && entry.serverTime.After(until) ||
+			store.isExpired(entry.serverTime) {
+			continue
+		}
+		matched = append(matched, entry)
+	}
+	ret := make([]SubjectReport, 0, len(matched))
+	if len(matched) == 0 {
+		return ret, nil
+	}
+	file, err := os.Open(store.FilePath)
+	if err != nil {
+		return nil, fmt.Errorf("ReportStore.Query: failed to open store file - %w", err)
+	}
+	defer file.Close()
+	for _, entry := range matched {
+		report, err := store.readEntry(file, entry)
+		if err != nil {
+			return nil, fmt.Errorf("ReportStore.Query: failed to read report at offset %d - %w", entry.offset, err)
+		}
+		ret = append(ret, report)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].ServerTime.After(ret[j].ServerTime)
+	})
+	return ret, nil
+}
+
+/*
+RemoveExpired removes the reports past the retention period from the store file, and returns the number of reports
+removed. In order to avoid rewriting the file too often, the reports are only removed once they take up a
+considerable fraction of the file; they are excluded from the query results in the meantime.
+*/
+func (store *ReportStore) RemoveExpired() (removed int, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var expiredSize int64
+	for _, entry := range store.index {
+		if store.isExpired(entry.serverTime) {
+			removed++
+			expiredSize += int64(entry.length)
+		}
+	}
+	if removed == 0 || expiredSize*ReportStoreCompactFraction < store.fileSize {
+		return 0, nil
+	}
+	file, err := os.Open(store.FilePath)
+	if err != nil {
+		return 0, fmt.Errorf("ReportStore.RemoveExpired: failed to open store file - %w", err)
+	}
+	defer file.Close()
+	if err := store.rewrite(file, func(entry reportIndexEntry) bool { return !store.isExpired(entry.serverTime) }); err != nil {
+		return 0, fmt.Errorf("ReportStore.RemoveExpired: %w", err)
+	}
+	return removed, nil
+}
+
+// RemoveIf rewrites the store file without the reports for which the function returns true, and returns the number of reports removed.
+func (store *ReportStore) RemoveIf(fun func(SubjectReport) bool) (removed int, err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	file, err := os.Open(store.FilePath)
+	if err != nil {
+		return 0, fmt.Errorf("ReportStore.RemoveIf: failed to open store file - %w", err)
+	}
+	defer file.Close()
+	remove := make(map[int64]struct{})
+	for _, entry := range store.index {
+		report, err := store.readEntry(file, entry)
+		if err != nil {
+			return 0, fmt.Errorf("ReportStore.RemoveIf: failed to read report at offset %d - %w", entry.offset, err)
+		}
+		if fun(report) {
+			remove[entry.offset] = struct{}{}
+		}
+	}
+	if len(remove) == 0 {
+		return 0, nil
+	}
+	if err := store.rewrite(file, func(entry reportIndexEntry) bool {
+		_, removed := remove[entry.offset]
+		return !removed
+	}); err != nil {
+		return 0, fmt.Errorf("ReportStore.RemoveIf: %w", err)
+	}
+	return len(remove), nil
+}
+
+/*
+rewrite copies the (still encrypted) reports to keep from the store file into a temporary file, replaces the store
+file with it, and then updates the index. The caller must hold the mutex.
+*/
+func (store *ReportStore) rewrite(file *os.File, keep func(reportIndexEntry) bool) error {
+	// Write the remaining reports into a temporary file and then replace the store file, so that a crash does not lose the reports.
+	tmpPath := store.FilePath + ".tmp"
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file - %w", err)
+	}
+	writer := bufio.NewWriter(tmpFile)
+	newIndex := make([]reportIndexEntry, 0, len(store.index))
+	var newSize int64
+	for _, entry := range store.index {
+		if !keep(entry) {
+			continue
+		}
+		if _, err = io.Copy(writer, io.NewSectionReader(file, entry.offset, int64(entry.length))); err != nil {
+			break
+		}
+		newEntry := entry
+		newEntry.offset = newSize
+		newIndex = append(newIndex, newEntry)
+		newSize += int64(entry.length)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to write temporary file - %w", err)
+	}
+	if err := os.Rename(tmpPath, store.FilePath); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace store file - %w", err)
+	}
+	store.index = newIndex
+	store.fileSize = newSize
+	return nil
+}
@@ -0,0 +1,142 @@
+package toolbox
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageProcessor_PersistentStore(t *testing.T) {
+	storePath := filepath.Join(t.TempDir(), "reports.dat")
+	require.Error(t, (&ReportStore{FilePath: storePath}).Initialise())
+	// Write an expired report and an incomplete report into the store in advance
+	oldStore := &ReportStore{FilePath: storePath, Passphrase: "pass", RetentionSec: 3 * 3600}
+	require.NoError(t, oldStore.Initialise())
+	require.NoError(t, oldStore.Append(SubjectReport{
+		OriginalRequest:  SubjectReportRequest{SubjectHostName: "old-host"},
+		SubjectClientTag: "old-ip",
+		ServerTime:       time.Now().Add(-2 * time.Hour),
+	}))
+	file, err := os.OpenFile(storePath, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.WriteString("incomplete")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	// The reports cannot be read without the correct passphrase
+	require.Error(t, (&ReportStore{FilePath: storePath, Passphrase: "wrong"}).Initialise())
+
+	proc := &MessageProcessor{MaxReportsPerHostName: 2, PersistentStore: ReportStore{FilePath: storePath, Passphrase: "pass", RetentionSec: 3600}}
+	require.NoError(t, proc.Initialise())
+	require.Empty(t, proc.GetLatestReports(100))
+	for _, host := range []string{"host1", "host1", "host1", "HOST2"} {
+		proc.StoreReport(context.Background(), SubjectReportRequest{SubjectHostName: host, SubjectIP: host + "-ip"}, "client-"+host, "daemon")
+	}
+	require.Equal(t, map[string]int{"host1": 2, "host2": 1}, proc.GetSubjectReportCount())
+	// The reports are encrypted in the store
+	content, err := os.ReadFile(storePath)
+	require.NoError(t, err)
+	require.NotContains(t, string(content), "host1")
+	require.NotContains(t, string(content), "incomplete")
+	require.Len(t, strings.Split(strings.TrimSpace(string(content)), "\n"), 4)
+
+	// The store keeps all reports regardless of the maximum number of reports kept in memory
+	reports, err := proc.GetHistoricalReports("host1", time.Time{}, time.Time{}, 100)
+	require.NoError(t, err)
+	require.Len(t, reports, 3)
+	require.False(t, reports[0].ServerTime.Before(reports[2].ServerTime))
+	reports, err = proc.GetHistoricalReports("", time.Now().Add(-time.Minute), time.Now().Add(time.Minute), 2)
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+	require.Equal(t, "host2", reports[0].OriginalRequest.SubjectHostName)
+	reports, err = proc.GetHistoricalReports("", time.Now().Add(time.Minute), time.Time{}, 100)
+	require.NoError(t, err)
+	require.Empty(t, reports)
+
+	// A restarted message processor restores the reports from the store
+	restarted := &MessageProcessor{MaxReportsPerHostName: 2, PersistentStore: ReportStore{FilePath: storePath, Passphrase: "pass", RetentionSec: 3600}}
+	require.NoError(t, restarted.Initialise())
+	require.Equal(t, map[string]int{"host1": 2, "host2": 1}, restarted.GetSubjectReportCount())
+	require.True(t, restarted.HasClientTag("client-HOST2"))
+	latest := restarted.GetLatestReportsFromSubject("host2", 1)
+	require.Len(t, latest, 1)
+	require.Equal(t, "HOST2-ip", latest[0].OriginalRequest.SubjectIP)
+	require.False(t, latest[0].OriginalRequest.ServerTime.IsZero())
+
+	// Purging a client removes its reports from the store too
+	require.Equal(t, 3, restarted.PurgeClient("host1"))
+	reports, err = restarted.GetHistoricalReports("", time.Time{}, time.Time{}, 100)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	require.Equal(t, []string{"host2"}, restarted.PersistentStore.HostNames())
+	restarted = &MessageProcessor{MaxReportsPerHostName: 2, PersistentStore: ReportStore{FilePath: storePath, Passphrase: "pass", RetentionSec: 3600}}
+	require.NoError(t, restarted.Initialise())
+	require.Equal(t, map[string]int{"host2": 1}, restarted.GetSubjectReportCount())
+}
+
+func TestReportStore_RemoveExpired(t *testing.T) {
+	store := &ReportStore{FilePath: filepath.Join(t.TempDir(), "reports.dat"), Passphrase: "pass", RetentionSec: 3600}
+	require.NoError(t, store.Initialise())
+	appendReport := func(hostName string, age time.Duration) {
+		require.NoError(t, store.Append(SubjectReport{OriginalRequest: SubjectReportRequest{SubjectHostName: hostName}, ServerTime: time.Now().Add(-age)}))
+	}
+	appendReport("old", 2*time.Hour)
+	for i := 0; i < 10; i++ {
+		appendReport("new", time.Minute)
+	}
+	// The expired report is excluded from the queries, though it remains in the file until it takes up enough space.
+	reports, err := store.Query("", time.Time{}, time.Time{}, 100)
+	require.NoError(t, err)
+	require.Len(t, reports, 10)
+	removed, err := store.RemoveExpired()
+	require.NoError(t, err)
+	require.Zero(t, removed)
+	for i := 0; i < 3; i++ {
+		appendReport("old", 2*time.Hour)
+	}
+	removed, err = store.RemoveExpired()
+	require.NoError(t, err)
+	require.Equal(t, 4, removed)
+	require.Equal(t, []string{"new"}, store.HostNames())
+	// The index follows the rewritten file
+	reports, err = store.Query("new", time.Time{}, time.Time{}, 3)
+	require.NoError(t, err)
+	require.Len(t, reports, 3)
+	appendReport("new", 0)
+	reports, err = store.Query("NEW", time.Now().Add(-time.Second), time.Time{}, 100)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	info, err := os.Stat(store.FilePath)
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), store.fileSize)
+
+	// A failed write leaves the index and the file size unchanged
+	if _, err := os.Stat("/dev/full"); err == nil {
+		filePath, fileSize, indexLen := store.FilePath, store.fileSize, len(store.index)
+		store.FilePath = "/dev/full"
+		require.Error(t, store.Append(SubjectReport{OriginalRequest: SubjectReportRequest{SubjectHostName: "new"}, ServerTime: time.Now()}))
+		require.Equal(t, fileSize, store.fileSize)
+		require.Len(t, store.index, indexLen)
+		store.FilePath = filePath
+		appendReport("new", 0)
+		reports, err = store.Query("new", time.Now().Add(-time.Second), time.Time{}, 100)
+		require.NoError(t, err)
+		require.Len(t, reports, 2)
+	}
+}
+
+func TestMessageProcessor_GetHistoricalReportsFromMemory(t *testing.T) {
+	proc := &MessageProcessor{}
+	require.NoError(t, proc.Initialise())
+	proc.StoreReport(context.Background(), SubjectReportRequest{SubjectHostName: "host1"}, "ip", "daemon")
+	reports, err := proc.GetHistoricalReports("host1", time.Now().Add(-time.Minute), time.Time{}, 10)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	reports, err = proc.GetHistoricalReports("host1", time.Time{}, time.Now().Add(-time.Minute), 10)
+	require.NoError(t, err)
+	require.Empty(t, reports)
+}
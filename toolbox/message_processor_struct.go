@@ -1,9 +1,13 @@
 package toolbox
 
 import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 	"time"
@@ -101,14 +105,7 @@ SerialiseCompact serialises the request into a compact string.
 The fields carried by the serialised string rank from most important to least important.
 */
 func (req *SubjectReportRequest) SerialiseCompact() string {
-	var serialisedComment string
-	if commentStr, isStr := req.SubjectComment.(string); isStr {
-		serialisedComment = commentStr
-	} else {
-		if commentJSON, err := json.Marshal(req.SubjectComment); err == nil {
-			serialisedComment = string(commentJSON)
-		}
-	}
+	serialisedComment := req.serialiseComment()
 	return fmt.Sprintf("%s%c%s%c%s%c%s%c%s%c%s%c%s%c%d%c%d",
 		// Ordered from most important to least important
 		strings.ToLower(req.SubjectHostName),
@@ -133,6 +130,17 @@ func (req *SubjectReportRequest) SerialiseCompact() string {
 	)
 }
 
+// serialiseComment returns the comment string, or the comment object serialised in JSON.
+func (req *SubjectReportRequest) serialiseComment() string {
+	if commentStr, isStr := req.SubjectComment.(string); isStr {
+		return commentStr
+	}
+	if commentJSON, err := json.Marshal(req.SubjectComment); err == nil {
+		return string(commentJSON)
+	}
+	return ""
+}
+
 // ErrSubjectReportTruncated is returned when a subject report has been truncated during its transport, therefore not all of the fields were decoded successfully.
 // See also "DeserialiseFromCompact".
 var ErrSubjectReportTruncated = errors.New("the subject report request or response appears to have been truncated")
@@ -192,6 +200,123 @@ func (req *SubjectReportRequest) DeserialiseFromCompact(in string) error {
 	return nil
 }
 
+const (
+	// SubjectReportBinaryNumFields is the number of report fields carried by a binary report command.
+	SubjectReportBinaryNumFields = 9
+	// subjectReportBinaryPlain indicates that the body of a binary report command is not compressed.
+	subjectReportBinaryPlain byte = 0
+	// subjectReportBinaryDeflate indicates that the body of a binary report command is compressed by DEFLATE.
+	subjectReportBinaryDeflate byte = 1
+)
+
+/*
+EncodeBinaryReportCommand encodes the app command password and the subject report into a compact binary form, which is
+often less than half the size of the DTMF-encoded compact report when it is transmitted via DNS queries. Only the first
+numFields fields of the report are included, and the fields are ordered from most important to least important in the
+same way as SerialiseCompact.
+See also "DecodeBinaryReportCommand".
+*/
+func EncodeBinaryReportCommand(password string, req SubjectReportRequest, numFields int) []byte {
+	body := appendBinaryString(nil, password)
+	strFields := []string{
+		strings.ToLower(req.SubjectHostName),
+		req.CommandRequest.Command,
+		req.CommandResponse.Command,
+		req.CommandResponse.Result,
+		strings.ToLower(req.SubjectPlatform),
+		req.serialiseComment(),
+		strings.ToLower(req.SubjectIP),
+	}
+	for i, field := range strFields {
+		if i >= numFields {
+			break
+		}
+		body = appendBinaryString(body, field)
+	}
+	if numFields > len(strFields) {
+		body = binary.AppendVarint(body, req.CommandResponse.ReceivedAt.Unix())
+	}
+	if numFields > len(strFields)+1 {
+		body = binary.AppendVarint(body, int64(req.CommandResponse.RunDurationSec))
+	}
+	// Short reports may not benefit from compression
+	var compressed bytes.Buffer
+	if writer, err := flate.NewWriter(&compressed, flate.BestCompression); err == nil {
+		_, _ = writer.Write(body)
+		if err := writer.Close(); err == nil && compressed.Len() < len(body) {
+			return append([]byte{subjectReportBinaryDeflate}, compressed.Bytes()...)
+		}
+	}
+	return append([]byte{subjectReportBinaryPlain}, body...)
+}
+
+// appendBinaryString appends the length of the string followed by the string itself to the buffer.
+func appendBinaryString(buf []byte, str string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(str)))
+	return append(buf, str...)
+}
+
+/*
+DecodeBinaryReportCommand decodes the output of EncodeBinaryReportCommand and returns the equivalent app command in text,
+which invokes the store&forward message processor with the compact report (see SerialiseCompact). If the report was
+encoded with fewer fields, the returned command carries a truncated report.
+*/
+func DecodeBinaryReportCommand(in []byte) (string, error) {
+	if len(in) < 1 {
+		return "", errors.New("DecodeBinaryReportCommand: input is empty")
+	}
+	var body []byte
+	switch in[0] {
+	case subjectReportBinaryPlain:
+		body = in[1:]
+	case subjectReportBinaryDeflate:
+		// The body cannot possibly be larger than the maximum length of an app command
+		reader := flate.NewReader(bytes.NewReader(in[1:]))
+		defer reader.Close()
+		var err error
+		body, err = io.ReadAll(io.LimitReader(reader, MaxCmdLength))
+		if err != nil {
+			return "", fmt.Errorf("DecodeBinaryReportCommand: failed to decompress - %w", err)
+		}
+	default:
+		return "", fmt.Errorf("DecodeBinaryReportCommand: unknown format %d", in[0])
+	}
+	password, body, err := readBinaryString(body)
+	if err != nil || password == "" {
+		return "", errors.New("DecodeBinaryReportCommand: failed to decode password")
+	}
+	fields := make([]string, 0, SubjectReportBinaryNumFields)
+	for i := 0; i < 7 && len(body) > 0; i++ {
+		var field string
+		if field, body, err = readBinaryString(body); err != nil {
+			return "", fmt.Errorf("DecodeBinaryReportCommand: failed to decode field %d", i)
+		}
+		if i == 3 || i == 5 {
+			// Both command result and comment may have multiple lines
+			field = strings.ReplaceAll(field, "\n", string(SubjectReportSerialisedLineSeparator))
+		}
+		fields = append(fields, field)
+	}
+	for i := 0; i < 2 && len(body) > 0; i++ {
+		num, n := binary.Varint(body)
+		if n <= 0 {
+			return "", fmt.Errorf("DecodeBinaryReportCommand: failed to decode field %d", len(fields))
+		}
+		fields = append(fields, strconv.FormatInt(num, 10))
+		body = body[n:]
+	}
+	return password + StoreAndForwardMessageProcessorTrigger + strings.Join(fields, string(SubjectReportSerialisedFieldSeparator)), nil
+}
+
+// readBinaryString reads a string prefixed by its length from the buffer, and returns the remainder of the buffer.
+func readBinaryString(buf []byte) (string, []byte, error) {
+	strLen, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < strLen {
+		return "", nil, errors.New("readBinaryString: string is truncated")
+	}
+	return string(buf[n : n+int(strLen)]), buf[n+int(strLen):], nil
+}
+
 /*
 SubjectReportResponse is a reply made in response to a subject (remote) report. It may embed a command request that this
 message processor (local) would like the subject (remote) to execute, and/or result from app command execution this
@@ -89,3 +89,56 @@ func TestSubjectReportRequest_SerialiseCompact(t *testing.T) {
 	}
 
 }
+
+func TestEncodeBinaryReportCommand(t *testing.T) {
+	req := SubjectReportRequest{
+		SubjectIP:       "123.132.123.123",
+		SubjectHostName: "hzgl-dev-abc.example.com",
+		SubjectPlatform: "windows/amd64",
+		SubjectComment:  "hello there\nsecond line",
+		CommandRequest: AppCommandRequest{
+			Command: "123456098765.s start-computer",
+		},
+		CommandResponse: AppCommandResponse{
+			Command:        "123456098765.s stop-computer",
+			ReceivedAt:     time.Unix(1234567890, 0),
+			Result:         "stopped the computer all right\nsecond line",
+			RunDurationSec: 182,
+		},
+	}
+	// Decode all fields
+	encoded := EncodeBinaryReportCommand("123456098765", req, SubjectReportBinaryNumFields)
+	decoded, err := DecodeBinaryReportCommand(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "123456098765" + StoreAndForwardMessageProcessorTrigger + req.SerialiseCompact(); decoded != want {
+		t.Fatalf("\n%q\n%q", decoded, want)
+	}
+	var deserialised SubjectReportRequest
+	if err := deserialised.DeserialiseFromCompact(strings.TrimPrefix(decoded, "123456098765"+StoreAndForwardMessageProcessorTrigger)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deserialised, req) {
+		t.Fatalf("\n%+v\n%+v\n", deserialised, req)
+	}
+	// Decode fewer fields
+	encoded = EncodeBinaryReportCommand("123456098765", req, 2)
+	decoded, err = DecodeBinaryReportCommand(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deserialised2 SubjectReportRequest
+	if err := deserialised2.DeserialiseFromCompact(strings.TrimPrefix(decoded, "123456098765"+StoreAndForwardMessageProcessorTrigger)); err != ErrSubjectReportTruncated {
+		t.Fatal(err)
+	}
+	if deserialised2.SubjectHostName != "hzgl-dev-abc.example.com" || deserialised2.CommandRequest.Command != "123456098765.s start-computer" || deserialised2.SubjectIP != "" {
+		t.Fatalf("%+v", deserialised2)
+	}
+	// Malformed input
+	for _, malformed := range [][]byte{nil, {9}, {0}, {0, 5, 'a'}, {1, 1, 2, 3}} {
+		if _, err := DecodeBinaryReportCommand(malformed); err == nil {
+			t.Fatalf("did not error on %v", malformed)
+		}
+	}
+}
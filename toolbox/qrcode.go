@@ -0,0 +1,489 @@
+package toolbox
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+)
+
+const (
+	// QRCodeMaxVersion is the largest QR code version (57x57 modules) supported by the encoder.
+	QRCodeMaxVersion = 10
+	// QRCodeQuietZonePNG is the width in modules of the light border around a QR code picture.
+	QRCodeQuietZonePNG = 4
+	// QRCodeQuietZoneText is the width in modules of the light border around a QR code in text, it is narrower to save space.
+	QRCodeQuietZoneText = 2
+)
+
+// qrBlockSpec describes the error correction blocks of a QR code version at error correction level M.
+type qrBlockSpec struct {
+	ecPerBlock                   int
+	numShortBlocks, shortDataLen int
+	numLongBlocks                int
+}
+
+// qrVersionSpecs are the error correction block specifications of versions 1 to 10 at error correction level M.
+var qrVersionSpecs = [QRCodeMaxVersion + 1]qrBlockSpec{
+	{}, // there is no version 0
+	{10, 1, 16, 0},
+	{16, 1, 28, 0},
+	{26, 1, 44, 0},
+	{18, 2, 32, 0},
+	{24, 2, 43, 0},
+	{16, 4, 27, 0},
+	{18, 4, 31, 0},
+	{22, 2, 38, 2},
+	{22, 3, 36, 2},
+	{26, 4, 43, 1},
+}
+
+// qrAlignmentPositions are the row/column coordinates of the alignment pattern centres of versions 1 to 10.
+var qrAlignmentPositions = [QRCodeMaxVersion + 1][]int{
+	{}, {}, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// numDataCodewords returns the number of data codewords of the QR code version.
+func (spec qrBlockSpec) numDataCodewords() int {
+	return spec.numShortBlocks*spec.shortDataLen + spec.numLongBlocks*(spec.shortDataLen+1)
+}
+
+/*
+QRSymbol is a QR code symbol encoded in byte mode with error correction level M (recovers ~15% damage), which is
+sufficient for short text such as a URL or wifi credentials.
+*/
+type QRSymbol struct {
+	// Version determines the size of the symbol, which is 17+4*Version modules on each side.
+	Version int
+	// Modules are the dark (true) and light (false) modules of the symbol, indexed by row and then column.
+	Modules [][]bool
+
+	isFunction [][]bool
+}
+
+// EncodeQRCode encodes the data in the smallest QR code symbol that fits.
+func EncodeQRCode(data []byte) (*QRSymbol, error) {
+	version := 1
+	for ; version <= QRCodeMaxVersion; version++ {
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*qrVersionSpecs[version].numDataCodewords() {
+			break
+		}
+	}
+	if version > QRCodeMaxVersion {
+		return nil, fmt.Errorf("EncodeQRCode: data length %d exceeds the maximum of %d bytes", len(data), (8*qrVersionSpecs[QRCodeMaxVersion].numDataCodewords()-20)/8)
+	}
+	size := 17 + 4*version
+	qr := &QRSymbol{Version: version, Modules: make([][]bool, size), isFunction: make([][]bool, size)}
+	for i := 0; i < size; i++ {
+		qr.Modules[i] = make([]bool, size)
+		qr.isFunction[i] = make([]bool, size)
+	}
+	qr.drawFunctionPatterns()
+	qr.drawCodewords(qr.addErrorCorrection(qr.encodeData(data)))
+	// Choose the mask that results in the lowest penalty
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormatBits(mask)
+		if penalty := qr.getPenalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		// Applying the same mask again undoes it
+		qr.applyMask(mask)
+	}
+	qr.applyMask(bestMask)
+	qr.drawFormatBits(bestMask)
+	qr.isFunction = nil
+	return qr, nil
+}
+
+// size returns the number of modules on each side of the symbol.
+func (qr *QRSymbol) size() int {
+	return len(qr.Modules)
+}
+
+// setFunctionModule sets the colour of a module that belongs to a function pattern, which is not subjected to masking.
+func (qr *QRSymbol) setFunctionModule(x, y int, isDark bool) {
+	qr.Modules[y][x] = isDark
+	qr.isFunction[y][x] = true
+}
+
+// drawFunctionPatterns draws the timing, finder, and alignment patterns, and reserves the areas of format and version information.
+func (qr *QRSymbol) drawFunctionPatterns() {
+	size := qr.size()
+	for i := 0; i < size; i++ {
+		qr.setFunctionModule(6, i, i%2 == 0)
+		qr.setFunctionModule(i, 6, i%2 == 0)
+	}
+	for _, centre := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := centre[0]+dx, centre[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					dist := max(qrAbs(dx), qrAbs(dy))
+					qr.setFunctionModule(x, y, dist != 2 && dist != 4)
+				}
+			}
+		}
+	}
+	positions := qrAlignmentPositions[qr.Version]
+	for i, x := range positions {
+		for j, y := range positions {
+			// Alignment patterns do not overlap the finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == len(positions)-1) || (i == len(positions)-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.setFunctionModule(x+dx, y+dy, max(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// Reserve the format information area, the bits are drawn after choosing the mask.
+	qr.drawFormatBits(0)
+	if qr.Version >= 7 {
+		bits := getQRVersionBits(qr.Version)
+		for i := 0; i < 18; i++ {
+			bit := (bits>>i)&1 == 1
+			a, b := size-11+i%3, i/3
+			qr.setFunctionModule(a, b, bit)
+			qr.setFunctionModule(b, a, bit)
+		}
+	}
+}
+
+// getQRFormatBits returns the 15-bit format information of error correction level M and the mask.
+func getQRFormatBits(mask int) int {
+	// The two bits of error correction level M are 00
+	data := mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// getQRVersionBits returns the 18-bit version information of the version (7 and above).
+func getQRVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+// drawFormatBits draws both copies of the format information of the mask.
+func (qr *QRSymbol) drawFormatBits(mask int) {
+	size := qr.size()
+	bits := getQRFormatBits(mask)
+	bit := func(i int) bool {
+		return (bits>>i)&1 == 1
+	}
+	// The copy around the top left finder pattern
+	for i := 0; i <= 5; i++ {
+		qr.setFunctionModule(8, i, bit(i))
+	}
+	qr.setFunctionModule(8, 7, bit(6))
+	qr.setFunctionModule(8, 8, bit(7))
+	qr.setFunctionModule(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunctionModule(14-i, 8, bit(i))
+	}
+	// The copy split between the top right and bottom left finder patterns
+	for i := 0; i < 8; i++ {
+		qr.setFunctionModule(size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunctionModule(8, size-15+i, bit(i))
+	}
+	// The module is always dark
+	qr.setFunctionModule(8, size-8, true)
+}
+
+// encodeData returns the data codewords of the byte mode segment, completed with terminator and padding.
+func (qr *QRSymbol) encodeData(data []byte) []byte {
+	var bits []bool
+	appendBits := func(val, numBits int) {
+		for i := numBits - 1; i >= 0; i-- {
+			bits = append(bits, (val>>i)&1 == 1)
+		}
+	}
+	// Byte mode indicator
+	appendBits(0x4, 4)
+	if qr.Version >= 10 {
+		appendBits(len(data), 16)
+	} else {
+		appendBits(len(data), 8)
+	}
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	capacityBits := 8 * qrVersionSpecs[qr.Version].numDataCodewords()
+	// Terminator of up to 4 bits and then padding to a byte boundary
+	appendBits(0, min(4, capacityBits-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+	codewords := make([]byte, len(bits)/8, capacityBits/8)
+	for i, bit := range bits {
+		if bit {
+			codewords[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	for pad := byte(0xEC); len(codewords) < capacityBits/8; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+	return codewords
+}
+
+// addErrorCorrection splits the data codewords into blocks, computes their error correction codewords, and interleaves them all.
+func (qr *QRSymbol) addErrorCorrection(data []byte) []byte {
+	spec := qrVersionSpecs[qr.Version]
+	divisor := reedSolomonDivisor(spec.ecPerBlock)
+	var dataBlocks, ecBlocks [][]byte
+	for i, offset := 0, 0; i < spec.numShortBlocks+spec.numLongBlocks; i++ {
+		blockLen := spec.shortDataLen
+		if i >= spec.numShortBlocks {
+			blockLen++
+		}
+		block := data[offset : offset+blockLen]
+		offset += blockLen
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, reedSolomonRemainder(block, divisor))
+	}
+	var ret []byte
+	for i := 0; i <= spec.shortDataLen; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				ret = append(ret, block[i])
+			}
+		}
+	}
+	for i := 0; i < spec.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			ret = append(ret, block[i])
+		}
+	}
+	return ret
+}
+
+// drawCodewords places the codewords in the zig-zag pattern among the modules that do not belong to function patterns.
+func (qr *QRSymbol) drawCodewords(codewords []byte) {
+	size := qr.size()
+	i := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		// Skip the vertical timing pattern
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					// Upward
+					y = size - 1 - vert
+				}
+				if !qr.isFunction[y][x] && i < len(codewords)*8 {
+					qr.Modules[y][x] = (codewords[i/8]>>(7-i%8))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask flips the colour of the modules that do not belong to function patterns according to the mask pattern.
+func (qr *QRSymbol) applyMask(mask int) {
+	size := qr.size()
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !qr.isFunction[y][x] {
+				qr.Modules[y][x] = !qr.Modules[y][x]
+			}
+		}
+	}
+}
+
+// getPenalty returns the penalty score of the symbol, a lower score means the symbol is easier to scan.
+func (qr *QRSymbol) getPenalty() (penalty int) {
+	size := qr.size()
+	finderLike := []string{"10111010000", "00001011101"}
+	var dark int
+	for _, horizontal := range []bool{true, false} {
+		for a := 0; a < size; a++ {
+			var line strings.Builder
+			runLen := 0
+			var runColour bool
+			for b := 0; b < size; b++ {
+				module := qr.Modules[a][b]
+				if !horizontal {
+					module = qr.Modules[b][a]
+				}
+				if module {
+					line.WriteByte('1')
+				} else {
+					line.WriteByte('0')
+				}
+				// Adjacent modules of the same colour
+				if b > 0 && module == runColour {
+					runLen++
+					if runLen == 5 {
+						penalty += 3
+					} else if runLen > 5 {
+						penalty++
+					}
+				} else {
+					runColour = module
+					runLen = 1
+				}
+			}
+			// Patterns that look like the finder pattern
+			for _, pattern := range finderLike {
+				penalty += 40 * strings.Count(line.String(), pattern)
+			}
+		}
+	}
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if qr.Modules[y][x] {
+				dark++
+			}
+			// Blocks of 2x2 modules of the same colour
+			if x < size-1 && y < size-1 {
+				module := qr.Modules[y][x]
+				if module == qr.Modules[y][x+1] && module == qr.Modules[y+1][x] && module == qr.Modules[y+1][x+1] {
+					penalty += 3
+				}
+			}
+		}
+	}
+	// Imbalance of dark and light modules
+	total := size * size
+	penalty += 10 * ((qrAbs(dark*20-total*10)+total-1)/total - 1)
+	return
+}
+
+// reedSolomonMultiply multiplies two elements of GF(2^8) modulo the QR code polynomial 0x11D.
+func reedSolomonMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// reedSolomonDivisor returns the coefficients of the Reed-Solomon generator polynomial of the degree, excluding the leading term.
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	var root byte = 1
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = reedSolomonMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = reedSolomonMultiply(root, 0x02)
+	}
+	return result
+}
+
+// reedSolomonRemainder returns the error correction codewords of the data.
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= reedSolomonMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// PNG returns the symbol in a black and white PNG picture, each module is drawn as a square of the scale in pixels.
+func (qr *QRSymbol) PNG(scale int) ([]byte, error) {
+	size := qr.size() + 2*QRCodeQuietZonePNG
+	img := image.NewPaletted(image.Rect(0, 0, size*scale, size*scale), color.Palette{color.White, color.Black})
+	for y, row := range qr.Modules {
+		for x, isDark := range row {
+			if !isDark {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetColorIndex((x+QRCodeQuietZonePNG)*scale+px, (y+QRCodeQuietZonePNG)*scale+py, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("QRSymbol.PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+Text returns the symbol drawn in plain text, in which each dark module is "##" and each light module is two spaces.
+The text should be displayed in a monospace font with dark characters over light background.
+*/
+func (qr *QRSymbol) Text() string {
+	var out strings.Builder
+	lightRow := strings.Repeat("  ", qr.size()+2*QRCodeQuietZoneText) + "\n"
+	for i := 0; i < QRCodeQuietZoneText; i++ {
+		out.WriteString(lightRow)
+	}
+	for _, row := range qr.Modules {
+		out.WriteString(strings.Repeat("  ", QRCodeQuietZoneText))
+		for _, isDark := range row {
+			if isDark {
+				out.WriteString("##")
+			} else {
+				out.WriteString("  ")
+			}
+		}
+		out.WriteString(strings.Repeat("  ", QRCodeQuietZoneText))
+		out.WriteRune('\n')
+	}
+	for i := 0; i < QRCodeQuietZoneText; i++ {
+		out.WriteString(lightRow)
+	}
+	return out.String()
+}
+
+// qrAbs returns the absolute value of the integer.
+func qrAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,162 @@
+package toolbox
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// decodeQRSymbol reads the data of a byte mode symbol and verifies its error correction codewords.
+func decodeQRSymbol(t *testing.T, symbol *QRSymbol) []byte {
+	size := len(symbol.Modules)
+	require.Equal(t, 17+4*symbol.Version, size)
+	// Read the format information from the copy around the top left finder pattern
+	var formatBits int
+	formatPos := [][2]int{{8, 0}, {8, 1}, {8, 2}, {8, 3}, {8, 4}, {8, 5}, {8, 7}, {8, 8}, {7, 8}, {5, 8}, {4, 8}, {3, 8}, {2, 8}, {1, 8}, {0, 8}}
+	for i, pos := range formatPos {
+		if symbol.Modules[pos[1]][pos[0]] {
+			formatBits |= 1 << i
+		}
+	}
+	formatBits ^= 0x5412
+	require.Equal(t, 0, formatBits>>13, "error correction level must be M")
+	mask := (formatBits >> 10) & 7
+	require.Equal(t, getQRFormatBits(mask), formatBits^0x5412)
+	// Undo the mask
+	unmasked := &QRSymbol{Version: symbol.Version, Modules: make([][]bool, size), isFunction: make([][]bool, size)}
+	for i := range unmasked.Modules {
+		unmasked.Modules[i] = make([]bool, size)
+		unmasked.isFunction[i] = make([]bool, size)
+	}
+	unmasked.drawFunctionPatterns()
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if !unmasked.isFunction[y][x] {
+				unmasked.Modules[y][x] = symbol.Modules[y][x]
+			}
+		}
+	}
+	unmasked.applyMask(mask)
+	// Read the codewords in the zig-zag pattern
+	spec := qrVersionSpecs[symbol.Version]
+	numBlocks := spec.numShortBlocks + spec.numLongBlocks
+	codewords := make([]byte, spec.numDataCodewords()+numBlocks*spec.ecPerBlock)
+	i := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = size - 1 - vert
+				}
+				if !unmasked.isFunction[y][x] && i < len(codewords)*8 {
+					if unmasked.Modules[y][x] {
+						codewords[i/8] |= 1 << (7 - i%8)
+					}
+					i++
+				}
+			}
+		}
+	}
+	// De-interleave the blocks and verify their error correction codewords
+	dataBlocks := make([][]byte, numBlocks)
+	ecBlocks := make([][]byte, numBlocks)
+	pos := 0
+	for i := 0; i <= spec.shortDataLen; i++ {
+		for b := 0; b < numBlocks; b++ {
+			if i < spec.shortDataLen || b >= spec.numShortBlocks {
+				dataBlocks[b] = append(dataBlocks[b], codewords[pos])
+				pos++
+			}
+		}
+	}
+	for i := 0; i < spec.ecPerBlock; i++ {
+		for b := 0; b < numBlocks; b++ {
+			ecBlocks[b] = append(ecBlocks[b], codewords[pos])
+			pos++
+		}
+	}
+	var data []byte
+	for b := 0; b < numBlocks; b++ {
+		require.Equal(t, reedSolomonRemainder(dataBlocks[b], reedSolomonDivisor(spec.ecPerBlock)), ecBlocks[b])
+		data = append(data, dataBlocks[b]...)
+	}
+	// Parse the byte mode segment
+	readBits := func(offset, numBits int) (val int) {
+		for i := offset; i < offset+numBits; i++ {
+			val = val<<1 | int((data[i/8]>>(7-i%8))&1)
+		}
+		return
+	}
+	require.Equal(t, 0x4, readBits(0, 4))
+	countBits := 8
+	if symbol.Version >= 10 {
+		countBits = 16
+	}
+	length := readBits(4, countBits)
+	ret := make([]byte, length)
+	for i := range ret {
+		ret[i] = byte(readBits(4+countBits+8*i, 8))
+	}
+	return ret
+}
+
+func TestReedSolomon(t *testing.T) {
+	// The data and error correction codewords of "HELLO WORLD" in version 1-M, alphanumeric mode.
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	require.Equal(t, []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}, reedSolomonRemainder(data, reedSolomonDivisor(10)))
+}
+
+func TestQRFormatAndVersionBits(t *testing.T) {
+	require.Equal(t, 0b101010000010010, getQRFormatBits(0))
+	require.Equal(t, 0b100010111111001, getQRFormatBits(4))
+	require.Equal(t, 0b100101010100000, getQRFormatBits(7))
+	require.Equal(t, 0x07C94, getQRVersionBits(7))
+	require.Equal(t, 0x0A4D3, getQRVersionBits(10))
+}
+
+func TestEncodeQRCode(t *testing.T) {
+	// Capacity of each version in bytes
+	for version, capacity := range []int{0, 14, 26, 42, 62, 84, 106, 122, 152, 180, 213} {
+		if version == 0 {
+			continue
+		}
+		data := []byte(strings.Repeat("laitos", 40)[:capacity])
+		symbol, err := EncodeQRCode(data)
+		require.NoError(t, err)
+		require.Equal(t, version, symbol.Version)
+		require.Equal(t, data, decodeQRSymbol(t, symbol))
+		if version < QRCodeMaxVersion {
+			symbol, err = EncodeQRCode(append(data, 'x'))
+			require.NoError(t, err)
+			require.Equal(t, version+1, symbol.Version)
+		}
+	}
+	_, err := EncodeQRCode(make([]byte, 214))
+	require.Error(t, err)
+
+	symbol, err := EncodeQRCode([]byte("WIFI:T:WPA;S:laitos;P:secret;;"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("WIFI:T:WPA;S:laitos;P:secret;;"), decodeQRSymbol(t, symbol))
+	// The text drawing has a quiet zone on each side
+	lines := strings.Split(strings.TrimSuffix(symbol.Text(), "\n"), "\n")
+	require.Len(t, lines, 29+2*QRCodeQuietZoneText)
+	require.Equal(t, strings.Repeat(" ", 2*(29+2*QRCodeQuietZoneText)), lines[0])
+	require.Equal(t, "    "+strings.Repeat("##", 7), lines[QRCodeQuietZoneText][:4+14])
+	// The picture is drawn at scale with a quiet zone
+	picture, err := symbol.PNG(3)
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(picture))
+	require.NoError(t, err)
+	require.Equal(t, 3*(29+2*QRCodeQuietZonePNG), img.Bounds().Dx())
+	r, _, _, _ := img.At(0, 0).RGBA()
+	require.EqualValues(t, 0xffff, r)
+	r, _, _, _ = img.At(3*QRCodeQuietZonePNG, 3*QRCodeQuietZonePNG).RGBA()
+	require.EqualValues(t, 0, r)
+}
@@ -0,0 +1,203 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/platform"
+)
+
+const (
+	// TextToSpeechTimeoutSec is the default timeout of synthesising the speech of a text.
+	TextToSpeechTimeoutSec = 10
+	// TextToSpeechMaxTextLen is the maximum length of text to be synthesised, longer text is truncated.
+	TextToSpeechMaxTextLen = 4000
+	// TextToSpeechMaxAudioBytes is the maximum size of synthesised speech audio accepted from a speech API.
+	TextToSpeechMaxAudioBytes = 16 * 1024 * 1024
+	// TextToSpeechDefaultWordsPerMinute is the default speed of speech made by a speech synthesiser program.
+	TextToSpeechDefaultWordsPerMinute = 150
+	// TextToSpeechDefaultAPIModel is the default speech model name sent to the speech API.
+	TextToSpeechDefaultAPIModel = "tts-1"
+	// TextToSpeechDefaultAPIVoice is the default voice name sent to the speech API.
+	TextToSpeechDefaultAPIVoice = "alloy"
+)
+
+// TextToSpeechPrograms are the speech synthesiser programs that may be installed on the computer, in the order of preference.
+var TextToSpeechPrograms = []string{"espeak-ng", "espeak"}
+
+/*
+TextToSpeech synthesises the speech audio of a text. It uses a speech API compatible with OpenAI's "/v1/audio/speech"
+if the API URL is configured, or otherwise a speech synthesiser program (espeak-ng or espeak) installed on the computer.
+*/
+type TextToSpeech struct {
+	// APIURL is the URL of the speech API, e.g. "https://api.openai.com/v1/audio/speech". Leave it empty to use a speech synthesiser program instead.
+	APIURL string `json:"APIURL"`
+	// APIKey is the bearer token that authorises requests made to the speech API.
+	APIKey string `json:"APIKey"`
+	// APIModel is the name of speech model used by the speech API, it defaults to TextToSpeechDefaultAPIModel.
+	APIModel string `json:"APIModel"`
+	// Voice is the voice name of the speech API (e.g. "alloy"), or the voice of the speech synthesiser program (e.g. "en-us"). It defaults to the voice of the locale.
+	Voice string `json:"Voice"`
+	// WordsPerMinute is the speed of speech made by the speech synthesiser program, it defaults to TextToSpeechDefaultWordsPerMinute.
+	WordsPerMinute int `json:"WordsPerMinute"`
+
+	programPath string // programPath is the absolute path to the speech synthesiser program
+}
+
+// Initialise fills in the default values of configuration and looks for the speech synthesiser program.
+func (tts *TextToSpeech) Initialise() error {
+	if tts.APIModel == "" {
+		tts.APIModel = TextToSpeechDefaultAPIModel
+	}
+	if tts.WordsPerMinute < 1 {
+		tts.WordsPerMinute = TextToSpeechDefaultWordsPerMinute
+	}
+	if tts.APIURL != "" {
+		return nil
+	}
+	for _, name := range TextToSpeechPrograms {
+		for _, binPrefix := range []string{"/usr/bin", "/usr/local/bin", "/bin"} {
+			execPath := filepath.Join(binPrefix, name)
+			if _, err := os.Stat(execPath); err == nil {
+				tts.programPath = execPath
+				return nil
+			}
+		}
+		if execPath, err := exec.LookPath(name); err == nil {
+			tts.programPath = execPath
+			return nil
+		}
+	}
+	return fmt.Errorf("TextToSpeech.Initialise: the speech API URL is not configured and none of the speech synthesiser programs %v is installed", TextToSpeechPrograms)
+}
+
+// IsConfigured returns true only if the speech API is configured or a speech synthesiser program has been found.
+func (tts *TextToSpeech) IsConfigured() bool {
+	return tts.APIURL != "" || tts.programPath != ""
+}
+
+// SelfTest synthesises a short speech using the speech synthesiser program. The speech API is not tested to avoid incurring its usage cost.
+func (tts *TextToSpeech) SelfTest() error {
+	if !tts.IsConfigured() {
+		return ErrIncompleteConfig
+	} else if tts.APIURL != "" {
+		return nil
+	}
+	if _, _, err := tts.Synthesise(context.Background(), LocaleEnglish, "self test"); err != nil {
+		return fmt.Errorf("TextToSpeech.SelfTest: %w", err)
+	}
+	return nil
+}
+
+/*
+Synthesise returns the speech audio of the text spoken in the language of the locale, along with the content type of the
+audio - "audio/mpeg" from the speech API or "audio/wav" from the speech synthesiser program.
+*/
+func (tts *TextToSpeech) Synthesise(ctx context.Context, locale, text string) (audio []byte, contentType string, err error) {
+	if !tts.IsConfigured() {
+		return nil, "", ErrIncompleteConfig
+	}
+	if text = strings.TrimSpace(text); text == "" {
+		return nil, "", errors.New("TextToSpeech.Synthesise: the text is empty")
+	}
+	if len(text) > TextToSpeechMaxTextLen {
+		text = text[:TextToSpeechMaxTextLen]
+	}
+	timeoutSec := TextToSpeechTimeoutSec
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		if timeoutSec = int(time.Until(deadline) / time.Second); timeoutSec < 1 {
+			return nil, "", fmt.Errorf("TextToSpeech.Synthesise: insufficient time left - %w", context.DeadlineExceeded)
+		}
+	}
+	if tts.APIURL != "" {
+		audio, err = tts.synthesiseByAPI(ctx, timeoutSec, text)
+		return audio, "audio/mpeg", err
+	}
+	audio, err = tts.synthesiseByProgram(timeoutSec, locale, text)
+	return audio, "audio/wav", err
+}
+
+// synthesiseByAPI asks the speech API to synthesise the speech of the text in MP3 format.
+func (tts *TextToSpeech) synthesiseByAPI(ctx context.Context, timeoutSec int, text string) ([]byte, error) {
+	voice := tts.Voice
+	if voice == "" {
+		voice = TextToSpeechDefaultAPIVoice
+	}
+	reqBody, err := json.Marshal(map[string]string{
+		"model":           tts.APIModel,
+		"input":           text,
+		"voice":           voice,
+		"response_format": "mp3",
+	})
+	if err != nil {
+		return nil, err
+	}
+	req := inet.HTTPRequest{
+		TimeoutSec:          timeoutSec,
+		Method:              http.MethodPost,
+		ContentType:         "application/json",
+		Body:                bytes.NewReader(reqBody),
+		MaxBytes:            TextToSpeechMaxAudioBytes,
+		RejectLargeResponse: true,
+		MaxRetry:            1,
+	}
+	if tts.APIKey != "" {
+		req.Header = http.Header{"Authorization": {"Bearer " + tts.APIKey}}
+	}
+	resp, err := inet.DoHTTP(ctx, req, strings.ReplaceAll(tts.APIURL, "%", "%%"))
+	if err != nil {
+		return nil, fmt.Errorf("TextToSpeech.synthesiseByAPI: %w", err)
+	} else if err := resp.Non2xxToError(); err != nil {
+		return nil, fmt.Errorf("TextToSpeech.synthesiseByAPI: %w", err)
+	} else if len(resp.Body) == 0 {
+		return nil, errors.New("TextToSpeech.synthesiseByAPI: the speech API responded with an empty audio")
+	}
+	return resp.Body, nil
+}
+
+// synthesiseByProgram runs the speech synthesiser program to synthesise the speech of the text in WAV format.
+func (tts *TextToSpeech) synthesiseByProgram(timeoutSec int, locale, text string) ([]byte, error) {
+	voice := tts.Voice
+	if voice == "" {
+		// The program knows English voices by their region (e.g. "en-us"), and most other voices by their language alone (e.g. "de").
+		voice = strings.ToLower(Translate(locale, TextSpeechLanguage))
+		if !strings.HasPrefix(voice, "en") {
+			voice, _, _ = strings.Cut(voice, "-")
+		}
+	}
+	workDir, err := os.MkdirTemp("", "laitos-TextToSpeech")
+	if err != nil {
+		return nil, fmt.Errorf("TextToSpeech.synthesiseByProgram: failed to create temporary directory - %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(workDir)
+	}()
+	// The text is given to the program in a file to prevent it from being mistaken as command line flags
+	textPath, audioPath := filepath.Join(workDir, "speech.txt"), filepath.Join(workDir, "speech.wav")
+	if err := os.WriteFile(textPath, []byte(text), 0600); err != nil {
+		return nil, fmt.Errorf("TextToSpeech.synthesiseByProgram: failed to write text file - %w", err)
+	}
+	out, err := platform.InvokeProgram(nil, timeoutSec, tts.programPath,
+		"-v", voice, "-s", strconv.Itoa(tts.WordsPerMinute), "-f", textPath, "-w", audioPath)
+	if err != nil {
+		return nil, fmt.Errorf("TextToSpeech.synthesiseByProgram: %w - %s", err, strings.TrimSpace(out))
+	}
+	audio, err := os.ReadFile(audioPath)
+	if err != nil {
+		return nil, fmt.Errorf("TextToSpeech.synthesiseByProgram: failed to read the synthesised audio - %w", err)
+	} else if len(audio) == 0 {
+		return nil, fmt.Errorf("TextToSpeech.synthesiseByProgram: the program did not synthesise any audio - %s", strings.TrimSpace(out))
+	}
+	return audio, nil
+}
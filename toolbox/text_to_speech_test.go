@@ -0,0 +1,62 @@
+package toolbox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTextToSpeech_API(t *testing.T) {
+	var reqBody map[string]string
+	var authHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &reqBody)
+		authHeader = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte("mp3 audio"))
+	}))
+	defer server.Close()
+
+	tts := TextToSpeech{}
+	require.False(t, tts.IsConfigured())
+	_, _, err := tts.Synthesise(context.Background(), LocaleEnglish, "hello")
+	require.ErrorIs(t, err, ErrIncompleteConfig)
+
+	tts = TextToSpeech{APIURL: server.URL, APIKey: "key"}
+	require.NoError(t, tts.Initialise())
+	require.True(t, tts.IsConfigured())
+	require.NoError(t, tts.SelfTest())
+	_, _, err = tts.Synthesise(context.Background(), LocaleEnglish, "  ")
+	require.Error(t, err)
+
+	audio, contentType, err := tts.Synthesise(context.Background(), LocaleEnglish, " hello world ")
+	require.NoError(t, err)
+	require.Equal(t, "mp3 audio", string(audio))
+	require.Equal(t, "audio/mpeg", contentType)
+	require.Equal(t, "Bearer key", authHeader)
+	require.Equal(t, map[string]string{"model": TextToSpeechDefaultAPIModel, "input": "hello world", "voice": TextToSpeechDefaultAPIVoice, "response_format": "mp3"}, reqBody)
+
+	// The synthesis does not begin if the deadline has passed
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, _, err = tts.Synthesise(ctx, LocaleEnglish, "hello")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestTextToSpeech_Program(t *testing.T) {
+	tts := TextToSpeech{}
+	if err := tts.Initialise(); err != nil {
+		t.Skip("speech synthesiser program is not installed")
+	}
+	require.NoError(t, tts.SelfTest())
+	audio, contentType, err := tts.Synthesise(context.Background(), LocaleGerman, "guten Tag")
+	require.NoError(t, err)
+	require.Equal(t, "audio/wav", contentType)
+	require.Equal(t, "RIFF", string(audio[:4]))
+}